@@ -0,0 +1,78 @@
+/**
+ * @file agsys_cbor.h
+ * @brief Minimal CBOR codec for extensible LoRa payloads
+ * 
+ * Payloads flagged with AGSYS_VERSION_FLAG_CBOR are a CBOR map from field
+ * numbers to values, so fields can be added without breaking devices built
+ * against an older layout. Readers look fields up by number and ignore the
+ * rest.
+ * 
+ * Only the subset shared with the property controller is supported: definite
+ * lengths, unsigned integer keys, and integer, float, bool, byte string, and
+ * text string values (no nesting, no tags). CBOR is big-endian, unlike the
+ * fixed payloads.
+ * 
+ * Write keys in ascending order so encodings are canonical and match the
+ * controller's byte for byte.
+ */
+
+#ifndef AGSYS_CBOR_H
+#define AGSYS_CBOR_H
+
+#include "agsys_common.h"
+
+/* ==========================================================================
+ * WRITER
+ * ========================================================================== */
+
+typedef struct {
+    uint8_t    *buf;
+    size_t      size;
+    size_t      len;
+    bool        overflow;   /* Set once a write did not fit */
+} agsys_cbor_writer_t;
+
+/**
+ * @brief Start writing a map of count fields into buf
+ */
+void agsys_cbor_writer_init(agsys_cbor_writer_t *w, uint8_t *buf, size_t size,
+                            size_t count);
+
+void agsys_cbor_put_uint(agsys_cbor_writer_t *w, uint32_t key, uint64_t value);
+void agsys_cbor_put_int(agsys_cbor_writer_t *w, uint32_t key, int64_t value);
+void agsys_cbor_put_float(agsys_cbor_writer_t *w, uint32_t key, float value);
+void agsys_cbor_put_bool(agsys_cbor_writer_t *w, uint32_t key, bool value);
+void agsys_cbor_put_bytes(agsys_cbor_writer_t *w, uint32_t key,
+                          const uint8_t *data, size_t len);
+void agsys_cbor_put_text(agsys_cbor_writer_t *w, uint32_t key, const char *text);
+
+/**
+ * @brief Finish writing
+ * 
+ * @param w             Writer
+ * @param out_len       Output: encoded length
+ * @return AGSYS_OK on success, AGSYS_ERR_NO_MEMORY if the buffer was too small
+ */
+agsys_err_t agsys_cbor_writer_finish(const agsys_cbor_writer_t *w, size_t *out_len);
+
+/* ==========================================================================
+ * READER
+ * 
+ * Each getter returns false if the field is missing, has another type, or
+ * the payload is malformed.
+ * ========================================================================== */
+
+bool agsys_cbor_get_uint(const uint8_t *buf, size_t len, uint32_t key, uint64_t *value);
+bool agsys_cbor_get_int(const uint8_t *buf, size_t len, uint32_t key, int64_t *value);
+bool agsys_cbor_get_float(const uint8_t *buf, size_t len, uint32_t key, float *value);
+bool agsys_cbor_get_bool(const uint8_t *buf, size_t len, uint32_t key, bool *value);
+
+/**
+ * @brief Get a byte or text string field, pointing into buf
+ * 
+ * Text strings are not NUL terminated.
+ */
+bool agsys_cbor_get_bytes(const uint8_t *buf, size_t len, uint32_t key,
+                          const uint8_t **data, size_t *data_len);
+
+#endif /* AGSYS_CBOR_H */
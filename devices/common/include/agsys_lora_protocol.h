@@ -38,9 +38,19 @@ extern "C" {
  * ========================================================================== */
 
 #define AGSYS_PROTOCOL_VERSION      1
+#define AGSYS_PROTOCOL_VERSION_CRC  2       /* First version with a frame CRC */
 #define AGSYS_MAGIC_BYTE1           0x41    /* 'A' */
 #define AGSYS_MAGIC_BYTE2           0x47    /* 'G' */
 
+/* Version 2+ frames end with a CRC-16/CCITT-FALSE (little-endian) over
+ * header + payload, inside the encryption */
+#define AGSYS_FRAME_CRC_SIZE        2
+
+/* Set in the version byte when the payload is a CBOR map (see agsys_cbor.h)
+ * rather than a fixed struct */
+#define AGSYS_VERSION_FLAG_CBOR     0x80
+#define AGSYS_VERSION_MASK          0x7F
+
 /* ==========================================================================
  * DEVICE TYPES (may be defined elsewhere, use guards)
  * ========================================================================== */
@@ -105,6 +115,10 @@ extern "C" {
 #define AGSYS_MSG_OTA_REQUEST           0xE3  /* Device requests OTA after seeing OTA_PENDING */
 #define AGSYS_MSG_OTA_READY             0xE4  /* Device ready to receive chunks */
 #define AGSYS_MSG_OTA_FINISH            0xE5  /* Controller signals OTA complete */
+#define AGSYS_MSG_OTA_BITMAP            0xE6  /* Device reports chunks received in a window */
+#define AGSYS_MSG_OTA_SESSION           0xE7  /* Controller announces a multicast session (broadcast) */
+#define AGSYS_MSG_OTA_JOIN              0xE8  /* Device joins a multicast session */
+#define AGSYS_MSG_OTA_MCAST_CHUNK       0xE9  /* Controller broadcasts a session chunk */
 
 /* ==========================================================================
  * PACKET HEADER (15 bytes on wire)
@@ -276,6 +290,14 @@ typedef struct __attribute__((packed)) {
 #define AGSYS_ACK_FLAG_TIME_SYNC        (1 << 2)
 #define AGSYS_ACK_FLAG_OTA_PENDING      (1 << 3)  /* OTA update available, device should stay awake */
 
+/* NACK error codes (status field of a NACK) */
+#define AGSYS_NACK_ERR_INVALID_PAYLOAD  0x01  /* Payload too short or malformed */
+#define AGSYS_NACK_ERR_UNSUPPORTED      0x02  /* Message type not supported */
+#define AGSYS_NACK_ERR_INVALID_PARAM    0x03  /* Parameter out of range */
+#define AGSYS_NACK_ERR_BUSY             0x04  /* Busy, message may be resent */
+#define AGSYS_NACK_ERR_HARDWARE         0x05  /* Hardware fault carrying out the command */
+#define AGSYS_NACK_ERR_DECRYPT          0x06  /* Decryption or authentication failed */
+
 /* Time Sync (AGSYS_MSG_TIME_SYNC) */
 typedef struct __attribute__((packed)) {
     uint32_t    unix_timestamp;     /* Current Unix timestamp */
@@ -323,12 +345,17 @@ typedef struct __attribute__((packed)) {
 } agsys_ota_announce_t;
 
 /* OTA Request - Device requests OTA after seeing OTA_PENDING flag (AGSYS_MSG_OTA_REQUEST) */
+#define AGSYS_OTA_CAP_WINDOWED          (1 << 0)  /* Buffers out-of-order chunks, sends OTA_BITMAP */
+#define AGSYS_OTA_MAX_WINDOW            64        /* Most chunks one bitmap covers */
+
 typedef struct __attribute__((packed)) {
     uint8_t     current_major;      /* Current firmware version */
     uint8_t     current_minor;
     uint8_t     current_patch;
     uint8_t     hw_revision;        /* Device hardware revision */
-    uint8_t     reserved[4];
+    uint8_t     capabilities;       /* AGSYS_OTA_CAP_* (0 in older firmware) */
+    uint8_t     max_window;         /* Chunks the device can buffer, 0 for controller default */
+    uint8_t     reserved[2];
 } agsys_ota_request_t;
 
 /* OTA Ready - Device confirms ready to receive chunks (AGSYS_MSG_OTA_READY) */
@@ -344,6 +371,54 @@ typedef struct __attribute__((packed)) {
     uint8_t     data[];             /* Chunk data (variable length) */
 } agsys_ota_chunk_t;
 
+/* OTA Bitmap - Device reports received chunks in a windowed transfer (AGSYS_MSG_OTA_BITMAP).
+ * Bit i, LSB first, is chunk base_chunk + i. base_chunk is the first chunk
+ * still missing, so all earlier chunks are implied received. Sent after the
+ * last chunk of a window arrives, or of a multicast broadcast; the controller
+ * retransmits the gaps with the next window. */
+typedef struct __attribute__((packed)) {
+    uint16_t    base_chunk;         /* First chunk covered */
+    uint8_t     chunk_count;        /* Chunks covered (max AGSYS_OTA_MAX_WINDOW) */
+    uint8_t     bitmap[];           /* (chunk_count + 7) / 8 bytes */
+} agsys_ota_bitmap_t;
+
+/* OTA Session - Controller announces a multicast update to every device of a
+ * type (AGSYS_MSG_OTA_SESSION). Devices that want it reply with OTA_JOIN
+ * within listen_sec, then stay in receive for chunks broadcast every
+ * chunk_interval_ms. */
+typedef struct __attribute__((packed)) {
+    uint8_t     session_id;
+    uint8_t     device_type;        /* Only devices of this type join */
+    uint8_t     version_major;      /* Target firmware version */
+    uint8_t     version_minor;
+    uint8_t     version_patch;
+    uint8_t     hw_revision_min;    /* Minimum compatible hardware revision */
+    uint32_t    firmware_size;
+    uint16_t    chunk_count;
+    uint16_t    chunk_size;
+    uint32_t    firmware_crc;
+    uint16_t    listen_sec;         /* Seconds until the first chunk */
+    uint16_t    chunk_interval_ms;  /* Time between broadcast chunks */
+} agsys_ota_session_t;
+
+/* OTA Join - Device joins a multicast session (AGSYS_MSG_OTA_JOIN) */
+typedef struct __attribute__((packed)) {
+    uint8_t     session_id;
+    uint8_t     current_major;      /* Current firmware version */
+    uint8_t     current_minor;
+    uint8_t     current_patch;
+    uint8_t     hw_revision;
+    uint8_t     max_window;         /* Chunks buffered for repairs, 0 for controller default */
+} agsys_ota_join_t;
+
+/* OTA Multicast Chunk - Controller broadcasts a session chunk (AGSYS_MSG_OTA_MCAST_CHUNK) */
+typedef struct __attribute__((packed)) {
+    uint8_t     session_id;
+    uint16_t    chunk_index;
+    uint16_t    chunk_size;
+    uint8_t     data[];
+} agsys_ota_mcast_chunk_t;
+
 /* OTA Finish - Controller signals all chunks sent (AGSYS_MSG_OTA_FINISH) */
 typedef struct __attribute__((packed)) {
     uint32_t    firmware_crc;       /* CRC32 for final verification */
@@ -59,6 +59,15 @@ agsys_err_t agsys_protocol_encode(const agsys_header_t *header,
                                    uint8_t *out_buf,
                                    size_t *out_len);
 
+/**
+ * @brief Compute the frame CRC (CRC-16/CCITT-FALSE)
+ * 
+ * @param data          Header and payload
+ * @param len           Data length
+ * @return CRC of the data
+ */
+uint16_t agsys_protocol_crc16(const uint8_t *data, size_t len);
+
 /**
  * @brief Decode a received message
  * 
@@ -0,0 +1,310 @@
+/**
+ * @file agsys_cbor.c
+ * @brief Minimal CBOR codec for extensible LoRa payloads
+ */
+
+#include "agsys_cbor.h"
+
+/* ==========================================================================
+ * CONSTANTS
+ * ========================================================================== */
+
+#define CBOR_MAJOR_UINT     0
+#define CBOR_MAJOR_NEGINT   1
+#define CBOR_MAJOR_BYTES    2
+#define CBOR_MAJOR_TEXT     3
+#define CBOR_MAJOR_MAP      5
+#define CBOR_MAJOR_SIMPLE   7
+
+#define CBOR_FALSE          20
+#define CBOR_TRUE           21
+#define CBOR_FLOAT16        25
+#define CBOR_FLOAT32        26
+
+/* ==========================================================================
+ * WRITER
+ * ========================================================================== */
+
+static void put_raw(agsys_cbor_writer_t *w, const uint8_t *data, size_t len)
+{
+    if (w->overflow || w->size - w->len < len) {
+        w->overflow = true;
+        return;
+    }
+    memcpy(w->buf + w->len, data, len);
+    w->len += len;
+}
+
+/* Write an item head in its shortest form */
+static void put_head(agsys_cbor_writer_t *w, uint8_t major, uint64_t n)
+{
+    uint8_t head[9];
+    size_t size;
+
+    if (n < 24) {
+        head[0] = (uint8_t)(major << 5 | n);
+        size = 1;
+    } else if (n <= 0xFF) {
+        head[0] = (uint8_t)(major << 5 | 24);
+        size = 2;
+    } else if (n <= 0xFFFF) {
+        head[0] = (uint8_t)(major << 5 | 25);
+        size = 3;
+    } else if (n <= 0xFFFFFFFF) {
+        head[0] = (uint8_t)(major << 5 | 26);
+        size = 5;
+    } else {
+        head[0] = (uint8_t)(major << 5 | 27);
+        size = 9;
+    }
+
+    for (size_t i = size - 1; i > 0; i--) {
+        head[i] = (uint8_t)(n & 0xFF);
+        n >>= 8;
+    }
+    put_raw(w, head, size);
+}
+
+void agsys_cbor_writer_init(agsys_cbor_writer_t *w, uint8_t *buf, size_t size,
+                            size_t count)
+{
+    w->buf = buf;
+    w->size = size;
+    w->len = 0;
+    w->overflow = false;
+    put_head(w, CBOR_MAJOR_MAP, count);
+}
+
+void agsys_cbor_put_uint(agsys_cbor_writer_t *w, uint32_t key, uint64_t value)
+{
+    put_head(w, CBOR_MAJOR_UINT, key);
+    put_head(w, CBOR_MAJOR_UINT, value);
+}
+
+void agsys_cbor_put_int(agsys_cbor_writer_t *w, uint32_t key, int64_t value)
+{
+    put_head(w, CBOR_MAJOR_UINT, key);
+    if (value >= 0) {
+        put_head(w, CBOR_MAJOR_UINT, (uint64_t)value);
+    } else {
+        put_head(w, CBOR_MAJOR_NEGINT, (uint64_t)(-1 - value));
+    }
+}
+
+void agsys_cbor_put_float(agsys_cbor_writer_t *w, uint32_t key, float value)
+{
+    uint32_t bits;
+    memcpy(&bits, &value, sizeof(bits));
+
+    uint8_t item[5] = {
+        CBOR_MAJOR_SIMPLE << 5 | CBOR_FLOAT32,
+        (uint8_t)(bits >> 24), (uint8_t)(bits >> 16),
+        (uint8_t)(bits >> 8), (uint8_t)bits,
+    };
+    put_head(w, CBOR_MAJOR_UINT, key);
+    put_raw(w, item, sizeof(item));
+}
+
+void agsys_cbor_put_bool(agsys_cbor_writer_t *w, uint32_t key, bool value)
+{
+    uint8_t item = CBOR_MAJOR_SIMPLE << 5 | (value ? CBOR_TRUE : CBOR_FALSE);
+    put_head(w, CBOR_MAJOR_UINT, key);
+    put_raw(w, &item, 1);
+}
+
+void agsys_cbor_put_bytes(agsys_cbor_writer_t *w, uint32_t key,
+                          const uint8_t *data, size_t len)
+{
+    put_head(w, CBOR_MAJOR_UINT, key);
+    put_head(w, CBOR_MAJOR_BYTES, len);
+    put_raw(w, data, len);
+}
+
+void agsys_cbor_put_text(agsys_cbor_writer_t *w, uint32_t key, const char *text)
+{
+    size_t len = strlen(text);
+    put_head(w, CBOR_MAJOR_UINT, key);
+    put_head(w, CBOR_MAJOR_TEXT, len);
+    put_raw(w, (const uint8_t *)text, len);
+}
+
+agsys_err_t agsys_cbor_writer_finish(const agsys_cbor_writer_t *w, size_t *out_len)
+{
+    if (w->overflow) {
+        return AGSYS_ERR_NO_MEMORY;
+    }
+    *out_len = w->len;
+    return AGSYS_OK;
+}
+
+/* ==========================================================================
+ * READER
+ * ========================================================================== */
+
+typedef struct {
+    uint8_t         major;
+    uint8_t         info;       /* Additional info, tells simple values apart */
+    uint64_t        arg;        /* Value, length, or raw float bits */
+    const uint8_t  *data;       /* String contents */
+} cbor_item_t;
+
+/* Read an item at *pos, advancing past its head and any string contents */
+static bool read_item(const uint8_t *buf, size_t len, size_t *pos, cbor_item_t *item)
+{
+    if (*pos >= len) {
+        return false;
+    }
+    uint8_t b = buf[(*pos)++];
+    item->major = b >> 5;
+    item->info = b & 0x1F;
+    item->arg = item->info;
+    item->data = NULL;
+
+    if (item->info > 27) {
+        return false;   /* Indefinite lengths are not supported */
+    }
+    if (item->info >= 24) {
+        size_t size = (size_t)1 << (item->info - 24);
+        if (len - *pos < size) {
+            return false;
+        }
+        item->arg = 0;
+        for (size_t i = 0; i < size; i++) {
+            item->arg = item->arg << 8 | buf[(*pos)++];
+        }
+    }
+
+    if (item->major == CBOR_MAJOR_BYTES || item->major == CBOR_MAJOR_TEXT) {
+        if (len - *pos < item->arg) {
+            return false;
+        }
+        item->data = buf + *pos;
+        *pos += (size_t)item->arg;
+    }
+    return true;
+}
+
+/* Find the value of a field */
+static bool find(const uint8_t *buf, size_t len, uint32_t key, cbor_item_t *value)
+{
+    size_t pos = 0;
+    cbor_item_t map;
+    if (!read_item(buf, len, &pos, &map) || map.major != CBOR_MAJOR_MAP) {
+        return false;
+    }
+
+    for (uint64_t i = 0; i < map.arg; i++) {
+        cbor_item_t k;
+        if (!read_item(buf, len, &pos, &k) || k.major != CBOR_MAJOR_UINT) {
+            return false;
+        }
+        if (!read_item(buf, len, &pos, value)) {
+            return false;
+        }
+        /* Arrays, maps, and tags would need their contents skipped */
+        if (value->major == 4 || value->major == CBOR_MAJOR_MAP || value->major == 6) {
+            return false;
+        }
+        if (k.arg == key) {
+            return true;
+        }
+    }
+    return false;
+}
+
+/* Widen an IEEE 754 half precision float */
+static float half_to_float(uint16_t h)
+{
+    uint32_t sign = (uint32_t)(h >> 15) << 31;
+    uint32_t exp = (h >> 10) & 0x1F;
+    uint32_t frac = h & 0x3FF;
+    uint32_t bits;
+    float f;
+
+    if (exp == 0) {
+        f = (float)frac / (float)(1 << 24);
+        return sign ? -f : f;
+    }
+    if (exp == 0x1F) {
+        bits = sign | 0xFFu << 23 | frac << 13;
+    } else {
+        bits = sign | (exp + 127 - 15) << 23 | frac << 13;
+    }
+    memcpy(&f, &bits, sizeof(f));
+    return f;
+}
+
+bool agsys_cbor_get_uint(const uint8_t *buf, size_t len, uint32_t key, uint64_t *value)
+{
+    cbor_item_t item;
+    if (!find(buf, len, key, &item) || item.major != CBOR_MAJOR_UINT) {
+        return false;
+    }
+    *value = item.arg;
+    return true;
+}
+
+bool agsys_cbor_get_int(const uint8_t *buf, size_t len, uint32_t key, int64_t *value)
+{
+    cbor_item_t item;
+    if (!find(buf, len, key, &item) || item.arg > INT64_MAX) {
+        return false;
+    }
+    if (item.major == CBOR_MAJOR_UINT) {
+        *value = (int64_t)item.arg;
+    } else if (item.major == CBOR_MAJOR_NEGINT) {
+        *value = -1 - (int64_t)item.arg;
+    } else {
+        return false;
+    }
+    return true;
+}
+
+bool agsys_cbor_get_float(const uint8_t *buf, size_t len, uint32_t key, float *value)
+{
+    cbor_item_t item;
+    if (!find(buf, len, key, &item) || item.major != CBOR_MAJOR_SIMPLE) {
+        return false;
+    }
+    if (item.info == CBOR_FLOAT16) {
+        *value = half_to_float((uint16_t)item.arg);
+    } else if (item.info == CBOR_FLOAT32) {
+        uint32_t bits = (uint32_t)item.arg;
+        memcpy(value, &bits, sizeof(*value));
+    } else if (item.info == 27) {
+        double d;
+        memcpy(&d, &item.arg, sizeof(d));
+        *value = (float)d;
+    } else {
+        return false;
+    }
+    return true;
+}
+
+bool agsys_cbor_get_bool(const uint8_t *buf, size_t len, uint32_t key, bool *value)
+{
+    cbor_item_t item;
+    if (!find(buf, len, key, &item) || item.major != CBOR_MAJOR_SIMPLE) {
+        return false;
+    }
+    if (item.info != CBOR_FALSE && item.info != CBOR_TRUE) {
+        return false;
+    }
+    *value = item.info == CBOR_TRUE;
+    return true;
+}
+
+bool agsys_cbor_get_bytes(const uint8_t *buf, size_t len, uint32_t key,
+                          const uint8_t **data, size_t *data_len)
+{
+    cbor_item_t item;
+    if (!find(buf, len, key, &item)) {
+        return false;
+    }
+    if (item.major != CBOR_MAJOR_BYTES && item.major != CBOR_MAJOR_TEXT) {
+        return false;
+    }
+    *data = item.data;
+    *data_len = (size_t)item.arg;
+    return true;
+}
@@ -18,6 +18,27 @@ static uint16_t get_next_seq_num(void)
     return m_seq_num++;
 }
 
+/* ==========================================================================
+ * FRAME CRC
+ * ========================================================================== */
+
+uint16_t agsys_protocol_crc16(const uint8_t *data, size_t len)
+{
+    uint16_t crc = 0xFFFF;
+
+    for (size_t i = 0; i < len; i++) {
+        crc ^= (uint16_t)data[i] << 8;
+        for (int j = 0; j < 8; j++) {
+            if (crc & 0x8000) {
+                crc = (crc << 1) ^ 0x1021;
+            } else {
+                crc <<= 1;
+            }
+        }
+    }
+    return crc;
+}
+
 /* ==========================================================================
  * ENCODING / DECODING
  * ========================================================================== */
@@ -44,8 +65,8 @@ agsys_err_t agsys_protocol_encode(const agsys_msg_header_t *header,
         return AGSYS_ERR_NOT_INITIALIZED;
     }
 
-    /* Build plaintext: header + payload */
-    uint8_t plaintext[AGSYS_MSG_HEADER_SIZE + AGSYS_MAX_PAYLOAD_SIZE];
+    /* Build plaintext: header + payload (+ CRC) */
+    uint8_t plaintext[AGSYS_MSG_HEADER_SIZE + AGSYS_MAX_PAYLOAD_SIZE + AGSYS_FRAME_CRC_SIZE];
     size_t plaintext_len = AGSYS_MSG_HEADER_SIZE + payload_len;
 
     /* Copy header (with updated seq_num if zero) */
@@ -60,6 +81,13 @@ agsys_err_t agsys_protocol_encode(const agsys_msg_header_t *header,
         memcpy(plaintext + AGSYS_MSG_HEADER_SIZE, payload, payload_len);
     }
 
+    /* Append frame CRC for versions that carry one */
+    if ((hdr.version & AGSYS_VERSION_MASK) >= AGSYS_PROTOCOL_VERSION_CRC) {
+        uint16_t crc = agsys_protocol_crc16(plaintext, plaintext_len);
+        plaintext[plaintext_len++] = (uint8_t)(crc & 0xFF);
+        plaintext[plaintext_len++] = (uint8_t)(crc >> 8);
+    }
+
     /* Generate IV */
     uint8_t iv[AGSYS_CRYPTO_IV_SIZE];
     agsys_err_t err = agsys_crypto_generate_iv(iv);
@@ -68,7 +96,7 @@ agsys_err_t agsys_protocol_encode(const agsys_msg_header_t *header,
     }
 
     /* Encrypt */
-    uint8_t ciphertext[AGSYS_MSG_HEADER_SIZE + AGSYS_MAX_PAYLOAD_SIZE];
+    uint8_t ciphertext[AGSYS_MSG_HEADER_SIZE + AGSYS_MAX_PAYLOAD_SIZE + AGSYS_FRAME_CRC_SIZE];
     uint8_t tag[AGSYS_CRYPTO_TAG_SIZE];
 
     err = agsys_crypto_encrypt(ctx, plaintext, plaintext_len,
@@ -121,7 +149,7 @@ agsys_err_t agsys_protocol_decode(const uint8_t *in_buf,
     const uint8_t *tag = in_buf + ciphertext_len + AGSYS_CRYPTO_IV_SIZE;
 
     /* Decrypt */
-    uint8_t plaintext[AGSYS_MSG_HEADER_SIZE + AGSYS_MAX_PAYLOAD_SIZE];
+    uint8_t plaintext[AGSYS_MSG_HEADER_SIZE + AGSYS_MAX_PAYLOAD_SIZE + AGSYS_FRAME_CRC_SIZE];
 
     agsys_err_t err = agsys_crypto_decrypt(ctx, ciphertext, ciphertext_len,
                                             NULL, 0,  /* No AAD */
@@ -135,13 +163,31 @@ agsys_err_t agsys_protocol_decode(const uint8_t *in_buf,
     memcpy(header, plaintext, AGSYS_MSG_HEADER_SIZE);
 
     /* Validate header */
-    if (header->version != AGSYS_PROTOCOL_VERSION) {
-        AGSYS_LOG_WARNING("Protocol: Version mismatch: %d", header->version);
+    uint8_t version = header->version & AGSYS_VERSION_MASK;
+    if (version < AGSYS_PROTOCOL_VERSION || version > AGSYS_PROTOCOL_VERSION_CRC) {
+        AGSYS_LOG_WARNING("Protocol: Version mismatch: %d", version);
         return AGSYS_ERR_INVALID_PARAM;
     }
 
+    /* Verify and strip frame CRC */
+    size_t frame_len = ciphertext_len;
+    if (version >= AGSYS_PROTOCOL_VERSION_CRC) {
+        if (frame_len < AGSYS_MSG_HEADER_SIZE + AGSYS_FRAME_CRC_SIZE) {
+            AGSYS_LOG_WARNING("Protocol: Frame too short for CRC: %d", frame_len);
+            return AGSYS_ERR_INVALID_PARAM;
+        }
+        frame_len -= AGSYS_FRAME_CRC_SIZE;
+        uint16_t got = (uint16_t)plaintext[frame_len] |
+                       ((uint16_t)plaintext[frame_len + 1] << 8);
+        uint16_t want = agsys_protocol_crc16(plaintext, frame_len);
+        if (got != want) {
+            AGSYS_LOG_WARNING("Protocol: Frame CRC mismatch: %04X != %04X", got, want);
+            return AGSYS_ERR_INVALID_PARAM;
+        }
+    }
+
     /* Extract payload */
-    size_t plen = ciphertext_len - AGSYS_MSG_HEADER_SIZE;
+    size_t plen = frame_len - AGSYS_MSG_HEADER_SIZE;
     if (plen > 0 && payload != NULL) {
         memcpy(payload, plaintext + AGSYS_MSG_HEADER_SIZE, plen);
     }
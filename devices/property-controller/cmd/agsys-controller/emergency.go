@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	emergencyReason string
+
+	emergencyStopCmd = &cobra.Command{
+		Use:   "emergency-stop",
+		Short: "Close every valve and hold them closed until re-armed",
+		Long: `Send a close command to every valve, cancel open commands still in flight, and
+send valve controllers empty schedules. Valves stay closed, and open commands
+from the cloud, Modbus, or anywhere else are refused, until the stop is
+re-armed with "agsys-controller emergency-stop rearm". The stop survives a
+controller restart.`,
+		Args: cobra.NoArgs,
+		RunE: emergencyStop,
+	}
+
+	emergencyRearmCmd = &cobra.Command{
+		Use:   "rearm",
+		Short: "End the emergency stop so valves can open again",
+		Long: `End the emergency stop in force. Valves stay closed and cancelled commands are
+not resumed; schedules go back to the valve controllers.`,
+		Args: cobra.NoArgs,
+		RunE: emergencyRearm,
+	}
+)
+
+func init() {
+	emergencyStopCmd.PersistentFlags().StringVarP(&socketPath, "socket", "s", "", "Local API socket path (default from config)")
+	emergencyStopCmd.Flags().StringVarP(&emergencyReason, "reason", "r", "", "Why the valves are being stopped, for the audit log and alert")
+
+	emergencyStopCmd.AddCommand(emergencyRearmCmd)
+}
+
+func emergencyStop(cmd *cobra.Command, args []string) error {
+	closed, err := localClient().EmergencyStop(emergencyReason)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Emergency stop in force: close sent to %d valves\n", closed)
+	fmt.Println("Run 'agsys-controller emergency-stop rearm' to allow valves to open again")
+	return nil
+}
+
+func emergencyRearm(cmd *cobra.Command, args []string) error {
+	if err := localClient().RearmEmergencyStop(); err != nil {
+		return err
+	}
+	fmt.Println("Emergency stop re-armed; valves stay closed until commanded open")
+	return nil
+}
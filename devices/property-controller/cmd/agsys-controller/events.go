@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/agsys/property-controller/internal/localapi"
+	"github.com/spf13/cobra"
+)
+
+var (
+	eventTypes  []string
+	eventDevice string
+
+	eventsCmd = &cobra.Command{
+		Use:   "events",
+		Short: "Stream live events from the running controller",
+		Long: `Stream new soil and meter readings, valve state changes, and alarms from
+the running controller as they happen, one JSON object per line.`,
+		Example: `  agsys-controller events
+  agsys-controller events --type valve,alarm
+  agsys-controller events --device 0102030405060708`,
+		RunE: streamEvents,
+	}
+)
+
+func init() {
+	eventsCmd.Flags().StringVarP(&socketPath, "socket", "s", "", "Local API socket path (default from config)")
+	eventsCmd.Flags().StringSliceVarP(&eventTypes, "type", "t", nil, "Only show these event types (soil, meter, valve, alarm, alert)")
+	eventsCmd.Flags().StringVar(&eventDevice, "device", "", "Only show events from this device UID")
+}
+
+func streamEvents(cmd *cobra.Command, args []string) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	enc := json.NewEncoder(os.Stdout)
+	return localClient().Events(ctx, eventTypes, eventDevice, func(ev localapi.Event) {
+		enc.Encode(ev)
+	})
+}
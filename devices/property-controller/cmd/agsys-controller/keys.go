@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	keysCmd = &cobra.Command{
+		Use:   "keys",
+		Short: "Manage per-device LoRa keys on the running controller",
+	}
+
+	keysStatusCmd = &cobra.Command{
+		Use:   "status",
+		Short: "Show rotated device keys and rotations in progress",
+		RunE:  keysStatus,
+	}
+
+	keysRotateCmd = &cobra.Command{
+		Use:   "rotate <device-uid>",
+		Short: "Generate and deliver a new key to a device",
+		Args:  cobra.ExactArgs(1),
+		RunE:  keysRotate,
+	}
+)
+
+func init() {
+	keysCmd.PersistentFlags().StringVarP(&socketPath, "socket", "s", "", "Local API socket path (default from config)")
+
+	keysCmd.AddCommand(keysStatusCmd)
+	keysCmd.AddCommand(keysRotateCmd)
+}
+
+func keysStatus(cmd *cobra.Command, args []string) error {
+	keys, err := localClient().DeviceKeys()
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		fmt.Println("No device keys have been rotated; all devices use the network key")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "DEVICE\tKEY\tSTATE\tPENDING\tATTEMPTS\tACTIVATED\tOLD KEY VALID UNTIL")
+	fmt.Fprintln(w, "------\t---\t-----\t-------\t--------\t---------\t-------------------")
+
+	for _, k := range keys {
+		key, pending, attempts, activated, until := "network", "-", "-", "-", "-"
+		if k.KeyID != 0 {
+			key = fmt.Sprintf("%d", k.KeyID)
+		}
+		if k.PendingKeyID != 0 {
+			pending = fmt.Sprintf("%d", k.PendingKeyID)
+			attempts = fmt.Sprintf("%d", k.Attempts)
+		}
+		if k.ActivatedAt != nil {
+			activated = k.ActivatedAt.Format(time.DateTime)
+		}
+		if k.PreviousValidUntil != nil {
+			until = k.PreviousValidUntil.Format(time.DateTime)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			k.DeviceUID, key, k.State, pending, attempts, activated, until)
+	}
+	w.Flush()
+	return nil
+}
+
+func keysRotate(cmd *cobra.Command, args []string) error {
+	if err := localClient().RotateDeviceKey(args[0]); err != nil {
+		return err
+	}
+	fmt.Printf("Key rotation started for %s; the old key stays valid until the device acknowledges\n", args[0])
+	return nil
+}
@@ -9,6 +9,8 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -16,6 +18,13 @@ import (
 	"gopkg.in/yaml.v3"
 
 	"github.com/agsys/property-controller/internal/engine"
+	"github.com/agsys/property-controller/internal/logging"
+	"github.com/agsys/property-controller/internal/modbus"
+	"github.com/agsys/property-controller/internal/notify"
+	"github.com/agsys/property-controller/internal/protocol"
+	"github.com/agsys/property-controller/internal/sdnotify"
+	"github.com/agsys/property-controller/internal/storage"
+	"github.com/agsys/property-controller/internal/tracing"
 )
 
 // Config represents the configuration file structure
@@ -25,28 +34,76 @@ type Config struct {
 		Name string `yaml:"name"`
 	} `yaml:"property"`
 
+	// Further properties served by this process, each a config file of its
+	// own. The LoRa radio settings here are shared by all of them.
+	Properties []string `yaml:"properties"`
+
 	Cloud struct {
-		GRPCAddr string `yaml:"grpc_addr"`
-		APIKey   string `yaml:"api_key"`
-		UseTLS   bool   `yaml:"use_tls"`
+		GRPCAddr        string   `yaml:"grpc_addr"`
+		FallbackAddrs   []string `yaml:"fallback_addrs"`
+		FailoverAfter   int      `yaml:"failover_after"`
+		FailbackMinutes int      `yaml:"failback_check_minutes"`
+		APIKey          string   `yaml:"api_key"`
+		APIKeyFile      string   `yaml:"api_key_file"`
+		UseTLS          bool     `yaml:"use_tls"`
+		SessionTTLHours int      `yaml:"session_ttl_hours"`
+		LivenessSeconds int      `yaml:"liveness_timeout_seconds"`
+		Proxy           string   `yaml:"proxy"`
+		Compression     string   `yaml:"compression"`
 	} `yaml:"cloud"`
 
 	Controller struct {
-		ID string `yaml:"id"`
+		ID              string `yaml:"id"`
+		FirmwareVersion string `yaml:"firmware_version"`
 	} `yaml:"controller"`
 
 	LoRa struct {
+		Driver     string `yaml:"driver"`
+		SPIDevice  string `yaml:"spi_device"`
+		EventURL   string `yaml:"event_url"`
+		CommandURL string `yaml:"command_url"`
+		Gateways   []struct {
+			EventURL   string `yaml:"event_url"`
+			CommandURL string `yaml:"command_url"`
+		} `yaml:"gateways"`
 		Frequency       uint32 `yaml:"frequency"`
 		SpreadingFactor uint8  `yaml:"spreading_factor"`
 		Bandwidth       uint32 `yaml:"bandwidth"`
-		CodingRate      uint8  `yaml:"coding_rate"`
-		TxPower         int8   `yaml:"tx_power"`
+		CodingRate      string `yaml:"coding_rate"`
+		TxPower         *int8  `yaml:"tx_power"`
 		SyncWord        uint8  `yaml:"sync_word"`
 		AESKey          string `yaml:"aes_key"`
+		AESKeyFile      string `yaml:"aes_key_file"`
+		DeviceKeys      bool   `yaml:"device_keys"`
+		LegacyDevices   bool   `yaml:"legacy_devices"`
+		ADR             bool   `yaml:"adr"`
+		LinkHistoryDays int    `yaml:"link_history_days"`
+		DuplicateWindow *int   `yaml:"duplicate_window_seconds"`
+		RateLimit       *int   `yaml:"rate_limit_per_device"`
+		RateLimitGlobal *int   `yaml:"rate_limit_global"`
+		CaptureFile     string `yaml:"capture_file"`
+		DownlinkTTL     *int   `yaml:"downlink_ttl_hours"`
+		TxJitterMs      int    `yaml:"tx_jitter_ms"`
+		MaxDwellMs      int    `yaml:"max_dwell_ms"`
+		LBT             struct {
+			Enabled    bool   `yaml:"enabled"`
+			RSSITarget *int   `yaml:"rssi_target_dbm"`
+			ScanTimeUs int    `yaml:"scan_time_us"`
+			Retries    *int   `yaml:"retries"`
+			BackoffMs  int    `yaml:"backoff_ms"`
+			SPIDevice  string `yaml:"spi_device"`
+		} `yaml:"lbt"`
 	} `yaml:"lora"`
 
 	Database struct {
-		Path string `yaml:"path"`
+		Driver   string `yaml:"driver"`
+		Path     string `yaml:"path"`
+		KeyFile  string `yaml:"key_file"`
+		Postgres struct {
+			DSN           string `yaml:"dsn"`
+			Timescale     bool   `yaml:"timescale"`
+			RetentionDays int    `yaml:"retention_days"`
+		} `yaml:"postgres"`
 	} `yaml:"database"`
 
 	Timing struct {
@@ -54,12 +111,262 @@ type Config struct {
 		CommandTimeout   int `yaml:"command_timeout"`
 		CommandRetries   int `yaml:"command_retries"`
 		TimeSyncInterval int `yaml:"time_sync_interval"`
+		CommandRetention int `yaml:"command_retention_days"`
+		DebugTimeout     int `yaml:"debug_command_timeout"`
+		ClockSkewAlert   int `yaml:"clock_skew_alert"`
+		ClockResyncMin   int `yaml:"clock_resync_min"`
 	} `yaml:"timing"`
 
+	Sync struct {
+		BatchSize    int  `yaml:"batch_size"`
+		Concurrency  int  `yaml:"concurrency"`
+		DrainSeconds *int `yaml:"drain_seconds"`
+	} `yaml:"sync"`
+
 	Logging struct {
 		Level string `yaml:"level"`
 		File  string `yaml:"file"`
 	} `yaml:"logging"`
+
+	Tracing struct {
+		Endpoint    string  `yaml:"endpoint"`
+		Insecure    bool    `yaml:"insecure"`
+		SampleRatio float64 `yaml:"sample_ratio"`
+	} `yaml:"tracing"`
+
+	LocalAPI struct {
+		Socket  string `yaml:"socket"`
+		Listen  string `yaml:"listen"`
+		TLSCert string `yaml:"tls_cert"`
+		TLSKey  string `yaml:"tls_key"`
+	} `yaml:"local_api"`
+
+	Valves struct {
+		MaxOpenMinutes        int     `yaml:"max_open_minutes"`
+		ManualOverrideMinutes *int    `yaml:"manual_override_minutes"`
+		FlowLPM               float64 `yaml:"flow_lpm"`
+		Limits                []struct {
+			ControllerUID  string  `yaml:"controller_uid"`
+			Address        uint8   `yaml:"address"`
+			MaxOpenMinutes *int    `yaml:"max_open_minutes"`
+			FlowLPM        float64 `yaml:"flow_lpm"`
+		} `yaml:"limits"`
+	} `yaml:"valves"`
+
+	FlowAnalytics struct {
+		Enabled            *bool   `yaml:"enabled"`
+		IntervalSeconds    int     `yaml:"interval_seconds"`
+		WindowMinutes      int     `yaml:"window_minutes"`
+		MinFlowLPM         float32 `yaml:"min_flow_lpm"`
+		ValveSettleSeconds int     `yaml:"valve_settle_seconds"`
+	} `yaml:"flow_analytics"`
+
+	Maintenance struct {
+		CheckpointMinutes   *int   `yaml:"checkpoint_minutes"`
+		IntegrityCheckHours *int   `yaml:"integrity_check_hours"`
+		VacuumDays          *int   `yaml:"vacuum_days"`
+		BackupHours         *int   `yaml:"backup_hours"`
+		BackupDir           string `yaml:"backup_dir"`
+		BackupKeep          int    `yaml:"backup_keep"`
+		IdleStartHour       *int   `yaml:"idle_start_hour"`
+		IdleEndHour         *int   `yaml:"idle_end_hour"`
+	} `yaml:"maintenance"`
+
+	KeyRotation struct {
+		GraceHours     int `yaml:"grace_hours"`
+		TimeoutSeconds int `yaml:"timeout_seconds"`
+		Retries        int `yaml:"retries"`
+	} `yaml:"key_rotation"`
+
+	Modbus struct {
+		Listen             string `yaml:"listen"`
+		ReadOnly           bool   `yaml:"read_only"`
+		IdleTimeoutSeconds int    `yaml:"idle_timeout_seconds"`
+		MaxConnections     int    `yaml:"max_connections"`
+		Valves             []struct {
+			ControllerUID string `yaml:"controller_uid"`
+			Address       uint8  `yaml:"address"`
+		} `yaml:"valves"`
+		Sensors []struct {
+			DeviceUID string `yaml:"device_uid"`
+			Probe     uint8  `yaml:"probe"`
+		} `yaml:"sensors"`
+		Meters []string `yaml:"meters"`
+	} `yaml:"modbus"`
+
+	Weather struct {
+		APIKey         string   `yaml:"api_key"`
+		APIKeyFile     string   `yaml:"api_key_file"`
+		Latitude       float64  `yaml:"latitude"`
+		Longitude      float64  `yaml:"longitude"`
+		FetchMinutes   int      `yaml:"fetch_minutes"`
+		LookBackHours  int      `yaml:"lookback_hours"`
+		LookAheadHours int      `yaml:"lookahead_hours"`
+		SkipRainMM     *float64 `yaml:"skip_rain_mm"`
+		ReduceRainMM   *float64 `yaml:"reduce_rain_mm"`
+		ReferenceETMM  float64  `yaml:"reference_et_mm"`
+		MinScale       float64  `yaml:"min_scale"`
+		MaxScale       float64  `yaml:"max_scale"`
+		MaxAgeHours    int      `yaml:"max_age_hours"`
+		URL            string   `yaml:"url"`
+		TimeoutSeconds int      `yaml:"timeout_seconds"`
+	} `yaml:"weather"`
+
+	Fertigation struct {
+		PreFlushMinutes  *int `yaml:"pre_flush_minutes"`
+		PostFlushMinutes *int `yaml:"post_flush_minutes"`
+		Injectors        []struct {
+			ControllerUID string `yaml:"controller_uid"`
+			Address       uint8  `yaml:"address"`
+		} `yaml:"injectors"`
+	} `yaml:"fertigation"`
+
+	MoistureAlerts struct {
+		DryPercent uint8  `yaml:"dry_percent"`
+		WetPercent uint8  `yaml:"wet_percent"`
+		Hysteresis *uint8 `yaml:"hysteresis"`
+		Zones      []struct {
+			ZoneUID    string `yaml:"zone_uid"`
+			DryPercent uint8  `yaml:"dry_percent"`
+			WetPercent uint8  `yaml:"wet_percent"`
+		} `yaml:"zones"`
+	} `yaml:"moisture_alerts"`
+
+	Drydown struct {
+		WindowHours     int      `yaml:"window_hours"`
+		MinSpanHours    *float64 `yaml:"min_span_hours"`
+		RisePercent     *uint8   `yaml:"rise_percent"`
+		TempCoefficient *float64 `yaml:"temp_coefficient"`
+		TargetPercent   uint8    `yaml:"target_percent"`
+		SkipAheadHours  float64  `yaml:"skip_ahead_hours"`
+	} `yaml:"drydown"`
+
+	Validation struct {
+		MinTemperatureC   *float64 `yaml:"min_temperature_c"`
+		MaxTemperatureC   *float64 `yaml:"max_temperature_c"`
+		MaxMoistureStep   *uint8   `yaml:"max_moisture_step"`
+		StepWindowMinutes int      `yaml:"step_window_minutes"`
+		MeterDropL        *float64 `yaml:"meter_drop_l"`
+	} `yaml:"validation"`
+
+	DeviceLogs struct {
+		HistoryDays     *int   `yaml:"history_days"`
+		Forward         bool   `yaml:"forward"`
+		ForwardSeverity string `yaml:"forward_severity"`
+	} `yaml:"device_logs"`
+
+	ActuatorHealth struct {
+		MaxMA        uint16   `yaml:"max_ma"`
+		MinMA        uint16   `yaml:"min_ma"`
+		DriftPercent *float64 `yaml:"drift_percent"`
+		Recent       int      `yaml:"recent"`
+		Baseline     *int     `yaml:"baseline"`
+		HistoryDays  *int     `yaml:"history_days"`
+	} `yaml:"actuator_health"`
+
+	PowerFail struct {
+		CloseValves bool `yaml:"close_valves"`
+	} `yaml:"power_fail"`
+
+	Reboots struct {
+		LoopCount       *int `yaml:"loop_count"`
+		LoopWindowHours int  `yaml:"loop_window_hours"`
+	} `yaml:"reboots"`
+
+	FirmwareInventory struct {
+		ResyncHours *int `yaml:"resync_hours"`
+	} `yaml:"firmware_inventory"`
+
+	Spoofing struct {
+		RSSIJumpDB   *int    `yaml:"rssi_jump_db"`
+		MinSamples   int     `yaml:"min_samples"`
+		SequenceJump *uint16 `yaml:"sequence_jump"`
+		Quarantine   bool    `yaml:"quarantine"`
+	} `yaml:"spoofing"`
+
+	ReportIntervals struct {
+		LowBatteryMinutes *int    `yaml:"low_battery_minutes"`
+		LowBatteryMV      *uint16 `yaml:"low_battery_mv"`
+		TimeoutMinutes    int     `yaml:"timeout_minutes"`
+		Retries           *int    `yaml:"retries"`
+	} `yaml:"report_intervals"`
+
+	ScheduleAcks struct {
+		TimeoutSeconds int  `yaml:"timeout_seconds"`
+		Retries        *int `yaml:"retries"`
+	} `yaml:"schedule_acks"`
+
+	MeterPins struct {
+		TimeoutMinutes int  `yaml:"timeout_minutes"`
+		Retries        *int `yaml:"retries"`
+	} `yaml:"meter_pins"`
+
+	MeterCalibration struct {
+		AckTimeoutMinutes  int      `yaml:"ack_timeout_minutes"`
+		MaxDurationMinutes *int     `yaml:"max_duration_minutes"`
+		MaxChangePercent   *float64 `yaml:"max_change_percent"`
+	} `yaml:"meter_calibration"`
+
+	Acks struct {
+		Enabled   *bool `yaml:"enabled"`
+		FlagsOnly bool  `yaml:"flags_only"`
+	} `yaml:"acks"`
+
+	OTA struct {
+		FirmwareCacheDir       string   `yaml:"firmware_cache_dir"`
+		ChunkSize              int      `yaml:"chunk_size"`
+		ChunkTimeoutSeconds    int      `yaml:"chunk_timeout_seconds"`
+		ChunkRetries           int      `yaml:"chunk_retries"`
+		AnnounceSeconds        int      `yaml:"announce_interval_seconds"`
+		WindowSize             *int     `yaml:"window_size"`
+		MulticastPacingSeconds *float64 `yaml:"multicast_pacing_seconds"`
+		AirtimePercent         *float64 `yaml:"airtime_percent"`
+		AirtimeWindowSeconds   int      `yaml:"airtime_window_seconds"`
+		PauseForCommands       *bool    `yaml:"pause_for_commands"`
+	} `yaml:"ota"`
+
+	LowBandwidth struct {
+		Enabled           bool `yaml:"enabled"`
+		BatchSize         int  `yaml:"batch_size"`
+		SyncMinutes       int  `yaml:"sync_interval_minutes"`
+		AggregateMinutes  *int `yaml:"aggregate_minutes"`
+		FirmwareStartHour *int `yaml:"firmware_start_hour"`
+		FirmwareEndHour   *int `yaml:"firmware_end_hour"`
+	} `yaml:"low_bandwidth"`
+
+	Alerts struct {
+		OfflineMinutes      *int     `yaml:"offline_minutes"`
+		CloudOfflineMinutes *int     `yaml:"cloud_offline_minutes"`
+		FrostC              *float64 `yaml:"frost_c"`
+		GatewayMinScore     *int     `yaml:"gateway_min_score"`
+		GatewayWindowMin    int      `yaml:"gateway_window_minutes"`
+	} `yaml:"alerts"`
+
+	Notifications struct {
+		MinSeverity    string `yaml:"min_severity"`
+		RateLimit      *int   `yaml:"rate_limit"`
+		QuietStartHour int    `yaml:"quiet_start_hour"`
+		QuietEndHour   int    `yaml:"quiet_end_hour"`
+		TimeoutSeconds int    `yaml:"timeout_seconds"`
+		SMTP           struct {
+			Host     string   `yaml:"host"`
+			Port     int      `yaml:"port"`
+			Username string   `yaml:"username"`
+			Password string   `yaml:"password"`
+			From     string   `yaml:"from"`
+			To       []string `yaml:"to"`
+		} `yaml:"smtp"`
+		Twilio struct {
+			AccountSID string   `yaml:"account_sid"`
+			AuthToken  string   `yaml:"auth_token"`
+			From       string   `yaml:"from"`
+			To         []string `yaml:"to"`
+		} `yaml:"twilio"`
+		Webhook struct {
+			URL     string            `yaml:"url"`
+			Headers map[string]string `yaml:"headers"`
+		} `yaml:"webhook"`
+	} `yaml:"notifications"`
 }
 
 var (
@@ -76,6 +383,23 @@ var (
 		RunE:  runController,
 	}
 
+	reloadCmd = &cobra.Command{
+		Use:   "reload",
+		Short: "Reload the configuration of the running controller",
+		Long: `Reload controller.yaml in the running controller, equivalent to sending it SIGHUP.
+
+Logging, sync intervals, command timeouts and retries, valve limits, and cloud
+connection settings are applied without restarting LoRa or dropping pending
+commands. Other changes are logged and take effect on the next restart.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := localClient().Reload(); err != nil {
+				return err
+			}
+			fmt.Println("Configuration reloaded")
+			return nil
+		},
+	}
+
 	versionCmd = &cobra.Command{
 		Use:   "version",
 		Short: "Print version information",
@@ -87,8 +411,19 @@ var (
 
 func init() {
 	rootCmd.PersistentFlags().StringVarP(&configFile, "config", "c", "/etc/agsys/controller.yaml", "Configuration file path")
+	rootCmd.PersistentFlags().StringVar(&apiToken, "token", os.Getenv("AGSYS_TOKEN"), "Local API token for commands that change state (default $AGSYS_TOKEN)")
 	rootCmd.AddCommand(runCmd)
+	rootCmd.AddCommand(reloadCmd)
+	rootCmd.AddCommand(provisionCmd)
+	rootCmd.AddCommand(replayCmd)
+	rootCmd.AddCommand(statusCmd)
 	rootCmd.AddCommand(versionCmd)
+	rootCmd.AddCommand(otaCmd)
+	rootCmd.AddCommand(keysCmd)
+	rootCmd.AddCommand(eventsCmd)
+	rootCmd.AddCommand(valvesCmd)
+	rootCmd.AddCommand(recommendationsCmd)
+	rootCmd.AddCommand(emergencyStopCmd)
 }
 
 func main() {
@@ -98,7 +433,21 @@ func main() {
 	}
 }
 
+// loadConfig reads the main config file, with settings overridden from the
+// environment
 func loadConfig(path string) (*Config, error) {
+	cfg, err := parseConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := applyEnvOverrides(cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// parseConfig reads a config file as it is
+func parseConfig(path string) (*Config, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read config file: %w", err)
@@ -119,45 +468,381 @@ func runController(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("failed to load config: %w", err)
 	}
 
+	props, err := loadProperties(cfg)
+	if err != nil {
+		return err
+	}
+
+	if err := logging.Setup(cfg.Logging.Level, cfg.Logging.File); err != nil {
+		return fmt.Errorf("failed to set up logging: %w", err)
+	}
+
+	// Not reloaded: spans buffered under the old exporter would be lost
+	stopTracing, err := tracing.Setup(tracing.Config{
+		Endpoint:    cfg.Tracing.Endpoint,
+		Insecure:    cfg.Tracing.Insecure,
+		SampleRatio: cfg.Tracing.SampleRatio,
+	}, cfg.Controller.ID, props[0].config.FirmwareVersion)
+	if err != nil {
+		return fmt.Errorf("failed to set up tracing: %w", err)
+	}
+
+	// Several properties share the main config's radio, and the systemd
+	// watchdog only hears from the process once all of them are healthy
+	var radio *engine.SharedRadio
+	var gate *watchdogGate
+	if len(props) > 1 {
+		radio, err = engine.NewSharedRadio(props[0].config)
+		if err != nil {
+			return err
+		}
+		gate = newWatchdogGate(len(props))
+	}
+
+	// Create engines
+	for i, p := range props {
+		// Feed the systemd watchdog if WatchdogSec= is set for the service
+		p.config.WatchdogInterval = sdnotify.WatchdogInterval()
+		if radio != nil {
+			p.config.SharedRadio = radio
+			p.config.WatchdogNotify = gate.notifier(i)
+		}
+
+		p.engine, err = engine.New(p.config)
+		if err != nil {
+			return fmt.Errorf("failed to create engine for %s: %w", p.configPath, err)
+		}
+		p.engine.SetReloadHandler(func() error { return reloadConfig(props) })
+	}
+
+	// Set up signal handling
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	// Start engines
+	if radio != nil {
+		if err := radio.Start(); err != nil {
+			return fmt.Errorf("failed to start LoRa driver: %w", err)
+		}
+	}
+	for _, p := range props {
+		log.Printf("Starting AgSys Property Controller for property %s", p.config.PropertyUID)
+		if err := p.engine.Start(ctx); err != nil {
+			return fmt.Errorf("failed to start engine for %s: %w", p.configPath, err)
+		}
+	}
+	if err := sdnotify.Ready(); err != nil {
+		log.Printf("Failed to notify systemd: %v", err)
+	}
+
+	// Wait for shutdown signal, reloading the config on SIGHUP
+	for sig := range sigChan {
+		if sig == syscall.SIGHUP {
+			log.Printf("Received SIGHUP, reloading %s", configFile)
+			if err := reloadConfig(props); err != nil {
+				log.Printf("Config reload failed, keeping current settings: %v", err)
+			}
+			continue
+		}
+		log.Printf("Received signal %v, shutting down...", sig)
+		break
+	}
+
+	// Stop engines
+	if err := sdnotify.Stopping(); err != nil {
+		log.Printf("Failed to notify systemd: %v", err)
+	}
+	for _, p := range props {
+		if err := p.engine.Stop(); err != nil {
+			log.Printf("Error during shutdown of %s: %v", p.configPath, err)
+		}
+	}
+	if radio != nil {
+		if err := radio.Stop(); err != nil {
+			log.Printf("Error stopping LoRa driver: %v", err)
+		}
+	}
+
+	flushCtx, flushCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer flushCancel()
+	if err := stopTracing(flushCtx); err != nil {
+		log.Printf("Error flushing traces: %v", err)
+	}
+
+	log.Println("Shutdown complete")
+	return nil
+}
+
+// reloadMu serializes reloads from SIGHUP and the local API
+var reloadMu sync.Mutex
+
+// reloadConfig re-reads the config files and applies them to the running
+// engines. Nothing is changed if any file fails to load or validate.
+func reloadConfig(props []*property) error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	cfg, err := loadConfig(configFile)
+	if err != nil {
+		return err
+	}
+	if !sameProperties(props, cfg) {
+		log.Printf("Config reload: properties changed, restart required to apply")
+		cfg.Properties = nil
+		for _, p := range props[1:] {
+			cfg.Properties = append(cfg.Properties, p.configPath)
+		}
+	}
+	reloaded, err := loadProperties(cfg)
+	if err != nil {
+		return err
+	}
+
+	if err := logging.Setup(cfg.Logging.Level, cfg.Logging.File); err != nil {
+		return fmt.Errorf("failed to set up logging: %w", err)
+	}
+	for i, p := range props {
+		p.engine.Reload(reloaded[i].config)
+	}
+	return nil
+}
+
+// buildEngineConfig validates the config file and maps it onto engine settings
+func buildEngineConfig(cfg *Config) (engine.Config, error) {
 	// Validate required fields
 	if cfg.Controller.ID == "" {
-		return fmt.Errorf("controller.id is required")
+		return engine.Config{}, fmt.Errorf("controller.id is required")
 	}
-	if cfg.Cloud.APIKey == "" {
-		return fmt.Errorf("cloud.api_key is required")
+	apiKey, err := readSecret(cfg.Cloud.APIKey, cfg.Cloud.APIKeyFile, "cloud.api_key")
+	if err != nil {
+		return engine.Config{}, err
+	}
+	if apiKey == "" {
+		return engine.Config{}, fmt.Errorf("cloud.api_key is required")
 	}
 
 	// Parse AES key
+	aesKeyHex, err := readSecret(cfg.LoRa.AESKey, cfg.LoRa.AESKeyFile, "lora.aes_key")
+	if err != nil {
+		return engine.Config{}, err
+	}
 	var aesKey []byte
-	if cfg.LoRa.AESKey != "" {
-		aesKey, err = hex.DecodeString(cfg.LoRa.AESKey)
+	if aesKeyHex != "" {
+		aesKey, err = hex.DecodeString(aesKeyHex)
 		if err != nil {
-			return fmt.Errorf("invalid AES key: %w", err)
+			return engine.Config{}, fmt.Errorf("invalid AES key: %w", err)
 		}
 		if len(aesKey) != 16 {
-			return fmt.Errorf("AES key must be 16 bytes (32 hex characters)")
+			return engine.Config{}, fmt.Errorf("AES key must be 16 bytes (32 hex characters)")
 		}
 	}
 
-	// Build engine config
 	engineCfg := engine.DefaultConfig()
 	engineCfg.ControllerID = cfg.Controller.ID
+	if cfg.Controller.FirmwareVersion != "" {
+		engineCfg.FirmwareVersion = cfg.Controller.FirmwareVersion
+	}
+	engineCfg.PropertyUID = cfg.Property.UID
 	if cfg.Cloud.GRPCAddr != "" {
 		engineCfg.GRPCAddr = cfg.Cloud.GRPCAddr
 	}
-	engineCfg.APIKey = cfg.Cloud.APIKey
+	engineCfg.GRPCFallbacks = cfg.Cloud.FallbackAddrs
+	engineCfg.CloudFailover = cfg.Cloud.FailoverAfter
+	if cfg.Cloud.FailbackMinutes > 0 {
+		engineCfg.CloudFailback = time.Duration(cfg.Cloud.FailbackMinutes) * time.Minute
+	}
+	engineCfg.APIKey = apiKey
 	engineCfg.UseTLS = cfg.Cloud.UseTLS
+	if cfg.Cloud.SessionTTLHours > 0 {
+		engineCfg.CloudSessionTTL = time.Duration(cfg.Cloud.SessionTTLHours) * time.Hour
+	}
+	if cfg.Cloud.LivenessSeconds > 0 {
+		engineCfg.CloudLiveness = secondsToDuration(cfg.Cloud.LivenessSeconds)
+	}
+	engineCfg.CloudProxy = cfg.Cloud.Proxy
+	switch cfg.Cloud.Compression {
+	case "", "none":
+	case "gzip", "zstd":
+		engineCfg.CloudCompression = cfg.Cloud.Compression
+	default:
+		return engine.Config{}, fmt.Errorf("cloud.compression must be gzip, zstd, or none")
+	}
 	engineCfg.AESKey = aesKey
+	if cfg.LoRa.LegacyDevices && !cfg.LoRa.DeviceKeys {
+		return engine.Config{}, fmt.Errorf("lora.legacy_devices needs lora.device_keys")
+	}
+	engineCfg.LoRa.DeviceKeys = cfg.LoRa.DeviceKeys
+	engineCfg.LoRa.LegacyDevices = cfg.LoRa.LegacyDevices
 
+	switch cfg.Database.Driver {
+	case "", storage.DriverSQLite:
+	case storage.DriverPostgres:
+		if cfg.Database.Postgres.DSN == "" {
+			return engine.Config{}, fmt.Errorf("database.postgres.dsn is required with the postgres driver")
+		}
+	default:
+		return engine.Config{}, fmt.Errorf("database.driver must be sqlite or postgres")
+	}
+	if cfg.Database.Postgres.RetentionDays < 0 {
+		return engine.Config{}, fmt.Errorf("database.postgres.retention_days must not be negative")
+	}
+	if cfg.Database.Postgres.RetentionDays > 0 && !cfg.Database.Postgres.Timescale {
+		return engine.Config{}, fmt.Errorf("database.postgres.retention_days needs timescale")
+	}
+	engineCfg.DatabaseDriver = cfg.Database.Driver
 	if cfg.Database.Path != "" {
 		engineCfg.DatabasePath = cfg.Database.Path
 	}
-	if cfg.LoRa.Frequency != 0 {
-		engineCfg.LoRaFrequency = cfg.LoRa.Frequency
+	engineCfg.Postgres = storage.PostgresConfig{
+		DSN:           cfg.Database.Postgres.DSN,
+		Timescale:     cfg.Database.Postgres.Timescale,
+		RetentionDays: cfg.Database.Postgres.RetentionDays,
+	}
+	if cfg.Database.KeyFile != "" {
+		data, err := os.ReadFile(cfg.Database.KeyFile)
+		if err != nil {
+			return engine.Config{}, fmt.Errorf("failed to read database key: %w", err)
+		}
+		key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(key) != storage.DatabaseKeySize {
+			return engine.Config{}, fmt.Errorf("database.key_file must hold %d hex characters", 2*storage.DatabaseKeySize)
+		}
+		engineCfg.DatabaseKey = key
+	}
+	switch cfg.LoRa.Driver {
+	case "":
+	case "concentratord":
+		if cfg.LoRa.EventURL == "" {
+			return engine.Config{}, fmt.Errorf("lora.driver concentratord needs lora.event_url")
+		}
+	case "sx1301", "sx1302":
+		if cfg.LoRa.EventURL != "" || len(cfg.LoRa.Gateways) > 0 {
+			return engine.Config{}, fmt.Errorf("lora.event_url and lora.gateways are only used by lora.driver concentratord")
+		}
+	default:
+		return engine.Config{}, fmt.Errorf("lora.driver must be concentratord, sx1301, or sx1302")
+	}
+	engineCfg.LoRa.Driver = cfg.LoRa.Driver
+	engineCfg.LoRa.SPIDevice = cfg.LoRa.SPIDevice
+	if (cfg.LoRa.EventURL == "") != (cfg.LoRa.CommandURL == "") {
+		return engine.Config{}, fmt.Errorf("lora.event_url and lora.command_url must be set together")
+	}
+	engineCfg.LoRa.EventURL = cfg.LoRa.EventURL
+	engineCfg.LoRa.CommandURL = cfg.LoRa.CommandURL
+	for i, g := range cfg.LoRa.Gateways {
+		if g.EventURL == "" || g.CommandURL == "" {
+			return engine.Config{}, fmt.Errorf("lora.gateways[%d] must set both event_url and command_url", i)
+		}
+		engineCfg.LoRa.Gateways = append(engineCfg.LoRa.Gateways, engine.GatewayConfig{EventURL: g.EventURL, CommandURL: g.CommandURL})
+	}
+	if f := cfg.LoRa.Frequency; f != 0 {
+		if f < 400000000 || f > 1020000000 {
+			return engine.Config{}, fmt.Errorf("lora.frequency must be between 400000000 and 1020000000 Hz")
+		}
+		engineCfg.LoRa.Frequency = f
+	}
+	if sf := cfg.LoRa.SpreadingFactor; sf != 0 {
+		if sf < 7 || sf > 12 {
+			return engine.Config{}, fmt.Errorf("lora.spreading_factor must be between 7 and 12")
+		}
+		engineCfg.LoRa.SpreadingFactor = sf
+	}
+	switch cfg.LoRa.Bandwidth {
+	case 0:
+	case 125000, 250000, 500000:
+		engineCfg.LoRa.Bandwidth = cfg.LoRa.Bandwidth
+	default:
+		return engine.Config{}, fmt.Errorf("lora.bandwidth must be 125000, 250000, or 500000")
+	}
+	switch cfg.LoRa.CodingRate {
+	case "":
+	case "4/5", "4/6", "4/7", "4/8":
+		engineCfg.LoRa.CodingRate = cfg.LoRa.CodingRate[2] - '0'
+	default:
+		return engine.Config{}, fmt.Errorf("lora.coding_rate must be 4/5, 4/6, 4/7, or 4/8")
+	}
+	if p := cfg.LoRa.TxPower; p != nil {
+		if *p < 0 || *p > 30 {
+			return engine.Config{}, fmt.Errorf("lora.tx_power must be between 0 and 30 dBm")
+		}
+		engineCfg.LoRa.TxPower = *p
+	}
+	if cfg.LoRa.SyncWord != 0 {
+		engineCfg.LoRa.SyncWord = cfg.LoRa.SyncWord
+	}
+	engineCfg.LoRa.ADR = cfg.LoRa.ADR
+	engineCfg.LoRa.CaptureFile = cfg.LoRa.CaptureFile
+	if h := cfg.LoRa.DownlinkTTL; h != nil {
+		if *h < 0 {
+			return engine.Config{}, fmt.Errorf("lora.downlink_ttl_hours must not be negative")
+		}
+		engineCfg.LoRa.DownlinkTTL = time.Duration(*h) * time.Hour
+	}
+	if cfg.LoRa.TxJitterMs < 0 {
+		return engine.Config{}, fmt.Errorf("lora.tx_jitter_ms must not be negative")
+	}
+	engineCfg.LoRa.TxJitter = time.Duration(cfg.LoRa.TxJitterMs) * time.Millisecond
+	if cfg.LoRa.MaxDwellMs < 0 {
+		return engine.Config{}, fmt.Errorf("lora.max_dwell_ms must not be negative")
+	}
+	engineCfg.LoRa.MaxDwell = time.Duration(cfg.LoRa.MaxDwellMs) * time.Millisecond
+	lbt := cfg.LoRa.LBT
+	engineCfg.LoRa.LBT.Enabled = lbt.Enabled
+	if t := lbt.RSSITarget; t != nil {
+		if *t < -128 || *t > 0 {
+			return engine.Config{}, fmt.Errorf("lora.lbt.rssi_target_dbm must be between -128 and 0")
+		}
+		engineCfg.LoRa.LBT.RSSITarget = int8(*t)
+	}
+	switch lbt.ScanTimeUs {
+	case 0:
+	case 128, 5000:
+		engineCfg.LoRa.LBT.ScanTime = time.Duration(lbt.ScanTimeUs) * time.Microsecond
+	default:
+		return engine.Config{}, fmt.Errorf("lora.lbt.scan_time_us must be 128 or 5000")
+	}
+	if r := lbt.Retries; r != nil {
+		if *r < 0 {
+			return engine.Config{}, fmt.Errorf("lora.lbt.retries must not be negative")
+		}
+		engineCfg.LoRa.LBT.Retries = *r
+	}
+	if lbt.BackoffMs < 0 {
+		return engine.Config{}, fmt.Errorf("lora.lbt.backoff_ms must not be negative")
+	} else if lbt.BackoffMs > 0 {
+		engineCfg.LoRa.LBT.Backoff = time.Duration(lbt.BackoffMs) * time.Millisecond
+	}
+	engineCfg.LoRa.LBTDevice = lbt.SPIDevice
+	if cfg.LoRa.LinkHistoryDays > 0 {
+		engineCfg.LinkHistory = time.Duration(cfg.LoRa.LinkHistoryDays) * 24 * time.Hour
+	}
+	if cfg.LoRa.DuplicateWindow != nil {
+		engineCfg.DuplicateWindow = secondsToDuration(*cfg.LoRa.DuplicateWindow)
+	}
+	if cfg.LoRa.RateLimit != nil {
+		engineCfg.IngestLimit.PerDevice = *cfg.LoRa.RateLimit
+	}
+	if cfg.LoRa.RateLimitGlobal != nil {
+		engineCfg.IngestLimit.Global = *cfg.LoRa.RateLimitGlobal
 	}
 	if cfg.Timing.SyncInterval > 0 {
 		engineCfg.SyncInterval = secondsToDuration(cfg.Timing.SyncInterval)
 	}
+	if cfg.Sync.BatchSize > 0 {
+		engineCfg.Sync.BatchSize = cfg.Sync.BatchSize
+	}
+	if cfg.Sync.Concurrency < 0 || cfg.Sync.Concurrency > 4 {
+		return engine.Config{}, fmt.Errorf("sync.concurrency must be between 1 and 4")
+	}
+	if cfg.Sync.Concurrency > 0 {
+		engineCfg.Sync.Concurrency = cfg.Sync.Concurrency
+	}
+	if cfg.Sync.DrainSeconds != nil {
+		engineCfg.Sync.DrainInterval = secondsToDuration(*cfg.Sync.DrainSeconds)
+	}
 	if cfg.Timing.CommandTimeout > 0 {
 		engineCfg.CommandTimeout = secondsToDuration(cfg.Timing.CommandTimeout)
 	}
@@ -167,37 +852,430 @@ func runController(cmd *cobra.Command, args []string) error {
 	if cfg.Timing.TimeSyncInterval > 0 {
 		engineCfg.TimeSyncInterval = secondsToDuration(cfg.Timing.TimeSyncInterval)
 	}
-
-	// Create engine
-	eng, err := engine.New(engineCfg)
+	if cfg.Timing.CommandRetention > 0 {
+		engineCfg.CommandRetention = time.Duration(cfg.Timing.CommandRetention) * 24 * time.Hour
+	}
+	if cfg.Timing.DebugTimeout > 0 {
+		engineCfg.DebugTimeout = secondsToDuration(cfg.Timing.DebugTimeout)
+	}
+	if cfg.Timing.ClockSkewAlert > 0 {
+		engineCfg.Clock.SkewThreshold = secondsToDuration(cfg.Timing.ClockSkewAlert)
+	}
+	if cfg.Timing.ClockResyncMin > 0 {
+		engineCfg.Clock.MinResyncInterval = time.Duration(cfg.Timing.ClockResyncMin) * time.Minute
+	}
+	if cfg.LocalAPI.Socket != "" {
+		engineCfg.LocalAPISocket = cfg.LocalAPI.Socket
+	}
+	if (cfg.LocalAPI.TLSCert == "") != (cfg.LocalAPI.TLSKey == "") {
+		return engine.Config{}, fmt.Errorf("local_api.tls_cert and local_api.tls_key must be set together")
+	}
+	engineCfg.LocalAPIListen = cfg.LocalAPI.Listen
+	engineCfg.LocalAPITLSCert = cfg.LocalAPI.TLSCert
+	engineCfg.LocalAPITLSKey = cfg.LocalAPI.TLSKey
+	if cfg.Valves.MaxOpenMinutes > 0 {
+		engineCfg.ValveMaxOpen = time.Duration(cfg.Valves.MaxOpenMinutes) * time.Minute
+	}
+	if m := cfg.Valves.ManualOverrideMinutes; m != nil {
+		if *m < 0 {
+			return engine.Config{}, fmt.Errorf("valves.manual_override_minutes must not be negative")
+		}
+		engineCfg.ManualOverride = time.Duration(*m) * time.Minute
+	}
+	if cfg.Valves.FlowLPM < 0 {
+		return engine.Config{}, fmt.Errorf("valves.flow_lpm must not be negative")
+	}
+	engineCfg.ValveFlow = cfg.Valves.FlowLPM
+	if cfg.FlowAnalytics.Enabled != nil {
+		engineCfg.FlowAnalytics.Enabled = *cfg.FlowAnalytics.Enabled
+	}
+	if cfg.FlowAnalytics.IntervalSeconds > 0 {
+		engineCfg.FlowAnalytics.Interval = secondsToDuration(cfg.FlowAnalytics.IntervalSeconds)
+	}
+	if cfg.FlowAnalytics.WindowMinutes > 0 {
+		engineCfg.FlowAnalytics.Window = time.Duration(cfg.FlowAnalytics.WindowMinutes) * time.Minute
+	}
+	if cfg.FlowAnalytics.MinFlowLPM > 0 {
+		engineCfg.FlowAnalytics.MinFlowLPM = cfg.FlowAnalytics.MinFlowLPM
+	}
+	if cfg.FlowAnalytics.ValveSettleSeconds > 0 {
+		engineCfg.FlowAnalytics.ValveSettle = secondsToDuration(cfg.FlowAnalytics.ValveSettleSeconds)
+	}
+	if m := cfg.Maintenance; m.CheckpointMinutes != nil {
+		engineCfg.Maintenance.CheckpointInterval = time.Duration(*m.CheckpointMinutes) * time.Minute
+	}
+	if m := cfg.Maintenance; m.IntegrityCheckHours != nil {
+		engineCfg.Maintenance.IntegrityInterval = time.Duration(*m.IntegrityCheckHours) * time.Hour
+	}
+	if m := cfg.Maintenance; m.VacuumDays != nil {
+		engineCfg.Maintenance.VacuumInterval = time.Duration(*m.VacuumDays) * 24 * time.Hour
+	}
+	if m := cfg.Maintenance; m.BackupHours != nil {
+		engineCfg.Maintenance.BackupInterval = time.Duration(*m.BackupHours) * time.Hour
+	}
+	engineCfg.Maintenance.BackupDir = cfg.Maintenance.BackupDir
+	if cfg.Maintenance.BackupKeep > 0 {
+		engineCfg.Maintenance.BackupKeep = cfg.Maintenance.BackupKeep
+	}
+	if m := cfg.Maintenance; m.IdleStartHour != nil {
+		engineCfg.Maintenance.IdleStartHour = *m.IdleStartHour
+	}
+	if m := cfg.Maintenance; m.IdleEndHour != nil {
+		engineCfg.Maintenance.IdleEndHour = *m.IdleEndHour
+	}
+	if cfg.KeyRotation.GraceHours > 0 {
+		engineCfg.KeyRotation.Grace = time.Duration(cfg.KeyRotation.GraceHours) * time.Hour
+	}
+	if cfg.KeyRotation.TimeoutSeconds > 0 {
+		engineCfg.KeyRotation.Timeout = secondsToDuration(cfg.KeyRotation.TimeoutSeconds)
+	}
+	if cfg.KeyRotation.Retries > 0 {
+		engineCfg.KeyRotation.Retries = cfg.KeyRotation.Retries
+	}
+	for _, l := range cfg.Valves.Limits {
+		// A limit that only sets the flow keeps the global maximum
+		maxOpen := engineCfg.ValveMaxOpen
+		if l.MaxOpenMinutes != nil {
+			maxOpen = time.Duration(*l.MaxOpenMinutes) * time.Minute
+		}
+		engineCfg.ValveLimits = append(engineCfg.ValveLimits, engine.ValveLimit{
+			ControllerUID: l.ControllerUID,
+			Address:       l.Address,
+			MaxOpen:       maxOpen,
+			FlowLPM:       l.FlowLPM,
+		})
+	}
+	engineCfg.Modbus.Listen = cfg.Modbus.Listen
+	engineCfg.Modbus.ReadOnly = cfg.Modbus.ReadOnly
+	if cfg.Modbus.IdleTimeoutSeconds > 0 {
+		engineCfg.Modbus.IdleTimeout = secondsToDuration(cfg.Modbus.IdleTimeoutSeconds)
+	}
+	if cfg.Modbus.MaxConnections > 0 {
+		engineCfg.Modbus.MaxConns = cfg.Modbus.MaxConnections
+	}
+	for _, v := range cfg.Modbus.Valves {
+		engineCfg.Modbus.Valves = append(engineCfg.Modbus.Valves, modbus.ValveRef{ControllerUID: v.ControllerUID, Address: v.Address})
+	}
+	for _, s := range cfg.Modbus.Sensors {
+		engineCfg.Modbus.Sensors = append(engineCfg.Modbus.Sensors, modbus.SensorRef{DeviceUID: s.DeviceUID, Probe: s.Probe})
+	}
+	engineCfg.Modbus.Meters = cfg.Modbus.Meters
+	weatherKey, err := readSecret(cfg.Weather.APIKey, cfg.Weather.APIKeyFile, "weather.api_key")
 	if err != nil {
-		return fmt.Errorf("failed to create engine: %w", err)
+		return engine.Config{}, err
 	}
-
-	// Set up signal handling
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-
-	// Start engine
-	log.Printf("Starting AgSys Property Controller for property %s", cfg.Property.UID)
-	if err := eng.Start(ctx); err != nil {
-		return fmt.Errorf("failed to start engine: %w", err)
+	engineCfg.Weather.OpenWeather.APIKey = weatherKey
+	engineCfg.Weather.OpenWeather.Latitude = cfg.Weather.Latitude
+	engineCfg.Weather.OpenWeather.Longitude = cfg.Weather.Longitude
+	if cfg.Weather.URL != "" {
+		engineCfg.Weather.OpenWeather.URL = cfg.Weather.URL
 	}
-
-	// Wait for shutdown signal
-	sig := <-sigChan
-	log.Printf("Received signal %v, shutting down...", sig)
-
-	// Stop engine
-	if err := eng.Stop(); err != nil {
-		log.Printf("Error during shutdown: %v", err)
+	if cfg.Weather.TimeoutSeconds > 0 {
+		engineCfg.Weather.OpenWeather.Timeout = secondsToDuration(cfg.Weather.TimeoutSeconds)
+	}
+	if cfg.Weather.FetchMinutes > 0 {
+		engineCfg.Weather.FetchInterval = time.Duration(cfg.Weather.FetchMinutes) * time.Minute
+	}
+	if cfg.Weather.LookBackHours > 0 {
+		engineCfg.Weather.LookBack = time.Duration(cfg.Weather.LookBackHours) * time.Hour
+	}
+	if cfg.Weather.LookAheadHours > 0 {
+		engineCfg.Weather.LookAhead = time.Duration(cfg.Weather.LookAheadHours) * time.Hour
+	}
+	if cfg.Weather.SkipRainMM != nil {
+		engineCfg.Weather.SkipRainMM = *cfg.Weather.SkipRainMM
+	}
+	if cfg.Weather.ReduceRainMM != nil {
+		engineCfg.Weather.ReduceRainMM = *cfg.Weather.ReduceRainMM
+	}
+	engineCfg.Weather.ReferenceET = cfg.Weather.ReferenceETMM
+	if cfg.Weather.MinScale > 0 {
+		engineCfg.Weather.MinScale = cfg.Weather.MinScale
+	}
+	if cfg.Weather.MaxScale > 0 {
+		engineCfg.Weather.MaxScale = cfg.Weather.MaxScale
+	}
+	if cfg.Weather.MaxAgeHours > 0 {
+		engineCfg.Weather.MaxAge = time.Duration(cfg.Weather.MaxAgeHours) * time.Hour
+	}
+	if f := cfg.Fertigation; f.PreFlushMinutes != nil {
+		engineCfg.Fertigation.PreFlush = time.Duration(*f.PreFlushMinutes) * time.Minute
+	}
+	if f := cfg.Fertigation; f.PostFlushMinutes != nil {
+		engineCfg.Fertigation.PostFlush = time.Duration(*f.PostFlushMinutes) * time.Minute
+	}
+	for _, i := range cfg.Fertigation.Injectors {
+		engineCfg.Fertigation.Injectors = append(engineCfg.Fertigation.Injectors, engine.InjectorRef{ControllerUID: i.ControllerUID, Address: i.Address})
+	}
+	engineCfg.MoistureAlerts.DryPercent = cfg.MoistureAlerts.DryPercent
+	engineCfg.MoistureAlerts.WetPercent = cfg.MoistureAlerts.WetPercent
+	if cfg.MoistureAlerts.Hysteresis != nil {
+		engineCfg.MoistureAlerts.Hysteresis = *cfg.MoistureAlerts.Hysteresis
+	}
+	for _, z := range cfg.MoistureAlerts.Zones {
+		engineCfg.MoistureAlerts.Zones = append(engineCfg.MoistureAlerts.Zones, engine.ZoneMoisture{ZoneUID: z.ZoneUID, DryPercent: z.DryPercent, WetPercent: z.WetPercent})
+	}
+	if d := cfg.Drydown; d.WindowHours > 0 {
+		engineCfg.Drydown.Window = time.Duration(d.WindowHours) * time.Hour
+	}
+	if d := cfg.Drydown; d.MinSpanHours != nil {
+		engineCfg.Drydown.MinSpan = time.Duration(*d.MinSpanHours * float64(time.Hour))
+	}
+	if d := cfg.Drydown; d.RisePercent != nil {
+		engineCfg.Drydown.RisePercent = *d.RisePercent
+	}
+	if d := cfg.Drydown; d.TempCoefficient != nil {
+		engineCfg.Drydown.TempCoefficient = *d.TempCoefficient
+	}
+	engineCfg.Drydown.TargetPercent = cfg.Drydown.TargetPercent
+	if cfg.Drydown.SkipAheadHours < 0 {
+		return engine.Config{}, fmt.Errorf("drydown.skip_ahead_hours must not be negative")
+	}
+	engineCfg.Drydown.SkipAhead = time.Duration(cfg.Drydown.SkipAheadHours * float64(time.Hour))
+	if v := cfg.Validation; v.MinTemperatureC != nil {
+		engineCfg.Validation.MinTemperatureC = *v.MinTemperatureC
+	}
+	if v := cfg.Validation; v.MaxTemperatureC != nil {
+		engineCfg.Validation.MaxTemperatureC = *v.MaxTemperatureC
+	}
+	if v := cfg.Validation; v.MaxMoistureStep != nil {
+		engineCfg.Validation.MaxMoistureStep = *v.MaxMoistureStep
+	}
+	if cfg.Validation.StepWindowMinutes > 0 {
+		engineCfg.Validation.StepWindow = time.Duration(cfg.Validation.StepWindowMinutes) * time.Minute
+	}
+	if v := cfg.Validation; v.MeterDropL != nil {
+		engineCfg.Validation.MeterDropL = *v.MeterDropL
 	}
+	if engineCfg.Validation.MinTemperatureC >= engineCfg.Validation.MaxTemperatureC {
+		return engine.Config{}, fmt.Errorf("validation.min_temperature_c must be below max_temperature_c")
+	}
+	if d := cfg.DeviceLogs; d.HistoryDays != nil {
+		engineCfg.DeviceLogs.History = time.Duration(*d.HistoryDays) * 24 * time.Hour
+	}
+	engineCfg.DeviceLogs.Forward = cfg.DeviceLogs.Forward
+	if cfg.DeviceLogs.ForwardSeverity != "" {
+		severity, err := protocol.ParseLogSeverity(cfg.DeviceLogs.ForwardSeverity)
+		if err != nil {
+			return engine.Config{}, fmt.Errorf("device_logs.forward_severity: %w", err)
+		}
+		engineCfg.DeviceLogs.MinSeverity = severity
+	}
+	engineCfg.ActuatorHealth.MaxMA = cfg.ActuatorHealth.MaxMA
+	engineCfg.ActuatorHealth.MinMA = cfg.ActuatorHealth.MinMA
+	if h := cfg.ActuatorHealth; h.MaxMA > 0 && h.MinMA >= h.MaxMA {
+		return engine.Config{}, fmt.Errorf("actuator_health.min_ma must be below max_ma")
+	}
+	if h := cfg.ActuatorHealth; h.DriftPercent != nil {
+		if *h.DriftPercent < 0 || *h.DriftPercent >= 100 {
+			return engine.Config{}, fmt.Errorf("actuator_health.drift_percent must be between 0 and 100")
+		}
+		engineCfg.ActuatorHealth.DriftPercent = *h.DriftPercent
+	}
+	if cfg.ActuatorHealth.Recent > 0 {
+		engineCfg.ActuatorHealth.Recent = cfg.ActuatorHealth.Recent
+	}
+	if h := cfg.ActuatorHealth; h.Baseline != nil {
+		if *h.Baseline < 0 {
+			return engine.Config{}, fmt.Errorf("actuator_health.baseline must not be negative")
+		}
+		engineCfg.ActuatorHealth.Baseline = *h.Baseline
+	}
+	if h := cfg.ActuatorHealth; h.HistoryDays != nil {
+		engineCfg.ActuatorHealth.History = time.Duration(*h.HistoryDays) * 24 * time.Hour
+	}
+	engineCfg.PowerFail.CloseValves = cfg.PowerFail.CloseValves
+	if r := cfg.Reboots; r.LoopCount != nil {
+		if *r.LoopCount < 0 {
+			return engine.Config{}, fmt.Errorf("reboots.loop_count must not be negative")
+		}
+		engineCfg.Reboots.LoopCount = *r.LoopCount
+	}
+	if cfg.Reboots.LoopWindowHours > 0 {
+		engineCfg.Reboots.LoopWindow = time.Duration(cfg.Reboots.LoopWindowHours) * time.Hour
+	}
+	if h := cfg.FirmwareInventory.ResyncHours; h != nil {
+		if *h < 0 {
+			return engine.Config{}, fmt.Errorf("firmware_inventory.resync_hours must not be negative")
+		}
+		engineCfg.Inventory.ResyncInterval = time.Duration(*h) * time.Hour
+	}
+	if v := cfg.Spoofing; v.RSSIJumpDB != nil {
+		engineCfg.Spoofing.RSSIJump = *v.RSSIJumpDB
+	}
+	if cfg.Spoofing.MinSamples > 0 {
+		engineCfg.Spoofing.MinSamples = cfg.Spoofing.MinSamples
+	}
+	if v := cfg.Spoofing; v.SequenceJump != nil {
+		engineCfg.Spoofing.SequenceJump = *v.SequenceJump
+	}
+	engineCfg.Spoofing.Quarantine = cfg.Spoofing.Quarantine
+	if r := cfg.ReportIntervals; r.LowBatteryMinutes != nil {
+		engineCfg.ReportInterval.LowBattery = time.Duration(*r.LowBatteryMinutes) * time.Minute
+	}
+	if r := cfg.ReportIntervals; r.LowBatteryMV != nil {
+		engineCfg.ReportInterval.LowBatteryMV = *r.LowBatteryMV
+	}
+	if cfg.ReportIntervals.TimeoutMinutes > 0 {
+		engineCfg.ReportInterval.Timeout = time.Duration(cfg.ReportIntervals.TimeoutMinutes) * time.Minute
+	}
+	if r := cfg.ReportIntervals; r.Retries != nil {
+		engineCfg.ReportInterval.Retries = *r.Retries
+	}
+	if cfg.ScheduleAcks.TimeoutSeconds > 0 {
+		engineCfg.ScheduleAck.Timeout = time.Duration(cfg.ScheduleAcks.TimeoutSeconds) * time.Second
+	}
+	if r := cfg.ScheduleAcks.Retries; r != nil {
+		if *r < 0 {
+			return engine.Config{}, fmt.Errorf("schedule_acks.retries must not be negative")
+		}
+		engineCfg.ScheduleAck.Retries = *r
+	}
+	if cfg.MeterPins.TimeoutMinutes > 0 {
+		engineCfg.MeterPin.Timeout = time.Duration(cfg.MeterPins.TimeoutMinutes) * time.Minute
+	}
+	if r := cfg.MeterPins.Retries; r != nil {
+		if *r < 0 {
+			return engine.Config{}, fmt.Errorf("meter_pins.retries must not be negative")
+		}
+		engineCfg.MeterPin.Retries = *r
+	}
+	if c := cfg.MeterCalibration; c.AckTimeoutMinutes > 0 {
+		engineCfg.MeterCalibration.AckTimeout = time.Duration(c.AckTimeoutMinutes) * time.Minute
+	}
+	if m := cfg.MeterCalibration.MaxDurationMinutes; m != nil {
+		if *m < 0 {
+			return engine.Config{}, fmt.Errorf("meter_calibration.max_duration_minutes must not be negative")
+		}
+		engineCfg.MeterCalibration.MaxDuration = time.Duration(*m) * time.Minute
+	}
+	if p := cfg.MeterCalibration.MaxChangePercent; p != nil {
+		if *p < 0 {
+			return engine.Config{}, fmt.Errorf("meter_calibration.max_change_percent must not be negative")
+		}
+		engineCfg.MeterCalibration.MaxChange = *p / 100
+	}
+	if a := cfg.Acks; a.Enabled != nil {
+		engineCfg.Acks.Enabled = *a.Enabled
+	}
+	engineCfg.Acks.FlagsOnly = cfg.Acks.FlagsOnly
+	if cfg.OTA.FirmwareCacheDir != "" {
+		engineCfg.FirmwareCacheDir = cfg.OTA.FirmwareCacheDir
+	}
+	if n := cfg.OTA.ChunkSize; n != 0 {
+		if n < 16 || n > 1024 {
+			return engine.Config{}, fmt.Errorf("ota.chunk_size must be between 16 and 1024")
+		}
+		engineCfg.OTA.ChunkSize = uint16(n)
+	}
+	if cfg.OTA.ChunkTimeoutSeconds > 0 {
+		engineCfg.OTA.ChunkTimeout = secondsToDuration(cfg.OTA.ChunkTimeoutSeconds)
+	}
+	if cfg.OTA.ChunkRetries > 0 {
+		engineCfg.OTA.ChunkRetries = cfg.OTA.ChunkRetries
+	}
+	if cfg.OTA.AnnounceSeconds > 0 {
+		engineCfg.OTA.AnnounceInterval = secondsToDuration(cfg.OTA.AnnounceSeconds)
+	}
+	if o := cfg.OTA; o.WindowSize != nil {
+		if *o.WindowSize < 0 || *o.WindowSize > int(protocol.MaxOTAWindow) {
+			return engine.Config{}, fmt.Errorf("ota.window_size must be between 0 and %d", protocol.MaxOTAWindow)
+		}
+		engineCfg.OTA.WindowSize = uint8(*o.WindowSize)
+	}
+	if o := cfg.OTA; o.MulticastPacingSeconds != nil {
+		if *o.MulticastPacingSeconds < 0 {
+			return engine.Config{}, fmt.Errorf("ota.multicast_pacing_seconds must not be negative")
+		}
+		engineCfg.OTA.MulticastPacing = time.Duration(*o.MulticastPacingSeconds * float64(time.Second))
+	}
+	if o := cfg.OTA; o.AirtimePercent != nil {
+		if *o.AirtimePercent < 0 || *o.AirtimePercent > 100 {
+			return engine.Config{}, fmt.Errorf("ota.airtime_percent must be between 0 and 100")
+		}
+		engineCfg.OTA.AirtimeBudget = *o.AirtimePercent / 100
+	}
+	if cfg.OTA.AirtimeWindowSeconds > 0 {
+		engineCfg.OTA.AirtimeWindow = secondsToDuration(cfg.OTA.AirtimeWindowSeconds)
+	}
+	if o := cfg.OTA; o.PauseForCommands != nil {
+		engineCfg.OTA.PauseForCommands = *o.PauseForCommands
+	}
+	engineCfg.LowBandwidth.Enabled = cfg.LowBandwidth.Enabled
+	if cfg.LowBandwidth.BatchSize > 0 {
+		engineCfg.LowBandwidth.BatchSize = cfg.LowBandwidth.BatchSize
+	}
+	if cfg.LowBandwidth.SyncMinutes > 0 {
+		engineCfg.LowBandwidth.SyncInterval = time.Duration(cfg.LowBandwidth.SyncMinutes) * time.Minute
+	}
+	if b := cfg.LowBandwidth; b.AggregateMinutes != nil {
+		engineCfg.LowBandwidth.AggregateWindow = time.Duration(*b.AggregateMinutes) * time.Minute
+	}
+	for _, h := range []*int{cfg.LowBandwidth.FirmwareStartHour, cfg.LowBandwidth.FirmwareEndHour} {
+		if h != nil && (*h < 0 || *h > 23) {
+			return engine.Config{}, fmt.Errorf("low_bandwidth firmware hours must be between 0 and 23")
+		}
+	}
+	if b := cfg.LowBandwidth; b.FirmwareStartHour != nil {
+		engineCfg.LowBandwidth.FirmwareStartHour = *b.FirmwareStartHour
+	}
+	if b := cfg.LowBandwidth; b.FirmwareEndHour != nil {
+		engineCfg.LowBandwidth.FirmwareEndHour = *b.FirmwareEndHour
+	}
+	if cfg.Alerts.OfflineMinutes != nil {
+		engineCfg.Alerts.OfflineAfter = time.Duration(*cfg.Alerts.OfflineMinutes) * time.Minute
+	}
+	if cfg.Alerts.CloudOfflineMinutes != nil {
+		engineCfg.Alerts.CloudOffline = time.Duration(*cfg.Alerts.CloudOfflineMinutes) * time.Minute
+	}
+	if cfg.Alerts.FrostC != nil {
+		engineCfg.Alerts.Frost = true
+		engineCfg.Alerts.FrostC = *cfg.Alerts.FrostC
+	}
+	if cfg.Alerts.GatewayMinScore != nil {
+		if *cfg.Alerts.GatewayMinScore < 0 || *cfg.Alerts.GatewayMinScore > 100 {
+			return engine.Config{}, fmt.Errorf("alerts.gateway_min_score must be 0-100")
+		}
+		engineCfg.Alerts.GatewayMinScore = *cfg.Alerts.GatewayMinScore
+	}
+	if cfg.Alerts.GatewayWindowMin < 0 {
+		return engine.Config{}, fmt.Errorf("alerts.gateway_window_minutes must not be negative")
+	}
+	if cfg.Alerts.GatewayWindowMin > 0 {
+		engineCfg.Alerts.GatewayWindow = time.Duration(cfg.Alerts.GatewayWindowMin) * time.Minute
+	}
+	if n := cfg.Notifications; n.MinSeverity != "" {
+		switch n.MinSeverity {
+		case notify.SeverityInfo, notify.SeverityWarning, notify.SeverityCritical:
+			engineCfg.Notify.MinSeverity = n.MinSeverity
+		default:
+			return engine.Config{}, fmt.Errorf("notifications.min_severity must be info, warning, or critical")
+		}
+	}
+	if n := cfg.Notifications; n.RateLimit != nil {
+		engineCfg.Notify.RateLimit = *n.RateLimit
+	}
+	engineCfg.Notify.QuietStartHour = cfg.Notifications.QuietStartHour
+	engineCfg.Notify.QuietEndHour = cfg.Notifications.QuietEndHour
+	if cfg.Notifications.TimeoutSeconds > 0 {
+		engineCfg.Notify.Timeout = secondsToDuration(cfg.Notifications.TimeoutSeconds)
+	}
+	engineCfg.Notify.SMTP.Host = cfg.Notifications.SMTP.Host
+	if cfg.Notifications.SMTP.Port > 0 {
+		engineCfg.Notify.SMTP.Port = cfg.Notifications.SMTP.Port
+	}
+	engineCfg.Notify.SMTP.Username = cfg.Notifications.SMTP.Username
+	engineCfg.Notify.SMTP.Password = cfg.Notifications.SMTP.Password
+	engineCfg.Notify.SMTP.From = cfg.Notifications.SMTP.From
+	engineCfg.Notify.SMTP.To = cfg.Notifications.SMTP.To
+	engineCfg.Notify.Twilio.AccountSID = cfg.Notifications.Twilio.AccountSID
+	engineCfg.Notify.Twilio.AuthToken = cfg.Notifications.Twilio.AuthToken
+	engineCfg.Notify.Twilio.From = cfg.Notifications.Twilio.From
+	engineCfg.Notify.Twilio.To = cfg.Notifications.Twilio.To
+	engineCfg.Notify.Webhook.URL = cfg.Notifications.Webhook.URL
+	engineCfg.Notify.Webhook.Headers = cfg.Notifications.Webhook.Headers
 
-	log.Println("Shutdown complete")
-	return nil
+	return engineCfg, nil
 }
 
 func secondsToDuration(seconds int) time.Duration {
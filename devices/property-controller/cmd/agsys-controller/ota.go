@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/agsys/property-controller/internal/localapi"
+)
+
+var (
+	socketPath      string
+	apiToken        string
+	multicastListen time.Duration
+
+	otaCmd = &cobra.Command{
+		Use:   "ota",
+		Short: "Manage OTA firmware updates on the running controller",
+	}
+
+	otaStatusCmd = &cobra.Command{
+		Use:   "status",
+		Short: "Show OTA update progress",
+		RunE:  otaStatus,
+	}
+
+	otaStartCmd = &cobra.Command{
+		Use:   "start <device-uid>",
+		Short: "Queue an OTA update for a device",
+		Args:  cobra.ExactArgs(1),
+		RunE:  otaStart,
+	}
+
+	otaCancelCmd = &cobra.Command{
+		Use:   "cancel <device-uid>",
+		Short: "Cancel a pending or active OTA update",
+		Args:  cobra.ExactArgs(1),
+		RunE:  otaCancel,
+	}
+
+	otaMulticastCmd = &cobra.Command{
+		Use:   "multicast <device-type>",
+		Short: "Update every listening device of a type with one broadcast",
+		Long: `Announce a multicast OTA session for a device type. Devices that join within
+the listen window receive the firmware in a single broadcast, then any chunks
+they missed in unicast repair rounds.`,
+		Args: cobra.ExactArgs(1),
+		RunE: otaMulticast,
+	}
+
+	otaListFirmwareCmd = &cobra.Command{
+		Use:   "list-firmware",
+		Short: "List firmware images cached on the controller",
+		RunE:  otaListFirmware,
+	}
+)
+
+func init() {
+	otaCmd.PersistentFlags().StringVarP(&socketPath, "socket", "s", "", "Local API socket path (default from config)")
+	reloadCmd.Flags().StringVarP(&socketPath, "socket", "s", "", "Local API socket path (default from config)")
+
+	otaMulticastCmd.Flags().DurationVar(&multicastListen, "listen", 2*time.Minute, "How long devices can join before the broadcast starts")
+
+	otaCmd.AddCommand(otaStatusCmd)
+	otaCmd.AddCommand(otaStartCmd)
+	otaCmd.AddCommand(otaCancelCmd)
+	otaCmd.AddCommand(otaMulticastCmd)
+	otaCmd.AddCommand(otaListFirmwareCmd)
+}
+
+// localClient returns a client for the running controller's local API.
+// The socket comes from --socket, then the config file, then the default.
+// Commands that change state need a --token with a sufficient role.
+func localClient() *localapi.Client {
+	path := socketPath
+	if path == "" {
+		if cfg, err := loadConfig(configFile); err == nil && cfg.LocalAPI.Socket != "" {
+			path = cfg.LocalAPI.Socket
+		}
+	}
+	if path == "" {
+		path = localapi.DefaultConfig().SocketPath
+	}
+	client := localapi.NewClient(path)
+	client.SetToken(apiToken)
+	return client
+}
+
+func otaStatus(cmd *cobra.Command, args []string) error {
+	status, err := localClient().OTAStatus()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "DEVICE\tTYPE\tFROM\tTO\tSTATE\tPROGRESS\tLAST ACTIVITY\tERROR")
+	fmt.Fprintln(w, "------\t----\t----\t--\t-----\t--------\t-------------\t-----")
+
+	for _, u := range status.Updates {
+		progress := fmt.Sprintf("%d/%d", u.ChunksAcked, u.TotalChunks)
+		lastActivity := "-"
+		if !u.LastActivity.IsZero() {
+			lastActivity = u.LastActivity.Format(time.DateTime)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			u.DeviceUID, u.DeviceType, u.CurrentVersion, u.TargetVersion,
+			u.State, progress, lastActivity, u.ErrorMessage)
+	}
+	w.Flush()
+
+	if len(status.Pending) > 0 {
+		fmt.Println()
+		fmt.Println("Waiting for device to wake:")
+		for _, uid := range status.Pending {
+			fmt.Printf("  %s\n", uid)
+		}
+	}
+
+	if mc := status.Multicast; mc != nil {
+		fmt.Println()
+		fmt.Printf("Multicast session %d: type %d to v%s, %s, %d/%d chunks broadcast, %d devices\n",
+			mc.SessionID, mc.DeviceType, mc.TargetVersion, mc.State, mc.ChunksSent, mc.TotalChunks, len(mc.Members))
+	}
+	return nil
+}
+
+func otaStart(cmd *cobra.Command, args []string) error {
+	if err := localClient().OTAStart(args[0]); err != nil {
+		return err
+	}
+	fmt.Printf("OTA update queued for %s; it will start on the device's next check-in\n", args[0])
+	return nil
+}
+
+func otaCancel(cmd *cobra.Command, args []string) error {
+	if err := localClient().OTACancel(args[0]); err != nil {
+		return err
+	}
+	fmt.Printf("OTA update cancelled for %s\n", args[0])
+	return nil
+}
+
+func otaMulticast(cmd *cobra.Command, args []string) error {
+	deviceType, err := strconv.ParseUint(args[0], 10, 8)
+	if err != nil {
+		return fmt.Errorf("invalid device type %q", args[0])
+	}
+	session, err := localClient().OTAMulticast(uint8(deviceType), multicastListen)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Multicast session %d announced for device type %d v%s; devices can join until %s\n",
+		session.SessionID, session.DeviceType, session.TargetVersion, session.ListenUntil.Format(time.DateTime))
+	return nil
+}
+
+func otaListFirmware(cmd *cobra.Command, args []string) error {
+	firmware, err := localClient().OTAListFirmware()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TYPE\tVERSION\tSIZE\tCHUNKS\tCRC32\tFILE")
+	fmt.Fprintln(w, "----\t-------\t----\t------\t-----\t----")
+
+	for _, fw := range firmware {
+		fmt.Fprintf(w, "%d\t%s\t%d\t%d\t%08X\t%s\n",
+			fw.DeviceType, fw.Version, fw.Size, fw.ChunkCount, fw.CRC32, fw.FilePath)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix starts the environment variables that override config settings
+const envPrefix = "AGSYS_"
+
+// applyEnvOverrides sets config settings from AGSYS_* environment variables
+// named after their path in the file, e.g. AGSYS_CLOUD_API_KEY for
+// cloud.api_key. Strings are taken as they are; other values are parsed as
+// YAML, so lists can be given as [a, b]. A secret or secret file set in the
+// environment replaces the other form set in the file, so AGSYS_CLOUD_API_KEY
+// wins over a configured cloud.api_key_file.
+func applyEnvOverrides(cfg *Config) error {
+	return applyEnv(reflect.ValueOf(cfg).Elem(), envPrefix)
+}
+
+func applyEnv(v reflect.Value, prefix string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		tag := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		if tag == "" || tag == "-" {
+			continue
+		}
+		name := prefix + strings.ToUpper(tag)
+		field := v.Field(i)
+
+		if field.Kind() == reflect.Struct {
+			if err := applyEnv(field, name+"_"); err != nil {
+				return err
+			}
+			continue
+		}
+
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if field.Kind() == reflect.String {
+			field.SetString(value)
+		} else if err := yaml.Unmarshal([]byte(value), field.Addr().Interface()); err != nil {
+			return fmt.Errorf("invalid %s: %w", name, err)
+		}
+
+		if other, ok := secretCounterpart(v, tag); ok {
+			if _, set := os.LookupEnv(prefix + strings.ToUpper(other)); !set {
+				v.FieldByIndex(fieldByTag(t, other).Index).SetZero()
+			}
+		}
+	}
+	return nil
+}
+
+// secretCounterpart returns the other form of a secret setting, the file
+// for a key and the key for a file, if the struct has both
+func secretCounterpart(v reflect.Value, tag string) (string, bool) {
+	other := tag + "_file"
+	if key, ok := strings.CutSuffix(tag, "_file"); ok {
+		other = key
+	}
+	if f := fieldByTag(v.Type(), other); f.Index == nil || f.Type.Kind() != reflect.String {
+		return "", false
+	}
+	return other, true
+}
+
+// fieldByTag returns the struct field with a YAML tag, or a zero field
+func fieldByTag(t reflect.Type, tag string) reflect.StructField {
+	for i := 0; i < t.NumField(); i++ {
+		if strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0] == tag {
+			return t.Field(i)
+		}
+	}
+	return reflect.StructField{}
+}
+
+// readSecret returns a secret set either in the config file or in a file of
+// its own, such as a Docker secret or systemd credential. A relative path is
+// looked up in systemd's credentials directory when the service has one.
+func readSecret(value, path, name string) (string, error) {
+	if path == "" {
+		return value, nil
+	}
+	if value != "" {
+		return "", fmt.Errorf("set %s or %s_file, not both", name, name)
+	}
+
+	if dir := os.Getenv("CREDENTIALS_DIRECTORY"); dir != "" && !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s_file: %w", name, err)
+	}
+	secret := strings.TrimSpace(string(data))
+	if secret == "" {
+		return "", fmt.Errorf("%s_file %s is empty", name, path)
+	}
+	return secret, nil
+}
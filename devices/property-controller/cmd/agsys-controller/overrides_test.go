@@ -0,0 +1,164 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+// TestApplyEnvOverrides tests that AGSYS_* variables override settings of
+// every kind, and that a secret from the environment replaces the file's
+func TestApplyEnvOverrides(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		env     map[string]string
+		check   func(*Config) bool
+		wantErr bool
+	}{
+		{
+			name:  "string",
+			file:  "controller:\n  id: from-file\n",
+			env:   map[string]string{"AGSYS_CONTROLLER_ID": "from-env"},
+			check: func(c *Config) bool { return c.Controller.ID == "from-env" },
+		},
+		{
+			name:  "number",
+			env:   map[string]string{"AGSYS_TIMING_SYNC_INTERVAL": "45"},
+			check: func(c *Config) bool { return c.Timing.SyncInterval == 45 },
+		},
+		{
+			name:  "pointer",
+			env:   map[string]string{"AGSYS_LORA_DUPLICATE_WINDOW_SECONDS": "0"},
+			check: func(c *Config) bool { return c.LoRa.DuplicateWindow != nil && *c.LoRa.DuplicateWindow == 0 },
+		},
+		{
+			name: "list",
+			env:  map[string]string{"AGSYS_CLOUD_FALLBACK_ADDRS": "[a.example:443, b.example:443]"},
+			check: func(c *Config) bool {
+				return slices.Equal(c.Cloud.FallbackAddrs, []string{"a.example:443", "b.example:443"})
+			},
+		},
+		{
+			name:  "nested struct",
+			env:   map[string]string{"AGSYS_DATABASE_POSTGRES_DSN": "postgres://db/agsys"},
+			check: func(c *Config) bool { return c.Database.Postgres.DSN == "postgres://db/agsys" },
+		},
+		{
+			name:  "unset keeps the file",
+			file:  "timing:\n  sync_interval: 30\n",
+			check: func(c *Config) bool { return c.Timing.SyncInterval == 30 },
+		},
+		{
+			name:    "invalid number",
+			env:     map[string]string{"AGSYS_TIMING_SYNC_INTERVAL": "soon"},
+			wantErr: true,
+		},
+		{
+			name: "key replaces the file's key file",
+			file: "cloud:\n  api_key_file: cloud-api-key\n",
+			env:  map[string]string{"AGSYS_CLOUD_API_KEY": "secret"},
+			check: func(c *Config) bool {
+				return c.Cloud.APIKey == "secret" && c.Cloud.APIKeyFile == ""
+			},
+		},
+		{
+			name: "key file replaces the file's key",
+			file: "lora:\n  aes_key: 00112233445566778899aabbccddeeff\n",
+			env:  map[string]string{"AGSYS_LORA_AES_KEY_FILE": "/run/secrets/lora_aes_key"},
+			check: func(c *Config) bool {
+				return c.LoRa.AESKey == "" && c.LoRa.AESKeyFile == "/run/secrets/lora_aes_key"
+			},
+		},
+		{
+			name: "key and key file both from the environment",
+			env:  map[string]string{"AGSYS_CLOUD_API_KEY": "secret", "AGSYS_CLOUD_API_KEY_FILE": "cloud-api-key"},
+			check: func(c *Config) bool {
+				return c.Cloud.APIKey == "secret" && c.Cloud.APIKeyFile == "cloud-api-key"
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			cfg := &Config{}
+			if err := yaml.Unmarshal([]byte(tt.file), cfg); err != nil {
+				t.Fatalf("Unmarshal failed: %v", err)
+			}
+
+			err := applyEnvOverrides(cfg)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("Expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("applyEnvOverrides failed: %v", err)
+			}
+			if !tt.check(cfg) {
+				t.Errorf("Config after overrides = %+v", cfg)
+			}
+		})
+	}
+}
+
+// TestReadSecret tests reading secrets from the config or their own files
+func TestReadSecret(t *testing.T) {
+	dir := t.TempDir()
+	credentials := t.TempDir()
+	write := func(dir, name, data string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+		return path
+	}
+	secretFile := write(dir, "secret", "  from-file\n")
+	emptyFile := write(dir, "empty", "\n")
+	write(credentials, "cloud-api-key", "from-credential\n")
+
+	tests := []struct {
+		name        string
+		value       string
+		path        string
+		credentials string
+		want        string
+		wantErr     bool
+	}{
+		{name: "value", value: "from-config", want: "from-config"},
+		{name: "neither", want: ""},
+		{name: "file", path: secretFile, want: "from-file"},
+		{name: "both", value: "from-config", path: secretFile, wantErr: true},
+		{name: "credential", path: "cloud-api-key", credentials: credentials, want: "from-credential"},
+		{name: "absolute path skips credentials", path: secretFile, credentials: credentials, want: "from-file"},
+		{name: "relative path without credentials", path: "cloud-api-key", wantErr: true},
+		{name: "empty file", path: emptyFile, wantErr: true},
+		{name: "missing file", path: filepath.Join(dir, "missing"), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("CREDENTIALS_DIRECTORY", tt.credentials)
+			got, err := readSecret(tt.value, tt.path, "cloud.api_key")
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("readSecret = %q, expected an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readSecret failed: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("readSecret = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/agsys/property-controller/internal/engine"
+	"github.com/agsys/property-controller/internal/sdnotify"
+	"github.com/agsys/property-controller/internal/storage"
+)
+
+// property is one property served by the controller process: the config
+// file it was loaded from and its engine. The main config file is the first
+// property; its properties list names the rest.
+type property struct {
+	configPath string
+	config     engine.Config
+	engine     *engine.Engine
+}
+
+// loadProperties builds the engine settings of every property from the main
+// config and the property files it lists, rejecting properties that would
+// share a database, controller ID, or listener
+func loadProperties(cfg *Config) ([]*property, error) {
+	engineCfg, err := buildEngineConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	props := []*property{{configPath: configFile, config: engineCfg}}
+
+	for _, path := range cfg.Properties {
+		propCfg, err := parseConfig(path)
+		if err != nil {
+			return nil, fmt.Errorf("property %s: %w", path, err)
+		}
+		if len(propCfg.Properties) > 0 {
+			return nil, fmt.Errorf("property %s: properties can only be listed in the main config", path)
+		}
+		engineCfg, err := buildEngineConfig(propCfg)
+		if err != nil {
+			return nil, fmt.Errorf("property %s: %w", path, err)
+		}
+		props = append(props, &property{configPath: path, config: engineCfg})
+	}
+
+	if err := checkProperties(props); err != nil {
+		return nil, err
+	}
+	return props, nil
+}
+
+// checkProperties rejects properties that would collide in one process
+func checkProperties(props []*property) error {
+	checks := []struct {
+		name  string
+		value func(engine.Config) string
+	}{
+		{"controller.id", func(c engine.Config) string { return c.ControllerID }},
+		{"database.path", func(c engine.Config) string {
+			if c.DatabaseDriver == storage.DriverPostgres {
+				return ""
+			}
+			return c.DatabasePath
+		}},
+		{"database.postgres.dsn", func(c engine.Config) string { return c.Postgres.DSN }},
+		{"local_api.socket", func(c engine.Config) string { return c.LocalAPISocket }},
+		{"local_api.listen", func(c engine.Config) string { return c.LocalAPIListen }},
+		{"modbus.listen", func(c engine.Config) string { return c.Modbus.Listen }},
+	}
+	for _, check := range checks {
+		seen := make(map[string]string)
+		for _, p := range props {
+			value := check.value(p.config)
+			if value == "" {
+				continue
+			}
+			if other, ok := seen[value]; ok {
+				return fmt.Errorf("%s and %s have the same %s %q", other, p.configPath, check.name, value)
+			}
+			seen[value] = p.configPath
+		}
+	}
+	return nil
+}
+
+// sameProperties reports whether a reloaded config lists the properties
+// running now
+func sameProperties(props []*property, cfg *Config) bool {
+	paths := make([]string, 0, len(props)-1)
+	for _, p := range props[1:] {
+		paths = append(paths, p.configPath)
+	}
+	return slices.Equal(paths, cfg.Properties)
+}
+
+// watchdogGate sends the systemd keepalive once every engine has vouched
+// for its loops since the last one, so a single hung property still gets
+// the process restarted
+type watchdogGate struct {
+	mu    sync.Mutex
+	n     int
+	ready map[int]bool
+}
+
+func newWatchdogGate(n int) *watchdogGate {
+	return &watchdogGate{n: n, ready: make(map[int]bool)}
+}
+
+// notifier returns the keepalive function of the i'th engine
+func (g *watchdogGate) notifier(i int) func() error {
+	return func() error {
+		g.mu.Lock()
+		g.ready[i] = true
+		all := len(g.ready) == g.n
+		if all {
+			clear(g.ready)
+		}
+		g.mu.Unlock()
+
+		if !all {
+			return nil
+		}
+		return sdnotify.Watchdog()
+	}
+}
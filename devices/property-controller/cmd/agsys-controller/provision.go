@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+
+	"github.com/agsys/property-controller/internal/cloud"
+	"github.com/agsys/property-controller/internal/engine"
+	"github.com/agsys/property-controller/internal/storage"
+)
+
+var (
+	provisionURL      string
+	provisionDatabase string
+	provisionForce    bool
+
+	provisionCmd = &cobra.Command{
+		Use:   "provision <claim-code>",
+		Short: "Enroll a new controller with the cloud and write its config",
+		Long: `Enroll this controller with the AgSys cloud using the claim code shown
+for the property in the AgSys app, then write the config file (--config) with
+the controller ID and API key the cloud assigns, and create the database.
+
+The claim code can only be used once. The config file is written before the
+database is created, so the credentials are kept even if that step fails.
+Settings not returned by the cloud are left at their defaults; edit the file
+afterwards to change them.`,
+		Args: cobra.ExactArgs(1),
+		RunE: provision,
+	}
+)
+
+// provisionTimeout bounds the enrollment request
+const provisionTimeout = 30 * time.Second
+
+func init() {
+	provisionCmd.Flags().StringVar(&provisionURL, "enroll-url", cloud.DefaultEnrollURL, "Cloud enrollment endpoint")
+	provisionCmd.Flags().StringVar(&provisionDatabase, "database", engine.DefaultConfig().DatabasePath, "Database to create")
+	provisionCmd.Flags().BoolVar(&provisionForce, "force", false, "Replace an existing config file")
+}
+
+// provisionedConfig is the config file written for a new controller
+type provisionedConfig struct {
+	Controller struct {
+		ID string `yaml:"id"`
+	} `yaml:"controller"`
+
+	Property struct {
+		UID  string `yaml:"uid,omitempty"`
+		Name string `yaml:"name,omitempty"`
+	} `yaml:"property,omitempty"`
+
+	Cloud struct {
+		GRPCAddr string `yaml:"grpc_addr,omitempty"`
+		APIKey   string `yaml:"api_key"`
+		UseTLS   bool   `yaml:"use_tls"`
+	} `yaml:"cloud"`
+
+	LoRa struct {
+		AESKey string `yaml:"aes_key,omitempty"`
+	} `yaml:"lora,omitempty"`
+
+	Database struct {
+		Path string `yaml:"path"`
+	} `yaml:"database"`
+}
+
+func provision(cmd *cobra.Command, args []string) error {
+	if _, err := os.Stat(configFile); err == nil && !provisionForce {
+		return fmt.Errorf("%s already exists; use --force to replace it", configFile)
+	}
+
+	// The instance ID identifies this installation to the cloud, which
+	// assigns the controller ID
+	hostname, _ := os.Hostname()
+	req := cloud.EnrollRequest{
+		ClaimCode:       args[0],
+		InstanceID:      uuid.NewString(),
+		Hostname:        hostname,
+		FirmwareVersion: engine.DefaultConfig().FirmwareVersion,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), provisionTimeout)
+	defer cancel()
+	enrollment, err := cloud.Enroll(ctx, provisionURL, req)
+	if err != nil {
+		return fmt.Errorf("failed to enroll: %w", err)
+	}
+
+	var cfg provisionedConfig
+	cfg.Controller.ID = enrollment.ControllerID
+	cfg.Property.UID = enrollment.PropertyUID
+	cfg.Property.Name = enrollment.PropertyName
+	cfg.Cloud.GRPCAddr = enrollment.GRPCAddr
+	cfg.Cloud.APIKey = enrollment.APIKey
+	cfg.Cloud.UseTLS = enrollment.UseTLS
+	cfg.LoRa.AESKey = enrollment.AESKey
+	cfg.Database.Path = provisionDatabase
+	if err := writeProvisionedConfig(configFile, &cfg); err != nil {
+		return err
+	}
+
+	// Check the cloud's answer makes a config the controller will run with
+	loaded, err := parseConfig(configFile)
+	if err != nil {
+		return err
+	}
+	if _, err := buildEngineConfig(loaded); err != nil {
+		return fmt.Errorf("enrolled, but %s is invalid: %w", configFile, err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(provisionDatabase), 0755); err != nil {
+		return fmt.Errorf("failed to create database directory: %w", err)
+	}
+	db, err := storage.Open(provisionDatabase)
+	if err != nil {
+		return fmt.Errorf("failed to create database: %w", err)
+	}
+	if err := db.Close(); err != nil {
+		return fmt.Errorf("failed to create database: %w", err)
+	}
+
+	fmt.Printf("Enrolled as controller %s", enrollment.ControllerID)
+	if enrollment.PropertyName != "" {
+		fmt.Printf(" for %s", enrollment.PropertyName)
+	}
+	fmt.Println()
+	fmt.Printf("Wrote %s and created %s\n", configFile, provisionDatabase)
+	if enrollment.AESKey == "" {
+		fmt.Println("The property has no LoRa network key yet; set lora.aes_key before adding devices")
+	}
+	return nil
+}
+
+// writeProvisionedConfig writes the config file readable only by its owner,
+// since it holds the API key. It is written in place of any existing file
+// only once complete.
+func writeProvisionedConfig(path string, cfg *provisionedConfig) error {
+	var buf bytes.Buffer
+	buf.WriteString("# AgSys Property Controller Configuration\n# Written by agsys-controller provision\n\n")
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(cfg); err != nil {
+		return fmt.Errorf("failed to encode config: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create config directory: %w", err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return fmt.Errorf("failed to write config: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write config: %w", err)
+	}
+	return nil
+}
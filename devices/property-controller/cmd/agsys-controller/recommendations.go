@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+)
+
+var recommendationsCmd = &cobra.Command{
+	Use:   "recommendations",
+	Short: "Show when each zone is expected to need water",
+	Long: `Show the soil drydown model's prediction for each zone with soil sensors: its
+average moisture, how fast it has been drying since it was last wetted, and
+how many hours until it reaches its target moisture.`,
+	Args: cobra.NoArgs,
+	RunE: listRecommendations,
+}
+
+func init() {
+	recommendationsCmd.Flags().StringVarP(&socketPath, "socket", "s", "", "Local API socket path (default from config)")
+}
+
+func listRecommendations(cmd *cobra.Command, args []string) error {
+	recs, err := localClient().Recommendations()
+	if err != nil {
+		return err
+	}
+	if len(recs) == 0 {
+		fmt.Println("No zones with soil sensors")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ZONE\tPROBES\tMOISTURE\tTARGET\tRATE %/H\tWATER IN\tWATER BY\tNOTE")
+	fmt.Fprintln(w, "----\t------\t--------\t------\t--------\t--------\t--------\t----")
+
+	for _, r := range recs {
+		zone := r.ZoneID
+		if r.ZoneName != "" {
+			zone = r.ZoneName
+		}
+		waterIn, waterBy, note := "-", "-", r.Reason
+		if r.WaterInHours != nil {
+			waterIn = fmt.Sprintf("%.1fh", *r.WaterInHours)
+			waterBy = r.WaterBy.Local().Format("Jan 2 15:04")
+		}
+		if r.SkipRuns {
+			note = "scheduled runs skipped"
+		}
+		fmt.Fprintf(w, "%s\t%d\t%.1f%%\t%d%%\t%.2f\t%s\t%s\t%s\n",
+			zone, r.Probes, r.MoisturePercent, r.TargetPercent, r.DryingRate, waterIn, waterBy, note)
+	}
+	w.Flush()
+	return nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/agsys/property-controller/internal/engine"
+	"github.com/agsys/property-controller/internal/lora"
+	"github.com/agsys/property-controller/internal/notify"
+	"github.com/agsys/property-controller/internal/protocol"
+	"github.com/agsys/property-controller/internal/storage"
+)
+
+var (
+	replayDatabase string
+	replayRealtime bool
+	replaySettle   time.Duration
+
+	replayCmd = &cobra.Command{
+		Use:   "replay <capture>",
+		Short: "Feed a LoRa capture back through the engine offline",
+		Long: `Feed the uplinks of a capture file (lora.capture_file) back through an
+engine built from the config file, to reproduce field issues offline.
+
+The engine runs against a copy of the configured database unless --database
+names one, and never reaches the cloud, the radio, or the local API.
+Downlinks it would send are logged instead. Uplinks are replayed in the clear
+as captured, so no keys are needed; those that couldn't be decrypted when
+captured are skipped. The database is left in place afterwards for
+agsys-db --database.`,
+		Args: cobra.ExactArgs(1),
+		RunE: replay,
+	}
+)
+
+func init() {
+	replayCmd.Flags().StringVar(&replayDatabase, "database", "", "Database to replay into (default a copy of the configured one)")
+	replayCmd.Flags().BoolVar(&replayRealtime, "realtime", false, "Keep the captured time between uplinks")
+	replayCmd.Flags().DurationVar(&replaySettle, "settle", 2*time.Second, "How long to keep the engine running after the last uplink")
+}
+
+// errOffline refuses the cloud connection of a replaying engine
+var errOffline = errors.New("replay runs offline")
+
+func replay(cmd *cobra.Command, args []string) error {
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	records, err := lora.ReadCapture(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	cfg, err := loadConfig(configFile)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+	engineCfg, err := buildEngineConfig(cfg)
+	if err != nil {
+		return err
+	}
+
+	dbPath := replayDatabase
+	if dbPath == "" {
+		dir, err := os.MkdirTemp("", "agsys-replay-")
+		if err != nil {
+			return err
+		}
+		dbPath = filepath.Join(dir, "controller.db")
+		if err := snapshotDatabase(engineCfg.DatabasePath, dbPath); err != nil {
+			return err
+		}
+	}
+
+	// Cut the engine off from everything but the capture
+	radio := newReplayRadio()
+	engineCfg.DatabasePath = dbPath
+	engineCfg.Radio = radio
+	engineCfg.AESKey = nil
+	engineCfg.LoRa.DeviceKeys = false
+	engineCfg.LoRa.EventURL = ""
+	engineCfg.LoRa.Gateways = nil
+	engineCfg.LoRa.CaptureFile = ""
+	engineCfg.CloudDialer = func(ctx context.Context, addr string) (net.Conn, error) { return nil, errOffline }
+	engineCfg.LocalAPISocket = ""
+	engineCfg.LocalAPIListen = ""
+	engineCfg.Modbus.Listen = ""
+	engineCfg.Maintenance.BackupDir = ""
+	engineCfg.Weather.OpenWeather.APIKey = ""
+	engineCfg.Notify = notify.DefaultConfig()
+
+	e, err := engine.New(engineCfg)
+	if err != nil {
+		return fmt.Errorf("failed to create engine: %w", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := e.Start(ctx); err != nil {
+		return fmt.Errorf("failed to start engine: %w", err)
+	}
+
+	var replayed, skipped int
+	var last time.Time
+	for _, rec := range records {
+		if rec.Dir != lora.CaptureRx {
+			continue
+		}
+		if rec.Frame == nil {
+			skipped++
+			continue
+		}
+		msg, err := protocol.Decode(rec.Frame)
+		if err != nil {
+			log.Printf("Skipping uplink captured at %s: %v", rec.Time.Format(time.DateTime), err)
+			skipped++
+			continue
+		}
+		msg.RSSI, msg.SNR = rec.RSSI, rec.SNR
+
+		if replayRealtime && !last.IsZero() && rec.Time.After(last) {
+			time.Sleep(rec.Time.Sub(last))
+		}
+		last = rec.Time
+		radio.uplinks <- msg
+		replayed++
+	}
+
+	time.Sleep(replaySettle)
+	if err := e.Stop(); err != nil {
+		log.Printf("Error stopping engine: %v", err)
+	}
+
+	fmt.Printf("Replayed %d uplinks (%d skipped) into %s\n", replayed, skipped, dbPath)
+	return nil
+}
+
+// snapshotDatabase copies the database at src to dst, so a replay doesn't
+// change it
+func snapshotDatabase(src, dst string) error {
+	db, err := storage.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open database: %w", err)
+	}
+	defer db.Close()
+	if err := db.Backup(context.Background(), dst); err != nil {
+		return fmt.Errorf("failed to copy database: %w", err)
+	}
+	return nil
+}
+
+// replayRadio hands captured uplinks to the driver and logs the downlinks
+// the engine sends in reply
+type replayRadio struct {
+	uplinks chan *protocol.LoRaMessage
+}
+
+func newReplayRadio() *replayRadio {
+	return &replayRadio{uplinks: make(chan *protocol.LoRaMessage)}
+}
+
+// Receive implements lora.Radio
+func (r *replayRadio) Receive() (*protocol.LoRaMessage, error) {
+	select {
+	case msg := <-r.uplinks:
+		return msg, nil
+	case <-time.After(10 * time.Millisecond):
+		return nil, nil
+	}
+}
+
+// Transmit implements lora.Radio
+func (r *replayRadio) Transmit(data []byte, sf uint8, txPower int8) error {
+	msg, err := protocol.Decode(data)
+	if err != nil {
+		log.Printf("Replay TX: %d bytes (not sent)", len(data))
+		return nil
+	}
+	log.Printf("Replay TX to %s: type 0x%02X, %d bytes (not sent)", msg.DeviceUIDString(), msg.Header.MsgType, len(msg.Payload))
+	return nil
+}
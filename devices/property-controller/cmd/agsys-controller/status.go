@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	statusJSON bool
+
+	statusCmd = &cobra.Command{
+		Use:   "status",
+		Short: "Show health of the running controller",
+		Long: `Show cloud connection state, LoRa driver state, device counts, records
+waiting to sync, unexpected device reboots, pending commands, OTA activity, and
+lifetime counters of the running controller.`,
+		RunE: showStatus,
+	}
+)
+
+func init() {
+	statusCmd.Flags().StringVarP(&socketPath, "socket", "s", "", "Local API socket path (default from config)")
+	statusCmd.Flags().BoolVar(&statusJSON, "json", false, "Print raw JSON")
+}
+
+func showStatus(cmd *cobra.Command, args []string) error {
+	status, err := localClient().Status()
+	if err != nil {
+		return err
+	}
+
+	if statusJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(status)
+	}
+
+	cloud := "disconnected"
+	if status.Cloud.Connected {
+		cloud = "connected"
+	} else if status.Cloud.Failure != "" {
+		cloud = fmt.Sprintf("disconnected, %s failure: %s", status.Cloud.Failure, status.Cloud.Error)
+	}
+	radio := "stopped"
+	if status.LoRa.Running {
+		radio = "running"
+	}
+
+	if stop := status.EmergencyStop; stop != nil {
+		fmt.Printf("EMERGENCY STOP in force since %s (%s", stop.StoppedAt.Format(time.DateTime), stop.Source)
+		if stop.Reason != "" {
+			fmt.Printf(": %s", stop.Reason)
+		}
+		fmt.Printf("), %d valves closed; valves cannot open until re-armed\n\n", stop.ValvesClosed)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Controller:\t%s (firmware %s)\n", status.ControllerID, status.FirmwareVersion)
+	fmt.Fprintf(w, "Uptime:\t%s\n", time.Since(status.StartedAt).Round(time.Second))
+	fmt.Fprintf(w, "Cloud:\t%s (%s)\n", cloud, status.Cloud.ServerAddr)
+	mode := ""
+	if status.Cloud.LowBandwidth {
+		mode = ", low-bandwidth mode"
+	}
+	fmt.Fprintf(w, "Cloud usage:\t%.1f MB up, %.1f MB down in %s%s\n",
+		float64(status.Cloud.Usage.BytesUp)/(1024*1024), float64(status.Cloud.Usage.BytesDown)/(1024*1024),
+		status.Cloud.Usage.Month, mode)
+	fmt.Fprintf(w, "LoRa:\t%s at %.1f MHz, last RX %s\n",
+		radio, float64(status.LoRa.Frequency)/1e6, agoString(status.LoRa.LastRx))
+	fmt.Fprintf(w, "Packets:\t%d RX (%d duplicates, %d throttled dropped), %d TX (%d errors, %d skipped busy, %d queued, %d awaiting uplinks)\n",
+		status.LoRa.RxPackets, status.LoRa.DuplicatesDropped, status.LoRa.ThrottledDropped,
+		status.LoRa.TxPackets, status.LoRa.TxErrors, status.LoRa.TxSkipped, status.LoRa.TxQueued, status.LoRa.TxWindow)
+	if status.LoRa.Legacy > 0 {
+		fmt.Fprintf(w, "Device keys:\t%d devices still on the network key\n", status.LoRa.Legacy)
+	}
+	for _, g := range status.LoRa.Gateways {
+		fmt.Fprintf(w, "Gateway %s:\thealth %d, %d/%d RX CRC ok, %d/%d TX emitted, last report %s\n",
+			g.GatewayID, g.Score, g.RxOK, g.RxReceived, g.TxEmitted, g.TxReceived, agoString(g.LastReport))
+	}
+	w.Flush()
+
+	fmt.Println()
+	fmt.Println("Devices:")
+	types := make([]string, 0, len(status.Devices))
+	for t := range status.Devices {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	if len(types) == 0 {
+		fmt.Println("  none")
+	}
+	for _, t := range types {
+		fmt.Printf("  %-18s %d\n", t, status.Devices[t])
+	}
+
+	fmt.Println()
+	fmt.Println("Waiting to sync:")
+	fmt.Printf("  %-18s %d\n", "soil readings", status.Unsynced.SoilReadings)
+	fmt.Printf("  %-18s %d\n", "meter readings", status.Unsynced.MeterReadings)
+	fmt.Printf("  %-18s %d\n", "alerts", status.Unsynced.Alerts)
+	fmt.Printf("  %-18s %d\n", "valve events", status.Unsynced.ValveEvents)
+
+	if len(status.Reboots) > 0 {
+		fmt.Println()
+		fmt.Println("Unexpected reboots in the last day:")
+		for _, r := range status.Reboots {
+			fmt.Printf("  %-18s %d\n", r.DeviceUID, r.Unexpected)
+		}
+	}
+
+	fmt.Println()
+	fmt.Printf("Commands: %d pending, %d failed\n", status.Commands.Pending, status.Commands.Failed)
+	fmt.Printf("OTA: %d active, %d waiting for device\n", len(status.OTA.Updates), len(status.OTA.Pending))
+	for _, u := range status.OTA.Updates {
+		fmt.Printf("  %s %s -> %s %s %d/%d\n", u.DeviceUID, u.CurrentVersion, u.TargetVersion,
+			u.State, u.ChunksAcked, u.TotalChunks)
+	}
+
+	life := status.Lifetime
+	fmt.Println()
+	fmt.Println("Lifetime:")
+	fmt.Printf("  %-18s %d RX, %d TX, %d skipped busy\n", "radio packets", life.RadioRxPackets, life.RadioTxPackets, life.RadioTxSkipped)
+	fmt.Printf("  %-18s %d decode failures, %d duplicates, %d throttled\n", "uplinks",
+		life.DecodeFailures, life.DuplicatesDropped, life.ThrottledDropped)
+	fmt.Printf("  %-18s %d sent, %d acked, %d failed\n", "commands",
+		life.CommandsSent, life.CommandsAcked, life.CommandsFailed)
+	fmt.Printf("  %-18s %d batches sent, %d failed\n", "cloud sync", life.SyncSucceeded, life.SyncFailed)
+	msgTypes := make([]string, 0, len(life.Messages))
+	for t := range life.Messages {
+		msgTypes = append(msgTypes, t)
+	}
+	sort.Strings(msgTypes)
+	for _, t := range msgTypes {
+		fmt.Printf("  %-18s %d\n", "type "+t, life.Messages[t])
+	}
+	return nil
+}
+
+// agoString formats the time elapsed since t, or "never" for a zero time
+func agoString(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return time.Since(t).Round(time.Second).String() + " ago"
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+)
+
+var valvesCmd = &cobra.Command{
+	Use:   "valves",
+	Short: "List valve actuators with their names and zones",
+	RunE:  listValves,
+}
+
+func init() {
+	valvesCmd.Flags().StringVarP(&socketPath, "socket", "s", "", "Local API socket path (default from config)")
+}
+
+func listValves(cmd *cobra.Command, args []string) error {
+	valves, err := localClient().Valves()
+	if err != nil {
+		return err
+	}
+	if len(valves) == 0 {
+		fmt.Println("No valve actuators")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "UID\tNAME\tALIAS\tZONE\tSTATE\tVALVE ID")
+	fmt.Fprintln(w, "---\t----\t-----\t----\t-----\t--------")
+
+	for _, v := range valves {
+		alias, zone, valveID := "-", "-", "-"
+		if v.Alias != "" {
+			alias = v.Alias
+		}
+		if v.ZoneName != "" {
+			zone = v.ZoneName
+		} else if v.ZoneID != "" {
+			zone = v.ZoneID
+		}
+		if v.ValveID != "" {
+			valveID = v.ValveID
+		}
+		state := v.State
+		if v.OverrideUntil != nil {
+			state += fmt.Sprintf(" (manual until %s)", v.OverrideUntil.Local().Format("15:04"))
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", v.UID, v.Name, alias, zone, state, valveID)
+	}
+	w.Flush()
+	return nil
+}
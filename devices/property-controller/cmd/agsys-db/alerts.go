@@ -0,0 +1,133 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/agsys/property-controller/internal/localapi"
+)
+
+var (
+	alertsAll    bool
+	alertsDevice string
+
+	alertsCmd = &cobra.Command{
+		Use:   "alerts",
+		Short: "Show alerts",
+		Long: `Show alerts raised by the controller: meter alarms, offline devices, low
+battery, failed valve commands, and soil moisture thresholds. Only open
+(active or acknowledged) alerts are shown unless --all is given.`,
+		RunE: showAlerts,
+	}
+
+	alertsAckCmd = &cobra.Command{
+		Use:   "ack <id>",
+		Short: "Acknowledge an active alert",
+		Long: `Mark an active alert as acknowledged. It stays open until its condition
+clears. Needs --rw and an operator --token.`,
+		Args: cobra.ExactArgs(1),
+		RunE: ackAlert,
+	}
+)
+
+func init() {
+	alertsCmd.Flags().BoolVarP(&alertsAll, "all", "a", false, "Include cleared alerts")
+	alertsCmd.Flags().StringVar(&alertsDevice, "device", "", "Only show this device UID")
+	alertsCmd.Flags().IntVarP(&limit, "limit", "n", 50, "Number of records to show")
+	alertsCmd.AddCommand(alertsAckCmd)
+}
+
+func showAlerts(cmd *cobra.Command, args []string) error {
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`SELECT id, state, severity, alert_type, device_uid, probe_id, count,
+		timestamp, last_seen, cleared_at, synced_to_cloud, COALESCE(message, '')
+		FROM alerts WHERE (? OR state != 'cleared') AND (? = '' OR device_uid = ?)
+		ORDER BY timestamp DESC LIMIT ?`, alertsAll, alertsDevice, alertsDevice, limit)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSTATE\tSEVERITY\tTYPE\tDEVICE\tPROBE\tCOUNT\tRAISED\tLAST SEEN\tCLEARED\tSYNC\tMESSAGE")
+	fmt.Fprintln(w, "--\t-----\t--------\t----\t------\t-----\t-----\t------\t---------\t-------\t----\t-------")
+
+	for rows.Next() {
+		var id int64
+		var state, severity, alertType, deviceUID, message string
+		var probeID, count int
+		var raised time.Time
+		var lastSeen, clearedAt sql.NullTime
+		var synced bool
+
+		if err := rows.Scan(&id, &state, &severity, &alertType, &deviceUID, &probeID, &count,
+			&raised, &lastSeen, &clearedAt, &synced, &message); err != nil {
+			return err
+		}
+
+		lastStr, clearedStr := "-", "-"
+		if lastSeen.Valid {
+			lastStr = lastSeen.Time.Format("01-02 15:04")
+		}
+		if clearedAt.Valid {
+			clearedStr = clearedAt.Time.Format("01-02 15:04")
+		}
+		syncStr := "N"
+		if synced {
+			syncStr = "Y"
+		}
+
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%d\t%d\t%s\t%s\t%s\t%s\t%s\n",
+			id, state, severity, alertType, deviceUID, probeID, count,
+			raised.Format("01-02 15:04"), lastStr, clearedStr, syncStr, message)
+	}
+	w.Flush()
+	return rows.Err()
+}
+
+func ackAlert(cmd *cobra.Command, args []string) error {
+	if err := requireRW("alerts ack"); err != nil {
+		return err
+	}
+	if err := requireToken("alerts ack", localapi.RoleOperator); err != nil {
+		return err
+	}
+	id, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid alert ID %q", args[0])
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var state string
+	if err := db.QueryRow("SELECT state FROM alerts WHERE id = ?", id).Scan(&state); err != nil {
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("alert %d not found", id)
+		}
+		return err
+	}
+	if state != "active" {
+		return fmt.Errorf("alert %d is %s, not active", id, state)
+	}
+
+	if _, err := db.Exec("UPDATE alerts SET state = 'acked', acked_at = ? WHERE id = ?", time.Now(), id); err != nil {
+		return err
+	}
+	fmt.Printf("Alert %d acknowledged\n", id)
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	auditDevice string
+	auditSource string
+	auditKind   string
+	auditSince  time.Duration
+	auditParams bool
+
+	auditCmd = &cobra.Command{
+		Use:   "audit",
+		Short: "Show the command audit log",
+		Long: `Show valve, meter, and OTA commands issued by the controller with their
+source (cloud, schedule, local_api, modbus, rule), actor, and outcome. The log
+is append-only: each ack, nack, or timeout is a new row that repeats the
+command it belongs to.`,
+		RunE: showAudit,
+	}
+)
+
+func init() {
+	auditCmd.Flags().StringVar(&auditDevice, "device", "", "Only show this device UID")
+	auditCmd.Flags().StringVar(&auditSource, "source", "", "Only show this source")
+	auditCmd.Flags().StringVar(&auditKind, "kind", "", "Only show this kind (valve, meter_config, meter_reset, meter_pin, meter_calibration, ota_start, ota_cancel, ota_multicast, debug)")
+	auditCmd.Flags().DurationVar(&auditSince, "since", 0, "Only show entries newer than this, e.g. 24h")
+	auditCmd.Flags().BoolVar(&auditParams, "params", false, "Show command parameters")
+	auditCmd.Flags().IntVarP(&limit, "limit", "n", 50, "Number of records to show")
+}
+
+func showAudit(cmd *cobra.Command, args []string) error {
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var since time.Time
+	if auditSince > 0 {
+		since = time.Now().Add(-auditSince)
+	}
+
+	rows, err := db.Query(`SELECT id, timestamp, kind, device_uid, COALESCE(actuator_addr, 0), command,
+		COALESCE(params, '-'), source, COALESCE(actor, '-'), COALESCE(cloud_command_id, '-'),
+		COALESCE(command_id, 0), outcome, COALESCE(detail, '-')
+		FROM command_audit
+		WHERE (? = '' OR device_uid = ?) AND (? = '' OR source = ?) AND (? = '' OR kind = ?) AND timestamp >= ?
+		ORDER BY id DESC LIMIT ?`,
+		auditDevice, auditDevice, auditSource, auditSource, auditKind, auditKind, since, limit)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	header := "ID\tTIME\tKIND\tDEVICE\tADDR\tCOMMAND\tSOURCE\tACTOR\tCLOUD ID\tCMD\tOUTCOME\tDETAIL"
+	rule := "--\t----\t----\t------\t----\t-------\t------\t-----\t--------\t---\t-------\t------"
+	if auditParams {
+		header += "\tPARAMS"
+		rule += "\t------"
+	}
+	fmt.Fprintln(w, header)
+	fmt.Fprintln(w, rule)
+
+	for rows.Next() {
+		var id int64
+		var ts time.Time
+		var kind, deviceUID, command, params, source, actor, cloudID, outcome, detail string
+		var addr, cmdID int
+
+		if err := rows.Scan(&id, &ts, &kind, &deviceUID, &addr, &command, &params, &source,
+			&actor, &cloudID, &cmdID, &outcome, &detail); err != nil {
+			return err
+		}
+
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%d\t%s\t%s\t%s\t%s\t%d\t%s\t%s",
+			id, ts.Format("01-02 15:04:05"), kind, deviceUID, addr, command, source,
+			actor, cloudID, cmdID, outcome, detail)
+		if auditParams {
+			fmt.Fprintf(w, "\t%s", params)
+		}
+		fmt.Fprintln(w)
+	}
+	w.Flush()
+	return rows.Err()
+}
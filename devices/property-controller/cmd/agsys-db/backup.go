@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/agsys/property-controller/internal/localapi"
+	"github.com/agsys/property-controller/internal/storage"
+)
+
+var (
+	restoreSocket string
+
+	backupCmd = &cobra.Command{
+		Use:   "backup <path>",
+		Short: "Copy the database to a file while the controller runs",
+		Long: `Copy the database to path with SQLite's online backup API. The controller
+can keep running; the copy is consistent and is checked before it replaces
+anything at path.`,
+		Args: cobra.ExactArgs(1),
+		RunE: backupDatabase,
+	}
+
+	restoreCmd = &cobra.Command{
+		Use:   "restore <path>",
+		Short: "Replace the database with a backup",
+		Long: `Replace the database with the backup at path, after checking the backup's
+integrity. The controller must be stopped first. The database being replaced
+is saved beside it as <database>.before-restore. Needs --rw and an admin
+--token, checked against the current database or, if there is none, against
+the backup.`,
+		Args: cobra.ExactArgs(1),
+		RunE: restoreDatabase,
+	}
+)
+
+func init() {
+	restoreCmd.Flags().StringVar(&restoreSocket, "socket", localapi.DefaultConfig().SocketPath, "Local API socket of the controller, to check it is stopped")
+	rootCmd.AddCommand(backupCmd)
+	rootCmd.AddCommand(restoreCmd)
+}
+
+func backupDatabase(cmd *cobra.Command, args []string) error {
+	path := args[0]
+	if _, err := os.Stat(path); err == nil {
+		if err := confirm(fmt.Sprintf("Overwrite %s", path)); err != nil {
+			return err
+		}
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	start := time.Now()
+	if err := storage.Backup(context.Background(), db, path); err != nil {
+		return fmt.Errorf("backup failed: %w", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Backed up %s to %s (%d KB) in %s\n", dbPath, path, info.Size()/1024, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+func restoreDatabase(cmd *cobra.Command, args []string) error {
+	from := args[0]
+	info, err := os.Stat(from)
+	if err != nil {
+		return err
+	}
+	if err := requireRW("restore"); err != nil {
+		return err
+	}
+	_, statErr := os.Stat(dbPath)
+	exists := statErr == nil
+	if exists {
+		err = requireToken("restore", localapi.RoleAdmin)
+	} else {
+		err = requireBackupToken(from)
+	}
+	if err != nil {
+		return err
+	}
+
+	if conn, err := net.Dial("unix", restoreSocket); err == nil {
+		conn.Close()
+		return fmt.Errorf("the controller is running (%s answers); stop it before restoring", restoreSocket)
+	}
+	if err := confirm(fmt.Sprintf("Replace %s with the backup %s from %s",
+		dbPath, from, info.ModTime().Format("2006-01-02 15:04"))); err != nil {
+		return err
+	}
+
+	if exists {
+		db, err := openDB()
+		if err != nil {
+			return err
+		}
+		saved := dbPath + ".before-restore"
+		err = storage.Backup(context.Background(), db, saved)
+		db.Close()
+		if err != nil {
+			return fmt.Errorf("failed to save the current database (move it aside to restore anyway): %w", err)
+		}
+		fmt.Printf("Saved the current database as %s\n", saved)
+	}
+
+	if err := storage.Restore(context.Background(), from, dbPath); err != nil {
+		return fmt.Errorf("restore failed: %w", err)
+	}
+	fmt.Printf("Restored %s from %s\n", dbPath, from)
+	return nil
+}
+
+// requireBackupToken checks --token against a backup, for restoring where
+// there is no database yet
+func requireBackupToken(path string) error {
+	if apiToken == "" {
+		return fmt.Errorf("restore needs an API token with the %s role; pass --token or set AGSYS_TOKEN", localapi.RoleAdmin)
+	}
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	_, err = checkToken(db, "restore", localapi.RoleAdmin)
+	if errors.Is(err, localapi.ErrInvalidToken) {
+		return fmt.Errorf("%w in the backup", err)
+	}
+	return err
+}
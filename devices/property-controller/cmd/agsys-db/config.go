@@ -0,0 +1,394 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/agsys/property-controller/internal/localapi"
+	"github.com/agsys/property-controller/internal/protocol"
+	"github.com/agsys/property-controller/internal/storage"
+)
+
+var (
+	configCmd = &cobra.Command{
+		Use:   "config",
+		Short: "Show or set the config stored for a device",
+		Long: `Show the config the controller keeps for a device and whether the device
+has confirmed it, or queue a new meter config. Queued configs are picked up
+by the running controller on its next sync cycle and sent after the meter's
+next uplink; the meter confirms them with a config ack.`,
+	}
+
+	configShowCmd = &cobra.Command{
+		Use:   "show <device-uid>",
+		Short: "Show a device's stored config and its delivery",
+		Args:  cobra.ExactArgs(1),
+		RunE:  showConfig,
+	}
+
+	configSetCmd = &cobra.Command{
+		Use:   "set <device-uid>",
+		Short: "Queue a new meter config",
+		Long: `Change a water meter's config and queue it, as the next config version, for
+the running controller to send. Settings left out keep their stored value; a
+meter with no stored config needs --pulses-per-liter. Needs --rw and an
+operator --token.`,
+		Args: cobra.ExactArgs(1),
+		RunE: setConfig,
+	}
+
+	configReportInterval int
+	configPulsesPerLiter float64
+	configLeakMinutes    int
+	configMaxFlow        float64
+	configLeakDetect     bool
+	configReverseDetect  bool
+	configTamperDetect   bool
+)
+
+func init() {
+	configSetCmd.Flags().IntVar(&configReportInterval, "report-interval", 0, "Seconds between reports (0 for the meter default)")
+	configSetCmd.Flags().Float64Var(&configPulsesPerLiter, "pulses-per-liter", 0, "Meter calibration, e.g. 4.5")
+	configSetCmd.Flags().IntVar(&configLeakMinutes, "leak-minutes", 0, "Minutes of continuous flow the meter reports as a leak")
+	configSetCmd.Flags().Float64Var(&configMaxFlow, "max-flow", 0, "Highest expected flow in L/min")
+	configSetCmd.Flags().BoolVar(&configLeakDetect, "leak-detect", false, "Enable leak detection")
+	configSetCmd.Flags().BoolVar(&configReverseDetect, "reverse-detect", false, "Enable reverse flow detection")
+	configSetCmd.Flags().BoolVar(&configTamperDetect, "tamper-detect", false, "Enable tamper detection")
+
+	configCmd.AddCommand(configShowCmd)
+	configCmd.AddCommand(configSetCmd)
+}
+
+// meterConfigFlags names the meter config flag bits
+var meterConfigFlags = []struct {
+	bit  uint8
+	name string
+}{
+	{protocol.MeterCfgLeakDetectEn, "Leak detection"},
+	{protocol.MeterCfgReverseDetect, "Reverse detection"},
+	{protocol.MeterCfgTamperDetect, "Tamper detection"},
+}
+
+func showConfig(cmd *cobra.Command, args []string) error {
+	uid := args[0]
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var name string
+	if err := db.QueryRow("SELECT name FROM devices WHERE uid = ?", uid).Scan(&name); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("device %s not found", uid)
+		}
+		return err
+	}
+	fmt.Printf("Device %s (%s)\n", uid, name)
+
+	found := false
+	c, err := queryMeterConfig(db, uid)
+	if err != nil {
+		return err
+	}
+	if c != nil {
+		found = true
+		printMeterConfig(c)
+		if err := printMeterCalibrations(db, uid); err != nil {
+			return err
+		}
+	}
+
+	var interval, version uint16
+	var state sql.NullString
+	var applied sql.NullInt64
+	var appliedAt sql.NullTime
+	err = db.QueryRow(`SELECT report_interval_sec, config_version, state, applied_interval_sec, applied_at
+		FROM device_configs WHERE device_uid = ?`, uid).Scan(&interval, &version, &state, &applied, &appliedAt)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+	case err != nil:
+		return err
+	default:
+		found = true
+		fmt.Println()
+		fmt.Printf("Report interval v%d (%s)\n", version, configStateString(state.String))
+		fmt.Printf("  Interval:          %s\n", intervalString(interval))
+		if appliedAt.Valid {
+			fmt.Printf("  Confirmed:         %s at %s\n", intervalString(uint16(applied.Int64)), appliedAt.Time.Local().Format(time.DateTime))
+		}
+	}
+
+	if !found {
+		fmt.Println("No config stored")
+	}
+	return nil
+}
+
+func printMeterConfig(c *storage.MeterConfig) {
+	fmt.Println()
+	fmt.Printf("Meter config v%d (%s)\n", c.ConfigVersion, configStateString(c.State))
+	fmt.Printf("  Report interval:   %s\n", intervalString(c.ReportIntervalSec))
+	fmt.Printf("  Pulses per liter:  %.2f\n", float64(c.PulsesPerLiter)/100)
+	fmt.Printf("  Leak threshold:    %d min\n", c.LeakThresholdMin)
+	fmt.Printf("  Max flow rate:     %.1f L/min\n", float64(c.MaxFlowRateLPM)/10)
+	for _, f := range meterConfigFlags {
+		fmt.Printf("  %-18s %s\n", f.name+":", onOff(c.Flags&f.bit != 0))
+	}
+	if c.Actor != "" {
+		fmt.Printf("  Set by:            %s at %s\n", c.Actor, c.UpdatedAt.Local().Format(time.DateTime))
+	}
+	if c.SentAt != nil {
+		fmt.Printf("  Sent:              %s\n", c.SentAt.Local().Format(time.DateTime))
+	}
+	switch {
+	case c.AckedVersion != nil && *c.AckedVersion == c.ConfigVersion:
+		fmt.Printf("  Confirmed:         yes, at %s\n", c.AckedAt.Local().Format(time.DateTime))
+	case c.AckedVersion != nil:
+		fmt.Printf("  Confirmed:         no, the meter last confirmed v%d at %s\n", *c.AckedVersion, c.AckedAt.Local().Format(time.DateTime))
+	default:
+		fmt.Println("  Confirmed:         no")
+	}
+}
+
+// printMeterCalibrations lists a meter's latest calibration sessions
+func printMeterCalibrations(db *sql.DB, uid string) error {
+	rows, err := db.Query(`SELECT session_id, state, reference_liters, pulses, old_pulses_per_liter,
+		new_pulses_per_liter, config_version, COALESCE(error, ''), started_at
+		FROM meter_calibrations WHERE device_uid = ? ORDER BY id DESC LIMIT 5`, uid)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	first := true
+	for rows.Next() {
+		var c storage.MeterCalibration
+		if err := rows.Scan(&c.SessionID, &c.State, &c.ReferenceLiters, &c.Pulses, &c.OldPulsesPerLiter,
+			&c.NewPulsesPerLiter, &c.ConfigVersion, &c.Error, &c.StartedAt); err != nil {
+			return err
+		}
+		if first {
+			fmt.Println()
+			fmt.Println("Calibrations")
+			first = false
+		}
+		line := fmt.Sprintf("  %s  session %d  %s", c.StartedAt.Local().Format(time.DateTime), c.SessionID, c.State)
+		switch {
+		case c.State == storage.MeterCalCompleted:
+			line += fmt.Sprintf(": %d pulses for %.1f L, %.2f -> %.2f pulses per liter (v%d)", c.Pulses, c.ReferenceLiters,
+				float64(c.OldPulsesPerLiter)/100, float64(c.NewPulsesPerLiter)/100, c.ConfigVersion)
+		case c.Error != "":
+			line += ": " + c.Error
+		}
+		fmt.Println(line)
+	}
+	return rows.Err()
+}
+
+func setConfig(cmd *cobra.Command, args []string) error {
+	uid := args[0]
+	flags := cmd.Flags()
+	changed := false
+	for _, flag := range []string{"report-interval", "pulses-per-liter", "leak-minutes", "max-flow",
+		"leak-detect", "reverse-detect", "tamper-detect"} {
+		changed = changed || flags.Changed(flag)
+	}
+	if !changed {
+		return fmt.Errorf("nothing to set; see --help for the settings")
+	}
+	if err := requireRW("config set"); err != nil {
+		return err
+	}
+	actor, err := requireActor("config set", localapi.RoleOperator)
+	if err != nil {
+		return err
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var name string
+	var deviceType int
+	if err := tx.QueryRow("SELECT name, device_type FROM devices WHERE uid = ?", uid).Scan(&name, &deviceType); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("device %s not found", uid)
+		}
+		return err
+	}
+	if deviceType != int(protocol.DeviceTypeWaterMeter) {
+		return fmt.Errorf("device %s is not a water meter; only meter configs can be set", uid)
+	}
+
+	c, err := queryMeterConfig(tx, uid)
+	if err != nil {
+		return err
+	}
+	if c == nil {
+		if !flags.Changed("pulses-per-liter") {
+			return fmt.Errorf("meter %s has no stored config; --pulses-per-liter is needed", uid)
+		}
+		c = &storage.MeterConfig{DeviceUID: uid}
+	}
+
+	if flags.Changed("report-interval") {
+		if configReportInterval < 0 || configReportInterval > math.MaxUint16 {
+			return fmt.Errorf("--report-interval must be 0 to %d seconds", math.MaxUint16)
+		}
+		c.ReportIntervalSec = uint16(configReportInterval)
+	}
+	if flags.Changed("pulses-per-liter") {
+		if configPulsesPerLiter <= 0 || configPulsesPerLiter*100 > math.MaxUint16 {
+			return fmt.Errorf("--pulses-per-liter must be above 0 and at most %.2f", float64(math.MaxUint16)/100)
+		}
+		c.PulsesPerLiter = uint16(math.Round(configPulsesPerLiter * 100))
+	}
+	if flags.Changed("leak-minutes") {
+		if configLeakMinutes < 0 || configLeakMinutes > math.MaxUint16 {
+			return fmt.Errorf("--leak-minutes must be 0 to %d", math.MaxUint16)
+		}
+		c.LeakThresholdMin = uint16(configLeakMinutes)
+	}
+	if flags.Changed("max-flow") {
+		if configMaxFlow < 0 || configMaxFlow*10 > math.MaxUint16 {
+			return fmt.Errorf("--max-flow must be 0 to %.1f L/min", float64(math.MaxUint16)/10)
+		}
+		c.MaxFlowRateLPM = uint16(math.Round(configMaxFlow * 10))
+	}
+	for _, f := range []struct {
+		flag string
+		bit  uint8
+		on   bool
+	}{
+		{"leak-detect", protocol.MeterCfgLeakDetectEn, configLeakDetect},
+		{"reverse-detect", protocol.MeterCfgReverseDetect, configReverseDetect},
+		{"tamper-detect", protocol.MeterCfgTamperDetect, configTamperDetect},
+	} {
+		switch {
+		case !flags.Changed(f.flag):
+		case f.on:
+			c.Flags |= f.bit
+		default:
+			c.Flags &^= f.bit
+		}
+	}
+
+	// A config ack carries only the version, so the meter's report interval
+	// and meter config share one version sequence
+	var intervalVersion uint16
+	if err := tx.QueryRow("SELECT COALESCE(MAX(config_version), 0) FROM device_configs WHERE device_uid = ?", uid).Scan(&intervalVersion); err != nil {
+		return err
+	}
+	c.ConfigVersion = max(c.ConfigVersion, intervalVersion) + 1
+	c.State = storage.DeviceConfigQueued
+	c.Actor = actor
+	c.SentAt = nil
+	c.UpdatedAt = time.Now()
+
+	var ackedVersion, ackedAt interface{}
+	if c.AckedVersion != nil {
+		ackedVersion, ackedAt = *c.AckedVersion, *c.AckedAt
+	}
+	_, err = tx.Exec(`INSERT INTO meter_configs
+		(device_uid, config_version, report_interval_sec, pulses_per_liter, leak_threshold_min, max_flow_rate_lpm, flags,
+			state, actor, sent_at, acked_version, acked_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, NULL, ?, ?, ?)
+		ON CONFLICT(device_uid) DO UPDATE SET
+			config_version = excluded.config_version,
+			report_interval_sec = excluded.report_interval_sec,
+			pulses_per_liter = excluded.pulses_per_liter,
+			leak_threshold_min = excluded.leak_threshold_min,
+			max_flow_rate_lpm = excluded.max_flow_rate_lpm,
+			flags = excluded.flags,
+			state = excluded.state,
+			actor = excluded.actor,
+			sent_at = NULL,
+			updated_at = excluded.updated_at`,
+		uid, c.ConfigVersion, c.ReportIntervalSec, c.PulsesPerLiter, c.LeakThresholdMin, c.MaxFlowRateLPM, c.Flags,
+		c.State, c.Actor, ackedVersion, ackedAt, c.UpdatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to queue meter config: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Meter config v%d queued for %s (%s); the controller sends it after the meter's next uplink\n",
+		c.ConfigVersion, uid, name)
+	printMeterConfig(c)
+	return nil
+}
+
+// queryMeterConfig reads a meter's stored config, or nil if it has none
+func queryMeterConfig(q interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}, uid string) (*storage.MeterConfig, error) {
+	c := &storage.MeterConfig{}
+	var state, actor sql.NullString
+	var sentAt, ackedAt sql.NullTime
+	var acked sql.NullInt64
+	err := q.QueryRow(`SELECT device_uid, config_version, report_interval_sec, pulses_per_liter, leak_threshold_min,
+		max_flow_rate_lpm, flags, state, actor, sent_at, acked_version, acked_at, updated_at
+		FROM meter_configs WHERE device_uid = ?`, uid).Scan(&c.DeviceUID, &c.ConfigVersion, &c.ReportIntervalSec,
+		&c.PulsesPerLiter, &c.LeakThresholdMin, &c.MaxFlowRateLPM, &c.Flags, &state, &actor, &sentAt, &acked, &ackedAt, &c.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.State, c.Actor = state.String, actor.String
+	if sentAt.Valid {
+		c.SentAt = &sentAt.Time
+	}
+	if acked.Valid && ackedAt.Valid {
+		v := uint16(acked.Int64)
+		c.AckedVersion, c.AckedAt = &v, &ackedAt.Time
+	}
+	return c, nil
+}
+
+// configStateString describes the delivery state of a device config
+func configStateString(state string) string {
+	switch state {
+	case storage.DeviceConfigQueued:
+		return "queued, not yet sent"
+	case storage.DeviceConfigPending:
+		return "sent, awaiting the device's ack"
+	case storage.DeviceConfigApplied:
+		return "applied"
+	case storage.DeviceConfigFailed:
+		return "failed"
+	case "":
+		return "not sent"
+	}
+	return state
+}
+
+func intervalString(sec uint16) string {
+	if sec == 0 {
+		return "device default"
+	}
+	return (time.Duration(sec) * time.Second).String()
+}
+
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
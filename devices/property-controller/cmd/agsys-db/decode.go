@@ -0,0 +1,360 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"github.com/agsys/property-controller/internal/lora"
+	"github.com/agsys/property-controller/internal/protocol"
+)
+
+var (
+	decodeKey       string
+	decodeDeviceKey string
+	decodeDerive    bool
+
+	decodeCmd = &cobra.Command{
+		Use:   "decode <hex>",
+		Short: "Decode a raw LoRa frame",
+		Long: `Decode a raw LoRa frame, e.g. from a gateway log or a capture file, and
+print its header and payload fields. The frame may be split into several
+arguments and contain spaces or colons. The database isn't opened.
+
+Encrypted frames need a key: --key for the network key (AES-128-CTR),
+--device-key for a device's rotated key, or --derive for the key derived from
+the device UID (both AES-128-GCM). Uplinks have only the payload encrypted;
+downlinks from the controller have the whole frame encrypted, which is tried
+when the header doesn't decode. CTR carries no authentication, so a wrong
+network key shows up as nonsense fields rather than an error.`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: decodeFrame,
+	}
+)
+
+func init() {
+	decodeCmd.Flags().StringVar(&decodeKey, "key", "", "Network AES key (32 hex characters)")
+	decodeCmd.Flags().StringVar(&decodeDeviceKey, "device-key", "", "Device's rotated AES key (32 hex characters)")
+	decodeCmd.Flags().BoolVar(&decodeDerive, "derive", false, "Use the key derived from the device UID")
+	decodeCmd.MarkFlagsMutuallyExclusive("key", "device-key", "derive")
+}
+
+// msgTypeNames names the message types for decode
+var msgTypeNames = map[uint8]string{
+	protocol.MsgTypeHeartbeat:         "heartbeat",
+	protocol.MsgTypeLogBatch:          "log batch",
+	protocol.MsgTypeConfigRequest:     "config request",
+	protocol.MsgTypeAck:               "ack",
+	protocol.MsgTypeNack:              "nack",
+	protocol.MsgTypeConfigUpdate:      "config update",
+	protocol.MsgTypeTimeSync:          "time sync",
+	protocol.MsgTypeKeyRotate:         "key rotate",
+	protocol.MsgTypeKeyRotateAck:      "key rotate ack",
+	protocol.MsgTypeTimeSyncAck:       "time sync ack",
+	protocol.MsgTypeConfigAck:         "config ack",
+	protocol.MsgTypeFragment:          "fragment",
+	protocol.MsgTypeDebugCommand:      "debug command",
+	protocol.MsgTypeDebugReply:        "debug reply",
+	protocol.MsgTypeSoilReport:        "soil report",
+	protocol.MsgTypeSoilCalibrateReq:  "soil calibrate request",
+	protocol.MsgTypeMeterReport:       "meter report",
+	protocol.MsgTypeMeterAlarm:        "meter alarm",
+	protocol.MsgTypeMeterCalibrateReq: "meter calibrate request",
+	protocol.MsgTypeMeterResetTotal:   "meter reset total",
+	protocol.MsgTypeMeterResetAck:     "meter reset ack",
+	protocol.MsgTypeMeterPin:          "meter pin",
+	protocol.MsgTypeMeterPinAck:       "meter pin ack",
+	protocol.MsgTypeMeterCalibrateAck: "meter calibrate ack",
+	protocol.MsgTypeValveStatus:       "valve status",
+	protocol.MsgTypeValveAck:          "valve ack",
+	protocol.MsgTypeValveScheduleReq:  "valve schedule request",
+	protocol.MsgTypeValveCommand:      "valve command",
+	protocol.MsgTypeValveSchedule:     "valve schedule",
+	protocol.MsgTypeInjectorCommand:   "injector command",
+	protocol.MsgTypeInjectorAck:       "injector ack",
+	protocol.MsgTypeOTAAnnounce:       "OTA announce",
+	protocol.MsgTypeOTAChunk:          "OTA chunk",
+	protocol.MsgTypeOTAStatus:         "OTA status",
+	protocol.MsgTypeOTARequest:        "OTA request",
+	protocol.MsgTypeOTAReady:          "OTA ready",
+	protocol.MsgTypeOTAFinish:         "OTA finish",
+	protocol.MsgTypeOTABitmap:         "OTA bitmap",
+	protocol.MsgTypeOTASession:        "OTA session",
+	protocol.MsgTypeOTAJoin:           "OTA join",
+	protocol.MsgTypeOTAMulticastChunk: "OTA multicast chunk",
+}
+
+func decodeFrame(cmd *cobra.Command, args []string) error {
+	frame, err := parseHex(strings.Join(args, ""))
+	if err != nil {
+		return err
+	}
+
+	var networkKey, deviceKey []byte
+	if decodeKey != "" {
+		if networkKey, err = parseKey(decodeKey); err != nil {
+			return fmt.Errorf("--key: %w", err)
+		}
+	}
+	if decodeDeviceKey != "" {
+		if deviceKey, err = parseKey(decodeDeviceKey); err != nil {
+			return fmt.Errorf("--device-key: %w", err)
+		}
+	}
+
+	encryption := "none"
+	msg, err := protocol.Decode(frame)
+	switch {
+	case err == nil && (networkKey != nil || deviceKey != nil || decodeDerive):
+		// An uplink, with only the payload encrypted
+		key := deviceKey
+		if decodeDerive {
+			key = lora.DeriveKey(msg.Header.DeviceUID)
+		}
+		if key != nil {
+			msg.Payload, err = lora.DecryptGCM(key, msg.Payload)
+			encryption = "payload, AES-128-GCM"
+		} else {
+			msg.Payload, err = decryptCTR(networkKey, msg.Payload)
+			encryption = "payload, AES-128-CTR"
+		}
+		if err != nil {
+			return fmt.Errorf("failed to decrypt payload: %w", err)
+		}
+
+	case err != nil && (networkKey != nil || deviceKey != nil):
+		// A downlink, encrypted whole
+		var plaintext []byte
+		var decryptErr error
+		if deviceKey != nil {
+			plaintext, decryptErr = lora.DecryptGCM(deviceKey, frame)
+			encryption = "frame, AES-128-GCM"
+		} else {
+			plaintext, decryptErr = decryptCTR(networkKey, frame)
+			encryption = "frame, AES-128-CTR"
+		}
+		if decryptErr != nil {
+			return fmt.Errorf("%v; failed to decrypt as a whole frame: %w", err, decryptErr)
+		}
+		decrypted, decodeErr := protocol.Decode(plaintext)
+		if decodeErr != nil {
+			return fmt.Errorf("%v, nor once decrypted: %w", err, decodeErr)
+		}
+		msg = decrypted
+
+	case err != nil && decodeDerive:
+		return fmt.Errorf("%w; the header may be encrypted, which needs --key or --device-key", err)
+
+	case err != nil:
+		return fmt.Errorf("%w; if the frame is encrypted, pass a key", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	h := msg.Header
+	name, ok := msgTypeNames[h.MsgType]
+	if !ok {
+		name = "unknown"
+	}
+	version := fmt.Sprintf("%d", h.Version)
+	if protocol.HasFrameCRC(h.Version) {
+		version += " (frame CRC ok)"
+	}
+	if msg.CBOR {
+		version += " (CBOR payload)"
+	}
+	fmt.Fprintf(w, "Version:\t%s\n", version)
+	fmt.Fprintf(w, "Type:\t0x%02X %s\n", h.MsgType, name)
+	fmt.Fprintf(w, "Device type:\t%s\n", deviceTypeString(int(h.DeviceType)))
+	fmt.Fprintf(w, "Device UID:\t%s\n", msg.DeviceUIDString())
+	fmt.Fprintf(w, "Sequence:\t%d\n", h.Sequence)
+	fmt.Fprintf(w, "Encryption:\t%s\n", encryption)
+	fmt.Fprintf(w, "Payload:\t%d bytes %s\n", len(msg.Payload), strings.ToUpper(hex.EncodeToString(msg.Payload)))
+	w.Flush()
+
+	fields, err := decodePayload(msg)
+	if err != nil {
+		fmt.Printf("\nPayload doesn't decode: %v\n", err)
+		return nil
+	}
+	if fields == nil {
+		return nil
+	}
+	fmt.Println()
+	printFields(w, "", reflect.ValueOf(fields))
+	return w.Flush()
+}
+
+// decodePayload decodes the payload of a message into its fields. It
+// returns nil for message types with no decoder.
+func decodePayload(msg *protocol.LoRaMessage) (any, error) {
+	if msg.CBOR {
+		return protocol.DecodeCBORMap(msg.Payload)
+	}
+
+	p := msg.Payload
+	switch msg.Header.MsgType {
+	case protocol.MsgTypeHeartbeat:
+		return protocol.DecodeHeartbeat(p)
+	case protocol.MsgTypeSoilReport:
+		// Legacy single-probe reports are shorter than batched ones
+		if len(p) < protocol.SoilReportSize {
+			return protocol.DecodeSensorData(p)
+		}
+		return protocol.DecodeSoilReport(p)
+	case protocol.MsgTypeMeterReport:
+		return protocol.DecodeWaterMeter(p)
+	case protocol.MsgTypeMeterAlarm:
+		return protocol.DecodeMeterAlarm(p)
+	case protocol.MsgTypeMeterResetAck:
+		return protocol.DecodeMeterResetAck(p)
+	case protocol.MsgTypeMeterPin:
+		return protocol.DecodeMeterPin(p)
+	case protocol.MsgTypeMeterPinAck:
+		return protocol.DecodeMeterPinAck(p)
+	case protocol.MsgTypeMeterCalibrateReq:
+		return protocol.DecodeMeterCalibrateReq(p)
+	case protocol.MsgTypeMeterCalibrateAck:
+		return protocol.DecodeMeterCalibrateAck(p)
+	case protocol.MsgTypeAck, protocol.MsgTypeNack:
+		return protocol.DecodeAck(p)
+	case protocol.MsgTypeValveStatus:
+		return protocol.DecodeValveStatus(p)
+	case protocol.MsgTypeValveCommand:
+		return protocol.DecodeValveCommand(p)
+	case protocol.MsgTypeValveAck:
+		return protocol.DecodeValveAck(p)
+	case protocol.MsgTypeInjectorCommand:
+		return protocol.DecodeInjectorCommand(p)
+	case protocol.MsgTypeInjectorAck:
+		return protocol.DecodeInjectorAck(p)
+	case protocol.MsgTypeTimeSyncAck:
+		return protocol.DecodeTimeSyncAck(p)
+	case protocol.MsgTypeKeyRotate:
+		return protocol.DecodeKeyRotate(p)
+	case protocol.MsgTypeKeyRotateAck:
+		return protocol.DecodeKeyRotateAck(p)
+	case protocol.MsgTypeConfigAck:
+		return protocol.DecodeConfigAck(p)
+	case protocol.MsgTypeLogBatch:
+		return protocol.DecodeLogBatch(p)
+	case protocol.MsgTypeDebugCommand:
+		return protocol.DecodeDebugCommand(p)
+	case protocol.MsgTypeDebugReply:
+		return protocol.DecodeDebugReply(p)
+	case protocol.MsgTypeFragment:
+		return protocol.DecodeFragment(p)
+	case protocol.MsgTypeOTAAnnounce:
+		return protocol.DecodeOTAAnnounce(p)
+	case protocol.MsgTypeOTARequest:
+		return protocol.DecodeOTARequest(p)
+	case protocol.MsgTypeOTAReady:
+		return protocol.DecodeOTAReady(p)
+	case protocol.MsgTypeOTAStatus:
+		return protocol.DecodeOTAStatus(p)
+	case protocol.MsgTypeOTABitmap:
+		return protocol.DecodeOTABitmap(p)
+	case protocol.MsgTypeOTASession:
+		return protocol.DecodeOTASession(p)
+	case protocol.MsgTypeOTAJoin:
+		return protocol.DecodeOTAJoin(p)
+	}
+	return nil, nil
+}
+
+// printFields prints the fields of a decoded payload one per line, with
+// nested structs and lists indented under their field
+func printFields(w *tabwriter.Writer, indent string, v reflect.Value) {
+	for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		v = v.Elem()
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < v.NumField(); i++ {
+			if t.Field(i).IsExported() {
+				printField(w, indent, t.Field(i).Name, v.Field(i))
+			}
+		}
+	case reflect.Map:
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j]) })
+		for _, k := range keys {
+			printField(w, indent, fmt.Sprint(k), v.MapIndex(k))
+		}
+	default:
+		fmt.Fprintf(w, "%s%v\n", indent, v)
+	}
+}
+
+// printField prints a named field, descending into structs and lists of
+// them
+func printField(w *tabwriter.Writer, indent, name string, v reflect.Value) {
+	for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		v = v.Elem()
+	}
+
+	switch {
+	case v.Kind() == reflect.Struct:
+		fmt.Fprintf(w, "%s%s:\n", indent, name)
+		printFields(w, indent+"  ", v)
+	case (v.Kind() == reflect.Slice || v.Kind() == reflect.Array) && v.Type().Elem().Kind() == reflect.Struct:
+		fmt.Fprintf(w, "%s%s:\t%d\n", indent, name, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			printField(w, indent+"  ", fmt.Sprintf("[%d]", i), v.Index(i))
+		}
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+		fmt.Fprintf(w, "%s%s:\t%s\n", indent, name, strings.ToUpper(hex.EncodeToString(v.Bytes())))
+	default:
+		fmt.Fprintf(w, "%s%s:\t%v\n", indent, name, v)
+	}
+}
+
+// parseHex parses a frame written in hex, ignoring spaces, colons, and a
+// 0x prefix
+func parseHex(s string) ([]byte, error) {
+	s = strings.TrimPrefix(strings.ToLower(s), "0x")
+	s = strings.NewReplacer(" ", "", ":", "", "\t", "", "\n", "").Replace(s)
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hex: %w", err)
+	}
+	return data, nil
+}
+
+// parseKey parses an AES-128 key written in hex
+func parseKey(s string) ([]byte, error) {
+	key, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hex: %w", err)
+	}
+	if len(key) != 16 {
+		return nil, fmt.Errorf("key must be 16 bytes (32 hex characters), got %d", len(key))
+	}
+	return key, nil
+}
+
+// decryptCTR decrypts data sealed with the network key the way the
+// controller's LoRa driver does: a 16-byte IV followed by AES-128-CTR
+// ciphertext
+func decryptCTR(key, data []byte) ([]byte, error) {
+	if len(data) < aes.BlockSize {
+		return nil, errors.New("ciphertext too short")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	plaintext := make([]byte, len(data)-aes.BlockSize)
+	cipher.NewCTR(block, data[:aes.BlockSize]).XORKeyStream(plaintext, data[aes.BlockSize:])
+	return plaintext, nil
+}
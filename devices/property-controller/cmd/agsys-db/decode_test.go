@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/agsys/property-controller/internal/lora"
+	"github.com/agsys/property-controller/internal/protocol"
+)
+
+// encryptCTR seals data the way decryptCTR opens it, with a fixed IV
+func encryptCTR(t *testing.T, key, data []byte) []byte {
+	t.Helper()
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatalf("NewCipher failed: %v", err)
+	}
+	iv := bytes.Repeat([]byte{0x5A}, aes.BlockSize)
+	out := append([]byte{}, iv...)
+	sealed := make([]byte, len(data))
+	cipher.NewCTR(block, iv).XORKeyStream(sealed, data)
+	return append(out, sealed...)
+}
+
+// sealGCM seals data under a device key
+func sealGCM(t *testing.T, key, data []byte) []byte {
+	t.Helper()
+	sealed, err := lora.EncryptGCM(key, 7, data)
+	if err != nil {
+		t.Fatalf("EncryptGCM failed: %v", err)
+	}
+	return sealed
+}
+
+// TestDecodeFrame tests decoding plain, payload-encrypted, and whole-frame
+// encrypted frames, and that malformed input fails without a panic
+func TestDecodeFrame(t *testing.T) {
+	networkKey := bytes.Repeat([]byte{0x11}, 16)
+	deviceKey := bytes.Repeat([]byte{0x22}, 16)
+	uid := [8]byte{1, 2, 3, 4, 5, 6, 7, 8}
+
+	frame := func(msgType, deviceType uint8, payload []byte) []byte {
+		msg := &protocol.LoRaMessage{Header: *protocol.NewHeader(msgType, deviceType, uid, 42), Payload: payload}
+		return msg.Encode()
+	}
+	report := (&protocol.SoilReportPayload{
+		Timestamp:  3600,
+		ProbeCount: 1,
+		Probes:     [protocol.MaxProbes]protocol.ProbeReading{{ProbeIndex: 0, FrequencyHz: 41000, MoisturePercent: 37}},
+		BatteryMV:  3312,
+	}).Encode()
+	legacy := (&protocol.SensorDataPayload{ProbeID: 2, MoistureRaw: 43210, MoisturePercent: 28, BatteryMV: 3150}).Encode()
+	command := frame(protocol.MsgTypeValveCommand, protocol.DeviceTypeValveController,
+		(&protocol.ValveCommandPayload{ActuatorAddr: 3, Command: protocol.ValveCmdOpen, CommandID: 77}).Encode())
+	plain := frame(protocol.MsgTypeSoilReport, protocol.DeviceTypeSoilMoisture, report)
+
+	tests := []struct {
+		name      string
+		frame     string
+		key       string
+		deviceKey string
+		derive    bool
+		want      []string // Text the output must contain
+		wantErr   bool
+	}{
+		{
+			name:  "plain soil report",
+			frame: hex.EncodeToString(plain),
+			want:  []string{"soil report", "none", "BatteryMV:", "3312"},
+		},
+		{
+			name:  "spaces, colons and 0x prefix",
+			frame: "0x" + strings.Join(strings.Split(hex.EncodeToString(plain), ""), ":"),
+			want:  []string{"soil report", "3312"},
+		},
+		{
+			name:  "legacy short soil report",
+			frame: hex.EncodeToString(frame(protocol.MsgTypeSoilReport, protocol.DeviceTypeSoilMoisture, legacy)),
+			want:  []string{"soil report", "MoistureRaw:", "43210"},
+		},
+		{
+			name:  "uplink, payload under the network key",
+			frame: hex.EncodeToString(frame(protocol.MsgTypeSoilReport, protocol.DeviceTypeSoilMoisture, encryptCTR(t, networkKey, report))),
+			key:   hex.EncodeToString(networkKey),
+			want:  []string{"payload, AES-128-CTR", "3312"},
+		},
+		{
+			name:      "uplink, payload under a device key",
+			frame:     hex.EncodeToString(frame(protocol.MsgTypeSoilReport, protocol.DeviceTypeSoilMoisture, sealGCM(t, deviceKey, report))),
+			deviceKey: hex.EncodeToString(deviceKey),
+			want:      []string{"payload, AES-128-GCM", "3312"},
+		},
+		{
+			name:   "uplink, payload under the derived key",
+			frame:  hex.EncodeToString(frame(protocol.MsgTypeSoilReport, protocol.DeviceTypeSoilMoisture, sealGCM(t, lora.DeriveKey(uid), report))),
+			derive: true,
+			want:   []string{"payload, AES-128-GCM", "3312"},
+		},
+		{
+			name:  "downlink, whole frame under the network key",
+			frame: hex.EncodeToString(encryptCTR(t, networkKey, command)),
+			key:   hex.EncodeToString(networkKey),
+			want:  []string{"frame, AES-128-CTR", "valve command", "CommandID:", "77"},
+		},
+		{
+			name:      "downlink, whole frame under a device key",
+			frame:     hex.EncodeToString(sealGCM(t, deviceKey, command)),
+			deviceKey: hex.EncodeToString(deviceKey),
+			want:      []string{"frame, AES-128-GCM", "valve command", "77"},
+		},
+		{
+			name:      "payload under another device key",
+			frame:     hex.EncodeToString(frame(protocol.MsgTypeSoilReport, protocol.DeviceTypeSoilMoisture, sealGCM(t, deviceKey, report))),
+			deviceKey: hex.EncodeToString(networkKey),
+			wantErr:   true,
+		},
+		{name: "empty", frame: "", wantErr: true},
+		{name: "garbage hex", frame: "zz-not-hex", wantErr: true},
+		{name: "odd length hex", frame: "abc", wantErr: true},
+		{name: "truncated header", frame: hex.EncodeToString(plain[:6]), wantErr: true},
+		{name: "truncated header with a key", frame: hex.EncodeToString(plain[:6]), key: hex.EncodeToString(networkKey), wantErr: true},
+		{name: "truncated header with a device key", frame: hex.EncodeToString(plain[:6]), deviceKey: hex.EncodeToString(deviceKey), wantErr: true},
+		{name: "truncated header with the derived key", frame: hex.EncodeToString(plain[:6]), derive: true, wantErr: true},
+		{
+			name:      "truncated sealed payload",
+			frame:     hex.EncodeToString(frame(protocol.MsgTypeSoilReport, protocol.DeviceTypeSoilMoisture, []byte{1, 2})),
+			deviceKey: hex.EncodeToString(deviceKey),
+			wantErr:   true,
+		},
+		{
+			name:  "truncated CTR payload",
+			frame: hex.EncodeToString(frame(protocol.MsgTypeSoilReport, protocol.DeviceTypeSoilMoisture, []byte{1, 2})),
+			key:   hex.EncodeToString(networkKey),
+			// Too short to hold an IV
+			wantErr: true,
+		},
+		{name: "short key", frame: hex.EncodeToString(plain), key: "0011", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			savedKey, savedDeviceKey, savedDerive := decodeKey, decodeDeviceKey, decodeDerive
+			decodeKey, decodeDeviceKey, decodeDerive = tt.key, tt.deviceKey, tt.derive
+			defer func() { decodeKey, decodeDeviceKey, decodeDerive = savedKey, savedDeviceKey, savedDerive }()
+
+			out, err := captureStdout(t, func() error { return decodeFrame(nil, []string{tt.frame}) })
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("decodeFrame printed %q, expected an error", out)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decodeFrame failed: %v", err)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(out, want) {
+					t.Errorf("Output lacks %q:\n%s", want, out)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/agsys/property-controller/internal/localapi"
+	"github.com/agsys/property-controller/internal/storage"
+)
+
+var (
+	deviceCmd = &cobra.Command{
+		Use:   "device",
+		Short: "Rename, reassign, forget, or release a device",
+		Long: `Change a device's alias or zone, forget it, or release it from quarantine.
+Changes are written to the database at once and picked up by the running
+controller on its next sync cycle. Each is also queued for the cloud, but the cloud protocol has no
+message for device changes yet, so they stay queued (counted by stats) and
+the cloud keeps its own view of the device until they can be sent.`,
+	}
+
+	deviceAliasCmd = &cobra.Command{
+		Use:   "set-alias <uid> <alias>",
+		Short: "Set a device's alias (\"\" to clear it)",
+		Long:  `Set the alias a device is shown under. Needs --rw and an operator --token.`,
+		Args:  cobra.ExactArgs(2),
+		RunE:  setDeviceAlias,
+	}
+
+	deviceZoneCmd = &cobra.Command{
+		Use:   "set-zone <uid> <zone-uid|none>",
+		Short: "Assign a device to a zone",
+		Long: `Assign a device to one of the zones synced from the cloud (see zones), or
+to none. Needs --rw and an operator --token.`,
+		Args: cobra.ExactArgs(2),
+		RunE: setDeviceZone,
+	}
+
+	deviceForgetCmd = &cobra.Command{
+		Use:   "forget <uid>",
+		Short: "Remove a device and its valve actuators",
+		Long: `Remove a device and its valve actuators, e.g. after it was taken out of
+the field. Its readings, events, and keys are kept. The controller stops
+treating it as registered; if it is heard again it comes back as an
+unregistered device, and if the cloud adds it again, as a registered one.
+Needs --rw and an admin --token.`,
+		Args: cobra.ExactArgs(1),
+		RunE: forgetDevice,
+	}
+
+	deviceReleaseCmd = &cobra.Command{
+		Use:   "release <uid>",
+		Short: "Accept a device quarantined as a suspected spoof again",
+		Long: `Lift the quarantine of a device whose uplinks were dropped as a suspected
+spoof or clone (Q in devices), e.g. once it is confirmed to have been moved.
+The controller clears its alert and learns its signal strength and sequence
+again.
+Approving the device in the cloud does the same. Needs --rw and an admin
+--token.`,
+		Args: cobra.ExactArgs(1),
+		RunE: releaseDevice,
+	}
+)
+
+func init() {
+	deviceCmd.AddCommand(deviceAliasCmd)
+	deviceCmd.AddCommand(deviceZoneCmd)
+	deviceCmd.AddCommand(deviceForgetCmd)
+	deviceCmd.AddCommand(deviceReleaseCmd)
+}
+
+func setDeviceAlias(cmd *cobra.Command, args []string) error {
+	uid, alias := args[0], args[1]
+	return changeDevice("device set-alias", localapi.RoleOperator, uid, storage.DeviceChangeAlias, alias,
+		func(tx *sql.Tx) error {
+			_, err := tx.Exec("UPDATE devices SET alias = ?, updated_at = ? WHERE uid = ?", nullIfEmpty(alias), time.Now(), uid)
+			return err
+		})
+}
+
+func setDeviceZone(cmd *cobra.Command, args []string) error {
+	uid, zone := args[0], args[1]
+	if zone == "none" {
+		zone = ""
+	}
+	return changeDevice("device set-zone", localapi.RoleOperator, uid, storage.DeviceChangeZone, zone,
+		func(tx *sql.Tx) error {
+			if zone != "" {
+				var n int
+				if err := tx.QueryRow("SELECT COUNT(*) FROM zones WHERE uid = ?", zone).Scan(&n); err != nil {
+					return err
+				}
+				if n == 0 {
+					return fmt.Errorf("zone %s not found (see zones)", zone)
+				}
+			}
+			_, err := tx.Exec("UPDATE devices SET zone_id = ?, updated_at = ? WHERE uid = ?", nullIfEmpty(zone), time.Now(), uid)
+			return err
+		})
+}
+
+func forgetDevice(cmd *cobra.Command, args []string) error {
+	uid := args[0]
+	return changeDevice("device forget", localapi.RoleAdmin, uid, storage.DeviceChangeForget, "",
+		func(tx *sql.Tx) error {
+			var actuators int
+			if err := tx.QueryRow("SELECT COUNT(*) FROM valve_actuators WHERE controller_uid = ?", uid).Scan(&actuators); err != nil {
+				return err
+			}
+			prompt := fmt.Sprintf("Forget device %s", uid)
+			if actuators > 0 {
+				prompt += fmt.Sprintf(" and its %d valve actuators", actuators)
+			}
+			if err := confirm(prompt); err != nil {
+				return err
+			}
+			if _, err := tx.Exec("DELETE FROM valve_actuators WHERE controller_uid = ?", uid); err != nil {
+				return err
+			}
+			_, err := tx.Exec("DELETE FROM devices WHERE uid = ?", uid)
+			return err
+		})
+}
+
+func releaseDevice(cmd *cobra.Command, args []string) error {
+	uid := args[0]
+	return changeDevice("device release", localapi.RoleAdmin, uid, storage.DeviceChangeRelease, "",
+		func(tx *sql.Tx) error {
+			result, err := tx.Exec(`UPDATE devices SET quarantined_at = NULL, quarantine_reason = NULL
+				WHERE uid = ? AND quarantined_at IS NOT NULL`, uid)
+			if err != nil {
+				return err
+			}
+			if n, _ := result.RowsAffected(); n == 0 {
+				return fmt.Errorf("device %s is not quarantined", uid)
+			}
+			return nil
+		})
+}
+
+// changeDevice applies a change to an existing device and queues it for the
+// controller and the cloud, in one transaction
+func changeDevice(what string, need localapi.Role, uid, change, value string, apply func(tx *sql.Tx) error) error {
+	if err := requireRW(what); err != nil {
+		return err
+	}
+	actor, err := requireActor(what, need)
+	if err != nil {
+		return err
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var name string
+	if err := tx.QueryRow("SELECT name FROM devices WHERE uid = ?", uid).Scan(&name); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("device %s not found", uid)
+		}
+		return err
+	}
+	if err := apply(tx); err != nil {
+		return err
+	}
+	// The cloud doesn't know about quarantine, so a release has nothing to send
+	synced := change == storage.DeviceChangeRelease
+	result, err := tx.Exec(`INSERT INTO device_changes (device_uid, change, value, actor, created_at, synced_to_cloud)
+		VALUES (?, ?, ?, ?, ?, ?)`, uid, change, nullIfEmpty(value), actor, time.Now(), synced)
+	if err != nil {
+		return fmt.Errorf("failed to queue device change: %w", err)
+	}
+	id, _ := result.LastInsertId()
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	switch change {
+	case storage.DeviceChangeForget:
+		fmt.Printf("Device %s (%s) forgotten", uid, name)
+	case storage.DeviceChangeRelease:
+		fmt.Printf("Device %s (%s) released from quarantine", uid, name)
+	default:
+		fmt.Printf("Device %s (%s) %s set to %s", uid, name, change, valueOrNone(value))
+	}
+	fmt.Printf(" (change %d)\n", id)
+	return nil
+}
+
+func nullIfEmpty(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+func valueOrNone(s string) string {
+	if s == "" {
+		return "none"
+	}
+	return s
+}
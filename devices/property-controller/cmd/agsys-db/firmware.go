@@ -0,0 +1,98 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var firmwareCmd = &cobra.Command{
+	Use:   "firmware",
+	Short: "Show the firmware each device runs",
+	Long: `Show the firmware version and hardware revision each device last reported,
+from heartbeats and OTA messages, then how many devices of each type run each
+version. SYNCED shows whether the entry has been sent to the cloud since it
+last changed.`,
+	RunE: showFirmware,
+}
+
+func showFirmware(cmd *cobra.Command, args []string) error {
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`SELECT device_uid, device_type, version, hw_rev, COALESCE(previous_version, ''),
+		source, reported_at, changed_at, synced_to_cloud
+		FROM firmware_inventory ORDER BY device_type, version, device_uid`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	type versionKey struct {
+		deviceType int
+		version    string
+	}
+	counts := make(map[versionKey]int)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "DEVICE\tTYPE\tVERSION\tHW REV\tPREVIOUS\tSOURCE\tREPORTED\tCHANGED\tSYNCED")
+	fmt.Fprintln(w, "------\t----\t-------\t------\t--------\t------\t--------\t-------\t------")
+	for rows.Next() {
+		var uid, version, previous, source string
+		var deviceType int
+		var hwRev sql.NullInt64
+		var reportedAt, changedAt time.Time
+		var synced bool
+		if err := rows.Scan(&uid, &deviceType, &version, &hwRev, &previous, &source, &reportedAt, &changedAt, &synced); err != nil {
+			return err
+		}
+		counts[versionKey{deviceType, version}]++
+
+		hwStr := "-"
+		if hwRev.Valid {
+			hwStr = fmt.Sprintf("%d", hwRev.Int64)
+		}
+		if previous == "" {
+			previous = "-"
+		}
+		syncStr := "N"
+		if synced {
+			syncStr = "Y"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			uid, deviceTypeString(deviceType), version, hwStr, previous, source,
+			reportedAt.Format("2006-01-02 15:04"), changedAt.Format("2006-01-02 15:04"), syncStr)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	w.Flush()
+
+	keys := make([]versionKey, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].deviceType != keys[j].deviceType {
+			return keys[i].deviceType < keys[j].deviceType
+		}
+		return keys[i].version < keys[j].version
+	})
+	fmt.Println()
+	fmt.Println("Versions:")
+	if len(keys) == 0 {
+		fmt.Println("  none reported")
+	}
+	for _, k := range keys {
+		fmt.Printf("  %-12s %-10s %d\n", deviceTypeString(k.deviceType), k.version, counts[k])
+	}
+	return nil
+}
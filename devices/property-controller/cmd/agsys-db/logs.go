@@ -0,0 +1,118 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	logsSeverity string
+	logsSince    time.Duration
+
+	logsCmd = &cobra.Command{
+		Use:   "logs <device-uid>",
+		Short: "Show a device's firmware log",
+		Long: `Show firmware log entries a device sent in log batches, newest first.
+DEVICE TIME is the device's clock when the entry was logged (- if it wasn't
+set); RECEIVED is when the controller got it.`,
+		Args: cobra.ExactArgs(1),
+		RunE: showLogs,
+	}
+)
+
+// Log severities, in order, as stored in device_logs
+var logSeverities = []string{"debug", "info", "warning", "error"}
+
+// Firmware log entry types (AGSYS_LOG_TYPE_* in agsys_fram_log.h)
+var logTypes = map[int]string{
+	0x01: "sensor",
+	0x02: "meter",
+	0x03: "valve",
+	0x04: "alarm",
+	0x05: "config",
+	0x06: "boot",
+	0x07: "error",
+	0x08: "debug",
+	0x09: "ota",
+}
+
+func init() {
+	logsCmd.Flags().StringVar(&logsSeverity, "severity", "", "Only show entries at or above this severity (debug, info, warning, error)")
+	logsCmd.Flags().DurationVar(&logsSince, "since", 0, "Only show entries received within this, e.g. 24h")
+	logsCmd.Flags().IntVarP(&limit, "limit", "n", 50, "Number of records to show")
+}
+
+func showLogs(cmd *cobra.Command, args []string) error {
+	minSeverity := 0
+	if logsSeverity != "" {
+		minSeverity = -1
+		for i, s := range logSeverities {
+			if s == logsSeverity {
+				minSeverity = i
+			}
+		}
+		if minSeverity < 0 {
+			return fmt.Errorf("unknown severity %q (debug, info, warning, or error)", logsSeverity)
+		}
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var since time.Time
+	if logsSince > 0 {
+		since = time.Now().Add(-logsSince)
+	}
+
+	rows, err := db.Query(`SELECT id, received_at, device_time, severity, log_type, code, message
+		FROM device_logs
+		WHERE device_uid = ? AND severity >= ? AND received_at >= ?
+		ORDER BY id DESC LIMIT ?`,
+		args[0], minSeverity, since, limit)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tRECEIVED\tDEVICE TIME\tSEVERITY\tTYPE\tCODE\tMESSAGE")
+	fmt.Fprintln(w, "--\t--------\t-----------\t--------\t----\t----\t-------")
+
+	for rows.Next() {
+		var id int64
+		var received time.Time
+		var deviceTime sql.NullTime
+		var severity, logType, code int
+		var message string
+
+		if err := rows.Scan(&id, &received, &deviceTime, &severity, &logType, &code, &message); err != nil {
+			return err
+		}
+
+		deviceTimeStr := "-"
+		if deviceTime.Valid {
+			deviceTimeStr = deviceTime.Time.Local().Format("01-02 15:04:05")
+		}
+		severityStr := fmt.Sprintf("%d", severity)
+		if severity >= 0 && severity < len(logSeverities) {
+			severityStr = logSeverities[severity]
+		}
+		typeStr, ok := logTypes[logType]
+		if !ok {
+			typeStr = fmt.Sprintf("0x%02X", logType)
+		}
+
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t0x%04X\t%s\n",
+			id, received.Format("01-02 15:04:05"), deviceTimeStr, severityStr, typeStr, code, message)
+	}
+	w.Flush()
+	return rows.Err()
+}
@@ -3,6 +3,7 @@
 package main
 
 import (
+	"bufio"
 	"database/sql"
 	"fmt"
 	"os"
@@ -55,10 +56,17 @@ var (
 		RunE:  showEvents,
 	}
 
+	zonesCmd = &cobra.Command{
+		Use:   "zones",
+		Short: "Show zones synced from the cloud",
+		RunE:  showZones,
+	}
+
 	schedulesCmd = &cobra.Command{
-		Use:   "schedules",
-		Short: "Show watering schedules",
-		RunE:  showSchedules,
+		Use:     "schedules",
+		Aliases: []string{"schedule"},
+		Short:   "Show watering schedules",
+		RunE:    showSchedules,
 	}
 
 	pendingCmd = &cobra.Command{
@@ -73,32 +81,49 @@ var (
 		RunE:  showStats,
 	}
 
-	queryCmd = &cobra.Command{
-		Use:   "query [sql]",
-		Short: "Execute a raw SQL query",
-		Args:  cobra.ExactArgs(1),
-		RunE:  executeQuery,
-	}
-
-	limit int
+	limit       int
+	verbose     bool
+	linkHours   int
+	readWrite   bool
+	busyTimeout time.Duration
+	assumeYes   bool
 )
 
 func init() {
 	rootCmd.PersistentFlags().StringVarP(&dbPath, "database", "d", "/var/lib/agsys/controller.db", "Database file path")
+	rootCmd.PersistentFlags().BoolVar(&readWrite, "rw", false, "Open the database read-write (needed for writes and WAL recovery)")
+	rootCmd.PersistentFlags().DurationVar(&busyTimeout, "busy-timeout", 5*time.Second, "How long to wait for a lock held by the controller")
+	rootCmd.PersistentFlags().BoolVarP(&assumeYes, "yes", "y", false, "Don't ask for confirmation of destructive operations")
 
+	devicesCmd.Flags().BoolVarP(&verbose, "verbose", "v", false, "Show RSSI/SNR history, uptime, and unexpected reboots per device")
+	devicesCmd.Flags().IntVar(&linkHours, "hours", 24, "Hours of RSSI/SNR and reboot history for --verbose")
 	sensorCmd.Flags().IntVarP(&limit, "limit", "n", 20, "Number of records to show")
 	meterCmd.Flags().IntVarP(&limit, "limit", "n", 20, "Number of records to show")
 	eventsCmd.Flags().IntVarP(&limit, "limit", "n", 20, "Number of records to show")
 
 	rootCmd.AddCommand(devicesCmd)
+	rootCmd.AddCommand(deviceCmd)
 	rootCmd.AddCommand(sensorCmd)
 	rootCmd.AddCommand(meterCmd)
 	rootCmd.AddCommand(valvesCmd)
 	rootCmd.AddCommand(eventsCmd)
+	rootCmd.AddCommand(zonesCmd)
 	rootCmd.AddCommand(schedulesCmd)
 	rootCmd.AddCommand(pendingCmd)
 	rootCmd.AddCommand(statsCmd)
 	rootCmd.AddCommand(queryCmd)
+	rootCmd.AddCommand(usageCmd)
+	rootCmd.AddCommand(rollupsCmd)
+	rootCmd.AddCommand(alertsCmd)
+	rootCmd.AddCommand(auditCmd)
+	rootCmd.AddCommand(rejectedCmd)
+	rootCmd.AddCommand(logsCmd)
+	rootCmd.AddCommand(tokensCmd)
+	rootCmd.AddCommand(otaCmd)
+	rootCmd.AddCommand(resyncCmd)
+	rootCmd.AddCommand(decodeCmd)
+	rootCmd.AddCommand(firmwareCmd)
+	rootCmd.AddCommand(configCmd)
 }
 
 func main() {
@@ -108,8 +133,51 @@ func main() {
 	}
 }
 
+// openDB opens the database read-only unless --rw is given. Read-only
+// connections can't recover a WAL left behind by a crashed controller, so
+// --rw is also the way to inspect a database in that state.
 func openDB() (*sql.DB, error) {
-	return sql.Open("sqlite3", dbPath+"?mode=ro")
+	if _, err := os.Stat(dbPath); err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	return sql.Open("sqlite3", dsn())
+}
+
+// dsn builds the connection string for the --database, --rw and
+// --busy-timeout flags
+func dsn() string {
+	mode := "ro"
+	if readWrite {
+		mode = "rw"
+	}
+	return fmt.Sprintf("file:%s?mode=%s&_busy_timeout=%d", dbPath, mode, busyTimeout.Milliseconds())
+}
+
+// requireRW fails a write command unless the database was opened with --rw
+func requireRW(what string) error {
+	if !readWrite {
+		return fmt.Errorf("%s modifies the database; rerun with --rw", what)
+	}
+	return nil
+}
+
+// confirm asks the user to approve a destructive operation. --yes skips the
+// prompt; without a terminal to ask, the operation is refused.
+func confirm(prompt string) error {
+	if assumeYes {
+		return nil
+	}
+	if info, err := os.Stdin.Stat(); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return fmt.Errorf("%s: confirmation required, rerun with --yes", prompt)
+	}
+
+	fmt.Fprintf(os.Stderr, "%s [y/N]: ", prompt)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return nil
+	}
+	return fmt.Errorf("aborted")
 }
 
 func listDevices(cmd *cobra.Command, args []string) error {
@@ -120,27 +188,50 @@ func listDevices(cmd *cobra.Command, args []string) error {
 	defer db.Close()
 
 	rows, err := db.Query(`
-		SELECT uid, device_type, name, alias, zone_id, last_seen, battery_mv, rssi, is_registered
-		FROM devices ORDER BY last_seen DESC
+		SELECT d.uid, d.device_type, d.name, d.alias, COALESCE(z.name, d.zone_id), d.last_seen,
+			d.battery_mv, d.rssi, d.protocol_version, d.is_registered, d.quarantined_at IS NOT NULL,
+			d.uptime_sec, d.uptime_at
+		FROM devices d LEFT JOIN zones z ON z.uid = d.zone_id
+		ORDER BY d.last_seen DESC
 	`)
 	if err != nil {
 		return err
 	}
 	defer rows.Close()
 
+	var links map[string]linkStats
+	var reboots map[string]int
+	if verbose {
+		since := time.Now().Add(-time.Duration(linkHours) * time.Hour)
+		if links, err = queryLinkStats(db, since); err != nil {
+			return err
+		}
+		if reboots, err = queryReboots(db, since); err != nil {
+			return err
+		}
+	}
+
 	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
-	fmt.Fprintln(w, "UID\tTYPE\tNAME\tALIAS\tZONE\tLAST SEEN\tBATTERY\tRSSI\tREG")
-	fmt.Fprintln(w, "---\t----\t----\t-----\t----\t---------\t-------\t----\t---")
+	if verbose {
+		fmt.Fprintln(w, "UID\tTYPE\tNAME\tALIAS\tZONE\tLAST SEEN\tBATTERY\tRSSI\tPROTO\tREG\tMSGS\tRSSI BEST/WORST/AVG\tSNR BEST/WORST/AVG\tUPTIME\tREBOOTS")
+		fmt.Fprintln(w, "---\t----\t----\t-----\t----\t---------\t-------\t----\t-----\t---\t----\t-------------------\t------------------\t------\t-------")
+	} else {
+		fmt.Fprintln(w, "UID\tTYPE\tNAME\tALIAS\tZONE\tLAST SEEN\tBATTERY\tRSSI\tPROTO\tREG")
+		fmt.Fprintln(w, "---\t----\t----\t-----\t----\t---------\t-------\t----\t-----\t---")
+	}
 
 	for rows.Next() {
 		var uid, name string
 		var deviceType int
 		var alias, zoneID sql.NullString
 		var lastSeen time.Time
-		var batteryMV, rssi sql.NullInt64
-		var isRegistered bool
+		var batteryMV, rssi, protoVer sql.NullInt64
+		var isRegistered, quarantined bool
+		var uptimeSec sql.NullInt64
+		var uptimeAt sql.NullTime
 
-		if err := rows.Scan(&uid, &deviceType, &name, &alias, &zoneID, &lastSeen, &batteryMV, &rssi, &isRegistered); err != nil {
+		if err := rows.Scan(&uid, &deviceType, &name, &alias, &zoneID, &lastSeen, &batteryMV, &rssi, &protoVer, &isRegistered, &quarantined,
+			&uptimeSec, &uptimeAt); err != nil {
 			return err
 		}
 
@@ -158,19 +249,97 @@ func listDevices(cmd *cobra.Command, args []string) error {
 		if rssi.Valid {
 			rssiStr = fmt.Sprintf("%ddBm", rssi.Int64)
 		}
+		protoStr := "-"
+		if protoVer.Valid {
+			protoStr = fmt.Sprintf("v%d", protoVer.Int64)
+		}
 		regStr := "N"
-		if isRegistered {
+		if quarantined {
+			regStr = "Q" // Suspected spoof, uplinks dropped
+		} else if isRegistered {
 			regStr = "Y"
 		}
 
-		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s",
 			uid[:16], typeStr, name, aliasStr, zoneStr,
-			lastSeen.Format("2006-01-02 15:04"), battStr, rssiStr, regStr)
+			lastSeen.Format("2006-01-02 15:04"), battStr, rssiStr, protoStr, regStr)
+		if verbose {
+			if l, ok := links[uid]; ok {
+				fmt.Fprintf(w, "\t%d\t%d/%d/%.0f dBm\t%.1f/%.1f/%.1f dB",
+					l.samples, l.bestRSSI, l.worstRSSI, l.avgRSSI, l.bestSNR, l.worstSNR, l.avgSNR)
+			} else {
+				fmt.Fprint(w, "\t0\t-\t-")
+			}
+			// The uptime as of now, assuming no reboot since it was reported
+			uptimeStr := "-"
+			if uptimeSec.Valid && uptimeAt.Valid {
+				uptime := time.Duration(uptimeSec.Int64)*time.Second + time.Since(uptimeAt.Time)
+				uptimeStr = uptime.Round(time.Minute).String()
+			}
+			fmt.Fprintf(w, "\t%s\t%d", uptimeStr, reboots[uid])
+		}
+		fmt.Fprintln(w)
 	}
 	w.Flush()
 	return nil
 }
 
+// queryReboots counts each device's unexpected reboots since a time
+func queryReboots(db *sql.DB, since time.Time) (map[string]int, error) {
+	rows, err := db.Query(`
+		SELECT device_uid, COUNT(*) FROM device_reboots
+		WHERE unexpected = 1 AND timestamp >= ? GROUP BY device_uid
+	`, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reboots := make(map[string]int)
+	for rows.Next() {
+		var uid string
+		var n int
+		if err := rows.Scan(&uid, &n); err != nil {
+			return nil, err
+		}
+		reboots[uid] = n
+	}
+	return reboots, rows.Err()
+}
+
+// linkStats summarizes a device's signal quality from the link_quality table
+type linkStats struct {
+	samples             int
+	bestRSSI, worstRSSI int
+	avgRSSI             float64
+	bestSNR, worstSNR   float64
+	avgSNR              float64
+}
+
+// queryLinkStats returns per-device signal quality since a time
+func queryLinkStats(db *sql.DB, since time.Time) (map[string]linkStats, error) {
+	rows, err := db.Query(`
+		SELECT device_uid, COUNT(*), MAX(rssi), MIN(rssi), AVG(rssi), MAX(snr), MIN(snr), AVG(snr)
+		FROM link_quality WHERE received_at >= ? GROUP BY device_uid
+	`, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	links := make(map[string]linkStats)
+	for rows.Next() {
+		var uid string
+		var l linkStats
+		if err := rows.Scan(&uid, &l.samples, &l.bestRSSI, &l.worstRSSI, &l.avgRSSI,
+			&l.bestSNR, &l.worstSNR, &l.avgSNR); err != nil {
+			return nil, err
+		}
+		links[uid] = l
+	}
+	return links, rows.Err()
+}
+
 func showSensorData(cmd *cobra.Command, args []string) error {
 	db, err := openDB()
 	if err != nil {
@@ -183,13 +352,13 @@ func showSensorData(cmd *cobra.Command, args []string) error {
 
 	if len(args) > 0 {
 		query = `
-			SELECT device_uid, probe_id, moisture_percent, temperature, battery_mv, rssi, timestamp, synced_to_cloud
+			SELECT device_uid, probe_id, moisture_percent, temperature, battery_mv, rssi, timestamp, id <= ` + cursorSQL("soil_moisture_readings") + `
 			FROM soil_moisture_readings WHERE device_uid = ? ORDER BY timestamp DESC LIMIT ?
 		`
 		queryArgs = []interface{}{args[0], limit}
 	} else {
 		query = `
-			SELECT device_uid, probe_id, moisture_percent, temperature, battery_mv, rssi, timestamp, synced_to_cloud
+			SELECT device_uid, probe_id, moisture_percent, temperature, battery_mv, rssi, timestamp, id <= ` + cursorSQL("soil_moisture_readings") + `
 			FROM soil_moisture_readings ORDER BY timestamp DESC LIMIT ?
 		`
 		queryArgs = []interface{}{limit}
@@ -241,13 +410,13 @@ func showMeterData(cmd *cobra.Command, args []string) error {
 
 	if len(args) > 0 {
 		query = `
-			SELECT device_uid, total_liters, flow_rate_lpm, battery_mv, rssi, timestamp, synced_to_cloud
+			SELECT device_uid, total_volume_l, flow_rate_lpm, battery_mv, rssi, timestamp, id <= ` + cursorSQL("water_meter_readings") + `
 			FROM water_meter_readings WHERE device_uid = ? ORDER BY timestamp DESC LIMIT ?
 		`
 		queryArgs = []interface{}{args[0], limit}
 	} else {
 		query = `
-			SELECT device_uid, total_liters, flow_rate_lpm, battery_mv, rssi, timestamp, synced_to_cloud
+			SELECT device_uid, total_volume_l, flow_rate_lpm, battery_mv, rssi, timestamp, id <= ` + cursorSQL("water_meter_readings") + `
 			FROM water_meter_readings ORDER BY timestamp DESC LIMIT ?
 		`
 		queryArgs = []interface{}{limit}
@@ -265,7 +434,7 @@ func showMeterData(cmd *cobra.Command, args []string) error {
 
 	for rows.Next() {
 		var deviceUID string
-		var totalLiters int
+		var totalLiters float64
 		var flowRate float64
 		var batteryMV, rssi int
 		var timestamp time.Time
@@ -280,7 +449,7 @@ func showMeterData(cmd *cobra.Command, args []string) error {
 			syncStr = "Y"
 		}
 
-		fmt.Fprintf(w, "%s\t%d\t%.1f\t%dmV\t%ddBm\t%s\t%s\n",
+		fmt.Fprintf(w, "%s\t%.1f\t%.1f\t%dmV\t%ddBm\t%s\t%s\n",
 			deviceUID[:16], totalLiters, flowRate, batteryMV, rssi,
 			timestamp.Format("01-02 15:04"), syncStr)
 	}
@@ -296,8 +465,10 @@ func showValves(cmd *cobra.Command, args []string) error {
 	defer db.Close()
 
 	rows, err := db.Query(`
-		SELECT uid, controller_uid, address, name, alias, current_state, last_state_change, is_registered
-		FROM valve_actuators ORDER BY controller_uid, address
+		SELECT v.uid, v.controller_uid, v.address, v.name, v.alias, COALESCE(z.name, v.zone_id),
+			v.current_state, v.last_state_change, v.is_registered
+		FROM valve_actuators v LEFT JOIN zones z ON z.uid = v.zone_id
+		ORDER BY v.controller_uid, v.address
 	`)
 	if err != nil {
 		return err
@@ -305,17 +476,17 @@ func showValves(cmd *cobra.Command, args []string) error {
 	defer rows.Close()
 
 	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
-	fmt.Fprintln(w, "UID\tCONTROLLER\tADDR\tNAME\tSTATE\tLAST CHANGE\tREG")
-	fmt.Fprintln(w, "---\t----------\t----\t----\t-----\t-----------\t---")
+	fmt.Fprintln(w, "UID\tCONTROLLER\tADDR\tNAME\tALIAS\tZONE\tSTATE\tLAST CHANGE\tREG")
+	fmt.Fprintln(w, "---\t----------\t----\t----\t-----\t----\t-----\t-----------\t---")
 
 	for rows.Next() {
 		var uid, controllerUID, name string
-		var alias sql.NullString
+		var alias, zone sql.NullString
 		var address, currentState int
 		var lastChange sql.NullTime
 		var isRegistered bool
 
-		if err := rows.Scan(&uid, &controllerUID, &address, &name, &alias, &currentState, &lastChange, &isRegistered); err != nil {
+		if err := rows.Scan(&uid, &controllerUID, &address, &name, &alias, &zone, &currentState, &lastChange, &isRegistered); err != nil {
 			return err
 		}
 
@@ -329,8 +500,56 @@ func showValves(cmd *cobra.Command, args []string) error {
 			regStr = "Y"
 		}
 
-		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\t%s\n",
-			uid, controllerUID[:16], address, name, stateStr, changeStr, regStr)
+		zoneStr := zone.String
+		if zoneStr == "" {
+			zoneStr = "-"
+		}
+		aliasStr := alias.String
+		if aliasStr == "" {
+			aliasStr = "-"
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			uid, controllerUID[:16], address, name, aliasStr, zoneStr, stateStr, changeStr, regStr)
+	}
+	w.Flush()
+	return nil
+}
+
+func showZones(cmd *cobra.Command, args []string) error {
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`
+		SELECT z.uid, z.name, z.alias, z.updated_at,
+			(SELECT COUNT(*) FROM devices d WHERE d.zone_id = z.uid),
+			(SELECT COUNT(*) FROM valve_actuators v WHERE v.zone_id = z.uid)
+		FROM zones z ORDER BY z.name, z.uid
+	`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "UID\tNAME\tALIAS\tDEVICES\tVALVES\tUPDATED")
+	fmt.Fprintln(w, "---\t----\t-----\t-------\t------\t-------")
+
+	for rows.Next() {
+		var uid, name string
+		var alias sql.NullString
+		var updatedAt time.Time
+		var devices, valves int
+
+		if err := rows.Scan(&uid, &name, &alias, &updatedAt, &devices, &valves); err != nil {
+			return err
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%s\n",
+			uid, name, alias.String, devices, valves, updatedAt.Format("2006-01-02 15:04"))
 	}
 	w.Flush()
 	return nil
@@ -348,13 +567,13 @@ func showEvents(cmd *cobra.Command, args []string) error {
 
 	if len(args) > 0 {
 		query = `
-			SELECT controller_uid, actuator_addr, prev_state, new_state, source, timestamp, synced_to_cloud
+			SELECT controller_uid, actuator_addr, prev_state, new_state, source, COALESCE(note, ''), timestamp, id <= ` + cursorSQL("valve_events") + `
 			FROM valve_events WHERE controller_uid = ? ORDER BY timestamp DESC LIMIT ?
 		`
 		queryArgs = []interface{}{args[0], limit}
 	} else {
 		query = `
-			SELECT controller_uid, actuator_addr, prev_state, new_state, source, timestamp, synced_to_cloud
+			SELECT controller_uid, actuator_addr, prev_state, new_state, source, COALESCE(note, ''), timestamp, id <= ` + cursorSQL("valve_events") + `
 			FROM valve_events ORDER BY timestamp DESC LIMIT ?
 		`
 		queryArgs = []interface{}{limit}
@@ -367,17 +586,17 @@ func showEvents(cmd *cobra.Command, args []string) error {
 	defer rows.Close()
 
 	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
-	fmt.Fprintln(w, "CONTROLLER\tADDR\tFROM\tTO\tSOURCE\tTIME\tSYNC")
-	fmt.Fprintln(w, "----------\t----\t----\t--\t------\t----\t----")
+	fmt.Fprintln(w, "CONTROLLER\tADDR\tFROM\tTO\tSOURCE\tTIME\tSYNC\tNOTE")
+	fmt.Fprintln(w, "----------\t----\t----\t--\t------\t----\t----\t----")
 
 	for rows.Next() {
-		var controllerUID, source string
+		var controllerUID, source, note string
 		var actuatorAddr int
 		var prevState, newState sql.NullInt64
 		var timestamp time.Time
 		var synced bool
 
-		if err := rows.Scan(&controllerUID, &actuatorAddr, &prevState, &newState, &source, &timestamp, &synced); err != nil {
+		if err := rows.Scan(&controllerUID, &actuatorAddr, &prevState, &newState, &source, &note, &timestamp, &synced); err != nil {
 			return err
 		}
 
@@ -391,9 +610,9 @@ func showEvents(cmd *cobra.Command, args []string) error {
 			syncStr = "Y"
 		}
 
-		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\t%s\n",
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\t%s\t%s\n",
 			controllerUID[:16], actuatorAddr, prevStr, newStr, source,
-			timestamp.Format("01-02 15:04"), syncStr)
+			timestamp.Format("01-02 15:04"), syncStr, note)
 	}
 	w.Flush()
 	return nil
@@ -454,7 +673,8 @@ func showPending(cmd *cobra.Command, args []string) error {
 	defer db.Close()
 
 	rows, err := db.Query(`
-		SELECT command_id, controller_uid, actuator_addr, command, created_at, expires_at, retries, max_retries, acknowledged
+		SELECT command_id, controller_uid, actuator_addr, command, created_at, expires_at, retries, max_retries, acknowledged,
+			COALESCE(failed, 0)
 		FROM pending_commands WHERE acknowledged = 0 ORDER BY created_at DESC
 	`)
 	if err != nil {
@@ -463,26 +683,30 @@ func showPending(cmd *cobra.Command, args []string) error {
 	defer rows.Close()
 
 	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
-	fmt.Fprintln(w, "CMD ID\tCONTROLLER\tADDR\tCOMMAND\tCREATED\tEXPIRES\tRETRIES")
-	fmt.Fprintln(w, "------\t----------\t----\t-------\t-------\t-------\t-------")
+	fmt.Fprintln(w, "CMD ID\tCONTROLLER\tADDR\tCOMMAND\tCREATED\tEXPIRES\tRETRIES\tSTATUS")
+	fmt.Fprintln(w, "------\t----------\t----\t-------\t-------\t-------\t-------\t------")
 
 	for rows.Next() {
 		var commandID int
 		var controllerUID string
 		var actuatorAddr, command, retries, maxRetries int
 		var createdAt, expiresAt time.Time
-		var acknowledged bool
+		var acknowledged, failed bool
 
-		if err := rows.Scan(&commandID, &controllerUID, &actuatorAddr, &command, &createdAt, &expiresAt, &retries, &maxRetries, &acknowledged); err != nil {
+		if err := rows.Scan(&commandID, &controllerUID, &actuatorAddr, &command, &createdAt, &expiresAt, &retries, &maxRetries, &acknowledged, &failed); err != nil {
 			return err
 		}
 
 		cmdStr := valveCommandString(command)
+		statusStr := "waiting"
+		if failed {
+			statusStr = "FAILED"
+		}
 
-		fmt.Fprintf(w, "%d\t%s\t%d\t%s\t%s\t%s\t%d/%d\n",
+		fmt.Fprintf(w, "%d\t%s\t%d\t%s\t%s\t%s\t%d/%d\t%s\n",
 			commandID, controllerUID[:16], actuatorAddr, cmdStr,
 			createdAt.Format("15:04:05"), expiresAt.Format("15:04:05"),
-			retries, maxRetries)
+			retries, maxRetries, statusStr)
 	}
 	w.Flush()
 	return nil
@@ -503,92 +727,93 @@ func showStats(cmd *cobra.Command, args []string) error {
 	db.QueryRow("SELECT COUNT(*) FROM devices").Scan(&deviceCount)
 	fmt.Printf("Devices: %d\n", deviceCount)
 
+	// Local device changes the cloud hasn't been told about
+	var unappliedChanges, unsyncedChanges int
+	db.QueryRow("SELECT COUNT(*) FROM device_changes WHERE applied_at IS NULL").Scan(&unappliedChanges)
+	db.QueryRow("SELECT COUNT(*) FROM device_changes WHERE synced_to_cloud = 0").Scan(&unsyncedChanges)
+	if unappliedChanges > 0 || unsyncedChanges > 0 {
+		fmt.Printf("Device changes: %d not yet applied by the controller, %d not synced\n", unappliedChanges, unsyncedChanges)
+	}
+
 	// Sensor readings
 	var sensorCount, unsyncedSensor int
 	db.QueryRow("SELECT COUNT(*) FROM soil_moisture_readings").Scan(&sensorCount)
-	db.QueryRow("SELECT COUNT(*) FROM soil_moisture_readings WHERE synced_to_cloud = 0").Scan(&unsyncedSensor)
+	db.QueryRow("SELECT COUNT(*) FROM soil_moisture_readings WHERE id > " + cursorSQL("soil_moisture_readings")).Scan(&unsyncedSensor)
 	fmt.Printf("Sensor readings: %d (unsynced: %d)\n", sensorCount, unsyncedSensor)
 
 	// Water meter readings
 	var meterCount, unsyncedMeter int
 	db.QueryRow("SELECT COUNT(*) FROM water_meter_readings").Scan(&meterCount)
-	db.QueryRow("SELECT COUNT(*) FROM water_meter_readings WHERE synced_to_cloud = 0").Scan(&unsyncedMeter)
+	db.QueryRow("SELECT COUNT(*) FROM water_meter_readings WHERE id > " + cursorSQL("water_meter_readings")).Scan(&unsyncedMeter)
 	fmt.Printf("Meter readings: %d (unsynced: %d)\n", meterCount, unsyncedMeter)
 
 	// Valve events
 	var eventCount, unsyncedEvents int
 	db.QueryRow("SELECT COUNT(*) FROM valve_events").Scan(&eventCount)
-	db.QueryRow("SELECT COUNT(*) FROM valve_events WHERE synced_to_cloud = 0").Scan(&unsyncedEvents)
+	db.QueryRow("SELECT COUNT(*) FROM valve_events WHERE id > " + cursorSQL("valve_events")).Scan(&unsyncedEvents)
 	fmt.Printf("Valve events: %d (unsynced: %d)\n", eventCount, unsyncedEvents)
 
+	// Device logs, and those queued for a cloud that can't take them yet
+	var logCount, unsyncedLogs int
+	db.QueryRow("SELECT COUNT(*) FROM device_logs").Scan(&logCount)
+	db.QueryRow("SELECT COUNT(*) FROM device_logs WHERE synced_to_cloud = 0").Scan(&unsyncedLogs)
+	fmt.Printf("Device log entries: %d (unsynced: %d)\n", logCount, unsyncedLogs)
+
 	// Pending commands
 	var pendingCount int
-	db.QueryRow("SELECT COUNT(*) FROM pending_commands WHERE acknowledged = 0").Scan(&pendingCount)
-	fmt.Printf("Pending commands: %d\n", pendingCount)
+	var failedCount int
+	db.QueryRow("SELECT COUNT(*) FROM pending_commands WHERE acknowledged = 0 AND COALESCE(failed, 0) = 0").Scan(&pendingCount)
+	db.QueryRow("SELECT COUNT(*) FROM pending_commands WHERE COALESCE(failed, 0) = 1").Scan(&failedCount)
+	fmt.Printf("Pending commands: %d (failed: %d)\n", pendingCount, failedCount)
 
 	// Schedules
 	var scheduleCount int
 	db.QueryRow("SELECT COUNT(*) FROM schedules").Scan(&scheduleCount)
 	fmt.Printf("Schedules: %d\n", scheduleCount)
 
-	return nil
-}
-
-func executeQuery(cmd *cobra.Command, args []string) error {
-	db, err := openDB()
-	if err != nil {
-		return err
+	// File sizes
+	fmt.Println()
+	for _, f := range []struct{ label, path string }{{"Database file", dbPath}, {"WAL file", dbPath + "-wal"}} {
+		if info, err := os.Stat(f.path); err == nil {
+			fmt.Printf("%s: %.1f MB\n", f.label, float64(info.Size())/(1024*1024))
+		}
 	}
-	defer db.Close()
 
-	query := args[0]
-
-	// Only allow SELECT queries for safety
-	if !strings.HasPrefix(strings.ToUpper(strings.TrimSpace(query)), "SELECT") {
-		return fmt.Errorf("only SELECT queries are allowed")
-	}
+	return showMaintenance(db)
+}
 
-	rows, err := db.Query(query)
+// showMaintenance prints the most recent run of each maintenance task
+func showMaintenance(db *sql.DB) error {
+	rows, err := db.Query(`SELECT task, ok, COALESCE(result, ''), duration_ms, ran_at
+		FROM maintenance_runs
+		WHERE id IN (SELECT MAX(id) FROM maintenance_runs GROUP BY task)
+		ORDER BY task`)
 	if err != nil {
-		return err
+		return nil // Database predates maintenance tracking
 	}
 	defer rows.Close()
 
-	cols, err := rows.Columns()
-	if err != nil {
-		return err
-	}
-
+	fmt.Println()
+	fmt.Println("Maintenance:")
 	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
-	fmt.Fprintln(w, strings.Join(cols, "\t"))
-	fmt.Fprintln(w, strings.Repeat("-\t", len(cols)))
-
-	values := make([]interface{}, len(cols))
-	valuePtrs := make([]interface{}, len(cols))
-	for i := range values {
-		valuePtrs[i] = &values[i]
-	}
-
+	fmt.Fprintln(w, "  TASK\tLAST RUN\tSTATUS\tDURATION\tRESULT")
+	fmt.Fprintln(w, "  ----\t--------\t------\t--------\t------")
 	for rows.Next() {
-		if err := rows.Scan(valuePtrs...); err != nil {
+		var task, result string
+		var ok bool
+		var durationMS int64
+		var ranAt time.Time
+		if err := rows.Scan(&task, &ok, &result, &durationMS, &ranAt); err != nil {
 			return err
 		}
-
-		var row []string
-		for _, v := range values {
-			switch val := v.(type) {
-			case nil:
-				row = append(row, "NULL")
-			case []byte:
-				row = append(row, string(val))
-			default:
-				row = append(row, fmt.Sprintf("%v", val))
-			}
+		status := "OK"
+		if !ok {
+			status = "FAILED"
 		}
-		fmt.Fprintln(w, strings.Join(row, "\t"))
+		fmt.Fprintf(w, "  %s\t%s\t%s\t%dms\t%s\n", task, ranAt.Local().Format(time.DateTime), status, durationMS, result)
 	}
 	w.Flush()
-	return nil
+	return rows.Err()
 }
 
 func deviceTypeString(t int) string {
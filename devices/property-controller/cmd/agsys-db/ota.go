@@ -0,0 +1,112 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	otaFirmwareDir string
+	otaDevice      string
+
+	otaCmd = &cobra.Command{
+		Use:   "ota",
+		Short: "Show cached firmware and OTA update progress",
+		Long: `Show the firmware images cached for OTA updates and the latest update of each
+device as recorded by the controller. ACKED is the chunks the device has
+confirmed out of the total; a device stuck in transferring or verifying with
+a stale LAST ACTIVITY has stopped responding.`,
+		RunE: showOTA,
+	}
+)
+
+func init() {
+	otaCmd.Flags().StringVar(&otaFirmwareDir, "firmware-dir", "/var/lib/agsys/firmware", "Firmware cache directory")
+	otaCmd.Flags().StringVar(&otaDevice, "device", "", "Only show this device UID")
+}
+
+func showOTA(cmd *cobra.Command, args []string) error {
+	if err := showCachedFirmware(); err != nil {
+		return err
+	}
+	fmt.Println()
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`SELECT device_uid, device_type, COALESCE(current_version, '-'), COALESCE(target_version, '-'),
+		state, COALESCE(chunks_acked, 0), COALESCE(total_chunks, 0), COALESCE(retry_count, 0),
+		last_activity, COALESCE(error_message, '')
+		FROM ota_updates
+		WHERE (? = '' OR device_uid = ?)
+		ORDER BY updated_at DESC`, otaDevice, otaDevice)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "DEVICE\tTYPE\tFROM\tTO\tSTATE\tACKED\tRETRIES\tLAST ACTIVITY\tERROR")
+	fmt.Fprintln(w, "------\t----\t----\t--\t-----\t-----\t-------\t-------------\t-----")
+
+	for rows.Next() {
+		var deviceUID, from, to, state, errMsg string
+		var deviceType, acked, total, retries int
+		var lastActivity sql.NullTime
+
+		if err := rows.Scan(&deviceUID, &deviceType, &from, &to, &state, &acked, &total, &retries,
+			&lastActivity, &errMsg); err != nil {
+			return err
+		}
+
+		activity := "-"
+		if lastActivity.Valid {
+			activity = lastActivity.Time.Format("01-02 15:04:05")
+		}
+		if errMsg == "" {
+			errMsg = "-"
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%d/%d\t%d\t%s\t%s\n",
+			deviceUID, deviceType, from, to, state, acked, total, retries, activity, errMsg)
+	}
+	w.Flush()
+	return rows.Err()
+}
+
+// showCachedFirmware lists the images in the firmware cache, named
+// <device type>_<major>.<minor>.<patch>.bin by the controller
+func showCachedFirmware() error {
+	entries, err := os.ReadDir(otaFirmwareDir)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read firmware cache: %w", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TYPE\tVERSION\tSIZE\tCACHED")
+	fmt.Fprintln(w, "----\t-------\t----\t------")
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		var deviceType, major, minor, patch uint8
+		if n, _ := fmt.Sscanf(entry.Name(), "%d_%d.%d.%d.bin", &deviceType, &major, &minor, &patch); n != 4 {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%d\t%d.%d.%d\t%d\t%s\n",
+			deviceType, major, minor, patch, info.Size(), info.ModTime().Format(time.DateTime))
+	}
+	return w.Flush()
+}
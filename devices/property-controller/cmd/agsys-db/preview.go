@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/agsys/property-controller/internal/localapi"
+	"github.com/spf13/cobra"
+)
+
+var (
+	previewDays   int
+	previewSocket string
+
+	schedulePreviewCmd = &cobra.Command{
+		Use:   "preview",
+		Short: "Show the valve runs and water use expected from the schedules",
+		Long: `Expand the active schedules over the coming days into the runs each valve is
+expected to make and the open and close events they produce. The running
+controller applies its rules: runs are skipped during an emergency stop or a
+manual override, scaled or skipped for the weather, and cut short by a valve's
+runtime limit. Water use is estimated from valves.flow_lpm in the controller
+config and is left blank for valves without a flow.`,
+		Args: cobra.NoArgs,
+		RunE: showSchedulePreview,
+	}
+)
+
+func init() {
+	schedulePreviewCmd.Flags().IntVar(&previewDays, "days", 7, fmt.Sprintf("Number of days to preview (1-%d)", localapi.MaxPreviewDays))
+	schedulePreviewCmd.Flags().StringVar(&previewSocket, "socket", localapi.DefaultConfig().SocketPath, "Local API socket of the running controller")
+	schedulesCmd.AddCommand(schedulePreviewCmd)
+}
+
+func showSchedulePreview(cmd *cobra.Command, args []string) error {
+	if previewDays < 1 || previewDays > localapi.MaxPreviewDays {
+		return fmt.Errorf("invalid --days %d (1-%d)", previewDays, localapi.MaxPreviewDays)
+	}
+	client := localapi.NewClient(previewSocket)
+	client.SetToken(apiToken)
+	preview, err := client.SchedulePreview(previewDays)
+	if err != nil {
+		return fmt.Errorf("failed to get preview from the controller: %w", err)
+	}
+
+	fmt.Printf("Schedule preview %s to %s\n\n", preview.From.Local().Format("2006-01-02 15:04"), preview.Until.Local().Format("2006-01-02 15:04"))
+	if len(preview.Runs) == 0 {
+		fmt.Println("No scheduled runs")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "START\tEND\tSCHEDULE\tCONTROLLER\tADDR\tVALVE\tMINS\tWATER L\tNOTE")
+	fmt.Fprintln(w, "-----\t---\t--------\t----------\t----\t-----\t----\t-------\t----")
+
+	var days []string
+	dayWater := make(map[string]float64)
+	dayMins := make(map[string]int)
+	for _, r := range preview.Runs {
+		start := r.Start.Local()
+		end, mins, water := "-", "skip", "-"
+		if !r.Skipped {
+			end = start.Add(time.Duration(r.DurationMins) * time.Minute).Format("15:04")
+			mins = fmt.Sprintf("%d", r.DurationMins)
+			if r.WaterL > 0 {
+				water = fmt.Sprintf("%.0f", r.WaterL)
+			}
+		}
+		valve := r.Valve
+		if valve == "" {
+			valve = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\t%s\n",
+			start.Format("Mon 01-02 15:04"), end, r.ScheduleName, r.ControllerUID, r.Address,
+			valve, mins, water, r.Reason)
+
+		day := start.Format("Mon 2006-01-02")
+		if _, ok := dayMins[day]; !ok {
+			days = append(days, day)
+		}
+		dayMins[day] += r.DurationMins
+		dayWater[day] += r.WaterL
+	}
+	w.Flush()
+
+	fmt.Println()
+	w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "DAY\tVALVE MINS\tWATER L")
+	fmt.Fprintln(w, "---\t----------\t-------")
+	total := 0
+	for _, day := range days {
+		fmt.Fprintf(w, "%s\t%d\t%.0f\n", day, dayMins[day], dayWater[day])
+		total += dayMins[day]
+	}
+	fmt.Fprintf(w, "Total\t%d\t%.0f\n", total, preview.WaterL)
+	w.Flush()
+	return nil
+}
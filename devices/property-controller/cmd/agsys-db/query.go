@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+	"github.com/spf13/cobra"
+
+	"github.com/agsys/property-controller/internal/localapi"
+)
+
+// sqliteRecursive is SQLITE_RECURSIVE, which go-sqlite3 does not export
+const sqliteRecursive = 33
+
+var (
+	queryParams  []string
+	queryLimit   int
+	queryTimeout time.Duration
+
+	queryCmd = &cobra.Command{
+		Use:   "query [sql]",
+		Short: "Execute a raw SQL query (writes require --rw)",
+		Long: `Execute a raw SQL query.
+
+Queries run under a SQLite authorizer that only allows reading, so writes
+can't be smuggled in through a CTE, ATTACH, or a pragma. A statement the
+authorizer rejects is run only with --rw and an admin --token, after
+confirmation.
+
+Bind values to ? placeholders in order with --param VALUE, or to named
+placeholders with --param :name=VALUE. Values are bound as text.`,
+		Example: `  agsys-db query "SELECT * FROM devices WHERE uid = ?" --param 0102030405060708
+  agsys-db query "SELECT * FROM water_meter_readings WHERE device_uid = :uid" -p :uid=0102030405060708 -n 50`,
+		Args: cobra.ExactArgs(1),
+		RunE: executeQuery,
+	}
+
+	// readGuard authorizes every statement prepared on a guarded connection
+	readGuard queryGuard
+)
+
+func init() {
+	queryCmd.Flags().StringArrayVarP(&queryParams, "param", "p", nil, "Bind a parameter: VALUE for ?, or :name=VALUE (repeatable)")
+	queryCmd.Flags().IntVarP(&queryLimit, "limit", "n", 1000, "Maximum number of rows to show (0 for no limit)")
+	queryCmd.Flags().DurationVar(&queryTimeout, "timeout", 30*time.Second, "Cancel the query after this long (0 for no timeout)")
+
+	sql.Register("sqlite3_readonly", &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			conn.RegisterAuthorizer(readGuard.authorize)
+			return nil
+		},
+	})
+}
+
+// queryGuard is a SQLite authorizer that only allows reads. SQLite consults
+// it for every table, column, function, and pragma while preparing a
+// statement, so it sees writes that a check of the leading keyword misses.
+type queryGuard struct {
+	denied string // First operation refused, for the error message
+}
+
+// readOnlyPragmas are pragmas that only report information
+var readOnlyPragmas = map[string]bool{
+	"table_info":       true,
+	"table_xinfo":      true,
+	"index_list":       true,
+	"index_info":       true,
+	"index_xinfo":      true,
+	"foreign_key_list": true,
+	"integrity_check":  true,
+	"quick_check":      true,
+	"compile_options":  true,
+	"database_list":    true,
+}
+
+// readOnlyWithoutValue are pragmas that only report when not given a value
+var readOnlyWithoutValue = map[string]bool{
+	"journal_mode":   true,
+	"user_version":   true,
+	"page_count":     true,
+	"page_size":      true,
+	"freelist_count": true,
+	"busy_timeout":   true,
+}
+
+func (g *queryGuard) authorize(op int, arg1, arg2, arg3 string) int {
+	switch op {
+	case sqlite3.SQLITE_SELECT, sqlite3.SQLITE_READ, sqliteRecursive:
+		return sqlite3.SQLITE_OK
+	case sqlite3.SQLITE_FUNCTION:
+		if !strings.EqualFold(arg2, "load_extension") {
+			return sqlite3.SQLITE_OK
+		}
+	case sqlite3.SQLITE_PRAGMA:
+		name := strings.ToLower(arg1)
+		if readOnlyPragmas[name] || (readOnlyWithoutValue[name] && arg2 == "") {
+			return sqlite3.SQLITE_OK
+		}
+	}
+
+	if g.denied == "" {
+		g.denied = authorizerOpString(op, arg1, arg2)
+	}
+	return sqlite3.SQLITE_DENY
+}
+
+func authorizerOpString(op int, arg1, arg2 string) string {
+	switch op {
+	case sqlite3.SQLITE_INSERT:
+		return "insert into " + arg1
+	case sqlite3.SQLITE_UPDATE:
+		return "update of " + arg1
+	case sqlite3.SQLITE_DELETE:
+		return "delete from " + arg1
+	case sqlite3.SQLITE_ATTACH:
+		return "ATTACH"
+	case sqlite3.SQLITE_PRAGMA:
+		return "PRAGMA " + arg1
+	case sqlite3.SQLITE_FUNCTION:
+		return arg2 + "()"
+	case sqlite3.SQLITE_TRANSACTION:
+		return "transaction control"
+	default:
+		return fmt.Sprintf("operation %d", op)
+	}
+}
+
+// openGuardedDB opens the database on a connection that only allows reads
+func openGuardedDB() (*sql.DB, error) {
+	if _, err := os.Stat(dbPath); err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	db, err := sql.Open("sqlite3_readonly", dsn())
+	if err != nil {
+		return nil, err
+	}
+	// One connection, so readGuard describes the statement just prepared
+	db.SetMaxOpenConns(1)
+	return db, nil
+}
+
+// parseParams converts --param flags into query arguments
+func parseParams(params []string) []interface{} {
+	args := make([]interface{}, 0, len(params))
+	for _, p := range params {
+		if len(p) > 1 && strings.ContainsRune(":@$", rune(p[0])) {
+			if name, value, ok := strings.Cut(p[1:], "="); ok && name != "" {
+				args = append(args, sql.Named(name, value))
+				continue
+			}
+		}
+		args = append(args, p)
+	}
+	return args
+}
+
+// queryContext applies --timeout
+func queryContext() (context.Context, context.CancelFunc) {
+	if queryTimeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), queryTimeout)
+}
+
+func executeQuery(cmd *cobra.Command, args []string) error {
+	db, err := openGuardedDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	query := args[0]
+	params := parseParams(queryParams)
+
+	ctx, cancel := queryContext()
+	defer cancel()
+
+	readGuard.denied = ""
+	rows, err := db.QueryContext(ctx, query, params...)
+	if err != nil {
+		if readGuard.denied != "" {
+			return executeWrite(query, params, readGuard.denied)
+		}
+		return err
+	}
+	defer rows.Close()
+
+	cols, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(cols, "\t"))
+	fmt.Fprintln(w, strings.Repeat("-\t", len(cols)))
+
+	values := make([]interface{}, len(cols))
+	valuePtrs := make([]interface{}, len(cols))
+	for i := range values {
+		valuePtrs[i] = &values[i]
+	}
+
+	shown := 0
+	for rows.Next() {
+		if queryLimit > 0 && shown == queryLimit {
+			w.Flush()
+			fmt.Println("(more rows not shown, raise --limit)")
+			return nil
+		}
+		if err := rows.Scan(valuePtrs...); err != nil {
+			return err
+		}
+
+		var row []string
+		for _, v := range values {
+			switch val := v.(type) {
+			case nil:
+				row = append(row, "NULL")
+			case []byte:
+				row = append(row, string(val))
+			default:
+				row = append(row, fmt.Sprintf("%v", val))
+			}
+		}
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+		shown++
+	}
+	w.Flush()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("query failed: %w", err)
+	}
+	return nil
+}
+
+// executeWrite runs a statement the read-only guard refused, after --rw and
+// confirmation checks
+func executeWrite(query string, params []interface{}, denied string) error {
+	if err := requireRW(fmt.Sprintf("query (%s)", denied)); err != nil {
+		return err
+	}
+	if err := requireToken("query --rw", localapi.RoleAdmin); err != nil {
+		return err
+	}
+	if err := confirm(fmt.Sprintf("Run %q against %s", strings.TrimSpace(query), dbPath)); err != nil {
+		return err
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ctx, cancel := queryContext()
+	defer cancel()
+
+	result, err := db.ExecContext(ctx, query, params...)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil {
+		fmt.Printf("%d rows affected\n", n)
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"database/sql"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// queryTestDB creates a database of three rows for agsys-db query to read
+func queryTestDB(t *testing.T) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "controller.db")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+	if _, err := db.Exec(`CREATE TABLE devices (id INTEGER PRIMARY KEY, name TEXT);
+		INSERT INTO devices (id, name) VALUES (1, 'north'), (2, 'south'), (3, 'east')`); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+
+	savedPath, savedRW := dbPath, readWrite
+	dbPath, readWrite = path, false
+	t.Cleanup(func() { dbPath, readWrite = savedPath, savedRW })
+}
+
+// runQuery runs agsys-db query with the given flags, returning what it printed
+func runQuery(t *testing.T, query string, params []string, limit int, timeout time.Duration) (string, error) {
+	t.Helper()
+	savedParams, savedLimit, savedTimeout := queryParams, queryLimit, queryTimeout
+	queryParams, queryLimit, queryTimeout = params, limit, timeout
+	defer func() { queryParams, queryLimit, queryTimeout = savedParams, savedLimit, savedTimeout }()
+
+	return captureStdout(t, func() error { return executeQuery(nil, []string{query}) })
+}
+
+// captureStdout runs fn, returning what it printed along with its error
+func captureStdout(t *testing.T, fn func() error) (string, error) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Pipe failed: %v", err)
+	}
+	out := make(chan string)
+	go func() {
+		b, _ := io.ReadAll(r)
+		out <- string(b)
+	}()
+	stdout := os.Stdout
+	os.Stdout = w
+	err = fn()
+	os.Stdout = stdout
+	w.Close()
+	return <-out, err
+}
+
+// TestQueryGuard tests that statements which write, however they are
+// phrased, are refused without --rw, and that reads pass
+func TestQueryGuard(t *testing.T) {
+	queryTestDB(t)
+
+	denied := []string{
+		"DELETE FROM devices",
+		"WITH x AS (SELECT 1) DELETE FROM devices",
+		"INSERT INTO devices (id, name) VALUES (4, 'west') RETURNING id",
+		"UPDATE devices SET name = 'west' RETURNING id",
+		"ATTACH DATABASE ':memory:' AS other",
+		"PRAGMA journal_mode=DELETE",
+		"PRAGMA user_version=7",
+		"SELECT load_extension('/tmp/evil')",
+		"BEGIN",
+	}
+	for _, query := range denied {
+		t.Run(query, func(t *testing.T) {
+			_, err := runQuery(t, query, nil, 1000, 0)
+			if err == nil || !strings.Contains(err.Error(), "rerun with --rw") {
+				t.Errorf("Query error = %v, want a refusal without --rw", err)
+			}
+		})
+	}
+
+	out, err := runQuery(t, "SELECT COUNT(*) FROM devices", nil, 1000, 0)
+	if err != nil || !strings.Contains(out, "3") {
+		t.Errorf("Rows after refused writes: %q (err %v), want 3", out, err)
+	}
+
+	allowed := []struct{ query, want string }{
+		{"SELECT name FROM devices ORDER BY id", "north"},
+		{"SELECT upper(name) FROM devices WHERE id = 1", "NORTH"},
+		{"WITH RECURSIVE n(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM n WHERE i < 5) SELECT MAX(i) AS top FROM n", "5"},
+		{"PRAGMA table_info(devices)", "name"},
+		{"PRAGMA journal_mode", "journal_mode"},
+	}
+	for _, tt := range allowed {
+		t.Run(tt.query, func(t *testing.T) {
+			out, err := runQuery(t, tt.query, nil, 1000, 0)
+			if err != nil {
+				t.Fatalf("Query failed: %v", err)
+			}
+			if !strings.Contains(out, tt.want) {
+				t.Errorf("Query output %q lacks %q", out, tt.want)
+			}
+		})
+	}
+}
+
+// TestQueryFlags tests that --param, --limit, and --timeout take effect
+func TestQueryFlags(t *testing.T) {
+	queryTestDB(t)
+
+	out, err := runQuery(t, "SELECT name FROM devices WHERE id = ?", []string{"2"}, 1000, 0)
+	if err != nil || !strings.Contains(out, "south") || strings.Contains(out, "north") {
+		t.Errorf("Positional parameter: %q (err %v), want only south", out, err)
+	}
+
+	out, err = runQuery(t, "SELECT id FROM devices WHERE name = :name", []string{":name=east"}, 1000, 0)
+	if err != nil || !strings.Contains(out, "3") || strings.Contains(out, "1") {
+		t.Errorf("Named parameter: %q (err %v), want only 3", out, err)
+	}
+
+	out, err = runQuery(t, "SELECT name FROM devices ORDER BY id", nil, 2, 0)
+	if err != nil || !strings.Contains(out, "south") || strings.Contains(out, "east") ||
+		!strings.Contains(out, "more rows not shown") {
+		t.Errorf("Limit of 2: %q (err %v), want two rows and a note", out, err)
+	}
+
+	start := time.Now()
+	_, err = runQuery(t, "WITH RECURSIVE n(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM n) SELECT COUNT(*) FROM n",
+		nil, 1000, 50*time.Millisecond)
+	if err == nil {
+		t.Error("Endless query succeeded, want it cancelled by the timeout")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Timeout of 50ms took %s to cancel the query", elapsed)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	rejectedDevice  string
+	rejectedReason  string
+	rejectedSince   time.Duration
+	rejectedReading bool
+
+	rejectedCmd = &cobra.Command{
+		Use:   "rejected",
+		Short: "Show readings rejected by validation",
+		Long: `Show soil and water meter readings that failed range, rate-of-change, or
+totalizer checks. Rejected readings are not stored with the other readings or
+synced to the cloud. PREVIOUS is the last accepted value the reading was
+compared against.`,
+		RunE: showRejected,
+	}
+)
+
+func init() {
+	rejectedCmd.Flags().StringVar(&rejectedDevice, "device", "", "Only show this device UID")
+	rejectedCmd.Flags().StringVar(&rejectedReason, "reason", "", "Only show this reason (moisture_range, temperature_range, moisture_step, totalizer_invalid, totalizer_decrease)")
+	rejectedCmd.Flags().DurationVar(&rejectedSince, "since", 0, "Only show readings newer than this, e.g. 24h")
+	rejectedCmd.Flags().BoolVar(&rejectedReading, "reading", false, "Show the raw reading")
+	rejectedCmd.Flags().IntVarP(&limit, "limit", "n", 50, "Number of records to show")
+}
+
+func showRejected(cmd *cobra.Command, args []string) error {
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var since time.Time
+	if rejectedSince > 0 {
+		since = time.Now().Add(-rejectedSince)
+	}
+
+	rows, err := db.Query(`SELECT id, timestamp, device_uid, probe_id, reading_type, reason, COALESCE(value, 0),
+		COALESCE(CAST(previous AS TEXT), '-'), COALESCE(reading, '-')
+		FROM rejected_readings
+		WHERE (? = '' OR device_uid = ?) AND (? = '' OR reason = ?) AND timestamp >= ?
+		ORDER BY id DESC LIMIT ?`,
+		rejectedDevice, rejectedDevice, rejectedReason, rejectedReason, since, limit)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	header := "ID\tTIME\tDEVICE\tPROBE\tTYPE\tREASON\tVALUE\tPREVIOUS"
+	rule := "--\t----\t------\t-----\t----\t------\t-----\t--------"
+	if rejectedReading {
+		header += "\tREADING"
+		rule += "\t-------"
+	}
+	fmt.Fprintln(w, header)
+	fmt.Fprintln(w, rule)
+
+	for rows.Next() {
+		var id int64
+		var ts time.Time
+		var deviceUID, readingType, reason, previous, reading string
+		var probe int
+		var value float64
+
+		if err := rows.Scan(&id, &ts, &deviceUID, &probe, &readingType, &reason, &value, &previous, &reading); err != nil {
+			return err
+		}
+
+		fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%s\t%s\t%g\t%s",
+			id, ts.Format("01-02 15:04:05"), deviceUID, probe, readingType, reason, value, previous)
+		if rejectedReading {
+			fmt.Fprintf(w, "\t%s", reading)
+		}
+		fmt.Fprintln(w)
+	}
+	w.Flush()
+	return rows.Err()
+}
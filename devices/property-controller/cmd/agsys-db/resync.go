@@ -0,0 +1,135 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/agsys/property-controller/internal/localapi"
+	"github.com/agsys/property-controller/internal/storage"
+	"github.com/spf13/cobra"
+)
+
+var (
+	resyncFrom  string
+	resyncTo    string
+	resyncTable string
+
+	resyncCmd = &cobra.Command{
+		Use:   "resync",
+		Short: "Send readings and valve events from a time on to the cloud again",
+		Long: `Move the cloud sync cursors back so everything recorded from --from on is
+sent again by the running controller, e.g. after the cloud lost a day of
+data. Needs --rw and an operator --token.
+
+With --to, only the window from --from to --to is sent again, as a backfill:
+the controller resends the rows of the window it has already synced a batch
+at a time, in sync cycles the live data leaves room in, without holding up
+anything recorded since.`,
+		Args: cobra.NoArgs,
+		RunE: resync,
+	}
+)
+
+// resyncTables maps --table names to the tables synced through a cursor
+var resyncTables = map[string]string{
+	"soil":   storage.SyncSoilReadings,
+	"meter":  storage.SyncMeterReadings,
+	"events": storage.SyncValveEvents,
+}
+
+func init() {
+	resyncCmd.Flags().StringVar(&resyncFrom, "from", "", "Local time to resync from: 2006-01-02 or \"2006-01-02 15:04\"")
+	resyncCmd.Flags().StringVar(&resyncTo, "to", "", "Local time to backfill up to (exclusive), same formats as --from")
+	resyncCmd.Flags().StringVar(&resyncTable, "table", "", "Only resync soil, meter, or events")
+	resyncCmd.MarkFlagRequired("from")
+}
+
+// parseLocalTime parses a date, optionally with a time of day, in local time
+func parseLocalTime(s string) (time.Time, error) {
+	for _, layout := range []string{"2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q (use 2006-01-02 or \"2006-01-02 15:04\")", s)
+}
+
+func resync(cmd *cobra.Command, args []string) error {
+	from, err := parseLocalTime(resyncFrom)
+	if err != nil {
+		return err
+	}
+	tables := storage.SyncCursorTables
+	if resyncTable != "" {
+		table, ok := resyncTables[resyncTable]
+		if !ok {
+			return fmt.Errorf("invalid --table %q (use soil, meter, or events)", resyncTable)
+		}
+		tables = []string{table}
+	}
+	if err := requireRW("resync"); err != nil {
+		return err
+	}
+	if err := requireToken("resync", localapi.RoleOperator); err != nil {
+		return err
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if resyncTo != "" {
+		to, err := parseLocalTime(resyncTo)
+		if err != nil {
+			return err
+		}
+		return backfill(db, tables, from, to)
+	}
+
+	for _, table := range tables {
+		_, err := db.Exec(fmt.Sprintf(`UPDATE sync_cursors SET
+				last_id = MIN(last_id, COALESCE((SELECT MIN(id) FROM %s WHERE timestamp >= ?) - 1, last_id)),
+				updated_at = ?
+			WHERE table_name = ?`, table), from, time.Now(), table)
+		if err != nil {
+			return fmt.Errorf("failed to move %s sync cursor: %w", table, err)
+		}
+		var waiting int
+		if err := db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE id > %s", table, cursorSQL(table))).Scan(&waiting); err != nil {
+			return err
+		}
+		fmt.Printf("%s: %d rows waiting to sync\n", table, waiting)
+	}
+	return nil
+}
+
+// backfill queues a backfill of each table for the running controller
+func backfill(db *sql.DB, tables []string, from, to time.Time) error {
+	if !from.Before(to) {
+		return fmt.Errorf("--to must be after --from")
+	}
+	for _, table := range tables {
+		result, err := db.Exec(`INSERT INTO backfills (table_name, from_time, to_time, source, created_at)
+			VALUES (?, ?, ?, 'cli', ?)`, table, from, to, time.Now())
+		if err != nil {
+			return fmt.Errorf("failed to queue %s backfill: %w", table, err)
+		}
+		id, _ := result.LastInsertId()
+
+		var synced int
+		if err := db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE id <= %s AND timestamp >= ? AND timestamp < ?",
+			table, cursorSQL(table)), from, to).Scan(&synced); err != nil {
+			return err
+		}
+		fmt.Printf("%s: backfill %d queued, %d rows to send again\n", table, id, synced)
+	}
+	return nil
+}
+
+// cursorSQL is a subquery for the last ID of a table synced to cloud
+func cursorSQL(table string) string {
+	return fmt.Sprintf("(SELECT last_id FROM sync_cursors WHERE table_name = '%s')", table)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	rollupPeriod string
+	rollupDevice string
+	rollupDays   int
+
+	rollupsCmd = &cobra.Command{
+		Use:   "rollups <soil|meter>",
+		Short: "Show hourly or daily reading rollups",
+		Long: `Show min/max/average readings aggregated by hour or day. Rollups are
+maintained by the running controller and cover complete hours and days.`,
+		Args:      cobra.ExactArgs(1),
+		ValidArgs: []string{"soil", "meter"},
+		RunE:      showRollups,
+	}
+)
+
+func init() {
+	rollupsCmd.Flags().StringVarP(&rollupPeriod, "period", "p", "day", "Rollup period: hour or day")
+	rollupsCmd.Flags().StringVar(&rollupDevice, "device", "", "Only show this device UID")
+	rollupsCmd.Flags().IntVar(&rollupDays, "days", 7, "Number of days to include")
+}
+
+func showRollups(cmd *cobra.Command, args []string) error {
+	if rollupPeriod != "hour" && rollupPeriod != "day" {
+		return fmt.Errorf("invalid --period %q (use hour or day)", rollupPeriod)
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	since := time.Now().AddDate(0, 0, -rollupDays)
+	layout := "2006-01-02 15:00"
+	if rollupPeriod == "day" {
+		layout = "2006-01-02"
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	defer w.Flush()
+
+	switch args[0] {
+	case "soil":
+		rows, err := db.Query(`SELECT device_uid, probe_id, period_start, samples, moisture_min, moisture_max, moisture_avg,
+			temperature_min, temperature_max, temperature_avg
+			FROM soil_rollups WHERE period = ? AND period_start >= ? AND (? = '' OR device_uid = ?)
+			ORDER BY period_start, device_uid, probe_id`, rollupPeriod, since, rollupDevice, rollupDevice)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		fmt.Fprintln(w, "PERIOD\tDEVICE\tPROBE\tSAMPLES\tMOISTURE MIN/AVG/MAX\tTEMP MIN/AVG/MAX (°C)")
+		fmt.Fprintln(w, "------\t------\t-----\t-------\t--------------------\t---------------------")
+		for rows.Next() {
+			var uid string
+			var probe, samples, mMin, mMax, tMin, tMax int
+			var mAvg, tAvg float64
+			var start time.Time
+			if err := rows.Scan(&uid, &probe, &start, &samples, &mMin, &mMax, &mAvg, &tMin, &tMax, &tAvg); err != nil {
+				return err
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d/%.0f/%d%%\t%.1f/%.1f/%.1f\n",
+				start.Local().Format(layout), uid, probe, samples, mMin, mAvg, mMax,
+				float64(tMin)/10, tAvg/10, float64(tMax)/10)
+		}
+		return rows.Err()
+
+	case "meter":
+		rows, err := db.Query(`SELECT device_uid, period_start, samples, flow_min, flow_max, flow_avg, volume_delta_l, total_volume_l
+			FROM meter_rollups WHERE period = ? AND period_start >= ? AND (? = '' OR device_uid = ?)
+			ORDER BY period_start, device_uid`, rollupPeriod, since, rollupDevice, rollupDevice)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		fmt.Fprintln(w, "PERIOD\tDEVICE\tSAMPLES\tFLOW MIN/AVG/MAX (L/min)\tUSED (L)\tTOTAL (L)")
+		fmt.Fprintln(w, "------\t------\t-------\t------------------------\t--------\t---------")
+		for rows.Next() {
+			var uid string
+			var samples int
+			var fMin, fMax, fAvg, delta, total float64
+			var start time.Time
+			if err := rows.Scan(&uid, &start, &samples, &fMin, &fMax, &fAvg, &delta, &total); err != nil {
+				return err
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d\t%.1f/%.1f/%.1f\t%.1f\t%.1f\n",
+				start.Local().Format(layout), uid, samples, fMin, fAvg, fMax, delta, total)
+		}
+		return rows.Err()
+
+	default:
+		return fmt.Errorf("unknown rollup type %q (use soil or meter)", args[0])
+	}
+}
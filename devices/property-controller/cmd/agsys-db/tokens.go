@@ -0,0 +1,212 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/agsys/property-controller/internal/localapi"
+	"github.com/agsys/property-controller/internal/storage"
+)
+
+var (
+	apiToken  string
+	tokenRole string
+
+	tokensCmd = &cobra.Command{
+		Use:   "tokens",
+		Short: "List API tokens",
+		Long: `List tokens for the local API and for agsys-db and agsys-controller
+commands that change state. Roles are viewer (read only), operator (also OTA
+updates and alert acknowledgment), and admin (also configuration reload, key
+rotation, raw writes, and token management).`,
+		RunE: listTokens,
+	}
+
+	tokensCreateCmd = &cobra.Command{
+		Use:   "create <name>",
+		Short: "Create an API token",
+		Long: `Create a token and print it. Only a hash is stored, so the token can't be
+shown again. Needs --rw and an admin --token, except for the first admin
+token.`,
+		Args: cobra.ExactArgs(1),
+		RunE: createToken,
+	}
+
+	tokensRevokeCmd = &cobra.Command{
+		Use:   "revoke <name>",
+		Short: "Revoke an API token",
+		Long:  `Delete a token. Needs --rw and an admin --token.`,
+		Args:  cobra.ExactArgs(1),
+		RunE:  revokeToken,
+	}
+)
+
+func init() {
+	rootCmd.PersistentFlags().StringVar(&apiToken, "token", os.Getenv("AGSYS_TOKEN"), "API token for commands that change state (default $AGSYS_TOKEN)")
+
+	tokensCreateCmd.Flags().StringVar(&tokenRole, "role", string(localapi.RoleViewer), "Role: viewer, operator, or admin")
+	tokensCmd.AddCommand(tokensCreateCmd)
+	tokensCmd.AddCommand(tokensRevokeCmd)
+}
+
+// requireToken fails unless --token names a token with at least the given role
+func requireToken(what string, need localapi.Role) error {
+	_, err := requireActor(what, need)
+	return err
+}
+
+// requireActor is requireToken for commands that record who made a change,
+// returning the token's name
+func requireActor(what string, need localapi.Role) (string, error) {
+	if apiToken == "" {
+		return "", fmt.Errorf("%s needs an API token with the %s role; pass --token or set AGSYS_TOKEN", what, need)
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+
+	name, err := checkToken(db, what, need)
+	if err != nil {
+		return "", err
+	}
+	if _, err := db.Exec("UPDATE api_tokens SET last_used_at = ? WHERE name = ?", time.Now(), name); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// checkToken fails unless --token names a token in db with at least the
+// given role, returning the token's name
+func checkToken(db *sql.DB, what string, need localapi.Role) (string, error) {
+	var name, roleName string
+	err := db.QueryRow("SELECT name, role FROM api_tokens WHERE token_hash = ?",
+		storage.HashAPIToken(apiToken)).Scan(&name, &roleName)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", localapi.ErrInvalidToken
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to check API token: %w", err)
+	}
+	role, err := localapi.ParseRole(roleName)
+	if err != nil {
+		return "", fmt.Errorf("API token %s: %w", name, err)
+	}
+	if !role.Allows(need) {
+		return "", fmt.Errorf("%s needs the %s role; token %s is %s", what, need, name, role)
+	}
+	return name, nil
+}
+
+func listTokens(cmd *cobra.Command, args []string) error {
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT id, name, role, created_at, last_used_at FROM api_tokens ORDER BY name")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tROLE\tCREATED\tLAST USED")
+	fmt.Fprintln(w, "--\t----\t----\t-------\t---------")
+
+	for rows.Next() {
+		var id int64
+		var name, role string
+		var created time.Time
+		var lastUsed sql.NullTime
+		if err := rows.Scan(&id, &name, &role, &created, &lastUsed); err != nil {
+			return err
+		}
+		lastStr := "never"
+		if lastUsed.Valid {
+			lastStr = lastUsed.Time.Format("2006-01-02 15:04")
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", id, name, role, created.Format("2006-01-02 15:04"), lastStr)
+	}
+	w.Flush()
+	return rows.Err()
+}
+
+func createToken(cmd *cobra.Command, args []string) error {
+	if err := requireRW("tokens create"); err != nil {
+		return err
+	}
+	role, err := localapi.ParseRole(tokenRole)
+	if err != nil {
+		return err
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	// The first admin token can't be authorized by another one
+	var admins int
+	if err := db.QueryRow("SELECT COUNT(*) FROM api_tokens WHERE role = ?", localapi.RoleAdmin).Scan(&admins); err != nil {
+		return err
+	}
+	if admins > 0 || role != localapi.RoleAdmin {
+		if err := requireToken("tokens create", localapi.RoleAdmin); err != nil {
+			return err
+		}
+	}
+
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return fmt.Errorf("failed to generate token: %w", err)
+	}
+	token := hex.EncodeToString(buf)
+
+	if _, err := db.Exec("INSERT INTO api_tokens (name, role, token_hash, created_at) VALUES (?, ?, ?, ?)",
+		args[0], role, storage.HashAPIToken(token), time.Now()); err != nil {
+		return fmt.Errorf("failed to create token %s: %w", args[0], err)
+	}
+	fmt.Printf("Created %s token %s. Store it now, it can't be shown again:\n%s\n", role, args[0], token)
+	return nil
+}
+
+func revokeToken(cmd *cobra.Command, args []string) error {
+	if err := requireRW("tokens revoke"); err != nil {
+		return err
+	}
+	if err := requireToken("tokens revoke", localapi.RoleAdmin); err != nil {
+		return err
+	}
+	if err := confirm(fmt.Sprintf("Revoke API token %s", args[0])); err != nil {
+		return err
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	result, err := db.Exec("DELETE FROM api_tokens WHERE name = ?", args[0])
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("token %s not found", args[0])
+	}
+	fmt.Printf("Token %s revoked\n", args[0])
+	return nil
+}
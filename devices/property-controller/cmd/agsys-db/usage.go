@@ -0,0 +1,328 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/agsys/property-controller/internal/protocol"
+)
+
+var (
+	usageGroupBy string
+	usageDays    int
+
+	usageCmd = &cobra.Command{
+		Use:   "usage",
+		Short: "Show water usage by day, week, or zone",
+		Long: `Show water usage computed from meter totalizer deltas and valve open durations.
+A valve counts as open from when it starts opening until it reports closed,
+as the controller counts it.
+
+Grouping by zone uses the meter's zone when it has one. Otherwise each meter
+delta is split across zones in proportion to how long their valves were open
+during that interval.`,
+		RunE: showUsage,
+	}
+)
+
+func init() {
+	usageCmd.Flags().StringVarP(&usageGroupBy, "group-by", "g", "day", "Group by day, week, or zone")
+	usageCmd.Flags().IntVar(&usageDays, "days", 30, "Number of days to include")
+}
+
+// usageRow is one line of the usage report
+type usageRow struct {
+	liters    float64
+	valveTime time.Duration
+}
+
+// meterDelta is water measured by one meter between two readings
+type meterDelta struct {
+	zone   string
+	start  time.Time
+	end    time.Time
+	liters float64
+}
+
+// valveInterval is a period during which a valve may have passed water
+type valveInterval struct {
+	zone  string
+	start time.Time
+	end   time.Time
+}
+
+const unassignedZone = "(unassigned)"
+
+func showUsage(cmd *cobra.Command, args []string) error {
+	switch usageGroupBy {
+	case "day", "week", "zone":
+	default:
+		return fmt.Errorf("invalid --group-by %q (use day, week, or zone)", usageGroupBy)
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	now := time.Now()
+	since := now.AddDate(0, 0, -usageDays)
+
+	deltas, err := loadMeterDeltas(db, since)
+	if err != nil {
+		return err
+	}
+	intervals, err := loadValveIntervals(db, since, now)
+	if err != nil {
+		return err
+	}
+
+	rows := make(map[string]*usageRow)
+	row := func(key string) *usageRow {
+		if rows[key] == nil {
+			rows[key] = &usageRow{}
+		}
+		return rows[key]
+	}
+
+	if usageGroupBy == "zone" {
+		for _, v := range intervals {
+			row(v.zone).valveTime += v.end.Sub(v.start)
+		}
+		for _, d := range deltas {
+			for zone, liters := range apportionDelta(d, intervals) {
+				row(zone).liters += liters
+			}
+		}
+	} else {
+		for _, v := range intervals {
+			forEachPeriod(v.start, v.end, usageGroupBy, func(key string, overlap time.Duration) {
+				row(key).valveTime += overlap
+			})
+		}
+		for _, d := range deltas {
+			row(periodKey(d.end, usageGroupBy)).liters += d.liters
+		}
+	}
+
+	keys := make([]string, 0, len(rows))
+	for k := range rows {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	header := "PERIOD"
+	if usageGroupBy == "zone" {
+		header = "ZONE"
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "%s\tWATER (L)\tVALVE TIME\n", header)
+	fmt.Fprintln(w, "------\t---------\t----------")
+
+	var total usageRow
+	for _, k := range keys {
+		r := rows[k]
+		total.liters += r.liters
+		total.valveTime += r.valveTime
+		fmt.Fprintf(w, "%s\t%.1f\t%s\n", k, r.liters, formatDuration(r.valveTime))
+	}
+	fmt.Fprintf(w, "TOTAL\t%.1f\t%s\n", total.liters, formatDuration(total.valveTime))
+	w.Flush()
+	return nil
+}
+
+// loadMeterDeltas returns the water used between consecutive readings of each
+// meter, from the cumulative total. Negative deltas, from resets or rollovers
+// in readings stored before the cumulative total was tracked, are skipped.
+func loadMeterDeltas(db *sql.DB, since time.Time) ([]meterDelta, error) {
+	rows, err := db.Query(`
+		SELECT r.device_uid, COALESCE(r.cumulative_l, r.total_volume_l), r.timestamp, COALESCE(z.name, d.zone_id, '')
+		FROM water_meter_readings r
+		LEFT JOIN devices d ON d.uid = r.device_uid
+		LEFT JOIN zones z ON z.uid = d.zone_id
+		WHERE r.timestamp >= ?
+		ORDER BY r.device_uid, r.timestamp
+	`, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deltas []meterDelta
+	var prevUID string
+	var prevTotal float64
+	var prevTime time.Time
+
+	for rows.Next() {
+		var uid, zone string
+		var total float64
+		var timestamp time.Time
+		if err := rows.Scan(&uid, &total, &timestamp, &zone); err != nil {
+			return nil, err
+		}
+
+		if uid == prevUID && total >= prevTotal {
+			deltas = append(deltas, meterDelta{
+				zone:   zone,
+				start:  prevTime,
+				end:    timestamp,
+				liters: total - prevTotal,
+			})
+		}
+		prevUID, prevTotal, prevTime = uid, total, timestamp
+	}
+	return deltas, rows.Err()
+}
+
+// loadValveIntervals returns the periods each valve may have passed water,
+// from valve events. A valve's state at since comes from its last event
+// before then, so valves already open count from since; valves still open
+// are counted up to now.
+func loadValveIntervals(db *sql.DB, since, now time.Time) ([]valveInterval, error) {
+	rows, err := db.Query(`
+		SELECT e.controller_uid, e.actuator_addr, e.new_state, e.timestamp, COALESCE(z.name, a.zone_id, '')
+		FROM valve_events e
+		LEFT JOIN valve_actuators a ON a.controller_uid = e.controller_uid AND a.address = e.actuator_addr
+		LEFT JOIN zones z ON z.uid = a.zone_id
+		WHERE e.timestamp >= ? OR e.id = (
+			SELECT id FROM valve_events
+			WHERE controller_uid = e.controller_uid AND actuator_addr = e.actuator_addr AND timestamp < ?
+			ORDER BY timestamp DESC, id DESC LIMIT 1
+		)
+		ORDER BY e.timestamp, e.id
+	`, since, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	type openValve struct {
+		zone  string
+		since time.Time
+	}
+	open := make(map[string]openValve)
+	var intervals []valveInterval
+
+	for rows.Next() {
+		var controllerUID, zone string
+		var addr, state int
+		var timestamp time.Time
+		if err := rows.Scan(&controllerUID, &addr, &state, &timestamp, &zone); err != nil {
+			return nil, err
+		}
+		if zone == "" {
+			zone = unassignedZone
+		}
+		if timestamp.Before(since) {
+			timestamp = since
+		}
+
+		key := fmt.Sprintf("%s_%02d", controllerUID, addr)
+		isOpen := protocol.ValveMayFlow(uint8(state))
+		v, wasOpen := open[key]
+
+		switch {
+		case isOpen && !wasOpen:
+			open[key] = openValve{zone: zone, since: timestamp}
+		case !isOpen && wasOpen:
+			intervals = append(intervals, valveInterval{zone: v.zone, start: v.since, end: timestamp})
+			delete(open, key)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, v := range open {
+		intervals = append(intervals, valveInterval{zone: v.zone, start: v.since, end: now})
+	}
+	return intervals, nil
+}
+
+// apportionDelta splits a meter delta across zones. A meter assigned to a zone
+// gets all of it; otherwise it is shared by valve open time during the delta.
+func apportionDelta(d meterDelta, intervals []valveInterval) map[string]float64 {
+	if d.zone != "" {
+		return map[string]float64{d.zone: d.liters}
+	}
+
+	openTime := make(map[string]time.Duration)
+	var totalOpen time.Duration
+	for _, v := range intervals {
+		overlap := overlapDuration(d.start, d.end, v.start, v.end)
+		if overlap > 0 {
+			openTime[v.zone] += overlap
+			totalOpen += overlap
+		}
+	}
+
+	if totalOpen == 0 {
+		return map[string]float64{unassignedZone: d.liters}
+	}
+
+	result := make(map[string]float64, len(openTime))
+	for zone, t := range openTime {
+		result[zone] = d.liters * float64(t) / float64(totalOpen)
+	}
+	return result
+}
+
+// periodKey returns the day or week a time falls in
+func periodKey(t time.Time, groupBy string) string {
+	return periodStart(t, groupBy).Format("2006-01-02")
+}
+
+// periodStart returns the start of the day, or of the (Monday-based) week
+func periodStart(t time.Time, groupBy string) time.Time {
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	if groupBy == "week" {
+		offset := (int(day.Weekday()) + 6) % 7 // Days since Monday
+		day = day.AddDate(0, 0, -offset)
+	}
+	return day
+}
+
+// forEachPeriod calls fn with each period overlapping [start, end) and the length of the overlap
+func forEachPeriod(start, end time.Time, groupBy string, fn func(key string, overlap time.Duration)) {
+	for start.Before(end) {
+		p := periodStart(start, groupBy)
+		next := p.AddDate(0, 0, 1)
+		if groupBy == "week" {
+			next = p.AddDate(0, 0, 7)
+		}
+		stop := end
+		if next.Before(end) {
+			stop = next
+		}
+		fn(p.Format("2006-01-02"), stop.Sub(start))
+		start = stop
+	}
+}
+
+func overlapDuration(aStart, aEnd, bStart, bEnd time.Time) time.Duration {
+	start := aStart
+	if bStart.After(start) {
+		start = bStart
+	}
+	end := aEnd
+	if bEnd.Before(end) {
+		end = bEnd
+	}
+	if !end.After(start) {
+		return 0
+	}
+	return end.Sub(start)
+}
+
+func formatDuration(d time.Duration) string {
+	d = d.Round(time.Minute)
+	return fmt.Sprintf("%dh%02dm", int(d.Hours()), int(d.Minutes())%60)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/agsys/property-controller/internal/protocol"
+	"github.com/agsys/property-controller/internal/storage"
+)
+
+// TestLoadValveIntervals tests that valve time counts every state that may
+// pass water, including valves already open when the window starts
+func TestLoadValveIntervals(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "controller.db")
+	store, err := storage.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer store.Close()
+
+	const controller = "0102030405060708"
+	since := time.Date(2025, 6, 2, 6, 0, 0, 0, time.Local)
+	now := since.Add(6 * time.Hour)
+	event := func(addr, state uint8, at time.Duration) {
+		t.Helper()
+		if _, err := store.InsertValveEvent(&storage.ValveEvent{ControllerUID: controller, ActuatorAddr: addr,
+			NewState: state, Source: "schedule", Timestamp: since.Add(at)}); err != nil {
+			t.Fatalf("InsertValveEvent failed: %v", err)
+		}
+	}
+
+	// Open before the window, closed inside it
+	event(1, protocol.ValveStateOpen, -2*time.Hour)
+	event(1, protocol.ValveStateClosed, time.Hour)
+	// Open and closed before the window
+	event(2, protocol.ValveStateOpen, -3*time.Hour)
+	event(2, protocol.ValveStateClosed, -time.Hour)
+	// Water flows from opening until closed
+	event(3, protocol.ValveStateOpening, 2*time.Hour)
+	event(3, protocol.ValveStateOpen, 2*time.Hour+time.Minute)
+	event(3, protocol.ValveStateClosing, 3*time.Hour)
+	event(3, protocol.ValveStateClosed, 3*time.Hour+2*time.Minute)
+	// Still open
+	event(4, protocol.ValveStateOpen, 5*time.Hour)
+
+	if err := store.UpsertZone(&storage.Zone{UID: "zone-1", Name: "North"}); err != nil {
+		t.Fatalf("UpsertZone failed: %v", err)
+	}
+	if err := store.UpdateValveActuatorState(controller, 1, protocol.ValveStateClosed); err != nil {
+		t.Fatalf("UpdateValveActuatorState failed: %v", err)
+	}
+
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+	if _, err := db.Exec("UPDATE valve_actuators SET zone_id = 'zone-1' WHERE address = 1"); err != nil {
+		t.Fatalf("Failed to assign zone: %v", err)
+	}
+
+	intervals, err := loadValveIntervals(db, since, now)
+	if err != nil {
+		t.Fatalf("loadValveIntervals failed: %v", err)
+	}
+	sort.Slice(intervals, func(i, j int) bool { return intervals[i].start.Before(intervals[j].start) })
+
+	want := []valveInterval{
+		{zone: "North", start: since, end: since.Add(time.Hour)},
+		{zone: unassignedZone, start: since.Add(2 * time.Hour), end: since.Add(3*time.Hour + 2*time.Minute)},
+		{zone: unassignedZone, start: since.Add(5 * time.Hour), end: now},
+	}
+	if len(intervals) != len(want) {
+		t.Fatalf("Intervals = %+v, want %+v", intervals, want)
+	}
+	for i, w := range want {
+		got := intervals[i]
+		if got.zone != w.zone || !got.start.Equal(w.start) || !got.end.Equal(w.end) {
+			t.Errorf("Interval %d = %+v, want %+v", i, got, w)
+		}
+	}
+}
+
+// TestApportionDelta tests how a meter delta is shared across zones
+func TestApportionDelta(t *testing.T) {
+	base := time.Date(2025, 6, 2, 6, 0, 0, 0, time.Local)
+	at := func(minutes int) time.Time { return base.Add(time.Duration(minutes) * time.Minute) }
+	intervals := []valveInterval{
+		{zone: "North", start: at(0), end: at(30)},
+		{zone: "South", start: at(20), end: at(80)},
+	}
+
+	tests := []struct {
+		name  string
+		delta meterDelta
+		want  map[string]float64
+	}{
+		{
+			name:  "meter with a zone",
+			delta: meterDelta{zone: "East", start: at(0), end: at(60), liters: 100},
+			want:  map[string]float64{"East": 100},
+		},
+		{
+			name:  "split by open time",
+			delta: meterDelta{start: at(0), end: at(60), liters: 100},
+			// North open 30 min, South 40 min
+			want: map[string]float64{"North": 100 * 30.0 / 70, "South": 100 * 40.0 / 70},
+		},
+		{
+			name:  "one valve open",
+			delta: meterDelta{start: at(40), end: at(60), liters: 25},
+			want:  map[string]float64{"South": 25},
+		},
+		{
+			name:  "no valve open",
+			delta: meterDelta{start: at(90), end: at(120), liters: 5},
+			want:  map[string]float64{unassignedZone: 5},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := apportionDelta(tt.delta, intervals)
+			if len(got) != len(tt.want) {
+				t.Fatalf("apportionDelta = %v, want %v", got, tt.want)
+			}
+			for zone, liters := range tt.want {
+				if diff := got[zone] - liters; diff > 1e-9 || diff < -1e-9 {
+					t.Errorf("%s = %v L, want %v L", zone, got[zone], liters)
+				}
+			}
+		})
+	}
+}
+
+// TestForEachPeriod tests splitting valve time across days and weeks
+func TestForEachPeriod(t *testing.T) {
+	// Sunday 22:00 to Monday 02:00
+	start := time.Date(2025, 6, 1, 22, 0, 0, 0, time.Local)
+	end := start.Add(4 * time.Hour)
+
+	tests := []struct {
+		groupBy string
+		want    map[string]time.Duration
+	}{
+		{"day", map[string]time.Duration{"2025-06-01": 2 * time.Hour, "2025-06-02": 2 * time.Hour}},
+		{"week", map[string]time.Duration{"2025-05-26": 2 * time.Hour, "2025-06-02": 2 * time.Hour}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.groupBy, func(t *testing.T) {
+			got := make(map[string]time.Duration)
+			forEachPeriod(start, end, tt.groupBy, func(key string, overlap time.Duration) {
+				got[key] += overlap
+			})
+			if len(got) != len(tt.want) {
+				t.Fatalf("Periods = %v, want %v", got, tt.want)
+			}
+			for key, d := range tt.want {
+				if got[key] != d {
+					t.Errorf("%s = %s, want %s", key, got[key], d)
+				}
+			}
+		})
+	}
+
+	// Readings are counted in the period they end in
+	if key := periodKey(time.Date(2025, 6, 8, 23, 0, 0, 0, time.Local), "week"); key != "2025-06-02" {
+		t.Errorf("Week of Sunday 2025-06-08 = %s, want 2025-06-02", key)
+	}
+	if key := periodKey(end, "day"); key != "2025-06-02" {
+		t.Errorf("Day of %s = %s, want 2025-06-02", end, key)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/google/uuid"
+
+	"github.com/agsys/property-controller/internal/cloud"
+)
+
+// enrollHandler accepts any claim code and enrolls the controller against
+// this fake cloud, for trying out `agsys-controller provision`
+func enrollHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req cloud.EnrollRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ClaimCode == "" {
+		http.Error(w, "claim_code is required", http.StatusBadRequest)
+		return
+	}
+
+	key := apiKey
+	if key == "" {
+		key = "dev-api-key"
+	}
+	host, port, _ := net.SplitHostPort(listenAddr)
+	if host == "" {
+		host = "localhost"
+	}
+	enrollment := cloud.Enrollment{
+		ControllerID: uuid.NewString(),
+		APIKey:       key,
+		GRPCAddr:     net.JoinHostPort(host, port),
+		PropertyName: "Fake Property",
+	}
+	log.Printf("Enrolled controller %s (instance %s on %s) with claim code %s",
+		enrollment.ControllerID, req.InstanceID, req.Hostname, req.ClaimCode)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(enrollment)
+}
@@ -0,0 +1,160 @@
+// AgSys fake cloud
+// Development stand-in for the AgSys backend. It serves the controller and
+// firmware gRPC services with canned devices, schedules, valve commands, and
+// firmware so the controller can run locally without the production backend.
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+	"google.golang.org/grpc"
+
+	"github.com/agsys/property-controller/internal/testing/fakecloud"
+	controllerv1 "github.com/ccroswhite/agsys-api/gen/go/proto/controller/v1"
+)
+
+var (
+	listenAddr   string
+	scenarioFile string
+	apiKey       string
+	enrollAddr   string
+
+	rootCmd = &cobra.Command{
+		Use:   "agsys-fakecloud",
+		Short: "Fake AgSys backend for local development",
+		Long: `Serve the controller and firmware gRPC services with canned data.
+
+On every controller connection the scenario's devices are approved and its
+schedules are sent. Its valve commands are sent once, each the given time
+after the first connection, and its firmware is offered for OTA. Everything
+the controller sends is logged.
+
+Point the controller at it with cloud.grpc_addr set to the listen address
+and cloud.use_tls set to false. With --enroll set, it also accepts any claim
+code from agsys-controller provision --enroll-url http://<addr>/enroll.`,
+		RunE: runFakeCloud,
+	}
+)
+
+func init() {
+	rootCmd.Flags().StringVarP(&listenAddr, "listen", "l", ":50051", "Address to serve gRPC on")
+	rootCmd.Flags().StringVarP(&scenarioFile, "scenario", "s", "", "Scenario file with devices, schedules, commands, and firmware (default built-in)")
+	rootCmd.Flags().StringVar(&apiKey, "api-key", "", "Only accept controllers with this API key (default any)")
+	rootCmd.Flags().StringVar(&enrollAddr, "enroll", "", "Address to serve controller enrollment on over HTTP (default disabled)")
+}
+
+func main() {
+	if err := rootCmd.Execute(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func runFakeCloud(cmd *cobra.Command, args []string) error {
+	scenario := defaultScenario()
+	if scenarioFile != "" {
+		var err error
+		if scenario, err = loadScenario(scenarioFile); err != nil {
+			return err
+		}
+	}
+
+	images, err := scenario.firmware()
+	if err != nil {
+		return err
+	}
+	commands := make([]*controllerv1.BackendMessage, len(scenario.Commands))
+	for i, c := range scenario.Commands {
+		if commands[i], err = c.command(i + 1); err != nil {
+			return err
+		}
+	}
+
+	cloud := fakecloud.New()
+	cloud.APIKey = apiKey
+	cloud.PingInterval = 30 * time.Second
+	for deviceType, fw := range images {
+		cloud.SetFirmware(deviceType, fw)
+		log.Printf("Serving firmware %s (%d bytes)", fw.ID, len(fw.Data))
+	}
+
+	var firstConnect sync.Once
+	cloud.OnConnect = func() {
+		log.Println("Controller connected")
+		// Push blocks while the stream isn't reading, so send from a goroutine
+		go func() {
+			for _, msg := range scenario.connectMessages() {
+				cloud.Push(msg)
+			}
+		}()
+		firstConnect.Do(func() {
+			for i, c := range scenario.Commands {
+				msg := commands[i]
+				time.AfterFunc(c.After, func() {
+					log.Printf("Sending valve command %s", msg.GetValveCommand().CommandId)
+					cloud.Push(msg)
+				})
+			}
+		})
+	}
+	cloud.OnMessage = logMessage
+
+	lis, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+	server := grpc.NewServer()
+	cloud.Register(server)
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigChan
+		log.Println("Shutting down")
+		server.Stop()
+	}()
+
+	if enrollAddr != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/enroll", enrollHandler)
+		go func() {
+			log.Printf("Fake cloud enrolling on %s", enrollAddr)
+			if err := http.ListenAndServe(enrollAddr, mux); err != nil {
+				log.Printf("Enrollment server stopped: %v", err)
+			}
+		}()
+	}
+
+	log.Printf("Fake cloud listening on %s", lis.Addr())
+	return server.Serve(lis)
+}
+
+// logMessage prints a one-line summary of a controller message
+func logMessage(msg *controllerv1.ControllerMessage) {
+	switch p := msg.Payload.(type) {
+	case *controllerv1.ControllerMessage_Heartbeat:
+		log.Printf("Heartbeat: firmware %s", p.Heartbeat.FirmwareVersion)
+	case *controllerv1.ControllerMessage_SensorData:
+		log.Printf("Sensor data from %s: %d readings", p.SensorData.DeviceUid, len(p.SensorData.Readings))
+	case *controllerv1.ControllerMessage_MeterData:
+		log.Printf("Meter data from %s: %d readings", p.MeterData.DeviceUid, len(p.MeterData.Readings))
+	case *controllerv1.ControllerMessage_CommandAck:
+		ack := p.CommandAck
+		if ack.Success {
+			log.Printf("Command %s acknowledged", ack.CommandId)
+		} else {
+			log.Printf("Command %s failed: %s", ack.CommandId, ack.ErrorMessage)
+		}
+	default:
+		log.Printf("Message %T", msg.Payload)
+	}
+}
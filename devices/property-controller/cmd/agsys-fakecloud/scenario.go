@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/agsys/property-controller/internal/testing/fakecloud"
+	controllerv1 "github.com/ccroswhite/agsys-api/gen/go/proto/controller/v1"
+)
+
+// Scenario is the canned data the fake cloud serves
+type Scenario struct {
+	PropertyID string         `yaml:"property_id"`
+	Devices    []DeviceSpec   `yaml:"devices"`
+	Schedules  []ScheduleSpec `yaml:"schedules"`
+	Commands   []CommandSpec  `yaml:"commands"`
+	Firmware   []FirmwareSpec `yaml:"firmware"`
+}
+
+// DeviceSpec is a device approved when the controller connects
+type DeviceSpec struct {
+	UID    string `yaml:"uid"`
+	Type   string `yaml:"type"` // soil_moisture, valve_controller, water_meter, valve_actuator
+	Name   string `yaml:"name"`
+	ZoneID string `yaml:"zone_id"`
+}
+
+// ScheduleSpec is an irrigation schedule sent when the controller connects
+type ScheduleSpec struct {
+	ID              string      `yaml:"id"`
+	Name            string      `yaml:"name"`
+	Enabled         *bool       `yaml:"enabled"` // Defaults to true
+	Days            []string    `yaml:"days"`    // sun, mon, ... sat
+	StartTime       string      `yaml:"start_time"`
+	DurationMinutes int32       `yaml:"duration_minutes"`
+	Valves          []ValveSpec `yaml:"valves"`
+}
+
+// ValveSpec is a valve run by a schedule
+type ValveSpec struct {
+	ValveID  string `yaml:"valve_id"`
+	Actuator int32  `yaml:"actuator"`
+}
+
+// CommandSpec is a valve command sent some time after the first connection
+type CommandSpec struct {
+	After           time.Duration `yaml:"after"`
+	ControllerUID   string        `yaml:"controller_uid"`
+	ValveID         string        `yaml:"valve_id"`
+	Actuator        int32         `yaml:"actuator"`
+	Command         string        `yaml:"command"` // open, close, or stop
+	DurationSeconds int32         `yaml:"duration_seconds"`
+}
+
+// FirmwareSpec is an image served for OTA. File is read when set;
+// otherwise Size bytes of filler are generated.
+type FirmwareSpec struct {
+	DeviceType string `yaml:"device_type"`
+	Version    string `yaml:"version"`
+	File       string `yaml:"file"`
+	Size       int    `yaml:"size"`
+}
+
+// defaultScenario is served when no scenario file is given
+func defaultScenario() *Scenario {
+	return &Scenario{
+		PropertyID: "dev-property",
+		Devices: []DeviceSpec{
+			{UID: "0200000000000001", Type: "valve_controller", Name: "Dev valve controller"},
+			{UID: "0100000000000001", Type: "soil_moisture", Name: "Dev soil probe"},
+		},
+		Schedules: []ScheduleSpec{{
+			ID:              "dev-morning",
+			Name:            "Morning",
+			Days:            []string{"mon", "wed", "fri"},
+			StartTime:       "06:00",
+			DurationMinutes: 20,
+			Valves:          []ValveSpec{{ValveID: "dev-valve-1", Actuator: 1}},
+		}},
+		Commands: []CommandSpec{
+			{After: 30 * time.Second, ControllerUID: "0200000000000001", Actuator: 1, Command: "open", DurationSeconds: 300},
+			{After: 90 * time.Second, ControllerUID: "0200000000000001", Actuator: 1, Command: "close"},
+		},
+		Firmware: []FirmwareSpec{
+			{DeviceType: "soil_moisture", Version: "1.0.1", Size: 16 * 1024},
+		},
+	}
+}
+
+// loadScenario reads a scenario file
+func loadScenario(path string) (*Scenario, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read scenario: %w", err)
+	}
+
+	var sc Scenario
+	if err := yaml.Unmarshal(data, &sc); err != nil {
+		return nil, fmt.Errorf("failed to parse scenario: %w", err)
+	}
+	return &sc, nil
+}
+
+// deviceTypes maps scenario device type names to the proto enum
+var deviceTypes = map[string]controllerv1.DeviceTypeEnum{
+	"soil_moisture":    controllerv1.DeviceTypeEnum_DEVICE_TYPE_SOIL_MOISTURE,
+	"valve_controller": controllerv1.DeviceTypeEnum_DEVICE_TYPE_VALVE_CONTROLLER,
+	"water_meter":      controllerv1.DeviceTypeEnum_DEVICE_TYPE_WATER_METER,
+	"valve_actuator":   controllerv1.DeviceTypeEnum_DEVICE_TYPE_VALVE_ACTUATOR,
+}
+
+// valveCommands maps scenario command names to the proto enum
+var valveCommands = map[string]controllerv1.Command{
+	"open":  controllerv1.Command_COMMAND_OPEN,
+	"close": controllerv1.Command_COMMAND_CLOSE,
+	"stop":  controllerv1.Command_COMMAND_STOP,
+}
+
+// firmware builds the images to serve, by device type
+func (sc *Scenario) firmware() (map[controllerv1.DeviceTypeEnum]*fakecloud.Firmware, error) {
+	images := make(map[controllerv1.DeviceTypeEnum]*fakecloud.Firmware)
+	for _, spec := range sc.Firmware {
+		deviceType, ok := deviceTypes[spec.DeviceType]
+		if !ok {
+			return nil, fmt.Errorf("firmware: unknown device type %q", spec.DeviceType)
+		}
+
+		var major, minor, patch int32
+		if n, _ := fmt.Sscanf(spec.Version, "%d.%d.%d", &major, &minor, &patch); n != 3 {
+			return nil, fmt.Errorf("firmware: invalid version %q (use major.minor.patch)", spec.Version)
+		}
+
+		var data []byte
+		switch {
+		case spec.File != "":
+			var err error
+			if data, err = os.ReadFile(spec.File); err != nil {
+				return nil, fmt.Errorf("firmware: %w", err)
+			}
+		case spec.Size > 0:
+			data = make([]byte, spec.Size)
+			rand.New(rand.NewSource(int64(deviceType))).Read(data)
+		default:
+			return nil, fmt.Errorf("firmware for %s needs a file or a size", spec.DeviceType)
+		}
+
+		images[deviceType] = &fakecloud.Firmware{
+			ID:    fmt.Sprintf("fake-%s-%s", spec.DeviceType, spec.Version),
+			Major: major,
+			Minor: minor,
+			Patch: patch,
+			Data:  data,
+		}
+	}
+	return images, nil
+}
+
+// connectMessages are sent every time the controller connects
+func (sc *Scenario) connectMessages() []*controllerv1.BackendMessage {
+	var msgs []*controllerv1.BackendMessage
+	for _, d := range sc.Devices {
+		approved := &controllerv1.DeviceApproved{
+			DeviceUid:  strings.ToUpper(d.UID),
+			DeviceType: d.Type,
+			Name:       d.Name,
+		}
+		if d.ZoneID != "" {
+			zone := d.ZoneID
+			approved.ZoneId = &zone
+		}
+		msgs = append(msgs, &controllerv1.BackendMessage{
+			Payload: &controllerv1.BackendMessage_DeviceApproved{DeviceApproved: approved},
+		})
+	}
+
+	if len(sc.Schedules) > 0 {
+		update := &controllerv1.ScheduleUpdate{PropertyId: sc.PropertyID}
+		for _, s := range sc.Schedules {
+			sched := &controllerv1.Schedule{
+				ScheduleId:      s.ID,
+				Name:            s.Name,
+				Enabled:         s.Enabled == nil || *s.Enabled,
+				Days:            s.Days,
+				StartTime:       s.StartTime,
+				DurationMinutes: s.DurationMinutes,
+			}
+			for _, v := range s.Valves {
+				sched.Valves = append(sched.Valves, &controllerv1.ScheduleValve{ValveId: v.ValveID, ActuatorAddress: v.Actuator})
+			}
+			update.Schedules = append(update.Schedules, sched)
+		}
+		msgs = append(msgs, &controllerv1.BackendMessage{
+			Payload: &controllerv1.BackendMessage_ScheduleUpdate{ScheduleUpdate: update},
+		})
+	}
+	return msgs
+}
+
+// command builds the valve command message for a spec
+func (c CommandSpec) command(id int) (*controllerv1.BackendMessage, error) {
+	cmd, ok := valveCommands[c.Command]
+	if !ok {
+		return nil, fmt.Errorf("command %d: unknown valve command %q (use open, close, or stop)", id, c.Command)
+	}
+	return &controllerv1.BackendMessage{
+		Payload: &controllerv1.BackendMessage_ValveCommand{
+			ValveCommand: &controllerv1.ValveCommand{
+				CommandId:       fmt.Sprintf("fake-cmd-%d", id),
+				ControllerUid:   strings.ToUpper(c.ControllerUID),
+				ValveId:         c.ValveID,
+				ActuatorAddress: c.Actuator,
+				Command:         cmd,
+				DurationSeconds: c.DurationSeconds,
+			},
+		},
+	}, nil
+}
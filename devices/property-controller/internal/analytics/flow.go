@@ -0,0 +1,249 @@
+// Package analytics derives alarms by correlating data from different devices.
+//
+// The flow checker cross-checks water meter readings against valve events:
+// - Flow measured while every valve is closed (leak or stuck-open valve)
+// - A valve open with no measured flow (failed actuator, closed supply, clog)
+package analytics
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/agsys/property-controller/internal/protocol"
+	"github.com/agsys/property-controller/internal/storage"
+)
+
+// Config holds flow analytics configuration
+type Config struct {
+	Enabled     bool
+	Interval    time.Duration // How often to run the cross-check
+	Window      time.Duration // How long a condition must persist before alarming
+	MinFlowLPM  float32       // Flow at or below this is treated as no flow
+	ValveSettle time.Duration // Time for flow to start/stop after a valve changes
+}
+
+// DefaultConfig returns default flow analytics configuration
+func DefaultConfig() Config {
+	return Config{
+		Enabled:     true,
+		Interval:    1 * time.Minute,
+		Window:      15 * time.Minute,
+		MinFlowLPM:  0.5,
+		ValveSettle: 2 * time.Minute,
+	}
+}
+
+// AlarmFunc is called for each newly raised derived alarm
+type AlarmFunc func(alarm *storage.MeterAlarm)
+
+// ClearFunc is called when a derived alarm's condition is no longer seen
+type ClearFunc func(alarm *storage.MeterAlarm)
+
+// FlowChecker periodically correlates meter flow with valve state
+type FlowChecker struct {
+	config    Config
+	db        *storage.DB
+	alarmFunc AlarmFunc
+	clearFunc ClearFunc
+
+	// Conditions currently alarmed, so each is raised once until it clears
+	active map[string]*storage.MeterAlarm
+
+	wg       sync.WaitGroup
+	stopChan chan struct{}
+}
+
+// NewFlowChecker creates a new flow checker
+func NewFlowChecker(config Config, db *storage.DB, alarmFunc AlarmFunc) *FlowChecker {
+	return &FlowChecker{
+		config:    config,
+		db:        db,
+		alarmFunc: alarmFunc,
+		active:    make(map[string]*storage.MeterAlarm),
+		stopChan:  make(chan struct{}),
+	}
+}
+
+// SetClearFunc sets the callback for cleared derived alarms
+func (c *FlowChecker) SetClearFunc(fn ClearFunc) {
+	c.clearFunc = fn
+}
+
+// Start starts the periodic cross-check
+func (c *FlowChecker) Start(ctx context.Context) {
+	if !c.config.Enabled {
+		return
+	}
+
+	c.wg.Add(1)
+	go c.checkLoop(ctx)
+}
+
+// Stop stops the flow checker
+func (c *FlowChecker) Stop() {
+	close(c.stopChan)
+	c.wg.Wait()
+}
+
+// checkLoop runs the cross-check on every interval
+func (c *FlowChecker) checkLoop(ctx context.Context) {
+	defer c.wg.Done()
+
+	ticker := time.NewTicker(c.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.stopChan:
+			return
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.Check(time.Now()); err != nil {
+				log.Printf("Flow analytics check failed: %v", err)
+			}
+		}
+	}
+}
+
+// Check runs the cross-check as of now and raises any new alarms
+func (c *FlowChecker) Check(now time.Time) error {
+	windowStart := now.Add(-c.config.Window)
+	valveStart := windowStart.Add(-c.config.ValveSettle)
+
+	readings, err := c.db.GetWaterMeterReadingsSince(windowStart)
+	if err != nil {
+		return fmt.Errorf("failed to get meter readings: %w", err)
+	}
+	initial, err := c.db.GetLastValveEventsBefore(valveStart)
+	if err != nil {
+		return fmt.Errorf("failed to get valve states: %w", err)
+	}
+	events, err := c.db.GetValveEventsSince(valveStart)
+	if err != nil {
+		return fmt.Errorf("failed to get valve events: %w", err)
+	}
+
+	alarms := Evaluate(c.config, now, initial, events, readings)
+
+	seen := make(map[string]bool, len(alarms))
+	for _, a := range alarms {
+		key := fmt.Sprintf("%s/%d", a.DeviceUID, a.AlarmType)
+		seen[key] = true
+		if c.active[key] != nil {
+			continue
+		}
+		c.active[key] = a
+
+		log.Printf("ALARM (derived) for water meter %s: %s, flow: %.2f L/min over %ds",
+			a.DeviceUID, protocol.MeterAlarmTypeString(a.AlarmType), a.FlowRateLPM, a.DurationSec)
+		if c.alarmFunc != nil {
+			c.alarmFunc(a)
+		}
+	}
+
+	for key, a := range c.active {
+		if !seen[key] {
+			log.Printf("Derived alarm %s cleared", key)
+			delete(c.active, key)
+			if c.clearFunc != nil {
+				c.clearFunc(a)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Evaluate returns the derived alarms for the window ending at now.
+// initial holds the last valve event per actuator before the window (less
+// ValveSettle) and events holds every valve event since then.
+func Evaluate(config Config, now time.Time, initial, events []*storage.ValveEvent, readings []*storage.WaterMeterReading) []*storage.MeterAlarm {
+	// Work out valve state over the window
+	state := make(map[string]uint8)
+	openThroughout := make(map[string]bool)
+	for _, ev := range initial {
+		key := actuatorKey(ev)
+		state[key] = ev.NewState
+		openThroughout[key] = ev.NewState == protocol.ValveStateOpen
+	}
+	anyOpen := false
+	for _, s := range state {
+		if protocol.ValveMayFlow(s) {
+			anyOpen = true
+		}
+	}
+	for _, ev := range events {
+		key := actuatorKey(ev)
+		if protocol.ValveMayFlow(ev.NewState) {
+			anyOpen = true
+		}
+		if ev.NewState != protocol.ValveStateOpen {
+			openThroughout[key] = false
+		}
+	}
+	someOpenThroughout := false
+	for _, open := range openThroughout {
+		if open {
+			someOpenThroughout = true
+		}
+	}
+
+	// Group readings by meter
+	byMeter := make(map[string][]*storage.WaterMeterReading)
+	var meters []string
+	for _, r := range readings {
+		if _, ok := byMeter[r.DeviceUID]; !ok {
+			meters = append(meters, r.DeviceUID)
+		}
+		byMeter[r.DeviceUID] = append(byMeter[r.DeviceUID], r)
+	}
+
+	var alarms []*storage.MeterAlarm
+	for _, meter := range meters {
+		rs := byMeter[meter]
+		if len(rs) < 2 {
+			continue // Not enough data to call it persistent
+		}
+
+		allFlowing, noneFlowing := true, true
+		for _, r := range rs {
+			if r.FlowRateLPM > config.MinFlowLPM {
+				noneFlowing = false
+			} else {
+				allFlowing = false
+			}
+		}
+
+		var alarmType uint8
+		switch {
+		case allFlowing && !anyOpen:
+			alarmType = protocol.MeterAlarmFlowWhileClosed
+		case noneFlowing && someOpenThroughout:
+			alarmType = protocol.MeterAlarmNoFlowWhileOpen
+		default:
+			continue
+		}
+
+		first, last := rs[0], rs[len(rs)-1]
+		alarms = append(alarms, &storage.MeterAlarm{
+			DeviceUID:    meter,
+			AlarmType:    alarmType,
+			FlowRateLPM:  last.FlowRateLPM,
+			DurationSec:  uint32(last.Timestamp.Sub(first.Timestamp).Seconds()),
+			TotalVolumeL: last.TotalVolumeL,
+			RSSI:         last.RSSI,
+			Source:       "analytics",
+			Timestamp:    now,
+		})
+	}
+
+	return alarms
+}
+
+func actuatorKey(ev *storage.ValveEvent) string {
+	return fmt.Sprintf("%s_%02d", ev.ControllerUID, ev.ActuatorAddr)
+}
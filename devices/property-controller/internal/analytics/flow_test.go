@@ -0,0 +1,69 @@
+package analytics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/agsys/property-controller/internal/protocol"
+	"github.com/agsys/property-controller/internal/storage"
+)
+
+// TestEvaluate tests flow vs valve cross-check conditions
+func TestEvaluate(t *testing.T) {
+	config := DefaultConfig()
+	now := time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+	meter := "1111111111111111"
+	controller := "2222222222222222"
+
+	readings := func(flows ...float32) []*storage.WaterMeterReading {
+		var rs []*storage.WaterMeterReading
+		for i, f := range flows {
+			rs = append(rs, &storage.WaterMeterReading{
+				DeviceUID:   meter,
+				FlowRateLPM: f,
+				Timestamp:   now.Add(-config.Window + time.Duration(i+1)*time.Minute),
+			})
+		}
+		return rs
+	}
+	valve := func(state uint8, at time.Time) *storage.ValveEvent {
+		return &storage.ValveEvent{ControllerUID: controller, ActuatorAddr: 1, NewState: state, Timestamp: at}
+	}
+	longAgo := now.Add(-time.Hour)
+
+	tests := []struct {
+		name     string
+		initial  []*storage.ValveEvent
+		events   []*storage.ValveEvent
+		readings []*storage.WaterMeterReading
+		want     []uint8
+	}{
+		{"flow with valves closed", []*storage.ValveEvent{valve(protocol.ValveStateClosed, longAgo)}, nil, readings(5, 6, 5), []uint8{protocol.MeterAlarmFlowWhileClosed}},
+		{"flow with no valve history", nil, nil, readings(5, 6), []uint8{protocol.MeterAlarmFlowWhileClosed}},
+		{"flow with valve open", []*storage.ValveEvent{valve(protocol.ValveStateOpen, longAgo)}, nil, readings(5, 6, 5), nil},
+		{"flow draining after close", []*storage.ValveEvent{valve(protocol.ValveStateOpen, longAgo)}, []*storage.ValveEvent{valve(protocol.ValveStateClosed, now.Add(-config.Window))}, readings(5, 1), nil},
+		{"intermittent flow", []*storage.ValveEvent{valve(protocol.ValveStateClosed, longAgo)}, nil, readings(5, 0, 5), nil},
+		{"single reading", []*storage.ValveEvent{valve(protocol.ValveStateClosed, longAgo)}, nil, readings(5), nil},
+		{"no flow with valve open", []*storage.ValveEvent{valve(protocol.ValveStateOpen, longAgo)}, nil, readings(0, 0.2, 0), []uint8{protocol.MeterAlarmNoFlowWhileOpen}},
+		{"no flow with valve just opened", []*storage.ValveEvent{valve(protocol.ValveStateClosed, longAgo)}, []*storage.ValveEvent{valve(protocol.ValveStateOpen, now.Add(-time.Minute))}, readings(0, 0), nil},
+		{"no flow with valves closed", []*storage.ValveEvent{valve(protocol.ValveStateClosed, longAgo)}, nil, readings(0, 0), nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alarms := Evaluate(config, now, tt.initial, tt.events, tt.readings)
+			if len(alarms) != len(tt.want) {
+				t.Fatalf("got %d alarms, want %d", len(alarms), len(tt.want))
+			}
+			for i, a := range alarms {
+				if a.AlarmType != tt.want[i] {
+					t.Errorf("alarm %d type = %s, want %s", i,
+						protocol.MeterAlarmTypeString(a.AlarmType), protocol.MeterAlarmTypeString(tt.want[i]))
+				}
+				if a.DeviceUID != meter || a.Source != "analytics" {
+					t.Errorf("alarm %d = %+v", i, a)
+				}
+			}
+		})
+	}
+}
@@ -641,7 +641,9 @@ type ScheduleUpdatePayload struct {
 	Schedules  []Schedule `json:"schedules"`
 }
 
-// Schedule represents a single irrigation schedule
+// Schedule represents a single irrigation schedule. A schedule with Runs
+// runs each of them; one without runs its valves on Days at StartTime and
+// any StartTimes.
 type Schedule struct {
 	ScheduleID      string          `json:"schedule_id"`
 	ZoneID          string          `json:"zone_id"`
@@ -649,8 +651,25 @@ type Schedule struct {
 	Enabled         bool            `json:"enabled"`
 	Days            []string        `json:"days"`
 	StartTime       string          `json:"start_time"`
+	StartTimes      []string        `json:"start_times,omitempty"`
 	DurationMinutes int             `json:"duration_minutes"`
 	Valves          []ScheduleValve `json:"valves"`
+	Runs            []ScheduleRun   `json:"runs,omitempty"`
+	Fertigation     *Fertigation    `json:"fertigation,omitempty"`
+}
+
+// ScheduleRun is one set of days and start times of a schedule, for its own
+// valves or, if it lists none, the schedule's
+type ScheduleRun struct {
+	Days            []string        `json:"days"`
+	StartTimes      []string        `json:"start_times"`
+	DurationMinutes int             `json:"duration_minutes"`
+	Valves          []ScheduleValve `json:"valves,omitempty"`
+}
+
+// Fertigation adds fertilizer injection to a schedule's runs
+type Fertigation struct {
+	DoseMinutes int `json:"dose_minutes"`
 }
 
 // ScheduleValve represents a valve in a schedule
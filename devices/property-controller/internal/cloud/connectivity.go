@@ -0,0 +1,138 @@
+package cloud
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Connectivity failure kinds, named for the step that failed
+const (
+	FailureDNS     = "dns"     // The backend, or proxy, name didn't resolve
+	FailureConnect = "connect" // No TCP connection to the backend or proxy
+	FailureProxy   = "proxy"   // The proxy refused or broke the tunnel
+	FailurePortal  = "portal"  // Something, likely a captive portal, answered for the backend
+	FailureTLS     = "tls"     // The TLS handshake failed
+	FailureAuth    = "auth"    // The backend rejected the controller's credentials
+	FailureBackend = "backend" // Anything else, once the backend was reached
+)
+
+// precheckTimeout bounds the connectivity pre-check
+const precheckTimeout = 15 * time.Second
+
+// ConnectivityError is a failure to reach the backend, classified by where
+// it failed so the logs and local status say what to fix
+type ConnectivityError struct {
+	Kind string
+	Err  error
+}
+
+func (e *ConnectivityError) Error() string {
+	return fmt.Sprintf("%s failure: %v", e.Kind, e.Err)
+}
+
+func (e *ConnectivityError) Unwrap() error {
+	return e.Err
+}
+
+// classifyFailure wraps err as a ConnectivityError, keeping the kind of one
+// already classified
+func classifyFailure(err error) *ConnectivityError {
+	var ce *ConnectivityError
+	if errors.As(err, &ce) {
+		return ce
+	}
+	switch status.Code(err) {
+	case codes.Unauthenticated, codes.PermissionDenied:
+		return &ConnectivityError{Kind: FailureAuth, Err: err}
+	}
+	return &ConnectivityError{Kind: FailureBackend, Err: err}
+}
+
+// LastFailure returns why the last connection attempt failed, or nil if it
+// succeeded
+func (c *GRPCClient) LastFailure() *ConnectivityError {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lastFailure
+}
+
+// precheck walks the steps gRPC would otherwise fail on opaquely: resolving
+// the backend at addr, or the proxy, connecting, and the TLS handshake. A
+// captive portal shows up as a plain HTTP answer or a certificate that isn't
+// the backend's.
+func (c *GRPCClient) precheck(ctx context.Context, addr string) error {
+	ctx, cancel := context.WithTimeout(ctx, precheckTimeout)
+	defer cancel()
+
+	proxyURL, err := c.config.proxyURL(addr)
+	if err != nil {
+		return &ConnectivityError{Kind: FailureProxy, Err: err}
+	}
+
+	// Through a proxy only the proxy's name is resolved here
+	target := addr
+	if proxyURL != nil {
+		target = proxyURL.Host
+	}
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		host = target
+	}
+	if net.ParseIP(host) == nil {
+		if _, err := net.DefaultResolver.LookupHost(ctx, host); err != nil {
+			return &ConnectivityError{Kind: FailureDNS, Err: err}
+		}
+	}
+
+	var conn net.Conn
+	if proxyURL != nil {
+		conn, err = dialProxy(ctx, proxyURL, addr)
+	} else {
+		var d net.Dialer
+		conn, err = d.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			err = &ConnectivityError{Kind: FailureConnect, Err: err}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if !c.config.UseTLS {
+		return nil
+	}
+	serverName, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		serverName = addr
+	}
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: serverName})
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return classifyTLSFailure(err)
+	}
+	return nil
+}
+
+// classifyTLSFailure tells a captive portal intercepting the connection
+// apart from other handshake failures, such as an expired certificate or a
+// controller clock that is far off
+func classifyTLSFailure(err error) *ConnectivityError {
+	var recordErr tls.RecordHeaderError
+	if errors.As(err, &recordErr) {
+		return &ConnectivityError{Kind: FailurePortal, Err: fmt.Errorf("backend answered without TLS: %w", err)}
+	}
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	if errors.As(err, &authorityErr) || errors.As(err, &hostnameErr) {
+		return &ConnectivityError{Kind: FailurePortal, Err: fmt.Errorf("certificate is not the backend's: %w", err)}
+	}
+	return &ConnectivityError{Kind: FailureTLS, Err: err}
+}
@@ -0,0 +1,77 @@
+// Package cloud provides communication with the AgSys cloud service.
+// This file implements first-boot enrollment of a new controller.
+package cloud
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// DefaultEnrollURL is the cloud's controller enrollment endpoint
+const DefaultEnrollURL = "https://api.agsys.io/api/v1/controllers/enroll"
+
+// EnrollRequest claims a controller for a property. The gRPC API has no
+// enrollment call, and a new controller has no API key to authenticate
+// one with, so enrollment is a plain HTTPS request authorized by the claim
+// code printed for the property in the AgSys app.
+type EnrollRequest struct {
+	ClaimCode       string `json:"claim_code"`
+	InstanceID      string `json:"instance_id"` // Identity generated on this controller
+	Hostname        string `json:"hostname,omitempty"`
+	FirmwareVersion string `json:"firmware_version,omitempty"`
+}
+
+// Enrollment is the cloud's answer to an accepted claim
+type Enrollment struct {
+	ControllerID string `json:"controller_id"`
+	APIKey       string `json:"api_key"`
+	GRPCAddr     string `json:"grpc_addr"`
+	UseTLS       bool   `json:"use_tls"`
+	PropertyUID  string `json:"property_uid"`
+	PropertyName string `json:"property_name"`
+	AESKey       string `json:"aes_key"` // LoRa network key in hex (empty if the property has none yet)
+}
+
+// Enroll exchanges a claim code for the controller's ID and API key. The
+// claim code is single use; the cloud rejects it once a controller has
+// enrolled with it.
+func Enroll(ctx context.Context, url string, req EnrollRequest) (*Enrollment, error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("marshal enrollment: %w", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("create request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return nil, fmt.Errorf("read response: %w", err)
+	}
+	if resp.StatusCode >= 400 {
+		return nil, fmt.Errorf("enrollment rejected (%d): %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var enrollment Enrollment
+	if err := json.Unmarshal(body, &enrollment); err != nil {
+		return nil, fmt.Errorf("invalid enrollment response: %w", err)
+	}
+	if enrollment.ControllerID == "" || enrollment.APIKey == "" {
+		return nil, fmt.Errorf("enrollment response is missing the controller ID or API key")
+	}
+	return &enrollment, nil
+}
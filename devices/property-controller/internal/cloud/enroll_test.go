@@ -0,0 +1,46 @@
+package cloud
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestEnroll tests a claim accepted and a claim rejected by the cloud
+func TestEnroll(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req EnrollRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.ClaimCode != "ABCD-1234" {
+			http.Error(w, "claim code already used", http.StatusForbidden)
+			return
+		}
+		json.NewEncoder(w).Encode(Enrollment{
+			ControllerID: "ctrl-" + req.InstanceID,
+			APIKey:       "key-1",
+			GRPCAddr:     "grpc.example.com:443",
+			UseTLS:       true,
+		})
+	}))
+	defer srv.Close()
+
+	enrollment, err := Enroll(context.Background(), srv.URL, EnrollRequest{ClaimCode: "ABCD-1234", InstanceID: "i-1"})
+	if err != nil {
+		t.Fatalf("Enroll failed: %v", err)
+	}
+	want := Enrollment{ControllerID: "ctrl-i-1", APIKey: "key-1", GRPCAddr: "grpc.example.com:443", UseTLS: true}
+	if *enrollment != want {
+		t.Errorf("Enrollment = %+v, want %+v", *enrollment, want)
+	}
+
+	_, err = Enroll(context.Background(), srv.URL, EnrollRequest{ClaimCode: "USED-0000", InstanceID: "i-2"})
+	if err == nil || !strings.Contains(err.Error(), "claim code already used") {
+		t.Errorf("Enroll with a used claim code: err = %v, want the cloud's rejection", err)
+	}
+}
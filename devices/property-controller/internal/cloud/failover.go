@@ -0,0 +1,118 @@
+package cloud
+
+import (
+	"context"
+	"log"
+	"time"
+
+	controllerv1 "github.com/ccroswhite/agsys-api/gen/go/proto/controller/v1"
+)
+
+// endpoints returns the primary backend address followed by its fallbacks
+func (cfg GRPCConfig) endpoints() []string {
+	return append([]string{cfg.ServerAddr}, cfg.FallbackAddrs...)
+}
+
+// Endpoint returns the backend address the client is connecting to: the
+// primary, or a fallback while the primary is unreachable
+func (c *GRPCClient) Endpoint() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.addr()
+}
+
+// addr returns the current backend address. Callers hold c.mu.
+func (c *GRPCClient) addr() string {
+	endpoints := c.config.endpoints()
+	return endpoints[c.endpoint%len(endpoints)]
+}
+
+// recordFailure counts a failed connection attempt, moving on to the next
+// backend after FailoverAfter failures in a row. It reports whether the
+// client moved to a fallback, which is tried at once; coming round to the
+// primary again waits out the backoff as usual.
+func (c *GRPCClient) recordFailure() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	endpoints := c.config.endpoints()
+	if len(endpoints) < 2 {
+		return false
+	}
+	c.failures++
+	if c.failures < max(c.config.FailoverAfter, 1) {
+		return false
+	}
+
+	from, attempts := c.addr(), c.failures
+	c.switchEndpoint((c.endpoint + 1) % len(endpoints))
+	log.Printf("Backend %s unreachable after %d attempts, failing over to %s", from, attempts, c.addr())
+	return c.endpoint != 0
+}
+
+// switchEndpoint moves the client to another backend. The connection and
+// session belong to the old one, so both are dropped; a connected stream
+// fails and reconnects to the new backend. Callers hold c.mu.
+func (c *GRPCClient) switchEndpoint(i int) {
+	c.endpoint = i
+	c.failures = 0
+	c.sessionToken = ""
+	c.tokenExpiry = time.Time{}
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+}
+
+// failbackLoop health-checks the primary backend while connected to a
+// fallback, and moves back to it once it answers again. The same checks as
+// before a connection attempt are used: name resolution, TCP, and the TLS
+// handshake.
+func (c *GRPCClient) failbackLoop(stream controllerv1.ControllerService_ConnectClient) {
+	defer c.wg.Done()
+
+	ticker := time.NewTicker(c.config.FailbackInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.stopChan:
+			return
+		case <-stream.Context().Done():
+			return
+		case <-ticker.C:
+		}
+
+		c.mu.Lock()
+		primary := c.config.ServerAddr
+		c.mu.Unlock()
+		if err := c.healthCheck(stream.Context(), primary); err != nil {
+			continue
+		}
+
+		c.mu.Lock()
+		if c.endpoint == 0 {
+			c.mu.Unlock()
+			return // Already moved back, e.g. by a config reload
+		}
+		log.Printf("Primary backend %s is reachable again, failing back from %s", primary, c.addr())
+		c.switchEndpoint(0)
+		c.mu.Unlock()
+		return
+	}
+}
+
+// healthCheck reports whether a backend can be reached, through the custom
+// dialer if one is set
+func (c *GRPCClient) healthCheck(ctx context.Context, addr string) error {
+	if c.config.Dialer == nil {
+		return c.precheck(ctx, addr)
+	}
+	ctx, cancel := context.WithTimeout(ctx, precheckTimeout)
+	defer cancel()
+	conn, err := c.config.Dialer(ctx, addr)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
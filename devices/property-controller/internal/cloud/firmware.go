@@ -8,12 +8,11 @@ import (
 	"io"
 	"log"
 	"os"
+	"sync"
 
 	"github.com/agsys/property-controller/internal/ota"
 	controllerv1 "github.com/ccroswhite/agsys-api/gen/go/proto/controller/v1"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials"
-	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/metadata"
 )
 
@@ -24,6 +23,7 @@ type FirmwareClient struct {
 	conn         *grpc.ClientConn
 	client       controllerv1.FirmwareServiceClient
 	sessionToken string
+	tokenMu      sync.Mutex // Guards sessionToken, which is renewed in the background
 }
 
 // NewFirmwareClient creates a new firmware client
@@ -35,7 +35,9 @@ func NewFirmwareClient(config GRPCConfig) *FirmwareClient {
 
 // SetSessionToken sets the session token for authenticated requests
 func (c *FirmwareClient) SetSessionToken(token string) {
+	c.tokenMu.Lock()
 	c.sessionToken = token
+	c.tokenMu.Unlock()
 }
 
 // Connect establishes connection to the firmware service
@@ -44,13 +46,9 @@ func (c *FirmwareClient) Connect(ctx context.Context) error {
 		return nil // Already connected
 	}
 
-	opts := []grpc.DialOption{}
-
-	if c.config.UseTLS {
-		creds := credentials.NewClientTLSFromCert(nil, "")
-		opts = append(opts, grpc.WithTransportCredentials(creds))
-	} else {
-		opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	opts, err := c.config.dialOptions(c.config.ServerAddr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to firmware service: %w", err)
 	}
 
 	conn, err := grpc.DialContext(ctx, c.config.ServerAddr, opts...)
@@ -74,12 +72,27 @@ func (c *FirmwareClient) Close() error {
 	return nil
 }
 
+// UpdateConnection changes the backend address and credentials. The next
+// request dials the new address.
+func (c *FirmwareClient) UpdateConnection(serverAddr, apiKey string, useTLS bool) {
+	if c.config.ServerAddr == serverAddr && c.config.APIKey == apiKey && c.config.UseTLS == useTLS {
+		return
+	}
+	c.config.ServerAddr = serverAddr
+	c.config.APIKey = apiKey
+	c.config.UseTLS = useTLS
+	c.Close()
+}
+
 // contextWithAuth returns a context with the session token in metadata
 func (c *FirmwareClient) contextWithAuth(ctx context.Context) context.Context {
-	if c.sessionToken == "" {
+	c.tokenMu.Lock()
+	token := c.sessionToken
+	c.tokenMu.Unlock()
+	if token == "" {
 		return ctx
 	}
-	md := metadata.Pairs(authTokenMetadataKey, c.sessionToken)
+	md := metadata.Pairs(authTokenMetadataKey, token)
 	return metadata.NewOutgoingContext(ctx, md)
 }
 
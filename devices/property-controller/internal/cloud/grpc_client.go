@@ -3,18 +3,24 @@ package cloud
 
 import (
 	"context"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"math/rand"
+	"net"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	_ "github.com/agsys/property-controller/internal/cloud/zstd" // Registers the zstd compressor
+	"github.com/agsys/property-controller/internal/protocol"
 	controllerv1 "github.com/ccroswhite/agsys-api/gen/go/proto/controller/v1"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials"
-	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/connectivity"
+	_ "google.golang.org/grpc/encoding/gzip" // Registers the gzip compressor
 	"google.golang.org/grpc/keepalive"
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/protobuf/types/known/timestamppb"
@@ -32,6 +38,22 @@ type GRPCConfig struct {
 	APIKey       string // API key for authentication
 	UseTLS       bool   // Whether to use TLS
 
+	// Dialer opens the transport in place of a TCP connection (e.g. an
+	// in-memory listener in tests). Nil dials ServerAddr over TCP.
+	Dialer func(ctx context.Context, addr string) (net.Conn, error)
+
+	// Proxy to reach the backend through, as an http://, https:// or
+	// socks5:// URL with optional credentials. Empty uses HTTPS_PROXY and
+	// NO_PROXY from the environment.
+	Proxy string
+
+	// Usage, when set, counts the bytes exchanged with the backend
+	Usage *UsageCounter
+
+	// Compression of messages sent on the stream: "gzip", "zstd", or empty
+	// for none. The backend must accept the encoding.
+	Compression string
+
 	// Reconnection settings (exponential backoff)
 	InitialRetryDelay time.Duration
 	MaxRetryDelay     time.Duration
@@ -41,6 +63,23 @@ type GRPCConfig struct {
 	// Keepalive settings
 	KeepaliveTime    time.Duration
 	KeepaliveTimeout time.Duration
+
+	// Session token lifetime. The token is reused across reconnects until it
+	// expires and renewed SessionRefresh before then.
+	SessionTTL     time.Duration
+	SessionRefresh time.Duration
+
+	// Reconnect when nothing, not even a ping, arrives from the backend for
+	// this long (0 relies on transport keepalives alone)
+	LivenessTimeout time.Duration
+
+	// Secondary backends, tried in order once ServerAddr has failed
+	// FailoverAfter connection attempts in a row. While on one, ServerAddr
+	// is health-checked every FailbackInterval and returned to when it
+	// answers.
+	FallbackAddrs    []string
+	FailoverAfter    int
+	FailbackInterval time.Duration
 }
 
 // DefaultGRPCConfig returns default gRPC client configuration
@@ -53,6 +92,11 @@ func DefaultGRPCConfig() GRPCConfig {
 		JitterPercent:     0.25,
 		KeepaliveTime:     30 * time.Second,
 		KeepaliveTimeout:  10 * time.Second,
+		SessionTTL:        24 * time.Hour,
+		SessionRefresh:    time.Hour,
+		LivenessTimeout:   2 * time.Minute,
+		FailoverAfter:     3,
+		FailbackInterval:  5 * time.Minute,
 	}
 }
 
@@ -69,14 +113,31 @@ type GRPCClient struct {
 	mu        sync.Mutex
 	connected bool
 
-	// Current retry delay for exponential backoff
+	// Cancels the current stream, and when the backend was last heard from
+	streamCancel context.CancelFunc
+	lastReceived atomic.Int64
+
+	// Called as the stream comes up or goes down
+	onConnectionState func(connected bool)
+
+	// Current retry delay for exponential backoff, and why the last
+	// connection attempt failed
 	currentRetryDelay time.Duration
+	lastFailure       *ConnectivityError
+
+	// Index of the backend in use (0 is ServerAddr, then FallbackAddrs), and
+	// failed attempts on it in a row
+	endpoint int
+	failures int
 
 	// Firmware version for heartbeats
 	firmwareVersion string
 
-	// Session token from authentication
-	sessionToken string
+	// Session token from authentication, its expiry, and its renewal
+	sessionToken   string
+	tokenExpiry    time.Time
+	refreshTimer   *time.Timer
+	onSessionToken func(string)
 
 	// Callbacks for messages from backend
 	onValveCommand    func(*controllerv1.ValveCommand)
@@ -84,6 +145,9 @@ type GRPCClient struct {
 	onDeviceAdded     func(*controllerv1.DeviceApproved)
 	onConfigUpdate    func(*controllerv1.ConfigUpdate)
 	onMeterPinCommand func(*controllerv1.MeterPinCommand)
+
+	// Fills in LoRa stats for heartbeats
+	loraStats func() *controllerv1.LoRaStats
 }
 
 // NewGRPCClient creates a new gRPC cloud client
@@ -97,6 +161,11 @@ func NewGRPCClient(config GRPCConfig) *GRPCClient {
 	}
 }
 
+// SetLoRaStatsProvider sets the function that fills in LoRa stats for heartbeats
+func (c *GRPCClient) SetLoRaStatsProvider(provider func() *controllerv1.LoRaStats) {
+	c.loraStats = provider
+}
+
 // SetFirmwareVersion sets the firmware version reported in heartbeats
 func (c *GRPCClient) SetFirmwareVersion(version string) {
 	c.firmwareVersion = version
@@ -122,6 +191,11 @@ func (c *GRPCClient) SetConfigUpdateHandler(handler func(*controllerv1.ConfigUpd
 	c.onConfigUpdate = handler
 }
 
+// SetMeterPinCommandHandler sets the callback for meter remote shutoff commands
+func (c *GRPCClient) SetMeterPinCommandHandler(handler func(*controllerv1.MeterPinCommand)) {
+	c.onMeterPinCommand = handler
+}
+
 // Connect establishes connection to the gRPC server
 func (c *GRPCClient) Connect(ctx context.Context) error {
 	c.mu.Lock()
@@ -132,71 +206,93 @@ func (c *GRPCClient) Connect(ctx context.Context) error {
 	}
 
 	// Set up dial options
-	opts := []grpc.DialOption{
-		grpc.WithKeepaliveParams(keepalive.ClientParameters{
-			Time:                c.config.KeepaliveTime,
-			Timeout:             c.config.KeepaliveTimeout,
-			PermitWithoutStream: true,
-		}),
-	}
-
-	if c.config.UseTLS {
-		creds := credentials.NewClientTLSFromCert(nil, "")
-		opts = append(opts, grpc.WithTransportCredentials(creds))
-	} else {
-		opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
-	}
-
-	// Connect to server
-	conn, err := grpc.DialContext(ctx, c.config.ServerAddr, opts...)
+	addr := c.addr()
+	opts, err := c.config.dialOptions(addr)
 	if err != nil {
-		return fmt.Errorf("failed to connect: %w", err)
+		return &ConnectivityError{Kind: FailureProxy, Err: err}
+	}
+	opts = append(opts, grpc.WithKeepaliveParams(keepalive.ClientParameters{
+		Time:                c.config.KeepaliveTime,
+		Timeout:             c.config.KeepaliveTimeout,
+		PermitWithoutStream: true,
+	}))
+
+	// Find out where the network fails before gRPC hides it behind a
+	// generic unavailable error. A custom dialer has nothing to check.
+	if c.config.Dialer == nil {
+		if err := c.precheck(ctx, addr); err != nil {
+			return err
+		}
 	}
-	c.conn = conn
-	c.client = controllerv1.NewControllerServiceClient(conn)
 
-	// Authenticate
-	authResp, err := c.client.Authenticate(ctx, &controllerv1.AuthRequest{
-		ControllerId:    c.config.ControllerID,
-		ApiKey:          c.config.APIKey,
-		FirmwareVersion: c.firmwareVersion,
-	})
-	if err != nil {
-		conn.Close()
-		return fmt.Errorf("authentication failed: %w", err)
-	}
-	if !authResp.Success {
-		conn.Close()
-		return fmt.Errorf("authentication rejected: %s", authResp.ErrorMessage)
+	// Reuse the connection after a dropped stream; gRPC redials it as needed
+	conn := c.conn
+	if conn == nil || conn.GetState() == connectivity.Shutdown {
+		conn, err = grpc.DialContext(ctx, addr, opts...)
+		if err != nil {
+			return fmt.Errorf("failed to connect: %w", err)
+		}
+		c.conn = conn
+		c.client = controllerv1.NewControllerServiceClient(conn)
 	}
 
-	// Store session token for subsequent requests
-	c.sessionToken = authResp.SessionToken
+	// Authenticate, unless the session outlived the disconnect, so a long
+	// outage doesn't end with every controller re-authenticating at once
+	if !c.sessionValid() {
+		if err := c.authenticate(ctx); err != nil {
+			conn.Close()
+			return err
+		}
+	} else {
+		c.scheduleRefresh(time.Until(c.tokenExpiry) - c.config.SessionRefresh)
+	}
 
 	// Establish bidirectional stream with session token in metadata
-	streamCtx := c.contextWithAuth(ctx)
-	stream, err := c.client.Connect(streamCtx)
+	var callOpts []grpc.CallOption
+	if c.config.Compression != "" {
+		callOpts = append(callOpts, grpc.UseCompressor(c.config.Compression))
+	}
+	streamCtx, cancel := context.WithCancel(c.contextWithAuth(ctx))
+	stream, err := c.client.Connect(streamCtx, callOpts...)
 	if err != nil {
+		cancel()
+		if isUnauthenticated(err) {
+			c.sessionToken = ""
+		}
 		conn.Close()
 		return fmt.Errorf("failed to establish stream: %w", err)
 	}
 	c.stream = stream
+	c.streamCancel = cancel
 
 	// Send initial heartbeat
 	if err := c.sendHeartbeat(); err != nil {
+		cancel()
 		conn.Close()
 		return fmt.Errorf("failed to send initial heartbeat: %w", err)
 	}
 
 	c.connected = true
 	c.currentRetryDelay = c.config.InitialRetryDelay
+	c.lastFailure = nil
+	c.failures = 0
+	c.markReceived()
 
-	// Start sender and receiver goroutines
+	// Start sender and receiver goroutines, the liveness check, and, on a
+	// fallback backend, the primary's health check
 	c.wg.Add(2)
 	go c.sendLoop()
 	go c.receiveLoop()
+	if c.config.LivenessTimeout > 0 {
+		c.wg.Add(1)
+		go c.livenessLoop(stream, cancel)
+	}
+	if c.endpoint != 0 && c.config.FailbackInterval > 0 {
+		c.wg.Add(1)
+		go c.failbackLoop(stream)
+	}
 
-	log.Printf("Connected to AgSys backend at %s", c.config.ServerAddr)
+	log.Printf("Connected to AgSys backend at %s", addr)
 	return nil
 }
 
@@ -216,7 +312,14 @@ func (c *GRPCClient) ConnectWithRetry(ctx context.Context) {
 			return
 		}
 
-		log.Printf("Connection failed: %v, retrying in %v", err, c.currentRetryDelay)
+		failure := classifyFailure(err)
+		c.mu.Lock()
+		c.lastFailure = failure
+		c.mu.Unlock()
+		if c.recordFailure() {
+			continue // Try the fallback at once
+		}
+		log.Printf("Connection failed (%s): %v, retrying in %v", failure.Kind, failure.Err, c.currentRetryDelay)
 
 		// Wait with jitter
 		jitter := time.Duration(float64(c.currentRetryDelay) * c.config.JitterPercent * (rand.Float64()*2 - 1))
@@ -233,27 +336,65 @@ func (c *GRPCClient) ConnectWithRetry(ctx context.Context) {
 // Close closes the connection
 func (c *GRPCClient) Close() error {
 	c.mu.Lock()
-	defer c.mu.Unlock()
 
 	if !c.connected {
+		c.mu.Unlock()
 		return nil
 	}
 
 	close(c.stopChan)
-	c.wg.Wait()
+	c.connected = false
+	if c.refreshTimer != nil {
+		c.refreshTimer.Stop()
+	}
+	stream, conn := c.stream, c.conn
+	c.mu.Unlock()
 
-	if c.stream != nil {
-		c.stream.CloseSend()
+	// Close the connection before waiting: it unblocks a receive loop
+	// waiting on the stream, and the loops may take mu on the way out
+	if stream != nil {
+		stream.CloseSend()
 	}
-	if c.conn != nil {
-		c.conn.Close()
+	if conn != nil {
+		conn.Close()
 	}
+	c.wg.Wait()
 
-	c.connected = false
+	c.mu.Lock()
 	c.stopChan = make(chan struct{})
+	c.mu.Unlock()
 	return nil
 }
 
+// UpdateConnection changes the backend addresses and credentials. An open
+// connection is dropped so the client reconnects with the new settings,
+// starting with the primary.
+func (c *GRPCClient) UpdateConnection(serverAddr string, fallbackAddrs []string, apiKey string, useTLS bool) {
+	c.mu.Lock()
+	if c.config.ServerAddr == serverAddr && slices.Equal(c.config.FallbackAddrs, fallbackAddrs) &&
+		c.config.APIKey == apiKey && c.config.UseTLS == useTLS {
+		c.mu.Unlock()
+		return
+	}
+	c.config.ServerAddr = serverAddr
+	c.config.FallbackAddrs = slices.Clone(fallbackAddrs)
+	c.config.APIKey = apiKey
+	c.config.UseTLS = useTLS
+	c.endpoint, c.failures = 0, 0
+	c.sessionToken = "" // Issued for the old settings
+	conn := c.conn
+	c.mu.Unlock()
+
+	log.Printf("Cloud connection settings changed, reconnecting to %s", serverAddr)
+
+	// Closing the connection fails the stream; the receive loop then
+	// reconnects through handleDisconnect using the new settings. An idle
+	// connection is closed too so it isn't reused.
+	if conn != nil {
+		conn.Close()
+	}
+}
+
 // IsConnected returns whether the client is connected
 func (c *GRPCClient) IsConnected() bool {
 	c.mu.Lock()
@@ -281,6 +422,8 @@ func (c *GRPCClient) sendLoop() {
 func (c *GRPCClient) receiveLoop() {
 	defer c.wg.Done()
 
+	c.notifyConnectionState(true)
+
 	for {
 		select {
 		case <-c.stopChan:
@@ -294,12 +437,20 @@ func (c *GRPCClient) receiveLoop() {
 			c.handleDisconnect()
 			return
 		}
+		if err != nil && isUnauthenticated(err) {
+			// Only the session is bad: re-authenticate over the same connection
+			log.Printf("Session token rejected, re-authenticating: %v", err)
+			c.invalidateSession()
+			c.handleDisconnect()
+			return
+		}
 		if err != nil {
 			log.Printf("Receive error: %v", err)
 			c.handleDisconnect()
 			return
 		}
 
+		c.markReceived()
 		c.handleBackendMessage(msg)
 	}
 }
@@ -325,17 +476,39 @@ func (c *GRPCClient) handleBackendMessage(msg *controllerv1.BackendMessage) {
 		if c.onConfigUpdate != nil {
 			c.onConfigUpdate(payload.ConfigUpdate)
 		}
+	case *controllerv1.BackendMessage_MeterPinCommand:
+		if c.onMeterPinCommand != nil {
+			c.onMeterPinCommand(payload.MeterPinCommand)
+		}
 	case *controllerv1.BackendMessage_Ping:
 		// Respond with heartbeat
-		c.SendHeartbeat(0, nil)
+		c.sendHeartbeat()
 	}
 }
 
 func (c *GRPCClient) handleDisconnect() {
 	c.mu.Lock()
+	wasConnected := c.connected
 	c.connected = false
+	if c.streamCancel != nil {
+		c.streamCancel()
+	}
+	stopChan := c.stopChan
 	c.mu.Unlock()
 
+	// The connection was closed on purpose
+	select {
+	case <-stopChan:
+		return
+	default:
+	}
+
+	// Both loops see a failed stream; only the first reconnects
+	if !wasConnected {
+		return
+	}
+	c.notifyConnectionState(false)
+
 	// Trigger reconnection in background
 	go c.ConnectWithRetry(context.Background())
 }
@@ -368,7 +541,11 @@ func (c *GRPCClient) SendHeartbeat(uptimeSeconds int64, loraStats *controllerv1.
 }
 
 func (c *GRPCClient) sendHeartbeat() error {
-	return c.SendHeartbeat(0, nil)
+	var stats *controllerv1.LoRaStats
+	if c.loraStats != nil {
+		stats = c.loraStats()
+	}
+	return c.SendHeartbeat(0, stats)
 }
 
 // SendSensorData sends sensor readings to the backend
@@ -422,15 +599,17 @@ type MeterAlarmData struct {
 // mapAlarmType converts internal alarm type to protobuf enum
 func mapAlarmType(alarmType uint8) controllerv1.MeterAlarmType {
 	switch alarmType {
-	case 0:
+	case protocol.MeterAlarmCleared:
 		return controllerv1.MeterAlarmType_METER_ALARM_TYPE_CLEARED
-	case 1:
+	case protocol.MeterAlarmLeak, protocol.MeterAlarmFlowWhileClosed:
 		return controllerv1.MeterAlarmType_METER_ALARM_TYPE_LEAK
-	case 2:
+	case protocol.MeterAlarmReverse:
 		return controllerv1.MeterAlarmType_METER_ALARM_TYPE_REVERSE_FLOW
-	case 3:
+	case protocol.MeterAlarmTamper, protocol.MeterAlarmNoFlowWhileOpen:
+		// An open valve the meter sees no flow through may mean the
+		// meter has failed or been bypassed
 		return controllerv1.MeterAlarmType_METER_ALARM_TYPE_TAMPER
-	case 4:
+	case protocol.MeterAlarmHighFlow:
 		return controllerv1.MeterAlarmType_METER_ALARM_TYPE_HIGH_FLOW
 	default:
 		return controllerv1.MeterAlarmType_METER_ALARM_TYPE_UNSPECIFIED
@@ -464,6 +643,45 @@ func (c *GRPCClient) SendMeterAlarm(deviceUID string, alarm *MeterAlarmData) err
 	}
 }
 
+// SoilAlertData holds a soil moisture threshold crossing for cloud transmission
+type SoilAlertData struct {
+	ProbeID         uint8
+	MoisturePercent float32
+	Alert           string // "moisture_dry", "moisture_wet", or "moisture_ok"
+	Timestamp       time.Time
+}
+
+// SendSoilAlert sends the probe reading behind a moisture threshold crossing
+// to the backend (high priority). The shared protocol has no soil alert
+// message yet, so the reading goes out at once rather than waiting for the
+// next sensor sync batch.
+func (c *GRPCClient) SendSoilAlert(deviceUID string, alert *SoilAlertData) error {
+	msg := &controllerv1.ControllerMessage{
+		Payload: &controllerv1.ControllerMessage_SensorData{
+			SensorData: &controllerv1.SensorDataBatch{
+				DeviceUid: deviceUID,
+				Readings: []*controllerv1.SensorReading{{
+					Timestamp: timestamppb.New(alert.Timestamp),
+					Probes: []*controllerv1.ProbeReading{{
+						Index:           int32(alert.ProbeID),
+						MoisturePercent: alert.MoisturePercent,
+					}},
+				}},
+			},
+		},
+	}
+
+	log.Printf("Sending soil alert to cloud: device=%s probe=%d %s at %.0f%%",
+		deviceUID, alert.ProbeID, alert.Alert, alert.MoisturePercent)
+
+	select {
+	case c.sendChan <- msg:
+		return nil
+	default:
+		return fmt.Errorf("send buffer full")
+	}
+}
+
 // SendValveStatus sends valve status updates to the backend
 func (c *GRPCClient) SendValveStatus(controllerUID string, actuators []*controllerv1.ActuatorStatus) error {
 	msg := &controllerv1.ControllerMessage{
@@ -483,15 +701,15 @@ func (c *GRPCClient) SendValveStatus(controllerUID string, actuators []*controll
 	}
 }
 
-// SendDeviceDiscovery reports a newly discovered device
-func (c *GRPCClient) SendDeviceDiscovery(deviceUID, deviceType, firmwareVersion string, signalRSSI int32) error {
+// SendDeviceDiscovery reports a device and the firmware it runs
+func (c *GRPCClient) SendDeviceDiscovery(deviceUID, deviceType, firmwareVersion string, firstSeen time.Time, signalRSSI int32) error {
 	msg := &controllerv1.ControllerMessage{
 		Payload: &controllerv1.ControllerMessage_DeviceDiscovery{
 			DeviceDiscovery: &controllerv1.DeviceDiscovery{
 				DeviceUid:       deviceUID,
 				DeviceType:      deviceType,
 				FirmwareVersion: firmwareVersion,
-				FirstSeen:       timestamppb.Now(),
+				FirstSeen:       timestamppb.New(firstSeen),
 				SignalRssi:      signalRSSI,
 			},
 		},
@@ -526,6 +744,38 @@ func (c *GRPCClient) SendCommandAck(commandID string, success bool, errorMessage
 	}
 }
 
+// SendDebugReply relays a device's reply to a diagnostic command. The shared
+// protocol has no message for replies yet, so it goes out as the command's
+// ack: successful unless the device reported a non-zero status, with the
+// reply data hex-encoded in the message.
+func (c *GRPCClient) SendDebugReply(commandID string, status uint8, data []byte) error {
+	message := hex.EncodeToString(data)
+	if status != 0 {
+		message = fmt.Sprintf("status %d: %s", status, message)
+	}
+	return c.SendCommandAck(commandID, status == 0, message)
+}
+
+// MeterCalibrationData is the result of a water meter's known-volume
+// calibration
+type MeterCalibrationData struct {
+	ReferenceLiters   float64 // Volume run through the meter
+	Pulses            uint32  // Pulses the meter counted for it
+	OldPulsesPerLiter float64
+	NewPulsesPerLiter float64
+	ConfigVersion     uint16 // Meter config carrying the new value
+}
+
+// SendMeterCalibration reports a completed meter calibration. The shared
+// protocol has no calibration message yet, so it goes out as the successful
+// ack of the command that finished the session, with the result in the
+// message.
+func (c *GRPCClient) SendMeterCalibration(commandID string, cal *MeterCalibrationData) error {
+	message := fmt.Sprintf("pulses_per_liter=%.2f old_pulses_per_liter=%.2f pulses=%d reference_liters=%.1f config_version=%d",
+		cal.NewPulsesPerLiter, cal.OldPulsesPerLiter, cal.Pulses, cal.ReferenceLiters, cal.ConfigVersion)
+	return c.SendCommandAck(commandID, true, message)
+}
+
 // contextWithAuth returns a context with the session token in metadata
 func (c *GRPCClient) contextWithAuth(ctx context.Context) context.Context {
 	if c.sessionToken == "" {
@@ -0,0 +1,31 @@
+package cloud
+
+import (
+	"testing"
+
+	"github.com/agsys/property-controller/internal/protocol"
+	controllerv1 "github.com/ccroswhite/agsys-api/gen/go/proto/controller/v1"
+)
+
+// TestMapAlarmType tests that every meter alarm, reported or derived, maps to
+// a cloud alarm type
+func TestMapAlarmType(t *testing.T) {
+	tests := []struct {
+		alarm uint8
+		want  controllerv1.MeterAlarmType
+	}{
+		{protocol.MeterAlarmCleared, controllerv1.MeterAlarmType_METER_ALARM_TYPE_CLEARED},
+		{protocol.MeterAlarmLeak, controllerv1.MeterAlarmType_METER_ALARM_TYPE_LEAK},
+		{protocol.MeterAlarmReverse, controllerv1.MeterAlarmType_METER_ALARM_TYPE_REVERSE_FLOW},
+		{protocol.MeterAlarmTamper, controllerv1.MeterAlarmType_METER_ALARM_TYPE_TAMPER},
+		{protocol.MeterAlarmHighFlow, controllerv1.MeterAlarmType_METER_ALARM_TYPE_HIGH_FLOW},
+		{protocol.MeterAlarmFlowWhileClosed, controllerv1.MeterAlarmType_METER_ALARM_TYPE_LEAK},
+		{protocol.MeterAlarmNoFlowWhileOpen, controllerv1.MeterAlarmType_METER_ALARM_TYPE_TAMPER},
+		{0x7F, controllerv1.MeterAlarmType_METER_ALARM_TYPE_UNSPECIFIED},
+	}
+	for _, tt := range tests {
+		if got := mapAlarmType(tt.alarm); got != tt.want {
+			t.Errorf("mapAlarmType(0x%02X) = %v, want %v", tt.alarm, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package cloud
+
+import (
+	"context"
+	"log"
+	"time"
+
+	controllerv1 "github.com/ccroswhite/agsys-api/gen/go/proto/controller/v1"
+)
+
+// SetConnectionStateHandler sets the callback invoked when the stream comes
+// up or goes down, so the caller can switch between online and offline
+// operation without polling IsConnected
+func (c *GRPCClient) SetConnectionStateHandler(handler func(connected bool)) {
+	c.mu.Lock()
+	c.onConnectionState = handler
+	c.mu.Unlock()
+}
+
+// notifyConnectionState reports a change of connection state. Callers must
+// not hold c.mu.
+func (c *GRPCClient) notifyConnectionState(connected bool) {
+	c.mu.Lock()
+	handler := c.onConnectionState
+	c.mu.Unlock()
+	if handler != nil {
+		handler(connected)
+	}
+}
+
+// markReceived records that the backend was heard from
+func (c *GRPCClient) markReceived() {
+	c.lastReceived.Store(time.Now().UnixNano())
+}
+
+// livenessLoop drops a stream the backend has gone quiet on. The backend
+// pings idle streams, so hearing nothing for LivenessTimeout means the
+// stream is dead even if the transport hasn't noticed; cancelling it fails
+// the receive loop, which reconnects.
+func (c *GRPCClient) livenessLoop(stream controllerv1.ControllerService_ConnectClient, cancel context.CancelFunc) {
+	defer c.wg.Done()
+
+	timeout := c.config.LivenessTimeout
+	ticker := time.NewTicker(max(timeout/4, 10*time.Millisecond))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.stopChan:
+			return
+		case <-stream.Context().Done():
+			return
+		case <-ticker.C:
+		}
+
+		idle := time.Since(time.Unix(0, c.lastReceived.Load()))
+		if idle > timeout {
+			log.Printf("Nothing from backend in %v, reconnecting", idle.Round(time.Millisecond))
+			cancel()
+			return
+		}
+	}
+}
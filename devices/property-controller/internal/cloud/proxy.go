@@ -0,0 +1,162 @@
+package cloud
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/proxy"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// proxyURL returns the proxy the backend at addr is reached through, or nil
+// to connect directly. An empty Proxy setting falls back to HTTPS_PROXY and
+// NO_PROXY from the environment, read on every call rather than cached for
+// the process as net/http does.
+func (cfg GRPCConfig) proxyURL(addr string) (*url.URL, error) {
+	if cfg.Proxy == "" {
+		return httpproxy.FromEnvironment().ProxyFunc()(&url.URL{Scheme: "https", Host: addr})
+	}
+	u, err := url.Parse(cfg.Proxy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy %q: %w", cfg.Proxy, err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+		return u, nil
+	}
+	return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+}
+
+// dialOptions returns the transport options shared by the stream and
+// firmware clients for the backend at addr: credentials, usage counting, and
+// the dialer, through the proxy if any
+func (cfg GRPCConfig) dialOptions(addr string) ([]grpc.DialOption, error) {
+	var opts []grpc.DialOption
+	if cfg.Usage != nil {
+		opts = append(opts, grpc.WithStatsHandler(cfg.Usage))
+	}
+	if cfg.UseTLS {
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewClientTLSFromCert(nil, "")))
+	} else {
+		opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	}
+
+	if cfg.Dialer != nil {
+		return append(opts, grpc.WithContextDialer(cfg.Dialer)), nil
+	}
+	proxyURL, err := cfg.proxyURL(addr)
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL != nil {
+		// gRPC only understands HTTP proxies from the environment, so the
+		// proxy is dialed here for every scheme
+		opts = append(opts, grpc.WithNoProxy(), grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return dialProxy(ctx, proxyURL, addr)
+		}))
+	}
+	return opts, nil
+}
+
+// dialProxy opens a connection to addr through an HTTP(S) CONNECT or SOCKS5
+// proxy. A proxy that can't be reached fails with FailureConnect, one that
+// refuses the tunnel with FailureProxy.
+func dialProxy(ctx context.Context, proxyURL *url.URL, addr string) (net.Conn, error) {
+	switch proxyURL.Scheme {
+	case "http", "https":
+		return dialHTTPProxy(ctx, proxyURL, addr)
+	case "socks5", "socks5h":
+		dialer, err := proxy.FromURL(proxyURL, proxy.Direct)
+		if err != nil {
+			return nil, &ConnectivityError{Kind: FailureProxy, Err: err}
+		}
+		contextDialer, ok := dialer.(proxy.ContextDialer)
+		if !ok {
+			return nil, &ConnectivityError{Kind: FailureProxy, Err: fmt.Errorf("proxy %s can't be dialed with a context", proxyURL.Redacted())}
+		}
+		conn, err := contextDialer.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			// The SOCKS library wraps the failed dial to the proxy itself
+			var dialErr *net.OpError
+			if errors.As(errors.Unwrap(err), &dialErr) && dialErr.Op == "dial" {
+				return nil, &ConnectivityError{Kind: FailureConnect, Err: err}
+			}
+			return nil, &ConnectivityError{Kind: FailureProxy, Err: err}
+		}
+		return conn, nil
+	default:
+		return nil, &ConnectivityError{Kind: FailureProxy, Err: fmt.Errorf("unsupported proxy scheme %q", proxyURL.Scheme)}
+	}
+}
+
+// dialHTTPProxy opens a tunnel to addr with an HTTP CONNECT request
+func dialHTTPProxy(ctx context.Context, proxyURL *url.URL, addr string) (net.Conn, error) {
+	proxyAddr := proxyURL.Host
+	if proxyURL.Port() == "" {
+		port := "80"
+		if proxyURL.Scheme == "https" {
+			port = "443"
+		}
+		proxyAddr = net.JoinHostPort(proxyURL.Hostname(), port)
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, &ConnectivityError{Kind: FailureConnect, Err: fmt.Errorf("proxy %s: %w", proxyAddr, err)}
+	}
+	if proxyURL.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: proxyURL.Hostname()})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, &ConnectivityError{Kind: FailureProxy, Err: fmt.Errorf("proxy %s TLS: %w", proxyAddr, err)}
+		}
+		conn = tlsConn
+	}
+
+	// Don't let a proxy that never answers hold the dial past its deadline
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if user := proxyURL.User; user != nil {
+		password, _ := user.Password()
+		creds := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+creds)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, &ConnectivityError{Kind: FailureProxy, Err: fmt.Errorf("proxy %s: %w", proxyAddr, err)}
+	}
+
+	// The backend doesn't speak until the client does, so nothing past the
+	// response is buffered
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		conn.Close()
+		return nil, &ConnectivityError{Kind: FailureProxy, Err: fmt.Errorf("proxy %s: %w", proxyAddr, err)}
+	}
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, &ConnectivityError{Kind: FailureProxy, Err: fmt.Errorf("proxy %s refused tunnel to %s: %s", proxyAddr, addr, resp.Status)}
+	}
+	return conn, nil
+}
@@ -0,0 +1,293 @@
+package cloud
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// echoBackend listens on loopback and echoes whatever each connection sends
+func echoBackend(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// connectProxy is an HTTP CONNECT proxy that tunnels for one set of
+// credentials
+func connectProxy(t *testing.T, user, password string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+			return
+		}
+		req := &http.Request{Header: http.Header{"Authorization": r.Header["Proxy-Authorization"]}}
+		if u, p, ok := req.BasicAuth(); !ok || u != user || p != password {
+			w.Header().Set("Proxy-Authenticate", `Basic realm="proxy"`)
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		backend, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			backend.Close()
+			return
+		}
+		buf.Flush()
+		go func() {
+			io.Copy(backend, conn)
+			backend.Close()
+		}()
+		io.Copy(conn, backend)
+		conn.Close()
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// closedAddr returns a loopback address nothing listens on
+func closedAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+// failureKind returns the kind of a ConnectivityError, or "" for any other error
+func failureKind(err error) string {
+	var ce *ConnectivityError
+	if errors.As(err, &ce) {
+		return ce.Kind
+	}
+	return ""
+}
+
+// TestDialHTTPProxy tests tunnels through an HTTP CONNECT proxy and how
+// failures to get one are classified
+func TestDialHTTPProxy(t *testing.T) {
+	backend := echoBackend(t)
+	srv := connectProxy(t, "agsys", "s3cret")
+	proxyHost := srv.Listener.Addr().String()
+	tlsProxy := httptest.NewUnstartedServer(http.NotFoundHandler())
+	tlsProxy.Config.ErrorLog = log.New(io.Discard, "", 0) // The handshake fails by design
+	tlsProxy.StartTLS()
+	defer tlsProxy.Close()
+
+	tests := []struct {
+		name  string
+		proxy string
+		want  string // Failure kind, "" for a working tunnel
+	}{
+		{name: "tunnel", proxy: "http://agsys:s3cret@" + proxyHost},
+		{name: "wrong credentials", proxy: "http://agsys:guess@" + proxyHost, want: FailureProxy},
+		{name: "no credentials", proxy: "http://" + proxyHost, want: FailureProxy},
+		{name: "unreachable proxy", proxy: "http://" + closedAddr(t), want: FailureConnect},
+		// The test server's certificate isn't trusted
+		{name: "untrusted TLS proxy", proxy: "https://" + tlsProxy.Listener.Addr().String(), want: FailureProxy},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxyURL, err := url.Parse(tt.proxy)
+			if err != nil {
+				t.Fatalf("Parse failed: %v", err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			conn, err := dialProxy(ctx, proxyURL, backend)
+			if tt.want != "" {
+				if kind := failureKind(err); kind != tt.want {
+					t.Fatalf("dialProxy error = %v, want a %s failure", err, tt.want)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("dialProxy failed: %v", err)
+			}
+			defer conn.Close()
+
+			if _, err := conn.Write([]byte("ping")); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+			reply := make([]byte, 4)
+			if _, err := io.ReadFull(conn, reply); err != nil || string(reply) != "ping" {
+				t.Errorf("Echo through the tunnel = %q (err %v), want ping", reply, err)
+			}
+		})
+	}
+}
+
+// TestDialSOCKSProxy tests that a SOCKS5 proxy that can't be reached is a
+// connect failure, and one that refuses the connection, or a scheme no proxy
+// speaks, a proxy failure
+func TestDialSOCKSProxy(t *testing.T) {
+	// A SOCKS5 proxy that accepts no authentication and refuses every
+	// connection request
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				greeting := make([]byte, 2)
+				if _, err := io.ReadFull(conn, greeting); err != nil {
+					return
+				}
+				io.ReadFull(conn, make([]byte, greeting[1]))
+				conn.Write([]byte{0x05, 0x00})
+				io.ReadFull(conn, make([]byte, 4+4+2)) // IPv4 request
+				conn.Write([]byte{0x05, 0x05, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+			}()
+		}
+	}()
+
+	tests := []struct {
+		name  string
+		proxy string
+		want  string
+	}{
+		{name: "refused", proxy: "socks5://" + ln.Addr().String(), want: FailureProxy},
+		{name: "unreachable proxy", proxy: "socks5://" + closedAddr(t), want: FailureConnect},
+		{name: "unsupported scheme", proxy: "ftp://" + ln.Addr().String(), want: FailureProxy},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxyURL, _ := url.Parse(tt.proxy)
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			conn, err := dialProxy(ctx, proxyURL, "127.0.0.1:443")
+			if err == nil {
+				conn.Close()
+			}
+			if kind := failureKind(err); kind != tt.want {
+				t.Errorf("dialProxy error = %v, want a %s failure", err, tt.want)
+			}
+		})
+	}
+}
+
+// TestProxyURL tests the proxy setting and the fallback to the environment
+func TestProxyURL(t *testing.T) {
+	const backend = "grpc.example.com:443"
+
+	tests := []struct {
+		name    string
+		proxy   string
+		env     map[string]string
+		want    string // Proxy URL, "" to connect directly
+		wantErr bool
+	}{
+		{name: "http", proxy: "http://proxy.local:3128", want: "http://proxy.local:3128"},
+		{name: "https", proxy: "https://user:pw@proxy.local", want: "https://user:pw@proxy.local"},
+		{name: "socks5h", proxy: "socks5h://proxy.local:1080", want: "socks5h://proxy.local:1080"},
+		{name: "unsupported scheme", proxy: "ftp://proxy.local", wantErr: true},
+		{name: "invalid", proxy: "http://proxy local", wantErr: true},
+		{name: "setting beats the environment", proxy: "http://proxy.local:3128",
+			env: map[string]string{"HTTPS_PROXY": "http://env.local:8080"}, want: "http://proxy.local:3128"},
+		{name: "environment", env: map[string]string{"HTTPS_PROXY": "http://env.local:8080"}, want: "http://env.local:8080"},
+		{name: "NO_PROXY", env: map[string]string{"HTTPS_PROXY": "http://env.local:8080", "NO_PROXY": ".example.com"}},
+		{name: "no proxy anywhere"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range []string{"HTTPS_PROXY", "https_proxy", "NO_PROXY", "no_proxy"} {
+				t.Setenv(name, tt.env[name])
+			}
+
+			got, err := GRPCConfig{Proxy: tt.proxy}.proxyURL(backend)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("proxyURL = %v, expected an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("proxyURL failed: %v", err)
+			}
+			if (got == nil && tt.want != "") || (got != nil && got.String() != tt.want) {
+				t.Errorf("proxyURL = %v, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestPrecheckThroughProxy tests that the connectivity pre-check reports
+// where a proxied connection fails
+func TestPrecheckThroughProxy(t *testing.T) {
+	backend := echoBackend(t)
+	srv := connectProxy(t, "agsys", "s3cret")
+	proxyHost := srv.Listener.Addr().String()
+
+	tests := []struct {
+		name  string
+		proxy string
+		want  string
+	}{
+		{name: "tunnel", proxy: "http://agsys:s3cret@" + proxyHost},
+		{name: "proxy auth required", proxy: "http://" + proxyHost, want: FailureProxy},
+		{name: "unreachable proxy", proxy: "http://" + closedAddr(t), want: FailureConnect},
+		{name: "bad proxy setting", proxy: "gopher://" + proxyHost, want: FailureProxy},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultGRPCConfig()
+			cfg.UseTLS = false
+			cfg.Proxy = tt.proxy
+			err := NewGRPCClient(cfg).precheck(context.Background(), backend)
+			if tt.want == "" {
+				if err != nil {
+					t.Errorf("precheck failed: %v", err)
+				}
+				return
+			}
+			if kind := failureKind(err); kind != tt.want {
+				t.Errorf("precheck error = %v, want a %s failure", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package cloud
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	controllerv1 "github.com/ccroswhite/agsys-api/gen/go/proto/controller/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// authTimeout bounds a background session refresh
+	authTimeout = 30 * time.Second
+
+	// refreshRetryDelay is the wait before retrying a failed refresh
+	refreshRetryDelay = time.Minute
+)
+
+// SetSessionTokenHandler sets the callback invoked with each new session
+// token, e.g. to share it with the firmware client
+func (c *GRPCClient) SetSessionTokenHandler(handler func(token string)) {
+	c.mu.Lock()
+	c.onSessionToken = handler
+	c.mu.Unlock()
+}
+
+// sessionValid reports whether the session token can still be used.
+// Callers hold c.mu.
+func (c *GRPCClient) sessionValid() bool {
+	return c.sessionToken != "" && time.Now().Before(c.tokenExpiry)
+}
+
+// invalidateSession drops the session token so the next connection
+// authenticates again
+func (c *GRPCClient) invalidateSession() {
+	c.mu.Lock()
+	c.sessionToken = ""
+	c.tokenExpiry = time.Time{}
+	c.mu.Unlock()
+}
+
+// authenticate exchanges the API key for a session token and schedules its
+// refresh. Callers hold c.mu.
+func (c *GRPCClient) authenticate(ctx context.Context) error {
+	authResp, err := c.client.Authenticate(ctx, &controllerv1.AuthRequest{
+		ControllerId:    c.config.ControllerID,
+		ApiKey:          c.config.APIKey,
+		FirmwareVersion: c.firmwareVersion,
+	})
+	if err != nil {
+		return fmt.Errorf("authentication failed: %w", err)
+	}
+	if !authResp.Success {
+		return &ConnectivityError{Kind: FailureAuth, Err: fmt.Errorf("authentication rejected: %s", authResp.ErrorMessage)}
+	}
+
+	c.sessionToken = authResp.SessionToken
+	c.tokenExpiry = time.Now().Add(c.config.SessionTTL)
+	if c.onSessionToken != nil {
+		c.onSessionToken(c.sessionToken)
+	}
+	c.scheduleRefresh(c.config.SessionTTL - c.config.SessionRefresh)
+	return nil
+}
+
+// scheduleRefresh re-authenticates after a delay, replacing any refresh
+// already scheduled. Callers hold c.mu.
+func (c *GRPCClient) scheduleRefresh(after time.Duration) {
+	if c.refreshTimer != nil {
+		c.refreshTimer.Stop()
+	}
+	c.refreshTimer = time.AfterFunc(max(after, 0), c.refreshSession)
+}
+
+// refreshSession renews the session token before it expires. The open
+// stream is left alone; the new token is used from the next connection on.
+func (c *GRPCClient) refreshSession() {
+	ctx, cancel := context.WithTimeout(context.Background(), authTimeout)
+	defer cancel()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.connected {
+		return // The next connection authenticates if the token has expired
+	}
+	if err := c.authenticate(ctx); err != nil {
+		retry := min(refreshRetryDelay, max(time.Until(c.tokenExpiry), 0))
+		log.Printf("Session refresh failed: %v, retrying in %v", err, retry)
+		if retry > 0 {
+			c.scheduleRefresh(retry)
+		}
+		return
+	}
+	log.Printf("Session token refreshed, valid until %s", c.tokenExpiry.Format(time.DateTime))
+}
+
+// isUnauthenticated reports whether the backend rejected the session token
+func isUnauthenticated(err error) bool {
+	return status.Code(err) == codes.Unauthenticated
+}
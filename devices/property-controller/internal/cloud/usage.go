@@ -0,0 +1,44 @@
+package cloud
+
+import (
+	"context"
+	"sync/atomic"
+
+	"google.golang.org/grpc/stats"
+)
+
+// UsageCounter counts the bytes of gRPC messages exchanged with the
+// backend. Message framing is included; HTTP/2 and TLS overhead are not, so
+// the carrier's count runs somewhat higher.
+type UsageCounter struct {
+	up   atomic.Int64
+	down atomic.Int64
+}
+
+// Take returns the bytes sent and received since the last call
+func (u *UsageCounter) Take() (up, down int64) {
+	return u.up.Swap(0), u.down.Swap(0)
+}
+
+// TagRPC implements stats.Handler
+func (u *UsageCounter) TagRPC(ctx context.Context, _ *stats.RPCTagInfo) context.Context {
+	return ctx
+}
+
+// HandleRPC implements stats.Handler, counting message payloads
+func (u *UsageCounter) HandleRPC(_ context.Context, s stats.RPCStats) {
+	switch p := s.(type) {
+	case *stats.OutPayload:
+		u.up.Add(int64(p.WireLength))
+	case *stats.InPayload:
+		u.down.Add(int64(p.WireLength))
+	}
+}
+
+// TagConn implements stats.Handler
+func (u *UsageCounter) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+// HandleConn implements stats.Handler
+func (u *UsageCounter) HandleConn(context.Context, stats.ConnStats) {}
@@ -0,0 +1,130 @@
+package engine
+
+import (
+	"log"
+	"time"
+
+	"github.com/agsys/property-controller/internal/logging"
+	"github.com/agsys/property-controller/internal/protocol"
+	"github.com/agsys/property-controller/internal/storage"
+)
+
+// AckConfig controls the ACKs device reports are answered with. Each report
+// gets one ACK once it has been handled, whose flags tell the device what
+// waits for it: logs to send, a config or schedule, a time sync or an OTA
+// update.
+type AckConfig struct {
+	Enabled   bool // Ack device reports
+	FlagsOnly bool // Only ack reports that were rejected or have a flag set, saving airtime
+}
+
+// DefaultAckConfig returns default ACK settings
+func DefaultAckConfig() AckConfig {
+	return AckConfig{Enabled: true}
+}
+
+// ackedUplinks are the reports answered with an ACK, each with the check of
+// whether its payload could be read. Other uplinks answer the controller's
+// own downlinks, are acked by their handler, as log batches are, or belong to
+// an OTA session.
+var ackedUplinks = map[uint8]func([]byte) error{
+	protocol.MsgTypeSensorReport: func(p []byte) error {
+		if len(p) >= protocol.SoilReportSize {
+			_, err := protocol.DecodeSoilReport(p)
+			return err
+		}
+		_, err := protocol.DecodeSensorData(p)
+		return err
+	},
+	protocol.MsgTypeWaterMeterReport: func(p []byte) error {
+		_, err := protocol.DecodeWaterMeter(p)
+		return err
+	},
+	protocol.MsgTypeMeterAlarm: func(p []byte) error {
+		_, err := protocol.DecodeMeterAlarm(p)
+		return err
+	},
+	protocol.MsgTypeValveStatus: func(p []byte) error {
+		_, err := protocol.DecodeValveStatus(p)
+		return err
+	},
+	protocol.MsgTypeHeartbeat: func(p []byte) error {
+		if len(p) == 0 {
+			return nil // Older firmware
+		}
+		_, err := protocol.DecodeHeartbeat(p)
+		return err
+	},
+}
+
+// ackUplink answers a device report with an ACK, its status saying whether
+// the payload could be read and its flags computed from what waits for the
+// device. A time sync due to the device follows the ACK.
+func (e *Engine) ackUplink(deviceUID string, msg *protocol.LoRaMessage, now time.Time) {
+	check, ok := ackedUplinks[msg.Header.MsgType]
+	cfg := e.settings().Acks
+	if !ok || !cfg.Enabled {
+		return
+	}
+
+	var status uint8
+	if err := check(msg.Payload); err != nil {
+		status = protocol.NackErrInvalidPayload
+	}
+	flags := e.ackFlags(deviceUID, msg)
+	timeSync := e.takeClockSync(deviceUID, now)
+	if timeSync {
+		flags |= protocol.AckFlagTimeSync
+	}
+	if cfg.FlagsOnly && status == 0 && flags == 0 && !e.otaPending(deviceUID, msg.Header.DeviceType) {
+		return
+	}
+
+	logging.Debugf("ACK type 0x%02X from %s seq %d, status %d, flags 0x%02X",
+		msg.Header.MsgType, deviceUID, msg.Header.Sequence, status, flags)
+	if err := e.SendAck(deviceUID, msg.Header.DeviceType, msg.Header.Sequence, status, flags); err != nil {
+		log.Printf("Failed to ack type 0x%02X from %s: %v", msg.Header.MsgType, deviceUID, err)
+	}
+	if timeSync {
+		e.sendClockSync(deviceUID)
+	}
+}
+
+// ackFlags computes the flags of the ACK to a device's report, besides
+// OTA_PENDING, which SendAck sets, and the time sync
+func (e *Engine) ackFlags(deviceUID string, msg *protocol.LoRaMessage) uint8 {
+	var flags uint8
+
+	// Soil sensors say in each report whether they hold unsent logs
+	if msg.Header.MsgType == protocol.MsgTypeSensorReport && len(msg.Payload) >= protocol.SoilReportSize {
+		if r, err := protocol.DecodeSoilReport(msg.Payload); err == nil &&
+			(r.PendingLogs > 0 || r.Flags&protocol.SensorFlagHasPendingLogs != 0) {
+			flags |= protocol.AckFlagSendLogs
+		}
+	}
+
+	c, err := e.db.GetDeviceConfig(deviceUID)
+	if err != nil {
+		log.Printf("Failed to load config of %s: %v", deviceUID, err)
+	} else if c != nil && c.State == storage.DeviceConfigPending {
+		flags |= protocol.AckFlagConfigAvail
+	}
+	if msg.Header.DeviceType == protocol.DeviceTypeWaterMeter {
+		m, err := e.db.GetMeterConfig(deviceUID)
+		if err != nil {
+			log.Printf("Failed to load meter config of %s: %v", deviceUID, err)
+		} else if m != nil && (m.State == storage.DeviceConfigQueued || m.State == storage.DeviceConfigPending) {
+			flags |= protocol.AckFlagConfigAvail
+		}
+	}
+
+	if msg.Header.DeviceType == protocol.DeviceTypeValveController {
+		d, err := e.db.GetScheduleDelivery(deviceUID)
+		if err != nil {
+			log.Printf("Failed to load schedule delivery of %s: %v", deviceUID, err)
+		} else if d != nil && d.State == storage.DeviceConfigPending {
+			flags |= protocol.AckFlagScheduleUpdate
+		}
+	}
+	return flags
+}
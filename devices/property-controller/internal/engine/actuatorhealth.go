@@ -0,0 +1,161 @@
+package engine
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/agsys/property-controller/internal/protocol"
+	"github.com/agsys/property-controller/internal/storage"
+)
+
+// ActuatorHealthConfig sets the motor current outside of which valve
+// actuators raise maintenance alerts. Limits apply to the average of the
+// recent actuations, so a single odd reading doesn't raise one; an actuation
+// the firmware cut off on overcurrent does.
+type ActuatorHealthConfig struct {
+	MaxMA        uint16        // Overcurrent above this draw, e.g. a sticking valve (0 disables)
+	MinMA        uint16        // Undercurrent below this draw, e.g. a disconnected valve (0 disables)
+	DriftPercent float64       // Alert when the draw moves this far from the actuator's baseline (0 disables)
+	Recent       int           // Actuations the recent draw averages
+	Baseline     int           // Earlier actuations the baseline averages
+	History      time.Duration // How long actuations are kept (0 keeps them)
+}
+
+// DefaultActuatorHealthConfig returns default actuator health settings. The
+// draw of a healthy actuator depends on the valve, so only drift from each
+// actuator's own baseline is checked.
+func DefaultActuatorHealthConfig() ActuatorHealthConfig {
+	return ActuatorHealthConfig{
+		DriftPercent: 40,
+		Recent:       5,
+		Baseline:     20,
+		History:      365 * 24 * time.Hour,
+	}
+}
+
+// recordActuation stores the current an actuator drew moving to a new state
+// and checks its trend
+func (e *Engine) recordActuation(deviceUID string, status *protocol.ValveStatusPayload, now time.Time) {
+	if status.State != protocol.ValveStateOpen && status.State != protocol.ValveStateClosed {
+		return
+	}
+	if status.Flags&protocol.ValveFlagOvercurrent != 0 {
+		log.Printf("Valve on %s addr %d cut off on overcurrent at %dmA", deviceUID, status.ActuatorAddr, status.CurrentMA)
+	}
+
+	err := e.db.InsertActuatorCurrent(&storage.ActuatorCurrent{
+		ControllerUID: deviceUID,
+		ActuatorAddr:  status.ActuatorAddr,
+		State:         status.State,
+		CurrentMA:     status.CurrentMA,
+		Flags:         status.Flags,
+		Timestamp:     now,
+	})
+	if err != nil {
+		log.Printf("Failed to record actuation of %s addr %d: %v", deviceUID, status.ActuatorAddr, err)
+		return
+	}
+	e.checkActuatorHealth(deviceUID, status.ActuatorAddr, now)
+}
+
+// checkActuatorHealth raises a maintenance alert when an actuator's recent
+// draw is outside the limits or has drifted from its baseline, and clears it
+// once the draw is back
+func (e *Engine) checkActuatorHealth(controllerUID string, addr uint8, now time.Time) {
+	cfg := e.settings().ActuatorHealth
+	if cfg.Recent <= 0 {
+		return
+	}
+
+	currents, err := e.db.GetActuatorCurrents(controllerUID, addr, cfg.Recent+max(cfg.Baseline, 0))
+	if err != nil {
+		log.Printf("Failed to get actuations of %s addr %d: %v", controllerUID, addr, err)
+		return
+	}
+	if len(currents) == 0 {
+		return
+	}
+
+	// The firmware cutting the motor off is overcurrent whatever the trend.
+	// Otherwise there must be enough actuations for a trend.
+	enough := len(currents) >= cfg.Recent
+	recent := averageCurrent(currents[:min(len(currents), cfg.Recent)])
+	cutOff := currents[0].Flags&protocol.ValveFlagOvercurrent != 0
+	over, under := cutOff, false
+	var reason string
+	switch {
+	case cutOff:
+		reason = "cut off on overcurrent"
+	case !enough:
+	case cfg.MaxMA > 0 && recent > float64(cfg.MaxMA):
+		over, reason = true, fmt.Sprintf("above the %dmA limit", cfg.MaxMA)
+	case cfg.MinMA > 0 && recent < float64(cfg.MinMA):
+		under, reason = true, fmt.Sprintf("below the %dmA limit", cfg.MinMA)
+	case cfg.DriftPercent > 0 && cfg.Baseline > 0 && len(currents) == cfg.Recent+cfg.Baseline:
+		baseline := averageCurrent(currents[cfg.Recent:])
+		drift := cfg.DriftPercent / 100
+		if recent > baseline*(1+drift) {
+			over, reason = true, fmt.Sprintf("up from a baseline of %.0fmA", baseline)
+		} else if recent < baseline*(1-drift) {
+			under, reason = true, fmt.Sprintf("down from a baseline of %.0fmA", baseline)
+		}
+	}
+
+	switch {
+	case over:
+		e.clearAlerts(controllerUID, addr, alertValveUndercurrent)
+		e.raiseAlert(&storage.Alert{
+			DeviceUID: controllerUID,
+			ProbeID:   addr,
+			AlertType: alertValveOvercurrent,
+			Severity:  storage.AlertWarning,
+			Message: fmt.Sprintf("maintenance: valve on %s addr %d draws %.0fmA over its last %d actuations, %s; it may be sticking",
+				controllerUID, addr, recent, min(len(currents), cfg.Recent), reason),
+			Value:     recent,
+			Threshold: float64(cfg.MaxMA),
+			Timestamp: now,
+		})
+	case under:
+		e.clearAlerts(controllerUID, addr, alertValveOvercurrent)
+		e.raiseAlert(&storage.Alert{
+			DeviceUID: controllerUID,
+			ProbeID:   addr,
+			AlertType: alertValveUndercurrent,
+			Severity:  storage.AlertWarning,
+			Message: fmt.Sprintf("maintenance: valve on %s addr %d draws %.0fmA over its last %d actuations, %s; it may be disconnected",
+				controllerUID, addr, recent, cfg.Recent, reason),
+			Value:     recent,
+			Threshold: float64(cfg.MinMA),
+			Timestamp: now,
+		})
+	case enough:
+		e.clearAlerts(controllerUID, addr, alertValveOvercurrent, alertValveUndercurrent)
+	}
+}
+
+// averageCurrent averages the draw of actuations
+func averageCurrent(currents []*storage.ActuatorCurrent) float64 {
+	var sum float64
+	for _, c := range currents {
+		sum += float64(c.CurrentMA)
+	}
+	return sum / float64(len(currents))
+}
+
+// pruneActuatorCurrents deletes actuations past retention
+func (e *Engine) pruneActuatorCurrents() {
+	retention := e.settings().ActuatorHealth.History
+	if retention <= 0 {
+		return
+	}
+
+	n, err := e.db.DeleteActuatorCurrentsBefore(time.Now().Add(-retention))
+	if err != nil {
+		log.Printf("Failed to prune actuator currents: %v", err)
+		return
+	}
+	if n > 0 {
+		log.Printf("Pruned %d actuator current samples", n)
+	}
+}
@@ -0,0 +1,117 @@
+package engine
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/agsys/property-controller/internal/localapi"
+	"github.com/agsys/property-controller/internal/storage"
+)
+
+// actuatorMeta picks the name, alias, and zone_id keys present in a cloud
+// config update. Keys that are absent are left unchanged.
+func actuatorMeta(cfg map[string]string) storage.ValveActuatorMeta {
+	var meta storage.ValveActuatorMeta
+	if v, ok := cfg["name"]; ok {
+		meta.Name = &v
+	}
+	if v, ok := cfg["alias"]; ok {
+		meta.Alias = &v
+	}
+	if v, ok := cfg["zone_id"]; ok {
+		meta.ZoneID = &v
+	}
+	return meta
+}
+
+// handleActuatorUpdate applies names and zone assignment from the cloud to a
+// valve actuator. Config carries actuator_uid, or controller_uid and
+// actuator_address, plus any of name, alias, and zone_id.
+func (e *Engine) handleActuatorUpdate(cfg map[string]string) {
+	controllerUID, addr, err := actuatorFromConfig(cfg)
+	if err != nil {
+		log.Printf("Invalid actuator update: %v", err)
+		return
+	}
+
+	meta := actuatorMeta(cfg)
+	if meta.Name == nil && meta.Alias == nil && meta.ZoneID == nil {
+		log.Printf("Invalid actuator update, nothing to change: %v", cfg)
+		return
+	}
+	if err := e.db.UpdateValveActuatorMeta(controllerUID, addr, meta); err != nil {
+		log.Printf("Failed to update actuator %s addr %d: %v", controllerUID, addr, err)
+		return
+	}
+	log.Printf("Actuator %s addr %d updated: %v", controllerUID, addr, cfg)
+}
+
+// actuatorFromConfig reads the actuator an update refers to
+func actuatorFromConfig(cfg map[string]string) (string, uint8, error) {
+	if uid := cfg["actuator_uid"]; uid != "" {
+		return parseActuatorUID(uid)
+	}
+	controllerUID := cfg["controller_uid"]
+	addr, err := strconv.ParseUint(cfg["actuator_address"], 10, 8)
+	if controllerUID == "" || err != nil {
+		return "", 0, fmt.Errorf("missing actuator_uid or controller_uid and actuator_address: %v", cfg)
+	}
+	return controllerUID, uint8(addr), nil
+}
+
+// Valves lists valve actuators with their names and zones for the local API
+func (e *Engine) Valves() ([]localapi.Valve, error) {
+	actuators, err := e.db.GetValveActuators()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get valve actuators: %w", err)
+	}
+	zones, err := e.db.GetZones()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get zones: %w", err)
+	}
+	zoneNames := make(map[string]string, len(zones))
+	for _, z := range zones {
+		zoneNames[z.UID] = z.Name
+	}
+	overrides, err := e.db.GetValveOverrides(time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get manual overrides: %w", err)
+	}
+	type valveKey struct {
+		controllerUID string
+		addr          uint8
+	}
+	overrideUntil := make(map[valveKey]time.Time, len(overrides))
+	for _, o := range overrides {
+		overrideUntil[valveKey{o.ControllerUID, o.ActuatorAddr}] = o.ExpiresAt
+	}
+
+	valves := make([]localapi.Valve, 0, len(actuators))
+	for _, a := range actuators {
+		v := localapi.Valve{
+			UID:           a.UID,
+			ControllerUID: a.ControllerUID,
+			Address:       a.Address,
+			Name:          a.Name,
+			Alias:         a.Alias,
+			ZoneID:        a.ZoneID,
+			ZoneName:      zoneNames[a.ZoneID],
+			ValveID:       a.ValveID,
+			State:         valveStateString(a.CurrentState),
+			Registered:    a.IsRegistered,
+		}
+		if !a.LastStateChange.IsZero() {
+			v.LastChange = &a.LastStateChange
+		}
+		if !a.OpenedAt.IsZero() {
+			v.OpenedAt = &a.OpenedAt
+		}
+		if until, ok := overrideUntil[valveKey{a.ControllerUID, a.Address}]; ok {
+			v.OverrideUntil = &until
+		}
+		valves = append(valves, v)
+	}
+	return valves, nil
+}
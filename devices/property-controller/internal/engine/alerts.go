@@ -0,0 +1,339 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/agsys/property-controller/internal/cloud"
+	"github.com/agsys/property-controller/internal/notify"
+	"github.com/agsys/property-controller/internal/protocol"
+	"github.com/agsys/property-controller/internal/storage"
+)
+
+// Alert types raised by the engine. Meter alarms use meterAlertType.
+const (
+	alertDeviceOffline = "device_offline"
+	alertLowBattery    = "low_battery"
+	alertCommandFailed = "command_failed"
+	alertMoistureDry   = "moisture_dry"
+	alertMoistureWet   = "moisture_wet"
+	alertFrost         = "frost"
+	alertCloudOffline  = "cloud_offline"
+	alertEmergencyStop = "emergency_stop"
+	alertGatewayHealth = "gateway_degraded"
+
+	alertValveOvercurrent  = "valve_overcurrent"
+	alertValveUndercurrent = "valve_undercurrent"
+	alertValveRuntimeLimit = "valve_runtime_limit"
+	alertPowerFail         = "power_fail"
+	alertRebootLoop        = "reboot_loop"
+)
+
+// AlertConfig controls alerts the engine raises on its own checks
+type AlertConfig struct {
+	OfflineAfter time.Duration // Alert for devices not heard from in this long (0 disables)
+	CloudOffline time.Duration // Alert when the cloud has been unreachable this long (0 disables)
+	Frost        bool          // Alert on soil sensor temperatures at or below FrostC
+	FrostC       float64
+
+	GatewayMinScore int           // Alert when a gateway's health score drops below this (0 disables)
+	GatewayWindow   time.Duration // Period the gateway health score covers
+}
+
+// DefaultAlertConfig returns default alert settings
+func DefaultAlertConfig() AlertConfig {
+	return AlertConfig{
+		OfflineAfter: 3 * time.Hour,
+		CloudOffline: 30 * time.Minute,
+		FrostC:       1,
+
+		GatewayMinScore: 80,
+		GatewayWindow:   time.Hour,
+	}
+}
+
+// meterAlertType names the alert for a meter alarm type
+func meterAlertType(alarmType uint8) string {
+	return "meter_" + strings.ToLower(protocol.MeterAlarmTypeString(alarmType))
+}
+
+// meterAlertSeverity rates a meter alarm; anything that may be losing water
+// is critical
+func meterAlertSeverity(alarmType uint8) string {
+	if alarmType == protocol.MeterAlarmNoFlowWhileOpen {
+		return storage.AlertWarning
+	}
+	return storage.AlertCritical
+}
+
+// raiseMeterAlert raises the alert for a stored meter alarm
+func (e *Engine) raiseMeterAlert(alarm *storage.MeterAlarm) {
+	e.raiseAlert(&storage.Alert{
+		DeviceUID: alarm.DeviceUID,
+		AlertType: meterAlertType(alarm.AlarmType),
+		Severity:  meterAlertSeverity(alarm.AlarmType),
+		Message: fmt.Sprintf("water meter %s: %s, flow %.2f L/min for %ds", alarm.DeviceUID,
+			protocol.MeterAlarmTypeString(alarm.AlarmType), alarm.FlowRateLPM, alarm.DurationSec),
+		Value:     float64(alarm.FlowRateLPM),
+		SourceID:  alarm.ID,
+		Timestamp: alarm.Timestamp,
+	})
+}
+
+// raiseAlert stores an alert and publishes it, which sends it to the cloud
+// and the notification sinks. A repeat of an alert that is still open only
+// counts against the open one.
+func (e *Engine) raiseAlert(a *storage.Alert) {
+	raised, err := e.db.RaiseAlert(a)
+	if err != nil {
+		log.Printf("Failed to store alert: %v", err)
+		return
+	}
+	if !raised {
+		return
+	}
+
+	log.Printf("ALERT (%s): %s", a.Severity, a.Message)
+	e.bus.Alert.publish(AlertChanged{Alert: a})
+}
+
+// notifyAlert sends a new alert to the local notification sinks, which work
+// without the cloud
+func (e *Engine) notifyAlert(a *storage.Alert) {
+	err := e.notifier.Notify(context.Background(), notify.Message{
+		Severity:  a.Severity,
+		Type:      a.AlertType,
+		DeviceUID: a.DeviceUID,
+		Text:      a.Message,
+		Time:      a.Timestamp,
+	})
+	if err != nil {
+		log.Printf("Failed to send alert notification: %v", err)
+	}
+}
+
+// clearAlerts clears a device probe's open alerts of the given types and
+// publishes the clearing, which sends it to the cloud
+func (e *Engine) clearAlerts(deviceUID string, probeID uint8, alertTypes ...string) {
+	cleared, err := e.db.ClearAlerts(deviceUID, probeID, time.Now(), alertTypes...)
+	if err != nil {
+		log.Printf("Failed to clear alerts: %v", err)
+		return
+	}
+
+	for _, a := range cleared {
+		log.Printf("Alert cleared: %s", a.Message)
+		e.bus.Alert.publish(AlertChanged{Alert: a, Cleared: true})
+	}
+}
+
+// sendAlertToCloud sends an alert, or its clearing, to the cloud immediately
+func (e *Engine) sendAlertToCloud(a *storage.Alert) {
+	if !e.cloud.IsConnected() {
+		log.Printf("Cannot send alert to cloud: not connected")
+		return
+	}
+
+	var err error
+	switch {
+	case a.SourceID != 0:
+		err = e.sendMeterAlert(a)
+		e.countSync(err)
+	case a.State != storage.AlertCleared && (a.AlertType == alertMoistureDry || a.AlertType == alertMoistureWet):
+		err = e.cloud.SendSoilAlert(a.DeviceUID, &cloud.SoilAlertData{
+			ProbeID:         a.ProbeID,
+			MoisturePercent: float32(a.Value),
+			Alert:           a.AlertType,
+			Timestamp:       a.Timestamp,
+		})
+		e.countSync(err)
+	default:
+		// The shared protocol has nothing that carries these. They stay
+		// local, in agsys-db alerts and the local API event stream.
+	}
+	if err != nil {
+		log.Printf("Failed to send alert to cloud: %v", err)
+		return
+	}
+	e.db.MarkAlertSynced(a.ID)
+}
+
+// sendMeterAlert sends a meter alert to the cloud as the meter alarm behind
+// it, or as a cleared alarm once the alert clears
+func (e *Engine) sendMeterAlert(a *storage.Alert) error {
+	alarm, err := e.db.GetMeterAlarm(a.SourceID)
+	if err != nil {
+		return fmt.Errorf("failed to get meter alarm %d: %w", a.SourceID, err)
+	}
+
+	data := &cloud.MeterAlarmData{
+		AlarmType:    alarm.AlarmType,
+		FlowRateLPM:  alarm.FlowRateLPM,
+		DurationSec:  alarm.DurationSec,
+		TotalVolumeL: alarm.TotalVolumeL,
+		RSSI:         alarm.RSSI,
+		Timestamp:    alarm.Timestamp,
+	}
+	if a.State == storage.AlertCleared && a.ClearedAt != nil {
+		data.AlarmType, data.Timestamp = protocol.MeterAlarmCleared, *a.ClearedAt
+	}
+	if err := e.cloud.SendMeterAlarm(alarm.DeviceUID, data); err != nil {
+		return err
+	}
+	e.db.MarkMeterAlarmSynced(alarm.ID)
+	return nil
+}
+
+// alertLoop periodically checks for devices that have gone quiet, for a
+// lost cloud connection, and for degraded gateways
+func (e *Engine) alertLoop(ctx context.Context) {
+	defer e.wg.Done()
+
+	const interval = 1 * time.Minute
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		e.beat("alerts", interval)
+
+		select {
+		case <-e.stopChan:
+			return
+		case <-ctx.Done():
+			return
+		case <-e.cloudChanged:
+			e.checkCloudLink(time.Now(), e.cloud.IsConnected())
+		case now := <-ticker.C:
+			e.checkOfflineDevices(now)
+			e.checkCloudLink(now, e.cloud.IsConnected())
+			e.checkGatewayHealth(now)
+		}
+	}
+}
+
+// checkOfflineDevices raises an alert for each device not heard from within
+// OfflineAfter and clears it once the device reports again
+func (e *Engine) checkOfflineDevices(now time.Time) {
+	offlineAfter := e.settings().Alerts.OfflineAfter
+
+	open, err := e.db.GetOpenAlerts()
+	if err != nil {
+		log.Printf("Failed to get open alerts: %v", err)
+		return
+	}
+	offline := make(map[string]bool)
+	for _, a := range open {
+		if a.AlertType == alertDeviceOffline {
+			offline[a.DeviceUID] = true
+		}
+	}
+
+	devices, err := e.db.GetAllDevices()
+	if err != nil {
+		log.Printf("Failed to get devices: %v", err)
+		return
+	}
+	for _, d := range devices {
+		quiet := now.Sub(d.LastSeen)
+		switch {
+		case offlineAfter > 0 && !d.LastSeen.IsZero() && quiet > offlineAfter:
+			if !offline[d.UID] {
+				e.raiseAlert(&storage.Alert{
+					DeviceUID: d.UID,
+					ZoneID:    d.ZoneID,
+					AlertType: alertDeviceOffline,
+					Severity:  storage.AlertWarning,
+					Message:   fmt.Sprintf("device %s not heard from since %s", d.UID, d.LastSeen.Format(time.DateTime)),
+					Timestamp: now,
+				})
+			}
+		case offline[d.UID]:
+			e.clearAlerts(d.UID, 0, alertDeviceOffline)
+		}
+	}
+}
+
+// checkCloudLink raises an alert once the cloud has been unreachable for
+// CloudOffline and clears it on reconnect. The alert can only reach the
+// farmer through the notification sinks.
+func (e *Engine) checkCloudLink(now time.Time, connected bool) {
+	cfg := e.settings()
+	if connected {
+		if !e.cloudLostAt.IsZero() {
+			e.cloudLostAt = time.Time{}
+			e.clearAlerts(cfg.ControllerID, 0, alertCloudOffline)
+		}
+		return
+	}
+
+	if e.cloudLostAt.IsZero() {
+		e.cloudLostAt = now
+	}
+	if cfg.Alerts.CloudOffline > 0 && now.Sub(e.cloudLostAt) >= cfg.Alerts.CloudOffline {
+		e.raiseAlert(&storage.Alert{
+			DeviceUID: cfg.ControllerID,
+			AlertType: alertCloudOffline,
+			Severity:  storage.AlertCritical,
+			Message:   fmt.Sprintf("controller offline from the AgSys cloud since %s", e.cloudLostAt.Format(time.DateTime)),
+			Timestamp: now,
+		})
+	}
+}
+
+// checkFrost raises a frost alert when a soil sensor reads at or below the
+// frost temperature and clears it once the sensor is a degree warmer
+func (e *Engine) checkFrost(deviceUID string, temperature int16) {
+	cfg := e.settings().Alerts
+	if !cfg.Frost {
+		return
+	}
+
+	tempC := float64(temperature) / 10
+	switch {
+	case tempC <= cfg.FrostC:
+		e.raiseAlert(&storage.Alert{
+			DeviceUID: deviceUID,
+			AlertType: alertFrost,
+			Severity:  storage.AlertCritical,
+			Message:   fmt.Sprintf("frost risk: %s reads %.1f°C, at or below %.1f°C", deviceUID, tempC, cfg.FrostC),
+			Value:     tempC,
+			Threshold: cfg.FrostC,
+			Timestamp: time.Now(),
+		})
+	case tempC > cfg.FrostC+1:
+		e.clearAlerts(deviceUID, 0, alertFrost)
+	}
+}
+
+// checkBattery raises or clears a device's low battery alert from the low
+// battery flag in its report
+func (e *Engine) checkBattery(deviceUID string, low bool, batteryMV uint16) {
+	if !low {
+		e.clearAlerts(deviceUID, 0, alertLowBattery)
+		return
+	}
+	e.raiseAlert(&storage.Alert{
+		DeviceUID: deviceUID,
+		AlertType: alertLowBattery,
+		Severity:  storage.AlertWarning,
+		Message:   fmt.Sprintf("low battery on %s: %dmV", deviceUID, batteryMV),
+		Value:     float64(batteryMV),
+		Timestamp: time.Now(),
+	})
+}
+
+// raiseCommandFailed raises an alert for a valve command that failed or was
+// never acknowledged. A later successful command to the actuator clears it.
+func (e *Engine) raiseCommandFailed(controllerUID string, addr uint8, reason string) {
+	e.raiseAlert(&storage.Alert{
+		DeviceUID: controllerUID,
+		ProbeID:   addr,
+		AlertType: alertCommandFailed,
+		Severity:  storage.AlertWarning,
+		Message:   fmt.Sprintf("valve command to %s addr %d failed: %s", controllerUID, addr, reason),
+		Timestamp: time.Now(),
+	})
+}
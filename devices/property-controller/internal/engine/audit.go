@@ -0,0 +1,60 @@
+package engine
+
+import (
+	"encoding/json"
+	"log"
+
+	"github.com/agsys/property-controller/internal/storage"
+)
+
+// Command sources recorded in the audit log
+const (
+	sourceCloud    = "cloud"     // Cloud user or API, actor is the user ID when known
+	sourceSchedule = "schedule"  // Cloud schedule run, actor is the schedule ID
+	sourceLocalAPI = "local_api" // On-site tools over the local API socket
+	sourceModbus   = "modbus"    // SCADA coil write
+	sourceRule     = "rule"      // Controller safety rule, actor is the rule name
+)
+
+// auditCommand appends an entry to the command audit log. A failure to audit
+// is logged but never holds up the command.
+func (e *Engine) auditCommand(a *storage.CommandAudit) {
+	// Commands to devices, not emergency stops
+	if a.DeviceUID != "" {
+		e.countOutcome(a.Outcome)
+	}
+	if _, err := e.db.InsertCommandAudit(a); err != nil {
+		log.Printf("Failed to audit %s command to %s: %v", a.Kind, a.DeviceUID, err)
+	}
+}
+
+// auditOutcome records the outcome of a command sent over LoRa
+func (e *Engine) auditOutcome(deviceUID string, commandID uint16, outcome, detail string) {
+	e.countOutcome(outcome)
+	found, err := e.db.AppendCommandOutcome(deviceUID, commandID, outcome, detail)
+	if err != nil {
+		log.Printf("Failed to audit outcome of command %d to %s: %v", commandID, deviceUID, err)
+		return
+	}
+	if !found {
+		log.Printf("No audited send of command %d to %s for outcome %s", commandID, deviceUID, outcome)
+	}
+}
+
+// auditRejectedValve records a valve command that was refused before it
+// could be sent
+func (e *Engine) auditRejectedValve(deviceUID string, actuatorAddr uint8, command uint8, origin storage.CommandAudit, reason error) {
+	entry := origin
+	entry.Kind, entry.DeviceUID, entry.ActuatorAddr = "valve", deviceUID, actuatorAddr
+	entry.Command, entry.Outcome, entry.Detail = valveCommandString(command), storage.AuditRejected, reason.Error()
+	e.auditCommand(&entry)
+}
+
+// auditParams encodes command parameters for the audit log
+func auditParams(params interface{}) string {
+	data, err := json.Marshal(params)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
@@ -0,0 +1,225 @@
+package engine
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/agsys/property-controller/internal/storage"
+)
+
+// Sources of a backfill
+const (
+	backfillSourceCloud = "cloud"
+	backfillSourceCLI   = "cli"
+)
+
+// backfillTables maps the table names used in cloud requests to the tables
+// synced through a cursor
+var backfillTables = map[string]string{
+	"soil":   storage.SyncSoilReadings,
+	"meter":  storage.SyncMeterReadings,
+	"events": storage.SyncValveEvents,
+}
+
+// BackfillRange queues the rows of a sync cursor table taken in [from, to)
+// to be sent to the cloud again, e.g. after the cloud lost data. Only rows
+// already synced are resent; the sync loop sends them a batch at a time, in
+// cycles the live data leaves room in. It returns the backfill's ID.
+func (e *Engine) BackfillRange(table string, from, to time.Time) (int64, error) {
+	b, err := e.backfillRange(table, from, to, storage.Backfill{Source: backfillSourceCLI})
+	if err != nil {
+		return 0, err
+	}
+	return b.ID, nil
+}
+
+func (e *Engine) backfillRange(table string, from, to time.Time, origin storage.Backfill) (*storage.Backfill, error) {
+	if !slices.Contains(storage.SyncCursorTables, table) {
+		return nil, fmt.Errorf("table %q can't be backfilled", table)
+	}
+	if !from.Before(to) {
+		return nil, fmt.Errorf("backfill window %s to %s is empty", from.Format(time.RFC3339), to.Format(time.RFC3339))
+	}
+
+	b := origin
+	b.TableName, b.From, b.To = table, from, to
+	if err := e.db.InsertBackfill(&b); err != nil {
+		return nil, fmt.Errorf("failed to queue backfill: %w", err)
+	}
+	log.Printf("Backfill %d queued: %s from %s to %s", b.ID, table, from.Format(time.RFC3339), to.Format(time.RFC3339))
+	nudge(e.syncNow)
+	return &b, nil
+}
+
+// syncBackfill sends the next batch of the oldest backfill, reporting
+// whether more is likely waiting. Rows from the first that couldn't be sent
+// are tried again next cycle.
+func (e *Engine) syncBackfill(limit int) bool {
+	backfills, err := e.db.GetActiveBackfills()
+	if err != nil {
+		log.Printf("Failed to get backfills: %v", err)
+		return false
+	}
+	if len(backfills) == 0 {
+		return false
+	}
+	b := backfills[0]
+
+	fetched, sent, through, err := e.sendBackfillBatch(b, limit)
+	if err != nil {
+		log.Printf("Backfill %d: %v", b.ID, err)
+		return false
+	}
+	if sent > 0 {
+		if err := e.db.AdvanceBackfill(b.ID, through, sent); err != nil {
+			log.Printf("Failed to record progress of backfill %d: %v", b.ID, err)
+			return false
+		}
+	}
+	if sent < fetched {
+		return false // Cloud refused part of the batch; try again next cycle
+	}
+	if fetched >= limit {
+		return true
+	}
+
+	b.RowsSent += sent
+	e.completeBackfill(b)
+	return len(backfills) > 1
+}
+
+// sendBackfillBatch sends the next rows of a backfill, returning how many
+// were fetched, how many got through before the first failure, and the ID
+// of the last of those
+func (e *Engine) sendBackfillBatch(b *storage.Backfill, limit int) (int, int, int64, error) {
+	switch b.TableName {
+	case storage.SyncSoilReadings:
+		readings, err := e.db.GetBackfillSoilReadings(b, limit)
+		if err != nil {
+			return 0, 0, 0, fmt.Errorf("failed to get soil readings: %w", err)
+		}
+		ok := e.sendSoilReadings(readings)
+		sent, through := sentPrefix(readings,
+			func(r *storage.SoilMoistureReading) int64 { return r.ID },
+			func(r *storage.SoilMoistureReading) bool { return ok[r.DeviceUID] })
+		return len(readings), sent, through, nil
+	case storage.SyncMeterReadings:
+		readings, err := e.db.GetBackfillMeterReadings(b, limit)
+		if err != nil {
+			return 0, 0, 0, fmt.Errorf("failed to get meter readings: %w", err)
+		}
+		ok := e.sendMeterReadings(readings)
+		sent, through := sentPrefix(readings,
+			func(r *storage.WaterMeterReading) int64 { return r.ID },
+			func(r *storage.WaterMeterReading) bool { return ok[r.DeviceUID] })
+		return len(readings), sent, through, nil
+	case storage.SyncValveEvents:
+		events, err := e.db.GetBackfillValveEvents(b, limit)
+		if err != nil {
+			return 0, 0, 0, fmt.Errorf("failed to get valve events: %w", err)
+		}
+		ok := e.sendValveEvents(events)
+		sent, through := sentPrefix(events,
+			func(ev *storage.ValveEvent) int64 { return ev.ID },
+			func(ev *storage.ValveEvent) bool { return ok[ev.ControllerUID] })
+		return len(events), sent, through, nil
+	default:
+		// Queued by hand with a bad table; nothing to send
+		return 0, 0, 0, nil
+	}
+}
+
+// completeBackfill marks a backfill done and, once every backfill of its
+// cloud request is done, acknowledges the request
+func (e *Engine) completeBackfill(b *storage.Backfill) {
+	if err := e.db.CompleteBackfill(b.ID, time.Now()); err != nil {
+		log.Printf("Failed to complete backfill %d: %v", b.ID, err)
+		return
+	}
+	log.Printf("Backfill %d complete: %d %s rows sent again", b.ID, b.RowsSent, b.TableName)
+
+	if b.CloudCommandID == "" {
+		return
+	}
+	rows, active, err := e.db.GetBackfillRowsSent(b.CloudCommandID)
+	if err != nil {
+		log.Printf("Failed to check backfills of cloud command %s: %v", b.CloudCommandID, err)
+		return
+	}
+	if active == 0 {
+		log.Printf("Backfill request %s complete: %d rows sent again", b.CloudCommandID, rows)
+		if err := e.cloud.SendCommandAck(b.CloudCommandID, true, ""); err != nil {
+			log.Printf("Failed to send backfill ack to cloud: %v", err)
+		}
+	}
+}
+
+// handleBackfillRequest processes a cloud request to send data again.
+// Config carries from and to (RFC 3339), optionally table (soil, meter, or
+// events, comma-separated; all if empty), command_id, and actor. The request
+// is acknowledged once every table's backfill is done, or at once if it is
+// refused. A command ID seen before is not queued again.
+func (e *Engine) handleBackfillRequest(cfg map[string]string) {
+	cloudCommandID := cfg["command_id"]
+	reject := func(err error) {
+		log.Printf("Cannot backfill: %v", err)
+		if cloudCommandID != "" {
+			e.cloud.SendCommandAck(cloudCommandID, false, err.Error())
+		}
+	}
+
+	from, err := time.Parse(time.RFC3339, cfg["from"])
+	if err != nil {
+		reject(fmt.Errorf("invalid from %q", cfg["from"]))
+		return
+	}
+	to, err := time.Parse(time.RFC3339, cfg["to"])
+	if err != nil {
+		reject(fmt.Errorf("invalid to %q", cfg["to"]))
+		return
+	}
+	tables := storage.SyncCursorTables
+	if names := cfg["table"]; names != "" {
+		tables = nil
+		for _, name := range strings.Split(names, ",") {
+			table, ok := backfillTables[strings.TrimSpace(name)]
+			if !ok {
+				reject(fmt.Errorf("invalid table %q (use soil, meter, or events)", name))
+				return
+			}
+			tables = append(tables, table)
+		}
+	}
+	if !from.Before(to) {
+		reject(fmt.Errorf("backfill window %s to %s is empty", cfg["from"], cfg["to"]))
+		return
+	}
+
+	if cloudCommandID != "" {
+		seen, err := e.db.HasBackfill(cloudCommandID)
+		if err != nil {
+			log.Printf("Failed to check for duplicate backfill %s: %v", cloudCommandID, err)
+		}
+		if seen {
+			log.Printf("Ignoring duplicate backfill request %s", cloudCommandID)
+			return
+		}
+	}
+
+	origin := storage.Backfill{Source: backfillSourceCloud, Actor: cfg["actor"], CloudCommandID: cloudCommandID}
+	queued := 0
+	for _, table := range tables {
+		if _, err = e.backfillRange(table, from, to, origin); err != nil {
+			// Tables already queued still run and acknowledge the request
+			log.Printf("Backfill of %s failed: %v", table, err)
+			continue
+		}
+		queued++
+	}
+	if queued == 0 {
+		reject(err)
+	}
+}
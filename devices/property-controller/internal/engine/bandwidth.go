@@ -0,0 +1,286 @@
+package engine
+
+import (
+	"log"
+	"slices"
+	"time"
+
+	"github.com/agsys/property-controller/internal/storage"
+	controllerv1 "github.com/ccroswhite/agsys-api/gen/go/proto/controller/v1"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// aggregateFetchLimit bounds the raw readings of each kind aggregated per
+// sync cycle
+const aggregateFetchLimit = 1000
+
+// LowBandwidthConfig trims cloud traffic for sites on metered LTE links
+type LowBandwidthConfig struct {
+	Enabled           bool
+	BatchSize         int           // Records sent per sync cycle, of each kind
+	SyncInterval      time.Duration // Sync this often instead of Config.SyncInterval (0 keeps it)
+	AggregateWindow   time.Duration // Average readings over windows this long before upload (0 sends each reading)
+	FirmwareStartHour int           // Firmware downloads only from this local hour...
+	FirmwareEndHour   int           // ...until this one; equal hours allow any time
+}
+
+// DefaultLowBandwidthConfig returns default low-bandwidth settings, off
+func DefaultLowBandwidthConfig() LowBandwidthConfig {
+	return LowBandwidthConfig{
+		BatchSize:         10,
+		SyncInterval:      5 * time.Minute,
+		AggregateWindow:   time.Hour,
+		FirmwareStartHour: 1,
+		FirmwareEndHour:   5,
+	}
+}
+
+// firmwareDownloadAllowed reports whether OTA firmware may be downloaded now.
+// In low-bandwidth mode downloads wait for the configured hours, which may
+// wrap past midnight.
+func (e *Engine) firmwareDownloadAllowed() bool {
+	cfg := e.settings().LowBandwidth
+	if !cfg.Enabled || cfg.FirmwareStartHour == cfg.FirmwareEndHour {
+		return true
+	}
+	hour := time.Now().Hour()
+	if cfg.FirmwareStartHour < cfg.FirmwareEndHour {
+		return hour >= cfg.FirmwareStartHour && hour < cfg.FirmwareEndHour
+	}
+	return hour >= cfg.FirmwareStartHour || hour < cfg.FirmwareEndHour
+}
+
+// usageMonth is the key monthly cloud usage is recorded under
+func usageMonth(t time.Time) string {
+	return t.Format("2006-01")
+}
+
+// recordCloudUsage adds the traffic counted since the last call to this
+// month's cloud usage
+func (e *Engine) recordCloudUsage() {
+	up, down := e.cloudUsage.Take()
+	if up == 0 && down == 0 {
+		return
+	}
+	if err := e.db.AddCloudUsage(usageMonth(time.Now()), up, down); err != nil {
+		log.Printf("Failed to record cloud usage: %v", err)
+	}
+}
+
+// aggregatedReading is one device's readings over an aggregation window,
+// and the raw readings it stands for
+type aggregatedReading struct {
+	deviceUID string
+	start     time.Time
+	ids       []int64
+}
+
+// trimWindows keeps the oldest limit windows. When the raw fetch was cut
+// short, the newest window may be missing readings, so it waits for the
+// next cycle unless it is the only one.
+func trimWindows[T any](windows []T, start func(T) time.Time, limit int, truncated bool) []T {
+	if truncated && len(windows) > 1 {
+		last := start(windows[len(windows)-1])
+		for len(windows) > 1 && start(windows[len(windows)-1]).Equal(last) {
+			windows = windows[:len(windows)-1]
+		}
+	}
+	if len(windows) > limit {
+		windows = windows[:limit]
+	}
+	return windows
+}
+
+type soilWindow struct {
+	aggregatedReading
+	last     *storage.SoilMoistureReading
+	moisture map[uint8]*probeMean
+	tempSum  float64
+	tempN    int
+}
+
+type probeMean struct {
+	sum float64
+	n   int
+}
+
+// aggregateSoilReadings averages soil readings per device and probe over
+// windows, oldest first. Battery and RSSI are the window's last.
+func aggregateSoilReadings(readings []*storage.SoilMoistureReading, window time.Duration) []*soilWindow {
+	type key struct {
+		deviceUID string
+		start     time.Time
+	}
+	byKey := make(map[key]*soilWindow)
+	var windows []*soilWindow
+	for _, r := range readings {
+		k := key{r.DeviceUID, r.Timestamp.Truncate(window)}
+		w, ok := byKey[k]
+		if !ok {
+			w = &soilWindow{
+				aggregatedReading: aggregatedReading{deviceUID: k.deviceUID, start: k.start},
+				moisture:          make(map[uint8]*probeMean),
+			}
+			byKey[k] = w
+			windows = append(windows, w)
+		}
+		w.ids = append(w.ids, r.ID)
+		w.last = r
+		m, ok := w.moisture[r.ProbeID]
+		if !ok {
+			m = &probeMean{}
+			w.moisture[r.ProbeID] = m
+		}
+		m.sum += float64(r.MoisturePercent)
+		m.n++
+		w.tempSum += float64(r.Temperature)
+		w.tempN++
+	}
+	slices.SortStableFunc(windows, func(a, b *soilWindow) int { return a.start.Compare(b.start) })
+	return windows
+}
+
+// sensorReading converts a window to the reading uploaded for it
+func (w *soilWindow) sensorReading() *controllerv1.SensorReading {
+	probes := make([]uint8, 0, len(w.moisture))
+	for p := range w.moisture {
+		probes = append(probes, p)
+	}
+	slices.Sort(probes)
+
+	reading := &controllerv1.SensorReading{
+		Timestamp:    timestamppb.New(w.last.Timestamp),
+		BatteryMv:    int32(w.last.BatteryMV),
+		TemperatureC: float32(w.tempSum/float64(w.tempN)) / 10.0,
+		SignalRssi:   int32(w.last.RSSI),
+	}
+	for _, p := range probes {
+		reading.Probes = append(reading.Probes, &controllerv1.ProbeReading{
+			Index:           int32(p),
+			MoisturePercent: float32(w.moisture[p].sum / float64(w.moisture[p].n)),
+		})
+	}
+	return reading
+}
+
+type meterWindow struct {
+	aggregatedReading
+	last    *storage.WaterMeterReading
+	flowSum float64
+}
+
+// aggregateMeterReadings reduces meter readings to one per device and
+// window, oldest first: the window's last total with its average flow rate
+func aggregateMeterReadings(readings []*storage.WaterMeterReading, window time.Duration) []*meterWindow {
+	type key struct {
+		deviceUID string
+		start     time.Time
+	}
+	byKey := make(map[key]*meterWindow)
+	var windows []*meterWindow
+	for _, r := range readings {
+		k := key{r.DeviceUID, r.Timestamp.Truncate(window)}
+		w, ok := byKey[k]
+		if !ok {
+			w = &meterWindow{aggregatedReading: aggregatedReading{deviceUID: k.deviceUID, start: k.start}}
+			byKey[k] = w
+			windows = append(windows, w)
+		}
+		w.ids = append(w.ids, r.ID)
+		w.last = r
+		w.flowSum += float64(r.FlowRateLPM)
+	}
+	slices.SortStableFunc(windows, func(a, b *meterWindow) int { return a.start.Compare(b.start) })
+	return windows
+}
+
+// meterReading converts a window to the reading uploaded for it
+func (w *meterWindow) meterReading() *controllerv1.MeterReading {
+	return &controllerv1.MeterReading{
+		Timestamp:   timestamppb.New(w.last.Timestamp),
+		TotalLiters: w.last.CumulativeL,
+		FlowRateLpm: float32(w.flowSum / float64(len(w.ids))),
+		BatteryMv:   intPtr32(int32(w.last.BatteryMV)),
+		SignalRssi:  int32(w.last.RSSI),
+	}
+}
+
+// syncAggregatedReadings uploads soil and meter readings averaged over
+// complete windows, so a metered link carries one reading per device and
+// window however often the devices report
+func (e *Engine) syncAggregatedReadings(cfg LowBandwidthConfig, batch int, now time.Time) {
+	cutoff := now.Truncate(cfg.AggregateWindow)
+
+	readings, err := e.db.GetUnsyncedSoilMoistureReadingsBefore(cutoff, aggregateFetchLimit)
+	if err != nil {
+		log.Printf("Failed to get unsynced sensor readings: %v", err)
+	} else {
+		windows := trimWindows(aggregateSoilReadings(readings, cfg.AggregateWindow),
+			func(w *soilWindow) time.Time { return w.start }, batch, len(readings) >= aggregateFetchLimit)
+
+		byDevice := make(map[string][]*soilWindow)
+		for _, w := range windows {
+			byDevice[w.deviceUID] = append(byDevice[w.deviceUID], w)
+		}
+		sent := make(map[int64]bool)
+		for deviceUID, deviceWindows := range byDevice {
+			sensorReadings := make([]*controllerv1.SensorReading, len(deviceWindows))
+			for i, w := range deviceWindows {
+				sensorReadings[i] = w.sensorReading()
+			}
+			// Windows are oldest first; the first starts no later than its readings
+			span, links := e.startSyncSpan(storage.SyncSoilReadings, deviceUID, len(sensorReadings), deviceWindows[0].start)
+			err := e.cloud.SendSensorData(deviceUID, sensorReadings)
+			e.endSyncSpan(span, storage.SyncSoilReadings, deviceUID, links, err)
+			e.countSync(err)
+			if err != nil {
+				log.Printf("Failed to sync sensor readings for %s: %v", deviceUID, err)
+				continue
+			}
+			for _, w := range deviceWindows {
+				for _, id := range w.ids {
+					sent[id] = true
+				}
+			}
+		}
+		e.advanceSyncCursor(storage.SyncSoilReadings, syncedThrough(readings,
+			func(r *storage.SoilMoistureReading) int64 { return r.ID },
+			func(r *storage.SoilMoistureReading) bool { return sent[r.ID] }))
+	}
+
+	meterReadings, err := e.db.GetUnsyncedWaterMeterReadingsBefore(cutoff, aggregateFetchLimit)
+	if err != nil {
+		log.Printf("Failed to get unsynced meter readings: %v", err)
+		return
+	}
+	windows := trimWindows(aggregateMeterReadings(meterReadings, cfg.AggregateWindow),
+		func(w *meterWindow) time.Time { return w.start }, batch, len(meterReadings) == aggregateFetchLimit)
+
+	byDevice := make(map[string][]*meterWindow)
+	for _, w := range windows {
+		byDevice[w.deviceUID] = append(byDevice[w.deviceUID], w)
+	}
+	sent := make(map[int64]bool)
+	for deviceUID, deviceWindows := range byDevice {
+		readings := make([]*controllerv1.MeterReading, len(deviceWindows))
+		for i, w := range deviceWindows {
+			readings[i] = w.meterReading()
+		}
+		span, links := e.startSyncSpan(storage.SyncMeterReadings, deviceUID, len(readings), deviceWindows[0].start)
+		err := e.cloud.SendMeterData(deviceUID, readings)
+		e.endSyncSpan(span, storage.SyncMeterReadings, deviceUID, links, err)
+		e.countSync(err)
+		if err != nil {
+			log.Printf("Failed to sync meter readings for %s: %v", deviceUID, err)
+			continue
+		}
+		for _, w := range deviceWindows {
+			for _, id := range w.ids {
+				sent[id] = true
+			}
+		}
+	}
+	e.advanceSyncCursor(storage.SyncMeterReadings, syncedThrough(meterReadings,
+		func(r *storage.WaterMeterReading) int64 { return r.ID },
+		func(r *storage.WaterMeterReading) bool { return sent[r.ID] }))
+}
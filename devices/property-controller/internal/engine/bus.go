@@ -0,0 +1,92 @@
+package engine
+
+import (
+	"sync"
+
+	"github.com/agsys/property-controller/internal/storage"
+)
+
+// Topic delivers one type of engine event to its subscribers. Handlers run
+// on the publishing goroutine, in the order they subscribed, so they see
+// events in the order they happened and must not block: anything slow,
+// such as a network call, belongs on a goroutine of its own.
+type Topic[T any] struct {
+	mu       sync.RWMutex
+	handlers []func(T)
+}
+
+// Subscribe adds a handler for every later event on the topic
+func (t *Topic[T]) Subscribe(handler func(T)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.handlers = append(t.handlers, handler)
+}
+
+// publish hands an event to every subscriber
+func (t *Topic[T]) publish(ev T) {
+	t.mu.RLock()
+	handlers := t.handlers
+	t.mu.RUnlock()
+	for _, handler := range handlers {
+		handler(ev)
+	}
+}
+
+// Bus carries what happens in the engine to whatever acts on it: the local
+// API event streams, the alert rules, cloud delivery and notifications, and
+// the sync and alert loops. Message handlers only store and publish, so a
+// new consumer subscribes here instead of being called from each handler.
+type Bus struct {
+	Sensor Topic[SensorReceived]
+	Meter  Topic[MeterReceived]
+	Valve  Topic[ValveChanged]
+	Alarm  Topic[AlarmRaised]
+	Alert  Topic[AlertChanged]
+	Cloud  Topic[CloudState]
+}
+
+// SensorReceived is a stored soil reading: a multi-probe report, or a legacy
+// single-probe reading with no Report
+type SensorReceived struct {
+	ID          int64 // Row ID of the first reading
+	DeviceUID   string
+	Report      *storage.SoilReport
+	Readings    []*storage.SoilMoistureReading
+	Temperature int16 // Device temperature in tenths of a degree
+}
+
+// MeterReceived is a stored water meter reading
+type MeterReceived struct {
+	ID      int64
+	Reading *storage.WaterMeterReading
+}
+
+// ValveChanged is a stored valve event: a state report, or a valve the
+// controller closed or opened itself
+type ValveChanged struct {
+	ID    int64
+	Event *storage.ValveEvent
+}
+
+// AlarmRaised is a stored meter alarm, from the meter or from flow
+// analytics. A cleared alarm is published too, with its AlarmType.
+type AlarmRaised struct {
+	Alarm *storage.MeterAlarm
+}
+
+// AlertChanged is a controller alert that was raised or cleared
+type AlertChanged struct {
+	Alert   *storage.Alert
+	Cleared bool
+}
+
+// CloudState is the cloud stream coming up or going down
+type CloudState struct {
+	Connected bool
+}
+
+// Events returns the engine's event bus, for in-process integrations to
+// subscribe to before Start
+func (e *Engine) Events() *Bus {
+	return &e.bus
+}
@@ -0,0 +1,167 @@
+package engine
+
+import (
+	"log"
+	"math"
+	"time"
+
+	"github.com/agsys/property-controller/internal/lora"
+	"github.com/agsys/property-controller/internal/protocol"
+	"github.com/agsys/property-controller/internal/storage"
+)
+
+// ClockConfig controls tracking of device clock skew from time sync acks
+type ClockConfig struct {
+	SkewThreshold     time.Duration // Skew at which a device is flagged and resynced early
+	MinResyncInterval time.Duration // Shortest interval between extra syncs to one device
+}
+
+// DefaultClockConfig returns default clock tracking settings
+func DefaultClockConfig() ClockConfig {
+	return ClockConfig{
+		SkewThreshold:     5 * time.Second,
+		MinResyncInterval: 15 * time.Minute,
+	}
+}
+
+// deviceClock is what the engine knows about a device's RTC
+type deviceClock struct {
+	checkedAt time.Time // Last confirmed sync, when the clock was corrected
+	driftPPM  *float64
+	nextSync  time.Time // Extra unicast sync due (zero if the broadcast is enough)
+}
+
+// loadDeviceClocks restores confirmed sync times so drift can be measured
+// across restarts
+func (e *Engine) loadDeviceClocks() {
+	clocks, err := e.db.GetDeviceClocks()
+	if err != nil {
+		log.Printf("Failed to load device clocks: %v", err)
+		return
+	}
+
+	e.clockMu.Lock()
+	defer e.clockMu.Unlock()
+	for _, c := range clocks {
+		e.clocks[c.DeviceUID] = &deviceClock{checkedAt: c.CheckedAt, driftPPM: c.DriftPPM}
+	}
+}
+
+// handleTimeSyncAck records the clock skew a device reported when it applied
+// a time sync and schedules extra syncs for devices that drift too fast
+func (e *Engine) handleTimeSyncAck(deviceUID string, msg *protocol.LoRaMessage) {
+	ack, err := protocol.DecodeTimeSyncAck(msg.Payload)
+	if err != nil {
+		log.Printf("Failed to decode time sync ack from %s: %v", deviceUID, err)
+		e.count(counterDecodeFailures)
+		return
+	}
+
+	now := time.Now()
+	skew := ack.Skew()
+	cfg := e.settings()
+
+	e.clockMu.Lock()
+	c, ok := e.clocks[deviceUID]
+	if !ok {
+		c = &deviceClock{}
+		e.clocks[deviceUID] = c
+	}
+	// The previous confirmed sync set the clock right, so all skew since
+	// then is drift
+	if elapsed := now.Sub(c.checkedAt); !c.checkedAt.IsZero() && elapsed >= time.Minute {
+		ppm := skew.Seconds() / elapsed.Seconds() * 1e6
+		c.driftPPM = &ppm
+	}
+	c.checkedAt = now
+	c.nextSync = resyncAt(now, skew, c.driftPPM, cfg.Clock, cfg.TimeSyncInterval)
+	drift := c.driftPPM
+	next := c.nextSync
+	e.clockMu.Unlock()
+
+	if err := e.db.UpdateDeviceClock(&storage.DeviceClock{
+		DeviceUID: deviceUID,
+		Skew:      skew,
+		DriftPPM:  drift,
+		CheckedAt: now,
+	}); err != nil {
+		log.Printf("Failed to record clock skew for %s: %v", deviceUID, err)
+	}
+
+	if skew.Abs() > cfg.Clock.SkewThreshold {
+		log.Printf("ALERT: device %s clock was off by %s", deviceUID, skew)
+	}
+	if !next.IsZero() {
+		log.Printf("Device %s RTC drifting, next time sync at %s", deviceUID, next.Format(time.TimeOnly))
+	}
+}
+
+// resyncAt returns when a device should get an extra sync so its clock stays
+// within the skew threshold, or zero if the regular broadcast is enough.
+// With no drift measurement yet, a device found out of tolerance is synced
+// again after the minimum interval to measure it.
+func resyncAt(now time.Time, skew time.Duration, driftPPM *float64, cfg ClockConfig, broadcastInterval time.Duration) time.Time {
+	var interval time.Duration
+	switch {
+	case driftPPM != nil && *driftPPM != 0:
+		seconds := cfg.SkewThreshold.Seconds() / (math.Abs(*driftPPM) / 1e6)
+		interval = time.Duration(math.Min(seconds, broadcastInterval.Seconds()) * float64(time.Second))
+	case skew.Abs() > cfg.SkewThreshold:
+		interval = cfg.MinResyncInterval
+	default:
+		return time.Time{}
+	}
+
+	if interval < cfg.MinResyncInterval {
+		interval = cfg.MinResyncInterval
+	}
+	if interval >= broadcastInterval {
+		return time.Time{}
+	}
+	return now.Add(interval)
+}
+
+// sendDueClockSyncs sends unicast time syncs to drifting devices. Each sync
+// is sent once; the device's ack schedules the next one.
+func (e *Engine) sendDueClockSyncs(now time.Time) {
+	var due []string
+	e.clockMu.Lock()
+	for deviceUID, c := range e.clocks {
+		if !c.nextSync.IsZero() && !c.nextSync.After(now) {
+			c.nextSync = time.Time{}
+			due = append(due, deviceUID)
+		}
+	}
+	e.clockMu.Unlock()
+
+	for _, deviceUID := range due {
+		e.sendClockSync(deviceUID)
+	}
+}
+
+// takeClockSync reports whether an extra sync to a device is due, clearing
+// it so the caller sends it, e.g. right after the ACK of an uplink
+func (e *Engine) takeClockSync(deviceUID string, now time.Time) bool {
+	e.clockMu.Lock()
+	defer e.clockMu.Unlock()
+	c, ok := e.clocks[deviceUID]
+	if !ok || c.nextSync.IsZero() || c.nextSync.After(now) {
+		return false
+	}
+	c.nextSync = time.Time{}
+	return true
+}
+
+// sendClockSync sends a device a unicast time sync
+func (e *Engine) sendClockSync(deviceUID string) {
+	uid, err := lora.ParseDeviceUID(deviceUID)
+	if err != nil {
+		return
+	}
+	msg := lora.CreateTimeSyncMessage(0)
+	msg.Header.DeviceUID = uid
+	msg.Header.Sequence = e.lora.GetNextSeqNum()
+	if err := e.lora.Send(msg); err != nil {
+		log.Printf("Failed to send time sync to %s: %v", deviceUID, err)
+	}
+}
@@ -0,0 +1,29 @@
+package engine
+
+import "log"
+
+// handleCloudState follows the cloud stream coming up or going down. The
+// alert loop notes the change at once rather than on its next tick, and a
+// restored link flushes the unsynced backlog without waiting for the sync
+// interval. LoRa handling doesn't depend on the link.
+func (e *Engine) handleCloudState(ev CloudState) {
+	if ev.Connected {
+		// Firmware downloads follow the stream onto a fallback server and back
+		cfg := e.settings()
+		e.firmware.UpdateConnection(e.cloud.Endpoint(), cfg.APIKey, cfg.UseTLS)
+		log.Println("Cloud link up, syncing backlog")
+		nudge(e.syncNow)
+	} else {
+		log.Println("Cloud link down, running offline")
+	}
+	nudge(e.cloudChanged)
+}
+
+// nudge wakes a loop waiting on a channel without blocking if a wake is
+// already pending
+func nudge(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,75 @@
+package engine
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SyncConfig tunes how the unsynced backlog is sent to the cloud
+type SyncConfig struct {
+	BatchSize     int           // Records sent per sync cycle, of each kind
+	Concurrency   int           // Kinds of record (soil, meter, alerts, valve events) synced at once
+	DrainInterval time.Duration // Next cycle this soon after one that filled a batch (0 waits for the interval)
+}
+
+// DefaultSyncConfig returns default sync settings: 50 records of each kind
+// per cycle, one kind at a time, and a backlog drained every 2 seconds
+func DefaultSyncConfig() SyncConfig {
+	return SyncConfig{
+		BatchSize:     50,
+		Concurrency:   1,
+		DrainInterval: 2 * time.Second,
+	}
+}
+
+// syncBatchSize returns how many records of each kind a sync cycle sends.
+// Low-bandwidth mode has a batch size of its own.
+func (c Config) syncBatchSize() int {
+	if c.LowBandwidth.Enabled && c.LowBandwidth.BatchSize > 0 {
+		return c.LowBandwidth.BatchSize
+	}
+	if c.Sync.BatchSize > 0 {
+		return c.Sync.BatchSize
+	}
+	return DefaultSyncConfig().BatchSize
+}
+
+// syncInterval returns how often the sync loop runs, slower on a metered
+// link if low-bandwidth mode sets an interval
+func (c Config) syncInterval() time.Duration {
+	if c.LowBandwidth.Enabled && c.LowBandwidth.SyncInterval > 0 {
+		return c.LowBandwidth.SyncInterval
+	}
+	return c.SyncInterval
+}
+
+// drainInterval returns how soon a cycle that filled a batch is followed
+// up, or 0 to wait for the interval. A metered link drains at its own pace.
+func (c Config) drainInterval() time.Duration {
+	if c.LowBandwidth.Enabled {
+		return 0
+	}
+	return c.Sync.DrainInterval
+}
+
+// runSyncTasks runs a sync cycle's tasks, up to concurrency of them at
+// once, and reports whether any of them left a backlog
+func runSyncTasks(concurrency int, tasks []func() bool) bool {
+	var wg sync.WaitGroup
+	var backlog atomic.Bool
+	slots := make(chan struct{}, max(concurrency, 1))
+	for _, task := range tasks {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			if task() {
+				backlog.Store(true)
+			}
+		}()
+	}
+	wg.Wait()
+	return backlog.Load()
+}
@@ -0,0 +1,248 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/agsys/property-controller/internal/protocol"
+	"github.com/agsys/property-controller/internal/storage"
+)
+
+// ValveGroup selects the valves a group command goes to: every valve in a
+// zone, or the actuators of one valve controller whose bits are set in a
+// mask (bit n for address n)
+type ValveGroup struct {
+	ZoneID        string
+	ControllerUID string
+	ActuatorMask  uint64
+}
+
+// String describes the group for logs and the command audit log
+func (g ValveGroup) String() string {
+	if g.ZoneID != "" {
+		return "zone " + g.ZoneID
+	}
+	return fmt.Sprintf("%s mask %#x", g.ControllerUID, g.ActuatorMask)
+}
+
+// groupValves resolves a group to its valves' controllers and addresses
+func (e *Engine) groupValves(g ValveGroup) ([]*storage.ValveActuator, error) {
+	if g.ZoneID == "" {
+		if g.ControllerUID == "" || g.ActuatorMask == 0 {
+			return nil, errors.New("a zone, or a controller and actuator mask, is required")
+		}
+		var valves []*storage.ValveActuator
+		for addr := 0; addr < 64; addr++ {
+			if g.ActuatorMask&(1<<addr) != 0 {
+				valves = append(valves, &storage.ValveActuator{ControllerUID: g.ControllerUID, Address: uint8(addr)})
+			}
+		}
+		return valves, nil
+	}
+
+	actuators, err := e.db.GetValveActuators()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get valves: %w", err)
+	}
+	var valves []*storage.ValveActuator
+	for _, a := range actuators {
+		if a.ZoneID == g.ZoneID {
+			valves = append(valves, a)
+		}
+	}
+	if len(valves) == 0 {
+		return nil, fmt.Errorf("no valves in zone %s", g.ZoneID)
+	}
+	return valves, nil
+}
+
+// SendGroupCommand sends one command to every valve in a group and tracks
+// the members together. It returns the group ID.
+func (e *Engine) SendGroupCommand(group ValveGroup, command uint8, source, actor string) (int64, error) {
+	return e.sendGroupCommand(group, command, 0, storage.CommandAudit{Source: source, Actor: actor})
+}
+
+// sendGroupCommand fans a command out to the valves of a group, one tracked
+// command per valve. Members are retried and audited like any other valve
+// command, but report their outcomes to the group, which acknowledges the
+// cloud command once every member has resolved. An open with a duration
+// closes each valve when it runs out.
+func (e *Engine) sendGroupCommand(group ValveGroup, command uint8, duration time.Duration, origin storage.CommandAudit) (int64, error) {
+	valves, err := e.groupValves(group)
+	if err != nil {
+		e.auditRejectedGroup(group, command, origin, err)
+		return 0, err
+	}
+
+	g := &storage.CommandGroup{
+		CloudCommandID: origin.CloudCommandID,
+		Command:        command,
+		Target:         group.String(),
+		Members:        len(valves),
+	}
+	if err := e.db.InsertCommandGroup(g); err != nil {
+		err = fmt.Errorf("failed to store command group: %w", err)
+		e.auditRejectedGroup(group, command, origin, err)
+		return 0, err
+	}
+	log.Printf("Sending %s to %d valves of %s (group %d)", valveCommandString(command), len(valves), group, g.ID)
+
+	params := map[string]interface{}{"group": g.ID, "target": g.Target}
+	if duration > 0 {
+		params["duration_seconds"] = int(duration.Seconds())
+	}
+	origin.Params = auditParams(params)
+
+	for _, v := range valves {
+		if err := e.sendValveCommand(v.ControllerUID, v.Address, command, origin, g.ID); err != nil {
+			log.Printf("Failed to send group %d command to %s addr %d: %v", g.ID, v.ControllerUID, v.Address, err)
+			if err := e.db.AddCommandGroupUnsent(g.ID, fmt.Sprintf("%s addr %d: %v", v.ControllerUID, v.Address, err)); err != nil {
+				log.Printf("Failed to record unsent member of group %d: %v", g.ID, err)
+			}
+			continue
+		}
+		if command == protocol.ValveCmdOpen && duration > 0 {
+			e.startValveTimer(v.ControllerUID, v.Address, duration, origin.CloudCommandID)
+		}
+	}
+
+	// Every member may already be resolved, e.g. if none could be sent
+	e.resolveCommandGroup(g.ID)
+	return g.ID, nil
+}
+
+// resolveCommandGroup completes a group once every member has been
+// acknowledged, has failed, or could not be sent, and reports the aggregate
+// outcome to the cloud in one acknowledgment
+func (e *Engine) resolveCommandGroup(id int64) {
+	g, err := e.db.GetCommandGroup(id)
+	if err != nil || g == nil {
+		log.Printf("Failed to get command group %d: %v", id, err)
+		return
+	}
+	if g.CompletedAt != nil {
+		return
+	}
+	members, err := e.db.GetCommandGroupMembers(id)
+	if err != nil {
+		log.Printf("Failed to get members of command group %d: %v", id, err)
+		return
+	}
+	if len(members)+g.Unsent < g.Members {
+		return // Still sending
+	}
+
+	failures := g.UnsentErrors
+	for _, m := range members {
+		if !m.Acknowledged && !m.Failed {
+			return // Still awaiting an acknowledgment
+		}
+		if m.Failed {
+			failures = append(failures, fmt.Sprintf("%s addr %d: %s", m.ControllerUID, m.ActuatorAddr, m.Error))
+		}
+	}
+
+	success, reason := len(failures) == 0, ""
+	if !success {
+		reason = fmt.Sprintf("%d of %d valves failed: %s", len(failures), g.Members, strings.Join(failures, "; "))
+	}
+	done, err := e.db.CompleteCommandGroup(id, success, reason, time.Now())
+	if err != nil {
+		log.Printf("Failed to complete command group %d: %v", id, err)
+		return
+	}
+	if !done {
+		return // Completed by another member's outcome
+	}
+
+	if success {
+		log.Printf("Command group %d (%s) complete: all %d valves acknowledged", id, g.Target, g.Members)
+	} else {
+		log.Printf("Command group %d (%s) complete: %s", id, g.Target, reason)
+	}
+	if g.CloudCommandID != "" {
+		if err := e.cloud.SendCommandAck(g.CloudCommandID, success, reason); err != nil {
+			log.Printf("Failed to send group command ack to cloud: %v", err)
+		}
+	}
+}
+
+// handleGroupCommand processes a cloud command for a set of valves. Config
+// carries command (open, close, or stop), command_id, zone_id or
+// controller_uid and actuator_mask, and optionally duration_seconds and
+// actor. A command ID seen before is not sent again; its outcome is repeated
+// if known.
+func (e *Engine) handleGroupCommand(cfg map[string]string) {
+	var command uint8
+	switch cfg["command"] {
+	case "open":
+		command = protocol.ValveCmdOpen
+	case "close":
+		command = protocol.ValveCmdClose
+	case "stop":
+		command = protocol.ValveCmdStop
+	default:
+		log.Printf("Invalid group command: %v", cfg)
+		return
+	}
+
+	cloudCommandID := cfg["command_id"]
+	reject := func(err error) {
+		log.Printf("Cannot send group command: %v", err)
+		if cloudCommandID != "" {
+			e.cloud.SendCommandAck(cloudCommandID, false, err.Error())
+		}
+	}
+
+	group := ValveGroup{ZoneID: cfg["zone_id"], ControllerUID: cfg["controller_uid"]}
+	if mask := cfg["actuator_mask"]; mask != "" {
+		m, err := strconv.ParseUint(mask, 0, 64)
+		if err != nil {
+			reject(fmt.Errorf("invalid actuator mask %q", mask))
+			return
+		}
+		group.ActuatorMask = m
+	}
+	var duration time.Duration
+	if s := cfg["duration_seconds"]; s != "" {
+		seconds, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			reject(fmt.Errorf("invalid duration %q", s))
+			return
+		}
+		duration = time.Duration(seconds) * time.Second
+	}
+
+	if cloudCommandID != "" {
+		prev, err := e.db.GetCommandGroupByCloudID(cloudCommandID)
+		if err != nil {
+			log.Printf("Failed to check for duplicate group command %s: %v", cloudCommandID, err)
+		}
+		if prev != nil {
+			log.Printf("Ignoring duplicate cloud command %s (group %d)", cloudCommandID, prev.ID)
+			if prev.CompletedAt != nil {
+				e.cloud.SendCommandAck(cloudCommandID, prev.Success, prev.Error)
+			}
+			return
+		}
+	}
+
+	origin := storage.CommandAudit{Source: sourceCloud, Actor: cfg["actor"], CloudCommandID: cloudCommandID}
+	if _, err := e.sendGroupCommand(group, command, duration, origin); err != nil {
+		reject(err)
+	}
+}
+
+// auditRejectedGroup records a group command that was refused before any
+// member was sent
+func (e *Engine) auditRejectedGroup(group ValveGroup, command uint8, origin storage.CommandAudit, reason error) {
+	entry := origin
+	entry.Kind, entry.DeviceUID = "valve_group", group.ControllerUID
+	entry.Command, entry.Outcome, entry.Detail = valveCommandString(command), storage.AuditRejected, reason.Error()
+	entry.Params = auditParams(map[string]interface{}{"target": group.String()})
+	e.auditCommand(&entry)
+}
@@ -0,0 +1,169 @@
+package engine
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/agsys/property-controller/internal/lora"
+	"github.com/agsys/property-controller/internal/protocol"
+	"github.com/agsys/property-controller/internal/storage"
+)
+
+// Diagnostic commands longer than this are refused, so one request can't tie
+// up the downlink with fragments
+const maxDebugCommandLen = 512
+
+// debugKey identifies a diagnostic command awaiting a device's reply
+type debugKey struct {
+	deviceUID string
+	requestID uint16
+}
+
+// debugRequest is a diagnostic command sent to a device
+type debugRequest struct {
+	cloudCommandID string
+	sentAt         time.Time
+}
+
+// handleDebugCommand passes a diagnostic command from the cloud through to a
+// device: device_uid, command_id, data (hex), and actor optional. The reply
+// is relayed as the command's ack.
+func (e *Engine) handleDebugCommand(cfg map[string]string) {
+	cloudCommandID := cfg["command_id"]
+	if cloudCommandID == "" {
+		log.Printf("Ignoring debug command without a command ID for %s", cfg["device_uid"])
+		return
+	}
+
+	data, err := hex.DecodeString(cfg["data"])
+	if err == nil {
+		err = e.SendDebugCommand(cfg["device_uid"], data, cloudCommandID, sourceCloud, cfg["actor"])
+	} else {
+		err = fmt.Errorf("invalid data: %w", err)
+	}
+	if err != nil {
+		log.Printf("Debug command %s failed: %v", cloudCommandID, err)
+		e.cloud.SendCommandAck(cloudCommandID, false, err.Error())
+	}
+}
+
+// SendDebugCommand sends an opaque diagnostic command to a registered device
+// and waits for its reply in the background. The reply is relayed to the
+// cloud if the command came from it. The source and actor are recorded in
+// the command audit log.
+func (e *Engine) SendDebugCommand(deviceUID string, data []byte, cloudCommandID, source, actor string) error {
+	cmdID := uint16(atomic.AddUint32(&e.commandID, 1))
+
+	entry := &storage.CommandAudit{
+		Kind:           "debug",
+		DeviceUID:      deviceUID,
+		Command:        "debug",
+		Params:         auditParams(map[string]string{"data": hex.EncodeToString(data)}),
+		Source:         source,
+		Actor:          actor,
+		CloudCommandID: cloudCommandID,
+		CommandID:      cmdID,
+		Outcome:        storage.AuditSent,
+	}
+	defer e.auditCommand(entry)
+
+	reject := func(err error) error {
+		entry.Outcome, entry.Detail = storage.AuditRejected, err.Error()
+		return err
+	}
+	if len(data) > maxDebugCommandLen {
+		return reject(fmt.Errorf("debug command of %d bytes is over %d", len(data), maxDebugCommandLen))
+	}
+	uid, err := lora.ParseDeviceUID(deviceUID)
+	if err != nil {
+		return reject(fmt.Errorf("invalid device UID: %w", err))
+	}
+	e.mu.RLock()
+	_, registered := e.registeredDevices[deviceUID]
+	e.mu.RUnlock()
+	if !registered {
+		return reject(fmt.Errorf("device %s is not registered", deviceUID))
+	}
+
+	// Expected before it is sent, so a quick reply finds it
+	key := debugKey{deviceUID, cmdID}
+	e.debugMu.Lock()
+	if e.debugRequests == nil {
+		e.debugRequests = make(map[debugKey]*debugRequest)
+	}
+	e.debugRequests[key] = &debugRequest{cloudCommandID: cloudCommandID, sentAt: time.Now()}
+	e.debugMu.Unlock()
+
+	cmd := &protocol.DebugCommandPayload{RequestID: cmdID, Data: data}
+	if err := e.lora.SendFragmented(uid, protocol.MsgTypeDebugCommand, cmd.Encode()); err != nil {
+		e.debugMu.Lock()
+		delete(e.debugRequests, key)
+		e.debugMu.Unlock()
+		entry.Outcome, entry.Detail = storage.AuditSendFailed, err.Error()
+		return err
+	}
+
+	log.Printf("Sent debug command %d to %s: %d bytes", cmdID, deviceUID, len(data))
+	return nil
+}
+
+// handleDebugReply relays a device's reply to a diagnostic command
+func (e *Engine) handleDebugReply(deviceUID string, msg *protocol.LoRaMessage) {
+	reply, err := protocol.DecodeDebugReply(msg.Payload)
+	if err != nil {
+		log.Printf("Failed to decode debug reply from %s: %v", deviceUID, err)
+		e.count(counterDecodeFailures)
+		return
+	}
+
+	key := debugKey{deviceUID, reply.RequestID}
+	e.debugMu.Lock()
+	req, ok := e.debugRequests[key]
+	delete(e.debugRequests, key)
+	e.debugMu.Unlock()
+	if !ok {
+		log.Printf("Ignoring debug reply %d from %s: no command awaiting it", reply.RequestID, deviceUID)
+		return
+	}
+
+	log.Printf("Debug reply %d from %s: status %d, %d bytes", reply.RequestID, deviceUID, reply.Status, len(reply.Data))
+	if reply.Status != 0 {
+		e.auditOutcome(deviceUID, reply.RequestID, storage.AuditNacked, fmt.Sprintf("status %d", reply.Status))
+	} else {
+		e.auditOutcome(deviceUID, reply.RequestID, storage.AuditAcked, fmt.Sprintf("%d bytes", len(reply.Data)))
+	}
+
+	if req.cloudCommandID != "" {
+		if err := e.cloud.SendDebugReply(req.cloudCommandID, reply.Status, reply.Data); err != nil {
+			log.Printf("Failed to relay debug reply %d from %s: %v", reply.RequestID, deviceUID, err)
+		}
+	}
+}
+
+// expireDebugCommands gives up on diagnostic commands whose device hasn't
+// replied within the timeout
+func (e *Engine) expireDebugCommands(now time.Time) {
+	timeout := e.settings().DebugTimeout
+
+	e.debugMu.Lock()
+	expired := make(map[debugKey]*debugRequest)
+	for key, req := range e.debugRequests {
+		if now.Sub(req.sentAt) >= timeout {
+			expired[key] = req
+			delete(e.debugRequests, key)
+		}
+	}
+	e.debugMu.Unlock()
+
+	for key, req := range expired {
+		reason := fmt.Sprintf("no reply from device within %s", timeout)
+		log.Printf("Debug command %d to %s: %s", key.requestID, key.deviceUID, reason)
+		e.auditOutcome(key.deviceUID, key.requestID, storage.AuditNoAck, reason)
+		if req.cloudCommandID != "" {
+			e.cloud.SendCommandAck(req.cloudCommandID, false, reason)
+		}
+	}
+}
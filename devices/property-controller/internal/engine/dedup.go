@@ -0,0 +1,63 @@
+package engine
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/agsys/property-controller/internal/logging"
+	"github.com/agsys/property-controller/internal/protocol"
+	"github.com/agsys/property-controller/internal/storage"
+)
+
+// uplinkSeq is the sequence number of a device's last accepted uplink
+type uplinkSeq struct {
+	seq    uint16
+	seenAt time.Time
+}
+
+// loadDeviceSequences restores last accepted sequence numbers so
+// retransmissions straddling a restart are still caught
+func (e *Engine) loadDeviceSequences() {
+	seqs, err := e.db.GetDeviceSequences()
+	if err != nil {
+		log.Printf("Failed to load device sequences: %v", err)
+		return
+	}
+
+	e.uplinkMu.Lock()
+	defer e.uplinkMu.Unlock()
+	for _, s := range seqs {
+		e.uplinks[s.DeviceUID] = uplinkSeq{seq: s.Sequence, seenAt: s.SeenAt}
+	}
+}
+
+// isDuplicateUplink reports whether a message repeats a device's last
+// accepted uplink within the duplicate window, and otherwise records it as
+// the last accepted one. A device that restarts its sequence numbers is only
+// mistaken for a retransmission if it lands on the same number within the
+// window.
+func (e *Engine) isDuplicateUplink(deviceUID string, msg *protocol.LoRaMessage, now time.Time) bool {
+	window := e.settings().DuplicateWindow
+	if window <= 0 {
+		return false
+	}
+	seq := msg.Header.Sequence
+
+	e.uplinkMu.Lock()
+	last, ok := e.uplinks[deviceUID]
+	if ok && last.seq == seq && now.Sub(last.seenAt) < window {
+		e.uplinkMu.Unlock()
+		atomic.AddUint64(&e.duplicates, 1)
+		e.count(counterDuplicates)
+		logging.Debugf("Dropped duplicate type 0x%02X from %s seq %d", msg.Header.MsgType, deviceUID, seq)
+		return true
+	}
+	e.uplinks[deviceUID] = uplinkSeq{seq: seq, seenAt: now}
+	e.uplinkMu.Unlock()
+
+	if err := e.db.UpdateDeviceSequence(&storage.DeviceSequence{DeviceUID: deviceUID, Sequence: seq, SeenAt: now}); err != nil {
+		log.Printf("Failed to record sequence of %s: %v", deviceUID, err)
+	}
+	return false
+}
@@ -0,0 +1,52 @@
+package engine
+
+import (
+	"log"
+	"time"
+
+	"github.com/agsys/property-controller/internal/storage"
+)
+
+// applyDeviceChanges brings the registered device cache, and quarantine, in
+// line with the device changes made with agsys-db, which has already written
+// them to the devices table. They stay queued for the cloud: the protocol has
+// no message for device changes yet.
+func (e *Engine) applyDeviceChanges() {
+	changes, err := e.db.GetUnappliedDeviceChanges()
+	if err != nil {
+		log.Printf("Failed to get device changes: %v", err)
+		return
+	}
+
+	for _, c := range changes {
+		// A forgotten device heard again starts over as unregistered
+		if c.Change == storage.DeviceChangeRelease || c.Change == storage.DeviceChangeForget {
+			e.releaseDevice(c.DeviceUID)
+		}
+
+		e.mu.Lock()
+		device, cached := e.registeredDevices[c.DeviceUID]
+		switch c.Change {
+		case storage.DeviceChangeAlias:
+			if cached {
+				device.Alias = c.Value
+			}
+		case storage.DeviceChangeZone:
+			if cached {
+				device.ZoneID = c.Value
+			}
+		case storage.DeviceChangeForget:
+			delete(e.registeredDevices, c.DeviceUID)
+			if shared := e.config.SharedRadio; shared != nil {
+				shared.release(c.DeviceUID, e)
+			}
+		}
+		e.mu.Unlock()
+
+		log.Printf("Device %s: %s change %d by %s applied", c.DeviceUID, c.Change, c.ID, c.Actor)
+		if err := e.db.MarkDeviceChangeApplied(c.ID, time.Now()); err != nil {
+			log.Printf("Failed to mark device change %d applied: %v", c.ID, err)
+			return
+		}
+	}
+}
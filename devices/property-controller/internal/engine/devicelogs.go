@@ -0,0 +1,100 @@
+package engine
+
+import (
+	"log"
+	"time"
+
+	"github.com/agsys/property-controller/internal/logging"
+	"github.com/agsys/property-controller/internal/protocol"
+	"github.com/agsys/property-controller/internal/storage"
+)
+
+// DeviceLogConfig controls the firmware log entries devices send in log
+// batches. The cloud protocol has no message for device logs yet, so entries
+// queued for the cloud stay queued until it does.
+type DeviceLogConfig struct {
+	History     time.Duration // How long entries are kept (0 keeps them)
+	Forward     bool          // Queue entries for the cloud
+	MinSeverity uint8         // Least severe entry queued for the cloud
+}
+
+// DefaultDeviceLogConfig returns default device log settings: a month of
+// entries, kept local
+func DefaultDeviceLogConfig() DeviceLogConfig {
+	return DeviceLogConfig{
+		History:     30 * 24 * time.Hour,
+		MinSeverity: protocol.LogSeverityWarning,
+	}
+}
+
+// handleLogBatch stores the entries of a device's log batch and acks it, so
+// the device can free them. The ack asks for the next batch if the device
+// holds more. A batch that can't be stored isn't acked, and the device sends
+// it again.
+func (e *Engine) handleLogBatch(deviceUID string, msg *protocol.LoRaMessage) {
+	batch, err := protocol.DecodeLogBatch(msg.Payload)
+	if err != nil {
+		log.Printf("Failed to decode log batch from %s: %v", deviceUID, err)
+		e.count(counterDecodeFailures)
+		return
+	}
+
+	cfg := e.settings().DeviceLogs
+	now := time.Now()
+	logs := make([]*storage.DeviceLog, 0, len(batch.Entries))
+	for _, entry := range batch.Entries {
+		l := &storage.DeviceLog{
+			DeviceUID:  deviceUID,
+			Severity:   entry.Severity,
+			LogType:    entry.Type,
+			Code:       entry.Code,
+			Message:    entry.Message,
+			ReceivedAt: now,
+			// Entries not forwarded have nothing to send
+			SyncedToCloud: !cfg.Forward || entry.Severity < cfg.MinSeverity,
+		}
+		if entry.Timestamp != 0 {
+			t := time.Unix(int64(entry.Timestamp), 0)
+			l.DeviceTime = &t
+		}
+		logs = append(logs, l)
+
+		if entry.Severity >= protocol.LogSeverityWarning {
+			log.Printf("Device %s %s: type %d code %d: %s",
+				deviceUID, protocol.LogSeverityString(entry.Severity), entry.Type, entry.Code, entry.Message)
+		} else {
+			logging.Debugf("Device %s %s: type %d code %d: %s",
+				deviceUID, protocol.LogSeverityString(entry.Severity), entry.Type, entry.Code, entry.Message)
+		}
+	}
+
+	if err := e.db.InsertDeviceLogs(logs); err != nil {
+		log.Printf("Failed to store log batch from %s: %v", deviceUID, err)
+		return
+	}
+
+	var flags uint8
+	if batch.Remaining > 0 {
+		flags |= protocol.AckFlagSendLogs
+	}
+	if err := e.SendAck(deviceUID, msg.Header.DeviceType, msg.Header.Sequence, 0, flags); err != nil {
+		log.Printf("Failed to ack log batch from %s: %v", deviceUID, err)
+	}
+}
+
+// pruneDeviceLogs deletes device log entries past retention
+func (e *Engine) pruneDeviceLogs() {
+	retention := e.settings().DeviceLogs.History
+	if retention <= 0 {
+		return
+	}
+
+	n, err := e.db.DeleteDeviceLogsBefore(time.Now().Add(-retention))
+	if err != nil {
+		log.Printf("Failed to prune device logs: %v", err)
+		return
+	}
+	if n > 0 {
+		log.Printf("Pruned %d device log entries", n)
+	}
+}
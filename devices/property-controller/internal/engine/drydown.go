@@ -0,0 +1,226 @@
+package engine
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/agsys/property-controller/internal/localapi"
+	"github.com/agsys/property-controller/internal/protocol"
+	"github.com/agsys/property-controller/internal/storage"
+)
+
+// DrydownConfig controls the soil drydown model that predicts when each
+// zone needs water
+type DrydownConfig struct {
+	Window          time.Duration // Readings the model looks back over
+	MinSpan         time.Duration // Shortest drydown a drying rate is fitted to
+	RisePercent     uint8         // Rise between readings that counts as watering or rain
+	TempCoefficient float64       // Change in drying rate per °C above the drydown's average temperature
+	TargetPercent   uint8         // Water at this moisture (0 uses the zone's dry alert threshold)
+	SkipAhead       time.Duration // Skip scheduled runs of zones not due for water within this (0 disables)
+}
+
+// DefaultDrydownConfig returns default drydown settings, with schedule
+// adjustment off
+func DefaultDrydownConfig() DrydownConfig {
+	return DrydownConfig{
+		Window:          48 * time.Hour,
+		MinSpan:         6 * time.Hour,
+		RisePercent:     2,
+		TempCoefficient: 0.03,
+	}
+}
+
+// probeDrydown is the drying of one probe since it was last wetted
+type probeDrydown struct {
+	moisture float64 // Latest reading
+	rate     float64 // Points lost per hour, adjusted for temperature
+	fitted   bool    // False if the drydown is too short to fit
+}
+
+// fitDrydown fits a drying rate to a probe's readings, in time order. The
+// drydown starts after the last rise of more than RisePercent, and its rate
+// is the least-squares slope of moisture over time, scaled by how much
+// warmer or cooler the latest reading is than the drydown's average.
+func fitDrydown(readings []*storage.SoilMoistureReading, cfg DrydownConfig) probeDrydown {
+	last := len(readings) - 1
+	p := probeDrydown{moisture: float64(readings[last].MoisturePercent)}
+
+	start := last
+	for start > 0 && int(readings[start].MoisturePercent)-int(readings[start-1].MoisturePercent) <= int(cfg.RisePercent) {
+		start--
+	}
+	segment := readings[start:]
+	if len(segment) < 3 || readings[last].Timestamp.Sub(segment[0].Timestamp) < cfg.MinSpan {
+		return p
+	}
+
+	var sumX, sumY, sumXY, sumXX, sumTemp float64
+	n := float64(len(segment))
+	for _, r := range segment {
+		x := r.Timestamp.Sub(segment[0].Timestamp).Hours()
+		y := float64(r.MoisturePercent)
+		sumX, sumY, sumXY, sumXX = sumX+x, sumY+y, sumXY+x*y, sumXX+x*x
+		sumTemp += float64(r.Temperature) / 10
+	}
+	denom := n*sumXX - sumX*sumX
+	if denom == 0 {
+		return p
+	}
+	slope := (n*sumXY - sumX*sumY) / denom
+
+	p.fitted = true
+	if slope < 0 {
+		warmer := float64(readings[last].Temperature)/10 - sumTemp/n
+		p.rate = -slope * math.Max(0, 1+cfg.TempCoefficient*warmer)
+	}
+	return p
+}
+
+// Recommendations predicts when each zone with soil sensors needs water:
+// the hours until its average moisture, falling at its probes' average
+// drying rate, reaches the zone's target
+func (e *Engine) Recommendations() ([]localapi.ZoneRecommendation, error) {
+	return e.recommendations(time.Now())
+}
+
+func (e *Engine) recommendations(now time.Time) ([]localapi.ZoneRecommendation, error) {
+	cfg := e.settings()
+	readings, err := e.db.GetZoneSoilReadings(now.Add(-cfg.Drydown.Window))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get soil readings: %w", err)
+	}
+	zones, err := e.db.GetZones()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get zones: %w", err)
+	}
+	names := make(map[string]string, len(zones))
+	for _, z := range zones {
+		names[z.UID] = z.Name
+	}
+
+	recs := make([]localapi.ZoneRecommendation, 0, len(readings))
+	for zoneID, zoneReadings := range readings {
+		rec := localapi.ZoneRecommendation{ZoneID: zoneID, ZoneName: names[zoneID], TargetPercent: cfg.Drydown.TargetPercent}
+		if rec.TargetPercent == 0 {
+			rec.TargetPercent, _ = cfg.MoistureAlerts.thresholds(zoneID)
+		}
+
+		var fitted int
+		var moisture, rate float64
+		for _, probe := range splitProbes(zoneReadings) {
+			p := fitDrydown(probe, cfg.Drydown)
+			rec.Probes++
+			moisture += p.moisture
+			if p.fitted {
+				fitted++
+				rate += p.rate
+			}
+		}
+		rec.MoisturePercent = math.Round(moisture/float64(rec.Probes)*10) / 10
+		if fitted > 0 {
+			rec.DryingRate = math.Round(rate/float64(fitted)*100) / 100
+		}
+
+		switch {
+		case rec.TargetPercent == 0:
+			rec.Reason = "no target moisture (set drydown.target_percent or a dry alert threshold)"
+		case rec.MoisturePercent <= float64(rec.TargetPercent):
+			hours, by := 0.0, now
+			rec.WaterInHours, rec.WaterBy = &hours, &by
+		case fitted == 0:
+			rec.Reason = fmt.Sprintf("no drydown of %s since the last watering", cfg.Drydown.MinSpan)
+		case rec.DryingRate <= 0:
+			rec.Reason = "not drying"
+		default:
+			hours := math.Round((rec.MoisturePercent-float64(rec.TargetPercent))/rec.DryingRate*10) / 10
+			by := now.Add(time.Duration(hours * float64(time.Hour)))
+			rec.WaterInHours, rec.WaterBy = &hours, &by
+		}
+		rec.SkipRuns = skipForDrydown(cfg.Drydown, rec, now)
+		recs = append(recs, rec)
+	}
+
+	sort.Slice(recs, func(i, j int) bool { return recs[i].ZoneID < recs[j].ZoneID })
+	return recs, nil
+}
+
+// splitProbes splits a zone's readings, ordered by device, probe, and time,
+// into one series per probe
+func splitProbes(readings []*storage.SoilMoistureReading) [][]*storage.SoilMoistureReading {
+	var probes [][]*storage.SoilMoistureReading
+	start := 0
+	for i := 1; i <= len(readings); i++ {
+		if i == len(readings) || readings[i].DeviceUID != readings[start].DeviceUID || readings[i].ProbeID != readings[start].ProbeID {
+			probes = append(probes, readings[start:i])
+			start = i
+		}
+	}
+	return probes
+}
+
+// skipForDrydown reports whether a zone's runs at the given time are skipped
+// because it isn't due for water within SkipAhead. Zones whose need can't
+// be predicted are watered as scheduled.
+func skipForDrydown(cfg DrydownConfig, rec localapi.ZoneRecommendation, at time.Time) bool {
+	return cfg.SkipAhead > 0 && rec.WaterBy != nil && rec.WaterBy.Sub(at) > cfg.SkipAhead
+}
+
+// drydownSkips returns the recommendations of zones whose scheduled runs are
+// skipped, by zone ID, or nil if schedule adjustment is off
+func (e *Engine) drydownSkips(now time.Time) map[string]localapi.ZoneRecommendation {
+	if e.settings().Drydown.SkipAhead <= 0 {
+		return nil
+	}
+	recs, err := e.recommendations(now)
+	if err != nil {
+		log.Printf("Failed to predict soil drydown: %v", err)
+		return nil
+	}
+	skips := make(map[string]localapi.ZoneRecommendation)
+	for _, rec := range recs {
+		if rec.SkipRuns {
+			skips[rec.ZoneID] = rec
+		}
+	}
+	return skips
+}
+
+// drydownScheduleEntries removes from a controller's schedule entries the
+// actuators of zones that aren't due for water yet, dropping entries left
+// with no actuators
+func (e *Engine) drydownScheduleEntries(controllerUID string, entries []protocol.ScheduleEntry, now time.Time) []protocol.ScheduleEntry {
+	skips := e.drydownSkips(now)
+	if len(skips) == 0 {
+		return entries
+	}
+	actuators, err := e.db.GetValveActuators()
+	if err != nil {
+		log.Printf("Failed to get valves: %v", err)
+		return entries
+	}
+
+	var skipMask uint64
+	for _, a := range actuators {
+		if rec, ok := skips[a.ZoneID]; ok && a.ControllerUID == controllerUID && a.Address < 64 {
+			skipMask |= 1 << a.Address
+			log.Printf("Skipping scheduled runs of %s addr %d: zone %s not due for water until %s",
+				controllerUID, a.Address, rec.ZoneID, rec.WaterBy.Local().Format("Jan 2 15:04"))
+		}
+	}
+	if skipMask == 0 {
+		return entries
+	}
+
+	out := make([]protocol.ScheduleEntry, 0, len(entries))
+	for _, entry := range entries {
+		entry.ActuatorMask &^= skipMask
+		if entry.ActuatorMask != 0 {
+			out = append(out, entry)
+		}
+	}
+	return out
+}
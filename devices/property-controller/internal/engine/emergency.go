@@ -0,0 +1,229 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/agsys/property-controller/internal/localapi"
+	"github.com/agsys/property-controller/internal/protocol"
+	"github.com/agsys/property-controller/internal/storage"
+)
+
+// sourceEmergency marks the valve events of valves closed by an emergency stop
+const sourceEmergency = "emergency"
+
+// errEmergencyStop refuses an open while an emergency stop is in force
+var errEmergencyStop = errors.New("emergency stop in force, re-arm before opening valves")
+
+// EmergencyStop closes every known valve and holds them closed until
+// RearmEmergencyStop: pending opens are cancelled, open commands are refused,
+// and valve controllers are sent empty schedules. The stop is stored, so it
+// stays in force across restarts. Stopping again while stopped sends the
+// closes again. It returns the number of close commands sent.
+func (e *Engine) EmergencyStop(source, actor, reason string) (int, error) {
+	stop := &storage.EmergencyStop{StoppedAt: time.Now(), Source: source, Actor: actor, Reason: reason}
+	started, err := e.db.StartEmergencyStop(stop)
+	e.auditEmergency("stop", source, actor, reason, err)
+	if err != nil {
+		return 0, fmt.Errorf("failed to record emergency stop: %w", err)
+	}
+	log.Printf("EMERGENCY STOP (%s): %s - closing all valves", source, reason)
+
+	e.cancelPendingOpens()
+	closed, failed := e.closeAllValves(storage.CommandAudit{
+		Source: source,
+		Actor:  actor,
+		Params: auditParams(map[string]interface{}{"emergency_stop": stop.ID, "reason": reason}),
+	})
+	if err := e.db.AddEmergencyStopValves(stop.ID, closed); err != nil {
+		log.Printf("Failed to count emergency stop closes: %v", err)
+	}
+	e.pushSchedules()
+
+	if started {
+		cfg := e.settings()
+		message := fmt.Sprintf("emergency stop from %s: all valves closed and held closed until re-armed", source)
+		if reason != "" {
+			message += " (" + reason + ")"
+		}
+		e.raiseAlert(&storage.Alert{
+			DeviceUID: cfg.ControllerID,
+			AlertType: alertEmergencyStop,
+			Severity:  storage.AlertCritical,
+			Message:   message,
+			Timestamp: stop.StoppedAt,
+		})
+	}
+
+	if failed > 0 {
+		return closed, fmt.Errorf("emergency stop in force, but %d of %d close commands could not be sent", failed, closed+failed)
+	}
+	return closed, nil
+}
+
+// RearmEmergencyStop ends the emergency stop in force, letting valves open
+// again. Nothing that was cancelled is resumed; valve controllers get their
+// schedules back.
+func (e *Engine) RearmEmergencyStop(source, actor string) error {
+	stop, err := e.db.RearmEmergencyStop(source, actor, time.Now())
+	if err == nil && stop == nil {
+		err = errors.New("no emergency stop is in force")
+	}
+	e.auditEmergency("rearm", source, actor, "", err)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Emergency stop of %s re-armed (%s)", stop.StoppedAt.Format(time.DateTime), source)
+	e.clearAlerts(e.settings().ControllerID, 0, alertEmergencyStop)
+	e.pushSchedules()
+	return nil
+}
+
+// emergencyStopped reports whether an emergency stop is in force. If that
+// can't be read, valves are held closed.
+func (e *Engine) emergencyStopped() bool {
+	stop, err := e.db.GetActiveEmergencyStop()
+	if err != nil {
+		log.Printf("Failed to check for an emergency stop, assuming one: %v", err)
+		return true
+	}
+	return stop != nil
+}
+
+// cancelPendingOpens fails every open command still awaiting an
+// acknowledgment, so it is not retried, and tells the cloud
+func (e *Engine) cancelPendingOpens() {
+	opens, err := e.db.GetUnresolvedCommands(protocol.ValveCmdOpen)
+	if err != nil {
+		log.Printf("Failed to get pending opens: %v", err)
+		return
+	}
+
+	const reason = "cancelled by emergency stop"
+	for _, cmd := range opens {
+		if err := e.db.MarkCommandFailed(cmd.ID, reason); err != nil {
+			log.Printf("Failed to cancel command %d: %v", cmd.CommandID, err)
+			continue
+		}
+		e.auditOutcome(cmd.ControllerUID, cmd.CommandID, storage.AuditCancelled, reason)
+		if cmd.GroupID != 0 {
+			e.resolveCommandGroup(cmd.GroupID)
+		} else if cmd.CloudCommandID != "" {
+			if err := e.cloud.SendCommandAck(cmd.CloudCommandID, false, reason); err != nil {
+				log.Printf("Failed to send command cancellation to cloud: %v", err)
+			}
+		}
+		log.Printf("Cancelled open command %d to %s addr %d", cmd.CommandID, cmd.ControllerUID, cmd.ActuatorAddr)
+	}
+}
+
+// closeAllValves sends a close command to every known valve, whatever its
+// last reported state, and records each as a valve event. It returns the
+// number of closes sent and the number that could not be.
+func (e *Engine) closeAllValves(origin storage.CommandAudit) (closed, failed int) {
+	actuators, err := e.db.GetValveActuators()
+	if err != nil {
+		log.Printf("Failed to get valves: %v", err)
+		return 0, 0
+	}
+
+	now := time.Now()
+	for _, a := range actuators {
+		if err := e.sendValveCommand(a.ControllerUID, a.Address, protocol.ValveCmdClose, origin, 0); err != nil {
+			log.Printf("Failed to close valve %s addr %d: %v", a.ControllerUID, a.Address, err)
+			failed++
+			continue
+		}
+		closed++
+
+		event := &storage.ValveEvent{
+			ControllerUID: a.ControllerUID,
+			ActuatorAddr:  a.Address,
+			PrevState:     a.CurrentState,
+			NewState:      protocol.ValveStateClosing,
+			Source:        sourceEmergency,
+			Timestamp:     now,
+		}
+		id, err := e.db.InsertValveEvent(event)
+		if err != nil {
+			log.Printf("Failed to store valve event: %v", err)
+			continue
+		}
+		e.bus.Valve.publish(ValveChanged{ID: id, Event: event})
+	}
+	return closed, failed
+}
+
+// pushSchedules sends each valve controller its schedule now rather than
+// at its next request, so a stop or re-arm reaches it at once
+func (e *Engine) pushSchedules() {
+	actuators, err := e.db.GetValveActuators()
+	if err != nil {
+		log.Printf("Failed to get valves: %v", err)
+		return
+	}
+
+	sent := make(map[string]bool)
+	for _, a := range actuators {
+		if !sent[a.ControllerUID] {
+			sent[a.ControllerUID] = true
+			e.sendSchedule(a.ControllerUID)
+		}
+	}
+}
+
+// auditEmergency records an emergency stop or re-arm in the command audit log
+func (e *Engine) auditEmergency(command, source, actor, reason string, err error) {
+	entry := &storage.CommandAudit{
+		Kind:    "emergency_stop",
+		Command: command,
+		Source:  source,
+		Actor:   actor,
+		Outcome: storage.AuditSent,
+	}
+	if reason != "" {
+		entry.Params = auditParams(map[string]interface{}{"reason": reason})
+	}
+	if err != nil {
+		entry.Outcome, entry.Detail = storage.AuditRejected, err.Error()
+	}
+	e.auditCommand(entry)
+}
+
+// emergencyService exposes the emergency stop to the local API
+type emergencyService struct {
+	engine *Engine
+}
+
+// EmergencyStop stops every valve on behalf of a local API caller
+func (s emergencyService) EmergencyStop(actor, reason string) (int, error) {
+	return s.engine.EmergencyStop(sourceLocalAPI, actor, reason)
+}
+
+// RearmEmergencyStop re-arms on behalf of a local API caller
+func (s emergencyService) RearmEmergencyStop(actor string) error {
+	return s.engine.RearmEmergencyStop(sourceLocalAPI, actor)
+}
+
+// emergencyStatus describes the emergency stop in force for the status
+// report, or returns nil
+func (e *Engine) emergencyStatus() *localapi.EmergencyStopStatus {
+	stop, err := e.db.GetActiveEmergencyStop()
+	if err != nil {
+		log.Printf("Failed to get emergency stop: %v", err)
+		return nil
+	}
+	if stop == nil {
+		return nil
+	}
+	return &localapi.EmergencyStopStatus{
+		StoppedAt:    stop.StoppedAt,
+		Source:       stop.Source,
+		Actor:        stop.Actor,
+		Reason:       stop.Reason,
+		ValvesClosed: stop.ValvesClosed,
+	}
+}
@@ -7,33 +7,110 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"net"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/agsys/property-controller/internal/analytics"
 	"github.com/agsys/property-controller/internal/cloud"
+	"github.com/agsys/property-controller/internal/localapi"
+	"github.com/agsys/property-controller/internal/logging"
 	"github.com/agsys/property-controller/internal/lora"
+	"github.com/agsys/property-controller/internal/modbus"
+	"github.com/agsys/property-controller/internal/notify"
 	"github.com/agsys/property-controller/internal/ota"
 	"github.com/agsys/property-controller/internal/protocol"
 	"github.com/agsys/property-controller/internal/storage"
+	"github.com/agsys/property-controller/internal/weather"
 	controllerv1 "github.com/ccroswhite/agsys-api/gen/go/proto/controller/v1"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 // Config holds engine configuration
 type Config struct {
 	DatabasePath     string
-	GRPCAddr         string // gRPC server address (e.g., "grpc.agsys.io:443")
-	ControllerID     string // Controller UUID
+	DatabaseDriver   string // storage.DriverSQLite (the default) or storage.DriverPostgres
+	Postgres         storage.PostgresConfig
+	DatabaseKey      []byte   // Encrypts device LoRa keys in the database (nil stores them in the clear)
+	GRPCAddr         string   // gRPC server address (e.g., "grpc.agsys.io:443")
+	GRPCFallbacks    []string // Secondary gRPC servers, tried in order when GRPCAddr is unreachable
+	ControllerID     string   // Controller UUID
+	PropertyUID      string   // Property the controller belongs to, recorded on synced zones
 	APIKey           string
-	UseTLS           bool // Use TLS for gRPC connection
+	UseTLS           bool          // Use TLS for gRPC connection
+	CloudSessionTTL  time.Duration // Assumed session token lifetime (0 uses the cloud client default)
+	CloudLiveness    time.Duration // Reconnect when the cloud sends nothing for this long (0 uses the cloud client default)
+	CloudProxy       string        // http://, https:// or socks5:// proxy for the cloud (empty uses HTTPS_PROXY)
+	CloudCompression string        // "gzip" or "zstd" to compress uploads (empty sends them uncompressed)
+	CloudFailover    int           // Failed attempts before moving to the next gRPC server (0 uses the cloud client default)
+	CloudFailback    time.Duration // How often the primary is checked while on a fallback (0 uses the cloud client default)
 	AESKey           []byte
-	LoRaFrequency    uint32
+	LoRa             LoRaConfig
+	SharedRadio      *SharedRadio // LoRa driver shared with other properties' engines (nil creates one from LoRa)
 	CommandTimeout   time.Duration
 	CommandRetries   int
+	CommandRetention time.Duration // How long finished commands are kept
+	DebugTimeout     time.Duration // How long a device has to reply to a diagnostic command
 	SyncInterval     time.Duration
+	Sync             SyncConfig
 	TimeSyncInterval time.Duration
+	LowBandwidth     LowBandwidthConfig
 	FirmwareVersion  string
+	LocalAPISocket   string // Unix socket for the local API (empty disables it)
+	LocalAPIListen   string // TCP address for network API clients (empty disables it)
+	LocalAPITLSCert  string // TLS certificate and key for LocalAPIListen
+	LocalAPITLSKey   string
+	ValveMaxOpen     time.Duration // Auto-close valves open longer than this (0 disables)
+	ValveLimits      []ValveLimit  // Per-valve overrides of ValveMaxOpen
+	ManualOverride   time.Duration // Schedules and rules leave a valve operated by hand alone this long (0 disables)
+	ValveFlow        float64       // Expected flow of a valve in L/min for schedule previews (0 unknown)
+	FlowAnalytics    analytics.Config
+	Maintenance      MaintenanceConfig
+	KeyRotation      KeyRotationConfig
+	LinkHistory      time.Duration // How long per-message RSSI/SNR samples are kept
+	DeviceLogs       DeviceLogConfig
+	DuplicateWindow  time.Duration // Drop uplinks repeating a device's last sequence within this (0 disables)
+	IngestLimit      IngestLimitConfig
+	Spoofing         SpoofingConfig
+	Clock            ClockConfig
+	Modbus           modbus.Config
+	Weather          WeatherConfig
+	Fertigation      FertigationConfig
+	MoistureAlerts   MoistureAlertConfig
+	Drydown          DrydownConfig
+	Validation       ValidationConfig
+	ReportInterval   ReportIntervalConfig
+	ScheduleAck      ScheduleAckConfig
+	MeterPin         MeterPinConfig
+	MeterCalibration MeterCalibrationConfig
+	Acks             AckConfig
+	ActuatorHealth   ActuatorHealthConfig
+	PowerFail        PowerFailConfig
+	Reboots          RebootConfig
+	Inventory        FirmwareInventoryConfig
+	Alerts           AlertConfig
+	Notify           notify.Config
+	WatchdogInterval time.Duration // systemd watchdog timeout (0 disables pings)
+	WatchdogNotify   func() error  // Sends the watchdog keepalive (nil notifies systemd directly)
+	FirmwareCacheDir string        // Where OTA firmware images are cached
+	OTA              OTAConfig
+
+	// Transport overrides for the integration test harness
+	Radio       lora.Radio                                               // Replaces the concentrator (nil uses the hardware)
+	CloudDialer func(ctx context.Context, addr string) (net.Conn, error) // Replaces TCP to GRPCAddr (nil dials it)
+}
+
+// ValveLimit overrides the maximum open duration and expected flow for a
+// single valve actuator
+type ValveLimit struct {
+	ControllerUID string
+	Address       uint8
+	MaxOpen       time.Duration
+	FlowLPM       float64 // Overrides ValveFlow when set
 }
 
 // DefaultConfig returns default engine configuration
@@ -42,12 +119,46 @@ func DefaultConfig() Config {
 		DatabasePath:     "/var/lib/agsys/controller.db",
 		GRPCAddr:         "localhost:50051",
 		UseTLS:           false,
-		LoRaFrequency:    915000000,
+		LoRa:             DefaultLoRaConfig(),
 		CommandTimeout:   10 * time.Second,
 		CommandRetries:   3,
+		CommandRetention: 7 * 24 * time.Hour,
+		DebugTimeout:     time.Minute,
 		SyncInterval:     30 * time.Second,
+		Sync:             DefaultSyncConfig(),
 		TimeSyncInterval: 1 * time.Hour,
+		LowBandwidth:     DefaultLowBandwidthConfig(),
 		FirmwareVersion:  "1.0.0",
+		LocalAPISocket:   localapi.DefaultConfig().SocketPath,
+		ValveMaxOpen:     4 * time.Hour,
+		ManualOverride:   time.Hour,
+		FlowAnalytics:    analytics.DefaultConfig(),
+		Maintenance:      DefaultMaintenanceConfig(),
+		KeyRotation:      DefaultKeyRotationConfig(),
+		LinkHistory:      30 * 24 * time.Hour,
+		DeviceLogs:       DefaultDeviceLogConfig(),
+		DuplicateWindow:  10 * time.Minute,
+		IngestLimit:      DefaultIngestLimitConfig(),
+		Spoofing:         DefaultSpoofingConfig(),
+		Clock:            DefaultClockConfig(),
+		Modbus:           modbus.DefaultConfig(),
+		Weather:          DefaultWeatherConfig(),
+		Fertigation:      DefaultFertigationConfig(),
+		MoistureAlerts:   DefaultMoistureAlertConfig(),
+		Drydown:          DefaultDrydownConfig(),
+		Validation:       DefaultValidationConfig(),
+		ReportInterval:   DefaultReportIntervalConfig(),
+		ScheduleAck:      DefaultScheduleAckConfig(),
+		MeterPin:         DefaultMeterPinConfig(),
+		MeterCalibration: DefaultMeterCalibrationConfig(),
+		Acks:             DefaultAckConfig(),
+		ActuatorHealth:   DefaultActuatorHealthConfig(),
+		Reboots:          DefaultRebootConfig(),
+		Inventory:        DefaultFirmwareInventoryConfig(),
+		Alerts:           DefaultAlertConfig(),
+		Notify:           notify.DefaultConfig(),
+		FirmwareCacheDir: ota.DefaultConfig().FirmwareCacheDir,
+		OTA:              DefaultOTAConfig(),
 	}
 }
 
@@ -57,89 +168,322 @@ type Engine struct {
 	db        *storage.DB
 	lora      *lora.Driver
 	cloud     *cloud.GRPCClient
+	firmware  *cloud.FirmwareClient
 	ota       *ota.Manager
+	flow      *analytics.FlowChecker
+	api       *localapi.Server
+	modbus    *modbus.Server
+	weather   weather.Provider // nil when weather adjustment is off
+	notifier  *notify.Notifier
 	stopChan  chan struct{}
 	wg        sync.WaitGroup
 	mu        sync.RWMutex
 	commandID uint32
+	startedAt time.Time
+	recovery  string // How a damaged database was replaced at startup, if it was
+
+	// Guards the config fields that Reload may change
+	configMu sync.RWMutex
+	// Closed and replaced on every reload to wake loops with fixed tickers
+	reloaded chan struct{}
+
+	// Last iteration of each watched loop, for the systemd watchdog
+	beatMu sync.Mutex
+	beats  map[string]loopBeat
 
 	// Registered devices (from cloud)
 	registeredDevices map[string]*storage.Device
 
-	// Device firmware versions (updated from reports)
+	// Device firmware versions from heartbeats and OTA messages, guarded by mu
 	deviceVersions map[string]ota.Version
+
+	// Valves auto-closed for exceeding their runtime limit, by actuator UID
+	runtimeShutoffs map[string]time.Time
+
+	// Diagnostic commands awaiting a device's reply
+	debugMu       sync.Mutex
+	debugRequests map[debugKey]*debugRequest
+
+	// Key deliveries awaiting an ack, by device UID
+	rotationMu sync.Mutex
+	rotations  map[string]*keyRotation
+
+	// Last accepted uplink sequence and protocol version, by device UID, and
+	// retransmissions dropped
+	uplinkMu   sync.Mutex
+	uplinks    map[string]uplinkSeq
+	versions   map[string]uint8
+	duplicates uint64
+
+	// Ingest rate limit buckets by device UID and for all devices, and
+	// uplinks dropped over them
+	ingestMu  sync.Mutex
+	ingest    map[string]*ingestBucket
+	ingestAll ingestBucket
+	throttled uint64
+
+	// RSSI baselines, and devices quarantined as suspected spoofs with why,
+	// by device UID
+	spoofMu       sync.Mutex
+	rssiBaselines map[string]*rssiBaseline
+	quarantined   map[string]string
+
+	// Device RTC state from time sync acks, by device UID
+	clockMu sync.Mutex
+	clocks  map[string]*deviceClock
+
+	// Fertigation doses planned or running, by valve controller UID
+	fertMu      sync.Mutex
+	fertigation map[string]*fertigationRun
+
+	// Held while a valve command is sent and its pending row written, so a
+	// transmit failure reported before the row exists still finds it
+	txMu sync.Mutex
+
+	// Last moisture alert level of each soil probe
+	moistMu  sync.Mutex
+	moisture map[moistureProbe]string
+
+	// When the cloud connection was lost, zero while connected (alert loop only)
+	cloudLostAt time.Time
+
+	// When the whole firmware inventory was last queued for the cloud (sync loop only)
+	inventoryResyncAt time.Time
+
+	// Receive spans of readings not yet synced to the cloud
+	traceMu    sync.Mutex
+	traceLinks map[traceKey][]trace.Link
+
+	// Traffic with the cloud not yet added to the monthly usage
+	cloudUsage *cloud.UsageCounter
+
+	// Lifetime counters, written to the database with the cloud usage
+	stats engineStats
+
+	// Wake the alert and sync loops when the cloud link changes
+	cloudChanged chan struct{}
+	syncNow      chan struct{}
+
+	// Stored records, alerts, and link changes, and what acts on them
+	bus Bus
 }
 
 // New creates a new engine instance
 func New(config Config) (*Engine, error) {
 	// Open database
-	db, err := storage.Open(config.DatabasePath)
+	db, recovery, err := openDatabase(config)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
+	if config.DatabaseKey != nil {
+		n, err := db.SetEncryptionKey(config.DatabaseKey)
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to set database key: %w", err)
+		}
+		if n > 0 {
+			log.Printf("Encrypted %d device keys stored in the clear", n)
+		}
+	}
 
-	// Create LoRa driver
-	loraConfig := lora.DefaultConfig()
-	loraConfig.Frequency = config.LoRaFrequency
-	loraConfig.AESKey = config.AESKey
-
-	loraDriver, err := lora.New(loraConfig)
-	if err != nil {
-		db.Close()
-		return nil, fmt.Errorf("failed to create LoRa driver: %w", err)
+	// Create LoRa driver, unless another property's engine shares one
+	var loraDriver *lora.Driver
+	if config.SharedRadio != nil {
+		loraDriver = config.SharedRadio.driver
+	} else {
+		loraDriver, err = lora.New(loraConfig(config))
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to create LoRa driver: %w", err)
+		}
 	}
 
 	// Create gRPC cloud client
 	grpcConfig := cloud.DefaultGRPCConfig()
 	grpcConfig.ServerAddr = config.GRPCAddr
+	grpcConfig.FallbackAddrs = config.GRPCFallbacks
 	grpcConfig.ControllerID = config.ControllerID
 	grpcConfig.APIKey = config.APIKey
 	grpcConfig.UseTLS = config.UseTLS
+	grpcConfig.Dialer = config.CloudDialer
+	grpcConfig.Proxy = config.CloudProxy
+	grpcConfig.Usage = &cloud.UsageCounter{}
+	grpcConfig.Compression = config.CloudCompression
+	if config.CloudLiveness > 0 {
+		grpcConfig.LivenessTimeout = config.CloudLiveness
+	}
+	if config.CloudFailover > 0 {
+		grpcConfig.FailoverAfter = config.CloudFailover
+	}
+	if config.CloudFailback > 0 {
+		grpcConfig.FailbackInterval = config.CloudFailback
+	}
+	if config.CloudSessionTTL > 0 {
+		grpcConfig.SessionTTL = config.CloudSessionTTL
+		grpcConfig.SessionRefresh = min(grpcConfig.SessionRefresh, config.CloudSessionTTL/4)
+	}
 
 	cloudClient := cloud.NewGRPCClient(grpcConfig)
 	cloudClient.SetFirmwareVersion(config.FirmwareVersion)
 
-	// Create firmware client for OTA downloads
+	// Create firmware client for OTA downloads, sharing the stream's session
 	firmwareClient := cloud.NewFirmwareClient(grpcConfig)
+	cloudClient.SetSessionTokenHandler(firmwareClient.SetSessionToken)
 
 	// Create OTA manager
 	otaConfig := ota.DefaultConfig()
+	if config.FirmwareCacheDir != "" {
+		otaConfig.FirmwareCacheDir = config.FirmwareCacheDir
+	}
+	otaConfig.ChunkSize = config.OTA.ChunkSize
+	otaConfig.ChunkTimeout = config.OTA.ChunkTimeout
+	otaConfig.MaxRetries = config.OTA.ChunkRetries
+	otaConfig.AnnounceInterval = config.OTA.AnnounceInterval
+	otaConfig.WindowSize = config.OTA.WindowSize
+	otaConfig.MulticastPacing = config.OTA.MulticastPacing
+	otaConfig.AirtimeBudget = config.OTA.AirtimeBudget
+	otaConfig.AirtimeWindow = config.OTA.AirtimeWindow
+	// Chunks larger than a frame at the device's data rate go fragmented
 	otaSendFunc := func(deviceUID [8]byte, msgType uint8, payload []byte) error {
-		return loraDriver.SendToDevice(deviceUID, msgType, payload)
+		return loraDriver.SendFragmented(deviceUID, msgType, payload)
 	}
 	otaManager, err := ota.New(otaConfig, otaSendFunc, firmwareClient)
 	if err != nil {
 		db.Close()
-		loraDriver.Stop()
+		if config.SharedRadio == nil {
+			loraDriver.Stop()
+		}
 		return nil, fmt.Errorf("failed to create OTA manager: %w", err)
 	}
 
-	return &Engine{
+	e := &Engine{
 		config:            config,
 		db:                db,
+		recovery:          recovery,
 		lora:              loraDriver,
 		cloud:             cloudClient,
+		firmware:          firmwareClient,
+		cloudUsage:        grpcConfig.Usage,
 		ota:               otaManager,
+		notifier:          notify.New(config.Notify),
 		stopChan:          make(chan struct{}),
+		reloaded:          make(chan struct{}),
+		beats:             make(map[string]loopBeat),
 		registeredDevices: make(map[string]*storage.Device),
 		deviceVersions:    make(map[string]ota.Version),
-	}, nil
+		runtimeShutoffs:   make(map[string]time.Time),
+		rotations:         make(map[string]*keyRotation),
+		uplinks:           make(map[string]uplinkSeq),
+		versions:          make(map[string]uint8),
+		ingest:            make(map[string]*ingestBucket),
+		rssiBaselines:     make(map[string]*rssiBaseline),
+		quarantined:       make(map[string]string),
+		clocks:            make(map[string]*deviceClock),
+		fertigation:       make(map[string]*fertigationRun),
+		moisture:          make(map[moistureProbe]string),
+		cloudChanged:      make(chan struct{}, 1),
+		syncNow:           make(chan struct{}, 1),
+	}
+
+	// Create flow analytics (meter vs valve cross-check)
+	e.flow = analytics.NewFlowChecker(config.FlowAnalytics, db, e.handleDerivedAlarm)
+	e.flow.SetClearFunc(e.handleDerivedClear)
+
+	// Persist OTA progress so stuck updates can be diagnosed offline
+	otaManager.SetUpdateCallback(e.saveOTAUpdate)
+
+	// Keep firmware chunks to their share of the downlink
+	otaManager.SetAirtimeFunc(loraDriver.Airtime)
+	if config.OTA.PauseForCommands {
+		otaManager.SetBusyFunc(e.commandsPending)
+	}
+	otaManager.SetDownloadAllowedFunc(e.firmwareDownloadAllowed)
+
+	// Create local API server for on-site tools
+	if config.LocalAPISocket != "" {
+		apiConfig := localapi.DefaultConfig()
+		apiConfig.SocketPath = config.LocalAPISocket
+		apiConfig.Listen = config.LocalAPIListen
+		apiConfig.TLSCert = config.LocalAPITLSCert
+		apiConfig.TLSKey = config.LocalAPITLSKey
+		e.api = localapi.NewServer(apiConfig, &otaService{Manager: otaManager, engine: e}, e)
+		e.api.SetRollupService(rollupService{db: db})
+		e.api.SetKeyService(e)
+		e.api.SetValveService(e)
+		e.api.SetEmergencyService(emergencyService{engine: e})
+		e.api.SetScheduleService(e)
+		e.api.SetRecommendationService(e)
+		e.api.SetTokenService(e)
+	}
+
+	// Create Modbus TCP slave for SCADA integration
+	if config.Modbus.Listen != "" {
+		e.modbus = modbus.NewServer(config.Modbus, modbusSource{engine: e})
+	}
+
+	// Create the forecast source for weather-adjusted schedules
+	if config.Weather.OpenWeather.APIKey != "" {
+		e.weather = weather.NewOpenWeather(config.Weather.OpenWeather)
+	}
+
+	// Connect the event bus to the engine's own consumers
+	e.subscribe()
+
+	return e, nil
+}
+
+// databaseConfig returns the storage settings of an engine configuration
+func databaseConfig(config Config) storage.Config {
+	return storage.Config{Driver: config.DatabaseDriver, Path: config.DatabasePath, Postgres: config.Postgres}
 }
 
 // Start starts the engine
 func (e *Engine) Start(ctx context.Context) error {
-	// Set up LoRa receive callback
-	e.lora.SetReceiveCallback(e.handleLoRaMessage)
+	e.startedAt = time.Now()
 
 	// Set up gRPC callbacks for messages from cloud
 	e.cloud.SetValveCommandHandler(e.handleValveCommandGRPC)
 	e.cloud.SetScheduleHandler(e.handleScheduleUpdateGRPC)
 	e.cloud.SetDeviceAddedHandler(e.handleDeviceAddedGRPC)
 	e.cloud.SetConfigUpdateHandler(e.handleConfigUpdateGRPC)
+	e.cloud.SetMeterPinCommandHandler(e.handleMeterPinCommandGRPC)
+	e.cloud.SetLoRaStatsProvider(e.loraStats)
+	e.cloud.SetConnectionStateHandler(func(connected bool) {
+		e.bus.Cloud.publish(CloudState{Connected: connected})
+	})
+
+	if e.recovery != "" {
+		e.raiseAlert(&storage.Alert{
+			DeviceUID: e.config.ControllerID,
+			AlertType: alertDatabaseRecovered,
+			Severity:  storage.AlertCritical,
+			Message:   e.recovery,
+			Timestamp: e.startedAt,
+		})
+	}
+
+	// Restore rotated device keys before any traffic
+	if err := e.loadDeviceKeys(); err != nil {
+		return err
+	}
 
-	// Start LoRa driver
-	if err := e.lora.Start(); err != nil {
-		return fmt.Errorf("failed to start LoRa driver: %w", err)
+	e.loadDeviceClocks()
+	e.loadDeviceSequences()
+	e.loadProtocolVersions()
+	e.loadDeviceVersions()
+	e.loadSpoofingState()
+	e.loadCounters()
+
+	// Start LoRa driver, or join the one shared between properties
+	if shared := e.config.SharedRadio; shared != nil {
+		shared.attach(e)
+	} else {
+		e.lora.SetReceiveCallback(e.handleLoRaMessage)
+		e.lora.SetGatewayStatsCallback(e.handleGatewayStats)
+		e.lora.SetTxResultCallback(e.handleTxResult)
+		if err := e.lora.Start(); err != nil {
+			return fmt.Errorf("failed to start LoRa driver: %w", err)
+		}
 	}
 
 	// Start OTA manager
@@ -147,6 +491,23 @@ func (e *Engine) Start(ctx context.Context) error {
 		return fmt.Errorf("failed to start OTA manager: %w", err)
 	}
 
+	// Start flow analytics
+	e.flow.Start(ctx)
+
+	// Start local API (non-fatal: the controller runs fine without it)
+	if e.api != nil {
+		if err := e.api.Start(); err != nil {
+			log.Printf("Failed to start local API: %v", err)
+		}
+	}
+
+	// Start Modbus TCP (non-fatal, like the local API)
+	if e.modbus != nil {
+		if err := e.modbus.Start(); err != nil {
+			log.Printf("Failed to start Modbus TCP: %v", err)
+		}
+	}
+
 	// Connect to cloud (with automatic reconnection)
 	go e.cloud.ConnectWithRetry(ctx)
 
@@ -157,9 +518,46 @@ func (e *Engine) Start(ctx context.Context) error {
 	e.wg.Add(1)
 	go e.commandRetryLoop(ctx)
 
+	e.wg.Add(1)
+	go e.commandCleanupLoop(ctx)
+
 	e.wg.Add(1)
 	go e.timeSyncLoop(ctx)
 
+	e.wg.Add(1)
+	go e.valveRuntimeLoop(ctx)
+
+	e.wg.Add(1)
+	go e.valveTimerLoop(ctx)
+
+	// A PostgreSQL server checkpoints and vacuums itself
+	if e.db.Driver() == storage.DriverSQLite {
+		e.wg.Add(1)
+		go e.maintenanceLoop(ctx)
+	}
+
+	e.wg.Add(1)
+	go e.rollupLoop(ctx)
+
+	e.wg.Add(1)
+	go e.keyRotationLoop(ctx)
+
+	if e.weather != nil {
+		e.wg.Add(1)
+		go e.weatherLoop(ctx)
+	}
+
+	e.wg.Add(1)
+	go e.fertigationLoop(ctx)
+
+	e.wg.Add(1)
+	go e.alertLoop(ctx)
+
+	if e.config.WatchdogInterval > 0 {
+		e.wg.Add(1)
+		go e.watchdogLoop(ctx)
+	}
+
 	log.Println("Engine started")
 	return nil
 }
@@ -169,6 +567,18 @@ func (e *Engine) Stop() error {
 	close(e.stopChan)
 	e.wg.Wait()
 
+	if e.api != nil {
+		if err := e.api.Stop(); err != nil {
+			log.Printf("Error stopping local API: %v", err)
+		}
+	}
+
+	if e.modbus != nil {
+		if err := e.modbus.Stop(); err != nil {
+			log.Printf("Error stopping Modbus TCP: %v", err)
+		}
+	}
+
 	if err := e.cloud.Close(); err != nil {
 		log.Printf("Error stopping cloud client: %v", err)
 	}
@@ -176,7 +586,11 @@ func (e *Engine) Stop() error {
 	// Stop OTA manager
 	e.ota.Stop()
 
-	if err := e.lora.Stop(); err != nil {
+	e.flow.Stop()
+
+	if shared := e.config.SharedRadio; shared != nil {
+		shared.detach(e)
+	} else if err := e.lora.Stop(); err != nil {
 		log.Printf("Error stopping LoRa driver: %v", err)
 	}
 
@@ -191,6 +605,18 @@ func (e *Engine) Stop() error {
 // handleLoRaMessage processes incoming LoRa messages from devices
 func (e *Engine) handleLoRaMessage(msg *protocol.LoRaMessage) {
 	deviceUID := msg.DeviceUIDString()
+	logging.Debugf("RX type 0x%02X from %s seq %d, RSSI %d, %d bytes",
+		msg.Header.MsgType, deviceUID, msg.Header.Sequence, msg.RSSI, len(msg.Payload))
+	e.count(rxCounter(msg.Header.MsgType))
+
+	ctx, span := startReceiveSpan(deviceUID, msg)
+	defer span.End()
+
+	// A device spamming reports must not swamp the database or cloud sync
+	if !e.allowUplink(deviceUID, time.Now()) {
+		dropSpan(span, "throttled")
+		return
+	}
 
 	// Check if device is registered
 	e.mu.RLock()
@@ -202,27 +628,56 @@ func (e *Engine) handleLoRaMessage(msg *protocol.LoRaMessage) {
 		// Still process but mark as unregistered
 		device = &storage.Device{
 			UID:          deviceUID,
+			DeviceType:   msg.Header.DeviceType,
 			IsRegistered: false,
 		}
 	}
 
-	// Update device last seen
+	// A cloned or spoofed UID must not feed readings or the link history
 	now := time.Now()
+	if e.screenUplink(deviceUID, registered, msg, now) {
+		dropSpan(span, "quarantined")
+		return
+	}
+
+	// Update device last seen
 	device.LastSeen = now
 	device.RSSI = msg.RSSI
 	e.db.UpsertDevice(device)
+	e.recordLinkSample(deviceUID, msg, now)
+	e.recordProtocolVersion(deviceUID, msg.Header.Version)
+
+	// Retransmissions would store a report twice. A retransmitted report is
+	// still acked, since the device resent it for missing the ACK.
+	if e.isDuplicateUplink(deviceUID, msg, now) {
+		dropSpan(span, "duplicate")
+		e.ackUplink(deviceUID, msg, now)
+		return
+	}
+	// Reports are acked once handled, so the flags reflect what handling them
+	// left waiting for the device
+	defer e.ackUplink(deviceUID, msg, now)
 
 	// Process based on message type
 	switch msg.Header.MsgType {
 	case protocol.MsgTypeSensorReport:
-		e.handleSensorData(deviceUID, msg)
+		e.handleSensorData(ctx, deviceUID, msg)
 
 	case protocol.MsgTypeWaterMeterReport:
-		e.handleWaterMeterData(deviceUID, msg)
+		e.handleWaterMeterData(ctx, deviceUID, msg)
 
 	case protocol.MsgTypeMeterAlarm:
 		e.handleMeterAlarm(deviceUID, msg)
 
+	case protocol.MsgTypeMeterResetAck:
+		e.handleMeterResetAck(deviceUID, msg)
+
+	case protocol.MsgTypeMeterPinAck:
+		e.handleMeterPinAck(deviceUID, msg)
+
+	case protocol.MsgTypeMeterCalibrateAck:
+		e.handleMeterCalibrateAck(deviceUID, msg)
+
 	case protocol.MsgTypeValveStatus:
 		e.handleValveStatus(deviceUID, msg)
 
@@ -232,10 +687,35 @@ func (e *Engine) handleLoRaMessage(msg *protocol.LoRaMessage) {
 	case protocol.MsgTypeScheduleRequest:
 		e.handleScheduleRequest(deviceUID, msg)
 
+	case protocol.MsgTypeScheduleAck:
+		e.handleScheduleAck(deviceUID, msg)
+
 	case protocol.MsgTypeHeartbeat:
-		log.Printf("Heartbeat from %s, RSSI: %d", deviceUID, msg.RSSI)
+		e.handleHeartbeat(deviceUID, msg)
+
+	case protocol.MsgTypeLogBatch:
+		e.handleLogBatch(deviceUID, msg)
+
+	case protocol.MsgTypeTimeSyncAck:
+		e.handleTimeSyncAck(deviceUID, msg)
+
+	case protocol.MsgTypeNack:
+		e.handleNack(deviceUID, msg)
+
+	case protocol.MsgTypeConfigAck:
+		e.handleConfigAck(deviceUID, msg)
+
+	case protocol.MsgTypeKeyRotateAck:
+		e.handleKeyRotateAck(deviceUID, msg)
+
+	case protocol.MsgTypeInjectorAck:
+		e.handleInjectorAck(deviceUID, msg)
+
+	case protocol.MsgTypeDebugReply:
+		e.handleDebugReply(deviceUID, msg)
 
 	case protocol.MsgTypeOTARequest:
+		e.recordOTAFirmware(deviceUID, msg, time.Now())
 		if err := e.ota.HandleOTARequest(deviceUID, msg.Header.DeviceType, msg.Payload); err != nil {
 			log.Printf("Failed to handle OTA request from %s: %v", deviceUID, err)
 		}
@@ -246,20 +726,40 @@ func (e *Engine) handleLoRaMessage(msg *protocol.LoRaMessage) {
 		}
 
 	case protocol.MsgTypeOTAStatus:
+		e.recordOTAFirmware(deviceUID, msg, time.Now())
 		if err := e.ota.HandleOTAStatus(deviceUID, msg.Payload); err != nil {
 			log.Printf("Failed to handle OTA status from %s: %v", deviceUID, err)
 		}
 
+	case protocol.MsgTypeOTABitmap:
+		if err := e.ota.HandleOTABitmap(deviceUID, msg.Payload); err != nil {
+			log.Printf("Failed to handle OTA bitmap from %s: %v", deviceUID, err)
+		}
+
+	case protocol.MsgTypeOTAJoin:
+		if err := e.ota.HandleOTAJoin(deviceUID, msg.Header.DeviceType, msg.Payload); err != nil {
+			log.Printf("Failed to handle OTA join from %s: %v", deviceUID, err)
+		}
+
 	default:
 		log.Printf("Unknown message type 0x%02X from %s", msg.Header.MsgType, deviceUID)
 	}
 }
 
 // handleSensorData processes soil moisture sensor data
-func (e *Engine) handleSensorData(deviceUID string, msg *protocol.LoRaMessage) {
+func (e *Engine) handleSensorData(ctx context.Context, deviceUID string, msg *protocol.LoRaMessage) {
+	// Batched multi-probe reports are larger than the legacy single-probe payload
+	if len(msg.Payload) >= protocol.SoilReportSize {
+		e.handleSoilReport(ctx, deviceUID, msg)
+		return
+	}
+
+	span := startSpan(ctx, "decode")
 	data, err := protocol.DecodeSensorData(msg.Payload)
+	endSpan(span, err)
 	if err != nil {
 		log.Printf("Failed to decode sensor data from %s: %v", deviceUID, err)
+		e.count(counterDecodeFailures)
 		return
 	}
 
@@ -274,25 +774,93 @@ func (e *Engine) handleSensorData(deviceUID string, msg *protocol.LoRaMessage) {
 		RSSI:            msg.RSSI,
 		Timestamp:       time.Now(),
 	}
+	if !e.validateSoilReading(reading) {
+		return
+	}
 
+	span = startSpan(ctx, "store")
 	id, err := e.db.InsertSoilMoistureReading(reading)
+	endSpan(span, err)
 	if err != nil {
 		log.Printf("Failed to store sensor reading: %v", err)
 		return
 	}
+	e.traceStored(ctx, storage.SyncSoilReadings, deviceUID)
 
 	log.Printf("Sensor data from %s probe %d: %d%% moisture, %d°C, %dmV battery",
 		deviceUID, data.ProbeID, data.MoisturePercent, data.Temperature/10, data.BatteryMV)
 
-	// Queue for cloud sync
-	e.queueForCloudSync("sensor", id, reading)
+	e.bus.Sensor.publish(SensorReceived{
+		ID:          id,
+		DeviceUID:   deviceUID,
+		Readings:    []*storage.SoilMoistureReading{reading},
+		Temperature: data.Temperature,
+	})
+}
+
+// handleSoilReport processes a multi-probe soil report, storing all probes
+// as one timestamped group
+func (e *Engine) handleSoilReport(ctx context.Context, deviceUID string, msg *protocol.LoRaMessage) {
+	span := startSpan(ctx, "decode")
+	data, err := protocol.DecodeSoilReport(msg.Payload)
+	endSpan(span, err)
+	if err != nil {
+		log.Printf("Failed to decode soil report from %s: %v", deviceUID, err)
+		e.count(counterDecodeFailures)
+		return
+	}
+
+	report := &storage.SoilReport{
+		DeviceUID:   deviceUID,
+		ProbeCount:  data.ProbeCount,
+		Temperature: data.Temperature,
+		BatteryMV:   data.BatteryMV,
+		Flags:       data.Flags,
+		RSSI:        msg.RSSI,
+		Timestamp:   time.Now(),
+	}
+
+	probes := data.ValidProbes()
+	readings := make([]*storage.SoilMoistureReading, 0, len(probes))
+	for _, p := range probes {
+		readings = append(readings, &storage.SoilMoistureReading{
+			ProbeID:         p.ProbeIndex,
+			MoistureRaw:     p.FrequencyHz,
+			MoisturePercent: p.MoisturePercent,
+		})
+	}
+	if readings = e.validateSoilReport(report, readings); len(readings) == 0 {
+		return
+	}
+
+	span = startSpan(ctx, "store")
+	id, err := e.db.InsertSoilReport(report, readings)
+	endSpan(span, err)
+	if err != nil {
+		log.Printf("Failed to store soil report: %v", err)
+		return
+	}
+	e.traceStored(ctx, storage.SyncSoilReadings, deviceUID)
+
+	log.Printf("Soil report from %s: %d probes, %d°C, %dmV battery",
+		deviceUID, data.ProbeCount, data.Temperature/10, data.BatteryMV)
+	e.bus.Sensor.publish(SensorReceived{
+		ID:          id,
+		DeviceUID:   deviceUID,
+		Report:      report,
+		Readings:    readings,
+		Temperature: data.Temperature,
+	})
 }
 
 // handleWaterMeterData processes water meter data
-func (e *Engine) handleWaterMeterData(deviceUID string, msg *protocol.LoRaMessage) {
+func (e *Engine) handleWaterMeterData(ctx context.Context, deviceUID string, msg *protocol.LoRaMessage) {
+	span := startSpan(ctx, "decode")
 	data, err := protocol.DecodeWaterMeter(msg.Payload)
+	endSpan(span, err)
 	if err != nil {
 		log.Printf("Failed to decode water meter data from %s: %v", deviceUID, err)
+		e.count(counterDecodeFailures)
 		return
 	}
 
@@ -308,18 +876,24 @@ func (e *Engine) handleWaterMeterData(deviceUID string, msg *protocol.LoRaMessag
 		RSSI:          msg.RSSI,
 		Timestamp:     time.Now(),
 	}
+	totalizer := e.reconcileTotalizer(reading)
+	if !e.validateMeterReading(reading) {
+		return
+	}
+	e.saveTotalizer(totalizer)
 
+	span = startSpan(ctx, "store")
 	id, err := e.db.InsertWaterMeterReading(reading)
+	endSpan(span, err)
 	if err != nil {
 		log.Printf("Failed to store water meter reading: %v", err)
 		return
 	}
+	e.traceStored(ctx, storage.SyncMeterReadings, deviceUID)
 
 	log.Printf("Water meter from %s: %.2f L total, %.2f L/min flow, signal=%.1f µV",
 		deviceUID, data.TotalVolumeL, reading.FlowRateLPM, data.SignalUV)
-
-	// Queue for cloud sync
-	e.queueForCloudSync("meter", id, reading)
+	e.bus.Meter.publish(MeterReceived{ID: id, Reading: reading})
 }
 
 // handleMeterAlarm processes water meter alarm messages
@@ -327,6 +901,7 @@ func (e *Engine) handleMeterAlarm(deviceUID string, msg *protocol.LoRaMessage) {
 	alarm, err := protocol.DecodeMeterAlarm(msg.Payload)
 	if err != nil {
 		log.Printf("Failed to decode meter alarm from %s: %v", deviceUID, err)
+		e.count(counterDecodeFailures)
 		return
 	}
 
@@ -350,38 +925,37 @@ func (e *Engine) handleMeterAlarm(deviceUID string, msg *protocol.LoRaMessage) {
 		log.Printf("Failed to store meter alarm: %v", err)
 		return
 	}
-
-	// Queue for immediate cloud sync (high priority)
-	e.queueForCloudSync("meter_alarm", id, meterAlarm)
-
-	// If alarm is active (not cleared), send to cloud immediately
-	if alarm.AlarmType != protocol.MeterAlarmCleared {
-		go e.sendAlarmToCloud(deviceUID, meterAlarm)
-	}
+	meterAlarm.ID = id
+	e.bus.Alarm.publish(AlarmRaised{Alarm: meterAlarm})
 }
 
-// sendAlarmToCloud sends an alarm to the cloud immediately
-func (e *Engine) sendAlarmToCloud(deviceUID string, alarm *storage.MeterAlarm) {
-	if !e.cloud.IsConnected() {
-		log.Printf("Cannot send alarm to cloud: not connected")
+// handleDerivedAlarm stores an alarm raised by flow analytics
+func (e *Engine) handleDerivedAlarm(alarm *storage.MeterAlarm) {
+	id, err := e.db.InsertMeterAlarm(alarm)
+	if err != nil {
+		log.Printf("Failed to store derived alarm: %v", err)
 		return
 	}
+	alarm.ID = id
+	e.bus.Alarm.publish(AlarmRaised{Alarm: alarm})
+}
 
-	// Convert storage.MeterAlarm to cloud.MeterAlarmData
-	alarmData := &cloud.MeterAlarmData{
-		AlarmType:    alarm.AlarmType,
-		FlowRateLPM:  alarm.FlowRateLPM,
-		DurationSec:  alarm.DurationSec,
-		TotalVolumeL: alarm.TotalVolumeL,
-		RSSI:         alarm.RSSI,
-		Timestamp:    alarm.Timestamp,
+// alarmAlerts raises an alert for a meter alarm, or clears them all when the
+// meter reports its alarms cleared
+func (e *Engine) alarmAlerts(ev AlarmRaised) {
+	alarm := ev.Alarm
+	if alarm.AlarmType == protocol.MeterAlarmCleared {
+		e.clearAlerts(alarm.DeviceUID, 0, meterAlertType(protocol.MeterAlarmLeak), meterAlertType(protocol.MeterAlarmReverse),
+			meterAlertType(protocol.MeterAlarmTamper), meterAlertType(protocol.MeterAlarmHighFlow))
+		return
 	}
+	e.raiseMeterAlert(alarm)
+}
 
-	if err := e.cloud.SendMeterAlarm(deviceUID, alarmData); err != nil {
-		log.Printf("Failed to send alarm to cloud: %v", err)
-	} else {
-		log.Printf("Alarm sent to cloud for device %s", deviceUID)
-	}
+// handleDerivedClear clears the alert for a derived alarm whose condition
+// has passed
+func (e *Engine) handleDerivedClear(alarm *storage.MeterAlarm) {
+	e.clearAlerts(alarm.DeviceUID, 0, meterAlertType(alarm.AlarmType))
 }
 
 // SendAck sends an acknowledgment to a device
@@ -391,12 +965,7 @@ func (e *Engine) SendAck(deviceUID string, deviceType uint8, sequence uint16, st
 		return fmt.Errorf("invalid device UID: %w", err)
 	}
 
-	// Check if OTA is pending for this device
-	e.mu.RLock()
-	currentVersion, hasVersion := e.deviceVersions[deviceUID]
-	e.mu.RUnlock()
-
-	if hasVersion && e.ota.ShouldSetOTAPending(deviceUID, deviceType, currentVersion) {
+	if e.otaPending(deviceUID, deviceType) {
 		flags |= protocol.AckFlagOTAPending
 		log.Printf("Setting OTA_PENDING flag for device %s", deviceUID)
 	}
@@ -411,27 +980,70 @@ func (e *Engine) SendAck(deviceUID string, deviceType uint8, sequence uint16, st
 	return e.lora.SendToDevice(uid, protocol.MsgTypeAck, payload)
 }
 
-// SendMeterConfig sends a configuration update to a water meter device
-func (e *Engine) SendMeterConfig(deviceUID string, config *protocol.MeterConfigPayload) error {
+// otaPending reports whether an OTA update waits for a device, because it
+// runs older firmware than the cached release or an update was started
+func (e *Engine) otaPending(deviceUID string, deviceType uint8) bool {
+	e.mu.RLock()
+	currentVersion, hasVersion := e.deviceVersions[deviceUID]
+	e.mu.RUnlock()
+
+	return (hasVersion && e.ota.ShouldSetOTAPending(deviceUID, deviceType, currentVersion)) || e.ota.IsPending(deviceUID)
+}
+
+// SendMeterConfig sends a configuration update to a water meter device, in
+// the receive window after its next uplink. The source and actor are
+// recorded in the command audit log.
+func (e *Engine) SendMeterConfig(deviceUID string, config *protocol.MeterConfigPayload, source, actor string) error {
+	entry := &storage.CommandAudit{
+		Kind:      "meter_config",
+		DeviceUID: deviceUID,
+		Command:   "config",
+		Params:    auditParams(config),
+		Source:    source,
+		Actor:     actor,
+		Outcome:   storage.AuditSent,
+	}
+	defer e.auditCommand(entry)
+
 	uid, err := lora.ParseDeviceUID(deviceUID)
 	if err != nil {
+		entry.Outcome, entry.Detail = storage.AuditRejected, err.Error()
 		return fmt.Errorf("invalid device UID: %w", err)
 	}
 
 	payload := config.Encode()
-	return e.lora.SendToDevice(uid, protocol.MsgTypeConfigUpdate, payload)
+	if err := e.lora.SendInWindow(uid, protocol.MsgTypeConfigUpdate, payload); err != nil {
+		entry.Outcome, entry.Detail = storage.AuditSendFailed, err.Error()
+		return err
+	}
+	return nil
 }
 
-// SendMeterReset sends a totalizer reset command to a water meter
-func (e *Engine) SendMeterReset(deviceUID string, resetToZero bool, newTotal uint32) error {
+// SendMeterReset sends a totalizer reset command to a water meter, in the
+// receive window after its next uplink. The source and actor are recorded in
+// the command audit log.
+func (e *Engine) SendMeterReset(deviceUID string, resetToZero bool, newTotal uint32, source, actor string) error {
+	// Generate command ID
+	cmdID := uint16(atomic.AddUint32(&e.commandID, 1))
+
+	entry := &storage.CommandAudit{
+		Kind:      "meter_reset",
+		DeviceUID: deviceUID,
+		Command:   "reset_total",
+		Params:    auditParams(map[string]interface{}{"reset_to_zero": resetToZero, "new_total_liters": newTotal}),
+		Source:    source,
+		Actor:     actor,
+		CommandID: cmdID,
+		Outcome:   storage.AuditSent,
+	}
+	defer e.auditCommand(entry)
+
 	uid, err := lora.ParseDeviceUID(deviceUID)
 	if err != nil {
+		entry.Outcome, entry.Detail = storage.AuditRejected, err.Error()
 		return fmt.Errorf("invalid device UID: %w", err)
 	}
 
-	// Generate command ID
-	cmdID := uint16(atomic.AddUint32(&e.commandID, 1))
-
 	resetType := uint8(0)
 	if !resetToZero {
 		resetType = 1
@@ -444,10 +1056,13 @@ func (e *Engine) SendMeterReset(deviceUID string, resetToZero bool, newTotal uin
 	}
 
 	payload := reset.Encode()
-	if err := e.lora.SendToDevice(uid, protocol.MsgTypeMeterResetTotal, payload); err != nil {
+	if err := e.lora.SendInWindow(uid, protocol.MsgTypeMeterResetTotal, payload); err != nil {
+		entry.Outcome, entry.Detail = storage.AuditSendFailed, err.Error()
 		return err
 	}
 
+	e.expectReset(deviceUID, cmdID, float64(reset.NewTotalLiters))
+
 	log.Printf("Sent meter reset to %s: cmdID=%d, resetType=%d", deviceUID, cmdID, resetType)
 	return nil
 }
@@ -457,19 +1072,33 @@ func (e *Engine) handleValveStatus(deviceUID string, msg *protocol.LoRaMessage)
 	status, err := protocol.DecodeValveStatus(msg.Payload)
 	if err != nil {
 		log.Printf("Failed to decode valve status from %s: %v", deviceUID, err)
+		e.count(counterDecodeFailures)
 		return
 	}
 
-	// Update actuator state in database
+	// Update actuator state in database. A change of state is an actuation,
+	// whose current is kept for the actuator's health.
+	prev, known, err := e.db.GetValveActuatorState(deviceUID, status.ActuatorAddr)
+	if err != nil {
+		log.Printf("Failed to get valve state: %v", err)
+	}
 	if err := e.db.UpdateValveActuatorState(deviceUID, status.ActuatorAddr, status.State); err != nil {
 		log.Printf("Failed to update valve state: %v", err)
 	}
+	if status.State == protocol.ValveStateClosed {
+		e.clearAlerts(deviceUID, status.ActuatorAddr, alertValveRuntimeLimit)
+	}
 
 	stateStr := valveStateString(status.State)
 	log.Printf("Valve status from %s addr %d: %s, current: %dmA, flags: 0x%02X",
 		deviceUID, status.ActuatorAddr, stateStr, status.CurrentMA, status.Flags)
+	if !known || prev != status.State {
+		e.recordActuation(deviceUID, status, time.Now())
+	}
+	e.checkPower(deviceUID, status.Flags, time.Now())
 
-	// Record event
+	// Record event. A change made by hand at the valve holds off schedules
+	// and rules for a while.
 	event := &storage.ValveEvent{
 		ControllerUID: deviceUID,
 		ActuatorAddr:  status.ActuatorAddr,
@@ -477,15 +1106,17 @@ func (e *Engine) handleValveStatus(deviceUID string, msg *protocol.LoRaMessage)
 		Source:        "status",
 		Timestamp:     time.Now(),
 	}
+	if status.Flags&protocol.ValveFlagManual != 0 {
+		event.Source = sourceManual
+		e.startManualOverride(deviceUID, status.ActuatorAddr, status.State, event.Timestamp)
+	}
 
 	id, err := e.db.InsertValveEvent(event)
 	if err != nil {
 		log.Printf("Failed to store valve event: %v", err)
 		return
 	}
-
-	// Queue for cloud sync
-	e.queueForCloudSync("valve_event", id, event)
+	e.bus.Valve.publish(ValveChanged{ID: id, Event: event})
 }
 
 // handleValveAck processes valve command acknowledgments
@@ -493,9 +1124,18 @@ func (e *Engine) handleValveAck(deviceUID string, msg *protocol.LoRaMessage) {
 	ack, err := protocol.DecodeValveAck(msg.Payload)
 	if err != nil {
 		log.Printf("Failed to decode valve ack from %s: %v", deviceUID, err)
+		e.count(counterDecodeFailures)
 		return
 	}
 
+	// Look up the command before acknowledging it, for its cloud command ID
+	// or its group
+	cmdIDStr := fmt.Sprintf("%d", ack.CommandID)
+	pending, err := e.db.GetPendingCommand(ack.CommandID)
+	if err == nil && pending.CloudCommandID != "" {
+		cmdIDStr = pending.CloudCommandID
+	}
+
 	// Mark command as acknowledged
 	if err := e.db.AcknowledgeCommand(ack.CommandID, ack.ResultState); err != nil {
 		log.Printf("Failed to acknowledge command %d: %v", ack.CommandID, err)
@@ -505,6 +1145,9 @@ func (e *Engine) handleValveAck(deviceUID string, msg *protocol.LoRaMessage) {
 	if err := e.db.UpdateValveActuatorState(deviceUID, ack.ActuatorAddr, ack.ResultState); err != nil {
 		log.Printf("Failed to update valve state: %v", err)
 	}
+	if ack.ResultState == protocol.ValveStateClosed {
+		e.clearAlerts(deviceUID, ack.ActuatorAddr, alertValveRuntimeLimit)
+	}
 
 	successStr := "SUCCESS"
 	if !ack.Success {
@@ -512,9 +1155,26 @@ func (e *Engine) handleValveAck(deviceUID string, msg *protocol.LoRaMessage) {
 	}
 	log.Printf("Valve ack from %s addr %d: cmd %d %s, state: %s",
 		deviceUID, ack.ActuatorAddr, ack.CommandID, successStr, valveStateString(ack.ResultState))
+	if ack.Success {
+		e.auditOutcome(deviceUID, ack.CommandID, storage.AuditAcked, valveStateString(ack.ResultState))
+		e.clearAlerts(deviceUID, ack.ActuatorAddr, alertCommandFailed)
+	} else {
+		e.auditOutcome(deviceUID, ack.CommandID, storage.AuditNacked, valveStateString(ack.ResultState))
+		e.raiseCommandFailed(deviceUID, ack.ActuatorAddr, "rejected by the controller")
+	}
+
+	// A group member's outcome reaches the cloud with the rest of its group
+	if pending != nil && pending.GroupID != 0 {
+		if !ack.Success {
+			if err := e.db.MarkCommandFailed(pending.ID, "rejected by the controller"); err != nil {
+				log.Printf("Failed to mark command %d failed: %v", ack.CommandID, err)
+			}
+		}
+		e.resolveCommandGroup(pending.GroupID)
+		return
+	}
 
 	// Send acknowledgment to cloud via gRPC
-	cmdIDStr := fmt.Sprintf("%d", ack.CommandID)
 	errMsg := ""
 	if !ack.Success {
 		errMsg = "command failed"
@@ -524,39 +1184,103 @@ func (e *Engine) handleValveAck(deviceUID string, msg *protocol.LoRaMessage) {
 	}
 }
 
+// handleNack fails the command a device refused, reporting the device's
+// error to the cloud instead of waiting for the command to time out. A busy
+// device is left to the normal retries.
+func (e *Engine) handleNack(deviceUID string, msg *protocol.LoRaMessage) {
+	nack, err := protocol.DecodeAck(msg.Payload)
+	if err != nil {
+		log.Printf("Failed to decode NACK from %s: %v", deviceUID, err)
+		e.count(counterDecodeFailures)
+		return
+	}
+	reason := protocol.NackErrorString(nack.Status)
+
+	cmd, err := e.db.GetUnresolvedCommandBySequence(deviceUID, nack.AckedSequence)
+	if err != nil {
+		log.Printf("NACK from %s for seq %d: %s", deviceUID, nack.AckedSequence, reason)
+		return
+	}
+	if nack.Status == protocol.NackErrBusy {
+		log.Printf("Command %d to %s addr %d NACKed: %s, will retry", cmd.CommandID, deviceUID, cmd.ActuatorAddr, reason)
+		return
+	}
+
+	log.Printf("Command %d to %s addr %d failed: NACKed with %s", cmd.CommandID, deviceUID, cmd.ActuatorAddr, reason)
+	e.failCommand(cmd, storage.AuditNacked, "rejected by device: "+reason)
+}
+
+// handleTxResult fails a valve command as soon as the driver reports its
+// transmission failed, instead of leaving it to time out. Other downlinks
+// are only logged, since they have no pending command to fail.
+func (e *Engine) handleTxResult(result lora.TxResult) {
+	if result.Err == nil {
+		return
+	}
+	deviceUID := lora.DeviceUIDToString(result.DeviceUID)
+	if result.MsgType != protocol.MsgTypeValveCommand {
+		log.Printf("Downlink 0x%02x to %s seq %d not sent: %v", result.MsgType, deviceUID, result.Sequence, result.Err)
+		return
+	}
+
+	e.txMu.Lock()
+	cmd, err := e.db.GetUnresolvedCommandBySequence(deviceUID, result.Sequence)
+	e.txMu.Unlock()
+	if err != nil {
+		log.Printf("Valve command to %s seq %d not sent: %v", deviceUID, result.Sequence, result.Err)
+		return
+	}
+
+	log.Printf("Command %d to %s addr %d failed: %v", cmd.CommandID, deviceUID, cmd.ActuatorAddr, result.Err)
+	e.failCommand(cmd, storage.AuditSendFailed, "transmit failed: "+result.Err.Error())
+}
+
 // handleScheduleRequest processes schedule requests from valve controllers
 func (e *Engine) handleScheduleRequest(deviceUID string, msg *protocol.LoRaMessage) {
 	log.Printf("Schedule request from %s", deviceUID)
+	e.sendSchedule(deviceUID)
+}
 
+// sendSchedule sends a valve controller its schedule and awaits its ack,
+// reporting whether the controller has a schedule. While an emergency stop is
+// in force the schedule goes out with no entries.
+func (e *Engine) sendSchedule(deviceUID string) bool {
 	// Get schedule for this controller
 	schedule, entries, err := e.db.GetScheduleForController(deviceUID)
 	if err != nil {
 		log.Printf("No schedule found for %s: %v", deviceUID, err)
-		return
+		return false
 	}
 
-	// Convert to protocol format
-	protoEntries := make([]protocol.ScheduleEntry, len(entries))
-	for i, e := range entries {
-		protoEntries[i] = protocol.ScheduleEntry{
-			DayMask:      e.DayMask,
-			StartHour:    e.StartHour,
-			StartMinute:  e.StartMinute,
-			DurationMins: e.DurationMins,
-			ActuatorMask: e.ActuatorMask,
+	// Convert to protocol format, adjusted for the weather
+	var protoEntries []protocol.ScheduleEntry
+	if e.emergencyStopped() {
+		log.Printf("Schedule for %s held back by emergency stop", deviceUID)
+	} else {
+		now := time.Now()
+		adj := e.currentWeather(now)
+		protoEntries = weatherScheduleEntries(entries, adj)
+		if adj.reason != "" {
+			log.Printf("Schedule for %s adjusted for weather: %s", deviceUID, adj)
 		}
+		protoEntries = e.drydownScheduleEntries(deviceUID, protoEntries, now)
 	}
 
-	// Send schedule to device
+	// Send schedule to device, fragmented if too large for one frame
 	uid, _ := lora.ParseDeviceUID(deviceUID)
-	scheduleMsg := lora.CreateScheduleUpdateMessage(uid, schedule.Version, protoEntries)
-	scheduleMsg.Header.Sequence = e.lora.GetNextSeqNum()
+	payload := &protocol.ScheduleUpdatePayload{
+		Version:    schedule.Version,
+		EntryCount: uint8(len(protoEntries)),
+		Entries:    protoEntries,
+	}
 
-	if err := e.lora.Send(scheduleMsg); err != nil {
+	if err := e.lora.SendFragmented(uid, protocol.MsgTypeScheduleUpdate, payload.Encode()); err != nil {
 		log.Printf("Failed to send schedule to %s: %v", deviceUID, err)
 	} else {
-		log.Printf("Sent schedule v%d with %d entries to %s", schedule.Version, len(entries), deviceUID)
+		log.Printf("Sent schedule v%d with %d entries to %s", schedule.Version, len(protoEntries), deviceUID)
 	}
+	e.scheduleSent(deviceUID, schedule.Version)
+	return true
 }
 
 // handleDeviceAdded processes device added notifications from the cloud
@@ -581,13 +1305,33 @@ func (e *Engine) handleDeviceAdded(data json.RawMessage) {
 		LastSeen:     time.Now(),
 	}
 	e.registeredDevices[deviceInfo.DeviceUID] = device
+	if shared := e.config.SharedRadio; shared != nil {
+		shared.claim(deviceInfo.DeviceUID, e)
+	}
 
 	// Store in database
 	if err := e.db.UpsertDevice(device); err != nil {
 		log.Printf("Failed to store device %s: %v", deviceInfo.DeviceUID, err)
 	}
+	// Approval vouches for a device quarantined as a suspected spoof
+	e.releaseDevice(deviceInfo.DeviceUID)
 
 	log.Printf("Device added: %s (%s) - %s", deviceInfo.DeviceUID, deviceInfo.DeviceType, deviceInfo.Name)
+
+	// Valve actuators carry their controller and address in the config
+	if device.DeviceType == protocol.DeviceTypeValveActuator {
+		controllerUID, _ := deviceInfo.Config["controller_uid"].(string)
+		addr, ok := deviceInfo.Config["actuator_address"].(float64)
+		if controllerUID == "" || !ok {
+			log.Printf("Cannot map valve %s: missing controller_uid or actuator_address", deviceInfo.DeviceID)
+			return
+		}
+		valveID := deviceInfo.DeviceID
+		if valveID == "" {
+			valveID = deviceInfo.DeviceUID
+		}
+		e.registerValve(valveID, controllerUID, uint8(addr), deviceInfo.Name, deviceInfo.ZoneID)
+	}
 }
 
 // handleConfigUpdate processes config updates from the cloud
@@ -610,41 +1354,7 @@ func (e *Engine) handleScheduleUpdate(data json.RawMessage) {
 		return
 	}
 
-	// Process each schedule in the update
-	for _, sched := range update.Schedules {
-		// Convert days to day mask
-		dayMask := daysToDayMask(sched.Days)
-		startHour, startMinute := parseStartTime(sched.StartTime)
-
-		// Convert to storage format
-		schedule := &storage.Schedule{
-			UID:      sched.ScheduleID,
-			Name:     sched.Name,
-			IsActive: sched.Enabled,
-		}
-
-		// Create a single entry for this schedule
-		var actuatorMask uint64
-		for _, v := range sched.Valves {
-			actuatorMask |= (1 << v.ActuatorAddress)
-		}
-
-		entries := []storage.ScheduleEntry{{
-			DayMask:      dayMask,
-			StartHour:    startHour,
-			StartMinute:  startMinute,
-			DurationMins: uint16(sched.DurationMinutes),
-			ActuatorMask: actuatorMask,
-		}}
-
-		// Store in database
-		if err := e.db.UpsertSchedule(schedule, entries); err != nil {
-			log.Printf("Failed to store schedule: %v", err)
-			continue
-		}
-
-		log.Printf("Updated schedule %s: %s", sched.ScheduleID, sched.Name)
-	}
+	e.applySchedules(jsonSchedules(update))
 }
 
 // deviceTypeFromString converts a device type string to uint8
@@ -663,6 +1373,22 @@ func deviceTypeFromString(s string) uint8 {
 	}
 }
 
+// deviceTypeToString converts a device type to its cloud name
+func deviceTypeToString(t uint8) string {
+	switch t {
+	case 0x01:
+		return "soil_moisture"
+	case 0x02:
+		return "valve_controller"
+	case 0x03:
+		return "water_meter"
+	case 0x04:
+		return "valve_actuator"
+	default:
+		return fmt.Sprintf("unknown_%d", t)
+	}
+}
+
 // daysToDayMask converts a slice of day strings to a bitmask
 func daysToDayMask(days []string) uint8 {
 	var mask uint8
@@ -687,13 +1413,6 @@ func daysToDayMask(days []string) uint8 {
 	return mask
 }
 
-// parseStartTime parses a time string like "06:00" into hour and minute
-func parseStartTime(s string) (uint8, uint8) {
-	var hour, minute int
-	fmt.Sscanf(s, "%d:%d", &hour, &minute)
-	return uint8(hour), uint8(minute)
-}
-
 // handleValveCommand processes immediate valve commands from the cloud
 func (e *Engine) handleValveCommand(data json.RawMessage) {
 	cmd, err := cloud.ParseValveCommand(data)
@@ -719,45 +1438,155 @@ func (e *Engine) handleValveCommand(data json.RawMessage) {
 		return
 	}
 
-	// Send command to device
-	// TODO: Need to map valve_id to controller_uid - for now use valve_id as controller
-	controllerUID := cmd.ValveID // This should be looked up from database
-	if err := e.SendValveCommand(controllerUID, cmd.ActuatorAddress, protoCmd); err != nil {
-		log.Printf("Failed to send valve command: %v", err)
+	origin := storage.CommandAudit{
+		Source:         sourceCloud,
+		Actor:          cmd.SourceID,
+		CloudCommandID: cmd.CommandID,
+		Params: auditParams(map[string]interface{}{
+			"valve_id": cmd.ValveID, "duration_seconds": cmd.DurationSeconds, "priority": cmd.Priority}),
+	}
+	if cmd.Source == sourceSchedule {
+		origin.Source = sourceSchedule
 	}
-}
-
-// SendValveCommand sends a valve command to a device and tracks it
-func (e *Engine) SendValveCommand(controllerUID string, actuatorAddr uint8, command uint8) error {
-	// Generate command ID
-	cmdID := uint16(atomic.AddUint32(&e.commandID, 1))
 
-	// Parse device UID
-	uid, err := lora.ParseDeviceUID(controllerUID)
+	// Resolve the valve to its controller and actuator address
+	controllerUID, addr, err := e.resolveValve(cmd.ValveID, "", cmd.ActuatorAddress)
 	if err != nil {
-		return fmt.Errorf("invalid controller UID: %w", err)
+		log.Printf("Cannot send valve command: %v", err)
+		e.auditRejectedValve(cmd.ValveID, cmd.ActuatorAddress, protoCmd, origin, err)
+		if cmd.CommandID != "" {
+			e.cloud.SendCommandAck(cmd.CommandID, false, err.Error())
+		}
+		return
 	}
 
-	// Create and send message
-	msg := lora.CreateValveCommand(uid, actuatorAddr, command, cmdID)
-	msg.Header.Sequence = e.lora.GetNextSeqNum()
-
-	if err := e.lora.Send(msg); err != nil {
-		return fmt.Errorf("failed to send command: %w", err)
+	sent := e.sendCloudValveCommand(controllerUID, addr, protoCmd, origin)
+	if sent && protoCmd == protocol.ValveCmdOpen && cmd.DurationSeconds != nil && *cmd.DurationSeconds > 0 {
+		e.startValveTimer(controllerUID, addr, time.Duration(*cmd.DurationSeconds)*time.Second, cmd.CommandID)
 	}
+}
 
-	// Store pending command for tracking
-	pending := &storage.PendingCommand{
-		CommandID:     cmdID,
-		ControllerUID: controllerUID,
-		ActuatorAddr:  actuatorAddr,
-		Command:       command,
-		ExpiresAt:     time.Now().Add(e.config.CommandTimeout),
-		MaxRetries:    e.config.CommandRetries,
+// resolveValve returns the controller UID and actuator address for a cloud
+// valve ID. An explicit controller UID (with its address) is used as-is when
+// the valve ID isn't mapped.
+func (e *Engine) resolveValve(valveID, controllerUID string, addr uint8) (string, uint8, error) {
+	if valveID != "" {
+		actuator, err := e.db.LookupValve(valveID)
+		if err != nil {
+			return "", 0, fmt.Errorf("failed to look up valve %s: %w", valveID, err)
+		}
+		if actuator != nil {
+			return actuator.ControllerUID, actuator.Address, nil
+		}
 	}
 
-	if _, err := e.db.InsertPendingCommand(pending); err != nil {
-		log.Printf("Failed to store pending command: %v", err)
+	if controllerUID != "" {
+		return controllerUID, addr, nil
+	}
+	return "", 0, fmt.Errorf("valve %s is not mapped to a controller", valveID)
+}
+
+// registerValve records a cloud valve ID mapping
+func (e *Engine) registerValve(valveID, controllerUID string, addr uint8, name, zoneID string) {
+	if err := e.db.RegisterValve(valveID, controllerUID, addr, name, zoneID); err != nil {
+		log.Printf("Failed to register valve %s: %v", valveID, err)
+		return
+	}
+	log.Printf("Valve %s mapped to %s addr %d", valveID, controllerUID, addr)
+}
+
+// parseActuatorUID splits a valve actuator UID ("<controller-uid>_<addr>")
+func parseActuatorUID(uid string) (string, uint8, error) {
+	controllerUID, addrStr, ok := strings.Cut(uid, "_")
+	if !ok {
+		return "", 0, fmt.Errorf("invalid actuator UID: %s", uid)
+	}
+	addr, err := strconv.ParseUint(addrStr, 10, 8)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid actuator address in %s: %w", uid, err)
+	}
+	return controllerUID, uint8(addr), nil
+}
+
+// SendValveCommand sends a valve command to a device and tracks it. The
+// source and actor are recorded in the command audit log.
+func (e *Engine) SendValveCommand(controllerUID string, actuatorAddr uint8, command uint8, source, actor string) error {
+	return e.sendValveCommand(controllerUID, actuatorAddr, command, storage.CommandAudit{Source: source, Actor: actor}, 0)
+}
+
+// sendValveCommand sends a valve command and audits it. The origin carries
+// the source, actor, parameters, and cloud command ID of the request; the
+// cloud command ID is kept alongside the LoRa command ID. A member of a
+// command group (group non-zero) leaves the cloud command ID to its group,
+// which acknowledges it.
+func (e *Engine) sendValveCommand(controllerUID string, actuatorAddr uint8, command uint8, origin storage.CommandAudit, group int64) error {
+	// Generate command ID
+	cmdID := uint16(atomic.AddUint32(&e.commandID, 1))
+
+	entry := origin
+	entry.Kind = "valve"
+	entry.DeviceUID = controllerUID
+	entry.ActuatorAddr = actuatorAddr
+	entry.Command = valveCommandString(command)
+	entry.CommandID = cmdID
+	entry.Outcome = storage.AuditSent
+
+	// Nothing opens while an emergency stop is in force
+	if command == protocol.ValveCmdOpen && e.emergencyStopped() {
+		entry.Outcome, entry.Detail = storage.AuditRejected, errEmergencyStop.Error()
+		e.auditCommand(&entry)
+		return errEmergencyStop
+	}
+	if err := e.overrideError(controllerUID, actuatorAddr, origin.Source); err != nil {
+		entry.Outcome, entry.Detail = storage.AuditRejected, err.Error()
+		e.auditCommand(&entry)
+		return err
+	}
+
+	// Parse device UID
+	uid, err := lora.ParseDeviceUID(controllerUID)
+	if err != nil {
+		entry.Outcome, entry.Detail = storage.AuditRejected, err.Error()
+		e.auditCommand(&entry)
+		return fmt.Errorf("invalid controller UID: %w", err)
+	}
+
+	// Create and send message
+	msg := lora.CreateValveCommand(uid, actuatorAddr, command, cmdID)
+	msg.Header.Sequence = e.lora.GetNextSeqNum()
+
+	e.txMu.Lock()
+	defer e.txMu.Unlock()
+	if err := e.lora.Send(msg); err != nil {
+		entry.Outcome, entry.Detail = storage.AuditSendFailed, err.Error()
+		e.auditCommand(&entry)
+		return fmt.Errorf("failed to send command: %w", err)
+	}
+	e.auditCommand(&entry)
+	e.cancelValveTimer(controllerUID, actuatorAddr)
+	if !overridable(origin.Source) {
+		e.endManualOverride(controllerUID, actuatorAddr)
+	}
+
+	// Store pending command for tracking
+	cfg := e.settings()
+	pending := &storage.PendingCommand{
+		CommandID:      cmdID,
+		ControllerUID:  controllerUID,
+		ActuatorAddr:   actuatorAddr,
+		Command:        command,
+		ExpiresAt:      time.Now().Add(cfg.CommandTimeout),
+		MaxRetries:     cfg.CommandRetries,
+		CloudCommandID: origin.CloudCommandID,
+		Sequence:       msg.Header.Sequence,
+		GroupID:        group,
+	}
+	if group != 0 {
+		pending.CloudCommandID = ""
+	}
+
+	if _, err := e.db.InsertPendingCommand(pending); err != nil {
+		log.Printf("Failed to store pending command: %v", err)
 	}
 
 	log.Printf("Sent valve command %d to %s addr %d: %s",
@@ -769,121 +1598,283 @@ func (e *Engine) SendValveCommand(controllerUID string, actuatorAddr uint8, comm
 // cloudSyncLoop periodically syncs data to the cloud
 func (e *Engine) cloudSyncLoop(ctx context.Context) {
 	defer e.wg.Done()
+	defer e.recordCloudUsage()
+	defer e.recordCounters()
 
-	ticker := time.NewTicker(e.config.SyncInterval)
+	interval := e.settings().syncInterval()
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
+	// A cycle that leaves a backlog is followed up sooner than the ticker
+	var drain <-chan time.Time
+	cycle := func() {
+		drain = nil
+		e.applyDeviceChanges()
+		e.sendQueuedMeterConfigs()
+		if e.syncToCloud() {
+			if d := e.settings().drainInterval(); d > 0 {
+				drain = time.After(d)
+			}
+		}
+	}
+
 	for {
+		e.beat("cloud sync", interval)
+
 		select {
 		case <-e.stopChan:
 			return
 		case <-ctx.Done():
 			return
+		case <-e.reloadNotify():
+			if d := e.settings().syncInterval(); d != interval {
+				interval = d
+				ticker.Reset(interval)
+			}
+		case <-e.syncNow:
+			cycle()
+		case <-drain:
+			cycle()
 		case <-ticker.C:
-			e.syncToCloud()
+			cycle()
+			e.recordCloudUsage()
+			e.recordCounters()
 		}
 	}
 }
 
-// syncToCloud sends unsynced data to the cloud via gRPC
-func (e *Engine) syncToCloud() {
+// syncToCloud sends unsynced data to the cloud via gRPC, each kind of
+// record as a task of its own, then a batch of any backfill. It reports
+// whether any kind filled its batch, in which case more is likely waiting.
+func (e *Engine) syncToCloud() bool {
 	if !e.cloud.IsConnected() {
-		return // Skip sync if not connected
+		return false // Skip sync if not connected
 	}
 
-	// Sync soil moisture readings - batch by device
-	readings, err := e.db.GetUnsyncedSoilMoistureReadings(50)
-	if err != nil {
-		log.Printf("Failed to get unsynced sensor readings: %v", err)
+	cfg := e.settings()
+	batch := cfg.syncBatchSize()
+
+	var tasks []func() bool
+	if cfg.LowBandwidth.Enabled && cfg.LowBandwidth.AggregateWindow > 0 {
+		tasks = append(tasks, func() bool {
+			e.syncAggregatedReadings(cfg.LowBandwidth, batch, time.Now())
+			return false // Metered links never drain early
+		})
 	} else {
-		// Group readings by device
-		byDevice := make(map[string][]*controllerv1.SensorReading)
-		for _, r := range readings {
-			reading := &controllerv1.SensorReading{
-				Timestamp: timestamppb.New(r.Timestamp),
-				Probes: []*controllerv1.ProbeReading{{
-					Index:           int32(r.ProbeID),
-					MoisturePercent: float32(r.MoisturePercent),
-				}},
-				BatteryMv:    int32(r.BatteryMV),
-				TemperatureC: float32(r.Temperature) / 10.0,
-				SignalRssi:   int32(r.RSSI),
-			}
-			byDevice[r.DeviceUID] = append(byDevice[r.DeviceUID], reading)
+		tasks = append(tasks,
+			func() bool { return e.syncSoilReadings(batch) },
+			func() bool { return e.syncMeterReadings(batch) })
+	}
+	tasks = append(tasks,
+		func() bool { return e.syncAlerts(batch) },
+		func() bool { return e.syncValveEvents(batch) },
+		func() bool { return e.syncFirmwareInventory(batch, time.Now()) })
+	if runSyncTasks(cfg.Sync.Concurrency, tasks) {
+		return true
+	}
+
+	// Backfills only use a cycle the live data left room in
+	return e.syncBackfill(batch)
+}
+
+// syncAlerts resends up to limit alerts that couldn't be sent immediately
+func (e *Engine) syncAlerts(limit int) bool {
+	alerts, err := e.db.GetUnsyncedAlerts(limit)
+	if err != nil {
+		log.Printf("Failed to get unsynced alerts: %v", err)
+		return false
+	}
+	for _, a := range alerts {
+		e.sendAlertToCloud(a)
+	}
+	return len(alerts) == limit
+}
+
+// syncValveEvents sends up to limit unsynced valve events, grouped by
+// controller
+func (e *Engine) syncValveEvents(limit int) bool {
+	events, err := e.db.GetUnsyncedValveEvents(limit)
+	if err != nil {
+		log.Printf("Failed to get unsynced valve events: %v", err)
+		return false
+	}
+	sent := e.sendValveEvents(events)
+	e.advanceSyncCursor(storage.SyncValveEvents, syncedThrough(events,
+		func(ev *storage.ValveEvent) int64 { return ev.ID },
+		func(ev *storage.ValveEvent) bool { return sent[ev.ControllerUID] }))
+	return len(events) == limit
+}
+
+// sendValveEvents sends valve events to the cloud grouped by controller,
+// returning the controllers whose events got through
+func (e *Engine) sendValveEvents(events []*storage.ValveEvent) map[string]bool {
+	// Group by controller
+	byController := make(map[string][]*controllerv1.ActuatorStatus)
+	for _, ev := range events {
+		status := &controllerv1.ActuatorStatus{
+			Address:   int32(ev.ActuatorAddr),
+			State:     valveStateString(ev.NewState),
+			ChangedAt: timestamppb.New(ev.Timestamp),
 		}
+		byController[ev.ControllerUID] = append(byController[ev.ControllerUID], status)
+	}
 
-		for deviceUID, deviceReadings := range byDevice {
-			if err := e.cloud.SendSensorData(deviceUID, deviceReadings); err != nil {
-				log.Printf("Failed to sync sensor readings for %s: %v", deviceUID, err)
-				continue
-			}
-			// Mark all readings for this device as synced
-			for _, r := range readings {
-				if r.DeviceUID == deviceUID {
-					e.db.MarkSoilMoistureReadingSynced(r.ID)
-				}
-			}
+	sent := make(map[string]bool)
+	for controllerUID, statuses := range byController {
+		err := e.cloud.SendValveStatus(controllerUID, statuses)
+		e.countSync(err)
+		if err != nil {
+			log.Printf("Failed to sync valve events for %s: %v", controllerUID, err)
+			continue
 		}
+		sent[controllerUID] = true
 	}
+	return sent
+}
 
-	// Sync water meter readings - batch by device
-	meterReadings, err := e.db.GetUnsyncedWaterMeterReadings(50)
-	if err != nil {
-		log.Printf("Failed to get unsynced meter readings: %v", err)
-	} else {
-		byDevice := make(map[string][]*controllerv1.MeterReading)
-		for _, r := range meterReadings {
-			reading := &controllerv1.MeterReading{
-				Timestamp:   timestamppb.New(r.Timestamp),
-				TotalLiters: float64(r.TotalVolumeL),
-				FlowRateLpm: r.FlowRateLPM,
-				BatteryMv:   intPtr32(int32(r.BatteryMV)),
-				SignalRssi:  int32(r.RSSI),
-			}
-			byDevice[r.DeviceUID] = append(byDevice[r.DeviceUID], reading)
+// syncedThrough returns the ID a sync cursor can advance to: that of the
+// last row, in ID order, before the first whose send failed. Rows after a
+// failure are sent again next cycle, even if they got through.
+func syncedThrough[T any](rows []T, id func(T) int64, sent func(T) bool) int64 {
+	_, through := sentPrefix(rows, id, sent)
+	return through
+}
+
+// sentPrefix returns how many rows, in ID order, were sent before the first
+// whose send failed, and the ID of the last of them
+func sentPrefix[T any](rows []T, id func(T) int64, sent func(T) bool) (int, int64) {
+	var through int64
+	for i, r := range rows {
+		if !sent(r) {
+			return i, through
 		}
+		through = id(r)
+	}
+	return len(rows), through
+}
+
+// advanceSyncCursor moves a table's sync cursor past the rows sent
+func (e *Engine) advanceSyncCursor(table string, through int64) {
+	if through == 0 {
+		return
+	}
+	if err := e.db.AdvanceSyncCursor(table, through); err != nil {
+		log.Printf("Failed to advance %s sync cursor: %v", table, err)
+	}
+}
+
+// syncSoilReadings sends up to limit unsynced soil readings as they were
+// taken, batched by device
+func (e *Engine) syncSoilReadings(limit int) bool {
+	readings, err := e.db.GetUnsyncedSoilMoistureReadings(limit)
+	if err != nil {
+		log.Printf("Failed to get unsynced sensor readings: %v", err)
+		return false
+	}
+	sent := e.sendSoilReadings(readings)
+	e.advanceSyncCursor(storage.SyncSoilReadings, syncedThrough(readings,
+		func(r *storage.SoilMoistureReading) int64 { return r.ID },
+		func(r *storage.SoilMoistureReading) bool { return sent[r.DeviceUID] }))
+	return len(readings) >= limit
+}
 
-		for deviceUID, deviceReadings := range byDevice {
-			if err := e.cloud.SendMeterData(deviceUID, deviceReadings); err != nil {
-				log.Printf("Failed to sync meter readings for %s: %v", deviceUID, err)
+// sendSoilReadings sends soil readings to the cloud as they were taken,
+// batched by device, returning the devices whose readings got through
+func (e *Engine) sendSoilReadings(readings []*storage.SoilMoistureReading) map[string]bool {
+	// Group readings by device; probes from the same soil report share
+	// one SensorReading
+	byDevice := make(map[string][]*controllerv1.SensorReading)
+	byReport := make(map[int64]*controllerv1.SensorReading)
+	oldest := make(map[string]time.Time)
+	for _, r := range readings {
+		if t, ok := oldest[r.DeviceUID]; !ok || r.Timestamp.Before(t) {
+			oldest[r.DeviceUID] = r.Timestamp
+		}
+		probe := &controllerv1.ProbeReading{
+			Index:           int32(r.ProbeID),
+			MoisturePercent: float32(r.MoisturePercent),
+		}
+		if r.ReportID != 0 {
+			if reading, ok := byReport[r.ReportID]; ok {
+				reading.Probes = append(reading.Probes, probe)
 				continue
 			}
-			for _, r := range meterReadings {
-				if r.DeviceUID == deviceUID {
-					e.db.MarkWaterMeterReadingSynced(r.ID)
-				}
-			}
 		}
+		reading := &controllerv1.SensorReading{
+			Timestamp:    timestamppb.New(r.Timestamp),
+			Probes:       []*controllerv1.ProbeReading{probe},
+			BatteryMv:    int32(r.BatteryMV),
+			TemperatureC: float32(r.Temperature) / 10.0,
+			SignalRssi:   int32(r.RSSI),
+		}
+		if r.ReportID != 0 {
+			byReport[r.ReportID] = reading
+		}
+		byDevice[r.DeviceUID] = append(byDevice[r.DeviceUID], reading)
 	}
 
-	// Sync valve events
-	events, err := e.db.GetUnsyncedValveEvents(50)
+	sent := make(map[string]bool)
+	for deviceUID, deviceReadings := range byDevice {
+		span, links := e.startSyncSpan(storage.SyncSoilReadings, deviceUID, len(deviceReadings), oldest[deviceUID])
+		err := e.cloud.SendSensorData(deviceUID, deviceReadings)
+		e.endSyncSpan(span, storage.SyncSoilReadings, deviceUID, links, err)
+		e.countSync(err)
+		if err != nil {
+			log.Printf("Failed to sync sensor readings for %s: %v", deviceUID, err)
+			continue
+		}
+		sent[deviceUID] = true
+	}
+	return sent
+}
+
+// syncMeterReadings sends up to limit unsynced water meter readings as they
+// were taken, batched by device
+func (e *Engine) syncMeterReadings(limit int) bool {
+	meterReadings, err := e.db.GetUnsyncedWaterMeterReadings(limit)
 	if err != nil {
-		log.Printf("Failed to get unsynced valve events: %v", err)
-	} else {
-		// Group by controller
-		byController := make(map[string][]*controllerv1.ActuatorStatus)
-		for _, ev := range events {
-			status := &controllerv1.ActuatorStatus{
-				Address:   int32(ev.ActuatorAddr),
-				State:     valveStateString(ev.NewState),
-				ChangedAt: timestamppb.New(ev.Timestamp),
-			}
-			byController[ev.ControllerUID] = append(byController[ev.ControllerUID], status)
+		log.Printf("Failed to get unsynced meter readings: %v", err)
+		return false
+	}
+	sent := e.sendMeterReadings(meterReadings)
+	e.advanceSyncCursor(storage.SyncMeterReadings, syncedThrough(meterReadings,
+		func(r *storage.WaterMeterReading) int64 { return r.ID },
+		func(r *storage.WaterMeterReading) bool { return sent[r.DeviceUID] }))
+	return len(meterReadings) == limit
+}
+
+// sendMeterReadings sends water meter readings to the cloud as they were
+// taken, batched by device, returning the devices whose readings got through
+func (e *Engine) sendMeterReadings(meterReadings []*storage.WaterMeterReading) map[string]bool {
+	byDevice := make(map[string][]*controllerv1.MeterReading)
+	oldest := make(map[string]time.Time)
+	for _, r := range meterReadings {
+		if t, ok := oldest[r.DeviceUID]; !ok || r.Timestamp.Before(t) {
+			oldest[r.DeviceUID] = r.Timestamp
+		}
+		reading := &controllerv1.MeterReading{
+			Timestamp:   timestamppb.New(r.Timestamp),
+			TotalLiters: r.CumulativeL,
+			FlowRateLpm: r.FlowRateLPM,
+			BatteryMv:   intPtr32(int32(r.BatteryMV)),
+			SignalRssi:  int32(r.RSSI),
 		}
+		byDevice[r.DeviceUID] = append(byDevice[r.DeviceUID], reading)
+	}
 
-		for controllerUID, statuses := range byController {
-			if err := e.cloud.SendValveStatus(controllerUID, statuses); err != nil {
-				log.Printf("Failed to sync valve events for %s: %v", controllerUID, err)
-				continue
-			}
-			for _, ev := range events {
-				if ev.ControllerUID == controllerUID {
-					e.db.MarkValveEventSynced(ev.ID)
-				}
-			}
+	sent := make(map[string]bool)
+	for deviceUID, deviceReadings := range byDevice {
+		span, links := e.startSyncSpan(storage.SyncMeterReadings, deviceUID, len(deviceReadings), oldest[deviceUID])
+		err := e.cloud.SendMeterData(deviceUID, deviceReadings)
+		e.endSyncSpan(span, storage.SyncMeterReadings, deviceUID, links, err)
+		e.countSync(err)
+		if err != nil {
+			log.Printf("Failed to sync meter readings for %s: %v", deviceUID, err)
+			continue
 		}
+		sent[deviceUID] = true
 	}
+	return sent
 }
 
 func intPtr32(i int32) *int32 {
@@ -894,10 +1885,13 @@ func intPtr32(i int32) *int32 {
 func (e *Engine) commandRetryLoop(ctx context.Context) {
 	defer e.wg.Done()
 
-	ticker := time.NewTicker(5 * time.Second)
+	const interval = 5 * time.Second
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
 	for {
+		e.beat("command retry", interval)
+
 		select {
 		case <-e.stopChan:
 			return
@@ -905,6 +1899,11 @@ func (e *Engine) commandRetryLoop(ctx context.Context) {
 			return
 		case <-ticker.C:
 			e.retryExpiredCommands()
+			e.failExhaustedCommands()
+			e.retryUnackedSchedules()
+			e.retryUnackedMeterPins()
+			e.expireDebugCommands(time.Now())
+			e.expireMeterCalibrations(time.Now())
 		}
 	}
 }
@@ -932,37 +1931,279 @@ func (e *Engine) retryExpiredCommands() {
 		msg := lora.CreateValveCommand(uid, cmd.ActuatorAddr, cmd.Command, cmd.CommandID)
 		msg.Header.Sequence = e.lora.GetNextSeqNum()
 
+		e.txMu.Lock()
 		if err := e.lora.Send(msg); err != nil {
+			e.txMu.Unlock()
 			log.Printf("Failed to retry command: %v", err)
 			continue
 		}
 
-		// Update retry count and expiry
-		newExpiry := time.Now().Add(e.config.CommandTimeout)
-		if err := e.db.IncrementCommandRetry(cmd.ID, newExpiry); err != nil {
+		// Update retry count, sequence, and expiry
+		newExpiry := time.Now().Add(e.settings().CommandTimeout)
+		if err := e.db.IncrementCommandRetry(cmd.ID, msg.Header.Sequence, newExpiry); err != nil {
 			log.Printf("Failed to update command retry: %v", err)
 		}
+		e.txMu.Unlock()
+	}
+}
+
+// valveRuntimeLoop periodically closes valves that exceed their runtime limit
+func (e *Engine) valveRuntimeLoop(ctx context.Context) {
+	defer e.wg.Done()
+
+	const interval = 30 * time.Second
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		e.beat("valve runtime", interval)
+
+		select {
+		case <-e.stopChan:
+			return
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			e.enforceValveRuntimeLimits()
+		}
+	}
+}
+
+// valveMaxOpen returns the maximum open duration for an actuator
+func (e *Engine) valveMaxOpen(controllerUID string, addr uint8) time.Duration {
+	cfg := e.settings()
+	for _, l := range cfg.ValveLimits {
+		if l.ControllerUID == controllerUID && l.Address == addr {
+			return l.MaxOpen
+		}
+	}
+	return cfg.ValveMaxOpen
+}
+
+// enforceValveRuntimeLimits sends a close command to every valve that has been
+// open longer than its limit. This protects against lost close commands and
+// stuck schedules.
+func (e *Engine) enforceValveRuntimeLimits() {
+	actuators, err := e.db.GetOpenValveActuators()
+	if err != nil {
+		log.Printf("Failed to get open valves: %v", err)
+		return
+	}
+
+	now := time.Now()
+	open := make(map[string]bool, len(actuators))
+	for _, a := range actuators {
+		open[a.UID] = true
+
+		limit := e.valveMaxOpen(a.ControllerUID, a.Address)
+		if limit <= 0 || now.Sub(a.OpenedAt) < limit {
+			continue
+		}
+
+		// Someone at the valve has taken over; the limit applies again once
+		// the override ends
+		if e.manualOverride(a.ControllerUID, a.Address) != nil {
+			continue
+		}
+
+		// The close command is retried by commandRetryLoop; only send a new
+		// one once those retries have had time to run out
+		cfg := e.settings()
+		retryWindow := cfg.CommandTimeout * time.Duration(cfg.CommandRetries+1)
+		if last, ok := e.runtimeShutoffs[a.UID]; ok && now.Sub(last) < retryWindow {
+			continue
+		}
+
+		e.runtimeShutoffs[a.UID] = now
+		e.raiseAlert(&storage.Alert{
+			DeviceUID: a.ControllerUID,
+			ProbeID:   a.Address,
+			AlertType: alertValveRuntimeLimit,
+			Severity:  storage.AlertCritical,
+			Message: fmt.Sprintf("valve %s addr %d open for %s, exceeds limit of %s - closing",
+				a.ControllerUID, a.Address, now.Sub(a.OpenedAt).Round(time.Second), limit),
+			Value:     now.Sub(a.OpenedAt).Minutes(),
+			Threshold: limit.Minutes(),
+			Timestamp: now,
+		})
+		if err := e.SendValveCommand(a.ControllerUID, a.Address, protocol.ValveCmdClose, sourceRule, "runtime_limit"); err != nil {
+			log.Printf("Failed to auto-close valve %s addr %d: %v", a.ControllerUID, a.Address, err)
+			continue
+		}
+
+		// Record the shutoff so it reaches the cloud with the valve events
+		event := &storage.ValveEvent{
+			ControllerUID: a.ControllerUID,
+			ActuatorAddr:  a.Address,
+			PrevState:     a.CurrentState,
+			NewState:      protocol.ValveStateClosing,
+			Source:        "runtime_limit",
+			Timestamp:     now,
+		}
+		id, err := e.db.InsertValveEvent(event)
+		if err != nil {
+			log.Printf("Failed to store valve event: %v", err)
+			continue
+		}
+		e.bus.Valve.publish(ValveChanged{ID: id, Event: event})
+	}
+
+	// Forget shutoffs for valves that have since closed
+	for uid := range e.runtimeShutoffs {
+		if !open[uid] {
+			delete(e.runtimeShutoffs, uid)
+		}
+	}
+}
+
+// failExhaustedCommands moves commands that ran out of retries to the failed
+// state and reports the failure to the cloud
+func (e *Engine) failExhaustedCommands() {
+	exhausted, err := e.db.GetExhaustedCommands()
+	if err != nil {
+		log.Printf("Failed to get exhausted commands: %v", err)
+		return
+	}
+
+	for _, cmd := range exhausted {
+		log.Printf("Command %d to %s addr %d failed: no acknowledgment after %d retries",
+			cmd.CommandID, cmd.ControllerUID, cmd.ActuatorAddr, cmd.Retries)
+		e.failCommand(cmd, storage.AuditNoAck, fmt.Sprintf("no acknowledgment after %d retries", cmd.Retries))
+	}
+}
+
+// failCommand moves a command to the failed state, audits and alerts on it,
+// and reports the reason to the cloud
+func (e *Engine) failCommand(cmd *storage.PendingCommand, outcome, reason string) {
+	if err := e.db.MarkCommandFailed(cmd.ID, reason); err != nil {
+		log.Printf("Failed to mark command %d failed: %v", cmd.CommandID, err)
+		return
+	}
+	e.auditOutcome(cmd.ControllerUID, cmd.CommandID, outcome, reason)
+	e.raiseCommandFailed(cmd.ControllerUID, cmd.ActuatorAddr, reason)
+	if cmd.GroupID != 0 {
+		e.resolveCommandGroup(cmd.GroupID)
+		return
+	}
+
+	cmdIDStr := cmd.CloudCommandID
+	if cmdIDStr == "" {
+		cmdIDStr = fmt.Sprintf("%d", cmd.CommandID)
+	}
+	if err := e.cloud.SendCommandAck(cmdIDStr, false, reason); err != nil {
+		log.Printf("Failed to send command failure to cloud: %v", err)
+	}
+}
+
+// commandCleanupLoop periodically deletes old finished commands
+func (e *Engine) commandCleanupLoop(ctx context.Context) {
+	defer e.wg.Done()
+
+	ticker := time.NewTicker(1 * time.Hour)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.stopChan:
+			return
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			e.cleanupCommands()
+		}
+	}
+}
+
+// cleanupCommands deletes acknowledged and failed commands past retention
+func (e *Engine) cleanupCommands() {
+	retention := e.settings().CommandRetention
+	if retention <= 0 {
+		return
+	}
+
+	n, err := e.db.DeleteFinishedCommands(time.Now().Add(-retention))
+	if err != nil {
+		log.Printf("Failed to clean up commands: %v", err)
+		return
+	}
+	if n > 0 {
+		log.Printf("Cleaned up %d finished commands", n)
+	}
+	if n, err := e.db.DeleteCompletedCommandGroups(time.Now().Add(-retention)); err != nil {
+		log.Printf("Failed to clean up command groups: %v", err)
+	} else if n > 0 {
+		log.Printf("Cleaned up %d completed command groups", n)
+	}
+	if n, err := e.db.DeleteCompletedBackfills(time.Now().Add(-retention)); err != nil {
+		log.Printf("Failed to clean up backfills: %v", err)
+	} else if n > 0 {
+		log.Printf("Cleaned up %d completed backfills", n)
 	}
 }
 
-// timeSyncLoop periodically broadcasts time sync messages
+// rollupLoop keeps the hourly and daily reading rollups up to date and
+// prunes old link quality samples, gateway stats, device logs, and actuator
+// currents
+func (e *Engine) rollupLoop(ctx context.Context) {
+	defer e.wg.Done()
+
+	e.updateRollups()
+
+	ticker := time.NewTicker(15 * time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.stopChan:
+			return
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			e.updateRollups()
+			e.pruneLinkQuality()
+			e.pruneGatewayStats()
+			e.pruneDeviceLogs()
+			e.pruneActuatorCurrents()
+		}
+	}
+}
+
+func (e *Engine) updateRollups() {
+	if err := e.db.UpdateRollups(time.Now()); err != nil {
+		log.Printf("Failed to update rollups: %v", err)
+	}
+}
+
+// timeSyncLoop periodically broadcasts time sync messages, with extra
+// unicast syncs for devices whose clocks drift too fast
 func (e *Engine) timeSyncLoop(ctx context.Context) {
 	defer e.wg.Done()
 
 	// Send initial time sync
 	e.broadcastTimeSync()
 
-	ticker := time.NewTicker(e.config.TimeSyncInterval)
+	interval := e.settings().TimeSyncInterval
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
+	resync := time.NewTicker(time.Minute)
+	defer resync.Stop()
+
 	for {
 		select {
 		case <-e.stopChan:
 			return
 		case <-ctx.Done():
 			return
+		case <-e.reloadNotify():
+			if d := e.settings().TimeSyncInterval; d != interval {
+				interval = d
+				ticker.Reset(interval)
+			}
 		case <-ticker.C:
 			e.broadcastTimeSync()
+		case now := <-resync.C:
+			e.sendDueClockSyncs(now)
 		}
 	}
 }
@@ -979,18 +2220,6 @@ func (e *Engine) broadcastTimeSync() {
 	}
 }
 
-// queueForCloudSync queues data for cloud synchronization
-func (e *Engine) queueForCloudSync(dataType string, dataID int64, data interface{}) {
-	// If connected, try to send immediately
-	if e.cloud.IsConnected() {
-		// Data will be synced in the next sync cycle
-		return
-	}
-
-	// Otherwise, data is already in the database with synced_to_cloud = false
-	// It will be synced when connection is restored
-}
-
 // gRPC message handlers
 
 // handleValveCommandGRPC processes valve commands from the cloud via gRPC
@@ -1012,51 +2241,76 @@ func (e *Engine) handleValveCommandGRPC(cmd *controllerv1.ValveCommand) {
 		return
 	}
 
-	// Send command to device
-	controllerUID := cmd.ControllerUid
-	if err := e.SendValveCommand(controllerUID, uint8(cmd.ActuatorAddress), protoCmd); err != nil {
-		log.Printf("Failed to send valve command: %v", err)
+	origin := storage.CommandAudit{
+		Source:         sourceCloud,
+		CloudCommandID: cmd.CommandId,
+		Params:         auditParams(map[string]interface{}{"valve_id": cmd.ValveId, "duration_seconds": cmd.DurationSeconds}),
 	}
-}
-
-// handleScheduleUpdateGRPC processes schedule updates from the cloud via gRPC
-func (e *Engine) handleScheduleUpdateGRPC(update *controllerv1.ScheduleUpdate) {
-	log.Printf("Schedule update for property %s with %d schedules", update.PropertyId, len(update.Schedules))
-
-	for _, sched := range update.Schedules {
-		// Convert days to day mask
-		dayMask := daysToDayMask(sched.Days)
-		startHour, startMinute := parseStartTime(sched.StartTime)
 
-		// Convert to storage format
-		schedule := &storage.Schedule{
-			UID:      sched.ScheduleId,
-			Name:     sched.Name,
-			IsActive: sched.Enabled,
+	// Resolve the valve to its controller and actuator address
+	controllerUID, addr, err := e.resolveValve(cmd.ValveId, cmd.ControllerUid, uint8(cmd.ActuatorAddress))
+	if err != nil {
+		log.Printf("Cannot send valve command: %v", err)
+		device := cmd.ControllerUid
+		if device == "" {
+			device = cmd.ValveId
 		}
-
-		// Create a single entry for this schedule
-		var actuatorMask uint64
-		for _, v := range sched.Valves {
-			actuatorMask |= (1 << v.ActuatorAddress)
+		e.auditRejectedValve(device, uint8(cmd.ActuatorAddress), protoCmd, origin, err)
+		if cmd.CommandId != "" {
+			e.cloud.SendCommandAck(cmd.CommandId, false, err.Error())
 		}
+		return
+	}
 
-		entries := []storage.ScheduleEntry{{
-			DayMask:      dayMask,
-			StartHour:    startHour,
-			StartMinute:  startMinute,
-			DurationMins: uint16(sched.DurationMinutes),
-			ActuatorMask: actuatorMask,
-		}}
+	// An open with a duration closes by itself when the duration runs out
+	sent := e.sendCloudValveCommand(controllerUID, addr, protoCmd, origin)
+	if sent && protoCmd == protocol.ValveCmdOpen && cmd.DurationSeconds > 0 {
+		e.startValveTimer(controllerUID, addr, time.Duration(cmd.DurationSeconds)*time.Second, cmd.CommandId)
+	}
+}
 
-		// Store in database
-		if err := e.db.UpsertSchedule(schedule, entries); err != nil {
-			log.Printf("Failed to store schedule: %v", err)
-			continue
+// sendCloudValveCommand sends a cloud-issued valve command unless the cloud
+// command ID has been seen before. Cloud messages may be redelivered after a
+// reconnect, and actuating twice must be avoided. It reports whether the
+// command was sent.
+func (e *Engine) sendCloudValveCommand(controllerUID string, actuatorAddr uint8, command uint8, origin storage.CommandAudit) bool {
+	cloudCommandID := origin.CloudCommandID
+	if cloudCommandID != "" {
+		if prev, err := e.db.GetPendingCommandByCloudID(cloudCommandID); err == nil {
+			log.Printf("Ignoring duplicate cloud command %s (LoRa command %d)", cloudCommandID, prev.CommandID)
+			entry := origin
+			entry.Kind, entry.DeviceUID, entry.ActuatorAddr = "valve", controllerUID, actuatorAddr
+			entry.Command, entry.CommandID, entry.Outcome = valveCommandString(command), prev.CommandID, storage.AuditDuplicate
+			e.auditCommand(&entry)
+
+			// Repeat the outcome if we already have one, in case the cloud missed it
+			switch {
+			case prev.Acknowledged:
+				e.cloud.SendCommandAck(cloudCommandID, true, "")
+			case prev.Failed && prev.Error != "":
+				e.cloud.SendCommandAck(cloudCommandID, false, prev.Error)
+			case prev.Failed:
+				e.cloud.SendCommandAck(cloudCommandID, false, "no acknowledgment from device")
+			}
+			return false
 		}
+	}
 
-		log.Printf("Updated schedule %s: %s", sched.ScheduleId, sched.Name)
+	if err := e.sendValveCommand(controllerUID, actuatorAddr, command, origin, 0); err != nil {
+		log.Printf("Failed to send valve command: %v", err)
+		if cloudCommandID != "" {
+			e.cloud.SendCommandAck(cloudCommandID, false, err.Error())
+		}
+		return false
 	}
+	return true
+}
+
+// handleScheduleUpdateGRPC processes schedule updates from the cloud via gRPC
+func (e *Engine) handleScheduleUpdateGRPC(update *controllerv1.ScheduleUpdate) {
+	log.Printf("Schedule update for property %s with %d schedules", update.PropertyId, len(update.Schedules))
+
+	e.applySchedules(grpcSchedules(update))
 }
 
 // handleDeviceAddedGRPC processes device approval notifications from the cloud via gRPC
@@ -1075,18 +2329,132 @@ func (e *Engine) handleDeviceAddedGRPC(approved *controllerv1.DeviceApproved) {
 		LastSeen:     time.Now(),
 	}
 	e.registeredDevices[approved.DeviceUid] = device
+	if shared := e.config.SharedRadio; shared != nil {
+		shared.claim(approved.DeviceUid, e)
+	}
 
 	// Store in database
 	if err := e.db.UpsertDevice(device); err != nil {
 		log.Printf("Failed to store device %s: %v", approved.DeviceUid, err)
 	}
+	// Approval vouches for a device quarantined as a suspected spoof
+	e.releaseDevice(approved.DeviceUid)
 
 	log.Printf("Device approved: %s (%s) - %s", approved.DeviceUid, approved.DeviceType, approved.Name)
+
+	// Valve actuators are approved by actuator UID, which is also their valve ID
+	if device.DeviceType == protocol.DeviceTypeValveActuator {
+		controllerUID, addr, err := parseActuatorUID(approved.DeviceUid)
+		if err != nil {
+			log.Printf("Cannot map valve: %v", err)
+			return
+		}
+		e.registerValve(approved.DeviceUid, controllerUID, addr, approved.Name, approved.GetZoneId())
+	}
 }
 
 // handleConfigUpdateGRPC processes config updates from the cloud via gRPC
 func (e *Engine) handleConfigUpdateGRPC(update *controllerv1.ConfigUpdate) {
 	log.Printf("Config update received for target: %s", update.Target)
+
+	// Valve mapping: valve_id, controller_uid, actuator_address (name, alias, zone_id optional)
+	if update.Target == "valve" {
+		cfg := update.Config
+		addr, err := strconv.ParseUint(cfg["actuator_address"], 10, 8)
+		if cfg["valve_id"] == "" || cfg["controller_uid"] == "" || err != nil {
+			log.Printf("Invalid valve mapping: %v", cfg)
+			return
+		}
+		e.registerValve(cfg["valve_id"], cfg["controller_uid"], uint8(addr), cfg["name"], cfg["zone_id"])
+		if alias, ok := cfg["alias"]; ok {
+			meta := storage.ValveActuatorMeta{Alias: &alias}
+			if err := e.db.UpdateValveActuatorMeta(cfg["controller_uid"], uint8(addr), meta); err != nil {
+				log.Printf("Failed to set alias of valve %s: %v", cfg["valve_id"], err)
+			}
+		}
+		return
+	}
+
+	// Actuator metadata: actuator_uid or controller_uid and actuator_address,
+	// with any of name, alias, zone_id
+	if update.Target == "actuator" {
+		e.handleActuatorUpdate(update.Config)
+		return
+	}
+
+	// Zone: zone_id, name (alias optional), or deleted=true
+	if update.Target == "zone" {
+		e.handleZoneUpdate(update.Config)
+		return
+	}
+
+	// Full zone list: zone_id -> name; zones not listed are removed
+	if update.Target == "zones" {
+		e.handleZonesSync(update.Config)
+		return
+	}
+
+	// Key rotation: device_uid
+	if update.Target == "key_rotation" {
+		if err := e.RotateDeviceKey(update.Config["device_uid"]); err != nil {
+			log.Printf("Key rotation failed: %v", err)
+		}
+		return
+	}
+
+	// Report interval: device_uid, interval_sec (0 for the device default)
+	if update.Target == "report_interval" {
+		seconds, err := strconv.ParseUint(update.Config["interval_sec"], 10, 16)
+		if err != nil {
+			log.Printf("Invalid report interval: %v", update.Config)
+			return
+		}
+		if err := e.SetReportInterval(update.Config["device_uid"], time.Duration(seconds)*time.Second); err != nil {
+			log.Printf("Report interval update failed: %v", err)
+		}
+		return
+	}
+
+	// Command for a set of valves: see handleGroupCommand
+	if update.Target == "valve_group" {
+		e.handleGroupCommand(update.Config)
+		return
+	}
+
+	// Send already-synced data again: see handleBackfillRequest
+	if update.Target == "backfill" {
+		e.handleBackfillRequest(update.Config)
+		return
+	}
+
+	// Diagnostic command passed through to a device: see handleDebugCommand
+	if update.Target == "debug_command" {
+		e.handleDebugCommand(update.Config)
+		return
+	}
+
+	// Water meter calibration step: see handleMeterCalibrationCommand
+	if update.Target == "meter_calibration" {
+		e.handleMeterCalibrationCommand(update.Config)
+		return
+	}
+
+	// Emergency stop: reason and actor optional
+	if update.Target == "emergency_stop" {
+		if _, err := e.EmergencyStop(sourceCloud, update.Config["actor"], update.Config["reason"]); err != nil {
+			log.Printf("Emergency stop: %v", err)
+		}
+		return
+	}
+
+	// Emergency stop re-arm: actor optional
+	if update.Target == "emergency_rearm" {
+		if err := e.RearmEmergencyStop(sourceCloud, update.Config["actor"]); err != nil {
+			log.Printf("Emergency stop re-arm failed: %v", err)
+		}
+		return
+	}
+
 	// TODO: Apply configuration changes
 	for key, value := range update.Config {
 		log.Printf("  %s = %s", key, value)
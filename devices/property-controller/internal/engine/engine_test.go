@@ -1,12 +1,37 @@
 package engine
 
 import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
 	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/agsys/property-controller/internal/cloud"
+	"github.com/agsys/property-controller/internal/localapi"
+	"github.com/agsys/property-controller/internal/lora"
+	"github.com/agsys/property-controller/internal/lora/gw"
+	"github.com/agsys/property-controller/internal/notify"
+	"github.com/agsys/property-controller/internal/ota"
 	"github.com/agsys/property-controller/internal/protocol"
 	"github.com/agsys/property-controller/internal/storage"
+	"github.com/agsys/property-controller/internal/weather"
+	controllerv1 "github.com/ccroswhite/agsys-api/gen/go/proto/controller/v1"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
 )
 
 // MockLoRaDriver simulates the LoRa driver for testing
@@ -224,6 +249,432 @@ func TestWaterMeterReadingStorage(t *testing.T) {
 	}
 }
 
+// TestSoilReportStorage tests that all probes of a soil report are stored as one group
+func TestSoilReportStorage(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "agsys-test-*.db")
+	if err != nil {
+		t.Fatalf("Failed to create temp db: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	tmpFile.Close()
+
+	db, err := storage.Open(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	report := &storage.SoilReport{
+		DeviceUID:   "0102030405060708",
+		ProbeCount:  3,
+		Temperature: 215,
+		BatteryMV:   3300,
+		RSSI:        -85,
+		Timestamp:   time.Now(),
+	}
+	probes := []*storage.SoilMoistureReading{
+		{ProbeID: 0, MoistureRaw: 41000, MoisturePercent: 20},
+		{ProbeID: 1, MoistureRaw: 43000, MoisturePercent: 30},
+		{ProbeID: 2, MoistureRaw: 45000, MoisturePercent: 40},
+	}
+
+	reportID, err := db.InsertSoilReport(report, probes)
+	if err != nil {
+		t.Fatalf("InsertSoilReport failed: %v", err)
+	}
+
+	readings, err := db.GetUnsyncedSoilMoistureReadings(10)
+	if err != nil {
+		t.Fatalf("GetUnsyncedSoilMoistureReadings failed: %v", err)
+	}
+	if len(readings) != 3 {
+		t.Fatalf("Expected 3 readings, got %d", len(readings))
+	}
+
+	for _, r := range readings {
+		if r.ReportID != reportID {
+			t.Errorf("probe %d ReportID = %d, want %d", r.ProbeID, r.ReportID, reportID)
+		}
+		if !r.Timestamp.Equal(readings[0].Timestamp) {
+			t.Errorf("probe %d timestamp differs from group", r.ProbeID)
+		}
+		if r.BatteryMV != report.BatteryMV {
+			t.Errorf("probe %d BatteryMV = %d, want %d", r.ProbeID, r.BatteryMV, report.BatteryMV)
+		}
+	}
+
+	// A batch ending partway through a report still carries all of it
+	if _, err := db.InsertSoilMoistureReading(&storage.SoilMoistureReading{
+		DeviceUID: "1112131415161718", MoisturePercent: 50, Timestamp: time.Now(),
+	}); err != nil {
+		t.Fatalf("InsertSoilMoistureReading failed: %v", err)
+	}
+	readings, err = db.GetUnsyncedSoilMoistureReadings(2)
+	if err != nil {
+		t.Fatalf("GetUnsyncedSoilMoistureReadings failed: %v", err)
+	}
+	if len(readings) != 3 || readings[2].ReportID != reportID {
+		t.Errorf("Batch of 2 returned %d readings, want the 3 of the report", len(readings))
+	}
+}
+
+// TestValveOpenedAtTracking tests that opened_at follows valve state changes
+func TestValveOpenedAtTracking(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "agsys-test-*.db")
+	if err != nil {
+		t.Fatalf("Failed to create temp db: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	tmpFile.Close()
+
+	db, err := storage.Open(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	controller := "0102030405060708"
+	if err := db.UpdateValveActuatorState(controller, 3, protocol.ValveStateOpening); err != nil {
+		t.Fatalf("UpdateValveActuatorState failed: %v", err)
+	}
+
+	open, err := db.GetOpenValveActuators()
+	if err != nil {
+		t.Fatalf("GetOpenValveActuators failed: %v", err)
+	}
+	if len(open) != 1 || open[0].Address != 3 {
+		t.Fatalf("Expected valve 3 open, got %+v", open)
+	}
+	openedAt := open[0].OpenedAt
+
+	// Further open reports must not reset the start time
+	time.Sleep(10 * time.Millisecond)
+	if err := db.UpdateValveActuatorState(controller, 3, protocol.ValveStateOpen); err != nil {
+		t.Fatalf("UpdateValveActuatorState failed: %v", err)
+	}
+	open, _ = db.GetOpenValveActuators()
+	if len(open) != 1 || !open[0].OpenedAt.Equal(openedAt) {
+		t.Errorf("opened_at changed on repeated open report: got %v, want %v", open[0].OpenedAt, openedAt)
+	}
+
+	// Water still flows while the valve closes
+	if err := db.UpdateValveActuatorState(controller, 3, protocol.ValveStateClosing); err != nil {
+		t.Fatalf("UpdateValveActuatorState failed: %v", err)
+	}
+	open, _ = db.GetOpenValveActuators()
+	if len(open) != 1 || !open[0].OpenedAt.Equal(openedAt) {
+		t.Errorf("Expected valve 3 still open while closing, got %+v", open)
+	}
+
+	if err := db.UpdateValveActuatorState(controller, 3, protocol.ValveStateClosed); err != nil {
+		t.Fatalf("UpdateValveActuatorState failed: %v", err)
+	}
+	open, _ = db.GetOpenValveActuators()
+	if len(open) != 0 {
+		t.Errorf("Expected no open valves after close, got %d", len(open))
+	}
+}
+
+// TestValveRuntimeLimit tests that a valve open past its limit is shut off
+// with an alert, which clears once the valve reports closed
+func TestValveRuntimeLimit(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "agsys-test-*.db")
+	if err != nil {
+		t.Fatalf("Failed to create temp db: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	tmpFile.Close()
+
+	db, err := storage.Open(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	driver, err := lora.New(lora.DefaultConfig())
+	if err != nil {
+		t.Fatalf("Failed to create LoRa driver: %v", err)
+	}
+
+	cfg := DefaultConfig()
+	cfg.ValveMaxOpen = time.Millisecond
+	e := &Engine{
+		config:          cfg,
+		db:              db,
+		lora:            driver,
+		cloud:           cloud.NewGRPCClient(cloud.DefaultGRPCConfig()),
+		notifier:        notify.New(cfg.Notify),
+		runtimeShutoffs: make(map[string]time.Time),
+	}
+
+	const controller = "0102030405060708"
+	if err := db.UpdateValveActuatorState(controller, 3, protocol.ValveStateOpen); err != nil {
+		t.Fatalf("UpdateValveActuatorState failed: %v", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	// The radio isn't running, so the close command fails; the alert is
+	// raised all the same
+	e.enforceValveRuntimeLimits()
+	alerts, _ := db.GetOpenDeviceAlerts(controller)
+	if len(alerts) != 1 || alerts[0].AlertType != alertValveRuntimeLimit || alerts[0].ProbeID != 3 ||
+		alerts[0].Severity != storage.AlertCritical {
+		t.Fatalf("Unexpected alerts: %+v", alerts)
+	}
+
+	payload := &protocol.ValveStatusPayload{ActuatorAddr: 3, State: protocol.ValveStateClosed}
+	e.handleValveStatus(controller, &protocol.LoRaMessage{Payload: payload.Encode()})
+	if alerts, _ := db.GetOpenDeviceAlerts(controller); len(alerts) != 0 {
+		t.Errorf("Alerts still open after the valve closed: %+v", alerts)
+	}
+}
+
+// TestValveMaxOpen tests per-valve runtime limit overrides
+func TestValveMaxOpen(t *testing.T) {
+	e := &Engine{config: DefaultConfig()}
+	e.config.ValveLimits = []ValveLimit{
+		{ControllerUID: "0102030405060708", Address: 3, MaxOpen: 30 * time.Minute},
+	}
+
+	if got := e.valveMaxOpen("0102030405060708", 3); got != 30*time.Minute {
+		t.Errorf("override: got %s, want 30m", got)
+	}
+	if got := e.valveMaxOpen("0102030405060708", 4); got != e.config.ValveMaxOpen {
+		t.Errorf("default: got %s, want %s", got, e.config.ValveMaxOpen)
+	}
+}
+
+// TestMeterSchemaMigration tests that databases with the old total_liters column are upgraded
+func TestMeterSchemaMigration(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "agsys-test-*.db")
+	if err != nil {
+		t.Fatalf("Failed to create temp db: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	tmpFile.Close()
+
+	// Create the original schema by hand
+	old, err := sql.Open("sqlite3", tmpFile.Name())
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	_, err = old.Exec(`CREATE TABLE water_meter_readings (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		device_uid TEXT NOT NULL,
+		total_liters INTEGER NOT NULL,
+		flow_rate_lpm REAL,
+		battery_mv INTEGER,
+		rssi INTEGER,
+		timestamp DATETIME DEFAULT CURRENT_TIMESTAMP,
+		synced_to_cloud INTEGER DEFAULT 0
+	)`)
+	old.Close()
+	if err != nil {
+		t.Fatalf("Failed to create old schema: %v", err)
+	}
+
+	db, err := storage.Open(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("Failed to migrate database: %v", err)
+	}
+	defer db.Close()
+
+	reading := &storage.WaterMeterReading{
+		DeviceUID:    "0102030405060708",
+		TotalVolumeL: 42.5,
+		Timestamp:    time.Now(),
+	}
+	if _, err := db.InsertWaterMeterReading(reading); err != nil {
+		t.Fatalf("InsertWaterMeterReading after migration failed: %v", err)
+	}
+}
+
+// TestCommandFailureAndCleanup tests exhausted commands move to failed and are cleaned up
+func TestCommandFailureAndCleanup(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "agsys-test-*.db")
+	if err != nil {
+		t.Fatalf("Failed to create temp db: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	tmpFile.Close()
+
+	db, err := storage.Open(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	cmd := &storage.PendingCommand{
+		CommandID:     42,
+		ControllerUID: "0102030405060708",
+		ActuatorAddr:  1,
+		Command:       protocol.ValveCmdOpen,
+		ExpiresAt:     time.Now().Add(-time.Second),
+		MaxRetries:    1,
+	}
+	id, err := db.InsertPendingCommand(cmd)
+	if err != nil {
+		t.Fatalf("InsertPendingCommand failed: %v", err)
+	}
+
+	// Still has a retry left
+	if exhausted, _ := db.GetExhaustedCommands(); len(exhausted) != 0 {
+		t.Fatalf("Expected no exhausted commands, got %d", len(exhausted))
+	}
+	if err := db.IncrementCommandRetry(id, 7, time.Now().Add(-time.Second)); err != nil {
+		t.Fatalf("IncrementCommandRetry failed: %v", err)
+	}
+
+	exhausted, err := db.GetExhaustedCommands()
+	if err != nil {
+		t.Fatalf("GetExhaustedCommands failed: %v", err)
+	}
+	if len(exhausted) != 1 || exhausted[0].CommandID != 42 {
+		t.Fatalf("Expected command 42 exhausted, got %+v", exhausted)
+	}
+
+	if err := db.MarkCommandFailed(id, "no acknowledgment after 1 retries"); err != nil {
+		t.Fatalf("MarkCommandFailed failed: %v", err)
+	}
+	if exhausted, _ := db.GetExhaustedCommands(); len(exhausted) != 0 {
+		t.Errorf("Failed command still reported as exhausted")
+	}
+	if expired, _ := db.GetExpiredCommands(); len(expired) != 0 {
+		t.Errorf("Failed command still reported for retry")
+	}
+
+	// Recent failures are kept, old ones deleted
+	if n, _ := db.DeleteFinishedCommands(time.Now().Add(-time.Hour)); n != 0 {
+		t.Errorf("Deleted %d recent commands, want 0", n)
+	}
+	if n, _ := db.DeleteFinishedCommands(time.Now().Add(time.Hour)); n != 1 {
+		t.Errorf("Deleted %d old commands, want 1", n)
+	}
+}
+
+// TestPendingCommandCloudID tests looking up commands by cloud command ID
+func TestPendingCommandCloudID(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "agsys-test-*.db")
+	if err != nil {
+		t.Fatalf("Failed to create temp db: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	tmpFile.Close()
+
+	db, err := storage.Open(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	// Two commands sharing a LoRa command ID, as after a wrap or restart
+	for _, cloudID := range []string{"cmd-old", "cmd-new"} {
+		_, err := db.InsertPendingCommand(&storage.PendingCommand{
+			CommandID:      7,
+			ControllerUID:  "0102030405060708",
+			ActuatorAddr:   1,
+			Command:        protocol.ValveCmdOpen,
+			ExpiresAt:      time.Now().Add(time.Minute),
+			MaxRetries:     3,
+			CloudCommandID: cloudID,
+		})
+		if err != nil {
+			t.Fatalf("InsertPendingCommand failed: %v", err)
+		}
+	}
+
+	cmd, err := db.GetPendingCommand(7)
+	if err != nil {
+		t.Fatalf("GetPendingCommand failed: %v", err)
+	}
+	if cmd.CloudCommandID != "cmd-new" {
+		t.Errorf("GetPendingCommand returned %q, want most recent", cmd.CloudCommandID)
+	}
+
+	cmd, err = db.GetPendingCommandByCloudID("cmd-old")
+	if err != nil {
+		t.Fatalf("GetPendingCommandByCloudID failed: %v", err)
+	}
+	if cmd.CommandID != 7 || cmd.Acknowledged {
+		t.Errorf("GetPendingCommandByCloudID = %+v", cmd)
+	}
+
+	if _, err := db.GetPendingCommandByCloudID("cmd-unknown"); err == nil {
+		t.Error("Expected error for unknown cloud command ID")
+	}
+}
+
+// TestValveRegistry tests mapping cloud valve IDs to controller and address
+func TestValveRegistry(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "agsys-test-*.db")
+	if err != nil {
+		t.Fatalf("Failed to create temp db: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	tmpFile.Close()
+
+	db, err := storage.Open(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	e := &Engine{config: DefaultConfig(), db: db}
+
+	if _, _, err := e.resolveValve("valve-1", "", 0); err == nil {
+		t.Error("Expected error for unmapped valve")
+	}
+
+	// Explicit controller is used when the valve isn't mapped
+	controller, addr, err := e.resolveValve("valve-1", "0102030405060708", 2)
+	if err != nil || controller != "0102030405060708" || addr != 2 {
+		t.Errorf("resolveValve fallback = %s/%d, %v", controller, addr, err)
+	}
+
+	if err := db.RegisterValve("valve-1", "0102030405060708", 5, "North field", ""); err != nil {
+		t.Fatalf("RegisterValve failed: %v", err)
+	}
+	controller, addr, err = e.resolveValve("valve-1", "", 0)
+	if err != nil || controller != "0102030405060708" || addr != 5 {
+		t.Errorf("resolveValve = %s/%d, %v", controller, addr, err)
+	}
+
+	// Remapping moves the valve ID
+	if err := db.RegisterValve("valve-1", "0102030405060708", 6, "North field", ""); err != nil {
+		t.Fatalf("RegisterValve remap failed: %v", err)
+	}
+	a, err := db.LookupValve("valve-1")
+	if err != nil || a == nil || a.Address != 6 {
+		t.Errorf("LookupValve after remap = %+v, %v", a, err)
+	}
+}
+
+// TestParseActuatorUID tests splitting actuator UIDs
+func TestParseActuatorUID(t *testing.T) {
+	tests := []struct {
+		uid        string
+		controller string
+		addr       uint8
+		wantErr    bool
+	}{
+		{"0102030405060708_05", "0102030405060708", 5, false},
+		{"0102030405060708_63", "0102030405060708", 63, false},
+		{"0102030405060708", "", 0, true},
+		{"0102030405060708_x", "", 0, true},
+	}
+
+	for _, tt := range tests {
+		controller, addr, err := parseActuatorUID(tt.uid)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseActuatorUID(%q) error = %v, wantErr %v", tt.uid, err, tt.wantErr)
+			continue
+		}
+		if controller != tt.controller || addr != tt.addr {
+			t.Errorf("parseActuatorUID(%q) = %s/%d, want %s/%d", tt.uid, controller, addr, tt.controller, tt.addr)
+		}
+	}
+}
+
 // TestDeviceUpsert tests device registration and updates
 func TestDeviceUpsert(t *testing.T) {
 	tmpFile, err := os.CreateTemp("", "agsys-test-*.db")
@@ -395,3 +846,4066 @@ func TestConfigUpdateFlow(t *testing.T) {
 		t.Errorf("Flags mismatch: got %d, want %d", parsedFlags, config.Flags)
 	}
 }
+
+// TestReload verifies runtime settings change while restart-only settings don't
+func TestReload(t *testing.T) {
+	cfg := DefaultConfig()
+	e := &Engine{
+		config:   cfg,
+		cloud:    cloud.NewGRPCClient(cloud.DefaultGRPCConfig()),
+		notifier: notify.New(notify.DefaultConfig()),
+		firmware: cloud.NewFirmwareClient(cloud.DefaultGRPCConfig()),
+		reloaded: make(chan struct{}),
+	}
+	notify := e.reloadNotify()
+
+	next := cfg
+	next.SyncInterval = 5 * time.Second
+	next.CommandRetries = 7
+	next.GRPCAddr = "grpc.example.com:443"
+	next.ValveLimits = []ValveLimit{{ControllerUID: "0102030405060708", Address: 1, MaxOpen: time.Minute}}
+	next.DatabasePath = "/tmp/other.db"
+	e.Reload(next)
+
+	select {
+	case <-notify:
+	default:
+		t.Error("Expected reload notification")
+	}
+
+	got := e.settings()
+	if got.SyncInterval != 5*time.Second || got.CommandRetries != 7 || got.GRPCAddr != "grpc.example.com:443" {
+		t.Errorf("Runtime settings not applied: %+v", got)
+	}
+	if e.valveMaxOpen("0102030405060708", 1) != time.Minute {
+		t.Error("Valve limits not applied")
+	}
+	if got.DatabasePath != cfg.DatabasePath {
+		t.Errorf("DatabasePath = %s, want unchanged %s", got.DatabasePath, cfg.DatabasePath)
+	}
+}
+
+// TestStatusCounts verifies device, unsynced, and command counts for status
+func TestStatusCounts(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "agsys-test-*.db")
+	if err != nil {
+		t.Fatalf("Failed to create temp db: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	tmpFile.Close()
+
+	db, err := storage.Open(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	now := time.Now()
+	for i, deviceType := range []uint8{0x01, 0x01, 0x03} {
+		d := &storage.Device{
+			UID:        fmt.Sprintf("000000000000000%d", i),
+			DeviceType: deviceType,
+			FirstSeen:  now,
+			LastSeen:   now,
+		}
+		if err := db.UpsertDevice(d); err != nil {
+			t.Fatalf("UpsertDevice failed: %v", err)
+		}
+	}
+
+	eventID, err := db.InsertValveEvent(&storage.ValveEvent{ControllerUID: "0102030405060708", Timestamp: now})
+	if err != nil {
+		t.Fatalf("InsertValveEvent failed: %v", err)
+	}
+	if _, err := db.InsertValveEvent(&storage.ValveEvent{ControllerUID: "0102030405060708", Timestamp: now}); err != nil {
+		t.Fatalf("InsertValveEvent failed: %v", err)
+	}
+	if err := db.AdvanceSyncCursor(storage.SyncValveEvents, eventID); err != nil {
+		t.Fatalf("AdvanceSyncCursor failed: %v", err)
+	}
+
+	if _, err := db.InsertPendingCommand(&storage.PendingCommand{
+		CommandID: 1, ControllerUID: "0102030405060708", ExpiresAt: now.Add(time.Minute),
+	}); err != nil {
+		t.Fatalf("InsertPendingCommand failed: %v", err)
+	}
+
+	counts, err := db.GetStatusCounts()
+	if err != nil {
+		t.Fatalf("GetStatusCounts failed: %v", err)
+	}
+	if counts.DevicesByType[0x01] != 2 || counts.DevicesByType[0x03] != 1 {
+		t.Errorf("DevicesByType = %v", counts.DevicesByType)
+	}
+	if counts.UnsyncedEvents != 1 {
+		t.Errorf("UnsyncedEvents = %d, want 1", counts.UnsyncedEvents)
+	}
+	if counts.PendingCommands != 1 || counts.FailedCommands != 0 {
+		t.Errorf("Commands = %d pending, %d failed", counts.PendingCommands, counts.FailedCommands)
+	}
+}
+
+// TestStalledLoop verifies the watchdog detects loops that stop iterating
+func TestStalledLoop(t *testing.T) {
+	e := &Engine{beats: make(map[string]loopBeat)}
+	e.beat("command retry", 5*time.Second)
+
+	now := time.Now()
+	if name := e.stalledLoop(now, time.Minute); name != "" {
+		t.Errorf("Fresh loop reported stalled: %s", name)
+	}
+	if name := e.stalledLoop(now.Add(2*time.Minute), time.Minute); name != "command retry" {
+		t.Errorf("stalledLoop = %q, want command retry", name)
+	}
+}
+
+// TestMaintenance verifies checkpoint, integrity check, and run history
+func TestMaintenance(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "agsys-test-*.db")
+	if err != nil {
+		t.Fatalf("Failed to create temp db: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	tmpFile.Close()
+
+	db, err := storage.Open(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	cfg := DefaultConfig()
+	cfg.Maintenance.VacuumInterval = 24 * time.Hour
+	cfg.Maintenance.BackupDir = t.TempDir()
+	cfg.Maintenance.BackupKeep = 2
+	e := &Engine{config: cfg, db: db}
+
+	// Outside the idle window only the checkpoint runs
+	last := make(map[string]time.Time)
+	noon := time.Date(2024, 6, 1, 12, 0, 0, 0, time.Local)
+	e.runMaintenance(noon, last)
+
+	runs, err := db.GetLastMaintenance()
+	if err != nil {
+		t.Fatalf("GetLastMaintenance failed: %v", err)
+	}
+	if r := runs["checkpoint"]; r == nil || !r.OK {
+		t.Fatalf("Expected successful checkpoint, got %+v", r)
+	}
+	if runs["integrity_check"] != nil || runs["vacuum"] != nil || runs["backup"] != nil {
+		t.Error("Integrity check, vacuum, and backup should wait for the idle window")
+	}
+
+	night := time.Date(2024, 6, 2, 3, 0, 0, 0, time.Local)
+	e.runMaintenance(night, last)
+
+	runs, err = db.GetLastMaintenance()
+	if err != nil {
+		t.Fatalf("GetLastMaintenance failed: %v", err)
+	}
+	for _, task := range []string{"checkpoint", "integrity_check", "vacuum", "backup"} {
+		if r := runs[task]; r == nil || !r.OK || !r.RanAt.Equal(night) {
+			t.Errorf("%s: got %+v, want successful run at %s", task, r, night)
+		}
+	}
+
+	// Only the newest backups are kept
+	for day := 3; day <= 4; day++ {
+		e.runMaintenance(time.Date(2024, 6, day, 3, 0, 0, 0, time.Local), last)
+	}
+	backups, _ := filepath.Glob(filepath.Join(cfg.Maintenance.BackupDir, "*.db"))
+	want := []string{
+		filepath.Join(cfg.Maintenance.BackupDir, "controller-20240603-030000.db"),
+		filepath.Join(cfg.Maintenance.BackupDir, "controller-20240604-030000.db"),
+	}
+	if !slices.Equal(backups, want) {
+		t.Errorf("Backups = %v, want %v", backups, want)
+	}
+
+	// A missing backup directory fails the backup instead of creating it
+	e.config.Maintenance.BackupDir = filepath.Join(cfg.Maintenance.BackupDir, "unmounted")
+	e.runMaintenance(time.Date(2024, 6, 5, 3, 0, 0, 0, time.Local), last)
+	if runs, _ := db.GetLastMaintenance(); runs["backup"] == nil || runs["backup"].OK {
+		t.Errorf("Backup to a missing directory: got %+v, want a failed run", runs["backup"])
+	}
+}
+
+// TestDatabaseRecovery verifies a damaged database is replaced by the newest
+// usable backup at startup
+func TestDatabaseRecovery(t *testing.T) {
+	dir := t.TempDir()
+	cfg := DefaultConfig()
+	cfg.DatabasePath = filepath.Join(dir, "controller.db")
+	cfg.Maintenance.BackupDir = filepath.Join(dir, "backups")
+	if err := os.Mkdir(cfg.Maintenance.BackupDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	db, recovery, err := openDatabase(cfg)
+	if err != nil || recovery != "" {
+		t.Fatalf("openDatabase on a new database = %q, %v", recovery, err)
+	}
+	if _, err := db.InsertWaterMeterReading(&storage.WaterMeterReading{DeviceUID: "0102030405060708", Timestamp: time.Now()}); err != nil {
+		t.Fatalf("InsertWaterMeterReading failed: %v", err)
+	}
+	good := filepath.Join(cfg.Maintenance.BackupDir, "controller-20240601-030000.db")
+	if err := db.Backup(context.Background(), good); err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+	db.Close()
+
+	// The newest backup is damaged too, so the one before it is restored
+	junk := []byte("not a database, just what was left on the SD card")
+	os.WriteFile(filepath.Join(cfg.Maintenance.BackupDir, "controller-20240602-030000.db"), junk, 0o644)
+	os.WriteFile(cfg.DatabasePath, junk, 0o644)
+
+	db, recovery, err = openDatabase(cfg)
+	if err != nil {
+		t.Fatalf("openDatabase failed: %v", err)
+	}
+	if !strings.Contains(recovery, "restored from backup controller-20240601-030000.db") {
+		t.Errorf("Recovery = %q, want a restore from the good backup", recovery)
+	}
+	if latest, err := db.GetLatestWaterMeterReading("0102030405060708"); err != nil || latest == nil {
+		t.Errorf("Reading not restored: %+v, %v", latest, err)
+	}
+	db.Close()
+	if aside, _ := filepath.Glob(cfg.DatabasePath + ".corrupt-*"); len(aside) != 1 {
+		t.Errorf("Damaged database moved aside as %v, want one file", aside)
+	}
+
+	// Without a backup the controller starts over
+	os.WriteFile(cfg.DatabasePath, junk, 0o644)
+	cfg.Maintenance.BackupDir = ""
+	db, recovery, err = openDatabase(cfg)
+	if err != nil {
+		t.Fatalf("openDatabase failed: %v", err)
+	}
+	db.Close()
+	if !strings.Contains(recovery, "empty database") {
+		t.Errorf("Recovery = %q, want a fresh database", recovery)
+	}
+
+	// Failures that aren't damage are returned as before
+	cfg.DatabasePath = filepath.Join(dir, "missing", "controller.db")
+	if _, _, err := openDatabase(cfg); err == nil {
+		t.Error("openDatabase in a missing directory succeeded")
+	}
+}
+
+// TestIdleWindow verifies idle windows with and without wrapping midnight
+func TestIdleWindow(t *testing.T) {
+	tests := []struct {
+		start, end int
+		hour       int
+		want       bool
+	}{
+		{2, 5, 1, false},
+		{2, 5, 2, true},
+		{2, 5, 4, true},
+		{2, 5, 5, false},
+		{22, 4, 23, true},
+		{22, 4, 3, true},
+		{22, 4, 12, false},
+	}
+
+	for _, tt := range tests {
+		c := MaintenanceConfig{IdleStartHour: tt.start, IdleEndHour: tt.end}
+		if got := c.inIdleWindow(tt.hour); got != tt.want {
+			t.Errorf("inIdleWindow(%d-%d, %d) = %v, want %v", tt.start, tt.end, tt.hour, got, tt.want)
+		}
+	}
+}
+
+// TestRollups verifies hourly and daily rollups of soil and meter readings
+func TestRollups(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "agsys-test-*.db")
+	if err != nil {
+		t.Fatalf("Failed to create temp db: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	tmpFile.Close()
+
+	db, err := storage.Open(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	day := time.Date(2024, 6, 1, 0, 0, 0, 0, time.Local)
+	soil := []struct {
+		at       time.Duration
+		moisture uint8
+	}{
+		{10 * time.Hour, 30},
+		{10*time.Hour + 30*time.Minute, 40},
+		{11 * time.Hour, 50},
+	}
+	for _, r := range soil {
+		if _, err := db.InsertSoilMoistureReading(&storage.SoilMoistureReading{
+			DeviceUID: "0000000000000001", MoisturePercent: r.moisture, Temperature: 200, Timestamp: day.Add(r.at),
+		}); err != nil {
+			t.Fatalf("InsertSoilMoistureReading failed: %v", err)
+		}
+	}
+
+	meter := []struct {
+		at    time.Duration
+		total float32
+		flow  float32
+	}{
+		{10 * time.Hour, 100, 0},
+		{10*time.Hour + 30*time.Minute, 130, 2},
+		{11 * time.Hour, 5, 4}, // Totalizer reset
+		{11*time.Hour + 30*time.Minute, 25, 6},
+	}
+	for _, r := range meter {
+		if _, err := db.InsertWaterMeterReading(&storage.WaterMeterReading{
+			DeviceUID: "0000000000000002", TotalVolumeL: r.total, FlowRateLPM: r.flow, Timestamp: day.Add(r.at),
+		}); err != nil {
+			t.Fatalf("InsertWaterMeterReading failed: %v", err)
+		}
+	}
+
+	if err := db.UpdateRollups(day.AddDate(0, 0, 1).Add(time.Hour)); err != nil {
+		t.Fatalf("UpdateRollups failed: %v", err)
+	}
+
+	hours, err := db.GetSoilRollups("", storage.RollupHour, day)
+	if err != nil {
+		t.Fatalf("GetSoilRollups failed: %v", err)
+	}
+	if len(hours) != 2 {
+		t.Fatalf("Expected 2 hourly soil rollups, got %d", len(hours))
+	}
+	if h := hours[0]; h.Samples != 2 || h.MoistureMin != 30 || h.MoistureMax != 40 || h.MoistureAvg != 35 {
+		t.Errorf("Hour 10 soil rollup = %+v", h)
+	}
+
+	days, err := db.GetSoilRollups("0000000000000001", storage.RollupDay, day)
+	if err != nil {
+		t.Fatalf("GetSoilRollups failed: %v", err)
+	}
+	if len(days) != 1 || days[0].Samples != 3 || days[0].MoistureAvg != 40 || !days[0].PeriodStart.Equal(day) {
+		t.Errorf("Daily soil rollups = %+v", days)
+	}
+
+	meterHours, err := db.GetMeterRollups("", storage.RollupHour, day)
+	if err != nil {
+		t.Fatalf("GetMeterRollups failed: %v", err)
+	}
+	if len(meterHours) != 2 || meterHours[0].VolumeDeltaL != 30 || meterHours[1].VolumeDeltaL != 20 {
+		t.Fatalf("Hourly meter rollups = %+v", meterHours)
+	}
+
+	meterDays, err := db.GetMeterRollups("0000000000000002", storage.RollupDay, day)
+	if err != nil {
+		t.Fatalf("GetMeterRollups failed: %v", err)
+	}
+	if len(meterDays) != 1 {
+		t.Fatalf("Expected 1 daily meter rollup, got %d", len(meterDays))
+	}
+	if d := meterDays[0]; d.Samples != 4 || d.VolumeDeltaL != 50 || d.FlowMax != 6 || d.FlowAvg != 3 || d.TotalVolumeL != 25 {
+		t.Errorf("Daily meter rollup = %+v", d)
+	}
+
+	// Rerunning is idempotent
+	if err := db.UpdateRollups(day.AddDate(0, 0, 1).Add(time.Hour)); err != nil {
+		t.Fatalf("UpdateRollups failed: %v", err)
+	}
+	if again, _ := db.GetMeterRollups("", storage.RollupDay, day); len(again) != 1 || again[0].VolumeDeltaL != 50 {
+		t.Errorf("Rerun changed daily meter rollups: %+v", again)
+	}
+}
+
+// TestKeyRotation verifies key delivery, ack, abandonment, and restore
+func TestKeyRotation(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "agsys-test-*.db")
+	if err != nil {
+		t.Fatalf("Failed to create temp db: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	tmpFile.Close()
+
+	db, err := storage.Open(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	newEngine := func() *Engine {
+		driver, err := lora.New(lora.DefaultConfig())
+		if err != nil {
+			t.Fatalf("Failed to create LoRa driver: %v", err)
+		}
+		cfg := DefaultConfig()
+		cfg.KeyRotation.Retries = 0
+		e := &Engine{config: cfg, db: db, lora: driver, rotations: make(map[string]*keyRotation)}
+		if err := e.loadDeviceKeys(); err != nil {
+			t.Fatalf("loadDeviceKeys failed: %v", err)
+		}
+		return e
+	}
+
+	const deviceUID = "0102030405060708"
+	uid, _ := lora.ParseDeviceUID(deviceUID)
+	e := newEngine()
+
+	if err := e.RotateDeviceKey(deviceUID); err != nil {
+		t.Fatalf("RotateDeviceKey failed: %v", err)
+	}
+	if err := e.RotateDeviceKey(deviceUID); err == nil {
+		t.Error("Expected error for rotation already in progress")
+	}
+
+	ack := &protocol.LoRaMessage{
+		Header:  protocol.Header{MsgType: protocol.MsgTypeKeyRotateAck, DeviceUID: uid},
+		Payload: (&protocol.KeyRotateAckPayload{KeyID: 1}).Encode(),
+	}
+	e.handleKeyRotateAck(deviceUID, ack)
+
+	if info, ok := e.lora.Keys().Info(uid); !ok || info.KeyID != 1 || info.HasPending {
+		t.Errorf("Driver key state after ack = %+v, want key 1 active", info)
+	}
+	active, err := db.GetDeviceKeys(storage.DeviceKeyActive)
+	if err != nil || len(active) != 1 || active[0].KeyID != 1 {
+		t.Fatalf("Active keys = %+v (err %v), want key 1", active, err)
+	}
+
+	// A second rotation that is never acked is abandoned after its retries
+	if err := e.RotateDeviceKey(deviceUID); err != nil {
+		t.Fatalf("RotateDeviceKey failed: %v", err)
+	}
+	e.retryKeyRotations(time.Now().Add(time.Hour))
+
+	if len(e.rotations) != 0 {
+		t.Error("Exhausted rotation should be removed")
+	}
+	failed, err := db.GetDeviceKeys(storage.DeviceKeyFailed)
+	if err != nil || len(failed) != 1 || failed[0].KeyID != 2 {
+		t.Errorf("Failed keys = %+v (err %v), want key 2", failed, err)
+	}
+
+	// The active key survives a restart
+	e = newEngine()
+	if info, ok := e.lora.Keys().Info(uid); !ok || info.KeyID != 1 {
+		t.Errorf("Restored key state = %+v, want key 1", info)
+	}
+	keys, err := e.DeviceKeys()
+	if err != nil || len(keys) != 1 || keys[0].State != "active" {
+		t.Errorf("DeviceKeys = %+v (err %v), want one active key", keys, err)
+	}
+}
+
+// TestKeyRotationEncrypted verifies rotated keys survive a restart only with
+// the database key they were encrypted under
+func TestKeyRotationEncrypted(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "agsys-test-*.db")
+	if err != nil {
+		t.Fatalf("Failed to create temp db: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	tmpFile.Close()
+
+	key := make([]byte, storage.DatabaseKeySize)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	openDB := func(key []byte) *storage.DB {
+		db, err := storage.Open(tmpFile.Name())
+		if err != nil {
+			t.Fatalf("Failed to open database: %v", err)
+		}
+		if key != nil {
+			if _, err := db.SetEncryptionKey(key); err != nil {
+				db.Close()
+				t.Fatalf("SetEncryptionKey failed: %v", err)
+			}
+		}
+		return db
+	}
+	newEngine := func(db *storage.DB) *Engine {
+		driver, err := lora.New(lora.DefaultConfig())
+		if err != nil {
+			t.Fatalf("Failed to create LoRa driver: %v", err)
+		}
+		cfg := DefaultConfig()
+		cfg.KeyRotation.Retries = 0
+		return &Engine{config: cfg, db: db, lora: driver, rotations: make(map[string]*keyRotation)}
+	}
+
+	const deviceUID = "0102030405060708"
+	uid, _ := lora.ParseDeviceUID(deviceUID)
+	db := openDB(key)
+	e := newEngine(db)
+	if err := e.RotateDeviceKey(deviceUID); err != nil {
+		t.Fatalf("RotateDeviceKey failed: %v", err)
+	}
+	e.handleKeyRotateAck(deviceUID, &protocol.LoRaMessage{
+		Header:  protocol.Header{MsgType: protocol.MsgTypeKeyRotateAck, DeviceUID: uid},
+		Payload: (&protocol.KeyRotateAckPayload{KeyID: 1}).Encode(),
+	})
+	db.Close()
+
+	db = openDB(nil)
+	if err := newEngine(db).loadDeviceKeys(); err == nil {
+		t.Error("Encrypted keys loaded without the database key")
+	}
+	wrong := slices.Clone(key)
+	wrong[0] ^= 0xFF
+	if _, err := db.SetEncryptionKey(wrong); err == nil {
+		t.Error("SetEncryptionKey accepted a key the device keys weren't encrypted with")
+	}
+	db.Close()
+
+	db = openDB(key)
+	defer db.Close()
+	e = newEngine(db)
+	if err := e.loadDeviceKeys(); err != nil {
+		t.Fatalf("loadDeviceKeys failed: %v", err)
+	}
+	if info, ok := e.lora.Keys().Info(uid); !ok || info.KeyID != 1 {
+		t.Errorf("Restored key state = %+v, want key 1", info)
+	}
+}
+
+// TestLinkQuality verifies per-device RSSI/SNR summaries and pruning
+func TestLinkQuality(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "agsys-test-*.db")
+	if err != nil {
+		t.Fatalf("Failed to create temp db: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	tmpFile.Close()
+
+	db, err := storage.Open(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	now := time.Now()
+	samples := []storage.LinkSample{
+		{DeviceUID: "AAAA000000000001", RSSI: -80, SNR: 8, ReceivedAt: now.Add(-2 * time.Hour)},
+		{DeviceUID: "AAAA000000000001", RSSI: -100, SNR: -2, ReceivedAt: now.Add(-time.Hour)},
+		{DeviceUID: "AAAA000000000001", RSSI: -90, SNR: 3, ReceivedAt: now},
+		{DeviceUID: "AAAA000000000002", RSSI: -115, SNR: -12, ReceivedAt: now},
+		{DeviceUID: "AAAA000000000002", RSSI: -60, SNR: 10, ReceivedAt: now.Add(-48 * time.Hour)},
+	}
+	for i := range samples {
+		if err := db.InsertLinkSample(&samples[i]); err != nil {
+			t.Fatalf("InsertLinkSample failed: %v", err)
+		}
+	}
+
+	stats, err := db.GetLinkQualityStats(now.Add(-24 * time.Hour))
+	if err != nil {
+		t.Fatalf("GetLinkQualityStats failed: %v", err)
+	}
+	if len(stats) != 2 {
+		t.Fatalf("Expected 2 devices, got %d", len(stats))
+	}
+	s := stats[0]
+	if s.DeviceUID != "AAAA000000000001" || s.Samples != 3 || s.BestRSSI != -80 || s.WorstRSSI != -100 ||
+		s.AvgRSSI != -90 || s.BestSNR != 8 || s.WorstSNR != -2 || s.AvgSNR != 3 {
+		t.Errorf("Unexpected stats for device 1: %+v", s)
+	}
+	if stats[1].Samples != 1 || stats[1].BestRSSI != -115 {
+		t.Errorf("Old sample should be outside the window: %+v", stats[1])
+	}
+
+	n, err := db.DeleteLinkSamplesBefore(now.Add(-24 * time.Hour))
+	if err != nil || n != 1 {
+		t.Errorf("DeleteLinkSamplesBefore = %d (err %v), want 1", n, err)
+	}
+}
+
+// TestGatewayHealth tests gateway stats scoring and the degraded gateway
+// alert
+func TestGatewayHealth(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "agsys-test-*.db")
+	if err != nil {
+		t.Fatalf("Failed to create temp db: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	tmpFile.Close()
+
+	db, err := storage.Open(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	e := &Engine{
+		config:   DefaultConfig(),
+		db:       db,
+		cloud:    cloud.NewGRPCClient(cloud.DefaultGRPCConfig()),
+		notifier: notify.New(notify.DefaultConfig()),
+	}
+	e.subscribe()
+
+	const gateway, quiet = "0016C001FF10A235", "0016C001FF10A236"
+	report := func(id string, rx, rxOK, tx, txOK uint32) {
+		e.handleGatewayStats(&gw.GatewayStats{GatewayId: id, RxPacketsReceived: rx, RxPacketsReceivedOk: rxOK,
+			TxPacketsReceived: tx, TxPacketsEmitted: txOK})
+	}
+	report(gateway, 40, 40, 10, 10)
+	report(gateway, 60, 30, 10, 8)
+	report(quiet, 5, 0, 1, 0) // Too few packets to score
+
+	now := time.Now()
+	health, err := e.gatewayHealthAt(now)
+	if err != nil {
+		t.Fatalf("gatewayHealthAt failed: %v", err)
+	}
+	if len(health) != 2 {
+		t.Fatalf("Scored %d gateways, want 2", len(health))
+	}
+	h := health[0]
+	if h.GatewayID != gateway || h.RxReceived != 100 || h.RxOK != 70 || h.TxReceived != 20 || h.TxEmitted != 18 ||
+		h.CRCErrorRate != 0.3 || h.TxFailureRate != 0.1 || h.Score != 63 || h.LastReport.IsZero() {
+		t.Errorf("Unexpected health: %+v", h)
+	}
+	if health[1].Score != 100 {
+		t.Errorf("Quiet gateway scored %d, want 100", health[1].Score)
+	}
+
+	// The degraded gateway alerts once and clears when its score recovers
+	e.checkGatewayHealth(now)
+	e.checkGatewayHealth(now)
+	open, _ := db.GetOpenAlerts()
+	if len(open) != 1 || open[0].DeviceUID != gateway || open[0].AlertType != alertGatewayHealth || open[0].Count != 1 {
+		t.Fatalf("Unexpected gateway alerts: %+v", open)
+	}
+	report(gateway, 900, 900, 180, 180)
+	e.checkGatewayHealth(now)
+	if open, _ := db.GetOpenAlerts(); len(open) != 0 {
+		t.Fatalf("Gateway alert not cleared: %+v", open)
+	}
+
+	// Reports older than the window don't count
+	if health, _ := e.gatewayHealthAt(now.Add(2 * time.Hour)); len(health) != 0 {
+		t.Errorf("Scored %d gateways outside the window", len(health))
+	}
+	if n, err := db.DeleteGatewayStatsBefore(now.Add(time.Minute)); err != nil || n != 4 {
+		t.Errorf("DeleteGatewayStatsBefore = %d (err %v), want 4", n, err)
+	}
+}
+
+// TestDeviceClock tests clock skew storage and drift-based resync scheduling
+func TestDeviceClock(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "agsys-test-*.db")
+	if err != nil {
+		t.Fatalf("Failed to create temp db: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	tmpFile.Close()
+
+	db, err := storage.Open(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	if err := db.UpsertDevice(&storage.Device{UID: "AAAA000000000001", DeviceType: 1}); err != nil {
+		t.Fatalf("UpsertDevice failed: %v", err)
+	}
+	if err := db.UpsertDevice(&storage.Device{UID: "AAAA000000000002", DeviceType: 1}); err != nil {
+		t.Fatalf("UpsertDevice failed: %v", err)
+	}
+
+	ppm := 120.5
+	checked := time.Now().Truncate(time.Second)
+	if err := db.UpdateDeviceClock(&storage.DeviceClock{
+		DeviceUID: "AAAA000000000001",
+		Skew:      -3 * time.Second,
+		DriftPPM:  &ppm,
+		CheckedAt: checked,
+	}); err != nil {
+		t.Fatalf("UpdateDeviceClock failed: %v", err)
+	}
+
+	clocks, err := db.GetDeviceClocks()
+	if err != nil {
+		t.Fatalf("GetDeviceClocks failed: %v", err)
+	}
+	if len(clocks) != 1 {
+		t.Fatalf("Expected 1 device clock, got %d", len(clocks))
+	}
+	c := clocks[0]
+	if c.Skew != -3*time.Second || c.DriftPPM == nil || *c.DriftPPM != ppm || !c.CheckedAt.Equal(checked) {
+		t.Errorf("Unexpected device clock: %+v", c)
+	}
+
+	cfg := ClockConfig{SkewThreshold: 5 * time.Second, MinResyncInterval: 15 * time.Minute}
+	now := time.Now()
+	drift := func(v float64) *float64 { return &v }
+
+	tests := []struct {
+		name  string
+		skew  time.Duration
+		drift *float64
+		want  time.Duration // 0 means no extra sync
+	}{
+		{"within threshold, no drift yet", 2 * time.Second, nil, 0},
+		{"over threshold, no drift yet", 10 * time.Second, nil, 15 * time.Minute},
+		{"slow drift covered by broadcast", time.Second, drift(1), 0},
+		{"fast drift", 3 * time.Second, drift(2500), 2000 * time.Second},
+		{"negative drift", -3 * time.Second, drift(-2500), 2000 * time.Second},
+		{"very fast drift clamped", 30 * time.Second, drift(50000), 15 * time.Minute},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := resyncAt(now, tt.skew, tt.drift, cfg, time.Hour)
+			if tt.want == 0 {
+				if !got.IsZero() {
+					t.Errorf("resyncAt = %v, want no extra sync", got.Sub(now))
+				}
+				return
+			}
+			if got.Sub(now) != tt.want {
+				t.Errorf("resyncAt = %v, want %v", got.Sub(now), tt.want)
+			}
+		})
+	}
+}
+
+// TestZoneSync tests zone CRUD and full-list replacement
+func TestZoneSync(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "agsys-test-*.db")
+	if err != nil {
+		t.Fatalf("Failed to create temp db: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	tmpFile.Close()
+
+	db, err := storage.Open(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	e := &Engine{db: db, config: Config{PropertyUID: "PROP-1"}}
+
+	e.handleZoneUpdate(map[string]string{"zone_id": "z1", "name": "North Block", "alias": "north"})
+	e.handleZoneUpdate(map[string]string{"zone_id": "z2", "name": "South Block"})
+	e.handleZoneUpdate(map[string]string{"zone_id": "z3"}) // Missing name, ignored
+
+	z, err := db.GetZone("z1")
+	if err != nil || z == nil {
+		t.Fatalf("GetZone failed: %v", err)
+	}
+	if z.Name != "North Block" || z.Alias != "north" || z.PropertyID != "PROP-1" {
+		t.Errorf("Unexpected zone: %+v", z)
+	}
+	if z, _ := db.GetZone("z3"); z != nil {
+		t.Errorf("Zone without a name should not be stored")
+	}
+
+	e.handleZoneUpdate(map[string]string{"zone_id": "z2", "deleted": "true"})
+	if z, _ := db.GetZone("z2"); z != nil {
+		t.Errorf("Zone z2 should be deleted")
+	}
+
+	e.handleZonesSync(map[string]string{"z1": "North", "z4": "East"})
+	zones, err := db.GetZones()
+	if err != nil {
+		t.Fatalf("GetZones failed: %v", err)
+	}
+	if len(zones) != 2 || zones[0].UID != "z4" || zones[1].UID != "z1" {
+		t.Fatalf("Unexpected zones after sync: %+v", zones)
+	}
+	if zones[1].Name != "North" || zones[1].Alias != "north" {
+		t.Errorf("Sync should rename z1 and keep its alias: %+v", zones[1])
+	}
+
+	e.handleZonesSync(map[string]string{})
+	if zones, _ := db.GetZones(); len(zones) != 0 {
+		t.Errorf("Empty sync should remove all zones, got %d", len(zones))
+	}
+}
+
+// TestActuatorMetadata tests cloud updates of actuator names, aliases, and zones
+func TestActuatorMetadata(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "agsys-test-*.db")
+	if err != nil {
+		t.Fatalf("Failed to create temp db: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	tmpFile.Close()
+
+	db, err := storage.Open(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	e := &Engine{db: db, config: Config{PropertyUID: "PROP-1"}}
+	const controller = "0102030405060708"
+	db.UpsertDevice(&storage.Device{UID: controller, DeviceType: protocol.DeviceTypeValveController})
+	e.handleZoneUpdate(map[string]string{"zone_id": "z1", "name": "North Block"})
+
+	// Auto-created actuators get a default name
+	db.UpdateValveActuatorState(controller, 3, protocol.ValveStateClosed)
+	e.handleActuatorUpdate(map[string]string{"actuator_uid": controller + "_03", "name": "Vines row 1", "alias": "v1", "zone_id": "z1"})
+	// Metadata can arrive before the actuator has reported
+	e.handleActuatorUpdate(map[string]string{"controller_uid": controller, "actuator_address": "4", "alias": "v2"})
+	e.handleActuatorUpdate(map[string]string{"controller_uid": controller}) // No address, ignored
+
+	valves, err := e.Valves()
+	if err != nil {
+		t.Fatalf("Valves failed: %v", err)
+	}
+	if len(valves) != 2 {
+		t.Fatalf("got %d valves, want 2: %+v", len(valves), valves)
+	}
+	if v := valves[0]; v.Name != "Vines row 1" || v.Alias != "v1" || v.ZoneName != "North Block" || v.State != "CLOSED" {
+		t.Errorf("Unexpected valve 3: %+v", v)
+	}
+	if v := valves[1]; v.Name != "Valve 4" || v.Alias != "v2" || v.ZoneID != "" {
+		t.Errorf("Unexpected valve 4: %+v", v)
+	}
+
+	// Only the keys sent change; empty values clear or reset them
+	e.handleActuatorUpdate(map[string]string{"actuator_uid": controller + "_03", "alias": "", "name": ""})
+	valves, _ = e.Valves()
+	if v := valves[0]; v.Name != "Valve 3" || v.Alias != "" || v.ZoneID != "z1" {
+		t.Errorf("Unexpected valve 3 after partial update: %+v", v)
+	}
+
+	// A valve mapping keeps the alias unless one is sent
+	e.handleConfigUpdateGRPC(&controllerv1.ConfigUpdate{Target: "valve", Config: map[string]string{
+		"valve_id": "valve-4", "controller_uid": controller, "actuator_address": "4", "name": "Orchard"}})
+	valves, _ = e.Valves()
+	if v := valves[1]; v.Name != "Orchard" || v.Alias != "v2" || v.ValveID != "valve-4" || !v.Registered {
+		t.Errorf("Unexpected valve 4 after mapping: %+v", v)
+	}
+}
+
+// TestEventStream tests that stored records reach local API event streams
+func TestEventStream(t *testing.T) {
+	dir := t.TempDir()
+	api := localapi.NewServer(localapi.Config{SocketPath: filepath.Join(dir, "api.sock"), SocketMode: 0600}, nil, nil)
+	if err := api.Start(); err != nil {
+		t.Fatalf("Failed to start local API: %v", err)
+	}
+	e := &Engine{api: api}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	received := make(chan localapi.Event, 16)
+	done := make(chan error, 1)
+	go func() {
+		client := localapi.NewClient(filepath.Join(dir, "api.sock"))
+		done <- client.Events(ctx, []string{localapi.EventValve, localapi.EventAlarm}, "", func(ev localapi.Event) {
+			received <- ev
+		})
+	}()
+
+	// The stream subscribes asynchronously; publish until it is listening
+	deadline := time.After(5 * time.Second)
+	var ev localapi.Event
+waiting:
+	for {
+		e.publishEvent(1, &storage.SoilMoistureReading{DeviceUID: "AAAA000000000001"}) // Filtered out
+		e.publishEvent(7, &storage.ValveEvent{ControllerUID: "AAAA000000000002", ActuatorAddr: 3, NewState: 1})
+		select {
+		case ev = <-received:
+			break waiting
+		case <-time.After(20 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("No event received")
+		}
+	}
+	if ev.Type != localapi.EventValve || ev.ID != 7 || ev.DeviceUID != "AAAA000000000002" {
+		t.Errorf("Unexpected event: %+v", ev)
+	}
+
+	e.publishEvent(9, &storage.MeterAlarm{DeviceUID: "AAAA000000000003", AlarmType: 1})
+	for {
+		select {
+		case ev = <-received:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Alarm event not received")
+		}
+		if ev.Type != localapi.EventValve {
+			break
+		}
+	}
+	if ev.Type != localapi.EventAlarm || ev.DeviceUID != "AAAA000000000003" {
+		t.Errorf("Unexpected event: %+v", ev)
+	}
+
+	// Stopping the server ends the stream
+	if err := api.Stop(); err != nil {
+		t.Errorf("Stop failed: %v", err)
+	}
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("Events should report the closed stream")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stream did not end on server stop")
+	}
+}
+
+// TestWeatherAdjustment tests rain skip, rain reduction, and ET scaling
+func TestWeatherAdjustment(t *testing.T) {
+	now := time.Date(2026, 7, 1, 12, 0, 0, 0, time.UTC)
+	cfg := DefaultWeatherConfig()
+	cfg.ReferenceET = 6
+
+	totals := func(rain, et float64) *storage.WeatherTotals {
+		return &storage.WeatherTotals{Hours: 24, RainMM: rain, ETMM: et, UpdatedAt: now.Add(-time.Hour)}
+	}
+
+	tests := []struct {
+		name      string
+		past      *storage.WeatherTotals
+		ahead     *storage.WeatherTotals
+		wantScale float64
+		wantNote  bool
+	}{
+		{"no data", &storage.WeatherTotals{}, &storage.WeatherTotals{}, 1, false},
+		{"stale data", totals(0, 0), &storage.WeatherTotals{Hours: 24, RainMM: 20, UpdatedAt: now.Add(-12 * time.Hour)}, 1, false},
+		{"reference ET, dry", totals(0, 0), totals(0, 6), 1, false},
+		{"rain fallen and forecast adds up to skip", totals(4, 0), totals(2.5, 6), 0, true},
+		{"light rain reduces", totals(0, 0), totals(4, 6), 0.5, true},
+		{"hot day scales up", totals(0, 0), totals(0, 7.5), 1.25, true},
+		{"ET scale is bounded", totals(0, 0), totals(0, 1), 0.5, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			adj := adjustForWeather(cfg, tt.past, tt.ahead, now)
+			if diff := adj.scale - tt.wantScale; diff > 0.001 || diff < -0.001 {
+				t.Errorf("scale = %.3f, want %.3f", adj.scale, tt.wantScale)
+			}
+			if (adj.reason != "") != tt.wantNote {
+				t.Errorf("reason = %q", adj.reason)
+			}
+		})
+	}
+
+	entries := []storage.ScheduleEntry{{DurationMins: 20}, {DurationMins: 1}}
+	got := weatherScheduleEntries(entries, weatherAdjustment{scale: 0.4, reason: "rain"})
+	if len(got) != 1 || got[0].DurationMins != 8 {
+		t.Errorf("Scaled entries = %+v, want one 8 minute run", got)
+	}
+	if got := weatherScheduleEntries(entries, weatherAdjustment{reason: "rain"}); len(got) != 0 {
+		t.Errorf("Skipped schedule should send no entries, got %+v", got)
+	}
+}
+
+type fakeWeather struct{}
+
+func (fakeWeather) Fetch(ctx context.Context) ([]weather.Hour, error) { return nil, nil }
+
+// TestWeatherRuns tests that runs the weather skips are annotated in valve events
+func TestWeatherRuns(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "agsys-test-*.db")
+	if err != nil {
+		t.Fatalf("Failed to create temp db: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	tmpFile.Close()
+
+	db, err := storage.Open(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	e := &Engine{
+		db:      db,
+		config:  Config{Weather: DefaultWeatherConfig()},
+		cloud:   cloud.NewGRPCClient(cloud.DefaultGRPCConfig()),
+		weather: fakeWeather{},
+	}
+
+	now := time.Now().Truncate(time.Minute)
+	var hours []*storage.WeatherHour
+	for h := now.Truncate(time.Hour); h.Before(now.Add(12 * time.Hour)); h = h.Add(time.Hour) {
+		hours = append(hours, &storage.WeatherHour{Hour: h, RainMM: 1, UpdatedAt: now})
+	}
+	if err := db.UpsertWeatherHours(hours); err != nil {
+		t.Fatalf("UpsertWeatherHours failed: %v", err)
+	}
+
+	controller := "0102030405060708"
+	db.UpsertDevice(&storage.Device{UID: controller, DeviceType: protocol.DeviceTypeValveController, Name: "Valves"})
+	local := now.Local()
+	start := local.Add(-time.Minute)
+	if err := db.UpsertSchedule(&storage.Schedule{UID: "s1", ControllerUID: controller, Version: 1, Name: "Morning", IsActive: true},
+		[]storage.ScheduleEntry{
+			{DayMask: 1 << uint(start.Weekday()), StartHour: uint8(start.Hour()), StartMinute: uint8(start.Minute()), DurationMins: 30, ActuatorMask: 0b101},
+			{DayMask: 0x7F, StartHour: uint8((local.Hour() + 3) % 24), DurationMins: 30, ActuatorMask: 0b10},
+		}); err != nil {
+		t.Fatalf("UpsertSchedule failed: %v", err)
+	}
+
+	e.annotateWeatherRuns(now.Add(-2*time.Minute), now)
+
+	events, err := db.GetUnsyncedValveEvents(10)
+	if err != nil {
+		t.Fatalf("GetUnsyncedValveEvents failed: %v", err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("Expected events for actuators 0 and 2, got %d", len(events))
+	}
+	for _, ev := range events {
+		if ev.Source != "weather" || ev.Note == "" || (ev.ActuatorAddr != 0 && ev.ActuatorAddr != 2) {
+			t.Errorf("Unexpected event: %+v", ev)
+		}
+	}
+
+	// Served schedules drop the skipped runs
+	_, entries, _ := db.GetScheduleForController(controller)
+	if got := weatherScheduleEntries(entries, e.currentWeather(now)); len(got) != 0 {
+		t.Errorf("Expected all runs skipped, got %+v", got)
+	}
+}
+
+// TestCloudSchedules tests that cloud schedules are split by valve
+// controller into one entry per run and start time, and that a controller's
+// version moves forward only when its part changes
+func TestCloudSchedules(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "agsys-test-*.db")
+	if err != nil {
+		t.Fatalf("Failed to create temp db: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	tmpFile.Close()
+
+	db, err := storage.Open(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	driver, err := lora.New(lora.DefaultConfig())
+	if err != nil {
+		t.Fatalf("Failed to create LoRa driver: %v", err)
+	}
+	e := &Engine{config: DefaultConfig(), db: db, lora: driver, cloud: cloud.NewGRPCClient(cloud.DefaultGRPCConfig())}
+
+	const a, b = "0102030405060708", "0102030405060709"
+	db.RegisterValve("v1", a, 1, "", "")
+	db.RegisterValve("v2", a, 2, "", "")
+	db.RegisterValve("v3", b, 0, "", "")
+
+	update := func(valves ...string) {
+		sched := func(days []string, start string) *controllerv1.Schedule {
+			s := &controllerv1.Schedule{ScheduleId: "s1", Name: "Orchard", Enabled: true, Days: days, StartTime: start, DurationMinutes: 20}
+			for _, v := range valves {
+				s.Valves = append(s.Valves, &controllerv1.ScheduleValve{ValveId: v})
+			}
+			return s
+		}
+		e.handleScheduleUpdateGRPC(&controllerv1.ScheduleUpdate{Schedules: []*controllerv1.Schedule{
+			sched([]string{"mon", "wed"}, "06:00, 18:30"),
+			sched([]string{"sat"}, "07:15"),
+		}})
+	}
+	version := func(controllerUID string) (uint16, []storage.ScheduleEntry) {
+		t.Helper()
+		s, entries, err := db.GetScheduleForController(controllerUID)
+		if err != nil {
+			t.Fatalf("GetScheduleForController(%s) failed: %v", controllerUID, err)
+		}
+		return s.Version, entries
+	}
+
+	update("v1", "v2", "v3")
+	va, entries := version(a)
+	if len(entries) != 3 {
+		t.Fatalf("Controller A entries = %+v, want 3", entries)
+	}
+	if entry := entries[1]; entry.DayMask != 0x0A || entry.StartHour != 18 || entry.StartMinute != 30 || entry.ActuatorMask != 0b110 || entry.DurationMins != 20 {
+		t.Errorf("Unexpected entry: %+v", entry)
+	}
+	vb, entries := version(b)
+	if len(entries) != 3 || entries[2].DayMask != 0x40 || entries[2].ActuatorMask != 0b1 {
+		t.Errorf("Controller B entries = %+v", entries)
+	}
+
+	// The same schedule again changes nothing
+	update("v1", "v2", "v3")
+	if v, _ := version(a); v != va {
+		t.Errorf("Version of unchanged schedule moved from %d to %d", va, v)
+	}
+
+	// Moving the schedule off controller B clears it there with a new version
+	update("v1", "v2")
+	if v, entries := version(b); v <= vb || len(entries) != 0 {
+		t.Errorf("Controller B after removal: version %d (was %d), entries %+v", v, vb, entries)
+	}
+	if v, _ := version(a); v != va {
+		t.Errorf("Controller A version moved from %d to %d", va, v)
+	}
+}
+
+// TestSchedulePreview tests expanding schedules into runs with the runtime
+// limit, manual overrides, and flow estimates applied
+func TestSchedulePreview(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "agsys-test-*.db")
+	if err != nil {
+		t.Fatalf("Failed to create temp db: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	tmpFile.Close()
+
+	db, err := storage.Open(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	const controller = "0102030405060708"
+	cfg := DefaultConfig()
+	cfg.ValveFlow = 10
+	cfg.ValveLimits = []ValveLimit{{ControllerUID: controller, Address: 2, MaxOpen: 30 * time.Minute, FlowLPM: 4}}
+	e := &Engine{config: cfg, db: db}
+	db.RegisterValve("v1", controller, 1, "Lawn", "")
+
+	// Monday and Thursday at 06:00 for 45 minutes on valves 1 and 2
+	_, err = db.ReplaceCloudSchedule("s1", "Lawn", true, map[string][]storage.ScheduleEntry{
+		controller: {{DayMask: 1<<time.Monday | 1<<time.Thursday, StartHour: 6, DurationMins: 45, ActuatorMask: 0b110}},
+	})
+	if err != nil {
+		t.Fatalf("ReplaceCloudSchedule failed: %v", err)
+	}
+
+	// A Sunday noon to the next Sunday noon covers one Monday and one Thursday
+	from := time.Date(2024, 6, 2, 12, 0, 0, 0, time.Local)
+	preview, err := e.schedulePreview(from, from.AddDate(0, 0, 7))
+	if err != nil {
+		t.Fatalf("schedulePreview failed: %v", err)
+	}
+	if len(preview.Runs) != 4 || len(preview.Events) != 8 {
+		t.Fatalf("Got %d runs and %d events, want 4 and 8: %+v", len(preview.Runs), len(preview.Events), preview.Runs)
+	}
+	first, limited := preview.Runs[0], preview.Runs[1]
+	if want := time.Date(2024, 6, 3, 6, 0, 0, 0, time.Local); !first.Start.Equal(want) || first.Address != 1 || first.Valve != "Lawn" {
+		t.Errorf("First run = %+v, want valve 1 (Lawn) at %v", first, want)
+	}
+	if first.DurationMins != 45 || first.WaterL != 450 {
+		t.Errorf("Valve 1 run = %d min, %.0f L, want 45 min, 450 L", first.DurationMins, first.WaterL)
+	}
+	if limited.DurationMins != 30 || limited.WaterL != 120 || limited.Reason == "" {
+		t.Errorf("Valve 2 run = %+v, want cut to 30 min and 120 L", limited)
+	}
+	if preview.WaterL != 2*(450+120) {
+		t.Errorf("Total water = %.0f, want %d", preview.WaterL, 2*(450+120))
+	}
+	if ev := preview.Events[2]; ev.Command != "close" || !ev.Time.Equal(first.Start.Add(30*time.Minute)) {
+		t.Errorf("Third event = %+v, want valve 2 closing after 30 minutes", ev)
+	}
+
+	// A manual override running past a start skips that run
+	db.SetValveOverride(&storage.ValveOverride{ControllerUID: controller, ActuatorAddr: 1, StartedAt: from, ExpiresAt: from.Add(24 * time.Hour)})
+	preview, err = e.schedulePreview(from, from.AddDate(0, 0, 7))
+	if err != nil {
+		t.Fatalf("schedulePreview failed: %v", err)
+	}
+	if run := preview.Runs[0]; !run.Skipped || run.DurationMins != 0 || run.WaterL != 0 {
+		t.Errorf("Overridden run = %+v, want skipped", run)
+	}
+	if run := preview.Runs[2]; run.Skipped {
+		t.Errorf("Run after the override ends = %+v, want it to go ahead", run)
+	}
+}
+
+// TestDrydown tests fitting drying rates, predicting when zones need water,
+// and skipping runs of zones that don't need it yet
+func TestDrydown(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "agsys-test-*.db")
+	if err != nil {
+		t.Fatalf("Failed to create temp db: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	tmpFile.Close()
+
+	db, err := storage.Open(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	const controller = "0102030405060708"
+	cfg := DefaultConfig()
+	cfg.Drydown.TargetPercent = 20
+	e := &Engine{config: cfg, db: db}
+
+	now := time.Now()
+	reading := func(device string, hoursAgo float64, percent uint8, temp int16) {
+		t.Helper()
+		r := &storage.SoilMoistureReading{DeviceUID: device, MoisturePercent: percent, Temperature: temp,
+			Timestamp: now.Add(-time.Duration(hoursAgo * float64(time.Hour)))}
+		if _, err := db.InsertSoilMoistureReading(r); err != nil {
+			t.Fatalf("InsertSoilMoistureReading failed: %v", err)
+		}
+	}
+	db.UpsertDevice(&storage.Device{UID: "AAAA000000000001", DeviceType: 1, ZoneID: "z1"})
+	db.UpsertDevice(&storage.Device{UID: "AAAA000000000002", DeviceType: 1, ZoneID: "z2"})
+
+	// Zone 1 was watered 24 hours ago and has dried half a point an hour since
+	reading("AAAA000000000001", 30, 22, 200)
+	for h := 24; h >= 0; h -= 2 {
+		reading("AAAA000000000001", float64(h), uint8(40-(24-h)/2), 200)
+	}
+	// Zone 2 has too few readings to fit
+	reading("AAAA000000000002", 2, 35, 200)
+	reading("AAAA000000000002", 1, 34, 200)
+
+	recs, err := e.recommendations(now)
+	if err != nil {
+		t.Fatalf("recommendations failed: %v", err)
+	}
+	if len(recs) != 2 {
+		t.Fatalf("Got %d recommendations, want 2: %+v", len(recs), recs)
+	}
+	z1, z2 := recs[0], recs[1]
+	if z1.MoisturePercent != 28 || z1.DryingRate != 0.5 || z1.WaterInHours == nil || *z1.WaterInHours != 16 {
+		t.Errorf("Zone 1 = %+v, want 28%% drying 0.5/h, water in 16h", z1)
+	}
+	if z2.WaterInHours != nil || z2.Reason == "" {
+		t.Errorf("Zone 2 = %+v, want no prediction with a reason", z2)
+	}
+
+	// Warmer than during the drydown dries faster
+	warm := []*storage.SoilMoistureReading{
+		{MoisturePercent: 40, Temperature: 200, Timestamp: now.Add(-12 * time.Hour)},
+		{MoisturePercent: 37, Temperature: 200, Timestamp: now.Add(-6 * time.Hour)},
+		{MoisturePercent: 34, Temperature: 300, Timestamp: now},
+	}
+	if p := fitDrydown(warm, cfg.Drydown); !p.fitted || math.Abs(p.rate-0.6) > 0.001 {
+		t.Errorf("Warm drydown rate = %+v, want 0.6", p)
+	}
+
+	// With a 12 hour horizon, zone 1's valve is dropped from the schedule
+	db.RegisterValve("v1", controller, 1, "", "z1")
+	e.config.Drydown.SkipAhead = 12 * time.Hour
+	entries := e.drydownScheduleEntries(controller, []protocol.ScheduleEntry{
+		{DayMask: 0x7F, StartHour: 6, DurationMins: 20, ActuatorMask: 0b110},
+		{DayMask: 0x7F, StartHour: 18, DurationMins: 20, ActuatorMask: 0b010},
+	}, now)
+	if len(entries) != 1 || entries[0].ActuatorMask != 0b100 {
+		t.Errorf("Adjusted entries = %+v, want only valve 2 at 06:00", entries)
+	}
+	e.config.Drydown.SkipAhead = 24 * time.Hour
+	if entries := e.drydownScheduleEntries(controller, []protocol.ScheduleEntry{{ActuatorMask: 0b010}}, now); len(entries) != 1 {
+		t.Errorf("Entries with water due within 24 hours = %+v, want unchanged", entries)
+	}
+}
+
+// TestFertigation tests dose planning, waiting for the zone, and injector
+// start/stop sequencing
+func TestFertigation(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "agsys-test-*.db")
+	if err != nil {
+		t.Fatalf("Failed to create temp db: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	tmpFile.Close()
+
+	db, err := storage.Open(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	driver, err := lora.New(lora.DefaultConfig())
+	if err != nil {
+		t.Fatalf("Failed to create LoRa driver: %v", err)
+	}
+
+	const controller = "0102030405060708"
+	cfg := DefaultConfig()
+	cfg.Fertigation.Injectors = []InjectorRef{{ControllerUID: controller, Address: 9}}
+	e := &Engine{
+		config:      cfg,
+		db:          db,
+		lora:        driver,
+		cloud:       cloud.NewGRPCClient(cloud.DefaultGRPCConfig()),
+		fertigation: make(map[string]*fertigationRun),
+	}
+
+	db.UpsertDevice(&storage.Device{UID: controller, DeviceType: protocol.DeviceTypeValveController, Name: "Valves"})
+	start := time.Now().Truncate(time.Minute)
+	local := start.Local()
+	entry := func(duration uint16) storage.ScheduleEntry {
+		return storage.ScheduleEntry{DayMask: 1 << uint(local.Weekday()), StartHour: uint8(local.Hour()), StartMinute: uint8(local.Minute()),
+			DurationMins: duration, ActuatorMask: 0b1, Fertigate: true, DoseMins: 5}
+	}
+
+	// 10 + 5 + 15 minutes doesn't fit in a 25 minute run
+	db.UpsertSchedule(&storage.Schedule{UID: "s1", ControllerUID: controller, Version: 1, Name: "Feed", IsActive: true},
+		[]storage.ScheduleEntry{entry(25)})
+	e.planFertigation(start.Add(-time.Minute), start)
+	if len(e.fertigation) != 0 {
+		t.Fatalf("Dose planned for a run too short to flush")
+	}
+
+	db.UpsertSchedule(&storage.Schedule{UID: "s1", ControllerUID: controller, Version: 1, Name: "Feed", IsActive: true},
+		[]storage.ScheduleEntry{entry(40)})
+	e.planFertigation(start.Add(-time.Minute), start)
+	run := e.fertigation[controller]
+	if run == nil || !run.startAt.Equal(start.Add(10*time.Minute)) || run.injector != 9 {
+		t.Fatalf("Unexpected run: %+v", run)
+	}
+
+	// The injector waits for the zone valve to open
+	e.stepFertigation(run.startAt)
+	if !run.sentAt.IsZero() {
+		t.Fatal("Injector started with the zone closed")
+	}
+	db.UpdateValveActuatorState(controller, 0, protocol.ValveStateOpen)
+	e.stepFertigation(run.startAt.Add(10 * time.Second))
+	if run.sentAt.IsZero() || run.command != protocol.InjectorCmdStart {
+		t.Fatalf("Injector start not sent: %+v", run)
+	}
+
+	ack := func(running bool) {
+		payload := &protocol.InjectorAckPayload{ActuatorAddr: 9, CommandID: run.cmdID, Running: running, Success: true}
+		e.handleInjectorAck(controller, &protocol.LoRaMessage{Payload: payload.Encode()})
+	}
+	ack(true)
+	if !run.running || run.stopAt.IsZero() {
+		t.Fatalf("Run not marked running: %+v", run)
+	}
+
+	e.stepFertigation(run.stopAt)
+	if run.command != protocol.InjectorCmdStop {
+		t.Fatalf("Injector stop not sent: %+v", run)
+	}
+	ack(false)
+	if len(e.fertigation) != 0 {
+		t.Errorf("Run should be finished")
+	}
+
+	events, err := db.GetUnsyncedValveEvents(10)
+	if err != nil {
+		t.Fatalf("GetUnsyncedValveEvents failed: %v", err)
+	}
+	if len(events) != 2 || events[0].NewState != protocol.ValveStateOpen || events[1].NewState != protocol.ValveStateClosed {
+		t.Fatalf("Expected injector start and stop events, got %d", len(events))
+	}
+	if events[0].ActuatorAddr != 9 || events[0].Source != "fertigation" || events[0].Note == "" {
+		t.Errorf("Unexpected event: %+v", events[0])
+	}
+}
+
+// TestMoistureAlerts tests threshold crossings, hysteresis, and zone overrides
+func TestMoistureAlerts(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "agsys-test-*.db")
+	if err != nil {
+		t.Fatalf("Failed to create temp db: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	tmpFile.Close()
+
+	db, err := storage.Open(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	const sensor = "0102030405060708"
+	db.UpsertZone(&storage.Zone{UID: "z1", Name: "Orchard"})
+	db.UpsertDevice(&storage.Device{UID: sensor, DeviceType: protocol.DeviceTypeSoilMoisture, Name: "Probe", ZoneID: "z1"})
+
+	cfg := DefaultConfig()
+	cfg.MoistureAlerts.DryPercent = 15
+	cfg.MoistureAlerts.WetPercent = 50
+	cfg.MoistureAlerts.Zones = []ZoneMoisture{{ZoneUID: "z1", DryPercent: 20, WetPercent: 45}}
+	newEngine := func() *Engine {
+		return &Engine{
+			config:   cfg,
+			db:       db,
+			cloud:    cloud.NewGRPCClient(cloud.DefaultGRPCConfig()),
+			notifier: notify.New(cfg.Notify),
+			moisture: make(map[moistureProbe]string),
+		}
+	}
+	e := newEngine()
+
+	read := func(percent uint8) {
+		e.checkMoisture(sensor, []*storage.SoilMoistureReading{
+			{DeviceUID: sensor, ProbeID: 1, MoisturePercent: percent, Timestamp: time.Now()},
+		})
+	}
+	// The zone's 20% dry threshold applies, and recovery needs 3 points
+	for _, percent := range []uint8{30, 20, 18, 22, 23, 46} {
+		read(percent)
+	}
+
+	alerts, err := db.GetUnsyncedAlerts(10)
+	if err != nil {
+		t.Fatalf("GetUnsyncedAlerts failed: %v", err)
+	}
+	if len(alerts) != 2 {
+		t.Fatalf("Expected 2 alerts, got %d", len(alerts))
+	}
+	if a := alerts[0]; a.AlertType != alertMoistureDry || a.State != storage.AlertCleared ||
+		a.Value != 20 || a.Threshold != 20 || a.ZoneID != "z1" || a.ProbeID != 1 {
+		t.Errorf("Unexpected dry alert: %+v", a)
+	}
+	if a := alerts[1]; a.AlertType != alertMoistureWet || a.State != storage.AlertActive || a.Threshold != 45 {
+		t.Errorf("Unexpected wet alert: %+v", a)
+	}
+
+	// A restart remembers the probe is saturated
+	e = newEngine()
+	read(47)
+	if alerts, _ := db.GetUnsyncedAlerts(10); len(alerts) != 2 || alerts[1].Count != 1 {
+		t.Errorf("Repeat alert after restart: %+v", alerts)
+	}
+}
+
+// TestActuatorHealth tests that valve actuations are recorded with their
+// current, and that drift from the baseline, the limits, and overcurrent
+// cut-offs raise and clear maintenance alerts
+func TestActuatorHealth(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "agsys-test-*.db")
+	if err != nil {
+		t.Fatalf("Failed to create temp db: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	tmpFile.Close()
+
+	db, err := storage.Open(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	cfg := DefaultConfig()
+	cfg.ActuatorHealth = ActuatorHealthConfig{MinMA: 50, DriftPercent: 40, Recent: 2, Baseline: 4}
+	e := &Engine{
+		config:   cfg,
+		db:       db,
+		cloud:    cloud.NewGRPCClient(cloud.DefaultGRPCConfig()),
+		notifier: notify.New(cfg.Notify),
+	}
+
+	const controller = "0102030405060708"
+	state := protocol.ValveStateClosed
+	actuate := func(currentMA uint16, flags uint8) {
+		if state == protocol.ValveStateClosed {
+			state = protocol.ValveStateOpen
+		} else {
+			state = protocol.ValveStateClosed
+		}
+		payload := (&protocol.ValveStatusPayload{ActuatorAddr: 3, State: state, CurrentMA: currentMA, Flags: flags}).Encode()
+		e.handleValveStatus(controller, &protocol.LoRaMessage{Payload: payload})
+	}
+	open := func() []string {
+		t.Helper()
+		alerts, err := db.GetOpenDeviceAlerts(controller)
+		if err != nil {
+			t.Fatalf("GetOpenDeviceAlerts failed: %v", err)
+		}
+		var types []string
+		for _, a := range alerts {
+			if a.ProbeID != 3 {
+				t.Errorf("Alert on addr %d, want 3", a.ProbeID)
+			}
+			types = append(types, a.AlertType)
+		}
+		return types
+	}
+
+	for range 6 {
+		actuate(200, 0)
+	}
+	// A status repeating the state is not an actuation
+	payload := (&protocol.ValveStatusPayload{ActuatorAddr: 3, State: state, CurrentMA: 999}).Encode()
+	e.handleValveStatus(controller, &protocol.LoRaMessage{Payload: payload})
+	if currents, _ := db.GetActuatorCurrents(controller, 3, 10); len(currents) != 6 || currents[0].CurrentMA != 200 {
+		t.Errorf("Recorded %d actuations, want 6 at 200mA", len(currents))
+	}
+	if types := open(); len(types) != 0 {
+		t.Errorf("Healthy actuator raised %v", types)
+	}
+
+	// A valve drawing more each time drifts above its baseline
+	actuate(400, 0)
+	actuate(400, 0)
+	if types := open(); len(types) != 1 || types[0] != alertValveOvercurrent {
+		t.Errorf("After drift up, open alerts = %v, want overcurrent", types)
+	}
+	actuate(200, 0)
+	actuate(200, 0)
+	if types := open(); len(types) != 0 {
+		t.Errorf("After recovery, open alerts = %v, want none", types)
+	}
+
+	// A cut-off raises overcurrent at once; a dead motor is undercurrent
+	actuate(250, protocol.ValveFlagOvercurrent)
+	if types := open(); len(types) != 1 || types[0] != alertValveOvercurrent {
+		t.Errorf("After cut-off, open alerts = %v, want overcurrent", types)
+	}
+	actuate(0, 0)
+	actuate(0, 0)
+	if types := open(); len(types) != 1 || types[0] != alertValveUndercurrent {
+		t.Errorf("After no draw, open alerts = %v, want undercurrent", types)
+	}
+}
+
+// idleRadio hears nothing and drops what it transmits
+type idleRadio struct{}
+
+func (idleRadio) Receive() (*protocol.LoRaMessage, error) {
+	time.Sleep(10 * time.Millisecond)
+	return nil, nil
+}
+
+func (idleRadio) Transmit([]byte, uint8, int8) error { return nil }
+
+// TestPowerFail tests that power flags in valve status reports record power
+// events, raise and clear the power alert, and close open valves when set to
+func TestPowerFail(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "agsys-test-*.db")
+	if err != nil {
+		t.Fatalf("Failed to create temp db: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	tmpFile.Close()
+
+	db, err := storage.Open(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	loraCfg := lora.DefaultConfig()
+	loraCfg.Radio = idleRadio{}
+	driver, err := lora.New(loraCfg)
+	if err != nil {
+		t.Fatalf("Failed to create LoRa driver: %v", err)
+	}
+	if err := driver.Start(); err != nil {
+		t.Fatalf("Failed to start LoRa driver: %v", err)
+	}
+	defer driver.Stop()
+	cfg := DefaultConfig()
+	cfg.PowerFail.CloseValves = true
+	e := &Engine{
+		config:   cfg,
+		db:       db,
+		lora:     driver,
+		cloud:    cloud.NewGRPCClient(cloud.DefaultGRPCConfig()),
+		notifier: notify.New(cfg.Notify),
+	}
+
+	const controller = "0102030405060708"
+	status := func(addr, state, flags uint8) {
+		payload := &protocol.ValveStatusPayload{ActuatorAddr: addr, State: state, Flags: flags}
+		e.handleValveStatus(controller, &protocol.LoRaMessage{Payload: payload.Encode()})
+	}
+	last := func() *storage.PowerEvent {
+		t.Helper()
+		ev, err := db.GetLastPowerEvent(controller)
+		if err != nil {
+			t.Fatalf("GetLastPowerEvent failed: %v", err)
+		}
+		return ev
+	}
+	alerted := func() bool {
+		alerts, _ := db.GetOpenDeviceAlerts(controller)
+		return len(alerts) == 1 && alerts[0].AlertType == alertPowerFail && alerts[0].Severity == storage.AlertCritical
+	}
+
+	status(1, protocol.ValveStateOpen, 0)
+	status(2, protocol.ValveStateClosed, 0)
+	if ev := last(); ev != nil {
+		t.Errorf("Power event %+v on mains power", ev)
+	}
+
+	// Losing power closes the open valve, once
+	status(2, protocol.ValveStateClosed, protocol.ValveFlagPowerFail|protocol.ValveFlagOnBattery)
+	status(2, protocol.ValveStateClosed, protocol.ValveFlagPowerFail|protocol.ValveFlagOnBattery)
+	if ev := last(); ev == nil || ev.Event != storage.PowerBattery || ev.ValvesClosed != 1 {
+		t.Errorf("After power loss, last event = %+v, want on_battery with 1 close", ev)
+	}
+	closes, err := db.GetUnresolvedCommands(protocol.ValveCmdClose)
+	if err != nil || len(closes) != 1 || closes[0].ActuatorAddr != 1 {
+		t.Errorf("Close commands = %+v (err %v), want one to addr 1", closes, err)
+	}
+	if !alerted() {
+		t.Error("No power_fail alert while on battery")
+	}
+
+	status(2, protocol.ValveStateClosed, 0)
+	if ev := last(); ev == nil || ev.Event != storage.PowerRestored {
+		t.Errorf("After power back, last event = %+v, want power_restored", ev)
+	}
+	if alerted() {
+		t.Error("power_fail alert still open on mains power")
+	}
+}
+
+// TestReboots tests that a device's uptime starting over is stored as a
+// reboot, and that repeated unexpected reboots raise an alert
+func TestReboots(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "agsys-test-*.db")
+	if err != nil {
+		t.Fatalf("Failed to create temp db: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	tmpFile.Close()
+
+	db, err := storage.Open(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	cfg := DefaultConfig()
+	e := &Engine{config: cfg, db: db, notifier: notify.New(cfg.Notify)}
+
+	const device = "0102030405060708"
+	t0 := time.Now().Add(-48 * time.Hour)
+	if err := db.UpsertDevice(&storage.Device{UID: device, DeviceType: protocol.DeviceTypeSoilMoisture, LastSeen: t0}); err != nil {
+		t.Fatalf("UpsertDevice failed: %v", err)
+	}
+	heartbeat := func(at time.Duration, uptime uint32, reason uint8) {
+		e.trackUptime(device, &protocol.HeartbeatPayload{UptimeSec: uptime, BootReason: reason}, t0.Add(at))
+	}
+	unexpected := func(at time.Duration) int {
+		t.Helper()
+		n, err := db.CountUnexpectedReboots(device, t0.Add(at-cfg.Reboots.LoopWindow))
+		if err != nil {
+			t.Fatalf("CountUnexpectedReboots failed: %v", err)
+		}
+		return n
+	}
+	alerted := func() bool {
+		alerts, _ := db.GetOpenDeviceAlerts(device)
+		return len(alerts) == 1 && alerts[0].AlertType == alertRebootLoop
+	}
+
+	// Uptime carrying on is no reboot
+	heartbeat(0, 100, protocol.BootReasonNormal)
+	heartbeat(time.Hour, 3700, protocol.BootReasonNormal)
+	if n := unexpected(time.Hour); n != 0 {
+		t.Errorf("%d reboots with the uptime carrying on, want 0", n)
+	}
+
+	// The uptime going down, or the boot time moving later between
+	// heartbeats hours apart, are reboots; a reboot into new firmware is
+	// expected
+	heartbeat(2*time.Hour, 30, protocol.BootReasonWatchdog)
+	heartbeat(5*time.Hour, 60, protocol.BootReasonPowerCycle)
+	heartbeat(6*time.Hour, 10, protocol.BootReasonOTASuccess)
+	if n := unexpected(6 * time.Hour); n != 2 {
+		t.Errorf("%d unexpected reboots, want 2", n)
+	}
+	if alerted() {
+		t.Error("reboot_loop alert below the loop count")
+	}
+
+	heartbeat(7*time.Hour, 5, protocol.BootReasonHardFault)
+	if !alerted() {
+		t.Error("No reboot_loop alert at the loop count")
+	}
+	counts, err := db.GetUnexpectedReboots(t0)
+	if err != nil || counts[device] != 3 {
+		t.Errorf("GetUnexpectedReboots = %v (err %v), want 3 for %s", counts, err, device)
+	}
+
+	// The alert clears once the reboots age out of the window
+	heartbeat(32*time.Hour, 5+25*3600, protocol.BootReasonHardFault)
+	if alerted() {
+		t.Error("reboot_loop alert still open after the window")
+	}
+}
+
+// TestFirmwareInventory tests that the firmware devices report is recorded
+// with its changes, and that the inventory is synced and resynced
+func TestFirmwareInventory(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "agsys-test-*.db")
+	if err != nil {
+		t.Fatalf("Failed to create temp db: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	tmpFile.Close()
+
+	db, err := storage.Open(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	cfg := DefaultConfig()
+	e := &Engine{config: cfg, db: db, cloud: cloud.NewGRPCClient(cloud.DefaultGRPCConfig()),
+		deviceVersions: make(map[string]ota.Version)}
+
+	const sensor, meter = "0102030405060708", "1112131415161718"
+	message := func(deviceType, msgType uint8, payload []byte) *protocol.LoRaMessage {
+		msg := &protocol.LoRaMessage{Payload: payload}
+		msg.Header.MsgType = msgType
+		msg.Header.DeviceType = deviceType
+		return msg
+	}
+	inventory := func() map[string]*storage.FirmwareInventory {
+		t.Helper()
+		entries, err := db.GetFirmwareInventory()
+		if err != nil {
+			t.Fatalf("GetFirmwareInventory failed: %v", err)
+		}
+		byUID := make(map[string]*storage.FirmwareInventory)
+		for _, f := range entries {
+			byUID[f.DeviceUID] = f
+		}
+		return byUID
+	}
+
+	hb := &protocol.HeartbeatPayload{UptimeSec: 60, FWVersion: [3]uint8{1, 2, 3}, HWRev: 2}
+	e.handleHeartbeat(sensor, message(protocol.DeviceTypeSoilMoisture, protocol.MsgTypeHeartbeat, hb.Encode()))
+	req := &protocol.OTARequestPayload{CurrentMajor: 2, CurrentMinor: 0, CurrentPatch: 1, HWRevision: 1}
+	e.recordOTAFirmware(meter, message(protocol.DeviceTypeWaterMeter, protocol.MsgTypeOTARequest, req.Encode()), time.Now())
+
+	// A heartbeat of older firmware records no version
+	old := &protocol.HeartbeatPayload{UptimeSec: 60}
+	e.handleHeartbeat(meter, message(protocol.DeviceTypeWaterMeter, protocol.MsgTypeHeartbeat, old.Encode()[:protocol.HeartbeatMinSize]))
+
+	inv := inventory()
+	if f := inv[sensor]; f == nil || f.Version != "1.2.3" || f.HWRev == nil || *f.HWRev != 2 || f.Source != firmwareFromHeartbeat {
+		t.Errorf("Sensor firmware = %+v, want 1.2.3 rev 2 from a heartbeat", f)
+	}
+	if f := inv[meter]; f == nil || f.Version != "2.0.1" || f.HWRev == nil || *f.HWRev != 1 {
+		t.Errorf("Meter firmware = %+v, want 2.0.1 rev 1", f)
+	}
+
+	if more := e.syncFirmwareInventory(10, time.Now()); more {
+		t.Error("Sync of two entries reported more waiting")
+	}
+	if unsynced, _ := db.GetUnsyncedFirmwareInventory(10); len(unsynced) != 0 {
+		t.Errorf("%d entries unsynced after a sync", len(unsynced))
+	}
+
+	// An OTA in progress doesn't change the version; one finished does,
+	// keeping the hardware revision
+	status := &protocol.OTAStatusPayload{Status: protocol.OTAStatusInProgress, VersionMajor: 9}
+	e.recordOTAFirmware(sensor, message(protocol.DeviceTypeSoilMoisture, protocol.MsgTypeOTAStatus, status.Encode()), time.Now())
+	status = &protocol.OTAStatusPayload{Status: protocol.OTAStatusSuccess, VersionMajor: 1, VersionMinor: 3}
+	e.recordOTAFirmware(sensor, message(protocol.DeviceTypeSoilMoisture, protocol.MsgTypeOTAStatus, status.Encode()), time.Now())
+	if f := inventory()[sensor]; f.Version != "1.3.0" || f.PreviousVersion != "1.2.3" || f.HWRev == nil || *f.HWRev != 2 || f.SyncedToCloud {
+		t.Errorf("Sensor firmware after the update = %+v, want unsynced 1.3.0 from 1.2.3, rev 2", f)
+	}
+	if unsynced, _ := db.GetUnsyncedFirmwareInventory(10); len(unsynced) != 1 || unsynced[0].DeviceUID != sensor {
+		t.Errorf("Unsynced after the update = %+v, want the sensor", unsynced)
+	}
+	e.syncFirmwareInventory(10, time.Now())
+
+	// The whole inventory goes out again once the resync interval is up
+	e.syncFirmwareInventory(1, time.Now().Add(cfg.Inventory.ResyncInterval+time.Minute))
+	if unsynced, _ := db.GetUnsyncedFirmwareInventory(10); len(unsynced) != 1 {
+		t.Errorf("%d entries left after a resync batch of 1, want 1", len(unsynced))
+	}
+}
+
+// TestOTAPendingFromReports tests that versions devices report reach the
+// devices table and decide whether their ACKs offer an update
+func TestOTAPendingFromReports(t *testing.T) {
+	dir := t.TempDir()
+	db, err := storage.Open(filepath.Join(dir, "controller.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	loraCfg := lora.DefaultConfig()
+	loraCfg.Radio = idleRadio{}
+	driver, err := lora.New(loraCfg)
+	if err != nil {
+		t.Fatalf("Failed to create LoRa driver: %v", err)
+	}
+	if err := driver.Start(); err != nil {
+		t.Fatalf("Failed to start LoRa driver: %v", err)
+	}
+	defer driver.Stop()
+
+	// Firmware 2.0.0 is cached for soil sensors
+	otaCfg := ota.DefaultConfig()
+	otaCfg.FirmwareCacheDir = filepath.Join(dir, "firmware")
+	if err := os.MkdirAll(otaCfg.FirmwareCacheDir, 0755); err != nil {
+		t.Fatalf("Failed to create firmware cache: %v", err)
+	}
+	image := filepath.Join(otaCfg.FirmwareCacheDir, fmt.Sprintf("%d_2.0.0.bin", protocol.DeviceTypeSoilMoisture))
+	if err := os.WriteFile(image, make([]byte, 1024), 0644); err != nil {
+		t.Fatalf("Failed to write firmware: %v", err)
+	}
+	manager, err := ota.New(otaCfg, driver.SendToDevice, nil)
+	if err != nil {
+		t.Fatalf("Failed to create OTA manager: %v", err)
+	}
+	if err := manager.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start OTA manager: %v", err)
+	}
+	defer manager.Stop()
+
+	e := &Engine{config: DefaultConfig(), db: db, lora: driver, ota: manager, deviceVersions: make(map[string]ota.Version)}
+
+	const outdated, current = "0102030405060708", "1112131415161718"
+	for _, uid := range []string{outdated, current} {
+		if err := db.UpsertDevice(&storage.Device{UID: uid, DeviceType: protocol.DeviceTypeSoilMoisture, Name: uid}); err != nil {
+			t.Fatalf("UpsertDevice failed: %v", err)
+		}
+	}
+	heartbeat := func(uid string, version [3]uint8) {
+		hb := &protocol.HeartbeatPayload{UptimeSec: 60, FWVersion: version, HWRev: 1}
+		e.handleHeartbeat(uid, &protocol.LoRaMessage{
+			Header:  protocol.Header{MsgType: protocol.MsgTypeHeartbeat, DeviceType: protocol.DeviceTypeSoilMoisture},
+			Payload: hb.Encode(),
+		})
+	}
+	ack := func(uid string) {
+		t.Helper()
+		if err := e.SendAck(uid, protocol.DeviceTypeSoilMoisture, 1, 0, 0); err != nil {
+			t.Fatalf("SendAck to %s failed: %v", uid, err)
+		}
+	}
+
+	// Nothing is offered before a device reports its version
+	ack(outdated)
+	if manager.IsPending(outdated) {
+		t.Error("Update offered to a device with no reported version")
+	}
+
+	heartbeat(outdated, [3]uint8{1, 4, 0})
+	heartbeat(current, [3]uint8{2, 0, 0})
+	ack(outdated)
+	ack(current)
+	if !manager.IsPending(outdated) {
+		t.Error("No update offered to a device reporting 1.4.0")
+	}
+	if manager.IsPending(current) {
+		t.Error("Update offered to a device already on 2.0.0")
+	}
+
+	// The version is kept with the device, not blanked by later uplinks,
+	// and restored after a restart
+	if err := db.UpsertDevice(&storage.Device{UID: outdated, DeviceType: protocol.DeviceTypeSoilMoisture, LastSeen: time.Now()}); err != nil {
+		t.Fatalf("UpsertDevice failed: %v", err)
+	}
+	if d, err := db.GetDevice(outdated); err != nil || d.FirmwareVer != "1.4.0" {
+		t.Errorf("Device firmware = %+v (err %v), want 1.4.0", d, err)
+	}
+	restarted := &Engine{db: db, deviceVersions: make(map[string]ota.Version)}
+	restarted.loadDeviceVersions()
+	if v := restarted.deviceVersions[outdated]; v != (ota.Version{Major: 1, Minor: 4}) {
+		t.Errorf("Restored version = %s, want 1.4.0", v)
+	}
+}
+
+// TestEventBus tests that handlers publish what they store, to subscribers
+// in the order they subscribed
+func TestEventBus(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "agsys-test-*.db")
+	if err != nil {
+		t.Fatalf("Failed to create temp db: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	tmpFile.Close()
+
+	db, err := storage.Open(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	e := &Engine{config: DefaultConfig(), db: db}
+	var order []string
+	var alarms []AlarmRaised
+	e.Events().Alarm.Subscribe(func(ev AlarmRaised) {
+		order = append(order, "first")
+		alarms = append(alarms, ev)
+	})
+	e.Events().Alarm.Subscribe(func(AlarmRaised) { order = append(order, "second") })
+	var valves []ValveChanged
+	e.Events().Valve.Subscribe(func(ev ValveChanged) { valves = append(valves, ev) })
+
+	const meter, controller = "0102030405060708", "1112131415161718"
+	leak := &protocol.MeterAlarmPayload{AlarmType: protocol.MeterAlarmLeak, FlowRateLPM: 12}
+	e.handleMeterAlarm(meter, &protocol.LoRaMessage{Payload: leak.Encode()})
+	if len(alarms) != 1 || alarms[0].Alarm.ID == 0 || alarms[0].Alarm.DeviceUID != meter {
+		t.Fatalf("Alarm events = %+v", alarms)
+	}
+	if !slices.Equal(order, []string{"first", "second"}) {
+		t.Errorf("Subscribers ran in order %v", order)
+	}
+
+	status := &protocol.ValveStatusPayload{ActuatorAddr: 4, State: protocol.ValveStateOpen}
+	e.handleValveStatus(controller, &protocol.LoRaMessage{Payload: status.Encode()})
+	if len(valves) != 1 || valves[0].ID == 0 || valves[0].Event.ActuatorAddr != 4 || valves[0].Event.NewState != protocol.ValveStateOpen {
+		t.Errorf("Valve events = %+v", valves)
+	}
+}
+
+// TestAlerts tests alert dedup, clearing, and the offline and command checks
+func TestAlerts(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "agsys-test-*.db")
+	if err != nil {
+		t.Fatalf("Failed to create temp db: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	tmpFile.Close()
+
+	db, err := storage.Open(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	e := &Engine{
+		config:   DefaultConfig(),
+		db:       db,
+		cloud:    cloud.NewGRPCClient(cloud.DefaultGRPCConfig()),
+		notifier: notify.New(notify.DefaultConfig()),
+	}
+	e.subscribe()
+
+	const meter, controller = "0102030405060708", "1112131415161718"
+	now := time.Now()
+	db.UpsertDevice(&storage.Device{UID: meter, DeviceType: protocol.DeviceTypeWaterMeter, LastSeen: now.Add(-4 * time.Hour)})
+	db.UpsertDevice(&storage.Device{UID: controller, DeviceType: protocol.DeviceTypeValveController, LastSeen: now})
+
+	// Repeated leak alarms dedup into one critical alert until the meter clears
+	leak := &protocol.MeterAlarmPayload{AlarmType: protocol.MeterAlarmLeak, FlowRateLPM: 12}
+	for range 3 {
+		e.handleMeterAlarm(meter, &protocol.LoRaMessage{Payload: leak.Encode()})
+	}
+	open, err := db.GetOpenDeviceAlerts(meter)
+	if err != nil {
+		t.Fatalf("GetOpenDeviceAlerts failed: %v", err)
+	}
+	if len(open) != 1 || open[0].AlertType != "meter_leak" || open[0].Severity != storage.AlertCritical ||
+		open[0].Count != 3 || open[0].SourceID == 0 {
+		t.Fatalf("Unexpected leak alerts: %+v", open)
+	}
+	cleared := &protocol.MeterAlarmPayload{AlarmType: protocol.MeterAlarmCleared}
+	e.handleMeterAlarm(meter, &protocol.LoRaMessage{Payload: cleared.Encode()})
+	if open, _ := db.GetOpenDeviceAlerts(meter); len(open) != 0 {
+		t.Fatalf("Leak alert not cleared: %+v", open)
+	}
+
+	// The meter has been quiet past OfflineAfter; the controller hasn't
+	e.checkOfflineDevices(now)
+	e.checkOfflineDevices(now)
+	open, _ = db.GetOpenAlerts()
+	if len(open) != 1 || open[0].DeviceUID != meter || open[0].AlertType != alertDeviceOffline || open[0].Count != 1 {
+		t.Fatalf("Unexpected offline alerts: %+v", open)
+	}
+	db.UpsertDevice(&storage.Device{UID: meter, DeviceType: protocol.DeviceTypeWaterMeter, LastSeen: now})
+	e.checkOfflineDevices(now)
+	if open, _ := db.GetOpenAlerts(); len(open) != 0 {
+		t.Fatalf("Offline alert not cleared: %+v", open)
+	}
+
+	// A failed command alerts until a command to the same actuator succeeds
+	e.raiseCommandFailed(controller, 2, "no acknowledgment after 3 retries")
+	ack := &protocol.ValveAckPayload{ActuatorAddr: 2, CommandID: 7, ResultState: protocol.ValveStateOpen, Success: true}
+	open, _ = db.GetOpenDeviceAlerts(controller)
+	if len(open) != 1 || open[0].ProbeID != 2 {
+		t.Fatalf("Unexpected command alerts: %+v", open)
+	}
+	e.handleValveAck(controller, &protocol.LoRaMessage{Payload: ack.Encode()})
+	if open, _ := db.GetOpenDeviceAlerts(controller); len(open) != 0 {
+		t.Fatalf("Command alert not cleared: %+v", open)
+	}
+
+	counts, err := db.GetStatusCounts()
+	if err != nil {
+		t.Fatalf("GetStatusCounts failed: %v", err)
+	}
+	if counts.UnsyncedAlerts != 3 {
+		t.Errorf("UnsyncedAlerts = %d, want 3", counts.UnsyncedAlerts)
+	}
+}
+
+// chanSink passes notifications to a channel
+type chanSink chan notify.Message
+
+func (c chanSink) Name() string { return "chan" }
+
+func (c chanSink) Send(ctx context.Context, m notify.Message) error {
+	c <- m
+	return nil
+}
+
+// TestAlertNotifications tests that frost and cloud outage alerts reach the
+// notification sinks once, and clear
+func TestAlertNotifications(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "agsys-test-*.db")
+	if err != nil {
+		t.Fatalf("Failed to create temp db: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	tmpFile.Close()
+
+	db, err := storage.Open(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	cfg := DefaultConfig()
+	cfg.ControllerID = "controller-1"
+	cfg.Alerts.Frost = true
+	sink := make(chanSink, 10)
+	e := &Engine{
+		config:   cfg,
+		db:       db,
+		cloud:    cloud.NewGRPCClient(cloud.DefaultGRPCConfig()),
+		notifier: notify.New(cfg.Notify),
+	}
+	e.subscribe()
+	e.notifier.SetSinks(sink)
+	expect := func(alertType string) {
+		t.Helper()
+		select {
+		case m := <-sink:
+			if m.Type != alertType || m.Severity != notify.SeverityCritical {
+				t.Errorf("Unexpected notification: %+v", m)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("No %s notification", alertType)
+		}
+	}
+
+	// Repeat frost readings notify once; a warm reading clears the alert
+	const sensor = "0102030405060708"
+	e.checkFrost(sensor, 5)
+	e.checkFrost(sensor, -10)
+	expect(alertFrost)
+	e.checkFrost(sensor, 15)
+	if open, _ := db.GetOpenDeviceAlerts(sensor); len(open) != 1 {
+		t.Fatalf("Frost alert cleared within a degree of the threshold: %+v", open)
+	}
+	e.checkFrost(sensor, 25)
+	if open, _ := db.GetOpenDeviceAlerts(sensor); len(open) != 0 {
+		t.Fatalf("Frost alert not cleared: %+v", open)
+	}
+
+	// The cloud outage alerts only after CloudOffline
+	now := time.Now()
+	e.checkCloudLink(now, false)
+	e.checkCloudLink(now.Add(10*time.Minute), false)
+	if open, _ := db.GetOpenDeviceAlerts(cfg.ControllerID); len(open) != 0 {
+		t.Fatalf("Cloud alert raised early: %+v", open)
+	}
+	e.checkCloudLink(now.Add(30*time.Minute), false)
+	e.checkCloudLink(now.Add(31*time.Minute), false)
+	expect(alertCloudOffline)
+	e.checkCloudLink(now.Add(40*time.Minute), true)
+	if open, _ := db.GetOpenDeviceAlerts(cfg.ControllerID); len(open) != 0 {
+		t.Fatalf("Cloud alert not cleared: %+v", open)
+	}
+
+	select {
+	case m := <-sink:
+		t.Errorf("Unexpected extra notification: %+v", m)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// TestCommandAudit tests that a cloud valve command is audited with its
+// origin, outcome, and redelivery
+func TestCommandAudit(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "agsys-test-*.db")
+	if err != nil {
+		t.Fatalf("Failed to create temp db: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	tmpFile.Close()
+
+	db, err := storage.Open(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	driver, err := lora.New(lora.DefaultConfig())
+	if err != nil {
+		t.Fatalf("Failed to create LoRa driver: %v", err)
+	}
+
+	cfg := DefaultConfig()
+	e := &Engine{
+		config:   cfg,
+		db:       db,
+		lora:     driver,
+		cloud:    cloud.NewGRPCClient(cloud.DefaultGRPCConfig()),
+		notifier: notify.New(cfg.Notify),
+	}
+
+	// The driver isn't running, so the send fails and is audited as such
+	const controller = "0102030405060708"
+	origin := storage.CommandAudit{Source: sourceCloud, Actor: "user-7", CloudCommandID: "cmd-1", Params: `{"valve_id":"v1"}`}
+	e.sendCloudValveCommand(controller, 2, protocol.ValveCmdOpen, origin)
+
+	entries, err := db.GetCommandAudit(controller, 10)
+	if err != nil {
+		t.Fatalf("GetCommandAudit failed: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("Unexpected audit entries: %d", len(entries))
+	}
+	if a := entries[0]; a.Kind != "valve" || a.Command != "open" || a.ActuatorAddr != 2 || a.Actor != "user-7" ||
+		a.CloudCommandID != "cmd-1" || a.Params != origin.Params || a.Outcome != storage.AuditSendFailed {
+		t.Errorf("Unexpected failed send entry: %+v", a)
+	}
+
+	// A command that went out earlier is acked, and its redelivery is audited
+	// as a duplicate
+	sent := origin
+	sent.Kind, sent.DeviceUID, sent.ActuatorAddr, sent.Command = "valve", controller, 2, "open"
+	sent.CloudCommandID, sent.CommandID, sent.Outcome = "cmd-2", 42, storage.AuditSent
+	db.InsertCommandAudit(&sent)
+	db.InsertPendingCommand(&storage.PendingCommand{CommandID: 42, ControllerUID: controller, ActuatorAddr: 2,
+		Command: protocol.ValveCmdOpen, ExpiresAt: time.Now().Add(time.Minute), CloudCommandID: "cmd-2"})
+
+	origin.CloudCommandID = "cmd-2"
+	e.sendCloudValveCommand(controller, 2, protocol.ValveCmdOpen, origin)
+	ack := &protocol.ValveAckPayload{ActuatorAddr: 2, CommandID: 42, ResultState: protocol.ValveStateOpen, Success: true}
+	e.handleValveAck(controller, &protocol.LoRaMessage{Payload: ack.Encode()})
+
+	entries, _ = db.GetCommandAudit(controller, 10)
+	if len(entries) != 4 || entries[1].Outcome != storage.AuditDuplicate || entries[1].CommandID != 42 {
+		t.Fatalf("Unexpected duplicate entry: %+v", entries[1])
+	}
+	if a := entries[0]; a.Outcome != storage.AuditAcked || a.Actor != "user-7" || a.CommandID != 42 || a.Detail != "OPEN" {
+		t.Errorf("Unexpected ack entry: %+v", a)
+	}
+
+	// Commands refused before sending are audited too
+	if err := e.SendValveCommand("bogus", 1, protocol.ValveCmdClose, sourceLocalAPI, ""); err == nil {
+		t.Fatal("Expected error for an invalid controller UID")
+	}
+	entries, _ = db.GetCommandAudit("", 10)
+	if len(entries) != 5 || entries[0].Outcome != storage.AuditRejected || entries[0].Source != sourceLocalAPI {
+		t.Errorf("Unexpected rejected entry: %+v", entries[0])
+	}
+}
+
+// TestManualOverride tests that a valve operated by hand holds off schedule
+// and rule commands until its override expires
+func TestManualOverride(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "agsys-test-*.db")
+	if err != nil {
+		t.Fatalf("Failed to create temp db: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	tmpFile.Close()
+
+	db, err := storage.Open(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	driver, err := lora.New(lora.DefaultConfig())
+	if err != nil {
+		t.Fatalf("Failed to create LoRa driver: %v", err)
+	}
+
+	cfg := DefaultConfig()
+	e := &Engine{
+		config:   cfg,
+		db:       db,
+		lora:     driver,
+		cloud:    cloud.NewGRPCClient(cloud.DefaultGRPCConfig()),
+		notifier: notify.New(cfg.Notify),
+	}
+
+	const controller = "0102030405060708"
+	status := func(addr uint8) {
+		payload := &protocol.ValveStatusPayload{ActuatorAddr: addr, State: protocol.ValveStateOpen, Flags: protocol.ValveFlagManual}
+		e.handleValveStatus(controller, &protocol.LoRaMessage{Payload: payload.Encode()})
+	}
+
+	status(2)
+	events, _ := db.GetValveEventsSince(time.Time{})
+	if len(events) != 1 || events[0].Source != sourceManual {
+		t.Fatalf("Unexpected valve events: %+v", events)
+	}
+	o := e.manualOverride(controller, 2)
+	if o == nil || o.State != protocol.ValveStateOpen || o.ExpiresAt.Sub(o.StartedAt) != cfg.ManualOverride {
+		t.Fatalf("Unexpected override: %+v", o)
+	}
+
+	// Rules are refused before reaching the radio
+	if err := e.SendValveCommand(controller, 2, protocol.ValveCmdClose, sourceRule, "runtime_limit"); err == nil {
+		t.Fatal("Expected a rule command to be refused during the override")
+	}
+	entries, _ := db.GetCommandAudit(controller, 10)
+	if len(entries) != 1 || entries[0].Outcome != storage.AuditRejected {
+		t.Fatalf("Unexpected audit entries: %+v", entries)
+	}
+
+	// A person's command goes on to the radio, which isn't running, and
+	// other valves are unaffected
+	e.SendValveCommand(controller, 2, protocol.ValveCmdClose, sourceLocalAPI, "")
+	if entries, _ := db.GetCommandAudit(controller, 10); entries[0].Outcome != storage.AuditSendFailed {
+		t.Errorf("Local API command outcome = %s, want %s", entries[0].Outcome, storage.AuditSendFailed)
+	}
+	if err := e.overrideError(controller, 3, sourceSchedule); err != nil {
+		t.Errorf("Override of another valve: %v", err)
+	}
+
+	// Expired overrides no longer apply
+	o.ExpiresAt = time.Now().Add(-time.Second)
+	db.SetValveOverride(o)
+	if err := e.overrideError(controller, 2, sourceRule); err != nil {
+		t.Errorf("Expired override still applies: %v", err)
+	}
+
+	// With overrides disabled a manual change is only recorded
+	e.config.ManualOverride = 0
+	status(4)
+	if o := e.manualOverride(controller, 4); o != nil {
+		t.Errorf("Override with overrides disabled: %+v", o)
+	}
+	if events, _ := db.GetValveEventsSince(time.Time{}); len(events) != 2 || events[1].Source != sourceManual {
+		t.Errorf("Unexpected valve events: %+v", events)
+	}
+}
+
+// TestNack verifies a NACK fails the command it refers to, except for a busy
+// device, which is left to retry
+func TestNack(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "agsys-test-*.db")
+	if err != nil {
+		t.Fatalf("Failed to create temp db: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	tmpFile.Close()
+
+	db, err := storage.Open(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	cfg := DefaultConfig()
+	e := &Engine{
+		config:   cfg,
+		db:       db,
+		cloud:    cloud.NewGRPCClient(cloud.DefaultGRPCConfig()),
+		notifier: notify.New(cfg.Notify),
+	}
+
+	const controller = "0102030405060708"
+	sent := storage.CommandAudit{Kind: "valve", DeviceUID: controller, ActuatorAddr: 3, Command: "open",
+		Source: sourceCloud, CommandID: 42, Outcome: storage.AuditSent}
+	db.InsertCommandAudit(&sent)
+	db.InsertPendingCommand(&storage.PendingCommand{CommandID: 42, ControllerUID: controller, ActuatorAddr: 3,
+		Command: protocol.ValveCmdOpen, ExpiresAt: time.Now().Add(time.Minute), MaxRetries: 3, Sequence: 100})
+	nack := func(seq uint16, code uint8) {
+		payload := (&protocol.AckPayload{AckedSequence: seq, Status: code}).Encode()
+		e.handleNack(controller, &protocol.LoRaMessage{Payload: payload})
+	}
+
+	// A busy device and a NACK for another sequence leave the command pending
+	nack(100, protocol.NackErrBusy)
+	nack(99, protocol.NackErrInvalidParam)
+	if cmd, err := db.GetPendingCommand(42); err != nil || cmd.Failed {
+		t.Fatalf("Command after busy NACK = %+v (err %v), want pending", cmd, err)
+	}
+
+	nack(100, protocol.NackErrInvalidParam)
+	cmd, err := db.GetPendingCommand(42)
+	if err != nil || !cmd.Failed || cmd.Error != "rejected by device: invalid parameter" {
+		t.Fatalf("Command after NACK = %+v (err %v), want failed with the device error", cmd, err)
+	}
+	if expired, _ := db.GetExpiredCommands(); len(expired) != 0 {
+		t.Error("NACKed command still reported for retry")
+	}
+
+	entries, _ := db.GetCommandAudit(controller, 10)
+	if len(entries) != 2 || entries[0].Outcome != storage.AuditNacked || entries[0].Detail != cmd.Error {
+		t.Errorf("Unexpected audit entries: %+v", entries)
+	}
+	alerts, _ := db.GetOpenDeviceAlerts(controller)
+	if len(alerts) != 1 || alerts[0].AlertType != alertCommandFailed || alerts[0].ProbeID != 3 {
+		t.Errorf("Unexpected alerts: %+v", alerts)
+	}
+}
+
+// TestTxResult verifies a failed transmission fails its valve command at
+// once, and a successful one leaves it waiting for the ack
+func TestTxResult(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "agsys-test-*.db")
+	if err != nil {
+		t.Fatalf("Failed to create temp db: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	tmpFile.Close()
+
+	db, err := storage.Open(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	cfg := DefaultConfig()
+	e := &Engine{
+		config:   cfg,
+		db:       db,
+		cloud:    cloud.NewGRPCClient(cloud.DefaultGRPCConfig()),
+		notifier: notify.New(cfg.Notify),
+	}
+
+	const controller = "0102030405060708"
+	uid, _ := lora.ParseDeviceUID(controller)
+	sent := storage.CommandAudit{Kind: "valve", DeviceUID: controller, ActuatorAddr: 3, Command: "open",
+		Source: sourceCloud, CommandID: 42, Outcome: storage.AuditSent}
+	db.InsertCommandAudit(&sent)
+	db.InsertPendingCommand(&storage.PendingCommand{CommandID: 42, ControllerUID: controller, ActuatorAddr: 3,
+		Command: protocol.ValveCmdOpen, ExpiresAt: time.Now().Add(time.Minute), MaxRetries: 3, Sequence: 100})
+	result := func(msgType uint8, seq uint16, err error) {
+		e.handleTxResult(lora.TxResult{DeviceUID: uid, MsgType: msgType, Sequence: seq, Err: err})
+	}
+
+	// A transmitted command, another sequence, and another message type
+	// leave the command pending
+	result(protocol.MsgTypeValveCommand, 100, nil)
+	result(protocol.MsgTypeValveCommand, 99, lora.ErrChannelBusy)
+	result(protocol.MsgTypeScheduleUpdate, 100, lora.ErrChannelBusy)
+	if cmd, err := db.GetPendingCommand(42); err != nil || cmd.Failed {
+		t.Fatalf("Command after unrelated results = %+v (err %v), want pending", cmd, err)
+	}
+
+	result(protocol.MsgTypeValveCommand, 100, lora.ErrChannelBusy)
+	cmd, err := db.GetPendingCommand(42)
+	if err != nil || !cmd.Failed || cmd.Error != "transmit failed: "+lora.ErrChannelBusy.Error() {
+		t.Fatalf("Command after failed transmit = %+v (err %v), want failed", cmd, err)
+	}
+	if expired, _ := db.GetExpiredCommands(); len(expired) != 0 {
+		t.Error("Failed command still reported for retry")
+	}
+
+	entries, _ := db.GetCommandAudit(controller, 10)
+	if len(entries) != 2 || entries[0].Outcome != storage.AuditSendFailed || entries[0].Detail != cmd.Error {
+		t.Errorf("Unexpected audit entries: %+v", entries)
+	}
+	alerts, _ := db.GetOpenDeviceAlerts(controller)
+	if len(alerts) != 1 || alerts[0].AlertType != alertCommandFailed || alerts[0].ProbeID != 3 {
+		t.Errorf("Unexpected alerts: %+v", alerts)
+	}
+}
+
+// TestLocalAPIRoles tests that local API writes need a token with the right
+// role, and that the network listener needs a token for everything
+func TestLocalAPIRoles(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "agsys-test-*.db")
+	if err != nil {
+		t.Fatalf("Failed to create temp db: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	tmpFile.Close()
+
+	db, err := storage.Open(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	// Find a free port for the network listener
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to find a free port: %v", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	socket := filepath.Join(t.TempDir(), "api.sock")
+	e := &Engine{db: db}
+	api := localapi.NewServer(localapi.Config{SocketPath: socket, SocketMode: 0600, Listen: addr}, nil, nil)
+	api.SetValveService(e)
+	api.SetTokenService(e)
+	reloads := 0
+	api.SetReloadHandler(func() error { reloads++; return nil })
+	if err := api.Start(); err != nil {
+		t.Fatalf("Failed to start local API: %v", err)
+	}
+	defer api.Stop()
+
+	db.InsertAPIToken("tablet", string(localapi.RoleViewer), "viewer-token")
+	db.InsertAPIToken("agronomist", string(localapi.RoleAdmin), "admin-token")
+
+	// Anonymous socket clients can read but not change anything
+	client := localapi.NewClient(socket)
+	if _, err := client.Valves(); err != nil {
+		t.Errorf("Anonymous read failed: %v", err)
+	}
+	if err := client.Reload(); err == nil {
+		t.Error("Anonymous reload allowed")
+	}
+	client.SetToken("viewer-token")
+	if err := client.Reload(); err == nil {
+		t.Error("Viewer reload allowed")
+	}
+	client.SetToken("wrong")
+	if _, err := client.Valves(); err == nil {
+		t.Error("Invalid token accepted")
+	}
+	client.SetToken("admin-token")
+	if err := client.Reload(); err != nil || reloads != 1 {
+		t.Errorf("Admin reload failed: %v", err)
+	}
+
+	// Network clients always need a token
+	get := func(token string) int {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, "http://"+addr+"/valves", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Network request failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := get(""); code != http.StatusUnauthorized {
+		t.Errorf("Anonymous network read returned %d", code)
+	}
+	if code := get("viewer-token"); code != http.StatusOK {
+		t.Errorf("Viewer network read returned %d", code)
+	}
+
+	if tok, err := db.GetAPIToken("viewer-token"); err != nil || tok.LastUsedAt.IsZero() {
+		t.Errorf("Token use not recorded: %+v (err %v)", tok, err)
+	}
+}
+
+// TestReadingValidation tests that implausible readings are quarantined
+// instead of stored
+func TestReadingValidation(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "agsys-test-*.db")
+	if err != nil {
+		t.Fatalf("Failed to create temp db: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	tmpFile.Close()
+
+	db, err := storage.Open(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	const sensor, meter = "0102030405060708", "0303030303030303"
+	e := &Engine{config: DefaultConfig(), db: db}
+	now := time.Now()
+
+	// Range checks need no history
+	if e.validateSoilReading(&storage.SoilMoistureReading{DeviceUID: sensor, ProbeID: 1, MoisturePercent: 101, Timestamp: now}) {
+		t.Error("Accepted moisture above 100%")
+	}
+	if e.validateSoilReading(&storage.SoilMoistureReading{DeviceUID: sensor, ProbeID: 1, MoisturePercent: 30, Temperature: 900, Timestamp: now}) {
+		t.Error("Accepted 90°C soil temperature")
+	}
+
+	// A jump from the last accepted reading is rejected only while it is recent
+	db.InsertSoilMoistureReading(&storage.SoilMoistureReading{DeviceUID: sensor, ProbeID: 1, MoisturePercent: 30, Timestamp: now.Add(-10 * time.Minute)})
+	if e.validateSoilReading(&storage.SoilMoistureReading{DeviceUID: sensor, ProbeID: 1, MoisturePercent: 95, Temperature: 200, Timestamp: now}) {
+		t.Error("Accepted a 65 point moisture step")
+	}
+	if !e.validateSoilReading(&storage.SoilMoistureReading{DeviceUID: sensor, ProbeID: 1, MoisturePercent: 60, Temperature: 200, Timestamp: now}) {
+		t.Error("Rejected a 30 point moisture step")
+	}
+	if !e.validateSoilReading(&storage.SoilMoistureReading{DeviceUID: sensor, ProbeID: 1, MoisturePercent: 95, Temperature: 200, Timestamp: now.Add(2 * time.Hour)}) {
+		t.Error("Rejected a step against a stale reading")
+	}
+
+	// Bad probes are dropped from a report, a bad temperature drops it all
+	report := &storage.SoilReport{DeviceUID: sensor, Temperature: 150, Timestamp: now}
+	probes := []*storage.SoilMoistureReading{{ProbeID: 0, MoisturePercent: 40}, {ProbeID: 2, MoisturePercent: 120}}
+	if valid := e.validateSoilReport(report, probes); len(valid) != 1 || valid[0].ProbeID != 0 {
+		t.Errorf("Expected only probe 0 to pass, got %+v", valid)
+	}
+	report.Temperature = -600
+	if valid := e.validateSoilReport(report, []*storage.SoilMoistureReading{{ProbeID: 0, MoisturePercent: 40}}); len(valid) != 0 {
+		t.Errorf("Expected report with -60°C to be rejected, got %+v", valid)
+	}
+
+	// Totalizers may not go backwards beyond rounding
+	db.InsertWaterMeterReading(&storage.WaterMeterReading{DeviceUID: meter, TotalVolumeL: 1000, Timestamp: now.Add(-time.Minute)})
+	validMeter := func(total float32) bool {
+		r := &storage.WaterMeterReading{DeviceUID: meter, TotalVolumeL: total, Timestamp: now}
+		e.reconcileTotalizer(r)
+		return e.validateMeterReading(r)
+	}
+	if !validMeter(999.5) {
+		t.Error("Rejected a totalizer within rounding")
+	}
+	if validMeter(900) {
+		t.Error("Accepted a decreasing totalizer")
+	}
+	if validMeter(float32(math.NaN())) {
+		t.Error("Accepted a NaN totalizer")
+	}
+
+	rejected, err := db.GetRejectedReadings("", 20)
+	if err != nil {
+		t.Fatalf("GetRejectedReadings failed: %v", err)
+	}
+	want := []string{storage.RejectTotalizerInvalid, storage.RejectTotalizerDecrease, storage.RejectTemperatureRange,
+		storage.RejectMoistureRange, storage.RejectMoistureStep, storage.RejectTemperatureRange, storage.RejectMoistureRange}
+	if len(rejected) != len(want) {
+		t.Fatalf("Expected %d rejected readings, got %d", len(want), len(rejected))
+	}
+	for i, r := range rejected {
+		if r.Reason != want[i] {
+			t.Errorf("Rejected reading %d: reason %q, want %q", i, r.Reason, want[i])
+		}
+	}
+	if r := rejected[1]; r.Previous == nil || *r.Previous != 1000 || r.Value != 900 || r.Reading == "" {
+		t.Errorf("Unexpected totalizer rejection: %+v", r)
+	}
+	if r := rejected[4]; r.Previous == nil || *r.Previous != 30 || r.ProbeID != 1 {
+		t.Errorf("Unexpected step rejection: %+v", r)
+	}
+	if readings, _ := db.GetSoilMoistureReadings(sensor, 10); len(readings) != 1 {
+		t.Errorf("Validation stored readings: %d", len(readings))
+	}
+}
+
+// TestMeterTotalizer tests that the cumulative meter total survives
+// rollovers and resets, acked or not
+func TestMeterTotalizer(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "agsys-test-*.db")
+	if err != nil {
+		t.Fatalf("Failed to create temp db: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	tmpFile.Close()
+
+	db, err := storage.Open(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	const meter = "0303030303030303"
+	e := &Engine{config: DefaultConfig(), db: db}
+	now := time.Now()
+
+	// report stores a reading the way handleWaterMeterData does
+	report := func(total float64) *storage.WaterMeterReading {
+		t.Helper()
+		now = now.Add(time.Minute)
+		r := &storage.WaterMeterReading{DeviceUID: meter, TotalVolumeL: float32(total), Timestamp: now}
+		totalizer := e.reconcileTotalizer(r)
+		if !e.validateMeterReading(r) {
+			t.Fatalf("Reading of %.0f L rejected", total)
+		}
+		e.saveTotalizer(totalizer)
+		if _, err := db.InsertWaterMeterReading(r); err != nil {
+			t.Fatalf("InsertWaterMeterReading failed: %v", err)
+		}
+		return r
+	}
+	ack := func(cmdID uint16, oldL, newL uint32) {
+		payload := make([]byte, 11)
+		binary.LittleEndian.PutUint16(payload[0:2], cmdID)
+		binary.LittleEndian.PutUint32(payload[3:7], oldL)
+		binary.LittleEndian.PutUint32(payload[7:11], newL)
+		e.handleMeterResetAck(meter, &protocol.LoRaMessage{Payload: payload})
+	}
+
+	// A wrap of the uint32 totalizer carries on from the old total
+	report(totalizerRange - 1000)
+	if r := report(500); r.CumulativeL != totalizerRange+500 {
+		t.Errorf("Cumulative after rollover = %.0f, want %.0f", r.CumulativeL, float64(totalizerRange+500))
+	}
+
+	// An acked reset to zero keeps the cumulative total where it was
+	e.expectReset(meter, 7, 0)
+	ack(7, 600, 0)
+	if r := report(50); r.CumulativeL != totalizerRange+650 {
+		t.Errorf("Cumulative after acked reset = %.0f, want %.0f", r.CumulativeL, float64(totalizerRange+650))
+	}
+
+	// A reset whose ack is lost is applied by the first lower report, and the
+	// late ack isn't applied again
+	e.expectReset(meter, 8, 10)
+	if r := report(30); r.CumulativeL != totalizerRange+670 {
+		t.Errorf("Cumulative after unacked reset = %.0f, want %.0f", r.CumulativeL, float64(totalizerRange+670))
+	}
+	ack(8, 50, 10)
+	if r := report(40); r.CumulativeL != totalizerRange+680 {
+		t.Errorf("Cumulative after late ack = %.0f, want %.0f", r.CumulativeL, float64(totalizerRange+680))
+	}
+
+	totalizer, err := db.GetMeterTotalizer(meter)
+	if err != nil || totalizer == nil {
+		t.Fatalf("GetMeterTotalizer failed: %v", err)
+	}
+	if totalizer.Rollovers != 1 || totalizer.Resets != 2 || totalizer.PendingResetID != 0 || totalizer.LastRawL != 40 {
+		t.Errorf("Unexpected totalizer state: %+v", totalizer)
+	}
+
+	// Cloud sync and rollups see the cumulative total
+	readings, err := db.GetUnsyncedWaterMeterReadings(10)
+	if err != nil {
+		t.Fatalf("GetUnsyncedWaterMeterReadings failed: %v", err)
+	}
+	for i := 1; i < len(readings); i++ {
+		if readings[i].CumulativeL < readings[i-1].CumulativeL {
+			t.Errorf("Cumulative total went backwards: %.0f -> %.0f", readings[i-1].CumulativeL, readings[i].CumulativeL)
+		}
+	}
+}
+
+// TestReportInterval verifies report intervals follow cloud config and
+// battery state and are confirmed by the device's ack
+func TestReportInterval(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "agsys-test-*.db")
+	if err != nil {
+		t.Fatalf("Failed to create temp db: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	tmpFile.Close()
+
+	db, err := storage.Open(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	driver, err := lora.New(lora.DefaultConfig())
+	if err != nil {
+		t.Fatalf("Failed to create LoRa driver: %v", err)
+	}
+	cfg := DefaultConfig()
+	cfg.ReportInterval.Timeout = 0
+	cfg.ReportInterval.Retries = 1
+	e := &Engine{config: cfg, db: db, lora: driver}
+
+	const sensor = "0404040404040404"
+	get := func() *storage.DeviceConfig {
+		t.Helper()
+		c, err := db.GetDeviceConfig(sensor)
+		if err != nil || c == nil {
+			t.Fatalf("GetDeviceConfig = %+v (err %v)", c, err)
+		}
+		return c
+	}
+	ack := func(version, interval uint16, status uint8) {
+		payload := (&protocol.ConfigAckPayload{ConfigVersion: version, Status: status, ReportIntervalSec: interval}).Encode()
+		e.handleConfigAck(sensor, &protocol.LoRaMessage{Payload: payload})
+	}
+
+	// A device on a healthy battery and without cloud config is left alone
+	e.checkReportInterval(sensor, false, 3600)
+	if c, _ := db.GetDeviceConfig(sensor); c != nil {
+		t.Errorf("Unconfigured device got config %+v", c)
+	}
+
+	if err := e.SetReportInterval(sensor, 15*time.Minute); err != nil {
+		t.Fatalf("SetReportInterval failed: %v", err)
+	}
+	if err := e.SetReportInterval(sensor, 24*time.Hour); err == nil {
+		t.Error("Expected error for interval beyond 16 bits of seconds")
+	}
+	if c := get(); c.ReportIntervalSec != 900 || c.State != storage.DeviceConfigPending || c.ConfigVersion != 1 {
+		t.Errorf("After cloud config = %+v, want 900s pending v1", c)
+	}
+
+	ack(1, 900, 0)
+	if c := get(); c.State != storage.DeviceConfigApplied || c.AppliedIntervalSec != 900 || c.AppliedAt == nil {
+		t.Errorf("After ack = %+v, want 900s applied", c)
+	}
+
+	// A low battery slows the device down, and an ack for the old version
+	// doesn't confirm it
+	e.checkReportInterval(sensor, true, 2900)
+	if c := get(); c.ReportIntervalSec != 3600 || c.ConfigVersion != 2 || !c.LowBattery {
+		t.Errorf("After low battery = %+v, want 3600s v2", c)
+	}
+	ack(1, 900, 0)
+	if c := get(); c.State != storage.DeviceConfigPending {
+		t.Errorf("Stale ack changed state to %s", c.State)
+	}
+
+	// Unacked intervals are resent on reports until the retries run out
+	e.checkReportInterval(sensor, true, 2900)
+	if c := get(); c.Attempts != 2 || c.State != storage.DeviceConfigPending {
+		t.Errorf("After resend = %+v, want attempt 2 pending", c)
+	}
+	e.checkReportInterval(sensor, true, 2900)
+	if c := get(); c.State != storage.DeviceConfigFailed {
+		t.Errorf("After retries = %+v, want failed", c)
+	}
+
+	// The cloud interval returns once the battery recovers
+	e.checkReportInterval(sensor, false, 3300)
+	ack(3, 900, 0)
+	if c := get(); c.ReportIntervalSec != 900 || c.State != storage.DeviceConfigApplied || c.LowBattery {
+		t.Errorf("After battery recovered = %+v, want 900s applied", c)
+	}
+}
+
+// TestScheduleAck tests that schedules are tracked until the controller
+// acks them, resent when the ack is overdue or for an old version, and
+// failed once out of retries
+func TestScheduleAck(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "agsys-test-*.db")
+	if err != nil {
+		t.Fatalf("Failed to create temp db: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	tmpFile.Close()
+
+	db, err := storage.Open(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	driver, err := lora.New(lora.DefaultConfig())
+	if err != nil {
+		t.Fatalf("Failed to create LoRa driver: %v", err)
+	}
+	cfg := DefaultConfig()
+	cfg.ScheduleAck.Timeout = 0
+	cfg.ScheduleAck.Retries = 1
+	e := &Engine{config: cfg, db: db, lora: driver}
+
+	const controller = "0102030405060708"
+	schedule := func(version uint16) {
+		t.Helper()
+		s := &storage.Schedule{UID: "s1/" + controller, ControllerUID: controller, Version: version, Name: "Orchard", IsActive: true}
+		entries := []storage.ScheduleEntry{{DayMask: 0x7F, StartHour: 6, DurationMins: 20, ActuatorMask: 1}}
+		if err := db.UpsertSchedule(s, entries); err != nil {
+			t.Fatalf("UpsertSchedule failed: %v", err)
+		}
+	}
+	get := func() *storage.ScheduleDelivery {
+		t.Helper()
+		d, err := db.GetScheduleDelivery(controller)
+		if err != nil || d == nil {
+			t.Fatalf("GetScheduleDelivery = %+v (err %v)", d, err)
+		}
+		return d
+	}
+	ack := func(version uint16, status uint8) {
+		payload := (&protocol.ScheduleAckPayload{Version: version, Status: status, EntryCount: 1}).Encode()
+		e.handleScheduleAck(controller, &protocol.LoRaMessage{Payload: payload})
+	}
+
+	schedule(3)
+	e.sendSchedule(controller)
+	if d := get(); d.Version != 3 || d.State != storage.DeviceConfigPending || d.Attempts != 1 || d.SentAt == nil {
+		t.Errorf("After push = %+v, want v3 pending attempt 1", d)
+	}
+	ack(3, 0)
+	if d := get(); d.State != storage.DeviceConfigApplied || d.AckedVersion == nil || *d.AckedVersion != 3 || d.AckedAt == nil {
+		t.Errorf("After ack = %+v, want v3 applied", d)
+	}
+	e.retryUnackedSchedules()
+	if d := get(); d.Attempts != 1 {
+		t.Errorf("Acked schedule resent: %+v", d)
+	}
+
+	// A controller reporting an older version is sent the active one at once
+	schedule(4)
+	ack(3, 0)
+	if d := get(); d.Version != 4 || d.State != storage.DeviceConfigPending || d.Attempts != 1 {
+		t.Errorf("After lagging ack = %+v, want v4 pending attempt 1", d)
+	}
+
+	// Unacked schedules are resent until the retries run out
+	e.retryUnackedSchedules()
+	if d := get(); d.Attempts != 2 || d.State != storage.DeviceConfigPending {
+		t.Errorf("After resend = %+v, want attempt 2 pending", d)
+	}
+	e.retryUnackedSchedules()
+	if d := get(); d.State != storage.DeviceConfigFailed || *d.AckedVersion != 3 {
+		t.Errorf("After retries = %+v, want failed with v3 acked", d)
+	}
+
+	// A new push starts over, and a rejection fails it
+	e.sendSchedule(controller)
+	if d := get(); d.Attempts != 1 || d.State != storage.DeviceConfigPending {
+		t.Errorf("After new push = %+v, want attempt 1 pending", d)
+	}
+	ack(4, 2)
+	if d := get(); d.State != storage.DeviceConfigFailed {
+		t.Errorf("After rejection = %+v, want failed", d)
+	}
+
+	if _, err := protocol.DecodeScheduleAck([]byte{4, 0}); err == nil {
+		t.Error("DecodeScheduleAck should reject short payload")
+	}
+}
+
+// TestDuplicateUplink verifies retransmitted uplinks are dropped within the
+// window, including across a restart
+func TestDuplicateUplink(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "agsys-test-*.db")
+	if err != nil {
+		t.Fatalf("Failed to create temp db: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	tmpFile.Close()
+
+	db, err := storage.Open(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	const deviceUID = "0505050505050505"
+	now := time.Now()
+	db.UpsertDevice(&storage.Device{UID: deviceUID, DeviceType: protocol.DeviceTypeSoilMoisture, FirstSeen: now, LastSeen: now})
+
+	newEngine := func() *Engine {
+		e := &Engine{config: DefaultConfig(), db: db, uplinks: make(map[string]uplinkSeq)}
+		e.loadDeviceSequences()
+		return e
+	}
+	frame := func(seq uint16) *protocol.LoRaMessage {
+		return &protocol.LoRaMessage{Header: protocol.Header{MsgType: protocol.MsgTypeSoilReport, Sequence: seq}}
+	}
+
+	e := newEngine()
+	if e.isDuplicateUplink(deviceUID, frame(7), now) {
+		t.Error("First frame dropped as a duplicate")
+	}
+	if !e.isDuplicateUplink(deviceUID, frame(7), now.Add(time.Second)) {
+		t.Error("Retransmission not dropped")
+	}
+	if e.isDuplicateUplink(deviceUID, frame(8), now.Add(2*time.Second)) {
+		t.Error("Next frame dropped as a duplicate")
+	}
+
+	// The last sequence survives a restart
+	e = newEngine()
+	if !e.isDuplicateUplink(deviceUID, frame(8), now.Add(3*time.Second)) {
+		t.Error("Retransmission after restart not dropped")
+	}
+	if e.duplicates != 1 {
+		t.Errorf("Duplicates = %d, want 1", e.duplicates)
+	}
+
+	// Outside the window a repeated sequence is a new frame
+	if e.isDuplicateUplink(deviceUID, frame(8), now.Add(time.Hour)) {
+		t.Error("Repeated sequence outside the window dropped")
+	}
+}
+
+// TestProtocolVersion tests recording and restoring device protocol versions
+func TestProtocolVersion(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "agsys-test-*.db")
+	if err != nil {
+		t.Fatalf("Failed to create temp db: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	tmpFile.Close()
+
+	db, err := storage.Open(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	driver, err := lora.New(lora.DefaultConfig())
+	if err != nil {
+		t.Fatalf("Failed to create driver: %v", err)
+	}
+
+	const deviceUID = "0606060606060606"
+	now := time.Now()
+	db.UpsertDevice(&storage.Device{UID: deviceUID, DeviceType: protocol.DeviceTypeWaterMeter, FirstSeen: now, LastSeen: now})
+
+	newEngine := func() *Engine {
+		e := &Engine{config: DefaultConfig(), db: db, lora: driver, versions: make(map[string]uint8)}
+		e.loadProtocolVersions()
+		return e
+	}
+
+	e := newEngine()
+	e.recordProtocolVersion(deviceUID, protocol.ProtocolVersion)
+	e.recordProtocolVersion(deviceUID, protocol.ProtocolVersionCRC)
+
+	device, err := db.GetDevice(deviceUID)
+	if err != nil {
+		t.Fatalf("GetDevice failed: %v", err)
+	}
+	if device.ProtocolVer != protocol.ProtocolVersionCRC {
+		t.Errorf("Stored protocol version = %d, want %d", device.ProtocolVer, protocol.ProtocolVersionCRC)
+	}
+
+	// The version survives a restart
+	e = newEngine()
+	if v := e.versions[deviceUID]; v != protocol.ProtocolVersionCRC {
+		t.Errorf("Restored protocol version = %d, want %d", v, protocol.ProtocolVersionCRC)
+	}
+}
+
+// TestAggregateReadings tests that low-bandwidth mode averages readings per
+// TestSyncSettings tests the sync batch and interval in normal and
+// low-bandwidth mode, and that sync tasks stay within their concurrency
+func TestSyncSettings(t *testing.T) {
+	cfg := DefaultConfig()
+	if cfg.syncBatchSize() != 50 || cfg.syncInterval() != 30*time.Second || cfg.drainInterval() != 2*time.Second {
+		t.Errorf("Default sync = %d every %v, draining every %v", cfg.syncBatchSize(), cfg.syncInterval(), cfg.drainInterval())
+	}
+	cfg.LowBandwidth.Enabled = true
+	if cfg.syncBatchSize() != 10 || cfg.syncInterval() != 5*time.Minute || cfg.drainInterval() != 0 {
+		t.Errorf("Low-bandwidth sync = %d every %v, draining every %v", cfg.syncBatchSize(), cfg.syncInterval(), cfg.drainInterval())
+	}
+
+	for _, concurrency := range []int{1, 2, 4} {
+		var running, peak atomic.Int32
+		task := func(backlog bool) func() bool {
+			return func() bool {
+				n := running.Add(1)
+				for {
+					p := peak.Load()
+					if n <= p || peak.CompareAndSwap(p, n) {
+						break
+					}
+				}
+				time.Sleep(20 * time.Millisecond)
+				running.Add(-1)
+				return backlog
+			}
+		}
+		backlog := runSyncTasks(concurrency, []func() bool{task(false), task(false), task(true), task(false)})
+		if !backlog {
+			t.Errorf("Concurrency %d: backlog not reported", concurrency)
+		}
+		if p := peak.Load(); p != int32(concurrency) {
+			t.Errorf("Concurrency %d: %d tasks ran at once", concurrency, p)
+		}
+	}
+	if runSyncTasks(2, []func() bool{func() bool { return false }}) {
+		t.Error("Backlog reported without one")
+	}
+}
+
+// device and window and holds back a window the fetch may have cut short
+func TestAggregateReadings(t *testing.T) {
+	base := time.Date(2026, 3, 1, 8, 0, 0, 0, time.UTC)
+	var soil []*storage.SoilMoistureReading
+	var meter []*storage.WaterMeterReading
+	for i := 0; i < 6; i++ {
+		ts := base.Add(time.Duration(i) * 20 * time.Minute)
+		soil = append(soil,
+			&storage.SoilMoistureReading{ID: int64(2 * i), DeviceUID: "s1", ProbeID: 0, MoisturePercent: uint8(10 + i), Temperature: int16(200 + i), Timestamp: ts},
+			&storage.SoilMoistureReading{ID: int64(2*i + 1), DeviceUID: "s1", ProbeID: 1, MoisturePercent: 50, Temperature: int16(200 + i), Timestamp: ts})
+		meter = append(meter, &storage.WaterMeterReading{ID: int64(i), DeviceUID: "m1", CumulativeL: float64(100 * i), FlowRateLPM: float32(i), Timestamp: ts})
+	}
+
+	windows := aggregateSoilReadings(soil, time.Hour)
+	if len(windows) != 2 {
+		t.Fatalf("Got %d soil windows, want 2", len(windows))
+	}
+	reading := windows[0].sensorReading()
+	if len(windows[0].ids) != 6 || len(reading.Probes) != 2 {
+		t.Fatalf("First window has %d readings and %d probes, want 6 and 2", len(windows[0].ids), len(reading.Probes))
+	}
+	if p := reading.Probes[0].MoisturePercent; p != 11 {
+		t.Errorf("Probe 0 moisture = %v, want 11", p)
+	}
+	if c := reading.TemperatureC; c < 20.09 || c > 20.11 {
+		t.Errorf("Temperature = %v, want 20.1", c)
+	}
+	if ts := reading.Timestamp.AsTime(); !ts.Equal(base.Add(40 * time.Minute)) {
+		t.Errorf("Timestamp = %v, want the window's last reading", ts)
+	}
+
+	meterWindows := aggregateMeterReadings(meter, time.Hour)
+	if m := meterWindows[1].meterReading(); m.TotalLiters != 500 || m.FlowRateLpm != 4 {
+		t.Errorf("Second meter window total %v flow %v, want 500 and 4", m.TotalLiters, m.FlowRateLpm)
+	}
+
+	start := func(w *soilWindow) time.Time { return w.start }
+	if n := len(trimWindows(windows, start, 10, true)); n != 1 {
+		t.Errorf("Truncated fetch kept %d windows, want 1", n)
+	}
+	if n := len(trimWindows(windows[:1], start, 10, true)); n != 1 {
+		t.Errorf("Truncated fetch of one window kept %d, want 1", n)
+	}
+	if n := len(trimWindows(windows, start, 1, false)); n != 1 {
+		t.Errorf("Batch of 1 kept %d windows", n)
+	}
+}
+
+// TestSyncCursor tests that readings sync through a cursor, which only
+// passes rows sent and never moves back
+func TestSyncCursor(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "agsys-test-*.db")
+	if err != nil {
+		t.Fatalf("Failed to create temp db: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	tmpFile.Close()
+
+	db, err := storage.Open(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	base := time.Now().Add(-3 * time.Hour).Truncate(time.Second)
+	var ids []int64
+	for i := 0; i < 3; i++ {
+		id, err := db.InsertWaterMeterReading(&storage.WaterMeterReading{
+			DeviceUID:    "0102030405060708",
+			TotalVolumeL: float32(i),
+			Timestamp:    base.Add(time.Duration(i) * time.Hour),
+		})
+		if err != nil {
+			t.Fatalf("InsertWaterMeterReading failed: %v", err)
+		}
+		ids = append(ids, id)
+	}
+
+	readings, err := db.GetUnsyncedWaterMeterReadingsBefore(base.Add(90*time.Minute), 10)
+	if err != nil {
+		t.Fatalf("GetUnsyncedWaterMeterReadingsBefore failed: %v", err)
+	}
+	if len(readings) != 2 {
+		t.Fatalf("Got %d readings before the cutoff, want 2", len(readings))
+	}
+
+	through := syncedThrough(readings,
+		func(r *storage.WaterMeterReading) int64 { return r.ID },
+		func(r *storage.WaterMeterReading) bool { return r.ID != ids[1] })
+	if through != ids[0] {
+		t.Fatalf("syncedThrough = %d, want %d", through, ids[0])
+	}
+	if err := db.AdvanceSyncCursor(storage.SyncMeterReadings, through); err != nil {
+		t.Fatalf("AdvanceSyncCursor failed: %v", err)
+	}
+	if err := db.AdvanceSyncCursor(storage.SyncMeterReadings, 0); err != nil {
+		t.Fatalf("AdvanceSyncCursor failed: %v", err)
+	}
+	if cursor, _ := db.GetSyncCursor(storage.SyncMeterReadings); cursor != ids[0] {
+		t.Errorf("Cursor = %d after moving back, want %d", cursor, ids[0])
+	}
+	counts, err := db.GetStatusCounts()
+	if err != nil {
+		t.Fatalf("GetStatusCounts failed: %v", err)
+	}
+	if counts.UnsyncedMeter != 2 {
+		t.Errorf("UnsyncedMeter = %d, want 2", counts.UnsyncedMeter)
+	}
+
+	if err := db.AdvanceSyncCursor(storage.SyncMeterReadings, ids[2]); err != nil {
+		t.Fatalf("AdvanceSyncCursor failed: %v", err)
+	}
+	latest, err := db.GetLatestWaterMeterReading("0102030405060708")
+	if err != nil || latest == nil || !latest.SyncedToCloud {
+		t.Errorf("Latest reading not reported synced: %+v, %v", latest, err)
+	}
+}
+
+func TestBackfill(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "agsys-test-*.db")
+	if err != nil {
+		t.Fatalf("Failed to create temp db: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	tmpFile.Close()
+
+	db, err := storage.Open(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	e := &Engine{config: DefaultConfig(), db: db, cloud: cloud.NewGRPCClient(cloud.DefaultGRPCConfig())}
+
+	base := time.Now().Add(-5 * time.Hour).Truncate(time.Second)
+	var ids []int64
+	for i := 0; i < 5; i++ {
+		id, err := db.InsertWaterMeterReading(&storage.WaterMeterReading{
+			DeviceUID:    "0102030405060708",
+			TotalVolumeL: float32(i),
+			Timestamp:    base.Add(time.Duration(i) * time.Hour),
+		})
+		if err != nil {
+			t.Fatalf("InsertWaterMeterReading failed: %v", err)
+		}
+		ids = append(ids, id)
+	}
+	// The last two readings haven't been synced yet
+	if err := db.AdvanceSyncCursor(storage.SyncMeterReadings, ids[2]); err != nil {
+		t.Fatalf("AdvanceSyncCursor failed: %v", err)
+	}
+
+	if _, err := e.BackfillRange("alerts", base, base.Add(time.Hour)); err == nil {
+		t.Error("Backfill of a table without a sync cursor accepted")
+	}
+	if _, err := e.BackfillRange(storage.SyncMeterReadings, base, base); err == nil {
+		t.Error("Backfill of an empty window accepted")
+	}
+
+	// Everything after the first reading; only the two synced ones go again
+	if _, err := e.BackfillRange(storage.SyncMeterReadings, base.Add(time.Minute), base.Add(6*time.Hour)); err != nil {
+		t.Fatalf("BackfillRange failed: %v", err)
+	}
+	if more := e.syncBackfill(1); !more {
+		t.Error("syncBackfill reported nothing more after a full batch")
+	}
+	active, err := db.GetActiveBackfills()
+	if err != nil || len(active) != 1 {
+		t.Fatalf("GetActiveBackfills = %d, %v; want 1", len(active), err)
+	}
+	if active[0].LastID != ids[1] || active[0].RowsSent != 1 {
+		t.Errorf("Backfill at %d with %d rows sent, want %d with 1", active[0].LastID, active[0].RowsSent, ids[1])
+	}
+	if more := e.syncBackfill(1); !more {
+		t.Error("syncBackfill reported nothing more after a full batch")
+	}
+	if more := e.syncBackfill(1); more {
+		t.Error("syncBackfill reported more after the window was sent")
+	}
+	if active, _ := db.GetActiveBackfills(); len(active) != 0 {
+		t.Errorf("%d backfills still active after the window was sent", len(active))
+	}
+	if cursor, _ := db.GetSyncCursor(storage.SyncMeterReadings); cursor != ids[2] {
+		t.Errorf("Sync cursor moved to %d by a backfill, want %d", cursor, ids[2])
+	}
+
+	// Cloud requests: bad input is refused, a repeated command ID ignored
+	e.handleBackfillRequest(map[string]string{"from": "yesterday", "to": base.Format(time.RFC3339), "command_id": "bf-1"})
+	e.handleBackfillRequest(map[string]string{"from": base.Format(time.RFC3339), "to": base.Add(time.Hour).Format(time.RFC3339), "table": "weather", "command_id": "bf-1"})
+	if seen, _ := db.HasBackfill("bf-1"); seen {
+		t.Error("Invalid backfill request queued")
+	}
+	request := map[string]string{
+		"from":       base.Format(time.RFC3339),
+		"to":         base.Add(time.Hour).Format(time.RFC3339),
+		"table":      "soil, meter",
+		"command_id": "bf-2",
+		"actor":      "ops@example.com",
+	}
+	e.handleBackfillRequest(request)
+	e.handleBackfillRequest(request)
+	active, _ = db.GetActiveBackfills()
+	if len(active) != 2 {
+		t.Fatalf("Got %d backfills for a two-table request sent twice, want 2", len(active))
+	}
+	if active[0].TableName != storage.SyncSoilReadings || active[0].Source != backfillSourceCloud || active[0].Actor != "ops@example.com" {
+		t.Errorf("Unexpected backfill %+v", active[0])
+	}
+	for e.syncBackfill(10) {
+	}
+	sent, running, err := db.GetBackfillRowsSent("bf-2")
+	if err != nil || sent != 1 || running != 0 {
+		t.Errorf("GetBackfillRowsSent = %d, %d, %v; want 1, 0", sent, running, err)
+	}
+}
+
+func TestDeviceChanges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "controller.db")
+	db, err := storage.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	shared := &SharedRadio{owners: make(map[string]*Engine)}
+	config := DefaultConfig()
+	config.SharedRadio = shared
+	e := &Engine{config: config, db: db, registeredDevices: make(map[string]*storage.Device)}
+	for _, uid := range []string{"0102030405060708", "1112131415161718"} {
+		e.registeredDevices[uid] = &storage.Device{UID: uid, Name: "Sensor", IsRegistered: true}
+		shared.claim(uid, e)
+	}
+
+	// As agsys-db queues them
+	cli, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer cli.Close()
+	for _, c := range [][2]string{
+		{"0102030405060708", storage.DeviceChangeAlias},
+		{"0102030405060708", storage.DeviceChangeZone},
+		{"1112131415161718", storage.DeviceChangeForget},
+	} {
+		if _, err := cli.Exec(`INSERT INTO device_changes (device_uid, change, value, actor, created_at)
+			VALUES (?, ?, ?, 'field-tech', ?)`, c[0], c[1], "north-"+c[1], time.Now()); err != nil {
+			t.Fatalf("Failed to queue device change: %v", err)
+		}
+	}
+
+	e.applyDeviceChanges()
+
+	device := e.registeredDevices["0102030405060708"]
+	if device.Alias != "north-alias" || device.ZoneID != "north-zone" {
+		t.Errorf("Cached device alias %q zone %q, want north-alias and north-zone", device.Alias, device.ZoneID)
+	}
+	if _, ok := e.registeredDevices["1112131415161718"]; ok {
+		t.Error("Forgotten device still registered")
+	}
+	if shared.owners["1112131415161718"] != nil {
+		t.Error("Forgotten device still routed to the engine")
+	}
+	if shared.owners["0102030405060708"] != e {
+		t.Error("Renamed device no longer routed to the engine")
+	}
+
+	changes, err := db.GetUnappliedDeviceChanges()
+	if err != nil {
+		t.Fatalf("GetUnappliedDeviceChanges failed: %v", err)
+	}
+	if len(changes) != 0 {
+		t.Errorf("%d device changes left unapplied", len(changes))
+	}
+	var unsynced int
+	if err := cli.QueryRow("SELECT COUNT(*) FROM device_changes WHERE synced_to_cloud = 0").Scan(&unsynced); err != nil {
+		t.Fatal(err)
+	}
+	if unsynced != 3 {
+		t.Errorf("%d device changes still queued for the cloud, want 3", unsynced)
+	}
+}
+
+func TestSpoofingDetection(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "controller.db")
+	db, err := storage.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	const deviceUID = "0606060606060606"
+	now := time.Now()
+	db.UpsertDevice(&storage.Device{UID: deviceUID, DeviceType: protocol.DeviceTypeSoilMoisture, FirstSeen: now, LastSeen: now, IsRegistered: true})
+
+	config := DefaultConfig()
+	config.Spoofing = SpoofingConfig{RSSIJump: 30, MinSamples: 5, SequenceJump: 100}
+	newEngine := func() *Engine {
+		e := &Engine{config: config, db: db, uplinks: make(map[string]uplinkSeq),
+			rssiBaselines: make(map[string]*rssiBaseline), quarantined: make(map[string]string)}
+		e.loadDeviceSequences()
+		e.loadSpoofingState()
+		return e
+	}
+	var seq uint16
+	uplink := func(e *Engine, rssi int16) bool {
+		seq++
+		msg := &protocol.LoRaMessage{Header: protocol.Header{MsgType: protocol.MsgTypeSoilReport, Sequence: seq}, RSSI: rssi}
+		if e.screenUplink(deviceUID, true, msg, now) {
+			return true
+		}
+		e.isDuplicateUplink(deviceUID, msg, now)
+		return false
+	}
+	openAlerts := func() int {
+		alerts, err := db.GetOpenDeviceAlerts(deviceUID)
+		if err != nil {
+			t.Fatalf("GetOpenDeviceAlerts failed: %v", err)
+		}
+		return len(alerts)
+	}
+
+	e := newEngine()
+	for i := 0; i < 5; i++ {
+		if uplink(e, -90+int16(i%3)*5) {
+			t.Fatal("Uplink dropped with quarantine off")
+		}
+	}
+	if openAlerts() != 0 {
+		t.Fatal("Alert raised for a steady device")
+	}
+
+	// Flagged, but kept with quarantine off
+	if uplink(e, -40) {
+		t.Error("Uplink dropped with quarantine off")
+	}
+	if openAlerts() != 1 {
+		t.Fatal("No alert for a 50 dB RSSI jump")
+	}
+	e.releaseDevice(deviceUID)
+	if openAlerts() != 0 {
+		t.Error("Alert not cleared on release")
+	}
+
+	// With quarantine on, a sequence jump drops the device until released
+	e.config.Spoofing.Quarantine = true
+	if uplink(e, -85) {
+		t.Error("Released device's uplink dropped")
+	}
+	seq += 500
+	if !uplink(e, -85) {
+		t.Error("Uplink after a sequence jump not dropped")
+	}
+	if !uplink(e, -85) {
+		t.Error("Uplink from a quarantined device not dropped")
+	}
+	if openAlerts() != 1 {
+		t.Error("No alert for a sequence jump")
+	}
+
+	// The quarantine survives a restart
+	e = newEngine()
+	e.config.Spoofing.Quarantine = true
+	if !uplink(e, -85) {
+		t.Error("Quarantine lost on restart")
+	}
+	e.releaseDevice(deviceUID)
+	if quarantined, _ := db.GetQuarantinedDevices(); len(quarantined) != 0 {
+		t.Errorf("Quarantined after release: %v", quarantined)
+	}
+	if uplink(e, -85) {
+		t.Error("Released device's uplink dropped")
+	}
+	if openAlerts() != 0 {
+		t.Error("Alert not cleared on release")
+	}
+
+	checks := []struct {
+		last, seq uint16
+		flagged   bool
+	}{
+		{100, 101, false},
+		{100, 150, false},
+		{100, 300, true},
+		{100, 50, true},
+		{100, 3, false}, // Restarted count
+		{65530, 5, false},
+	}
+	for _, c := range checks {
+		if got := config.Spoofing.checkSequence(c.last, c.seq) != ""; got != c.flagged {
+			t.Errorf("Sequence %d after %d flagged = %v, want %v", c.seq, c.last, got, c.flagged)
+		}
+	}
+}
+
+func TestIngestRateLimit(t *testing.T) {
+	config := DefaultConfig()
+	config.IngestLimit = IngestLimitConfig{PerDevice: 3, Global: 5}
+	e := &Engine{config: config, ingest: make(map[string]*ingestBucket)}
+
+	const spammer, sensor = "0707070707070707", "0808080808080808"
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if !e.allowUplink(spammer, now) {
+			t.Fatalf("Uplink %d within the device limit dropped", i+1)
+		}
+	}
+	if e.allowUplink(spammer, now) {
+		t.Error("Uplink over the device limit accepted")
+	}
+
+	// Another device has its own limit, but shares the global one
+	if !e.allowUplink(sensor, now) || !e.allowUplink(sensor, now) {
+		t.Error("Other device throttled by the spammer's limit")
+	}
+	if e.allowUplink(sensor, now) {
+		t.Error("Uplink over the global limit accepted")
+	}
+	if e.throttled != 2 {
+		t.Errorf("Throttled = %d, want 2", e.throttled)
+	}
+
+	// Buckets refill at the limit a minute
+	now = now.Add(20 * time.Second)
+	if !e.allowUplink(spammer, now) {
+		t.Error("Uplink dropped after the device bucket refilled")
+	}
+	if e.ingest[spammer].dropped != 0 {
+		t.Error("Dropped count not reset once throttling ended")
+	}
+	if e.allowUplink(spammer, now) {
+		t.Error("Uplink accepted beyond a third of a minute's refill")
+	}
+
+	e.config.IngestLimit = IngestLimitConfig{}
+	for i := 0; i < 100; i++ {
+		if !e.allowUplink(spammer, now) {
+			t.Fatal("Uplink dropped with limits disabled")
+		}
+	}
+}
+
+func TestLifetimeCounters(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "controller.db")
+	db, err := storage.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	e := &Engine{config: DefaultConfig(), db: db}
+	e.loadCounters()
+	e.count(rxCounter(protocol.MsgTypeSensorReport))
+	e.count(rxCounter(protocol.MsgTypeSensorReport))
+	e.count(counterDecodeFailures)
+	for _, outcome := range []string{storage.AuditSent, storage.AuditSent, storage.AuditAcked,
+		storage.AuditNoAck, storage.AuditRejected, storage.AuditDuplicate} {
+		e.countOutcome(outcome)
+	}
+	e.countSync(nil)
+	e.countSync(fmt.Errorf("unavailable"))
+	e.recordCounters()
+
+	// Counted after the last write, so only in memory until the next
+	e.count(counterDecodeFailures)
+
+	// A restart picks up where the last run's writes left off
+	restarted := &Engine{config: DefaultConfig(), db: db}
+	restarted.loadCounters()
+	restarted.count(counterSyncOK)
+	counts := restarted.lifetimeCounts()
+
+	want := localapi.LifetimeCounts{
+		Messages:       map[string]int64{fmt.Sprintf("0x%02X", protocol.MsgTypeSensorReport): 2},
+		DecodeFailures: 1,
+		CommandsSent:   2,
+		CommandsAcked:  1,
+		CommandsFailed: 1,
+		SyncSucceeded:  2,
+		SyncFailed:     1,
+	}
+	if !reflect.DeepEqual(counts, want) {
+		t.Errorf("Lifetime counts = %+v, want %+v", counts, want)
+	}
+
+	// Writes add to what is stored rather than replacing it
+	restarted.recordCounters()
+	stored, err := db.GetCounters()
+	if err != nil {
+		t.Fatalf("Failed to get counters: %v", err)
+	}
+	if stored[counterSyncOK] != 2 || stored[counterCommandsSent] != 2 {
+		t.Errorf("Stored counters = %v, want 2 sync_ok and 2 commands_sent", stored)
+	}
+	e.recordCounters()
+	if stored, _ := db.GetCounters(); stored[counterDecodeFailures] != 2 {
+		t.Errorf("Stored decode failures = %d, want 2", stored[counterDecodeFailures])
+	}
+}
+
+func TestTraceLinks(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(noop.NewTracerProvider())
+
+	const uid = "0102030405060708"
+	e := &Engine{}
+	msg := &protocol.LoRaMessage{
+		Header:  protocol.Header{MsgType: protocol.MsgTypeSensorReport, Sequence: 7},
+		Payload: []byte{1, 2, 3},
+		RSSI:    -90,
+	}
+	ctx, receive := startReceiveSpan(uid, msg)
+	e.traceStored(ctx, storage.SyncSoilReadings, uid)
+	receive.End()
+
+	// A failed send keeps the link for the retry
+	span, links := e.startSyncSpan(storage.SyncSoilReadings, uid, 1, time.Now().Add(-time.Minute))
+	e.endSyncSpan(span, storage.SyncSoilReadings, uid, links, fmt.Errorf("unavailable"))
+	span, links = e.startSyncSpan(storage.SyncSoilReadings, uid, 1, time.Now().Add(-time.Minute))
+	e.endSyncSpan(span, storage.SyncSoilReadings, uid, links, nil)
+
+	spans := recorder.Ended()
+	if len(spans) != 3 {
+		t.Fatalf("Got %d spans, want receive and two syncs", len(spans))
+	}
+	receiveID := spans[0].SpanContext().SpanID()
+	for i, s := range spans[1:] {
+		if s.Name() != "cloud.sync" {
+			t.Errorf("Span %d is %q, want cloud.sync", i+1, s.Name())
+		}
+		if len(s.Links()) != 1 || s.Links()[0].SpanContext.SpanID() != receiveID {
+			t.Errorf("Sync %d links = %v, want the receive span", i+1, s.Links())
+		}
+		for _, a := range s.Attributes() {
+			if a.Key == attrReportAge && a.Value.AsInt64() < time.Minute.Milliseconds() {
+				t.Errorf("Sync %d report age = %dms, want at least a minute", i+1, a.Value.AsInt64())
+			}
+		}
+	}
+	if spans[1].Status().Code != codes.Error || spans[2].Status().Code == codes.Error {
+		t.Errorf("Sync statuses = %v, %v, want the first failed", spans[1].Status(), spans[2].Status())
+	}
+
+	// Sent, so nothing is left to link
+	if len(e.traceLinks) != 0 {
+		t.Errorf("Trace links left = %v", e.traceLinks)
+	}
+
+	// Untraced uplinks keep nothing
+	e.traceStored(context.Background(), storage.SyncSoilReadings, uid)
+	if len(e.traceLinks) != 0 {
+		t.Errorf("Untraced uplink kept a link")
+	}
+}
+
+func TestLogBatch(t *testing.T) {
+	dir := t.TempDir()
+	db, err := storage.Open(filepath.Join(dir, "controller.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	driver, err := lora.New(lora.DefaultConfig())
+	if err != nil {
+		t.Fatalf("Failed to create driver: %v", err)
+	}
+	otaCfg := ota.DefaultConfig()
+	otaCfg.FirmwareCacheDir = filepath.Join(dir, "firmware")
+	manager, err := ota.New(otaCfg, driver.SendToDevice, nil)
+	if err != nil {
+		t.Fatalf("Failed to create OTA manager: %v", err)
+	}
+
+	cfg := DefaultConfig()
+	cfg.DeviceLogs.Forward = true
+	e := &Engine{config: cfg, db: db, lora: driver, ota: manager}
+
+	const deviceUID = "0707070707070707"
+	uid, _ := lora.ParseDeviceUID(deviceUID)
+	batch := &protocol.LogBatchPayload{
+		Remaining: 4,
+		Entries: []protocol.LogEntry{
+			{Timestamp: 1700000000, Severity: protocol.LogSeverityError, Type: 0x07, Code: 0x21, Message: "FRAM write failed"},
+			{Severity: protocol.LogSeverityInfo, Type: 0x06, Code: 1, Message: "boot"},
+		},
+	}
+	msg := &protocol.LoRaMessage{
+		Header:  protocol.Header{MsgType: protocol.MsgTypeLogBatch, DeviceUID: uid, Sequence: 9},
+		Payload: batch.Encode(),
+	}
+	e.handleLogBatch(deviceUID, msg)
+
+	logs, err := db.GetDeviceLogs(deviceUID, 10)
+	if err != nil {
+		t.Fatalf("Failed to get device logs: %v", err)
+	}
+	if len(logs) != 2 {
+		t.Fatalf("Stored %d log entries, want 2", len(logs))
+	}
+	boot, fault := logs[0], logs[1]
+	if fault.Severity != protocol.LogSeverityError || fault.Code != 0x21 || fault.Message != "FRAM write failed" {
+		t.Errorf("Stored entry = %+v", fault)
+	}
+	if fault.DeviceTime == nil || fault.DeviceTime.Unix() != 1700000000 {
+		t.Errorf("Device time = %v, want 1700000000", fault.DeviceTime)
+	}
+	if boot.DeviceTime != nil {
+		t.Errorf("Device time of an entry logged without a clock = %v", boot.DeviceTime)
+	}
+	// Only entries at or above the forwarding severity are queued
+	if fault.SyncedToCloud || !boot.SyncedToCloud {
+		t.Errorf("Queued for cloud: error %v, info %v", !fault.SyncedToCloud, !boot.SyncedToCloud)
+	}
+
+	// A truncated batch stores nothing
+	msg.Payload = msg.Payload[:len(msg.Payload)-1]
+	e.handleLogBatch(deviceUID, msg)
+	if logs, _ := db.GetDeviceLogs(deviceUID, 10); len(logs) != 2 {
+		t.Errorf("Truncated batch stored entries: %d total", len(logs))
+	}
+	if n := e.lifetimeCounters()[counterDecodeFailures]; n != 1 {
+		t.Errorf("Decode failures = %d, want 1", n)
+	}
+
+	// Entries past retention are pruned
+	e.config.DeviceLogs.History = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	e.pruneDeviceLogs()
+	if logs, _ := db.GetDeviceLogs(deviceUID, 10); len(logs) != 0 {
+		t.Errorf("%d log entries left after pruning", len(logs))
+	}
+}
+
+// recordingRadio hears nothing and passes on the frames it transmits
+type recordingRadio struct {
+	sent chan *protocol.LoRaMessage
+}
+
+func (recordingRadio) Receive() (*protocol.LoRaMessage, error) {
+	time.Sleep(10 * time.Millisecond)
+	return nil, nil
+}
+
+func (r recordingRadio) Transmit(data []byte, _ uint8, _ int8) error {
+	msg, err := protocol.Decode(data)
+	if err != nil {
+		return err
+	}
+	r.sent <- msg
+	return nil
+}
+
+// TestReportAcks tests that reports are answered with one ACK whose status
+// and flags reflect the payload and what waits for the device
+func TestReportAcks(t *testing.T) {
+	dir := t.TempDir()
+	db, err := storage.Open(filepath.Join(dir, "controller.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	radio := recordingRadio{sent: make(chan *protocol.LoRaMessage, 16)}
+	loraCfg := lora.DefaultConfig()
+	loraCfg.Radio = radio
+	driver, err := lora.New(loraCfg)
+	if err != nil {
+		t.Fatalf("Failed to create LoRa driver: %v", err)
+	}
+	if err := driver.Start(); err != nil {
+		t.Fatalf("Failed to start LoRa driver: %v", err)
+	}
+	defer driver.Stop()
+
+	otaCfg := ota.DefaultConfig()
+	otaCfg.FirmwareCacheDir = filepath.Join(dir, "firmware")
+	manager, err := ota.New(otaCfg, driver.SendToDevice, nil)
+	if err != nil {
+		t.Fatalf("Failed to create OTA manager: %v", err)
+	}
+
+	e := &Engine{
+		config:         DefaultConfig(),
+		db:             db,
+		lora:           driver,
+		ota:            manager,
+		deviceVersions: make(map[string]ota.Version),
+		clocks:         make(map[string]*deviceClock),
+	}
+
+	const sensor, controller = "0102030405060708", "1112131415161718"
+	uplink := func(uid string, deviceType, msgType uint8, seq uint16, payload []byte) {
+		e.ackUplink(uid, &protocol.LoRaMessage{
+			Header:  protocol.Header{MsgType: msgType, DeviceType: deviceType, Sequence: seq},
+			Payload: payload,
+		}, time.Now())
+	}
+	next := func() *protocol.LoRaMessage {
+		t.Helper()
+		select {
+		case msg := <-radio.sent:
+			return msg
+		case <-time.After(2 * time.Second):
+			t.Fatal("No downlink sent")
+			return nil
+		}
+	}
+	expectAck := func(seq uint16, status, flags uint8) {
+		t.Helper()
+		msg := next()
+		if msg.Header.MsgType != protocol.MsgTypeAck {
+			t.Fatalf("Downlink type 0x%02X, want ACK", msg.Header.MsgType)
+		}
+		ack, err := protocol.DecodeAck(msg.Payload)
+		if err != nil {
+			t.Fatalf("DecodeAck failed: %v", err)
+		}
+		if ack.AckedSequence != seq || ack.Status != status || ack.Flags != flags {
+			t.Errorf("ACK = %+v, want seq %d status %d flags 0x%02X", ack, seq, status, flags)
+		}
+	}
+
+	// A soil sensor holding logs is asked for them
+	report := &protocol.SoilReportPayload{ProbeCount: 1, PendingLogs: 2}
+	uplink(sensor, protocol.DeviceTypeSoilMoisture, protocol.MsgTypeSensorReport, 1, report.Encode())
+	expectAck(1, 0, protocol.AckFlagSendLogs)
+
+	// An unreadable heartbeat is acked with an error; an empty one is not
+	uplink(sensor, protocol.DeviceTypeSoilMoisture, protocol.MsgTypeHeartbeat, 2, []byte{1, 2})
+	expectAck(2, protocol.NackErrInvalidPayload, 0)
+	uplink(sensor, protocol.DeviceTypeSoilMoisture, protocol.MsgTypeHeartbeat, 3, nil)
+	expectAck(3, 0, 0)
+
+	// A pending report interval, a pending schedule and a due time sync are
+	// flagged, and the sync follows the ACK
+	if err := db.SaveDeviceConfig(&storage.DeviceConfig{DeviceUID: sensor, ReportIntervalSec: 600, ConfigVersion: 1, State: storage.DeviceConfigPending}); err != nil {
+		t.Fatalf("SaveDeviceConfig failed: %v", err)
+	}
+	uplink(sensor, protocol.DeviceTypeSoilMoisture, protocol.MsgTypeHeartbeat, 4, nil)
+	expectAck(4, 0, protocol.AckFlagConfigAvail)
+
+	if err := db.SaveScheduleDelivery(&storage.ScheduleDelivery{ControllerUID: controller, Version: 3, State: storage.DeviceConfigPending}); err != nil {
+		t.Fatalf("SaveScheduleDelivery failed: %v", err)
+	}
+	e.clocks[controller] = &deviceClock{nextSync: time.Now().Add(-time.Minute)}
+	status := &protocol.ValveStatusPayload{ActuatorAddr: 1, State: protocol.ValveStateClosed}
+	uplink(controller, protocol.DeviceTypeValveController, protocol.MsgTypeValveStatus, 5, status.Encode())
+	expectAck(5, 0, protocol.AckFlagScheduleUpdate|protocol.AckFlagTimeSync)
+	if msg := next(); msg.Header.MsgType != protocol.MsgTypeTimeSync {
+		t.Errorf("Downlink after the ACK is type 0x%02X, want a time sync", msg.Header.MsgType)
+	}
+	if !e.clocks[controller].nextSync.IsZero() {
+		t.Error("Time sync still due after it was sent")
+	}
+
+	// Acks of the controller's downlinks get no ACK, and with flags only
+	// neither do reports with nothing waiting
+	uplink(controller, protocol.DeviceTypeValveController, protocol.MsgTypeValveAck, 6, []byte{1, 0, 0})
+	e.config.Acks.FlagsOnly = true
+	uplink(controller, protocol.DeviceTypeValveController, protocol.MsgTypeValveStatus, 7, status.Encode())
+	uplink(sensor, protocol.DeviceTypeSoilMoisture, protocol.MsgTypeHeartbeat, 8, nil)
+	expectAck(7, 0, protocol.AckFlagScheduleUpdate)
+	expectAck(8, 0, protocol.AckFlagConfigAvail)
+	if err := db.SaveDeviceConfig(&storage.DeviceConfig{DeviceUID: sensor, ReportIntervalSec: 600, ConfigVersion: 1, State: storage.DeviceConfigApplied}); err != nil {
+		t.Fatalf("SaveDeviceConfig failed: %v", err)
+	}
+	uplink(sensor, protocol.DeviceTypeSoilMoisture, protocol.MsgTypeHeartbeat, 9, nil)
+	uplink(sensor, protocol.DeviceTypeSoilMoisture, protocol.MsgTypeHeartbeat, 10, []byte{1})
+	expectAck(10, protocol.NackErrInvalidPayload, 0)
+
+	e.config.Acks.Enabled = false
+	uplink(sensor, protocol.DeviceTypeSoilMoisture, protocol.MsgTypeHeartbeat, 11, []byte{1})
+	select {
+	case msg := <-radio.sent:
+		t.Errorf("Downlink type 0x%02X sent with acks disabled", msg.Header.MsgType)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+// TestMeterConfigDelivery tests that meter configs queued with agsys-db are
+// sent, confirmed by the meter's config ack, and share versions with the
+// meter's report interval
+func TestMeterConfigDelivery(t *testing.T) {
+	db, err := storage.Open(filepath.Join(t.TempDir(), "controller.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	loraCfg := lora.DefaultConfig()
+	loraCfg.Radio = idleRadio{}
+	driver, err := lora.New(loraCfg)
+	if err != nil {
+		t.Fatalf("Failed to create LoRa driver: %v", err)
+	}
+	if err := driver.Start(); err != nil {
+		t.Fatalf("Failed to start LoRa driver: %v", err)
+	}
+	defer driver.Stop()
+
+	e := &Engine{config: DefaultConfig(), db: db, lora: driver}
+
+	const meter = "0102030405060708"
+	if err := db.UpsertDevice(&storage.Device{UID: meter, DeviceType: protocol.DeviceTypeWaterMeter, Name: "meter"}); err != nil {
+		t.Fatalf("UpsertDevice failed: %v", err)
+	}
+	queued := &storage.MeterConfig{DeviceUID: meter, ConfigVersion: 5, PulsesPerLiter: 450, LeakThresholdMin: 60,
+		Flags: protocol.MeterCfgLeakDetectEn, State: storage.DeviceConfigQueued, Actor: "ops"}
+	if err := db.SaveMeterConfig(queued); err != nil {
+		t.Fatalf("SaveMeterConfig failed: %v", err)
+	}
+	configAck := func(version uint16, status uint8) {
+		ack := &protocol.ConfigAckPayload{ConfigVersion: version, Status: status}
+		e.handleConfigAck(meter, &protocol.LoRaMessage{
+			Header:  protocol.Header{MsgType: protocol.MsgTypeConfigAck, DeviceType: protocol.DeviceTypeWaterMeter},
+			Payload: ack.Encode(),
+		})
+	}
+	load := func() *storage.MeterConfig {
+		t.Helper()
+		c, err := db.GetMeterConfig(meter)
+		if err != nil || c == nil {
+			t.Fatalf("GetMeterConfig = %v, %v", c, err)
+		}
+		return c
+	}
+
+	e.sendQueuedMeterConfigs()
+	c := load()
+	if c.State != storage.DeviceConfigPending || c.SentAt == nil {
+		t.Fatalf("After sending, config = %+v, want pending with a send time", c)
+	}
+	if queued, _ := db.GetQueuedMeterConfigs(); len(queued) != 0 {
+		t.Errorf("%d configs still queued after sending", len(queued))
+	}
+	audit, err := db.GetCommandAudit(meter, 10)
+	if err != nil || len(audit) != 1 || audit[0].Kind != "meter_config" || audit[0].Source != meterConfigSourceCLI || audit[0].Actor != "ops" {
+		t.Errorf("Audit = %+v (err %v), want one meter_config from cli by ops", audit, err)
+	}
+
+	// An ack of another version leaves it pending
+	configAck(4, 0)
+	if c := load(); c.State != storage.DeviceConfigPending || c.AckedVersion != nil {
+		t.Errorf("After a stale ack, config = %+v, want still pending", c)
+	}
+	configAck(5, 0)
+	if c := load(); c.State != storage.DeviceConfigApplied || c.AckedVersion == nil || *c.AckedVersion != 5 || c.AckedAt == nil {
+		t.Errorf("After the ack, config = %+v, want v5 applied", c)
+	}
+
+	// The report interval takes the next version after the meter config
+	if err := e.SetReportInterval(meter, 10*time.Minute); err != nil {
+		t.Fatalf("SetReportInterval failed: %v", err)
+	}
+	if d, err := db.GetDeviceConfig(meter); err != nil || d == nil || d.ConfigVersion != 6 {
+		t.Errorf("Report interval config = %+v (err %v), want v6", d, err)
+	}
+}
+
+func TestMeterPinCommands(t *testing.T) {
+	db, err := storage.Open(filepath.Join(t.TempDir(), "controller.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	loraCfg := lora.DefaultConfig()
+	loraCfg.Radio = idleRadio{}
+	driver, err := lora.New(loraCfg)
+	if err != nil {
+		t.Fatalf("Failed to create LoRa driver: %v", err)
+	}
+	if err := driver.Start(); err != nil {
+		t.Fatalf("Failed to start LoRa driver: %v", err)
+	}
+	defer driver.Stop()
+
+	const meter, soil = "0102030405060708", "1112131415161718"
+	cfg := DefaultConfig()
+	cfg.MeterPin = MeterPinConfig{Timeout: 0, Retries: 1}
+	e := &Engine{config: cfg, db: db, lora: driver, cloud: cloud.NewGRPCClient(cloud.DefaultGRPCConfig()),
+		registeredDevices: map[string]*storage.Device{
+			meter: {UID: meter, DeviceType: protocol.DeviceTypeWaterMeter},
+			soil:  {UID: soil, DeviceType: protocol.DeviceTypeSoilMoisture},
+		}}
+	for _, d := range e.registeredDevices {
+		if err := db.UpsertDevice(d); err != nil {
+			t.Fatalf("UpsertDevice failed: %v", err)
+		}
+	}
+	load := func() *storage.MeterPin {
+		t.Helper()
+		p, err := db.GetMeterPin(meter)
+		if err != nil || p == nil {
+			t.Fatalf("GetMeterPin = %v, %v", p, err)
+		}
+		return p
+	}
+	pinAck := func(commandID uint16, status, valve uint8) {
+		ack := &protocol.MeterPinAckPayload{CommandID: commandID, Status: status, ValveState: valve}
+		e.handleMeterPinAck(meter, &protocol.LoRaMessage{
+			Header:  protocol.Header{MsgType: protocol.MsgTypeMeterPinAck, DeviceType: protocol.DeviceTypeWaterMeter},
+			Payload: ack.Encode(),
+		})
+	}
+
+	// Only water meters have a valve to shut
+	if err := e.SendMeterPin(soil, true, "", sourceLocalAPI, ""); err == nil {
+		t.Error("SendMeterPin to a soil sensor should fail")
+	}
+
+	e.handleMeterPinCommandGRPC(&controllerv1.MeterPinCommand{CommandId: "cmd-1", DeviceUid: meter, Shutoff: true})
+	p := load()
+	if p.State != storage.DeviceConfigPending || !p.Pinned || p.Attempts != 1 || p.CloudCommandID != "cmd-1" {
+		t.Fatalf("After the cloud command, pin = %+v, want a pending shutoff of cmd-1", p)
+	}
+	shutoffID := p.CommandID
+
+	// A redelivered cloud command is not sent again
+	e.handleMeterPinCommandGRPC(&controllerv1.MeterPinCommand{CommandId: "cmd-1", DeviceUid: meter, Shutoff: true})
+	if p := load(); p.CommandID != shutoffID || p.Attempts != 1 {
+		t.Errorf("After a redelivery, pin = %+v, want command %d unchanged", p, shutoffID)
+	}
+
+	// An overdue ack resends the command under the same ID
+	e.retryUnackedMeterPins()
+	if p := load(); p.CommandID != shutoffID || p.Attempts != 2 || p.State != storage.DeviceConfigPending {
+		t.Errorf("After a resend, pin = %+v, want attempt 2 of command %d", p, shutoffID)
+	}
+
+	// An ack of another command is ignored
+	pinAck(shutoffID+100, 0, protocol.MeterValveClosed)
+	if p := load(); p.State != storage.DeviceConfigPending {
+		t.Errorf("After a stray ack, pin = %+v, want still pending", p)
+	}
+	pinAck(shutoffID, 0, protocol.MeterValveClosed)
+	p = load()
+	if p.State != storage.DeviceConfigApplied || p.AckedAt == nil || p.ValveState == nil || *p.ValveState != protocol.MeterValveClosed {
+		t.Errorf("After the ack, pin = %+v, want applied with the valve closed", p)
+	}
+
+	// A later command replaces one awaiting its ack
+	if err := e.SendMeterPin(meter, false, "", sourceLocalAPI, "ops"); err != nil {
+		t.Fatalf("SendMeterPin failed: %v", err)
+	}
+	releaseID := load().CommandID
+	if err := e.SendMeterPin(meter, true, "", sourceLocalAPI, "ops"); err != nil {
+		t.Fatalf("SendMeterPin failed: %v", err)
+	}
+	p = load()
+	if p.CommandID == releaseID || !p.Pinned {
+		t.Errorf("After a second command, pin = %+v, want the new shutoff", p)
+	}
+
+	// Out of retries, the command fails
+	e.retryUnackedMeterPins()
+	e.retryUnackedMeterPins()
+	if p := load(); p.State != storage.DeviceConfigFailed || p.Error == "" {
+		t.Errorf("After the retries, pin = %+v, want failed with a reason", p)
+	}
+
+	outcomes := make(map[uint16][]string)
+	audit, err := db.GetCommandAudit(meter, 50)
+	if err != nil {
+		t.Fatalf("GetCommandAudit failed: %v", err)
+	}
+	for _, a := range audit {
+		if a.Kind != "meter_pin" {
+			t.Errorf("Audit kind = %q, want meter_pin", a.Kind)
+		}
+		outcomes[a.CommandID] = append(outcomes[a.CommandID], a.Outcome)
+	}
+	has := func(id uint16, outcome string) bool {
+		for _, o := range outcomes[id] {
+			if o == outcome {
+				return true
+			}
+		}
+		return false
+	}
+	if !has(shutoffID, storage.AuditDuplicate) || !has(shutoffID, storage.AuditAcked) {
+		t.Errorf("Outcomes of the cloud shutoff = %v, want duplicate and acked", outcomes[shutoffID])
+	}
+	if !has(releaseID, storage.AuditCancelled) {
+		t.Errorf("Outcomes of the replaced release = %v, want cancelled", outcomes[releaseID])
+	}
+	if !has(p.CommandID, storage.AuditNoAck) {
+		t.Errorf("Outcomes of the last shutoff = %v, want no_ack", outcomes[p.CommandID])
+	}
+}
+
+func TestMeterCalibration(t *testing.T) {
+	db, err := storage.Open(filepath.Join(t.TempDir(), "controller.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	loraCfg := lora.DefaultConfig()
+	loraCfg.Radio = idleRadio{}
+	driver, err := lora.New(loraCfg)
+	if err != nil {
+		t.Fatalf("Failed to create LoRa driver: %v", err)
+	}
+	if err := driver.Start(); err != nil {
+		t.Fatalf("Failed to start LoRa driver: %v", err)
+	}
+	defer driver.Stop()
+
+	const meter = "0102030405060708"
+	e := &Engine{config: DefaultConfig(), db: db, lora: driver, cloud: cloud.NewGRPCClient(cloud.DefaultGRPCConfig()),
+		registeredDevices: map[string]*storage.Device{meter: {UID: meter, DeviceType: protocol.DeviceTypeWaterMeter}}}
+	if err := db.UpsertDevice(e.registeredDevices[meter]); err != nil {
+		t.Fatalf("UpsertDevice failed: %v", err)
+	}
+	calAck := func(sessionID uint16, action, status uint8, pulses uint32) {
+		ack := &protocol.MeterCalibrateAckPayload{SessionID: sessionID, Action: action, Status: status, Pulses: pulses}
+		e.handleMeterCalibrateAck(meter, &protocol.LoRaMessage{
+			Header:  protocol.Header{MsgType: protocol.MsgTypeMeterCalibrateAck, DeviceType: protocol.DeviceTypeWaterMeter},
+			Payload: ack.Encode(),
+		})
+	}
+	latest := func() *storage.MeterCalibration {
+		t.Helper()
+		cals, err := db.GetMeterCalibrations(meter, 1)
+		if err != nil || len(cals) != 1 {
+			t.Fatalf("GetMeterCalibrations = %v, %v", cals, err)
+		}
+		return cals[0]
+	}
+	run := func(action string, liters string) {
+		e.handleMeterCalibrationCommand(map[string]string{
+			"device_uid": meter, "action": action, "reference_liters": liters, "command_id": "cal-" + action})
+	}
+
+	// The result updates the stored config, so there must be one
+	if err := e.StartMeterCalibration(meter, "", sourceLocalAPI, ""); err == nil {
+		t.Error("StartMeterCalibration without a meter config should fail")
+	}
+	if err := db.SaveMeterConfig(&storage.MeterConfig{DeviceUID: meter, ConfigVersion: 3, PulsesPerLiter: 450,
+		LeakThresholdMin: 60, State: storage.DeviceConfigApplied}); err != nil {
+		t.Fatalf("SaveMeterConfig failed: %v", err)
+	}
+
+	run("start", "")
+	c := latest()
+	if c.State != storage.MeterCalStarting || c.OldPulsesPerLiter != 450 || c.CloudCommandID != "cal-start" {
+		t.Fatalf("After the start, session = %+v, want starting from 4.50 pulses per liter", c)
+	}
+	if err := e.StartMeterCalibration(meter, "", sourceLocalAPI, ""); err == nil {
+		t.Error("A second session should be refused while one is under way")
+	}
+	if err := e.FinishMeterCalibration(meter, 100, "", sourceLocalAPI, ""); err == nil {
+		t.Error("A session should not finish before the meter starts counting")
+	}
+
+	calAck(c.SessionID+1, protocol.MeterCalStart, 0, 0)
+	if c := latest(); c.State != storage.MeterCalStarting {
+		t.Errorf("After an ack of another session, session = %+v, want still starting", c)
+	}
+	calAck(c.SessionID, protocol.MeterCalStart, 0, 0)
+	if c := latest(); c.State != storage.MeterCalRunning || c.RunningAt == nil || c.CloudCommandID != "" {
+		t.Fatalf("After the start ack, session = %+v, want running", c)
+	}
+
+	run("finish", "250")
+	if c := latest(); c.State != storage.MeterCalFinishing || c.ReferenceLiters != 250 {
+		t.Fatalf("After the finish, session = %+v, want finishing with 250 L", c)
+	}
+	calAck(c.SessionID, protocol.MeterCalFinish, 0, 1130)
+	c = latest()
+	if c.State != storage.MeterCalCompleted || c.Pulses != 1130 || c.NewPulsesPerLiter != 452 || c.ConfigVersion != 4 {
+		t.Errorf("After the finish ack, session = %+v, want completed at 4.52 pulses per liter in v4", c)
+	}
+	if m, err := db.GetMeterConfig(meter); err != nil || m.PulsesPerLiter != 452 || m.ConfigVersion != 4 ||
+		m.State != storage.DeviceConfigPending || m.LeakThresholdMin != 60 {
+		t.Errorf("Meter config = %+v (err %v), want v4 sent with 4.52 pulses per liter and the rest kept", m, err)
+	}
+
+	// A result far off the current value is rejected
+	run("start", "")
+	c = latest()
+	calAck(c.SessionID, protocol.MeterCalStart, 0, 0)
+	run("finish", "25")
+	calAck(c.SessionID, protocol.MeterCalFinish, 0, 1130)
+	if c := latest(); c.State != storage.MeterCalFailed || c.Error == "" {
+		t.Errorf("After an implausible result, session = %+v, want failed", c)
+	}
+	if m, _ := db.GetMeterConfig(meter); m.PulsesPerLiter != 452 {
+		t.Errorf("Pulses per liter = %d after a failed session, want 452 kept", m.PulsesPerLiter)
+	}
+
+	// A session left counting is cancelled, and one unacked fails
+	run("start", "")
+	c = latest()
+	calAck(c.SessionID, protocol.MeterCalStart, 0, 0)
+	e.expireMeterCalibrations(time.Now().Add(3 * time.Hour))
+	if c := latest(); c.State != storage.MeterCalFailed {
+		t.Errorf("After the max duration, session = %+v, want failed", c)
+	}
+	run("start", "")
+	e.expireMeterCalibrations(time.Now().Add(time.Hour))
+	if c := latest(); c.State != storage.MeterCalFailed {
+		t.Errorf("After the ack timeout, session = %+v, want failed", c)
+	}
+
+	run("start", "")
+	run("cancel", "")
+	if c := latest(); c.State != storage.MeterCalCancelled {
+		t.Errorf("After a cancel, session = %+v, want cancelled", c)
+	}
+}
@@ -0,0 +1,83 @@
+package engine
+
+import (
+	"github.com/agsys/property-controller/internal/localapi"
+	"github.com/agsys/property-controller/internal/protocol"
+	"github.com/agsys/property-controller/internal/storage"
+)
+
+// subscribe wires the engine's own consumers to its event bus. Later
+// consumers subscribe alongside them through Events.
+func (e *Engine) subscribe() {
+	b := &e.bus
+
+	// Local API event streams. A legacy reading is streamed on its own, a
+	// report as the group of its probes.
+	b.Sensor.Subscribe(func(ev SensorReceived) {
+		if ev.Report == nil {
+			e.publishEvent(ev.ID, ev.Readings[0])
+		} else {
+			e.publishEvent(ev.ID, ev.Readings)
+		}
+	})
+	b.Meter.Subscribe(func(ev MeterReceived) { e.publishEvent(ev.ID, ev.Reading) })
+	b.Valve.Subscribe(func(ev ValveChanged) { e.publishEvent(ev.ID, ev.Event) })
+	b.Alarm.Subscribe(func(ev AlarmRaised) { e.publishEvent(ev.Alarm.ID, ev.Alarm) })
+	b.Alert.Subscribe(func(ev AlertChanged) { e.publishEvent(ev.Alert.ID, ev.Alert) })
+
+	// Alert rules
+	b.Sensor.Subscribe(func(ev SensorReceived) {
+		if r := ev.Report; r != nil {
+			lowBattery := r.Flags&protocol.SensorFlagLowBattery != 0
+			e.checkBattery(ev.DeviceUID, lowBattery, r.BatteryMV)
+			e.checkReportInterval(ev.DeviceUID, lowBattery, r.BatteryMV)
+		}
+		e.checkMoisture(ev.DeviceUID, ev.Readings)
+		e.checkFrost(ev.DeviceUID, ev.Temperature)
+	})
+	b.Meter.Subscribe(func(ev MeterReceived) {
+		e.checkReportInterval(ev.Reading.DeviceUID, false, ev.Reading.BatteryMV)
+	})
+	b.Alarm.Subscribe(e.alarmAlerts)
+
+	// Alerts reach the cloud at once, and new ones the notification sinks,
+	// without holding up the handler that raised them
+	b.Alert.Subscribe(func(ev AlertChanged) {
+		go e.sendAlertToCloud(ev.Alert)
+		if !ev.Cleared {
+			go e.notifyAlert(ev.Alert)
+		}
+	})
+
+	// The sync and alert loops follow the cloud link
+	b.Cloud.Subscribe(e.handleCloudState)
+}
+
+// publishEvent pushes a newly stored record to local API event streams
+func (e *Engine) publishEvent(dataID int64, data interface{}) {
+	if e.api == nil {
+		return
+	}
+
+	ev := localapi.Event{ID: dataID, Data: data}
+	switch d := data.(type) {
+	case *storage.SoilMoistureReading:
+		ev.Type, ev.DeviceUID = localapi.EventSoil, d.DeviceUID
+	case []*storage.SoilMoistureReading:
+		ev.Type = localapi.EventSoil
+		if len(d) > 0 {
+			ev.DeviceUID = d[0].DeviceUID
+		}
+	case *storage.WaterMeterReading:
+		ev.Type, ev.DeviceUID = localapi.EventMeter, d.DeviceUID
+	case *storage.MeterAlarm:
+		ev.Type, ev.DeviceUID = localapi.EventAlarm, d.DeviceUID
+	case *storage.Alert:
+		ev.Type, ev.DeviceUID = localapi.EventAlert, d.DeviceUID
+	case *storage.ValveEvent:
+		ev.Type, ev.DeviceUID = localapi.EventValve, d.ControllerUID
+	default:
+		return
+	}
+	e.api.Publish(ev)
+}
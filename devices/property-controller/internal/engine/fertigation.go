@@ -0,0 +1,339 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/agsys/property-controller/internal/lora"
+	"github.com/agsys/property-controller/internal/protocol"
+	"github.com/agsys/property-controller/internal/storage"
+)
+
+// FertigationConfig controls fertilizer injection during scheduled runs
+type FertigationConfig struct {
+	PreFlush  time.Duration // Water only before dosing, so the zone is under pressure
+	PostFlush time.Duration // Water only after dosing, to clear fertilizer from the lines
+	Injectors []InjectorRef // Injector actuator on each valve controller
+}
+
+// InjectorRef names the injector actuator on a valve controller
+type InjectorRef struct {
+	ControllerUID string
+	Address       uint8
+}
+
+// DefaultFertigationConfig returns default fertigation settings
+func DefaultFertigationConfig() FertigationConfig {
+	return FertigationConfig{
+		PreFlush:  10 * time.Minute,
+		PostFlush: 15 * time.Minute,
+	}
+}
+
+// injector returns the injector address for a valve controller
+func (c FertigationConfig) injector(controllerUID string) (uint8, bool) {
+	for _, i := range c.Injectors {
+		if i.ControllerUID == controllerUID {
+			return i.Address, true
+		}
+	}
+	return 0, false
+}
+
+// fertigationRun is a dose planned or in progress on a valve controller
+type fertigationRun struct {
+	schedule   string // Schedule name, for logs and events
+	injector   uint8
+	valves     uint64 // Actuators watering during the run
+	dose       time.Duration
+	startAt    time.Time // Earliest injector start, after the pre-flush
+	latestStop time.Time // Injector must be off by here, before the post-flush
+	stopAt     time.Time // Set once the injector confirms it is running
+	running    bool
+
+	// Command awaiting an ack
+	command  uint8
+	cmdID    uint16
+	sentAt   time.Time // Zero when no command is outstanding
+	attempts int
+}
+
+// fertigationLoop starts doses for fertigation runs and sequences the
+// injector around the flush periods
+func (e *Engine) fertigationLoop(ctx context.Context) {
+	defer e.wg.Done()
+
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	checked := time.Now().Truncate(time.Minute)
+
+	for {
+		select {
+		case <-e.stopChan:
+			return
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if minute := now.Truncate(time.Minute); minute.After(checked) {
+				e.planFertigation(checked, minute)
+				checked = minute
+			}
+			e.stepFertigation(now)
+		}
+	}
+}
+
+// planFertigation plans a dose for each fertigation run starting in
+// (from, to]. A run too short to fit the flushes around the dose waters
+// without fertilizer.
+func (e *Engine) planFertigation(from, to time.Time) {
+	cfg := e.settings()
+	if len(cfg.Fertigation.Injectors) == 0 {
+		return
+	}
+	if to.Sub(from) > 10*time.Minute {
+		from = to.Add(-10 * time.Minute)
+	}
+
+	schedules, err := e.db.GetActiveSchedules()
+	if err != nil {
+		log.Printf("Failed to get schedules: %v", err)
+		return
+	}
+	for _, s := range schedules {
+		entries, err := e.db.GetScheduleEntries(s.ID)
+		if err != nil {
+			log.Printf("Failed to get entries for schedule %s: %v", s.UID, err)
+			continue
+		}
+		for _, entry := range entries {
+			if !entry.Fertigate || entry.DoseMins == 0 || !runStartsIn(entry, from, to) {
+				continue
+			}
+			e.planDose(s, entry, to, cfg.Fertigation)
+		}
+	}
+}
+
+// planDose queues the dose for one fertigation run starting at start
+func (e *Engine) planDose(s *storage.Schedule, entry storage.ScheduleEntry, start time.Time, cfg FertigationConfig) {
+	injector, ok := cfg.injector(s.ControllerUID)
+	if !ok {
+		log.Printf("ALERT: schedule %s has fertigation but controller %s has no injector configured", s.Name, s.ControllerUID)
+		return
+	}
+
+	runMins := e.currentWeather(start).adjustedDuration(entry.DurationMins)
+	if runMins == 0 {
+		log.Printf("Fertigation for schedule %s skipped with its run", s.Name)
+		return
+	}
+
+	run := &fertigationRun{
+		schedule:   s.Name,
+		injector:   injector,
+		valves:     entry.ActuatorMask,
+		dose:       time.Duration(entry.DoseMins) * time.Minute,
+		startAt:    start.Add(cfg.PreFlush),
+		latestStop: start.Add(time.Duration(runMins)*time.Minute - cfg.PostFlush),
+	}
+	if run.startAt.Add(run.dose).After(run.latestStop) {
+		log.Printf("ALERT: schedule %s run of %d min is too short for a %s dose with %s/%s flushes, watering without fertilizer",
+			s.Name, runMins, run.dose, cfg.PreFlush, cfg.PostFlush)
+		return
+	}
+
+	e.fertMu.Lock()
+	defer e.fertMu.Unlock()
+	if busy, ok := e.fertigation[s.ControllerUID]; ok {
+		log.Printf("ALERT: injector on %s still dosing for schedule %s, skipping dose for %s",
+			s.ControllerUID, busy.schedule, s.Name)
+		return
+	}
+	e.fertigation[s.ControllerUID] = run
+	log.Printf("Fertigation for schedule %s: %s dose from %s", s.Name, run.dose, run.startAt.Format(time.TimeOnly))
+}
+
+// stepFertigation starts and stops injectors that are due, stops injectors
+// whose zone closed early, and resends unacknowledged commands
+func (e *Engine) stepFertigation(now time.Time) {
+	cfg := e.settings()
+
+	e.fertMu.Lock()
+	defer e.fertMu.Unlock()
+
+	for controllerUID, run := range e.fertigation {
+		if !run.sentAt.IsZero() {
+			if now.Sub(run.sentAt) < cfg.CommandTimeout {
+				continue
+			}
+			if run.attempts > cfg.CommandRetries {
+				e.abandonDose(controllerUID, run)
+				continue
+			}
+			e.sendInjectorCommand(controllerUID, run, run.command)
+			continue
+		}
+
+		if run.running {
+			if !now.Before(run.stopAt) {
+				e.sendInjectorCommand(controllerUID, run, protocol.InjectorCmdStop)
+			} else if !e.zoneOpen(controllerUID, run.valves) {
+				log.Printf("ALERT: zone closed during fertigation for schedule %s, stopping injector on %s",
+					run.schedule, controllerUID)
+				e.sendInjectorCommand(controllerUID, run, protocol.InjectorCmdStop)
+			}
+			continue
+		}
+
+		if now.Before(run.startAt) {
+			continue
+		}
+		if now.Add(run.dose).After(run.latestStop) {
+			log.Printf("ALERT: zone for schedule %s did not open in time to dose, watering without fertilizer", run.schedule)
+			delete(e.fertigation, controllerUID)
+			continue
+		}
+		// Never inject into a closed line; wait for the zone to open
+		if e.zoneOpen(controllerUID, run.valves) {
+			e.sendInjectorCommand(controllerUID, run, protocol.InjectorCmdStart)
+		}
+	}
+}
+
+// zoneOpen reports whether any of a run's valves is open
+func (e *Engine) zoneOpen(controllerUID string, valves uint64) bool {
+	for addr := uint8(0); addr < 64; addr++ {
+		if valves&(1<<addr) == 0 {
+			continue
+		}
+		state, ok, err := e.db.GetValveActuatorState(controllerUID, addr)
+		if err != nil {
+			log.Printf("Failed to get valve state: %v", err)
+			continue
+		}
+		if ok && state == protocol.ValveStateOpen {
+			return true
+		}
+	}
+	return false
+}
+
+// sendInjectorCommand sends a start or stop to a run's injector. Must be
+// called with fertMu held.
+func (e *Engine) sendInjectorCommand(controllerUID string, run *fertigationRun, command uint8) {
+	if run.sentAt.IsZero() || run.command != command {
+		run.command = command
+		run.cmdID = uint16(atomic.AddUint32(&e.commandID, 1))
+		run.attempts = 0
+	}
+	run.attempts++
+	run.sentAt = time.Now()
+
+	payload := &protocol.InjectorCommandPayload{
+		ActuatorAddr: run.injector,
+		Command:      command,
+		CommandID:    run.cmdID,
+	}
+	if command == protocol.InjectorCmdStart {
+		// Failsafe in case the stop is lost, with a margin for the round trip
+		payload.MaxRunSec = uint16(min(run.dose.Seconds()+60, 65535))
+	}
+
+	uid, err := lora.ParseDeviceUID(controllerUID)
+	if err != nil {
+		log.Printf("Invalid controller UID %s: %v", controllerUID, err)
+		return
+	}
+	if err := e.lora.SendToDevice(uid, protocol.MsgTypeInjectorCommand, payload.Encode()); err != nil {
+		log.Printf("Failed to send injector command to %s: %v", controllerUID, err)
+		return
+	}
+	log.Printf("Sent injector command %d to %s addr %d: %s", run.cmdID, controllerUID, run.injector, injectorCommandString(command))
+}
+
+// abandonDose gives up on a run whose injector stopped answering. Must be
+// called with fertMu held.
+func (e *Engine) abandonDose(controllerUID string, run *fertigationRun) {
+	delete(e.fertigation, controllerUID)
+	if run.command == protocol.InjectorCmdStop || run.running {
+		log.Printf("ALERT: injector %d on %s did not confirm stop; it stops itself at its failsafe limit",
+			run.injector, controllerUID)
+		return
+	}
+	log.Printf("ALERT: injector %d on %s did not confirm start for schedule %s; if it did start, it stops itself at its failsafe limit",
+		run.injector, controllerUID, run.schedule)
+}
+
+// handleInjectorAck processes injector command acknowledgments
+func (e *Engine) handleInjectorAck(deviceUID string, msg *protocol.LoRaMessage) {
+	ack, err := protocol.DecodeInjectorAck(msg.Payload)
+	if err != nil {
+		log.Printf("Failed to decode injector ack from %s: %v", deviceUID, err)
+		e.count(counterDecodeFailures)
+		return
+	}
+
+	e.fertMu.Lock()
+	run, ok := e.fertigation[deviceUID]
+	if !ok || run.sentAt.IsZero() || run.cmdID != ack.CommandID {
+		e.fertMu.Unlock()
+		log.Printf("Unexpected injector ack %d from %s", ack.CommandID, deviceUID)
+		return
+	}
+	command := run.command
+	run.sentAt = time.Time{}
+
+	var note string
+	switch {
+	case !ack.Success:
+		delete(e.fertigation, deviceUID)
+		log.Printf("ALERT: injector %d on %s failed to %s for schedule %s",
+			run.injector, deviceUID, injectorCommandString(command), run.schedule)
+	case command == protocol.InjectorCmdStart:
+		run.running = true
+		run.stopAt = time.Now().Add(run.dose)
+		note = fmt.Sprintf("fertigation started for %s, %s dose", run.schedule, run.dose)
+	default:
+		delete(e.fertigation, deviceUID)
+		note = "fertigation finished for " + run.schedule
+	}
+	injector := run.injector
+	e.fertMu.Unlock()
+
+	if note == "" {
+		return
+	}
+	log.Printf("Injector %d on %s: %s", injector, deviceUID, note)
+
+	prev, next := uint8(protocol.ValveStateClosed), uint8(protocol.ValveStateOpen)
+	if !ack.Running {
+		prev, next = next, prev
+	}
+	event := &storage.ValveEvent{
+		ControllerUID: deviceUID,
+		ActuatorAddr:  injector,
+		PrevState:     prev,
+		NewState:      next,
+		CommandID:     ack.CommandID,
+		Source:        "fertigation",
+		Note:          note,
+		Timestamp:     time.Now(),
+	}
+	id, err := e.db.InsertValveEvent(event)
+	if err != nil {
+		log.Printf("Failed to store valve event: %v", err)
+		return
+	}
+	e.bus.Valve.publish(ValveChanged{ID: id, Event: event})
+}
+
+func injectorCommandString(cmd uint8) string {
+	if cmd == protocol.InjectorCmdStart {
+		return "start"
+	}
+	return "stop"
+}
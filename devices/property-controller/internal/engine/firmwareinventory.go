@@ -0,0 +1,136 @@
+package engine
+
+import (
+	"log"
+	"time"
+
+	"github.com/agsys/property-controller/internal/ota"
+	"github.com/agsys/property-controller/internal/protocol"
+	"github.com/agsys/property-controller/internal/storage"
+)
+
+// Messages a device's firmware version is recorded from
+const (
+	firmwareFromHeartbeat  = "heartbeat"
+	firmwareFromOTARequest = "ota_request"
+	firmwareFromOTAStatus  = "ota_status"
+)
+
+// FirmwareInventoryConfig controls how the firmware inventory reaches the
+// cloud. Changes go out on the next sync; the whole inventory is sent again
+// every ResyncInterval so the cloud's fleet view converges even if it lost
+// some.
+type FirmwareInventoryConfig struct {
+	ResyncInterval time.Duration // Send every device's firmware this often (0 sends changes only)
+}
+
+// DefaultFirmwareInventoryConfig returns default firmware inventory settings
+func DefaultFirmwareInventoryConfig() FirmwareInventoryConfig {
+	return FirmwareInventoryConfig{ResyncInterval: 24 * time.Hour}
+}
+
+// loadDeviceVersions restores the firmware version each device last
+// reported, so OTA_PENDING is offered after a restart before it reports again
+func (e *Engine) loadDeviceVersions() {
+	versions, err := e.db.GetDeviceFirmwareVersions()
+	if err != nil {
+		log.Printf("Failed to load device firmware versions: %v", err)
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for deviceUID, s := range versions {
+		if v, err := ota.ParseVersion(s); err == nil {
+			e.deviceVersions[deviceUID] = v
+		}
+	}
+}
+
+// recordFirmware records the firmware a device reported running, in the
+// inventory, the device registry, and the versions OTA_PENDING is decided
+// on. A nil hardware revision keeps the one known.
+func (e *Engine) recordFirmware(deviceUID string, deviceType uint8, version ota.Version, hwRev *uint8, source string, now time.Time) {
+	f := &storage.FirmwareInventory{
+		DeviceUID:  deviceUID,
+		DeviceType: deviceType,
+		Version:    version.String(),
+		HWRev:      hwRev,
+		Source:     source,
+		ReportedAt: now,
+	}
+	e.mu.Lock()
+	e.deviceVersions[deviceUID] = version
+	e.mu.Unlock()
+	if err := e.db.UpdateDeviceFirmware(deviceUID, f.Version); err != nil {
+		log.Printf("Failed to update firmware version of %s: %v", deviceUID, err)
+	}
+
+	changed, err := e.db.RecordFirmware(f)
+	if err != nil {
+		log.Printf("Failed to record firmware of %s: %v", deviceUID, err)
+		return
+	}
+	if changed && f.PreviousVersion != "" {
+		log.Printf("Device %s now runs firmware %s (was %s)", deviceUID, f.Version, f.PreviousVersion)
+	}
+}
+
+// recordOTAFirmware records the firmware a device reports in an OTA request,
+// and in an OTA status once an update has finished or rolled back
+func (e *Engine) recordOTAFirmware(deviceUID string, msg *protocol.LoRaMessage, now time.Time) {
+	switch msg.Header.MsgType {
+	case protocol.MsgTypeOTARequest:
+		req, err := protocol.DecodeOTARequest(msg.Payload)
+		if err != nil {
+			return // The OTA manager logs it
+		}
+		hwRev := req.HWRevision
+		e.recordFirmware(deviceUID, msg.Header.DeviceType,
+			ota.Version{Major: req.CurrentMajor, Minor: req.CurrentMinor, Patch: req.CurrentPatch}, &hwRev, firmwareFromOTARequest, now)
+
+	case protocol.MsgTypeOTAStatus:
+		status, err := protocol.DecodeOTAStatus(msg.Payload)
+		if err != nil || (status.Status != protocol.OTAStatusSuccess && status.Status != protocol.OTAStatusRolledBack) {
+			return
+		}
+		e.recordFirmware(deviceUID, msg.Header.DeviceType,
+			ota.Version{Major: status.VersionMajor, Minor: status.VersionMinor, Patch: status.VersionPatch}, nil, firmwareFromOTAStatus, now)
+	}
+}
+
+// syncFirmwareInventory sends up to limit firmware inventory entries not yet
+// sent, queueing the whole inventory again when the resync interval is up.
+// The shared protocol has no inventory message, so each goes out as a device
+// discovery carrying the version; the hardware revision stays local.
+func (e *Engine) syncFirmwareInventory(limit int, now time.Time) bool {
+	if interval := e.settings().Inventory.ResyncInterval; interval > 0 && now.Sub(e.inventoryResyncAt) >= interval {
+		if err := e.db.ResyncFirmwareInventory(); err != nil {
+			log.Printf("Failed to queue the firmware inventory: %v", err)
+		} else {
+			e.inventoryResyncAt = now
+		}
+	}
+
+	inventory, err := e.db.GetUnsyncedFirmwareInventory(limit)
+	if err != nil {
+		log.Printf("Failed to get unsynced firmware inventory: %v", err)
+		return false
+	}
+	for _, f := range inventory {
+		firstSeen, rssi := f.ChangedAt, int32(0)
+		if d, err := e.db.GetDevice(f.DeviceUID); err == nil {
+			firstSeen, rssi = d.FirstSeen, int32(d.RSSI)
+		}
+		err := e.cloud.SendDeviceDiscovery(f.DeviceUID, deviceTypeToString(f.DeviceType), f.Version, firstSeen, rssi)
+		e.countSync(err)
+		if err != nil {
+			log.Printf("Failed to send firmware of %s: %v", f.DeviceUID, err)
+			return false
+		}
+		if err := e.db.MarkFirmwareSynced(f.DeviceUID, f.Version); err != nil {
+			log.Printf("Failed to mark firmware of %s synced: %v", f.DeviceUID, err)
+		}
+	}
+	return len(inventory) == limit
+}
@@ -0,0 +1,128 @@
+package engine
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/agsys/property-controller/internal/localapi"
+	"github.com/agsys/property-controller/internal/lora/gw"
+	"github.com/agsys/property-controller/internal/storage"
+)
+
+// gatewayMinPackets is how many packets a rate needs over the health window
+// before it counts against the score, so a few bad packets on a quiet
+// gateway don't raise an alert
+const gatewayMinPackets = 10
+
+// handleGatewayStats stores the packet counts a gateway reports each stats
+// interval
+func (e *Engine) handleGatewayStats(stats *gw.GatewayStats) {
+	err := e.db.InsertGatewayStats(&storage.GatewayStats{
+		GatewayID:  stats.GatewayId,
+		RxReceived: int64(stats.RxPacketsReceived),
+		RxOK:       int64(stats.RxPacketsReceivedOk),
+		TxReceived: int64(stats.TxPacketsReceived),
+		TxEmitted:  int64(stats.TxPacketsEmitted),
+		ReceivedAt: time.Now(),
+	})
+	if err != nil {
+		log.Printf("Failed to record gateway stats: %v", err)
+	}
+}
+
+// gatewayHealth scores a gateway's packet counts. The score is the fraction
+// of uplinks received intact times the fraction of downlinks transmitted, as
+// a percentage.
+func gatewayHealth(s *storage.GatewayStats) localapi.GatewayHealth {
+	h := localapi.GatewayHealth{
+		GatewayID:  s.GatewayID,
+		RxReceived: s.RxReceived,
+		RxOK:       s.RxOK,
+		TxReceived: s.TxReceived,
+		TxEmitted:  s.TxEmitted,
+		LastReport: s.ReceivedAt,
+	}
+	if s.RxReceived >= gatewayMinPackets {
+		h.CRCErrorRate = float64(s.RxReceived-s.RxOK) / float64(s.RxReceived)
+	}
+	if s.TxReceived >= gatewayMinPackets {
+		h.TxFailureRate = float64(s.TxReceived-s.TxEmitted) / float64(s.TxReceived)
+	}
+	h.Score = int(math.Round(100 * (1 - h.CRCErrorRate) * (1 - h.TxFailureRate)))
+	return h
+}
+
+// gatewayHealthAt scores each gateway that reported stats within the health
+// window before now
+func (e *Engine) gatewayHealthAt(now time.Time) ([]localapi.GatewayHealth, error) {
+	totals, err := e.db.GetGatewayStatsTotals(now.Add(-e.settings().Alerts.GatewayWindow))
+	if err != nil {
+		return nil, err
+	}
+	health := make([]localapi.GatewayHealth, 0, len(totals))
+	for _, s := range totals {
+		health = append(health, gatewayHealth(s))
+	}
+	return health, nil
+}
+
+// checkGatewayHealth raises an alert for each gateway whose health score is
+// below GatewayMinScore and clears it once the score recovers
+func (e *Engine) checkGatewayHealth(now time.Time) {
+	cfg := e.settings().Alerts
+
+	health, err := e.gatewayHealthAt(now)
+	if err != nil {
+		log.Printf("Failed to get gateway stats: %v", err)
+		return
+	}
+	open, err := e.db.GetOpenAlerts()
+	if err != nil {
+		log.Printf("Failed to get open alerts: %v", err)
+		return
+	}
+	degraded := make(map[string]bool)
+	for _, a := range open {
+		if a.AlertType == alertGatewayHealth {
+			degraded[a.DeviceUID] = true
+		}
+	}
+
+	for _, h := range health {
+		switch {
+		case cfg.GatewayMinScore > 0 && h.Score < cfg.GatewayMinScore:
+			if !degraded[h.GatewayID] {
+				e.raiseAlert(&storage.Alert{
+					DeviceUID: h.GatewayID,
+					AlertType: alertGatewayHealth,
+					Severity:  storage.AlertWarning,
+					Message: fmt.Sprintf("gateway %s health %d: %.0f%% of uplinks failed CRC, %.0f%% of downlinks not transmitted in the last %s",
+						h.GatewayID, h.Score, 100*h.CRCErrorRate, 100*h.TxFailureRate, cfg.GatewayWindow),
+					Value:     float64(h.Score),
+					Timestamp: now,
+				})
+			}
+		case degraded[h.GatewayID]:
+			e.clearAlerts(h.GatewayID, 0, alertGatewayHealth)
+		}
+	}
+}
+
+// pruneGatewayStats deletes gateway stats past the link history retention
+func (e *Engine) pruneGatewayStats() {
+	retention := e.settings().LinkHistory
+	if retention <= 0 {
+		return
+	}
+
+	n, err := e.db.DeleteGatewayStatsBefore(time.Now().Add(-retention))
+	if err != nil {
+		log.Printf("Failed to prune gateway stats: %v", err)
+		return
+	}
+	if n > 0 {
+		log.Printf("Pruned %d gateway stats reports", n)
+	}
+}
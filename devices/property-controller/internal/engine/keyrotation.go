@@ -0,0 +1,309 @@
+package engine
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/agsys/property-controller/internal/localapi"
+	"github.com/agsys/property-controller/internal/lora"
+	"github.com/agsys/property-controller/internal/protocol"
+	"github.com/agsys/property-controller/internal/storage"
+)
+
+// KeyRotationConfig controls delivery of new per-device LoRa keys
+type KeyRotationConfig struct {
+	Grace   time.Duration // How long a replaced key is still accepted on uplinks
+	Timeout time.Duration // Wait for an ack before resending the key
+	Retries int           // Resends before the rotation is abandoned
+}
+
+// DefaultKeyRotationConfig returns default key rotation settings
+func DefaultKeyRotationConfig() KeyRotationConfig {
+	return KeyRotationConfig{
+		Grace:   24 * time.Hour,
+		Timeout: 2 * time.Minute,
+		Retries: 5,
+	}
+}
+
+// downlinkNonceMark names the stored high-water mark of downlink nonces
+const downlinkNonceMark = "lora_downlink"
+
+// keyRotation is a key delivery awaiting the device's ack
+type keyRotation struct {
+	keyID    uint8
+	key      [16]byte
+	sentAt   time.Time // Zero until first sent
+	attempts int
+}
+
+// loadDeviceKeys restores active keys into the LoRa driver, resumes its
+// downlink nonces past those used before, and resumes rotations that were in
+// flight at the last shutdown
+func (e *Engine) loadDeviceKeys() error {
+	keys := e.lora.Keys()
+	keys.SetGrace(e.settings().KeyRotation.Grace)
+	if e.config.SharedRadio == nil {
+		keys.SetActivateCallback(e.handleKeyActivated)
+
+		mark, err := e.db.GetNonceMark(downlinkNonceMark)
+		if err != nil {
+			return fmt.Errorf("failed to load downlink nonce mark: %w", err)
+		}
+		keys.Nonces().Resume(mark, func(mark uint32) error {
+			return e.db.SetNonceMark(downlinkNonceMark, mark)
+		})
+	}
+
+	active, err := e.db.GetDeviceKeys(storage.DeviceKeyActive)
+	if err != nil {
+		return fmt.Errorf("failed to load active keys: %w", err)
+	}
+	for _, k := range active {
+		uid, err := lora.ParseDeviceUID(k.DeviceUID)
+		if err != nil {
+			log.Printf("Skipping key for invalid device UID %s: %v", k.DeviceUID, err)
+			continue
+		}
+		keys.Load(uid, k.KeyID, k.Key)
+	}
+
+	pending, err := e.db.GetDeviceKeys(storage.DeviceKeyPending)
+	if err != nil {
+		return fmt.Errorf("failed to load pending keys: %w", err)
+	}
+	e.rotationMu.Lock()
+	defer e.rotationMu.Unlock()
+	for _, k := range pending {
+		uid, err := lora.ParseDeviceUID(k.DeviceUID)
+		if err != nil || len(k.Key) != lora.CryptoKeySize {
+			continue
+		}
+		keys.SetPending(uid, k.KeyID, k.Key)
+		rot := &keyRotation{keyID: k.KeyID}
+		copy(rot.key[:], k.Key)
+		e.rotations[k.DeviceUID] = rot
+	}
+
+	if len(active) > 0 || len(pending) > 0 {
+		log.Printf("Loaded %d device keys, %d rotations in progress", len(active), len(pending))
+	}
+	return nil
+}
+
+// RotateDeviceKey generates a new key for a device and starts delivering it,
+// encrypted under the device's current key
+func (e *Engine) RotateDeviceKey(deviceUID string) error {
+	uid, err := lora.ParseDeviceUID(deviceUID)
+	if err != nil {
+		return fmt.Errorf("invalid device UID: %w", err)
+	}
+
+	e.rotationMu.Lock()
+	defer e.rotationMu.Unlock()
+
+	if _, busy := e.rotations[deviceUID]; busy {
+		return fmt.Errorf("key rotation already in progress for %s", deviceUID)
+	}
+
+	latest, err := e.db.GetLatestDeviceKey(deviceUID)
+	if err != nil {
+		return fmt.Errorf("failed to get device key: %w", err)
+	}
+	rot := &keyRotation{keyID: 1}
+	if latest != nil && latest.KeyID < 255 {
+		rot.keyID = latest.KeyID + 1
+	}
+	if _, err := rand.Read(rot.key[:]); err != nil {
+		return fmt.Errorf("failed to generate key: %w", err)
+	}
+
+	// Supersede a rotation abandoned earlier
+	if err := e.db.FailDeviceKey(deviceUID); err != nil {
+		return fmt.Errorf("failed to update device keys: %w", err)
+	}
+	if _, err := e.db.InsertDeviceKey(&storage.DeviceKey{
+		DeviceUID: deviceUID,
+		KeyID:     rot.keyID,
+		Key:       rot.key[:],
+		CreatedAt: time.Now(),
+	}); err != nil {
+		return fmt.Errorf("failed to store device key: %w", err)
+	}
+
+	e.lora.Keys().SetPending(uid, rot.keyID, rot.key[:])
+	e.rotations[deviceUID] = rot
+
+	log.Printf("Rotating key for %s to key %d", deviceUID, rot.keyID)
+	e.sendKeyRotate(deviceUID, uid, rot)
+	return nil
+}
+
+// sendKeyRotate sends a pending key to a device. Must be called with
+// rotationMu held.
+func (e *Engine) sendKeyRotate(deviceUID string, uid [8]byte, rot *keyRotation) {
+	rot.attempts++
+	rot.sentAt = time.Now()
+
+	payload := &protocol.KeyRotatePayload{KeyID: rot.keyID, Key: rot.key}
+	if err := e.lora.SendToDevice(uid, protocol.MsgTypeKeyRotate, payload.Encode()); err != nil {
+		log.Printf("Failed to send key rotation to %s: %v", deviceUID, err)
+	}
+}
+
+// handleKeyRotateAck processes a device's confirmation of a new key
+func (e *Engine) handleKeyRotateAck(deviceUID string, msg *protocol.LoRaMessage) {
+	ack, err := protocol.DecodeKeyRotateAck(msg.Payload)
+	if err != nil {
+		log.Printf("Failed to decode key rotate ack from %s: %v", deviceUID, err)
+		e.count(counterDecodeFailures)
+		return
+	}
+
+	if ack.Status != 0 {
+		log.Printf("Device %s rejected key %d (status %d)", deviceUID, ack.KeyID, ack.Status)
+		e.abandonKeyRotation(deviceUID, msg.Header.DeviceUID)
+		return
+	}
+
+	e.lora.Keys().Activate(msg.Header.DeviceUID, ack.KeyID)
+	e.handleKeyActivated(msg.Header.DeviceUID, ack.KeyID)
+}
+
+// handleKeyActivated records a device switching to its new key, either from
+// its ack or from the LoRa driver hearing it use the pending key
+func (e *Engine) handleKeyActivated(uid [8]byte, keyID uint8) {
+	deviceUID := lora.DeviceUIDToString(uid)
+
+	e.rotationMu.Lock()
+	if rot, ok := e.rotations[deviceUID]; ok && rot.keyID == keyID {
+		delete(e.rotations, deviceUID)
+	}
+	e.rotationMu.Unlock()
+
+	// Also covers an abandoned key heard within its grace window
+	activated, err := e.db.ActivateDeviceKey(deviceUID, keyID)
+	if err != nil {
+		log.Printf("Failed to record key activation for %s: %v", deviceUID, err)
+		return
+	}
+	if activated {
+		log.Printf("Device %s switched to key %d", deviceUID, keyID)
+	}
+}
+
+// abandonKeyRotation gives up on delivering a key. The driver keeps
+// accepting the pending key for the grace window in case the device did
+// install it.
+func (e *Engine) abandonKeyRotation(deviceUID string, uid [8]byte) {
+	e.rotationMu.Lock()
+	delete(e.rotations, deviceUID)
+	e.rotationMu.Unlock()
+
+	e.lora.Keys().Abandon(uid)
+	if err := e.db.FailDeviceKey(deviceUID); err != nil {
+		log.Printf("Failed to mark key failed for %s: %v", deviceUID, err)
+	}
+}
+
+// keyRotationLoop resends keys that have not been acknowledged
+func (e *Engine) keyRotationLoop(ctx context.Context) {
+	defer e.wg.Done()
+
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.stopChan:
+			return
+		case <-ctx.Done():
+			return
+		case <-e.reloadNotify():
+			e.lora.Keys().SetGrace(e.settings().KeyRotation.Grace)
+		case now := <-ticker.C:
+			e.retryKeyRotations(now)
+		}
+	}
+}
+
+// retryKeyRotations resends overdue keys and abandons rotations that have
+// used up their retries
+func (e *Engine) retryKeyRotations(now time.Time) {
+	cfg := e.settings().KeyRotation
+
+	var exhausted []string
+	e.rotationMu.Lock()
+	for deviceUID, rot := range e.rotations {
+		if now.Sub(rot.sentAt) < cfg.Timeout {
+			continue
+		}
+		if rot.attempts > cfg.Retries {
+			exhausted = append(exhausted, deviceUID)
+			continue
+		}
+		uid, err := lora.ParseDeviceUID(deviceUID)
+		if err != nil {
+			continue
+		}
+		log.Printf("Resending key %d to %s (attempt %d/%d)", rot.keyID, deviceUID, rot.attempts+1, cfg.Retries+1)
+		e.sendKeyRotate(deviceUID, uid, rot)
+	}
+	e.rotationMu.Unlock()
+
+	for _, deviceUID := range exhausted {
+		log.Printf("ALERT: key rotation for %s failed, no ack after %d attempts", deviceUID, cfg.Retries+1)
+		uid, _ := lora.ParseDeviceUID(deviceUID)
+		e.abandonKeyRotation(deviceUID, uid)
+	}
+}
+
+// DeviceKeys reports the key state of rotated devices to the local API
+func (e *Engine) DeviceKeys() ([]localapi.DeviceKeyStatus, error) {
+	active, err := e.db.GetDeviceKeys(storage.DeviceKeyActive)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get device keys: %w", err)
+	}
+
+	byDevice := make(map[string]*localapi.DeviceKeyStatus)
+	for _, k := range active {
+		byDevice[k.DeviceUID] = &localapi.DeviceKeyStatus{
+			DeviceUID:   k.DeviceUID,
+			KeyID:       k.KeyID,
+			State:       "active",
+			ActivatedAt: k.ActivatedAt,
+		}
+	}
+
+	e.rotationMu.Lock()
+	for deviceUID, rot := range e.rotations {
+		status, ok := byDevice[deviceUID]
+		if !ok {
+			status = &localapi.DeviceKeyStatus{DeviceUID: deviceUID}
+			byDevice[deviceUID] = status
+		}
+		status.State = "rotating"
+		status.PendingKeyID = rot.keyID
+		status.Attempts = rot.attempts
+	}
+	e.rotationMu.Unlock()
+
+	result := make([]localapi.DeviceKeyStatus, 0, len(byDevice))
+	for deviceUID, status := range byDevice {
+		if uid, err := lora.ParseDeviceUID(deviceUID); err == nil {
+			if info, ok := e.lora.Keys().Info(uid); ok && !info.PreviousUntil.IsZero() {
+				until := info.PreviousUntil
+				status.PreviousValidUntil = &until
+			}
+		}
+		result = append(result, *status)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].DeviceUID < result[j].DeviceUID
+	})
+	return result, nil
+}
@@ -0,0 +1,80 @@
+package engine
+
+import (
+	"log"
+	"time"
+
+	"github.com/agsys/property-controller/internal/protocol"
+	"github.com/agsys/property-controller/internal/storage"
+	controllerv1 "github.com/ccroswhite/agsys-api/gen/go/proto/controller/v1"
+)
+
+// recordLinkSample stores the RSSI/SNR of a received message
+func (e *Engine) recordLinkSample(deviceUID string, msg *protocol.LoRaMessage, at time.Time) {
+	err := e.db.InsertLinkSample(&storage.LinkSample{
+		DeviceUID:  deviceUID,
+		MsgType:    msg.Header.MsgType,
+		RSSI:       msg.RSSI,
+		SNR:        msg.SNR,
+		ReceivedAt: at,
+	})
+	if err != nil {
+		log.Printf("Failed to record link quality for %s: %v", deviceUID, err)
+	}
+}
+
+// pruneLinkQuality deletes link samples past retention
+func (e *Engine) pruneLinkQuality() {
+	retention := e.settings().LinkHistory
+	if retention <= 0 {
+		return
+	}
+
+	n, err := e.db.DeleteLinkSamplesBefore(time.Now().Add(-retention))
+	if err != nil {
+		log.Printf("Failed to prune link quality: %v", err)
+		return
+	}
+	if n > 0 {
+		log.Printf("Pruned %d link quality samples", n)
+	}
+}
+
+// loraStats reports lifetime packet counters and the last hour's average
+// signal quality across all devices for the cloud heartbeat. On a shared
+// radio, whose lifetime packets aren't counted, the driver's counts since
+// it started are sent instead.
+func (e *Engine) loraStats() *controllerv1.LoRaStats {
+	var stats *controllerv1.LoRaStats
+	if e.config.SharedRadio == nil {
+		counters := e.lifetimeCounters()
+		stats = &controllerv1.LoRaStats{
+			PacketsReceived: counters[counterRadioRx],
+			PacketsSent:     counters[counterRadioTx],
+		}
+	} else {
+		driver := e.lora.Stats()
+		stats = &controllerv1.LoRaStats{
+			PacketsReceived: int64(driver.RxPackets),
+			PacketsSent:     int64(driver.TxPackets),
+		}
+	}
+
+	devices, err := e.db.GetLinkQualityStats(time.Now().Add(-time.Hour))
+	if err != nil {
+		log.Printf("Failed to get link quality: %v", err)
+		return stats
+	}
+	var samples int
+	var rssi, snr float64
+	for _, d := range devices {
+		samples += d.Samples
+		rssi += d.AvgRSSI * float64(d.Samples)
+		snr += d.AvgSNR * float64(d.Samples)
+	}
+	if samples > 0 {
+		stats.AvgRssi = float32(rssi / float64(samples))
+		stats.AvgSnr = float32(snr / float64(samples))
+	}
+	return stats
+}
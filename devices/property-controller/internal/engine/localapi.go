@@ -0,0 +1,228 @@
+package engine
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/agsys/property-controller/internal/localapi"
+	"github.com/agsys/property-controller/internal/ota"
+	"github.com/agsys/property-controller/internal/storage"
+)
+
+// otaService exposes OTA operations to the local API, resolving device
+// types from the device registry so callers only need the device UID
+type otaService struct {
+	*ota.Manager
+	engine *Engine
+}
+
+// StartOTAUpdate queues an OTA update for a device. The actor is the name
+// of the API token used, if any.
+func (s *otaService) StartOTAUpdate(deviceUID, actor string) error {
+	deviceType, err := s.engine.lookupDeviceType(deviceUID)
+	if err == nil {
+		err = s.StartUpdate(deviceUID, deviceType)
+	}
+	s.audit("ota_start", "start", deviceUID, actor, err)
+	return err
+}
+
+// CancelOTAUpdate cancels a pending or active OTA update for a device
+func (s *otaService) CancelOTAUpdate(deviceUID, actor string) error {
+	deviceType, _ := s.engine.lookupDeviceType(deviceUID)
+	err := s.CancelUpdate(deviceUID, deviceType)
+	s.audit("ota_cancel", "cancel", deviceUID, actor, err)
+	return err
+}
+
+// StartOTAMulticast starts a multicast OTA session for a device type
+func (s *otaService) StartOTAMulticast(deviceType uint8, listen time.Duration, actor string) (*ota.MulticastSession, error) {
+	session, err := s.StartMulticast(deviceType, listen)
+	s.audit("ota_multicast", fmt.Sprintf("multicast type %d", deviceType), "", actor, err)
+	return session, err
+}
+
+// audit records an OTA request from the local API
+func (s *otaService) audit(kind, command, deviceUID, actor string, err error) {
+	entry := &storage.CommandAudit{
+		Kind:      kind,
+		DeviceUID: deviceUID,
+		Command:   command,
+		Source:    sourceLocalAPI,
+		Actor:     actor,
+		Outcome:   storage.AuditSent,
+	}
+	if err != nil {
+		entry.Outcome, entry.Detail = storage.AuditRejected, err.Error()
+	}
+	s.engine.auditCommand(entry)
+}
+
+// Authenticate checks a local API token against the api_tokens table
+func (e *Engine) Authenticate(token string) (string, localapi.Role, error) {
+	t, err := e.db.GetAPIToken(token)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", "", localapi.ErrInvalidToken
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("failed to check API token: %w", err)
+	}
+	role, err := localapi.ParseRole(t.Role)
+	if err != nil {
+		return "", "", fmt.Errorf("API token %s: %w", t.Name, err)
+	}
+	return t.Name, role, nil
+}
+
+// lookupDeviceType returns the device type for a known device
+func (e *Engine) lookupDeviceType(deviceUID string) (uint8, error) {
+	e.mu.RLock()
+	device, exists := e.registeredDevices[deviceUID]
+	e.mu.RUnlock()
+	if exists && device.DeviceType != 0 {
+		return device.DeviceType, nil
+	}
+
+	device, err := e.db.GetDevice(deviceUID)
+	if err != nil {
+		return 0, fmt.Errorf("unknown device %s", deviceUID)
+	}
+	if device.DeviceType == 0 {
+		return 0, fmt.Errorf("device type not known for %s", deviceUID)
+	}
+	return device.DeviceType, nil
+}
+
+// Status reports controller health to the local API
+func (e *Engine) Status() (*localapi.StatusResponse, error) {
+	counts, err := e.db.GetStatusCounts()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get database counts: %w", err)
+	}
+
+	cfg := e.settings()
+	radio := e.lora.Stats()
+
+	status := &localapi.StatusResponse{
+		ControllerID:    cfg.ControllerID,
+		FirmwareVersion: cfg.FirmwareVersion,
+		StartedAt:       e.startedAt,
+		Cloud: localapi.CloudStatus{
+			Connected:  e.cloud.IsConnected(),
+			ServerAddr: e.cloud.Endpoint(),
+		},
+		LoRa: localapi.LoRaStatus{
+			Running:   radio.Running,
+			Frequency: radio.Frequency,
+			RxPackets: radio.RxPackets,
+			TxPackets: radio.TxPackets,
+			TxErrors:  radio.TxErrors,
+			TxSkipped: radio.TxSkipped,
+			TxQueued:  radio.TxQueued,
+			TxWindow:  radio.TxWindow,
+			Legacy:    radio.Legacy,
+			LastRx:    radio.LastRx,
+
+			DuplicatesDropped: atomic.LoadUint64(&e.duplicates),
+			ThrottledDropped:  atomic.LoadUint64(&e.throttled),
+		},
+		Devices: make(map[string]int, len(counts.DevicesByType)),
+		Unsynced: localapi.UnsyncedCounts{
+			SoilReadings:  counts.UnsyncedSoil,
+			MeterReadings: counts.UnsyncedMeter,
+			Alerts:        counts.UnsyncedAlerts,
+			ValveEvents:   counts.UnsyncedEvents,
+		},
+		Commands: localapi.CommandCounts{
+			Pending: counts.PendingCommands,
+			Failed:  counts.FailedCommands,
+		},
+		Lifetime:      e.lifetimeCounts(),
+		EmergencyStop: e.emergencyStatus(),
+	}
+	for t, n := range counts.DevicesByType {
+		status.Devices[deviceTypeToString(t)] = n
+	}
+	status.Cloud.LowBandwidth = cfg.LowBandwidth.Enabled
+	if usage, err := e.db.GetCloudUsage(usageMonth(time.Now())); err != nil {
+		log.Printf("Failed to get cloud usage: %v", err)
+	} else {
+		status.Cloud.Usage = localapi.CloudUsage{Month: usage.Month, BytesUp: usage.BytesUp, BytesDown: usage.BytesDown}
+	}
+	if gateways, err := e.gatewayHealthAt(time.Now()); err != nil {
+		log.Printf("Failed to get gateway stats: %v", err)
+	} else {
+		status.LoRa.Gateways = gateways
+	}
+	if reboots, err := e.db.GetUnexpectedReboots(time.Now().Add(-rebootReportWindow)); err != nil {
+		log.Printf("Failed to get device reboots: %v", err)
+	} else {
+		for uid, n := range reboots {
+			status.Reboots = append(status.Reboots, localapi.DeviceReboots{DeviceUID: uid, Unexpected: n})
+		}
+		sort.Slice(status.Reboots, func(i, j int) bool { return status.Reboots[i].DeviceUID < status.Reboots[j].DeviceUID })
+	}
+	if failure := e.cloud.LastFailure(); failure != nil && !status.Cloud.Connected {
+		status.Cloud.Failure = failure.Kind
+		status.Cloud.Error = failure.Err.Error()
+	}
+	return status, nil
+}
+
+// rollupService serves reading rollups to the local API
+type rollupService struct {
+	db *storage.DB
+}
+
+// SoilRollups returns soil rollups with temperatures in °C
+func (s rollupService) SoilRollups(deviceUID, period string, since time.Time) ([]localapi.SoilRollup, error) {
+	rollups, err := s.db.GetSoilRollups(deviceUID, period, since)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]localapi.SoilRollup, 0, len(rollups))
+	for _, r := range rollups {
+		result = append(result, localapi.SoilRollup{
+			DeviceUID:      r.DeviceUID,
+			ProbeID:        r.ProbeID,
+			PeriodStart:    r.PeriodStart,
+			Samples:        r.Samples,
+			MoistureMin:    r.MoistureMin,
+			MoistureMax:    r.MoistureMax,
+			MoistureAvg:    r.MoistureAvg,
+			TemperatureMin: float64(r.TemperatureMin) / 10,
+			TemperatureMax: float64(r.TemperatureMax) / 10,
+			TemperatureAvg: r.TemperatureAvg / 10,
+		})
+	}
+	return result, nil
+}
+
+// MeterRollups returns meter rollups
+func (s rollupService) MeterRollups(deviceUID, period string, since time.Time) ([]localapi.MeterRollup, error) {
+	rollups, err := s.db.GetMeterRollups(deviceUID, period, since)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]localapi.MeterRollup, 0, len(rollups))
+	for _, r := range rollups {
+		result = append(result, localapi.MeterRollup{
+			DeviceUID:    r.DeviceUID,
+			PeriodStart:  r.PeriodStart,
+			Samples:      r.Samples,
+			FlowMin:      r.FlowMin,
+			FlowMax:      r.FlowMax,
+			FlowAvg:      r.FlowAvg,
+			VolumeDeltaL: r.VolumeDeltaL,
+			TotalVolumeL: r.TotalVolumeL,
+		})
+	}
+	return result, nil
+}
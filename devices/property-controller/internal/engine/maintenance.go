@@ -0,0 +1,211 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/agsys/property-controller/internal/storage"
+)
+
+// MaintenanceConfig controls periodic database maintenance
+type MaintenanceConfig struct {
+	CheckpointInterval time.Duration // WAL checkpoint (0 disables)
+	IntegrityInterval  time.Duration // Integrity check, run in the idle window (0 disables)
+	VacuumInterval     time.Duration // VACUUM, run in the idle window (0 disables)
+	BackupInterval     time.Duration // Backup to BackupDir, run in the idle window (0 disables)
+	BackupDir          string        // Existing directory backups are written to, e.g. a USB or NFS mount (empty disables)
+	BackupKeep         int           // Newest backups kept in BackupDir
+	IdleStartHour      int           // Local hour the idle window starts
+	IdleEndHour        int           // Local hour the idle window ends (exclusive)
+}
+
+// DefaultMaintenanceConfig returns default maintenance settings
+func DefaultMaintenanceConfig() MaintenanceConfig {
+	return MaintenanceConfig{
+		CheckpointInterval: 1 * time.Hour,
+		IntegrityInterval:  7 * 24 * time.Hour,
+		VacuumInterval:     0,
+		BackupInterval:     24 * time.Hour,
+		BackupKeep:         7,
+		IdleStartHour:      2,
+		IdleEndHour:        5,
+	}
+}
+
+// inIdleWindow reports whether hour falls in the idle window, which may wrap
+// past midnight
+func (c MaintenanceConfig) inIdleWindow(hour int) bool {
+	if c.IdleStartHour <= c.IdleEndHour {
+		return hour >= c.IdleStartHour && hour < c.IdleEndHour
+	}
+	return hour >= c.IdleStartHour || hour < c.IdleEndHour
+}
+
+// maintenanceLoop periodically checkpoints the WAL and, during the idle
+// window, checks integrity, vacuums, and backs up the database
+func (e *Engine) maintenanceLoop(ctx context.Context) {
+	defer e.wg.Done()
+
+	// Resume schedules across restarts
+	last := make(map[string]time.Time)
+	if runs, err := e.db.GetLastMaintenance(); err != nil {
+		log.Printf("Failed to load maintenance history: %v", err)
+	} else {
+		for task, r := range runs {
+			last[task] = r.RanAt
+		}
+	}
+
+	ticker := time.NewTicker(10 * time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.stopChan:
+			return
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			e.runMaintenance(now, last)
+		}
+	}
+}
+
+// runMaintenance runs the maintenance tasks that are due
+func (e *Engine) runMaintenance(now time.Time, last map[string]time.Time) {
+	cfg := e.settings().Maintenance
+	due := func(task string, interval time.Duration) bool {
+		return interval > 0 && now.Sub(last[task]) >= interval
+	}
+
+	if due("checkpoint", cfg.CheckpointInterval) {
+		e.maintain("checkpoint", now, last, func() (string, error) {
+			r, err := e.db.Checkpoint()
+			if err != nil {
+				return "", err
+			}
+			if r.Busy {
+				return "", fmt.Errorf("busy, %d of %d frames checkpointed", r.CheckpointedFrames, r.LogFrames)
+			}
+			return fmt.Sprintf("%d frames checkpointed", r.CheckpointedFrames), nil
+		})
+	}
+
+	integrityDue := due("integrity_check", cfg.IntegrityInterval)
+	vacuumDue := due("vacuum", cfg.VacuumInterval)
+	backupDue := cfg.BackupDir != "" && due("backup", cfg.BackupInterval)
+	if !integrityDue && !vacuumDue && !backupDue {
+		return
+	}
+	if !cfg.inIdleWindow(now.Hour()) || !e.databaseIdle() {
+		return
+	}
+
+	if integrityDue {
+		e.maintain("integrity_check", now, last, func() (string, error) {
+			problems, err := e.db.IntegrityCheck()
+			if err != nil {
+				return "", err
+			}
+			if len(problems) > 0 {
+				log.Printf("ALERT: database integrity check found %d problems", len(problems))
+				return "", fmt.Errorf("%s", strings.Join(problems, "; "))
+			}
+			return "ok", nil
+		})
+	}
+	if vacuumDue {
+		e.maintain("vacuum", now, last, func() (string, error) {
+			return "ok", e.db.Vacuum()
+		})
+	}
+	if backupDue {
+		e.maintain("backup", now, last, func() (string, error) {
+			return e.backupDatabase(cfg, now)
+		})
+	}
+}
+
+// backupDatabase writes a timestamped copy of the database to the backup
+// directory and removes all but the newest BackupKeep. The directory must
+// already exist, so an unmounted USB stick or share fails the backup rather
+// than filling the SD card.
+func (e *Engine) backupDatabase(cfg MaintenanceConfig, now time.Time) (string, error) {
+	if info, err := os.Stat(cfg.BackupDir); err != nil || !info.IsDir() {
+		return "", fmt.Errorf("backup directory %s not available", cfg.BackupDir)
+	}
+	dbPath := e.settings().DatabasePath
+	path := filepath.Join(cfg.BackupDir, backupPrefix(dbPath)+now.Format(backupTimeFormat)+".db")
+	if err := e.db.Backup(context.Background(), path); err != nil {
+		return "", err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+
+	backups, err := listBackups(cfg.BackupDir, dbPath)
+	if err != nil {
+		return "", err
+	}
+	for i := 0; i < len(backups)-max(cfg.BackupKeep, 1); i++ {
+		if err := os.Remove(backups[i]); err != nil {
+			log.Printf("Failed to remove old backup %s: %v", backups[i], err)
+		}
+	}
+	return fmt.Sprintf("%s (%d KB)", path, info.Size()/1024), nil
+}
+
+// databaseIdle reports whether no valves are open and no commands are in
+// flight, so long-running maintenance won't delay time-critical writes
+func (e *Engine) databaseIdle() bool {
+	open, err := e.db.GetOpenValveActuators()
+	if err != nil || len(open) > 0 {
+		return false
+	}
+	counts, err := e.db.GetStatusCounts()
+	return err == nil && counts.PendingCommands == 0
+}
+
+// maintain runs one maintenance task, logs the result, and records it
+func (e *Engine) maintain(task string, now time.Time, last map[string]time.Time, fn func() (string, error)) {
+	start := time.Now()
+	result, err := fn()
+	run := &storage.MaintenanceRun{
+		Task:     task,
+		OK:       err == nil,
+		Result:   result,
+		Duration: time.Since(start),
+		RanAt:    now,
+	}
+	if err != nil {
+		run.Result = err.Error()
+		log.Printf("Database %s failed: %v", task, err)
+	} else {
+		log.Printf("Database %s: %s (%s)", task, result, run.Duration.Round(time.Millisecond))
+	}
+
+	last[task] = now
+	if err := e.db.RecordMaintenance(run); err != nil {
+		log.Printf("Failed to record %s: %v", task, err)
+	}
+}
+
+// Backups are named after the database and the time they were taken
+const backupTimeFormat = "20060102-150405"
+
+// backupPrefix is the start of the names of a database's backups
+func backupPrefix(dbPath string) string {
+	return strings.TrimSuffix(filepath.Base(dbPath), ".db") + "-"
+}
+
+// listBackups returns a database's backups in dir, oldest first
+func listBackups(dir, dbPath string) ([]string, error) {
+	// Timestamps sort by name
+	return filepath.Glob(filepath.Join(dir, backupPrefix(dbPath)+"????????-??????.db"))
+}
@@ -0,0 +1,420 @@
+package engine
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/agsys/property-controller/internal/cloud"
+	"github.com/agsys/property-controller/internal/lora"
+	"github.com/agsys/property-controller/internal/protocol"
+	"github.com/agsys/property-controller/internal/storage"
+)
+
+// MeterCalibrationConfig controls known-volume calibration sessions of water
+// meters. A meter only listens after its uplinks, so each step waits for the
+// meter's next report.
+type MeterCalibrationConfig struct {
+	AckTimeout  time.Duration // Fail a session whose start or finish isn't acked within this long
+	MaxDuration time.Duration // Cancel a session not finished within this long of counting (0 never does)
+	MaxChange   float64       // Reject results moving pulses per liter by more than this fraction (0 accepts any)
+}
+
+// DefaultMeterCalibrationConfig returns default meter calibration settings
+func DefaultMeterCalibrationConfig() MeterCalibrationConfig {
+	return MeterCalibrationConfig{
+		AckTimeout:  10 * time.Minute,
+		MaxDuration: 2 * time.Hour,
+		MaxChange:   0.5,
+	}
+}
+
+// meterCalActionString returns the audit name of a calibration step
+func meterCalActionString(action uint8) string {
+	switch action {
+	case protocol.MeterCalStart:
+		return "calibrate_start"
+	case protocol.MeterCalFinish:
+		return "calibrate_finish"
+	case protocol.MeterCalCancel:
+		return "calibrate_cancel"
+	default:
+		return fmt.Sprintf("calibrate_%d", action)
+	}
+}
+
+// handleMeterCalibrationCommand runs a calibration step from the cloud:
+// device_uid, action (start, finish, or cancel), reference_liters for a
+// finish, command_id, and actor optional. A start or finish is acked once the
+// meter confirms it, a finish with the calibration result.
+func (e *Engine) handleMeterCalibrationCommand(cfg map[string]string) {
+	cloudCommandID, deviceUID := cfg["command_id"], cfg["device_uid"]
+
+	var err error
+	switch cfg["action"] {
+	case "start":
+		err = e.StartMeterCalibration(deviceUID, cloudCommandID, sourceCloud, cfg["actor"])
+	case "finish":
+		liters, perr := strconv.ParseFloat(cfg["reference_liters"], 64)
+		if perr != nil {
+			err = fmt.Errorf("invalid reference_liters: %w", perr)
+			break
+		}
+		err = e.FinishMeterCalibration(deviceUID, liters, cloudCommandID, sourceCloud, cfg["actor"])
+	case "cancel":
+		err = e.CancelMeterCalibration(deviceUID, sourceCloud, cfg["actor"])
+		if err == nil && cloudCommandID != "" {
+			e.cloud.SendCommandAck(cloudCommandID, true, "")
+		}
+	default:
+		err = fmt.Errorf("unknown calibration action %q (use start, finish, or cancel)", cfg["action"])
+	}
+	if err != nil {
+		log.Printf("Meter calibration command failed: %v", err)
+		if cloudCommandID != "" {
+			e.cloud.SendCommandAck(cloudCommandID, false, err.Error())
+		}
+	}
+}
+
+// StartMeterCalibration starts a known-volume calibration session: the meter
+// counts pulses until the session is finished with the volume run through
+// it. The meter must have a stored config, which the result updates. The
+// source and actor are recorded in the command audit log.
+func (e *Engine) StartMeterCalibration(deviceUID, cloudCommandID, source, actor string) error {
+	sessionID := uint16(atomic.AddUint32(&e.commandID, 1))
+	entry := meterCalAudit(deviceUID, sessionID, protocol.MeterCalStart, nil, cloudCommandID, source, actor)
+	defer e.auditCommand(entry)
+
+	reject := func(err error) error {
+		entry.Outcome, entry.Detail = storage.AuditRejected, err.Error()
+		return err
+	}
+	uid, err := e.waterMeterUID(deviceUID)
+	if err != nil {
+		return reject(err)
+	}
+	active, err := e.db.GetActiveMeterCalibration(deviceUID)
+	if err != nil {
+		return reject(fmt.Errorf("failed to load calibration of %s: %w", deviceUID, err))
+	}
+	if active != nil {
+		return reject(fmt.Errorf("meter %s already has calibration session %d %s", deviceUID, active.SessionID, active.State))
+	}
+	config, err := e.db.GetMeterConfig(deviceUID)
+	if err != nil {
+		return reject(fmt.Errorf("failed to load meter config of %s: %w", deviceUID, err))
+	}
+	if config == nil {
+		return reject(fmt.Errorf("meter %s has no stored config to calibrate", deviceUID))
+	}
+
+	if err := e.sendMeterCalStep(uid, sessionID, protocol.MeterCalStart); err != nil {
+		entry.Outcome, entry.Detail = storage.AuditSendFailed, err.Error()
+		return err
+	}
+
+	now := time.Now()
+	e.saveMeterCalibration(&storage.MeterCalibration{
+		DeviceUID:         deviceUID,
+		SessionID:         sessionID,
+		State:             storage.MeterCalStarting,
+		OldPulsesPerLiter: config.PulsesPerLiter,
+		CloudCommandID:    cloudCommandID,
+		Source:            source,
+		Actor:             actor,
+		StartedAt:         now,
+		SentAt:            &now,
+	})
+	log.Printf("Calibration session %d of meter %s starts after its next uplink", sessionID, deviceUID)
+	return nil
+}
+
+// FinishMeterCalibration finishes a meter's running calibration session with
+// the volume run through the meter since it started counting
+func (e *Engine) FinishMeterCalibration(deviceUID string, referenceLiters float64, cloudCommandID, source, actor string) error {
+	c, err := e.db.GetActiveMeterCalibration(deviceUID)
+	if err != nil {
+		return fmt.Errorf("failed to load calibration of %s: %w", deviceUID, err)
+	}
+	var sessionID uint16
+	if c != nil {
+		sessionID = c.SessionID
+	}
+	entry := meterCalAudit(deviceUID, sessionID, protocol.MeterCalFinish,
+		map[string]interface{}{"reference_liters": referenceLiters}, cloudCommandID, source, actor)
+	defer e.auditCommand(entry)
+
+	reject := func(err error) error {
+		entry.Outcome, entry.Detail = storage.AuditRejected, err.Error()
+		return err
+	}
+	switch {
+	case c == nil:
+		return reject(fmt.Errorf("meter %s has no calibration session under way", deviceUID))
+	case c.State != storage.MeterCalRunning:
+		return reject(fmt.Errorf("calibration session %d of %s is %s, not running", c.SessionID, deviceUID, c.State))
+	case !(referenceLiters > 0) || math.IsInf(referenceLiters, 0):
+		return reject(fmt.Errorf("reference volume must be a positive number of liters"))
+	}
+	uid, err := e.waterMeterUID(deviceUID)
+	if err != nil {
+		return reject(err)
+	}
+
+	if err := e.sendMeterCalStep(uid, c.SessionID, protocol.MeterCalFinish); err != nil {
+		entry.Outcome, entry.Detail = storage.AuditSendFailed, err.Error()
+		return err
+	}
+
+	now := time.Now()
+	c.State = storage.MeterCalFinishing
+	c.ReferenceLiters = referenceLiters
+	c.CloudCommandID = cloudCommandID
+	c.SentAt = &now
+	e.saveMeterCalibration(c)
+	log.Printf("Calibration session %d of meter %s finishes with %.1f L after its next uplink", c.SessionID, deviceUID, referenceLiters)
+	return nil
+}
+
+// CancelMeterCalibration abandons a meter's calibration session, leaving its
+// config as it was
+func (e *Engine) CancelMeterCalibration(deviceUID, source, actor string) error {
+	c, err := e.db.GetActiveMeterCalibration(deviceUID)
+	if err != nil {
+		return fmt.Errorf("failed to load calibration of %s: %w", deviceUID, err)
+	}
+	if c == nil {
+		return fmt.Errorf("meter %s has no calibration session under way", deviceUID)
+	}
+	e.sendMeterCalCancel(c, source, actor)
+	e.endMeterCalibration(c, storage.MeterCalCancelled, "cancelled by "+source)
+	return nil
+}
+
+// handleMeterCalibrateAck advances a meter's calibration session on the
+// meter's ack of its start or finish
+func (e *Engine) handleMeterCalibrateAck(deviceUID string, msg *protocol.LoRaMessage) {
+	ack, err := protocol.DecodeMeterCalibrateAck(msg.Payload)
+	if err != nil {
+		log.Printf("Failed to decode meter calibrate ack from %s: %v", deviceUID, err)
+		e.count(counterDecodeFailures)
+		return
+	}
+
+	c, err := e.db.GetActiveMeterCalibration(deviceUID)
+	if err != nil {
+		log.Printf("Failed to load calibration of %s: %v", deviceUID, err)
+		return
+	}
+	if c == nil || c.SessionID != ack.SessionID {
+		log.Printf("Ignoring calibrate ack %d from %s: no session under way", ack.SessionID, deviceUID)
+		return
+	}
+	awaited := (ack.Action == protocol.MeterCalStart && c.State == storage.MeterCalStarting) ||
+		(ack.Action == protocol.MeterCalFinish && c.State == storage.MeterCalFinishing)
+	if !awaited {
+		log.Printf("Ignoring %s ack from %s: session %d is %s", meterCalActionString(ack.Action), deviceUID, c.SessionID, c.State)
+		return
+	}
+
+	if ack.Status != 0 {
+		reason := fmt.Sprintf("meter refused %s: status %d", meterCalActionString(ack.Action), ack.Status)
+		log.Printf("Calibration session %d of meter %s failed: %s", c.SessionID, deviceUID, reason)
+		e.auditOutcome(deviceUID, c.SessionID, storage.AuditNacked, fmt.Sprintf("status %d", ack.Status))
+		e.endMeterCalibration(c, storage.MeterCalFailed, reason)
+		return
+	}
+
+	if ack.Action == protocol.MeterCalStart {
+		now := time.Now()
+		log.Printf("Meter %s is counting pulses for calibration session %d", deviceUID, c.SessionID)
+		e.auditOutcome(deviceUID, c.SessionID, storage.AuditAcked, "counting")
+		if c.CloudCommandID != "" {
+			e.cloud.SendCommandAck(c.CloudCommandID, true, "")
+		}
+		c.State = storage.MeterCalRunning
+		c.RunningAt = &now
+		c.CloudCommandID = ""
+		e.saveMeterCalibration(c)
+		return
+	}
+
+	e.auditOutcome(deviceUID, c.SessionID, storage.AuditAcked, fmt.Sprintf("%d pulses", ack.Pulses))
+	e.completeMeterCalibration(c, ack.Pulses)
+}
+
+// completeMeterCalibration computes a meter's pulses per liter from the
+// pulses counted for the reference volume, and pushes the meter its config
+// with the new value
+func (e *Engine) completeMeterCalibration(c *storage.MeterCalibration, pulses uint32) {
+	c.Pulses = pulses
+	scaled := math.Round(float64(pulses) / c.ReferenceLiters * 100)
+	if scaled < 1 || scaled > math.MaxUint16 {
+		e.endMeterCalibration(c, storage.MeterCalFailed,
+			fmt.Sprintf("%d pulses for %.1f L is not a usable pulses per liter", pulses, c.ReferenceLiters))
+		return
+	}
+	if limit := e.settings().MeterCalibration.MaxChange; limit > 0 && c.OldPulsesPerLiter > 0 {
+		old := float64(c.OldPulsesPerLiter)
+		if change := math.Abs(scaled-old) / old; change > limit {
+			e.endMeterCalibration(c, storage.MeterCalFailed,
+				fmt.Sprintf("%.2f pulses per liter is %.0f%% off the current %.2f, over the %.0f%% limit",
+					scaled/100, change*100, old/100, limit*100))
+			return
+		}
+	}
+
+	config, err := e.db.GetMeterConfig(c.DeviceUID)
+	if err != nil || config == nil {
+		e.endMeterCalibration(c, storage.MeterCalFailed, "meter config no longer stored")
+		return
+	}
+	current := config.ConfigVersion
+	if d, err := e.db.GetDeviceConfig(c.DeviceUID); err == nil && d != nil {
+		current = d.ConfigVersion
+	}
+	config.PulsesPerLiter = uint16(scaled)
+	config.ConfigVersion = e.nextConfigVersion(c.DeviceUID, current)
+	config.State = storage.DeviceConfigQueued
+	config.Actor = c.Actor
+	config.SentAt = nil
+	e.deliverMeterConfig(config, c.Source)
+
+	now := time.Now()
+	c.State = storage.MeterCalCompleted
+	c.NewPulsesPerLiter = config.PulsesPerLiter
+	c.ConfigVersion = config.ConfigVersion
+	c.FinishedAt = &now
+	log.Printf("Meter %s calibrated: %d pulses for %.1f L, %.2f pulses per liter (was %.2f), config v%d",
+		c.DeviceUID, pulses, c.ReferenceLiters, scaled/100, float64(c.OldPulsesPerLiter)/100, c.ConfigVersion)
+
+	if c.CloudCommandID != "" {
+		err := e.cloud.SendMeterCalibration(c.CloudCommandID, &cloud.MeterCalibrationData{
+			ReferenceLiters:   c.ReferenceLiters,
+			Pulses:            pulses,
+			OldPulsesPerLiter: float64(c.OldPulsesPerLiter) / 100,
+			NewPulsesPerLiter: scaled / 100,
+			ConfigVersion:     c.ConfigVersion,
+		})
+		if err != nil {
+			log.Printf("Failed to report calibration of %s: %v", c.DeviceUID, err)
+		}
+		c.CloudCommandID = ""
+	}
+	e.saveMeterCalibration(c)
+}
+
+// expireMeterCalibrations fails sessions whose start or finish the meter
+// hasn't acked in time, and cancels those left counting too long
+func (e *Engine) expireMeterCalibrations(now time.Time) {
+	cfg := e.settings().MeterCalibration
+	sessions, err := e.db.GetActiveMeterCalibrations()
+	if err != nil {
+		log.Printf("Failed to get meter calibrations: %v", err)
+		return
+	}
+
+	for _, c := range sessions {
+		switch c.State {
+		case storage.MeterCalStarting, storage.MeterCalFinishing:
+			if c.SentAt != nil && now.Sub(*c.SentAt) >= cfg.AckTimeout {
+				reason := fmt.Sprintf("no acknowledgment from meter within %s", cfg.AckTimeout)
+				log.Printf("Calibration session %d of meter %s failed: %s", c.SessionID, c.DeviceUID, reason)
+				e.auditOutcome(c.DeviceUID, c.SessionID, storage.AuditNoAck, reason)
+				e.endMeterCalibration(c, storage.MeterCalFailed, reason)
+			}
+		case storage.MeterCalRunning:
+			if cfg.MaxDuration > 0 && c.RunningAt != nil && now.Sub(*c.RunningAt) >= cfg.MaxDuration {
+				reason := fmt.Sprintf("not finished within %s", cfg.MaxDuration)
+				log.Printf("Cancelling calibration session %d of meter %s: %s", c.SessionID, c.DeviceUID, reason)
+				e.sendMeterCalCancel(c, sourceRule, "calibration_timeout")
+				e.endMeterCalibration(c, storage.MeterCalFailed, reason)
+			}
+		}
+	}
+}
+
+// endMeterCalibration ends a session without a result, and nacks the cloud
+// command awaiting the meter, if any
+func (e *Engine) endMeterCalibration(c *storage.MeterCalibration, state, reason string) {
+	now := time.Now()
+	c.State = state
+	c.Error = reason
+	c.FinishedAt = &now
+	if c.CloudCommandID != "" {
+		e.cloud.SendCommandAck(c.CloudCommandID, false, reason)
+		c.CloudCommandID = ""
+	}
+	e.saveMeterCalibration(c)
+}
+
+// sendMeterCalCancel tells a meter to abandon its session, recording it in
+// the command audit log. The session ends whether or not the meter hears it.
+func (e *Engine) sendMeterCalCancel(c *storage.MeterCalibration, source, actor string) {
+	entry := meterCalAudit(c.DeviceUID, c.SessionID, protocol.MeterCalCancel, nil, "", source, actor)
+	defer e.auditCommand(entry)
+
+	uid, err := lora.ParseDeviceUID(c.DeviceUID)
+	if err == nil {
+		err = e.sendMeterCalStep(uid, c.SessionID, protocol.MeterCalCancel)
+	}
+	if err != nil {
+		log.Printf("Failed to cancel calibration session %d of %s: %v", c.SessionID, c.DeviceUID, err)
+		entry.Outcome, entry.Detail = storage.AuditSendFailed, err.Error()
+	}
+}
+
+// sendMeterCalStep sends a calibration session step in the receive window
+// after the meter's next uplink
+func (e *Engine) sendMeterCalStep(uid [8]byte, sessionID uint16, action uint8) error {
+	req := &protocol.MeterCalibrateReqPayload{SessionID: sessionID, Action: action}
+	return e.lora.SendInWindow(uid, protocol.MsgTypeMeterCalibrateReq, req.Encode())
+}
+
+// meterCalAudit returns the audit entry of a calibration step
+func meterCalAudit(deviceUID string, sessionID uint16, action uint8, params interface{}, cloudCommandID, source, actor string) *storage.CommandAudit {
+	entry := &storage.CommandAudit{
+		Kind:           "meter_calibration",
+		DeviceUID:      deviceUID,
+		Command:        meterCalActionString(action),
+		Source:         source,
+		Actor:          actor,
+		CloudCommandID: cloudCommandID,
+		CommandID:      sessionID,
+		Outcome:        storage.AuditSent,
+	}
+	if params != nil {
+		entry.Params = auditParams(params)
+	}
+	return entry
+}
+
+// waterMeterUID parses the UID of a registered water meter, for commands
+// only meters carry out
+func (e *Engine) waterMeterUID(deviceUID string) ([8]byte, error) {
+	uid, err := lora.ParseDeviceUID(deviceUID)
+	if err != nil {
+		return uid, fmt.Errorf("invalid device UID: %w", err)
+	}
+	e.mu.RLock()
+	device, registered := e.registeredDevices[deviceUID]
+	e.mu.RUnlock()
+	if !registered {
+		return uid, fmt.Errorf("device %s is not registered", deviceUID)
+	}
+	if device.DeviceType != protocol.DeviceTypeWaterMeter {
+		return uid, fmt.Errorf("device %s is not a water meter", deviceUID)
+	}
+	return uid, nil
+}
+
+// saveMeterCalibration stores a meter calibration session
+func (e *Engine) saveMeterCalibration(c *storage.MeterCalibration) {
+	if err := e.db.SaveMeterCalibration(c); err != nil {
+		log.Printf("Failed to save calibration of %s: %v", c.DeviceUID, err)
+	}
+}
@@ -0,0 +1,96 @@
+package engine
+
+import (
+	"log"
+	"time"
+
+	"github.com/agsys/property-controller/internal/protocol"
+	"github.com/agsys/property-controller/internal/storage"
+)
+
+// meterConfigSourceCLI is the audit source of meter configs set with agsys-db
+const meterConfigSourceCLI = "cli"
+
+// sendQueuedMeterConfigs sends the meter configs queued with agsys-db, each
+// in the receive window after the meter's next uplink
+func (e *Engine) sendQueuedMeterConfigs() {
+	configs, err := e.db.GetQueuedMeterConfigs()
+	if err != nil {
+		log.Printf("Failed to get queued meter configs: %v", err)
+		return
+	}
+
+	for _, c := range configs {
+		e.deliverMeterConfig(c, meterConfigSourceCLI)
+	}
+}
+
+// deliverMeterConfig sends a meter its config and marks the config pending.
+// One that can't be sent stays queued for the next attempt.
+func (e *Engine) deliverMeterConfig(c *storage.MeterConfig, source string) {
+	payload := &protocol.MeterConfigPayload{
+		ConfigVersion:     c.ConfigVersion,
+		ReportIntervalSec: c.ReportIntervalSec,
+		PulsesPerLiter:    c.PulsesPerLiter,
+		LeakThresholdMin:  c.LeakThresholdMin,
+		MaxFlowRateLPM:    c.MaxFlowRateLPM,
+		Flags:             c.Flags,
+	}
+	if err := e.SendMeterConfig(c.DeviceUID, payload, source, c.Actor); err != nil {
+		log.Printf("Failed to send config v%d to %s: %v", c.ConfigVersion, c.DeviceUID, err)
+		e.saveMeterConfig(c)
+		return
+	}
+	log.Printf("Config v%d for meter %s goes out after its next uplink", c.ConfigVersion, c.DeviceUID)
+
+	now := time.Now()
+	c.State = storage.DeviceConfigPending
+	c.SentAt = &now
+	e.saveMeterConfig(c)
+}
+
+// handleMeterConfigAck records a meter's confirmation of its config,
+// reporting whether the ack was of the config sent
+func (e *Engine) handleMeterConfigAck(deviceUID string, ack *protocol.ConfigAckPayload) bool {
+	c, err := e.db.GetMeterConfig(deviceUID)
+	if err != nil {
+		log.Printf("Failed to load meter config of %s: %v", deviceUID, err)
+		return false
+	}
+	if c == nil || c.State != storage.DeviceConfigPending || ack.ConfigVersion != c.ConfigVersion {
+		return false
+	}
+
+	if ack.Status != 0 {
+		log.Printf("Meter %s rejected config v%d (status %d)", deviceUID, c.ConfigVersion, ack.Status)
+		c.State = storage.DeviceConfigFailed
+	} else {
+		now := time.Now()
+		log.Printf("Meter %s applied config v%d", deviceUID, c.ConfigVersion)
+		c.State = storage.DeviceConfigApplied
+		c.AckedVersion = &ack.ConfigVersion
+		c.AckedAt = &now
+	}
+	e.saveMeterConfig(c)
+	return true
+}
+
+// nextConfigVersion returns the version of a device's next report interval.
+// A CONFIG_ACK carries only the version, so report intervals and meter
+// configs take their versions from one sequence per device.
+func (e *Engine) nextConfigVersion(deviceUID string, current uint16) uint16 {
+	m, err := e.db.GetMeterConfig(deviceUID)
+	if err != nil {
+		log.Printf("Failed to load meter config of %s: %v", deviceUID, err)
+	} else if m != nil && m.ConfigVersion > current {
+		current = m.ConfigVersion
+	}
+	return current + 1
+}
+
+// saveMeterConfig stores a meter's config
+func (e *Engine) saveMeterConfig(c *storage.MeterConfig) {
+	if err := e.db.SaveMeterConfig(c); err != nil {
+		log.Printf("Failed to save meter config of %s: %v", c.DeviceUID, err)
+	}
+}
@@ -0,0 +1,269 @@
+package engine
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	controllerv1 "github.com/ccroswhite/agsys-api/gen/go/proto/controller/v1"
+
+	"github.com/agsys/property-controller/internal/lora"
+	"github.com/agsys/property-controller/internal/protocol"
+	"github.com/agsys/property-controller/internal/storage"
+)
+
+// MeterPinConfig controls how remote shutoff (pin) commands to water meters
+// are confirmed. A meter only listens after its uplinks, so each send waits
+// for the meter's next report.
+type MeterPinConfig struct {
+	Timeout time.Duration // Wait for an ack before resending
+	Retries int           // Resends before the command is marked failed
+}
+
+// DefaultMeterPinConfig returns default meter pin settings
+func DefaultMeterPinConfig() MeterPinConfig {
+	return MeterPinConfig{
+		Timeout: 10 * time.Minute,
+		Retries: 3,
+	}
+}
+
+// meterPinCommandString returns the audit name of a pin command
+func meterPinCommandString(shutoff bool) string {
+	if shutoff {
+		return "shutoff"
+	}
+	return "release"
+}
+
+// meterValveStateString returns the name of a valve state in a pin ack
+func meterValveStateString(state uint8) string {
+	switch state {
+	case protocol.MeterValveOpen:
+		return "open"
+	case protocol.MeterValveClosed:
+		return "closed"
+	case protocol.MeterValveFault:
+		return "fault"
+	default:
+		return fmt.Sprintf("unknown (%d)", state)
+	}
+}
+
+// handleMeterPinCommandGRPC processes meter remote shutoff commands from the
+// cloud via gRPC. The command is acked to the cloud once the meter confirms
+// it, refuses it, or runs out of retries.
+func (e *Engine) handleMeterPinCommandGRPC(cmd *controllerv1.MeterPinCommand) {
+	log.Printf("Meter pin command from cloud: meter %s -> %s", cmd.DeviceUid, meterPinCommandString(cmd.Shutoff))
+
+	// Cloud messages may be redelivered after a reconnect
+	if cmd.CommandId != "" {
+		prev, err := e.db.GetMeterPinByCloudID(cmd.CommandId)
+		if err != nil {
+			log.Printf("Failed to look up cloud command %s: %v", cmd.CommandId, err)
+		} else if prev != nil {
+			log.Printf("Ignoring duplicate cloud command %s (LoRa command %d)", cmd.CommandId, prev.CommandID)
+			e.auditCommand(&storage.CommandAudit{
+				Kind:           "meter_pin",
+				DeviceUID:      prev.DeviceUID,
+				Command:        meterPinCommandString(prev.Pinned),
+				Source:         sourceCloud,
+				CloudCommandID: cmd.CommandId,
+				CommandID:      prev.CommandID,
+				Outcome:        storage.AuditDuplicate,
+			})
+
+			// Repeat the outcome if we already have one, in case the cloud missed it
+			switch prev.State {
+			case storage.DeviceConfigApplied:
+				e.cloud.SendCommandAck(cmd.CommandId, true, "")
+			case storage.DeviceConfigFailed:
+				e.cloud.SendCommandAck(cmd.CommandId, false, prev.Error)
+			}
+			return
+		}
+	}
+
+	if err := e.SendMeterPin(cmd.DeviceUid, cmd.Shutoff, cmd.CommandId, sourceCloud, ""); err != nil {
+		log.Printf("Meter pin command failed: %v", err)
+		if cmd.CommandId != "" {
+			e.cloud.SendCommandAck(cmd.CommandId, false, err.Error())
+		}
+	}
+}
+
+// SendMeterPin sends a water meter a command to shut its valve and hold it
+// shut, or to release it, in the receive window after the meter's next
+// uplink. The command replaces any still awaiting the meter's ack. The source
+// and actor are recorded in the command audit log.
+func (e *Engine) SendMeterPin(deviceUID string, shutoff bool, cloudCommandID, source, actor string) error {
+	cmdID := uint16(atomic.AddUint32(&e.commandID, 1))
+
+	entry := &storage.CommandAudit{
+		Kind:           "meter_pin",
+		DeviceUID:      deviceUID,
+		Command:        meterPinCommandString(shutoff),
+		Source:         source,
+		Actor:          actor,
+		CloudCommandID: cloudCommandID,
+		CommandID:      cmdID,
+		Outcome:        storage.AuditSent,
+	}
+	defer e.auditCommand(entry)
+
+	reject := func(err error) error {
+		entry.Outcome, entry.Detail = storage.AuditRejected, err.Error()
+		return err
+	}
+	uid, err := e.waterMeterUID(deviceUID)
+	if err != nil {
+		return reject(err)
+	}
+
+	action := protocol.MeterPinRelease
+	if shutoff {
+		action = protocol.MeterPinShutoff
+	}
+	payload := (&protocol.MeterPinPayload{CommandID: cmdID, Action: action}).Encode()
+	if err := e.lora.SendInWindow(uid, protocol.MsgTypeMeterPin, payload); err != nil {
+		entry.Outcome, entry.Detail = storage.AuditSendFailed, err.Error()
+		return err
+	}
+
+	prev, err := e.db.GetMeterPin(deviceUID)
+	if err != nil {
+		log.Printf("Failed to load meter pin of %s: %v", deviceUID, err)
+	} else if prev != nil && prev.State == storage.DeviceConfigPending {
+		reason := fmt.Sprintf("superseded by command %d", cmdID)
+		log.Printf("Meter pin command %d to %s %s", prev.CommandID, deviceUID, reason)
+		e.auditOutcome(deviceUID, prev.CommandID, storage.AuditCancelled, reason)
+		if prev.CloudCommandID != "" {
+			e.cloud.SendCommandAck(prev.CloudCommandID, false, reason)
+		}
+	}
+
+	now := time.Now()
+	e.saveMeterPin(&storage.MeterPin{
+		DeviceUID:      deviceUID,
+		CommandID:      cmdID,
+		Pinned:         shutoff,
+		State:          storage.DeviceConfigPending,
+		Attempts:       1,
+		CloudCommandID: cloudCommandID,
+		Source:         source,
+		Actor:          actor,
+		SentAt:         &now,
+	})
+
+	log.Printf("Meter %s %s (command %d) goes out after its next uplink", deviceUID, meterPinCommandString(shutoff), cmdID)
+	return nil
+}
+
+// retryUnackedMeterPins resends pin commands whose ack is overdue, and fails
+// those out of retries
+func (e *Engine) retryUnackedMeterPins() {
+	cfg := e.settings().MeterPin
+	pins, err := e.db.GetPendingMeterPins(time.Now().Add(-cfg.Timeout))
+	if err != nil {
+		log.Printf("Failed to get unacked meter pins: %v", err)
+		return
+	}
+
+	for _, p := range pins {
+		if p.Attempts > cfg.Retries {
+			log.Printf("ALERT: meter %s %s (command %d) failed, no ack after %d attempts",
+				p.DeviceUID, meterPinCommandString(p.Pinned), p.CommandID, p.Attempts)
+			e.failMeterPin(p, storage.AuditNoAck, fmt.Sprintf("no acknowledgment from meter after %d attempts", p.Attempts))
+			continue
+		}
+
+		uid, err := lora.ParseDeviceUID(p.DeviceUID)
+		if err != nil {
+			e.failMeterPin(p, storage.AuditRejected, fmt.Sprintf("invalid device UID: %v", err))
+			continue
+		}
+		log.Printf("Resending %s to meter %s (attempt %d/%d)", meterPinCommandString(p.Pinned), p.DeviceUID, p.Attempts+1, cfg.Retries+1)
+
+		action := protocol.MeterPinRelease
+		if p.Pinned {
+			action = protocol.MeterPinShutoff
+		}
+		payload := (&protocol.MeterPinPayload{CommandID: p.CommandID, Action: action}).Encode()
+		if err := e.lora.SendInWindow(uid, protocol.MsgTypeMeterPin, payload); err != nil {
+			log.Printf("Failed to resend meter pin to %s: %v", p.DeviceUID, err)
+			continue
+		}
+
+		now := time.Now()
+		p.Attempts++
+		p.SentAt = &now
+		e.saveMeterPin(p)
+	}
+}
+
+// handleMeterPinAck records a meter's confirmation of a pin command and acks
+// the command to the cloud if it came from there
+func (e *Engine) handleMeterPinAck(deviceUID string, msg *protocol.LoRaMessage) {
+	ack, err := protocol.DecodeMeterPinAck(msg.Payload)
+	if err != nil {
+		log.Printf("Failed to decode meter pin ack from %s: %v", deviceUID, err)
+		e.count(counterDecodeFailures)
+		return
+	}
+
+	p, err := e.db.GetMeterPin(deviceUID)
+	if err != nil {
+		log.Printf("Failed to load meter pin of %s: %v", deviceUID, err)
+		return
+	}
+	if p == nil || p.CommandID != ack.CommandID || p.State != storage.DeviceConfigPending {
+		log.Printf("Ignoring meter pin ack %d from %s: no command awaiting it", ack.CommandID, deviceUID)
+		return
+	}
+
+	valveState := ack.ValveState
+	p.ValveState = &valveState
+	if ack.Status != 0 {
+		log.Printf("ALERT: meter %s refused %s (command %d): status %d, valve %s", deviceUID,
+			meterPinCommandString(p.Pinned), ack.CommandID, ack.Status, meterValveStateString(ack.ValveState))
+		e.failMeterPin(p, storage.AuditNacked,
+			fmt.Sprintf("status %d, valve %s", ack.Status, meterValveStateString(ack.ValveState)))
+		return
+	}
+
+	now := time.Now()
+	log.Printf("Meter %s applied %s (command %d), valve %s", deviceUID,
+		meterPinCommandString(p.Pinned), ack.CommandID, meterValveStateString(ack.ValveState))
+	p.State = storage.DeviceConfigApplied
+	p.AckedAt = &now
+	p.Error = ""
+	e.saveMeterPin(p)
+	e.auditOutcome(deviceUID, p.CommandID, storage.AuditAcked, "valve "+meterValveStateString(ack.ValveState))
+	if p.CloudCommandID != "" {
+		if err := e.cloud.SendCommandAck(p.CloudCommandID, true, ""); err != nil {
+			log.Printf("Failed to ack meter pin command %s: %v", p.CloudCommandID, err)
+		}
+	}
+}
+
+// failMeterPin marks a pin command failed, records the outcome, and nacks the
+// command to the cloud if it came from there
+func (e *Engine) failMeterPin(p *storage.MeterPin, outcome, reason string) {
+	p.State = storage.DeviceConfigFailed
+	p.Error = reason
+	e.saveMeterPin(p)
+	e.auditOutcome(p.DeviceUID, p.CommandID, outcome, reason)
+	if p.CloudCommandID != "" {
+		if err := e.cloud.SendCommandAck(p.CloudCommandID, false, reason); err != nil {
+			log.Printf("Failed to nack meter pin command %s: %v", p.CloudCommandID, err)
+		}
+	}
+}
+
+// saveMeterPin stores the latest pin command of a meter
+func (e *Engine) saveMeterPin(p *storage.MeterPin) {
+	if err := e.db.SaveMeterPin(p); err != nil {
+		log.Printf("Failed to save meter pin of %s: %v", p.DeviceUID, err)
+	}
+}
@@ -0,0 +1,56 @@
+package engine
+
+import (
+	"log"
+
+	"github.com/agsys/property-controller/internal/modbus"
+	"github.com/agsys/property-controller/internal/protocol"
+)
+
+// modbusSource serves Modbus points from the database and turns coil
+// writes into valve commands
+type modbusSource struct {
+	engine *Engine
+}
+
+// ValveState returns the last reported state of a valve
+func (m modbusSource) ValveState(v modbus.ValveRef) (uint8, bool, error) {
+	return m.engine.db.GetValveActuatorState(v.ControllerUID, v.Address)
+}
+
+// SoilMoisture returns the latest moisture percentage of a probe
+func (m modbusSource) SoilMoisture(s modbus.SensorRef) (uint8, bool, error) {
+	return m.engine.db.GetLatestSoilMoisture(s.DeviceUID, s.Probe)
+}
+
+// MeterReading returns the latest flow rate and totalizer of a meter
+func (m modbusSource) MeterReading(deviceUID string) (float32, float32, bool, error) {
+	r, err := m.engine.db.GetLatestWaterMeterReading(deviceUID)
+	if err != nil || r == nil {
+		return 0, 0, false, err
+	}
+	return r.FlowRateLPM, r.TotalVolumeL, true, nil
+}
+
+// SetValve opens or closes a valve. PLCs often rewrite coils every scan, so
+// a valve already in or moving to the requested state gets no new command.
+func (m modbusSource) SetValve(v modbus.ValveRef, open bool) error {
+	state, known, err := m.engine.db.GetValveActuatorState(v.ControllerUID, v.Address)
+	if err != nil {
+		return err
+	}
+	if known {
+		isOpen := state == protocol.ValveStateOpen || state == protocol.ValveStateOpening
+		isClosed := state == protocol.ValveStateClosed || state == protocol.ValveStateClosing
+		if (open && isOpen) || (!open && isClosed) {
+			return nil
+		}
+	}
+
+	cmd := protocol.ValveCmdClose
+	if open {
+		cmd = protocol.ValveCmdOpen
+	}
+	log.Printf("Modbus: valve %s addr %d -> %s", v.ControllerUID, v.Address, valveCommandString(cmd))
+	return m.engine.SendValveCommand(v.ControllerUID, v.Address, cmd, sourceModbus, "")
+}
@@ -0,0 +1,143 @@
+package engine
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/agsys/property-controller/internal/storage"
+)
+
+// MoistureAlertConfig sets the soil moisture range outside of which probes
+// raise alerts
+type MoistureAlertConfig struct {
+	DryPercent uint8          // Alert at or below this moisture (0 disables)
+	WetPercent uint8          // Alert at or above this moisture, saturated (0 disables)
+	Hysteresis uint8          // Points moisture must recover past a threshold to clear
+	Zones      []ZoneMoisture // Per-zone overrides
+}
+
+// ZoneMoisture overrides the moisture thresholds for the sensors in a zone
+type ZoneMoisture struct {
+	ZoneUID    string
+	DryPercent uint8
+	WetPercent uint8
+}
+
+// DefaultMoistureAlertConfig returns default moisture alert settings, with
+// no thresholds set
+func DefaultMoistureAlertConfig() MoistureAlertConfig {
+	return MoistureAlertConfig{
+		Hysteresis: 3,
+	}
+}
+
+// thresholds returns the dry and wet thresholds for a zone
+func (c MoistureAlertConfig) thresholds(zoneUID string) (dry, wet uint8) {
+	for _, z := range c.Zones {
+		if zoneUID != "" && z.ZoneUID == zoneUID {
+			return z.DryPercent, z.WetPercent
+		}
+	}
+	return c.DryPercent, c.WetPercent
+}
+
+// moistureLevel classifies a reading as dry, wet, or in range ("") given the
+// probe's previous level. A probe stays dry or wet until it recovers past the
+// threshold by the hysteresis, so a reading hovering at a threshold doesn't
+// raise an alert on every report.
+func moistureLevel(percent, dry, wet, hysteresis uint8, prev string) string {
+	switch {
+	case dry > 0 && percent <= dry:
+		return alertMoistureDry
+	case wet > 0 && percent >= wet:
+		return alertMoistureWet
+	case prev == alertMoistureDry && dry > 0 && int(percent) < int(dry)+int(hysteresis):
+		return alertMoistureDry
+	case prev == alertMoistureWet && wet > 0 && int(percent) > int(wet)-int(hysteresis):
+		return alertMoistureWet
+	default:
+		return ""
+	}
+}
+
+// moistureProbe identifies a probe on a soil sensor
+type moistureProbe struct {
+	deviceUID string
+	probeID   uint8
+}
+
+// checkMoisture evaluates probe readings against the moisture thresholds for
+// the sensor's zone, raising an alert when a probe leaves the range and
+// clearing it when the probe recovers
+func (e *Engine) checkMoisture(deviceUID string, readings []*storage.SoilMoistureReading) {
+	cfg := e.settings().MoistureAlerts
+
+	var zoneUID string
+	if device, err := e.db.GetDevice(deviceUID); err == nil {
+		zoneUID = device.ZoneID
+	}
+	dry, wet := cfg.thresholds(zoneUID)
+
+	for _, r := range readings {
+		prev := e.probeLevel(deviceUID, r.ProbeID)
+		level := moistureLevel(r.MoisturePercent, dry, wet, cfg.Hysteresis, prev)
+		if level == prev {
+			continue
+		}
+
+		if prev != "" {
+			e.clearAlerts(deviceUID, r.ProbeID, prev)
+		}
+		if level != "" {
+			alert := &storage.Alert{
+				DeviceUID: deviceUID,
+				ZoneID:    zoneUID,
+				ProbeID:   r.ProbeID,
+				AlertType: level,
+				Severity:  storage.AlertWarning,
+				Value:     float64(r.MoisturePercent),
+				Threshold: float64(dry),
+				Message: fmt.Sprintf("soil moisture on %s probe %d is %d%%, at or below dry threshold %d%%",
+					deviceUID, r.ProbeID, r.MoisturePercent, dry),
+				Timestamp: r.Timestamp,
+			}
+			if level == alertMoistureWet {
+				alert.Threshold = float64(wet)
+				alert.Message = fmt.Sprintf("soil moisture on %s probe %d is %d%%, at or above saturation threshold %d%%",
+					deviceUID, r.ProbeID, r.MoisturePercent, wet)
+			}
+			e.raiseAlert(alert)
+		}
+
+		e.moistMu.Lock()
+		e.moisture[moistureProbe{deviceUID, r.ProbeID}] = level
+		e.moistMu.Unlock()
+	}
+}
+
+// probeLevel returns a probe's open moisture alert type, if any, loading it
+// from the database after a restart so crossings aren't alerted twice
+func (e *Engine) probeLevel(deviceUID string, probeID uint8) string {
+	key := moistureProbe{deviceUID, probeID}
+
+	e.moistMu.Lock()
+	defer e.moistMu.Unlock()
+	if level, ok := e.moisture[key]; ok {
+		return level
+	}
+
+	open, err := e.db.GetOpenDeviceAlerts(deviceUID)
+	if err != nil {
+		log.Printf("Failed to get open alerts for %s: %v", deviceUID, err)
+		return ""
+	}
+	level := ""
+	for _, a := range open {
+		if a.ProbeID == probeID && (a.AlertType == alertMoistureDry || a.AlertType == alertMoistureWet) {
+			level = a.AlertType
+			break
+		}
+	}
+	e.moisture[key] = level
+	return level
+}
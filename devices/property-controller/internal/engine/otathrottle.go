@@ -0,0 +1,50 @@
+package engine
+
+import (
+	"log"
+	"time"
+
+	"github.com/agsys/property-controller/internal/ota"
+)
+
+// OTAConfig controls firmware transfers and limits how much of the downlink
+// firmware chunks may use, so updates don't starve valve commands and time
+// syncs
+type OTAConfig struct {
+	ChunkSize        uint16        // Bytes of firmware per chunk
+	ChunkTimeout     time.Duration // How long a device has to ack a chunk
+	ChunkRetries     int           // Times a chunk is resent before the update fails
+	AnnounceInterval time.Duration // How often available updates are announced again
+	WindowSize       uint8         // Chunks in flight for devices that support it (0 sends one at a time)
+	MulticastPacing  time.Duration // Time between chunks broadcast to a multicast session
+	AirtimeBudget    float64       // Fraction of downlink airtime for chunks (0 disables the limit)
+	AirtimeWindow    time.Duration // Period the budget is measured over
+	PauseForCommands bool          // Hold chunks while valve commands await an ack
+}
+
+// DefaultOTAConfig returns default OTA transfer and airtime settings
+func DefaultOTAConfig() OTAConfig {
+	d := ota.DefaultConfig()
+	return OTAConfig{
+		ChunkSize:        d.ChunkSize,
+		ChunkTimeout:     d.ChunkTimeout,
+		ChunkRetries:     d.MaxRetries,
+		AnnounceInterval: d.AnnounceInterval,
+		WindowSize:       d.WindowSize,
+		MulticastPacing:  d.MulticastPacing,
+		AirtimeBudget:    d.AirtimeBudget,
+		AirtimeWindow:    d.AirtimeWindow,
+		PauseForCommands: true,
+	}
+}
+
+// commandsPending reports whether any command is still awaiting an ack, so
+// OTA chunks wait for it to resolve
+func (e *Engine) commandsPending() bool {
+	count, err := e.db.CountUnresolvedCommands()
+	if err != nil {
+		log.Printf("Failed to count pending commands: %v", err)
+		return false
+	}
+	return count > 0
+}
@@ -0,0 +1,35 @@
+package engine
+
+import (
+	"log"
+
+	"github.com/agsys/property-controller/internal/ota"
+	"github.com/agsys/property-controller/internal/storage"
+)
+
+// saveOTAUpdate records the progress of a device's OTA update
+func (e *Engine) saveOTAUpdate(u ota.DeviceUpdate) {
+	record := &storage.OTAUpdate{
+		DeviceUID:    u.DeviceUID,
+		DeviceType:   u.DeviceType,
+		State:        u.State.String(),
+		ChunksSent:   u.ChunksSent,
+		ChunksAcked:  u.ChunksAcked,
+		TotalChunks:  u.TotalChunks,
+		RetryCount:   u.RetryCount,
+		ErrorCode:    u.ErrorCode,
+		ErrorMessage: u.ErrorMessage,
+		StartedAt:    &u.StartedAt,
+		LastActivity: &u.LastActivity,
+		CompletedAt:  &u.CompletedAt,
+	}
+	if u.CurrentVersion != (ota.Version{}) {
+		record.CurrentVersion = u.CurrentVersion.String()
+	}
+	if u.TargetVersion != (ota.Version{}) {
+		record.TargetVersion = u.TargetVersion.String()
+	}
+	if err := e.db.SaveOTAUpdate(record); err != nil {
+		log.Printf("Failed to save OTA update of %s: %v", u.DeviceUID, err)
+	}
+}
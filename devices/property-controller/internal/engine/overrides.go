@@ -0,0 +1,80 @@
+package engine
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/agsys/property-controller/internal/storage"
+)
+
+// sourceManual marks the valve events of valves operated by hand at the valve
+const sourceManual = "manual"
+
+// overridable reports whether commands from a source give way to a manual
+// override. Commands a person issues, from the cloud, the local API, or
+// Modbus, go through and end the override.
+func overridable(source string) bool {
+	return source == sourceSchedule || source == sourceRule
+}
+
+// startManualOverride records that someone operated a valve by hand and
+// holds off schedules and rules for Config.ManualOverride. A pending timed
+// close of the valve is dropped: whoever is at the valve has taken over.
+func (e *Engine) startManualOverride(controllerUID string, addr, state uint8, now time.Time) {
+	period := e.settings().ManualOverride
+	if period <= 0 {
+		return
+	}
+
+	o := &storage.ValveOverride{
+		ControllerUID: controllerUID,
+		ActuatorAddr:  addr,
+		State:         state,
+		StartedAt:     now,
+		ExpiresAt:     now.Add(period),
+	}
+	if err := e.db.SetValveOverride(o); err != nil {
+		log.Printf("Failed to store manual override of valve %s addr %d: %v", controllerUID, addr, err)
+		return
+	}
+	e.cancelValveTimer(controllerUID, addr)
+	log.Printf("Valve %s addr %d operated by hand (%s), schedules and rules held off until %s",
+		controllerUID, addr, valveStateString(state), o.ExpiresAt.Format(time.DateTime))
+}
+
+// endManualOverride ends a valve's manual override once a person commands it
+func (e *Engine) endManualOverride(controllerUID string, addr uint8) {
+	ended, err := e.db.DeleteValveOverride(controllerUID, addr, time.Now())
+	if err != nil {
+		log.Printf("Failed to end manual override of valve %s addr %d: %v", controllerUID, addr, err)
+		return
+	}
+	if ended {
+		log.Printf("Manual override of valve %s addr %d ended by command", controllerUID, addr)
+	}
+}
+
+// manualOverride returns the manual override in force on a valve, or nil
+func (e *Engine) manualOverride(controllerUID string, addr uint8) *storage.ValveOverride {
+	o, err := e.db.GetValveOverride(controllerUID, addr, time.Now())
+	if err != nil {
+		log.Printf("Failed to get manual override of valve %s addr %d: %v", controllerUID, addr, err)
+		return nil
+	}
+	return o
+}
+
+// overrideError refuses a schedule or rule command to a valve under manual
+// override, or returns nil
+func (e *Engine) overrideError(controllerUID string, addr uint8, source string) error {
+	if !overridable(source) {
+		return nil
+	}
+	o := e.manualOverride(controllerUID, addr)
+	if o == nil {
+		return nil
+	}
+	return fmt.Errorf("valve %s addr %d under manual override until %s",
+		controllerUID, addr, o.ExpiresAt.Local().Format(time.DateTime))
+}
@@ -0,0 +1,151 @@
+package engine
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/agsys/property-controller/internal/protocol"
+	"github.com/agsys/property-controller/internal/storage"
+	controllerv1 "github.com/ccroswhite/agsys-api/gen/go/proto/controller/v1"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// sourcePowerFail marks the valve events of valves closed on a power failure
+const sourcePowerFail = "power_fail"
+
+// PowerFailConfig controls what the controller does when a valve controller
+// loses mains power
+type PowerFailConfig struct {
+	CloseValves bool // Close the controller's open valves, sparing a backup battery a later close
+}
+
+// checkPower records a change in a valve controller's power supply from the
+// flags of its valve status, raising an alert while mains power is out and
+// telling the cloud the controller's valve states
+func (e *Engine) checkPower(controllerUID string, flags uint8, now time.Time) {
+	event := storage.PowerRestored
+	switch {
+	case flags&protocol.ValveFlagOnBattery != 0:
+		event = storage.PowerBattery
+	case flags&protocol.ValveFlagPowerFail != 0:
+		event = storage.PowerFail
+	}
+
+	last, err := e.db.GetLastPowerEvent(controllerUID)
+	if err != nil {
+		log.Printf("Failed to get power state of %s: %v", controllerUID, err)
+		return
+	}
+	// Controllers start out on mains power
+	if (last == nil && event == storage.PowerRestored) || (last != nil && last.Event == event) {
+		return
+	}
+
+	ev := &storage.PowerEvent{ControllerUID: controllerUID, Event: event, Timestamp: now}
+	if event == storage.PowerRestored {
+		log.Printf("Valve controller %s back on mains power", controllerUID)
+		e.clearAlerts(controllerUID, 0, alertPowerFail)
+	} else {
+		onMains := last == nil || last.Event == storage.PowerRestored
+		if onMains && e.settings().PowerFail.CloseValves {
+			ev.ValvesClosed = e.closeControllerValves(controllerUID, now)
+		}
+
+		message := fmt.Sprintf("valve controller %s lost mains power", controllerUID)
+		if event == storage.PowerBattery {
+			message += ", running on its backup battery"
+		}
+		if ev.ValvesClosed > 0 {
+			message += fmt.Sprintf("; closing its %d open valves", ev.ValvesClosed)
+		}
+		e.raiseAlert(&storage.Alert{
+			DeviceUID: controllerUID,
+			AlertType: alertPowerFail,
+			Severity:  storage.AlertCritical,
+			Message:   message,
+			Timestamp: now,
+		})
+	}
+
+	if err := e.db.InsertPowerEvent(ev); err != nil {
+		log.Printf("Failed to store power event of %s: %v", controllerUID, err)
+	}
+	e.reportValveStates(controllerUID)
+}
+
+// closeControllerValves sends a close to each of a controller's valves that
+// is open or opening, recording each as a valve event, and returns the number
+// sent
+func (e *Engine) closeControllerValves(controllerUID string, now time.Time) int {
+	actuators, err := e.db.GetValveActuators()
+	if err != nil {
+		log.Printf("Failed to get valves: %v", err)
+		return 0
+	}
+
+	origin := storage.CommandAudit{Source: sourcePowerFail}
+	closed := 0
+	for _, a := range actuators {
+		if a.ControllerUID != controllerUID ||
+			(a.CurrentState != protocol.ValveStateOpen && a.CurrentState != protocol.ValveStateOpening) {
+			continue
+		}
+		if err := e.sendValveCommand(a.ControllerUID, a.Address, protocol.ValveCmdClose, origin, 0); err != nil {
+			log.Printf("Failed to close valve %s addr %d on power failure: %v", a.ControllerUID, a.Address, err)
+			continue
+		}
+		closed++
+
+		event := &storage.ValveEvent{
+			ControllerUID: a.ControllerUID,
+			ActuatorAddr:  a.Address,
+			PrevState:     a.CurrentState,
+			NewState:      protocol.ValveStateClosing,
+			Source:        sourcePowerFail,
+			Timestamp:     now,
+		}
+		id, err := e.db.InsertValveEvent(event)
+		if err != nil {
+			log.Printf("Failed to store valve event: %v", err)
+			continue
+		}
+		e.bus.Valve.publish(ValveChanged{ID: id, Event: event})
+	}
+	log.Printf("Valve controller %s lost power: closing %d open valves", controllerUID, closed)
+	return closed
+}
+
+// reportValveStates sends the cloud the state of each of a controller's
+// valves at once. The shared protocol has no power message, so this is how
+// the cloud learns of a power change without waiting for the next sync.
+func (e *Engine) reportValveStates(controllerUID string) {
+	if !e.cloud.IsConnected() {
+		return
+	}
+
+	actuators, err := e.db.GetValveActuators()
+	if err != nil {
+		log.Printf("Failed to get valves: %v", err)
+		return
+	}
+	var statuses []*controllerv1.ActuatorStatus
+	for _, a := range actuators {
+		if a.ControllerUID == controllerUID {
+			statuses = append(statuses, &controllerv1.ActuatorStatus{
+				Address:   int32(a.Address),
+				State:     valveStateString(a.CurrentState),
+				ChangedAt: timestamppb.New(a.LastStateChange),
+			})
+		}
+	}
+	if len(statuses) == 0 {
+		return
+	}
+
+	err = e.cloud.SendValveStatus(controllerUID, statuses)
+	e.countSync(err)
+	if err != nil {
+		log.Printf("Failed to report valve states of %s: %v", controllerUID, err)
+	}
+}
@@ -0,0 +1,173 @@
+package engine
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/agsys/property-controller/internal/localapi"
+	"github.com/agsys/property-controller/internal/storage"
+)
+
+// SchedulePreview expands the active schedules over the coming days into
+// the runs each valve is expected to make, applying the controller's rules:
+// an emergency stop or manual override skips runs, as does a zone not yet due
+// for water when schedules follow the drydown model, the weather scales or
+// skips them, and a valve's runtime limit cuts them short. Water use is
+// estimated from each valve's configured flow.
+func (e *Engine) SchedulePreview(days int) (*localapi.SchedulePreview, error) {
+	now := time.Now()
+	return e.schedulePreview(now, now.AddDate(0, 0, days))
+}
+
+func (e *Engine) schedulePreview(from, until time.Time) (*localapi.SchedulePreview, error) {
+	schedules, err := e.db.GetActiveSchedules()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get schedules: %w", err)
+	}
+	actuators, err := e.db.GetValveActuators()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get valves: %w", err)
+	}
+	var recs []localapi.ZoneRecommendation
+	if e.settings().Drydown.SkipAhead > 0 {
+		if recs, err = e.recommendations(from); err != nil {
+			return nil, err
+		}
+	}
+	names := make(map[string]string, len(actuators))
+	zones := make(map[string]*localapi.ZoneRecommendation, len(actuators))
+	for _, a := range actuators {
+		name := a.Alias
+		if name == "" {
+			name = a.Name
+		}
+		key := valveKey(a.ControllerUID, a.Address)
+		names[key] = name
+		for i := range recs {
+			if recs[i].ZoneID == a.ZoneID {
+				zones[key] = &recs[i]
+			}
+		}
+	}
+	overrides, err := e.db.GetValveOverrides(from)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get manual overrides: %w", err)
+	}
+	overridden := make(map[string]time.Time, len(overrides))
+	for _, o := range overrides {
+		overridden[valveKey(o.ControllerUID, o.ActuatorAddr)] = o.ExpiresAt
+	}
+	stopped := e.emergencyStopped()
+
+	preview := &localapi.SchedulePreview{From: from, Until: until, Runs: []localapi.PreviewRun{}, Events: []localapi.PreviewEvent{}}
+	for _, s := range schedules {
+		entries, err := e.db.GetScheduleEntries(s.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get entries for schedule %s: %w", s.UID, err)
+		}
+		for _, entry := range entries {
+			for _, start := range runStarts(entry, from, until) {
+				adj := e.currentWeather(start)
+				for addr := uint8(0); addr < 64; addr++ {
+					if entry.ActuatorMask&(1<<addr) == 0 {
+						continue
+					}
+					key := valveKey(s.ControllerUID, addr)
+					run := localapi.PreviewRun{
+						ScheduleUID:   s.UID,
+						ScheduleName:  s.Name,
+						ControllerUID: s.ControllerUID,
+						Address:       addr,
+						Valve:         names[key],
+						Start:         start,
+						ScheduledMins: int(entry.DurationMins),
+					}
+					e.applyPreviewRules(&run, adj, stopped, overridden[key], zones[key])
+					preview.Runs = append(preview.Runs, run)
+					if run.Skipped {
+						continue
+					}
+					preview.WaterL += run.WaterL
+					end := start.Add(time.Duration(run.DurationMins) * time.Minute)
+					preview.Events = append(preview.Events,
+						localapi.PreviewEvent{Time: start, ControllerUID: s.ControllerUID, Address: addr, Command: "open", ScheduleUID: s.UID},
+						localapi.PreviewEvent{Time: end, ControllerUID: s.ControllerUID, Address: addr, Command: "close", ScheduleUID: s.UID})
+				}
+			}
+		}
+	}
+
+	sort.SliceStable(preview.Runs, func(i, j int) bool { return preview.Runs[i].Start.Before(preview.Runs[j].Start) })
+	sort.SliceStable(preview.Events, func(i, j int) bool { return preview.Events[i].Time.Before(preview.Events[j].Time) })
+	return preview, nil
+}
+
+// applyPreviewRules works out what happens to one valve's run: its duration
+// after the rules, why it changed, and the water it is expected to use. The
+// zone recommendation is nil for valves outside a zone with soil sensors.
+func (e *Engine) applyPreviewRules(run *localapi.PreviewRun, adj weatherAdjustment, stopped bool, overrideUntil time.Time, zone *localapi.ZoneRecommendation) {
+	switch {
+	case stopped:
+		run.Skipped, run.Reason = true, "emergency stop in force"
+		return
+	case overrideUntil.After(run.Start):
+		run.Skipped, run.Reason = true, "manual override until "+overrideUntil.Local().Format("Jan 2 15:04")
+		return
+	case zone != nil && skipForDrydown(e.settings().Drydown, *zone, run.Start):
+		run.Skipped, run.Reason = true, "soil moisture: not due for water until "+zone.WaterBy.Local().Format("Jan 2 15:04")
+		return
+	}
+
+	var reasons []string
+	mins := int(adj.adjustedDuration(uint16(run.ScheduledMins)))
+	if mins == 0 {
+		run.Skipped, run.Reason = true, "weather: "+adj.reason
+		return
+	}
+	if adj.reason != "" {
+		reasons = append(reasons, fmt.Sprintf("weather: %s (%d of %d min)", adj.reason, mins, run.ScheduledMins))
+	}
+	if limit := e.valveMaxOpen(run.ControllerUID, run.Address); limit > 0 && time.Duration(mins)*time.Minute > limit {
+		mins = int(limit / time.Minute)
+		reasons = append(reasons, fmt.Sprintf("cut to runtime limit of %s", limit))
+	}
+
+	run.DurationMins = mins
+	run.Reason = strings.Join(reasons, "; ")
+	run.WaterL = e.valveFlow(run.ControllerUID, run.Address) * float64(mins)
+}
+
+// runStarts returns the local start times of a schedule entry in [from, until)
+func runStarts(entry storage.ScheduleEntry, from, until time.Time) []time.Time {
+	var starts []time.Time
+	day := from.Local()
+	day = time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, time.Local)
+	for ; day.Before(until); day = day.AddDate(0, 0, 1) {
+		if entry.DayMask&(1<<uint(day.Weekday())) == 0 {
+			continue
+		}
+		start := time.Date(day.Year(), day.Month(), day.Day(), int(entry.StartHour), int(entry.StartMinute), 0, 0, time.Local)
+		if !start.Before(from) && start.Before(until) {
+			starts = append(starts, start)
+		}
+	}
+	return starts
+}
+
+// valveFlow returns the expected flow of an actuator in L/min, 0 if unknown
+func (e *Engine) valveFlow(controllerUID string, addr uint8) float64 {
+	cfg := e.settings()
+	for _, l := range cfg.ValveLimits {
+		if l.ControllerUID == controllerUID && l.Address == addr && l.FlowLPM > 0 {
+			return l.FlowLPM
+		}
+	}
+	return cfg.ValveFlow
+}
+
+// valveKey identifies an actuator in maps
+func valveKey(controllerUID string, addr uint8) string {
+	return fmt.Sprintf("%s_%02d", controllerUID, addr)
+}
@@ -0,0 +1,126 @@
+package engine
+
+import (
+	"reflect"
+	"slices"
+	"time"
+
+	"github.com/agsys/property-controller/internal/lora"
+)
+
+// LoRaConfig holds the radio settings of the LoRa driver
+type LoRaConfig struct {
+	Frequency       uint32          // Hz
+	SpreadingFactor uint8           // SF7-SF12, the data rate before ADR adjusts it
+	Bandwidth       uint32          // Hz (125000, 250000, or 500000)
+	CodingRate      uint8           // Denominator of the 4/x coding rate (5-8)
+	TxPower         int8            // dBm, the power before ADR adjusts it
+	SyncWord        uint8           // 0x34 for public networks, 0x12 for private
+	ADR             bool            // Pick SF/TX power per downlink from link history
+	Driver          string          // "sx1301" or "sx1302" drives that concentrator itself (empty uses EventURL, or the SX1301)
+	SPIDevice       string          // SPI device of the concentrator (empty uses /dev/spidev0.0)
+	EventURL        string          // Concentratord event socket (empty uses the concentrator directly)
+	CommandURL      string          // Concentratord command socket
+	Gateways        []GatewayConfig // Further Concentratord gateways on the same network
+	CaptureFile     string          // Append every frame to this file for replay (empty disables)
+	DownlinkTTL     time.Duration   // How long a downlink waits for a device's next uplink (0 keeps it)
+	TxJitter        time.Duration   // Longest random delay before each downlink (0 disables)
+	MaxDwell        time.Duration   // Longest a frame may be on the air, where the region limits it (0 disables)
+	LBT             lora.LBTConfig  // Listen-before-talk, on radios that can sense the channel
+	LBTDevice       string          // SPI device of the SX1302 board's SX1261 (empty uses /dev/spidev0.1)
+	DeviceKeys      bool            // Seal unicast frames under keys derived from each device's UID
+	LegacyDevices   bool            // With DeviceKeys, still serve devices on the network key
+}
+
+// GatewayConfig holds the sockets of one Concentratord gateway
+type GatewayConfig struct {
+	EventURL   string
+	CommandURL string
+}
+
+// equal reports whether two LoRa configurations are the same
+func (c LoRaConfig) equal(o LoRaConfig) bool {
+	if !slices.Equal(c.Gateways, o.Gateways) {
+		return false
+	}
+	a, b := c, o
+	a.Gateways, b.Gateways = nil, nil
+	return reflect.DeepEqual(a, b)
+}
+
+// gateways returns every Concentratord gateway configured, EventURL first
+func (c LoRaConfig) gateways() []GatewayConfig {
+	var gws []GatewayConfig
+	if c.EventURL != "" {
+		gws = append(gws, GatewayConfig{EventURL: c.EventURL, CommandURL: c.CommandURL})
+	}
+	return append(gws, c.Gateways...)
+}
+
+// DefaultLoRaConfig returns the default LoRa radio settings, on the
+// concentrator directly
+func DefaultLoRaConfig() LoRaConfig {
+	d := lora.DefaultConfig()
+	return LoRaConfig{
+		Frequency:       d.Frequency,
+		SpreadingFactor: d.SpreadingFactor,
+		Bandwidth:       d.Bandwidth,
+		CodingRate:      d.CodingRate,
+		TxPower:         d.TxPower,
+		SyncWord:        d.SyncWord,
+		DownlinkTTL:     d.DownlinkTTL,
+		LBT:             d.LBT,
+	}
+}
+
+// loraConfig returns the LoRa driver settings of an engine configuration
+func loraConfig(config Config) lora.Config {
+	c := lora.DefaultConfig()
+	c.Frequency = config.LoRa.Frequency
+	c.SpreadingFactor = config.LoRa.SpreadingFactor
+	c.Bandwidth = config.LoRa.Bandwidth
+	c.CodingRate = config.LoRa.CodingRate
+	c.TxPower = config.LoRa.TxPower
+	c.SyncWord = config.LoRa.SyncWord
+	c.AESKey = config.AESKey
+	c.DeviceKeys = config.LoRa.DeviceKeys
+	c.LegacyDevices = config.LoRa.LegacyDevices
+	c.ADR.Enabled = config.LoRa.ADR
+	c.CaptureFile = config.LoRa.CaptureFile
+	c.DownlinkTTL = config.LoRa.DownlinkTTL
+	c.TxJitter = config.LoRa.TxJitter
+	c.MaxDwell = config.LoRa.MaxDwell
+	c.LBT = config.LoRa.LBT
+	c.Radio = config.Radio
+	if c.Radio != nil {
+		return c
+	}
+
+	gws := config.LoRa.gateways()
+	switch {
+	case config.LoRa.Driver == "sx1302":
+		board := lora.DefaultSX1302Config()
+		if config.LoRa.SPIDevice != "" {
+			board.SPIDevice = config.LoRa.SPIDevice
+		}
+		if config.LoRa.LBTDevice != "" {
+			board.SX1261Device = config.LoRa.LBTDevice
+		}
+		c.Radio = lora.NewSX1302Radio(board, c)
+	case config.LoRa.Driver == "sx1301" || len(gws) == 0:
+		board := lora.DefaultSX1301Config()
+		if config.LoRa.SPIDevice != "" {
+			board.SPIDevice = config.LoRa.SPIDevice
+		}
+		c.Radio = lora.NewSX1301Radio(board, c)
+	case len(gws) == 1:
+		c.Radio = lora.NewConcentratordRadio(gws[0].EventURL, gws[0].CommandURL, c)
+	default:
+		radios := make([]lora.Radio, len(gws))
+		for i, g := range gws {
+			radios[i] = lora.NewConcentratordRadio(g.EventURL, g.CommandURL, c)
+		}
+		c.Radio = lora.NewMultiRadio(radios...)
+	}
+	return c
+}
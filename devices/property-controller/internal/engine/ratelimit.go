@@ -0,0 +1,120 @@
+package engine
+
+import (
+	"log"
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// Per-device buckets kept before full ones are pruned, so a flood of made-up
+// UIDs can't grow the map without bound
+const maxIngestBuckets = 1024
+
+// IngestLimitConfig caps how many uplinks are processed a minute, so a
+// malfunctioning device spamming reports can't swamp the database and cloud
+// sync. Uplinks over a limit are dropped before anything is stored.
+type IngestLimitConfig struct {
+	PerDevice int // Uplinks a minute from one device UID (0 disables)
+	Global    int // Uplinks a minute from all devices together (0 disables)
+}
+
+// DefaultIngestLimitConfig returns default ingest limits: far above what a
+// device reporting every few minutes sends, and about what one concentrator
+// can receive
+func DefaultIngestLimitConfig() IngestLimitConfig {
+	return IngestLimitConfig{
+		PerDevice: 30,
+		Global:    600,
+	}
+}
+
+// ingestBucket is a token bucket refilled at the limit a minute, holding up
+// to a minute's worth, and the uplinks dropped since it last let one through
+type ingestBucket struct {
+	tokens  float64
+	last    time.Time
+	dropped int
+}
+
+// take refills the bucket and takes a token, reporting whether there was one
+func (b *ingestBucket) take(perMinute int, now time.Time) bool {
+	b.refill(perMinute, now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (b *ingestBucket) refill(perMinute int, now time.Time) {
+	limit := float64(perMinute)
+	if b.last.IsZero() {
+		b.tokens = limit
+	} else if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(limit, b.tokens+elapsed.Minutes()*limit)
+	}
+	b.last = now
+}
+
+// allowUplink reports whether an uplink from a device is within the ingest
+// limits, taking its share of them. Throttling is logged when it starts and,
+// with the number of uplinks dropped, when it ends.
+func (e *Engine) allowUplink(deviceUID string, now time.Time) bool {
+	cfg := e.settings().IngestLimit
+	if cfg.PerDevice <= 0 && cfg.Global <= 0 {
+		return true
+	}
+
+	e.ingestMu.Lock()
+	defer e.ingestMu.Unlock()
+
+	var device *ingestBucket
+	if cfg.PerDevice > 0 {
+		device = e.ingest[deviceUID]
+		if device == nil {
+			if len(e.ingest) >= maxIngestBuckets {
+				e.pruneIngestBuckets(cfg.PerDevice, now)
+			}
+			device = &ingestBucket{}
+			e.ingest[deviceUID] = device
+		}
+		if !device.take(cfg.PerDevice, now) {
+			if device.dropped++; device.dropped == 1 {
+				log.Printf("Throttling %s: over %d uplinks a minute", deviceUID, cfg.PerDevice)
+			}
+			atomic.AddUint64(&e.throttled, 1)
+			e.count(counterThrottled)
+			return false
+		}
+	}
+	if cfg.Global > 0 && !e.ingestAll.take(cfg.Global, now) {
+		if e.ingestAll.dropped++; e.ingestAll.dropped == 1 {
+			log.Printf("Throttling all devices: over %d uplinks a minute", cfg.Global)
+		}
+		atomic.AddUint64(&e.throttled, 1)
+		e.count(counterThrottled)
+		return false
+	}
+
+	if device != nil && device.dropped > 0 {
+		log.Printf("Stopped throttling %s: %d uplinks dropped", deviceUID, device.dropped)
+		device.dropped = 0
+	}
+	if cfg.Global > 0 && e.ingestAll.dropped > 0 {
+		log.Printf("Stopped throttling all devices: %d uplinks dropped", e.ingestAll.dropped)
+		e.ingestAll.dropped = 0
+	}
+	return true
+}
+
+// pruneIngestBuckets forgets devices whose bucket has refilled, which a new
+// bucket would start as anyway
+func (e *Engine) pruneIngestBuckets(perMinute int, now time.Time) {
+	for uid, b := range e.ingest {
+		b.refill(perMinute, now)
+		if b.tokens >= float64(perMinute) && b.dropped == 0 {
+			delete(e.ingest, uid)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package engine
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/agsys/property-controller/internal/ota"
+	"github.com/agsys/property-controller/internal/protocol"
+	"github.com/agsys/property-controller/internal/storage"
+)
+
+// rebootSlack is how far a device's boot time may appear to move between
+// heartbeats, from clock drift and delivery delays, before it counts as a
+// reboot
+const rebootSlack = 2 * time.Minute
+
+// rebootReportWindow is how far back status reports unexpected reboots
+const rebootReportWindow = 24 * time.Hour
+
+// RebootConfig sets when devices rebooting unexpectedly raise an alert.
+// Reboots into new firmware are expected; anything else, e.g. a brown-out or
+// a watchdog reset, is not.
+type RebootConfig struct {
+	LoopCount  int           // Alert when a device reboots unexpectedly this often within LoopWindow (0 disables)
+	LoopWindow time.Duration // Window LoopCount is counted over
+}
+
+// DefaultRebootConfig returns default reboot alert settings
+func DefaultRebootConfig() RebootConfig {
+	return RebootConfig{
+		LoopCount:  3,
+		LoopWindow: 24 * time.Hour,
+	}
+}
+
+// handleHeartbeat tracks the uptime and firmware a device reports in its
+// heartbeat. Heartbeats of older firmware carry no payload and are only
+// logged.
+func (e *Engine) handleHeartbeat(deviceUID string, msg *protocol.LoRaMessage) {
+	log.Printf("Heartbeat from %s, RSSI: %d", deviceUID, msg.RSSI)
+	if len(msg.Payload) == 0 {
+		return
+	}
+
+	hb, err := protocol.DecodeHeartbeat(msg.Payload)
+	if err != nil {
+		log.Printf("Failed to decode heartbeat from %s: %v", deviceUID, err)
+		e.count(counterDecodeFailures)
+		return
+	}
+	now := time.Now()
+	e.trackUptime(deviceUID, hb, now)
+	if hb.HasVersion() {
+		hwRev := hb.HWRev
+		e.recordFirmware(deviceUID, msg.Header.DeviceType,
+			ota.Version{Major: hb.FWVersion[0], Minor: hb.FWVersion[1], Patch: hb.FWVersion[2]}, &hwRev, firmwareFromHeartbeat, now)
+	}
+}
+
+// trackUptime records a device's uptime, recording a reboot when it has
+// started over since the last heartbeat, and checks for a reboot loop
+func (e *Engine) trackUptime(deviceUID string, hb *protocol.HeartbeatPayload, now time.Time) {
+	prev, err := e.db.GetDeviceUptime(deviceUID)
+	if err != nil {
+		log.Printf("Failed to get uptime of %s: %v", deviceUID, err)
+		return
+	}
+	uptime := hb.Uptime()
+	if err := e.db.UpdateDeviceUptime(&storage.DeviceUptime{DeviceUID: deviceUID, Uptime: uptime, ReportedAt: now}); err != nil {
+		log.Printf("Failed to record uptime of %s: %v", deviceUID, err)
+	}
+	if prev == nil {
+		return
+	}
+
+	// A reboot moves the boot time the uptime implies later. Checking that,
+	// not only for the uptime going down, catches reboots between heartbeats
+	// long apart.
+	elapsed := now.Sub(prev.ReportedAt)
+	shift := now.Add(-uptime).Sub(prev.ReportedAt.Add(-prev.Uptime))
+	if uptime >= prev.Uptime && shift <= max(rebootSlack, elapsed/1000) {
+		e.checkRebootLoop(deviceUID, now)
+		return
+	}
+
+	reboot := &storage.DeviceReboot{
+		DeviceUID:  deviceUID,
+		BootReason: hb.BootReason,
+		PrevUptime: prev.Uptime,
+		Unexpected: hb.BootReason != protocol.BootReasonOTASuccess && hb.BootReason != protocol.BootReasonOTARollback,
+		Timestamp:  now,
+	}
+	log.Printf("Device %s rebooted (%s) after %s up", deviceUID, protocol.BootReasonString(hb.BootReason), prev.Uptime)
+	if err := e.db.InsertDeviceReboot(reboot); err != nil {
+		log.Printf("Failed to store reboot of %s: %v", deviceUID, err)
+		return
+	}
+	e.checkRebootLoop(deviceUID, now)
+}
+
+// checkRebootLoop raises an alert while a device has rebooted unexpectedly
+// too often within the window, and clears it once it settles
+func (e *Engine) checkRebootLoop(deviceUID string, now time.Time) {
+	cfg := e.settings().Reboots
+	if cfg.LoopCount <= 0 {
+		return
+	}
+
+	n, err := e.db.CountUnexpectedReboots(deviceUID, now.Add(-cfg.LoopWindow))
+	if err != nil {
+		log.Printf("Failed to count reboots of %s: %v", deviceUID, err)
+		return
+	}
+	if n < cfg.LoopCount {
+		e.clearAlerts(deviceUID, 0, alertRebootLoop)
+		return
+	}
+	e.raiseAlert(&storage.Alert{
+		DeviceUID: deviceUID,
+		AlertType: alertRebootLoop,
+		Severity:  storage.AlertWarning,
+		Message: fmt.Sprintf("device %s rebooted unexpectedly %d times in %s; check its power supply or firmware",
+			deviceUID, n, cfg.LoopWindow),
+		Value:     float64(n),
+		Threshold: float64(cfg.LoopCount),
+		Timestamp: now,
+	})
+}
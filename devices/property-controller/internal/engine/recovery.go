@@ -0,0 +1,102 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/agsys/property-controller/internal/storage"
+)
+
+// alertDatabaseRecovered is raised when a corrupt database was replaced at
+// startup
+const alertDatabaseRecovered = "database_recovered"
+
+// openDatabase opens the database and quick-checks it if it is SQLite (a
+// PostgreSQL server looks after its own storage). A database that is
+// damaged is moved aside and replaced by the newest backup in the backup
+// directory that passes an integrity check, or by an empty database if there
+// is none, so the controller keeps running. Other failures, such as a
+// missing directory, are returned. The second result describes the recovery
+// for the alert raised once the engine starts, and is empty if the database
+// was sound.
+func openDatabase(config Config) (*storage.DB, string, error) {
+	db, err := storage.OpenConfig(databaseConfig(config))
+	if err != nil {
+		if !storage.IsCorrupt(err) {
+			return nil, "", err
+		}
+		return recoverDatabase(config, err)
+	}
+	if db.Driver() != storage.DriverSQLite {
+		return db, "", nil
+	}
+
+	problems, err := db.QuickCheck()
+	if err == nil && len(problems) == 0 {
+		return db, "", nil
+	}
+	db.Close()
+	if err != nil && !storage.IsCorrupt(err) {
+		return nil, "", fmt.Errorf("failed to check database: %w", err)
+	}
+	if err == nil {
+		err = errors.New(strings.Join(problems, "; "))
+	}
+	return recoverDatabase(config, err)
+}
+
+// recoverDatabase moves a damaged database aside and restores the newest
+// usable backup in its place
+func recoverDatabase(config Config, damage error) (*storage.DB, string, error) {
+	path := config.DatabasePath
+	log.Printf("ALERT: database %s is damaged: %v", path, damage)
+
+	aside := path + ".corrupt-" + time.Now().Format(backupTimeFormat)
+	if err := os.Rename(path, aside); err != nil {
+		return nil, "", fmt.Errorf("database %s is damaged (%v) and could not be moved aside: %w", path, damage, err)
+	}
+	// The WAL belongs to the damaged file and must not be replayed into
+	// the replacement
+	for _, suffix := range []string{"-wal", "-shm"} {
+		if err := os.Rename(path+suffix, aside+suffix); err != nil && !os.IsNotExist(err) {
+			return nil, "", fmt.Errorf("failed to move %s aside: %w", path+suffix, err)
+		}
+	}
+	message := fmt.Sprintf("database was damaged (%v) and moved to %s", damage, aside)
+
+	restored := ""
+	if dir := config.Maintenance.BackupDir; dir != "" {
+		backups, err := listBackups(dir, path)
+		if err != nil {
+			log.Printf("Failed to list backups in %s: %v", dir, err)
+		}
+		for _, backup := range slices.Backward(backups) {
+			if err := storage.Restore(context.Background(), backup, path); err != nil {
+				log.Printf("Cannot restore from %s: %v", backup, err)
+				os.Remove(path)
+				continue
+			}
+			restored = backup
+			break
+		}
+	}
+	if restored != "" {
+		message += "; restored from backup " + filepath.Base(restored)
+	} else {
+		message += "; no usable backup, started with an empty database"
+	}
+
+	db, err := storage.Open(path)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to open recovered database: %w", err)
+	}
+	log.Printf("ALERT: %s", message)
+	return db, message, nil
+}
@@ -0,0 +1,143 @@
+package engine
+
+import (
+	"bytes"
+	"log"
+	"slices"
+)
+
+// settings returns a copy of the current configuration
+func (e *Engine) settings() Config {
+	e.configMu.RLock()
+	defer e.configMu.RUnlock()
+	return e.config
+}
+
+// reloadNotify returns a channel that is closed on the next reload
+func (e *Engine) reloadNotify() <-chan struct{} {
+	e.configMu.RLock()
+	defer e.configMu.RUnlock()
+	return e.reloaded
+}
+
+// Reload applies a new configuration to the running engine. Sync intervals,
+// low-bandwidth mode, command timeouts and retries, valve limits and flows,
+// database maintenance, key rotation, device logs, ingest limits, weather
+// thresholds, fertigation, the drydown model, reading validation, spoofing
+// detection, report intervals, alert thresholds, notifications, and cloud
+// connection settings take effect immediately. The LoRa radio, database, and pending
+// commands are left untouched; settings that need them rebuilt are logged and
+// ignored until the next restart.
+func (e *Engine) Reload(config Config) {
+	e.configMu.Lock()
+	old := e.config
+
+	for _, name := range restartRequired(old, config) {
+		log.Printf("Config reload: %s changed, restart required to apply", name)
+	}
+
+	e.config.SyncInterval = config.SyncInterval
+	e.config.Sync = config.Sync
+	e.config.TimeSyncInterval = config.TimeSyncInterval
+	e.config.LowBandwidth = config.LowBandwidth
+	e.config.CommandTimeout = config.CommandTimeout
+	e.config.CommandRetries = config.CommandRetries
+	e.config.CommandRetention = config.CommandRetention
+	e.config.DebugTimeout = config.DebugTimeout
+	e.config.ValveMaxOpen = config.ValveMaxOpen
+	e.config.ValveLimits = slices.Clone(config.ValveLimits)
+	e.config.ManualOverride = config.ManualOverride
+	e.config.ValveFlow = config.ValveFlow
+	e.config.Maintenance = config.Maintenance
+	e.config.KeyRotation = config.KeyRotation
+	e.config.LinkHistory = config.LinkHistory
+	e.config.DeviceLogs = config.DeviceLogs
+	e.config.DuplicateWindow = config.DuplicateWindow
+	e.config.IngestLimit = config.IngestLimit
+	e.config.Clock = config.Clock
+	e.config.Weather = config.Weather
+	e.config.Weather.OpenWeather = old.Weather.OpenWeather
+	e.config.Fertigation = config.Fertigation
+	e.config.Fertigation.Injectors = slices.Clone(config.Fertigation.Injectors)
+	e.config.MoistureAlerts = config.MoistureAlerts
+	e.config.MoistureAlerts.Zones = slices.Clone(config.MoistureAlerts.Zones)
+	e.config.Drydown = config.Drydown
+	e.config.Validation = config.Validation
+	e.config.Spoofing = config.Spoofing
+	e.config.ReportInterval = config.ReportInterval
+	e.config.ScheduleAck = config.ScheduleAck
+	e.config.MeterPin = config.MeterPin
+	e.config.MeterCalibration = config.MeterCalibration
+	e.config.Acks = config.Acks
+	e.config.ActuatorHealth = config.ActuatorHealth
+	e.config.PowerFail = config.PowerFail
+	e.config.Reboots = config.Reboots
+	e.config.Inventory = config.Inventory
+	e.config.Alerts = config.Alerts
+	e.config.Notify = config.Notify
+	e.config.GRPCAddr = config.GRPCAddr
+	e.config.GRPCFallbacks = slices.Clone(config.GRPCFallbacks)
+	e.config.APIKey = config.APIKey
+	e.config.UseTLS = config.UseTLS
+
+	close(e.reloaded)
+	e.reloaded = make(chan struct{})
+	e.configMu.Unlock()
+
+	e.cloud.UpdateConnection(config.GRPCAddr, config.GRPCFallbacks, config.APIKey, config.UseTLS)
+	e.firmware.UpdateConnection(e.cloud.Endpoint(), config.APIKey, config.UseTLS)
+	e.notifier.SetConfig(config.Notify)
+
+	log.Printf("Config reloaded: sync every %s, time sync every %s, command timeout %s, %d retries",
+		config.SyncInterval, config.TimeSyncInterval, config.CommandTimeout, config.CommandRetries)
+}
+
+// restartRequired lists settings that differ but cannot be changed at runtime
+func restartRequired(old, config Config) []string {
+	var changed []string
+	if databaseConfig(old) != databaseConfig(config) {
+		changed = append(changed, "database")
+	}
+	if !bytes.Equal(old.DatabaseKey, config.DatabaseKey) {
+		changed = append(changed, "database key")
+	}
+	if old.ControllerID != config.ControllerID {
+		changed = append(changed, "controller ID")
+	}
+	if !old.LoRa.equal(config.LoRa) || !bytes.Equal(old.AESKey, config.AESKey) {
+		changed = append(changed, "LoRa settings")
+	}
+	if old.LocalAPISocket != config.LocalAPISocket {
+		changed = append(changed, "local API socket")
+	}
+	if old.LocalAPIListen != config.LocalAPIListen || old.LocalAPITLSCert != config.LocalAPITLSCert || old.LocalAPITLSKey != config.LocalAPITLSKey {
+		changed = append(changed, "local API listener")
+	}
+	if old.CloudProxy != config.CloudProxy || old.CloudCompression != config.CloudCompression {
+		changed = append(changed, "cloud proxy or compression")
+	}
+	if old.CloudFailover != config.CloudFailover || old.CloudFailback != config.CloudFailback {
+		changed = append(changed, "cloud failover timing")
+	}
+	if old.FirmwareVersion != config.FirmwareVersion {
+		changed = append(changed, "firmware version")
+	}
+	if old.OTA != config.OTA || old.FirmwareCacheDir != config.FirmwareCacheDir {
+		changed = append(changed, "OTA settings")
+	}
+	if old.FlowAnalytics != config.FlowAnalytics {
+		changed = append(changed, "flow analytics")
+	}
+	if old.Weather.OpenWeather != config.Weather.OpenWeather {
+		changed = append(changed, "weather provider")
+	}
+	return changed
+}
+
+// SetReloadHandler sets the function the local API calls to reload the
+// configuration file
+func (e *Engine) SetReloadHandler(fn func() error) {
+	if e.api != nil {
+		e.api.SetReloadHandler(fn)
+	}
+}
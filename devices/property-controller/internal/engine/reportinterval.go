@@ -0,0 +1,176 @@
+package engine
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/agsys/property-controller/internal/lora"
+	"github.com/agsys/property-controller/internal/protocol"
+	"github.com/agsys/property-controller/internal/storage"
+)
+
+// ReportIntervalConfig controls the report intervals pushed to soil sensors
+// and water meters
+type ReportIntervalConfig struct {
+	LowBattery   time.Duration // Shortest interval while a device's battery is low (0 disables)
+	LowBatteryMV uint16        // Battery level treated as low, besides the soil sensors' flag (0 uses the flag only)
+	Timeout      time.Duration // Wait for an ack before resending on the device's next report
+	Retries      int           // Resends before the interval is marked failed
+}
+
+// DefaultReportIntervalConfig returns default report interval settings
+func DefaultReportIntervalConfig() ReportIntervalConfig {
+	return ReportIntervalConfig{
+		LowBattery: time.Hour,
+		Timeout:    10 * time.Minute,
+		Retries:    3,
+	}
+}
+
+// SetReportInterval sets the interval a device should report at, as
+// configured in the cloud. Zero returns the device to its default. A device
+// with a low battery keeps reporting no faster than the low battery interval.
+func (e *Engine) SetReportInterval(deviceUID string, interval time.Duration) error {
+	if _, err := lora.ParseDeviceUID(deviceUID); err != nil {
+		return fmt.Errorf("invalid device UID: %w", err)
+	}
+	if interval < 0 || interval.Seconds() > math.MaxUint16 {
+		return fmt.Errorf("report interval %s out of range", interval)
+	}
+
+	c := e.deviceConfig(deviceUID)
+	c.CloudIntervalSec = uint16(interval / time.Second)
+	e.pushReportInterval(c)
+	return nil
+}
+
+// checkReportInterval adjusts a device's report interval to its battery state
+// on each report, and resends an interval the device hasn't acked
+func (e *Engine) checkReportInterval(deviceUID string, lowFlag bool, batteryMV uint16) {
+	cfg := e.settings().ReportInterval
+	low := lowFlag || (cfg.LowBatteryMV > 0 && batteryMV > 0 && batteryMV < cfg.LowBatteryMV)
+
+	c, err := e.db.GetDeviceConfig(deviceUID)
+	if err != nil {
+		log.Printf("Failed to load config of %s: %v", deviceUID, err)
+		return
+	}
+	// Devices never configured and on a healthy battery are left alone
+	if c == nil && !low {
+		return
+	}
+	if c == nil {
+		c = &storage.DeviceConfig{DeviceUID: deviceUID}
+	}
+
+	if c.LowBattery != low {
+		c.LowBattery = low
+		e.pushReportInterval(c)
+		return
+	}
+
+	if c.State != storage.DeviceConfigPending || c.SentAt == nil || time.Since(*c.SentAt) < cfg.Timeout {
+		return
+	}
+	if c.Attempts > cfg.Retries {
+		log.Printf("ALERT: report interval for %s failed, no ack after %d attempts", deviceUID, c.Attempts)
+		c.State = storage.DeviceConfigFailed
+	} else {
+		log.Printf("Resending report interval %ds to %s (attempt %d/%d)", c.ReportIntervalSec, deviceUID, c.Attempts+1, cfg.Retries+1)
+		e.sendReportInterval(c)
+	}
+	e.saveDeviceConfig(c)
+}
+
+// pushReportInterval sends a device the interval its cloud config and battery
+// call for, unless it already has it or is being sent it
+func (e *Engine) pushReportInterval(c *storage.DeviceConfig) {
+	interval := c.CloudIntervalSec
+	if low := e.settings().ReportInterval.LowBattery; c.LowBattery && low > 0 {
+		interval = max(interval, uint16(min(low.Seconds(), math.MaxUint16)))
+	}
+
+	current := c.State == storage.DeviceConfigPending || c.State == storage.DeviceConfigApplied
+	if !current || interval != c.ReportIntervalSec {
+		c.ReportIntervalSec = interval
+		c.ConfigVersion = e.nextConfigVersion(c.DeviceUID, c.ConfigVersion)
+		c.Attempts = 0
+		c.State = storage.DeviceConfigPending
+		log.Printf("Setting report interval of %s to %ds (low battery %t)", c.DeviceUID, interval, c.LowBattery)
+		e.sendReportInterval(c)
+	}
+	e.saveDeviceConfig(c)
+}
+
+// sendReportInterval sends a device its report interval as a config update
+func (e *Engine) sendReportInterval(c *storage.DeviceConfig) {
+	now := time.Now()
+	c.Attempts++
+	c.SentAt = &now
+
+	uid, err := lora.ParseDeviceUID(c.DeviceUID)
+	if err != nil {
+		return
+	}
+	payload := &protocol.ReportIntervalPayload{ConfigVersion: c.ConfigVersion, ReportIntervalSec: c.ReportIntervalSec}
+	if err := e.lora.SendToDevice(uid, protocol.MsgTypeConfigUpdate, payload.Encode()); err != nil {
+		log.Printf("Failed to send report interval to %s: %v", c.DeviceUID, err)
+	}
+}
+
+// handleConfigAck records a device's confirmation of its report interval, or
+// of its meter config
+func (e *Engine) handleConfigAck(deviceUID string, msg *protocol.LoRaMessage) {
+	ack, err := protocol.DecodeConfigAck(msg.Payload)
+	if err != nil {
+		log.Printf("Failed to decode config ack from %s: %v", deviceUID, err)
+		e.count(counterDecodeFailures)
+		return
+	}
+
+	c, err := e.db.GetDeviceConfig(deviceUID)
+	if err != nil {
+		log.Printf("Failed to load config of %s: %v", deviceUID, err)
+		return
+	}
+	// Acks of superseded versions change nothing
+	if c == nil || ack.ConfigVersion != c.ConfigVersion {
+		if !e.handleMeterConfigAck(deviceUID, ack) {
+			log.Printf("Config ack v%d from %s does not match a pending config", ack.ConfigVersion, deviceUID)
+		}
+		return
+	}
+
+	if ack.Status != 0 {
+		log.Printf("Device %s rejected report interval %ds (status %d)", deviceUID, c.ReportIntervalSec, ack.Status)
+		c.State = storage.DeviceConfigFailed
+	} else {
+		now := time.Now()
+		log.Printf("Device %s reporting every %ds", deviceUID, ack.ReportIntervalSec)
+		c.State = storage.DeviceConfigApplied
+		c.AppliedIntervalSec = ack.ReportIntervalSec
+		c.AppliedAt = &now
+	}
+	e.saveDeviceConfig(c)
+}
+
+// deviceConfig loads a device's managed report interval, or starts one
+func (e *Engine) deviceConfig(deviceUID string) *storage.DeviceConfig {
+	c, err := e.db.GetDeviceConfig(deviceUID)
+	if err != nil {
+		log.Printf("Failed to load config of %s: %v", deviceUID, err)
+	}
+	if c == nil {
+		c = &storage.DeviceConfig{DeviceUID: deviceUID}
+	}
+	return c
+}
+
+// saveDeviceConfig stores a device's managed report interval
+func (e *Engine) saveDeviceConfig(c *storage.DeviceConfig) {
+	if err := e.db.SaveDeviceConfig(c); err != nil {
+		log.Printf("Failed to save config of %s: %v", c.DeviceUID, err)
+	}
+}
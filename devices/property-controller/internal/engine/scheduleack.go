@@ -0,0 +1,132 @@
+package engine
+
+import (
+	"log"
+	"time"
+
+	"github.com/agsys/property-controller/internal/protocol"
+	"github.com/agsys/property-controller/internal/storage"
+)
+
+// ScheduleAckConfig controls how schedules pushed to valve controllers are
+// confirmed
+type ScheduleAckConfig struct {
+	Timeout time.Duration // Wait for an ack before resending
+	Retries int           // Resends before the schedule is marked failed
+}
+
+// DefaultScheduleAckConfig returns default schedule ack settings
+func DefaultScheduleAckConfig() ScheduleAckConfig {
+	return ScheduleAckConfig{
+		Timeout: 2 * time.Minute,
+		Retries: 3,
+	}
+}
+
+// scheduleSent records a schedule push awaiting the controller's ack. Pushes
+// of a version already awaiting its ack count as resends of it.
+func (e *Engine) scheduleSent(controllerUID string, version uint16) {
+	d, err := e.db.GetScheduleDelivery(controllerUID)
+	if err != nil {
+		log.Printf("Failed to load schedule delivery of %s: %v", controllerUID, err)
+	}
+	if d == nil {
+		d = &storage.ScheduleDelivery{ControllerUID: controllerUID}
+	}
+	if d.State != storage.DeviceConfigPending || d.Version != version {
+		d.Attempts = 0
+	}
+
+	now := time.Now()
+	d.Version = version
+	d.State = storage.DeviceConfigPending
+	d.Attempts++
+	d.SentAt = &now
+	e.saveScheduleDelivery(d)
+}
+
+// retryUnackedSchedules resends schedules whose ack is overdue
+func (e *Engine) retryUnackedSchedules() {
+	deliveries, err := e.db.GetPendingScheduleDeliveries(time.Now().Add(-e.settings().ScheduleAck.Timeout))
+	if err != nil {
+		log.Printf("Failed to get unacked schedules: %v", err)
+		return
+	}
+	for _, d := range deliveries {
+		e.resendSchedule(d)
+	}
+}
+
+// resendSchedule pushes a controller its schedule again, or marks the
+// schedule failed once out of retries
+func (e *Engine) resendSchedule(d *storage.ScheduleDelivery) {
+	retries := e.settings().ScheduleAck.Retries
+	if d.Attempts > retries {
+		log.Printf("ALERT: schedule v%d for %s failed, no ack after %d attempts", d.Version, d.ControllerUID, d.Attempts)
+		d.State = storage.DeviceConfigFailed
+		e.saveScheduleDelivery(d)
+		return
+	}
+
+	log.Printf("Resending schedule v%d to %s (attempt %d/%d)", d.Version, d.ControllerUID, d.Attempts+1, retries+1)
+	if !e.sendSchedule(d.ControllerUID) {
+		// The schedule was removed while awaiting its ack
+		d.State = storage.DeviceConfigFailed
+		e.saveScheduleDelivery(d)
+	}
+}
+
+// handleScheduleAck records the schedule version a valve controller has
+// stored, and pushes the active schedule again if the controller is behind
+func (e *Engine) handleScheduleAck(deviceUID string, msg *protocol.LoRaMessage) {
+	ack, err := protocol.DecodeScheduleAck(msg.Payload)
+	if err != nil {
+		log.Printf("Failed to decode schedule ack from %s: %v", deviceUID, err)
+		e.count(counterDecodeFailures)
+		return
+	}
+
+	d, err := e.db.GetScheduleDelivery(deviceUID)
+	if err != nil {
+		log.Printf("Failed to load schedule delivery of %s: %v", deviceUID, err)
+		return
+	}
+	if d == nil {
+		log.Printf("Schedule ack v%d from %s, but no schedule was sent", ack.Version, deviceUID)
+		return
+	}
+
+	if ack.Status != 0 {
+		log.Printf("Controller %s rejected schedule v%d (status %d)", deviceUID, ack.Version, ack.Status)
+		d.State = storage.DeviceConfigFailed
+		e.saveScheduleDelivery(d)
+		return
+	}
+
+	now := time.Now()
+	d.AckedVersion = &ack.Version
+	d.AckedAt = &now
+
+	schedule, _, err := e.db.GetScheduleForController(deviceUID)
+	if err == nil && ack.Version != schedule.Version {
+		log.Printf("Controller %s stored schedule v%d, but v%d is active", deviceUID, ack.Version, schedule.Version)
+		e.saveScheduleDelivery(d)
+		if d.State == storage.DeviceConfigPending {
+			e.resendSchedule(d)
+		} else {
+			e.sendSchedule(deviceUID)
+		}
+		return
+	}
+
+	log.Printf("Controller %s stored schedule v%d with %d entries", deviceUID, ack.Version, ack.EntryCount)
+	d.State = storage.DeviceConfigApplied
+	e.saveScheduleDelivery(d)
+}
+
+// saveScheduleDelivery stores the schedule last pushed to a controller
+func (e *Engine) saveScheduleDelivery(d *storage.ScheduleDelivery) {
+	if err := e.db.SaveScheduleDelivery(d); err != nil {
+		log.Printf("Failed to save schedule delivery of %s: %v", d.ControllerUID, err)
+	}
+}
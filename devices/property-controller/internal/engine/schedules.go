@@ -0,0 +1,201 @@
+package engine
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/agsys/property-controller/internal/cloud"
+	"github.com/agsys/property-controller/internal/storage"
+	controllerv1 "github.com/ccroswhite/agsys-api/gen/go/proto/controller/v1"
+)
+
+// cloudSchedule is a schedule from the cloud in the form both the JSON and
+// gRPC updates reduce to
+type cloudSchedule struct {
+	id      string
+	name    string
+	enabled bool
+	runs    []scheduleRun
+}
+
+// scheduleRun is one set of days and start times of a schedule and the
+// valves it runs
+type scheduleRun struct {
+	days         []string
+	startTimes   []string
+	durationMins int
+	doseMins     int // Fertigation dose, 0 for none
+	valves       []scheduleValve
+}
+
+// scheduleValve is a valve run by a schedule, by cloud valve ID and, for a
+// valve not mapped yet, its actuator address
+type scheduleValve struct {
+	valveID string
+	addr    uint8
+}
+
+// jsonSchedules converts a JSON schedule update. A schedule without runs
+// is one run of its top-level days, start times, and valves.
+func jsonSchedules(update *cloud.ScheduleUpdatePayload) []*cloudSchedule {
+	var schedules []*cloudSchedule
+	for _, sched := range update.Schedules {
+		valves := make([]scheduleValve, 0, len(sched.Valves))
+		for _, v := range sched.Valves {
+			valves = append(valves, scheduleValve{valveID: v.ValveID, addr: v.ActuatorAddress})
+		}
+		var doseMins int
+		if f := sched.Fertigation; f != nil {
+			doseMins = f.DoseMinutes
+		}
+
+		s := &cloudSchedule{id: sched.ScheduleID, name: sched.Name, enabled: sched.Enabled}
+		runs := sched.Runs
+		if len(runs) == 0 {
+			startTimes := sched.StartTimes
+			if sched.StartTime != "" {
+				startTimes = append([]string{sched.StartTime}, startTimes...)
+			}
+			runs = []cloud.ScheduleRun{{Days: sched.Days, StartTimes: startTimes, DurationMinutes: sched.DurationMinutes}}
+		}
+		for _, r := range runs {
+			run := scheduleRun{days: r.Days, startTimes: r.StartTimes, durationMins: r.DurationMinutes, doseMins: doseMins, valves: valves}
+			if len(r.Valves) > 0 {
+				run.valves = nil
+				for _, v := range r.Valves {
+					run.valves = append(run.valves, scheduleValve{valveID: v.ValveID, addr: v.ActuatorAddress})
+				}
+			}
+			s.runs = append(s.runs, run)
+		}
+		schedules = append(schedules, s)
+	}
+	return schedules
+}
+
+// grpcSchedules converts a gRPC schedule update. Each Schedule message is
+// one run, whose start time may list several times separated by commas;
+// messages with the same schedule ID are runs of one schedule.
+func grpcSchedules(update *controllerv1.ScheduleUpdate) []*cloudSchedule {
+	var schedules []*cloudSchedule
+	byID := make(map[string]*cloudSchedule)
+	for _, sched := range update.Schedules {
+		s, ok := byID[sched.ScheduleId]
+		if !ok {
+			s = &cloudSchedule{id: sched.ScheduleId, name: sched.Name, enabled: sched.Enabled}
+			byID[sched.ScheduleId] = s
+			schedules = append(schedules, s)
+		}
+
+		run := scheduleRun{days: sched.Days, durationMins: int(sched.DurationMinutes)}
+		for _, t := range strings.Split(sched.StartTime, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				run.startTimes = append(run.startTimes, t)
+			}
+		}
+		for _, v := range sched.Valves {
+			run.valves = append(run.valves, scheduleValve{valveID: v.ValveId, addr: uint8(v.ActuatorAddress)})
+		}
+		s.runs = append(s.runs, run)
+	}
+	return schedules
+}
+
+// applySchedules stores schedules from the cloud, split by the valve
+// controller each valve is on, and pushes its schedule to every controller
+// whose schedule changed
+func (e *Engine) applySchedules(schedules []*cloudSchedule) {
+	changed := make(map[string]bool)
+	for _, sched := range schedules {
+		if sched.id == "" {
+			log.Printf("Skipping schedule without an ID: %s", sched.name)
+			continue
+		}
+		parts := e.scheduleEntries(sched)
+		controllers, err := e.db.ReplaceCloudSchedule(sched.id, sched.name, sched.enabled, parts)
+		if err != nil {
+			log.Printf("Failed to store schedule %s: %v", sched.id, err)
+			continue
+		}
+		log.Printf("Updated schedule %s: %s (%d runs on %d controllers)", sched.id, sched.name, len(sched.runs), len(parts))
+		for _, controllerUID := range controllers {
+			changed[controllerUID] = true
+		}
+	}
+
+	controllers := make([]string, 0, len(changed))
+	for controllerUID := range changed {
+		controllers = append(controllers, controllerUID)
+	}
+	sort.Strings(controllers)
+	for _, controllerUID := range controllers {
+		e.sendSchedule(controllerUID)
+	}
+}
+
+// scheduleEntries converts a schedule to the entries of each valve
+// controller it runs valves on: one entry per run and start time, for the
+// run's valves on that controller. Valves that can't be resolved to a
+// controller, and start times that can't be parsed, are skipped.
+func (e *Engine) scheduleEntries(sched *cloudSchedule) map[string][]storage.ScheduleEntry {
+	parts := make(map[string][]storage.ScheduleEntry)
+	for _, run := range sched.runs {
+		dayMask := daysToDayMask(run.days)
+		if dayMask == 0 {
+			log.Printf("Schedule %s: skipping run without days", sched.id)
+			continue
+		}
+
+		var controllers []string
+		masks := make(map[string]uint64)
+		for _, v := range run.valves {
+			controllerUID, addr, err := e.resolveValve(v.valveID, "", v.addr)
+			if err != nil {
+				log.Printf("Schedule %s: %v", sched.id, err)
+				continue
+			}
+			if addr >= 64 {
+				log.Printf("Schedule %s: invalid actuator address %d", sched.id, addr)
+				continue
+			}
+			if _, ok := masks[controllerUID]; !ok {
+				controllers = append(controllers, controllerUID)
+			}
+			masks[controllerUID] |= 1 << addr
+		}
+
+		for _, start := range run.startTimes {
+			hour, minute, err := parseStartTime(start)
+			if err != nil {
+				log.Printf("Schedule %s: %v", sched.id, err)
+				continue
+			}
+			for _, controllerUID := range controllers {
+				entry := storage.ScheduleEntry{
+					DayMask:      dayMask,
+					StartHour:    hour,
+					StartMinute:  minute,
+					DurationMins: uint16(run.durationMins),
+					ActuatorMask: masks[controllerUID],
+				}
+				if run.doseMins > 0 {
+					entry.Fertigate = true
+					entry.DoseMins = uint16(run.doseMins)
+				}
+				parts[controllerUID] = append(parts[controllerUID], entry)
+			}
+		}
+	}
+	return parts
+}
+
+// parseStartTime parses a time string like "06:00" into hour and minute
+func parseStartTime(s string) (uint8, uint8, error) {
+	var hour, minute int
+	if n, _ := fmt.Sscanf(s, "%d:%d", &hour, &minute); n != 2 || hour < 0 || hour > 23 || minute < 0 || minute > 59 {
+		return 0, 0, fmt.Errorf("invalid start time %q", s)
+	}
+	return uint8(hour), uint8(minute), nil
+}
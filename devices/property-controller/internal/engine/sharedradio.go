@@ -0,0 +1,175 @@
+package engine
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+
+	"github.com/agsys/property-controller/internal/lora"
+	"github.com/agsys/property-controller/internal/lora/gw"
+	"github.com/agsys/property-controller/internal/protocol"
+)
+
+// SharedRadio is one LoRa driver serving the engines of several properties
+// in one process, for gateway hardware shared by adjacent properties. Each
+// uplink goes to the engine its device is registered with. A device no
+// engine has registered is heard by all of them, so whichever property's
+// cloud approves it claims it.
+type SharedRadio struct {
+	driver *lora.Driver
+
+	mu      sync.RWMutex
+	engines []*Engine
+	owners  map[string]*Engine // Device UID to the engine it is registered with
+}
+
+// NewSharedRadio creates the driver the engines will share from the LoRa
+// settings of config. Set it as Config.SharedRadio for each engine and
+// start it before them.
+func NewSharedRadio(config Config) (*SharedRadio, error) {
+	driver, err := lora.New(loraConfig(config))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create LoRa driver: %w", err)
+	}
+	s := &SharedRadio{driver: driver, owners: make(map[string]*Engine)}
+	driver.SetReceiveCallback(s.dispatch)
+	driver.SetGatewayStatsCallback(s.gatewayStats)
+	driver.SetTxResultCallback(s.txResult)
+	driver.Keys().SetActivateCallback(s.keyActivated)
+	return s, nil
+}
+
+// Start starts the shared driver
+func (s *SharedRadio) Start() error {
+	return s.driver.Start()
+}
+
+// Stop stops the shared driver, once every engine using it has stopped
+func (s *SharedRadio) Stop() error {
+	return s.driver.Stop()
+}
+
+// attach starts routing uplinks to an engine
+func (s *SharedRadio) attach(e *Engine) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.engines = append(s.engines, e)
+}
+
+// detach stops routing uplinks to an engine
+func (s *SharedRadio) detach(e *Engine) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.engines = slices.DeleteFunc(s.engines, func(other *Engine) bool { return other == e })
+	for uid, owner := range s.owners {
+		if owner == e {
+			delete(s.owners, uid)
+		}
+	}
+}
+
+// claim routes a device's uplinks to the engine it was approved on
+func (s *SharedRadio) claim(deviceUID string, e *Engine) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if owner, ok := s.owners[deviceUID]; ok && owner != e {
+		log.Printf("Device %s moved to the property of controller %s", deviceUID, e.config.ControllerID)
+	}
+	s.owners[deviceUID] = e
+}
+
+// release stops routing a device's uplinks to the engine that forgot it
+func (s *SharedRadio) release(deviceUID string, e *Engine) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.owners[deviceUID] == e {
+		delete(s.owners, deviceUID)
+	}
+}
+
+// owner returns the engine a device is registered with, or nil
+func (s *SharedRadio) owner(deviceUID string) *Engine {
+	s.mu.RLock()
+	owner, ok := s.owners[deviceUID]
+	engines := slices.Clone(s.engines)
+	s.mu.RUnlock()
+	if ok {
+		return owner
+	}
+
+	for _, e := range engines {
+		registered, err := e.db.IsDeviceRegistered(deviceUID)
+		if err != nil {
+			log.Printf("Failed to look up device %s: %v", deviceUID, err)
+			continue
+		}
+		if registered {
+			s.claim(deviceUID, e)
+			return e
+		}
+	}
+	return nil
+}
+
+// dispatch hands an uplink to the engine that owns its device, or a copy to
+// every engine if none does
+func (s *SharedRadio) dispatch(msg *protocol.LoRaMessage) {
+	deviceUID := msg.DeviceUIDString()
+	if owner := s.owner(deviceUID); owner != nil {
+		owner.handleLoRaMessage(msg)
+		return
+	}
+
+	s.mu.RLock()
+	engines := slices.Clone(s.engines)
+	s.mu.RUnlock()
+	for _, e := range engines {
+		copied := *msg
+		copied.Payload = slices.Clone(msg.Payload)
+		e.handleLoRaMessage(&copied)
+	}
+}
+
+// gatewayStats hands gateway statistics to every engine, since the gateway
+// serves all their properties
+func (s *SharedRadio) gatewayStats(stats *gw.GatewayStats) {
+	s.mu.RLock()
+	engines := slices.Clone(s.engines)
+	s.mu.RUnlock()
+	for _, e := range engines {
+		e.handleGatewayStats(stats)
+	}
+}
+
+// keyActivated records a device switching keys with the engine that owns
+// it, or with every engine if none does
+func (s *SharedRadio) keyActivated(uid [8]byte, keyID uint8) {
+	if owner := s.owner(lora.DeviceUIDToString(uid)); owner != nil {
+		owner.handleKeyActivated(uid, keyID)
+		return
+	}
+
+	s.mu.RLock()
+	engines := slices.Clone(s.engines)
+	s.mu.RUnlock()
+	for _, e := range engines {
+		e.handleKeyActivated(uid, keyID)
+	}
+}
+
+// txResult hands a transmit outcome to the engine that owns the device, or
+// to every engine if none does
+func (s *SharedRadio) txResult(result lora.TxResult) {
+	if owner := s.owner(lora.DeviceUIDToString(result.DeviceUID)); owner != nil {
+		owner.handleTxResult(result)
+		return
+	}
+
+	s.mu.RLock()
+	engines := slices.Clone(s.engines)
+	s.mu.RUnlock()
+	for _, e := range engines {
+		e.handleTxResult(result)
+	}
+}
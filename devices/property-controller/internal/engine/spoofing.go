@@ -0,0 +1,200 @@
+package engine
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/agsys/property-controller/internal/logging"
+	"github.com/agsys/property-controller/internal/protocol"
+	"github.com/agsys/property-controller/internal/storage"
+)
+
+// alertSuspectedSpoofing is raised when a registered device's uplinks look
+// like they come from another transmitter using its UID
+const alertSuspectedSpoofing = "suspected_spoofing"
+
+// Sequence numbers at or below this are taken as a device restarting its
+// count, not as a jump back
+const sequenceRestartMax = 16
+
+// rssiBaselineWindow is how many uplinks a device's average RSSI is taken
+// over; older ones fade out
+const rssiBaselineWindow = 50
+
+// SpoofingConfig controls the checks for a cloned or spoofed device UID: a
+// registered device whose uplinks arrive far from its usual signal strength,
+// or whose sequence numbers jump, is flagged with a critical alert
+type SpoofingConfig struct {
+	RSSIJump     int    // dB from a device's average RSSI that is suspect (0 disables)
+	MinSamples   int    // Uplinks a device's average needs before RSSI is checked
+	SequenceJump uint16 // Largest plausible forward jump in a device's sequence numbers (0 disables)
+	Quarantine   bool   // Drop a flagged device's uplinks until it is approved again
+}
+
+// DefaultSpoofingConfig returns default spoofing detection settings. A
+// fixed device's RSSI rarely moves more than 10-15 dB with weather and
+// foliage.
+func DefaultSpoofingConfig() SpoofingConfig {
+	return SpoofingConfig{
+		RSSIJump:     30,
+		MinSamples:   20,
+		SequenceJump: 1000,
+	}
+}
+
+// rssiBaseline is a device's running average RSSI
+type rssiBaseline struct {
+	avg     float64
+	samples int
+}
+
+// add folds an uplink's RSSI into the average
+func (b *rssiBaseline) add(rssi int16) {
+	if b.samples < rssiBaselineWindow {
+		b.samples++
+	}
+	b.avg += (float64(rssi) - b.avg) / float64(b.samples)
+}
+
+// loadSpoofingState restores quarantined devices and seeds RSSI baselines
+// from the link quality history, so checks don't start from nothing after a
+// restart
+func (e *Engine) loadSpoofingState() {
+	quarantined, err := e.db.GetQuarantinedDevices()
+	if err != nil {
+		log.Printf("Failed to load quarantined devices: %v", err)
+	}
+	stats, err := e.db.GetLinkQualityStats(time.Now().Add(-24 * time.Hour))
+	if err != nil {
+		log.Printf("Failed to load RSSI baselines: %v", err)
+	}
+
+	e.spoofMu.Lock()
+	defer e.spoofMu.Unlock()
+	for uid, reason := range quarantined {
+		e.quarantined[uid] = reason
+	}
+	for _, s := range stats {
+		e.rssiBaselines[s.DeviceUID] = &rssiBaseline{avg: s.AvgRSSI, samples: min(s.Samples, rssiBaselineWindow)}
+	}
+	if len(quarantined) > 0 {
+		log.Printf("%d devices quarantined as suspected spoofs", len(quarantined))
+	}
+}
+
+// screenUplink reports whether an uplink should be dropped: its device is
+// quarantined, or it is flagged now and quarantine is on. Only registered
+// devices are checked. It must run before isDuplicateUplink records the
+// sequence.
+func (e *Engine) screenUplink(deviceUID string, registered bool, msg *protocol.LoRaMessage, now time.Time) bool {
+	cfg := e.settings().Spoofing
+
+	e.spoofMu.Lock()
+	if _, ok := e.quarantined[deviceUID]; ok {
+		e.spoofMu.Unlock()
+		logging.Debugf("Dropped type 0x%02X from quarantined device %s", msg.Header.MsgType, deviceUID)
+		return true
+	}
+	if !registered {
+		e.spoofMu.Unlock()
+		return false
+	}
+	baseline := e.rssiBaselines[deviceUID]
+	if baseline == nil {
+		baseline = &rssiBaseline{}
+		e.rssiBaselines[deviceUID] = baseline
+	}
+	reason := cfg.checkRSSI(baseline, msg.RSSI)
+	// A moved device settles at its new level and stops being flagged
+	baseline.add(msg.RSSI)
+	e.spoofMu.Unlock()
+
+	if reason == "" {
+		e.uplinkMu.Lock()
+		last, ok := e.uplinks[deviceUID]
+		e.uplinkMu.Unlock()
+		if ok {
+			reason = cfg.checkSequence(last.seq, msg.Header.Sequence)
+		}
+	}
+	if reason == "" {
+		return false
+	}
+
+	message := fmt.Sprintf("device %s may be spoofed or cloned: %s", deviceUID, reason)
+	if cfg.Quarantine {
+		message += "; its uplinks are dropped until it is approved again"
+		e.spoofMu.Lock()
+		e.quarantined[deviceUID] = reason
+		e.spoofMu.Unlock()
+		if err := e.db.QuarantineDevice(deviceUID, reason, now); err != nil {
+			log.Printf("Failed to record quarantine of %s: %v", deviceUID, err)
+		}
+	}
+	e.raiseAlert(&storage.Alert{
+		DeviceUID: deviceUID,
+		AlertType: alertSuspectedSpoofing,
+		Severity:  storage.AlertCritical,
+		Message:   message,
+		Value:     float64(msg.RSSI),
+		Timestamp: now,
+	})
+	return cfg.Quarantine
+}
+
+// checkRSSI flags an RSSI too far from a device's average, once the average
+// has enough samples
+func (c SpoofingConfig) checkRSSI(b *rssiBaseline, rssi int16) string {
+	if c.RSSIJump <= 0 || b.samples < c.MinSamples {
+		return ""
+	}
+	if jump := math.Abs(float64(rssi) - b.avg); jump > float64(c.RSSIJump) {
+		return fmt.Sprintf("RSSI %d dBm is %.0f dB from its average of %.0f dBm", rssi, jump, b.avg)
+	}
+	return ""
+}
+
+// checkSequence flags a sequence number that jumps back, other than to a
+// restarted count, or further ahead than SequenceJump. Two transmitters
+// sharing a UID interleave their counts and trip one or the other.
+func (c SpoofingConfig) checkSequence(last, seq uint16) string {
+	if c.SequenceJump == 0 || seq == last {
+		return ""
+	}
+	ahead := seq - last // Wraps at 65536
+	switch {
+	case ahead > math.MaxUint16/2:
+		if seq > sequenceRestartMax {
+			return fmt.Sprintf("sequence went back from %d to %d", last, seq)
+		}
+	case ahead > c.SequenceJump:
+		return fmt.Sprintf("sequence jumped from %d to %d", last, seq)
+	}
+	return ""
+}
+
+// releaseDevice lifts a device's quarantine once it is approved again, and
+// clears its spoofing alert. Its RSSI average starts over, and so does its
+// sequence, which moved on while its uplinks were dropped.
+func (e *Engine) releaseDevice(deviceUID string) {
+	e.spoofMu.Lock()
+	_, quarantined := e.quarantined[deviceUID]
+	delete(e.quarantined, deviceUID)
+	delete(e.rssiBaselines, deviceUID)
+	e.spoofMu.Unlock()
+
+	e.uplinkMu.Lock()
+	delete(e.uplinks, deviceUID)
+	e.uplinkMu.Unlock()
+
+	released, err := e.db.ReleaseDevice(deviceUID)
+	if err != nil {
+		log.Printf("Failed to release device %s: %v", deviceUID, err)
+	}
+	if quarantined || released {
+		log.Printf("Device %s released from quarantine", deviceUID)
+	}
+	e.clearAlerts(deviceUID, 0, alertSuspectedSpoofing)
+}
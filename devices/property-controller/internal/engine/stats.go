@@ -0,0 +1,202 @@
+package engine
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/agsys/property-controller/internal/localapi"
+	"github.com/agsys/property-controller/internal/storage"
+)
+
+// Lifetime counter names, as stored in the engine_counters table. Uplinks
+// are counted under counterRxPrefix and their message type, e.g. rx_0x20.
+const (
+	counterRxPrefix       = "rx_"
+	counterDecodeFailures = "decode_failures"
+	counterDuplicates     = "duplicates_dropped"
+	counterThrottled      = "throttled_dropped"
+	counterCommandsSent   = "commands_sent"
+	counterCommandsAcked  = "commands_acked"
+	counterCommandsFailed = "commands_failed"
+	counterSyncOK         = "sync_ok"
+	counterSyncFailed     = "sync_failed"
+	counterRadioRx        = "radio_rx_packets"
+	counterRadioTx        = "radio_tx_packets"
+	counterRadioSkipped   = "radio_tx_skipped"
+)
+
+// engineStats holds the lifetime counters: totals including what was loaded
+// at startup, and the increments not yet written to the database
+type engineStats struct {
+	mu      sync.Mutex
+	total   map[string]int64
+	pending map[string]int64
+
+	// Radio driver packet counts already added, which restart from zero
+	// with the driver
+	radioRx, radioTx, radioSkipped uint64
+}
+
+// add adds n to a counter
+func (s *engineStats) add(name string, n int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.total == nil {
+		s.total = make(map[string]int64)
+		s.pending = make(map[string]int64)
+	}
+	s.total[name] += n
+	s.pending[name] += n
+}
+
+// count adds one to a lifetime counter
+func (e *Engine) count(name string) {
+	e.stats.add(name, 1)
+}
+
+// countSync counts a batch sent to the cloud, or one that failed
+func (e *Engine) countSync(err error) {
+	if err != nil {
+		e.count(counterSyncFailed)
+	} else {
+		e.count(counterSyncOK)
+	}
+}
+
+// countOutcome counts a command sent over LoRa and how it ended
+func (e *Engine) countOutcome(outcome string) {
+	switch outcome {
+	case storage.AuditSent:
+		e.count(counterCommandsSent)
+	case storage.AuditAcked:
+		e.count(counterCommandsAcked)
+	case storage.AuditSendFailed, storage.AuditNacked, storage.AuditNoAck:
+		e.count(counterCommandsFailed)
+	}
+}
+
+// loadCounters adds the counters stored by earlier runs to the totals
+func (e *Engine) loadCounters() {
+	stored, err := e.db.GetCounters()
+	if err != nil {
+		log.Printf("Failed to load engine counters: %v", err)
+		return
+	}
+
+	s := &e.stats
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.total == nil {
+		s.total = make(map[string]int64)
+		s.pending = make(map[string]int64)
+	}
+	for name, n := range stored {
+		s.total[name] += n
+	}
+}
+
+// recordCounters writes the increments counted since the last call to the
+// database. On failure they are kept for the next call.
+func (e *Engine) recordCounters() {
+	e.addRadioCounts()
+
+	s := &e.stats
+	s.mu.Lock()
+	pending := s.pending
+	s.pending = make(map[string]int64)
+	s.mu.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+
+	if err := e.db.AddCounters(pending); err != nil {
+		log.Printf("Failed to record engine counters: %v", err)
+		s.mu.Lock()
+		for name, n := range pending {
+			s.pending[name] += n
+		}
+		s.mu.Unlock()
+	}
+}
+
+// addRadioCounts adds the packets the radio driver has counted since the
+// last call. A shared radio's packets belong to every property on it, so
+// they aren't counted.
+func (e *Engine) addRadioCounts() {
+	if e.lora == nil || e.config.SharedRadio != nil {
+		return
+	}
+	driver := e.lora.Stats()
+
+	s := &e.stats
+	s.mu.Lock()
+	rx, tx := radioDelta(driver.RxPackets, s.radioRx), radioDelta(driver.TxPackets, s.radioTx)
+	skipped := radioDelta(driver.TxSkipped, s.radioSkipped)
+	s.radioRx, s.radioTx, s.radioSkipped = driver.RxPackets, driver.TxPackets, driver.TxSkipped
+	s.mu.Unlock()
+
+	if rx > 0 {
+		e.stats.add(counterRadioRx, rx)
+	}
+	if tx > 0 {
+		e.stats.add(counterRadioTx, tx)
+	}
+	if skipped > 0 {
+		e.stats.add(counterRadioSkipped, skipped)
+	}
+}
+
+// radioDelta returns how far a driver count has moved since last, all of it
+// if the driver was restarted
+func radioDelta(now, last uint64) int64 {
+	if now < last {
+		return int64(now)
+	}
+	return int64(now - last)
+}
+
+// lifetimeCounters returns a copy of the lifetime counters
+func (e *Engine) lifetimeCounters() map[string]int64 {
+	e.addRadioCounts()
+
+	s := &e.stats
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counters := make(map[string]int64, len(s.total))
+	for name, n := range s.total {
+		counters[name] = n
+	}
+	return counters
+}
+
+// lifetimeCounts returns the lifetime counters for the local API
+func (e *Engine) lifetimeCounts() localapi.LifetimeCounts {
+	counters := e.lifetimeCounters()
+	counts := localapi.LifetimeCounts{
+		Messages:          make(map[string]int64),
+		DecodeFailures:    counters[counterDecodeFailures],
+		DuplicatesDropped: counters[counterDuplicates],
+		ThrottledDropped:  counters[counterThrottled],
+		CommandsSent:      counters[counterCommandsSent],
+		CommandsAcked:     counters[counterCommandsAcked],
+		CommandsFailed:    counters[counterCommandsFailed],
+		SyncSucceeded:     counters[counterSyncOK],
+		SyncFailed:        counters[counterSyncFailed],
+		RadioRxPackets:    counters[counterRadioRx],
+		RadioTxPackets:    counters[counterRadioTx],
+		RadioTxSkipped:    counters[counterRadioSkipped],
+	}
+	for name, n := range counters {
+		if msgType, ok := strings.CutPrefix(name, counterRxPrefix); ok {
+			counts.Messages[msgType] = n
+		}
+	}
+	return counts
+}
+
+// rxCounter names the counter of uplinks of a message type
+func rxCounter(msgType uint8) string {
+	return fmt.Sprintf("%s0x%02X", counterRxPrefix, msgType)
+}
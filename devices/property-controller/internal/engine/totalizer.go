@@ -0,0 +1,123 @@
+package engine
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/agsys/property-controller/internal/protocol"
+	"github.com/agsys/property-controller/internal/storage"
+)
+
+// totalizerRange is the span of a meter's uint32 liter totalizer. A raw total
+// that falls by more than half of it has wrapped rather than been reset.
+const totalizerRange = 1 << 32
+
+// reconcileTotalizer gives a meter reading its cumulative total, crediting a
+// rollover or a reset whose ack was lost since the last accepted reading. The
+// returned state is only saved once the reading passes validation.
+func (e *Engine) reconcileTotalizer(r *storage.WaterMeterReading) *storage.MeterTotalizer {
+	t := e.meterTotalizer(r.DeviceUID)
+	raw := float64(r.TotalVolumeL)
+	tolerance := e.settings().Validation.MeterDropL
+
+	if t.LastRawL-raw > tolerance {
+		switch {
+		case t.PendingResetID != 0 && raw >= t.PendingResetL-tolerance:
+			// The reset took effect but its ack hasn't arrived; count from the
+			// last reading, so use between it and the reset is lost
+			log.Printf("Meter %s totalizer fell from %.1f L to %.1f L, applying pending reset %d",
+				r.DeviceUID, t.LastRawL, raw, t.PendingResetID)
+			applyReset(t, t.LastRawL, t.PendingResetL)
+		case t.LastRawL-raw > totalizerRange/2:
+			log.Printf("Meter %s totalizer rolled over from %.1f L to %.1f L", r.DeviceUID, t.LastRawL, raw)
+			t.OffsetL += totalizerRange
+			t.Rollovers++
+		}
+	}
+
+	r.CumulativeL = raw + t.OffsetL
+	t.LastRawL = raw
+	return t
+}
+
+// meterTotalizer loads a meter's totalizer state, starting it from the last
+// stored reading for a meter without one
+func (e *Engine) meterTotalizer(deviceUID string) *storage.MeterTotalizer {
+	t, err := e.db.GetMeterTotalizer(deviceUID)
+	if err != nil {
+		log.Printf("Failed to load totalizer of meter %s: %v", deviceUID, err)
+	}
+	if t != nil {
+		return t
+	}
+
+	t = &storage.MeterTotalizer{DeviceUID: deviceUID}
+	prev, err := e.db.GetLatestWaterMeterReading(deviceUID)
+	if err != nil {
+		log.Printf("Failed to load last reading of meter %s: %v", deviceUID, err)
+	}
+	if prev != nil {
+		t.LastRawL = float64(prev.TotalVolumeL)
+		t.OffsetL = prev.CumulativeL - t.LastRawL
+	}
+	return t
+}
+
+// saveTotalizer stores a meter's totalizer state
+func (e *Engine) saveTotalizer(t *storage.MeterTotalizer) {
+	if err := e.db.SaveMeterTotalizer(t); err != nil {
+		log.Printf("Failed to save totalizer of meter %s: %v", t.DeviceUID, err)
+	}
+}
+
+// applyReset moves a totalizer from oldL to newL while keeping its
+// cumulative total where it was
+func applyReset(t *storage.MeterTotalizer, oldL, newL float64) {
+	t.OffsetL += oldL - newL
+	t.LastRawL = newL
+	t.Resets++
+	t.PendingResetID, t.PendingResetL = 0, 0
+}
+
+// expectReset records a reset sent to a meter, so a drop in its totalizer
+// is credited even if the ack is lost
+func (e *Engine) expectReset(deviceUID string, commandID uint16, newL float64) {
+	t := e.meterTotalizer(deviceUID)
+	t.PendingResetID, t.PendingResetL = commandID, newL
+	e.saveTotalizer(t)
+}
+
+// handleMeterResetAck applies an acknowledged totalizer reset to the meter's
+// cumulative total and records the outcome in the audit log
+func (e *Engine) handleMeterResetAck(deviceUID string, msg *protocol.LoRaMessage) {
+	ack, err := protocol.DecodeMeterResetAck(msg.Payload)
+	if err != nil {
+		log.Printf("Failed to decode meter reset ack from %s: %v", deviceUID, err)
+		e.count(counterDecodeFailures)
+		return
+	}
+
+	t := e.meterTotalizer(deviceUID)
+	pending := t.PendingResetID == ack.AckedSequence
+
+	if ack.Status != 0 {
+		log.Printf("Meter %s rejected reset %d: status %d", deviceUID, ack.AckedSequence, ack.Status)
+		e.auditOutcome(deviceUID, ack.AckedSequence, storage.AuditNacked, fmt.Sprintf("status %d", ack.Status))
+		if pending {
+			t.PendingResetID, t.PendingResetL = 0, 0
+			e.saveTotalizer(t)
+		}
+		return
+	}
+
+	log.Printf("Meter %s reset %d acknowledged: %d L -> %d L", deviceUID, ack.AckedSequence, ack.OldTotalLiters, ack.NewTotalLiters)
+	e.auditOutcome(deviceUID, ack.AckedSequence, storage.AuditAcked,
+		fmt.Sprintf("old total %d L, new total %d L", ack.OldTotalLiters, ack.NewTotalLiters))
+
+	// A report after the reset may already have applied it
+	if !pending {
+		return
+	}
+	applyReset(t, float64(ack.OldTotalLiters), float64(ack.NewTotalLiters))
+	e.saveTotalizer(t)
+}
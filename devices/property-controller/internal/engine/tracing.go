@@ -0,0 +1,140 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/agsys/property-controller/internal/protocol"
+	"github.com/agsys/property-controller/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Receive spans kept per device and kind of reading for the cloud sync to
+// link to, and devices kept, so readings that never sync can't pile up
+const (
+	maxTraceLinks   = 32
+	maxTraceDevices = 1024
+)
+
+// Span attributes
+const (
+	attrDeviceUID = attribute.Key("agsys.device_uid")
+	attrMsgType   = attribute.Key("agsys.msg_type")
+	attrSequence  = attribute.Key("agsys.sequence")
+	attrRSSI      = attribute.Key("agsys.rssi")
+	attrSNR       = attribute.Key("agsys.snr")
+	attrBytes     = attribute.Key("agsys.payload_bytes")
+	attrDropped   = attribute.Key("agsys.dropped")
+	attrTable     = attribute.Key("agsys.table")
+	attrRecords   = attribute.Key("agsys.records")
+	attrReportAge = attribute.Key("agsys.report_age_ms")
+)
+
+// traceKey identifies the receive spans of one device's readings of a kind
+type traceKey struct {
+	table     string
+	deviceUID string
+}
+
+// startReceiveSpan starts the span an uplink is handled under
+func startReceiveSpan(deviceUID string, msg *protocol.LoRaMessage) (context.Context, trace.Span) {
+	return tracing.Tracer().Start(context.Background(), "lora.receive",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attrDeviceUID.String(deviceUID),
+			attrMsgType.String(fmt.Sprintf("0x%02X", msg.Header.MsgType)),
+			attrSequence.Int(int(msg.Header.Sequence)),
+			attrRSSI.Int(int(msg.RSSI)),
+			attrSNR.Float64(float64(msg.SNR)),
+			attrBytes.Int(len(msg.Payload)),
+		))
+}
+
+// startSpan starts a step of handling an uplink, such as decoding it
+func startSpan(ctx context.Context, name string) trace.Span {
+	_, span := tracing.Tracer().Start(ctx, name)
+	return span
+}
+
+// endSpan ends a span, marking it failed if err is set
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// dropSpan notes why an uplink was dropped before it was handled
+func dropSpan(span trace.Span, reason string) {
+	span.SetAttributes(attrDropped.String(reason))
+}
+
+// traceStored keeps the receive span of a stored reading, so its cloud sync
+// can link back to it. Untraced uplinks are skipped.
+func (e *Engine) traceStored(ctx context.Context, table, deviceUID string) {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsSampled() {
+		return
+	}
+	key := traceKey{table, deviceUID}
+
+	e.traceMu.Lock()
+	defer e.traceMu.Unlock()
+	if e.traceLinks == nil {
+		e.traceLinks = make(map[traceKey][]trace.Link)
+	}
+	links, ok := e.traceLinks[key]
+	if !ok && len(e.traceLinks) >= maxTraceDevices {
+		return
+	}
+	if len(links) >= maxTraceLinks {
+		links = links[1:]
+	}
+	e.traceLinks[key] = append(links, trace.Link{SpanContext: sc})
+}
+
+// startSyncSpan starts the span of sending a device's readings to the cloud,
+// linked to the uplinks they came from. The age of the oldest reading is the
+// time it took to get this far.
+func (e *Engine) startSyncSpan(table, deviceUID string, records int, oldest time.Time) (trace.Span, []trace.Link) {
+	key := traceKey{table, deviceUID}
+	e.traceMu.Lock()
+	links := e.traceLinks[key]
+	delete(e.traceLinks, key)
+	e.traceMu.Unlock()
+
+	_, span := tracing.Tracer().Start(context.Background(), "cloud.sync",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithLinks(links...),
+		trace.WithAttributes(
+			attrTable.String(table),
+			attrDeviceUID.String(deviceUID),
+			attrRecords.Int(records),
+			attrReportAge.Int64(time.Since(oldest).Milliseconds()),
+		))
+	return span, links
+}
+
+// endSyncSpan ends a sync span. A failed send keeps its links for the retry.
+func (e *Engine) endSyncSpan(span trace.Span, table, deviceUID string, links []trace.Link, err error) {
+	endSpan(span, err)
+	if err == nil || len(links) == 0 {
+		return
+	}
+
+	key := traceKey{table, deviceUID}
+	e.traceMu.Lock()
+	defer e.traceMu.Unlock()
+	if e.traceLinks == nil {
+		e.traceLinks = make(map[traceKey][]trace.Link)
+	}
+	links = append(links, e.traceLinks[key]...)
+	if len(links) > maxTraceLinks {
+		links = links[len(links)-maxTraceLinks:]
+	}
+	e.traceLinks[key] = links
+}
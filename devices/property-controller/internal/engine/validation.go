@@ -0,0 +1,180 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/agsys/property-controller/internal/storage"
+)
+
+// ValidationConfig sets the bounds incoming readings must fall within.
+// Readings outside them are quarantined in rejected_readings rather than
+// stored and synced to the cloud.
+type ValidationConfig struct {
+	MinTemperatureC float64       // Lowest plausible soil temperature
+	MaxTemperatureC float64       // Highest plausible soil temperature
+	MaxMoistureStep uint8         // Largest moisture change, in points, between readings within StepWindow (0 disables)
+	StepWindow      time.Duration // How recent the last accepted reading must be for the step check
+	MeterDropL      float64       // Totalizer decrease tolerated as float rounding
+}
+
+// DefaultValidationConfig returns default reading validation settings
+func DefaultValidationConfig() ValidationConfig {
+	return ValidationConfig{
+		MinTemperatureC: -40,
+		MaxTemperatureC: 85,
+		MaxMoistureStep: 40,
+		StepWindow:      time.Hour,
+		MeterDropL:      1,
+	}
+}
+
+// checkTemperature rejects a soil temperature, in 0.1°C units, outside the
+// configured bounds
+func (c ValidationConfig) checkTemperature(temperature int16) (reason string, value float64) {
+	tempC := float64(temperature) / 10
+	if tempC < c.MinTemperatureC || tempC > c.MaxTemperatureC {
+		return storage.RejectTemperatureRange, tempC
+	}
+	return "", tempC
+}
+
+// checkMoisture rejects a moisture percentage above 100, or one that moved
+// more than MaxMoistureStep points from the probe's last accepted reading.
+// prev is nil when the probe has no readings. Only a recent previous reading
+// is compared, so a genuine step change is accepted once the window passes.
+func (c ValidationConfig) checkMoisture(percent uint8, at time.Time, prev *storage.SoilMoistureReading) string {
+	if percent > 100 {
+		return storage.RejectMoistureRange
+	}
+	if c.MaxMoistureStep == 0 || prev == nil || at.Sub(prev.Timestamp) > c.StepWindow {
+		return ""
+	}
+	step := int(percent) - int(prev.MoisturePercent)
+	if step < 0 {
+		step = -step
+	}
+	if step > int(c.MaxMoistureStep) {
+		return storage.RejectMoistureStep
+	}
+	return ""
+}
+
+// checkTotalizer rejects a meter total that is not a finite, non-negative
+// number, or whose cumulative total fell below the meter's last accepted one
+// by more than MeterDropL. prev is nil when the meter has no readings.
+func (c ValidationConfig) checkTotalizer(r, prev *storage.WaterMeterReading) string {
+	total := float64(r.TotalVolumeL)
+	if math.IsNaN(total) || math.IsInf(total, 0) || total < 0 {
+		return storage.RejectTotalizerInvalid
+	}
+	if prev != nil && r.CumulativeL < prev.CumulativeL-c.MeterDropL {
+		return storage.RejectTotalizerDecrease
+	}
+	return ""
+}
+
+// validateSoilReading checks a single-probe reading, quarantining it and
+// returning false if it fails
+func (e *Engine) validateSoilReading(r *storage.SoilMoistureReading) bool {
+	cfg := e.settings().Validation
+
+	if reason, tempC := cfg.checkTemperature(r.Temperature); reason != "" {
+		e.rejectReading(&storage.RejectedReading{DeviceUID: r.DeviceUID, ProbeID: r.ProbeID, ReadingType: "soil",
+			Reason: reason, Value: tempC, Timestamp: r.Timestamp}, r)
+		return false
+	}
+	return e.validateProbe(cfg, r.DeviceUID, r, r.Timestamp)
+}
+
+// validateSoilReport checks a multi-probe report, returning the probe
+// readings that pass. An implausible temperature rejects the whole report;
+// otherwise bad probes are quarantined and dropped individually.
+func (e *Engine) validateSoilReport(report *storage.SoilReport, readings []*storage.SoilMoistureReading) []*storage.SoilMoistureReading {
+	cfg := e.settings().Validation
+
+	if reason, tempC := cfg.checkTemperature(report.Temperature); reason != "" {
+		e.rejectReading(&storage.RejectedReading{DeviceUID: report.DeviceUID, ReadingType: "soil",
+			Reason: reason, Value: tempC, Timestamp: report.Timestamp}, struct {
+			*storage.SoilReport
+			Probes []*storage.SoilMoistureReading `json:"probes"`
+		}{report, readings})
+		return nil
+	}
+
+	valid := readings[:0]
+	for _, r := range readings {
+		if e.validateProbe(cfg, report.DeviceUID, r, report.Timestamp) {
+			valid = append(valid, r)
+		}
+	}
+	return valid
+}
+
+// validateProbe runs the moisture checks on one probe reading, quarantining
+// the reading if it fails
+func (e *Engine) validateProbe(cfg ValidationConfig, deviceUID string, r *storage.SoilMoistureReading, at time.Time) bool {
+	prev, err := e.db.GetLatestSoilMoistureReading(deviceUID, r.ProbeID)
+	if err != nil {
+		log.Printf("Failed to load last reading of %s probe %d: %v", deviceUID, r.ProbeID, err)
+	}
+
+	reason := cfg.checkMoisture(r.MoisturePercent, at, prev)
+	if reason == "" {
+		return true
+	}
+	rejected := &storage.RejectedReading{DeviceUID: deviceUID, ProbeID: r.ProbeID, ReadingType: "soil",
+		Reason: reason, Value: float64(r.MoisturePercent), Timestamp: at}
+	if reason == storage.RejectMoistureStep {
+		previous := float64(prev.MoisturePercent)
+		rejected.Previous = &previous
+	}
+	e.rejectReading(rejected, r)
+	return false
+}
+
+// validateMeterReading checks a water meter reading, whose cumulative total
+// has been reconciled, quarantining it and returning false if it fails
+func (e *Engine) validateMeterReading(r *storage.WaterMeterReading) bool {
+	prev, err := e.db.GetLatestWaterMeterReading(r.DeviceUID)
+	if err != nil {
+		log.Printf("Failed to load last reading of meter %s: %v", r.DeviceUID, err)
+	}
+
+	reason := e.settings().Validation.checkTotalizer(r, prev)
+	if reason == "" {
+		return true
+	}
+	rejected := &storage.RejectedReading{DeviceUID: r.DeviceUID, ReadingType: "meter",
+		Reason: reason, Value: float64(r.TotalVolumeL), Timestamp: r.Timestamp}
+	if reason == storage.RejectTotalizerDecrease {
+		previous := float64(prev.TotalVolumeL)
+		rejected.Previous = &previous
+	}
+	e.rejectReading(rejected, r)
+	return false
+}
+
+// rejectReading stores a reading that failed validation
+func (e *Engine) rejectReading(rejected *storage.RejectedReading, reading interface{}) {
+	if data, err := json.Marshal(reading); err == nil {
+		rejected.Reading = string(data)
+	}
+
+	source := rejected.DeviceUID
+	if rejected.ReadingType == "soil" {
+		source += fmt.Sprintf(" probe %d", rejected.ProbeID)
+	}
+	detail := fmt.Sprintf("%s, value %g", rejected.Reason, rejected.Value)
+	if rejected.Previous != nil {
+		detail += fmt.Sprintf(", last accepted %g", *rejected.Previous)
+	}
+	log.Printf("Rejected %s reading from %s: %s", rejected.ReadingType, source, detail)
+
+	if _, err := e.db.InsertRejectedReading(rejected); err != nil {
+		log.Printf("Failed to store rejected reading: %v", err)
+	}
+}
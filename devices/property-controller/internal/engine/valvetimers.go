@@ -0,0 +1,110 @@
+package engine
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/agsys/property-controller/internal/protocol"
+	"github.com/agsys/property-controller/internal/storage"
+)
+
+// sourceDuration marks the valve events and audit entries of a valve closed
+// because the duration of its open command ran out
+const sourceDuration = "duration"
+
+// startValveTimer schedules the close of a valve opened for a duration. The
+// timer is stored, so it still fires, late if need be, after a restart.
+func (e *Engine) startValveTimer(controllerUID string, addr uint8, duration time.Duration, cloudCommandID string) {
+	timer := &storage.ValveTimer{
+		ControllerUID:  controllerUID,
+		ActuatorAddr:   addr,
+		CloseAt:        time.Now().Add(duration),
+		CloudCommandID: cloudCommandID,
+	}
+	if err := e.db.SetValveTimer(timer); err != nil {
+		log.Printf("Failed to store timer for valve %s addr %d, it will not close by itself: %v",
+			controllerUID, addr, err)
+		return
+	}
+	log.Printf("Valve %s addr %d will close in %s", controllerUID, addr, duration)
+}
+
+// cancelValveTimer drops a valve's pending close. Any command sent to the
+// valve after a timed open supersedes the duration.
+func (e *Engine) cancelValveTimer(controllerUID string, addr uint8) {
+	found, err := e.db.DeleteValveTimer(controllerUID, addr)
+	if err != nil {
+		log.Printf("Failed to cancel timer for valve %s addr %d: %v", controllerUID, addr, err)
+		return
+	}
+	if found {
+		log.Printf("Timer for valve %s addr %d cancelled", controllerUID, addr)
+	}
+}
+
+// valveTimerLoop closes valves whose open duration has run out
+func (e *Engine) valveTimerLoop(ctx context.Context) {
+	defer e.wg.Done()
+
+	const interval = 5 * time.Second
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// Timers that ran out while the controller was down fire at once
+	e.closeTimedValves()
+
+	for {
+		e.beat("valve timers", interval)
+
+		select {
+		case <-e.stopChan:
+			return
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			e.closeTimedValves()
+		}
+	}
+}
+
+// closeTimedValves sends a close command to every valve whose timer is due.
+// Sending the close cancels the timer; one that could not be sent stays and
+// is tried again on the next tick.
+func (e *Engine) closeTimedValves() {
+	now := time.Now()
+	timers, err := e.db.GetDueValveTimers(now)
+	if err != nil {
+		log.Printf("Failed to get valve timers: %v", err)
+		return
+	}
+
+	for _, t := range timers {
+		prevState, _, err := e.db.GetValveActuatorState(t.ControllerUID, t.ActuatorAddr)
+		if err != nil {
+			log.Printf("Failed to get state of valve %s addr %d: %v", t.ControllerUID, t.ActuatorAddr, err)
+		}
+
+		log.Printf("Valve %s addr %d duration ended - closing", t.ControllerUID, t.ActuatorAddr)
+		if err := e.SendValveCommand(t.ControllerUID, t.ActuatorAddr, protocol.ValveCmdClose, sourceRule, sourceDuration); err != nil {
+			log.Printf("Failed to auto-close valve %s addr %d: %v", t.ControllerUID, t.ActuatorAddr, err)
+			continue
+		}
+
+		// Record the close so it reaches the cloud with the valve events
+		event := &storage.ValveEvent{
+			ControllerUID: t.ControllerUID,
+			ActuatorAddr:  t.ActuatorAddr,
+			PrevState:     prevState,
+			NewState:      protocol.ValveStateClosing,
+			Source:        sourceDuration,
+			Timestamp:     now,
+		}
+		id, err := e.db.InsertValveEvent(event)
+		if err != nil {
+			log.Printf("Failed to store valve event: %v", err)
+			continue
+		}
+		e.bus.Valve.publish(ValveChanged{ID: id, Event: event})
+	}
+}
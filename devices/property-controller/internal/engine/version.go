@@ -0,0 +1,46 @@
+package engine
+
+import (
+	"log"
+
+	"github.com/agsys/property-controller/internal/lora"
+)
+
+// loadProtocolVersions restores the protocol version each device last sent,
+// so downlinks after a restart are framed for its firmware
+func (e *Engine) loadProtocolVersions() {
+	versions, err := e.db.GetDeviceProtocolVersions()
+	if err != nil {
+		log.Printf("Failed to load device protocol versions: %v", err)
+		return
+	}
+
+	e.uplinkMu.Lock()
+	defer e.uplinkMu.Unlock()
+	for deviceUID, version := range versions {
+		e.versions[deviceUID] = version
+		if uid, err := lora.ParseDeviceUID(deviceUID); err == nil {
+			e.lora.SetDeviceVersion(uid, version)
+		}
+	}
+}
+
+// recordProtocolVersion notes the protocol version of a device's uplink. A
+// device changes version when a firmware rollout reaches it; the driver then
+// frames its downlinks in the new version.
+func (e *Engine) recordProtocolVersion(deviceUID string, version uint8) {
+	e.uplinkMu.Lock()
+	prev, ok := e.versions[deviceUID]
+	e.versions[deviceUID] = version
+	e.uplinkMu.Unlock()
+
+	if ok && prev == version {
+		return
+	}
+	if ok {
+		log.Printf("Device %s moved from protocol v%d to v%d", deviceUID, prev, version)
+	}
+	if err := e.db.UpdateDeviceProtocolVersion(deviceUID, version); err != nil {
+		log.Printf("Failed to record protocol version of %s: %v", deviceUID, err)
+	}
+}
@@ -0,0 +1,67 @@
+package engine
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/agsys/property-controller/internal/sdnotify"
+)
+
+// loopBeat records when a background loop last ran and how often it should
+type loopBeat struct {
+	last   time.Time
+	period time.Duration
+}
+
+// beat records an iteration of a watched loop
+func (e *Engine) beat(name string, period time.Duration) {
+	e.beatMu.Lock()
+	e.beats[name] = loopBeat{last: time.Now(), period: period}
+	e.beatMu.Unlock()
+}
+
+// stalledLoop returns the name of a watched loop that has missed its
+// schedule by more than grace, or "" if all are running
+func (e *Engine) stalledLoop(now time.Time, grace time.Duration) string {
+	e.beatMu.Lock()
+	defer e.beatMu.Unlock()
+
+	for name, b := range e.beats {
+		if now.Sub(b.last) > b.period+grace {
+			return name
+		}
+	}
+	return ""
+}
+
+// watchdogLoop feeds the systemd watchdog while the main loops are running.
+// If a loop hangs the pings stop and systemd restarts the controller.
+func (e *Engine) watchdogLoop(ctx context.Context) {
+	defer e.wg.Done()
+
+	timeout := e.config.WatchdogInterval
+	ticker := time.NewTicker(timeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.stopChan:
+			return
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if name := e.stalledLoop(now, timeout); name != "" {
+				log.Printf("Watchdog: %s loop stalled, withholding keepalive", name)
+				continue
+			}
+			notify := e.config.WatchdogNotify
+			if notify == nil {
+				notify = sdnotify.Watchdog
+			}
+			if err := notify(); err != nil {
+				log.Printf("Failed to notify watchdog: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/agsys/property-controller/internal/protocol"
+	"github.com/agsys/property-controller/internal/storage"
+	"github.com/agsys/property-controller/internal/weather"
+)
+
+// WeatherConfig controls weather adjustment of watering schedules
+type WeatherConfig struct {
+	OpenWeather   weather.Config // Forecast source (no API key disables adjustment)
+	FetchInterval time.Duration
+	LookBack      time.Duration // Rain already fallen that counts toward a skip
+	LookAhead     time.Duration // Forecast rain and ET0 that count
+	SkipRainMM    float64       // Skip runs when rain in the window reaches this (0 disables)
+	ReduceRainMM  float64       // Shorten runs in proportion to rain between this and SkipRainMM
+	ReferenceET   float64       // Daily ET0 in mm the schedules were written for (0 disables ET scaling)
+	MinScale      float64       // Bounds on ET scaling of run durations
+	MaxScale      float64
+	MaxAge        time.Duration // Older weather is ignored and runs go ahead unchanged
+}
+
+// DefaultWeatherConfig returns default weather adjustment settings
+func DefaultWeatherConfig() WeatherConfig {
+	return WeatherConfig{
+		OpenWeather:   weather.DefaultConfig(),
+		FetchInterval: 1 * time.Hour,
+		LookBack:      24 * time.Hour,
+		LookAhead:     24 * time.Hour,
+		SkipRainMM:    6,
+		ReduceRainMM:  2,
+		MinScale:      0.5,
+		MaxScale:      1.5,
+		MaxAge:        6 * time.Hour,
+	}
+}
+
+// weatherAdjustment is how scheduled runs are changed for the weather
+type weatherAdjustment struct {
+	scale  float64 // Applied to run durations; 0 skips runs
+	reason string  // Empty when runs are unchanged
+}
+
+// noAdjustment leaves runs as scheduled
+var noAdjustment = weatherAdjustment{scale: 1}
+
+// adjustForWeather decides how to change runs given the rain that has fallen
+// and the rain and ET0 forecast. Without recent forecast data runs are left
+// alone, so a weather outage never stops watering.
+func adjustForWeather(cfg WeatherConfig, past, ahead *storage.WeatherTotals, now time.Time) weatherAdjustment {
+	if ahead.Hours == 0 || now.Sub(ahead.UpdatedAt) > cfg.MaxAge {
+		return noAdjustment
+	}
+
+	rain := past.RainMM + ahead.RainMM
+	if cfg.SkipRainMM > 0 && rain >= cfg.SkipRainMM {
+		return weatherAdjustment{reason: fmt.Sprintf("rain %.1f mm", rain)}
+	}
+
+	scale := 1.0
+	var reasons []string
+	if cfg.ReferenceET > 0 {
+		daily := ahead.ETMM * 24 / float64(ahead.Hours)
+		scale = math.Max(cfg.MinScale, math.Min(cfg.MaxScale, daily/cfg.ReferenceET))
+		reasons = append(reasons, fmt.Sprintf("ET0 %.1f mm/day", daily))
+	}
+	if cfg.ReduceRainMM > 0 && cfg.SkipRainMM > cfg.ReduceRainMM && rain >= cfg.ReduceRainMM {
+		scale *= 1 - (rain-cfg.ReduceRainMM)/(cfg.SkipRainMM-cfg.ReduceRainMM)
+		reasons = append(reasons, fmt.Sprintf("rain %.1f mm", rain))
+	}
+
+	if math.Abs(scale-1) < 0.005 {
+		return noAdjustment
+	}
+	return weatherAdjustment{scale: scale, reason: strings.Join(reasons, ", ")}
+}
+
+// String describes the adjustment for logs and valve event notes
+func (a weatherAdjustment) String() string {
+	switch {
+	case a.reason == "":
+		return "no adjustment"
+	case a.scale == 0:
+		return "skip (" + a.reason + ")"
+	default:
+		return fmt.Sprintf("%.0f%% (%s)", a.scale*100, a.reason)
+	}
+}
+
+// adjustedDuration scales a run duration, returning 0 if the run is skipped
+func (a weatherAdjustment) adjustedDuration(mins uint16) uint16 {
+	scaled := math.Round(float64(mins) * a.scale)
+	return uint16(math.Min(scaled, math.MaxUint16))
+}
+
+// currentWeather returns the adjustment to apply to runs now
+func (e *Engine) currentWeather(now time.Time) weatherAdjustment {
+	if e.weather == nil {
+		return noAdjustment
+	}
+
+	cfg := e.settings().Weather
+	hour := now.Truncate(time.Hour)
+	past, err := e.db.GetWeatherTotals(hour.Add(-cfg.LookBack), hour)
+	if err != nil {
+		log.Printf("Failed to read weather: %v", err)
+		return noAdjustment
+	}
+	ahead, err := e.db.GetWeatherTotals(hour, hour.Add(cfg.LookAhead))
+	if err != nil {
+		log.Printf("Failed to read weather: %v", err)
+		return noAdjustment
+	}
+	return adjustForWeather(cfg, past, ahead, now)
+}
+
+// weatherScheduleEntries converts schedule entries for sending, scaling
+// durations for the weather and dropping skipped runs
+func weatherScheduleEntries(entries []storage.ScheduleEntry, adj weatherAdjustment) []protocol.ScheduleEntry {
+	out := make([]protocol.ScheduleEntry, 0, len(entries))
+	for _, e := range entries {
+		duration := adj.adjustedDuration(e.DurationMins)
+		if duration == 0 {
+			continue
+		}
+		out = append(out, protocol.ScheduleEntry{
+			DayMask:      e.DayMask,
+			StartHour:    e.StartHour,
+			StartMinute:  e.StartMinute,
+			DurationMins: duration,
+			ActuatorMask: e.ActuatorMask,
+		})
+	}
+	return out
+}
+
+// weatherLoop fetches the forecast and annotates scheduled runs that the
+// weather changed. Controllers pull their schedules every few minutes, so the
+// adjusted schedule reaches them without a push.
+func (e *Engine) weatherLoop(ctx context.Context) {
+	defer e.wg.Done()
+
+	last := e.fetchWeather(ctx, noAdjustment)
+
+	interval := e.settings().Weather.FetchInterval
+	fetch := time.NewTicker(interval)
+	defer fetch.Stop()
+
+	runs := time.NewTicker(time.Minute)
+	defer runs.Stop()
+	checked := time.Now().Truncate(time.Minute)
+
+	for {
+		select {
+		case <-e.stopChan:
+			return
+		case <-ctx.Done():
+			return
+		case <-e.reloadNotify():
+			if d := e.settings().Weather.FetchInterval; d != interval {
+				interval = d
+				fetch.Reset(interval)
+			}
+		case <-fetch.C:
+			last = e.fetchWeather(ctx, last)
+		case now := <-runs.C:
+			now = now.Truncate(time.Minute)
+			e.annotateWeatherRuns(checked, now)
+			checked = now
+		}
+	}
+}
+
+// fetchWeather stores a new forecast and logs when the adjustment changes
+func (e *Engine) fetchWeather(ctx context.Context, last weatherAdjustment) weatherAdjustment {
+	now := time.Now()
+	hours, err := e.weather.Fetch(ctx)
+	if err != nil {
+		log.Printf("Failed to fetch weather: %v", err)
+	} else {
+		stored := make([]*storage.WeatherHour, len(hours))
+		for i, h := range hours {
+			stored[i] = &storage.WeatherHour{Hour: h.Time, RainMM: h.RainMM, ETMM: h.ETMM, UpdatedAt: now}
+		}
+		if err := e.db.UpsertWeatherHours(stored); err != nil {
+			log.Printf("Failed to store weather: %v", err)
+		}
+		if _, err := e.db.DeleteWeatherHoursBefore(now.Add(-7 * 24 * time.Hour)); err != nil {
+			log.Printf("Failed to prune weather: %v", err)
+		}
+	}
+
+	adj := e.currentWeather(now)
+	if adj != last {
+		log.Printf("Weather adjustment: %s", adj)
+	}
+	return adj
+}
+
+// annotateWeatherRuns records a valve event for each run starting in
+// (from, to] that the weather skipped or shortened
+func (e *Engine) annotateWeatherRuns(from, to time.Time) {
+	// Catch up on a late tick, but not on hours of missed runs
+	if to.Sub(from) > 10*time.Minute {
+		from = to.Add(-10 * time.Minute)
+	}
+
+	adj := e.currentWeather(to)
+	if adj.reason == "" {
+		return
+	}
+
+	schedules, err := e.db.GetActiveSchedules()
+	if err != nil {
+		log.Printf("Failed to get schedules: %v", err)
+		return
+	}
+	for _, s := range schedules {
+		entries, err := e.db.GetScheduleEntries(s.ID)
+		if err != nil {
+			log.Printf("Failed to get entries for schedule %s: %v", s.UID, err)
+			continue
+		}
+		for _, entry := range entries {
+			if !runStartsIn(entry, from, to) {
+				continue
+			}
+
+			note := "skipped for weather: " + adj.reason
+			if d := adj.adjustedDuration(entry.DurationMins); d > 0 {
+				note = fmt.Sprintf("%d of %d min for weather: %s", d, entry.DurationMins, adj.reason)
+			}
+			log.Printf("Schedule %s run at %02d:%02d %s", s.Name, entry.StartHour, entry.StartMinute, note)
+			e.recordWeatherRun(s.ControllerUID, entry.ActuatorMask, note, to)
+		}
+	}
+}
+
+// runStartsIn reports whether a schedule entry starts in (from, to], in
+// local time
+func runStartsIn(entry storage.ScheduleEntry, from, to time.Time) bool {
+	for t := from.Add(time.Minute); !t.After(to); t = t.Add(time.Minute) {
+		t := t.Local()
+		if entry.DayMask&(1<<uint(t.Weekday())) != 0 &&
+			t.Hour() == int(entry.StartHour) && t.Minute() == int(entry.StartMinute) {
+			return true
+		}
+	}
+	return false
+}
+
+// recordWeatherRun stores an annotation event for each actuator in a run.
+// The valve's state is unchanged, so the event repeats the current state.
+func (e *Engine) recordWeatherRun(controllerUID string, actuatorMask uint64, note string, now time.Time) {
+	for addr := uint8(0); addr < 64; addr++ {
+		if actuatorMask&(1<<addr) == 0 {
+			continue
+		}
+		state, _, err := e.db.GetValveActuatorState(controllerUID, addr)
+		if err != nil {
+			log.Printf("Failed to get valve state: %v", err)
+			continue
+		}
+
+		event := &storage.ValveEvent{
+			ControllerUID: controllerUID,
+			ActuatorAddr:  addr,
+			PrevState:     state,
+			NewState:      state,
+			Source:        "weather",
+			Note:          note,
+			Timestamp:     now,
+		}
+		id, err := e.db.InsertValveEvent(event)
+		if err != nil {
+			log.Printf("Failed to store valve event: %v", err)
+			continue
+		}
+		e.bus.Valve.publish(ValveChanged{ID: id, Event: event})
+	}
+}
@@ -0,0 +1,63 @@
+package engine
+
+import (
+	"log"
+	"sort"
+
+	"github.com/agsys/property-controller/internal/storage"
+)
+
+// handleZoneUpdate applies a single zone change from the cloud. Config
+// carries zone_id and name (alias optional), or deleted=true to remove it.
+func (e *Engine) handleZoneUpdate(cfg map[string]string) {
+	zoneID := cfg["zone_id"]
+	if zoneID == "" {
+		log.Printf("Invalid zone update: %v", cfg)
+		return
+	}
+
+	if cfg["deleted"] == "true" {
+		if err := e.db.DeleteZone(zoneID); err != nil {
+			log.Printf("Failed to delete zone %s: %v", zoneID, err)
+			return
+		}
+		log.Printf("Zone %s deleted", zoneID)
+		return
+	}
+
+	if cfg["name"] == "" {
+		log.Printf("Invalid zone update: %v", cfg)
+		return
+	}
+	if err := e.db.UpsertZone(&storage.Zone{
+		UID:        zoneID,
+		PropertyID: e.config.PropertyUID,
+		Name:       cfg["name"],
+		Alias:      cfg["alias"],
+	}); err != nil {
+		log.Printf("Failed to store zone %s: %v", zoneID, err)
+		return
+	}
+	log.Printf("Zone %s updated: %s", zoneID, cfg["name"])
+}
+
+// handleZonesSync replaces all zones with the full list from the cloud.
+// Config maps each zone ID to its name.
+func (e *Engine) handleZonesSync(cfg map[string]string) {
+	zones := make([]*storage.Zone, 0, len(cfg))
+	for zoneID, name := range cfg {
+		if zoneID == "" || name == "" {
+			log.Printf("Skipping invalid zone %q = %q", zoneID, name)
+			continue
+		}
+		zones = append(zones, &storage.Zone{UID: zoneID, PropertyID: e.config.PropertyUID, Name: name})
+	}
+	sort.Slice(zones, func(i, j int) bool { return zones[i].UID < zones[j].UID })
+
+	removed, err := e.db.ReplaceZones(zones)
+	if err != nil {
+		log.Printf("Failed to sync zones: %v", err)
+		return
+	}
+	log.Printf("Synced %d zones from cloud (%d removed)", len(zones), removed)
+}
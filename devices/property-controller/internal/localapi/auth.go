@@ -0,0 +1,103 @@
+package localapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Role is the access level granted to an API token. Each role includes the
+// ones below it.
+type Role string
+
+const (
+	RoleViewer   Role = "viewer"   // Read status, readings, valves, and events
+	RoleOperator Role = "operator" // Also start and cancel OTA updates, and emergency stop and re-arm
+	RoleAdmin    Role = "admin"    // Also reload configuration and rotate keys
+)
+
+// roleRank orders roles from least to most access
+var roleRank = map[Role]int{
+	RoleViewer:   1,
+	RoleOperator: 2,
+	RoleAdmin:    3,
+}
+
+// ParseRole validates a role name
+func ParseRole(s string) (Role, error) {
+	r := Role(strings.ToLower(strings.TrimSpace(s)))
+	if _, ok := roleRank[r]; !ok {
+		return "", fmt.Errorf("invalid role %q (use viewer, operator, or admin)", s)
+	}
+	return r, nil
+}
+
+// Allows reports whether the role includes the access of need
+func (r Role) Allows(need Role) bool {
+	return roleRank[r] >= roleRank[need]
+}
+
+// ErrInvalidToken is returned by a TokenService for unknown tokens
+var ErrInvalidToken = errors.New("invalid API token")
+
+// TokenService checks API tokens
+type TokenService interface {
+	// Authenticate returns the name and role of a token
+	Authenticate(token string) (name string, role Role, err error)
+}
+
+// principalKey carries the authenticated token name in a request context
+type principalKey struct{}
+
+// networkKey marks requests that arrived on the TCP listener
+type networkKey struct{}
+
+// Principal returns the name of the token a request was made with, or ""
+// for an anonymous request on the unix socket
+func Principal(r *http.Request) string {
+	name, _ := r.Context().Value(principalKey{}).(string)
+	return name
+}
+
+// route registers a handler that requires at least the given role
+func (s *Server) route(mux *http.ServeMux, pattern string, need Role, handler http.HandlerFunc) {
+	mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		name, role, err := s.authenticate(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="agsys"`)
+			writeError(w, http.StatusUnauthorized, err)
+			return
+		}
+		if !role.Allows(need) {
+			writeError(w, http.StatusForbidden, fmt.Errorf("%s requires the %s role", r.URL.Path, need))
+			return
+		}
+		if name != "" {
+			r = r.WithContext(context.WithValue(r.Context(), principalKey{}, name))
+		}
+		handler(w, r)
+	})
+}
+
+// authenticate resolves the bearer token of a request. Requests without a
+// token are viewers on the unix socket, whose file permissions already limit
+// who can connect, and are refused on the network listener.
+func (s *Server) authenticate(r *http.Request) (string, Role, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		if r.Context().Value(networkKey{}) != nil {
+			return "", "", errors.New("an API token is required")
+		}
+		return "", RoleViewer, nil
+	}
+	if s.tokens == nil {
+		return "", "", errors.New("API tokens are not supported")
+	}
+	name, role, err := s.tokens.Authenticate(token)
+	if err != nil {
+		return "", "", err
+	}
+	return name, role, nil
+}
@@ -0,0 +1,275 @@
+package localapi
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client talks to a running controller over its unix socket
+type Client struct {
+	http  *http.Client
+	token string
+}
+
+// NewClient creates a client for the socket at socketPath
+func NewClient(socketPath string) *Client {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socketPath)
+		},
+	}
+	return &Client{
+		http: &http.Client{
+			Transport: transport,
+			Timeout:   10 * time.Second,
+		},
+	}
+}
+
+// SetToken sets the API token sent with each request. Requests that change
+// state need a token with a sufficient role.
+func (c *Client) SetToken(token string) {
+	c.token = token
+}
+
+// Status returns the health of the running controller
+func (c *Client) Status() (*StatusResponse, error) {
+	var resp StatusResponse
+	if err := c.do(http.MethodGet, "/status", &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// OTAStatus returns the status of all OTA updates
+func (c *Client) OTAStatus() (*OTAStatusResponse, error) {
+	var resp OTAStatusResponse
+	if err := c.do(http.MethodGet, "/ota/status", &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// OTAListFirmware returns the firmware images cached on the controller
+func (c *Client) OTAListFirmware() ([]FirmwareEntry, error) {
+	var resp []FirmwareEntry
+	if err := c.do(http.MethodGet, "/ota/firmware", &resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// OTAStart queues an OTA update for a device
+func (c *Client) OTAStart(deviceUID string) error {
+	return c.do(http.MethodPost, "/ota/start/"+url.PathEscape(deviceUID), nil)
+}
+
+// OTACancel cancels a pending or active OTA update for a device
+func (c *Client) OTACancel(deviceUID string) error {
+	return c.do(http.MethodPost, "/ota/cancel/"+url.PathEscape(deviceUID), nil)
+}
+
+// OTAMulticast starts a multicast OTA session for every device of a type
+// that joins within the listen window
+func (c *Client) OTAMulticast(deviceType uint8, listen time.Duration) (*OTAMulticastStatus, error) {
+	var resp OTAMulticastStatus
+	path := fmt.Sprintf("/ota/multicast/%d?listen=%s", deviceType, url.QueryEscape(listen.String()))
+	if err := c.do(http.MethodPost, path, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Reload asks the controller to reload its configuration file
+func (c *Client) Reload() error {
+	return c.do(http.MethodPost, "/reload", nil)
+}
+
+// SoilRollups returns hourly or daily soil rollups for the last days.
+// An empty deviceUID returns all devices.
+func (c *Client) SoilRollups(deviceUID, period string, days int) ([]SoilRollup, error) {
+	var resp []SoilRollup
+	if err := c.do(http.MethodGet, "/rollups/soil?"+rollupParams(deviceUID, period, days), &resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// MeterRollups returns hourly or daily meter rollups for the last days.
+// An empty deviceUID returns all devices.
+func (c *Client) MeterRollups(deviceUID, period string, days int) ([]MeterRollup, error) {
+	var resp []MeterRollup
+	if err := c.do(http.MethodGet, "/rollups/meter?"+rollupParams(deviceUID, period, days), &resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// DeviceKeys returns the key state of devices that have rotated keys
+func (c *Client) DeviceKeys() ([]DeviceKeyStatus, error) {
+	var resp []DeviceKeyStatus
+	if err := c.do(http.MethodGet, "/keys", &resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// RotateDeviceKey starts delivering a new LoRa key to a device
+func (c *Client) RotateDeviceKey(deviceUID string) error {
+	return c.do(http.MethodPost, "/keys/rotate/"+url.PathEscape(deviceUID), nil)
+}
+
+// Valves returns the valve actuators and their names
+func (c *Client) Valves() ([]Valve, error) {
+	var resp []Valve
+	if err := c.do(http.MethodGet, "/valves", &resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// SchedulePreview returns the valve activity expected from the active
+// schedules over the coming days
+func (c *Client) SchedulePreview(days int) (*SchedulePreview, error) {
+	var resp SchedulePreview
+	if err := c.do(http.MethodGet, fmt.Sprintf("/schedules/preview?days=%d", days), &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Recommendations returns when each zone is expected to need water
+func (c *Client) Recommendations() ([]ZoneRecommendation, error) {
+	var resp []ZoneRecommendation
+	if err := c.do(http.MethodGet, "/zones/recommendations", &resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// EmergencyStop closes every valve and holds them closed until
+// RearmEmergencyStop, returning the number of close commands sent
+func (c *Client) EmergencyStop(reason string) (int, error) {
+	var resp EmergencyStopResponse
+	if err := c.do(http.MethodPost, "/emergency-stop?"+url.Values{"reason": {reason}}.Encode(), &resp); err != nil {
+		return 0, err
+	}
+	return resp.ValvesClosed, nil
+}
+
+// RearmEmergencyStop ends the emergency stop in force
+func (c *Client) RearmEmergencyStop() error {
+	return c.do(http.MethodPost, "/emergency-stop/rearm", nil)
+}
+
+// Events streams live events to fn until ctx is cancelled or the controller
+// closes the stream. Empty types and deviceUID match everything.
+func (c *Client) Events(ctx context.Context, types []string, deviceUID string, fn func(Event)) error {
+	v := url.Values{}
+	if len(types) > 0 {
+		v.Set("type", strings.Join(types, ","))
+	}
+	if deviceUID != "" {
+		v.Set("device", deviceUID)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://controller/events?"+v.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	c.authorize(req)
+
+	// The stream stays open, so it can't share the request timeout
+	stream := &http.Client{Transport: c.http.Transport}
+	resp, err := stream.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach controller (is it running?): %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var ev Event
+		if err := json.Unmarshal([]byte(data), &ev); err != nil {
+			return fmt.Errorf("failed to decode event: %w", err)
+		}
+		fn(ev)
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return errors.New("controller closed the event stream")
+}
+
+func rollupParams(deviceUID, period string, days int) string {
+	v := url.Values{}
+	v.Set("period", period)
+	v.Set("days", strconv.Itoa(days))
+	if deviceUID != "" {
+		v.Set("device", deviceUID)
+	}
+	return v.Encode()
+}
+
+func (c *Client) do(method, path string, out interface{}) error {
+	req, err := http.NewRequest(method, "http://controller"+path, nil)
+	if err != nil {
+		return err
+	}
+	c.authorize(req)
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach controller (is it running?): %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	return nil
+}
+
+// authorize adds the API token, if any, to a request
+func (c *Client) authorize(req *http.Request) {
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+}
+
+// responseError turns a failed response into the error the server reported
+func responseError(resp *http.Response) error {
+	var result ResultResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err == nil && result.Error != "" {
+		return fmt.Errorf("%s", result.Error)
+	}
+	return fmt.Errorf("controller returned %s", resp.Status)
+}
@@ -0,0 +1,176 @@
+package localapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// eventBuffer is how far a subscriber may fall behind before events
+	// are dropped for it
+	eventBuffer = 256
+	// eventKeepalive is how often an idle stream gets a comment line, so
+	// clients and proxies can tell it is still alive
+	eventKeepalive = 15 * time.Second
+)
+
+// eventSubscriber is one open /events stream
+type eventSubscriber struct {
+	ch      chan Event
+	dropped int // Events lost because ch was full, guarded by eventHub.mu
+}
+
+// eventHub fans published events out to /events subscribers
+type eventHub struct {
+	mu     sync.Mutex
+	subs   map[*eventSubscriber]struct{}
+	closed bool
+}
+
+// subscribe registers a new stream, or returns nil once the server stops
+func (h *eventHub) subscribe() *eventSubscriber {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return nil
+	}
+	if h.subs == nil {
+		h.subs = make(map[*eventSubscriber]struct{})
+	}
+	sub := &eventSubscriber{ch: make(chan Event, eventBuffer)}
+	h.subs[sub] = struct{}{}
+	return sub
+}
+
+func (h *eventHub) unsubscribe(sub *eventSubscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.subs[sub]; ok {
+		delete(h.subs, sub)
+		close(sub.ch)
+	}
+}
+
+// takeDropped returns and resets the number of events a subscriber missed
+func (h *eventHub) takeDropped(sub *eventSubscriber) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	n := sub.dropped
+	sub.dropped = 0
+	return n
+}
+
+// publish delivers an event to every subscriber without blocking
+func (h *eventHub) publish(ev Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for sub := range h.subs {
+		select {
+		case sub.ch <- ev:
+		default:
+			sub.dropped++
+		}
+	}
+}
+
+// close ends all streams so the HTTP server can shut down
+func (h *eventHub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closed = true
+	for sub := range h.subs {
+		delete(h.subs, sub)
+		close(sub.ch)
+	}
+}
+
+// Publish pushes an event to clients streaming GET /events. It never blocks;
+// clients that fall too far behind miss events and are told how many.
+func (s *Server) Publish(ev Event) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	s.events.publish(ev)
+}
+
+// handleEvents streams events as server-sent events. ?type= takes a comma
+// separated list of event types and ?device= a device UID to filter on.
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, errors.New("streaming is not supported"))
+		return
+	}
+
+	types := make(map[string]bool)
+	if v := r.URL.Query().Get("type"); v != "" {
+		for _, t := range strings.Split(v, ",") {
+			types[strings.TrimSpace(t)] = true
+		}
+	}
+	device := r.URL.Query().Get("device")
+
+	sub := s.events.subscribe()
+	if sub == nil {
+		writeError(w, http.StatusServiceUnavailable, errors.New("server is shutting down"))
+		return
+	}
+	defer s.events.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(eventKeepalive)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case ev, ok := <-sub.ch:
+			if !ok {
+				return
+			}
+			if n := s.events.takeDropped(sub); n > 0 {
+				writeEvent(w, Event{Type: EventDropped, Time: time.Now(), Data: map[string]int{"count": n}})
+			}
+			if len(types) > 0 && !types[ev.Type] {
+				continue
+			}
+			if device != "" && ev.DeviceUID != device {
+				continue
+			}
+			if err := writeEvent(w, ev); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// writeEvent writes one event in server-sent events framing
+func writeEvent(w http.ResponseWriter, ev Event) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data)
+	return err
+}
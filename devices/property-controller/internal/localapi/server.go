@@ -0,0 +1,599 @@
+// Package localapi provides a local HTTP API over a unix socket, and
+// optionally TCP, so that on-site tools can query and drive the running
+// controller without the cloud.
+package localapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/agsys/property-controller/internal/ota"
+)
+
+// Config holds local API configuration
+type Config struct {
+	SocketPath string      // Unix socket path
+	SocketMode os.FileMode // Permissions applied to the socket file
+	Listen     string      // TCP address for network clients, e.g. ":8443" (empty disables)
+	TLSCert    string      // Certificate and key for Listen; plain HTTP without them
+	TLSKey     string
+}
+
+// DefaultConfig returns default local API configuration
+func DefaultConfig() Config {
+	return Config{
+		SocketPath: "/run/agsys/controller.sock",
+		SocketMode: 0660,
+	}
+}
+
+// OTAService is the subset of controller operations exposed for OTA
+type OTAService interface {
+	GetUpdateStatus() map[string]*ota.DeviceUpdate
+	GetPendingDevices() []string
+	ListFirmware() []*ota.FirmwareInfo
+	StartOTAUpdate(deviceUID, actor string) error
+	CancelOTAUpdate(deviceUID, actor string) error
+	MulticastStatus() *ota.MulticastSession
+	StartOTAMulticast(deviceType uint8, listen time.Duration, actor string) (*ota.MulticastSession, error)
+}
+
+// StatusService reports controller health. The OTA section is filled in by
+// the server from the OTAService.
+type StatusService interface {
+	Status() (*StatusResponse, error)
+}
+
+// RollupService serves aggregated readings for charts
+type RollupService interface {
+	SoilRollups(deviceUID, period string, since time.Time) ([]SoilRollup, error)
+	MeterRollups(deviceUID, period string, since time.Time) ([]MeterRollup, error)
+}
+
+// KeyService rotates per-device LoRa keys
+type KeyService interface {
+	DeviceKeys() ([]DeviceKeyStatus, error)
+	RotateDeviceKey(deviceUID string) error
+}
+
+// ValveService lists valve actuators
+type ValveService interface {
+	Valves() ([]Valve, error)
+}
+
+// ScheduleService previews the valve activity of the active schedules
+type ScheduleService interface {
+	SchedulePreview(days int) (*SchedulePreview, error)
+}
+
+// RecommendationService predicts when each zone needs water
+type RecommendationService interface {
+	Recommendations() ([]ZoneRecommendation, error)
+}
+
+// EmergencyService closes every valve and holds them closed until re-armed.
+// The actor is the name of the API token used, if any.
+type EmergencyService interface {
+	EmergencyStop(actor, reason string) (int, error)
+	RearmEmergencyStop(actor string) error
+}
+
+// Server serves the local API on a unix socket, and on TCP if configured
+type Server struct {
+	config   Config
+	ota      OTAService
+	status   StatusService
+	rollups  RollupService
+	keys     KeyService
+	valves   ValveService
+	schedule ScheduleService
+	drydown  RecommendationService
+	estop    EmergencyService
+	tokens   TokenService
+	reload   func() error
+	events   eventHub
+	listener net.Listener
+	http     *http.Server
+	network  *http.Server // Serves Listen, nil when disabled
+}
+
+// NewServer creates a new local API server
+func NewServer(config Config, otaService OTAService, statusService StatusService) *Server {
+	s := &Server{
+		config: config,
+		ota:    otaService,
+		status: statusService,
+	}
+
+	mux := http.NewServeMux()
+	s.route(mux, "GET /status", RoleViewer, s.handleStatus)
+	s.route(mux, "GET /ota/status", RoleViewer, s.handleOTAStatus)
+	s.route(mux, "GET /ota/firmware", RoleViewer, s.handleOTAFirmware)
+	s.route(mux, "POST /ota/start/{uid}", RoleOperator, s.handleOTAStart)
+	s.route(mux, "POST /ota/cancel/{uid}", RoleOperator, s.handleOTACancel)
+	s.route(mux, "POST /ota/multicast/{type}", RoleOperator, s.handleOTAMulticast)
+	s.route(mux, "POST /reload", RoleAdmin, s.handleReload)
+	s.route(mux, "GET /rollups/soil", RoleViewer, s.handleSoilRollups)
+	s.route(mux, "GET /rollups/meter", RoleViewer, s.handleMeterRollups)
+	s.route(mux, "GET /keys", RoleViewer, s.handleKeys)
+	s.route(mux, "POST /keys/rotate/{uid}", RoleAdmin, s.handleKeyRotate)
+	s.route(mux, "GET /valves", RoleViewer, s.handleValves)
+	s.route(mux, "GET /schedules/preview", RoleViewer, s.handleSchedulePreview)
+	s.route(mux, "GET /zones/recommendations", RoleViewer, s.handleRecommendations)
+	s.route(mux, "POST /emergency-stop", RoleOperator, s.handleEmergencyStop)
+	s.route(mux, "POST /emergency-stop/rearm", RoleOperator, s.handleEmergencyRearm)
+	s.route(mux, "GET /events", RoleViewer, s.handleEvents)
+
+	s.http = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	if config.Listen != "" {
+		s.network = &http.Server{
+			Addr:              config.Listen,
+			Handler:           mux,
+			ReadHeaderTimeout: 5 * time.Second,
+			BaseContext: func(net.Listener) context.Context {
+				return context.WithValue(context.Background(), networkKey{}, true)
+			},
+		}
+	}
+	return s
+}
+
+// SetReloadHandler sets the function called by POST /reload
+func (s *Server) SetReloadHandler(fn func() error) {
+	s.reload = fn
+}
+
+// SetRollupService sets the service behind GET /rollups
+func (s *Server) SetRollupService(rollups RollupService) {
+	s.rollups = rollups
+}
+
+// SetKeyService sets the service behind /keys
+func (s *Server) SetKeyService(keys KeyService) {
+	s.keys = keys
+}
+
+// SetValveService sets the service behind GET /valves
+func (s *Server) SetValveService(valves ValveService) {
+	s.valves = valves
+}
+
+// SetScheduleService sets the service behind GET /schedules/preview
+func (s *Server) SetScheduleService(schedule ScheduleService) {
+	s.schedule = schedule
+}
+
+// SetRecommendationService sets the service behind GET /zones/recommendations
+func (s *Server) SetRecommendationService(drydown RecommendationService) {
+	s.drydown = drydown
+}
+
+// SetEmergencyService sets the service behind /emergency-stop
+func (s *Server) SetEmergencyService(estop EmergencyService) {
+	s.estop = estop
+}
+
+// SetTokenService sets the service that checks bearer tokens
+func (s *Server) SetTokenService(tokens TokenService) {
+	s.tokens = tokens
+}
+
+// Start begins listening on the unix socket
+func (s *Server) Start() error {
+	if err := os.MkdirAll(filepath.Dir(s.config.SocketPath), 0755); err != nil {
+		return fmt.Errorf("failed to create socket directory: %w", err)
+	}
+
+	// Remove a stale socket left by a previous run
+	if err := os.Remove(s.config.SocketPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove stale socket: %w", err)
+	}
+
+	listener, err := net.Listen("unix", s.config.SocketPath)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.config.SocketPath, err)
+	}
+	if err := os.Chmod(s.config.SocketPath, s.config.SocketMode); err != nil {
+		listener.Close()
+		return fmt.Errorf("failed to set socket permissions: %w", err)
+	}
+	s.listener = listener
+
+	go func() {
+		if err := s.http.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Local API server error: %v", err)
+		}
+	}()
+
+	log.Printf("Local API listening on %s", s.config.SocketPath)
+
+	if s.network != nil {
+		if err := s.startNetwork(); err != nil {
+			s.http.Close()
+			os.Remove(s.config.SocketPath)
+			return err
+		}
+	}
+	return nil
+}
+
+// startNetwork begins listening on the TCP address. Every request there needs
+// an API token.
+func (s *Server) startNetwork() error {
+	listener, err := net.Listen("tcp", s.config.Listen)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.config.Listen, err)
+	}
+
+	useTLS := s.config.TLSCert != "" && s.config.TLSKey != ""
+	go func() {
+		var err error
+		if useTLS {
+			err = s.network.ServeTLS(listener, s.config.TLSCert, s.config.TLSKey)
+		} else {
+			err = s.network.Serve(listener)
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Local API network server error: %v", err)
+		}
+	}()
+
+	if useTLS {
+		log.Printf("Local API listening on %s (TLS)", listener.Addr())
+	} else {
+		log.Printf("Local API listening on %s without TLS; tokens are sent in the clear", listener.Addr())
+	}
+	return nil
+}
+
+// Stop shuts down the server and removes the socket
+func (s *Server) Stop() error {
+	if s.listener == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Event streams never finish on their own
+	s.events.close()
+	err := s.http.Shutdown(ctx)
+	if s.network != nil {
+		if nerr := s.network.Shutdown(ctx); err == nil {
+			err = nerr
+		}
+	}
+	os.Remove(s.config.SocketPath)
+	return err
+}
+
+// --- OTA Handlers ---
+
+func (s *Server) handleOTAStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.otaStatus(false))
+}
+
+// otaStatus collects OTA progress, optionally skipping finished updates
+func (s *Server) otaStatus(activeOnly bool) OTAStatusResponse {
+	status := OTAStatusResponse{
+		Updates: []OTAUpdateStatus{},
+		Pending: s.ota.GetPendingDevices(),
+	}
+
+	for _, u := range s.ota.GetUpdateStatus() {
+		if activeOnly && !u.State.IsActive() {
+			continue
+		}
+		status.Updates = append(status.Updates, OTAUpdateStatus{
+			DeviceUID:      u.DeviceUID,
+			DeviceType:     u.DeviceType,
+			CurrentVersion: u.CurrentVersion.String(),
+			TargetVersion:  u.TargetVersion.String(),
+			State:          u.State.String(),
+			ChunksSent:     u.ChunksSent,
+			ChunksAcked:    u.ChunksAcked,
+			TotalChunks:    u.TotalChunks,
+			ErrorMessage:   u.ErrorMessage,
+			StartedAt:      u.StartedAt,
+			LastActivity:   u.LastActivity,
+			CompletedAt:    u.CompletedAt,
+		})
+	}
+	sort.Slice(status.Updates, func(i, j int) bool {
+		return status.Updates[i].DeviceUID < status.Updates[j].DeviceUID
+	})
+	sort.Strings(status.Pending)
+
+	// A finished session is only of interest in the full status
+	if session := s.ota.MulticastStatus(); session != nil && (!activeOnly || session.State != ota.MulticastComplete) {
+		status.Multicast = multicastStatus(session)
+	}
+	return status
+}
+
+// multicastStatus converts a multicast session for the API
+func multicastStatus(session *ota.MulticastSession) *OTAMulticastStatus {
+	return &OTAMulticastStatus{
+		SessionID:     session.ID,
+		DeviceType:    session.DeviceType,
+		TargetVersion: session.TargetVersion.String(),
+		State:         session.State.String(),
+		Members:       append([]string{}, session.Members...),
+		ChunksSent:    session.ChunksSent,
+		TotalChunks:   session.TotalChunks,
+		StartedAt:     session.StartedAt,
+		ListenUntil:   session.ListenUntil,
+		CompletedAt:   session.CompletedAt,
+	}
+}
+
+func (s *Server) handleOTAFirmware(w http.ResponseWriter, r *http.Request) {
+	firmware := []FirmwareEntry{}
+	for _, fw := range s.ota.ListFirmware() {
+		firmware = append(firmware, FirmwareEntry{
+			DeviceType: fw.DeviceType,
+			Version:    fw.Version.String(),
+			Size:       fw.Size,
+			CRC32:      fw.CRC32,
+			ChunkCount: fw.ChunkCount,
+			FilePath:   fw.FilePath,
+		})
+	}
+	sort.Slice(firmware, func(i, j int) bool {
+		return firmware[i].DeviceType < firmware[j].DeviceType
+	})
+
+	writeJSON(w, http.StatusOK, firmware)
+}
+
+func (s *Server) handleOTAStart(w http.ResponseWriter, r *http.Request) {
+	uid := r.PathValue("uid")
+	if err := s.ota.StartOTAUpdate(uid, Principal(r)); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, ResultResponse{Success: true})
+}
+
+func (s *Server) handleOTACancel(w http.ResponseWriter, r *http.Request) {
+	uid := r.PathValue("uid")
+	if err := s.ota.CancelOTAUpdate(uid, Principal(r)); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, ResultResponse{Success: true})
+}
+
+func (s *Server) handleOTAMulticast(w http.ResponseWriter, r *http.Request) {
+	deviceType, err := strconv.ParseUint(r.PathValue("type"), 10, 8)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid device type %q", r.PathValue("type")))
+		return
+	}
+	listen := 2 * time.Minute
+	if v := r.URL.Query().Get("listen"); v != "" {
+		if listen, err = time.ParseDuration(v); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid listen window %q", v))
+			return
+		}
+	}
+
+	session, err := s.ota.StartOTAMulticast(uint8(deviceType), listen, Principal(r))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, multicastStatus(session))
+}
+
+// --- Control Handlers ---
+
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	status, err := s.status.Status()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	status.OTA = s.otaStatus(true)
+	writeJSON(w, http.StatusOK, status)
+}
+
+func (s *Server) handleReload(w http.ResponseWriter, r *http.Request) {
+	if s.reload == nil {
+		writeError(w, http.StatusNotImplemented, errors.New("reload is not supported"))
+		return
+	}
+	if err := s.reload(); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, ResultResponse{Success: true})
+}
+
+// --- Rollup Handlers ---
+
+// rollupQuery parses ?period=hour|day&days=N&device=UID
+func rollupQuery(r *http.Request) (deviceUID, period string, since time.Time, err error) {
+	period = r.URL.Query().Get("period")
+	switch period {
+	case "":
+		period = "hour"
+	case "hour", "day":
+	default:
+		return "", "", since, fmt.Errorf("invalid period %q (use hour or day)", period)
+	}
+
+	days := 7
+	if v := r.URL.Query().Get("days"); v != "" {
+		if days, err = strconv.Atoi(v); err != nil || days <= 0 {
+			return "", "", since, fmt.Errorf("invalid days %q", v)
+		}
+	}
+	return r.URL.Query().Get("device"), period, time.Now().AddDate(0, 0, -days), nil
+}
+
+func (s *Server) handleSoilRollups(w http.ResponseWriter, r *http.Request) {
+	if s.rollups == nil {
+		writeError(w, http.StatusNotImplemented, errors.New("rollups are not supported"))
+		return
+	}
+	deviceUID, period, since, err := rollupQuery(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	rollups, err := s.rollups.SoilRollups(deviceUID, period, since)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, rollups)
+}
+
+func (s *Server) handleMeterRollups(w http.ResponseWriter, r *http.Request) {
+	if s.rollups == nil {
+		writeError(w, http.StatusNotImplemented, errors.New("rollups are not supported"))
+		return
+	}
+	deviceUID, period, since, err := rollupQuery(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	rollups, err := s.rollups.MeterRollups(deviceUID, period, since)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, rollups)
+}
+
+// --- Key Handlers ---
+
+func (s *Server) handleKeys(w http.ResponseWriter, r *http.Request) {
+	if s.keys == nil {
+		writeError(w, http.StatusNotImplemented, errors.New("key rotation is not supported"))
+		return
+	}
+	keys, err := s.keys.DeviceKeys()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, keys)
+}
+
+func (s *Server) handleKeyRotate(w http.ResponseWriter, r *http.Request) {
+	if s.keys == nil {
+		writeError(w, http.StatusNotImplemented, errors.New("key rotation is not supported"))
+		return
+	}
+	if err := s.keys.RotateDeviceKey(r.PathValue("uid")); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, ResultResponse{Success: true})
+}
+
+func (s *Server) handleValves(w http.ResponseWriter, r *http.Request) {
+	if s.valves == nil {
+		writeError(w, http.StatusNotImplemented, errors.New("valve listing is not supported"))
+		return
+	}
+	valves, err := s.valves.Valves()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, valves)
+}
+
+// MaxPreviewDays is the longest schedule preview served
+const MaxPreviewDays = 31
+
+func (s *Server) handleSchedulePreview(w http.ResponseWriter, r *http.Request) {
+	if s.schedule == nil {
+		writeError(w, http.StatusNotImplemented, errors.New("schedule preview is not supported"))
+		return
+	}
+	days := 7
+	if v := r.URL.Query().Get("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > MaxPreviewDays {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid days %q (1-%d)", v, MaxPreviewDays))
+			return
+		}
+		days = n
+	}
+	preview, err := s.schedule.SchedulePreview(days)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, preview)
+}
+
+func (s *Server) handleRecommendations(w http.ResponseWriter, r *http.Request) {
+	if s.drydown == nil {
+		writeError(w, http.StatusNotImplemented, errors.New("irrigation recommendations are not supported"))
+		return
+	}
+	recommendations, err := s.drydown.Recommendations()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, recommendations)
+}
+
+// --- Emergency Stop Handlers ---
+
+func (s *Server) handleEmergencyStop(w http.ResponseWriter, r *http.Request) {
+	if s.estop == nil {
+		writeError(w, http.StatusNotImplemented, errors.New("emergency stop is not supported"))
+		return
+	}
+	closed, err := s.estop.EmergencyStop(Principal(r), r.URL.Query().Get("reason"))
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, EmergencyStopResponse{ValvesClosed: closed, Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, EmergencyStopResponse{Success: true, ValvesClosed: closed})
+}
+
+func (s *Server) handleEmergencyRearm(w http.ResponseWriter, r *http.Request) {
+	if s.estop == nil {
+		writeError(w, http.StatusNotImplemented, errors.New("emergency stop is not supported"))
+		return
+	}
+	if err := s.estop.RearmEmergencyStop(Principal(r)); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, ResultResponse{Success: true})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Local API: failed to encode response: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, ResultResponse{Success: false, Error: err.Error()})
+}
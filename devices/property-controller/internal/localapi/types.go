@@ -0,0 +1,304 @@
+package localapi
+
+import "time"
+
+// ResultResponse is returned by operations that don't produce data
+type ResultResponse struct {
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+// OTAUpdateStatus describes the OTA progress of a single device
+type OTAUpdateStatus struct {
+	DeviceUID      string    `json:"device_uid"`
+	DeviceType     uint8     `json:"device_type"`
+	CurrentVersion string    `json:"current_version"`
+	TargetVersion  string    `json:"target_version"`
+	State          string    `json:"state"`
+	ChunksSent     uint16    `json:"chunks_sent"`
+	ChunksAcked    uint16    `json:"chunks_acked"`
+	TotalChunks    uint16    `json:"total_chunks"`
+	ErrorMessage   string    `json:"error_message,omitempty"`
+	StartedAt      time.Time `json:"started_at"`
+	LastActivity   time.Time `json:"last_activity"`
+	CompletedAt    time.Time `json:"completed_at"`
+}
+
+// OTAStatusResponse lists active updates and devices waiting to start
+type OTAStatusResponse struct {
+	Updates   []OTAUpdateStatus   `json:"updates"`
+	Pending   []string            `json:"pending"`
+	Multicast *OTAMulticastStatus `json:"multicast,omitempty"` // Latest multicast session
+}
+
+// OTAMulticastStatus describes a multicast OTA session
+type OTAMulticastStatus struct {
+	SessionID     uint8     `json:"session_id"`
+	DeviceType    uint8     `json:"device_type"`
+	TargetVersion string    `json:"target_version"`
+	State         string    `json:"state"`
+	Members       []string  `json:"members"`
+	ChunksSent    uint16    `json:"chunks_sent"` // Chunks broadcast so far
+	TotalChunks   uint16    `json:"total_chunks"`
+	StartedAt     time.Time `json:"started_at"`
+	ListenUntil   time.Time `json:"listen_until"`
+	CompletedAt   time.Time `json:"completed_at"`
+}
+
+// FirmwareEntry describes a cached firmware image
+type FirmwareEntry struct {
+	DeviceType uint8  `json:"device_type"`
+	Version    string `json:"version"`
+	Size       uint32 `json:"size"`
+	CRC32      uint32 `json:"crc32"`
+	ChunkCount uint16 `json:"chunk_count"`
+	FilePath   string `json:"file_path"`
+}
+
+// StatusResponse summarizes the health of the running controller
+type StatusResponse struct {
+	ControllerID    string            `json:"controller_id"`
+	FirmwareVersion string            `json:"firmware_version"`
+	StartedAt       time.Time         `json:"started_at"`
+	Cloud           CloudStatus       `json:"cloud"`
+	LoRa            LoRaStatus        `json:"lora"`
+	Devices         map[string]int    `json:"devices"` // Count by device type
+	Unsynced        UnsyncedCounts    `json:"unsynced"`
+	Commands        CommandCounts     `json:"commands"`
+	OTA             OTAStatusResponse `json:"ota"` // Active updates only
+	Lifetime        LifetimeCounts    `json:"lifetime"`
+	Reboots         []DeviceReboots   `json:"reboots,omitempty"` // Devices that rebooted unexpectedly over the last day
+
+	EmergencyStop *EmergencyStopStatus `json:"emergency_stop,omitempty"` // Set while one is in force
+}
+
+// DeviceReboots counts a device's unexpected reboots, e.g. brown-outs or
+// watchdog resets, seen from the uptime in its heartbeats
+type DeviceReboots struct {
+	DeviceUID  string `json:"device_uid"`
+	Unexpected int    `json:"unexpected"`
+}
+
+// EmergencyStopStatus describes the emergency stop in force
+type EmergencyStopStatus struct {
+	StoppedAt    time.Time `json:"stopped_at"`
+	Source       string    `json:"source"`
+	Actor        string    `json:"actor,omitempty"`
+	Reason       string    `json:"reason,omitempty"`
+	ValvesClosed int       `json:"valves_closed"`
+}
+
+// EmergencyStopResponse is the result of POST /emergency-stop
+type EmergencyStopResponse struct {
+	Success      bool   `json:"success"`
+	ValvesClosed int    `json:"valves_closed"` // Close commands sent
+	Error        string `json:"error,omitempty"`
+}
+
+// CloudStatus describes the backend connection
+type CloudStatus struct {
+	Connected  bool   `json:"connected"`
+	ServerAddr string `json:"server_addr"`
+
+	// Why the last connection attempt failed, while disconnected: dns,
+	// connect, proxy, portal, tls, auth or backend
+	Failure string `json:"failure,omitempty"`
+	Error   string `json:"error,omitempty"`
+
+	LowBandwidth bool       `json:"low_bandwidth"`
+	Usage        CloudUsage `json:"usage"` // This month so far
+}
+
+// CloudUsage is the traffic exchanged with the cloud in a calendar month,
+// counted as gRPC messages without HTTP/2 or TLS overhead
+type CloudUsage struct {
+	Month     string `json:"month"` // "YYYY-MM", local time
+	BytesUp   int64  `json:"bytes_up"`
+	BytesDown int64  `json:"bytes_down"`
+}
+
+// LoRaStatus describes the LoRa driver
+type LoRaStatus struct {
+	Running   bool      `json:"running"`
+	Frequency uint32    `json:"frequency"`
+	RxPackets uint64    `json:"rx_packets"`
+	TxPackets uint64    `json:"tx_packets"`
+	TxErrors  uint64    `json:"tx_errors"`
+	TxSkipped uint64    `json:"tx_skipped"` // Downlinks skipped as LBT found the channel busy
+	TxQueued  int       `json:"tx_queued"`
+	TxWindow  int       `json:"tx_window"` // Downlinks held for devices' next uplinks
+	Legacy    int       `json:"legacy"`    // Devices still on the network key while migrating to device keys
+	LastRx    time.Time `json:"last_rx"`
+
+	DuplicatesDropped uint64 `json:"duplicates_dropped"` // Retransmitted uplinks not processed again
+	ThrottledDropped  uint64 `json:"throttled_dropped"`  // Uplinks over the ingest rate limits
+
+	Gateways []GatewayHealth `json:"gateways,omitempty"` // Gateways that reported stats recently
+}
+
+// GatewayHealth scores a gateway on the packet counts it reported over the
+// health window
+type GatewayHealth struct {
+	GatewayID     string    `json:"gateway_id"`
+	Score         int       `json:"score"`           // 0-100, 100 with no CRC errors or TX failures
+	CRCErrorRate  float64   `json:"crc_error_rate"`  // Fraction of uplinks with a bad CRC
+	TxFailureRate float64   `json:"tx_failure_rate"` // Fraction of downlinks not transmitted
+	RxReceived    int64     `json:"rx_received"`
+	RxOK          int64     `json:"rx_ok"`
+	TxReceived    int64     `json:"tx_received"`
+	TxEmitted     int64     `json:"tx_emitted"`
+	LastReport    time.Time `json:"last_report"`
+}
+
+// UnsyncedCounts counts records waiting to be sent to the cloud
+type UnsyncedCounts struct {
+	SoilReadings  int `json:"soil_readings"`
+	MeterReadings int `json:"meter_readings"`
+	Alerts        int `json:"alerts"`
+	ValveEvents   int `json:"valve_events"`
+}
+
+// CommandCounts counts valve commands awaiting acknowledgment or failed
+type CommandCounts struct {
+	Pending int `json:"pending"`
+	Failed  int `json:"failed"`
+}
+
+// LifetimeCounts are engine counters kept across restarts
+type LifetimeCounts struct {
+	Messages          map[string]int64 `json:"messages"` // Uplinks by message type, e.g. "0x20"
+	DecodeFailures    int64            `json:"decode_failures"`
+	DuplicatesDropped int64            `json:"duplicates_dropped"`
+	ThrottledDropped  int64            `json:"throttled_dropped"`
+	CommandsSent      int64            `json:"commands_sent"`
+	CommandsAcked     int64            `json:"commands_acked"`
+	CommandsFailed    int64            `json:"commands_failed"` // Not sent, refused, or never acknowledged
+	SyncSucceeded     int64            `json:"sync_succeeded"`  // Batches sent to the cloud
+	SyncFailed        int64            `json:"sync_failed"`
+	RadioRxPackets    int64            `json:"radio_rx_packets"` // Zero on a shared radio
+	RadioTxPackets    int64            `json:"radio_tx_packets"`
+	RadioTxSkipped    int64            `json:"radio_tx_skipped"` // Downlinks skipped as LBT found the channel busy
+}
+
+// SoilRollup is one probe's aggregated readings over an hour or day
+type SoilRollup struct {
+	DeviceUID      string    `json:"device_uid"`
+	ProbeID        uint8     `json:"probe_id"`
+	PeriodStart    time.Time `json:"period_start"`
+	Samples        int       `json:"samples"`
+	MoistureMin    uint8     `json:"moisture_min"`
+	MoistureMax    uint8     `json:"moisture_max"`
+	MoistureAvg    float64   `json:"moisture_avg"`
+	TemperatureMin float64   `json:"temperature_min"` // °C
+	TemperatureMax float64   `json:"temperature_max"`
+	TemperatureAvg float64   `json:"temperature_avg"`
+}
+
+// MeterRollup is one meter's aggregated readings over an hour or day
+type MeterRollup struct {
+	DeviceUID    string    `json:"device_uid"`
+	PeriodStart  time.Time `json:"period_start"`
+	Samples      int       `json:"samples"`
+	FlowMin      float64   `json:"flow_min_lpm"`
+	FlowMax      float64   `json:"flow_max_lpm"`
+	FlowAvg      float64   `json:"flow_avg_lpm"`
+	VolumeDeltaL float64   `json:"volume_delta_l"`
+	TotalVolumeL float64   `json:"total_volume_l"`
+}
+
+// DeviceKeyStatus describes a device's rotated LoRa key
+type DeviceKeyStatus struct {
+	DeviceUID          string     `json:"device_uid"`
+	KeyID              uint8      `json:"key_id"` // 0 until the first rotation completes
+	State              string     `json:"state"`  // "active" or "rotating"
+	PendingKeyID       uint8      `json:"pending_key_id,omitempty"`
+	Attempts           int        `json:"attempts,omitempty"`
+	ActivatedAt        *time.Time `json:"activated_at,omitempty"`
+	PreviousValidUntil *time.Time `json:"previous_valid_until,omitempty"` // End of the old key's grace window
+}
+
+// Valve is a valve actuator with its cloud-assigned names
+type Valve struct {
+	UID           string     `json:"uid"`
+	ControllerUID string     `json:"controller_uid"`
+	Address       uint8      `json:"address"`
+	Name          string     `json:"name"`
+	Alias         string     `json:"alias,omitempty"`
+	ZoneID        string     `json:"zone_id,omitempty"`
+	ZoneName      string     `json:"zone_name,omitempty"`
+	ValveID       string     `json:"valve_id,omitempty"` // Cloud valve ID
+	State         string     `json:"state"`
+	LastChange    *time.Time `json:"last_change,omitempty"`
+	OpenedAt      *time.Time `json:"opened_at,omitempty"`
+	Registered    bool       `json:"registered"`
+	OverrideUntil *time.Time `json:"override_until,omitempty"` // Operated by hand; schedules and rules held off until then
+}
+
+// ZoneRecommendation is when a zone is expected to need water, from the
+// drydown of its soil sensors since they were last wetted
+type ZoneRecommendation struct {
+	ZoneID          string     `json:"zone_id"`
+	ZoneName        string     `json:"zone_name,omitempty"`
+	Probes          int        `json:"probes"`                   // Probes with recent readings
+	MoisturePercent float64    `json:"moisture_percent"`         // Average of the probes' latest readings
+	TargetPercent   uint8      `json:"target_percent"`           // Moisture at which the zone needs water
+	DryingRate      float64    `json:"drying_rate"`              // Percentage points lost per hour, adjusted for temperature
+	WaterInHours    *float64   `json:"water_in_hours,omitempty"` // Unset when it can't be predicted
+	WaterBy         *time.Time `json:"water_by,omitempty"`
+	SkipRuns        bool       `json:"skip_runs"`        // Scheduled runs are skipped because water isn't due yet
+	Reason          string     `json:"reason,omitempty"` // Why there is no prediction
+}
+
+// SchedulePreview is the valve activity the active schedules are expected
+// to produce over the coming days, with the controller's rules applied
+type SchedulePreview struct {
+	From   time.Time      `json:"from"`
+	Until  time.Time      `json:"until"`
+	Runs   []PreviewRun   `json:"runs"`    // One per valve and scheduled start, in time order
+	Events []PreviewEvent `json:"events"`  // Opens and closes of the runs that go ahead, in time order
+	WaterL float64        `json:"water_l"` // Estimated total for valves with a known flow
+}
+
+// PreviewRun is one valve's part in a scheduled run
+type PreviewRun struct {
+	ScheduleUID   string    `json:"schedule_uid"`
+	ScheduleName  string    `json:"schedule_name"`
+	ControllerUID string    `json:"controller_uid"`
+	Address       uint8     `json:"address"`
+	Valve         string    `json:"valve,omitempty"` // Alias or name
+	Start         time.Time `json:"start"`
+	ScheduledMins int       `json:"scheduled_mins"`
+	DurationMins  int       `json:"duration_mins"` // After rules, 0 if skipped
+	Skipped       bool      `json:"skipped"`
+	Reason        string    `json:"reason,omitempty"`  // Why the run was skipped or shortened
+	WaterL        float64   `json:"water_l,omitempty"` // Estimate, 0 when the valve's flow is unknown
+}
+
+// PreviewEvent is an expected valve open or close
+type PreviewEvent struct {
+	Time          time.Time `json:"time"`
+	ControllerUID string    `json:"controller_uid"`
+	Address       uint8     `json:"address"`
+	Command       string    `json:"command"` // "open" or "close"
+	ScheduleUID   string    `json:"schedule_uid"`
+}
+
+// Live event types streamed by GET /events
+const (
+	EventSoil    = "soil"    // Soil moisture reading or multi-probe report
+	EventMeter   = "meter"   // Water meter reading
+	EventAlarm   = "alarm"   // Meter alarm, from the device or flow analytics
+	EventAlert   = "alert"   // Alert raised or cleared
+	EventValve   = "valve"   // Valve state change
+	EventDropped = "dropped" // Events the client missed by reading too slowly
+)
+
+// Event is a live controller event. Data is the stored record as it is
+// synced to the cloud.
+type Event struct {
+	Type      string      `json:"type"`
+	ID        int64       `json:"id,omitempty"` // Database row ID
+	DeviceUID string      `json:"device_uid,omitempty"`
+	Time      time.Time   `json:"time"`
+	Data      interface{} `json:"data"`
+}
@@ -0,0 +1,119 @@
+// Package logging configures the process-wide logger from controller.yaml.
+// Messages logged with the standard log package are always written; Debugf
+// output is only written when the level is debug.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Level is a logging verbosity level
+type Level int32
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	default:
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+}
+
+// ParseLevel parses a level name. An empty name is info.
+func ParseLevel(name string) (Level, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "debug":
+		return LevelDebug, nil
+	case "", "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	default:
+		return LevelInfo, fmt.Errorf("unknown log level %q (use debug, info, warn, or error)", name)
+	}
+}
+
+var (
+	level atomic.Int32
+
+	mu   sync.Mutex
+	file *os.File // Current log file, nil when logging to stderr
+)
+
+func init() {
+	level.Store(int32(LevelInfo))
+}
+
+// Setup applies the log level and output file. An empty path logs to stderr.
+// Calling it again reopens the file, so it is safe to use after log rotation.
+func Setup(levelName, path string) error {
+	l, err := ParseLevel(levelName)
+	if err != nil {
+		return err
+	}
+
+	var out io.Writer = os.Stderr
+	var f *os.File
+	if path != "" {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return fmt.Errorf("failed to create log directory: %w", err)
+		}
+		f, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("failed to open log file: %w", err)
+		}
+		out = f
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	flags := log.LstdFlags
+	if l == LevelDebug {
+		flags |= log.Lmicroseconds | log.Lshortfile
+	}
+	log.SetFlags(flags)
+	log.SetOutput(out)
+	level.Store(int32(l))
+
+	if file != nil {
+		file.Close()
+	}
+	file = f
+	return nil
+}
+
+// CurrentLevel returns the active log level
+func CurrentLevel() Level {
+	return Level(level.Load())
+}
+
+// Debugf logs a message when the level is debug
+func Debugf(format string, v ...interface{}) {
+	if CurrentLevel() > LevelDebug {
+		return
+	}
+	log.Output(2, fmt.Sprintf(format, v...))
+}
@@ -0,0 +1,155 @@
+package lora
+
+import (
+	"sync"
+	"time"
+)
+
+// ADRConfig holds adaptive data rate configuration for downlinks
+type ADRConfig struct {
+	Enabled     bool
+	MinSF       uint8   // Fastest spreading factor to use (nearby devices)
+	MaxSF       uint8   // Slowest spreading factor to use (distant devices)
+	MinTxPower  int8    // Lowest TX power in dBm
+	MaxTxPower  int8    // Highest TX power in dBm
+	MarginDB    float32 // Link margin kept above the demodulation floor
+	HistorySize int     // Uplinks remembered per device
+	MaxAge      time.Duration
+}
+
+// DefaultADRConfig returns default ADR configuration (disabled)
+func DefaultADRConfig() ADRConfig {
+	return ADRConfig{
+		Enabled:     false,
+		MinSF:       7,
+		MaxSF:       12,
+		MinTxPower:  2,
+		MaxTxPower:  20,
+		MarginDB:    10,
+		HistorySize: 20,
+		MaxAge:      24 * time.Hour,
+	}
+}
+
+// LinkSample is the signal quality of a single uplink
+type LinkSample struct {
+	RSSI int16
+	SNR  float32
+	At   time.Time
+}
+
+// requiredSNR is the demodulation floor in dB for each spreading factor
+var requiredSNR = map[uint8]float32{
+	7:  -7.5,
+	8:  -10,
+	9:  -12.5,
+	10: -15,
+	11: -17.5,
+	12: -20,
+}
+
+// ADR tracks per-device link quality and picks downlink TX parameters
+type ADR struct {
+	config       ADRConfig
+	defaultSF    uint8
+	defaultPower int8
+	mu           sync.Mutex
+	history      map[[8]byte][]LinkSample
+}
+
+// NewADR creates a new ADR tracker. Devices without history, and all
+// downlinks when ADR is disabled, use the default SF and TX power.
+func NewADR(config ADRConfig, defaultSF uint8, defaultPower int8) *ADR {
+	if config.HistorySize <= 0 {
+		config.HistorySize = 1
+	}
+	return &ADR{
+		config:       config,
+		defaultSF:    defaultSF,
+		defaultPower: defaultPower,
+		history:      make(map[[8]byte][]LinkSample),
+	}
+}
+
+// Observe records the signal quality of an uplink from a device
+func (a *ADR) Observe(deviceUID [8]byte, rssi int16, snr float32) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	samples := append(a.history[deviceUID], LinkSample{RSSI: rssi, SNR: snr, At: time.Now()})
+	if len(samples) > a.config.HistorySize {
+		samples = samples[len(samples)-a.config.HistorySize:]
+	}
+	a.history[deviceUID] = samples
+}
+
+// History returns the recorded link samples for a device, oldest first
+func (a *ADR) History(deviceUID [8]byte) []LinkSample {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	samples := a.history[deviceUID]
+	result := make([]LinkSample, len(samples))
+	copy(result, samples)
+	return result
+}
+
+// TxParams returns the spreading factor and TX power for a downlink to a device
+func (a *ADR) TxParams(deviceUID [8]byte) (sf uint8, txPower int8) {
+	if !a.config.Enabled || isBroadcast(deviceUID) {
+		return a.defaultSF, a.defaultPower
+	}
+
+	a.mu.Lock()
+	samples := a.history[deviceUID]
+	a.mu.Unlock()
+
+	// Use the worst recent SNR so a single good packet doesn't drop the SF too far
+	var worstSNR float32
+	found := false
+	cutoff := time.Now().Add(-a.config.MaxAge)
+	for _, s := range samples {
+		if a.config.MaxAge > 0 && s.At.Before(cutoff) {
+			continue
+		}
+		if !found || s.SNR < worstSNR {
+			worstSNR = s.SNR
+			found = true
+		}
+	}
+	if !found {
+		return a.defaultSF, a.defaultPower
+	}
+
+	// Pick the fastest SF that still has the configured margin
+	sf = a.config.MaxSF
+	for candidate := a.config.MinSF; candidate <= a.config.MaxSF; candidate++ {
+		floor, ok := requiredSNR[candidate]
+		if ok && worstSNR >= floor+a.config.MarginDB {
+			sf = candidate
+			break
+		}
+	}
+
+	// Spend any margin left over at the fastest SF on lowering TX power
+	txPower = a.config.MaxTxPower
+	if sf == a.config.MinSF {
+		excess := worstSNR - (requiredSNR[sf] + a.config.MarginDB)
+		txPower = a.config.MaxTxPower - int8(excess)
+		if txPower < a.config.MinTxPower {
+			txPower = a.config.MinTxPower
+		}
+	}
+
+	return sf, txPower
+}
+
+// isBroadcast returns true for the all-0xFF broadcast UID
+func isBroadcast(uid [8]byte) bool {
+	for _, b := range uid {
+		if b != 0xFF {
+			return false
+		}
+	}
+	return true
+}
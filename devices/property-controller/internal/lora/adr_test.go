@@ -0,0 +1,78 @@
+package lora
+
+import "testing"
+
+// TestADRTxParams tests SF and TX power selection from link history
+func TestADRTxParams(t *testing.T) {
+	config := DefaultADRConfig()
+	config.Enabled = true
+
+	uid := [8]byte{1, 2, 3, 4, 5, 6, 7, 8}
+
+	tests := []struct {
+		name      string
+		snr       []float32
+		wantSF    uint8
+		wantPower int8
+	}{
+		{"no history uses defaults", nil, 10, 20},
+		{"strong link drops to SF7 and lowers power", []float32{9.5, 9.5}, 7, 13},
+		{"moderate link", []float32{-1, 3}, 9, 20},
+		{"weak link", []float32{-9}, 12, 20},
+		{"worst sample wins", []float32{10, -6}, 11, 20},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			adr := NewADR(config, 10, 20)
+			for _, snr := range tt.snr {
+				adr.Observe(uid, -100, snr)
+			}
+
+			sf, power := adr.TxParams(uid)
+			if sf != tt.wantSF || power != tt.wantPower {
+				t.Errorf("TxParams = SF%d/%d dBm, want SF%d/%d dBm", sf, power, tt.wantSF, tt.wantPower)
+			}
+		})
+	}
+}
+
+// TestADRDisabled ensures defaults are used when ADR is off or for broadcasts
+func TestADRDisabled(t *testing.T) {
+	uid := [8]byte{1, 2, 3, 4, 5, 6, 7, 8}
+
+	adr := NewADR(DefaultADRConfig(), 10, 20)
+	adr.Observe(uid, -40, 12)
+	if sf, power := adr.TxParams(uid); sf != 10 || power != 20 {
+		t.Errorf("disabled ADR returned SF%d/%d dBm", sf, power)
+	}
+
+	config := DefaultADRConfig()
+	config.Enabled = true
+	adr = NewADR(config, 10, 20)
+	broadcast := [8]byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+	adr.Observe(broadcast, -40, 12)
+	if sf, power := adr.TxParams(broadcast); sf != 10 || power != 20 {
+		t.Errorf("broadcast returned SF%d/%d dBm", sf, power)
+	}
+}
+
+// TestADRHistoryBounded ensures history is capped at HistorySize
+func TestADRHistoryBounded(t *testing.T) {
+	config := DefaultADRConfig()
+	config.HistorySize = 3
+	adr := NewADR(config, 10, 20)
+
+	uid := [8]byte{1}
+	for i := 0; i < 10; i++ {
+		adr.Observe(uid, int16(-100+i), 0)
+	}
+
+	history := adr.History(uid)
+	if len(history) != 3 {
+		t.Fatalf("history length = %d, want 3", len(history))
+	}
+	if history[0].RSSI != -93 {
+		t.Errorf("oldest RSSI = %d, want -93", history[0].RSSI)
+	}
+}
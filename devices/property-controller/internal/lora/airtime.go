@@ -0,0 +1,54 @@
+package lora
+
+import (
+	"crypto/aes"
+	"math"
+	"time"
+
+	"github.com/agsys/property-controller/internal/protocol"
+)
+
+// Airtime returns how long a LoRa frame of frameLen bytes is on the air
+// (Semtech AN1200.13), with an 8 symbol preamble, explicit header, and
+// payload CRC. codingRate is 5-8 for 4/5 to 4/8. Low data rate optimisation
+// is on when a symbol lasts longer than 16 ms, as at SF11 and SF12 on 125 kHz.
+func Airtime(frameLen int, sf uint8, bandwidth uint32, codingRate uint8) time.Duration {
+	symbol := float64(uint64(1)<<sf) / float64(bandwidth)
+	lowDataRate := 0.0
+	if symbol > 0.016 {
+		lowDataRate = 1
+	}
+
+	bits := 8*float64(frameLen) - 4*float64(sf) + 28 + 16
+	payloadSymbols := 8 + math.Max(math.Ceil(bits/(4*(float64(sf)-2*lowDataRate)))*float64(codingRate), 0)
+	seconds := (8 + 4.25 + payloadSymbols) * symbol
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// Airtime estimates how long a downlink with a payload of payloadLen bytes
+// to a device is on the air at its current data rate, summed over the
+// fragments it is split into. The worst case encryption overhead is always
+// allowed for.
+func (d *Driver) Airtime(deviceUID [8]byte, payloadLen int) time.Duration {
+	sf, _ := d.adr.TxParams(deviceUID)
+	version := d.versions.For(deviceUID)
+	overhead := protocol.HeaderSize + aes.BlockSize
+	if protocol.HasFrameCRC(version) {
+		overhead += protocol.FrameCRCSize
+	}
+
+	limit := maxPayload(d.frameLimit(sf), version)
+	if payloadLen <= limit {
+		return Airtime(overhead+payloadLen, sf, d.config.Bandwidth, d.config.CodingRate)
+	}
+	chunk := limit - protocol.FragmentHeaderSize
+	if chunk <= 0 {
+		return 0
+	}
+	var total time.Duration
+	for remaining := payloadLen; remaining > 0; remaining -= chunk {
+		frame := overhead + protocol.FragmentHeaderSize + min(remaining, chunk)
+		total += Airtime(frame, sf, d.config.Bandwidth, d.config.CodingRate)
+	}
+	return total
+}
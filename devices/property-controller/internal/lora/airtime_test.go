@@ -0,0 +1,29 @@
+package lora
+
+import (
+	"testing"
+	"time"
+)
+
+// TestAirtime tests time on air against the Semtech calculator
+func TestAirtime(t *testing.T) {
+	tests := []struct {
+		frameLen int
+		sf       uint8
+		want     time.Duration
+	}{
+		{13, 7, 46336 * time.Microsecond},
+		{64, 10, 698368 * time.Microsecond},
+		{64, 12, 2793472 * time.Microsecond}, // Low data rate optimisation on
+	}
+	for _, tt := range tests {
+		got := Airtime(tt.frameLen, tt.sf, 125000, 5)
+		if diff := got - tt.want; diff < -time.Microsecond || diff > time.Microsecond {
+			t.Errorf("Airtime(%d bytes, SF%d) = %s, want %s", tt.frameLen, tt.sf, got, tt.want)
+		}
+	}
+
+	if Airtime(64, 10, 125000, 8) <= Airtime(64, 10, 125000, 5) {
+		t.Error("Coding rate 4/8 should take longer than 4/5")
+	}
+}
@@ -0,0 +1,161 @@
+package lora
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/agsys/property-controller/internal/protocol"
+)
+
+// Capture directions
+const (
+	CaptureRx = "rx"
+	CaptureTx = "tx"
+)
+
+// HexBytes is a byte slice written to captures in hex, so frames can be
+// pasted straight into a decoder
+type HexBytes []byte
+
+// MarshalText implements encoding.TextMarshaler
+func (b HexBytes) MarshalText() ([]byte, error) {
+	return []byte(hex.EncodeToString(b)), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler
+func (b *HexBytes) UnmarshalText(text []byte) error {
+	data, err := hex.DecodeString(string(text))
+	if err != nil {
+		return err
+	}
+	*b = data
+	return nil
+}
+
+// CaptureRecord is one frame in a capture file. Raw is the frame as it went
+// over the air. Frame is the same frame in the clear, and is missing for
+// uplinks that couldn't be decrypted. The new key in a key rotation is
+// zeroed in both.
+type CaptureRecord struct {
+	Time    time.Time `json:"time"`
+	Dir     string    `json:"dir"`
+	RSSI    int16     `json:"rssi,omitempty"`
+	SNR     float32   `json:"snr,omitempty"`
+	SF      uint8     `json:"sf,omitempty"`
+	TxPower int8      `json:"tx_power,omitempty"`
+	Raw     HexBytes  `json:"raw"`
+	Frame   HexBytes  `json:"frame,omitempty"`
+	Error   string    `json:"error,omitempty"` // Why a downlink failed to transmit
+}
+
+// Capture appends every frame a driver receives and transmits to a file,
+// one JSON record per line, for debugging field issues offline. A nil
+// Capture records nothing.
+type Capture struct {
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+// OpenCapture opens a capture file for appending, creating it if needed.
+// The file holds decrypted frames, so only its owner can read it.
+func OpenCapture(path string) (*Capture, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open capture file: %w", err)
+	}
+	return &Capture{file: f, enc: json.NewEncoder(f)}, nil
+}
+
+// Received records an uplink frame. frame is nil if it couldn't be
+// decrypted.
+func (c *Capture) Received(raw, frame []byte, rssi int16, snr float32) {
+	c.record(CaptureRecord{Dir: CaptureRx, RSSI: rssi, SNR: snr, Raw: raw, Frame: frame})
+}
+
+// Sent records a downlink frame and the result of transmitting it
+func (c *Capture) Sent(raw, frame []byte, sf uint8, txPower int8, err error) {
+	if redacted := redactKeys(frame); !bytes.Equal(redacted, frame) {
+		if bytes.Equal(raw, frame) {
+			raw = redacted // Sent without encryption
+		}
+		frame = redacted
+	}
+	rec := CaptureRecord{Dir: CaptureTx, SF: sf, TxPower: txPower, Raw: raw, Frame: frame}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	c.record(rec)
+}
+
+// redactKeys returns a clear frame with the new key of a key rotation
+// zeroed, so a capture never holds device keys. Other frames are returned as
+// they are.
+func redactKeys(frame []byte) []byte {
+	if frame == nil {
+		return nil
+	}
+	msg, err := protocol.Decode(frame)
+	if err != nil || msg.Header.MsgType != protocol.MsgTypeKeyRotate {
+		return frame
+	}
+	p, err := protocol.DecodeKeyRotate(msg.Payload)
+	if err != nil {
+		return frame
+	}
+	p.Key = [16]byte{}
+	msg.Payload = append(p.Encode(), msg.Payload[len(p.Encode()):]...)
+	return msg.Encode()
+}
+
+func (c *Capture) record(rec CaptureRecord) {
+	if c == nil {
+		return
+	}
+	rec.Time = time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.enc == nil {
+		return
+	}
+	if err := c.enc.Encode(rec); err != nil {
+		log.Printf("Failed to write capture: %v", err)
+	}
+}
+
+// Close closes the capture file
+func (c *Capture) Close() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.enc = nil
+	return c.file.Close()
+}
+
+// ReadCapture reads the records of a capture file in order
+func ReadCapture(r io.Reader) ([]CaptureRecord, error) {
+	var records []CaptureRecord
+	dec := json.NewDecoder(r)
+	for {
+		var rec CaptureRecord
+		err := dec.Decode(&rec)
+		if errors.Is(err, io.EOF) {
+			return records, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid capture record %d: %w", len(records)+1, err)
+		}
+		records = append(records, rec)
+	}
+}
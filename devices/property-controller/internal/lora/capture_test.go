@@ -0,0 +1,169 @@
+package lora
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/agsys/property-controller/internal/protocol"
+)
+
+// chanRadio is a Radio backed by channels
+type chanRadio struct {
+	rx  chan *protocol.LoRaMessage
+	tx  chan []byte
+	err error // Returned by Transmit instead of sending
+}
+
+func (r *chanRadio) Receive() (*protocol.LoRaMessage, error) {
+	select {
+	case msg := <-r.rx:
+		return msg, nil
+	case <-time.After(10 * time.Millisecond):
+		return nil, nil
+	}
+}
+
+func (r *chanRadio) Transmit(data []byte, sf uint8, txPower int8) error {
+	if r.err != nil {
+		return r.err
+	}
+	r.tx <- data
+	return nil
+}
+
+// TestDriverCapture tests that frames are captured both as sent over the
+// air and in the clear
+func TestDriverCapture(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	radio := &chanRadio{rx: make(chan *protocol.LoRaMessage, 1), tx: make(chan []byte, 1)}
+	config := DefaultConfig()
+	config.AESKey = bytes.Repeat([]byte{0x42}, 16)
+	config.Radio = radio
+	config.CaptureFile = path
+
+	d, err := New(config)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	received := make(chan *protocol.LoRaMessage, 1)
+	d.SetReceiveCallback(func(msg *protocol.LoRaMessage) { received <- msg })
+	if err := d.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	uid := [8]byte{0x01, 0, 0, 0, 0, 0, 0, 0x07}
+	if err := d.SendToDevice(uid, protocol.MsgTypeTimeSync, []byte{1, 2, 3, 4}); err != nil {
+		t.Fatalf("SendToDevice failed: %v", err)
+	}
+	var sent []byte
+	select {
+	case sent = <-radio.tx:
+	case <-time.After(time.Second):
+		t.Fatal("Nothing transmitted")
+	}
+
+	uplink := &protocol.LoRaMessage{
+		Header: protocol.Header{
+			Magic:     [2]byte{protocol.MagicByte1, protocol.MagicByte2},
+			Version:   protocol.ProtocolVersion,
+			MsgType:   protocol.MsgTypeHeartbeat,
+			DeviceUID: uid,
+		},
+		Payload: []byte{5, 6, 7},
+		RSSI:    -100,
+	}
+	clear := uplink.Encode()
+	encrypted, err := d.encrypt(uplink.Payload)
+	if err != nil {
+		t.Fatalf("encrypt failed: %v", err)
+	}
+	uplink.Payload = encrypted
+	raw := uplink.Encode()
+	radio.rx <- uplink
+	select {
+	case <-received:
+	case <-time.After(time.Second):
+		t.Fatal("Nothing received")
+	}
+	if err := d.Stop(); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Open capture failed: %v", err)
+	}
+	defer f.Close()
+	records, err := ReadCapture(f)
+	if err != nil {
+		t.Fatalf("ReadCapture failed: %v", err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("Captured %d records, want 2", len(records))
+	}
+
+	tx, rx := records[0], records[1]
+	if tx.Dir != CaptureTx || !bytes.Equal(tx.Raw, sent) || bytes.Equal(tx.Frame, sent) {
+		t.Errorf("TX record = %+v, want the encrypted frame sent and its clear text", tx)
+	}
+	if msg, err := protocol.Decode(tx.Frame); err != nil || msg.Header.MsgType != protocol.MsgTypeTimeSync {
+		t.Errorf("TX frame decodes to %+v, %v", msg, err)
+	}
+	if rx.Dir != CaptureRx || !bytes.Equal(rx.Raw, raw) || !bytes.Equal(rx.Frame, clear) || rx.RSSI != -100 {
+		t.Errorf("RX record = %+v, want raw %X and frame %X at -100 dBm", rx, raw, clear)
+	}
+}
+
+// TestCaptureRedactsKeys tests that the new key in a key rotation is never
+// written to a capture
+func TestCaptureRedactsKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	c, err := OpenCapture(path)
+	if err != nil {
+		t.Fatalf("OpenCapture failed: %v", err)
+	}
+
+	key := bytes.Repeat([]byte{0xA5}, 16)
+	rotate := &protocol.KeyRotatePayload{KeyID: 3}
+	copy(rotate.Key[:], key)
+	uid := [8]byte{0x01, 0, 0, 0, 0, 0, 0, 0x07}
+	frame := newMessage(uid, protocol.MsgTypeKeyRotate, protocol.ProtocolVersion, 1, rotate.Encode()).Encode()
+	sealed, err := EncryptGCM(bytes.Repeat([]byte{0x42}, 16), DownlinkNonceFlag, frame)
+	if err != nil {
+		t.Fatalf("EncryptGCM failed: %v", err)
+	}
+	c.Sent(sealed, frame, 10, 20, nil)
+	c.Sent(frame, frame, 10, 20, nil) // Without encryption
+	if err := c.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	records, err := ReadCapture(bytes.NewReader(data))
+	if err != nil || len(records) != 2 {
+		t.Fatalf("ReadCapture = %d records, %v; want 2", len(records), err)
+	}
+	if !bytes.Equal(records[0].Raw, sealed) {
+		t.Errorf("Encrypted frame recorded as %X, want %X", records[0].Raw, sealed)
+	}
+	for i, rec := range records {
+		for _, b := range [][]byte{rec.Raw, rec.Frame} {
+			if bytes.Contains(b, key) {
+				t.Errorf("Record %d holds the new key: %X", i, b)
+			}
+		}
+		msg, err := protocol.Decode(rec.Frame)
+		if err != nil {
+			t.Fatalf("Record %d frame doesn't decode: %v", i, err)
+		}
+		if p, err := protocol.DecodeKeyRotate(msg.Payload); err != nil || p.KeyID != 3 {
+			t.Errorf("Record %d key rotation = %+v, %v; want key ID 3 kept", i, p, err)
+		}
+	}
+}
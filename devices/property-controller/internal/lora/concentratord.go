@@ -29,6 +29,10 @@ type ConcentratordConfig struct {
 	CodingRate      string // "4/5", "4/6", "4/7", "4/8"
 	TxPower         int32  // Transmit power in dBm
 	AESKey          []byte // 16-byte AES-128 key
+	DeviceKeys      bool   // Seal unicast frames with AES-128-GCM under keys derived from each device's UID
+	LegacyDevices   bool   // With DeviceKeys, still accept the network key from devices not yet migrated and answer them on it
+	ADR             ADRConfig
+	CaptureFile     string // Append every frame received and transmitted to this file (empty disables)
 }
 
 // DefaultConcentratordConfig returns default configuration
@@ -41,6 +45,7 @@ func DefaultConcentratordConfig() ConcentratordConfig {
 		Bandwidth:       125000,
 		CodingRate:      "4/5",
 		TxPower:         20,
+		ADR:             DefaultADRConfig(),
 	}
 }
 
@@ -49,7 +54,11 @@ type ConcentratordDriver struct {
 	config     ConcentratordConfig
 	cipher     cipher.Block
 	keyCache   *DeviceKeyCache
-	txNonce    uint32
+	keys       *KeyStore
+	adr        *ADR
+	versions   *frameVersions
+	fragments  *fragmenter
+	capture    *Capture
 	eventSock  zmq4.Socket
 	cmdSock    zmq4.Socket
 	ctx        context.Context
@@ -67,11 +76,16 @@ type ConcentratordDriver struct {
 func NewConcentratordDriver(config ConcentratordConfig) (*ConcentratordDriver, error) {
 	ctx, cancel := context.WithCancel(context.Background())
 
+	keys := NewKeyStore(DefaultKeyGrace)
 	d := &ConcentratordDriver{
-		config:   config,
-		ctx:      ctx,
-		cancel:   cancel,
-		keyCache: NewDeviceKeyCache(),
+		config:    config,
+		ctx:       ctx,
+		cancel:    cancel,
+		keyCache:  NewDeviceKeyCache(keys.Nonces(), config.LegacyDevices),
+		keys:      keys,
+		adr:       NewADR(config.ADR, uint8(config.SpreadingFactor), int8(config.TxPower)),
+		versions:  newFrameVersions(),
+		fragments: newFragmenter(),
 	}
 
 	// Legacy: support single shared key if provided (for backward compatibility)
@@ -84,6 +98,15 @@ func NewConcentratordDriver(config ConcentratordConfig) (*ConcentratordDriver, e
 		d.cipher = block
 	}
 
+	if config.CaptureFile != "" {
+		capture, err := OpenCapture(config.CaptureFile)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		d.capture = capture
+	}
+
 	return d, nil
 }
 
@@ -143,11 +166,17 @@ func (d *ConcentratordDriver) Stop() error {
 	if d.cmdSock != nil {
 		d.cmdSock.Close()
 	}
+	d.capture.Close()
 
 	log.Println("Concentratord driver stopped")
 	return nil
 }
 
+// Keys returns the store of rotated per-device keys
+func (d *ConcentratordDriver) Keys() *KeyStore {
+	return d.keys
+}
+
 // SetReceiveCallback sets the callback for received messages
 func (d *ConcentratordDriver) SetReceiveCallback(cb func(*protocol.LoRaMessage)) {
 	d.mu.Lock()
@@ -165,8 +194,17 @@ func (d *ConcentratordDriver) Send(msg *protocol.LoRaMessage) error {
 	d.mu.Unlock()
 
 	data := msg.Encode()
+	frame := data
 
-	if d.cipher != nil {
+	if encrypted, ok, err := d.keys.Encrypt(msg.Header.DeviceUID, data); err != nil {
+		return fmt.Errorf("encryption failed: %w", err)
+	} else if ok {
+		data = encrypted
+	} else if encrypted, ok, err := d.encryptForDevice(msg.Header.DeviceUID, data); err != nil {
+		return fmt.Errorf("encryption failed: %w", err)
+	} else if ok {
+		data = encrypted
+	} else if d.cipher != nil {
 		encrypted, err := d.encrypt(data)
 		if err != nil {
 			return fmt.Errorf("encryption failed: %w", err)
@@ -174,7 +212,20 @@ func (d *ConcentratordDriver) Send(msg *protocol.LoRaMessage) error {
 		data = encrypted
 	}
 
-	return d.sendDownlink(data)
+	sf, txPower := d.adr.TxParams(msg.Header.DeviceUID)
+	if limit := d.frameLimit(sf); len(data) > limit {
+		return fmt.Errorf("%w: %d byte frame to %s, over the %d that fit at SF%d and %d kHz",
+			ErrFrameTooLarge, len(data), msg.DeviceUIDString(), limit, sf, d.config.Bandwidth/1000)
+	}
+	err := d.sendDownlink(data, sf, txPower)
+	d.capture.Sent(data, frame, sf, txPower, err)
+	return err
+}
+
+// frameLimit returns the largest frame sent at a spreading factor on the
+// configured channel
+func (d *ConcentratordDriver) frameLimit(sf uint8) int {
+	return maxFrameSize(sf, d.config.Bandwidth, 5, 0)
 }
 
 // SendToDevice sends a message to a specific device
@@ -184,27 +235,34 @@ func (d *ConcentratordDriver) SendToDevice(deviceUID [8]byte, msgType uint8, pay
 	seq := d.seqNum
 	d.mu.Unlock()
 
-	msg := &protocol.LoRaMessage{
-		Header: protocol.Header{
-			Magic:      [2]byte{protocol.MagicByte1, protocol.MagicByte2},
-			Version:    protocol.ProtocolVersion,
-			MsgType:    msgType,
-			DeviceType: 0, // Controller doesn't have a device type
-			DeviceUID:  deviceUID,
-			Sequence:   seq,
-		},
-		Payload: payload,
-	}
+	return d.Send(newMessage(deviceUID, msgType, d.versions.For(deviceUID), seq, payload))
+}
 
-	return d.Send(msg)
+// SetDeviceVersion sets the protocol version downlinks to a device are framed
+// in, until it next sends an uplink. Used to restore versions at startup.
+func (d *ConcentratordDriver) SetDeviceVersion(deviceUID [8]byte, version uint8) {
+	d.versions.Observe(deviceUID, version)
+}
+
+// SendFragmented sends a payload to a device, split into fragments if it is
+// too large for a single frame at the device's spreading factor
+func (d *ConcentratordDriver) SendFragmented(deviceUID [8]byte, msgType uint8, payload []byte) error {
+	sf, _ := d.adr.TxParams(deviceUID)
+	limit := maxPayload(d.frameLimit(sf), d.versions.For(deviceUID))
+	fragType, parts, err := d.fragments.split(msgType, payload, limit)
+	if err != nil {
+		return err
+	}
+	for _, part := range parts {
+		if err := d.SendToDevice(deviceUID, fragType, part); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // Broadcast sends a message to all devices
 func (d *ConcentratordDriver) Broadcast(msgType uint8, payload []byte) error {
-	var broadcastUID [8]byte
-	for i := range broadcastUID {
-		broadcastUID[i] = 0xFF
-	}
 	return d.SendToDevice(broadcastUID, msgType, payload)
 }
 
@@ -240,7 +298,7 @@ func (d *ConcentratordDriver) fetchGatewayID() error {
 }
 
 // sendDownlink sends a downlink frame via Concentratord
-func (d *ConcentratordDriver) sendDownlink(payload []byte) error {
+func (d *ConcentratordDriver) sendDownlink(payload []byte, sf uint8, txPower int8) error {
 	d.mu.Lock()
 	d.downlinkID++
 	dlID := d.downlinkID
@@ -264,11 +322,11 @@ func (d *ConcentratordDriver) sendDownlink(payload []byte) error {
 				PhyPayload: payload,
 				TxInfo: &gw.DownlinkTxInfo{
 					Frequency: d.config.Frequency,
-					Power:     d.config.TxPower,
+					Power:     int32(txPower),
 					Modulation: &gw.Modulation{
 						Lora: &gw.LoraModulationInfo{
 							Bandwidth:             d.config.Bandwidth,
-							SpreadingFactor:       d.config.SpreadingFactor,
+							SpreadingFactor:       uint32(sf),
 							CodeRate:              codeRate,
 							PolarizationInversion: true,
 						},
@@ -312,7 +370,7 @@ func (d *ConcentratordDriver) sendDownlink(payload []byte) error {
 		}
 	}
 
-	log.Printf("TX: %d bytes, freq=%d, SF=%d", len(payload), d.config.Frequency, d.config.SpreadingFactor)
+	log.Printf("TX: %d bytes, freq=%d, SF=%d, power=%d dBm", len(payload), d.config.Frequency, sf, txPower)
 	return nil
 }
 
@@ -362,32 +420,72 @@ func (d *ConcentratordDriver) handleUplink(uplink *gw.UplinkFrame) {
 		return
 	}
 
+	if uplink.RxInfo != nil && uplink.RxInfo.CrcStatus == gw.CRCStatus_BAD_CRC {
+		return
+	}
+
+	var rssi int16
+	var snr float32
+	if uplink.RxInfo != nil {
+		rssi, snr = int16(uplink.RxInfo.Rssi), uplink.RxInfo.Snr
+	}
 	payload := uplink.PhyPayload
 
-	if d.cipher != nil {
+	// Try rotated device keys first, whose frames are sealed whole, then the
+	// key derived from the UID in the header, and fall back to the network key
+	rotated, legacy := false, false
+	if decrypted, ok := d.keys.DecryptAny(payload); ok {
+		payload = decrypted
+		rotated = true
+	} else if decrypted, ok := d.decryptFromDevice(payload); ok {
+		payload = decrypted
+	} else if d.config.DeviceKeys && !d.config.LegacyDevices {
+		log.Printf("Dropping uplink: not sealed under a device key")
+		d.capture.Received(uplink.PhyPayload, nil, rssi, snr)
+		return
+	} else if d.cipher != nil {
 		decrypted, err := d.decrypt(payload)
 		if err != nil {
 			log.Printf("Failed to decrypt uplink: %v", err)
+			d.capture.Received(uplink.PhyPayload, nil, rssi, snr)
 			return
 		}
 		payload = decrypted
+		legacy = true
+	} else {
+		legacy = true
 	}
+	d.capture.Received(uplink.PhyPayload, payload, rssi, snr)
 
 	msg, err := protocol.Decode(payload)
 	if err != nil {
 		log.Printf("Failed to decode message: %v", err)
 		return
 	}
+	if !rotated && !d.keys.AcceptsNetworkKey(msg.Header.DeviceUID) {
+		log.Printf("Dropping uplink from %s: no accepted key", msg.DeviceUIDString())
+		return
+	}
+	if legacy && d.config.DeviceKeys {
+		d.keyCache.SetLegacy(msg.Header.DeviceUID, true)
+	}
 
 	if uplink.RxInfo != nil {
-		msg.RSSI = int16(uplink.RxInfo.Rssi)
-		msg.SNR = uplink.RxInfo.Snr
+		msg.RSSI, msg.SNR = rssi, snr
+		d.adr.Observe(msg.Header.DeviceUID, msg.RSSI, msg.SNR)
 	}
+	d.versions.Observe(msg.Header.DeviceUID, msg.Header.Version)
 	msg.ReceivedAt = time.Now().Unix()
 
 	log.Printf("RX: %d bytes from %s, RSSI=%d, SNR=%.1f",
 		len(payload), msg.DeviceUIDString(), msg.RSSI, msg.SNR)
 
+	// Hold fragments until the whole message has arrived
+	msg, ok := d.fragments.reassemble(msg)
+	if !ok {
+		return
+	}
+
 	d.mu.Lock()
 	cb := d.onReceive
 	d.mu.Unlock()
@@ -404,22 +502,32 @@ func (d *ConcentratordDriver) handleStats(stats *gw.GatewayStats) {
 	log.Printf("Gateway stats: RX=%d, TX=%d", stats.RxPacketsReceivedOk, stats.TxPacketsEmitted)
 }
 
-// encryptForDevice encrypts data using AES-128-GCM with per-device key
-func (d *ConcentratordDriver) encryptForDevice(deviceUID [8]byte, plaintext []byte) ([]byte, error) {
-	key := d.keyCache.GetKey(deviceUID)
-
-	d.mu.Lock()
-	d.txNonce++
-	nonce := d.txNonce
-	d.mu.Unlock()
-
-	return EncryptGCM(key, nonce, plaintext)
+// encryptForDevice seals a downlink under the device's derived key. Returns
+// false if device keys are off, or for broadcasts and legacy devices.
+func (d *ConcentratordDriver) encryptForDevice(deviceUID [8]byte, plaintext []byte) ([]byte, bool, error) {
+	if !d.config.DeviceKeys {
+		return nil, false, nil
+	}
+	return d.keyCache.Encrypt(deviceUID, plaintext)
 }
 
-// decryptFromDevice decrypts data using AES-128-GCM with per-device key
-func (d *ConcentratordDriver) decryptFromDevice(deviceUID [8]byte, ciphertext []byte) ([]byte, error) {
-	key := d.keyCache.GetKey(deviceUID)
-	return DecryptGCM(key, ciphertext)
+// decryptFromDevice opens an uplink whose payload is sealed under the
+// derived key of the device its header names, as the RAK2245 driver's are,
+// and returns the frame with the payload opened
+func (d *ConcentratordDriver) decryptFromDevice(frame []byte) ([]byte, bool) {
+	if !d.config.DeviceKeys {
+		return nil, false
+	}
+	msg, err := protocol.Decode(frame)
+	if err != nil {
+		return nil, false
+	}
+	plaintext, ok := d.keyCache.Decrypt(msg.Header.DeviceUID, msg.Payload)
+	if !ok {
+		return nil, false
+	}
+	msg.Payload = plaintext
+	return msg.Encode(), true
 }
 
 // encrypt encrypts data using legacy AES-128-CTR (for backward compatibility)
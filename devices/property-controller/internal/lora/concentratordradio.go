@@ -0,0 +1,277 @@
+package lora
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/agsys/property-controller/internal/lora/gw"
+	"github.com/agsys/property-controller/internal/protocol"
+	"github.com/go-zeromq/zmq4"
+)
+
+// concentratordPoll is how long Receive waits for an uplink before reporting
+// none
+const concentratordPoll = 100 * time.Millisecond
+
+// ConcentratordRadio is a Radio that moves frames through ChirpStack
+// Concentratord, so the driver can use any concentrator Concentratord
+// supports. Encryption, ADR, and fragmentation stay with the driver; the
+// radio only carries frames.
+type ConcentratordRadio struct {
+	eventURL   string
+	commandURL string
+	config     Config
+
+	ctx       context.Context
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+	eventSock zmq4.Socket
+	uplinks   chan *protocol.LoRaMessage
+
+	mu         sync.Mutex // Guards the command socket, one request at a time
+	cmdSock    zmq4.Socket
+	gatewayID  string
+	downlinkID uint32
+
+	statsMu sync.Mutex
+	onStats func(*gw.GatewayStats)
+}
+
+// NewConcentratordRadio creates a radio for the Concentratord event (SUB)
+// and command (REQ) sockets. Downlinks use the frequency, bandwidth, and
+// coding rate of config.
+func NewConcentratordRadio(eventURL, commandURL string, config Config) *ConcentratordRadio {
+	return &ConcentratordRadio{
+		eventURL:   eventURL,
+		commandURL: commandURL,
+		config:     config,
+		uplinks:    make(chan *protocol.LoRaMessage, 100),
+	}
+}
+
+// Start connects to Concentratord and starts receiving uplinks
+func (r *ConcentratordRadio) Start() error {
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+
+	r.eventSock = zmq4.NewSub(r.ctx)
+	if err := r.eventSock.Dial(r.eventURL); err != nil {
+		r.cancel()
+		return fmt.Errorf("failed to connect event socket: %w", err)
+	}
+	if err := r.eventSock.SetOption(zmq4.OptionSubscribe, ""); err != nil {
+		r.eventSock.Close()
+		r.cancel()
+		return fmt.Errorf("failed to subscribe: %w", err)
+	}
+
+	r.cmdSock = zmq4.NewReq(r.ctx)
+	if err := r.cmdSock.Dial(r.commandURL); err != nil {
+		r.eventSock.Close()
+		r.cancel()
+		return fmt.Errorf("failed to connect command socket: %w", err)
+	}
+
+	if err := r.fetchGatewayID(); err != nil {
+		log.Printf("Warning: failed to get gateway ID: %v", err)
+	}
+
+	r.wg.Add(1)
+	go r.eventLoop()
+
+	log.Printf("Concentratord radio started: event=%s, cmd=%s, gateway=%s", r.eventURL, r.commandURL, r.gatewayID)
+	return nil
+}
+
+// Stop closes the Concentratord sockets
+func (r *ConcentratordRadio) Stop() error {
+	if r.cancel == nil {
+		return nil
+	}
+	r.cancel()
+	r.eventSock.Close()
+	r.cmdSock.Close()
+	r.wg.Wait()
+	return nil
+}
+
+// SetStatsCallback sets the callback for the statistics Concentratord
+// publishes each stats interval
+func (r *ConcentratordRadio) SetStatsCallback(cb func(*gw.GatewayStats)) {
+	r.statsMu.Lock()
+	r.onStats = cb
+	r.statsMu.Unlock()
+}
+
+// Receive implements Radio
+func (r *ConcentratordRadio) Receive() (*protocol.LoRaMessage, error) {
+	select {
+	case msg := <-r.uplinks:
+		return msg, nil
+	case <-time.After(concentratordPoll):
+		return nil, nil
+	}
+}
+
+// Transmit implements Radio, sending data as an immediate downlink and
+// waiting for Concentratord's TX ack
+func (r *ConcentratordRadio) Transmit(data []byte, sf uint8, txPower int8) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.downlinkID++
+	downlink := &gw.DownlinkFrame{
+		DownlinkId: r.downlinkID,
+		GatewayId:  r.gatewayID,
+		Items: []*gw.DownlinkFrameItem{
+			{
+				PhyPayload: data,
+				TxInfo: &gw.DownlinkTxInfo{
+					Frequency: r.config.Frequency,
+					Power:     int32(txPower),
+					Modulation: &gw.Modulation{
+						Lora: &gw.LoraModulationInfo{
+							Bandwidth:             r.config.Bandwidth,
+							SpreadingFactor:       uint32(sf),
+							CodeRate:              codeRate(r.config.CodingRate),
+							PolarizationInversion: true,
+						},
+					},
+					Timing: &gw.Timing{
+						Immediately: &gw.ImmediatelyTimingInfo{},
+					},
+				},
+			},
+		},
+	}
+
+	dlData, err := gw.MarshalDownlinkFrame(downlink)
+	if err != nil {
+		return fmt.Errorf("failed to marshal downlink: %w", err)
+	}
+	if err := r.cmdSock.Send(zmq4.NewMsgFrom([]byte("down"), dlData)); err != nil {
+		return fmt.Errorf("failed to send downlink: %w", err)
+	}
+	resp, err := r.cmdSock.Recv()
+	if err != nil {
+		return fmt.Errorf("failed to receive TX ack: %w", err)
+	}
+
+	if len(resp.Frames) > 0 {
+		txAck, err := gw.UnmarshalDownlinkTxAck(resp.Frames[0])
+		if err != nil {
+			return fmt.Errorf("failed to unmarshal TX ack: %w", err)
+		}
+		if len(txAck.Items) > 0 && txAck.Items[0].Status != gw.TxAckStatus_OK {
+			return fmt.Errorf("TX failed: %s", txAck.Items[0].Status.String())
+		}
+	}
+	return nil
+}
+
+// fetchGatewayID asks Concentratord for the gateway's EUI
+func (r *ConcentratordRadio) fetchGatewayID() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.cmdSock.Send(zmq4.NewMsgFrom([]byte("gateway_id"), []byte{})); err != nil {
+		return fmt.Errorf("failed to send command: %w", err)
+	}
+	resp, err := r.cmdSock.Recv()
+	if err != nil {
+		return fmt.Errorf("failed to receive response: %w", err)
+	}
+	if len(resp.Frames) > 0 {
+		gwResp, err := gw.UnmarshalGetGatewayIdResponse(resp.Frames[0])
+		if err != nil {
+			return err
+		}
+		r.gatewayID = gwResp.GatewayId
+	}
+	return nil
+}
+
+// eventLoop queues uplinks from Concentratord for Receive and passes its
+// statistics on
+func (r *ConcentratordRadio) eventLoop() {
+	defer r.wg.Done()
+
+	for {
+		msg, err := r.eventSock.Recv()
+		if err != nil {
+			if r.ctx.Err() != nil {
+				return
+			}
+			continue
+		}
+		if len(msg.Frames) < 2 {
+			continue
+		}
+
+		event, err := gw.UnmarshalEvent(string(msg.Frames[0]), msg.Frames[1])
+		if err != nil {
+			log.Printf("Failed to unmarshal event: %v", err)
+			continue
+		}
+		if event.GatewayStats != nil {
+			r.handleStats(event.GatewayStats)
+			continue
+		}
+		uplink := event.UplinkFrame
+		if uplink == nil || len(uplink.PhyPayload) == 0 {
+			continue
+		}
+		if uplink.RxInfo != nil && uplink.RxInfo.CrcStatus == gw.CRCStatus_BAD_CRC {
+			continue
+		}
+
+		rx, err := protocol.Decode(uplink.PhyPayload)
+		if err != nil {
+			log.Printf("Failed to decode uplink: %v", err)
+			continue
+		}
+		if uplink.RxInfo != nil {
+			rx.RSSI = int16(uplink.RxInfo.Rssi)
+			rx.SNR = uplink.RxInfo.Snr
+		}
+
+		select {
+		case r.uplinks <- rx:
+		default:
+			log.Println("Concentratord uplink queue full, dropping packet")
+		}
+	}
+}
+
+// handleStats passes gateway statistics to the stats callback, naming the
+// gateway if Concentratord didn't
+func (r *ConcentratordRadio) handleStats(stats *gw.GatewayStats) {
+	if stats.GatewayId == "" {
+		r.mu.Lock()
+		stats.GatewayId = r.gatewayID
+		r.mu.Unlock()
+	}
+
+	r.statsMu.Lock()
+	cb := r.onStats
+	r.statsMu.Unlock()
+	if cb != nil {
+		cb(stats)
+	}
+}
+
+// codeRate converts a coding rate denominator (5-8) to its Concentratord
+// value
+func codeRate(cr uint8) gw.CodeRate {
+	switch cr {
+	case 6:
+		return gw.CodeRate_CR_4_6
+	case 7:
+		return gw.CodeRate_CR_4_7
+	case 8:
+		return gw.CodeRate_CR_4_8
+	}
+	return gw.CodeRate_CR_4_5
+}
@@ -0,0 +1,159 @@
+package lora
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/agsys/property-controller/internal/lora/gw"
+	"github.com/agsys/property-controller/internal/protocol"
+	"github.com/go-zeromq/zmq4"
+)
+
+// TestConcentratordRadio tests uplinks, downlinks, and gateway stats through
+// a fake Concentratord
+func TestConcentratordRadio(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir := t.TempDir()
+	eventURL := "ipc://" + filepath.Join(dir, "event")
+	commandURL := "ipc://" + filepath.Join(dir, "command")
+
+	pub := zmq4.NewPub(ctx)
+	defer pub.Close()
+	if err := pub.Listen(eventURL); err != nil {
+		t.Fatalf("Listen event failed: %v", err)
+	}
+	rep := zmq4.NewRep(ctx)
+	defer rep.Close()
+	if err := rep.Listen(commandURL); err != nil {
+		t.Fatalf("Listen command failed: %v", err)
+	}
+
+	// Answer the gateway ID request, then ack each downlink
+	downlinks := make(chan []byte, 1)
+	go func() {
+		for {
+			req, err := rep.Recv()
+			if err != nil || len(req.Frames) < 2 {
+				return
+			}
+			var reply []byte
+			switch string(req.Frames[0]) {
+			case "gateway_id":
+				reply = []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
+			case "down":
+				downlinks <- req.Frames[1]
+				reply, _ = gw.MarshalDownlinkTxAck(&gw.DownlinkTxAck{
+					Items: []*gw.DownlinkTxAckItem{{Status: gw.TxAckStatus_OK}},
+				})
+			}
+			if err := rep.Send(zmq4.NewMsg(reply)); err != nil {
+				return
+			}
+		}
+	}()
+
+	config := DefaultConfig()
+	config.CodingRate = 6
+	radio := NewConcentratordRadio(eventURL, commandURL, config)
+	stats := make(chan *gw.GatewayStats, 1)
+	radio.SetStatsCallback(func(s *gw.GatewayStats) { stats <- s })
+	if err := radio.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer radio.Stop()
+
+	uid := [8]byte{0x01, 0, 0, 0, 0, 0, 0, 0x09}
+	sent := &protocol.LoRaMessage{
+		Header: protocol.Header{
+			Magic:     [2]byte{protocol.MagicByte1, protocol.MagicByte2},
+			Version:   protocol.ProtocolVersion,
+			MsgType:   protocol.MsgTypeHeartbeat,
+			DeviceUID: uid,
+		},
+		Payload: []byte{1, 2, 3},
+	}
+	up, err := gw.MarshalUplinkFrame(&gw.UplinkFrame{
+		PhyPayload: sent.Encode(),
+		RxInfo:     &gw.UplinkRxInfo{Rssi: -90, Snr: 7.5, CrcStatus: gw.CRCStatus_CRC_OK},
+	})
+	if err != nil {
+		t.Fatalf("MarshalUplinkFrame failed: %v", err)
+	}
+
+	// The subscription takes a moment to reach the publisher, so publish
+	// until the uplink is received
+	deadline := time.Now().Add(5 * time.Second)
+	var got *protocol.LoRaMessage
+	for got == nil && time.Now().Before(deadline) {
+		if err := pub.Send(zmq4.NewMsgFrom([]byte("up"), up)); err != nil {
+			t.Fatalf("Publish failed: %v", err)
+		}
+		if got, err = radio.Receive(); err != nil {
+			t.Fatalf("Receive failed: %v", err)
+		}
+	}
+	if got == nil {
+		t.Fatal("No uplink received")
+	}
+	if got.Header.DeviceUID != uid || !bytes.Equal(got.Payload, sent.Payload) {
+		t.Errorf("Received %+v, want %+v", got, sent)
+	}
+	if got.RSSI != -90 || got.SNR != 7.5 {
+		t.Errorf("RSSI/SNR = %d/%.1f, want -90/7.5", got.RSSI, got.SNR)
+	}
+
+	frame := []byte{0xAA, 0xBB, 0xCC}
+	if err := radio.Transmit(frame, 9, 14); err != nil {
+		t.Fatalf("Transmit failed: %v", err)
+	}
+	want, _ := gw.MarshalDownlinkFrame(&gw.DownlinkFrame{
+		DownlinkId: 1,
+		GatewayId:  radio.gatewayID,
+		Items: []*gw.DownlinkFrameItem{{
+			PhyPayload: frame,
+			TxInfo: &gw.DownlinkTxInfo{
+				Frequency: config.Frequency,
+				Power:     14,
+				Modulation: &gw.Modulation{Lora: &gw.LoraModulationInfo{
+					Bandwidth:             config.Bandwidth,
+					SpreadingFactor:       9,
+					CodeRate:              gw.CodeRate_CR_4_6,
+					PolarizationInversion: true,
+				}},
+				Timing: &gw.Timing{Immediately: &gw.ImmediatelyTimingInfo{}},
+			},
+		}},
+	})
+	select {
+	case dl := <-downlinks:
+		if !bytes.Equal(dl, want) {
+			t.Errorf("Downlink = %X, want %X", dl, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("No downlink sent")
+	}
+
+	published, _ := gw.MarshalGatewayStats(&gw.GatewayStats{
+		RxPacketsReceived:   40,
+		RxPacketsReceivedOk: 36,
+		TxPacketsReceived:   5,
+		TxPacketsEmitted:    4,
+	})
+	if err := pub.Send(zmq4.NewMsgFrom([]byte("stats"), published)); err != nil {
+		t.Fatalf("Publish failed: %v", err)
+	}
+	select {
+	case s := <-stats:
+		if s.GatewayId != radio.gatewayID || s.RxPacketsReceived != 40 || s.RxPacketsReceivedOk != 36 ||
+			s.TxPacketsReceived != 5 || s.TxPacketsEmitted != 4 {
+			t.Errorf("Stats = %+v, want 36/40 received and 4/5 emitted by %q", s, radio.gatewayID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("No stats received")
+	}
+}
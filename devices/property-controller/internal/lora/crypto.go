@@ -5,9 +5,11 @@ package lora
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/binary"
 	"fmt"
+	"sync"
 )
 
 // Crypto constants matching the device firmware
@@ -17,8 +19,15 @@ const (
 	CryptoTagSize   = 4                               // Truncated auth tag
 	CryptoOverhead  = CryptoNonceSize + CryptoTagSize // 8 bytes
 	DeviceUIDSize   = 8
+
+	// DownlinkNonceFlag is set in the nonce of every downlink the controller
+	// seals, so it never equals an uplink nonce under the same key
+	DownlinkNonceFlag = 1 << 31
 )
 
+// nonceBlock is how many downlink nonces are reserved in storage at a time
+const nonceBlock = 1024
+
 // SecretSalt is the shared salt for key derivation.
 // WARNING: This must match the salt in devices/common/include/agsys_protocol.h
 // Change this for production deployments!
@@ -27,15 +36,77 @@ var SecretSalt = []byte{
 	0x61, 0x53, 0x61, 0x6C, 0x74, 0x32, 0x30, 0x32,
 } // "AgSysLoRaSalt202"
 
-// DeviceKeyCache caches derived keys for devices
+// NonceCounter hands out the nonces downlinks are sealed with. A nonce must
+// never repeat under a key, and keys outlive the process, so the counter is
+// resumed from a high-water mark kept in storage and reserves nonces ahead
+// of use a block at a time. Until it is resumed it starts at a random point.
+type NonceCounter struct {
+	mu       sync.Mutex
+	next     uint32 // Next counter value, below DownlinkNonceFlag
+	reserved uint32 // Counter values below this are covered by the stored mark
+	reserve  func(mark uint32) error
+}
+
+// NewNonceCounter creates a counter starting at a random point
+func NewNonceCounter() *NonceCounter {
+	var seed [4]byte
+	rand.Read(seed[:])
+	return &NonceCounter{next: binary.BigEndian.Uint32(seed[:]) >> 2}
+}
+
+// Resume continues from a high-water mark stored by an earlier run. reserve
+// stores each new mark before any nonce below it is used.
+func (n *NonceCounter) Resume(mark uint32, reserve func(mark uint32) error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.next = mark
+	n.reserved = mark
+	n.reserve = reserve
+}
+
+// Next returns the next downlink nonce, with DownlinkNonceFlag set
+func (n *NonceCounter) Next() (uint32, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.next >= DownlinkNonceFlag-1 {
+		return 0, fmt.Errorf("downlink nonces exhausted")
+	}
+	if n.reserve != nil && n.next >= n.reserved {
+		mark := min(n.next+nonceBlock, DownlinkNonceFlag-1)
+		if err := n.reserve(mark); err != nil {
+			return 0, fmt.Errorf("failed to reserve nonces: %w", err)
+		}
+		n.reserved = mark
+	}
+	nonce := n.next
+	n.next++
+	return nonce | DownlinkNonceFlag, nil
+}
+
+// DeviceKeyCache caches derived keys for devices, and tracks the legacy
+// devices still heard on the network key while the fleet migrates to them
 type DeviceKeyCache struct {
-	keys map[[DeviceUIDSize]byte][]byte
+	mu       sync.Mutex
+	keys     map[[DeviceUIDSize]byte][]byte
+	legacy   map[[DeviceUIDSize]byte]bool
+	migrated map[[DeviceUIDSize]byte]bool // Heard on their own key, for legacyDevices
+	nonces   *NonceCounter
+
+	// Answer devices on the network key until they are heard on their own,
+	// so a legacy device isn't sent a downlink it can't open after a restart
+	legacyDevices bool
 }
 
-// NewDeviceKeyCache creates a new key cache
-func NewDeviceKeyCache() *DeviceKeyCache {
+// NewDeviceKeyCache creates a new key cache that seals downlinks with nonces
+// from a counter. With legacyDevices, devices not yet heard on their own key
+// are answered on the network key.
+func NewDeviceKeyCache(nonces *NonceCounter, legacyDevices bool) *DeviceKeyCache {
 	return &DeviceKeyCache{
-		keys: make(map[[DeviceUIDSize]byte][]byte),
+		keys:          make(map[[DeviceUIDSize]byte][]byte),
+		legacy:        make(map[[DeviceUIDSize]byte]bool),
+		migrated:      make(map[[DeviceUIDSize]byte]bool),
+		nonces:        nonces,
+		legacyDevices: legacyDevices,
 	}
 }
 
@@ -57,6 +128,13 @@ func DeriveKey(deviceUID [DeviceUIDSize]byte) []byte {
 
 // GetKey returns the key for a device, deriving and caching if needed
 func (c *DeviceKeyCache) GetKey(deviceUID [DeviceUIDSize]byte) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.key(deviceUID)
+}
+
+// key returns the key for a device. Must be called with mu held.
+func (c *DeviceKeyCache) key(deviceUID [DeviceUIDSize]byte) []byte {
 	if key, ok := c.keys[deviceUID]; ok {
 		return key
 	}
@@ -66,6 +144,61 @@ func (c *DeviceKeyCache) GetKey(deviceUID [DeviceUIDSize]byte) []byte {
 	return key
 }
 
+// Encrypt seals a downlink for a device under its derived key. Returns false
+// for broadcasts and legacy devices, which stay on the network key.
+func (c *DeviceKeyCache) Encrypt(deviceUID [DeviceUIDSize]byte, plaintext []byte) ([]byte, bool, error) {
+	c.mu.Lock()
+	if isBroadcast(deviceUID) || c.legacy[deviceUID] || (c.legacyDevices && !c.migrated[deviceUID]) {
+		c.mu.Unlock()
+		return nil, false, nil
+	}
+	key := c.key(deviceUID)
+	c.mu.Unlock()
+
+	nonce, err := c.nonces.Next()
+	if err != nil {
+		return nil, false, err
+	}
+	encrypted, err := EncryptGCM(key, nonce, plaintext)
+	return encrypted, true, err
+}
+
+// Decrypt opens the payload of an uplink from the device its header names.
+// A device heard on its own key is no longer legacy.
+func (c *DeviceKeyCache) Decrypt(deviceUID [DeviceUIDSize]byte, packet []byte) ([]byte, bool) {
+	c.mu.Lock()
+	key := c.key(deviceUID)
+	c.mu.Unlock()
+
+	plaintext, ok := openWith(key, deviceUID, packet, false)
+	if ok {
+		c.SetLegacy(deviceUID, false)
+	}
+	return plaintext, ok
+}
+
+// SetLegacy marks a device as heard on the network key, so downlinks to it
+// use the network key too, or clears the mark once it uses its own key
+func (c *DeviceKeyCache) SetLegacy(deviceUID [DeviceUIDSize]byte, legacy bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if legacy {
+		c.key(deviceUID)
+		c.legacy[deviceUID] = true
+		delete(c.migrated, deviceUID)
+	} else {
+		delete(c.legacy, deviceUID)
+		c.migrated[deviceUID] = true
+	}
+}
+
+// Legacy returns the number of devices last heard on the network key
+func (c *DeviceKeyCache) Legacy() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.legacy)
+}
+
 // EncryptGCM encrypts data using AES-128-GCM with a 4-byte nonce.
 // Output format: [Nonce:4][Ciphertext:N][Tag:4]
 func EncryptGCM(key []byte, nonce uint32, plaintext []byte) ([]byte, error) {
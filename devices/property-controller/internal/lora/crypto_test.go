@@ -0,0 +1,196 @@
+package lora
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/agsys/property-controller/internal/lora/gw"
+	"github.com/agsys/property-controller/internal/protocol"
+)
+
+// TestDeviceKeys tests that traffic is sealed under keys derived from the
+// device UID, and that legacy devices are served on the network key only
+// while migrating
+func TestDeviceKeys(t *testing.T) {
+	migrated := [8]byte{0x04, 0, 0, 0, 0, 0, 0, 0x01}
+	legacy := [8]byte{0x04, 0, 0, 0, 0, 0, 0, 0x02}
+
+	start := func(legacyDevices bool) (*Driver, *chanRadio, chan *protocol.LoRaMessage) {
+		radio := &chanRadio{rx: make(chan *protocol.LoRaMessage, 2), tx: make(chan []byte, 2)}
+		config := DefaultConfig()
+		config.Radio = radio
+		config.DeviceKeys = true
+		config.LegacyDevices = legacyDevices
+
+		d, err := New(config)
+		if err != nil {
+			t.Fatalf("New failed: %v", err)
+		}
+		received := make(chan *protocol.LoRaMessage, 2)
+		d.SetReceiveCallback(func(msg *protocol.LoRaMessage) { received <- msg })
+		if err := d.Start(); err != nil {
+			t.Fatalf("Start failed: %v", err)
+		}
+		return d, radio, received
+	}
+	uplink := func(radio *chanRadio, from [8]byte, payload []byte) {
+		radio.rx <- newMessage(from, protocol.MsgTypeHeartbeat, protocol.ProtocolVersion, 1, payload)
+	}
+	expect := func(received chan *protocol.LoRaMessage, from [8]byte, payload []byte) {
+		t.Helper()
+		select {
+		case msg := <-received:
+			if msg.Header.DeviceUID != from || !bytes.Equal(msg.Payload, payload) {
+				t.Errorf("Received %X from %X, want %X from %X", msg.Payload, msg.Header.DeviceUID, payload, from)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Uplink from %X not received", from)
+		}
+	}
+
+	d, radio, received := start(true)
+	defer d.Stop()
+
+	// A device not yet heard from, as after a restart, is answered on the
+	// network key
+	if err := d.SendToDevice(legacy, protocol.MsgTypeTimeSync, []byte{9}); err != nil {
+		t.Fatalf("SendToDevice failed: %v", err)
+	}
+	select {
+	case data := <-radio.tx:
+		if msg, err := protocol.Decode(data); err != nil || msg.Header.DeviceUID != legacy {
+			t.Errorf("Downlink to a device not yet heard = %+v, %v, want the network key", msg, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Downlink to a device not yet heard not sent")
+	}
+
+	sealed, err := EncryptGCM(DeriveKey(migrated), 7, []byte{1, 2, 3})
+	if err != nil {
+		t.Fatalf("EncryptGCM failed: %v", err)
+	}
+	uplink(radio, migrated, sealed)
+	expect(received, migrated, []byte{1, 2, 3})
+	uplink(radio, legacy, []byte{4, 5, 6})
+	expect(received, legacy, []byte{4, 5, 6})
+	if n := d.Stats().Legacy; n != 1 {
+		t.Errorf("Legacy = %d, want 1", n)
+	}
+
+	// The migrated device is answered under its own key, the legacy one on
+	// the network key
+	for _, uid := range [][8]byte{migrated, legacy} {
+		if err := d.SendToDevice(uid, protocol.MsgTypeTimeSync, []byte{9}); err != nil {
+			t.Fatalf("SendToDevice failed: %v", err)
+		}
+		var data []byte
+		select {
+		case data = <-radio.tx:
+		case <-time.After(time.Second):
+			t.Fatalf("Downlink to %X not sent", uid)
+		}
+		if uid == migrated {
+			if data, err = DecryptGCM(DeriveKey(uid), data); err != nil {
+				t.Fatalf("Downlink to the migrated device not sealed under its key: %v", err)
+			}
+		}
+		if msg, err := protocol.Decode(data); err != nil || msg.Header.DeviceUID != uid {
+			t.Errorf("Downlink to %X = %+v, %v", uid, msg, err)
+		}
+	}
+
+	// The legacy device moves over once heard under its own key
+	sealed, _ = EncryptGCM(DeriveKey(legacy), 8, []byte{7})
+	uplink(radio, legacy, sealed)
+	expect(received, legacy, []byte{7})
+	if n := d.Stats().Legacy; n != 0 {
+		t.Errorf("Legacy = %d after the device moved over, want 0", n)
+	}
+
+	// Without legacy devices, the network key is refused
+	strict, radio, received := start(false)
+	defer strict.Stop()
+	uplink(radio, legacy, []byte{4, 5, 6})
+	select {
+	case msg := <-received:
+		t.Errorf("Accepted %+v on the network key", msg)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+// TestNonceCounter tests that downlink nonces carry the direction flag and
+// resume past every nonce reserved before a restart
+func TestNonceCounter(t *testing.T) {
+	var stored uint32
+	reserve := func(mark uint32) error {
+		stored = mark
+		return nil
+	}
+
+	used := make(map[uint32]bool)
+	for run := 0; run < 2; run++ {
+		n := NewNonceCounter()
+		n.Resume(stored, reserve)
+		for i := 0; i < nonceBlock+1; i++ {
+			nonce, err := n.Next()
+			if err != nil {
+				t.Fatalf("Next failed: %v", err)
+			}
+			if nonce&DownlinkNonceFlag == 0 {
+				t.Fatalf("Nonce %08X lacks the downlink flag", nonce)
+			}
+			if used[nonce] {
+				t.Fatalf("Nonce %08X used twice in run %d", nonce, run)
+			}
+			used[nonce] = true
+		}
+	}
+	if stored != 4*nonceBlock {
+		t.Errorf("Stored mark = %d, want %d", stored, 4*nonceBlock)
+	}
+
+	n := NewNonceCounter()
+	n.Resume(stored, func(uint32) error { return errors.New("disk full") })
+	if _, err := n.Next(); err == nil {
+		t.Error("Next handed out a nonce it could not reserve")
+	}
+
+	// An uplink sealed with a downlink nonce is refused
+	uid := [8]byte{0x04, 0, 0, 0, 0, 0, 0, 0x03}
+	cache := NewDeviceKeyCache(NewNonceCounter(), false)
+	sealed, _, _ := cache.Encrypt(uid, []byte{1})
+	if _, ok := cache.Decrypt(uid, sealed); ok {
+		t.Error("Accepted a downlink played back as an uplink")
+	}
+}
+
+// TestConcentratordDeviceKeys tests that the Concentratord driver opens an
+// uplink under the key derived from the UID in its header, for a device it
+// has never heard before
+func TestConcentratordDeviceKeys(t *testing.T) {
+	config := DefaultConcentratordConfig()
+	config.DeviceKeys = true
+	d, err := NewConcentratordDriver(config)
+	if err != nil {
+		t.Fatalf("NewConcentratordDriver failed: %v", err)
+	}
+	var received []*protocol.LoRaMessage
+	d.SetReceiveCallback(func(msg *protocol.LoRaMessage) { received = append(received, msg) })
+
+	uid := [8]byte{0x04, 0, 0, 0, 0, 0, 0, 0x04}
+	sealed, err := EncryptGCM(DeriveKey(uid), 7, []byte{1, 2, 3})
+	if err != nil {
+		t.Fatalf("EncryptGCM failed: %v", err)
+	}
+	d.handleUplink(&gw.UplinkFrame{PhyPayload: newMessage(uid, protocol.MsgTypeHeartbeat, protocol.ProtocolVersion, 1, sealed).Encode()})
+	// Another device's key doesn't open it, nor does the network key
+	other := [8]byte{0x04, 0, 0, 0, 0, 0, 0, 0x05}
+	d.handleUplink(&gw.UplinkFrame{PhyPayload: newMessage(other, protocol.MsgTypeHeartbeat, protocol.ProtocolVersion, 2, sealed).Encode()})
+	d.handleUplink(&gw.UplinkFrame{PhyPayload: newMessage(other, protocol.MsgTypeHeartbeat, protocol.ProtocolVersion, 3, []byte{4}).Encode()})
+
+	if len(received) != 1 || received[0].Header.DeviceUID != uid || !bytes.Equal(received[0].Payload, []byte{1, 2, 3}) {
+		t.Errorf("Received %+v, want only %X from %X", received, []byte{1, 2, 3}, uid)
+	}
+}
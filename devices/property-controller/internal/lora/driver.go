@@ -1,5 +1,6 @@
-// Package lora provides the LoRa communication driver for the RAK2245 Pi HAT.
-// The RAK2245 uses the SX1301 concentrator chip which communicates via SPI.
+// Package lora provides the LoRa communication driver. By default it drives
+// the SX1301 concentrator of a RAK2245 Pi HAT over SPI; a Radio can carry
+// frames through Concentratord or an SX1302 concentrator instead.
 package lora
 
 import (
@@ -7,12 +8,14 @@ import (
 	"crypto/cipher"
 	"crypto/rand"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"sync"
 	"time"
 
+	"github.com/agsys/property-controller/internal/lora/gw"
 	"github.com/agsys/property-controller/internal/protocol"
 )
 
@@ -25,6 +28,15 @@ type Config struct {
 	TxPower         int8   // Transmit power in dBm
 	SyncWord        uint8  // Sync word for private network
 	AESKey          []byte // 16-byte AES-128 key for encryption
+	DeviceKeys      bool   // Seal unicast frames with AES-128-GCM under keys derived from each device's UID
+	LegacyDevices   bool   // With DeviceKeys, still accept the network key from devices not yet migrated and answer them on it
+	ADR             ADRConfig
+	Radio           Radio         // Packet I/O in place of the SX1301 (nil uses the RAK2245)
+	CaptureFile     string        // Append every frame received and transmitted to this file (empty disables)
+	DownlinkTTL     time.Duration // How long SendInWindow holds a downlink for a device not heard from (0 keeps it)
+	TxJitter        time.Duration // Longest random delay before each downlink (0 disables)
+	MaxDwell        time.Duration // Longest a frame may be on the air, where the region limits it (0 disables)
+	LBT             LBTConfig
 }
 
 // DefaultConfig returns default LoRa configuration for US 915 MHz
@@ -37,32 +49,90 @@ func DefaultConfig() Config {
 		TxPower:         20,
 		SyncWord:        0x34,
 		AESKey:          nil, // Must be set by application
+		ADR:             DefaultADRConfig(),
+		DownlinkTTL:     24 * time.Hour,
+		LBT:             DefaultLBTConfig(),
 	}
 }
 
-// Driver handles LoRa communication via the RAK2245
+// Driver handles LoRa communication through a Radio
 type Driver struct {
-	config   Config
-	cipher   cipher.Block
-	rxChan   chan *protocol.LoRaMessage
-	txChan   chan *protocol.LoRaMessage
-	stopChan chan struct{}
-	wg       sync.WaitGroup
-	mu       sync.Mutex
-	running  bool
-	seqNum   uint16
+	config    Config
+	cipher    cipher.Block
+	keys      *KeyStore
+	derived   *DeviceKeyCache // Derived per-device keys, nil unless DeviceKeys is set
+	adr       *ADR
+	versions  *frameVersions
+	fragments *fragmenter
+	window    *windowQueue
+	capture   *Capture
+	rxChan    chan *protocol.LoRaMessage
+	txChan    chan *protocol.LoRaMessage
+	stopChan  chan struct{}
+	wg        sync.WaitGroup
+	mu        sync.Mutex
+	running   bool
+	seqNum    uint16
+
+	// Packet counters, guarded by mu
+	rxPackets uint64
+	txPackets uint64
+	txErrors  uint64
+	txSkipped uint64
+	lastRx    time.Time
 
 	// Callbacks
-	onReceive func(*protocol.LoRaMessage)
+	onReceive      func(*protocol.LoRaMessage)
+	onGatewayStats func(*gw.GatewayStats)
+	onTxResult     func(TxResult)
 }
 
+// TxResult reports how the transmission of a queued message ended. Err is
+// nil once the radio has sent the frame, ErrChannelBusy if listen-before-talk
+// never found the channel clear, or the encryption or radio error otherwise.
+type TxResult struct {
+	DeviceUID [8]byte
+	MsgType   uint8
+	Sequence  uint16
+	Err       error
+}
+
+// downlinkDriver is what the Driver and the older ConcentratordDriver both
+// offer callers. The checks below keep the two from drifting apart.
+type downlinkDriver interface {
+	Start() error
+	Stop() error
+	Keys() *KeyStore
+	SetReceiveCallback(cb func(*protocol.LoRaMessage))
+	Send(msg *protocol.LoRaMessage) error
+	SendToDevice(deviceUID [8]byte, msgType uint8, payload []byte) error
+	SendFragmented(deviceUID [8]byte, msgType uint8, payload []byte) error
+	SetDeviceVersion(deviceUID [8]byte, version uint8)
+	Broadcast(msgType uint8, payload []byte) error
+	GetNextSeqNum() uint16
+}
+
+var (
+	_ downlinkDriver = (*Driver)(nil)
+	_ downlinkDriver = (*ConcentratordDriver)(nil)
+)
+
 // New creates a new LoRa driver
 func New(config Config) (*Driver, error) {
 	d := &Driver{
-		config:   config,
-		rxChan:   make(chan *protocol.LoRaMessage, 100),
-		txChan:   make(chan *protocol.LoRaMessage, 100),
-		stopChan: make(chan struct{}),
+		config:    config,
+		keys:      NewKeyStore(DefaultKeyGrace),
+		adr:       NewADR(config.ADR, config.SpreadingFactor, config.TxPower),
+		versions:  newFrameVersions(),
+		fragments: newFragmenter(),
+		window:    newWindowQueue(config.DownlinkTTL),
+		rxChan:    make(chan *protocol.LoRaMessage, 100),
+		txChan:    make(chan *protocol.LoRaMessage, 100),
+		stopChan:  make(chan struct{}),
+	}
+
+	if config.DeviceKeys {
+		d.derived = NewDeviceKeyCache(d.keys.Nonces(), config.LegacyDevices)
 	}
 
 	// Initialize AES cipher if key provided
@@ -74,6 +144,21 @@ func New(config Config) (*Driver, error) {
 		d.cipher = block
 	}
 
+	if config.CaptureFile != "" {
+		capture, err := OpenCapture(config.CaptureFile)
+		if err != nil {
+			return nil, err
+		}
+		d.capture = capture
+	}
+
+	if d.config.Radio == nil {
+		d.config.Radio = NewSX1301Radio(DefaultSX1301Config(), config)
+	}
+	if r, ok := d.config.Radio.(gatewayStatsReporter); ok {
+		r.SetStatsCallback(d.handleGatewayStats)
+	}
+
 	return d, nil
 }
 
@@ -87,7 +172,7 @@ func (d *Driver) Start() error {
 	d.running = true
 	d.mu.Unlock()
 
-	// Initialize RAK2245 hardware
+	// Initialize the radio hardware
 	if err := d.initHardware(); err != nil {
 		return fmt.Errorf("failed to initialize hardware: %w", err)
 	}
@@ -119,7 +204,54 @@ func (d *Driver) Stop() error {
 	close(d.stopChan)
 	d.wg.Wait()
 
-	return d.shutdownHardware()
+	err := d.shutdownHardware()
+	d.capture.Close()
+	return err
+}
+
+// DriverStats is a snapshot of driver state for status reporting
+type DriverStats struct {
+	Running   bool
+	Frequency uint32
+	RxPackets uint64
+	TxPackets uint64
+	TxErrors  uint64
+	TxSkipped uint64 // Downlinks not sent as the channel stayed busy
+	TxQueued  int
+	TxWindow  int // Downlinks held for devices' next uplinks
+	Legacy    int // Devices still heard on the network key with DeviceKeys set
+	LastRx    time.Time
+}
+
+// Stats returns the current driver state and packet counters
+func (d *Driver) Stats() DriverStats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return DriverStats{
+		Running:   d.running,
+		Frequency: d.config.Frequency,
+		RxPackets: d.rxPackets,
+		TxPackets: d.txPackets,
+		TxErrors:  d.txErrors,
+		TxSkipped: d.txSkipped,
+		TxQueued:  len(d.txChan),
+		TxWindow:  d.window.pending(),
+		Legacy:    d.legacyDevices(),
+		LastRx:    d.lastRx,
+	}
+}
+
+// legacyDevices returns the number of devices still on the network key
+func (d *Driver) legacyDevices() int {
+	if d.derived == nil {
+		return 0
+	}
+	return d.derived.Legacy()
+}
+
+// Keys returns the store of rotated per-device keys
+func (d *Driver) Keys() *KeyStore {
+	return d.keys
 }
 
 // SetReceiveCallback sets the callback for received messages
@@ -129,7 +261,49 @@ func (d *Driver) SetReceiveCallback(cb func(*protocol.LoRaMessage)) {
 	d.mu.Unlock()
 }
 
-// Send queues a message for transmission
+// SetGatewayStatsCallback sets the callback for the periodic statistics of
+// the gateway, for radios that report them
+func (d *Driver) SetGatewayStatsCallback(cb func(*gw.GatewayStats)) {
+	d.mu.Lock()
+	d.onGatewayStats = cb
+	d.mu.Unlock()
+}
+
+// handleGatewayStats passes gateway statistics from the radio on
+func (d *Driver) handleGatewayStats(stats *gw.GatewayStats) {
+	d.mu.Lock()
+	cb := d.onGatewayStats
+	d.mu.Unlock()
+	if cb != nil {
+		cb(stats)
+	}
+}
+
+// SetTxResultCallback sets the callback for the outcome of each message
+// taken off the transmit queue
+func (d *Driver) SetTxResultCallback(cb func(TxResult)) {
+	d.mu.Lock()
+	d.onTxResult = cb
+	d.mu.Unlock()
+}
+
+// reportTx passes the outcome of a transmission on
+func (d *Driver) reportTx(msg *protocol.LoRaMessage, err error) {
+	d.mu.Lock()
+	cb := d.onTxResult
+	d.mu.Unlock()
+	if cb != nil {
+		cb(TxResult{
+			DeviceUID: msg.Header.DeviceUID,
+			MsgType:   msg.Header.MsgType,
+			Sequence:  msg.Header.Sequence,
+			Err:       err,
+		})
+	}
+}
+
+// Send queues a message for transmission. A nil error only means the message
+// was queued; the outcome of the transmission goes to the TX result callback.
 func (d *Driver) Send(msg *protocol.LoRaMessage) error {
 	d.mu.Lock()
 	if !d.running {
@@ -138,6 +312,10 @@ func (d *Driver) Send(msg *protocol.LoRaMessage) error {
 	}
 	d.mu.Unlock()
 
+	if err := d.checkSize(msg); err != nil {
+		return err
+	}
+
 	select {
 	case d.txChan <- msg:
 		return nil
@@ -153,62 +331,71 @@ func (d *Driver) SendToDevice(deviceUID [8]byte, msgType uint8, payload []byte)
 	seq := d.seqNum
 	d.mu.Unlock()
 
-	msg := &protocol.LoRaMessage{
-		Header: protocol.Header{
-			Magic:      [2]byte{protocol.MagicByte1, protocol.MagicByte2},
-			Version:    protocol.ProtocolVersion,
-			MsgType:    msgType,
-			DeviceType: 0,
-			DeviceUID:  deviceUID,
-			Sequence:   seq,
-		},
-		Payload: payload,
+	return d.Send(newMessage(deviceUID, msgType, d.versions.For(deviceUID), seq, payload))
+}
+
+// SetDeviceVersion sets the protocol version downlinks to a device are framed
+// in, until it next sends an uplink. Used to restore versions at startup.
+func (d *Driver) SetDeviceVersion(deviceUID [8]byte, version uint8) {
+	d.versions.Observe(deviceUID, version)
+}
+
+// SendFragmented sends a payload to a device, split into fragments if it is
+// too large for a single frame at the device's spreading factor
+func (d *Driver) SendFragmented(deviceUID [8]byte, msgType uint8, payload []byte) error {
+	sf, _ := d.adr.TxParams(deviceUID)
+	limit := maxPayload(d.frameLimit(sf), d.versions.For(deviceUID))
+	fragType, parts, err := d.fragments.split(msgType, payload, limit)
+	if err != nil {
+		return err
+	}
+	for _, part := range parts {
+		if err := d.SendToDevice(deviceUID, fragType, part); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	return d.Send(msg)
+// SendInWindow holds a non-urgent message for a device until it next sends
+// an uplink, then sends it (fragmented if needed) in the receive window that
+// follows. Battery devices only listen briefly after their uplinks, so
+// downlinks sent at other times are mostly lost.
+func (d *Driver) SendInWindow(deviceUID [8]byte, msgType uint8, payload []byte) error {
+	if deviceUID == broadcastUID {
+		return fmt.Errorf("broadcasts can't wait for an uplink")
+	}
+	d.window.add(deviceUID, msgType, payload, time.Now())
+	return nil
+}
+
+// sendWindow sends the downlinks held for a device that just sent an uplink
+func (d *Driver) sendWindow(deviceUID [8]byte, now time.Time) {
+	for _, dl := range d.window.take(deviceUID, now) {
+		if err := d.SendFragmented(deviceUID, dl.msgType, dl.payload); err != nil {
+			log.Printf("Failed to send held downlink type 0x%02X to %s: %v", dl.msgType, DeviceUIDToString(deviceUID), err)
+		}
+	}
 }
 
 // Broadcast sends a message to all devices (uses broadcast UID)
 func (d *Driver) Broadcast(msgType uint8, payload []byte) error {
-	var broadcastUID [8]byte
-	for i := range broadcastUID {
-		broadcastUID[i] = 0xFF
-	}
 	return d.SendToDevice(broadcastUID, msgType, payload)
 }
 
-// initHardware initializes the RAK2245 SX1301 concentrator
+// initHardware starts the radio, if it holds hardware or connections
 func (d *Driver) initHardware() error {
-	// The RAK2245 uses the Semtech SX1301 concentrator chip
-	// Communication is via SPI on the Raspberry Pi
-	//
-	// For production, this would use the libloragw library or
-	// communicate directly via SPI. For now, we'll use a stub
-	// that can be replaced with actual hardware calls.
-	//
-	// The SX1301 initialization sequence:
-	// 1. Reset the concentrator via GPIO
-	// 2. Load firmware to the concentrator's MCU
-	// 3. Configure radio parameters (frequency, SF, BW, etc.)
-	// 4. Start the concentrator
-
-	log.Println("Initializing RAK2245 hardware (stub)")
-
-	// TODO: Implement actual SX1301 initialization
-	// This would typically use CGO to call libloragw functions:
-	// - lgw_board_setconf()
-	// - lgw_rxrf_setconf()
-	// - lgw_rxif_setconf()
-	// - lgw_txgain_setconf()
-	// - lgw_start()
-
+	if r, ok := d.config.Radio.(radioLifecycle); ok {
+		return r.Start()
+	}
 	return nil
 }
 
-// shutdownHardware cleanly shuts down the LoRa hardware
+// shutdownHardware cleanly shuts down the radio
 func (d *Driver) shutdownHardware() error {
-	log.Println("Shutting down RAK2245 hardware")
-	// TODO: Call lgw_stop()
+	if r, ok := d.config.Radio.(radioLifecycle); ok {
+		return r.Stop()
+	}
 	return nil
 }
 
@@ -222,7 +409,6 @@ func (d *Driver) receiveLoop() {
 			return
 		default:
 			// Poll for received packets
-			// In production, this would call lgw_receive() or use interrupts
 			msg, err := d.receivePacket()
 			if err != nil {
 				// No packet available or error
@@ -231,22 +417,64 @@ func (d *Driver) receiveLoop() {
 			}
 
 			if msg != nil {
-				// Decrypt if encryption enabled
-				if d.cipher != nil && len(msg.Payload) > 0 {
-					decrypted, err := d.decrypt(msg.Payload)
-					if err != nil {
-						log.Printf("Failed to decrypt message from %s: %v", msg.DeviceUIDString(), err)
+				var raw []byte
+				if d.capture != nil {
+					raw = msg.Encode() // Before decryption replaces the payload
+				}
+
+				// Decrypt with the device's rotated key, then the key
+				// derived from the UID in its header, falling back to the
+				// network key if encryption enabled
+				if len(msg.Payload) > 0 {
+					uid := msg.Header.DeviceUID
+					if decrypted, ok := d.keys.Decrypt(uid, msg.Payload); ok {
+						msg.Payload = decrypted
+					} else if !d.keys.AcceptsNetworkKey(uid) {
+						log.Printf("Dropping message from %s: no accepted key", msg.DeviceUIDString())
+						d.capture.Received(raw, nil, msg.RSSI, msg.SNR)
+						continue
+					} else if decrypted, ok := d.decryptDerived(uid, msg.Payload); ok {
+						msg.Payload = decrypted
+					} else if d.derived != nil && !d.config.LegacyDevices {
+						log.Printf("Dropping message from %s: not sealed under its device key", msg.DeviceUIDString())
+						d.capture.Received(raw, nil, msg.RSSI, msg.SNR)
 						continue
+					} else if d.cipher != nil {
+						decrypted, err := d.decrypt(msg.Payload)
+						if err != nil {
+							log.Printf("Failed to decrypt message from %s: %v", msg.DeviceUIDString(), err)
+							d.capture.Received(raw, nil, msg.RSSI, msg.SNR)
+							continue
+						}
+						msg.Payload = decrypted
+						d.markLegacy(uid)
+					} else {
+						d.markLegacy(uid)
 					}
-					msg.Payload = decrypted
+				}
+				if d.capture != nil {
+					d.capture.Received(raw, msg.Encode(), msg.RSSI, msg.SNR)
 				}
 
-				msg.ReceivedAt = time.Now().Unix()
+				now := time.Now()
+				msg.ReceivedAt = now.Unix()
+				d.adr.Observe(msg.Header.DeviceUID, msg.RSSI, msg.SNR)
+				d.versions.Observe(msg.Header.DeviceUID, msg.Header.Version)
 
-				// Call callback if set
 				d.mu.Lock()
+				d.rxPackets++
+				d.lastRx = now
 				cb := d.onReceive
 				d.mu.Unlock()
+
+				// Hold fragments until the whole message has arrived
+				whole, ok := d.fragments.reassemble(msg)
+				if !ok {
+					continue
+				}
+				msg = whole
+
+				// Call callback if set
 				if cb != nil {
 					cb(msg)
 				}
@@ -257,6 +485,9 @@ func (d *Driver) receiveLoop() {
 				default:
 					log.Println("Receive queue full, dropping packet")
 				}
+
+				// The device is listening now, after any reply to the uplink
+				d.sendWindow(msg.Header.DeviceUID, now)
 			}
 		}
 	}
@@ -273,21 +504,60 @@ func (d *Driver) transmitLoop() {
 		case msg := <-d.txChan:
 			// Encode message
 			data := msg.Encode()
+			frame := data
 
-			// Encrypt if encryption enabled
-			if d.cipher != nil {
+			// Encrypt with the device's rotated key, or the network key
+			// if encryption enabled
+			if encrypted, ok, err := d.keys.Encrypt(msg.Header.DeviceUID, data); err != nil {
+				log.Printf("Failed to encrypt message: %v", err)
+				d.reportTx(msg, err)
+				continue
+			} else if ok {
+				data = encrypted
+			} else if encrypted, ok, err := d.encryptDerived(msg.Header.DeviceUID, data); err != nil {
+				log.Printf("Failed to encrypt message: %v", err)
+				d.reportTx(msg, err)
+				continue
+			} else if ok {
+				data = encrypted
+			} else if d.cipher != nil {
 				encrypted, err := d.encrypt(data)
 				if err != nil {
 					log.Printf("Failed to encrypt message: %v", err)
+					d.reportTx(msg, err)
 					continue
 				}
 				data = encrypted
 			}
 
-			// Transmit
-			if err := d.transmitPacket(data); err != nil {
+			// Transmit with per-device data rate
+			// The data rate may have dropped since the message was queued
+			sf, txPower := d.adr.TxParams(msg.Header.DeviceUID)
+			var err error
+			if limit := d.frameLimit(sf); len(data) > limit {
+				err = fmt.Errorf("%w: %d byte frame to %s, over the %d that fit at SF%d and %d kHz",
+					ErrFrameTooLarge, len(data), msg.DeviceUIDString(), limit, sf, d.config.Bandwidth/1000)
+			} else {
+				err = d.transmitClear(msg.Header.DeviceUID, data, sf, txPower)
+			}
+			d.capture.Sent(data, frame, sf, txPower, err)
+			busy := errors.Is(err, ErrChannelBusy)
+			d.mu.Lock()
+			switch {
+			case busy:
+				d.txSkipped++
+			case err != nil:
+				d.txErrors++
+			default:
+				d.txPackets++
+			}
+			d.mu.Unlock()
+			if busy {
+				log.Printf("Skipped downlink to %s: channel still busy", msg.DeviceUIDString())
+			} else if err != nil {
 				log.Printf("Failed to transmit packet: %v", err)
 			}
+			d.reportTx(msg, err)
 
 			// Small delay between transmissions
 			time.Sleep(100 * time.Millisecond)
@@ -297,24 +567,59 @@ func (d *Driver) transmitLoop() {
 
 // receivePacket attempts to receive a LoRa packet
 func (d *Driver) receivePacket() (*protocol.LoRaMessage, error) {
-	// TODO: Implement actual packet reception via SX1301
-	// This would call lgw_receive() and process the packet
-	//
-	// For now, return nil to indicate no packet
-	return nil, nil
-}
-
-// transmitPacket transmits a LoRa packet
-func (d *Driver) transmitPacket(data []byte) error {
-	// TODO: Implement actual packet transmission via SX1301
-	// This would:
-	// 1. Create a lgw_pkt_tx_s structure
-	// 2. Set frequency, modulation, SF, BW, power, etc.
-	// 3. Copy payload data
-	// 4. Call lgw_send()
-
-	log.Printf("TX: %d bytes", len(data))
-	return nil
+	return d.config.Radio.Receive()
+}
+
+// transmitPacket transmits a LoRa packet to a device
+func (d *Driver) transmitPacket(deviceUID [8]byte, data []byte, sf uint8, txPower int8) error {
+	if r, ok := d.config.Radio.(deviceRadio); ok {
+		return r.TransmitTo(deviceUID, data, sf, txPower)
+	}
+	return d.config.Radio.Transmit(data, sf, txPower)
+}
+
+// frameLimit returns the largest frame sent at a spreading factor on the
+// configured channel
+func (d *Driver) frameLimit(sf uint8) int {
+	return maxFrameSize(sf, d.config.Bandwidth, d.config.CodingRate, d.config.MaxDwell)
+}
+
+// checkSize returns ErrFrameTooLarge, saying by how much, if a message's
+// payload won't fit a frame at the device's current data rate
+func (d *Driver) checkSize(msg *protocol.LoRaMessage) error {
+	sf, _ := d.adr.TxParams(msg.Header.DeviceUID)
+	limit := maxPayload(d.frameLimit(sf), msg.Header.Version)
+	if len(msg.Payload) <= limit {
+		return nil
+	}
+	return fmt.Errorf("%w: 0x%02X payload to %s is %d bytes, over the %d that fit at SF%d and %d kHz; send it fragmented",
+		ErrFrameTooLarge, msg.Header.MsgType, msg.DeviceUIDString(), len(msg.Payload), limit, sf, d.config.Bandwidth/1000)
+}
+
+// encryptDerived seals a downlink under the device's derived key. Returns
+// false if device keys are off, or for broadcasts and legacy devices.
+func (d *Driver) encryptDerived(deviceUID [8]byte, plaintext []byte) ([]byte, bool, error) {
+	if d.derived == nil {
+		return nil, false, nil
+	}
+	return d.derived.Encrypt(deviceUID, plaintext)
+}
+
+// decryptDerived opens an uplink payload under the derived key of the device
+// its header names
+func (d *Driver) decryptDerived(deviceUID [8]byte, packet []byte) ([]byte, bool) {
+	if d.derived == nil {
+		return nil, false
+	}
+	return d.derived.Decrypt(deviceUID, packet)
+}
+
+// markLegacy records a device heard on the network key while migrating to
+// device keys, so it is answered on the network key until it moves over
+func (d *Driver) markLegacy(deviceUID [8]byte) {
+	if d.derived != nil {
+		d.derived.SetLegacy(deviceUID, true)
+	}
 }
 
 // encrypt encrypts data using AES-128-CTR
@@ -391,6 +696,21 @@ func DeviceUIDToString(uid [8]byte) string {
 		uid[0], uid[1], uid[2], uid[3], uid[4], uid[5], uid[6], uid[7])
 }
 
+// newMessage builds a downlink in the frame layout every driver sends. The
+// controller has no device type of its own, so it is left zero.
+func newMessage(deviceUID [8]byte, msgType, version uint8, seq uint16, payload []byte) *protocol.LoRaMessage {
+	return &protocol.LoRaMessage{
+		Header: protocol.Header{
+			Magic:     [2]byte{protocol.MagicByte1, protocol.MagicByte2},
+			Version:   version,
+			MsgType:   msgType,
+			DeviceUID: deviceUID,
+			Sequence:  seq,
+		},
+		Payload: payload,
+	}
+}
+
 // CreateValveCommand creates a valve command message
 func CreateValveCommand(controllerUID [8]byte, actuatorAddr uint8, command uint8, commandID uint16) *protocol.LoRaMessage {
 	payload := &protocol.ValveCommandPayload{
@@ -399,16 +719,7 @@ func CreateValveCommand(controllerUID [8]byte, actuatorAddr uint8, command uint8
 		CommandID:    commandID,
 	}
 
-	return &protocol.LoRaMessage{
-		Header: protocol.Header{
-			Magic:      [2]byte{protocol.MagicByte1, protocol.MagicByte2},
-			Version:    protocol.ProtocolVersion,
-			MsgType:    protocol.MsgTypeValveCommand,
-			DeviceType: 0,
-			DeviceUID:  controllerUID,
-		},
-		Payload: payload.Encode(),
-	}
+	return newMessage(controllerUID, protocol.MsgTypeValveCommand, protocol.ProtocolVersion, 0, payload.Encode())
 }
 
 // CreateTimeSyncMessage creates a time sync message
@@ -418,21 +729,7 @@ func CreateTimeSyncMessage(utcOffset int8) *protocol.LoRaMessage {
 		UTCOffset:     utcOffset,
 	}
 
-	var broadcastUID [8]byte
-	for i := range broadcastUID {
-		broadcastUID[i] = 0xFF
-	}
-
-	return &protocol.LoRaMessage{
-		Header: protocol.Header{
-			Magic:      [2]byte{protocol.MagicByte1, protocol.MagicByte2},
-			Version:    protocol.ProtocolVersion,
-			MsgType:    protocol.MsgTypeTimeSync,
-			DeviceType: 0,
-			DeviceUID:  broadcastUID,
-		},
-		Payload: payload.Encode(),
-	}
+	return newMessage(broadcastUID, protocol.MsgTypeTimeSync, protocol.ProtocolVersion, 0, payload.Encode())
 }
 
 // CreateScheduleUpdateMessage creates a schedule update message
@@ -443,16 +740,7 @@ func CreateScheduleUpdateMessage(controllerUID [8]byte, version uint16, entries
 		Entries:    entries,
 	}
 
-	return &protocol.LoRaMessage{
-		Header: protocol.Header{
-			Magic:      [2]byte{protocol.MagicByte1, protocol.MagicByte2},
-			Version:    protocol.ProtocolVersion,
-			MsgType:    protocol.MsgTypeScheduleUpdate,
-			DeviceType: 0,
-			DeviceUID:  controllerUID,
-		},
-		Payload: payload.Encode(),
-	}
+	return newMessage(controllerUID, protocol.MsgTypeScheduleUpdate, protocol.ProtocolVersion, 0, payload.Encode())
 }
 
 // Ensure binary is imported (used in protocol package)
@@ -0,0 +1,118 @@
+package lora
+
+import (
+	"crypto/aes"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/agsys/property-controller/internal/protocol"
+)
+
+// FragmentTimeout is how long an incomplete fragmented uplink is held
+const FragmentTimeout = 2 * time.Minute
+
+// ErrFrameTooLarge is returned for a downlink that would not fit a frame at
+// the device's data rate. Large payloads must be sent fragmented.
+var ErrFrameTooLarge = errors.New("frame too large")
+
+// maxFramePayload is the largest frame sent at each spreading factor
+// (BW125), following the LoRaWAN regional limits devices are built to
+var maxFramePayload = map[uint8]int{
+	7:  230,
+	8:  230,
+	9:  123,
+	10: 59,
+	11: 59,
+	12: 59,
+}
+
+// fragmenter splits large downlinks and reassembles fragmented uplinks
+type fragmenter struct {
+	reassembly *protocol.Reassembler
+	mu         sync.Mutex
+	transferID uint8
+}
+
+func newFragmenter() *fragmenter {
+	return &fragmenter{reassembly: protocol.NewReassembler(FragmentTimeout)}
+}
+
+// maxFrameSize returns the largest frame sent at a spreading factor and
+// bandwidth. Doubling the bandwidth halves the symbol time, as one step down
+// in spreading factor does, so wider channels get the limit of the 125 kHz
+// spreading factor with the same symbol time. With a dwell limit the frame
+// must also be on the air no longer than it.
+func maxFrameSize(sf uint8, bandwidth uint32, codingRate uint8, dwell time.Duration) int {
+	equivalent := sf
+	for bw := bandwidth; bw > 125000 && equivalent > 7; bw /= 2 {
+		equivalent--
+	}
+	size, ok := maxFramePayload[equivalent]
+	if !ok {
+		size = maxFramePayload[12]
+	}
+	if dwell > 0 {
+		for size > 0 && Airtime(size, sf, bandwidth, codingRate) > dwell {
+			size--
+		}
+	}
+	return size
+}
+
+// maxPayload returns the largest message payload that fits a frame of
+// frameSize bytes. The worst case encryption overhead is always allowed for.
+func maxPayload(frameSize int, version uint8) int {
+	size := frameSize - protocol.HeaderSize - aes.BlockSize
+	if protocol.HasFrameCRC(version) {
+		size -= protocol.FrameCRCSize
+	}
+	return size
+}
+
+// split returns the payloads to send for a message: the payload itself if it
+// fits within limit, otherwise its encoded fragments
+func (f *fragmenter) split(msgType uint8, payload []byte, limit int) (uint8, [][]byte, error) {
+	if len(payload) <= limit {
+		return msgType, [][]byte{payload}, nil
+	}
+
+	f.mu.Lock()
+	f.transferID++
+	id := f.transferID
+	f.mu.Unlock()
+
+	frags, err := protocol.Fragment(msgType, id, payload, limit)
+	if err != nil {
+		return 0, nil, err
+	}
+	encoded := make([][]byte, len(frags))
+	for i := range frags {
+		encoded[i] = frags[i].Encode()
+	}
+	return protocol.MsgTypeFragment, encoded, nil
+}
+
+// reassemble passes whole messages through and collects fragments, returning
+// the reassembled message once its last fragment arrives
+func (f *fragmenter) reassemble(msg *protocol.LoRaMessage) (*protocol.LoRaMessage, bool) {
+	if msg.Header.MsgType != protocol.MsgTypeFragment {
+		return msg, true
+	}
+
+	frag, err := protocol.DecodeFragment(msg.Payload)
+	if err != nil {
+		log.Printf("Dropping fragment from %s: %v", msg.DeviceUIDString(), err)
+		return nil, false
+	}
+	msgType, payload, done := f.reassembly.Add(msg.Header.DeviceUID, frag, time.Now())
+	if !done {
+		return nil, false
+	}
+
+	whole := *msg
+	whole.Header.MsgType = msgType
+	whole.Payload = payload
+	return &whole, true
+}
@@ -0,0 +1,104 @@
+package lora
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/agsys/property-controller/internal/protocol"
+)
+
+// TestFragmenterSplit tests that only payloads too large for the SF are fragmented
+func TestFragmenterSplit(t *testing.T) {
+	f := newFragmenter()
+	uid := [8]byte{1, 2, 3, 4, 5, 6, 7, 8}
+	limit := maxPayload(maxFrameSize(10, 125000, 5, 0), protocol.ProtocolVersionCRC)
+
+	msgType, parts, err := f.split(protocol.MsgTypeConfigUpdate, make([]byte, limit), limit)
+	if err != nil {
+		t.Fatalf("split failed: %v", err)
+	}
+	if msgType != protocol.MsgTypeConfigUpdate || len(parts) != 1 {
+		t.Errorf("Payload at the limit sent as 0x%02X in %d parts, want whole", msgType, len(parts))
+	}
+
+	payload := make([]byte, 3*limit)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	msgType, parts, err = f.split(protocol.MsgTypeScheduleUpdate, payload, limit)
+	if err != nil {
+		t.Fatalf("split failed: %v", err)
+	}
+	if msgType != protocol.MsgTypeFragment || len(parts) < 4 {
+		t.Fatalf("Large payload sent as 0x%02X in %d parts, want fragments", msgType, len(parts))
+	}
+
+	// Faster spreading factors carry it whole
+	fast := maxPayload(maxFrameSize(7, 125000, 5, 0), protocol.ProtocolVersionCRC)
+	if _, parts, _ := f.split(protocol.MsgTypeScheduleUpdate, payload, fast); len(parts) != 1 {
+		t.Errorf("Payload fragmented into %d parts at SF7, want whole", len(parts))
+	}
+
+	// Fragments reassemble into the original message
+	var whole *protocol.LoRaMessage
+	for _, part := range parts {
+		msg := &protocol.LoRaMessage{
+			Header:  protocol.Header{MsgType: protocol.MsgTypeFragment, DeviceUID: uid},
+			Payload: part,
+		}
+		if m, ok := f.reassemble(msg); ok {
+			whole = m
+		}
+	}
+	if whole == nil {
+		t.Fatal("Fragments were not reassembled")
+	}
+	if whole.Header.MsgType != protocol.MsgTypeScheduleUpdate || !bytes.Equal(whole.Payload, payload) {
+		t.Errorf("Reassembled 0x%02X %X, want 0x%02X %X", whole.Header.MsgType, whole.Payload, protocol.MsgTypeScheduleUpdate, payload)
+	}
+}
+
+// TestFrameSizeLimits tests the frame limits for bandwidth and dwell time,
+// and that a downlink too large for the device's data rate is refused
+func TestFrameSizeLimits(t *testing.T) {
+	if n := maxFrameSize(10, 125000, 5, 0); n != 59 {
+		t.Errorf("SF10/125 kHz limit = %d, want 59", n)
+	}
+	if n := maxFrameSize(10, 500000, 5, 0); n != 230 {
+		t.Errorf("SF10/500 kHz limit = %d, want 230", n)
+	}
+	if n := maxFrameSize(9, 250000, 5, 0); n != 230 {
+		t.Errorf("SF9/250 kHz limit = %d, want 230", n)
+	}
+	dwell := 400 * time.Millisecond
+	n := maxFrameSize(9, 125000, 5, dwell)
+	if n >= 123 || Airtime(n, 9, 125000, 5) > dwell || Airtime(n+1, 9, 125000, 5) <= dwell {
+		t.Errorf("SF9/125 kHz limit with a 400 ms dwell = %d, want the largest frame within it", n)
+	}
+
+	radio := &chanRadio{rx: make(chan *protocol.LoRaMessage), tx: make(chan []byte, 16)}
+	config := DefaultConfig()
+	config.Radio = radio
+	d, err := New(config)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer d.Stop()
+
+	uid := [8]byte{1, 2, 3, 4, 5, 6, 7, 8}
+	limit := maxPayload(d.frameLimit(10), d.versions.For(uid))
+	if err := d.SendToDevice(uid, protocol.MsgTypeConfigUpdate, make([]byte, limit+1)); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("SendToDevice over the limit = %v, want ErrFrameTooLarge", err)
+	}
+	if err := d.SendToDevice(uid, protocol.MsgTypeConfigUpdate, make([]byte, limit)); err != nil {
+		t.Errorf("SendToDevice at the limit failed: %v", err)
+	}
+	if err := d.SendFragmented(uid, protocol.MsgTypeConfigUpdate, make([]byte, 3*limit)); err != nil {
+		t.Errorf("SendFragmented over the limit failed: %v", err)
+	}
+}
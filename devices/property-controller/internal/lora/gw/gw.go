@@ -115,6 +115,8 @@ type UplinkRxInfo struct {
 	Snr       float32
 	Channel   uint32
 	RfChain   uint32
+	Board     uint32
+	Antenna   uint32
 	Context   []byte
 	CrcStatus CRCStatus
 }
@@ -202,6 +204,7 @@ type DownlinkTxAckItem struct {
 // GatewayStats contains gateway statistics
 type GatewayStats struct {
 	GatewayId           string
+	ConfigVersion       string
 	RxPacketsReceived   uint32
 	RxPacketsReceivedOk uint32
 	TxPacketsReceived   uint32
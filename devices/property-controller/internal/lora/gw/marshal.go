@@ -1,10 +1,96 @@
 // Package gw provides marshaling/unmarshaling for ChirpStack Concentratord messages.
-// Uses a simple binary format compatible with the Concentratord ZMQ API.
+// Messages are encoded in the protobuf wire format using the field numbers from
+// ChirpStack v4 gw.proto, so they interoperate with Concentratord >= 4.
 package gw
 
 import (
 	"encoding/binary"
 	"fmt"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Field numbers from chirpstack/api/proto/gw/gw.proto (v4)
+const (
+	// UplinkFrame
+	fieldUplinkPhyPayload = 1
+	fieldUplinkTxInfo     = 4
+	fieldUplinkRxInfo     = 5
+
+	// UplinkTxInfo
+	fieldUplinkTxFrequency  = 1
+	fieldUplinkTxModulation = 2
+
+	// UplinkRxInfo
+	fieldRxGatewayID = 1
+	fieldRxUplinkID  = 2
+	fieldRxRssi      = 6
+	fieldRxSnr       = 7
+	fieldRxChannel   = 8
+	fieldRxRfChain   = 9
+	fieldRxBoard     = 10
+	fieldRxAntenna   = 11
+	fieldRxContext   = 13
+	fieldRxCrcStatus = 16
+
+	// Modulation (oneof)
+	fieldModulationLora = 3
+	fieldModulationFsk  = 4
+
+	// LoraModulationInfo
+	fieldLoraBandwidth       = 1
+	fieldLoraSpreadingFactor = 2
+	fieldLoraPolarizationInv = 4
+	fieldLoraCodeRate        = 5
+	fieldLoraPreamble        = 6
+	fieldLoraNoCrc           = 7
+
+	// FskModulationInfo
+	fieldFskFrequencyDeviation = 1
+	fieldFskDatarate           = 2
+
+	// DownlinkFrame
+	fieldDownlinkID        = 3
+	fieldDownlinkItems     = 5
+	fieldDownlinkGatewayID = 7
+
+	// DownlinkFrameItem
+	fieldItemPhyPayload = 1
+	fieldItemTxInfo     = 3
+
+	// DownlinkTxInfo
+	fieldTxFrequency  = 1
+	fieldTxPower      = 2
+	fieldTxModulation = 3
+	fieldTxBoard      = 4
+	fieldTxAntenna    = 5
+	fieldTxTiming     = 6
+	fieldTxContext    = 7
+
+	// Timing (oneof)
+	fieldTimingImmediately = 1
+	fieldTimingDelay       = 2
+	fieldTimingGpsEpoch    = 3
+
+	// google.protobuf.Duration
+	fieldDurationSeconds = 1
+	fieldDurationNanos   = 2
+
+	// DownlinkTxAck
+	fieldAckDownlinkID = 2
+	fieldAckItems      = 5
+	fieldAckGatewayID  = 6
+
+	// DownlinkTxAckItem
+	fieldAckItemStatus = 1
+
+	// GatewayStats
+	fieldStatsConfigVersion = 4
+	fieldStatsRxReceived    = 5
+	fieldStatsRxReceivedOk  = 6
+	fieldStatsTxReceived    = 7
+	fieldStatsTxEmitted     = 8
+	fieldStatsGatewayID     = 17
 )
 
 // MarshalCommand serializes a command for sending to Concentratord
@@ -27,37 +113,79 @@ func MarshalDownlinkFrame(dl *DownlinkFrame) ([]byte, error) {
 		return nil, fmt.Errorf("no downlink items")
 	}
 
-	item := dl.Items[0]
-	payload := item.PhyPayload
-	txInfo := item.TxInfo
+	var b []byte
+	b = appendVarint(b, fieldDownlinkID, uint64(dl.DownlinkId))
+	for _, item := range dl.Items {
+		b = appendMessage(b, fieldDownlinkItems, marshalDownlinkFrameItem(item))
+	}
+	b = appendString(b, fieldDownlinkGatewayID, dl.GatewayId)
+	return b, nil
+}
 
-	// Simple binary format:
-	// 4 bytes: downlink_id
-	// 4 bytes: frequency
-	// 4 bytes: power (signed)
-	// 4 bytes: bandwidth
-	// 4 bytes: spreading_factor
-	// 1 byte: coding_rate
-	// 1 byte: timing (0=immediate)
-	// 2 bytes: payload length
-	// N bytes: payload
+func marshalDownlinkFrameItem(item *DownlinkFrameItem) []byte {
+	var b []byte
+	b = appendBytes(b, fieldItemPhyPayload, item.PhyPayload)
+	if item.TxInfo != nil {
+		b = appendMessage(b, fieldItemTxInfo, marshalDownlinkTxInfo(item.TxInfo))
+	}
+	return b
+}
 
-	buf := make([]byte, 24+len(payload))
-	binary.LittleEndian.PutUint32(buf[0:4], dl.DownlinkId)
-	binary.LittleEndian.PutUint32(buf[4:8], txInfo.Frequency)
-	binary.LittleEndian.PutUint32(buf[8:12], uint32(txInfo.Power))
+func marshalDownlinkTxInfo(tx *DownlinkTxInfo) []byte {
+	var b []byte
+	b = appendVarint(b, fieldTxFrequency, uint64(tx.Frequency))
+	b = appendVarint(b, fieldTxPower, uint64(int64(tx.Power)))
+	if tx.Modulation != nil {
+		b = appendMessage(b, fieldTxModulation, marshalModulation(tx.Modulation))
+	}
+	b = appendVarint(b, fieldTxBoard, uint64(tx.Board))
+	b = appendVarint(b, fieldTxAntenna, uint64(tx.Antenna))
+	if tx.Timing != nil {
+		b = appendMessage(b, fieldTxTiming, marshalTiming(tx.Timing))
+	}
+	b = appendBytes(b, fieldTxContext, tx.Context)
+	return b
+}
 
-	if txInfo.Modulation != nil && txInfo.Modulation.Lora != nil {
-		binary.LittleEndian.PutUint32(buf[12:16], txInfo.Modulation.Lora.Bandwidth)
-		binary.LittleEndian.PutUint32(buf[16:20], txInfo.Modulation.Lora.SpreadingFactor)
-		buf[20] = byte(txInfo.Modulation.Lora.CodeRate)
+func marshalModulation(m *Modulation) []byte {
+	var b []byte
+	switch {
+	case m.Lora != nil:
+		var l []byte
+		l = appendVarint(l, fieldLoraBandwidth, uint64(m.Lora.Bandwidth))
+		l = appendVarint(l, fieldLoraSpreadingFactor, uint64(m.Lora.SpreadingFactor))
+		l = appendBool(l, fieldLoraPolarizationInv, m.Lora.PolarizationInversion)
+		l = appendVarint(l, fieldLoraCodeRate, uint64(m.Lora.CodeRate))
+		l = appendVarint(l, fieldLoraPreamble, uint64(m.Lora.Preamble))
+		l = appendBool(l, fieldLoraNoCrc, m.Lora.NoCrc)
+		b = appendMessage(b, fieldModulationLora, l)
+	case m.Fsk != nil:
+		var f []byte
+		f = appendVarint(f, fieldFskFrequencyDeviation, uint64(m.Fsk.FrequencyDeviation))
+		f = appendVarint(f, fieldFskDatarate, uint64(m.Fsk.Datarate))
+		b = appendMessage(b, fieldModulationFsk, f)
 	}
+	return b
+}
 
-	buf[21] = 0 // Immediate timing
-	binary.LittleEndian.PutUint16(buf[22:24], uint16(len(payload)))
-	copy(buf[24:], payload)
+func marshalTiming(t *Timing) []byte {
+	var b []byte
+	switch {
+	case t.Immediately != nil:
+		b = appendMessage(b, fieldTimingImmediately, nil)
+	case t.Delay != nil:
+		b = appendMessage(b, fieldTimingDelay, appendMessage(nil, 1, marshalDuration(t.Delay.DelayNanos)))
+	case t.GpsEpoch != nil:
+		b = appendMessage(b, fieldTimingGpsEpoch, appendMessage(nil, 1, marshalDuration(t.GpsEpoch.TimeSinceGpsEpochNanos)))
+	}
+	return b
+}
 
-	return buf, nil
+func marshalDuration(nanos int64) []byte {
+	var b []byte
+	b = appendVarint(b, fieldDurationSeconds, uint64(nanos/1e9))
+	b = appendVarint(b, fieldDurationNanos, uint64(int64(int32(nanos%1e9))))
+	return b
 }
 
 // UnmarshalEvent deserializes an event from Concentratord
@@ -86,56 +214,246 @@ func UnmarshalEvent(eventType string, data []byte) (*Event, error) {
 	return event, nil
 }
 
+// MarshalUplinkFrame serializes an uplink frame (used for testing and replay)
+func MarshalUplinkFrame(up *UplinkFrame) ([]byte, error) {
+	var b []byte
+	b = appendBytes(b, fieldUplinkPhyPayload, up.PhyPayload)
+	if up.TxInfo != nil {
+		var t []byte
+		t = appendVarint(t, fieldUplinkTxFrequency, uint64(up.TxInfo.Frequency))
+		if up.TxInfo.Modulation != nil {
+			t = appendMessage(t, fieldUplinkTxModulation, marshalModulation(up.TxInfo.Modulation))
+		}
+		b = appendMessage(b, fieldUplinkTxInfo, t)
+	}
+	if up.RxInfo != nil {
+		rx := up.RxInfo
+		var r []byte
+		r = appendString(r, fieldRxGatewayID, rx.GatewayId)
+		r = appendVarint(r, fieldRxUplinkID, uint64(rx.UplinkId))
+		r = appendVarint(r, fieldRxRssi, uint64(int64(rx.Rssi)))
+		if rx.Snr != 0 {
+			r = protowire.AppendTag(r, fieldRxSnr, protowire.Fixed32Type)
+			r = protowire.AppendFixed32(r, float32bits(rx.Snr))
+		}
+		r = appendVarint(r, fieldRxChannel, uint64(rx.Channel))
+		r = appendVarint(r, fieldRxRfChain, uint64(rx.RfChain))
+		r = appendVarint(r, fieldRxBoard, uint64(rx.Board))
+		r = appendVarint(r, fieldRxAntenna, uint64(rx.Antenna))
+		r = appendBytes(r, fieldRxContext, rx.Context)
+		r = appendVarint(r, fieldRxCrcStatus, uint64(rx.CrcStatus))
+		b = appendMessage(b, fieldUplinkRxInfo, r)
+	}
+	return b, nil
+}
+
 // UnmarshalUplinkFrame deserializes an uplink frame
-// Note: This expects the Concentratord's protobuf format
 func UnmarshalUplinkFrame(data []byte) (*UplinkFrame, error) {
-	// For now, use a simplified format that we'll refine
-	// The actual Concentratord uses protobuf, but we can parse the key fields
-
-	if len(data) < 20 {
-		return nil, fmt.Errorf("uplink data too short: %d bytes", len(data))
+	up := &UplinkFrame{}
+	err := walkFields(data, func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error {
+		switch num {
+		case fieldUplinkPhyPayload:
+			up.PhyPayload = append([]byte(nil), v...)
+		case fieldUplinkTxInfo:
+			tx, err := unmarshalUplinkTxInfo(v)
+			if err != nil {
+				return err
+			}
+			up.TxInfo = tx
+		case fieldUplinkRxInfo:
+			rx, err := unmarshalUplinkRxInfo(v)
+			if err != nil {
+				return err
+			}
+			up.RxInfo = rx
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid uplink frame: %w", err)
 	}
+	return up, nil
+}
 
-	// This is a placeholder - actual implementation would use protobuf
-	// For testing, we'll assume raw PHY payload
-	return &UplinkFrame{
-		PhyPayload: data,
-		RxInfo: &UplinkRxInfo{
-			Rssi: -50, // Placeholder
-			Snr:  10.0,
-		},
-	}, nil
+func unmarshalUplinkTxInfo(data []byte) (*UplinkTxInfo, error) {
+	tx := &UplinkTxInfo{}
+	err := walkFields(data, func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error {
+		switch num {
+		case fieldUplinkTxFrequency:
+			tx.Frequency = uint32(n)
+		case fieldUplinkTxModulation:
+			m, err := unmarshalModulation(v)
+			if err != nil {
+				return err
+			}
+			tx.Modulation = m
+		}
+		return nil
+	})
+	return tx, err
+}
+
+func unmarshalUplinkRxInfo(data []byte) (*UplinkRxInfo, error) {
+	rx := &UplinkRxInfo{}
+	err := walkFields(data, func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error {
+		switch num {
+		case fieldRxGatewayID:
+			rx.GatewayId = string(v)
+		case fieldRxUplinkID:
+			rx.UplinkId = uint32(n)
+		case fieldRxRssi:
+			rx.Rssi = int32(n)
+		case fieldRxSnr:
+			rx.Snr = float32frombits(uint32(n))
+		case fieldRxChannel:
+			rx.Channel = uint32(n)
+		case fieldRxRfChain:
+			rx.RfChain = uint32(n)
+		case fieldRxBoard:
+			rx.Board = uint32(n)
+		case fieldRxAntenna:
+			rx.Antenna = uint32(n)
+		case fieldRxContext:
+			rx.Context = append([]byte(nil), v...)
+		case fieldRxCrcStatus:
+			rx.CrcStatus = CRCStatus(n)
+		}
+		return nil
+	})
+	return rx, err
+}
+
+func unmarshalModulation(data []byte) (*Modulation, error) {
+	m := &Modulation{}
+	err := walkFields(data, func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error {
+		switch num {
+		case fieldModulationLora:
+			l := &LoraModulationInfo{}
+			if err := walkFields(v, func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error {
+				switch num {
+				case fieldLoraBandwidth:
+					l.Bandwidth = uint32(n)
+				case fieldLoraSpreadingFactor:
+					l.SpreadingFactor = uint32(n)
+				case fieldLoraPolarizationInv:
+					l.PolarizationInversion = n != 0
+				case fieldLoraCodeRate:
+					l.CodeRate = CodeRate(n)
+				case fieldLoraPreamble:
+					l.Preamble = uint32(n)
+				case fieldLoraNoCrc:
+					l.NoCrc = n != 0
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+			m.Lora = l
+		case fieldModulationFsk:
+			f := &FskModulationInfo{}
+			if err := walkFields(v, func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error {
+				switch num {
+				case fieldFskFrequencyDeviation:
+					f.FrequencyDeviation = uint32(n)
+				case fieldFskDatarate:
+					f.Datarate = uint32(n)
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+			m.Fsk = f
+		}
+		return nil
+	})
+	return m, err
+}
+
+// MarshalGatewayStats serializes gateway statistics (used for testing and replay)
+func MarshalGatewayStats(stats *GatewayStats) ([]byte, error) {
+	var b []byte
+	b = appendString(b, fieldStatsConfigVersion, stats.ConfigVersion)
+	b = appendVarint(b, fieldStatsRxReceived, uint64(stats.RxPacketsReceived))
+	b = appendVarint(b, fieldStatsRxReceivedOk, uint64(stats.RxPacketsReceivedOk))
+	b = appendVarint(b, fieldStatsTxReceived, uint64(stats.TxPacketsReceived))
+	b = appendVarint(b, fieldStatsTxEmitted, uint64(stats.TxPacketsEmitted))
+	b = appendString(b, fieldStatsGatewayID, stats.GatewayId)
+	return b, nil
 }
 
 // UnmarshalGatewayStats deserializes gateway statistics
 func UnmarshalGatewayStats(data []byte) (*GatewayStats, error) {
-	// Placeholder implementation
-	return &GatewayStats{}, nil
+	stats := &GatewayStats{}
+	err := walkFields(data, func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error {
+		switch num {
+		case fieldStatsGatewayID:
+			stats.GatewayId = string(v)
+		case fieldStatsConfigVersion:
+			stats.ConfigVersion = string(v)
+		case fieldStatsRxReceived:
+			stats.RxPacketsReceived = uint32(n)
+		case fieldStatsRxReceivedOk:
+			stats.RxPacketsReceivedOk = uint32(n)
+		case fieldStatsTxReceived:
+			stats.TxPacketsReceived = uint32(n)
+		case fieldStatsTxEmitted:
+			stats.TxPacketsEmitted = uint32(n)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid gateway stats: %w", err)
+	}
+	return stats, nil
 }
 
-// UnmarshalDownlinkTxAck deserializes a TX acknowledgment
-func UnmarshalDownlinkTxAck(data []byte) (*DownlinkTxAck, error) {
-	if len(data) < 8 {
-		return nil, fmt.Errorf("tx ack data too short: %d bytes", len(data))
+// MarshalDownlinkTxAck serializes a TX acknowledgment (used for testing and replay)
+func MarshalDownlinkTxAck(ack *DownlinkTxAck) ([]byte, error) {
+	var b []byte
+	b = appendVarint(b, fieldAckDownlinkID, uint64(ack.DownlinkId))
+	for _, item := range ack.Items {
+		// Always emit the status so an all-IGNORED item is still a distinct entry
+		var i []byte
+		i = protowire.AppendTag(i, fieldAckItemStatus, protowire.VarintType)
+		i = protowire.AppendVarint(i, uint64(item.Status))
+		b = appendMessage(b, fieldAckItems, i)
 	}
+	b = appendString(b, fieldAckGatewayID, ack.GatewayId)
+	return b, nil
+}
 
-	// Simple format:
-	// 4 bytes: downlink_id
-	// 4 bytes: status
-
-	ack := &DownlinkTxAck{
-		DownlinkId: binary.LittleEndian.Uint32(data[0:4]),
-		Items: []*DownlinkTxAckItem{
-			{Status: TxAckStatus(binary.LittleEndian.Uint32(data[4:8]))},
-		},
+// UnmarshalDownlinkTxAck deserializes a TX acknowledgment
+func UnmarshalDownlinkTxAck(data []byte) (*DownlinkTxAck, error) {
+	ack := &DownlinkTxAck{}
+	err := walkFields(data, func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error {
+		switch num {
+		case fieldAckDownlinkID:
+			ack.DownlinkId = uint32(n)
+		case fieldAckGatewayID:
+			ack.GatewayId = string(v)
+		case fieldAckItems:
+			item := &DownlinkTxAckItem{}
+			if err := walkFields(v, func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error {
+				if num == fieldAckItemStatus {
+					item.Status = TxAckStatus(n)
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+			ack.Items = append(ack.Items, item)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid tx ack: %w", err)
 	}
-
 	return ack, nil
 }
 
 // UnmarshalGetGatewayIdResponse deserializes a gateway ID response
 func UnmarshalGetGatewayIdResponse(data []byte) (*GetGatewayIdResponse, error) {
-	// Gateway ID is 8 bytes, returned as hex string
+	// Concentratord replies to "gateway_id" with the raw 8-byte EUI
 	if len(data) < 8 {
 		return nil, fmt.Errorf("gateway id response too short: %d bytes", len(data))
 	}
@@ -0,0 +1,193 @@
+package gw
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestUnmarshalUplinkFrameWire decodes a hand-encoded UplinkFrame laid out
+// per ChirpStack v4 gw.proto to guard the field numbers
+func TestUnmarshalUplinkFrameWire(t *testing.T) {
+	data := []byte{
+		0x0A, 0x03, 0x41, 0x47, 0x01, // phy_payload = 1
+		0x22, 0x08, // tx_info = 4
+		0x08, 0xC0, 0x95, 0xA7, 0xB4, 0x03, // frequency = 915000000
+		0x12, 0x00, // modulation = 2 (empty)
+		0x2A, 0x13, // rx_info = 5
+		0x30, 0xB0, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0x01, // rssi = 6 (-80)
+		0x3D, 0x00, 0x00, 0x20, 0x41, // snr = 7 (10.0)
+		0x80, 0x01, 0x02, // crc_status = 16 (CRC_OK)
+	}
+
+	up, err := UnmarshalUplinkFrame(data)
+	if err != nil {
+		t.Fatalf("UnmarshalUplinkFrame failed: %v", err)
+	}
+
+	if !bytes.Equal(up.PhyPayload, []byte{0x41, 0x47, 0x01}) {
+		t.Errorf("PhyPayload = %X", up.PhyPayload)
+	}
+	if up.TxInfo == nil || up.TxInfo.Frequency != 915000000 {
+		t.Errorf("TxInfo = %+v", up.TxInfo)
+	}
+	if up.RxInfo == nil {
+		t.Fatal("RxInfo missing")
+	}
+	if up.RxInfo.Rssi != -80 {
+		t.Errorf("Rssi = %d, want -80", up.RxInfo.Rssi)
+	}
+	if up.RxInfo.Snr != 10.0 {
+		t.Errorf("Snr = %f, want 10.0", up.RxInfo.Snr)
+	}
+	if up.RxInfo.CrcStatus != CRCStatus_CRC_OK {
+		t.Errorf("CrcStatus = %d, want CRC_OK", up.RxInfo.CrcStatus)
+	}
+}
+
+// TestUplinkFrameRoundTrip tests UplinkFrame marshal/unmarshal roundtrip
+func TestUplinkFrameRoundTrip(t *testing.T) {
+	orig := &UplinkFrame{
+		PhyPayload: []byte{0x41, 0x47, 0x01, 0x20, 0x01},
+		TxInfo: &UplinkTxInfo{
+			Frequency: 903900000,
+			Modulation: &Modulation{
+				Lora: &LoraModulationInfo{
+					Bandwidth:       125000,
+					SpreadingFactor: 10,
+					CodeRate:        CodeRate_CR_4_5,
+				},
+			},
+		},
+		RxInfo: &UplinkRxInfo{
+			GatewayId: "0016c001ff10a235",
+			UplinkId:  1234,
+			Rssi:      -112,
+			Snr:       -7.5,
+			Channel:   3,
+			Context:   []byte{0x01, 0x02, 0x03, 0x04},
+			CrcStatus: CRCStatus_CRC_OK,
+		},
+	}
+
+	data, err := MarshalUplinkFrame(orig)
+	if err != nil {
+		t.Fatalf("MarshalUplinkFrame failed: %v", err)
+	}
+
+	got, err := UnmarshalUplinkFrame(data)
+	if err != nil {
+		t.Fatalf("UnmarshalUplinkFrame failed: %v", err)
+	}
+
+	if !bytes.Equal(got.PhyPayload, orig.PhyPayload) {
+		t.Errorf("PhyPayload mismatch: got %X, want %X", got.PhyPayload, orig.PhyPayload)
+	}
+	if got.TxInfo.Modulation == nil || got.TxInfo.Modulation.Lora == nil {
+		t.Fatal("LoRa modulation missing")
+	}
+	if *got.TxInfo.Modulation.Lora != *orig.TxInfo.Modulation.Lora {
+		t.Errorf("Lora mismatch: got %+v, want %+v", got.TxInfo.Modulation.Lora, orig.TxInfo.Modulation.Lora)
+	}
+	if got.RxInfo.GatewayId != orig.RxInfo.GatewayId || got.RxInfo.Rssi != orig.RxInfo.Rssi ||
+		got.RxInfo.Snr != orig.RxInfo.Snr || got.RxInfo.Channel != orig.RxInfo.Channel ||
+		got.RxInfo.UplinkId != orig.RxInfo.UplinkId {
+		t.Errorf("RxInfo mismatch: got %+v, want %+v", got.RxInfo, orig.RxInfo)
+	}
+}
+
+// TestMarshalDownlinkFrameWire checks the DownlinkFrame field layout
+func TestMarshalDownlinkFrameWire(t *testing.T) {
+	dl := &DownlinkFrame{
+		DownlinkId: 7,
+		GatewayId:  "ab",
+		Items: []*DownlinkFrameItem{{
+			PhyPayload: []byte{0xAA},
+			TxInfo: &DownlinkTxInfo{
+				Frequency: 1,
+				Power:     20,
+				Timing:    &Timing{Immediately: &ImmediatelyTimingInfo{}},
+			},
+		}},
+	}
+
+	data, err := MarshalDownlinkFrame(dl)
+	if err != nil {
+		t.Fatalf("MarshalDownlinkFrame failed: %v", err)
+	}
+
+	want := []byte{
+		0x18, 0x07, // downlink_id = 3
+		0x2A, 0x0D, // items = 5
+		0x0A, 0x01, 0xAA, // phy_payload = 1
+		0x1A, 0x08, // tx_info = 3
+		0x08, 0x01, // frequency = 1
+		0x10, 0x14, // power = 2
+		0x32, 0x02, 0x0A, 0x00, // timing = 6 { immediately = 1 {} }
+		0x3A, 0x02, 0x61, 0x62, // gateway_id = 7
+	}
+	if !bytes.Equal(data, want) {
+		t.Errorf("wire mismatch:\n got  %X\n want %X", data, want)
+	}
+}
+
+// TestDownlinkTxAckRoundTrip tests DownlinkTxAck marshal/unmarshal roundtrip
+func TestDownlinkTxAckRoundTrip(t *testing.T) {
+	orig := &DownlinkTxAck{
+		GatewayId:  "0016c001ff10a235",
+		DownlinkId: 42,
+		Items: []*DownlinkTxAckItem{
+			{Status: TxAckStatus_IGNORED},
+			{Status: TxAckStatus_TOO_LATE},
+		},
+	}
+
+	data, err := MarshalDownlinkTxAck(orig)
+	if err != nil {
+		t.Fatalf("MarshalDownlinkTxAck failed: %v", err)
+	}
+
+	got, err := UnmarshalDownlinkTxAck(data)
+	if err != nil {
+		t.Fatalf("UnmarshalDownlinkTxAck failed: %v", err)
+	}
+
+	if got.DownlinkId != 42 || got.GatewayId != orig.GatewayId {
+		t.Errorf("got %+v, want %+v", got, orig)
+	}
+	if len(got.Items) != 2 || got.Items[0].Status != TxAckStatus_IGNORED || got.Items[1].Status != TxAckStatus_TOO_LATE {
+		t.Errorf("items mismatch: %+v", got.Items)
+	}
+}
+
+// TestGatewayStatsRoundTrip tests GatewayStats marshal/unmarshal roundtrip
+func TestGatewayStatsRoundTrip(t *testing.T) {
+	orig := &GatewayStats{
+		GatewayId:           "0016c001ff10a235",
+		ConfigVersion:       "1.2.3",
+		RxPacketsReceived:   100,
+		RxPacketsReceivedOk: 95,
+		TxPacketsReceived:   10,
+		TxPacketsEmitted:    9,
+	}
+
+	data, err := MarshalGatewayStats(orig)
+	if err != nil {
+		t.Fatalf("MarshalGatewayStats failed: %v", err)
+	}
+
+	got, err := UnmarshalGatewayStats(data)
+	if err != nil {
+		t.Fatalf("UnmarshalGatewayStats failed: %v", err)
+	}
+
+	if *got != *orig {
+		t.Errorf("got %+v, want %+v", got, orig)
+	}
+}
+
+// TestUnmarshalTruncated ensures malformed input is rejected
+func TestUnmarshalTruncated(t *testing.T) {
+	if _, err := UnmarshalUplinkFrame([]byte{0x0A, 0x05, 0x01}); err == nil {
+		t.Error("expected error for truncated uplink frame")
+	}
+}
@@ -0,0 +1,95 @@
+package gw
+
+import (
+	"math"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Helpers for the protobuf wire format. Like proto3, zero values are omitted.
+
+func appendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func appendBool(b []byte, num protowire.Number, v bool) []byte {
+	if !v {
+		return b
+	}
+	return appendVarint(b, num, 1)
+}
+
+func appendBytes(b []byte, num protowire.Number, v []byte) []byte {
+	if len(v) == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+func appendString(b []byte, num protowire.Number, v string) []byte {
+	if v == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, v)
+}
+
+// appendMessage always emits the field, since an empty sub-message is
+// meaningful for oneof members such as Timing.immediately
+func appendMessage(b []byte, num protowire.Number, v []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+// walkFields calls fn for each field in a protobuf message. Length-delimited
+// values are passed in v; varint and fixed values are passed in n.
+func walkFields(data []byte, fn func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error) error {
+	for len(data) > 0 {
+		num, typ, tagLen := protowire.ConsumeTag(data)
+		if tagLen < 0 {
+			return protowire.ParseError(tagLen)
+		}
+		data = data[tagLen:]
+
+		var v []byte
+		var n uint64
+		var valLen int
+
+		switch typ {
+		case protowire.VarintType:
+			n, valLen = protowire.ConsumeVarint(data)
+		case protowire.Fixed32Type:
+			var f uint32
+			f, valLen = protowire.ConsumeFixed32(data)
+			n = uint64(f)
+		case protowire.Fixed64Type:
+			n, valLen = protowire.ConsumeFixed64(data)
+		case protowire.BytesType:
+			v, valLen = protowire.ConsumeBytes(data)
+		default:
+			valLen = protowire.ConsumeFieldValue(num, typ, data)
+		}
+		if valLen < 0 {
+			return protowire.ParseError(valLen)
+		}
+		data = data[valLen:]
+
+		if err := fn(num, typ, v, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func float32bits(f float32) uint32 {
+	return math.Float32bits(f)
+}
+
+func float32frombits(b uint32) float32 {
+	return math.Float32frombits(b)
+}
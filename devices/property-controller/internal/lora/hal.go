@@ -0,0 +1,125 @@
+package lora
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/agsys/property-controller/internal/protocol"
+)
+
+// halPoll is how long Receive waits before polling a concentrator again when
+// no uplink is waiting
+const halPoll = 10 * time.Millisecond
+
+// halTxTimeout bounds how long Transmit waits for a downlink to leave the
+// radio, longer than the airtime of the largest frame at SF12
+const halTxTimeout = 5 * time.Second
+
+// concentratorHAL is the part of a concentrator radio that calls into a
+// Semtech libloragw
+type concentratorHAL interface {
+	start() error
+	stop() error
+	receive() ([]*protocol.LoRaMessage, error) // Uplinks waiting, without blocking
+	send(data []byte, sf uint8, txPower int8) error
+	emitting() (bool, error) // Whether the last downlink is still going out
+}
+
+// halRadio is a Radio over a libloragw HAL. It polls the concentrator for
+// uplinks and transmits downlinks immediately.
+type halRadio struct {
+	name   string
+	device string
+	hal    concentratorHAL
+
+	mu      sync.Mutex // Guards the HAL, which isn't safe for concurrent use
+	started bool
+	pending []*protocol.LoRaMessage // Uplinks received but not yet returned
+}
+
+// Start configures and starts the concentrator
+func (r *halRadio) Start() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.started {
+		return nil
+	}
+	if err := r.hal.start(); err != nil {
+		return err
+	}
+	r.started = true
+	log.Printf("%s concentrator started on %s", r.name, r.device)
+	return nil
+}
+
+// Stop stops the concentrator
+func (r *halRadio) Stop() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.started {
+		return nil
+	}
+	r.started = false
+	r.pending = nil
+	return r.hal.stop()
+}
+
+// Receive implements Radio
+func (r *halRadio) Receive() (*protocol.LoRaMessage, error) {
+	r.mu.Lock()
+	if !r.started {
+		r.mu.Unlock()
+		return nil, fmt.Errorf("concentrator not started")
+	}
+	if len(r.pending) == 0 {
+		msgs, err := r.hal.receive()
+		if err != nil {
+			r.mu.Unlock()
+			return nil, err
+		}
+		r.pending = msgs
+	}
+	if len(r.pending) == 0 {
+		r.mu.Unlock()
+		time.Sleep(halPoll)
+		return nil, nil
+	}
+	msg := r.pending[0]
+	r.pending = r.pending[1:]
+	r.mu.Unlock()
+	return msg, nil
+}
+
+// Transmit implements Radio, sending data immediately and waiting for the
+// radio to finish emitting it
+func (r *halRadio) Transmit(data []byte, sf uint8, txPower int8) error {
+	r.mu.Lock()
+	if !r.started {
+		r.mu.Unlock()
+		return fmt.Errorf("concentrator not started")
+	}
+	err := r.hal.send(data, sf, txPower)
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(halTxTimeout)
+	for time.Now().Before(deadline) {
+		r.mu.Lock()
+		emitting, err := r.hal.emitting()
+		r.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		if !emitting {
+			return nil
+		}
+		time.Sleep(halPoll)
+	}
+	return fmt.Errorf("TX not finished after %s", halTxTimeout)
+}
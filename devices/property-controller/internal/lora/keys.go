@@ -0,0 +1,304 @@
+package lora
+
+import (
+	"sync"
+	"time"
+
+	"github.com/agsys/property-controller/internal/protocol"
+)
+
+// DefaultKeyGrace is how long a replaced key is accepted until the engine
+// configures its own grace window
+const DefaultKeyGrace = 24 * time.Hour
+
+// KeyStore holds rotated per-device AES-128-GCM keys.
+//
+// Devices that have never been rotated have no entry and the driver keeps
+// using its existing network key for them. Once a device has an active key,
+// unicast traffic to and from it is sealed with AES-128-GCM under that key.
+// Broadcasts always stay on the network key.
+//
+// During a rotation the new key is held as pending. Uplinks are accepted
+// under the active key, the pending key and, for a grace window after a
+// rollover, the previous key, so a device that missed part of the exchange
+// is never locked out.
+type KeyStore struct {
+	grace      time.Duration
+	mu         sync.Mutex
+	devices    map[[8]byte]*deviceKeys
+	nonces     *NonceCounter
+	onActivate func(deviceUID [8]byte, keyID uint8)
+}
+
+// deviceKeys is the key state of a single device
+type deviceKeys struct {
+	current       []byte
+	currentID     uint8
+	pending       []byte
+	pendingID     uint8
+	pendingUntil  time.Time // Zero while the rotation is in progress
+	previous      []byte
+	previousUntil time.Time
+}
+
+// KeyInfo describes the key state of a device
+type KeyInfo struct {
+	KeyID         uint8
+	PendingKeyID  uint8
+	HasPending    bool
+	PreviousUntil time.Time
+}
+
+// NewKeyStore creates an empty key store. grace is how long a replaced key
+// is still accepted on uplinks.
+func NewKeyStore(grace time.Duration) *KeyStore {
+	return &KeyStore{
+		grace:   grace,
+		devices: make(map[[8]byte]*deviceKeys),
+		nonces:  NewNonceCounter(),
+	}
+}
+
+// Nonces returns the counter downlinks are sealed with, shared with the
+// driver's derived device keys. Resume it before the first downlink.
+func (s *KeyStore) Nonces() *NonceCounter {
+	return s.nonces
+}
+
+// SetGrace changes the grace window for subsequent rollovers
+func (s *KeyStore) SetGrace(grace time.Duration) {
+	s.mu.Lock()
+	s.grace = grace
+	s.mu.Unlock()
+}
+
+// SetActivateCallback sets the callback invoked when a pending key becomes
+// active because the device was heard using it
+func (s *KeyStore) SetActivateCallback(cb func(deviceUID [8]byte, keyID uint8)) {
+	s.mu.Lock()
+	s.onActivate = cb
+	s.mu.Unlock()
+}
+
+// Load sets the active key for a device, e.g. when restoring from storage
+func (s *KeyStore) Load(deviceUID [8]byte, keyID uint8, key []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dk := s.entry(deviceUID)
+	dk.current = append([]byte(nil), key...)
+	dk.currentID = keyID
+}
+
+// SetPending stages a new key for a device while the rotation is delivered
+func (s *KeyStore) SetPending(deviceUID [8]byte, keyID uint8, key []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dk := s.entry(deviceUID)
+	dk.pending = append([]byte(nil), key...)
+	dk.pendingID = keyID
+	dk.pendingUntil = time.Time{}
+}
+
+// Activate promotes the pending key with the given ID to the active key.
+// The replaced key stays accepted on uplinks for the grace window. Returns
+// false if no matching key is pending.
+func (s *KeyStore) Activate(deviceUID [8]byte, keyID uint8) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dk, ok := s.devices[deviceUID]
+	if !ok || dk.pending == nil || dk.pendingID != keyID {
+		return false
+	}
+	s.promote(dk)
+	return true
+}
+
+// Abandon gives up on a pending rotation. The pending key is still accepted
+// for the grace window in case the device took it but its ack was lost.
+func (s *KeyStore) Abandon(deviceUID [8]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if dk, ok := s.devices[deviceUID]; ok && dk.pending != nil {
+		dk.pendingUntil = time.Now().Add(s.grace)
+	}
+}
+
+// Info returns the key state of a device, or false if it has no rotated key
+func (s *KeyStore) Info(deviceUID [8]byte) (KeyInfo, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dk, ok := s.devices[deviceUID]
+	if !ok {
+		return KeyInfo{}, false
+	}
+	s.expire(dk, time.Now())
+	return KeyInfo{
+		KeyID:         dk.currentID,
+		PendingKeyID:  dk.pendingID,
+		HasPending:    dk.pending != nil,
+		PreviousUntil: dk.previousUntil,
+	}, true
+}
+
+// AcceptsNetworkKey reports whether uplinks from a device may still use the
+// network key: it has no active rotated key, or its first rotation is still
+// inside the grace window
+func (s *KeyStore) AcceptsNetworkKey(deviceUID [8]byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dk, ok := s.devices[deviceUID]
+	if !ok || dk.current == nil {
+		return true
+	}
+	s.expire(dk, time.Now())
+	return dk.previous == nil && !dk.previousUntil.IsZero()
+}
+
+// Encrypt seals a downlink for a device under its active key. Returns false
+// if the device has no rotated key and the network key should be used.
+func (s *KeyStore) Encrypt(deviceUID [8]byte, plaintext []byte) ([]byte, bool, error) {
+	s.mu.Lock()
+	dk, ok := s.devices[deviceUID]
+	if !ok || dk.current == nil || isBroadcast(deviceUID) {
+		s.mu.Unlock()
+		return nil, false, nil
+	}
+	key := dk.current
+	s.mu.Unlock()
+
+	nonce, err := s.nonces.Next()
+	if err != nil {
+		return nil, false, err
+	}
+	encrypted, err := EncryptGCM(key, nonce, plaintext)
+	return encrypted, true, err
+}
+
+// Decrypt opens an uplink from a known device. Returns false if the device
+// has no rotated key or no accepted key authenticates the packet.
+func (s *KeyStore) Decrypt(deviceUID [8]byte, packet []byte) ([]byte, bool) {
+	s.mu.Lock()
+	dk, ok := s.devices[deviceUID]
+	if !ok {
+		s.mu.Unlock()
+		return nil, false
+	}
+	plaintext, ok, cb, keyID := s.open(deviceUID, dk, packet, false, time.Now())
+	s.mu.Unlock()
+
+	if cb != nil {
+		cb(deviceUID, keyID)
+	}
+	return plaintext, ok
+}
+
+// DecryptAny opens an uplink whose sender is not known until decrypted by
+// trying the keys of every rotated device. The decoded header must name the
+// device whose key authenticated the packet.
+func (s *KeyStore) DecryptAny(packet []byte) ([]byte, bool) {
+	now := time.Now()
+
+	s.mu.Lock()
+	for uid, dk := range s.devices {
+		plaintext, ok, cb, keyID := s.open(uid, dk, packet, true, now)
+		if !ok {
+			continue
+		}
+		s.mu.Unlock()
+		if cb != nil {
+			cb(uid, keyID)
+		}
+		return plaintext, true
+	}
+	s.mu.Unlock()
+
+	return nil, false
+}
+
+// open tries the accepted keys of a device in turn. A packet sealed under
+// the pending key activates it. Must be called with mu held; the returned
+// callback must be invoked after mu is released.
+func (s *KeyStore) open(deviceUID [8]byte, dk *deviceKeys, packet []byte, fullMessage bool, now time.Time) ([]byte, bool, func([8]byte, uint8), uint8) {
+	s.expire(dk, now)
+
+	if plaintext, ok := openWith(dk.current, deviceUID, packet, fullMessage); ok {
+		return plaintext, true, nil, 0
+	}
+	if plaintext, ok := openWith(dk.pending, deviceUID, packet, fullMessage); ok {
+		keyID := dk.pendingID
+		s.promote(dk)
+		return plaintext, true, s.onActivate, keyID
+	}
+	if plaintext, ok := openWith(dk.previous, deviceUID, packet, fullMessage); ok {
+		return plaintext, true, nil, 0
+	}
+	return nil, false, nil, 0
+}
+
+// promote makes the pending key active and keeps the old one for the grace
+// window. Must be called with mu held.
+func (s *KeyStore) promote(dk *deviceKeys) {
+	// A nil previous key with a deadline means the network key is still
+	// accepted after a device's first rotation
+	dk.previous = dk.current
+	dk.previousUntil = time.Now().Add(s.grace)
+	dk.current = dk.pending
+	dk.currentID = dk.pendingID
+	dk.pending = nil
+	dk.pendingID = 0
+	dk.pendingUntil = time.Time{}
+}
+
+// expire drops keys whose grace window has passed. Must be called with mu held.
+func (s *KeyStore) expire(dk *deviceKeys, now time.Time) {
+	if !dk.previousUntil.IsZero() && now.After(dk.previousUntil) {
+		dk.previous = nil
+		dk.previousUntil = time.Time{}
+	}
+	if dk.pending != nil && !dk.pendingUntil.IsZero() && now.After(dk.pendingUntil) {
+		dk.pending = nil
+		dk.pendingID = 0
+		dk.pendingUntil = time.Time{}
+	}
+}
+
+// entry returns the key state for a device, creating it if needed.
+// Must be called with mu held.
+func (s *KeyStore) entry(deviceUID [8]byte) *deviceKeys {
+	dk, ok := s.devices[deviceUID]
+	if !ok {
+		dk = &deviceKeys{}
+		s.devices[deviceUID] = dk
+	}
+	return dk
+}
+
+// openWith decrypts a packet with a key. When fullMessage is set the
+// plaintext must also decode as a message from the expected device; the
+// RAK2245 driver only encrypts payloads, so it relies on the tag alone.
+func openWith(key []byte, deviceUID [8]byte, packet []byte, fullMessage bool) ([]byte, bool) {
+	if key == nil {
+		return nil, false
+	}
+	// A nonce with the downlink flag is one of ours played back
+	if nonce, err := ExtractNonce(packet); err != nil || nonce&DownlinkNonceFlag != 0 {
+		return nil, false
+	}
+	plaintext, err := DecryptGCM(key, packet)
+	if err != nil {
+		return nil, false
+	}
+	if fullMessage {
+		msg, err := protocol.Decode(plaintext)
+		if err != nil || msg.Header.DeviceUID != deviceUID {
+			return nil, false
+		}
+	}
+	return plaintext, true
+}
@@ -0,0 +1,132 @@
+package lora
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/agsys/property-controller/internal/protocol"
+)
+
+// TestKeyStoreRotation tests which keys are accepted through a rotation
+func TestKeyStoreRotation(t *testing.T) {
+	uid := [8]byte{1, 2, 3, 4, 5, 6, 7, 8}
+	oldKey := bytes.Repeat([]byte{0x11}, CryptoKeySize)
+	newKey := bytes.Repeat([]byte{0x22}, CryptoKeySize)
+	otherKey := bytes.Repeat([]byte{0x33}, CryptoKeySize)
+
+	msg := &protocol.LoRaMessage{
+		Header: protocol.Header{
+			Magic:     [2]byte{protocol.MagicByte1, protocol.MagicByte2},
+			Version:   protocol.ProtocolVersion,
+			MsgType:   protocol.MsgTypeHeartbeat,
+			DeviceUID: uid,
+		},
+		Payload: []byte{1, 2, 3},
+	}
+	seal := func(key []byte) []byte {
+		packet, err := EncryptGCM(key, 1, msg.Encode())
+		if err != nil {
+			t.Fatalf("EncryptGCM failed: %v", err)
+		}
+		return packet
+	}
+
+	tests := []struct {
+		name   string
+		setup  func(s *KeyStore)
+		key    []byte
+		want   bool
+		wantID uint8
+	}{
+		{"unrotated device", func(s *KeyStore) {}, oldKey, false, 0},
+		{"active key", func(s *KeyStore) { s.Load(uid, 1, oldKey) }, oldKey, true, 1},
+		{"unknown key", func(s *KeyStore) { s.Load(uid, 1, oldKey) }, otherKey, false, 1},
+		{"pending key activates", func(s *KeyStore) {
+			s.Load(uid, 1, oldKey)
+			s.SetPending(uid, 2, newKey)
+		}, newKey, true, 2},
+		{"old key still accepted while pending", func(s *KeyStore) {
+			s.Load(uid, 1, oldKey)
+			s.SetPending(uid, 2, newKey)
+		}, oldKey, true, 1},
+		{"previous key within grace", func(s *KeyStore) {
+			s.Load(uid, 1, oldKey)
+			s.SetPending(uid, 2, newKey)
+			s.Activate(uid, 2)
+		}, oldKey, true, 2},
+		{"previous key after grace", func(s *KeyStore) {
+			s.SetGrace(-time.Second)
+			s.Load(uid, 1, oldKey)
+			s.SetPending(uid, 2, newKey)
+			s.Activate(uid, 2)
+		}, oldKey, false, 2},
+		{"abandoned key within grace", func(s *KeyStore) {
+			s.Load(uid, 1, oldKey)
+			s.SetPending(uid, 2, newKey)
+			s.Abandon(uid)
+		}, newKey, true, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewKeyStore(time.Hour)
+			tt.setup(s)
+
+			plaintext, ok := s.DecryptAny(seal(tt.key))
+			if ok != tt.want {
+				t.Fatalf("DecryptAny ok = %v, want %v", ok, tt.want)
+			}
+			if ok && !bytes.Equal(plaintext, msg.Encode()) {
+				t.Errorf("DecryptAny plaintext mismatch")
+			}
+			info, _ := s.Info(uid)
+			if info.KeyID != tt.wantID {
+				t.Errorf("KeyID = %d, want %d", info.KeyID, tt.wantID)
+			}
+		})
+	}
+}
+
+// TestKeyStoreNetworkKeyGrace tests the network key fallback after a first rotation
+func TestKeyStoreNetworkKeyGrace(t *testing.T) {
+	uid := [8]byte{1, 2, 3, 4, 5, 6, 7, 8}
+	key := bytes.Repeat([]byte{0x22}, CryptoKeySize)
+
+	s := NewKeyStore(time.Hour)
+	if !s.AcceptsNetworkKey(uid) {
+		t.Error("unrotated device should accept the network key")
+	}
+
+	var activated uint8
+	s.SetActivateCallback(func(deviceUID [8]byte, keyID uint8) { activated = keyID })
+	s.SetPending(uid, 1, key)
+	if _, ok, _ := s.Encrypt(uid, []byte{1}); ok {
+		t.Error("pending key should not be used for downlinks")
+	}
+
+	packet, err := EncryptGCM(key, 1, []byte{9, 9})
+	if err != nil {
+		t.Fatalf("EncryptGCM failed: %v", err)
+	}
+	if _, ok := s.Decrypt(uid, packet); !ok {
+		t.Fatal("Decrypt should accept the pending key")
+	}
+	if activated != 1 {
+		t.Errorf("activate callback got key %d, want 1", activated)
+	}
+	if _, ok, _ := s.Encrypt(uid, []byte{1}); !ok {
+		t.Error("active key should be used for downlinks")
+	}
+	if !s.AcceptsNetworkKey(uid) {
+		t.Error("network key should be accepted within the grace window")
+	}
+
+	s.SetGrace(-time.Second)
+	s.Load(uid, 2, key)
+	s.SetPending(uid, 3, key)
+	s.Activate(uid, 3)
+	if s.AcceptsNetworkKey(uid) {
+		t.Error("network key should not be accepted after a second rotation")
+	}
+}
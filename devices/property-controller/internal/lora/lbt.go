@@ -0,0 +1,57 @@
+package lora
+
+import (
+	"errors"
+	"log"
+	"math/rand/v2"
+	"time"
+)
+
+// ErrChannelBusy is returned by a radio whose listen-before-talk found the
+// downlink channel in use
+var ErrChannelBusy = errors.New("channel busy")
+
+// LBTConfig holds the listen-before-talk settings. The radio senses the
+// channel before each downlink; while it is busy the driver waits a random
+// backoff and tries again, and skips the downlink after the last retry.
+type LBTConfig struct {
+	Enabled    bool
+	RSSITarget int8          // dBm; the channel is busy above this
+	ScanTime   time.Duration // How long the channel is sensed (128 µs or 5 ms on the SX1261)
+	Retries    int           // Further attempts after a busy channel
+	Backoff    time.Duration // Longest random wait before each retry
+}
+
+// DefaultLBTConfig returns the default listen-before-talk settings, off
+func DefaultLBTConfig() LBTConfig {
+	return LBTConfig{
+		RSSITarget: -80,
+		ScanTime:   5 * time.Millisecond,
+		Retries:    3,
+		Backoff:    500 * time.Millisecond,
+	}
+}
+
+// randomDelay returns a random duration below limit
+func randomDelay(limit time.Duration) time.Duration {
+	if limit <= 0 {
+		return 0
+	}
+	return rand.N(limit)
+}
+
+// transmitClear transmits a packet after a random jitter, so downlinks
+// don't line up with the uplinks they answer, and retries after a random
+// backoff while the radio finds the channel busy
+func (d *Driver) transmitClear(deviceUID [8]byte, data []byte, sf uint8, txPower int8) error {
+	time.Sleep(randomDelay(d.config.TxJitter))
+
+	err := d.transmitPacket(deviceUID, data, sf, txPower)
+	for attempt := 0; attempt < d.config.LBT.Retries && errors.Is(err, ErrChannelBusy); attempt++ {
+		wait := randomDelay(d.config.LBT.Backoff)
+		log.Printf("Channel busy for downlink to %s, retrying in %s", DeviceUIDToString(deviceUID), wait.Round(time.Millisecond))
+		time.Sleep(wait)
+		err = d.transmitPacket(deviceUID, data, sf, txPower)
+	}
+	return err
+}
@@ -0,0 +1,84 @@
+package lora
+
+import (
+	"testing"
+	"time"
+
+	"github.com/agsys/property-controller/internal/protocol"
+)
+
+// busyRadio is a Radio whose channel is busy for its first transmissions
+type busyRadio struct {
+	chanRadio
+	busy int
+}
+
+func (r *busyRadio) Transmit(data []byte, sf uint8, txPower int8) error {
+	if r.busy > 0 {
+		r.busy--
+		return ErrChannelBusy
+	}
+	return r.chanRadio.Transmit(data, sf, txPower)
+}
+
+// TestLBTRetries tests that a downlink is retried while the channel is busy
+// and skipped once the retries run out, and that both outcomes are reported
+func TestLBTRetries(t *testing.T) {
+	radio := &busyRadio{chanRadio: chanRadio{rx: make(chan *protocol.LoRaMessage), tx: make(chan []byte, 2)}}
+	config := DefaultConfig()
+	config.Radio = radio
+	config.TxJitter = 5 * time.Millisecond
+	config.LBT.Retries = 2
+	config.LBT.Backoff = 5 * time.Millisecond
+
+	d, err := New(config)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer d.Stop()
+	uid := [8]byte{0x01, 0, 0, 0, 0, 0, 0, 0x07}
+	results := make(chan TxResult, 2)
+	d.SetTxResultCallback(func(result TxResult) { results <- result })
+
+	// Busy twice, clear on the last retry
+	radio.busy = 2
+	if err := d.SendToDevice(uid, protocol.MsgTypeTimeSync, []byte{1}); err != nil {
+		t.Fatalf("SendToDevice failed: %v", err)
+	}
+	select {
+	case <-radio.tx:
+	case <-time.After(time.Second):
+		t.Fatal("Downlink not sent once the channel cleared")
+	}
+
+	// Busy past the retries
+	radio.busy = 3
+	if err := d.SendToDevice(uid, protocol.MsgTypeTimeSync, []byte{2}); err != nil {
+		t.Fatalf("SendToDevice failed: %v", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for d.Stats().TxSkipped == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	stats := d.Stats()
+	if stats.TxSkipped != 1 || stats.TxPackets != 1 || stats.TxErrors != 0 {
+		t.Errorf("Stats = %d skipped, %d sent, %d errors, want 1, 1, 0", stats.TxSkipped, stats.TxPackets, stats.TxErrors)
+	}
+	if len(radio.tx) != 0 {
+		t.Error("Downlink sent on a busy channel")
+	}
+
+	for i, want := range []error{nil, ErrChannelBusy} {
+		select {
+		case result := <-results:
+			if result.DeviceUID != uid || result.MsgType != protocol.MsgTypeTimeSync || result.Err != want {
+				t.Errorf("Result %d = %+v, want error %v", i, result, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Result %d not reported", i)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package lora
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/agsys/property-controller/internal/lora/gw"
+	"github.com/agsys/property-controller/internal/protocol"
+)
+
+// multiDedupWindow is how long after an uplink is received copies of it
+// heard by other gateways are dropped
+const multiDedupWindow = 2 * time.Second
+
+// noRSSI marks a gateway that hasn't heard a device
+const noRSSI = math.MinInt16
+
+// MultiRadio is a Radio that spreads the driver over several gateways, for
+// properties too large for one to cover. An uplink heard by more than one
+// gateway is passed on once, as the first gateway received it. Downlinks to
+// a device go out through the gateway that last heard it the strongest,
+// falling back to the others in turn if it fails to transmit; broadcasts go
+// out through every gateway.
+type MultiRadio struct {
+	radios  []Radio
+	uplinks chan *protocol.LoRaMessage
+	stop    chan struct{}
+	wg      sync.WaitGroup
+
+	mu   sync.Mutex
+	seen map[string]time.Time // Recent uplinks, by frame
+	rssi map[[8]byte][]int16  // Last RSSI of each device at each gateway
+}
+
+// NewMultiRadio creates a radio over several gateways. The first is used
+// for downlinks to devices no gateway has heard yet.
+func NewMultiRadio(radios ...Radio) *MultiRadio {
+	return &MultiRadio{
+		radios:  radios,
+		uplinks: make(chan *protocol.LoRaMessage, 100),
+		seen:    make(map[string]time.Time),
+		rssi:    make(map[[8]byte][]int16),
+	}
+}
+
+// Start starts each gateway and receiving from them
+func (m *MultiRadio) Start() error {
+	for i, r := range m.radios {
+		l, ok := r.(radioLifecycle)
+		if !ok {
+			continue
+		}
+		if err := l.Start(); err != nil {
+			m.stopRadios(i)
+			return fmt.Errorf("gateway %d: %w", i+1, err)
+		}
+	}
+
+	m.stop = make(chan struct{})
+	for i, r := range m.radios {
+		m.wg.Add(1)
+		go m.receiveLoop(i, r)
+	}
+	return nil
+}
+
+// Stop stops receiving and stops each gateway
+func (m *MultiRadio) Stop() error {
+	if m.stop == nil {
+		return nil
+	}
+	close(m.stop)
+	m.wg.Wait()
+	m.stop = nil
+	return m.stopRadios(len(m.radios))
+}
+
+// stopRadios stops the first n gateways
+func (m *MultiRadio) stopRadios(n int) error {
+	var errs []error
+	for _, r := range m.radios[:n] {
+		if l, ok := r.(radioLifecycle); ok {
+			errs = append(errs, l.Stop())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// SetStatsCallback passes the statistics of every gateway that reports them
+// to cb
+func (m *MultiRadio) SetStatsCallback(cb func(*gw.GatewayStats)) {
+	for _, r := range m.radios {
+		if s, ok := r.(gatewayStatsReporter); ok {
+			s.SetStatsCallback(cb)
+		}
+	}
+}
+
+// Receive implements Radio
+func (m *MultiRadio) Receive() (*protocol.LoRaMessage, error) {
+	select {
+	case msg := <-m.uplinks:
+		return msg, nil
+	case <-time.After(concentratordPoll):
+		return nil, nil
+	}
+}
+
+// receiveLoop passes on the uplinks one gateway receives
+func (m *MultiRadio) receiveLoop(i int, r Radio) {
+	defer m.wg.Done()
+
+	for {
+		select {
+		case <-m.stop:
+			return
+		default:
+		}
+
+		msg, err := r.Receive()
+		if err != nil {
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		if msg == nil || !m.first(i, msg, time.Now()) {
+			continue
+		}
+
+		select {
+		case m.uplinks <- msg:
+		default:
+			log.Println("Gateway uplink queue full, dropping packet")
+		}
+	}
+}
+
+// first notes the RSSI of an uplink at gateway i and reports whether it is
+// the first copy of the uplink received
+func (m *MultiRadio) first(i int, msg *protocol.LoRaMessage, now time.Time) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	uid := msg.Header.DeviceUID
+	levels, ok := m.rssi[uid]
+	if !ok {
+		levels = make([]int16, len(m.radios))
+		for j := range levels {
+			levels[j] = noRSSI
+		}
+		m.rssi[uid] = levels
+	}
+	levels[i] = msg.RSSI
+
+	for key, at := range m.seen {
+		if now.Sub(at) > multiDedupWindow {
+			delete(m.seen, key)
+		}
+	}
+	key := string(msg.Encode())
+	if _, dup := m.seen[key]; dup {
+		return false
+	}
+	m.seen[key] = now
+	return true
+}
+
+// Transmit implements Radio, sending data through every gateway
+func (m *MultiRadio) Transmit(data []byte, sf uint8, txPower int8) error {
+	var errs []error
+	for i, r := range m.radios {
+		if err := r.Transmit(data, sf, txPower); err != nil {
+			errs = append(errs, fmt.Errorf("gateway %d: %w", i+1, err))
+		}
+	}
+	if len(errs) == len(m.radios) {
+		return errors.Join(errs...)
+	}
+	return nil
+}
+
+// TransmitTo sends data to a device through the gateway that last heard it
+// the strongest, trying the others in turn if that fails. Broadcasts go
+// through every gateway.
+func (m *MultiRadio) TransmitTo(deviceUID [8]byte, data []byte, sf uint8, txPower int8) error {
+	if deviceUID == broadcastUID {
+		return m.Transmit(data, sf, txPower)
+	}
+
+	var errs []error
+	for _, i := range m.gatewaysFor(deviceUID) {
+		err := m.radios[i].Transmit(data, sf, txPower)
+		if err == nil {
+			return nil
+		}
+		log.Printf("Gateway %d failed to transmit to %s: %v", i+1, DeviceUIDToString(deviceUID), err)
+		errs = append(errs, fmt.Errorf("gateway %d: %w", i+1, err))
+	}
+	return errors.Join(errs...)
+}
+
+// gatewaysFor orders the gateways by the last RSSI they heard a device at,
+// strongest first
+func (m *MultiRadio) gatewaysFor(deviceUID [8]byte) []int {
+	order := make([]int, len(m.radios))
+	for i := range order {
+		order[i] = i
+	}
+
+	m.mu.Lock()
+	levels := slices.Clone(m.rssi[deviceUID])
+	m.mu.Unlock()
+	if levels == nil {
+		return order
+	}
+	sort.SliceStable(order, func(a, b int) bool { return levels[order[a]] > levels[order[b]] })
+	return order
+}
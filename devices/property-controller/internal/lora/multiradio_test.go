@@ -0,0 +1,87 @@
+package lora
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/agsys/property-controller/internal/protocol"
+)
+
+// TestMultiRadio tests that uplinks heard by several gateways are passed on
+// once and downlinks go through the gateway that hears a device best
+func TestMultiRadio(t *testing.T) {
+	near := &chanRadio{rx: make(chan *protocol.LoRaMessage, 1), tx: make(chan []byte, 1)}
+	far := &chanRadio{rx: make(chan *protocol.LoRaMessage, 1), tx: make(chan []byte, 1)}
+	m := NewMultiRadio(far, near)
+	if err := m.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer m.Stop()
+
+	uid := [8]byte{0x01, 0, 0, 0, 0, 0, 0, 0x07}
+	uplink := func(rssi int16) *protocol.LoRaMessage {
+		return &protocol.LoRaMessage{
+			Header: protocol.Header{
+				Magic:     [2]byte{protocol.MagicByte1, protocol.MagicByte2},
+				Version:   protocol.ProtocolVersion,
+				MsgType:   protocol.MsgTypeHeartbeat,
+				DeviceUID: uid,
+				Sequence:  1,
+			},
+			Payload: []byte{5, 6, 7},
+			RSSI:    rssi,
+		}
+	}
+	far.rx <- uplink(-120)
+	near.rx <- uplink(-80)
+
+	deadline := time.Now().Add(time.Second)
+	var received int
+	for time.Now().Before(deadline) {
+		msg, err := m.Receive()
+		if err != nil {
+			t.Fatalf("Receive failed: %v", err)
+		}
+		if msg != nil {
+			received++
+		}
+		if received > 0 && len(far.rx) == 0 && len(near.rx) == 0 {
+			break
+		}
+	}
+	if msg, _ := m.Receive(); msg != nil {
+		received++
+	}
+	if received != 1 {
+		t.Fatalf("Received %d copies of the uplink, want 1", received)
+	}
+
+	// The near gateway heard the device the strongest
+	if err := m.TransmitTo(uid, []byte{1}, 10, 20); err != nil {
+		t.Fatalf("TransmitTo failed: %v", err)
+	}
+	if len(near.tx) != 1 || len(far.tx) != 0 {
+		t.Fatalf("Sent %d near and %d far, want the near gateway", len(near.tx), len(far.tx))
+	}
+	<-near.tx
+
+	// Fall back to the far gateway when the near one fails
+	near.err = errors.New("busy")
+	if err := m.TransmitTo(uid, []byte{2}, 10, 20); err != nil {
+		t.Fatalf("TransmitTo with fallback failed: %v", err)
+	}
+	if len(far.tx) != 1 {
+		t.Fatal("Downlink not sent through the far gateway")
+	}
+	<-far.tx
+	near.err = nil
+
+	// Broadcasts go through every gateway
+	if err := m.TransmitTo(broadcastUID, []byte{3}, 10, 20); err != nil {
+		t.Fatalf("Broadcast failed: %v", err)
+	}
+	if len(near.tx) != 1 || len(far.tx) != 1 {
+		t.Fatalf("Broadcast sent %d near and %d far, want both", len(near.tx), len(far.tx))
+	}
+}
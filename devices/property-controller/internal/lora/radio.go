@@ -0,0 +1,57 @@
+package lora
+
+import (
+	"github.com/agsys/property-controller/internal/lora/gw"
+	"github.com/agsys/property-controller/internal/protocol"
+)
+
+// Radio sends and receives raw packets for the driver. The driver talks to
+// the SX1301 concentrator unless Config.Radio is set; the integration test
+// harness uses this to loop packets back in-process.
+type Radio interface {
+	// Receive returns the next received packet, or nil if none is waiting.
+	// It may block briefly while waiting for one.
+	Receive() (*protocol.LoRaMessage, error)
+
+	// Transmit sends an encoded (and encrypted, if keys are set) packet
+	Transmit(data []byte, sf uint8, txPower int8) error
+}
+
+// radioLifecycle is implemented by radios that hold connections, such as
+// ConcentratordRadio. The driver opens them on Start and closes them on Stop.
+type radioLifecycle interface {
+	Start() error
+	Stop() error
+}
+
+// gatewayStatsReporter is implemented by radios that receive the periodic
+// statistics of their gateway, such as ConcentratordRadio
+type gatewayStatsReporter interface {
+	SetStatsCallback(cb func(*gw.GatewayStats))
+}
+
+// deviceRadio is implemented by radios that choose how to reach each device,
+// such as MultiRadio. The driver transmits through TransmitTo when a radio
+// has it.
+type deviceRadio interface {
+	TransmitTo(deviceUID [8]byte, data []byte, sf uint8, txPower int8) error
+}
+
+// broadcastUID addresses every device
+var broadcastUID = [8]byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+
+// Every radio the driver can be configured with, and the optional
+// interfaces each is meant to have
+var (
+	_ Radio                = (*ConcentratordRadio)(nil)
+	_ radioLifecycle       = (*ConcentratordRadio)(nil)
+	_ gatewayStatsReporter = (*ConcentratordRadio)(nil)
+	_ Radio                = (*MultiRadio)(nil)
+	_ radioLifecycle       = (*MultiRadio)(nil)
+	_ gatewayStatsReporter = (*MultiRadio)(nil)
+	_ deviceRadio          = (*MultiRadio)(nil)
+	_ Radio                = (*SX1301Radio)(nil)
+	_ radioLifecycle       = (*SX1301Radio)(nil)
+	_ Radio                = (*SX1302Radio)(nil)
+	_ radioLifecycle       = (*SX1302Radio)(nil)
+)
@@ -0,0 +1,48 @@
+package lora
+
+// SX1301Config holds the board settings of an SX1301 concentrator, such as
+// the RAK2245
+type SX1301Config struct {
+	SPIDevice  string  // SPI device the concentrator is on, as libloragw was built for
+	RSSIOffset float32 // dB added to the RSSI the SX1257 reports
+	NotchFreq  uint32  // Hz, the TX notch filter of the SX1257
+}
+
+// DefaultSX1301Config returns the settings of a RAK2245 Pi HAT
+func DefaultSX1301Config() SX1301Config {
+	return SX1301Config{
+		SPIDevice:  "/dev/spidev0.0",
+		RSSIOffset: -166.0,
+		NotchFreq:  129000,
+	}
+}
+
+// SX1301Radio is a Radio that drives an SX1301 concentrator such as the
+// RAK2245 directly through the Semtech lora_gateway libloragw. It needs a
+// build with the sx1301 tag (and cgo); other builds fail to start it. Radio
+// 0 listens on the configured frequency, with the multi-SF channel at
+// 125 kHz or the single-SF channel at wider bandwidths, and transmits
+// downlinks immediately.
+//
+// The SX1301 HAL opens the SPI device it was compiled for, and the
+// concentrator must be reset before Start, as the Semtech reset_lgw.sh
+// script does.
+type SX1301Radio struct {
+	halRadio
+}
+
+// NewSX1301Radio creates a radio for the concentrator on board, using the
+// frequency, bandwidth, coding rate, and sync word of config
+func NewSX1301Radio(board SX1301Config, config Config) *SX1301Radio {
+	return &SX1301Radio{halRadio{
+		name:   "SX1301",
+		device: board.SPIDevice,
+		hal:    &sx1301HAL{board: board, config: config},
+	}}
+}
+
+// sx1301HAL calls the lora_gateway libloragw
+type sx1301HAL struct {
+	board  SX1301Config
+	config Config
+}
@@ -0,0 +1,244 @@
+//go:build linux && cgo && sx1301 && !sx1302
+
+package lora
+
+/*
+#cgo LDFLAGS: -lloragw -lm -lrt
+#include <string.h>
+#include <loragw_hal.h>
+*/
+import "C"
+
+import (
+	"fmt"
+	"unsafe"
+
+	"github.com/agsys/property-controller/internal/protocol"
+)
+
+// sx1301MaxPackets is how many uplinks are fetched from the concentrator at
+// a time
+const sx1301MaxPackets = 8
+
+// sx1301StdIF is the IF chain of the single-SF LoRa channel, used for
+// bandwidths the multi-SF channels don't support
+const sx1301StdIF = 8
+
+// sx1257TxGains is the TX gain table of the SX1257 radio on the RAK2245,
+// from the RAK reference configuration
+var sx1257TxGains = []struct {
+	power   int8
+	paGain  uint8
+	mixGain uint8
+}{
+	{-6, 0, 8}, {-3, 0, 10}, {0, 0, 12}, {3, 1, 8},
+	{6, 1, 10}, {10, 1, 12}, {11, 1, 13}, {12, 2, 9},
+	{13, 1, 15}, {14, 2, 10}, {16, 2, 11}, {20, 3, 9},
+	{23, 3, 10}, {25, 3, 11}, {26, 3, 12}, {27, 3, 14},
+}
+
+// start configures the board, radio 0, and its IF chain, then starts the
+// concentrator
+func (h *sx1301HAL) start() error {
+	var board C.struct_lgw_conf_board_s
+	switch h.config.SyncWord {
+	case 0x34:
+		board.lorawan_public = C.bool(true)
+	case 0x12:
+		board.lorawan_public = C.bool(false)
+	default:
+		return fmt.Errorf("SX1301 supports sync words 0x34 and 0x12, not 0x%02X", h.config.SyncWord)
+	}
+	board.clksrc = 1 // Radio 1 clocks the RAK2245
+	if C.lgw_board_setconf(board) != C.LGW_HAL_SUCCESS {
+		return fmt.Errorf("lgw_board_setconf failed")
+	}
+
+	var rf C.struct_lgw_conf_rxrf_s
+	rf.enable = C.bool(true)
+	rf.freq_hz = C.uint32_t(h.config.Frequency)
+	rf.rssi_offset = C.float(h.board.RSSIOffset)
+	rf._type = C.LGW_RADIO_TYPE_SX1257
+	rf.tx_enable = C.bool(true)
+	rf.tx_notch_freq = C.uint32_t(h.board.NotchFreq)
+	if C.lgw_rxrf_setconf(0, rf) != C.LGW_HAL_SUCCESS {
+		return fmt.Errorf("lgw_rxrf_setconf failed for radio 0")
+	}
+	// Radio 1 only supplies the clock
+	rf.tx_enable = C.bool(false)
+	if C.lgw_rxrf_setconf(1, rf) != C.LGW_HAL_SUCCESS {
+		return fmt.Errorf("lgw_rxrf_setconf failed for radio 1")
+	}
+
+	bw, err := sx1301Bandwidth(h.config.Bandwidth)
+	if err != nil {
+		return err
+	}
+	var ifConf C.struct_lgw_conf_rxif_s
+	ifConf.enable = C.bool(true)
+	ifConf.rf_chain = 0
+	ifConf.freq_hz = 0
+	ifChain := C.uint8_t(0)
+	if h.config.Bandwidth == 125000 {
+		ifConf.bandwidth = bw
+		ifConf.datarate = C.DR_LORA_MULTI
+	} else {
+		dr, err := sx1301DataRate(h.config.SpreadingFactor)
+		if err != nil {
+			return err
+		}
+		ifChain = sx1301StdIF
+		ifConf.bandwidth = bw
+		ifConf.datarate = dr
+	}
+	if C.lgw_rxif_setconf(ifChain, ifConf) != C.LGW_HAL_SUCCESS {
+		return fmt.Errorf("lgw_rxif_setconf failed for IF chain %d", ifChain)
+	}
+
+	var gains C.struct_lgw_tx_gain_lut_s
+	for i, g := range sx1257TxGains {
+		gains.lut[i].rf_power = C.int8_t(g.power)
+		gains.lut[i].pa_gain = C.uint8_t(g.paGain)
+		gains.lut[i].mix_gain = C.uint8_t(g.mixGain)
+		gains.lut[i].dac_gain = 3
+	}
+	gains.size = C.uint8_t(len(sx1257TxGains))
+	if C.lgw_txgain_setconf(&gains) != C.LGW_HAL_SUCCESS {
+		return fmt.Errorf("lgw_txgain_setconf failed")
+	}
+
+	if h.config.LBT.Enabled {
+		return fmt.Errorf("the SX1301 can't sense the channel for LBT")
+	}
+
+	if C.lgw_start() != C.LGW_HAL_SUCCESS {
+		return fmt.Errorf("lgw_start failed; is the concentrator reset and on %s?", h.board.SPIDevice)
+	}
+	return nil
+}
+
+// stop stops the concentrator
+func (h *sx1301HAL) stop() error {
+	if C.lgw_stop() != C.LGW_HAL_SUCCESS {
+		return fmt.Errorf("lgw_stop failed")
+	}
+	return nil
+}
+
+// receive fetches the uplinks waiting in the concentrator, dropping those
+// with a bad CRC or that aren't frames of ours
+func (h *sx1301HAL) receive() ([]*protocol.LoRaMessage, error) {
+	var pkts [sx1301MaxPackets]C.struct_lgw_pkt_rx_s
+	n := C.lgw_receive(sx1301MaxPackets, &pkts[0])
+	if n == C.LGW_HAL_ERROR {
+		return nil, fmt.Errorf("lgw_receive failed")
+	}
+
+	var msgs []*protocol.LoRaMessage
+	for _, p := range pkts[:n] {
+		if p.status != C.STAT_CRC_OK || p.modulation != C.MOD_LORA {
+			continue
+		}
+		data := C.GoBytes(unsafe.Pointer(&p.payload[0]), C.int(p.size))
+		msg, err := protocol.Decode(data)
+		if err != nil {
+			continue
+		}
+		msg.RSSI = int16(p.rssi)
+		msg.SNR = float32(p.snr)
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+// send queues data for immediate transmission on radio 0
+func (h *sx1301HAL) send(data []byte, sf uint8, txPower int8) error {
+	var pkt C.struct_lgw_pkt_tx_s
+	if len(data) == 0 {
+		return fmt.Errorf("empty frame")
+	}
+	if len(data) > len(pkt.payload) {
+		return fmt.Errorf("frame of %d bytes too large", len(data))
+	}
+	bw, err := sx1301Bandwidth(h.config.Bandwidth)
+	if err != nil {
+		return err
+	}
+	dr, err := sx1301DataRate(sf)
+	if err != nil {
+		return err
+	}
+
+	pkt.freq_hz = C.uint32_t(h.config.Frequency)
+	pkt.tx_mode = C.IMMEDIATE
+	pkt.rf_chain = 0
+	pkt.rf_power = C.int8_t(txPower)
+	pkt.modulation = C.MOD_LORA
+	pkt.bandwidth = bw
+	pkt.datarate = dr
+	pkt.coderate = sx1301CodeRate(h.config.CodingRate)
+	pkt.invert_pol = C.bool(true)
+	pkt.preamble = 8
+	pkt.size = C.uint16_t(len(data))
+	C.memcpy(unsafe.Pointer(&pkt.payload[0]), unsafe.Pointer(&data[0]), C.size_t(len(data)))
+
+	if C.lgw_send(pkt) != C.LGW_HAL_SUCCESS {
+		return fmt.Errorf("lgw_send failed")
+	}
+	return nil
+}
+
+// emitting reports whether the concentrator is still transmitting
+func (h *sx1301HAL) emitting() (bool, error) {
+	var status C.uint8_t
+	if C.lgw_status(C.TX_STATUS, &status) != C.LGW_HAL_SUCCESS {
+		return false, fmt.Errorf("lgw_status failed")
+	}
+	return status == C.TX_EMITTING || status == C.TX_SCHEDULED, nil
+}
+
+// sx1301Bandwidth converts a bandwidth in Hz to its HAL value
+func sx1301Bandwidth(hz uint32) (C.uint8_t, error) {
+	switch hz {
+	case 125000:
+		return C.BW_125KHZ, nil
+	case 250000:
+		return C.BW_250KHZ, nil
+	case 500000:
+		return C.BW_500KHZ, nil
+	}
+	return 0, fmt.Errorf("unsupported bandwidth %d Hz", hz)
+}
+
+// sx1301DataRate converts a spreading factor to its HAL value, which the
+// SX1301 HAL keeps as a bit per SF
+func sx1301DataRate(sf uint8) (C.uint32_t, error) {
+	switch sf {
+	case 7:
+		return C.DR_LORA_SF7, nil
+	case 8:
+		return C.DR_LORA_SF8, nil
+	case 9:
+		return C.DR_LORA_SF9, nil
+	case 10:
+		return C.DR_LORA_SF10, nil
+	case 11:
+		return C.DR_LORA_SF11, nil
+	case 12:
+		return C.DR_LORA_SF12, nil
+	}
+	return 0, fmt.Errorf("unsupported spreading factor %d", sf)
+}
+
+// sx1301CodeRate converts a coding rate denominator (5-8) to its HAL value
+func sx1301CodeRate(cr uint8) C.uint8_t {
+	switch cr {
+	case 6:
+		return C.CR_LORA_4_6
+	case 7:
+		return C.CR_LORA_4_7
+	case 8:
+		return C.CR_LORA_4_8
+	}
+	return C.CR_LORA_4_5
+}
@@ -0,0 +1,22 @@
+//go:build !(linux && cgo && sx1301 && !sx1302)
+
+package lora
+
+import (
+	"errors"
+
+	"github.com/agsys/property-controller/internal/protocol"
+)
+
+// errNoSX1301 is returned by an SX1301Radio in builds without the HAL
+var errNoSX1301 = errors.New("built without SX1301 support; rebuild with cgo and -tags sx1301")
+
+func (h *sx1301HAL) start() error { return errNoSX1301 }
+
+func (h *sx1301HAL) stop() error { return errNoSX1301 }
+
+func (h *sx1301HAL) receive() ([]*protocol.LoRaMessage, error) { return nil, errNoSX1301 }
+
+func (h *sx1301HAL) send(data []byte, sf uint8, txPower int8) error { return errNoSX1301 }
+
+func (h *sx1301HAL) emitting() (bool, error) { return false, errNoSX1301 }
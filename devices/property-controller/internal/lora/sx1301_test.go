@@ -0,0 +1,23 @@
+//go:build !(linux && cgo && sx1301 && !sx1302)
+
+package lora
+
+import (
+	"errors"
+	"testing"
+)
+
+// TestSX1301WithoutHAL tests that a driver without a Radio uses the SX1301,
+// and refuses to start in a build without its HAL
+func TestSX1301WithoutHAL(t *testing.T) {
+	d, err := New(DefaultConfig())
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if _, ok := d.config.Radio.(*SX1301Radio); !ok {
+		t.Fatalf("Radio = %T, want *SX1301Radio", d.config.Radio)
+	}
+	if err := d.Start(); !errors.Is(err, errNoSX1301) {
+		t.Fatalf("Start = %v, want %v", err, errNoSX1301)
+	}
+}
@@ -0,0 +1,49 @@
+package lora
+
+// SX1302Config holds the board settings of an SX1302/SX1303 concentrator,
+// such as the RAK2287 or RAK5146
+type SX1302Config struct {
+	SPIDevice    string  // SPI device the concentrator is on
+	RSSIOffset   float32 // dB added to the RSSI the SX1250 reports
+	SX1261Device string  // SPI device of the SX1261 that senses the channel for LBT
+}
+
+// DefaultSX1302Config returns the settings of a RAK2287/RAK5146 on a
+// Raspberry Pi HAT
+func DefaultSX1302Config() SX1302Config {
+	return SX1302Config{
+		SPIDevice:    "/dev/spidev0.0",
+		RSSIOffset:   -215.4,
+		SX1261Device: "/dev/spidev0.1",
+	}
+}
+
+// SX1302Radio is a Radio that drives an SX1302-based concentrator directly
+// through the Semtech sx1302_hal libloragw. It needs a build with the sx1302
+// tag (and cgo); other builds fail to start it. Radio 0 listens on the
+// configured frequency, with the multi-SF channel at 125 kHz or the single-SF
+// channel at wider bandwidths, and transmits downlinks immediately. With
+// LBT enabled the board's SX1261 senses the channel before each downlink,
+// and Transmit returns ErrChannelBusy when it is in use.
+//
+// The concentrator must be reset before Start, as the Semtech reset_lgw.sh
+// script does.
+type SX1302Radio struct {
+	halRadio
+}
+
+// NewSX1302Radio creates a radio for the concentrator on board, using the
+// frequency, bandwidth, coding rate, sync word, and LBT settings of config
+func NewSX1302Radio(board SX1302Config, config Config) *SX1302Radio {
+	return &SX1302Radio{halRadio{
+		name:   "SX1302",
+		device: board.SPIDevice,
+		hal:    &sx1302HAL{board: board, config: config},
+	}}
+}
+
+// sx1302HAL calls the sx1302_hal libloragw
+type sx1302HAL struct {
+	board  SX1302Config
+	config Config
+}
@@ -0,0 +1,252 @@
+//go:build linux && cgo && sx1302
+
+package lora
+
+/*
+#cgo LDFLAGS: -lloragw -ltinymt32 -lm -lrt -lpthread
+#include <stdlib.h>
+#include <string.h>
+#include <loragw_hal.h>
+*/
+import "C"
+
+import (
+	"fmt"
+	"time"
+	"unsafe"
+
+	"github.com/agsys/property-controller/internal/protocol"
+)
+
+// sx1302MaxPackets is how many uplinks are fetched from the concentrator at
+// a time
+const sx1302MaxPackets = 8
+
+// sx1302ServiceIF is the IF chain of the single-SF LoRa channel, used for
+// bandwidths the multi-SF channels don't support
+const sx1302ServiceIF = 8
+
+// sx1250TxGains is the TX gain table of the SX1250 radio on the RAK2287 and
+// RAK5146, from the Semtech reference configuration
+var sx1250TxGains = []struct {
+	power  int8
+	paGain uint8
+	pwrIdx uint8
+}{
+	{12, 0, 15}, {13, 0, 16}, {14, 0, 17}, {15, 0, 19},
+	{16, 0, 20}, {17, 0, 22}, {18, 1, 1}, {19, 1, 2},
+	{20, 1, 3}, {21, 1, 4}, {22, 1, 5}, {23, 1, 6},
+	{24, 1, 7}, {25, 1, 9}, {26, 1, 11}, {27, 1, 14},
+}
+
+// start configures the board, radio 0, and its IF chain, then starts the
+// concentrator
+func (h *sx1302HAL) start() error {
+	var board C.struct_lgw_conf_board_s
+	switch h.config.SyncWord {
+	case 0x34:
+		board.lorawan_public = C.bool(true)
+	case 0x12:
+		board.lorawan_public = C.bool(false)
+	default:
+		return fmt.Errorf("SX1302 supports sync words 0x34 and 0x12, not 0x%02X", h.config.SyncWord)
+	}
+	board.clksrc = 0
+	board.full_duplex = C.bool(false)
+	board.com_type = C.LGW_COM_SPI
+	if len(h.board.SPIDevice) >= len(board.com_path) {
+		return fmt.Errorf("SPI device path too long: %s", h.board.SPIDevice)
+	}
+	path := C.CString(h.board.SPIDevice)
+	C.strncpy(&board.com_path[0], path, C.size_t(len(board.com_path)-1))
+	C.free(unsafe.Pointer(path))
+	if C.lgw_board_setconf(&board) != C.LGW_HAL_SUCCESS {
+		return fmt.Errorf("lgw_board_setconf failed")
+	}
+
+	var rf C.struct_lgw_conf_rxrf_s
+	rf.enable = C.bool(true)
+	rf.freq_hz = C.uint32_t(h.config.Frequency)
+	rf.rssi_offset = C.float(h.board.RSSIOffset)
+	rf.rssi_tcomp = C.struct_lgw_rssi_tcomp_s{coeff_c: 20.41, coeff_d: 2162.56}
+	rf._type = C.LGW_RADIO_TYPE_SX1250
+	rf.tx_enable = C.bool(true)
+	if C.lgw_rxrf_setconf(0, &rf) != C.LGW_HAL_SUCCESS {
+		return fmt.Errorf("lgw_rxrf_setconf failed for radio 0")
+	}
+
+	bw, err := sx1302Bandwidth(h.config.Bandwidth)
+	if err != nil {
+		return err
+	}
+	var ifConf C.struct_lgw_conf_rxif_s
+	ifConf.enable = C.bool(true)
+	ifConf.rf_chain = 0
+	ifConf.freq_hz = 0
+	ifChain := C.uint8_t(0)
+	if h.config.Bandwidth != 125000 {
+		ifChain = sx1302ServiceIF
+		ifConf.bandwidth = bw
+		ifConf.datarate = C.uint32_t(h.config.SpreadingFactor)
+	}
+	if C.lgw_rxif_setconf(ifChain, &ifConf) != C.LGW_HAL_SUCCESS {
+		return fmt.Errorf("lgw_rxif_setconf failed for IF chain %d", ifChain)
+	}
+
+	var gains C.struct_lgw_tx_gain_lut_s
+	for i, g := range sx1250TxGains {
+		gains.lut[i].rf_power = C.int8_t(g.power)
+		gains.lut[i].pa_gain = C.uint8_t(g.paGain)
+		gains.lut[i].pwr_idx = C.uint8_t(g.pwrIdx)
+	}
+	gains.size = C.uint8_t(len(sx1250TxGains))
+	if C.lgw_txgain_setconf(0, &gains) != C.LGW_HAL_SUCCESS {
+		return fmt.Errorf("lgw_txgain_setconf failed")
+	}
+
+	if h.config.LBT.Enabled {
+		if err := h.setLBT(bw); err != nil {
+			return err
+		}
+	}
+
+	if C.lgw_start() != C.LGW_HAL_SUCCESS {
+		return fmt.Errorf("lgw_start failed; is the concentrator reset and on %s?", h.board.SPIDevice)
+	}
+	return nil
+}
+
+// setLBT configures the SX1261 to sense the downlink channel before each
+// transmission
+func (h *sx1302HAL) setLBT(bw C.uint8_t) error {
+	var conf C.struct_lgw_conf_sx1261_s
+	conf.enable = C.bool(true)
+	if len(h.board.SX1261Device) >= len(conf.spi_path) {
+		return fmt.Errorf("SPI device path too long: %s", h.board.SX1261Device)
+	}
+	path := C.CString(h.board.SX1261Device)
+	C.strncpy(&conf.spi_path[0], path, C.size_t(len(conf.spi_path)-1))
+	C.free(unsafe.Pointer(path))
+
+	conf.lbt_conf.enable = C.bool(true)
+	conf.lbt_conf.rssi_target = C.int8_t(h.config.LBT.RSSITarget)
+	conf.lbt_conf.nb_channel = 1
+	ch := &conf.lbt_conf.channels[0]
+	ch.freq_hz = C.uint32_t(h.config.Frequency)
+	ch.bandwidth = bw
+	ch.scan_time_us = C.LGW_LBT_SCAN_TIME_128_US
+	if h.config.LBT.ScanTime > 128*time.Microsecond {
+		ch.scan_time_us = C.LGW_LBT_SCAN_TIME_5000_US
+	}
+	ch.transmit_time_ms = C.uint16_t(halTxTimeout.Milliseconds())
+
+	if C.lgw_sx1261_setconf(&conf) != C.LGW_HAL_SUCCESS {
+		return fmt.Errorf("lgw_sx1261_setconf failed; is the SX1261 on %s?", h.board.SX1261Device)
+	}
+	return nil
+}
+
+// stop stops the concentrator
+func (h *sx1302HAL) stop() error {
+	if C.lgw_stop() != C.LGW_HAL_SUCCESS {
+		return fmt.Errorf("lgw_stop failed")
+	}
+	return nil
+}
+
+// receive fetches the uplinks waiting in the concentrator, dropping
+// those with a bad CRC or that aren't frames of ours
+func (h *sx1302HAL) receive() ([]*protocol.LoRaMessage, error) {
+	var pkts [sx1302MaxPackets]C.struct_lgw_pkt_rx_s
+	n := C.lgw_receive(sx1302MaxPackets, &pkts[0])
+	if n == C.LGW_HAL_ERROR {
+		return nil, fmt.Errorf("lgw_receive failed")
+	}
+
+	var msgs []*protocol.LoRaMessage
+	for _, p := range pkts[:n] {
+		if p.status != C.STAT_CRC_OK || p.modulation != C.MOD_LORA {
+			continue
+		}
+		data := C.GoBytes(unsafe.Pointer(&p.payload[0]), C.int(p.size))
+		msg, err := protocol.Decode(data)
+		if err != nil {
+			continue
+		}
+		msg.RSSI = int16(p.rssic)
+		msg.SNR = float32(p.snr)
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+// send queues data for immediate transmission on radio 0
+func (h *sx1302HAL) send(data []byte, sf uint8, txPower int8) error {
+	var pkt C.struct_lgw_pkt_tx_s
+	if len(data) == 0 {
+		return fmt.Errorf("empty frame")
+	}
+	if len(data) > len(pkt.payload) {
+		return fmt.Errorf("frame of %d bytes too large", len(data))
+	}
+	bw, err := sx1302Bandwidth(h.config.Bandwidth)
+	if err != nil {
+		return err
+	}
+
+	pkt.freq_hz = C.uint32_t(h.config.Frequency)
+	pkt.tx_mode = C.IMMEDIATE
+	pkt.rf_chain = 0
+	pkt.rf_power = C.int8_t(txPower)
+	pkt.modulation = C.MOD_LORA
+	pkt.bandwidth = bw
+	pkt.datarate = C.uint32_t(sf)
+	pkt.coderate = sx1302CodeRate(h.config.CodingRate)
+	pkt.invert_pol = C.bool(true)
+	pkt.preamble = 8
+	pkt.size = C.uint16_t(len(data))
+	C.memcpy(unsafe.Pointer(&pkt.payload[0]), unsafe.Pointer(&data[0]), C.size_t(len(data)))
+
+	switch C.lgw_send(&pkt) {
+	case C.LGW_HAL_SUCCESS:
+		return nil
+	case C.LGW_LBT_NOT_ALLOWED:
+		return ErrChannelBusy
+	}
+	return fmt.Errorf("lgw_send failed")
+}
+
+// emitting reports whether radio 0 is still transmitting
+func (h *sx1302HAL) emitting() (bool, error) {
+	var status C.uint8_t
+	if C.lgw_status(0, C.TX_STATUS, &status) != C.LGW_HAL_SUCCESS {
+		return false, fmt.Errorf("lgw_status failed")
+	}
+	return status == C.TX_EMITTING || status == C.TX_SCHEDULED, nil
+}
+
+// sx1302Bandwidth converts a bandwidth in Hz to its HAL value
+func sx1302Bandwidth(hz uint32) (C.uint8_t, error) {
+	switch hz {
+	case 125000:
+		return C.BW_125KHZ, nil
+	case 250000:
+		return C.BW_250KHZ, nil
+	case 500000:
+		return C.BW_500KHZ, nil
+	}
+	return 0, fmt.Errorf("unsupported bandwidth %d Hz", hz)
+}
+
+// sx1302CodeRate converts a coding rate denominator (5-8) to its HAL value
+func sx1302CodeRate(cr uint8) C.uint8_t {
+	switch cr {
+	case 6:
+		return C.CR_LORA_4_6
+	case 7:
+		return C.CR_LORA_4_7
+	case 8:
+		return C.CR_LORA_4_8
+	}
+	return C.CR_LORA_4_5
+}
@@ -0,0 +1,22 @@
+//go:build !(linux && cgo && sx1302)
+
+package lora
+
+import (
+	"errors"
+
+	"github.com/agsys/property-controller/internal/protocol"
+)
+
+// errNoSX1302 is returned by an SX1302Radio in builds without the HAL
+var errNoSX1302 = errors.New("built without SX1302 support; rebuild with cgo and -tags sx1302")
+
+func (h *sx1302HAL) start() error { return errNoSX1302 }
+
+func (h *sx1302HAL) stop() error { return errNoSX1302 }
+
+func (h *sx1302HAL) receive() ([]*protocol.LoRaMessage, error) { return nil, errNoSX1302 }
+
+func (h *sx1302HAL) send(data []byte, sf uint8, txPower int8) error { return errNoSX1302 }
+
+func (h *sx1302HAL) emitting() (bool, error) { return false, errNoSX1302 }
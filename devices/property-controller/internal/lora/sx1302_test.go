@@ -0,0 +1,30 @@
+//go:build !(linux && cgo && sx1302)
+
+package lora
+
+import (
+	"errors"
+	"testing"
+)
+
+// TestSX1302WithoutHAL tests that an SX1302 radio refuses to start in a
+// build without the HAL, and that the driver doesn't fall back to the stub
+func TestSX1302WithoutHAL(t *testing.T) {
+	r := NewSX1302Radio(DefaultSX1302Config(), DefaultConfig())
+	if err := r.Start(); !errors.Is(err, errNoSX1302) {
+		t.Fatalf("Start = %v, want %v", err, errNoSX1302)
+	}
+	if err := r.Transmit([]byte{1}, 10, 20); err == nil {
+		t.Error("Transmit succeeded on a radio that isn't started")
+	}
+
+	config := DefaultConfig()
+	config.Radio = r
+	d, err := New(config)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if err := d.Start(); !errors.Is(err, errNoSX1302) {
+		t.Fatalf("Driver Start = %v, want %v", err, errNoSX1302)
+	}
+}
@@ -0,0 +1,39 @@
+package lora
+
+import (
+	"sync"
+
+	"github.com/agsys/property-controller/internal/protocol"
+)
+
+// frameVersions tracks the protocol version each device last sent, so
+// downlinks only carry a frame CRC to devices whose firmware checks it
+type frameVersions struct {
+	mu       sync.Mutex
+	versions map[[8]byte]uint8
+}
+
+func newFrameVersions() *frameVersions {
+	return &frameVersions{versions: make(map[[8]byte]uint8)}
+}
+
+// Observe records the protocol version of an uplink
+func (f *frameVersions) Observe(deviceUID [8]byte, version uint8) {
+	if !protocol.SupportsVersion(version) {
+		return
+	}
+	f.mu.Lock()
+	f.versions[deviceUID] = version
+	f.mu.Unlock()
+}
+
+// For returns the protocol version to send a device. Devices not yet heard
+// from, and broadcasts, get the oldest version still supported.
+func (f *frameVersions) For(deviceUID [8]byte) uint8 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if v, ok := f.versions[deviceUID]; ok {
+		return v
+	}
+	return protocol.MinProtocolVersion
+}
@@ -0,0 +1,42 @@
+package lora
+
+import (
+	"testing"
+
+	"github.com/agsys/property-controller/internal/protocol"
+)
+
+// TestFrameVersions tests per-device downlink protocol version selection
+func TestFrameVersions(t *testing.T) {
+	f := newFrameVersions()
+	uid := [8]byte{1, 2, 3, 4, 5, 6, 7, 8}
+
+	if v := f.For(uid); v != protocol.MinProtocolVersion {
+		t.Errorf("Unknown device gets v%d, want v%d", v, protocol.MinProtocolVersion)
+	}
+
+	f.Observe(uid, protocol.CurrentProtocolVersion)
+	if v := f.For(uid); v != protocol.CurrentProtocolVersion {
+		t.Errorf("Device gets v%d, want v%d", v, protocol.CurrentProtocolVersion)
+	}
+
+	// Versions the controller can't decode are never used for downlinks
+	f.Observe(uid, protocol.CurrentProtocolVersion+1)
+	if v := f.For(uid); v != protocol.CurrentProtocolVersion {
+		t.Errorf("Device gets v%d after unsupported uplink, want v%d", v, protocol.CurrentProtocolVersion)
+	}
+
+	// Rolling a device back drops it to the older version
+	f.Observe(uid, protocol.MinProtocolVersion)
+	if v := f.For(uid); v != protocol.MinProtocolVersion {
+		t.Errorf("Device gets v%d after rollback, want v%d", v, protocol.MinProtocolVersion)
+	}
+
+	var broadcast [8]byte
+	for i := range broadcast {
+		broadcast[i] = 0xFF
+	}
+	if v := f.For(broadcast); v != protocol.MinProtocolVersion {
+		t.Errorf("Broadcast gets v%d, want v%d", v, protocol.MinProtocolVersion)
+	}
+}
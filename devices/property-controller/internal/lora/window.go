@@ -0,0 +1,77 @@
+package lora
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// maxWindowQueue is how many downlinks are held for a device at once; the
+// oldest is dropped to make room
+const maxWindowQueue = 16
+
+// windowDownlink is a downlink held for a device's next receive window
+type windowDownlink struct {
+	msgType  uint8
+	payload  []byte
+	queuedAt time.Time
+}
+
+// windowQueue holds non-urgent downlinks per device until the device next
+// sends an uplink, when it briefly listens. Battery devices miss downlinks
+// sent at any other time.
+type windowQueue struct {
+	mu     sync.Mutex
+	ttl    time.Duration // Downlinks older than this are dropped (0 keeps them)
+	queues map[[8]byte][]windowDownlink
+}
+
+func newWindowQueue(ttl time.Duration) *windowQueue {
+	return &windowQueue{ttl: ttl, queues: make(map[[8]byte][]windowDownlink)}
+}
+
+// add holds a downlink for a device
+func (q *windowQueue) add(deviceUID [8]byte, msgType uint8, payload []byte, now time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	queue := q.queues[deviceUID]
+	if len(queue) >= maxWindowQueue {
+		log.Printf("Downlink queue of %s full, dropping type 0x%02X queued %s", DeviceUIDToString(deviceUID),
+			queue[0].msgType, queue[0].queuedAt.Format(time.DateTime))
+		queue = queue[1:]
+	}
+	q.queues[deviceUID] = append(queue, windowDownlink{msgType: msgType, payload: payload, queuedAt: now})
+}
+
+// take removes and returns the downlinks held for a device, dropping those
+// past the TTL
+func (q *windowQueue) take(deviceUID [8]byte, now time.Time) []windowDownlink {
+	q.mu.Lock()
+	queue := q.queues[deviceUID]
+	delete(q.queues, deviceUID)
+	q.mu.Unlock()
+
+	live := queue[:0]
+	for _, dl := range queue {
+		if q.ttl > 0 && now.Sub(dl.queuedAt) > q.ttl {
+			log.Printf("Dropping downlink type 0x%02X to %s, queued %s and not heard from since",
+				dl.msgType, DeviceUIDToString(deviceUID), dl.queuedAt.Format(time.DateTime))
+			continue
+		}
+		live = append(live, dl)
+	}
+	return live
+}
+
+// pending returns how many downlinks are held across all devices
+func (q *windowQueue) pending() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	n := 0
+	for _, queue := range q.queues {
+		n += len(queue)
+	}
+	return n
+}
@@ -0,0 +1,95 @@
+package lora
+
+import (
+	"testing"
+	"time"
+
+	"github.com/agsys/property-controller/internal/protocol"
+)
+
+// TestSendInWindow tests that a held downlink waits for the device's next
+// uplink and goes out after it
+func TestSendInWindow(t *testing.T) {
+	radio := &chanRadio{rx: make(chan *protocol.LoRaMessage, 1), tx: make(chan []byte, 4)}
+	config := DefaultConfig()
+	config.Radio = radio
+
+	d, err := New(config)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer d.Stop()
+
+	uid := [8]byte{0x03, 0, 0, 0, 0, 0, 0, 0x09}
+	other := [8]byte{0x03, 0, 0, 0, 0, 0, 0, 0x0A}
+	if err := d.SendInWindow(uid, protocol.MsgTypeMeterResetTotal, []byte{1, 2, 3}); err != nil {
+		t.Fatalf("SendInWindow failed: %v", err)
+	}
+	if err := d.SendInWindow(broadcastUID, protocol.MsgTypeTimeSync, []byte{1}); err == nil {
+		t.Error("SendInWindow accepted a broadcast")
+	}
+	if n := d.Stats().TxWindow; n != 1 {
+		t.Errorf("TxWindow = %d, want 1", n)
+	}
+
+	uplink := func(from [8]byte) {
+		radio.rx <- &protocol.LoRaMessage{
+			Header: protocol.Header{
+				Magic:     [2]byte{protocol.MagicByte1, protocol.MagicByte2},
+				Version:   protocol.ProtocolVersion,
+				MsgType:   protocol.MsgTypeHeartbeat,
+				DeviceUID: from,
+			},
+			Payload: []byte{5, 6, 7},
+		}
+	}
+
+	// Another device's uplink leaves it held
+	uplink(other)
+	select {
+	case <-radio.tx:
+		t.Fatal("Held downlink sent after another device's uplink")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	uplink(uid)
+	select {
+	case data := <-radio.tx:
+		msg, err := protocol.Decode(data)
+		if err != nil || msg.Header.DeviceUID != uid || msg.Header.MsgType != protocol.MsgTypeMeterResetTotal {
+			t.Fatalf("Sent %+v, %v, want the held reset", msg, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Held downlink not sent after the device's uplink")
+	}
+	if n := d.Stats().TxWindow; n != 0 {
+		t.Errorf("TxWindow = %d after sending, want 0", n)
+	}
+}
+
+// TestWindowQueueLimits tests that held downlinks are capped per device and
+// dropped once past the TTL
+func TestWindowQueueLimits(t *testing.T) {
+	q := newWindowQueue(time.Hour)
+	uid := [8]byte{1}
+	start := time.Now()
+
+	for i := 0; i < maxWindowQueue+2; i++ {
+		q.add(uid, uint8(i), nil, start.Add(time.Duration(i)*time.Minute))
+	}
+	if n := q.pending(); n != maxWindowQueue {
+		t.Fatalf("pending = %d, want %d", n, maxWindowQueue)
+	}
+
+	// The two oldest were dropped for room, and the next two are past the TTL
+	held := q.take(uid, start.Add(time.Hour+3*time.Minute+30*time.Second))
+	if len(held) != maxWindowQueue-2 || held[0].msgType != 4 {
+		t.Fatalf("take returned %d starting at type %d, want %d starting at 4", len(held), held[0].msgType, maxWindowQueue-2)
+	}
+	if n := q.pending(); n != 0 {
+		t.Errorf("pending = %d after take, want 0", n)
+	}
+}
@@ -0,0 +1,456 @@
+// Package modbus exposes controller data as a Modbus TCP slave so that
+// pump-house SCADA and PLC systems can read valve states, soil moisture, and
+// meter values and open or close valves.
+//
+// Points are mapped by position in the configured lists, so register
+// addresses stay stable as devices come and go:
+//
+//	Coils 0-99             valve i open (write 1 to open, 0 to close)
+//	Discrete inputs 0-99   valve i reports an error
+//	Input registers        (also readable as holding registers)
+//	  0-99                 valve i state (0 closed, 1 open, 2 opening, 3 closing, 255 error)
+//	  100-199              soil probe i moisture, percent
+//	  200-399              meter i flow rate, L/min x100, uint32 as 2 registers at 200+2i
+//	  400-599              meter i totalizer, whole liters, uint32 as 2 registers at 400+2i
+//
+// Registers of points that are not mapped or have no reading yet read as
+// 0xFFFF. 32-bit values are sent high word first.
+package modbus
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// Register layout
+const (
+	MaxPoints = 100 // Points per block
+
+	RegValveState = 0
+	RegMoisture   = 100
+	RegFlowRate   = 200
+	RegTotal      = 400
+	regEnd        = 600
+
+	// Unknown is the value of a register with no data
+	Unknown uint16 = 0xFFFF
+)
+
+// Function codes
+const (
+	fcReadCoils          = 0x01
+	fcReadDiscreteInputs = 0x02
+	fcReadHolding        = 0x03
+	fcReadInput          = 0x04
+	fcWriteCoil          = 0x05
+	fcWriteCoils         = 0x0F
+)
+
+// Exception codes
+const (
+	exIllegalFunction = 0x01
+	exIllegalAddress  = 0x02
+	exIllegalValue    = 0x03
+	exDeviceFailure   = 0x04
+)
+
+// Config holds Modbus TCP server configuration
+type Config struct {
+	Listen      string        // TCP address such as ":502" (empty disables the server)
+	ReadOnly    bool          // Reject coil writes
+	IdleTimeout time.Duration // Close connections idle this long
+	MaxConns    int
+	Valves      []ValveRef  // Coil, discrete input, and valve state register i
+	Sensors     []SensorRef // Moisture register i
+	Meters      []string    // Meter device UIDs; flow and total registers i
+}
+
+// DefaultConfig returns default Modbus settings, with the server disabled
+func DefaultConfig() Config {
+	return Config{
+		IdleTimeout: 5 * time.Minute,
+		MaxConns:    8,
+	}
+}
+
+// ValveRef identifies a valve actuator
+type ValveRef struct {
+	ControllerUID string
+	Address       uint8
+}
+
+// SensorRef identifies a soil moisture probe
+type SensorRef struct {
+	DeviceUID string
+	Probe     uint8
+}
+
+// DataSource supplies point values and carries out valve writes. The ok
+// results are false for points with no data yet.
+type DataSource interface {
+	ValveState(v ValveRef) (state uint8, ok bool, err error)
+	SoilMoisture(s SensorRef) (percent uint8, ok bool, err error)
+	MeterReading(deviceUID string) (flowLPM, totalL float32, ok bool, err error)
+	SetValve(v ValveRef, open bool) error
+}
+
+// Valve states reported by actuators
+const (
+	valveOpen    = 1
+	valveOpening = 2
+	valveError   = 255
+)
+
+// Server is a Modbus TCP slave
+type Server struct {
+	config   Config
+	source   DataSource
+	listener net.Listener
+	mu       sync.Mutex
+	conns    map[net.Conn]struct{}
+	wg       sync.WaitGroup
+}
+
+// NewServer creates a Modbus TCP server
+func NewServer(config Config, source DataSource) *Server {
+	return &Server{
+		config: config,
+		source: source,
+		conns:  make(map[net.Conn]struct{}),
+	}
+}
+
+// Start begins accepting connections
+func (s *Server) Start() error {
+	if len(s.config.Valves) > MaxPoints || len(s.config.Sensors) > MaxPoints || len(s.config.Meters) > MaxPoints {
+		return fmt.Errorf("at most %d valves, sensors, and meters can be mapped", MaxPoints)
+	}
+
+	listener, err := net.Listen("tcp", s.config.Listen)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.config.Listen, err)
+	}
+	s.listener = listener
+
+	s.wg.Add(1)
+	go s.acceptLoop()
+
+	log.Printf("Modbus TCP listening on %s (%d valves, %d probes, %d meters)",
+		listener.Addr(), len(s.config.Valves), len(s.config.Sensors), len(s.config.Meters))
+	return nil
+}
+
+// Addr returns the address the server is listening on
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Stop closes the listener and all connections
+func (s *Server) Stop() error {
+	if s.listener == nil {
+		return nil
+	}
+	err := s.listener.Close()
+
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) acceptLoop() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("Modbus accept error: %v", err)
+			}
+			return
+		}
+
+		s.mu.Lock()
+		if s.config.MaxConns > 0 && len(s.conns) >= s.config.MaxConns {
+			s.mu.Unlock()
+			log.Printf("Modbus: rejecting %s, too many connections", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go s.serve(conn)
+	}
+}
+
+// serve handles requests on one connection until it closes
+func (s *Server) serve(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	header := make([]byte, 7)
+	for {
+		if s.config.IdleTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(s.config.IdleTimeout))
+		}
+
+		// MBAP header: transaction ID, protocol ID (0), length, unit ID
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		protocolID := binary.BigEndian.Uint16(header[2:4])
+		length := binary.BigEndian.Uint16(header[4:6])
+		if protocolID != 0 || length < 2 || length > 254 {
+			log.Printf("Modbus: closing %s after invalid frame", conn.RemoteAddr())
+			return
+		}
+
+		pdu := make([]byte, length-1)
+		if _, err := io.ReadFull(conn, pdu); err != nil {
+			return
+		}
+
+		resp := s.handle(pdu)
+
+		frame := make([]byte, 7+len(resp))
+		copy(frame, header[:4])
+		binary.BigEndian.PutUint16(frame[4:6], uint16(len(resp)+1))
+		frame[6] = header[6]
+		copy(frame[7:], resp)
+		if _, err := conn.Write(frame); err != nil {
+			return
+		}
+	}
+}
+
+// handle processes one request PDU and returns the response PDU
+func (s *Server) handle(pdu []byte) []byte {
+	fc := pdu[0]
+	data := pdu[1:]
+
+	var resp []byte
+	var ex byte
+	switch fc {
+	case fcReadCoils, fcReadDiscreteInputs:
+		resp, ex = s.readBits(fc, data)
+	case fcReadHolding, fcReadInput:
+		resp, ex = s.readRegisters(fc, data)
+	case fcWriteCoil:
+		resp, ex = s.writeCoil(data)
+	case fcWriteCoils:
+		resp, ex = s.writeCoils(data)
+	default:
+		ex = exIllegalFunction
+	}
+
+	if ex != 0 {
+		return []byte{fc | 0x80, ex}
+	}
+	return append([]byte{fc}, resp...)
+}
+
+// readBits serves coils (valve open) and discrete inputs (valve error)
+func (s *Server) readBits(fc byte, data []byte) ([]byte, byte) {
+	if len(data) != 4 {
+		return nil, exIllegalValue
+	}
+	start := int(binary.BigEndian.Uint16(data[0:2]))
+	count := int(binary.BigEndian.Uint16(data[2:4]))
+	if count < 1 || count > 2000 {
+		return nil, exIllegalValue
+	}
+	if start+count > len(s.config.Valves) {
+		return nil, exIllegalAddress
+	}
+
+	resp := make([]byte, 1+(count+7)/8)
+	resp[0] = byte(len(resp) - 1)
+	for i := 0; i < count; i++ {
+		state, ok, err := s.source.ValveState(s.config.Valves[start+i])
+		if err != nil {
+			log.Printf("Modbus: failed to read valve state: %v", err)
+			return nil, exDeviceFailure
+		}
+		var set bool
+		if fc == fcReadCoils {
+			set = ok && (state == valveOpen || state == valveOpening)
+		} else {
+			set = ok && state == valveError
+		}
+		if set {
+			resp[1+i/8] |= 1 << (i % 8)
+		}
+	}
+	return resp, 0
+}
+
+// readRegisters serves input and holding registers, which hold the same data
+func (s *Server) readRegisters(fc byte, data []byte) ([]byte, byte) {
+	if len(data) != 4 {
+		return nil, exIllegalValue
+	}
+	start := int(binary.BigEndian.Uint16(data[0:2]))
+	count := int(binary.BigEndian.Uint16(data[2:4]))
+	if count < 1 || count > 125 {
+		return nil, exIllegalValue
+	}
+	if start+count > regEnd {
+		return nil, exIllegalAddress
+	}
+
+	meters := make(map[int][2]uint32) // Meter index -> flow, total
+	resp := make([]byte, 1+2*count)
+	resp[0] = byte(2 * count)
+	for i := 0; i < count; i++ {
+		value, err := s.register(start+i, meters)
+		if err != nil {
+			log.Printf("Modbus: failed to read register %d: %v", start+i, err)
+			return nil, exDeviceFailure
+		}
+		binary.BigEndian.PutUint16(resp[1+2*i:], value)
+	}
+	return resp, 0
+}
+
+// register returns the value of one register. Meter readings are cached in
+// meters so both words of a value come from the same reading.
+func (s *Server) register(addr int, meters map[int][2]uint32) (uint16, error) {
+	switch {
+	case addr < RegMoisture:
+		i := addr - RegValveState
+		if i >= len(s.config.Valves) {
+			return Unknown, nil
+		}
+		state, ok, err := s.source.ValveState(s.config.Valves[i])
+		if err != nil || !ok {
+			return Unknown, err
+		}
+		return uint16(state), nil
+
+	case addr < RegFlowRate:
+		i := addr - RegMoisture
+		if i >= len(s.config.Sensors) {
+			return Unknown, nil
+		}
+		percent, ok, err := s.source.SoilMoisture(s.config.Sensors[i])
+		if err != nil || !ok {
+			return Unknown, err
+		}
+		return uint16(percent), nil
+
+	default:
+		block, offset := RegFlowRate, 0
+		if addr >= RegTotal {
+			block, offset = RegTotal, 1
+		}
+		i := (addr - block) / 2
+		if i >= len(s.config.Meters) {
+			return Unknown, nil
+		}
+
+		values, ok := meters[i]
+		if !ok {
+			flow, total, ok, err := s.source.MeterReading(s.config.Meters[i])
+			if err != nil {
+				return Unknown, err
+			}
+			values = [2]uint32{math.MaxUint32, math.MaxUint32}
+			if ok {
+				values = [2]uint32{scaleUint32(float64(flow) * 100), scaleUint32(float64(total))}
+			}
+			meters[i] = values
+		}
+
+		v := values[offset]
+		if (addr-block)%2 == 0 {
+			return uint16(v >> 16), nil
+		}
+		return uint16(v), nil
+	}
+}
+
+// scaleUint32 rounds a non-negative value into a uint32 register pair
+func scaleUint32(v float64) uint32 {
+	if v <= 0 || math.IsNaN(v) {
+		return 0
+	}
+	if v >= math.MaxUint32-1 {
+		return math.MaxUint32 - 1
+	}
+	return uint32(math.Round(v))
+}
+
+func (s *Server) writeCoil(data []byte) ([]byte, byte) {
+	if len(data) != 4 {
+		return nil, exIllegalValue
+	}
+	if s.config.ReadOnly {
+		return nil, exIllegalFunction
+	}
+	addr := int(binary.BigEndian.Uint16(data[0:2]))
+	value := binary.BigEndian.Uint16(data[2:4])
+	if value != 0xFF00 && value != 0x0000 {
+		return nil, exIllegalValue
+	}
+	if addr >= len(s.config.Valves) {
+		return nil, exIllegalAddress
+	}
+
+	if err := s.setValve(addr, value == 0xFF00); err != nil {
+		return nil, exDeviceFailure
+	}
+	return data, 0
+}
+
+func (s *Server) writeCoils(data []byte) ([]byte, byte) {
+	if len(data) < 5 {
+		return nil, exIllegalValue
+	}
+	if s.config.ReadOnly {
+		return nil, exIllegalFunction
+	}
+	start := int(binary.BigEndian.Uint16(data[0:2]))
+	count := int(binary.BigEndian.Uint16(data[2:4]))
+	byteCount := int(data[4])
+	if count < 1 || count > 1968 || byteCount != (count+7)/8 || len(data) != 5+byteCount {
+		return nil, exIllegalValue
+	}
+	if start+count > len(s.config.Valves) {
+		return nil, exIllegalAddress
+	}
+
+	bits := data[5:]
+	for i := 0; i < count; i++ {
+		if err := s.setValve(start+i, bits[i/8]&(1<<(i%8)) != 0); err != nil {
+			return nil, exDeviceFailure
+		}
+	}
+	return data[:4], 0
+}
+
+func (s *Server) setValve(i int, open bool) error {
+	v := s.config.Valves[i]
+	if err := s.source.SetValve(v, open); err != nil {
+		log.Printf("Modbus: failed to set valve %s addr %d: %v", v.ControllerUID, v.Address, err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package modbus
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+type fakeSource struct {
+	valves   map[ValveRef]uint8
+	moisture map[SensorRef]uint8
+	meters   map[string][2]float32
+	writes   []string
+}
+
+func (f *fakeSource) ValveState(v ValveRef) (uint8, bool, error) {
+	state, ok := f.valves[v]
+	return state, ok, nil
+}
+
+func (f *fakeSource) SoilMoisture(s SensorRef) (uint8, bool, error) {
+	percent, ok := f.moisture[s]
+	return percent, ok, nil
+}
+
+func (f *fakeSource) MeterReading(uid string) (float32, float32, bool, error) {
+	m, ok := f.meters[uid]
+	return m[0], m[1], ok, nil
+}
+
+func (f *fakeSource) SetValve(v ValveRef, open bool) error {
+	action := "close"
+	if open {
+		action = "open"
+	}
+	f.writes = append(f.writes, v.ControllerUID+" "+action)
+	return nil
+}
+
+func testServer() (*Server, *fakeSource) {
+	config := DefaultConfig()
+	config.Valves = []ValveRef{{"A", 0}, {"A", 1}, {"B", 0}}
+	config.Sensors = []SensorRef{{"S", 0}, {"S", 1}}
+	config.Meters = []string{"M"}
+
+	source := &fakeSource{
+		valves:   map[ValveRef]uint8{{"A", 0}: 1, {"A", 1}: 0, {"B", 0}: 255},
+		moisture: map[SensorRef]uint8{{"S", 0}: 42},
+		meters:   map[string][2]float32{"M": {12.5, 70000}},
+	}
+	return NewServer(config, source), source
+}
+
+func request(fc byte, words ...uint16) []byte {
+	pdu := []byte{fc}
+	for _, w := range words {
+		pdu = binary.BigEndian.AppendUint16(pdu, w)
+	}
+	return pdu
+}
+
+// TestReadPoints tests coil, discrete input, and register reads
+func TestReadPoints(t *testing.T) {
+	s, _ := testServer()
+
+	tests := []struct {
+		name string
+		req  []byte
+		want []byte
+	}{
+		{"coils report open valves", request(fcReadCoils, 0, 3), []byte{fcReadCoils, 1, 0b001}},
+		{"discrete inputs report errors", request(fcReadDiscreteInputs, 0, 3), []byte{fcReadDiscreteInputs, 1, 0b100}},
+		{"valve state registers", request(fcReadInput, 0, 4), []byte{fcReadInput, 8, 0, 1, 0, 0, 0, 255, 0xFF, 0xFF}},
+		{"moisture with unknown probe", request(fcReadInput, RegMoisture, 2), []byte{fcReadInput, 4, 0, 42, 0xFF, 0xFF}},
+		{"flow as uint32", request(fcReadHolding, RegFlowRate, 2), []byte{fcReadHolding, 4, 0, 0, 0x04, 0xE2}},
+		{"total as uint32", request(fcReadInput, RegTotal, 2), []byte{fcReadInput, 4, 0, 1, 0x11, 0x70}},
+		{"unmapped meter", request(fcReadInput, RegTotal+2, 2), []byte{fcReadInput, 4, 0xFF, 0xFF, 0xFF, 0xFF}},
+		{"coil past last valve", request(fcReadCoils, 2, 2), []byte{fcReadCoils | 0x80, exIllegalAddress}},
+		{"register past map", request(fcReadInput, regEnd-1, 2), []byte{fcReadInput | 0x80, exIllegalAddress}},
+		{"zero count", request(fcReadInput, 0, 0), []byte{fcReadInput | 0x80, exIllegalValue}},
+		{"unsupported function", request(0x06, 0, 1), []byte{0x86, exIllegalFunction}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := s.handle(tt.req); !bytes.Equal(got, tt.want) {
+				t.Errorf("handle = % X, want % X", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestWriteCoils tests valve writes and read-only mode
+func TestWriteCoils(t *testing.T) {
+	s, source := testServer()
+
+	if got := s.handle(request(fcWriteCoil, 1, 0xFF00)); !bytes.Equal(got, request(fcWriteCoil, 1, 0xFF00)) {
+		t.Errorf("write single coil = % X", got)
+	}
+	if got := s.handle(request(fcWriteCoil, 1, 0x1234)); got[0] != fcWriteCoil|0x80 || got[1] != exIllegalValue {
+		t.Errorf("bad coil value = % X, want illegal value", got)
+	}
+
+	multi := append(request(fcWriteCoils, 0, 3), 1, 0b010)
+	if got := s.handle(multi); !bytes.Equal(got, request(fcWriteCoils, 0, 3)) {
+		t.Errorf("write multiple coils = % X", got)
+	}
+
+	want := []string{"A open", "A close", "A open", "B close"}
+	if len(source.writes) != len(want) {
+		t.Fatalf("writes = %v, want %v", source.writes, want)
+	}
+	for i := range want {
+		if source.writes[i] != want[i] {
+			t.Errorf("writes = %v, want %v", source.writes, want)
+			break
+		}
+	}
+
+	s.config.ReadOnly = true
+	source.writes = nil
+	if got := s.handle(request(fcWriteCoil, 0, 0)); got[1] != exIllegalFunction {
+		t.Errorf("read-only write = % X, want illegal function", got)
+	}
+	if len(source.writes) != 0 {
+		t.Errorf("read-only server wrote %v", source.writes)
+	}
+}
+
+// TestServeTCP tests MBAP framing over a real connection
+func TestServeTCP(t *testing.T) {
+	s, _ := testServer()
+	s.config.Listen = "127.0.0.1:0"
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer s.Stop()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	pdu := request(fcReadInput, RegMoisture, 1)
+	frame := []byte{0x12, 0x34, 0, 0, 0, byte(len(pdu) + 1), 7}
+	if _, err := conn.Write(append(frame, pdu...)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	resp := make([]byte, 11)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	want := []byte{0x12, 0x34, 0, 0, 0, 5, 7, fcReadInput, 2, 0, 42}
+	if !bytes.Equal(resp, want) {
+		t.Errorf("response = % X, want % X", resp, want)
+	}
+}
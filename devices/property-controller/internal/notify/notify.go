@@ -0,0 +1,198 @@
+// Package notify delivers alerts straight to the farmer by email, SMS, and
+// webhook, so they arrive even when the AgSys cloud is unreachable.
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Severities, matching the alert severities in storage
+const (
+	SeverityInfo     = "info"
+	SeverityWarning  = "warning"
+	SeverityCritical = "critical"
+)
+
+// severityRank orders severities; unknown severities rank as info
+func severityRank(severity string) int {
+	switch severity {
+	case SeverityCritical:
+		return 2
+	case SeverityWarning:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// Message is an alert to deliver
+type Message struct {
+	Severity  string
+	Type      string // Alert type, e.g. "meter_leak"
+	DeviceUID string
+	Text      string
+	Time      time.Time
+}
+
+// Subject is a one-line summary for email subjects and SMS prefixes
+func (m Message) Subject() string {
+	return fmt.Sprintf("AgSys %s: %s", strings.ToUpper(m.Severity), m.Type)
+}
+
+// Sink delivers messages over one channel
+type Sink interface {
+	Name() string
+	Send(ctx context.Context, m Message) error
+}
+
+// Config selects the sinks and limits how often they are used
+type Config struct {
+	MinSeverity    string        // Least severe alert that is sent
+	RateLimit      int           // Most messages per RateWindow (0 is unlimited)
+	RateWindow     time.Duration // Window the rate limit counts over
+	QuietStartHour int           // Local hour quiet hours start; only critical alerts are sent
+	QuietEndHour   int           // Local hour quiet hours end (exclusive, equal to start disables)
+	Timeout        time.Duration // Per sink delivery timeout
+	SMTP           SMTPConfig
+	Twilio         TwilioConfig
+	Webhook        WebhookConfig
+}
+
+// DefaultConfig returns default notification settings, with no sinks set
+func DefaultConfig() Config {
+	return Config{
+		MinSeverity: SeverityCritical,
+		RateLimit:   10,
+		RateWindow:  1 * time.Hour,
+		Timeout:     30 * time.Second,
+		SMTP:        DefaultSMTPConfig(),
+		Twilio:      DefaultTwilioConfig(),
+	}
+}
+
+// inQuietHours reports whether hour falls in quiet hours, which may wrap
+// past midnight
+func (c Config) inQuietHours(hour int) bool {
+	switch {
+	case c.QuietStartHour == c.QuietEndHour:
+		return false
+	case c.QuietStartHour < c.QuietEndHour:
+		return hour >= c.QuietStartHour && hour < c.QuietEndHour
+	default:
+		return hour >= c.QuietStartHour || hour < c.QuietEndHour
+	}
+}
+
+// sinks returns the sinks that are configured
+func (c Config) sinks() []Sink {
+	var sinks []Sink
+	if c.SMTP.Host != "" && len(c.SMTP.To) > 0 {
+		sinks = append(sinks, NewSMTP(c.SMTP))
+	}
+	if c.Twilio.AccountSID != "" && len(c.Twilio.To) > 0 {
+		sinks = append(sinks, NewTwilio(c.Twilio))
+	}
+	if c.Webhook.URL != "" {
+		sinks = append(sinks, NewWebhook(c.Webhook))
+	}
+	return sinks
+}
+
+// Notifier filters alerts by severity, quiet hours, and rate and sends the
+// rest to every configured sink
+type Notifier struct {
+	mu     sync.Mutex
+	config Config
+	sinks  []Sink
+	sent   []time.Time // Send times within the rate window
+	held   int         // Messages held back by the rate limit since the last send
+	now    func() time.Time
+}
+
+// New creates a notifier
+func New(config Config) *Notifier {
+	return &Notifier{
+		config: config,
+		sinks:  config.sinks(),
+		now:    time.Now,
+	}
+}
+
+// SetConfig replaces the notification settings and sinks
+func (n *Notifier) SetConfig(config Config) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.config = config
+	n.sinks = config.sinks()
+}
+
+// SetSinks replaces the configured sinks, for tests and custom channels
+func (n *Notifier) SetSinks(sinks ...Sink) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.sinks = sinks
+}
+
+// Enabled reports whether any sink is configured
+func (n *Notifier) Enabled() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return len(n.sinks) > 0
+}
+
+// Notify sends a message to every sink unless it is below the minimum
+// severity, falls in quiet hours, or exceeds the rate limit. Messages held
+// back by the rate limit are counted in the next message that is sent.
+func (n *Notifier) Notify(ctx context.Context, m Message) error {
+	n.mu.Lock()
+	cfg, sinks := n.config, n.sinks
+	if len(sinks) == 0 || severityRank(m.Severity) < severityRank(cfg.MinSeverity) {
+		n.mu.Unlock()
+		return nil
+	}
+
+	now := n.now()
+	if m.Severity != SeverityCritical && cfg.inQuietHours(now.Hour()) {
+		n.mu.Unlock()
+		log.Printf("Notification held for quiet hours: %s", m.Text)
+		return nil
+	}
+
+	if cfg.RateLimit > 0 {
+		recent := n.sent[:0]
+		for _, t := range n.sent {
+			if now.Sub(t) < cfg.RateWindow {
+				recent = append(recent, t)
+			}
+		}
+		n.sent = recent
+		if len(n.sent) >= cfg.RateLimit {
+			n.held++
+			n.mu.Unlock()
+			log.Printf("Notification rate limit reached, holding back: %s", m.Text)
+			return nil
+		}
+		n.sent = append(n.sent, now)
+	}
+	if n.held > 0 {
+		m.Text += fmt.Sprintf(" (%d more alerts held back by the rate limit)", n.held)
+		n.held = 0
+	}
+	n.mu.Unlock()
+
+	var errs []error
+	for _, s := range sinks {
+		sendCtx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+		if err := s.Send(sendCtx, m); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", s.Name(), err))
+		}
+		cancel()
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,152 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordSink keeps the messages it is sent
+type recordSink struct {
+	sent []Message
+}
+
+func (r *recordSink) Name() string { return "record" }
+
+func (r *recordSink) Send(ctx context.Context, m Message) error {
+	r.sent = append(r.sent, m)
+	return nil
+}
+
+// TestNotifierFilters tests the severity filter, quiet hours, and rate limit
+func TestNotifierFilters(t *testing.T) {
+	config := DefaultConfig()
+	config.MinSeverity = SeverityWarning
+	config.RateLimit = 2
+	config.QuietStartHour = 22
+	config.QuietEndHour = 6
+
+	n := New(config)
+	sink := &recordSink{}
+	n.SetSinks(sink)
+
+	now := time.Date(2026, 7, 9, 12, 0, 0, 0, time.Local)
+	n.now = func() time.Time { return now }
+	notify := func(severity string) {
+		t.Helper()
+		if err := n.Notify(context.Background(), Message{Severity: severity, Type: "test", Text: severity}); err != nil {
+			t.Fatalf("Notify failed: %v", err)
+		}
+	}
+
+	notify(SeverityInfo)
+	notify(SeverityWarning)
+	if len(sink.sent) != 1 {
+		t.Fatalf("sent %d messages, want only the warning", len(sink.sent))
+	}
+
+	// Only critical alerts get through at night
+	now = time.Date(2026, 7, 9, 23, 0, 0, 0, time.Local)
+	notify(SeverityWarning)
+	notify(SeverityCritical)
+	if len(sink.sent) != 2 || sink.sent[1].Severity != SeverityCritical {
+		t.Fatalf("unexpected messages in quiet hours: %+v", sink.sent)
+	}
+
+	// One more fits in the limit of 2 per hour; the next two are held back
+	// and counted once the window has moved on
+	notify(SeverityCritical)
+	notify(SeverityCritical)
+	notify(SeverityCritical)
+	if len(sink.sent) != 3 {
+		t.Fatalf("sent %d messages, want the rate limit to hold back 2", len(sink.sent))
+	}
+	now = now.Add(2 * time.Hour)
+	notify(SeverityCritical)
+	if len(sink.sent) != 4 || !strings.Contains(sink.sent[3].Text, "2 more alerts") {
+		t.Errorf("held back alerts not counted: %+v", sink.sent)
+	}
+}
+
+// TestInQuietHours tests quiet hours that wrap past midnight
+func TestInQuietHours(t *testing.T) {
+	tests := []struct {
+		start, end, hour int
+		want             bool
+	}{
+		{22, 6, 23, true},
+		{22, 6, 5, true},
+		{22, 6, 6, false},
+		{22, 6, 12, false},
+		{1, 5, 3, true},
+		{1, 5, 5, false},
+		{0, 0, 3, false},
+	}
+
+	for _, tt := range tests {
+		c := Config{QuietStartHour: tt.start, QuietEndHour: tt.end}
+		if got := c.inQuietHours(tt.hour); got != tt.want {
+			t.Errorf("inQuietHours(%d) with %d-%d = %v, want %v", tt.hour, tt.start, tt.end, got, tt.want)
+		}
+	}
+}
+
+// TestHTTPSinks tests the webhook and Twilio request formats
+func TestHTTPSinks(t *testing.T) {
+	var webhook webhookPayload
+	var sms []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/hook":
+			if r.Header.Get("Authorization") != "Bearer token" {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			json.NewDecoder(r.Body).Decode(&webhook)
+		case "/Accounts/AC123/Messages.json":
+			if user, pass, ok := r.BasicAuth(); !ok || user != "AC123" || pass != "secret" {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			r.ParseForm()
+			sms = append(sms, r.PostForm.Get("To")+" "+r.PostForm.Get("Body"))
+			w.WriteHeader(http.StatusCreated)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	m := Message{
+		Severity:  SeverityCritical,
+		Type:      "meter_leak",
+		DeviceUID: "0102030405060708",
+		Text:      "leak detected",
+		Time:      time.Date(2026, 7, 9, 3, 0, 0, 0, time.UTC),
+	}
+
+	hook := NewWebhook(WebhookConfig{URL: srv.URL + "/hook", Headers: map[string]string{"Authorization": "Bearer token"}})
+	if err := hook.Send(context.Background(), m); err != nil {
+		t.Fatalf("webhook Send failed: %v", err)
+	}
+	if webhook.Type != "meter_leak" || webhook.Severity != SeverityCritical || !webhook.Time.Equal(m.Time) {
+		t.Errorf("unexpected webhook payload: %+v", webhook)
+	}
+
+	twilio := NewTwilio(TwilioConfig{AccountSID: "AC123", AuthToken: "secret", From: "+15550000", To: []string{"+15551111", "+15552222"}, URL: srv.URL})
+	if err := twilio.Send(context.Background(), m); err != nil {
+		t.Fatalf("Twilio Send failed: %v", err)
+	}
+	if len(sms) != 2 || sms[0] != "+15551111 AgSys CRITICAL: meter_leak: leak detected" {
+		t.Errorf("unexpected SMS requests: %q", sms)
+	}
+
+	twilio = NewTwilio(TwilioConfig{AccountSID: "AC123", AuthToken: "wrong", To: []string{"+15551111"}, URL: srv.URL})
+	if err := twilio.Send(context.Background(), m); err == nil {
+		t.Error("expected an error for a rejected SMS")
+	}
+}
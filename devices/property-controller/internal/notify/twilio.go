@@ -0,0 +1,74 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// TwilioConfig selects the Twilio account and phone numbers for SMS alerts
+type TwilioConfig struct {
+	AccountSID string // Empty disables SMS
+	AuthToken  string
+	From       string   // Twilio number, E.164
+	To         []string // Recipient numbers, E.164
+	URL        string   // API base URL
+}
+
+// DefaultTwilioConfig returns default Twilio settings
+func DefaultTwilioConfig() TwilioConfig {
+	return TwilioConfig{
+		URL: "https://api.twilio.com/2010-04-01",
+	}
+}
+
+// maxSMSLength keeps messages to at most three SMS segments
+const maxSMSLength = 459
+
+// Twilio sends alerts by SMS through the Twilio Messages API
+type Twilio struct {
+	config TwilioConfig
+	client *http.Client
+}
+
+// NewTwilio creates an SMS sink
+func NewTwilio(config TwilioConfig) *Twilio {
+	return &Twilio{
+		config: config,
+		client: &http.Client{},
+	}
+}
+
+// Name returns "twilio"
+func (t *Twilio) Name() string { return "twilio" }
+
+// Send texts a message to every recipient
+func (t *Twilio) Send(ctx context.Context, m Message) error {
+	body := m.Subject() + ": " + m.Text
+	if len(body) > maxSMSLength {
+		body = body[:maxSMSLength-3] + "..."
+	}
+	endpoint := fmt.Sprintf("%s/Accounts/%s/Messages.json", t.config.URL, url.PathEscape(t.config.AccountSID))
+
+	for _, to := range t.config.To {
+		form := url.Values{"From": {t.config.From}, "To": {to}, "Body": {body}}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(t.config.AccountSID, t.config.AuthToken)
+
+		resp, err := t.client.Do(req)
+		if err != nil {
+			return fmt.Errorf("failed to send SMS to %s: %w", to, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("SMS to %s failed: %s", to, resp.Status)
+		}
+	}
+	return nil
+}
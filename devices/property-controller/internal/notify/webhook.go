@@ -0,0 +1,77 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// WebhookConfig selects the URL alerts are posted to
+type WebhookConfig struct {
+	URL     string            // Empty disables the webhook
+	Headers map[string]string // Extra request headers, e.g. Authorization
+}
+
+// webhookPayload is the JSON body posted for each alert
+type webhookPayload struct {
+	Severity  string    `json:"severity"`
+	Type      string    `json:"type"`
+	DeviceUID string    `json:"device_uid"`
+	Subject   string    `json:"subject"`
+	Text      string    `json:"text"`
+	Time      time.Time `json:"time"`
+}
+
+// Webhook posts alerts as JSON to an HTTP endpoint
+type Webhook struct {
+	config WebhookConfig
+	client *http.Client
+}
+
+// NewWebhook creates a webhook sink
+func NewWebhook(config WebhookConfig) *Webhook {
+	return &Webhook{
+		config: config,
+		client: &http.Client{},
+	}
+}
+
+// Name returns "webhook"
+func (w *Webhook) Name() string { return "webhook" }
+
+// Send posts a message to the webhook URL
+func (w *Webhook) Send(ctx context.Context, m Message) error {
+	body, err := json.Marshal(webhookPayload{
+		Severity:  m.Severity,
+		Type:      m.Type,
+		DeviceUID: m.DeviceUID,
+		Subject:   m.Subject(),
+		Text:      m.Text,
+		Time:      m.Time.UTC(),
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range w.config.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to post webhook: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook failed: %s", resp.Status)
+	}
+	return nil
+}
@@ -22,6 +22,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/agsys/property-controller/internal/protocol"
 	"github.com/ccroswhite/agsys-api/pkg/lora"
 )
 
@@ -32,6 +33,10 @@ type Config struct {
 	ChunkTimeout     time.Duration // Timeout waiting for chunk ACK
 	MaxRetries       int           // Max retries per chunk
 	AnnounceInterval time.Duration // How often to re-announce available updates
+	WindowSize       uint8         // Chunks in flight for devices that report a received bitmap, 0 to disable
+	MulticastPacing  time.Duration // Time between chunks broadcast to a multicast session
+	AirtimeBudget    float64       // Fraction of downlink airtime chunks may use, 0 for no limit
+	AirtimeWindow    time.Duration // Period the airtime budget is measured over
 }
 
 // DefaultConfig returns default OTA configuration
@@ -42,6 +47,10 @@ func DefaultConfig() Config {
 		ChunkTimeout:     10 * time.Second,
 		MaxRetries:       5,
 		AnnounceInterval: 30 * time.Second,
+		WindowSize:       8,
+		MulticastPacing:  2 * time.Second,
+		AirtimeBudget:    0.2,
+		AirtimeWindow:    time.Minute,
 	}
 }
 
@@ -57,8 +66,39 @@ const (
 	StateComplete                       // Update successful
 	StateFailed                         // Update failed
 	StateRolledBack                     // Device rolled back
+	StateCancelled                      // Update cancelled by operator
 )
 
+func (s DeviceUpdateState) String() string {
+	switch s {
+	case StateIdle:
+		return "idle"
+	case StatePending:
+		return "pending"
+	case StateRequested:
+		return "requested"
+	case StateTransferring:
+		return "transferring"
+	case StateVerifying:
+		return "verifying"
+	case StateComplete:
+		return "complete"
+	case StateFailed:
+		return "failed"
+	case StateRolledBack:
+		return "rolled_back"
+	case StateCancelled:
+		return "cancelled"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(s))
+	}
+}
+
+// IsActive returns true if the update is in progress on the device
+func (s DeviceUpdateState) IsActive() bool {
+	return s == StateRequested || s == StateTransferring || s == StateVerifying
+}
+
 // DeviceUpdate tracks update progress for a single device
 type DeviceUpdate struct {
 	DeviceUID      string
@@ -75,6 +115,13 @@ type DeviceUpdate struct {
 	ErrorMessage   string
 	StartedAt      time.Time
 	CompletedAt    time.Time
+	WindowSize     uint8 // Chunks in flight, 0 for one chunk at a time
+
+	// Chunks the device has reported in windowed transfers
+	received []bool
+
+	// Multicast session the device joined, if any
+	session *MulticastSession
 }
 
 // Version represents a firmware version
@@ -88,6 +135,16 @@ func (v Version) String() string {
 	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
 }
 
+// ParseVersion parses a "major.minor.patch" version
+func ParseVersion(s string) (Version, error) {
+	var v Version
+	var rest string
+	if n, _ := fmt.Sscanf(s, "%d.%d.%d%s", &v.Major, &v.Minor, &v.Patch, &rest); n != 3 {
+		return Version{}, fmt.Errorf("invalid firmware version %q", s)
+	}
+	return v, nil
+}
+
 // FirmwareInfo describes a cached firmware file
 type FirmwareInfo struct {
 	DeviceType    uint8
@@ -119,8 +176,22 @@ type Manager struct {
 	// Devices pending update (need OTA_PENDING flag in ACK)
 	pendingDevices map[string]bool
 
-	// Cloud client for downloading firmware
+	// Cloud client for downloading firmware, and whether it may download now
 	cloudDownloader FirmwareDownloader
+	downloadAllowed func() bool
+
+	// Called with a copy of an update whenever it changes
+	onUpdate func(DeviceUpdate)
+
+	// Latest multicast session, kept after it ends for status
+	multicast     *MulticastSession
+	lastSessionID uint8
+
+	// Chunk airtime budget and the updates with chunks held to it
+	airtimeFunc AirtimeFunc
+	busyFunc    func() bool
+	airtime     airtimeBudget
+	held        map[string]int
 
 	stopChan chan struct{}
 	wg       sync.WaitGroup
@@ -148,6 +219,7 @@ func New(config Config, sendFunc SendFunc, downloader FirmwareDownloader) (*Mana
 		updates:         make(map[string]*DeviceUpdate),
 		pendingDevices:  make(map[string]bool),
 		cloudDownloader: downloader,
+		held:            make(map[string]int),
 		stopChan:        make(chan struct{}),
 	}, nil
 }
@@ -177,14 +249,41 @@ func (m *Manager) Stop() {
 	log.Println("OTA manager stopped")
 }
 
+// SetUpdateCallback sets the callback invoked with a copy of a device's
+// update whenever its progress changes, e.g. to persist it. It is called with
+// the manager locked, so it must not call back into the manager.
+func (m *Manager) SetUpdateCallback(cb func(DeviceUpdate)) {
+	m.mu.Lock()
+	m.onUpdate = cb
+	m.mu.Unlock()
+}
+
+// SetDownloadAllowedFunc sets the function reporting whether firmware may be
+// downloaded now. A new image found outside the allowed time is downloaded
+// by a later hourly check.
+func (m *Manager) SetDownloadAllowedFunc(fn func() bool) {
+	m.mu.Lock()
+	m.downloadAllowed = fn
+	m.mu.Unlock()
+}
+
+// changed reports an update to the update callback. Callers hold m.mu.
+func (m *Manager) changed(update *DeviceUpdate) {
+	if m.onUpdate != nil {
+		m.onUpdate(*update)
+	}
+}
+
 // ShouldSetOTAPending returns true if the device should receive OTA_PENDING flag
 func (m *Manager) ShouldSetOTAPending(deviceUID string, deviceType uint8, currentVersion Version) bool {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
 	// Check if device is already in an active update
-	if update, exists := m.updates[deviceUID]; exists {
-		if update.State != StateIdle && update.State != StateComplete && update.State != StateFailed {
+	update, hasUpdate := m.updates[deviceUID]
+	if hasUpdate {
+		if update.State != StateIdle && update.State != StateComplete && update.State != StateFailed &&
+			update.State != StateCancelled {
 			return false // Already updating
 		}
 	}
@@ -195,12 +294,28 @@ func (m *Manager) ShouldSetOTAPending(deviceUID string, deviceType uint8, curren
 		return false
 	}
 
+	// Don't re-offer a version the operator cancelled
+	if hasUpdate && update.State == StateCancelled && update.TargetVersion == fw.Version {
+		return false
+	}
+
 	// Compare versions
 	if isNewerVersion(fw.Version, currentVersion) {
 		// Mark device as pending
 		m.mu.RUnlock()
 		m.mu.Lock()
-		m.pendingDevices[deviceUID] = true
+		if !m.pendingDevices[deviceUID] {
+			m.pendingDevices[deviceUID] = true
+			m.changed(&DeviceUpdate{
+				DeviceUID:      deviceUID,
+				DeviceType:     deviceType,
+				CurrentVersion: currentVersion,
+				TargetVersion:  fw.Version,
+				State:          StatePending,
+				TotalChunks:    fw.ChunkCount,
+				LastActivity:   time.Now(),
+			})
+		}
 		m.mu.Unlock()
 		m.mu.RLock()
 		return true
@@ -236,7 +351,16 @@ func (m *Manager) HandleOTARequest(deviceUID string, deviceType uint8, payload [
 		LastActivity:   time.Now(),
 		StartedAt:      time.Now(),
 	}
+	// Devices that report a received bitmap get several chunks at a time
+	if caps, window := protocol.OTACapabilities(payload); caps&protocol.OTACapWindowed != 0 && m.config.WindowSize > 0 {
+		update.WindowSize = min(m.config.WindowSize, protocol.MaxOTAWindow)
+		if window > 0 {
+			update.WindowSize = min(update.WindowSize, window)
+		}
+		update.received = make([]bool, fw.ChunkCount)
+	}
 	m.updates[deviceUID] = update
+	m.changed(update)
 
 	// Remove from pending
 	delete(m.pendingDevices, deviceUID)
@@ -261,17 +385,69 @@ func (m *Manager) HandleOTAReady(deviceUID string, payload []byte) error {
 		m.mu.Unlock()
 		return fmt.Errorf("no active update for device %s", deviceUID)
 	}
+	if update.State == StateCancelled {
+		m.mu.Unlock()
+		return fmt.Errorf("update for device %s was cancelled", deviceUID)
+	}
 
 	update.State = StateTransferring
 	update.ChunksSent = ready.StartChunk
 	update.ChunksAcked = ready.StartChunk
 	update.LastActivity = time.Now()
+	windowed := update.WindowSize > 0
+	if windowed {
+		// Chunks before the resume point are already on the device
+		for i := 0; i < int(ready.StartChunk) && i < len(update.received); i++ {
+			update.received[i] = true
+		}
+	}
+	m.changed(update)
 	m.mu.Unlock()
 
 	log.Printf("OTA: Device %s ready, starting from chunk %d", deviceUID, ready.StartChunk)
 
 	// Start sending chunks
-	return m.sendNextChunk(deviceUID)
+	m.continueTransfer(deviceUID, windowed)
+	return nil
+}
+
+// HandleOTABitmap processes the chunks a device reports receiving during a
+// windowed transfer, and sends the next window with any gaps retransmitted
+func (m *Manager) HandleOTABitmap(deviceUID string, payload []byte) error {
+	bitmap, err := protocol.DecodeOTABitmap(payload)
+	if err != nil {
+		return fmt.Errorf("failed to decode OTA bitmap: %w", err)
+	}
+
+	m.mu.Lock()
+	update, exists := m.updates[deviceUID]
+	if !exists || update.WindowSize == 0 {
+		m.mu.Unlock()
+		return fmt.Errorf("no windowed update for device %s", deviceUID)
+	}
+	if update.State != StateTransferring {
+		m.mu.Unlock()
+		return nil
+	}
+
+	// Devices report from their first missing chunk
+	for i := 0; i < int(bitmap.BaseChunk) && i < len(update.received); i++ {
+		update.received[i] = true
+	}
+	for i := 0; i < int(bitmap.Count); i++ {
+		chunk := int(bitmap.BaseChunk) + i
+		if chunk < len(update.received) && bitmap.Received(i) {
+			update.received[chunk] = true
+		}
+	}
+	update.ChunksAcked = countReceived(update.received)
+	update.RetryCount = 0
+	update.LastActivity = time.Now()
+	m.changed(update)
+	m.mu.Unlock()
+
+	m.continueTransfer(deviceUID, true)
+	return nil
 }
 
 // HandleOTAStatus processes an OTA status message from a device
@@ -319,7 +495,15 @@ func (m *Manager) HandleOTAStatus(deviceUID string, payload []byte) error {
 	case lora.OTAStatusInProgress:
 		log.Printf("OTA: Device %s progress: %d/%d chunks",
 			deviceUID, status.ChunksReceived, update.TotalChunks)
+
+		// The device has everything sent so far, so send the next chunk
+		// (or the finish once all chunks are out)
+		if update.State == StateTransferring && update.WindowSize == 0 && status.ChunksReceived == update.ChunksSent {
+			update.RetryCount = 0
+			m.continueTransfer(deviceUID, false)
+		}
 	}
+	m.changed(update)
 
 	return nil
 }
@@ -345,6 +529,20 @@ func (m *Manager) sendAnnounce(deviceUID string, fw *FirmwareInfo) error {
 	return m.sendFunc(uid, lora.MsgTypeOTAAnnounce, announce.Encode())
 }
 
+// continueTransfer sends a device its next chunk or window in the
+// background, as chunks may be held for the airtime budget
+func (m *Manager) continueTransfer(deviceUID string, windowed bool) {
+	go func() {
+		send := m.sendNextChunk
+		if windowed {
+			send = m.sendWindow
+		}
+		if err := send(deviceUID); err != nil && err != errStopped {
+			log.Printf("OTA: Failed to send chunks to %s: %v", deviceUID, err)
+		}
+	}()
+}
+
 // sendNextChunk sends the next firmware chunk to a device
 func (m *Manager) sendNextChunk(deviceUID string) error {
 	m.mu.RLock()
@@ -385,13 +583,77 @@ func (m *Manager) sendNextChunk(deviceUID string) error {
 		return err
 	}
 
-	if err := m.sendFunc(uid, lora.MsgTypeOTAChunk, chunk.Encode()); err != nil {
+	if err := m.sendChunk(deviceUID, uid, lora.MsgTypeOTAChunk, chunk.Encode()); err != nil {
 		return err
 	}
 
 	m.mu.Lock()
 	update.ChunksSent = chunkIndex + 1
 	update.LastActivity = time.Now()
+	m.changed(update)
+	m.mu.Unlock()
+
+	return nil
+}
+
+// sendWindow sends the chunks of the window starting at the first chunk the
+// device is missing, skipping those it has reported. Once it has them all the
+// finish is sent.
+func (m *Manager) sendWindow(deviceUID string) error {
+	m.mu.Lock()
+	update, exists := m.updates[deviceUID]
+	if !exists {
+		m.mu.Unlock()
+		return fmt.Errorf("no active update for device %s", deviceUID)
+	}
+	fw, exists := m.firmware[update.DeviceType]
+	if !exists {
+		m.mu.Unlock()
+		return fmt.Errorf("firmware not found for device type %d", update.DeviceType)
+	}
+
+	base := 0
+	for base < len(update.received) && update.received[base] {
+		base++
+	}
+	if base >= len(update.received) {
+		m.mu.Unlock()
+		return m.sendFinish(deviceUID, fw)
+	}
+
+	var chunks []uint16
+	end := min(base+int(update.WindowSize), len(update.received))
+	for i := base; i < end; i++ {
+		if !update.received[i] {
+			chunks = append(chunks, uint16(i))
+		}
+	}
+	m.mu.Unlock()
+
+	uid, err := parseDeviceUID(deviceUID)
+	if err != nil {
+		return err
+	}
+
+	for _, chunkIndex := range chunks {
+		chunkData, err := m.readChunk(fw, chunkIndex)
+		if err != nil {
+			return fmt.Errorf("failed to read chunk %d: %w", chunkIndex, err)
+		}
+		chunk := &lora.OTAChunkPayload{
+			ChunkIndex: chunkIndex,
+			ChunkSize:  uint16(len(chunkData)),
+			Data:       chunkData,
+		}
+		if err := m.sendChunk(deviceUID, uid, lora.MsgTypeOTAChunk, chunk.Encode()); err != nil {
+			return err
+		}
+	}
+
+	m.mu.Lock()
+	update.ChunksSent = max(update.ChunksSent, uint16(end))
+	update.LastActivity = time.Now()
+	m.changed(update)
 	m.mu.Unlock()
 
 	return nil
@@ -413,6 +675,7 @@ func (m *Manager) sendFinish(deviceUID string, fw *FirmwareInfo) error {
 	if update, exists := m.updates[deviceUID]; exists {
 		update.State = StateVerifying
 		update.LastActivity = time.Now()
+		m.changed(update)
 	}
 	m.mu.Unlock()
 
@@ -584,7 +847,14 @@ func (m *Manager) syncFirmwareFromCloud(ctx context.Context) {
 			continue // Already have latest
 		}
 
-		// Download new firmware
+		// Download new firmware, unless downloads are deferred
+		m.mu.RLock()
+		allowed := m.downloadAllowed
+		m.mu.RUnlock()
+		if allowed != nil && !allowed() {
+			log.Printf("OTA: Deferring download of firmware for type %d v%s", dt, info.Version)
+			continue
+		}
 		filename := fmt.Sprintf("%d_%d.%d.%d.bin", dt, info.Version.Major, info.Version.Minor, info.Version.Patch)
 		destPath := filepath.Join(m.config.FirmwareCacheDir, filename)
 
@@ -635,27 +905,39 @@ func (m *Manager) checkUpdateTimeouts() {
 	defer m.mu.Unlock()
 
 	now := time.Now()
+	defer m.checkMulticast(now)
 
 	for deviceUID, update := range m.updates {
-		if update.State == StateComplete || update.State == StateFailed || update.State == StateRolledBack {
+		if update.State == StateComplete || update.State == StateFailed || update.State == StateRolledBack ||
+			update.State == StateCancelled {
+			continue
+		}
+		if update.inBroadcast() || m.held[deviceUID] > 0 {
 			continue
 		}
 
-		if now.Sub(update.LastActivity) > m.config.ChunkTimeout {
+		// A window takes longer to deliver than a single chunk
+		timeout := m.config.ChunkTimeout * time.Duration(max(1, update.WindowSize))
+		if now.Sub(update.LastActivity) > timeout {
 			update.RetryCount++
 
 			if update.RetryCount > m.config.MaxRetries {
 				update.State = StateFailed
 				update.ErrorMessage = "timeout"
+				m.changed(update)
 				log.Printf("OTA: Device %s update timed out after %d retries", deviceUID, m.config.MaxRetries)
 				continue
 			}
+			m.changed(update)
 
-			// Retry last chunk
-			if update.State == StateTransferring {
+			// Resend the window's missing chunks, or the last chunk
+			if update.State == StateTransferring && update.WindowSize > 0 {
+				log.Printf("OTA: Resending window at chunk %d for %s (attempt %d)", update.ChunksAcked, deviceUID, update.RetryCount)
+				m.continueTransfer(deviceUID, true)
+			} else if update.State == StateTransferring {
 				log.Printf("OTA: Retrying chunk %d for %s (attempt %d)", update.ChunksSent-1, deviceUID, update.RetryCount)
 				update.ChunksSent-- // Will resend
-				go m.sendNextChunk(deviceUID)
+				m.continueTransfer(deviceUID, false)
 			}
 		}
 	}
@@ -685,8 +967,111 @@ func (m *Manager) GetPendingDevices() []string {
 	return result
 }
 
+// IsPending returns true if the device has been marked for an update
+func (m *Manager) IsPending(deviceUID string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.pendingDevices[deviceUID]
+}
+
+// StartUpdate marks a device for update so OTA_PENDING is set on its next ACK
+func (m *Manager) StartUpdate(deviceUID string, deviceType uint8) error {
+	if _, err := parseDeviceUID(deviceUID); err != nil {
+		return fmt.Errorf("invalid device UID: %w", err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fw, exists := m.firmware[deviceType]
+	if !exists {
+		return fmt.Errorf("no firmware available for device type %d", deviceType)
+	}
+
+	if update, exists := m.updates[deviceUID]; exists {
+		if update.State.IsActive() {
+			return fmt.Errorf("update already in progress for device %s", deviceUID)
+		}
+		delete(m.updates, deviceUID)
+	}
+
+	m.pendingDevices[deviceUID] = true
+	// Not kept in updates, where a pending state would block the offer
+	m.changed(&DeviceUpdate{
+		DeviceUID:     deviceUID,
+		DeviceType:    deviceType,
+		TargetVersion: fw.Version,
+		State:         StatePending,
+		TotalChunks:   fw.ChunkCount,
+		LastActivity:  time.Now(),
+	})
+	log.Printf("OTA: Update queued for device %s", deviceUID)
+	return nil
+}
+
+// CancelUpdate cancels a pending or in-progress update for a device
+func (m *Manager) CancelUpdate(deviceUID string, deviceType uint8) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	wasPending := m.pendingDevices[deviceUID]
+	delete(m.pendingDevices, deviceUID)
+
+	update, exists := m.updates[deviceUID]
+	if exists && (update.State.IsActive() || update.State == StatePending) {
+		update.State = StateCancelled
+		update.ErrorMessage = "cancelled"
+		update.CompletedAt = time.Now()
+		m.changed(update)
+		log.Printf("OTA: Update for device %s cancelled", deviceUID)
+		return nil
+	}
+
+	if !wasPending {
+		return fmt.Errorf("no pending or active update for device %s", deviceUID)
+	}
+
+	// Record the cancellation so the same version isn't re-offered
+	update = &DeviceUpdate{
+		DeviceUID:    deviceUID,
+		DeviceType:   deviceType,
+		State:        StateCancelled,
+		ErrorMessage: "cancelled",
+		CompletedAt:  time.Now(),
+	}
+	if fw, ok := m.firmware[deviceType]; ok {
+		update.TargetVersion = fw.Version
+	}
+	m.updates[deviceUID] = update
+	m.changed(update)
+	log.Printf("OTA: Pending update for device %s cancelled", deviceUID)
+	return nil
+}
+
+// ListFirmware returns the cached firmware images
+func (m *Manager) ListFirmware() []*FirmwareInfo {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	result := make([]*FirmwareInfo, 0, len(m.firmware))
+	for _, fw := range m.firmware {
+		result = append(result, fw)
+	}
+	return result
+}
+
 // Helper functions
 
+func countReceived(received []bool) uint16 {
+	var n uint16
+	for _, r := range received {
+		if r {
+			n++
+		}
+	}
+	return n
+}
+
 func isNewerVersion(a, b Version) bool {
 	if a.Major != b.Major {
 		return a.Major > b.Major
@@ -0,0 +1,286 @@
+package ota
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"slices"
+	"time"
+
+	"github.com/agsys/property-controller/internal/protocol"
+)
+
+// broadcastUID addresses every device
+var broadcastUID = [8]byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+
+// MulticastState tracks the phase of a multicast session
+type MulticastState int
+
+const (
+	MulticastListening    MulticastState = iota // Announced, devices joining
+	MulticastBroadcasting                       // Sending each chunk once to all members
+	MulticastRepairing                          // Unicasting the chunks each member missed
+	MulticastComplete                           // Every member has finished
+)
+
+func (s MulticastState) String() string {
+	switch s {
+	case MulticastListening:
+		return "listening"
+	case MulticastBroadcasting:
+		return "broadcasting"
+	case MulticastRepairing:
+		return "repairing"
+	case MulticastComplete:
+		return "complete"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(s))
+	}
+}
+
+// MulticastSession updates every listening device of one type with a single
+// broadcast of the firmware. Devices join during the listen window; after
+// the broadcast each member reports the chunks it missed as a received
+// bitmap and gets them in windowed unicast repair rounds.
+type MulticastSession struct {
+	ID            uint8
+	DeviceType    uint8
+	TargetVersion Version
+	State         MulticastState
+	Members       []string
+	ChunksSent    uint16 // Chunks broadcast so far
+	TotalChunks   uint16
+	StartedAt     time.Time
+	ListenUntil   time.Time
+	CompletedAt   time.Time
+}
+
+// StartMulticast announces a multicast session for a device type. Devices
+// that join within the listen window are updated together.
+func (m *Manager) StartMulticast(deviceType uint8, listen time.Duration) (*MulticastSession, error) {
+	if listen <= 0 || listen > math.MaxUint16*time.Second {
+		return nil, fmt.Errorf("invalid listen window %s", listen)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if s := m.multicast; s != nil && s.State != MulticastComplete {
+		return nil, fmt.Errorf("multicast session %d is still %s", s.ID, s.State)
+	}
+	fw, exists := m.firmware[deviceType]
+	if !exists {
+		return nil, fmt.Errorf("no firmware available for device type %d", deviceType)
+	}
+
+	m.lastSessionID++
+	now := time.Now()
+	session := &MulticastSession{
+		ID:            m.lastSessionID,
+		DeviceType:    deviceType,
+		TargetVersion: fw.Version,
+		State:         MulticastListening,
+		TotalChunks:   fw.ChunkCount,
+		StartedAt:     now,
+		ListenUntil:   now.Add(listen),
+	}
+
+	announce := &protocol.OTASessionPayload{
+		SessionID:       session.ID,
+		DeviceType:      deviceType,
+		VersionMajor:    fw.Version.Major,
+		VersionMinor:    fw.Version.Minor,
+		VersionPatch:    fw.Version.Patch,
+		HWRevisionMin:   fw.HWRevisionMin,
+		FirmwareSize:    fw.Size,
+		ChunkCount:      fw.ChunkCount,
+		ChunkSize:       fw.ChunkSize,
+		FirmwareCRC:     fw.CRC32,
+		ListenSec:       uint16(listen / time.Second),
+		ChunkIntervalMs: uint16(min(m.config.MulticastPacing.Milliseconds(), math.MaxUint16)),
+	}
+	if err := m.sendFunc(broadcastUID, protocol.MsgTypeOTASession, announce.Encode()); err != nil {
+		return nil, fmt.Errorf("failed to announce multicast session: %w", err)
+	}
+	m.multicast = session
+
+	m.wg.Add(1)
+	go m.runMulticast(session, fw)
+
+	log.Printf("OTA: Multicast session %d announced for device type %d v%s, listening for %s",
+		session.ID, deviceType, fw.Version, listen)
+	return session.copy(), nil
+}
+
+// HandleOTAJoin adds a device to the multicast session it is joining
+func (m *Manager) HandleOTAJoin(deviceUID string, deviceType uint8, payload []byte) error {
+	join, err := protocol.DecodeOTAJoin(payload)
+	if err != nil {
+		return fmt.Errorf("failed to decode OTA join: %w", err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session := m.multicast
+	if session == nil || session.ID != join.SessionID || session.State != MulticastListening {
+		return fmt.Errorf("multicast session %d is not accepting devices", join.SessionID)
+	}
+	if deviceType != session.DeviceType {
+		return fmt.Errorf("device type %d can't join session %d for type %d", deviceType, session.ID, session.DeviceType)
+	}
+	fw, exists := m.firmware[deviceType]
+	if !exists {
+		return fmt.Errorf("no firmware available for device type %d", deviceType)
+	}
+	if join.HWRevision < fw.HWRevisionMin {
+		return fmt.Errorf("device %s hardware revision %d is below the minimum %d", deviceUID, join.HWRevision, fw.HWRevisionMin)
+	}
+	if update, exists := m.updates[deviceUID]; exists && update.State.IsActive() {
+		return fmt.Errorf("update already in progress for device %s", deviceUID)
+	}
+
+	// Repairs always use windowed transfers
+	window := min(max(m.config.WindowSize, 1), protocol.MaxOTAWindow)
+	if join.MaxWindow > 0 {
+		window = min(window, join.MaxWindow)
+	}
+	update := &DeviceUpdate{
+		DeviceUID:      deviceUID,
+		DeviceType:     deviceType,
+		CurrentVersion: Version{join.CurrentMajor, join.CurrentMinor, join.CurrentPatch},
+		TargetVersion:  fw.Version,
+		State:          StateRequested,
+		TotalChunks:    fw.ChunkCount,
+		LastActivity:   time.Now(),
+		StartedAt:      time.Now(),
+		WindowSize:     window,
+		received:       make([]bool, fw.ChunkCount),
+		session:        session,
+	}
+	m.updates[deviceUID] = update
+	delete(m.pendingDevices, deviceUID)
+	if !slices.Contains(session.Members, deviceUID) {
+		session.Members = append(session.Members, deviceUID)
+	}
+	m.changed(update)
+
+	log.Printf("OTA: Device %s joined multicast session %d from v%s", deviceUID, session.ID, update.CurrentVersion)
+	return nil
+}
+
+// MulticastStatus returns the latest multicast session, or nil if there
+// hasn't been one
+func (m *Manager) MulticastStatus() *MulticastSession {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.multicast == nil {
+		return nil
+	}
+	return m.multicast.copy()
+}
+
+// runMulticast waits out the listen window, broadcasts every chunk once, and
+// hands the members over to repair
+func (m *Manager) runMulticast(session *MulticastSession, fw *FirmwareInfo) {
+	defer m.wg.Done()
+
+	listen := time.NewTimer(time.Until(session.ListenUntil))
+	defer listen.Stop()
+	select {
+	case <-m.stopChan:
+		return
+	case <-listen.C:
+	}
+
+	m.mu.Lock()
+	if len(session.Members) == 0 {
+		session.State = MulticastComplete
+		session.CompletedAt = time.Now()
+		m.mu.Unlock()
+		log.Printf("OTA: No devices joined multicast session %d", session.ID)
+		return
+	}
+	session.State = MulticastBroadcasting
+	m.mu.Unlock()
+
+	log.Printf("OTA: Broadcasting %d chunks to %d devices in session %d",
+		fw.ChunkCount, len(session.Members), session.ID)
+
+	pacing := time.NewTicker(m.config.MulticastPacing)
+	defer pacing.Stop()
+
+	for i := uint16(0); i < fw.ChunkCount; i++ {
+		if i > 0 {
+			select {
+			case <-m.stopChan:
+				return
+			case <-pacing.C:
+			}
+		}
+
+		// Chunks lost here are recovered in the repair rounds
+		data, err := m.readChunk(fw, i)
+		if err != nil {
+			log.Printf("OTA: Failed to read chunk %d for session %d: %v", i, session.ID, err)
+		} else {
+			chunk := &protocol.OTAMulticastChunkPayload{SessionID: session.ID, ChunkIndex: i, Data: data}
+			if err := m.sendChunk("", broadcastUID, protocol.MsgTypeOTAMulticastChunk, chunk.Encode()); err == errStopped {
+				return
+			} else if err != nil {
+				log.Printf("OTA: Failed to broadcast chunk %d for session %d: %v", i, session.ID, err)
+			}
+		}
+
+		m.mu.Lock()
+		session.ChunksSent = i + 1
+		m.mu.Unlock()
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session.State = MulticastRepairing
+	now := time.Now()
+	for _, uid := range session.Members {
+		update, exists := m.updates[uid]
+		if !exists || update.session != session || update.State != StateRequested {
+			continue // Cancelled or restarted during the broadcast
+		}
+		update.State = StateTransferring
+		update.ChunksSent = update.TotalChunks
+		update.LastActivity = now
+		m.changed(update)
+	}
+	log.Printf("OTA: Multicast session %d broadcast done, repairing", session.ID)
+}
+
+// checkMulticast completes the session once no member is still updating.
+// Callers hold m.mu.
+func (m *Manager) checkMulticast(now time.Time) {
+	session := m.multicast
+	if session == nil || session.State != MulticastRepairing {
+		return
+	}
+	for _, uid := range session.Members {
+		if update, exists := m.updates[uid]; exists && update.session == session && update.State.IsActive() {
+			return
+		}
+	}
+	session.State = MulticastComplete
+	session.CompletedAt = now
+	log.Printf("OTA: Multicast session %d complete", session.ID)
+}
+
+// inBroadcast reports whether an update is waiting on its session's
+// broadcast rather than its own transfer
+func (u *DeviceUpdate) inBroadcast() bool {
+	return u.session != nil && (u.session.State == MulticastListening || u.session.State == MulticastBroadcasting)
+}
+
+// copy returns a snapshot of the session. Callers hold m.mu.
+func (s *MulticastSession) copy() *MulticastSession {
+	c := *s
+	c.Members = slices.Clone(s.Members)
+	return &c
+}
@@ -0,0 +1,132 @@
+package ota
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// throttlePoll is how often a held chunk rechecks the budget
+const throttlePoll = time.Second
+
+// errStopped aborts a held send when the manager stops
+var errStopped = errors.New("OTA manager stopped")
+
+// AirtimeFunc estimates how long a downlink with a payload of payloadLen
+// bytes to a device is on the air
+type AirtimeFunc func(deviceUID [8]byte, payloadLen int) time.Duration
+
+// airtimeBudget tracks the airtime of chunks sent within a sliding window
+type airtimeBudget struct {
+	mu   sync.Mutex
+	sent []airtimeUse
+}
+
+type airtimeUse struct {
+	at      time.Time
+	airtime time.Duration
+}
+
+// reserve records a send and returns true if its airtime fits the budget,
+// a fraction of the window. A window with nothing sent always admits one
+// chunk, however long.
+func (b *airtimeBudget) reserve(now time.Time, airtime time.Duration, budget float64, window time.Duration) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	cutoff := now.Add(-window)
+	i := 0
+	for i < len(b.sent) && !b.sent[i].at.After(cutoff) {
+		i++
+	}
+	b.sent = b.sent[i:]
+
+	var used time.Duration
+	for _, s := range b.sent {
+		used += s.airtime
+	}
+	if len(b.sent) > 0 && used+airtime > time.Duration(budget*float64(window)) {
+		return false
+	}
+	b.sent = append(b.sent, airtimeUse{at: now, airtime: airtime})
+	return true
+}
+
+// SetAirtimeFunc sets the function used to estimate chunk airtime. Chunks
+// are only held to the airtime budget once it is set.
+func (m *Manager) SetAirtimeFunc(fn AirtimeFunc) {
+	m.mu.Lock()
+	m.airtimeFunc = fn
+	m.mu.Unlock()
+}
+
+// SetBusyFunc sets the function reporting whether other downlinks, such as
+// valve commands awaiting acknowledgment, should go first. Chunks are held
+// while it returns true.
+func (m *Manager) SetBusyFunc(fn func() bool) {
+	m.mu.Lock()
+	m.busyFunc = fn
+	m.mu.Unlock()
+}
+
+// sendChunk sends a firmware chunk once the OTA airtime budget allows and
+// no other downlinks are waiting. deviceUID is the update the chunk belongs
+// to, which doesn't time out while the chunk is held, or empty for a
+// broadcast.
+func (m *Manager) sendChunk(deviceUID string, uid [8]byte, msgType uint8, payload []byte) error {
+	m.mu.Lock()
+	airtimeFunc, busyFunc := m.airtimeFunc, m.busyFunc
+	m.held[deviceUID]++
+	m.mu.Unlock()
+
+	defer func() {
+		m.mu.Lock()
+		if m.held[deviceUID]--; m.held[deviceUID] <= 0 {
+			delete(m.held, deviceUID)
+		}
+		m.mu.Unlock()
+	}()
+
+	budget := m.config.AirtimeBudget
+	throttled := airtimeFunc != nil && budget > 0 && budget < 1 && m.config.AirtimeWindow > 0
+	var airtime time.Duration
+	if throttled {
+		airtime = airtimeFunc(uid, len(payload))
+	}
+
+	var update *DeviceUpdate
+	for {
+		// Stop holding the chunk once the update is cancelled or fails
+		m.mu.RLock()
+		update = m.updates[deviceUID]
+		if update != nil && update.State != StateTransferring {
+			state := update.State
+			m.mu.RUnlock()
+			return fmt.Errorf("update for device %s is %s", deviceUID, state)
+		}
+		m.mu.RUnlock()
+
+		busy := busyFunc != nil && busyFunc()
+		if !busy && (!throttled || m.airtime.reserve(time.Now(), airtime, budget, m.config.AirtimeWindow)) {
+			break
+		}
+		select {
+		case <-m.stopChan:
+			return errStopped
+		case <-time.After(throttlePoll):
+		}
+	}
+
+	if err := m.sendFunc(uid, msgType, payload); err != nil {
+		return err
+	}
+
+	// Held time doesn't count against the device
+	if update != nil {
+		m.mu.Lock()
+		update.LastActivity = time.Now()
+		m.mu.Unlock()
+	}
+	return nil
+}
@@ -0,0 +1,299 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"slices"
+)
+
+// VersionFlagCBOR is set in the header version byte when the payload is a
+// CBOR map rather than a fixed-offset struct. New message types use it so
+// fields can be added without breaking firmware built against older structs.
+const VersionFlagCBOR uint8 = 0x80
+
+// CBOR major types
+const (
+	cborUint   = 0
+	cborNegInt = 1
+	cborBytes  = 2
+	cborText   = 3
+	cborMap    = 5
+	cborSimple = 7
+)
+
+// CBORMap is an extensible payload: a CBOR map from field numbers to values.
+// Values are uint64, int64, float32, float64, bool, []byte, or string once
+// decoded, and Encode also takes the smaller integer types. Decoders ignore
+// fields they don't know, so new ones can be added at any time.
+//
+// Unlike fixed payloads, CBOR is big-endian. Only the subset of RFC 8949 the
+// firmware codec supports is used: definite lengths, no nesting, and no tags.
+type CBORMap map[uint64]any
+
+// Encode serializes the map in canonical form, with keys in ascending order,
+// so identical maps encode identically in Go and C
+func (m CBORMap) Encode() ([]byte, error) {
+	buf := cborHead(nil, cborMap, uint64(len(m)))
+	keys := make([]uint64, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	for _, k := range keys {
+		buf = cborHead(buf, cborUint, k)
+		switch v := m[k].(type) {
+		case uint8:
+			buf = cborHead(buf, cborUint, uint64(v))
+		case uint16:
+			buf = cborHead(buf, cborUint, uint64(v))
+		case uint32:
+			buf = cborHead(buf, cborUint, uint64(v))
+		case uint64:
+			buf = cborHead(buf, cborUint, v)
+		case uint:
+			buf = cborHead(buf, cborUint, uint64(v))
+		case int8:
+			buf = cborInt(buf, int64(v))
+		case int16:
+			buf = cborInt(buf, int64(v))
+		case int32:
+			buf = cborInt(buf, int64(v))
+		case int:
+			buf = cborInt(buf, int64(v))
+		case int64:
+			buf = cborInt(buf, v)
+		case float32:
+			buf = append(buf, cborSimple<<5|26)
+			buf = binary.BigEndian.AppendUint32(buf, math.Float32bits(v))
+		case float64:
+			buf = append(buf, cborSimple<<5|27)
+			buf = binary.BigEndian.AppendUint64(buf, math.Float64bits(v))
+		case bool:
+			if v {
+				buf = append(buf, cborSimple<<5|21)
+			} else {
+				buf = append(buf, cborSimple<<5|20)
+			}
+		case []byte:
+			buf = cborHead(buf, cborBytes, uint64(len(v)))
+			buf = append(buf, v...)
+		case string:
+			buf = cborHead(buf, cborText, uint64(len(v)))
+			buf = append(buf, v...)
+		default:
+			return nil, fmt.Errorf("CBOR field %d: unsupported type %T", k, v)
+		}
+	}
+	return buf, nil
+}
+
+// DecodeCBORMap parses a CBOR map payload
+func DecodeCBORMap(data []byte) (CBORMap, error) {
+	d := cborDecoder{data: data}
+	major, count, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+	if major != cborMap {
+		return nil, fmt.Errorf("CBOR payload is major type %d, want a map", major)
+	}
+
+	m := make(CBORMap, min(count, uint64(len(data))))
+	for i := uint64(0); i < count; i++ {
+		major, key, err := d.head()
+		if err != nil {
+			return nil, err
+		}
+		if major != cborUint {
+			return nil, fmt.Errorf("CBOR key is major type %d, want an unsigned integer", major)
+		}
+		v, err := d.value()
+		if err != nil {
+			return nil, fmt.Errorf("CBOR field %d: %w", key, err)
+		}
+		m[key] = v
+	}
+	if d.pos != len(data) {
+		return nil, fmt.Errorf("CBOR payload has %d trailing bytes", len(data)-d.pos)
+	}
+	return m, nil
+}
+
+// Uint returns an unsigned integer field
+func (m CBORMap) Uint(key uint64) (uint64, bool) {
+	v, ok := m[key].(uint64)
+	return v, ok
+}
+
+// Int returns an integer field of either sign
+func (m CBORMap) Int(key uint64) (int64, bool) {
+	switch v := m[key].(type) {
+	case int64:
+		return v, true
+	case uint64:
+		return int64(v), v <= math.MaxInt64
+	}
+	return 0, false
+}
+
+// Float returns a floating point field of either precision
+func (m CBORMap) Float(key uint64) (float64, bool) {
+	switch v := m[key].(type) {
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// Bool returns a boolean field
+func (m CBORMap) Bool(key uint64) (bool, bool) {
+	v, ok := m[key].(bool)
+	return v, ok
+}
+
+// Bytes returns a byte string field
+func (m CBORMap) Bytes(key uint64) ([]byte, bool) {
+	v, ok := m[key].([]byte)
+	return v, ok
+}
+
+// Text returns a text string field
+func (m CBORMap) Text(key uint64) (string, bool) {
+	v, ok := m[key].(string)
+	return v, ok
+}
+
+// cborHead appends an item head in its shortest form
+func cborHead(buf []byte, major uint8, n uint64) []byte {
+	switch {
+	case n < 24:
+		return append(buf, major<<5|uint8(n))
+	case n <= math.MaxUint8:
+		return append(buf, major<<5|24, uint8(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(buf, major<<5|25), uint16(n))
+	case n <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(buf, major<<5|26), uint32(n))
+	default:
+		return binary.BigEndian.AppendUint64(append(buf, major<<5|27), n)
+	}
+}
+
+// cborInt appends a signed integer
+func cborInt(buf []byte, v int64) []byte {
+	if v >= 0 {
+		return cborHead(buf, cborUint, uint64(v))
+	}
+	return cborHead(buf, cborNegInt, uint64(-1-v))
+}
+
+type cborDecoder struct {
+	data []byte
+	pos  int
+}
+
+// head reads an item head, returning its major type and argument. For
+// simple values and floats the argument is the raw additional info or bits.
+func (d *cborDecoder) head() (uint8, uint64, error) {
+	if d.pos >= len(d.data) {
+		return 0, 0, fmt.Errorf("CBOR payload truncated")
+	}
+	b := d.data[d.pos]
+	d.pos++
+	major, info := b>>5, b&0x1F
+
+	size := 0
+	switch {
+	case info < 24:
+		return major, uint64(info), nil
+	case info == 24:
+		size = 1
+	case info == 25:
+		size = 2
+	case info == 26:
+		size = 4
+	case info == 27:
+		size = 8
+	default:
+		return 0, 0, fmt.Errorf("unsupported CBOR additional info %d", info)
+	}
+	if len(d.data)-d.pos < size {
+		return 0, 0, fmt.Errorf("CBOR payload truncated")
+	}
+	var n uint64
+	for _, c := range d.data[d.pos : d.pos+size] {
+		n = n<<8 | uint64(c)
+	}
+	d.pos += size
+	return major, n, nil
+}
+
+// value reads one map value
+func (d *cborDecoder) value() (any, error) {
+	start := d.pos
+	major, n, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+
+	switch major {
+	case cborUint:
+		return n, nil
+	case cborNegInt:
+		if n > math.MaxInt64 {
+			return nil, fmt.Errorf("negative integer out of range")
+		}
+		return -1 - int64(n), nil
+	case cborBytes, cborText:
+		if uint64(len(d.data)-d.pos) < n {
+			return nil, fmt.Errorf("CBOR payload truncated")
+		}
+		s := d.data[d.pos : d.pos+int(n)]
+		d.pos += int(n)
+		if major == cborText {
+			return string(s), nil
+		}
+		return slices.Clone(s), nil
+	case cborSimple:
+		switch info := d.data[start] & 0x1F; info {
+		case 20:
+			return false, nil
+		case 21:
+			return true, nil
+		case 25:
+			return halfToFloat32(uint16(n)), nil
+		case 26:
+			return math.Float32frombits(uint32(n)), nil
+		case 27:
+			return math.Float64frombits(n), nil
+		default:
+			return nil, fmt.Errorf("unsupported CBOR simple value %d", info)
+		}
+	}
+	return nil, fmt.Errorf("unsupported CBOR major type %d", major)
+}
+
+// halfToFloat32 widens an IEEE 754 half precision float
+func halfToFloat32(h uint16) float32 {
+	sign := uint32(h>>15) << 31
+	exp := uint32(h>>10) & 0x1F
+	frac := uint32(h) & 0x3FF
+
+	switch exp {
+	case 0:
+		// Zero or subnormal
+		f := float32(frac) / (1 << 24)
+		if sign != 0 {
+			f = -f
+		}
+		return f
+	case 0x1F:
+		// Infinity or NaN
+		return math.Float32frombits(sign | 0xFF<<23 | frac<<13)
+	}
+	return math.Float32frombits(sign | (exp+127-15)<<23 | frac<<13)
+}
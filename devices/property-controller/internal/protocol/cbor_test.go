@@ -0,0 +1,128 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// TestCBORMapEncodeDecode tests the canonical encoding and its roundtrip
+func TestCBORMapEncodeDecode(t *testing.T) {
+	m := CBORMap{
+		6: float32(1.5),
+		1: uint16(500),
+		3: []byte{0x01, 0x02},
+		2: -5,
+		5: true,
+		4: "ok",
+	}
+
+	encoded, err := m.Encode()
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	if got, want := hex.EncodeToString(encoded), "a6011901f402240342010204626f6b05f506fa3fc00000"; got != want {
+		t.Errorf("Encoded = %s, want %s", got, want)
+	}
+
+	decoded, err := DecodeCBORMap(encoded)
+	if err != nil {
+		t.Fatalf("DecodeCBORMap failed: %v", err)
+	}
+	if v, ok := decoded.Uint(1); !ok || v != 500 {
+		t.Errorf("Field 1 = %d, %t, want 500", v, ok)
+	}
+	if v, ok := decoded.Int(2); !ok || v != -5 {
+		t.Errorf("Field 2 = %d, %t, want -5", v, ok)
+	}
+	if v, ok := decoded.Bytes(3); !ok || !bytes.Equal(v, []byte{0x01, 0x02}) {
+		t.Errorf("Field 3 = %X, %t, want 0102", v, ok)
+	}
+	if v, ok := decoded.Text(4); !ok || v != "ok" {
+		t.Errorf("Field 4 = %q, %t, want ok", v, ok)
+	}
+	if v, ok := decoded.Bool(5); !ok || !v {
+		t.Errorf("Field 5 = %t, %t, want true", v, ok)
+	}
+	if v, ok := decoded.Float(6); !ok || v != 1.5 {
+		t.Errorf("Field 6 = %f, %t, want 1.5", v, ok)
+	}
+	if _, ok := decoded.Uint(7); ok {
+		t.Error("Missing field 7 reported present")
+	}
+	if _, ok := decoded.Uint(2); ok {
+		t.Error("Negative field 2 read as unsigned")
+	}
+}
+
+// TestCBORMapDecode tests decoding of encodings Go doesn't produce and
+// rejection of malformed payloads
+func TestCBORMapDecode(t *testing.T) {
+	// Half precision float and a 4 byte integer
+	m, err := DecodeCBORMap([]byte{0xA2, 0x01, 0xF9, 0x3E, 0x00, 0x18, 0x20, 0x1A, 0x00, 0x01, 0x00, 0x00})
+	if err != nil {
+		t.Fatalf("DecodeCBORMap failed: %v", err)
+	}
+	if v, _ := m.Float(1); v != 1.5 {
+		t.Errorf("Half float = %f, want 1.5", v)
+	}
+	if v, _ := m.Uint(32); v != 65536 {
+		t.Errorf("Field 32 = %d, want 65536", v)
+	}
+
+	invalid := []struct {
+		name string
+		data string
+	}{
+		{"empty", ""},
+		{"not a map", "8101"},
+		{"truncated value", "a1011901"},
+		{"truncated string", "a10143ab"},
+		{"text key", "a1616101"},
+		{"nested map", "a101a0"},
+		{"indefinite length", "bf01"},
+		{"trailing bytes", "a0ff"},
+	}
+	for _, tt := range invalid {
+		t.Run(tt.name, func(t *testing.T) {
+			data, _ := hex.DecodeString(tt.data)
+			if _, err := DecodeCBORMap(data); err == nil {
+				t.Error("Expected error")
+			}
+		})
+	}
+
+	if _, err := (CBORMap{1: struct{}{}}).Encode(); err == nil {
+		t.Error("Expected error encoding unsupported type")
+	}
+}
+
+// TestCBORFrameFlag tests that the CBOR flag travels in the version byte
+func TestCBORFrameFlag(t *testing.T) {
+	payload, _ := CBORMap{1: uint8(7)}.Encode()
+	msg := &LoRaMessage{
+		Header: Header{
+			Magic:   [2]byte{MagicByte1, MagicByte2},
+			Version: ProtocolVersionCRC,
+			MsgType: 0x50,
+		},
+		Payload: payload,
+		CBOR:    true,
+	}
+
+	encoded := msg.Encode()
+	if encoded[2] != ProtocolVersionCRC|VersionFlagCBOR {
+		t.Errorf("Version byte = 0x%02X, want 0x%02X", encoded[2], ProtocolVersionCRC|VersionFlagCBOR)
+	}
+
+	decoded, err := Decode(encoded)
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	if !decoded.CBOR || decoded.Header.Version != ProtocolVersionCRC {
+		t.Errorf("Decoded CBOR %t version %d, want true version %d", decoded.CBOR, decoded.Header.Version, ProtocolVersionCRC)
+	}
+	if !bytes.Equal(decoded.Payload, payload) {
+		t.Errorf("Payload = %X, want %X", decoded.Payload, payload)
+	}
+}
@@ -15,6 +15,8 @@ type TestVectors struct {
 	MeterResets  []MeterResetVector  `json:"meter_resets"`
 	Acks         []AckVector         `json:"acks"`
 	Headers      []HeaderVector      `json:"headers"`
+	FrameCRCs    []FrameCRCVector    `json:"frame_crcs"`
+	CBORMaps     []CBORVector        `json:"cbor_maps"`
 }
 
 type MeterAlarmVector struct {
@@ -60,6 +62,16 @@ type HeaderVector struct {
 	Encoded    string `json:"encoded"`
 }
 
+type FrameCRCVector struct {
+	Frame   string `json:"frame"` // Header and payload
+	CRC     uint16 `json:"crc"`
+	Encoded string `json:"encoded"` // Frame with its trailing CRC
+}
+
+type CBORVector struct {
+	Encoded string `json:"encoded"` // CBOR map as encoded by the firmware codec
+}
+
 func loadTestVectors(t *testing.T) *TestVectors {
 	t.Helper()
 
@@ -293,3 +305,60 @@ func TestCrossValidateHeader(t *testing.T) {
 		})
 	}
 }
+
+// TestCrossValidateFrameCRC validates the Go frame CRC matches C
+func TestCrossValidateFrameCRC(t *testing.T) {
+	vectors := loadTestVectors(t)
+	if vectors == nil {
+		return
+	}
+
+	for i, v := range vectors.FrameCRCs {
+		t.Run(string(rune('A'+i)), func(t *testing.T) {
+			frame, err := hex.DecodeString(v.Frame)
+			if err != nil {
+				t.Fatalf("Invalid hex: %v", err)
+			}
+			if crc := CRC16(frame); crc != v.CRC {
+				t.Errorf("CRC16: got %04X, want %04X", crc, v.CRC)
+			}
+
+			cEncoded, _ := hex.DecodeString(v.Encoded)
+			decoded, err := Decode(cEncoded)
+			if err != nil {
+				t.Fatalf("Decode failed: %v", err)
+			}
+			if encodedHex := hex.EncodeToString(decoded.Encode()); encodedHex != v.Encoded {
+				t.Errorf("Encoding mismatch:\n  Go: %s\n  C:  %s", encodedHex, v.Encoded)
+			}
+		})
+	}
+}
+
+// TestCrossValidateCBOR validates Go decodes C CBOR maps and re-encodes them identically
+func TestCrossValidateCBOR(t *testing.T) {
+	vectors := loadTestVectors(t)
+	if vectors == nil {
+		return
+	}
+
+	for i, v := range vectors.CBORMaps {
+		t.Run(string(rune('A'+i)), func(t *testing.T) {
+			cEncoded, err := hex.DecodeString(v.Encoded)
+			if err != nil {
+				t.Fatalf("Invalid hex: %v", err)
+			}
+			decoded, err := DecodeCBORMap(cEncoded)
+			if err != nil {
+				t.Fatalf("DecodeCBORMap failed: %v", err)
+			}
+			goEncoded, err := decoded.Encode()
+			if err != nil {
+				t.Fatalf("Encode failed: %v", err)
+			}
+			if encodedHex := hex.EncodeToString(goEncoded); encodedHex != v.Encoded {
+				t.Errorf("Encoding mismatch:\n  Go: %s\n  C:  %s", encodedHex, v.Encoded)
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package protocol
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// FragmentHeaderSize is the size of the header in front of each fragment
+const FragmentHeaderSize = 4
+
+// MaxFragments is the most fragments a single payload can be split into
+const MaxFragments = 255
+
+// FragmentPayload is one piece of a fragmented payload. Fragments of a
+// transfer share its transfer ID and the message type of the whole payload.
+type FragmentPayload struct {
+	MsgType    uint8 // Message type of the reassembled payload
+	TransferID uint8 // Distinguishes transfers to the same device
+	Index      uint8 // Position of this fragment, from 0
+	Count      uint8 // Fragments in the transfer
+	Data       []byte
+}
+
+// Encode serializes a fragment
+func (p *FragmentPayload) Encode() []byte {
+	buf := make([]byte, FragmentHeaderSize+len(p.Data))
+	buf[0] = p.MsgType
+	buf[1] = p.TransferID
+	buf[2] = p.Index
+	buf[3] = p.Count
+	copy(buf[FragmentHeaderSize:], p.Data)
+	return buf
+}
+
+// DecodeFragment parses a fragment
+func DecodeFragment(data []byte) (*FragmentPayload, error) {
+	if len(data) < FragmentHeaderSize {
+		return nil, fmt.Errorf("fragment too short: %d bytes", len(data))
+	}
+	p := &FragmentPayload{
+		MsgType:    data[0],
+		TransferID: data[1],
+		Index:      data[2],
+		Count:      data[3],
+		Data:       make([]byte, len(data)-FragmentHeaderSize),
+	}
+	copy(p.Data, data[FragmentHeaderSize:])
+	if p.Count == 0 || p.Index >= p.Count {
+		return nil, fmt.Errorf("invalid fragment %d of %d", p.Index, p.Count)
+	}
+	return p, nil
+}
+
+// Fragment splits a payload into fragments whose encoding fits in maxSize
+// bytes
+func Fragment(msgType, transferID uint8, payload []byte, maxSize int) ([]FragmentPayload, error) {
+	chunk := maxSize - FragmentHeaderSize
+	if chunk <= 0 {
+		return nil, fmt.Errorf("no room for fragment data in %d bytes", maxSize)
+	}
+	count := max(1, (len(payload)+chunk-1)/chunk)
+	if count > MaxFragments {
+		return nil, fmt.Errorf("payload of %d bytes needs %d fragments, max %d", len(payload), count, MaxFragments)
+	}
+
+	frags := make([]FragmentPayload, count)
+	for i := range frags {
+		end := min((i+1)*chunk, len(payload))
+		frags[i] = FragmentPayload{
+			MsgType:    msgType,
+			TransferID: transferID,
+			Index:      uint8(i),
+			Count:      uint8(count),
+			Data:       payload[i*chunk : end],
+		}
+	}
+	return frags, nil
+}
+
+// Reassembler collects fragments into whole payloads. Transfers not
+// completed within the timeout are dropped.
+type Reassembler struct {
+	timeout   time.Duration
+	mu        sync.Mutex
+	transfers map[transferKey]*transfer
+}
+
+type transferKey struct {
+	deviceUID  [8]byte
+	transferID uint8
+}
+
+type transfer struct {
+	msgType   uint8
+	parts     [][]byte
+	received  int
+	startedAt time.Time
+}
+
+// NewReassembler creates a reassembler that drops incomplete transfers after
+// the timeout
+func NewReassembler(timeout time.Duration) *Reassembler {
+	return &Reassembler{
+		timeout:   timeout,
+		transfers: make(map[transferKey]*transfer),
+	}
+}
+
+// Add records a fragment from a device. Once every fragment of its transfer
+// has arrived it returns the message type and reassembled payload with done
+// set.
+func (r *Reassembler) Add(deviceUID [8]byte, frag *FragmentPayload, now time.Time) (msgType uint8, payload []byte, done bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.expire(now)
+
+	key := transferKey{deviceUID: deviceUID, transferID: frag.TransferID}
+	t, ok := r.transfers[key]
+	// A fragment that doesn't fit the transfer in progress starts a new one,
+	// as the device has reused the ID
+	if !ok || t.msgType != frag.MsgType || len(t.parts) != int(frag.Count) {
+		t = &transfer{msgType: frag.MsgType, parts: make([][]byte, frag.Count), startedAt: now}
+		r.transfers[key] = t
+	}
+	if t.parts[frag.Index] == nil {
+		t.parts[frag.Index] = append([]byte{}, frag.Data...)
+		t.received++
+	}
+	if t.received < len(t.parts) {
+		return 0, nil, false
+	}
+
+	delete(r.transfers, key)
+	for _, part := range t.parts {
+		payload = append(payload, part...)
+	}
+	return t.msgType, payload, true
+}
+
+// Pending returns the number of incomplete transfers
+func (r *Reassembler) Pending() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.transfers)
+}
+
+// expire drops transfers that have run past the timeout
+func (r *Reassembler) expire(now time.Time) {
+	for key, t := range r.transfers {
+		if now.Sub(t.startedAt) > r.timeout {
+			delete(r.transfers, key)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// TestFragmentReassemble tests splitting a payload and reassembling it out of order
+func TestFragmentReassemble(t *testing.T) {
+	payload := make([]byte, 100)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+
+	frags, err := Fragment(MsgTypeScheduleUpdate, 7, payload, 30)
+	if err != nil {
+		t.Fatalf("Fragment failed: %v", err)
+	}
+	if len(frags) != 4 {
+		t.Fatalf("Got %d fragments, want 4", len(frags))
+	}
+	for _, f := range frags {
+		if size := len(f.Encode()); size > 30 {
+			t.Errorf("Fragment %d encodes to %d bytes, max 30", f.Index, size)
+		}
+	}
+
+	r := NewReassembler(time.Minute)
+	uid := [8]byte{1, 2, 3, 4, 5, 6, 7, 8}
+	now := time.Now()
+	for _, i := range []int{2, 0, 3, 0} {
+		decoded, err := DecodeFragment(frags[i].Encode())
+		if err != nil {
+			t.Fatalf("DecodeFragment failed: %v", err)
+		}
+		if _, _, done := r.Add(uid, decoded, now); done {
+			t.Fatal("Transfer completed before all fragments arrived")
+		}
+	}
+	if r.Pending() != 1 {
+		t.Errorf("Pending = %d, want 1", r.Pending())
+	}
+
+	msgType, got, done := r.Add(uid, &frags[1], now)
+	if !done {
+		t.Fatal("Transfer not completed after all fragments arrived")
+	}
+	if msgType != MsgTypeScheduleUpdate {
+		t.Errorf("MsgType = 0x%02X, want 0x%02X", msgType, MsgTypeScheduleUpdate)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Errorf("Reassembled payload = %X, want %X", got, payload)
+	}
+	if r.Pending() != 0 {
+		t.Errorf("Pending = %d after completion, want 0", r.Pending())
+	}
+}
+
+// TestReassemblerTimeout tests that incomplete transfers are dropped
+func TestReassemblerTimeout(t *testing.T) {
+	frags, err := Fragment(MsgTypeConfigUpdate, 1, make([]byte, 40), 24)
+	if err != nil {
+		t.Fatalf("Fragment failed: %v", err)
+	}
+
+	r := NewReassembler(time.Minute)
+	uid := [8]byte{1}
+	start := time.Now()
+	r.Add(uid, &frags[0], start)
+
+	// The rest of the transfer arrives too late to join the first fragment
+	for _, f := range frags[1:] {
+		if _, _, done := r.Add(uid, &f, start.Add(2*time.Minute)); done {
+			t.Fatal("Transfer completed with an expired fragment")
+		}
+	}
+	if r.Pending() != 1 {
+		t.Errorf("Pending = %d, want 1", r.Pending())
+	}
+}
+
+// TestFragmentLimits tests rejection of unusable sizes and invalid fragments
+func TestFragmentLimits(t *testing.T) {
+	if _, err := Fragment(MsgTypeConfigUpdate, 1, []byte{1}, FragmentHeaderSize); err == nil {
+		t.Error("Expected error with no room for data")
+	}
+	if _, err := Fragment(MsgTypeConfigUpdate, 1, make([]byte, 1000), FragmentHeaderSize+3); err == nil {
+		t.Error("Expected error for too many fragments")
+	}
+	if _, err := DecodeFragment([]byte{MsgTypeConfigUpdate, 1, 2, 2}); err == nil {
+		t.Error("Expected error for index past count")
+	}
+	if _, err := DecodeFragment([]byte{MsgTypeConfigUpdate, 1}); err == nil {
+		t.Error("Expected error for short fragment")
+	}
+}
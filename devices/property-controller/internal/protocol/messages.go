@@ -8,6 +8,7 @@ package protocol
 import (
 	"encoding/binary"
 	"fmt"
+	"time"
 
 	"github.com/ccroswhite/agsys-api/pkg/lora"
 )
@@ -21,6 +22,22 @@ const (
 	DeviceUIDSize   = lora.DeviceUIDSize
 )
 
+// ProtocolVersionCRC is the first protocol version whose frames end in a
+// CRC16 of the header and payload, to catch corruption the radio CRC misses.
+// Devices announce it in their header and the controller answers in kind.
+const ProtocolVersionCRC uint8 = 2
+
+// Protocol versions decoded. The oldest stays supported until every device
+// has been updated past it, so mixed-firmware fleets keep working during a
+// rollout; downlinks are framed in the version each device last sent.
+const (
+	MinProtocolVersion     = ProtocolVersion
+	CurrentProtocolVersion = ProtocolVersionCRC
+)
+
+// FrameCRCSize is the size of the trailing frame CRC
+const FrameCRCSize = 2
+
 // Re-export message types from shared package
 const (
 	MsgTypeHeartbeat         = lora.MsgTypeHeartbeat
@@ -49,6 +66,37 @@ const (
 	MsgTypeOTAFinish         = lora.MsgTypeOTAFinish
 )
 
+// Controller messages not yet part of the shared protocol package
+const (
+	MsgTypeKeyRotate    uint8 = 0x12 // Controller -> device: new key under the current key
+	MsgTypeKeyRotateAck uint8 = 0x13 // Device -> controller: new key installed
+	MsgTypeTimeSyncAck  uint8 = 0x14 // Device -> controller: time sync applied, with clock skew
+	MsgTypeConfigAck    uint8 = 0x15 // Device -> controller: report interval config applied
+	MsgTypeFragment     uint8 = 0x16 // Either direction: one piece of a payload too large for a frame
+	MsgTypeDebugCommand uint8 = 0x17 // Controller -> device: opaque diagnostic command relayed from the cloud
+	MsgTypeDebugReply   uint8 = 0x18 // Device -> controller: answer to a diagnostic command
+
+	MsgTypeMeterResetAck     uint8 = 0x34 // Water meter -> controller: totalizer reset applied, with old and new totals
+	MsgTypeMeterPin          uint8 = 0x35 // Controller -> water meter: shut off its valve and hold it shut, or release it
+	MsgTypeMeterPinAck       uint8 = 0x36 // Water meter -> controller: pin applied, with the valve's state
+	MsgTypeMeterCalibrateAck uint8 = 0x37 // Water meter -> controller: calibration step applied, with the pulses counted
+
+	MsgTypeInjectorCommand uint8 = 0x45 // Controller -> valve controller: start/stop a fertilizer injector
+	MsgTypeInjectorAck     uint8 = 0x46 // Valve controller -> controller: injector command result
+	MsgTypeScheduleAck     uint8 = 0x47 // Valve controller -> controller: schedule stored, with its version
+
+	MsgTypeOTABitmap         uint8 = 0xE6 // Device -> controller: chunks received in a windowed OTA transfer
+	MsgTypeOTASession        uint8 = 0xE7 // Controller -> devices (broadcast): multicast OTA session announce
+	MsgTypeOTAJoin           uint8 = 0xE8 // Device -> controller: join a multicast OTA session
+	MsgTypeOTAMulticastChunk uint8 = 0xE9 // Controller -> devices (broadcast): firmware chunk of a multicast session
+)
+
+// Injector commands
+const (
+	InjectorCmdStop  uint8 = 0
+	InjectorCmdStart uint8 = 1
+)
+
 // Re-export boot reason codes from shared package
 const (
 	BootReasonNormal      = lora.BootReasonNormal
@@ -59,6 +107,34 @@ const (
 	BootReasonHardFault   = lora.BootReasonHardFault
 )
 
+// BootReasonString returns a human-readable boot reason
+func BootReasonString(reason uint8) string {
+	switch reason {
+	case BootReasonNormal:
+		return "normal"
+	case BootReasonPowerCycle:
+		return "power_cycle"
+	case BootReasonWatchdog:
+		return "watchdog"
+	case BootReasonOTASuccess:
+		return "ota_success"
+	case BootReasonOTARollback:
+		return "ota_rollback"
+	case BootReasonHardFault:
+		return "hard_fault"
+	default:
+		return fmt.Sprintf("unknown(%d)", reason)
+	}
+}
+
+// Re-export OTA status codes from shared package
+const (
+	OTAStatusInProgress = lora.OTAStatusInProgress
+	OTAStatusSuccess    = lora.OTAStatusSuccess
+	OTAStatusFailed     = lora.OTAStatusFailed
+	OTAStatusRolledBack = lora.OTAStatusRolledBack
+)
+
 // Re-export OTA payload types from shared package
 type (
 	OTAAnnouncePayload = lora.OTAAnnouncePayload
@@ -100,6 +176,18 @@ const (
 	ValveStateError   = lora.ValveStateError
 )
 
+// ValveMayFlow returns true for valve states where water may be flowing. A
+// valve passes water while it travels either way, so Closing counts until
+// the valve reports Closed.
+func ValveMayFlow(state uint8) bool {
+	switch state {
+	case ValveStateOpen, ValveStateOpening, ValveStateClosing:
+		return true
+	default:
+		return false
+	}
+}
+
 // Re-export valve commands from shared package
 const (
 	ValveCmdClose = lora.ValveCmdClose
@@ -118,6 +206,7 @@ type LoRaMessage struct {
 	RSSI       int16   // Received signal strength (set by receiver)
 	SNR        float32 // Signal-to-noise ratio (set by receiver)
 	ReceivedAt int64   // Unix timestamp when received
+	CBOR       bool    // Payload is a CBORMap, flagged in the header version byte
 }
 
 // NewHeader creates a new header with magic bytes and version set
@@ -130,16 +219,30 @@ func DecodeHeader(data []byte) (*Header, error) {
 	return lora.DecodeHeader(data)
 }
 
-// Encode serializes the full message for transmission
+// Encode serializes the full message for transmission, ending it with a
+// frame CRC if its protocol version has one
 func (m *LoRaMessage) Encode() []byte {
 	headerBytes := m.Header.Encode()
-	buf := make([]byte, HeaderSize+len(m.Payload))
+	if m.CBOR {
+		headerBytes[2] |= VersionFlagCBOR
+	}
+	size := HeaderSize + len(m.Payload)
+	if HasFrameCRC(m.Header.Version) {
+		size += FrameCRCSize
+	}
+	buf := make([]byte, size)
 	copy(buf[0:HeaderSize], headerBytes)
 	copy(buf[HeaderSize:], m.Payload)
+	if HasFrameCRC(m.Header.Version) {
+		end := HeaderSize + len(m.Payload)
+		binary.LittleEndian.PutUint16(buf[end:], CRC16(buf[:end]))
+	}
 	return buf
 }
 
-// Decode parses a raw message into the LoRaMessage structure
+// Decode parses a raw message into the LoRaMessage structure, checking and
+// removing the frame CRC if its protocol version has one. The CBOR flag is
+// moved from the header version to the message.
 func Decode(data []byte) (*LoRaMessage, error) {
 	if len(data) < HeaderSize {
 		return nil, fmt.Errorf("message too short: %d bytes", len(data))
@@ -149,14 +252,29 @@ func Decode(data []byte) (*LoRaMessage, error) {
 	if err != nil {
 		return nil, err
 	}
+	cbor := header.Version&VersionFlagCBOR != 0
+	header.Version &^= VersionFlagCBOR
 
-	if !header.IsValid() {
+	if header.Magic != [2]byte{MagicByte1, MagicByte2} || !SupportsVersion(header.Version) {
 		return nil, fmt.Errorf("invalid header: magic=%02X%02X version=%d",
 			header.Magic[0], header.Magic[1], header.Version)
 	}
 
+	if HasFrameCRC(header.Version) {
+		if len(data) < HeaderSize+FrameCRCSize {
+			return nil, fmt.Errorf("message too short for frame CRC: %d bytes", len(data))
+		}
+		end := len(data) - FrameCRCSize
+		want := binary.LittleEndian.Uint16(data[end:])
+		if got := CRC16(data[:end]); got != want {
+			return nil, fmt.Errorf("frame CRC mismatch: got %04X, want %04X", got, want)
+		}
+		data = data[:end]
+	}
+
 	msg := &LoRaMessage{
 		Header: *header,
+		CBOR:   cbor,
 	}
 
 	if len(data) > HeaderSize {
@@ -172,6 +290,83 @@ func (m *LoRaMessage) DeviceUIDString() string {
 	return m.Header.DeviceUIDString()
 }
 
+// SupportsVersion reports whether frames of a protocol version can be decoded
+func SupportsVersion(version uint8) bool {
+	return version >= MinProtocolVersion && version <= CurrentProtocolVersion
+}
+
+// HasFrameCRC reports whether frames of a protocol version end in a CRC
+func HasFrameCRC(version uint8) bool {
+	return version >= ProtocolVersionCRC
+}
+
+// CRC16 computes the frame CRC: CRC-16/CCITT-FALSE (polynomial 0x1021,
+// initial value 0xFFFF), the same as agsys_protocol_crc16 in the firmware
+func CRC16(data []byte) uint16 {
+	crc := uint16(0xFFFF)
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// Heartbeat sizes. Firmware before the version fields sends the shorter one.
+const (
+	HeartbeatMinSize = 5 // Uptime and boot reason only
+	HeartbeatSize    = 9 // Encoded size of HeartbeatPayload
+)
+
+// HeartbeatPayload is a device's periodic sign of life
+type HeartbeatPayload struct {
+	UptimeSec  uint32   // Seconds since the device booted
+	BootReason uint8    // Reason for the last boot
+	FWVersion  [3]uint8 // Firmware version (major, minor, patch), zero if not sent
+	HWRev      uint8    // Hardware revision, valid with FWVersion
+}
+
+// Encode serializes heartbeat payload
+func (p *HeartbeatPayload) Encode() []byte {
+	buf := make([]byte, HeartbeatSize)
+	binary.LittleEndian.PutUint32(buf[0:4], p.UptimeSec)
+	buf[4] = p.BootReason
+	copy(buf[5:8], p.FWVersion[:])
+	buf[8] = p.HWRev
+	return buf
+}
+
+// HasVersion reports whether the heartbeat carried the firmware version
+func (p *HeartbeatPayload) HasVersion() bool {
+	return p.FWVersion != [3]uint8{}
+}
+
+// Uptime returns the time since the device booted
+func (p *HeartbeatPayload) Uptime() time.Duration {
+	return time.Duration(p.UptimeSec) * time.Second
+}
+
+// DecodeHeartbeat parses heartbeat from payload
+func DecodeHeartbeat(data []byte) (*HeartbeatPayload, error) {
+	if len(data) < HeartbeatMinSize {
+		return nil, fmt.Errorf("heartbeat too short: %d bytes", len(data))
+	}
+	p := &HeartbeatPayload{
+		UptimeSec:  binary.LittleEndian.Uint32(data[0:4]),
+		BootReason: data[4],
+	}
+	if len(data) >= HeartbeatSize {
+		copy(p.FWVersion[:], data[5:8])
+		p.HWRev = data[8]
+	}
+	return p, nil
+}
+
 // SensorDataPayload represents soil moisture sensor data
 type SensorDataPayload struct {
 	ProbeID         uint8  // Probe index 0-3
@@ -206,6 +401,95 @@ func DecodeSensorData(data []byte) (*SensorDataPayload, error) {
 	}, nil
 }
 
+// Soil report constants
+const (
+	MaxProbes      = 4  // Probe slots in a soil report
+	SoilReportSize = 31 // Encoded size of SoilReportPayload
+)
+
+// Soil report flags
+const (
+	SensorFlagLowBattery     uint8 = 0x01
+	SensorFlagFirstBoot      uint8 = 0x02
+	SensorFlagConfigRequest  uint8 = 0x04
+	SensorFlagHasPendingLogs uint8 = 0x08
+)
+
+// ProbeReading represents a single probe within a soil report
+type ProbeReading struct {
+	ProbeIndex      uint8  // Probe index 0-3
+	FrequencyHz     uint16 // Raw oscillator frequency (diagnostics)
+	MoisturePercent uint8  // Calculated moisture percentage
+}
+
+// SoilReportPayload represents a batched soil moisture report with all probes
+type SoilReportPayload struct {
+	Timestamp   uint32                  // Device uptime in seconds
+	ProbeCount  uint8                   // Number of valid probes (1-4)
+	Probes      [MaxProbes]ProbeReading // Probe readings (first ProbeCount valid)
+	BatteryMV   uint16                  // Battery voltage in mV
+	Temperature int16                   // Temperature in 0.1°C units
+	PendingLogs uint8                   // Number of unsent log entries
+	Flags       uint8                   // Status flags
+	FWVersion   [3]uint8                // Firmware version (major, minor, patch)
+	BootReason  uint8                   // Boot reason
+}
+
+// Encode serializes a soil report payload
+func (p *SoilReportPayload) Encode() []byte {
+	buf := make([]byte, SoilReportSize)
+	binary.LittleEndian.PutUint32(buf[0:4], p.Timestamp)
+	buf[4] = p.ProbeCount
+	for i, probe := range p.Probes {
+		off := 5 + i*4
+		buf[off] = probe.ProbeIndex
+		binary.LittleEndian.PutUint16(buf[off+1:off+3], probe.FrequencyHz)
+		buf[off+3] = probe.MoisturePercent
+	}
+	binary.LittleEndian.PutUint16(buf[21:23], p.BatteryMV)
+	binary.LittleEndian.PutUint16(buf[23:25], uint16(p.Temperature))
+	buf[25] = p.PendingLogs
+	buf[26] = p.Flags
+	copy(buf[27:30], p.FWVersion[:])
+	buf[30] = p.BootReason
+	return buf
+}
+
+// DecodeSoilReport parses a batched soil report from payload
+func DecodeSoilReport(data []byte) (*SoilReportPayload, error) {
+	if len(data) < SoilReportSize {
+		return nil, fmt.Errorf("soil report too short: %d bytes", len(data))
+	}
+
+	p := &SoilReportPayload{
+		Timestamp:   binary.LittleEndian.Uint32(data[0:4]),
+		ProbeCount:  data[4],
+		BatteryMV:   binary.LittleEndian.Uint16(data[21:23]),
+		Temperature: int16(binary.LittleEndian.Uint16(data[23:25])),
+		PendingLogs: data[25],
+		Flags:       data[26],
+		BootReason:  data[30],
+	}
+	if p.ProbeCount == 0 || p.ProbeCount > MaxProbes {
+		return nil, fmt.Errorf("invalid probe count: %d", p.ProbeCount)
+	}
+	for i := range p.Probes {
+		off := 5 + i*4
+		p.Probes[i] = ProbeReading{
+			ProbeIndex:      data[off],
+			FrequencyHz:     binary.LittleEndian.Uint16(data[off+1 : off+3]),
+			MoisturePercent: data[off+3],
+		}
+	}
+	copy(p.FWVersion[:], data[27:30])
+	return p, nil
+}
+
+// ValidProbes returns the probe readings that are populated
+func (p *SoilReportPayload) ValidProbes() []ProbeReading {
+	return p.Probes[:p.ProbeCount]
+}
+
 // WaterMeterPayload represents water meter data with full float precision
 // Re-exported from shared lora package for backward compatibility
 type WaterMeterPayload = lora.MeterReportPayload
@@ -227,6 +511,13 @@ const (
 	MeterAlarmHighFlow uint8 = 0x04 // Flow rate exceeds maximum
 )
 
+// Derived meter alarm types, raised by the controller's flow analytics
+// rather than reported by a meter
+const (
+	MeterAlarmFlowWhileClosed uint8 = 0x10 // Flow measured while all valves closed
+	MeterAlarmNoFlowWhileOpen uint8 = 0x11 // Valve open but no flow measured
+)
+
 // DecodeMeterAlarm parses meter alarm data from payload
 // Uses the new float-based format from the shared lora package
 var DecodeMeterAlarm = lora.DecodeMeterAlarm
@@ -244,6 +535,10 @@ func MeterAlarmTypeString(alarmType uint8) string {
 		return "TAMPER"
 	case MeterAlarmHighFlow:
 		return "HIGH_FLOW"
+	case MeterAlarmFlowWhileClosed:
+		return "FLOW_WHILE_CLOSED"
+	case MeterAlarmNoFlowWhileOpen:
+		return "NO_FLOW_WHILE_OPEN"
 	default:
 		return fmt.Sprintf("UNKNOWN(%d)", alarmType)
 	}
@@ -315,6 +610,136 @@ func DecodeMeterResetAck(data []byte) (*MeterResetAckPayload, error) {
 	}, nil
 }
 
+// Meter pin actions
+const (
+	MeterPinRelease uint8 = 0 // Release the valve to normal operation
+	MeterPinShutoff uint8 = 1 // Close the valve and keep it closed until released
+)
+
+// Meter valve states reported in a pin ack
+const (
+	MeterValveOpen   uint8 = 0
+	MeterValveClosed uint8 = 1
+	MeterValveFault  uint8 = 2 // The valve did not reach the commanded position
+)
+
+// MeterPinPayload represents a remote shutoff command to a water meter
+type MeterPinPayload struct {
+	CommandID uint16 // Command ID for acknowledgment
+	Action    uint8  // MeterPinShutoff or MeterPinRelease
+}
+
+// Encode serializes meter pin payload
+func (p *MeterPinPayload) Encode() []byte {
+	buf := make([]byte, 3)
+	binary.LittleEndian.PutUint16(buf[0:2], p.CommandID)
+	buf[2] = p.Action
+	return buf
+}
+
+// DecodeMeterPin parses meter pin command from payload
+func DecodeMeterPin(data []byte) (*MeterPinPayload, error) {
+	if len(data) < 3 {
+		return nil, fmt.Errorf("meter pin too short: %d bytes", len(data))
+	}
+	return &MeterPinPayload{
+		CommandID: binary.LittleEndian.Uint16(data[0:2]),
+		Action:    data[2],
+	}, nil
+}
+
+// MeterPinAckPayload represents the response to a meter pin command
+type MeterPinAckPayload struct {
+	CommandID  uint16 // Command ID being acknowledged
+	Status     uint8  // 0 = OK, non-zero = error
+	ValveState uint8  // Valve state after the command
+}
+
+// Encode serializes meter pin ack payload
+func (p *MeterPinAckPayload) Encode() []byte {
+	buf := make([]byte, 4)
+	binary.LittleEndian.PutUint16(buf[0:2], p.CommandID)
+	buf[2] = p.Status
+	buf[3] = p.ValveState
+	return buf
+}
+
+// DecodeMeterPinAck parses meter pin ack from payload
+func DecodeMeterPinAck(data []byte) (*MeterPinAckPayload, error) {
+	if len(data) < 4 {
+		return nil, fmt.Errorf("meter pin ack too short: %d bytes", len(data))
+	}
+	return &MeterPinAckPayload{
+		CommandID:  binary.LittleEndian.Uint16(data[0:2]),
+		Status:     data[2],
+		ValveState: data[3],
+	}, nil
+}
+
+// Meter calibration actions
+const (
+	MeterCalCancel uint8 = 0 // Abandon the session
+	MeterCalStart  uint8 = 1 // Start counting pulses for a known-volume test
+	MeterCalFinish uint8 = 2 // Stop counting and report the pulses
+)
+
+// MeterCalibrateReqPayload represents a calibration session step sent to a
+// water meter
+type MeterCalibrateReqPayload struct {
+	SessionID uint16 // Calibration session, echoed in the meter's ack
+	Action    uint8  // MeterCalStart, MeterCalFinish, or MeterCalCancel
+}
+
+// Encode serializes meter calibrate request payload
+func (p *MeterCalibrateReqPayload) Encode() []byte {
+	buf := make([]byte, 3)
+	binary.LittleEndian.PutUint16(buf[0:2], p.SessionID)
+	buf[2] = p.Action
+	return buf
+}
+
+// DecodeMeterCalibrateReq parses meter calibrate request from payload
+func DecodeMeterCalibrateReq(data []byte) (*MeterCalibrateReqPayload, error) {
+	if len(data) < 3 {
+		return nil, fmt.Errorf("meter calibrate request too short: %d bytes", len(data))
+	}
+	return &MeterCalibrateReqPayload{
+		SessionID: binary.LittleEndian.Uint16(data[0:2]),
+		Action:    data[2],
+	}, nil
+}
+
+// MeterCalibrateAckPayload represents the response to a calibration step
+type MeterCalibrateAckPayload struct {
+	SessionID uint16 // Calibration session being acknowledged
+	Action    uint8  // Action applied
+	Status    uint8  // 0 = OK, non-zero = error
+	Pulses    uint32 // Pulses counted since the session started
+}
+
+// Encode serializes meter calibrate ack payload
+func (p *MeterCalibrateAckPayload) Encode() []byte {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint16(buf[0:2], p.SessionID)
+	buf[2] = p.Action
+	buf[3] = p.Status
+	binary.LittleEndian.PutUint32(buf[4:8], p.Pulses)
+	return buf
+}
+
+// DecodeMeterCalibrateAck parses meter calibrate ack from payload
+func DecodeMeterCalibrateAck(data []byte) (*MeterCalibrateAckPayload, error) {
+	if len(data) < 8 {
+		return nil, fmt.Errorf("meter calibrate ack too short: %d bytes", len(data))
+	}
+	return &MeterCalibrateAckPayload{
+		SessionID: binary.LittleEndian.Uint16(data[0:2]),
+		Action:    data[2],
+		Status:    data[3],
+		Pulses:    binary.LittleEndian.Uint32(data[4:8]),
+	}, nil
+}
+
 // AckPayload represents a generic acknowledgment
 type AckPayload struct {
 	AckedSequence uint16 // Sequence number being acknowledged
@@ -324,10 +749,11 @@ type AckPayload struct {
 
 // ACK flags
 const (
-	AckFlagSendLogs    uint8 = 1 << 0 // Request pending logs
-	AckFlagConfigAvail uint8 = 1 << 1 // New config available
-	AckFlagTimeSync    uint8 = 1 << 2 // Time sync follows
-	AckFlagOTAPending  uint8 = 1 << 3 // OTA update available, device should stay awake
+	AckFlagSendLogs       uint8 = 1 << 0 // Request pending logs
+	AckFlagConfigAvail    uint8 = 1 << 1 // New config available
+	AckFlagTimeSync       uint8 = 1 << 2 // Time sync follows
+	AckFlagOTAPending     uint8 = 1 << 3 // OTA update available, device should stay awake
+	AckFlagScheduleUpdate uint8 = 1 << 4 // New schedule available, controller should request it
 )
 
 // Encode serializes ack payload
@@ -351,6 +777,37 @@ func DecodeAck(data []byte) (*AckPayload, error) {
 	}, nil
 }
 
+// NACK error codes, carried in the status of a NACK payload. A NACK uses the
+// same payload as an ACK, so DecodeAck parses it.
+const (
+	NackErrInvalidPayload uint8 = 0x01 // Payload too short or malformed
+	NackErrUnsupported    uint8 = 0x02 // Message type not supported by the device
+	NackErrInvalidParam   uint8 = 0x03 // Parameter out of range, e.g. an unknown actuator address
+	NackErrBusy           uint8 = 0x04 // Device busy, the message may be resent
+	NackErrHardware       uint8 = 0x05 // Hardware fault carrying out the command
+	NackErrDecrypt        uint8 = 0x06 // Message failed decryption or authentication
+)
+
+// NackErrorString returns a human-readable NACK error
+func NackErrorString(code uint8) string {
+	switch code {
+	case NackErrInvalidPayload:
+		return "invalid payload"
+	case NackErrUnsupported:
+		return "unsupported message"
+	case NackErrInvalidParam:
+		return "invalid parameter"
+	case NackErrBusy:
+		return "device busy"
+	case NackErrHardware:
+		return "hardware fault"
+	case NackErrDecrypt:
+		return "decryption failed"
+	default:
+		return fmt.Sprintf("error 0x%02X", code)
+	}
+}
+
 // ValveStatusPayload represents valve controller status
 type ValveStatusPayload struct {
 	ActuatorAddr uint8  // Actuator address (0-63)
@@ -359,6 +816,22 @@ type ValveStatusPayload struct {
 	Flags        uint8  // Status flags (bit 0: power fail, bit 1: overcurrent, etc.)
 }
 
+// ValveFlagPowerFail and ValveFlagOnBattery mark a valve status report from a
+// controller that has lost mains power, and one running on its backup battery
+const (
+	ValveFlagPowerFail uint8 = 0x01
+	ValveFlagOnBattery uint8 = 0x04
+)
+
+// ValveFlagOvercurrent marks a valve status report for an actuation the
+// firmware cut short because the motor drew too much current
+const ValveFlagOvercurrent uint8 = 0x02
+
+// ValveFlagManual marks a valve status report for a state change made by hand
+// at the valve, by its override switch or the BLE app, rather than by a
+// command
+const ValveFlagManual uint8 = 0x80
+
 // Encode serializes valve status payload
 func (p *ValveStatusPayload) Encode() []byte {
 	buf := make([]byte, 5)
@@ -445,6 +918,102 @@ func DecodeValveAck(data []byte) (*ValveAckPayload, error) {
 	}, nil
 }
 
+// InjectorCommandPayload starts or stops a fertilizer injector on a valve
+// controller. The controller stops the injector on its own after MaxRunSec
+// in case the stop command is lost.
+type InjectorCommandPayload struct {
+	ActuatorAddr uint8  // Injector actuator address
+	Command      uint8  // InjectorCmdStart or InjectorCmdStop
+	CommandID    uint16 // Unique command ID for tracking acknowledgment
+	MaxRunSec    uint16 // Failsafe run limit for a start (0 = no limit)
+}
+
+// Encode serializes injector command payload
+func (p *InjectorCommandPayload) Encode() []byte {
+	buf := make([]byte, 6)
+	buf[0] = p.ActuatorAddr
+	buf[1] = p.Command
+	binary.LittleEndian.PutUint16(buf[2:4], p.CommandID)
+	binary.LittleEndian.PutUint16(buf[4:6], p.MaxRunSec)
+	return buf
+}
+
+// DecodeInjectorCommand parses injector command from payload
+func DecodeInjectorCommand(data []byte) (*InjectorCommandPayload, error) {
+	if len(data) < 6 {
+		return nil, fmt.Errorf("injector command too short: %d bytes", len(data))
+	}
+	return &InjectorCommandPayload{
+		ActuatorAddr: data[0],
+		Command:      data[1],
+		CommandID:    binary.LittleEndian.Uint16(data[2:4]),
+		MaxRunSec:    binary.LittleEndian.Uint16(data[4:6]),
+	}, nil
+}
+
+// InjectorAckPayload reports the result of an injector command
+type InjectorAckPayload struct {
+	ActuatorAddr uint8  // Injector that executed the command
+	CommandID    uint16 // Command ID being acknowledged
+	Running      bool   // Whether the injector is now running
+	Success      bool   // Whether command succeeded
+}
+
+// Encode serializes injector ack payload
+func (p *InjectorAckPayload) Encode() []byte {
+	buf := make([]byte, 5)
+	buf[0] = p.ActuatorAddr
+	binary.LittleEndian.PutUint16(buf[1:3], p.CommandID)
+	if p.Running {
+		buf[3] = 1
+	}
+	if p.Success {
+		buf[4] = 1
+	}
+	return buf
+}
+
+// DecodeInjectorAck parses injector ack from payload
+func DecodeInjectorAck(data []byte) (*InjectorAckPayload, error) {
+	if len(data) < 5 {
+		return nil, fmt.Errorf("injector ack too short: %d bytes", len(data))
+	}
+	return &InjectorAckPayload{
+		ActuatorAddr: data[0],
+		CommandID:    binary.LittleEndian.Uint16(data[1:3]),
+		Running:      data[3] != 0,
+		Success:      data[4] != 0,
+	}, nil
+}
+
+// ScheduleAckPayload confirms a valve controller has stored a schedule
+type ScheduleAckPayload struct {
+	Version    uint16 // Version of the schedule now stored
+	Status     uint8  // 0 = OK, non-zero = error
+	EntryCount uint8  // Entries stored
+}
+
+// Encode serializes schedule ack payload
+func (p *ScheduleAckPayload) Encode() []byte {
+	buf := make([]byte, 4)
+	binary.LittleEndian.PutUint16(buf[0:2], p.Version)
+	buf[2] = p.Status
+	buf[3] = p.EntryCount
+	return buf
+}
+
+// DecodeScheduleAck parses schedule ack from payload
+func DecodeScheduleAck(data []byte) (*ScheduleAckPayload, error) {
+	if len(data) < 4 {
+		return nil, fmt.Errorf("schedule ack too short: %d bytes", len(data))
+	}
+	return &ScheduleAckPayload{
+		Version:    binary.LittleEndian.Uint16(data[0:2]),
+		Status:     data[2],
+		EntryCount: data[3],
+	}, nil
+}
+
 // ScheduleEntry represents a single schedule entry
 type ScheduleEntry struct {
 	DayMask      uint8  // Bit mask for days (bit 0 = Sunday, bit 6 = Saturday)
@@ -492,3 +1061,283 @@ func (p *TimeSyncPayload) Encode() []byte {
 	buf[4] = byte(p.UTCOffset)
 	return buf
 }
+
+// TimeSyncAckPayload confirms a device applied a time sync. Devices that
+// support it answer broadcast and unicast syncs after a random delay.
+type TimeSyncAckPayload struct {
+	SyncTimestamp uint32 // Unix timestamp from the time sync that was applied
+	DeviceTime    uint32 // Device RTC time when the sync arrived, before correction
+}
+
+// Encode serializes time sync ack payload
+func (p *TimeSyncAckPayload) Encode() []byte {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint32(buf[0:4], p.SyncTimestamp)
+	binary.LittleEndian.PutUint32(buf[4:8], p.DeviceTime)
+	return buf
+}
+
+// Skew returns how far the device clock was ahead of the controller's
+// (negative if behind)
+func (p *TimeSyncAckPayload) Skew() time.Duration {
+	return time.Duration(int64(p.DeviceTime)-int64(p.SyncTimestamp)) * time.Second
+}
+
+// DecodeTimeSyncAck parses time sync ack from payload
+func DecodeTimeSyncAck(data []byte) (*TimeSyncAckPayload, error) {
+	if len(data) < 8 {
+		return nil, fmt.Errorf("time sync ack too short: %d bytes", len(data))
+	}
+	return &TimeSyncAckPayload{
+		SyncTimestamp: binary.LittleEndian.Uint32(data[0:4]),
+		DeviceTime:    binary.LittleEndian.Uint32(data[4:8]),
+	}, nil
+}
+
+// KeyRotatePayload delivers a new AES-128 key to a device. The message
+// itself is encrypted under the device's current key.
+type KeyRotatePayload struct {
+	KeyID uint8    // Identifier of the new key, echoed in the ack
+	Key   [16]byte // New AES-128 key
+}
+
+// Encode serializes key rotate payload
+func (p *KeyRotatePayload) Encode() []byte {
+	buf := make([]byte, 17)
+	buf[0] = p.KeyID
+	copy(buf[1:17], p.Key[:])
+	return buf
+}
+
+// DecodeKeyRotate parses key rotate from payload
+func DecodeKeyRotate(data []byte) (*KeyRotatePayload, error) {
+	if len(data) < 17 {
+		return nil, fmt.Errorf("key rotate too short: %d bytes", len(data))
+	}
+	p := &KeyRotatePayload{KeyID: data[0]}
+	copy(p.Key[:], data[1:17])
+	return p, nil
+}
+
+// KeyRotateAckPayload confirms a device has installed a new key
+type KeyRotateAckPayload struct {
+	KeyID  uint8 // Identifier of the installed key
+	Status uint8 // 0 = OK, non-zero = error
+}
+
+// Encode serializes key rotate ack payload
+func (p *KeyRotateAckPayload) Encode() []byte {
+	return []byte{p.KeyID, p.Status}
+}
+
+// DecodeKeyRotateAck parses key rotate ack from payload
+func DecodeKeyRotateAck(data []byte) (*KeyRotateAckPayload, error) {
+	if len(data) < 2 {
+		return nil, fmt.Errorf("key rotate ack too short: %d bytes", len(data))
+	}
+	return &KeyRotateAckPayload{
+		KeyID:  data[0],
+		Status: data[1],
+	}, nil
+}
+
+// ReportIntervalPayload sets a soil sensor's or water meter's report
+// interval. It is sent as a config update and shares its first fields with
+// MeterConfigPayload; devices leave their other settings alone when given
+// only these.
+type ReportIntervalPayload struct {
+	ConfigVersion     uint16 // Echoed in the config ack
+	ReportIntervalSec uint16 // Report interval in seconds, 0 for the device default
+}
+
+// Encode serializes report interval payload
+func (p *ReportIntervalPayload) Encode() []byte {
+	buf := make([]byte, 4)
+	binary.LittleEndian.PutUint16(buf[0:2], p.ConfigVersion)
+	binary.LittleEndian.PutUint16(buf[2:4], p.ReportIntervalSec)
+	return buf
+}
+
+// ConfigAckPayload confirms a device has applied a report interval
+type ConfigAckPayload struct {
+	ConfigVersion     uint16 // Version of the applied config
+	Status            uint8  // 0 = OK, non-zero = error
+	ReportIntervalSec uint16 // Interval now in use
+}
+
+// Encode serializes config ack payload
+func (p *ConfigAckPayload) Encode() []byte {
+	buf := make([]byte, 5)
+	binary.LittleEndian.PutUint16(buf[0:2], p.ConfigVersion)
+	buf[2] = p.Status
+	binary.LittleEndian.PutUint16(buf[3:5], p.ReportIntervalSec)
+	return buf
+}
+
+// DecodeConfigAck parses config ack from payload
+func DecodeConfigAck(data []byte) (*ConfigAckPayload, error) {
+	if len(data) < 5 {
+		return nil, fmt.Errorf("config ack too short: %d bytes", len(data))
+	}
+	return &ConfigAckPayload{
+		ConfigVersion:     binary.LittleEndian.Uint16(data[0:2]),
+		Status:            data[2],
+		ReportIntervalSec: binary.LittleEndian.Uint16(data[3:5]),
+	}, nil
+}
+
+// Log severities of firmware log entries
+const (
+	LogSeverityDebug   uint8 = 0
+	LogSeverityInfo    uint8 = 1
+	LogSeverityWarning uint8 = 2
+	LogSeverityError   uint8 = 3
+)
+
+var logSeverityNames = []string{"debug", "info", "warning", "error"}
+
+// LogSeverityString returns the name of a log severity
+func LogSeverityString(severity uint8) string {
+	if int(severity) < len(logSeverityNames) {
+		return logSeverityNames[severity]
+	}
+	return fmt.Sprintf("0x%02X", severity)
+}
+
+// ParseLogSeverity returns the log severity with a name
+func ParseLogSeverity(name string) (uint8, error) {
+	for i, s := range logSeverityNames {
+		if s == name {
+			return uint8(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log severity %q (debug, info, warning, or error)", name)
+}
+
+// Log batch entry field sizes
+const (
+	logEntryHeaderSize = 9   // Timestamp, severity, type, code, message length
+	LogMessageMaxLen   = 255 // Longest entry message
+)
+
+// LogEntry is one entry of a device's firmware log
+type LogEntry struct {
+	Timestamp uint32 // Device RTC time the entry was logged, 0 if the clock wasn't set
+	Severity  uint8
+	Type      uint8  // Firmware log entry type (AGSYS_LOG_TYPE_*)
+	Code      uint16 // Firmware event or error code
+	Message   string
+}
+
+// LogBatchPayload carries entries of a device's firmware log, oldest first.
+// Devices send a batch when asked with AckFlagSendLogs, and free the entries
+// once it is acked. A batch too large for a frame is fragmented.
+type LogBatchPayload struct {
+	Remaining uint8 // Entries still held after this batch (255 for 255 or more)
+	Entries   []LogEntry
+}
+
+// Encode serializes log batch payload
+func (p *LogBatchPayload) Encode() []byte {
+	buf := []byte{uint8(len(p.Entries)), p.Remaining}
+	for _, entry := range p.Entries {
+		msg := entry.Message
+		if len(msg) > LogMessageMaxLen {
+			msg = msg[:LogMessageMaxLen]
+		}
+		var hdr [logEntryHeaderSize]byte
+		binary.LittleEndian.PutUint32(hdr[0:4], entry.Timestamp)
+		hdr[4] = entry.Severity
+		hdr[5] = entry.Type
+		binary.LittleEndian.PutUint16(hdr[6:8], entry.Code)
+		hdr[8] = uint8(len(msg))
+		buf = append(buf, hdr[:]...)
+		buf = append(buf, msg...)
+	}
+	return buf
+}
+
+// DecodeLogBatch parses log batch from payload
+func DecodeLogBatch(data []byte) (*LogBatchPayload, error) {
+	if len(data) < 2 {
+		return nil, fmt.Errorf("log batch too short: %d bytes", len(data))
+	}
+	count := int(data[0])
+	p := &LogBatchPayload{Remaining: data[1], Entries: make([]LogEntry, 0, count)}
+
+	off := 2
+	for i := 0; i < count; i++ {
+		if len(data) < off+logEntryHeaderSize {
+			return nil, fmt.Errorf("log batch entry %d truncated", i)
+		}
+		hdr := data[off : off+logEntryHeaderSize]
+		msgLen := int(hdr[8])
+		off += logEntryHeaderSize
+		if len(data) < off+msgLen {
+			return nil, fmt.Errorf("log batch entry %d message truncated", i)
+		}
+		p.Entries = append(p.Entries, LogEntry{
+			Timestamp: binary.LittleEndian.Uint32(hdr[0:4]),
+			Severity:  hdr[4],
+			Type:      hdr[5],
+			Code:      binary.LittleEndian.Uint16(hdr[6:8]),
+			Message:   string(data[off : off+msgLen]),
+		})
+		off += msgLen
+	}
+	return p, nil
+}
+
+// DebugCommandPayload carries a diagnostic command the controller passes
+// through without interpreting, so vendor support can query device internals
+// without a controller release per command. Its meaning is up to the
+// device's firmware.
+type DebugCommandPayload struct {
+	RequestID uint16 // Echoed in the reply
+	Data      []byte
+}
+
+// Encode serializes debug command payload
+func (p *DebugCommandPayload) Encode() []byte {
+	buf := make([]byte, 2, 2+len(p.Data))
+	binary.LittleEndian.PutUint16(buf[0:2], p.RequestID)
+	return append(buf, p.Data...)
+}
+
+// DecodeDebugCommand parses debug command from payload
+func DecodeDebugCommand(data []byte) (*DebugCommandPayload, error) {
+	if len(data) < 2 {
+		return nil, fmt.Errorf("debug command too short: %d bytes", len(data))
+	}
+	return &DebugCommandPayload{
+		RequestID: binary.LittleEndian.Uint16(data[0:2]),
+		Data:      append([]byte(nil), data[2:]...),
+	}, nil
+}
+
+// DebugReplyPayload is a device's answer to a diagnostic command
+type DebugReplyPayload struct {
+	RequestID uint16 // Request ID of the command answered
+	Status    uint8  // 0 = OK, non-zero = error code defined by the firmware
+	Data      []byte
+}
+
+// Encode serializes debug reply payload
+func (p *DebugReplyPayload) Encode() []byte {
+	buf := make([]byte, 3, 3+len(p.Data))
+	binary.LittleEndian.PutUint16(buf[0:2], p.RequestID)
+	buf[2] = p.Status
+	return append(buf, p.Data...)
+}
+
+// DecodeDebugReply parses debug reply from payload
+func DecodeDebugReply(data []byte) (*DebugReplyPayload, error) {
+	if len(data) < 3 {
+		return nil, fmt.Errorf("debug reply too short: %d bytes", len(data))
+	}
+	return &DebugReplyPayload{
+		RequestID: binary.LittleEndian.Uint16(data[0:2]),
+		Status:    data[2],
+		Data:      append([]byte(nil), data[3:]...),
+	}, nil
+}
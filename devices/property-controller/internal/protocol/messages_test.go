@@ -2,7 +2,10 @@ package protocol
 
 import (
 	"bytes"
+	"encoding/hex"
+	"reflect"
 	"testing"
+	"time"
 )
 
 // TestMeterAlarmEncodeDecode tests MeterAlarm payload encoding/decoding roundtrip
@@ -178,6 +181,126 @@ func TestMeterResetEncodeDecode(t *testing.T) {
 	}
 }
 
+// TestTimeSyncAckEncodeDecode tests time sync ack roundtrip and skew
+func TestTimeSyncAckEncodeDecode(t *testing.T) {
+	tests := []struct {
+		name string
+		ack  TimeSyncAckPayload
+		skew time.Duration
+	}{
+		{"in sync", TimeSyncAckPayload{SyncTimestamp: 1700000000, DeviceTime: 1700000000}, 0},
+		{"device ahead", TimeSyncAckPayload{SyncTimestamp: 1700000000, DeviceTime: 1700000042}, 42 * time.Second},
+		{"device behind", TimeSyncAckPayload{SyncTimestamp: 1700000000, DeviceTime: 1699999990}, -10 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decoded, err := DecodeTimeSyncAck(tt.ack.Encode())
+			if err != nil {
+				t.Fatalf("DecodeTimeSyncAck failed: %v", err)
+			}
+			if *decoded != tt.ack {
+				t.Errorf("TimeSyncAck mismatch: got %+v, want %+v", *decoded, tt.ack)
+			}
+			if decoded.Skew() != tt.skew {
+				t.Errorf("Skew = %s, want %s", decoded.Skew(), tt.skew)
+			}
+		})
+	}
+}
+
+// TestKeyRotateEncodeDecode tests key rotation payload roundtrips
+func TestKeyRotateEncodeDecode(t *testing.T) {
+	rotate := KeyRotatePayload{KeyID: 7}
+	for i := range rotate.Key {
+		rotate.Key[i] = byte(i * 11)
+	}
+
+	encoded := rotate.Encode()
+	if len(encoded) != 17 {
+		t.Fatalf("Encoded length wrong: got %d, want 17", len(encoded))
+	}
+	decoded, err := DecodeKeyRotate(encoded)
+	if err != nil {
+		t.Fatalf("DecodeKeyRotate failed: %v", err)
+	}
+	if *decoded != rotate {
+		t.Errorf("KeyRotate mismatch: got %+v, want %+v", *decoded, rotate)
+	}
+
+	ack := KeyRotateAckPayload{KeyID: 7, Status: 0}
+	decodedAck, err := DecodeKeyRotateAck(ack.Encode())
+	if err != nil {
+		t.Fatalf("DecodeKeyRotateAck failed: %v", err)
+	}
+	if *decodedAck != ack {
+		t.Errorf("KeyRotateAck mismatch: got %+v, want %+v", *decodedAck, ack)
+	}
+
+	if _, err := DecodeKeyRotateAck([]byte{7}); err == nil {
+		t.Error("DecodeKeyRotateAck should reject short payload")
+	}
+}
+
+// TestSoilReportEncodeDecode tests multi-probe SoilReport payload roundtrip
+func TestSoilReportEncodeDecode(t *testing.T) {
+	tests := []struct {
+		name   string
+		report SoilReportPayload
+	}{
+		{
+			name: "single probe",
+			report: SoilReportPayload{
+				Timestamp:   3600,
+				ProbeCount:  1,
+				Probes:      [MaxProbes]ProbeReading{{ProbeIndex: 0, FrequencyHz: 42000, MoisturePercent: 35}},
+				BatteryMV:   3300,
+				Temperature: 215,
+				Flags:       SensorFlagFirstBoot,
+				FWVersion:   [3]uint8{1, 2, 3},
+				BootReason:  1,
+			},
+		},
+		{
+			name: "four probes",
+			report: SoilReportPayload{
+				Timestamp:  86400,
+				ProbeCount: 4,
+				Probes: [MaxProbes]ProbeReading{
+					{ProbeIndex: 0, FrequencyHz: 41000, MoisturePercent: 20},
+					{ProbeIndex: 1, FrequencyHz: 43000, MoisturePercent: 30},
+					{ProbeIndex: 2, FrequencyHz: 45000, MoisturePercent: 40},
+					{ProbeIndex: 3, FrequencyHz: 47000, MoisturePercent: 50},
+				},
+				BatteryMV:   2900,
+				Temperature: -50,
+				PendingLogs: 7,
+				Flags:       SensorFlagLowBattery | SensorFlagHasPendingLogs,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded := tt.report.Encode()
+			if len(encoded) != SoilReportSize {
+				t.Fatalf("Encoded length wrong: got %d, want %d", len(encoded), SoilReportSize)
+			}
+
+			decoded, err := DecodeSoilReport(encoded)
+			if err != nil {
+				t.Fatalf("DecodeSoilReport failed: %v", err)
+			}
+			if *decoded != tt.report {
+				t.Errorf("Roundtrip mismatch:\n got  %+v\n want %+v", *decoded, tt.report)
+			}
+			if len(decoded.ValidProbes()) != int(tt.report.ProbeCount) {
+				t.Errorf("ValidProbes length: got %d, want %d", len(decoded.ValidProbes()), tt.report.ProbeCount)
+			}
+		})
+	}
+}
+
 // TestAckEncodeDecode tests Ack payload roundtrip
 func TestAckEncodeDecode(t *testing.T) {
 	ack := AckPayload{
@@ -262,6 +385,9 @@ func TestMessageTypeConstants(t *testing.T) {
 	if MsgTypeMeterAlarm != 0x31 {
 		t.Errorf("MsgTypeMeterAlarm = 0x%02X, want 0x31", MsgTypeMeterAlarm)
 	}
+	if MsgTypeMeterCalibrateReq != 0x32 {
+		t.Errorf("MsgTypeMeterCalibrateReq = 0x%02X, want 0x32", MsgTypeMeterCalibrateReq)
+	}
 	if MsgTypeMeterResetTotal != 0x33 {
 		t.Errorf("MsgTypeMeterResetTotal = 0x%02X, want 0x33", MsgTypeMeterResetTotal)
 	}
@@ -331,6 +457,18 @@ func TestDecodeErrors(t *testing.T) {
 		t.Error("DecodeMeterAlarm should fail with short data")
 	}
 
+	// Too short for SoilReport
+	_, err = DecodeSoilReport(make([]byte, 8))
+	if err == nil {
+		t.Error("DecodeSoilReport should fail with short data")
+	}
+
+	// Invalid probe count for SoilReport
+	_, err = DecodeSoilReport(make([]byte, SoilReportSize))
+	if err == nil {
+		t.Error("DecodeSoilReport should fail with zero probes")
+	}
+
 	// Too short for Ack
 	_, err = DecodeAck(make([]byte, 2))
 	if err == nil {
@@ -355,3 +493,207 @@ func TestDecodeErrors(t *testing.T) {
 		t.Error("Header.IsValid() should return false for invalid magic bytes")
 	}
 }
+
+// TestFrameCRC tests the trailing frame CRC of protocol version 2
+func TestFrameCRC(t *testing.T) {
+	// CRC-16/CCITT-FALSE check value
+	if crc := CRC16([]byte("123456789")); crc != 0x29B1 {
+		t.Errorf("CRC16 check = %04X, want 29B1", crc)
+	}
+
+	msg := &LoRaMessage{
+		Header: Header{
+			Magic:      [2]byte{MagicByte1, MagicByte2},
+			Version:    ProtocolVersionCRC,
+			MsgType:    0x30,
+			DeviceType: 0x02,
+			DeviceUID:  [8]byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08},
+			Sequence:   0x1234,
+		},
+		Payload: []byte{0x0A, 0x00, 0x00, 0x00},
+	}
+	encoded := msg.Encode()
+	if got, want := hex.EncodeToString(encoded), "4147023002010203040506070834120a0000002ec6"; got != want {
+		t.Errorf("Encoded frame = %s, want %s", got, want)
+	}
+
+	decoded, err := Decode(encoded)
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	if !bytes.Equal(decoded.Payload, msg.Payload) {
+		t.Errorf("Payload = %X, want %X (CRC not stripped?)", decoded.Payload, msg.Payload)
+	}
+
+	corrupt := bytes.Clone(encoded)
+	corrupt[HeaderSize] ^= 0x01
+	if _, err := Decode(corrupt); err == nil {
+		t.Error("Expected error for corrupted frame")
+	}
+	if _, err := Decode(encoded[:HeaderSize+1]); err == nil {
+		t.Error("Expected error for frame too short for its CRC")
+	}
+
+	// Version 1 frames carry no CRC
+	msg.Header.Version = ProtocolVersion
+	if encoded := msg.Encode(); len(encoded) != HeaderSize+len(msg.Payload) {
+		t.Errorf("Version 1 frame is %d bytes, want %d", len(encoded), HeaderSize+len(msg.Payload))
+	}
+}
+
+// TestInjectorEncodeDecode tests injector command and ack roundtrips
+func TestInjectorEncodeDecode(t *testing.T) {
+	cmd := InjectorCommandPayload{ActuatorAddr: 9, Command: InjectorCmdStart, CommandID: 0x1234, MaxRunSec: 900}
+	encoded := cmd.Encode()
+	if len(encoded) != 6 {
+		t.Fatalf("Encoded length wrong: got %d, want 6", len(encoded))
+	}
+	decoded, err := DecodeInjectorCommand(encoded)
+	if err != nil {
+		t.Fatalf("DecodeInjectorCommand failed: %v", err)
+	}
+	if *decoded != cmd {
+		t.Errorf("InjectorCommand mismatch: got %+v, want %+v", *decoded, cmd)
+	}
+
+	ack := InjectorAckPayload{ActuatorAddr: 9, CommandID: 0x1234, Running: true, Success: true}
+	decodedAck, err := DecodeInjectorAck(ack.Encode())
+	if err != nil {
+		t.Fatalf("DecodeInjectorAck failed: %v", err)
+	}
+	if *decodedAck != ack {
+		t.Errorf("InjectorAck mismatch: got %+v, want %+v", *decodedAck, ack)
+	}
+
+	if _, err := DecodeInjectorAck([]byte{9, 0x34}); err == nil {
+		t.Error("DecodeInjectorAck should reject short payload")
+	}
+}
+
+// TestReportIntervalEncodeDecode tests the report interval config and its ack
+func TestReportIntervalEncodeDecode(t *testing.T) {
+	cfg := ReportIntervalPayload{ConfigVersion: 0x0102, ReportIntervalSec: 3600}
+	encoded := cfg.Encode()
+	meter := MeterConfigPayload{ConfigVersion: 0x0102, ReportIntervalSec: 3600}
+	if !bytes.Equal(encoded, meter.Encode()[:4]) {
+		t.Errorf("Report interval %X is not a prefix of meter config %X", encoded, meter.Encode())
+	}
+
+	ack := ConfigAckPayload{ConfigVersion: 0x0102, Status: 0, ReportIntervalSec: 3600}
+	decoded, err := DecodeConfigAck(ack.Encode())
+	if err != nil {
+		t.Fatalf("DecodeConfigAck failed: %v", err)
+	}
+	if *decoded != ack {
+		t.Errorf("ConfigAck mismatch: got %+v, want %+v", *decoded, ack)
+	}
+	if _, err := DecodeConfigAck(encoded); err == nil {
+		t.Error("Expected error for short config ack")
+	}
+}
+
+// TestLogBatchEncodeDecode tests log batch roundtrips and truncated batches
+func TestLogBatchEncodeDecode(t *testing.T) {
+	batch := LogBatchPayload{
+		Remaining: 3,
+		Entries: []LogEntry{
+			{Timestamp: 1700000000, Severity: LogSeverityError, Type: 0x07, Code: 0x0102, Message: "FRAM CRC mismatch"},
+			{Timestamp: 0, Severity: LogSeverityInfo, Type: 0x06, Code: 1, Message: ""},
+		},
+	}
+	encoded := batch.Encode()
+	decoded, err := DecodeLogBatch(encoded)
+	if err != nil {
+		t.Fatalf("DecodeLogBatch failed: %v", err)
+	}
+	if !reflect.DeepEqual(*decoded, batch) {
+		t.Errorf("LogBatch mismatch: got %+v, want %+v", *decoded, batch)
+	}
+
+	if _, err := DecodeLogBatch(encoded[:len(encoded)-logEntryHeaderSize-1]); err == nil {
+		t.Error("DecodeLogBatch should reject a truncated entry")
+	}
+	if _, err := DecodeLogBatch(encoded[:12]); err == nil {
+		t.Error("DecodeLogBatch should reject a truncated message")
+	}
+
+	if s, err := ParseLogSeverity(LogSeverityString(LogSeverityWarning)); err != nil || s != LogSeverityWarning {
+		t.Errorf("ParseLogSeverity(warning) = %d, %v", s, err)
+	}
+	if _, err := ParseLogSeverity("fatal"); err == nil {
+		t.Error("ParseLogSeverity should reject unknown names")
+	}
+}
+
+// TestDebugCommandEncodeDecode tests diagnostic command and reply roundtrips
+func TestDebugCommandEncodeDecode(t *testing.T) {
+	cmd := DebugCommandPayload{RequestID: 0x0102, Data: []byte{0x10, 0x00, 0xFF}}
+	decodedCmd, err := DecodeDebugCommand(cmd.Encode())
+	if err != nil {
+		t.Fatalf("DecodeDebugCommand failed: %v", err)
+	}
+	if !reflect.DeepEqual(*decodedCmd, cmd) {
+		t.Errorf("DebugCommand mismatch: got %+v, want %+v", *decodedCmd, cmd)
+	}
+
+	reply := DebugReplyPayload{RequestID: 0x0102, Status: 0, Data: []byte("rtc ok")}
+	decodedReply, err := DecodeDebugReply(reply.Encode())
+	if err != nil {
+		t.Fatalf("DecodeDebugReply failed: %v", err)
+	}
+	if !reflect.DeepEqual(*decodedReply, reply) {
+		t.Errorf("DebugReply mismatch: got %+v, want %+v", *decodedReply, reply)
+	}
+	if empty, err := DecodeDebugReply([]byte{2, 1, 5}); err != nil || len(empty.Data) != 0 || empty.Status != 5 {
+		t.Errorf("Empty DebugReply = %+v, %v", empty, err)
+	}
+	if _, err := DecodeDebugReply([]byte{2, 1}); err == nil {
+		t.Error("DecodeDebugReply should reject short payload")
+	}
+}
+
+func TestMeterPinEncodeDecode(t *testing.T) {
+	cmd := MeterPinPayload{CommandID: 0x1234, Action: MeterPinShutoff}
+	decodedCmd, err := DecodeMeterPin(cmd.Encode())
+	if err != nil {
+		t.Fatalf("DecodeMeterPin failed: %v", err)
+	}
+	if *decodedCmd != cmd {
+		t.Errorf("MeterPin mismatch: got %+v, want %+v", *decodedCmd, cmd)
+	}
+
+	ack := MeterPinAckPayload{CommandID: 0x1234, Status: 0, ValveState: MeterValveClosed}
+	decodedAck, err := DecodeMeterPinAck(ack.Encode())
+	if err != nil {
+		t.Fatalf("DecodeMeterPinAck failed: %v", err)
+	}
+	if *decodedAck != ack {
+		t.Errorf("MeterPinAck mismatch: got %+v, want %+v", *decodedAck, ack)
+	}
+	if _, err := DecodeMeterPinAck([]byte{0x34, 0x12, 0}); err == nil {
+		t.Error("DecodeMeterPinAck should reject short payload")
+	}
+}
+
+func TestMeterCalibrateEncodeDecode(t *testing.T) {
+	req := MeterCalibrateReqPayload{SessionID: 0x0203, Action: MeterCalFinish}
+	decodedReq, err := DecodeMeterCalibrateReq(req.Encode())
+	if err != nil {
+		t.Fatalf("DecodeMeterCalibrateReq failed: %v", err)
+	}
+	if *decodedReq != req {
+		t.Errorf("MeterCalibrateReq mismatch: got %+v, want %+v", *decodedReq, req)
+	}
+
+	ack := MeterCalibrateAckPayload{SessionID: 0x0203, Action: MeterCalFinish, Status: 0, Pulses: 112500}
+	decodedAck, err := DecodeMeterCalibrateAck(ack.Encode())
+	if err != nil {
+		t.Fatalf("DecodeMeterCalibrateAck failed: %v", err)
+	}
+	if *decodedAck != ack {
+		t.Errorf("MeterCalibrateAck mismatch: got %+v, want %+v", *decodedAck, ack)
+	}
+	if _, err := DecodeMeterCalibrateAck(ack.Encode()[:7]); err == nil {
+		t.Error("DecodeMeterCalibrateAck should reject short payload")
+	}
+}
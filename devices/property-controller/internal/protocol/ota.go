@@ -0,0 +1,181 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// OTA capability flags, sent by the device in the first reserved byte of its
+// OTA request. Older firmware leaves the reserved bytes zero.
+const (
+	OTACapWindowed uint8 = 1 << 0 // Buffers out-of-order chunks and reports a received bitmap
+)
+
+// MaxOTAWindow is the most chunks a windowed transfer keeps in flight, the
+// bits in one bitmap
+const MaxOTAWindow = 64
+
+// OTACapabilities returns the capability flags and the largest window the
+// device can buffer from an OTA request payload. A window of 0 leaves the
+// size to the controller.
+func OTACapabilities(request []byte) (caps uint8, window uint8) {
+	if len(request) < 6 {
+		return 0, 0
+	}
+	return request[4], request[5]
+}
+
+// OTABitmapPayload reports which chunks of a window a device has received.
+// Bit i of the bitmap, least significant bit first, is chunk BaseChunk+i.
+// Devices report from their first missing chunk, so every chunk before
+// BaseChunk has been received.
+type OTABitmapPayload struct {
+	BaseChunk uint16 // First chunk covered
+	Count     uint8  // Chunks covered
+	Bitmap    []byte // (Count+7)/8 bytes
+}
+
+// Encode serializes the bitmap
+func (p *OTABitmapPayload) Encode() []byte {
+	buf := make([]byte, 3+len(p.Bitmap))
+	binary.LittleEndian.PutUint16(buf[0:2], p.BaseChunk)
+	buf[2] = p.Count
+	copy(buf[3:], p.Bitmap)
+	return buf
+}
+
+// DecodeOTABitmap parses a received bitmap
+func DecodeOTABitmap(data []byte) (*OTABitmapPayload, error) {
+	if len(data) < 3 {
+		return nil, fmt.Errorf("OTA bitmap too short: %d bytes", len(data))
+	}
+	p := &OTABitmapPayload{
+		BaseChunk: binary.LittleEndian.Uint16(data[0:2]),
+		Count:     data[2],
+	}
+	if p.Count > MaxOTAWindow {
+		return nil, fmt.Errorf("OTA bitmap covers %d chunks, max %d", p.Count, MaxOTAWindow)
+	}
+	size := (int(p.Count) + 7) / 8
+	if len(data) < 3+size {
+		return nil, fmt.Errorf("OTA bitmap of %d chunks too short: %d bytes", p.Count, len(data))
+	}
+	p.Bitmap = append([]byte{}, data[3:3+size]...)
+	return p, nil
+}
+
+// Received reports whether chunk BaseChunk+i has been received
+func (p *OTABitmapPayload) Received(i int) bool {
+	if i < 0 || i >= int(p.Count) {
+		return false
+	}
+	return p.Bitmap[i/8]&(1<<(i%8)) != 0
+}
+
+// OTASessionPayload announces a multicast OTA session to every device of a
+// type. Devices that want the update join within the listen window, then
+// receive the chunks broadcast one every chunk interval.
+type OTASessionPayload struct {
+	SessionID       uint8
+	DeviceType      uint8
+	VersionMajor    uint8
+	VersionMinor    uint8
+	VersionPatch    uint8
+	HWRevisionMin   uint8
+	FirmwareSize    uint32
+	ChunkCount      uint16
+	ChunkSize       uint16
+	FirmwareCRC     uint32
+	ListenSec       uint16 // Seconds until chunks start
+	ChunkIntervalMs uint16 // Time between broadcast chunks
+}
+
+// OTASessionSize is the size of an encoded session announce
+const OTASessionSize = 22
+
+// Encode serializes the session announce
+func (p *OTASessionPayload) Encode() []byte {
+	buf := make([]byte, OTASessionSize)
+	buf[0] = p.SessionID
+	buf[1] = p.DeviceType
+	buf[2] = p.VersionMajor
+	buf[3] = p.VersionMinor
+	buf[4] = p.VersionPatch
+	buf[5] = p.HWRevisionMin
+	binary.LittleEndian.PutUint32(buf[6:10], p.FirmwareSize)
+	binary.LittleEndian.PutUint16(buf[10:12], p.ChunkCount)
+	binary.LittleEndian.PutUint16(buf[12:14], p.ChunkSize)
+	binary.LittleEndian.PutUint32(buf[14:18], p.FirmwareCRC)
+	binary.LittleEndian.PutUint16(buf[18:20], p.ListenSec)
+	binary.LittleEndian.PutUint16(buf[20:22], p.ChunkIntervalMs)
+	return buf
+}
+
+// DecodeOTASession parses a session announce
+func DecodeOTASession(data []byte) (*OTASessionPayload, error) {
+	if len(data) < OTASessionSize {
+		return nil, fmt.Errorf("OTA session too short: %d bytes", len(data))
+	}
+	return &OTASessionPayload{
+		SessionID:       data[0],
+		DeviceType:      data[1],
+		VersionMajor:    data[2],
+		VersionMinor:    data[3],
+		VersionPatch:    data[4],
+		HWRevisionMin:   data[5],
+		FirmwareSize:    binary.LittleEndian.Uint32(data[6:10]),
+		ChunkCount:      binary.LittleEndian.Uint16(data[10:12]),
+		ChunkSize:       binary.LittleEndian.Uint16(data[12:14]),
+		FirmwareCRC:     binary.LittleEndian.Uint32(data[14:18]),
+		ListenSec:       binary.LittleEndian.Uint16(data[18:20]),
+		ChunkIntervalMs: binary.LittleEndian.Uint16(data[20:22]),
+	}, nil
+}
+
+// OTAJoinPayload is a device's request to join a multicast session
+type OTAJoinPayload struct {
+	SessionID    uint8
+	CurrentMajor uint8
+	CurrentMinor uint8
+	CurrentPatch uint8
+	HWRevision   uint8
+	MaxWindow    uint8 // Chunks the device can buffer for repairs, 0 for the controller default
+}
+
+// Encode serializes the join request
+func (p *OTAJoinPayload) Encode() []byte {
+	return []byte{p.SessionID, p.CurrentMajor, p.CurrentMinor, p.CurrentPatch, p.HWRevision, p.MaxWindow}
+}
+
+// DecodeOTAJoin parses a join request
+func DecodeOTAJoin(data []byte) (*OTAJoinPayload, error) {
+	if len(data) < 6 {
+		return nil, fmt.Errorf("OTA join too short: %d bytes", len(data))
+	}
+	return &OTAJoinPayload{
+		SessionID:    data[0],
+		CurrentMajor: data[1],
+		CurrentMinor: data[2],
+		CurrentPatch: data[3],
+		HWRevision:   data[4],
+		MaxWindow:    data[5],
+	}, nil
+}
+
+// OTAMulticastChunkPayload is a firmware chunk broadcast to a session
+type OTAMulticastChunkPayload struct {
+	SessionID  uint8
+	ChunkIndex uint16
+	Data       []byte
+}
+
+// Encode serializes the chunk: the session ID followed by the same layout
+// as a unicast chunk
+func (p *OTAMulticastChunkPayload) Encode() []byte {
+	buf := make([]byte, 5+len(p.Data))
+	buf[0] = p.SessionID
+	binary.LittleEndian.PutUint16(buf[1:3], p.ChunkIndex)
+	binary.LittleEndian.PutUint16(buf[3:5], uint16(len(p.Data)))
+	copy(buf[5:], p.Data)
+	return buf
+}
@@ -0,0 +1,88 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestOTABitmap tests the received bitmap roundtrip and bounds
+func TestOTABitmap(t *testing.T) {
+	p := &OTABitmapPayload{BaseChunk: 300, Count: 10, Bitmap: []byte{0b10110101, 0b10}}
+	decoded, err := DecodeOTABitmap(p.Encode())
+	if err != nil {
+		t.Fatalf("DecodeOTABitmap failed: %v", err)
+	}
+	if decoded.BaseChunk != 300 || decoded.Count != 10 {
+		t.Errorf("Decoded base %d count %d, want 300 and 10", decoded.BaseChunk, decoded.Count)
+	}
+
+	want := []bool{true, false, true, false, true, true, false, true, false, true}
+	for i, w := range want {
+		if got := decoded.Received(i); got != w {
+			t.Errorf("Received(%d) = %t, want %t", i, got, w)
+		}
+	}
+	if decoded.Received(10) {
+		t.Error("Chunk past the count reported received")
+	}
+
+	if _, err := DecodeOTABitmap([]byte{0, 0, 10, 0xFF}); err == nil {
+		t.Error("Expected error for short bitmap")
+	}
+	if _, err := DecodeOTABitmap([]byte{0, 0, MaxOTAWindow + 1}); err == nil {
+		t.Error("Expected error for oversized window")
+	}
+}
+
+// TestOTACapabilities tests reading capabilities from the request's reserved bytes
+func TestOTACapabilities(t *testing.T) {
+	if caps, window := OTACapabilities([]byte{1, 2, 3, 1, OTACapWindowed, 16, 0, 0}); caps != OTACapWindowed || window != 16 {
+		t.Errorf("Capabilities = 0x%02X window %d, want 0x%02X window 16", caps, window, OTACapWindowed)
+	}
+	if caps, _ := OTACapabilities([]byte{1, 2, 3, 1}); caps != 0 {
+		t.Errorf("Short request capabilities = 0x%02X, want 0", caps)
+	}
+}
+
+// TestOTASession tests the multicast session announce and join roundtrips
+func TestOTASession(t *testing.T) {
+	session := &OTASessionPayload{
+		SessionID:       3,
+		DeviceType:      DeviceTypeSoilMoisture,
+		VersionMajor:    1,
+		VersionMinor:    4,
+		VersionPatch:    2,
+		HWRevisionMin:   1,
+		FirmwareSize:    120000,
+		ChunkCount:      600,
+		ChunkSize:       200,
+		FirmwareCRC:     0xDEADBEEF,
+		ListenSec:       120,
+		ChunkIntervalMs: 1500,
+	}
+	encoded := session.Encode()
+	if len(encoded) != OTASessionSize {
+		t.Fatalf("Encoded session is %d bytes, want %d", len(encoded), OTASessionSize)
+	}
+	decoded, err := DecodeOTASession(encoded)
+	if err != nil {
+		t.Fatalf("DecodeOTASession failed: %v", err)
+	}
+	if *decoded != *session {
+		t.Errorf("Decoded session = %+v, want %+v", decoded, session)
+	}
+
+	join := &OTAJoinPayload{SessionID: 3, CurrentMajor: 1, CurrentMinor: 3, HWRevision: 2, MaxWindow: 16}
+	decodedJoin, err := DecodeOTAJoin(join.Encode())
+	if err != nil {
+		t.Fatalf("DecodeOTAJoin failed: %v", err)
+	}
+	if *decodedJoin != *join {
+		t.Errorf("Decoded join = %+v, want %+v", decodedJoin, join)
+	}
+
+	chunk := (&OTAMulticastChunkPayload{SessionID: 3, ChunkIndex: 0x0102, Data: []byte{0xAA, 0xBB}}).Encode()
+	if want := []byte{3, 0x02, 0x01, 0x02, 0x00, 0xAA, 0xBB}; !bytes.Equal(chunk, want) {
+		t.Errorf("Multicast chunk = %X, want %X", chunk, want)
+	}
+}
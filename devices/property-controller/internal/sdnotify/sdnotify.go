@@ -0,0 +1,69 @@
+// Package sdnotify implements the systemd sd_notify protocol so the
+// controller can report readiness and feed the service watchdog.
+// Every call is a no-op when not running under systemd.
+package sdnotify
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Notify sends a state string (e.g. "READY=1") to the systemd notify socket.
+// It returns false without error if NOTIFY_SOCKET is not set.
+func Notify(state string) (bool, error) {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return false, nil
+	}
+
+	// A leading @ means an abstract socket
+	if path[0] == '@' {
+		path = "\x00" + path[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return false, fmt.Errorf("failed to connect to notify socket: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, fmt.Errorf("failed to send notification: %w", err)
+	}
+	return true, nil
+}
+
+// Ready tells systemd that startup is complete
+func Ready() error {
+	_, err := Notify("READY=1")
+	return err
+}
+
+// Stopping tells systemd that shutdown has begun
+func Stopping() error {
+	_, err := Notify("STOPPING=1")
+	return err
+}
+
+// Watchdog resets the systemd watchdog timer
+func Watchdog() error {
+	_, err := Notify("WATCHDOG=1")
+	return err
+}
+
+// WatchdogInterval returns the watchdog timeout configured by systemd
+// (WatchdogSec=), or 0 if the watchdog is not enabled for this process
+func WatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
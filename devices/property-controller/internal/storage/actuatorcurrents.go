@@ -0,0 +1,48 @@
+package storage
+
+import "time"
+
+// InsertActuatorCurrent records the motor current of one valve actuation
+func (db *DB) InsertActuatorCurrent(c *ActuatorCurrent) error {
+	result, err := db.conn.Exec(`INSERT INTO actuator_currents
+		(controller_uid, actuator_addr, state, current_ma, flags, timestamp)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		c.ControllerUID, c.ActuatorAddr, c.State, c.CurrentMA, c.Flags, c.Timestamp)
+	if err != nil {
+		return err
+	}
+	c.ID, err = result.LastInsertId()
+	return err
+}
+
+// GetActuatorCurrents retrieves an actuator's most recent actuations, newest
+// first
+func (db *DB) GetActuatorCurrents(controllerUID string, addr uint8, limit int) ([]*ActuatorCurrent, error) {
+	rows, err := db.conn.Query(`SELECT id, controller_uid, actuator_addr, state, current_ma, flags, timestamp
+		FROM actuator_currents WHERE controller_uid = ? AND actuator_addr = ?
+		ORDER BY id DESC LIMIT ?`, controllerUID, addr, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var currents []*ActuatorCurrent
+	for rows.Next() {
+		c := &ActuatorCurrent{}
+		if err := rows.Scan(&c.ID, &c.ControllerUID, &c.ActuatorAddr, &c.State, &c.CurrentMA, &c.Flags, &c.Timestamp); err != nil {
+			return nil, err
+		}
+		currents = append(currents, c)
+	}
+	return currents, rows.Err()
+}
+
+// DeleteActuatorCurrentsBefore deletes actuations recorded before a time,
+// returning the number removed
+func (db *DB) DeleteActuatorCurrentsBefore(before time.Time) (int64, error) {
+	result, err := db.conn.Exec("DELETE FROM actuator_currents WHERE timestamp < ?", before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
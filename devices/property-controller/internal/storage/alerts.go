@@ -0,0 +1,161 @@
+package storage
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+const alertColumns = `id, device_uid, COALESCE(zone_id, ''), probe_id, alert_type,
+	COALESCE(severity, 'warning'), COALESCE(state, 'active'), COALESCE(message, ''),
+	COALESCE(value, 0), COALESCE(threshold, 0), COALESCE(source_id, 0), COALESCE(count, 1),
+	timestamp, last_seen, acked_at, cleared_at, synced_to_cloud`
+
+// RaiseAlert records an alert. If the same alert is already open for the
+// device and probe, that alert's count, value, and last seen time are updated
+// instead, a is filled in from it, and raised is false.
+func (db *DB) RaiseAlert(a *Alert) (raised bool, err error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	open, err := scanAlert(tx.QueryRow(`SELECT `+alertColumns+` FROM alerts
+		WHERE device_uid = ? AND probe_id = ? AND alert_type = ? AND state != ?
+		ORDER BY id DESC LIMIT 1`, a.DeviceUID, a.ProbeID, a.AlertType, AlertCleared))
+	switch {
+	case err == sql.ErrNoRows:
+		if a.Severity == "" {
+			a.Severity = AlertWarning
+		}
+		a.State, a.Count, a.LastSeen = AlertActive, 1, a.Timestamp
+		result, err := tx.Exec(`INSERT INTO alerts
+			(device_uid, zone_id, probe_id, alert_type, severity, state, message, value, threshold,
+			source_id, count, timestamp, last_seen)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			a.DeviceUID, nullIfEmpty(a.ZoneID), a.ProbeID, a.AlertType, a.Severity, a.State, a.Message,
+			a.Value, a.Threshold, nullIfZero(a.SourceID), a.Count, a.Timestamp, a.LastSeen)
+		if err != nil {
+			return false, err
+		}
+		if a.ID, err = result.LastInsertId(); err != nil {
+			return false, err
+		}
+		return true, tx.Commit()
+	case err != nil:
+		return false, err
+	}
+
+	open.Count++
+	open.Value, open.LastSeen = a.Value, a.Timestamp
+	if _, err := tx.Exec("UPDATE alerts SET count = ?, value = ?, last_seen = ? WHERE id = ?",
+		open.Count, open.Value, open.LastSeen, open.ID); err != nil {
+		return false, err
+	}
+	*a = *open
+	return false, tx.Commit()
+}
+
+// ClearAlerts clears the open alerts of the given types for a device probe,
+// returning the alerts cleared. Cleared alerts are synced to the cloud again.
+func (db *DB) ClearAlerts(deviceUID string, probeID uint8, now time.Time, alertTypes ...string) ([]*Alert, error) {
+	open, err := db.queryAlerts(`SELECT `+alertColumns+` FROM alerts
+		WHERE device_uid = ? AND probe_id = ? AND state != ? AND alert_type IN (?`+
+		strings.Repeat(", ?", len(alertTypes)-1)+`) ORDER BY id`,
+		append([]interface{}{deviceUID, probeID, AlertCleared}, stringArgs(alertTypes)...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, a := range open {
+		if _, err := db.conn.Exec(`UPDATE alerts SET state = ?, cleared_at = ?, synced_to_cloud = 0
+			WHERE id = ?`, AlertCleared, now, a.ID); err != nil {
+			return nil, err
+		}
+		a.State, a.ClearedAt, a.SyncedToCloud = AlertCleared, &now, false
+	}
+	return open, nil
+}
+
+// GetOpenAlerts retrieves alerts that haven't cleared, newest first
+func (db *DB) GetOpenAlerts() ([]*Alert, error) {
+	return db.queryAlerts(`SELECT `+alertColumns+` FROM alerts
+		WHERE state != ? ORDER BY timestamp DESC`, AlertCleared)
+}
+
+// GetOpenDeviceAlerts retrieves a device's alerts that haven't cleared
+func (db *DB) GetOpenDeviceAlerts(deviceUID string) ([]*Alert, error) {
+	return db.queryAlerts(`SELECT `+alertColumns+` FROM alerts
+		WHERE device_uid = ? AND state != ? ORDER BY timestamp DESC`, deviceUID, AlertCleared)
+}
+
+// GetUnsyncedAlerts retrieves alerts not yet synced to cloud
+func (db *DB) GetUnsyncedAlerts(limit int) ([]*Alert, error) {
+	return db.queryAlerts(`SELECT `+alertColumns+` FROM alerts
+		WHERE synced_to_cloud = 0 ORDER BY timestamp LIMIT ?`, limit)
+}
+
+// MarkAlertSynced marks an alert as synced
+func (db *DB) MarkAlertSynced(id int64) error {
+	_, err := db.conn.Exec("UPDATE alerts SET synced_to_cloud = 1 WHERE id = ?", id)
+	return err
+}
+
+// queryAlerts runs a query selecting alertColumns
+func (db *DB) queryAlerts(query string, args ...interface{}) ([]*Alert, error) {
+	rows, err := db.conn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var alerts []*Alert
+	for rows.Next() {
+		a, err := scanAlert(rows)
+		if err != nil {
+			return nil, err
+		}
+		alerts = append(alerts, a)
+	}
+	return alerts, rows.Err()
+}
+
+// scanAlert scans an alerts row
+func scanAlert(row interface{ Scan(...interface{}) error }) (*Alert, error) {
+	a := &Alert{}
+	var lastSeen, ackedAt, clearedAt sql.NullTime
+	if err := row.Scan(&a.ID, &a.DeviceUID, &a.ZoneID, &a.ProbeID, &a.AlertType,
+		&a.Severity, &a.State, &a.Message, &a.Value, &a.Threshold, &a.SourceID, &a.Count,
+		&a.Timestamp, &lastSeen, &ackedAt, &clearedAt, &a.SyncedToCloud); err != nil {
+		return nil, err
+	}
+	a.LastSeen = a.Timestamp
+	if lastSeen.Valid {
+		a.LastSeen = lastSeen.Time
+	}
+	if ackedAt.Valid {
+		a.AckedAt = &ackedAt.Time
+	}
+	if clearedAt.Valid {
+		a.ClearedAt = &clearedAt.Time
+	}
+	return a, nil
+}
+
+// nullIfZero stores an unset optional row ID as NULL
+func nullIfZero(id int64) interface{} {
+	if id == 0 {
+		return nil
+	}
+	return id
+}
+
+// stringArgs converts strings to query arguments
+func stringArgs(values []string) []interface{} {
+	args := make([]interface{}, len(values))
+	for i, v := range values {
+		args[i] = v
+	}
+	return args
+}
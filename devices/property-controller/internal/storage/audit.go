@@ -0,0 +1,84 @@
+package storage
+
+import "time"
+
+const auditColumns = `id, timestamp, kind, device_uid, COALESCE(actuator_addr, 0), command,
+	COALESCE(params, ''), source, COALESCE(actor, ''), COALESCE(cloud_command_id, ''),
+	COALESCE(command_id, 0), outcome, COALESCE(detail, '')`
+
+// InsertCommandAudit appends an entry to the command audit log
+func (db *DB) InsertCommandAudit(a *CommandAudit) (int64, error) {
+	if a.Timestamp.IsZero() {
+		a.Timestamp = time.Now()
+	}
+	result, err := db.conn.Exec(`INSERT INTO command_audit
+		(timestamp, kind, device_uid, actuator_addr, command, params, source, actor,
+		cloud_command_id, command_id, outcome, detail)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		a.Timestamp, a.Kind, a.DeviceUID, a.ActuatorAddr, a.Command, nullIfEmpty(a.Params), a.Source,
+		nullIfEmpty(a.Actor), nullIfEmpty(a.CloudCommandID), nullIfZero(int64(a.CommandID)), a.Outcome,
+		nullIfEmpty(a.Detail))
+	if err != nil {
+		return 0, err
+	}
+	a.ID, err = result.LastInsertId()
+	return a.ID, err
+}
+
+// AppendCommandOutcome records the outcome of a LoRa command, copying the
+// command, source, and actor from the most recent send of that command ID to
+// the device. Returns false if no such send is in the log.
+func (db *DB) AppendCommandOutcome(deviceUID string, commandID uint16, outcome, detail string) (bool, error) {
+	result, err := db.conn.Exec(`INSERT INTO command_audit
+		(timestamp, kind, device_uid, actuator_addr, command, params, source, actor,
+		cloud_command_id, command_id, outcome, detail)
+		SELECT ?, kind, device_uid, actuator_addr, command, params, source, actor,
+			cloud_command_id, command_id, ?, ?
+		FROM command_audit WHERE device_uid = ? AND command_id = ? AND outcome = ?
+		ORDER BY id DESC LIMIT 1`,
+		time.Now(), outcome, nullIfEmpty(detail), deviceUID, commandID, AuditSent)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// GetCommandAudit retrieves the newest audit entries, optionally for one
+// device, newest first
+func (db *DB) GetCommandAudit(deviceUID string, limit int) ([]*CommandAudit, error) {
+	query := `SELECT ` + auditColumns + ` FROM command_audit`
+	var args []interface{}
+	if deviceUID != "" {
+		query += ` WHERE device_uid = ?`
+		args = append(args, deviceUID)
+	}
+	query += ` ORDER BY id DESC LIMIT ?`
+	args = append(args, limit)
+
+	rows, err := db.conn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []*CommandAudit
+	for rows.Next() {
+		a, err := scanCommandAudit(rows)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, a)
+	}
+	return entries, rows.Err()
+}
+
+// scanCommandAudit scans a row selected with auditColumns
+func scanCommandAudit(row interface{ Scan(...interface{}) error }) (*CommandAudit, error) {
+	a := &CommandAudit{}
+	if err := row.Scan(&a.ID, &a.Timestamp, &a.Kind, &a.DeviceUID, &a.ActuatorAddr, &a.Command,
+		&a.Params, &a.Source, &a.Actor, &a.CloudCommandID, &a.CommandID, &a.Outcome, &a.Detail); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Database drivers a DB can store to
+const (
+	DriverSQLite   = "sqlite"
+	DriverPostgres = "postgres"
+)
+
+// Config selects the database a DB stores to
+type Config struct {
+	Driver   string         // DriverSQLite (the default) or DriverPostgres
+	Path     string         // SQLite database file
+	Postgres PostgresConfig // PostgreSQL server, for DriverPostgres
+}
+
+// backend is the database engine behind a DB. Queries throughout the package
+// are written in SQLite's dialect; a backend for another engine opens
+// connections that translate them.
+type backend interface {
+	// driver returns the name the backend is selected by
+	driver() string
+	// open connects to the database
+	open() (*sql.DB, error)
+	// hasColumn reports whether a table has the named column
+	hasColumn(conn *sql.DB, table, column string) (bool, error)
+	// setup runs engine-specific setup once the schema is current
+	setup(conn *sql.DB) error
+}
+
+// newBackend returns the backend cfg selects
+func newBackend(cfg Config) (backend, error) {
+	switch cfg.Driver {
+	case "", DriverSQLite:
+		return sqliteBackend{path: cfg.Path}, nil
+	case DriverPostgres:
+		if cfg.Postgres.DSN == "" {
+			return nil, fmt.Errorf("no PostgreSQL DSN configured")
+		}
+		return newPostgresBackend(cfg.Postgres), nil
+	default:
+		return nil, fmt.Errorf("unknown database driver %q", cfg.Driver)
+	}
+}
+
+// Driver returns the name of the database driver the DB stores to
+func (db *DB) Driver() string {
+	return db.backend.driver()
+}
+
+// requireSQLite fails operations that work on the SQLite file itself
+func (db *DB) requireSQLite(op string) error {
+	if driver := db.Driver(); driver != DriverSQLite {
+		return fmt.Errorf("%s needs SQLite, not %s", op, driver)
+	}
+	return nil
+}
+
+// sqliteBackend stores to a SQLite file in WAL mode
+type sqliteBackend struct {
+	path string
+}
+
+func (sqliteBackend) driver() string { return DriverSQLite }
+
+func (b sqliteBackend) open() (*sql.DB, error) {
+	return sql.Open("sqlite3", b.path+"?_journal_mode=WAL&_busy_timeout=5000")
+}
+
+func (sqliteBackend) hasColumn(conn *sql.DB, table, column string) (bool, error) {
+	rows, err := conn.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid       int
+			name      string
+			colType   string
+			notNull   int
+			dfltValue sql.NullString
+			pk        int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dfltValue, &pk); err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
+func (sqliteBackend) setup(*sql.DB) error { return nil }
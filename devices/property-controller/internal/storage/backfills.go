@@ -0,0 +1,117 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// InsertBackfill queues a backfill and sets its ID
+func (db *DB) InsertBackfill(b *Backfill) error {
+	b.CreatedAt = time.Now()
+	result, err := db.conn.Exec(`INSERT INTO backfills (table_name, from_time, to_time, source, actor, cloud_command_id, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		b.TableName, b.From.Local(), b.To.Local(), b.Source, nullIfEmpty(b.Actor), nullIfEmpty(b.CloudCommandID), b.CreatedAt)
+	if err != nil {
+		return err
+	}
+	b.ID, err = result.LastInsertId()
+	return err
+}
+
+// GetActiveBackfills retrieves the backfills not completed yet, oldest first
+func (db *DB) GetActiveBackfills() ([]*Backfill, error) {
+	rows, err := db.conn.Query(`SELECT id, table_name, from_time, to_time, last_id, rows_sent, source,
+		COALESCE(actor, ''), COALESCE(cloud_command_id, ''), created_at, completed_at
+		FROM backfills WHERE completed_at IS NULL ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var backfills []*Backfill
+	for rows.Next() {
+		b := &Backfill{}
+		var completedAt sql.NullTime
+		if err := rows.Scan(&b.ID, &b.TableName, &b.From, &b.To, &b.LastID, &b.RowsSent, &b.Source,
+			&b.Actor, &b.CloudCommandID, &b.CreatedAt, &completedAt); err != nil {
+			return nil, err
+		}
+		if completedAt.Valid {
+			b.CompletedAt = &completedAt.Time
+		}
+		backfills = append(backfills, b)
+	}
+	return backfills, rows.Err()
+}
+
+// GetBackfillRowsSent returns the rows resent by the backfills of a cloud
+// command, and how many of them are still running
+func (db *DB) GetBackfillRowsSent(cloudCommandID string) (sent, active int, err error) {
+	err = db.conn.QueryRow(`SELECT COALESCE(SUM(rows_sent), 0), COUNT(*) - COUNT(completed_at)
+		FROM backfills WHERE cloud_command_id = ?`, cloudCommandID).Scan(&sent, &active)
+	return sent, active, err
+}
+
+// HasBackfill reports whether backfills were queued for a cloud command
+func (db *DB) HasBackfill(cloudCommandID string) (bool, error) {
+	var n int
+	err := db.conn.QueryRow("SELECT COUNT(*) FROM backfills WHERE cloud_command_id = ?", cloudCommandID).Scan(&n)
+	return n > 0, err
+}
+
+// backfillWhere selects the synced rows of a backfill's window past the
+// last row it sent
+func backfillWhere(cursorSQL string) string {
+	return "id > ? AND id <= " + cursorSQL + " AND timestamp >= ? AND timestamp < ?"
+}
+
+// GetBackfillSoilReadings retrieves the next soil readings of a backfill,
+// in ID order
+func (db *DB) GetBackfillSoilReadings(b *Backfill, limit int) ([]*SoilMoistureReading, error) {
+	return db.querySyncSoilReadings(backfillWhere(soilCursorSQL), b.LastID, b.From.Local(), b.To.Local(), limit)
+}
+
+// GetBackfillMeterReadings retrieves the next water meter readings of a
+// backfill, in ID order
+func (db *DB) GetBackfillMeterReadings(b *Backfill, limit int) ([]*WaterMeterReading, error) {
+	return db.querySyncMeterReadings(backfillWhere(meterCursorSQL), b.LastID, b.From.Local(), b.To.Local(), limit)
+}
+
+// GetBackfillValveEvents retrieves the next valve events of a backfill, in
+// ID order
+func (db *DB) GetBackfillValveEvents(b *Backfill, limit int) ([]*ValveEvent, error) {
+	query := `SELECT id, controller_uid, actuator_addr, prev_state, new_state, command_id, source, COALESCE(note, ''), timestamp, 1
+		FROM valve_events WHERE ` + backfillWhere(valveCursorSQL) + `
+		ORDER BY id LIMIT ?`
+	return db.queryValveEvents(query, b.LastID, b.From.Local(), b.To.Local(), limit)
+}
+
+// AdvanceBackfill records rows of a backfill as sent again through an ID
+func (db *DB) AdvanceBackfill(id, lastID int64, rows int) error {
+	_, err := db.conn.Exec(`UPDATE backfills SET last_id = ?, rows_sent = rows_sent + ?
+		WHERE id = ? AND last_id < ?`, lastID, rows, id, lastID)
+	return err
+}
+
+// CompleteBackfill marks a backfill as done
+func (db *DB) CompleteBackfill(id int64, now time.Time) error {
+	result, err := db.conn.Exec("UPDATE backfills SET completed_at = ? WHERE id = ? AND completed_at IS NULL", now.UTC(), id)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("backfill %d not found or already complete", id)
+	}
+	return nil
+}
+
+// DeleteCompletedBackfills deletes backfills completed before the given
+// time, returning the number removed
+func (db *DB) DeleteCompletedBackfills(before time.Time) (int64, error) {
+	result, err := db.conn.Exec("DELETE FROM backfills WHERE completed_at IS NOT NULL AND completed_at < ?", before.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
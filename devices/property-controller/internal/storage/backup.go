@@ -0,0 +1,155 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+// Backup pacing: pages copied per step, and the pause between steps that
+// lets the controller write. A write from another connection restarts the
+// copy, so steps are large enough for a typical database to finish in a few.
+const (
+	backupStepPages = 1024
+	backupStepPause = 20 * time.Millisecond
+)
+
+// Backup copies the database to path with SQLite's online backup API while
+// it stays in use
+func (db *DB) Backup(ctx context.Context, path string) error {
+	if err := db.requireSQLite("backup"); err != nil {
+		return err
+	}
+	return Backup(ctx, db.conn, path)
+}
+
+// Backup copies an open database to path with SQLite's online backup API, a
+// step at a time so writers aren't held up. The copy is written beside path
+// and renamed into place once it passes a quick check, so path is never
+// left half written. It uses a rollback journal rather than WAL.
+func Backup(ctx context.Context, src *sql.DB, path string) error {
+	tmp := path + ".tmp"
+	os.Remove(tmp)
+	defer os.Remove(tmp)
+
+	dest, err := sql.Open("sqlite3", tmp)
+	if err != nil {
+		return err
+	}
+	err = copyDatabase(ctx, src, dest, backupStepPages)
+	if err == nil {
+		err = checkCopy(dest)
+	}
+	if err == nil {
+		// A single file, which opening read-only won't add a WAL to
+		_, err = dest.Exec("PRAGMA journal_mode=DELETE")
+	}
+	if closeErr := dest.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Restore replaces the contents of the database at path with the backup at
+// from, creating it if needed. The backup must pass an integrity check and
+// hold a controller database. Nothing else may have the database open.
+func Restore(ctx context.Context, from, path string) error {
+	if _, err := os.Stat(from); err != nil {
+		return err
+	}
+	src, err := sql.Open("sqlite3", "file:"+from+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	problems, err := integrityCheck(src, "integrity_check")
+	if err != nil {
+		return fmt.Errorf("failed to check backup: %w", err)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("backup is damaged: %s", strings.Join(problems, "; "))
+	}
+	var tables int
+	if err := src.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name IN ('devices', 'sync_cursors')").Scan(&tables); err != nil {
+		return err
+	}
+	if tables != 2 {
+		return fmt.Errorf("%s is not a controller database", from)
+	}
+
+	dest, err := sql.Open("sqlite3", path+"?_busy_timeout=5000")
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+	return copyDatabase(ctx, src, dest, -1)
+}
+
+// IsCorrupt reports whether an error means the database file is damaged or
+// isn't a database at all
+func IsCorrupt(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && (sqliteErr.Code == sqlite3.ErrCorrupt || sqliteErr.Code == sqlite3.ErrNotADB)
+}
+
+// copyDatabase copies src over dest with the backup API, pages at a time
+// (-1 for all at once)
+func copyDatabase(ctx context.Context, src, dest *sql.DB, pages int) error {
+	srcConn, err := src.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+	destConn, err := dest.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer destConn.Close()
+
+	return destConn.Raw(func(d any) error {
+		return srcConn.Raw(func(s any) error {
+			backup, err := d.(*sqlite3.SQLiteConn).Backup("main", s.(*sqlite3.SQLiteConn), "main")
+			if err != nil {
+				return fmt.Errorf("failed to start backup: %w", err)
+			}
+			for {
+				done, err := backup.Step(pages)
+				if err != nil {
+					backup.Close()
+					return fmt.Errorf("backup failed: %w", err)
+				}
+				if done {
+					return backup.Finish()
+				}
+				select {
+				case <-ctx.Done():
+					backup.Close()
+					return ctx.Err()
+				case <-time.After(backupStepPause):
+				}
+			}
+		})
+	})
+}
+
+// checkCopy runs a quick check on a fresh copy
+func checkCopy(conn *sql.DB) error {
+	problems, err := integrityCheck(conn, "quick_check")
+	if err != nil {
+		return fmt.Errorf("failed to check copy: %w", err)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("copy is damaged: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
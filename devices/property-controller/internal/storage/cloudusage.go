@@ -0,0 +1,32 @@
+package storage
+
+import (
+	"database/sql"
+	"time"
+)
+
+// AddCloudUsage adds traffic to the month's cloud usage
+func (db *DB) AddCloudUsage(month string, bytesUp, bytesDown int64) error {
+	_, err := db.conn.Exec(`INSERT INTO cloud_usage (month, bytes_up, bytes_down, updated_at)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT(month) DO UPDATE SET
+			bytes_up = cloud_usage.bytes_up + excluded.bytes_up,
+			bytes_down = cloud_usage.bytes_down + excluded.bytes_down,
+			updated_at = excluded.updated_at`,
+		month, bytesUp, bytesDown, time.Now())
+	return err
+}
+
+// GetCloudUsage returns a month's cloud usage, zero if nothing was recorded
+func (db *DB) GetCloudUsage(month string) (*CloudUsage, error) {
+	u := &CloudUsage{Month: month}
+	err := db.conn.QueryRow(`SELECT bytes_up, bytes_down, updated_at FROM cloud_usage WHERE month = ?`,
+		month).Scan(&u.BytesUp, &u.BytesDown, &u.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return u, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
@@ -0,0 +1,110 @@
+package storage
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// InsertCommandGroup records a command sent to a set of valves, before its
+// members are sent, and sets its ID
+func (db *DB) InsertCommandGroup(g *CommandGroup) error {
+	g.CreatedAt = time.Now()
+	result, err := db.conn.Exec(`INSERT INTO command_groups (cloud_command_id, command, target, members, created_at)
+		VALUES (?, ?, ?, ?, ?)`,
+		nullIfEmpty(g.CloudCommandID), g.Command, g.Target, g.Members, g.CreatedAt)
+	if err != nil {
+		return err
+	}
+	g.ID, err = result.LastInsertId()
+	return err
+}
+
+// AddCommandGroupUnsent counts a member of a group that could not be sent,
+// with the reason
+func (db *DB) AddCommandGroupUnsent(id int64, reason string) error {
+	_, err := db.conn.Exec(`UPDATE command_groups SET unsent = unsent + 1,
+		unsent_errors = COALESCE(unsent_errors || ?, '') || ? WHERE id = ?`, "\n", reason, id)
+	return err
+}
+
+// GetCommandGroup retrieves a command group, or nil if there is none
+func (db *DB) GetCommandGroup(id int64) (*CommandGroup, error) {
+	return db.getCommandGroup("id = ?", id)
+}
+
+// GetCommandGroupByCloudID retrieves the group sent for a cloud command UUID,
+// or nil if there is none
+func (db *DB) GetCommandGroupByCloudID(cloudCommandID string) (*CommandGroup, error) {
+	return db.getCommandGroup("cloud_command_id = ?", cloudCommandID)
+}
+
+func (db *DB) getCommandGroup(where string, args ...interface{}) (*CommandGroup, error) {
+	g := &CommandGroup{}
+	var unsentErrors, errText sql.NullString
+	var completedAt sql.NullTime
+	var success sql.NullBool
+	err := db.conn.QueryRow(`SELECT id, COALESCE(cloud_command_id, ''), command, target, members, unsent,
+		unsent_errors, created_at, completed_at, success, error
+		FROM command_groups WHERE `+where+` ORDER BY id DESC LIMIT 1`, args...).Scan(
+		&g.ID, &g.CloudCommandID, &g.Command, &g.Target, &g.Members, &g.Unsent,
+		&unsentErrors, &g.CreatedAt, &completedAt, &success, &errText)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if unsentErrors.Valid {
+		g.UnsentErrors = strings.Split(unsentErrors.String, "\n")
+	}
+	if completedAt.Valid {
+		g.CompletedAt = &completedAt.Time
+	}
+	g.Success, g.Error = success.Bool, errText.String
+	return g, nil
+}
+
+// GetCommandGroupMembers retrieves the commands sent as members of a group
+func (db *DB) GetCommandGroupMembers(id int64) ([]*PendingCommand, error) {
+	rows, err := db.conn.Query(`SELECT id, command_id, controller_uid, actuator_addr, command,
+		acknowledged, COALESCE(failed, 0), COALESCE(error, '')
+		FROM pending_commands WHERE group_id = ? ORDER BY id`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var commands []*PendingCommand
+	for rows.Next() {
+		cmd := &PendingCommand{GroupID: id}
+		if err := rows.Scan(&cmd.ID, &cmd.CommandID, &cmd.ControllerUID, &cmd.ActuatorAddr, &cmd.Command,
+			&cmd.Acknowledged, &cmd.Failed, &cmd.Error); err != nil {
+			return nil, err
+		}
+		commands = append(commands, cmd)
+	}
+	return commands, rows.Err()
+}
+
+// CompleteCommandGroup records the aggregate outcome of a group. It reports
+// whether this call completed it, so the outcome is reported only once.
+func (db *DB) CompleteCommandGroup(id int64, success bool, reason string, now time.Time) (bool, error) {
+	result, err := db.conn.Exec(`UPDATE command_groups SET completed_at = ?, success = ?, error = ?
+		WHERE id = ? AND completed_at IS NULL`, now.UTC(), success, nullIfEmpty(reason), id)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// DeleteCompletedCommandGroups deletes groups completed before the given
+// time, returning the number removed
+func (db *DB) DeleteCompletedCommandGroups(before time.Time) (int64, error) {
+	result, err := db.conn.Exec("DELETE FROM command_groups WHERE completed_at IS NOT NULL AND completed_at < ?", before.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,46 @@
+package storage
+
+import "time"
+
+// AddCounters adds to the engine's lifetime counters, creating any not yet
+// recorded
+func (db *DB) AddCounters(deltas map[string]int64) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	for name, n := range deltas {
+		if _, err := tx.Exec(`INSERT INTO engine_counters (name, value, updated_at)
+			VALUES (?, ?, ?)
+			ON CONFLICT(name) DO UPDATE SET
+				value = engine_counters.value + excluded.value,
+				updated_at = excluded.updated_at`,
+			name, n, now); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetCounters returns the engine's lifetime counters by name
+func (db *DB) GetCounters() (map[string]int64, error) {
+	rows, err := db.conn.Query(`SELECT name, value FROM engine_counters`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counters := make(map[string]int64)
+	for rows.Next() {
+		var name string
+		var value int64
+		if err := rows.Scan(&name, &value); err != nil {
+			return nil, err
+		}
+		counters[name] = value
+	}
+	return counters, rows.Err()
+}
@@ -1,30 +1,49 @@
 package storage
 
 import (
+	"crypto/cipher"
 	"database/sql"
 	"fmt"
+	"sort"
+	"strings"
 	"time"
 
+	"github.com/agsys/property-controller/internal/protocol"
 	_ "github.com/mattn/go-sqlite3"
 )
 
-// DB wraps the SQLite database connection
+// DB wraps the database connection
 type DB struct {
-	conn *sql.DB
+	conn    *sql.DB
+	backend backend
+	sealer  cipher.AEAD // Encrypts sensitive columns; nil stores them in the clear
 }
 
 // Open opens or creates the SQLite database
 func Open(path string) (*DB, error) {
-	conn, err := sql.Open("sqlite3", path+"?_journal_mode=WAL&_busy_timeout=5000")
+	return OpenConfig(Config{Driver: DriverSQLite, Path: path})
+}
+
+// OpenConfig opens or creates the database cfg selects
+func OpenConfig(cfg Config) (*DB, error) {
+	b, err := newBackend(cfg)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := b.open()
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
 
-	db := &DB{conn: conn}
+	db := &DB{conn: conn, backend: b}
 	if err := db.migrate(); err != nil {
 		conn.Close()
 		return nil, fmt.Errorf("failed to migrate database: %w", err)
 	}
+	if err := b.setup(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to set up database: %w", err)
+	}
 
 	return db, nil
 }
@@ -83,6 +102,7 @@ func (db *DB) migrate() error {
 		current_state INTEGER DEFAULT 0,
 		last_state_change DATETIME,
 		is_registered INTEGER DEFAULT 0,
+		valve_id TEXT,  -- Cloud valve ID used in valve commands
 		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
 		FOREIGN KEY (controller_uid) REFERENCES devices(uid),
 		FOREIGN KEY (zone_id) REFERENCES zones(uid),
@@ -105,14 +125,29 @@ func (db *DB) migrate() error {
 	);
 	CREATE INDEX IF NOT EXISTS idx_soil_moisture_device ON soil_moisture_readings(device_uid);
 	CREATE INDEX IF NOT EXISTS idx_soil_moisture_timestamp ON soil_moisture_readings(timestamp);
-	CREATE INDEX IF NOT EXISTS idx_soil_moisture_synced ON soil_moisture_readings(synced_to_cloud);
+
+	-- Soil reports (one row per multi-probe report, probes in soil_moisture_readings)
+	CREATE TABLE IF NOT EXISTS soil_reports (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		device_uid TEXT NOT NULL,
+		probe_count INTEGER NOT NULL,
+		temperature INTEGER,
+		battery_mv INTEGER,
+		flags INTEGER DEFAULT 0,
+		rssi INTEGER,
+		timestamp DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (device_uid) REFERENCES devices(uid)
+	);
 
 	-- Water meter readings
 	CREATE TABLE IF NOT EXISTS water_meter_readings (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
 		device_uid TEXT NOT NULL,
-		total_liters INTEGER NOT NULL,
+		total_volume_l REAL NOT NULL,
 		flow_rate_lpm REAL,
+		signal_uv REAL,
+		temperature_c REAL,
+		signal_quality INTEGER,
 		battery_mv INTEGER,
 		rssi INTEGER,
 		timestamp DATETIME DEFAULT CURRENT_TIMESTAMP,
@@ -121,7 +156,6 @@ func (db *DB) migrate() error {
 	);
 	CREATE INDEX IF NOT EXISTS idx_water_meter_device ON water_meter_readings(device_uid);
 	CREATE INDEX IF NOT EXISTS idx_water_meter_timestamp ON water_meter_readings(timestamp);
-	CREATE INDEX IF NOT EXISTS idx_water_meter_synced ON water_meter_readings(synced_to_cloud);
 
 	-- Valve events
 	CREATE TABLE IF NOT EXISTS valve_events (
@@ -138,7 +172,6 @@ func (db *DB) migrate() error {
 	);
 	CREATE INDEX IF NOT EXISTS idx_valve_events_controller ON valve_events(controller_uid);
 	CREATE INDEX IF NOT EXISTS idx_valve_events_timestamp ON valve_events(timestamp);
-	CREATE INDEX IF NOT EXISTS idx_valve_events_synced ON valve_events(synced_to_cloud);
 
 	-- Watering schedules
 	CREATE TABLE IF NOT EXISTS schedules (
@@ -179,6 +212,11 @@ func (db *DB) migrate() error {
 		acknowledged INTEGER DEFAULT 0,
 		ack_time DATETIME,
 		result_state INTEGER,
+		failed INTEGER DEFAULT 0,  -- Retries exhausted without acknowledgment, or NACKed
+		cloud_command_id TEXT,     -- Cloud command UUID, for deduplication
+		sequence INTEGER,          -- LoRa sequence of the last send, matched by NACKs
+		error TEXT,                -- Why the command failed
+		group_id INTEGER,          -- Command group the command is a member of
 		FOREIGN KEY (controller_uid) REFERENCES devices(uid)
 	);
 	CREATE INDEX IF NOT EXISTS idx_pending_commands_id ON pending_commands(command_id);
@@ -204,8 +242,9 @@ func (db *DB) migrate() error {
 		alarm_type INTEGER NOT NULL,
 		flow_rate_lpm REAL,
 		duration_sec INTEGER,
-		total_liters INTEGER,
+		total_volume_l REAL,
 		rssi INTEGER,
+		source TEXT DEFAULT 'device',  -- 'device' or 'analytics' (derived)
 		timestamp DATETIME DEFAULT CURRENT_TIMESTAMP,
 		synced_to_cloud INTEGER DEFAULT 0,
 		FOREIGN KEY (device_uid) REFERENCES devices(uid)
@@ -224,13 +263,615 @@ func (db *DB) migrate() error {
 		leak_threshold_min INTEGER NOT NULL,
 		max_flow_rate_lpm INTEGER NOT NULL,
 		flags INTEGER NOT NULL,
+		state TEXT,                             -- 'queued', 'pending', 'applied', or 'failed'
+		actor TEXT,                             -- Who set it
+		sent_at DATETIME,
+		acked_version INTEGER,                  -- Version the meter confirmed
+		acked_at DATETIME,
 		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
 		FOREIGN KEY (device_uid) REFERENCES devices(uid)
 	);
+
+	-- Hourly and daily rollups of soil readings, per probe
+	CREATE TABLE IF NOT EXISTS soil_rollups (
+		device_uid TEXT NOT NULL,
+		probe_id INTEGER NOT NULL,
+		period TEXT NOT NULL,          -- 'hour' or 'day'
+		period_start DATETIME NOT NULL,
+		samples INTEGER NOT NULL,
+		moisture_min INTEGER,
+		moisture_max INTEGER,
+		moisture_avg REAL,
+		temperature_min INTEGER,       -- 0.1°C units
+		temperature_max INTEGER,
+		temperature_avg REAL,
+		PRIMARY KEY (device_uid, probe_id, period, period_start)
+	);
+	CREATE INDEX IF NOT EXISTS idx_soil_rollups_period ON soil_rollups(period, period_start);
+
+	-- Hourly and daily rollups of water meter readings
+	CREATE TABLE IF NOT EXISTS meter_rollups (
+		device_uid TEXT NOT NULL,
+		period TEXT NOT NULL,          -- 'hour' or 'day'
+		period_start DATETIME NOT NULL,
+		samples INTEGER NOT NULL,
+		flow_min REAL,
+		flow_max REAL,
+		flow_avg REAL,
+		volume_delta_l REAL,           -- Cumulative total increase during the period
+		total_volume_l REAL,           -- Cumulative total at the end of the period
+		PRIMARY KEY (device_uid, period, period_start)
+	);
+	CREATE INDEX IF NOT EXISTS idx_meter_rollups_period ON meter_rollups(period, period_start);
+
+	-- Database maintenance history (checkpoint, integrity check, vacuum)
+	CREATE TABLE IF NOT EXISTS maintenance_runs (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		task TEXT NOT NULL,
+		ok INTEGER NOT NULL,
+		result TEXT,
+		duration_ms INTEGER NOT NULL,
+		ran_at DATETIME NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_maintenance_runs_task ON maintenance_runs(task, ran_at);
+
+	-- Mains power lost and restored at valve controllers, from the power
+	-- flags of their valve status reports
+	CREATE TABLE IF NOT EXISTS power_events (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		controller_uid TEXT NOT NULL,
+		event TEXT NOT NULL,            -- 'power_fail', 'on_battery', or 'power_restored'
+		valves_closed INTEGER DEFAULT 0, -- Closes sent to bring the valves to a safe state
+		timestamp DATETIME NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_power_events_controller ON power_events(controller_uid, id);
+
+	-- Motor current of each valve actuation, for actuator health trends
+	CREATE TABLE IF NOT EXISTS actuator_currents (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		controller_uid TEXT NOT NULL,
+		actuator_addr INTEGER NOT NULL,
+		state INTEGER NOT NULL,         -- State the actuation ended in
+		current_ma INTEGER NOT NULL,
+		flags INTEGER NOT NULL,         -- Valve status flags
+		timestamp DATETIME NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_actuator_currents_actuator ON actuator_currents(controller_uid, actuator_addr, id);
+	CREATE INDEX IF NOT EXISTS idx_actuator_currents_timestamp ON actuator_currents(timestamp);
+
+	-- Device reboots, seen as the uptime in heartbeats starting over
+	CREATE TABLE IF NOT EXISTS device_reboots (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		device_uid TEXT NOT NULL,
+		boot_reason INTEGER NOT NULL,
+		prev_uptime_sec INTEGER NOT NULL, -- Uptime of the last heartbeat before the reboot
+		unexpected INTEGER NOT NULL,      -- Not a reboot into new firmware
+		timestamp DATETIME NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_device_reboots_device ON device_reboots(device_uid, timestamp);
+
+	-- Firmware each device last reported running, for the cloud's fleet view
+	CREATE TABLE IF NOT EXISTS firmware_inventory (
+		device_uid TEXT PRIMARY KEY,
+		device_type INTEGER NOT NULL,
+		version TEXT NOT NULL,
+		hw_rev INTEGER,                 -- NULL until a message carrying it is seen
+		previous_version TEXT,
+		source TEXT NOT NULL,           -- Message that last reported it: 'heartbeat', 'ota_request', or 'ota_status'
+		reported_at DATETIME NOT NULL,
+		changed_at DATETIME NOT NULL,   -- When the version or hardware revision last changed
+		synced_to_cloud INTEGER DEFAULT 0
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_firmware_inventory_synced ON firmware_inventory(synced_to_cloud);
+
+	-- Signal quality of every received message, for gateway placement
+	CREATE TABLE IF NOT EXISTS link_quality (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		device_uid TEXT NOT NULL,
+		msg_type INTEGER NOT NULL,
+		rssi INTEGER NOT NULL,
+		snr REAL NOT NULL,
+		received_at DATETIME NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_link_quality_received ON link_quality(received_at, device_uid);
+
+	-- Packet counts a gateway reports each stats interval, for its health
+	CREATE TABLE IF NOT EXISTS gateway_stats (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		gateway_id TEXT NOT NULL,
+		rx_received INTEGER NOT NULL,
+		rx_ok INTEGER NOT NULL,
+		tx_received INTEGER NOT NULL,
+		tx_emitted INTEGER NOT NULL,
+		received_at DATETIME NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_gateway_stats_received ON gateway_stats(received_at, gateway_id);
+
+	-- Rotated per-device LoRa keys
+	CREATE TABLE IF NOT EXISTS device_keys (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		device_uid TEXT NOT NULL,
+		key_id INTEGER NOT NULL,
+		key BLOB NOT NULL,
+		sealed INTEGER DEFAULT 0,
+		state TEXT NOT NULL DEFAULT 'pending',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		activated_at DATETIME
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_device_keys_device ON device_keys(device_uid, state);
+
+	-- High-water marks of the GCM nonces LoRa downlinks are sealed with, so
+	-- none is used twice under a key across restarts
+	CREATE TABLE IF NOT EXISTS nonce_marks (
+		name TEXT PRIMARY KEY,
+		mark INTEGER NOT NULL,
+		updated_at DATETIME NOT NULL
+	);
+
+	-- Hourly rainfall and ET0 for weather-adjusted schedules. Past hours keep
+	-- the last forecast fetched for them.
+	CREATE TABLE IF NOT EXISTS weather_hours (
+		hour DATETIME PRIMARY KEY,
+		rain_mm REAL NOT NULL,
+		et_mm REAL NOT NULL,
+		updated_at DATETIME NOT NULL
+	);
+
+	-- Alerts from every source (meter alarms, offline devices, low battery,
+	-- failed commands, moisture thresholds). An alert stays open (active or
+	-- acked) until its condition clears; repeats while open bump its count.
+	CREATE TABLE IF NOT EXISTS alerts (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		device_uid TEXT NOT NULL,
+		zone_id TEXT,
+		probe_id INTEGER NOT NULL DEFAULT 0,  -- Probe or actuator address, 0 for the whole device
+		alert_type TEXT NOT NULL,
+		severity TEXT DEFAULT 'warning',      -- 'info', 'warning', or 'critical'
+		state TEXT DEFAULT 'active',          -- 'active', 'acked', or 'cleared'
+		message TEXT,
+		value REAL,
+		threshold REAL,
+		source_id INTEGER,                    -- meter_alarms row for meter alarms
+		count INTEGER DEFAULT 1,
+		timestamp DATETIME NOT NULL,          -- When first raised
+		last_seen DATETIME,
+		acked_at DATETIME,
+		cleared_at DATETIME,
+		synced_to_cloud INTEGER DEFAULT 0,
+		FOREIGN KEY (device_uid) REFERENCES devices(uid)
+	);
+	CREATE INDEX IF NOT EXISTS idx_alerts_device ON alerts(device_uid, probe_id, timestamp);
+	CREATE INDEX IF NOT EXISTS idx_alerts_synced ON alerts(synced_to_cloud);
+
+	-- Append-only log of commands issued to devices. A command's outcome is a
+	-- later row with the same device and command ID; rows are never changed.
+	CREATE TABLE IF NOT EXISTS command_audit (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		timestamp DATETIME NOT NULL,
+		kind TEXT NOT NULL,             -- 'valve', 'meter_config', 'meter_reset', 'ota_start', 'ota_cancel', 'ota_multicast'
+		device_uid TEXT NOT NULL,
+		actuator_addr INTEGER,
+		command TEXT NOT NULL,
+		params TEXT,                    -- JSON
+		source TEXT NOT NULL,           -- 'cloud', 'schedule', 'local_api', 'modbus', or 'rule'
+		actor TEXT,                     -- Cloud user ID, schedule ID, or rule name
+		cloud_command_id TEXT,
+		command_id INTEGER,             -- LoRa command ID
+		outcome TEXT NOT NULL,          -- 'sent', 'send_failed', 'rejected', 'duplicate', 'acked', 'nacked', 'no_ack'
+		detail TEXT
+	);
+	CREATE INDEX IF NOT EXISTS idx_command_audit_time ON command_audit(timestamp);
+	CREATE INDEX IF NOT EXISTS idx_command_audit_device ON command_audit(device_uid, command_id);
+	CREATE TRIGGER IF NOT EXISTS command_audit_no_update BEFORE UPDATE ON command_audit
+	BEGIN
+		SELECT RAISE(ABORT, 'command_audit is append-only');
+	END;
+	CREATE TRIGGER IF NOT EXISTS command_audit_no_delete BEFORE DELETE ON command_audit
+	BEGIN
+		SELECT RAISE(ABORT, 'command_audit is append-only');
+	END;
+
+	-- Running state of each water meter's totalizer. The cumulative total of a
+	-- reading is its raw total plus offset_l, which grows on every rollover
+	-- and reset so the cumulative total never goes backwards.
+	CREATE TABLE IF NOT EXISTS meter_totalizers (
+		device_uid TEXT PRIMARY KEY,
+		offset_l REAL NOT NULL DEFAULT 0,
+		last_raw_l REAL NOT NULL,       -- Raw total of the last accepted reading or reset
+		rollovers INTEGER DEFAULT 0,
+		resets INTEGER DEFAULT 0,
+		pending_reset_id INTEGER,       -- Command ID of a reset awaiting its ack
+		pending_reset_l REAL,           -- Total the pending reset sets
+		updated_at DATETIME NOT NULL
+	);
+
+	-- Report interval of each soil sensor and water meter, from cloud config
+	-- and battery state, and whether the device has confirmed it
+	CREATE TABLE IF NOT EXISTS device_configs (
+		device_uid TEXT PRIMARY KEY,
+		cloud_interval_sec INTEGER DEFAULT 0,   -- 0 for the device default
+		low_battery INTEGER DEFAULT 0,
+		report_interval_sec INTEGER NOT NULL,   -- Interval last sent
+		config_version INTEGER NOT NULL,
+		state TEXT,                             -- 'pending', 'applied', or 'failed'
+		attempts INTEGER DEFAULT 0,
+		sent_at DATETIME,
+		applied_interval_sec INTEGER,           -- Interval the device confirmed
+		applied_at DATETIME,
+		updated_at DATETIME NOT NULL
+	);
+
+	-- Schedule last pushed to each valve controller, and the version the
+	-- controller confirmed storing
+	CREATE TABLE IF NOT EXISTS schedule_deliveries (
+		controller_uid TEXT PRIMARY KEY,
+		version INTEGER NOT NULL,               -- Version last sent
+		state TEXT NOT NULL,                    -- 'pending', 'applied', or 'failed'
+		attempts INTEGER DEFAULT 0,
+		sent_at DATETIME,
+		acked_version INTEGER,                  -- Version the controller confirmed
+		acked_at DATETIME,
+		updated_at DATETIME NOT NULL
+	);
+
+	-- Latest remote shutoff (pin) command sent to each water meter, and
+	-- whether the meter confirmed it
+	CREATE TABLE IF NOT EXISTS meter_pins (
+		device_uid TEXT PRIMARY KEY,
+		command_id INTEGER NOT NULL,            -- LoRa command ID, echoed in the meter's ack
+		pinned INTEGER NOT NULL,                -- 1 to shut the valve and hold it shut, 0 to release it
+		state TEXT NOT NULL,                    -- 'pending', 'applied', or 'failed'
+		attempts INTEGER DEFAULT 0,
+		cloud_command_id TEXT,                  -- Cloud command UUID, if cloud-issued
+		source TEXT,
+		actor TEXT,
+		sent_at DATETIME,
+		acked_at DATETIME,
+		valve_state INTEGER,                    -- Valve state the meter reported in its ack
+		error TEXT,                             -- Why the command failed
+		updated_at DATETIME NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_meter_pins_cloud ON meter_pins(cloud_command_id);
+
+	-- Known-volume calibration sessions of water meters and their results
+	CREATE TABLE IF NOT EXISTS meter_calibrations (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		device_uid TEXT NOT NULL,
+		session_id INTEGER NOT NULL,            -- Echoed in the meter's acks
+		state TEXT NOT NULL,                    -- 'starting', 'running', 'finishing', 'completed', 'failed', or 'cancelled'
+		reference_liters REAL DEFAULT 0,        -- Volume run through the meter, given when finishing
+		pulses INTEGER DEFAULT 0,               -- Pulses the meter counted for it
+		old_pulses_per_liter INTEGER DEFAULT 0, -- * 100, from the meter config at the start
+		new_pulses_per_liter INTEGER DEFAULT 0, -- * 100, pushed to the meter in config_version
+		config_version INTEGER DEFAULT 0,
+		cloud_command_id TEXT,                  -- Cloud command awaiting the meter's ack, if cloud-issued
+		source TEXT,
+		actor TEXT,
+		error TEXT,                             -- Why the session failed
+		started_at DATETIME NOT NULL,
+		sent_at DATETIME,                       -- Last step sent to the meter
+		running_at DATETIME,                    -- Meter confirmed counting
+		finished_at DATETIME,
+		updated_at DATETIME NOT NULL,
+		FOREIGN KEY (device_uid) REFERENCES devices(uid)
+	);
+	CREATE INDEX IF NOT EXISTS idx_meter_calibrations_device ON meter_calibrations(device_uid, started_at);
+
+	-- Readings that failed validation, kept out of the reading tables and
+	-- cloud sync so a faulty sensor or corrupt frame can be investigated
+	CREATE TABLE IF NOT EXISTS rejected_readings (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		timestamp DATETIME NOT NULL,
+		device_uid TEXT NOT NULL,
+		probe_id INTEGER NOT NULL DEFAULT 0,
+		reading_type TEXT NOT NULL,     -- 'soil' or 'meter'
+		reason TEXT NOT NULL,           -- 'moisture_range', 'temperature_range', 'moisture_step', 'totalizer_invalid', 'totalizer_decrease'
+		value REAL,
+		previous REAL,                  -- Last accepted value, for step and totalizer checks
+		reading TEXT                    -- JSON
+	);
+	CREATE INDEX IF NOT EXISTS idx_rejected_readings_device ON rejected_readings(device_uid, timestamp);
+
+	-- Progress of the latest OTA update of each device, so stuck or failed
+	-- updates can be diagnosed without the running controller
+	CREATE TABLE IF NOT EXISTS ota_updates (
+		device_uid TEXT PRIMARY KEY,
+		device_type INTEGER NOT NULL,
+		current_version TEXT,
+		target_version TEXT,
+		state TEXT NOT NULL,            -- 'pending', 'requested', 'transferring', 'verifying', 'complete', 'failed', 'rolled_back', 'cancelled'
+		chunks_sent INTEGER DEFAULT 0,
+		chunks_acked INTEGER DEFAULT 0,
+		total_chunks INTEGER DEFAULT 0,
+		retry_count INTEGER DEFAULT 0,
+		error_code INTEGER DEFAULT 0,
+		error_message TEXT,
+		started_at DATETIME,
+		last_activity DATETIME,
+		completed_at DATETIME,
+		updated_at DATETIME NOT NULL
+	);
+
+	-- Tokens for the local API and CLI write commands. Only a SHA-256 hash of
+	-- each token is kept.
+	CREATE TABLE IF NOT EXISTS api_tokens (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL UNIQUE,
+		role TEXT NOT NULL,             -- 'viewer', 'operator', or 'admin'
+		token_hash TEXT NOT NULL UNIQUE,
+		created_at DATETIME NOT NULL,
+		last_used_at DATETIME
+	);
+
+	-- Bytes exchanged with the cloud per calendar month, for metered links
+	CREATE TABLE IF NOT EXISTS cloud_usage (
+		month TEXT PRIMARY KEY,         -- 'YYYY-MM', local time
+		bytes_up INTEGER NOT NULL DEFAULT 0,
+		bytes_down INTEGER NOT NULL DEFAULT 0,
+		updated_at DATETIME NOT NULL
+	);
+
+	-- Engine counters kept across restarts: messages by type, decode
+	-- failures, command outcomes, cloud sync batches
+	CREATE TABLE IF NOT EXISTS engine_counters (
+		name TEXT PRIMARY KEY,
+		value INTEGER NOT NULL DEFAULT 0,
+		updated_at DATETIME NOT NULL
+	);
+
+	-- Cloud sync progress of the append-only tables: rows up to last_id have
+	-- been sent. Their synced_to_cloud columns predate this and are no
+	-- longer written.
+	CREATE TABLE IF NOT EXISTS sync_cursors (
+		table_name TEXT PRIMARY KEY,
+		last_id INTEGER NOT NULL,
+		updated_at DATETIME NOT NULL
+	);
+
+	-- Automatic closes of valves opened for a set duration, kept here so a
+	-- restart does not leave a timed valve open
+	CREATE TABLE IF NOT EXISTS valve_timers (
+		controller_uid TEXT NOT NULL,
+		actuator_addr INTEGER NOT NULL,
+		close_at DATETIME NOT NULL,
+		cloud_command_id TEXT,
+		created_at DATETIME NOT NULL,
+		PRIMARY KEY (controller_uid, actuator_addr)
+	);
+
+	-- Valves operated by hand at the valve, left alone by schedules and rules
+	-- until expires_at
+	CREATE TABLE IF NOT EXISTS valve_overrides (
+		controller_uid TEXT NOT NULL,
+		actuator_addr INTEGER NOT NULL,
+		state INTEGER NOT NULL,         -- State the valve was put in
+		started_at DATETIME NOT NULL,
+		expires_at DATETIME NOT NULL,
+		PRIMARY KEY (controller_uid, actuator_addr)
+	);
+
+	-- Emergency stops. The stop without a rearmed_at is in force, and valves
+	-- may not open until it is re-armed.
+	CREATE TABLE IF NOT EXISTS emergency_stops (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		stopped_at DATETIME NOT NULL,
+		source TEXT NOT NULL,           -- 'cloud', 'local_api'
+		actor TEXT,
+		reason TEXT,
+		valves_closed INTEGER NOT NULL DEFAULT 0,
+		rearmed_at DATETIME,
+		rearm_source TEXT,
+		rearm_actor TEXT
+	);
+
+	-- Commands fanned out to a set of valves. Each member is a pending command
+	-- with the group's ID; the cloud gets one acknowledgment for the group once
+	-- every member is acknowledged, has failed, or could not be sent.
+	CREATE TABLE IF NOT EXISTS command_groups (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		cloud_command_id TEXT,
+		command INTEGER NOT NULL,
+		target TEXT NOT NULL,           -- Zone or controller and actuator mask
+		members INTEGER NOT NULL,       -- Valves the command went to
+		unsent INTEGER NOT NULL DEFAULT 0,
+		unsent_errors TEXT,             -- Why members could not be sent
+		created_at DATETIME NOT NULL,
+		completed_at DATETIME,
+		success INTEGER,
+		error TEXT
+	);
+	CREATE INDEX IF NOT EXISTS idx_command_groups_cloud_id ON command_groups(cloud_command_id);
+
+	-- Backfills: rows of a cursor table from a time window that were already
+	-- synced, sent to the cloud again by the sync loop a batch at a time
+	CREATE TABLE IF NOT EXISTS backfills (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		table_name TEXT NOT NULL,       -- One of the sync cursor tables
+		from_time DATETIME NOT NULL,
+		to_time DATETIME NOT NULL,
+		last_id INTEGER NOT NULL DEFAULT 0, -- Last row sent again
+		rows_sent INTEGER NOT NULL DEFAULT 0,
+		source TEXT NOT NULL,           -- cloud or cli
+		actor TEXT,
+		cloud_command_id TEXT,
+		created_at DATETIME NOT NULL,
+		completed_at DATETIME
+	);
+	CREATE INDEX IF NOT EXISTS idx_backfills_active ON backfills(completed_at);
+
+	-- Device changes made with agsys-db: applied to the running controller's
+	-- device cache, and held for the cloud until the protocol can carry them
+	CREATE TABLE IF NOT EXISTS device_changes (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		device_uid TEXT NOT NULL,
+		change TEXT NOT NULL,           -- alias, zone, forget, or release
+		value TEXT,                     -- New alias or zone UID; NULL to clear
+		actor TEXT,
+		created_at DATETIME NOT NULL,
+		applied_at DATETIME,            -- Picked up by the controller
+		synced_to_cloud INTEGER DEFAULT 0
+	);
+	CREATE INDEX IF NOT EXISTS idx_device_changes_applied ON device_changes(applied_at);
+
+	-- Firmware log entries sent by devices in log batches. Entries below the
+	-- forwarding severity are stored as synced, having nothing to send.
+	CREATE TABLE IF NOT EXISTS device_logs (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		device_uid TEXT NOT NULL,
+		device_time DATETIME,           -- Device clock when logged; NULL if it wasn't set
+		severity INTEGER NOT NULL,      -- 0 debug, 1 info, 2 warning, 3 error
+		log_type INTEGER NOT NULL,      -- Firmware log entry type
+		code INTEGER NOT NULL,
+		message TEXT NOT NULL,
+		received_at DATETIME NOT NULL,
+		synced_to_cloud INTEGER DEFAULT 0
+	);
+	CREATE INDEX IF NOT EXISTS idx_device_logs_device ON device_logs(device_uid, received_at);
+	CREATE INDEX IF NOT EXISTS idx_device_logs_received ON device_logs(received_at);
 	`
 
-	_, err := db.conn.Exec(schema)
-	return err
+	if _, err := db.conn.Exec(schema); err != nil {
+		return err
+	}
+
+	// Columns added after the initial schema
+	if err := db.addColumnIfMissing("soil_moisture_readings", "report_id", "INTEGER REFERENCES soil_reports(id)"); err != nil {
+		return err
+	}
+	if _, err := db.conn.Exec("CREATE INDEX IF NOT EXISTS idx_soil_moisture_report ON soil_moisture_readings(report_id)"); err != nil {
+		return err
+	}
+	if err := db.addColumnIfMissing("valve_actuators", "opened_at", "DATETIME"); err != nil {
+		return err
+	}
+	if err := db.addColumnIfMissing("valve_events", "note", "TEXT"); err != nil {
+		return err
+	}
+	if err := db.addColumnIfMissing("schedule_entries", "fertigate", "INTEGER DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := db.addColumnIfMissing("schedule_entries", "dose_mins", "INTEGER DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := db.addColumnIfMissing("schedules", "cloud_uid", "TEXT"); err != nil {
+		return err
+	}
+	if _, err := db.conn.Exec("CREATE INDEX IF NOT EXISTS idx_schedules_cloud_uid ON schedules(cloud_uid)"); err != nil {
+		return err
+	}
+
+	// Meter tables originally stored integer liters as total_liters
+	for _, table := range []string{"water_meter_readings", "meter_alarms"} {
+		if err := db.renameColumnIfPresent(table, "total_liters", "total_volume_l"); err != nil {
+			return err
+		}
+	}
+	for _, column := range []string{"signal_uv REAL", "temperature_c REAL", "signal_quality INTEGER"} {
+		name, definition, _ := strings.Cut(column, " ")
+		if err := db.addColumnIfMissing("water_meter_readings", name, definition); err != nil {
+			return err
+		}
+	}
+	if err := db.addColumnIfMissing("water_meter_readings", "cumulative_l", "REAL"); err != nil {
+		return err
+	}
+	if err := db.addColumnIfMissing("meter_alarms", "source", "TEXT DEFAULT 'device'"); err != nil {
+		return err
+	}
+	if err := db.addColumnIfMissing("pending_commands", "failed", "INTEGER DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := db.addColumnIfMissing("pending_commands", "cloud_command_id", "TEXT"); err != nil {
+		return err
+	}
+	if _, err := db.conn.Exec("CREATE INDEX IF NOT EXISTS idx_pending_commands_cloud_id ON pending_commands(cloud_command_id)"); err != nil {
+		return err
+	}
+	for _, column := range []string{"sequence INTEGER", "error TEXT", "group_id INTEGER"} {
+		name, definition, _ := strings.Cut(column, " ")
+		if err := db.addColumnIfMissing("pending_commands", name, definition); err != nil {
+			return err
+		}
+	}
+	if err := db.addColumnIfMissing("valve_actuators", "valve_id", "TEXT"); err != nil {
+		return err
+	}
+	if _, err := db.conn.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_valve_actuators_valve_id ON valve_actuators(valve_id)"); err != nil {
+		return err
+	}
+	for _, column := range []string{"clock_skew_ms INTEGER", "clock_drift_ppm REAL", "clock_checked_at DATETIME",
+		"last_seq INTEGER", "last_seq_at DATETIME", "protocol_version INTEGER",
+		"quarantined_at DATETIME", "quarantine_reason TEXT", "uptime_sec INTEGER", "uptime_at DATETIME"} {
+		name, definition, _ := strings.Cut(column, " ")
+		if err := db.addColumnIfMissing("devices", name, definition); err != nil {
+			return err
+		}
+	}
+	for _, column := range []string{"severity TEXT DEFAULT 'warning'", "state TEXT DEFAULT 'active'", "message TEXT",
+		"source_id INTEGER", "count INTEGER DEFAULT 1", "last_seen DATETIME", "acked_at DATETIME", "cleared_at DATETIME"} {
+		name, definition, _ := strings.Cut(column, " ")
+		if err := db.addColumnIfMissing("alerts", name, definition); err != nil {
+			return err
+		}
+	}
+	if _, err := db.conn.Exec("CREATE INDEX IF NOT EXISTS idx_alerts_state ON alerts(state)"); err != nil {
+		return err
+	}
+	if err := db.addColumnIfMissing("device_keys", "sealed", "INTEGER DEFAULT 0"); err != nil {
+		return err
+	}
+	for _, column := range []string{"state TEXT", "actor TEXT", "sent_at DATETIME", "acked_version INTEGER", "acked_at DATETIME"} {
+		name, definition, _ := strings.Cut(column, " ")
+		if err := db.addColumnIfMissing("meter_configs", name, definition); err != nil {
+			return err
+		}
+	}
+	if err := db.migrateSyncCursors(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// addColumnIfMissing adds a column to an existing table if it isn't there yet
+func (db *DB) addColumnIfMissing(table, column, definition string) error {
+	exists, err := db.hasColumn(table, column)
+	if err != nil || exists {
+		return err
+	}
+
+	_, err = db.conn.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	if err != nil {
+		return fmt.Errorf("failed to add column %s.%s: %w", table, column, err)
+	}
+	return nil
+}
+
+// renameColumnIfPresent renames a column left over from an older schema
+func (db *DB) renameColumnIfPresent(table, oldName, newName string) error {
+	exists, err := db.hasColumn(table, oldName)
+	if err != nil || !exists {
+		return err
+	}
+
+	_, err = db.conn.Exec(fmt.Sprintf("ALTER TABLE %s RENAME COLUMN %s TO %s", table, oldName, newName))
+	if err != nil {
+		return fmt.Errorf("failed to rename column %s.%s: %w", table, oldName, err)
+	}
+	return nil
+}
+
+// hasColumn reports whether a table has the named column
+func (db *DB) hasColumn(table, column string) (bool, error) {
+	return db.backend.hasColumn(db.conn, table, column)
 }
 
 // --- Device Operations ---
@@ -243,26 +884,28 @@ func (db *DB) UpsertDevice(d *Device) error {
 		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 		ON CONFLICT(uid) DO UPDATE SET
 			last_seen = excluded.last_seen,
-			firmware_version = COALESCE(excluded.firmware_version, firmware_version),
-			battery_mv = COALESCE(excluded.battery_mv, battery_mv),
-			rssi = COALESCE(excluded.rssi, rssi),
+			firmware_version = COALESCE(excluded.firmware_version, devices.firmware_version),
+			battery_mv = COALESCE(excluded.battery_mv, devices.battery_mv),
+			rssi = COALESCE(excluded.rssi, devices.rssi),
+			is_registered = CASE WHEN excluded.is_registered > devices.is_registered
+				THEN excluded.is_registered ELSE devices.is_registered END,
 			updated_at = excluded.updated_at
 	`
 	_, err := db.conn.Exec(query, d.UID, d.DeviceType, d.Name, d.Alias, d.ZoneID,
-		d.FirstSeen, d.LastSeen, d.FirmwareVer, d.BatteryMV, d.RSSI, d.IsRegistered, time.Now())
+		d.FirstSeen, d.LastSeen, nullIfEmpty(d.FirmwareVer), d.BatteryMV, d.RSSI, d.IsRegistered, time.Now())
 	return err
 }
 
 // GetDevice retrieves a device by UID
 func (db *DB) GetDevice(uid string) (*Device, error) {
 	query := `SELECT uid, device_type, name, alias, zone_id, first_seen, last_seen,
-		firmware_version, battery_mv, rssi, is_registered, updated_at
+		firmware_version, COALESCE(protocol_version, 0), battery_mv, rssi, is_registered, updated_at
 		FROM devices WHERE uid = ?`
 
 	d := &Device{}
 	var zoneID, alias, fwVer sql.NullString
 	err := db.conn.QueryRow(query, uid).Scan(&d.UID, &d.DeviceType, &d.Name, &alias,
-		&zoneID, &d.FirstSeen, &d.LastSeen, &fwVer, &d.BatteryMV, &d.RSSI, &d.IsRegistered, &d.UpdatedAt)
+		&zoneID, &d.FirstSeen, &d.LastSeen, &fwVer, &d.ProtocolVer, &d.BatteryMV, &d.RSSI, &d.IsRegistered, &d.UpdatedAt)
 	if err != nil {
 		return nil, err
 	}
@@ -275,7 +918,7 @@ func (db *DB) GetDevice(uid string) (*Device, error) {
 // GetAllDevices retrieves all devices
 func (db *DB) GetAllDevices() ([]*Device, error) {
 	query := `SELECT uid, device_type, name, alias, zone_id, first_seen, last_seen,
-		firmware_version, battery_mv, rssi, is_registered, updated_at FROM devices`
+		firmware_version, COALESCE(protocol_version, 0), battery_mv, rssi, is_registered, updated_at FROM devices`
 
 	rows, err := db.conn.Query(query)
 	if err != nil {
@@ -288,7 +931,7 @@ func (db *DB) GetAllDevices() ([]*Device, error) {
 		d := &Device{}
 		var zoneID, alias, fwVer sql.NullString
 		if err := rows.Scan(&d.UID, &d.DeviceType, &d.Name, &alias, &zoneID,
-			&d.FirstSeen, &d.LastSeen, &fwVer, &d.BatteryMV, &d.RSSI, &d.IsRegistered, &d.UpdatedAt); err != nil {
+			&d.FirstSeen, &d.LastSeen, &fwVer, &d.ProtocolVer, &d.BatteryMV, &d.RSSI, &d.IsRegistered, &d.UpdatedAt); err != nil {
 			return nil, err
 		}
 		d.Alias = alias.String
@@ -299,65 +942,196 @@ func (db *DB) GetAllDevices() ([]*Device, error) {
 	return devices, rows.Err()
 }
 
-// IsDeviceRegistered checks if a device UID is in the registered list
-func (db *DB) IsDeviceRegistered(uid string) (bool, error) {
-	var registered bool
-	err := db.conn.QueryRow("SELECT is_registered FROM devices WHERE uid = ?", uid).Scan(&registered)
-	if err == sql.ErrNoRows {
-		return false, nil
-	}
-	return registered, err
-}
-
-// --- Soil Moisture Operations ---
-
-// InsertSoilMoistureReading inserts a new soil moisture reading
-func (db *DB) InsertSoilMoistureReading(r *SoilMoistureReading) (int64, error) {
-	query := `INSERT INTO soil_moisture_readings 
-		(device_uid, probe_id, moisture_raw, moisture_percent, temperature, battery_mv, rssi, timestamp)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
-
-	result, err := db.conn.Exec(query, r.DeviceUID, r.ProbeID, r.MoistureRaw,
-		r.MoisturePercent, r.Temperature, r.BatteryMV, r.RSSI, r.Timestamp)
-	if err != nil {
-		return 0, err
-	}
-	return result.LastInsertId()
+// UpdateDeviceClock records the clock skew a device reported when it applied
+// a time sync, and its drift rate if known
+func (db *DB) UpdateDeviceClock(c *DeviceClock) error {
+	_, err := db.conn.Exec(`UPDATE devices SET clock_skew_ms = ?, clock_drift_ppm = ?, clock_checked_at = ?
+		WHERE uid = ?`, c.Skew.Milliseconds(), c.DriftPPM, c.CheckedAt, c.DeviceUID)
+	return err
 }
 
-// GetSoilMoistureReadings retrieves readings for a device
-func (db *DB) GetSoilMoistureReadings(deviceUID string, limit int) ([]*SoilMoistureReading, error) {
-	query := `SELECT id, device_uid, probe_id, moisture_raw, moisture_percent, temperature,
-		battery_mv, rssi, timestamp, synced_to_cloud
-		FROM soil_moisture_readings WHERE device_uid = ?
-		ORDER BY timestamp DESC LIMIT ?`
-
-	rows, err := db.conn.Query(query, deviceUID, limit)
+// GetDeviceClocks retrieves the last reported clock state of every device
+// that has confirmed a time sync
+func (db *DB) GetDeviceClocks() ([]*DeviceClock, error) {
+	rows, err := db.conn.Query(`SELECT uid, clock_skew_ms, clock_drift_ppm, clock_checked_at
+		FROM devices WHERE clock_checked_at IS NOT NULL ORDER BY uid`)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var readings []*SoilMoistureReading
+	var clocks []*DeviceClock
 	for rows.Next() {
-		r := &SoilMoistureReading{}
-		if err := rows.Scan(&r.ID, &r.DeviceUID, &r.ProbeID, &r.MoistureRaw,
-			&r.MoisturePercent, &r.Temperature, &r.BatteryMV, &r.RSSI, &r.Timestamp, &r.SyncedToCloud); err != nil {
+		c := &DeviceClock{}
+		var skewMS int64
+		var drift sql.NullFloat64
+		if err := rows.Scan(&c.DeviceUID, &skewMS, &drift, &c.CheckedAt); err != nil {
 			return nil, err
 		}
-		readings = append(readings, r)
+		c.Skew = time.Duration(skewMS) * time.Millisecond
+		if drift.Valid {
+			c.DriftPPM = &drift.Float64
+		}
+		clocks = append(clocks, c)
 	}
-	return readings, rows.Err()
+	return clocks, rows.Err()
 }
 
-// GetUnsyncedSoilMoistureReadings retrieves readings not yet synced to cloud
-func (db *DB) GetUnsyncedSoilMoistureReadings(limit int) ([]*SoilMoistureReading, error) {
-	query := `SELECT id, device_uid, probe_id, moisture_raw, moisture_percent, temperature,
-		battery_mv, rssi, timestamp, synced_to_cloud
-		FROM soil_moisture_readings WHERE synced_to_cloud = 0
-		ORDER BY timestamp LIMIT ?`
+// UpdateDeviceSequence records the sequence number of a device's last
+// accepted uplink
+func (db *DB) UpdateDeviceSequence(s *DeviceSequence) error {
+	_, err := db.conn.Exec("UPDATE devices SET last_seq = ?, last_seq_at = ? WHERE uid = ?", s.Sequence, s.SeenAt, s.DeviceUID)
+	return err
+}
 
-	rows, err := db.conn.Query(query, limit)
+// GetDeviceSequences retrieves the last accepted uplink sequence of every
+// device that has one
+func (db *DB) GetDeviceSequences() ([]*DeviceSequence, error) {
+	rows, err := db.conn.Query(`SELECT uid, last_seq, last_seq_at
+		FROM devices WHERE last_seq_at IS NOT NULL ORDER BY uid`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var seqs []*DeviceSequence
+	for rows.Next() {
+		s := &DeviceSequence{}
+		if err := rows.Scan(&s.DeviceUID, &s.Sequence, &s.SeenAt); err != nil {
+			return nil, err
+		}
+		seqs = append(seqs, s)
+	}
+	return seqs, rows.Err()
+}
+
+// UpdateDeviceFirmware records the firmware version a device reported
+func (db *DB) UpdateDeviceFirmware(uid, version string) error {
+	_, err := db.conn.Exec("UPDATE devices SET firmware_version = ?, updated_at = ? WHERE uid = ?", version, time.Now(), uid)
+	return err
+}
+
+// GetDeviceFirmwareVersions retrieves the firmware version of every device
+// that has reported one, by device UID
+func (db *DB) GetDeviceFirmwareVersions() (map[string]string, error) {
+	rows, err := db.conn.Query("SELECT uid, firmware_version FROM devices WHERE firmware_version IS NOT NULL AND firmware_version != ''")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := make(map[string]string)
+	for rows.Next() {
+		var uid, version string
+		if err := rows.Scan(&uid, &version); err != nil {
+			return nil, err
+		}
+		versions[uid] = version
+	}
+	return versions, rows.Err()
+}
+
+// UpdateDeviceProtocolVersion records the LoRa protocol version of a device's
+// latest uplink
+func (db *DB) UpdateDeviceProtocolVersion(uid string, version uint8) error {
+	_, err := db.conn.Exec("UPDATE devices SET protocol_version = ? WHERE uid = ?", version, uid)
+	return err
+}
+
+// GetDeviceProtocolVersions retrieves the last reported protocol version of
+// every device that has one, by device UID
+func (db *DB) GetDeviceProtocolVersions() (map[string]uint8, error) {
+	rows, err := db.conn.Query("SELECT uid, protocol_version FROM devices WHERE protocol_version IS NOT NULL")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := make(map[string]uint8)
+	for rows.Next() {
+		var uid string
+		var version uint8
+		if err := rows.Scan(&uid, &version); err != nil {
+			return nil, err
+		}
+		versions[uid] = version
+	}
+	return versions, rows.Err()
+}
+
+// QuarantineDevice records that a device's uplinks are dropped until it is
+// approved again, and why
+func (db *DB) QuarantineDevice(uid, reason string, at time.Time) error {
+	_, err := db.conn.Exec("UPDATE devices SET quarantined_at = ?, quarantine_reason = ? WHERE uid = ?", at, reason, uid)
+	return err
+}
+
+// ReleaseDevice lifts a device's quarantine, reporting whether it was
+// quarantined
+func (db *DB) ReleaseDevice(uid string) (bool, error) {
+	result, err := db.conn.Exec(`UPDATE devices SET quarantined_at = NULL, quarantine_reason = NULL
+		WHERE uid = ? AND quarantined_at IS NOT NULL`, uid)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// GetQuarantinedDevices retrieves the reason each quarantined device was
+// quarantined, by device UID
+func (db *DB) GetQuarantinedDevices() (map[string]string, error) {
+	rows, err := db.conn.Query("SELECT uid, COALESCE(quarantine_reason, '') FROM devices WHERE quarantined_at IS NOT NULL")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	quarantined := make(map[string]string)
+	for rows.Next() {
+		var uid, reason string
+		if err := rows.Scan(&uid, &reason); err != nil {
+			return nil, err
+		}
+		quarantined[uid] = reason
+	}
+	return quarantined, rows.Err()
+}
+
+// IsDeviceRegistered checks if a device UID is in the registered list
+func (db *DB) IsDeviceRegistered(uid string) (bool, error) {
+	var registered bool
+	err := db.conn.QueryRow("SELECT is_registered FROM devices WHERE uid = ?", uid).Scan(&registered)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return registered, err
+}
+
+// --- Soil Moisture Operations ---
+
+// InsertSoilMoistureReading inserts a new soil moisture reading
+func (db *DB) InsertSoilMoistureReading(r *SoilMoistureReading) (int64, error) {
+	query := `INSERT INTO soil_moisture_readings 
+		(device_uid, probe_id, moisture_raw, moisture_percent, temperature, battery_mv, rssi, timestamp)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+
+	result, err := db.conn.Exec(query, r.DeviceUID, r.ProbeID, r.MoistureRaw,
+		r.MoisturePercent, r.Temperature, r.BatteryMV, r.RSSI, r.Timestamp)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// GetSoilMoistureReadings retrieves readings for a device
+func (db *DB) GetSoilMoistureReadings(deviceUID string, limit int) ([]*SoilMoistureReading, error) {
+	query := `SELECT id, device_uid, probe_id, moisture_raw, moisture_percent, temperature,
+		battery_mv, rssi, timestamp, id <= ` + soilCursorSQL + `, report_id
+		FROM soil_moisture_readings WHERE device_uid = ?
+		ORDER BY timestamp DESC LIMIT ?`
+
+	rows, err := db.conn.Query(query, deviceUID, limit)
 	if err != nil {
 		return nil, err
 	}
@@ -366,30 +1140,204 @@ func (db *DB) GetUnsyncedSoilMoistureReadings(limit int) ([]*SoilMoistureReading
 	var readings []*SoilMoistureReading
 	for rows.Next() {
 		r := &SoilMoistureReading{}
+		var reportID sql.NullInt64
 		if err := rows.Scan(&r.ID, &r.DeviceUID, &r.ProbeID, &r.MoistureRaw,
-			&r.MoisturePercent, &r.Temperature, &r.BatteryMV, &r.RSSI, &r.Timestamp, &r.SyncedToCloud); err != nil {
+			&r.MoisturePercent, &r.Temperature, &r.BatteryMV, &r.RSSI, &r.Timestamp, &r.SyncedToCloud, &reportID); err != nil {
 			return nil, err
 		}
+		r.ReportID = reportID.Int64
 		readings = append(readings, r)
 	}
 	return readings, rows.Err()
 }
 
-// MarkSoilMoistureReadingSynced marks a reading as synced
-func (db *DB) MarkSoilMoistureReadingSynced(id int64) error {
-	_, err := db.conn.Exec("UPDATE soil_moisture_readings SET synced_to_cloud = 1 WHERE id = ?", id)
-	return err
+// GetLatestSoilMoisture returns the most recent moisture percentage of a
+// probe, or false if it has no readings
+func (db *DB) GetLatestSoilMoisture(deviceUID string, probeID uint8) (uint8, bool, error) {
+	var percent uint8
+	err := db.conn.QueryRow(`SELECT moisture_percent FROM soil_moisture_readings
+		WHERE device_uid = ? AND probe_id = ? ORDER BY timestamp DESC LIMIT 1`, deviceUID, probeID).Scan(&percent)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	return percent, err == nil, err
+}
+
+// GetLatestSoilMoistureReading retrieves the most recent reading of a probe,
+// or nil if it has none
+func (db *DB) GetLatestSoilMoistureReading(deviceUID string, probeID uint8) (*SoilMoistureReading, error) {
+	r := &SoilMoistureReading{}
+	var reportID sql.NullInt64
+	err := db.conn.QueryRow(`SELECT id, device_uid, probe_id, moisture_raw, moisture_percent, COALESCE(temperature, 0),
+		COALESCE(battery_mv, 0), COALESCE(rssi, 0), timestamp, id <= `+soilCursorSQL+`, report_id
+		FROM soil_moisture_readings WHERE device_uid = ? AND probe_id = ?
+		ORDER BY timestamp DESC LIMIT 1`, deviceUID, probeID).Scan(&r.ID, &r.DeviceUID, &r.ProbeID, &r.MoistureRaw,
+		&r.MoisturePercent, &r.Temperature, &r.BatteryMV, &r.RSSI, &r.Timestamp, &r.SyncedToCloud, &reportID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	r.ReportID = reportID.Int64
+	return r, nil
+}
+
+// GetZoneSoilReadings retrieves the readings since a time of the soil
+// sensors assigned to a zone, keyed by zone and ordered by device, probe, and
+// time
+func (db *DB) GetZoneSoilReadings(since time.Time) (map[string][]*SoilMoistureReading, error) {
+	rows, err := db.conn.Query(`SELECT d.zone_id, r.id, r.device_uid, r.probe_id, r.moisture_percent,
+		COALESCE(r.temperature, 0), r.timestamp
+		FROM soil_moisture_readings r JOIN devices d ON d.uid = r.device_uid
+		WHERE d.zone_id IS NOT NULL AND d.zone_id != '' AND r.timestamp >= ?
+		ORDER BY d.zone_id, r.device_uid, r.probe_id, r.timestamp`, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	readings := make(map[string][]*SoilMoistureReading)
+	for rows.Next() {
+		var zoneID string
+		r := &SoilMoistureReading{}
+		if err := rows.Scan(&zoneID, &r.ID, &r.DeviceUID, &r.ProbeID, &r.MoisturePercent, &r.Temperature, &r.Timestamp); err != nil {
+			return nil, err
+		}
+		readings[zoneID] = append(readings[zoneID], r)
+	}
+	return readings, rows.Err()
+}
+
+// GetUnsyncedSoilMoistureReadings retrieves readings past the sync cursor,
+// in ID order, with whole soil reports; a batch may run past the limit to
+// finish its last report
+func (db *DB) GetUnsyncedSoilMoistureReadings(limit int) ([]*SoilMoistureReading, error) {
+	return db.queryUnsyncedSoilReadings("", limit)
+}
+
+// GetUnsyncedSoilMoistureReadingsBefore retrieves readings past the sync
+// cursor, in ID order, stopping at the first taken at or after a time so
+// the cursor never passes a reading left behind
+func (db *DB) GetUnsyncedSoilMoistureReadingsBefore(before time.Time, limit int) ([]*SoilMoistureReading, error) {
+	return db.queryUnsyncedSoilReadings(`AND id < (SELECT COALESCE(MIN(id), 9223372036854775807) FROM soil_moisture_readings
+		WHERE id > `+soilCursorSQL+` AND timestamp >= ?)`, before, limit)
+}
+
+func (db *DB) queryUnsyncedSoilReadings(cond string, args ...interface{}) ([]*SoilMoistureReading, error) {
+	return db.querySyncSoilReadings("id > "+soilCursorSQL+" "+cond, args...)
+}
+
+// querySyncSoilReadings retrieves readings for sending to the cloud, in ID
+// order. The last argument is the limit. A batch ending partway through a
+// soil report runs on to the report's last probe, so the cloud gets each
+// report as one group.
+func (db *DB) querySyncSoilReadings(where string, args ...interface{}) ([]*SoilMoistureReading, error) {
+	readings, err := db.scanSyncSoilReadings(`SELECT id, device_uid, probe_id, moisture_raw, moisture_percent, temperature,
+		battery_mv, rssi, timestamp, 0, report_id
+		FROM soil_moisture_readings WHERE `+where+`
+		ORDER BY id LIMIT ?`, args...)
+	if err != nil || len(readings) == 0 {
+		return readings, err
+	}
+
+	// A report's probes are stored together, so only the last can be cut short
+	last := readings[len(readings)-1]
+	if last.ReportID == 0 {
+		return readings, nil
+	}
+	rest, err := db.scanSyncSoilReadings(`SELECT id, device_uid, probe_id, moisture_raw, moisture_percent, temperature,
+		battery_mv, rssi, timestamp, 0, report_id
+		FROM soil_moisture_readings WHERE report_id = ? AND id > ?
+		ORDER BY id`, last.ReportID, last.ID)
+	if err != nil {
+		return nil, err
+	}
+	return append(readings, rest...), nil
+}
+
+func (db *DB) scanSyncSoilReadings(query string, args ...interface{}) ([]*SoilMoistureReading, error) {
+	rows, err := db.conn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var readings []*SoilMoistureReading
+	for rows.Next() {
+		r := &SoilMoistureReading{}
+		var reportID sql.NullInt64
+		if err := rows.Scan(&r.ID, &r.DeviceUID, &r.ProbeID, &r.MoistureRaw,
+			&r.MoisturePercent, &r.Temperature, &r.BatteryMV, &r.RSSI, &r.Timestamp, &r.SyncedToCloud, &reportID); err != nil {
+			return nil, err
+		}
+		r.ReportID = reportID.Int64
+		readings = append(readings, r)
+	}
+	return readings, rows.Err()
+}
+
+// InsertSoilReport stores a multi-probe report and its probe readings as one
+// group sharing the report ID and timestamp
+func (db *DB) InsertSoilReport(report *SoilReport, readings []*SoilMoistureReading) (int64, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`INSERT INTO soil_reports
+		(device_uid, probe_count, temperature, battery_mv, flags, rssi, timestamp)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		report.DeviceUID, report.ProbeCount, report.Temperature, report.BatteryMV,
+		report.Flags, report.RSSI, report.Timestamp)
+	if err != nil {
+		return 0, err
+	}
+	reportID, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, r := range readings {
+		_, err := tx.Exec(`INSERT INTO soil_moisture_readings
+			(device_uid, probe_id, moisture_raw, moisture_percent, temperature, battery_mv, rssi, timestamp, report_id)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			report.DeviceUID, r.ProbeID, r.MoistureRaw, r.MoisturePercent,
+			report.Temperature, report.BatteryMV, report.RSSI, report.Timestamp, reportID)
+		if err != nil {
+			return 0, err
+		}
+		r.DeviceUID = report.DeviceUID
+		r.Temperature = report.Temperature
+		r.BatteryMV = report.BatteryMV
+		r.RSSI = report.RSSI
+		r.Timestamp = report.Timestamp
+		r.ReportID = reportID
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	report.ID = reportID
+	return reportID, nil
 }
 
 // --- Water Meter Operations ---
 
-// InsertWaterMeterReading inserts a new water meter reading
+// InsertWaterMeterReading inserts a new water meter reading. A reading with
+// no cumulative total falls back to its raw total when read.
 func (db *DB) InsertWaterMeterReading(r *WaterMeterReading) (int64, error) {
+	var cumulative interface{}
+	if r.CumulativeL != 0 {
+		cumulative = r.CumulativeL
+	}
+
 	query := `INSERT INTO water_meter_readings 
-		(device_uid, total_volume_l, flow_rate_lpm, signal_uv, temperature_c, signal_quality, battery_mv, rssi, timestamp)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+		(device_uid, total_volume_l, cumulative_l, flow_rate_lpm, signal_uv, temperature_c, signal_quality, battery_mv, rssi, timestamp)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
 
-	result, err := db.conn.Exec(query, r.DeviceUID, r.TotalVolumeL, r.FlowRateLPM,
+	result, err := db.conn.Exec(query, r.DeviceUID, r.TotalVolumeL, cumulative, r.FlowRateLPM,
 		r.SignalUV, r.TemperatureC, r.SignalQuality, r.BatteryMV, r.RSSI, r.Timestamp)
 	if err != nil {
 		return 0, err
@@ -397,13 +1345,32 @@ func (db *DB) InsertWaterMeterReading(r *WaterMeterReading) (int64, error) {
 	return result.LastInsertId()
 }
 
-// GetUnsyncedWaterMeterReadings retrieves readings not yet synced to cloud
+// GetUnsyncedWaterMeterReadings retrieves readings past the sync cursor, in
+// ID order
 func (db *DB) GetUnsyncedWaterMeterReadings(limit int) ([]*WaterMeterReading, error) {
-	query := `SELECT id, device_uid, total_volume_l, flow_rate_lpm, signal_uv, temperature_c, signal_quality, battery_mv, rssi, timestamp, synced_to_cloud
-		FROM water_meter_readings WHERE synced_to_cloud = 0
-		ORDER BY timestamp LIMIT ?`
+	return db.queryUnsyncedMeterReadings("", limit)
+}
 
-	rows, err := db.conn.Query(query, limit)
+// GetUnsyncedWaterMeterReadingsBefore retrieves readings past the sync
+// cursor, in ID order, stopping at the first taken at or after a time
+func (db *DB) GetUnsyncedWaterMeterReadingsBefore(before time.Time, limit int) ([]*WaterMeterReading, error) {
+	return db.queryUnsyncedMeterReadings(`AND id < (SELECT COALESCE(MIN(id), 9223372036854775807) FROM water_meter_readings
+		WHERE id > `+meterCursorSQL+` AND timestamp >= ?)`, before, limit)
+}
+
+func (db *DB) queryUnsyncedMeterReadings(cond string, args ...interface{}) ([]*WaterMeterReading, error) {
+	return db.querySyncMeterReadings("id > "+meterCursorSQL+" "+cond, args...)
+}
+
+// querySyncMeterReadings retrieves readings for sending to the cloud, in ID
+// order. The last argument is the limit.
+func (db *DB) querySyncMeterReadings(where string, args ...interface{}) ([]*WaterMeterReading, error) {
+	query := `SELECT id, device_uid, total_volume_l, COALESCE(cumulative_l, total_volume_l), flow_rate_lpm, signal_uv, temperature_c,
+		signal_quality, battery_mv, rssi, timestamp, 0
+		FROM water_meter_readings WHERE ` + where + `
+		ORDER BY id LIMIT ?`
+
+	rows, err := db.conn.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -412,7 +1379,7 @@ func (db *DB) GetUnsyncedWaterMeterReadings(limit int) ([]*WaterMeterReading, er
 	var readings []*WaterMeterReading
 	for rows.Next() {
 		r := &WaterMeterReading{}
-		if err := rows.Scan(&r.ID, &r.DeviceUID, &r.TotalVolumeL, &r.FlowRateLPM,
+		if err := rows.Scan(&r.ID, &r.DeviceUID, &r.TotalVolumeL, &r.CumulativeL, &r.FlowRateLPM,
 			&r.SignalUV, &r.TemperatureC, &r.SignalQuality, &r.BatteryMV, &r.RSSI, &r.Timestamp, &r.SyncedToCloud); err != nil {
 			return nil, err
 		}
@@ -421,10 +1388,47 @@ func (db *DB) GetUnsyncedWaterMeterReadings(limit int) ([]*WaterMeterReading, er
 	return readings, rows.Err()
 }
 
-// MarkWaterMeterReadingSynced marks a reading as synced
-func (db *DB) MarkWaterMeterReadingSynced(id int64) error {
-	_, err := db.conn.Exec("UPDATE water_meter_readings SET synced_to_cloud = 1 WHERE id = ?", id)
-	return err
+// GetWaterMeterReadingsSince retrieves readings from all meters since a time, oldest first
+func (db *DB) GetWaterMeterReadingsSince(since time.Time) ([]*WaterMeterReading, error) {
+	query := `SELECT id, device_uid, total_volume_l, COALESCE(cumulative_l, total_volume_l), flow_rate_lpm, COALESCE(signal_uv, 0),
+		COALESCE(temperature_c, 0), COALESCE(signal_quality, 0), battery_mv, rssi, timestamp, id <= ` + meterCursorSQL + `
+		FROM water_meter_readings WHERE timestamp >= ?
+		ORDER BY timestamp`
+
+	rows, err := db.conn.Query(query, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var readings []*WaterMeterReading
+	for rows.Next() {
+		r := &WaterMeterReading{}
+		if err := rows.Scan(&r.ID, &r.DeviceUID, &r.TotalVolumeL, &r.CumulativeL, &r.FlowRateLPM,
+			&r.SignalUV, &r.TemperatureC, &r.SignalQuality, &r.BatteryMV, &r.RSSI, &r.Timestamp, &r.SyncedToCloud); err != nil {
+			return nil, err
+		}
+		readings = append(readings, r)
+	}
+	return readings, rows.Err()
+}
+
+// GetLatestWaterMeterReading retrieves the most recent reading of a meter,
+// or nil if it has none
+func (db *DB) GetLatestWaterMeterReading(deviceUID string) (*WaterMeterReading, error) {
+	r := &WaterMeterReading{}
+	err := db.conn.QueryRow(`SELECT id, device_uid, total_volume_l, COALESCE(cumulative_l, total_volume_l), flow_rate_lpm,
+		COALESCE(signal_uv, 0), COALESCE(temperature_c, 0), COALESCE(signal_quality, 0), battery_mv, rssi, timestamp, id <= `+meterCursorSQL+`
+		FROM water_meter_readings WHERE device_uid = ?
+		ORDER BY timestamp DESC LIMIT 1`, deviceUID).Scan(&r.ID, &r.DeviceUID, &r.TotalVolumeL, &r.CumulativeL, &r.FlowRateLPM,
+		&r.SignalUV, &r.TemperatureC, &r.SignalQuality, &r.BatteryMV, &r.RSSI, &r.Timestamp, &r.SyncedToCloud)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
 }
 
 // --- Meter Alarm Operations ---
@@ -432,11 +1436,15 @@ func (db *DB) MarkWaterMeterReadingSynced(id int64) error {
 // InsertMeterAlarm inserts a new meter alarm
 func (db *DB) InsertMeterAlarm(a *MeterAlarm) (int64, error) {
 	query := `INSERT INTO meter_alarms 
-		(device_uid, alarm_type, flow_rate_lpm, duration_sec, total_volume_l, rssi, timestamp)
-		VALUES (?, ?, ?, ?, ?, ?, ?)`
+		(device_uid, alarm_type, flow_rate_lpm, duration_sec, total_volume_l, rssi, source, timestamp)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
 
+	source := a.Source
+	if source == "" {
+		source = "device"
+	}
 	result, err := db.conn.Exec(query, a.DeviceUID, a.AlarmType, a.FlowRateLPM,
-		a.DurationSec, a.TotalVolumeL, a.RSSI, a.Timestamp)
+		a.DurationSec, a.TotalVolumeL, a.RSSI, source, a.Timestamp)
 	if err != nil {
 		return 0, err
 	}
@@ -445,7 +1453,8 @@ func (db *DB) InsertMeterAlarm(a *MeterAlarm) (int64, error) {
 
 // GetUnsyncedMeterAlarms retrieves alarms not yet synced to cloud
 func (db *DB) GetUnsyncedMeterAlarms(limit int) ([]*MeterAlarm, error) {
-	query := `SELECT id, device_uid, alarm_type, flow_rate_lpm, duration_sec, total_volume_l, rssi, timestamp, synced_to_cloud
+	query := `SELECT id, device_uid, alarm_type, flow_rate_lpm, duration_sec, total_volume_l, rssi,
+		COALESCE(source, 'device'), timestamp, synced_to_cloud
 		FROM meter_alarms WHERE synced_to_cloud = 0
 		ORDER BY timestamp LIMIT ?`
 
@@ -459,7 +1468,7 @@ func (db *DB) GetUnsyncedMeterAlarms(limit int) ([]*MeterAlarm, error) {
 	for rows.Next() {
 		a := &MeterAlarm{}
 		if err := rows.Scan(&a.ID, &a.DeviceUID, &a.AlarmType, &a.FlowRateLPM,
-			&a.DurationSec, &a.TotalVolumeL, &a.RSSI, &a.Timestamp, &a.SyncedToCloud); err != nil {
+			&a.DurationSec, &a.TotalVolumeL, &a.RSSI, &a.Source, &a.Timestamp, &a.SyncedToCloud); err != nil {
 			return nil, err
 		}
 		alarms = append(alarms, a)
@@ -467,6 +1476,19 @@ func (db *DB) GetUnsyncedMeterAlarms(limit int) ([]*MeterAlarm, error) {
 	return alarms, rows.Err()
 }
 
+// GetMeterAlarm retrieves a meter alarm by ID
+func (db *DB) GetMeterAlarm(id int64) (*MeterAlarm, error) {
+	a := &MeterAlarm{}
+	err := db.conn.QueryRow(`SELECT id, device_uid, alarm_type, flow_rate_lpm, duration_sec, total_volume_l, rssi,
+		COALESCE(source, 'device'), timestamp, synced_to_cloud
+		FROM meter_alarms WHERE id = ?`, id).Scan(&a.ID, &a.DeviceUID, &a.AlarmType, &a.FlowRateLPM,
+		&a.DurationSec, &a.TotalVolumeL, &a.RSSI, &a.Source, &a.Timestamp, &a.SyncedToCloud)
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
 // MarkMeterAlarmSynced marks an alarm as synced
 func (db *DB) MarkMeterAlarmSynced(id int64) error {
 	_, err := db.conn.Exec("UPDATE meter_alarms SET synced_to_cloud = 1 WHERE id = ?", id)
@@ -478,24 +1500,49 @@ func (db *DB) MarkMeterAlarmSynced(id int64) error {
 // InsertValveEvent inserts a new valve event
 func (db *DB) InsertValveEvent(e *ValveEvent) (int64, error) {
 	query := `INSERT INTO valve_events 
-		(controller_uid, actuator_addr, prev_state, new_state, command_id, source, timestamp)
-		VALUES (?, ?, ?, ?, ?, ?, ?)`
+		(controller_uid, actuator_addr, prev_state, new_state, command_id, source, note, timestamp)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
 
 	result, err := db.conn.Exec(query, e.ControllerUID, e.ActuatorAddr, e.PrevState,
-		e.NewState, e.CommandID, e.Source, e.Timestamp)
+		e.NewState, e.CommandID, e.Source, nullIfEmpty(e.Note), e.Timestamp)
 	if err != nil {
 		return 0, err
 	}
 	return result.LastInsertId()
 }
 
-// GetUnsyncedValveEvents retrieves events not yet synced to cloud
+// GetUnsyncedValveEvents retrieves events past the sync cursor, in ID order
 func (db *DB) GetUnsyncedValveEvents(limit int) ([]*ValveEvent, error) {
-	query := `SELECT id, controller_uid, actuator_addr, prev_state, new_state, command_id, source, timestamp, synced_to_cloud
-		FROM valve_events WHERE synced_to_cloud = 0
-		ORDER BY timestamp LIMIT ?`
+	query := `SELECT id, controller_uid, actuator_addr, prev_state, new_state, command_id, source, COALESCE(note, ''), timestamp, 0
+		FROM valve_events WHERE id > ` + valveCursorSQL + `
+		ORDER BY id LIMIT ?`
+	return db.queryValveEvents(query, limit)
+}
 
-	rows, err := db.conn.Query(query, limit)
+// GetValveEventsSince retrieves valve events since a time, oldest first
+func (db *DB) GetValveEventsSince(since time.Time) ([]*ValveEvent, error) {
+	query := `SELECT id, controller_uid, actuator_addr, prev_state, new_state, command_id, source, COALESCE(note, ''), timestamp, id <= ` + valveCursorSQL + `
+		FROM valve_events WHERE timestamp >= ?
+		ORDER BY timestamp`
+	return db.queryValveEvents(query, since)
+}
+
+// GetLastValveEventsBefore retrieves the most recent event for each actuator
+// before a time, i.e. the valve states at that time
+func (db *DB) GetLastValveEventsBefore(before time.Time) ([]*ValveEvent, error) {
+	query := `SELECT e.id, e.controller_uid, e.actuator_addr, e.prev_state, e.new_state, e.command_id, e.source, COALESCE(e.note, ''), e.timestamp, e.id <= ` + valveCursorSQL + `
+		FROM valve_events e
+		WHERE e.id = (
+			SELECT id FROM valve_events
+			WHERE controller_uid = e.controller_uid AND actuator_addr = e.actuator_addr AND timestamp < ?
+			ORDER BY timestamp DESC, id DESC LIMIT 1
+		)`
+	return db.queryValveEvents(query, before)
+}
+
+// queryValveEvents runs a valve event query and scans the results
+func (db *DB) queryValveEvents(query string, args ...interface{}) ([]*ValveEvent, error) {
+	rows, err := db.conn.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -505,7 +1552,7 @@ func (db *DB) GetUnsyncedValveEvents(limit int) ([]*ValveEvent, error) {
 	for rows.Next() {
 		e := &ValveEvent{}
 		if err := rows.Scan(&e.ID, &e.ControllerUID, &e.ActuatorAddr, &e.PrevState,
-			&e.NewState, &e.CommandID, &e.Source, &e.Timestamp, &e.SyncedToCloud); err != nil {
+			&e.NewState, &e.CommandID, &e.Source, &e.Note, &e.Timestamp, &e.SyncedToCloud); err != nil {
 			return nil, err
 		}
 		events = append(events, e)
@@ -513,64 +1560,247 @@ func (db *DB) GetUnsyncedValveEvents(limit int) ([]*ValveEvent, error) {
 	return events, rows.Err()
 }
 
-// MarkValveEventSynced marks an event as synced
-func (db *DB) MarkValveEventSynced(id int64) error {
-	_, err := db.conn.Exec("UPDATE valve_events SET synced_to_cloud = 1 WHERE id = ?", id)
-	return err
-}
-
-// UpdateValveActuatorState updates the current state of a valve actuator
+// UpdateValveActuatorState updates the current state of a valve actuator.
+// opened_at is set when the valve starts opening and cleared once it is
+// closed, so it records how long the valve has been running.
 func (db *DB) UpdateValveActuatorState(controllerUID string, addr uint8, state uint8) error {
 	uid := fmt.Sprintf("%s_%02d", controllerUID, addr)
-	query := `INSERT INTO valve_actuators (uid, controller_uid, address, name, current_state, last_state_change)
-		VALUES (?, ?, ?, ?, ?, ?)
-		ON CONFLICT(uid) DO UPDATE SET current_state = excluded.current_state, last_state_change = excluded.last_state_change`
-
-	_, err := db.conn.Exec(query, uid, controllerUID, addr, fmt.Sprintf("Valve %d", addr), state, time.Now())
+	query := `INSERT INTO valve_actuators (uid, controller_uid, address, name, current_state, last_state_change, opened_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(uid) DO UPDATE SET current_state = excluded.current_state, last_state_change = excluded.last_state_change,
+			opened_at = CASE WHEN excluded.opened_at IS NULL THEN NULL
+				ELSE COALESCE(valve_actuators.opened_at, excluded.opened_at) END`
+
+	now := time.Now()
+	var openedAt interface{}
+	if protocol.ValveMayFlow(state) {
+		openedAt = now
+	}
+	_, err := db.conn.Exec(query, uid, controllerUID, addr, fmt.Sprintf("Valve %d", addr), state, now, openedAt)
 	return err
 }
 
-// --- Pending Commands ---
+// RegisterValve maps a cloud valve ID to a valve controller and actuator address.
+// Any previous mapping for the valve ID is replaced.
+func (db *DB) RegisterValve(valveID, controllerUID string, addr uint8, name, zoneID string) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
-// InsertPendingCommand inserts a new pending command
-func (db *DB) InsertPendingCommand(cmd *PendingCommand) (int64, error) {
-	query := `INSERT INTO pending_commands 
-		(command_id, controller_uid, actuator_addr, command, expires_at, max_retries)
-		VALUES (?, ?, ?, ?, ?, ?)`
+	// The valve may have moved to a different controller or address
+	if _, err := tx.Exec("UPDATE valve_actuators SET valve_id = NULL WHERE valve_id = ?", valveID); err != nil {
+		return err
+	}
 
-	result, err := db.conn.Exec(query, cmd.CommandID, cmd.ControllerUID, cmd.ActuatorAddr,
-		cmd.Command, cmd.ExpiresAt, cmd.MaxRetries)
+	if name == "" {
+		name = fmt.Sprintf("Valve %d", addr)
+	}
+	var zone interface{}
+	if zoneID != "" {
+		zone = zoneID
+	}
+
+	uid := fmt.Sprintf("%s_%02d", controllerUID, addr)
+	_, err = tx.Exec(`INSERT INTO valve_actuators (uid, controller_uid, address, name, zone_id, is_registered, valve_id, updated_at)
+		VALUES (?, ?, ?, ?, ?, 1, ?, ?)
+		ON CONFLICT(uid) DO UPDATE SET name = excluded.name, zone_id = COALESCE(excluded.zone_id, valve_actuators.zone_id),
+			is_registered = 1, valve_id = excluded.valve_id, updated_at = excluded.updated_at`,
+		uid, controllerUID, addr, name, zone, valveID, time.Now())
 	if err != nil {
-		return 0, err
+		return err
 	}
-	return result.LastInsertId()
-}
 
-// AcknowledgeCommand marks a command as acknowledged
-func (db *DB) AcknowledgeCommand(commandID uint16, resultState uint8) error {
-	query := `UPDATE pending_commands SET acknowledged = 1, ack_time = ?, result_state = ?
-		WHERE command_id = ? AND acknowledged = 0`
-	_, err := db.conn.Exec(query, time.Now(), resultState, commandID)
-	return err
+	return tx.Commit()
 }
 
-// GetPendingCommand retrieves a pending command by ID
-func (db *DB) GetPendingCommand(commandID uint16) (*PendingCommand, error) {
-	query := `SELECT id, command_id, controller_uid, actuator_addr, command, created_at,
-		expires_at, retries, max_retries, acknowledged, ack_time, result_state
-		FROM pending_commands WHERE command_id = ?`
+// UpdateValveActuatorMeta applies cloud-managed names and zone assignment to
+// an actuator, creating it if it hasn't reported yet. An empty name resets it
+// to the default "Valve N".
+func (db *DB) UpdateValveActuatorMeta(controllerUID string, addr uint8, meta ValveActuatorMeta) error {
+	uid := fmt.Sprintf("%s_%02d", controllerUID, addr)
+	defaultName := fmt.Sprintf("Valve %d", addr)
 
-	cmd := &PendingCommand{}
-	var ackTime sql.NullTime
-	err := db.conn.QueryRow(query, commandID).Scan(&cmd.ID, &cmd.CommandID, &cmd.ControllerUID,
-		&cmd.ActuatorAddr, &cmd.Command, &cmd.CreatedAt, &cmd.ExpiresAt, &cmd.Retries,
-		&cmd.MaxRetries, &cmd.Acknowledged, &ackTime, &cmd.ResultState)
-	if err != nil {
-		return nil, err
+	var name, alias, zone interface{}
+	if meta.Name != nil {
+		name = *meta.Name
+		if *meta.Name == "" {
+			name = defaultName
+		}
 	}
-	if ackTime.Valid {
+	if meta.Alias != nil {
+		alias = *meta.Alias
+	}
+	if meta.ZoneID != nil {
+		zone = *meta.ZoneID
+	}
+
+	_, err := db.conn.Exec(`INSERT INTO valve_actuators (uid, controller_uid, address, name, alias, zone_id, updated_at)
+		VALUES (?, ?, ?, COALESCE(?, ?), NULLIF(?, ''), NULLIF(?, ''), ?)
+		ON CONFLICT(uid) DO UPDATE SET
+			name = CASE WHEN CAST(? AS TEXT) IS NULL THEN valve_actuators.name ELSE excluded.name END,
+			alias = CASE WHEN CAST(? AS TEXT) IS NULL THEN valve_actuators.alias ELSE excluded.alias END,
+			zone_id = CASE WHEN CAST(? AS TEXT) IS NULL THEN valve_actuators.zone_id ELSE excluded.zone_id END,
+			updated_at = excluded.updated_at`,
+		uid, controllerUID, addr, name, defaultName, alias, zone, time.Now(), name, alias, zone)
+	return err
+}
+
+// LookupValve resolves a cloud valve ID to its actuator, or nil if unmapped
+func (db *DB) LookupValve(valveID string) (*ValveActuator, error) {
+	a := &ValveActuator{}
+	err := db.conn.QueryRow(`SELECT uid, controller_uid, address, name, COALESCE(valve_id, '')
+		FROM valve_actuators WHERE valve_id = ?`, valveID).Scan(&a.UID, &a.ControllerUID, &a.Address, &a.Name, &a.ValveID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// GetValveActuatorState returns the last reported state of an actuator, or
+// false if it is not known
+func (db *DB) GetValveActuatorState(controllerUID string, addr uint8) (uint8, bool, error) {
+	var state uint8
+	err := db.conn.QueryRow(`SELECT current_state FROM valve_actuators
+		WHERE controller_uid = ? AND address = ?`, controllerUID, addr).Scan(&state)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	return state, err == nil, err
+}
+
+// GetOpenValveActuators retrieves actuators that are currently open, with the
+// time they opened
+func (db *DB) GetOpenValveActuators() ([]*ValveActuator, error) {
+	query := `SELECT uid, controller_uid, address, name, COALESCE(alias, ''), COALESCE(zone_id, ''),
+		current_state, last_state_change, is_registered, opened_at
+		FROM valve_actuators WHERE opened_at IS NOT NULL
+		ORDER BY opened_at`
+
+	rows, err := db.conn.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var actuators []*ValveActuator
+	for rows.Next() {
+		a := &ValveActuator{}
+		var lastChange, openedAt sql.NullTime
+		if err := rows.Scan(&a.UID, &a.ControllerUID, &a.Address, &a.Name, &a.Alias, &a.ZoneID,
+			&a.CurrentState, &lastChange, &a.IsRegistered, &openedAt); err != nil {
+			return nil, err
+		}
+		a.LastStateChange = lastChange.Time
+		a.OpenedAt = openedAt.Time
+		actuators = append(actuators, a)
+	}
+	return actuators, rows.Err()
+}
+
+// GetValveActuators retrieves all actuators ordered by controller and address
+func (db *DB) GetValveActuators() ([]*ValveActuator, error) {
+	query := `SELECT uid, controller_uid, address, name, COALESCE(alias, ''), COALESCE(zone_id, ''),
+		current_state, last_state_change, is_registered, opened_at, COALESCE(valve_id, ''), updated_at
+		FROM valve_actuators ORDER BY controller_uid, address`
+
+	rows, err := db.conn.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var actuators []*ValveActuator
+	for rows.Next() {
+		a := &ValveActuator{}
+		var lastChange, openedAt, updatedAt sql.NullTime
+		if err := rows.Scan(&a.UID, &a.ControllerUID, &a.Address, &a.Name, &a.Alias, &a.ZoneID,
+			&a.CurrentState, &lastChange, &a.IsRegistered, &openedAt, &a.ValveID, &updatedAt); err != nil {
+			return nil, err
+		}
+		a.LastStateChange = lastChange.Time
+		a.OpenedAt = openedAt.Time
+		a.UpdatedAt = updatedAt.Time
+		actuators = append(actuators, a)
+	}
+	return actuators, rows.Err()
+}
+
+// --- Pending Commands ---
+
+// InsertPendingCommand inserts a new pending command
+func (db *DB) InsertPendingCommand(cmd *PendingCommand) (int64, error) {
+	query := `INSERT INTO pending_commands 
+		(command_id, controller_uid, actuator_addr, command, expires_at, max_retries, cloud_command_id, sequence, group_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+	var cloudID, groupID interface{}
+	if cmd.CloudCommandID != "" {
+		cloudID = cmd.CloudCommandID
+	}
+	if cmd.GroupID != 0 {
+		groupID = cmd.GroupID
+	}
+	result, err := db.conn.Exec(query, cmd.CommandID, cmd.ControllerUID, cmd.ActuatorAddr,
+		cmd.Command, cmd.ExpiresAt, cmd.MaxRetries, cloudID, cmd.Sequence, groupID)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// AcknowledgeCommand marks a command as acknowledged
+func (db *DB) AcknowledgeCommand(commandID uint16, resultState uint8) error {
+	query := `UPDATE pending_commands SET acknowledged = 1, ack_time = ?, result_state = ?
+		WHERE command_id = ? AND acknowledged = 0 AND failed = 0`
+	_, err := db.conn.Exec(query, time.Now(), resultState, commandID)
+	return err
+}
+
+// GetPendingCommand retrieves the most recent pending command with a LoRa command ID
+func (db *DB) GetPendingCommand(commandID uint16) (*PendingCommand, error) {
+	return db.getPendingCommand("command_id = ?", commandID)
+}
+
+// GetPendingCommandByCloudID retrieves the command sent for a cloud command UUID
+func (db *DB) GetPendingCommandByCloudID(cloudCommandID string) (*PendingCommand, error) {
+	return db.getPendingCommand("cloud_command_id = ?", cloudCommandID)
+}
+
+// GetUnresolvedCommandBySequence retrieves the command awaiting an ack whose
+// last send to a controller used a LoRa sequence number
+func (db *DB) GetUnresolvedCommandBySequence(controllerUID string, sequence uint16) (*PendingCommand, error) {
+	return db.getPendingCommand("controller_uid = ? AND sequence = ? AND acknowledged = 0 AND failed = 0",
+		controllerUID, sequence)
+}
+
+// getPendingCommand retrieves the most recent command matching a condition.
+// LoRa command IDs wrap at 16 bits, so older rows may share an ID.
+func (db *DB) getPendingCommand(where string, args ...interface{}) (*PendingCommand, error) {
+	query := `SELECT id, command_id, controller_uid, actuator_addr, command, created_at,
+		expires_at, retries, max_retries, acknowledged, ack_time, result_state,
+		COALESCE(failed, 0), COALESCE(cloud_command_id, ''), COALESCE(sequence, 0), COALESCE(error, ''),
+		COALESCE(group_id, 0)
+		FROM pending_commands WHERE ` + where + ` ORDER BY id DESC LIMIT 1`
+
+	cmd := &PendingCommand{}
+	var ackTime sql.NullTime
+	var resultState sql.NullInt64
+	err := db.conn.QueryRow(query, args...).Scan(&cmd.ID, &cmd.CommandID, &cmd.ControllerUID,
+		&cmd.ActuatorAddr, &cmd.Command, &cmd.CreatedAt, &cmd.ExpiresAt, &cmd.Retries,
+		&cmd.MaxRetries, &cmd.Acknowledged, &ackTime, &resultState, &cmd.Failed, &cmd.CloudCommandID,
+		&cmd.Sequence, &cmd.Error, &cmd.GroupID)
+	if err != nil {
+		return nil, err
+	}
+	if ackTime.Valid {
 		cmd.AckTime = ackTime.Time
 	}
+	cmd.ResultState = uint8(resultState.Int64)
 	return cmd, nil
 }
 
@@ -578,7 +1808,7 @@ func (db *DB) GetPendingCommand(commandID uint16) (*PendingCommand, error) {
 func (db *DB) GetExpiredCommands() ([]*PendingCommand, error) {
 	query := `SELECT id, command_id, controller_uid, actuator_addr, command, created_at,
 		expires_at, retries, max_retries, acknowledged
-		FROM pending_commands WHERE acknowledged = 0 AND expires_at < ? AND retries < max_retries`
+		FROM pending_commands WHERE acknowledged = 0 AND failed = 0 AND expires_at < ? AND retries < max_retries`
 
 	rows, err := db.conn.Query(query, time.Now())
 	if err != nil {
@@ -598,10 +1828,90 @@ func (db *DB) GetExpiredCommands() ([]*PendingCommand, error) {
 	return commands, rows.Err()
 }
 
-// IncrementCommandRetry increments the retry count and updates expiry
-func (db *DB) IncrementCommandRetry(id int64, newExpiry time.Time) error {
-	_, err := db.conn.Exec("UPDATE pending_commands SET retries = retries + 1, expires_at = ? WHERE id = ?",
-		newExpiry, id)
+// GetExhaustedCommands retrieves commands that expired after their last retry
+// and have not yet been marked failed
+func (db *DB) GetExhaustedCommands() ([]*PendingCommand, error) {
+	query := `SELECT id, command_id, controller_uid, actuator_addr, command, created_at,
+		expires_at, retries, max_retries, acknowledged, COALESCE(cloud_command_id, ''), COALESCE(group_id, 0)
+		FROM pending_commands WHERE acknowledged = 0 AND failed = 0 AND expires_at < ? AND retries >= max_retries`
+
+	rows, err := db.conn.Query(query, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var commands []*PendingCommand
+	for rows.Next() {
+		cmd := &PendingCommand{}
+		if err := rows.Scan(&cmd.ID, &cmd.CommandID, &cmd.ControllerUID, &cmd.ActuatorAddr,
+			&cmd.Command, &cmd.CreatedAt, &cmd.ExpiresAt, &cmd.Retries, &cmd.MaxRetries, &cmd.Acknowledged,
+			&cmd.CloudCommandID, &cmd.GroupID); err != nil {
+			return nil, err
+		}
+		commands = append(commands, cmd)
+	}
+	return commands, rows.Err()
+}
+
+// CountUnresolvedCommands returns the number of commands still awaiting an
+// acknowledgment
+func (db *DB) CountUnresolvedCommands() (int, error) {
+	var count int
+	err := db.conn.QueryRow("SELECT COUNT(*) FROM pending_commands WHERE acknowledged = 0 AND failed = 0").Scan(&count)
+	return count, err
+}
+
+// GetUnresolvedCommands retrieves the commands of one kind, e.g. opens, that
+// are still awaiting an acknowledgment
+func (db *DB) GetUnresolvedCommands(command uint8) ([]*PendingCommand, error) {
+	query := `SELECT id, command_id, controller_uid, actuator_addr, command, created_at,
+		expires_at, retries, max_retries, acknowledged, COALESCE(cloud_command_id, ''), COALESCE(group_id, 0)
+		FROM pending_commands WHERE acknowledged = 0 AND failed = 0 AND command = ?`
+
+	rows, err := db.conn.Query(query, command)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var commands []*PendingCommand
+	for rows.Next() {
+		cmd := &PendingCommand{}
+		if err := rows.Scan(&cmd.ID, &cmd.CommandID, &cmd.ControllerUID, &cmd.ActuatorAddr,
+			&cmd.Command, &cmd.CreatedAt, &cmd.ExpiresAt, &cmd.Retries, &cmd.MaxRetries, &cmd.Acknowledged,
+			&cmd.CloudCommandID, &cmd.GroupID); err != nil {
+			return nil, err
+		}
+		commands = append(commands, cmd)
+	}
+	return commands, rows.Err()
+}
+
+// MarkCommandFailed moves a command to the terminal failed state, recording
+// why it failed
+func (db *DB) MarkCommandFailed(id int64, reason string) error {
+	_, err := db.conn.Exec("UPDATE pending_commands SET failed = 1, error = ? WHERE id = ?", nullIfEmpty(reason), id)
+	return err
+}
+
+// DeleteFinishedCommands deletes acknowledged and failed commands created
+// before the given time, returning the number removed
+func (db *DB) DeleteFinishedCommands(before time.Time) (int64, error) {
+	// created_at defaults to CURRENT_TIMESTAMP, which is UTC
+	result, err := db.conn.Exec(`DELETE FROM pending_commands
+		WHERE (acknowledged = 1 OR failed = 1) AND created_at < ?`, before.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// IncrementCommandRetry increments the retry count and updates the expiry
+// and the LoRa sequence of the resend
+func (db *DB) IncrementCommandRetry(id int64, sequence uint16, newExpiry time.Time) error {
+	_, err := db.conn.Exec("UPDATE pending_commands SET retries = retries + 1, sequence = ?, expires_at = ? WHERE id = ?",
+		sequence, newExpiry, id)
 	return err
 }
 
@@ -621,8 +1931,7 @@ func (db *DB) UpsertSchedule(s *Schedule, entries []ScheduleEntry) error {
 		ON CONFLICT(uid) DO UPDATE SET version = excluded.version, name = excluded.name,
 			is_active = excluded.is_active, updated_at = excluded.updated_at`
 
-	result, err := tx.Exec(query, s.UID, s.ControllerUID, s.Version, s.Name, s.IsActive, time.Now())
-	if err != nil {
+	if _, err := tx.Exec(query, s.UID, s.ControllerUID, s.Version, s.Name, s.IsActive, time.Now()); err != nil {
 		return err
 	}
 
@@ -633,56 +1942,518 @@ func (db *DB) UpsertSchedule(s *Schedule, entries []ScheduleEntry) error {
 		return err
 	}
 
-	// Delete old entries
-	_, err = tx.Exec("DELETE FROM schedule_entries WHERE schedule_id = ?", scheduleID)
-	if err != nil {
+	if err := replaceScheduleEntries(tx, scheduleID, entries); err != nil {
 		return err
 	}
+	return tx.Commit()
+}
 
-	// Insert new entries
+// replaceScheduleEntries replaces the entries of a schedule
+func replaceScheduleEntries(tx *sql.Tx, scheduleID int64, entries []ScheduleEntry) error {
+	if _, err := tx.Exec("DELETE FROM schedule_entries WHERE schedule_id = ?", scheduleID); err != nil {
+		return err
+	}
 	for _, entry := range entries {
-		_, err = tx.Exec(`INSERT INTO schedule_entries 
-			(schedule_id, day_mask, start_hour, start_minute, duration_mins, actuator_mask)
-			VALUES (?, ?, ?, ?, ?, ?)`,
-			scheduleID, entry.DayMask, entry.StartHour, entry.StartMinute, entry.DurationMins, entry.ActuatorMask)
+		_, err := tx.Exec(`INSERT INTO schedule_entries 
+			(schedule_id, day_mask, start_hour, start_minute, duration_mins, actuator_mask, fertigate, dose_mins)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			scheduleID, entry.DayMask, entry.StartHour, entry.StartMinute, entry.DurationMins, entry.ActuatorMask,
+			entry.Fertigate, entry.DoseMins)
 		if err != nil {
 			return err
 		}
 	}
+	return nil
+}
 
-	_ = result // suppress unused warning
-	return tx.Commit()
+// ReplaceCloudSchedule stores a cloud schedule as one row per valve
+// controller it runs valves on, with UID "<schedule>/<controller>" and
+// entries for that controller's valves only. A controller whose part
+// changed, including one the schedule no longer runs valves on, gets the
+// next version of its schedule. The controllers whose schedule changed are
+// returned, so it can be pushed to them.
+func (db *DB) ReplaceCloudSchedule(cloudUID, name string, active bool, parts map[string][]ScheduleEntry) ([]string, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// A row stored before schedules were split by controller has no
+	// controller, and no device ever ran it
+	if _, err := tx.Exec("DELETE FROM schedule_entries WHERE schedule_id IN (SELECT id FROM schedules WHERE uid = ?)", cloudUID); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec("DELETE FROM schedules WHERE uid = ?", cloudUID); err != nil {
+		return nil, err
+	}
+
+	// Controllers the schedule no longer runs valves on are left an inactive
+	// row without entries, which keeps their version moving forward
+	rows, err := tx.Query("SELECT controller_uid FROM schedules WHERE cloud_uid = ?", cloudUID)
+	if err != nil {
+		return nil, err
+	}
+	controllers := make(map[string]bool)
+	for rows.Next() {
+		var controllerUID string
+		if err := rows.Scan(&controllerUID); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		controllers[controllerUID] = false
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for controllerUID := range parts {
+		controllers[controllerUID] = active
+	}
+
+	var changed []string
+	for controllerUID, isActive := range controllers {
+		var entries []ScheduleEntry
+		if isActive {
+			entries = parts[controllerUID]
+		}
+		updated, err := upsertControllerSchedule(tx, cloudUID, controllerUID, name, isActive, entries)
+		if err != nil {
+			return nil, err
+		}
+		if updated {
+			changed = append(changed, controllerUID)
+		}
+	}
+	sort.Strings(changed)
+	return changed, tx.Commit()
 }
 
-// GetScheduleForController retrieves the active schedule for a controller
-func (db *DB) GetScheduleForController(controllerUID string) (*Schedule, []ScheduleEntry, error) {
-	query := `SELECT id, uid, controller_uid, version, name, is_active, created_at, updated_at
-		FROM schedules WHERE controller_uid = ? AND is_active = 1`
+// upsertControllerSchedule stores one controller's part of a cloud schedule,
+// taking the controller's next version if the part changed. It reports
+// whether it did; a new name alone does not reach the device.
+func upsertControllerSchedule(tx *sql.Tx, cloudUID, controllerUID, name string, active bool, entries []ScheduleEntry) (bool, error) {
+	uid := cloudUID + "/" + controllerUID
+
+	var id int64
+	var wasActive bool
+	err := tx.QueryRow("SELECT id, is_active FROM schedules WHERE uid = ?", uid).Scan(&id, &wasActive)
+	if err != nil && err != sql.ErrNoRows {
+		return false, err
+	}
+	if err == nil && wasActive == active {
+		rows, err := tx.Query(`SELECT id, schedule_id, day_mask, start_hour, start_minute, duration_mins, actuator_mask,
+				COALESCE(fertigate, 0), COALESCE(dose_mins, 0)
+			FROM schedule_entries WHERE schedule_id = ? ORDER BY id`, id)
+		if err != nil {
+			return false, err
+		}
+		stored, err := scanScheduleEntries(rows)
+		if err != nil {
+			return false, err
+		}
+		if sameScheduleEntries(stored, entries) {
+			_, err := tx.Exec("UPDATE schedules SET name = ?, updated_at = ? WHERE id = ?", name, time.Now(), id)
+			return false, err
+		}
+	}
+
+	var version uint16
+	if err := tx.QueryRow("SELECT COALESCE(MAX(version), 0) + 1 FROM schedules WHERE controller_uid = ?",
+		controllerUID).Scan(&version); err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec(`INSERT INTO schedules (uid, cloud_uid, controller_uid, version, name, is_active, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(uid) DO UPDATE SET version = excluded.version, name = excluded.name,
+			is_active = excluded.is_active, updated_at = excluded.updated_at`,
+		uid, cloudUID, controllerUID, version, name, active, time.Now()); err != nil {
+		return false, err
+	}
+	if err := tx.QueryRow("SELECT id FROM schedules WHERE uid = ?", uid).Scan(&id); err != nil {
+		return false, err
+	}
+	return true, replaceScheduleEntries(tx, id, entries)
+}
+
+// sameScheduleEntries reports whether two lists of entries run the same
+func sameScheduleEntries(a, b []ScheduleEntry) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		x, y := a[i], b[i]
+		x.ID, x.ScheduleID, y.ID, y.ScheduleID = 0, 0, 0, 0
+		if x != y {
+			return false
+		}
+	}
+	return true
+}
 
-	s := &Schedule{}
-	err := db.conn.QueryRow(query, controllerUID).Scan(&s.ID, &s.UID, &s.ControllerUID,
-		&s.Version, &s.Name, &s.IsActive, &s.CreatedAt, &s.UpdatedAt)
+// GetScheduleForController retrieves the schedule a valve controller runs:
+// the entries of all its active schedules, under the highest version of any
+// of its schedules, so disabling a schedule or moving it off the controller
+// changes the version too. It returns sql.ErrNoRows if the controller has no
+// schedules.
+func (db *DB) GetScheduleForController(controllerUID string) (*Schedule, []ScheduleEntry, error) {
+	rows, err := db.conn.Query(`SELECT id, version, name, is_active, created_at, updated_at
+		FROM schedules WHERE controller_uid = ? ORDER BY id`, controllerUID)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	// Get entries
-	rows, err := db.conn.Query(`SELECT id, schedule_id, day_mask, start_hour, start_minute, duration_mins, actuator_mask
-		FROM schedule_entries WHERE schedule_id = ?`, s.ID)
-	if err != nil {
+	s := &Schedule{ControllerUID: controllerUID}
+	var active []int64
+	var names []string
+	found := false
+	for rows.Next() {
+		var id int64
+		var version uint16
+		var name string
+		var isActive bool
+		var createdAt, updatedAt time.Time
+		if err := rows.Scan(&id, &version, &name, &isActive, &createdAt, &updatedAt); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		if !found || version > s.Version {
+			s.Version = version
+		}
+		if !found || createdAt.Before(s.CreatedAt) {
+			s.CreatedAt = createdAt
+		}
+		if updatedAt.After(s.UpdatedAt) {
+			s.UpdatedAt = updatedAt
+		}
+		if isActive {
+			if len(active) == 0 {
+				s.ID = id
+			}
+			active = append(active, id)
+			names = append(names, name)
+		}
+		found = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
 		return nil, nil, err
 	}
+	if !found {
+		return nil, nil, sql.ErrNoRows
+	}
+	s.Name = strings.Join(names, ", ")
+	s.IsActive = len(active) > 0
+
+	var entries []ScheduleEntry
+	for _, id := range active {
+		e, err := db.GetScheduleEntries(id)
+		if err != nil {
+			return nil, nil, err
+		}
+		entries = append(entries, e...)
+	}
+	return s, entries, nil
+}
+
+// GetActiveSchedules retrieves all active schedules
+func (db *DB) GetActiveSchedules() ([]*Schedule, error) {
+	rows, err := db.conn.Query(`SELECT id, uid, controller_uid, version, name, is_active, created_at, updated_at
+		FROM schedules WHERE is_active = 1 ORDER BY controller_uid`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var schedules []*Schedule
+	for rows.Next() {
+		s := &Schedule{}
+		if err := rows.Scan(&s.ID, &s.UID, &s.ControllerUID, &s.Version, &s.Name,
+			&s.IsActive, &s.CreatedAt, &s.UpdatedAt); err != nil {
+			return nil, err
+		}
+		schedules = append(schedules, s)
+	}
+	return schedules, rows.Err()
+}
+
+// GetScheduleEntries retrieves the entries of a schedule
+func (db *DB) GetScheduleEntries(scheduleID int64) ([]ScheduleEntry, error) {
+	rows, err := db.conn.Query(`SELECT id, schedule_id, day_mask, start_hour, start_minute, duration_mins, actuator_mask,
+			COALESCE(fertigate, 0), COALESCE(dose_mins, 0)
+		FROM schedule_entries WHERE schedule_id = ? ORDER BY id`, scheduleID)
+	if err != nil {
+		return nil, err
+	}
+	return scanScheduleEntries(rows)
+}
+
+// scanScheduleEntries reads schedule entries from a query, closing it
+func scanScheduleEntries(rows *sql.Rows) ([]ScheduleEntry, error) {
 	defer rows.Close()
 
 	var entries []ScheduleEntry
 	for rows.Next() {
 		var e ScheduleEntry
 		if err := rows.Scan(&e.ID, &e.ScheduleID, &e.DayMask, &e.StartHour, &e.StartMinute,
-			&e.DurationMins, &e.ActuatorMask); err != nil {
-			return nil, nil, err
+			&e.DurationMins, &e.ActuatorMask, &e.Fertigate, &e.DoseMins); err != nil {
+			return nil, err
 		}
 		entries = append(entries, e)
 	}
+	return entries, rows.Err()
+}
+
+// --- Status ---
+
+// GetStatusCounts returns device counts, unsynced record counts, and command
+// counts for status reporting
+func (db *DB) GetStatusCounts() (*StatusCounts, error) {
+	c := &StatusCounts{DevicesByType: make(map[uint8]int)}
+
+	rows, err := db.conn.Query("SELECT device_type, COUNT(*) FROM devices GROUP BY device_type")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var deviceType uint8
+		var n int
+		if err := rows.Scan(&deviceType, &n); err != nil {
+			return nil, err
+		}
+		c.DevicesByType[deviceType] = n
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
 
-	return s, entries, rows.Err()
+	counts := []struct {
+		query string
+		dest  *int
+	}{
+		{"SELECT COUNT(*) FROM soil_moisture_readings WHERE id > " + soilCursorSQL, &c.UnsyncedSoil},
+		{"SELECT COUNT(*) FROM water_meter_readings WHERE id > " + meterCursorSQL, &c.UnsyncedMeter},
+		{"SELECT COUNT(*) FROM alerts WHERE synced_to_cloud = 0", &c.UnsyncedAlerts},
+		{"SELECT COUNT(*) FROM valve_events WHERE id > " + valveCursorSQL, &c.UnsyncedEvents},
+		{"SELECT COUNT(*) FROM pending_commands WHERE acknowledged = 0 AND failed = 0", &c.PendingCommands},
+		{"SELECT COUNT(*) FROM pending_commands WHERE failed = 1", &c.FailedCommands},
+	}
+	for _, q := range counts {
+		if err := db.conn.QueryRow(q.query).Scan(q.dest); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// --- Maintenance ---
+
+// Checkpoint copies the WAL into the database file and truncates it
+func (db *DB) Checkpoint() (*CheckpointResult, error) {
+	if err := db.requireSQLite("checkpoint"); err != nil {
+		return nil, err
+	}
+	var busy int
+	r := &CheckpointResult{}
+	err := db.conn.QueryRow("PRAGMA wal_checkpoint(TRUNCATE)").Scan(&busy, &r.LogFrames, &r.CheckpointedFrames)
+	if err != nil {
+		return nil, err
+	}
+	r.Busy = busy != 0
+	return r, nil
+}
+
+// IntegrityCheck runs PRAGMA integrity_check and returns the problems found,
+// or nil if the database is intact
+func (db *DB) IntegrityCheck() ([]string, error) {
+	if err := db.requireSQLite("integrity check"); err != nil {
+		return nil, err
+	}
+	return integrityCheck(db.conn, "integrity_check")
+}
+
+// QuickCheck runs PRAGMA quick_check, which skips the index checks of
+// IntegrityCheck to run fast enough for startup, and returns the problems
+// found
+func (db *DB) QuickCheck() ([]string, error) {
+	if err := db.requireSQLite("quick check"); err != nil {
+		return nil, err
+	}
+	return integrityCheck(db.conn, "quick_check")
+}
+
+// integrityCheck runs an integrity_check or quick_check pragma on conn
+func integrityCheck(conn *sql.DB, pragma string) ([]string, error) {
+	rows, err := conn.Query("PRAGMA " + pragma + "(100)")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var problems []string
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			return nil, err
+		}
+		if line != "ok" {
+			problems = append(problems, line)
+		}
+	}
+	return problems, rows.Err()
+}
+
+// Vacuum rebuilds the database file to reclaim free pages
+func (db *DB) Vacuum() error {
+	if err := db.requireSQLite("vacuum"); err != nil {
+		return err
+	}
+	_, err := db.conn.Exec("VACUUM")
+	return err
+}
+
+// RecordMaintenance stores the result of a maintenance task and prunes
+// history older than a year
+func (db *DB) RecordMaintenance(run *MaintenanceRun) error {
+	_, err := db.conn.Exec(`INSERT INTO maintenance_runs (task, ok, result, duration_ms, ran_at)
+		VALUES (?, ?, ?, ?, ?)`, run.Task, run.OK, run.Result, run.Duration.Milliseconds(), run.RanAt)
+	if err != nil {
+		return err
+	}
+	_, err = db.conn.Exec("DELETE FROM maintenance_runs WHERE ran_at < ?", run.RanAt.AddDate(-1, 0, 0))
+	return err
+}
+
+// GetLastMaintenance returns the most recent run of each maintenance task
+func (db *DB) GetLastMaintenance() (map[string]*MaintenanceRun, error) {
+	rows, err := db.conn.Query(`SELECT id, task, ok, COALESCE(result, ''), duration_ms, ran_at
+		FROM maintenance_runs
+		WHERE id IN (SELECT MAX(id) FROM maintenance_runs GROUP BY task)`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	runs := make(map[string]*MaintenanceRun)
+	for rows.Next() {
+		r := &MaintenanceRun{}
+		var durationMS int64
+		if err := rows.Scan(&r.ID, &r.Task, &r.OK, &r.Result, &durationMS, &r.RanAt); err != nil {
+			return nil, err
+		}
+		r.Duration = time.Duration(durationMS) * time.Millisecond
+		runs[r.Task] = r
+	}
+	return runs, rows.Err()
+}
+
+// --- Device Keys ---
+
+// InsertDeviceKey stores a newly generated key in the pending state,
+// encrypted if the database has an encryption key
+func (db *DB) InsertDeviceKey(k *DeviceKey) (int64, error) {
+	key, sealed, err := db.seal(k.Key, k.DeviceUID)
+	if err != nil {
+		return 0, err
+	}
+	result, err := db.conn.Exec(`INSERT INTO device_keys (device_uid, key_id, key, sealed, state, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)`, k.DeviceUID, k.KeyID, key, sealed, DeviceKeyPending, k.CreatedAt)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// ActivateDeviceKey makes a pending or failed key the device's active key
+// and retires the key it replaces. A failed key can still be activated when
+// the device turns out to have installed it. Returns false if no such key
+// is waiting, e.g. because it is already active.
+func (db *DB) ActivateDeviceKey(deviceUID string, keyID uint8) (bool, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var id int64
+	err = tx.QueryRow(`SELECT id FROM device_keys
+		WHERE device_uid = ? AND key_id = ? AND state IN (?, ?)
+		ORDER BY id DESC LIMIT 1`, deviceUID, keyID, DeviceKeyPending, DeviceKeyFailed).Scan(&id)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if _, err := tx.Exec("UPDATE device_keys SET state = ? WHERE device_uid = ? AND state IN (?, ?)",
+		DeviceKeyRetired, deviceUID, DeviceKeyActive, DeviceKeyPending); err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec("UPDATE device_keys SET state = ?, activated_at = ? WHERE id = ?",
+		DeviceKeyActive, time.Now(), id); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// FailDeviceKey marks a device's pending keys as failed
+func (db *DB) FailDeviceKey(deviceUID string) error {
+	_, err := db.conn.Exec("UPDATE device_keys SET state = ? WHERE device_uid = ? AND state = ?",
+		DeviceKeyFailed, deviceUID, DeviceKeyPending)
+	return err
+}
+
+// GetDeviceKeys retrieves keys in a state for all devices, oldest first
+func (db *DB) GetDeviceKeys(state string) ([]*DeviceKey, error) {
+	rows, err := db.conn.Query(`SELECT id, device_uid, key_id, key, sealed, state, created_at, activated_at
+		FROM device_keys WHERE state = ? ORDER BY id`, state)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []*DeviceKey
+	for rows.Next() {
+		k, err := db.scanDeviceKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// GetLatestDeviceKey retrieves the most recently generated key for a device,
+// or nil if it has never been rotated
+func (db *DB) GetLatestDeviceKey(deviceUID string) (*DeviceKey, error) {
+	row := db.conn.QueryRow(`SELECT id, device_uid, key_id, key, sealed, state, created_at, activated_at
+		FROM device_keys WHERE device_uid = ? ORDER BY id DESC LIMIT 1`, deviceUID)
+	k, err := db.scanDeviceKey(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return k, err
+}
+
+// scanDeviceKey scans a device_keys row, decrypting the key
+func (db *DB) scanDeviceKey(row interface{ Scan(...interface{}) error }) (*DeviceKey, error) {
+	k := &DeviceKey{}
+	var sealed bool
+	var activatedAt sql.NullTime
+	if err := row.Scan(&k.ID, &k.DeviceUID, &k.KeyID, &k.Key, &sealed, &k.State, &k.CreatedAt, &activatedAt); err != nil {
+		return nil, err
+	}
+	if sealed {
+		key, err := db.open(k.Key, k.DeviceUID)
+		if err != nil {
+			return nil, fmt.Errorf("device key %d: %w", k.ID, err)
+		}
+		k.Key = key
+	}
+	if activatedAt.Valid {
+		k.ActivatedAt = &activatedAt.Time
+	}
+	return k, nil
 }
@@ -0,0 +1,40 @@
+package storage
+
+import (
+	"database/sql"
+	"time"
+)
+
+// GetUnappliedDeviceChanges retrieves the device changes the controller
+// hasn't picked up yet, oldest first
+func (db *DB) GetUnappliedDeviceChanges() ([]*DeviceChange, error) {
+	rows, err := db.conn.Query(`SELECT id, device_uid, change, COALESCE(value, ''), COALESCE(actor, ''),
+		created_at, applied_at, synced_to_cloud
+		FROM device_changes WHERE applied_at IS NULL ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var changes []*DeviceChange
+	for rows.Next() {
+		c := &DeviceChange{}
+		var appliedAt sql.NullTime
+		if err := rows.Scan(&c.ID, &c.DeviceUID, &c.Change, &c.Value, &c.Actor,
+			&c.CreatedAt, &appliedAt, &c.SyncedToCloud); err != nil {
+			return nil, err
+		}
+		if appliedAt.Valid {
+			c.AppliedAt = &appliedAt.Time
+		}
+		changes = append(changes, c)
+	}
+	return changes, rows.Err()
+}
+
+// MarkDeviceChangeApplied records that the controller picked up a device
+// change
+func (db *DB) MarkDeviceChangeApplied(id int64, at time.Time) error {
+	_, err := db.conn.Exec("UPDATE device_changes SET applied_at = ? WHERE id = ?", at, id)
+	return err
+}
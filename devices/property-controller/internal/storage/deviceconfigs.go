@@ -0,0 +1,64 @@
+package storage
+
+import (
+	"database/sql"
+	"time"
+)
+
+// GetDeviceConfig retrieves a device's managed report interval, or nil if it
+// has none
+func (db *DB) GetDeviceConfig(deviceUID string) (*DeviceConfig, error) {
+	c := &DeviceConfig{}
+	var state sql.NullString
+	var sentAt, appliedAt sql.NullTime
+	var applied sql.NullInt64
+	err := db.conn.QueryRow(`SELECT device_uid, COALESCE(cloud_interval_sec, 0), COALESCE(low_battery, 0),
+		report_interval_sec, config_version, state, COALESCE(attempts, 0), sent_at, applied_interval_sec, applied_at, updated_at
+		FROM device_configs WHERE device_uid = ?`, deviceUID).Scan(&c.DeviceUID, &c.CloudIntervalSec, &c.LowBattery,
+		&c.ReportIntervalSec, &c.ConfigVersion, &state, &c.Attempts, &sentAt, &applied, &appliedAt, &c.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.State = state.String
+	c.AppliedIntervalSec = uint16(applied.Int64)
+	if sentAt.Valid {
+		c.SentAt = &sentAt.Time
+	}
+	if appliedAt.Valid {
+		c.AppliedAt = &appliedAt.Time
+	}
+	return c, nil
+}
+
+// SaveDeviceConfig inserts or replaces a device's managed report interval
+func (db *DB) SaveDeviceConfig(c *DeviceConfig) error {
+	c.UpdatedAt = time.Now()
+	var sentAt, appliedAt interface{}
+	if c.SentAt != nil {
+		sentAt = *c.SentAt
+	}
+	if c.AppliedAt != nil {
+		appliedAt = *c.AppliedAt
+	}
+	_, err := db.conn.Exec(`INSERT INTO device_configs
+		(device_uid, cloud_interval_sec, low_battery, report_interval_sec, config_version, state, attempts,
+		sent_at, applied_interval_sec, applied_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(device_uid) DO UPDATE SET
+			cloud_interval_sec = excluded.cloud_interval_sec,
+			low_battery = excluded.low_battery,
+			report_interval_sec = excluded.report_interval_sec,
+			config_version = excluded.config_version,
+			state = excluded.state,
+			attempts = excluded.attempts,
+			sent_at = excluded.sent_at,
+			applied_interval_sec = excluded.applied_interval_sec,
+			applied_at = excluded.applied_at,
+			updated_at = excluded.updated_at`,
+		c.DeviceUID, c.CloudIntervalSec, c.LowBattery, c.ReportIntervalSec, c.ConfigVersion, nullIfEmpty(c.State), c.Attempts,
+		sentAt, nullIfZero(int64(c.AppliedIntervalSec)), appliedAt, c.UpdatedAt)
+	return err
+}
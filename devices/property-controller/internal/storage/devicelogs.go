@@ -0,0 +1,56 @@
+package storage
+
+import "time"
+
+// InsertDeviceLogs stores the entries of a log batch in one transaction
+func (db *DB) InsertDeviceLogs(logs []*DeviceLog) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, l := range logs {
+		result, err := tx.Exec(`INSERT INTO device_logs
+			(device_uid, device_time, severity, log_type, code, message, received_at, synced_to_cloud)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			l.DeviceUID, l.DeviceTime, l.Severity, l.LogType, l.Code, l.Message, l.ReceivedAt, l.SyncedToCloud)
+		if err != nil {
+			return err
+		}
+		l.ID, _ = result.LastInsertId()
+	}
+	return tx.Commit()
+}
+
+// GetDeviceLogs returns a device's most recent log entries, newest first
+func (db *DB) GetDeviceLogs(deviceUID string, limit int) ([]*DeviceLog, error) {
+	rows, err := db.conn.Query(`SELECT id, device_uid, device_time, severity, log_type, code, message,
+			received_at, synced_to_cloud
+		FROM device_logs WHERE device_uid = ? ORDER BY id DESC LIMIT ?`, deviceUID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var logs []*DeviceLog
+	for rows.Next() {
+		l := &DeviceLog{}
+		if err := rows.Scan(&l.ID, &l.DeviceUID, &l.DeviceTime, &l.Severity, &l.LogType, &l.Code, &l.Message,
+			&l.ReceivedAt, &l.SyncedToCloud); err != nil {
+			return nil, err
+		}
+		logs = append(logs, l)
+	}
+	return logs, rows.Err()
+}
+
+// DeleteDeviceLogsBefore deletes log entries received before a time,
+// returning the number removed
+func (db *DB) DeleteDeviceLogsBefore(before time.Time) (int64, error) {
+	result, err := db.conn.Exec("DELETE FROM device_logs WHERE received_at < ?", before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"database/sql"
+	"time"
+)
+
+// UpdateDeviceUptime records the uptime a device reported in a heartbeat
+func (db *DB) UpdateDeviceUptime(u *DeviceUptime) error {
+	_, err := db.conn.Exec("UPDATE devices SET uptime_sec = ?, uptime_at = ? WHERE uid = ?",
+		int64(u.Uptime/time.Second), u.ReportedAt, u.DeviceUID)
+	return err
+}
+
+// GetDeviceUptime retrieves the uptime a device last reported, or nil if it
+// hasn't reported one
+func (db *DB) GetDeviceUptime(uid string) (*DeviceUptime, error) {
+	u := &DeviceUptime{DeviceUID: uid}
+	var uptimeSec int64
+	err := db.conn.QueryRow("SELECT uptime_sec, uptime_at FROM devices WHERE uid = ? AND uptime_at IS NOT NULL", uid).Scan(
+		&uptimeSec, &u.ReportedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	u.Uptime = time.Duration(uptimeSec) * time.Second
+	return u, nil
+}
+
+// InsertDeviceReboot records a device reboot
+func (db *DB) InsertDeviceReboot(r *DeviceReboot) error {
+	result, err := db.conn.Exec(`INSERT INTO device_reboots (device_uid, boot_reason, prev_uptime_sec, unexpected, timestamp)
+		VALUES (?, ?, ?, ?, ?)`, r.DeviceUID, r.BootReason, int64(r.PrevUptime/time.Second), r.Unexpected, r.Timestamp)
+	if err != nil {
+		return err
+	}
+	r.ID, err = result.LastInsertId()
+	return err
+}
+
+// GetUnexpectedReboots counts the unexpected reboots of each device since a
+// time, by device UID
+func (db *DB) GetUnexpectedReboots(since time.Time) (map[string]int, error) {
+	rows, err := db.conn.Query(`SELECT device_uid, COUNT(*) FROM device_reboots
+		WHERE unexpected = 1 AND timestamp >= ? GROUP BY device_uid`, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var uid string
+		var n int
+		if err := rows.Scan(&uid, &n); err != nil {
+			return nil, err
+		}
+		counts[uid] = n
+	}
+	return counts, rows.Err()
+}
+
+// CountUnexpectedReboots counts a device's unexpected reboots since a time
+func (db *DB) CountUnexpectedReboots(uid string, since time.Time) (int, error) {
+	var n int
+	err := db.conn.QueryRow(`SELECT COUNT(*) FROM device_reboots
+		WHERE device_uid = ? AND unexpected = 1 AND timestamp >= ?`, uid, since).Scan(&n)
+	return n, err
+}
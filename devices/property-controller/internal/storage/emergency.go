@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"database/sql"
+	"time"
+)
+
+// StartEmergencyStop records an emergency stop unless one is already in
+// force. It reports whether the stop is new; either way s is filled in with
+// the stop in force.
+func (db *DB) StartEmergencyStop(s *EmergencyStop) (bool, error) {
+	result, err := db.conn.Exec(`INSERT INTO emergency_stops (stopped_at, source, actor, reason)
+		SELECT ?, ?, ?, ? WHERE NOT EXISTS (SELECT 1 FROM emergency_stops WHERE rearmed_at IS NULL)`,
+		s.StoppedAt, s.Source, nullIfEmpty(s.Actor), nullIfEmpty(s.Reason))
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	active, err := db.GetActiveEmergencyStop()
+	if err != nil {
+		return false, err
+	}
+	*s = *active
+	return n > 0, nil
+}
+
+// AddEmergencyStopValves counts close commands sent by an emergency stop
+func (db *DB) AddEmergencyStopValves(id int64, n int) error {
+	_, err := db.conn.Exec("UPDATE emergency_stops SET valves_closed = valves_closed + ? WHERE id = ?", n, id)
+	return err
+}
+
+// GetActiveEmergencyStop returns the emergency stop in force, or nil
+func (db *DB) GetActiveEmergencyStop() (*EmergencyStop, error) {
+	s := &EmergencyStop{}
+	err := db.conn.QueryRow(`SELECT id, stopped_at, source, COALESCE(actor, ''), COALESCE(reason, ''), valves_closed
+		FROM emergency_stops WHERE rearmed_at IS NULL ORDER BY id DESC LIMIT 1`).Scan(
+		&s.ID, &s.StoppedAt, &s.Source, &s.Actor, &s.Reason, &s.ValvesClosed)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// RearmEmergencyStop ends the emergency stop in force, returning it, or nil
+// if there is none
+func (db *DB) RearmEmergencyStop(source, actor string, now time.Time) (*EmergencyStop, error) {
+	s, err := db.GetActiveEmergencyStop()
+	if err != nil || s == nil {
+		return nil, err
+	}
+	_, err = db.conn.Exec(`UPDATE emergency_stops SET rearmed_at = ?, rearm_source = ?, rearm_actor = ?
+		WHERE rearmed_at IS NULL`, now, source, nullIfEmpty(actor))
+	if err != nil {
+		return nil, err
+	}
+	s.RearmedAt, s.RearmSource, s.RearmActor = &now, source, actor
+	return s, nil
+}
@@ -0,0 +1,133 @@
+package storage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// DatabaseKeySize is the length of the key sensitive columns are encrypted
+// with (AES-256)
+const DatabaseKeySize = 32
+
+// ErrNoDatabaseKey is returned when reading an encrypted column without an
+// encryption key
+var ErrNoDatabaseKey = errors.New("encrypted, and no database key is set")
+
+// SetEncryptionKey encrypts sensitive columns, the rotated device LoRa keys,
+// with AES-256-GCM under key from now on, and encrypts those still stored in
+// the clear. It fails if the key doesn't open the keys already encrypted,
+// and returns how many it encrypted.
+func (db *DB) SetEncryptionKey(key []byte) (int, error) {
+	if len(key) != DatabaseKeySize {
+		return 0, fmt.Errorf("database key must be %d bytes", DatabaseKeySize)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return 0, err
+	}
+	sealer, err := cipher.NewGCM(block)
+	if err != nil {
+		return 0, err
+	}
+
+	// A wrong key would lock out every device on its next rotation
+	var deviceUID string
+	var sealed []byte
+	err = db.conn.QueryRow("SELECT device_uid, key FROM device_keys WHERE sealed = 1 LIMIT 1").Scan(&deviceUID, &sealed)
+	if err == nil {
+		if _, err := openSealed(sealer, sealed, deviceUID); err != nil {
+			return 0, fmt.Errorf("database key doesn't match the one the device keys were encrypted with")
+		}
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return 0, err
+	}
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT id, device_uid, key FROM device_keys WHERE sealed = 0")
+	if err != nil {
+		return 0, err
+	}
+	type plainKey struct {
+		id        int64
+		deviceUID string
+		key       []byte
+	}
+	var plain []plainKey
+	for rows.Next() {
+		var k plainKey
+		if err := rows.Scan(&k.id, &k.deviceUID, &k.key); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		plain = append(plain, k)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, k := range plain {
+		sealed, err := sealWith(sealer, k.key, k.deviceUID)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := tx.Exec("UPDATE device_keys SET key = ?, sealed = 1 WHERE id = ?", sealed, k.id); err != nil {
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	db.sealer = sealer
+	return len(plain), nil
+}
+
+// seal encrypts a sensitive value bound to the row's owner, reporting
+// whether it did; without a key the value is returned as is
+func (db *DB) seal(plaintext []byte, owner string) ([]byte, bool, error) {
+	if db.sealer == nil {
+		return plaintext, false, nil
+	}
+	sealed, err := sealWith(db.sealer, plaintext, owner)
+	return sealed, err == nil, err
+}
+
+// open decrypts a value sealed for the row's owner
+func (db *DB) open(sealed []byte, owner string) ([]byte, error) {
+	if db.sealer == nil {
+		return nil, ErrNoDatabaseKey
+	}
+	return openSealed(db.sealer, sealed, owner)
+}
+
+// sealWith encrypts plaintext as nonce || ciphertext, authenticating the
+// owner so a value can't be moved to another row
+func sealWith(sealer cipher.AEAD, plaintext []byte, owner string) ([]byte, error) {
+	nonce := make([]byte, sealer.NonceSize(), sealer.NonceSize()+len(plaintext)+sealer.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return sealer.Seal(nonce, nonce, plaintext, []byte(owner)), nil
+}
+
+func openSealed(sealer cipher.AEAD, sealed []byte, owner string) ([]byte, error) {
+	if len(sealed) < sealer.NonceSize() {
+		return nil, fmt.Errorf("encrypted value too short")
+	}
+	nonce, ciphertext := sealed[:sealer.NonceSize()], sealed[sealer.NonceSize():]
+	plaintext, err := sealer.Open(nil, nonce, ciphertext, []byte(owner))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt: %w", err)
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,126 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// firmwareInventoryColumns are the columns scanned by scanFirmwareInventory
+const firmwareInventoryColumns = `device_uid, device_type, version, hw_rev, COALESCE(previous_version, ''),
+	source, reported_at, changed_at, synced_to_cloud`
+
+// scanFirmwareInventory scans a row of firmwareInventoryColumns
+func scanFirmwareInventory(row interface{ Scan(...interface{}) error }) (*FirmwareInventory, error) {
+	f := &FirmwareInventory{}
+	var hwRev sql.NullInt64
+	if err := row.Scan(&f.DeviceUID, &f.DeviceType, &f.Version, &hwRev, &f.PreviousVersion,
+		&f.Source, &f.ReportedAt, &f.ChangedAt, &f.SyncedToCloud); err != nil {
+		return nil, err
+	}
+	if hwRev.Valid {
+		rev := uint8(hwRev.Int64)
+		f.HWRev = &rev
+	}
+	return f, nil
+}
+
+// RecordFirmware records the firmware a device reported. A new version or
+// hardware revision moves changed_at and queues the entry for the cloud; a
+// nil hardware revision keeps the known one. It reports whether anything
+// changed.
+func (db *DB) RecordFirmware(f *FirmwareInventory) (bool, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	prev, err := scanFirmwareInventory(tx.QueryRow(
+		"SELECT "+firmwareInventoryColumns+" FROM firmware_inventory WHERE device_uid = ?", f.DeviceUID))
+	if err != nil && err != sql.ErrNoRows {
+		return false, err
+	}
+
+	changed := prev == nil || prev.Version != f.Version ||
+		(f.HWRev != nil && (prev.HWRev == nil || *prev.HWRev != *f.HWRev))
+	if prev != nil {
+		if f.HWRev == nil {
+			f.HWRev = prev.HWRev
+		}
+		f.PreviousVersion = prev.PreviousVersion
+		if prev.Version != f.Version {
+			f.PreviousVersion = prev.Version
+		}
+		f.ChangedAt = prev.ChangedAt
+		f.SyncedToCloud = prev.SyncedToCloud
+	}
+	if changed {
+		f.ChangedAt = f.ReportedAt
+		f.SyncedToCloud = false
+	}
+
+	_, err = tx.Exec(`INSERT INTO firmware_inventory (device_uid, device_type, version, hw_rev, previous_version,
+			source, reported_at, changed_at, synced_to_cloud)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(device_uid) DO UPDATE SET
+			device_type = excluded.device_type,
+			version = excluded.version,
+			hw_rev = excluded.hw_rev,
+			previous_version = excluded.previous_version,
+			source = excluded.source,
+			reported_at = excluded.reported_at,
+			changed_at = excluded.changed_at,
+			synced_to_cloud = excluded.synced_to_cloud`,
+		f.DeviceUID, f.DeviceType, f.Version, f.HWRev, nullIfEmpty(f.PreviousVersion),
+		f.Source, f.ReportedAt, f.ChangedAt, f.SyncedToCloud)
+	if err != nil {
+		return false, fmt.Errorf("failed to record firmware of %s: %w", f.DeviceUID, err)
+	}
+	return changed, tx.Commit()
+}
+
+// GetFirmwareInventory retrieves the firmware of every device that has
+// reported it
+func (db *DB) GetFirmwareInventory() ([]*FirmwareInventory, error) {
+	return db.queryFirmwareInventory("SELECT " + firmwareInventoryColumns + " FROM firmware_inventory ORDER BY device_uid")
+}
+
+// GetUnsyncedFirmwareInventory retrieves up to limit entries not yet sent to
+// the cloud
+func (db *DB) GetUnsyncedFirmwareInventory(limit int) ([]*FirmwareInventory, error) {
+	return db.queryFirmwareInventory("SELECT "+firmwareInventoryColumns+
+		" FROM firmware_inventory WHERE synced_to_cloud = 0 ORDER BY changed_at LIMIT ?", limit)
+}
+
+// queryFirmwareInventory runs a query selecting firmwareInventoryColumns
+func (db *DB) queryFirmwareInventory(query string, args ...interface{}) ([]*FirmwareInventory, error) {
+	rows, err := db.conn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var inventory []*FirmwareInventory
+	for rows.Next() {
+		f, err := scanFirmwareInventory(rows)
+		if err != nil {
+			return nil, err
+		}
+		inventory = append(inventory, f)
+	}
+	return inventory, rows.Err()
+}
+
+// MarkFirmwareSynced marks a device's entry as sent to the cloud, unless its
+// version changed since it was read
+func (db *DB) MarkFirmwareSynced(deviceUID, version string) error {
+	_, err := db.conn.Exec("UPDATE firmware_inventory SET synced_to_cloud = 1 WHERE device_uid = ? AND version = ?",
+		deviceUID, version)
+	return err
+}
+
+// ResyncFirmwareInventory queues every entry to be sent to the cloud again
+func (db *DB) ResyncFirmwareInventory() error {
+	_, err := db.conn.Exec("UPDATE firmware_inventory SET synced_to_cloud = 0")
+	return err
+}
@@ -0,0 +1,54 @@
+package storage
+
+import "time"
+
+// InsertGatewayStats records the packet counts of one gateway stats interval
+func (db *DB) InsertGatewayStats(s *GatewayStats) error {
+	_, err := db.conn.Exec(`INSERT INTO gateway_stats (gateway_id, rx_received, rx_ok, tx_received, tx_emitted, received_at)
+		VALUES (?, ?, ?, ?, ?, ?)`, s.GatewayID, s.RxReceived, s.RxOK, s.TxReceived, s.TxEmitted, s.ReceivedAt)
+	return err
+}
+
+// GetGatewayStatsTotals sums the packet counts of each gateway reported
+// since a time, ordered by gateway ID. ReceivedAt is the latest report.
+func (db *DB) GetGatewayStatsTotals(since time.Time) ([]*GatewayStats, error) {
+	rows, err := db.conn.Query(`SELECT gateway_id, SUM(rx_received), SUM(rx_ok), SUM(tx_received), SUM(tx_emitted)
+		FROM gateway_stats WHERE received_at >= ?
+		GROUP BY gateway_id ORDER BY gateway_id`, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var totals []*GatewayStats
+	for rows.Next() {
+		s := &GatewayStats{}
+		if err := rows.Scan(&s.GatewayID, &s.RxReceived, &s.RxOK, &s.TxReceived, &s.TxEmitted); err != nil {
+			return nil, err
+		}
+		totals = append(totals, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Selected directly rather than with MAX() so it scans as a time
+	for _, s := range totals {
+		err := db.conn.QueryRow(`SELECT received_at FROM gateway_stats WHERE gateway_id = ?
+			ORDER BY received_at DESC LIMIT 1`, s.GatewayID).Scan(&s.ReceivedAt)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return totals, nil
+}
+
+// DeleteGatewayStatsBefore deletes stats reported before a time, returning
+// the number removed
+func (db *DB) DeleteGatewayStatsBefore(before time.Time) (int64, error) {
+	result, err := db.conn.Exec("DELETE FROM gateway_stats WHERE received_at < ?", before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
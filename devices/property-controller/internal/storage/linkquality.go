@@ -0,0 +1,44 @@
+package storage
+
+import "time"
+
+// InsertLinkSample records the signal quality of one received message
+func (db *DB) InsertLinkSample(s *LinkSample) error {
+	_, err := db.conn.Exec(`INSERT INTO link_quality (device_uid, msg_type, rssi, snr, received_at)
+		VALUES (?, ?, ?, ?, ?)`, s.DeviceUID, s.MsgType, s.RSSI, s.SNR, s.ReceivedAt)
+	return err
+}
+
+// GetLinkQualityStats summarizes signal quality per device for messages
+// received since a time, ordered by device UID
+func (db *DB) GetLinkQualityStats(since time.Time) ([]*LinkQualityStats, error) {
+	rows, err := db.conn.Query(`SELECT device_uid, COUNT(*),
+			MAX(rssi), MIN(rssi), AVG(rssi), MAX(snr), MIN(snr), AVG(snr)
+		FROM link_quality WHERE received_at >= ?
+		GROUP BY device_uid ORDER BY device_uid`, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var stats []*LinkQualityStats
+	for rows.Next() {
+		s := &LinkQualityStats{}
+		if err := rows.Scan(&s.DeviceUID, &s.Samples, &s.BestRSSI, &s.WorstRSSI, &s.AvgRSSI,
+			&s.BestSNR, &s.WorstSNR, &s.AvgSNR); err != nil {
+			return nil, err
+		}
+		stats = append(stats, s)
+	}
+	return stats, rows.Err()
+}
+
+// DeleteLinkSamplesBefore deletes samples received before a time, returning
+// the number removed
+func (db *DB) DeleteLinkSamplesBefore(before time.Time) (int64, error) {
+	result, err := db.conn.Exec("DELETE FROM link_quality WHERE received_at < ?", before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"database/sql"
+	"time"
+)
+
+const meterCalibrationColumns = `id, device_uid, session_id, state, reference_liters, pulses,
+	old_pulses_per_liter, new_pulses_per_liter, config_version, COALESCE(cloud_command_id, ''), COALESCE(source, ''), COALESCE(actor, ''), COALESCE(error, ''),
+	started_at, sent_at, running_at, finished_at, updated_at`
+
+// activeMeterCalibration matches the sessions still under way
+const activeMeterCalibration = `state IN ('` + MeterCalStarting + `', '` + MeterCalRunning + `', '` + MeterCalFinishing + `')`
+
+// GetActiveMeterCalibration retrieves a water meter's calibration session
+// still under way, or nil if it has none
+func (db *DB) GetActiveMeterCalibration(deviceUID string) (*MeterCalibration, error) {
+	c, err := scanMeterCalibration(db.conn.QueryRow(`SELECT `+meterCalibrationColumns+`
+		FROM meter_calibrations WHERE device_uid = ? AND `+activeMeterCalibration+`
+		ORDER BY id DESC LIMIT 1`, deviceUID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return c, err
+}
+
+// GetActiveMeterCalibrations retrieves the calibration sessions still under
+// way across all meters
+func (db *DB) GetActiveMeterCalibrations() ([]*MeterCalibration, error) {
+	return db.queryMeterCalibrations(`SELECT ` + meterCalibrationColumns + `
+		FROM meter_calibrations WHERE ` + activeMeterCalibration + ` ORDER BY id`)
+}
+
+// GetMeterCalibrations retrieves a water meter's calibration sessions, newest
+// first
+func (db *DB) GetMeterCalibrations(deviceUID string, limit int) ([]*MeterCalibration, error) {
+	return db.queryMeterCalibrations(`SELECT `+meterCalibrationColumns+`
+		FROM meter_calibrations WHERE device_uid = ? ORDER BY id DESC LIMIT ?`, deviceUID, limit)
+}
+
+// SaveMeterCalibration inserts a calibration session, or updates it once it
+// has an ID
+func (db *DB) SaveMeterCalibration(c *MeterCalibration) error {
+	c.UpdatedAt = time.Now()
+	var sentAt, runningAt, finishedAt interface{}
+	if c.SentAt != nil {
+		sentAt = *c.SentAt
+	}
+	if c.RunningAt != nil {
+		runningAt = *c.RunningAt
+	}
+	if c.FinishedAt != nil {
+		finishedAt = *c.FinishedAt
+	}
+	args := []interface{}{c.DeviceUID, c.SessionID, c.State, c.ReferenceLiters, c.Pulses, c.OldPulsesPerLiter,
+		c.NewPulsesPerLiter, c.ConfigVersion, nullIfEmpty(c.CloudCommandID), nullIfEmpty(c.Source), nullIfEmpty(c.Actor),
+		nullIfEmpty(c.Error),
+		c.StartedAt, sentAt, runningAt, finishedAt, c.UpdatedAt}
+
+	if c.ID != 0 {
+		_, err := db.conn.Exec(`UPDATE meter_calibrations SET
+			device_uid = ?, session_id = ?, state = ?, reference_liters = ?, pulses = ?, old_pulses_per_liter = ?,
+			new_pulses_per_liter = ?, config_version = ?, cloud_command_id = ?, source = ?, actor = ?, error = ?,
+			started_at = ?, sent_at = ?, running_at = ?, finished_at = ?, updated_at = ?
+			WHERE id = ?`, append(args, c.ID)...)
+		return err
+	}
+	result, err := db.conn.Exec(`INSERT INTO meter_calibrations
+		(device_uid, session_id, state, reference_liters, pulses, old_pulses_per_liter, new_pulses_per_liter,
+			config_version, cloud_command_id, source, actor, error, started_at, sent_at, running_at, finished_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, args...)
+	if err != nil {
+		return err
+	}
+	c.ID, err = result.LastInsertId()
+	return err
+}
+
+func (db *DB) queryMeterCalibrations(query string, args ...interface{}) ([]*MeterCalibration, error) {
+	rows, err := db.conn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var calibrations []*MeterCalibration
+	for rows.Next() {
+		c, err := scanMeterCalibration(rows)
+		if err != nil {
+			return nil, err
+		}
+		calibrations = append(calibrations, c)
+	}
+	return calibrations, rows.Err()
+}
+
+func scanMeterCalibration(row interface{ Scan(...interface{}) error }) (*MeterCalibration, error) {
+	c := &MeterCalibration{}
+	var sentAt, runningAt, finishedAt sql.NullTime
+	if err := row.Scan(&c.ID, &c.DeviceUID, &c.SessionID, &c.State, &c.ReferenceLiters, &c.Pulses, &c.OldPulsesPerLiter,
+		&c.NewPulsesPerLiter, &c.ConfigVersion, &c.CloudCommandID, &c.Source, &c.Actor, &c.Error,
+		&c.StartedAt, &sentAt, &runningAt, &finishedAt, &c.UpdatedAt); err != nil {
+		return nil, err
+	}
+	if sentAt.Valid {
+		c.SentAt = &sentAt.Time
+	}
+	if runningAt.Valid {
+		c.RunningAt = &runningAt.Time
+	}
+	if finishedAt.Valid {
+		c.FinishedAt = &finishedAt.Time
+	}
+	return c, nil
+}
@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"database/sql"
+	"time"
+)
+
+const meterConfigColumns = `id, device_uid, config_version, report_interval_sec, pulses_per_liter, leak_threshold_min,
+	max_flow_rate_lpm, flags, COALESCE(state, ''), COALESCE(actor, ''), sent_at, acked_version, acked_at, updated_at`
+
+// GetMeterConfig retrieves a water meter's stored config, or nil if it has
+// none
+func (db *DB) GetMeterConfig(deviceUID string) (*MeterConfig, error) {
+	c, err := scanMeterConfig(db.conn.QueryRow(`SELECT `+meterConfigColumns+`
+		FROM meter_configs WHERE device_uid = ?`, deviceUID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return c, err
+}
+
+// GetQueuedMeterConfigs retrieves meter configs awaiting delivery
+func (db *DB) GetQueuedMeterConfigs() ([]*MeterConfig, error) {
+	rows, err := db.conn.Query(`SELECT `+meterConfigColumns+`
+		FROM meter_configs WHERE state = ? ORDER BY updated_at`, DeviceConfigQueued)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var configs []*MeterConfig
+	for rows.Next() {
+		c, err := scanMeterConfig(rows)
+		if err != nil {
+			return nil, err
+		}
+		configs = append(configs, c)
+	}
+	return configs, rows.Err()
+}
+
+// SaveMeterConfig inserts or replaces a water meter's config
+func (db *DB) SaveMeterConfig(c *MeterConfig) error {
+	c.UpdatedAt = time.Now()
+	var sentAt, ackedVersion, ackedAt interface{}
+	if c.SentAt != nil {
+		sentAt = *c.SentAt
+	}
+	if c.AckedVersion != nil {
+		ackedVersion = *c.AckedVersion
+	}
+	if c.AckedAt != nil {
+		ackedAt = *c.AckedAt
+	}
+	_, err := db.conn.Exec(`INSERT INTO meter_configs
+		(device_uid, config_version, report_interval_sec, pulses_per_liter, leak_threshold_min, max_flow_rate_lpm, flags,
+			state, actor, sent_at, acked_version, acked_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(device_uid) DO UPDATE SET
+			config_version = excluded.config_version,
+			report_interval_sec = excluded.report_interval_sec,
+			pulses_per_liter = excluded.pulses_per_liter,
+			leak_threshold_min = excluded.leak_threshold_min,
+			max_flow_rate_lpm = excluded.max_flow_rate_lpm,
+			flags = excluded.flags,
+			state = excluded.state,
+			actor = excluded.actor,
+			sent_at = excluded.sent_at,
+			acked_version = excluded.acked_version,
+			acked_at = excluded.acked_at,
+			updated_at = excluded.updated_at`,
+		c.DeviceUID, c.ConfigVersion, c.ReportIntervalSec, c.PulsesPerLiter, c.LeakThresholdMin, c.MaxFlowRateLPM, c.Flags,
+		nullIfEmpty(c.State), nullIfEmpty(c.Actor), sentAt, ackedVersion, ackedAt, c.UpdatedAt)
+	return err
+}
+
+func scanMeterConfig(row interface{ Scan(...interface{}) error }) (*MeterConfig, error) {
+	c := &MeterConfig{}
+	var sentAt, ackedAt sql.NullTime
+	var acked sql.NullInt64
+	if err := row.Scan(&c.ID, &c.DeviceUID, &c.ConfigVersion, &c.ReportIntervalSec, &c.PulsesPerLiter, &c.LeakThresholdMin,
+		&c.MaxFlowRateLPM, &c.Flags, &c.State, &c.Actor, &sentAt, &acked, &ackedAt, &c.UpdatedAt); err != nil {
+		return nil, err
+	}
+	if sentAt.Valid {
+		c.SentAt = &sentAt.Time
+	}
+	if acked.Valid {
+		v := uint16(acked.Int64)
+		c.AckedVersion = &v
+	}
+	if ackedAt.Valid {
+		c.AckedAt = &ackedAt.Time
+	}
+	return c, nil
+}
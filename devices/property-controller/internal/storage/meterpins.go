@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"database/sql"
+	"time"
+)
+
+const meterPinColumns = `device_uid, command_id, pinned, state, COALESCE(attempts, 0), COALESCE(cloud_command_id, ''),
+	COALESCE(source, ''), COALESCE(actor, ''), sent_at, acked_at, valve_state, COALESCE(error, ''), updated_at`
+
+// GetMeterPin retrieves the latest pin command sent to a water meter, or nil
+// if none has been
+func (db *DB) GetMeterPin(deviceUID string) (*MeterPin, error) {
+	p, err := scanMeterPin(db.conn.QueryRow(`SELECT `+meterPinColumns+`
+		FROM meter_pins WHERE device_uid = ?`, deviceUID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return p, err
+}
+
+// GetMeterPinByCloudID retrieves the pin command with a cloud command ID, or
+// nil if it is not the latest of any meter
+func (db *DB) GetMeterPinByCloudID(cloudCommandID string) (*MeterPin, error) {
+	p, err := scanMeterPin(db.conn.QueryRow(`SELECT `+meterPinColumns+`
+		FROM meter_pins WHERE cloud_command_id = ?`, cloudCommandID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return p, err
+}
+
+// GetPendingMeterPins retrieves pin commands awaiting their meter's ack that
+// were last sent before the given time
+func (db *DB) GetPendingMeterPins(sentBefore time.Time) ([]*MeterPin, error) {
+	rows, err := db.conn.Query(`SELECT `+meterPinColumns+`
+		FROM meter_pins WHERE state = ? AND sent_at < ?
+		ORDER BY device_uid`, DeviceConfigPending, sentBefore)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pins []*MeterPin
+	for rows.Next() {
+		p, err := scanMeterPin(rows)
+		if err != nil {
+			return nil, err
+		}
+		pins = append(pins, p)
+	}
+	return pins, rows.Err()
+}
+
+// SaveMeterPin inserts or replaces the latest pin command of a water meter
+func (db *DB) SaveMeterPin(p *MeterPin) error {
+	p.UpdatedAt = time.Now()
+	var sentAt, ackedAt, valveState interface{}
+	if p.SentAt != nil {
+		sentAt = *p.SentAt
+	}
+	if p.AckedAt != nil {
+		ackedAt = *p.AckedAt
+	}
+	if p.ValveState != nil {
+		valveState = *p.ValveState
+	}
+	_, err := db.conn.Exec(`INSERT INTO meter_pins
+		(device_uid, command_id, pinned, state, attempts, cloud_command_id, source, actor, sent_at, acked_at,
+			valve_state, error, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(device_uid) DO UPDATE SET
+			command_id = excluded.command_id,
+			pinned = excluded.pinned,
+			state = excluded.state,
+			attempts = excluded.attempts,
+			cloud_command_id = excluded.cloud_command_id,
+			source = excluded.source,
+			actor = excluded.actor,
+			sent_at = excluded.sent_at,
+			acked_at = excluded.acked_at,
+			valve_state = excluded.valve_state,
+			error = excluded.error,
+			updated_at = excluded.updated_at`,
+		p.DeviceUID, p.CommandID, p.Pinned, p.State, p.Attempts, nullIfEmpty(p.CloudCommandID), nullIfEmpty(p.Source),
+		nullIfEmpty(p.Actor), sentAt, ackedAt, valveState, nullIfEmpty(p.Error), p.UpdatedAt)
+	return err
+}
+
+func scanMeterPin(row interface{ Scan(...interface{}) error }) (*MeterPin, error) {
+	p := &MeterPin{}
+	var sentAt, ackedAt sql.NullTime
+	var valveState sql.NullInt64
+	if err := row.Scan(&p.DeviceUID, &p.CommandID, &p.Pinned, &p.State, &p.Attempts, &p.CloudCommandID, &p.Source,
+		&p.Actor, &sentAt, &ackedAt, &valveState, &p.Error, &p.UpdatedAt); err != nil {
+		return nil, err
+	}
+	if sentAt.Valid {
+		p.SentAt = &sentAt.Time
+	}
+	if ackedAt.Valid {
+		p.AckedAt = &ackedAt.Time
+	}
+	if valveState.Valid {
+		v := uint8(valveState.Int64)
+		p.ValveState = &v
+	}
+	return p, nil
+}
@@ -30,12 +30,35 @@ type Device struct {
 	FirstSeen    time.Time `json:"first_seen"`
 	LastSeen     time.Time `json:"last_seen"`
 	FirmwareVer  string    `json:"firmware_version,omitempty"`
+	ProtocolVer  uint8     `json:"protocol_version,omitempty"` // LoRa protocol version of its last uplink
 	BatteryMV    uint16    `json:"battery_mv,omitempty"`
 	RSSI         int16     `json:"rssi,omitempty"`
 	IsRegistered bool      `json:"is_registered"` // True if registered in AgSys
 	UpdatedAt    time.Time `json:"updated_at"`
 }
 
+// DeviceClock is a device's RTC state from its last time sync confirmation
+type DeviceClock struct {
+	DeviceUID string        `json:"device_uid"`
+	Skew      time.Duration `json:"skew"`                // Device clock minus controller clock
+	DriftPPM  *float64      `json:"drift_ppm,omitempty"` // Nil until two confirmations are seen
+	CheckedAt time.Time     `json:"checked_at"`
+}
+
+// DeviceUptime is the uptime a device reported in its last heartbeat
+type DeviceUptime struct {
+	DeviceUID  string        `json:"device_uid"`
+	Uptime     time.Duration `json:"uptime"`
+	ReportedAt time.Time     `json:"reported_at"`
+}
+
+// DeviceSequence is the sequence number of a device's last accepted uplink
+type DeviceSequence struct {
+	DeviceUID string    `json:"device_uid"`
+	Sequence  uint16    `json:"sequence"`
+	SeenAt    time.Time `json:"seen_at"`
+}
+
 // ValveActuator represents an individual valve actuator connected to a valve controller
 type ValveActuator struct {
 	UID             string    `json:"uid"`            // Unique ID (controller_uid + address)
@@ -46,10 +69,20 @@ type ValveActuator struct {
 	ZoneID          string    `json:"zone_id,omitempty"`
 	CurrentState    uint8     `json:"current_state"` // Current valve state
 	LastStateChange time.Time `json:"last_state_change"`
+	OpenedAt        time.Time `json:"opened_at,omitempty"` // When the valve opened, zero while closed
 	IsRegistered    bool      `json:"is_registered"`
+	ValveID         string    `json:"valve_id,omitempty"` // Cloud valve ID used in valve commands
 	UpdatedAt       time.Time `json:"updated_at"`
 }
 
+// ValveActuatorMeta is cloud-managed metadata for a valve actuator. Nil
+// fields are left unchanged; an empty alias or zone clears it.
+type ValveActuatorMeta struct {
+	Name   *string
+	Alias  *string
+	ZoneID *string
+}
+
 // SoilMoistureReading represents a soil moisture sensor reading
 type SoilMoistureReading struct {
 	ID              int64     `json:"id"`
@@ -62,13 +95,27 @@ type SoilMoistureReading struct {
 	RSSI            int16     `json:"rssi"`
 	Timestamp       time.Time `json:"timestamp"`
 	SyncedToCloud   bool      `json:"synced_to_cloud"`
+	ReportID        int64     `json:"report_id,omitempty"` // Soil report group, 0 for single-probe readings
+}
+
+// SoilReport groups the probe readings of one multi-probe report
+type SoilReport struct {
+	ID          int64     `json:"id"`
+	DeviceUID   string    `json:"device_uid"`
+	ProbeCount  uint8     `json:"probe_count"`
+	Temperature int16     `json:"temperature"` // 0.1°C units
+	BatteryMV   uint16    `json:"battery_mv"`
+	Flags       uint8     `json:"flags"`
+	RSSI        int16     `json:"rssi"`
+	Timestamp   time.Time `json:"timestamp"`
 }
 
 // WaterMeterReading represents a water meter reading with full float precision
 type WaterMeterReading struct {
 	ID            int64     `json:"id"`
 	DeviceUID     string    `json:"device_uid"`
-	TotalVolumeL  float32   `json:"total_volume_l"` // Total volume in liters (IEEE 754 float)
+	TotalVolumeL  float32   `json:"total_volume_l"` // Total volume in liters as reported (IEEE 754 float)
+	CumulativeL   float64   `json:"cumulative_l"`   // Total volume across totalizer rollovers and resets
 	FlowRateLPM   float32   `json:"flow_rate_lpm"`  // Liters per minute (IEEE 754 float)
 	SignalUV      float32   `json:"signal_uv"`      // Raw electrode signal in microvolts
 	TemperatureC  float32   `json:"temperature_c"`  // Device temperature in Celsius
@@ -87,7 +134,8 @@ type ValveEvent struct {
 	PrevState     uint8     `json:"prev_state"`
 	NewState      uint8     `json:"new_state"`
 	CommandID     uint16    `json:"command_id,omitempty"` // If triggered by command
-	Source        string    `json:"source"`               // "schedule", "manual", "emergency"
+	Source        string    `json:"source"`               // "schedule", "manual", "emergency", "weather"
+	Note          string    `json:"note,omitempty"`       // Annotation, e.g. why a run was skipped
 	Timestamp     time.Time `json:"timestamp"`
 	SyncedToCloud bool      `json:"synced_to_cloud"`
 }
@@ -95,7 +143,7 @@ type ValveEvent struct {
 // Schedule represents a watering schedule
 type Schedule struct {
 	ID            int64     `json:"id"`
-	UID           string    `json:"uid"` // Schedule UID from AgSys
+	UID           string    `json:"uid"` // Schedule UID from AgSys, "<schedule>/<controller>" for each controller it runs on
 	ControllerUID string    `json:"controller_uid"`
 	Version       uint16    `json:"version"`
 	Name          string    `json:"name"`
@@ -113,22 +161,29 @@ type ScheduleEntry struct {
 	StartMinute  uint8  `json:"start_minute"`
 	DurationMins uint16 `json:"duration_mins"`
 	ActuatorMask uint64 `json:"actuator_mask"` // Which actuators to activate
+	Fertigate    bool   `json:"fertigate"`     // Run the controller's injector during this run
+	DoseMins     uint16 `json:"dose_mins"`     // Injector run time
 }
 
 // PendingCommand represents a command waiting for acknowledgment
 type PendingCommand struct {
-	ID            int64     `json:"id"`
-	CommandID     uint16    `json:"command_id"`
-	ControllerUID string    `json:"controller_uid"`
-	ActuatorAddr  uint8     `json:"actuator_addr"`
-	Command       uint8     `json:"command"`
-	CreatedAt     time.Time `json:"created_at"`
-	ExpiresAt     time.Time `json:"expires_at"`
-	Retries       int       `json:"retries"`
-	MaxRetries    int       `json:"max_retries"`
-	Acknowledged  bool      `json:"acknowledged"`
-	AckTime       time.Time `json:"ack_time,omitempty"`
-	ResultState   uint8     `json:"result_state,omitempty"`
+	ID             int64     `json:"id"`
+	CommandID      uint16    `json:"command_id"`
+	ControllerUID  string    `json:"controller_uid"`
+	ActuatorAddr   uint8     `json:"actuator_addr"`
+	Command        uint8     `json:"command"`
+	CreatedAt      time.Time `json:"created_at"`
+	ExpiresAt      time.Time `json:"expires_at"`
+	Retries        int       `json:"retries"`
+	MaxRetries     int       `json:"max_retries"`
+	Acknowledged   bool      `json:"acknowledged"`
+	AckTime        time.Time `json:"ack_time,omitempty"`
+	ResultState    uint8     `json:"result_state,omitempty"`
+	Failed         bool      `json:"failed"`                     // Retries exhausted without acknowledgment, or NACKed
+	CloudCommandID string    `json:"cloud_command_id,omitempty"` // Cloud command UUID, if cloud-issued
+	Sequence       uint16    `json:"sequence,omitempty"`         // LoRa sequence of the last send
+	Error          string    `json:"error,omitempty"`            // Why the command failed
+	GroupID        int64     `json:"group_id,omitempty"`         // Command group, if sent to a set of valves
 }
 
 // CloudSyncQueue represents items waiting to be synced to cloud
@@ -152,19 +207,533 @@ type MeterAlarm struct {
 	DurationSec   uint32    `json:"duration_sec"`   // Duration of alarm condition
 	TotalVolumeL  float32   `json:"total_volume_l"` // Total volume at alarm time (IEEE 754 float)
 	RSSI          int16     `json:"rssi"`
+	Source        string    `json:"source"` // "device" or "analytics" (derived by the controller)
 	Timestamp     time.Time `json:"timestamp"`
 	SyncedToCloud bool      `json:"synced_to_cloud"`
 }
 
-// MeterConfig represents water meter configuration stored locally
+// MeterConfig represents water meter configuration stored locally, and its
+// delivery to the meter
 type MeterConfig struct {
-	ID                int64     `json:"id"`
-	DeviceUID         string    `json:"device_uid"`
-	ConfigVersion     uint16    `json:"config_version"`
-	ReportIntervalSec uint16    `json:"report_interval_sec"`
-	PulsesPerLiter    uint16    `json:"pulses_per_liter"` // * 100
-	LeakThresholdMin  uint16    `json:"leak_threshold_min"`
-	MaxFlowRateLPM    uint16    `json:"max_flow_rate_lpm"` // * 10
-	Flags             uint8     `json:"flags"`
-	UpdatedAt         time.Time `json:"updated_at"`
+	ID                int64      `json:"id"`
+	DeviceUID         string     `json:"device_uid"`
+	ConfigVersion     uint16     `json:"config_version"`
+	ReportIntervalSec uint16     `json:"report_interval_sec"`
+	PulsesPerLiter    uint16     `json:"pulses_per_liter"` // * 100
+	LeakThresholdMin  uint16     `json:"leak_threshold_min"`
+	MaxFlowRateLPM    uint16     `json:"max_flow_rate_lpm"` // * 10
+	Flags             uint8      `json:"flags"`
+	State             string     `json:"state,omitempty"`
+	Actor             string     `json:"actor,omitempty"`
+	SentAt            *time.Time `json:"sent_at,omitempty"`
+	AckedVersion      *uint16    `json:"acked_version,omitempty"` // Version the meter confirmed
+	AckedAt           *time.Time `json:"acked_at,omitempty"`
+	UpdatedAt         time.Time  `json:"updated_at"`
+}
+
+// StatusCounts summarizes the database for controller status reporting
+type StatusCounts struct {
+	DevicesByType   map[uint8]int `json:"devices_by_type"`
+	UnsyncedSoil    int           `json:"unsynced_soil"`
+	UnsyncedMeter   int           `json:"unsynced_meter"`
+	UnsyncedAlerts  int           `json:"unsynced_alerts"`
+	UnsyncedEvents  int           `json:"unsynced_events"`
+	PendingCommands int           `json:"pending_commands"`
+	FailedCommands  int           `json:"failed_commands"`
+}
+
+// CheckpointResult is the outcome of a WAL checkpoint
+type CheckpointResult struct {
+	Busy               bool // A reader or writer prevented a full checkpoint
+	LogFrames          int  // Frames in the WAL
+	CheckpointedFrames int  // Frames copied into the database
+}
+
+// MaintenanceRun records one run of a database maintenance task
+type MaintenanceRun struct {
+	ID       int64         `json:"id"`
+	Task     string        `json:"task"` // "checkpoint", "integrity_check", or "vacuum"
+	OK       bool          `json:"ok"`
+	Result   string        `json:"result"`
+	Duration time.Duration `json:"duration"`
+	RanAt    time.Time     `json:"ran_at"`
+}
+
+// Power events
+const (
+	PowerFail     = "power_fail"     // Mains power lost
+	PowerBattery  = "on_battery"     // Mains power lost, running on the backup battery
+	PowerRestored = "power_restored" // Mains power back
+)
+
+// PowerEvent is a change in a valve controller's power supply
+type PowerEvent struct {
+	ID            int64     `json:"id"`
+	ControllerUID string    `json:"controller_uid"`
+	Event         string    `json:"event"`
+	ValvesClosed  int       `json:"valves_closed"` // Closes sent to bring the valves to a safe state
+	Timestamp     time.Time `json:"timestamp"`
+}
+
+// ActuatorCurrent is the motor current a valve actuator drew in one
+// actuation
+type ActuatorCurrent struct {
+	ID            int64     `json:"id"`
+	ControllerUID string    `json:"controller_uid"`
+	ActuatorAddr  uint8     `json:"actuator_addr"`
+	State         uint8     `json:"state"` // State the actuation ended in
+	CurrentMA     uint16    `json:"current_ma"`
+	Flags         uint8     `json:"flags"` // Valve status flags
+	Timestamp     time.Time `json:"timestamp"`
+}
+
+// DeviceReboot is a reboot of a device, seen as its uptime starting over
+type DeviceReboot struct {
+	ID         int64         `json:"id"`
+	DeviceUID  string        `json:"device_uid"`
+	BootReason uint8         `json:"boot_reason"`
+	PrevUptime time.Duration `json:"prev_uptime"` // Uptime of the last heartbeat before the reboot
+	Unexpected bool          `json:"unexpected"`  // Not a reboot into new firmware
+	Timestamp  time.Time     `json:"timestamp"`
+}
+
+// FirmwareInventory is the firmware a device last reported running
+type FirmwareInventory struct {
+	DeviceUID       string    `json:"device_uid"`
+	DeviceType      uint8     `json:"device_type"`
+	Version         string    `json:"version"`
+	HWRev           *uint8    `json:"hw_rev,omitempty"` // Nil until a message carrying it is seen
+	PreviousVersion string    `json:"previous_version,omitempty"`
+	Source          string    `json:"source"` // Message that last reported it
+	ReportedAt      time.Time `json:"reported_at"`
+	ChangedAt       time.Time `json:"changed_at"` // When the version or hardware revision last changed
+	SyncedToCloud   bool      `json:"synced_to_cloud"`
+}
+
+// LinkSample is the signal quality of one received message
+type LinkSample struct {
+	DeviceUID  string    `json:"device_uid"`
+	MsgType    uint8     `json:"msg_type"`
+	RSSI       int16     `json:"rssi"`
+	SNR        float32   `json:"snr"`
+	ReceivedAt time.Time `json:"received_at"`
+}
+
+// GatewayStats is the packet counts a gateway reported for one stats
+// interval
+type GatewayStats struct {
+	GatewayID  string    `json:"gateway_id"`
+	RxReceived int64     `json:"rx_received"` // Uplinks received, including CRC failures
+	RxOK       int64     `json:"rx_ok"`       // Uplinks received with a good CRC
+	TxReceived int64     `json:"tx_received"` // Downlinks asked to transmit
+	TxEmitted  int64     `json:"tx_emitted"`  // Downlinks transmitted
+	ReceivedAt time.Time `json:"received_at"`
+}
+
+// LinkQualityStats summarizes a device's signal quality over a period
+type LinkQualityStats struct {
+	DeviceUID string  `json:"device_uid"`
+	Samples   int     `json:"samples"`
+	BestRSSI  int16   `json:"best_rssi"`
+	WorstRSSI int16   `json:"worst_rssi"`
+	AvgRSSI   float64 `json:"avg_rssi"`
+	BestSNR   float32 `json:"best_snr"`
+	WorstSNR  float32 `json:"worst_snr"`
+	AvgSNR    float64 `json:"avg_snr"`
+}
+
+// DeviceKey is a rotated per-device LoRa key
+type DeviceKey struct {
+	ID          int64      `json:"id"`
+	DeviceUID   string     `json:"device_uid"`
+	KeyID       uint8      `json:"key_id"`
+	Key         []byte     `json:"-"`
+	State       string     `json:"state"`
+	CreatedAt   time.Time  `json:"created_at"`
+	ActivatedAt *time.Time `json:"activated_at,omitempty"`
+}
+
+// Device key states
+const (
+	DeviceKeyPending = "pending" // Generated, delivery not yet acknowledged
+	DeviceKeyActive  = "active"  // In use by the device
+	DeviceKeyRetired = "retired" // Replaced by a newer key
+	DeviceKeyFailed  = "failed"  // Delivery gave up without an acknowledgment
+)
+
+// Rollup periods
+const (
+	RollupHour = "hour"
+	RollupDay  = "day"
+)
+
+// SoilRollup aggregates one probe's readings over an hour or day
+type SoilRollup struct {
+	DeviceUID      string    `json:"device_uid"`
+	ProbeID        uint8     `json:"probe_id"`
+	Period         string    `json:"period"` // RollupHour or RollupDay
+	PeriodStart    time.Time `json:"period_start"`
+	Samples        int       `json:"samples"`
+	MoistureMin    uint8     `json:"moisture_min"`
+	MoistureMax    uint8     `json:"moisture_max"`
+	MoistureAvg    float64   `json:"moisture_avg"`
+	TemperatureMin int16     `json:"temperature_min"` // 0.1°C units
+	TemperatureMax int16     `json:"temperature_max"`
+	TemperatureAvg float64   `json:"temperature_avg"`
+}
+
+// MeterRollup aggregates one meter's readings over an hour or day
+type MeterRollup struct {
+	DeviceUID    string    `json:"device_uid"`
+	Period       string    `json:"period"` // RollupHour or RollupDay
+	PeriodStart  time.Time `json:"period_start"`
+	Samples      int       `json:"samples"`
+	FlowMin      float64   `json:"flow_min"`
+	FlowMax      float64   `json:"flow_max"`
+	FlowAvg      float64   `json:"flow_avg"`
+	VolumeDeltaL float64   `json:"volume_delta_l"` // Cumulative total increase
+	TotalVolumeL float64   `json:"total_volume_l"` // Cumulative total at the end of the period
+}
+
+// WeatherHour is the rainfall and ET0 for one hour
+type WeatherHour struct {
+	Hour      time.Time `json:"hour"`
+	RainMM    float64   `json:"rain_mm"`
+	ETMM      float64   `json:"et_mm"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// WeatherTotals sums weather hours over a window
+type WeatherTotals struct {
+	Hours     int       `json:"hours"` // Hours in the window with data
+	RainMM    float64   `json:"rain_mm"`
+	ETMM      float64   `json:"et_mm"`
+	UpdatedAt time.Time `json:"updated_at"` // Most recent fetch in the window
+}
+
+// Alert is a condition raised by the controller, open until it clears
+type Alert struct {
+	ID            int64      `json:"id"`
+	DeviceUID     string     `json:"device_uid"`
+	ZoneID        string     `json:"zone_id,omitempty"`
+	ProbeID       uint8      `json:"probe_id"` // Probe or actuator address, 0 for the whole device
+	AlertType     string     `json:"alert_type"`
+	Severity      string     `json:"severity"`
+	State         string     `json:"state"`
+	Message       string     `json:"message"`
+	Value         float64    `json:"value"`               // Reading that raised the alert
+	Threshold     float64    `json:"threshold"`           // Threshold crossed, if any
+	SourceID      int64      `json:"source_id,omitempty"` // meter_alarms row for meter alarms
+	Count         int        `json:"count"`               // Times raised while open
+	Timestamp     time.Time  `json:"timestamp"`           // When first raised
+	LastSeen      time.Time  `json:"last_seen"`
+	AckedAt       *time.Time `json:"acked_at,omitempty"`
+	ClearedAt     *time.Time `json:"cleared_at,omitempty"`
+	SyncedToCloud bool       `json:"synced_to_cloud"`
+}
+
+// Alert severities
+const (
+	AlertInfo     = "info"
+	AlertWarning  = "warning"
+	AlertCritical = "critical"
+)
+
+// Alert states
+const (
+	AlertActive  = "active"  // Condition present, not yet acknowledged
+	AlertAcked   = "acked"   // Condition present, acknowledged by an operator
+	AlertCleared = "cleared" // Condition gone
+)
+
+// CommandAudit is one entry in the append-only command audit log
+type CommandAudit struct {
+	ID             int64     `json:"id"`
+	Timestamp      time.Time `json:"timestamp"`
+	Kind           string    `json:"kind"` // "valve", "meter_config", "meter_reset", "ota_start", "ota_cancel", "ota_multicast", "debug"
+	DeviceUID      string    `json:"device_uid"`
+	ActuatorAddr   uint8     `json:"actuator_addr,omitempty"`
+	Command        string    `json:"command"`
+	Params         string    `json:"params,omitempty"` // JSON
+	Source         string    `json:"source"`           // "cloud", "schedule", "local_api", "modbus", "rule"
+	Actor          string    `json:"actor,omitempty"`  // Cloud user ID, schedule ID, or rule name
+	CloudCommandID string    `json:"cloud_command_id,omitempty"`
+	CommandID      uint16    `json:"command_id,omitempty"` // LoRa command ID
+	Outcome        string    `json:"outcome"`
+	Detail         string    `json:"detail,omitempty"`
+}
+
+// Command audit outcomes
+const (
+	AuditSent       = "sent"        // Sent to the device
+	AuditSendFailed = "send_failed" // Could not be sent
+	AuditRejected   = "rejected"    // Refused before sending
+	AuditDuplicate  = "duplicate"   // Redelivered cloud command, not sent again
+	AuditAcked      = "acked"       // Device carried it out
+	AuditNacked     = "nacked"      // Device refused or failed it
+	AuditNoAck      = "no_ack"      // Retries ran out without an acknowledgment
+	AuditCancelled  = "cancelled"   // Withdrawn before the device answered, by an emergency stop or a later command
+)
+
+// MeterTotalizer tracks a water meter's totalizer so readings can be given a
+// cumulative total that survives rollovers and resets
+type MeterTotalizer struct {
+	DeviceUID      string    `json:"device_uid"`
+	OffsetL        float64   `json:"offset_l"`   // Added to the raw total for the cumulative total
+	LastRawL       float64   `json:"last_raw_l"` // Raw total of the last accepted reading or reset
+	Rollovers      int       `json:"rollovers"`
+	Resets         int       `json:"resets"`
+	PendingResetID uint16    `json:"pending_reset_id,omitempty"` // Command ID of a reset awaiting its ack
+	PendingResetL  float64   `json:"pending_reset_l,omitempty"`  // Total the pending reset sets
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+// Device config states
+const (
+	DeviceConfigQueued  = "queued"  // Saved, awaiting delivery by the running controller
+	DeviceConfigPending = "pending" // Sent, awaiting the device's ack
+	DeviceConfigApplied = "applied" // Acked by the device
+	DeviceConfigFailed  = "failed"  // Rejected, or never acked within the retries
+)
+
+// DeviceConfig is the report interval the controller manages for a soil
+// sensor or water meter
+type DeviceConfig struct {
+	DeviceUID          string     `json:"device_uid"`
+	CloudIntervalSec   uint16     `json:"cloud_interval_sec,omitempty"` // From cloud config, 0 for the device default
+	LowBattery         bool       `json:"low_battery"`
+	ReportIntervalSec  uint16     `json:"report_interval_sec"` // Interval last sent to the device
+	ConfigVersion      uint16     `json:"config_version"`
+	State              string     `json:"state,omitempty"` // Empty until an interval is sent
+	Attempts           int        `json:"attempts"`
+	SentAt             *time.Time `json:"sent_at,omitempty"`
+	AppliedIntervalSec uint16     `json:"applied_interval_sec,omitempty"` // Interval the device confirmed
+	AppliedAt          *time.Time `json:"applied_at,omitempty"`
+	UpdatedAt          time.Time  `json:"updated_at"`
+}
+
+// ScheduleDelivery is the schedule last pushed to a valve controller and
+// whether the controller has confirmed storing it. Its state uses the device
+// config states.
+type ScheduleDelivery struct {
+	ControllerUID string     `json:"controller_uid"`
+	Version       uint16     `json:"version"` // Version last sent to the controller
+	State         string     `json:"state"`
+	Attempts      int        `json:"attempts"`
+	SentAt        *time.Time `json:"sent_at,omitempty"`
+	AckedVersion  *uint16    `json:"acked_version,omitempty"` // Version the controller confirmed
+	AckedAt       *time.Time `json:"acked_at,omitempty"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
+
+// MeterPin is the latest remote shutoff command sent to a water meter and
+// whether the meter has confirmed it. Its state uses the device config
+// states.
+type MeterPin struct {
+	DeviceUID      string     `json:"device_uid"`
+	CommandID      uint16     `json:"command_id"`
+	Pinned         bool       `json:"pinned"` // Valve shut and held shut, or released
+	State          string     `json:"state"`
+	Attempts       int        `json:"attempts"`
+	CloudCommandID string     `json:"cloud_command_id,omitempty"` // Cloud command UUID, if cloud-issued
+	Source         string     `json:"source,omitempty"`
+	Actor          string     `json:"actor,omitempty"`
+	SentAt         *time.Time `json:"sent_at,omitempty"`
+	AckedAt        *time.Time `json:"acked_at,omitempty"`
+	ValveState     *uint8     `json:"valve_state,omitempty"` // Valve state the meter reported
+	Error          string     `json:"error,omitempty"`       // Why the command failed
+	UpdatedAt      time.Time  `json:"updated_at"`
+}
+
+// Meter calibration session states
+const (
+	MeterCalStarting  = "starting"  // Start sent, awaiting the meter's ack
+	MeterCalRunning   = "running"   // Meter counting pulses
+	MeterCalFinishing = "finishing" // Finish sent, awaiting the pulse count
+	MeterCalCompleted = "completed" // Pulses per liter computed and pushed to the meter
+	MeterCalFailed    = "failed"    // Refused, unacked, or an implausible result
+	MeterCalCancelled = "cancelled" // Abandoned before finishing
+)
+
+// MeterCalibration is a known-volume calibration session of a water meter:
+// the meter counts pulses while a known volume runs through it, and the
+// pulses per liter follow from the two.
+type MeterCalibration struct {
+	ID                int64      `json:"id"`
+	DeviceUID         string     `json:"device_uid"`
+	SessionID         uint16     `json:"session_id"`
+	State             string     `json:"state"`
+	ReferenceLiters   float64    `json:"reference_liters,omitempty"`
+	Pulses            uint32     `json:"pulses,omitempty"`
+	OldPulsesPerLiter uint16     `json:"old_pulses_per_liter,omitempty"` // * 100
+	NewPulsesPerLiter uint16     `json:"new_pulses_per_liter,omitempty"` // * 100
+	ConfigVersion     uint16     `json:"config_version,omitempty"`       // Meter config carrying the result
+	CloudCommandID    string     `json:"cloud_command_id,omitempty"`     // Cloud command awaiting the meter's ack
+	Source            string     `json:"source,omitempty"`
+	Actor             string     `json:"actor,omitempty"`
+	Error             string     `json:"error,omitempty"`
+	StartedAt         time.Time  `json:"started_at"`
+	SentAt            *time.Time `json:"sent_at,omitempty"`
+	RunningAt         *time.Time `json:"running_at,omitempty"`
+	FinishedAt        *time.Time `json:"finished_at,omitempty"`
+	UpdatedAt         time.Time  `json:"updated_at"`
+}
+
+// OTAUpdate is the progress of a device's latest OTA update
+type OTAUpdate struct {
+	DeviceUID      string     `json:"device_uid"`
+	DeviceType     uint8      `json:"device_type"`
+	CurrentVersion string     `json:"current_version,omitempty"`
+	TargetVersion  string     `json:"target_version,omitempty"`
+	State          string     `json:"state"`
+	ChunksSent     uint16     `json:"chunks_sent"`
+	ChunksAcked    uint16     `json:"chunks_acked"`
+	TotalChunks    uint16     `json:"total_chunks"`
+	RetryCount     int        `json:"retry_count"`
+	ErrorCode      uint8      `json:"error_code,omitempty"`
+	ErrorMessage   string     `json:"error_message,omitempty"`
+	StartedAt      *time.Time `json:"started_at,omitempty"`
+	LastActivity   *time.Time `json:"last_activity,omitempty"`
+	CompletedAt    *time.Time `json:"completed_at,omitempty"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+}
+
+// RejectedReading is a reading quarantined for failing validation
+type RejectedReading struct {
+	ID          int64     `json:"id"`
+	Timestamp   time.Time `json:"timestamp"`
+	DeviceUID   string    `json:"device_uid"`
+	ProbeID     uint8     `json:"probe_id,omitempty"`
+	ReadingType string    `json:"reading_type"` // "soil" or "meter"
+	Reason      string    `json:"reason"`
+	Value       float64   `json:"value"`
+	Previous    *float64  `json:"previous,omitempty"` // Last accepted value, for step and totalizer checks
+	Reading     string    `json:"reading"`            // JSON
+}
+
+// Reasons a reading is rejected
+const (
+	RejectMoistureRange     = "moisture_range"     // Moisture above 100%
+	RejectTemperatureRange  = "temperature_range"  // Temperature outside the configured bounds
+	RejectMoistureStep      = "moisture_step"      // Moisture changed implausibly fast
+	RejectTotalizerInvalid  = "totalizer_invalid"  // Totalizer is negative, NaN, or infinite
+	RejectTotalizerDecrease = "totalizer_decrease" // Totalizer went backwards
+)
+
+// CloudUsage is the traffic exchanged with the cloud in a calendar month
+type CloudUsage struct {
+	Month     string    `json:"month"` // "YYYY-MM", local time
+	BytesUp   int64     `json:"bytes_up"`
+	BytesDown int64     `json:"bytes_down"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// APIToken is a local API token. The token itself is only shown when created.
+type APIToken struct {
+	ID         int64     `json:"id"`
+	Name       string    `json:"name"`
+	Role       string    `json:"role"` // "viewer", "operator", or "admin"
+	TokenHash  string    `json:"-"`    // Hex SHA-256 of the token
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at,omitempty"`
+}
+
+// ValveTimer is a pending automatic close of a valve opened for a duration
+type ValveTimer struct {
+	ControllerUID  string    `json:"controller_uid"`
+	ActuatorAddr   uint8     `json:"actuator_addr"`
+	CloseAt        time.Time `json:"close_at"`
+	CloudCommandID string    `json:"cloud_command_id,omitempty"` // Command that opened the valve
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// EmergencyStop is an emergency stop of every valve, in force until re-armed
+type EmergencyStop struct {
+	ID           int64      `json:"id"`
+	StoppedAt    time.Time  `json:"stopped_at"`
+	Source       string     `json:"source"` // Command audit source, e.g. "cloud"
+	Actor        string     `json:"actor,omitempty"`
+	Reason       string     `json:"reason,omitempty"`
+	ValvesClosed int        `json:"valves_closed"` // Close commands sent by the stop
+	RearmedAt    *time.Time `json:"rearmed_at,omitempty"`
+	RearmSource  string     `json:"rearm_source,omitempty"`
+	RearmActor   string     `json:"rearm_actor,omitempty"`
+}
+
+// ValveOverride is a valve someone operated by hand at the valve. Schedules
+// and rules leave it alone until the override expires.
+type ValveOverride struct {
+	ControllerUID string    `json:"controller_uid"`
+	ActuatorAddr  uint8     `json:"actuator_addr"`
+	State         uint8     `json:"state"` // State the valve was put in
+	StartedAt     time.Time `json:"started_at"`
+	ExpiresAt     time.Time `json:"expires_at"`
+}
+
+// CommandGroup is one command sent to a set of valves. Its members are the
+// pending commands carrying its ID.
+type CommandGroup struct {
+	ID             int64      `json:"id"`
+	CloudCommandID string     `json:"cloud_command_id,omitempty"`
+	Command        uint8      `json:"command"`
+	Target         string     `json:"target"`  // Zone or controller and actuator mask
+	Members        int        `json:"members"` // Valves the command went to
+	Unsent         int        `json:"unsent"`  // Members that could not be sent
+	UnsentErrors   []string   `json:"unsent_errors,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	CompletedAt    *time.Time `json:"completed_at,omitempty"` // When every member was resolved
+	Success        bool       `json:"success"`
+	Error          string     `json:"error,omitempty"`
+}
+
+// Backfill sends rows of a sync cursor table from a time window to the
+// cloud again, e.g. after the cloud lost data. Only rows already synced are
+// resent; later rows go out with the regular sync.
+type Backfill struct {
+	ID             int64      `json:"id"`
+	TableName      string     `json:"table_name"`
+	From           time.Time  `json:"from"`
+	To             time.Time  `json:"to"`
+	LastID         int64      `json:"last_id"` // Last row sent again
+	RowsSent       int        `json:"rows_sent"`
+	Source         string     `json:"source"` // cloud or cli
+	Actor          string     `json:"actor,omitempty"`
+	CloudCommandID string     `json:"cloud_command_id,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	CompletedAt    *time.Time `json:"completed_at,omitempty"`
+}
+
+// Device change kinds
+const (
+	DeviceChangeAlias   = "alias"
+	DeviceChangeZone    = "zone"
+	DeviceChangeForget  = "forget"
+	DeviceChangeRelease = "release" // Lifts a spoofing quarantine; local only
+)
+
+// DeviceChange is an edit to a device made locally with agsys-db, applied to
+// the devices table at once and to the running controller on its next sync
+// cycle
+type DeviceChange struct {
+	ID            int64      `json:"id"`
+	DeviceUID     string     `json:"device_uid"`
+	Change        string     `json:"change"`          // alias, zone, forget, or release
+	Value         string     `json:"value,omitempty"` // New alias or zone UID; empty clears it
+	Actor         string     `json:"actor,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	AppliedAt     *time.Time `json:"applied_at,omitempty"`
+	SyncedToCloud bool       `json:"synced_to_cloud"`
+}
+
+// DeviceLog is one entry of a device's firmware log, received in a log batch
+type DeviceLog struct {
+	ID            int64      `json:"id"`
+	DeviceUID     string     `json:"device_uid"`
+	DeviceTime    *time.Time `json:"device_time,omitempty"` // Nil if the device clock wasn't set
+	Severity      uint8      `json:"severity"`
+	LogType       uint8      `json:"log_type"`
+	Code          uint16     `json:"code"`
+	Message       string     `json:"message"`
+	ReceivedAt    time.Time  `json:"received_at"`
+	SyncedToCloud bool       `json:"synced_to_cloud"`
 }
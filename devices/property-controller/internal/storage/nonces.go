@@ -0,0 +1,27 @@
+package storage
+
+import (
+	"database/sql"
+	"time"
+)
+
+// GetNonceMark returns a nonce high-water mark, or 0 if none is stored
+func (db *DB) GetNonceMark(name string) (uint32, error) {
+	var mark int64
+	err := db.conn.QueryRow("SELECT mark FROM nonce_marks WHERE name = ?", name).Scan(&mark)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return uint32(mark), err
+}
+
+// SetNonceMark stores a nonce high-water mark. The mark only moves forward.
+func (db *DB) SetNonceMark(name string, mark uint32) error {
+	_, err := db.conn.Exec(`INSERT INTO nonce_marks (name, mark, updated_at)
+		VALUES (?, ?, ?)
+		ON CONFLICT(name) DO UPDATE SET
+			mark = CASE WHEN excluded.mark > nonce_marks.mark THEN excluded.mark ELSE nonce_marks.mark END,
+			updated_at = excluded.updated_at`,
+		name, int64(mark), time.Now())
+	return err
+}
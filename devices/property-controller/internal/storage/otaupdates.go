@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"database/sql"
+	"time"
+)
+
+// SaveOTAUpdate inserts or replaces the progress of a device's OTA update
+func (db *DB) SaveOTAUpdate(u *OTAUpdate) error {
+	u.UpdatedAt = time.Now()
+	_, err := db.conn.Exec(`INSERT INTO ota_updates
+		(device_uid, device_type, current_version, target_version, state, chunks_sent, chunks_acked,
+		total_chunks, retry_count, error_code, error_message, started_at, last_activity, completed_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(device_uid) DO UPDATE SET
+			device_type = excluded.device_type,
+			current_version = excluded.current_version,
+			target_version = excluded.target_version,
+			state = excluded.state,
+			chunks_sent = excluded.chunks_sent,
+			chunks_acked = excluded.chunks_acked,
+			total_chunks = excluded.total_chunks,
+			retry_count = excluded.retry_count,
+			error_code = excluded.error_code,
+			error_message = excluded.error_message,
+			started_at = excluded.started_at,
+			last_activity = excluded.last_activity,
+			completed_at = excluded.completed_at,
+			updated_at = excluded.updated_at`,
+		u.DeviceUID, u.DeviceType, nullIfEmpty(u.CurrentVersion), nullIfEmpty(u.TargetVersion), u.State,
+		u.ChunksSent, u.ChunksAcked, u.TotalChunks, u.RetryCount, u.ErrorCode, nullIfEmpty(u.ErrorMessage),
+		nullTime(u.StartedAt), nullTime(u.LastActivity), nullTime(u.CompletedAt), u.UpdatedAt)
+	return err
+}
+
+// GetOTAUpdates retrieves the latest OTA update of each device, most
+// recently changed first
+func (db *DB) GetOTAUpdates() ([]OTAUpdate, error) {
+	rows, err := db.conn.Query(`SELECT device_uid, device_type, COALESCE(current_version, ''),
+		COALESCE(target_version, ''), state, COALESCE(chunks_sent, 0), COALESCE(chunks_acked, 0),
+		COALESCE(total_chunks, 0), COALESCE(retry_count, 0), COALESCE(error_code, 0), COALESCE(error_message, ''),
+		started_at, last_activity, completed_at, updated_at
+		FROM ota_updates ORDER BY updated_at DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var updates []OTAUpdate
+	for rows.Next() {
+		var u OTAUpdate
+		var startedAt, lastActivity, completedAt sql.NullTime
+		if err := rows.Scan(&u.DeviceUID, &u.DeviceType, &u.CurrentVersion, &u.TargetVersion, &u.State,
+			&u.ChunksSent, &u.ChunksAcked, &u.TotalChunks, &u.RetryCount, &u.ErrorCode, &u.ErrorMessage,
+			&startedAt, &lastActivity, &completedAt, &u.UpdatedAt); err != nil {
+			return nil, err
+		}
+		if startedAt.Valid {
+			u.StartedAt = &startedAt.Time
+		}
+		if lastActivity.Valid {
+			u.LastActivity = &lastActivity.Time
+		}
+		if completedAt.Valid {
+			u.CompletedAt = &completedAt.Time
+		}
+		updates = append(updates, u)
+	}
+	return updates, rows.Err()
+}
+
+// nullTime stores unset times as NULL
+func nullTime(t *time.Time) interface{} {
+	if t == nil || t.IsZero() {
+		return nil
+	}
+	return *t
+}
@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"database/sql"
+	"time"
+)
+
+// SetValveOverride starts or extends a valve's manual override
+func (db *DB) SetValveOverride(o *ValveOverride) error {
+	_, err := db.conn.Exec(`INSERT INTO valve_overrides (controller_uid, actuator_addr, state, started_at, expires_at)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(controller_uid, actuator_addr) DO UPDATE SET
+			state = excluded.state,
+			started_at = excluded.started_at,
+			expires_at = excluded.expires_at`,
+		o.ControllerUID, o.ActuatorAddr, o.State, o.StartedAt.UTC(), o.ExpiresAt.UTC())
+	return err
+}
+
+// GetValveOverride returns a valve's manual override if it has not expired
+// by now, or nil
+func (db *DB) GetValveOverride(controllerUID string, actuatorAddr uint8, now time.Time) (*ValveOverride, error) {
+	o := &ValveOverride{}
+	err := db.conn.QueryRow(`SELECT controller_uid, actuator_addr, state, started_at, expires_at
+		FROM valve_overrides WHERE controller_uid = ? AND actuator_addr = ? AND expires_at > ?`,
+		controllerUID, actuatorAddr, now.UTC()).Scan(&o.ControllerUID, &o.ActuatorAddr, &o.State, &o.StartedAt, &o.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// GetValveOverrides returns the manual overrides that have not expired by now
+func (db *DB) GetValveOverrides(now time.Time) ([]*ValveOverride, error) {
+	rows, err := db.conn.Query(`SELECT controller_uid, actuator_addr, state, started_at, expires_at
+		FROM valve_overrides WHERE expires_at > ? ORDER BY controller_uid, actuator_addr`, now.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var overrides []*ValveOverride
+	for rows.Next() {
+		o := &ValveOverride{}
+		if err := rows.Scan(&o.ControllerUID, &o.ActuatorAddr, &o.State, &o.StartedAt, &o.ExpiresAt); err != nil {
+			return nil, err
+		}
+		overrides = append(overrides, o)
+	}
+	return overrides, rows.Err()
+}
+
+// DeleteValveOverride ends a valve's manual override. It reports whether the
+// valve had one in force.
+func (db *DB) DeleteValveOverride(controllerUID string, actuatorAddr uint8, now time.Time) (bool, error) {
+	result, err := db.conn.Exec(`DELETE FROM valve_overrides WHERE controller_uid = ? AND actuator_addr = ?
+		AND expires_at > ?`, controllerUID, actuatorAddr, now.UTC())
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
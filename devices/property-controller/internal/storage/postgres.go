@@ -0,0 +1,353 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// PostgresConfig connects a DB to a PostgreSQL server, optionally with the
+// TimescaleDB extension
+type PostgresConfig struct {
+	DSN           string // Connection string, e.g. "postgres://agsys@db.local/agsys"
+	Timescale     bool   // Keep readings in TimescaleDB hypertables
+	RetentionDays int    // With Timescale, drop readings older than this (0 keeps them)
+}
+
+// pgxDriver is the database/sql driver PostgreSQL connections go through. It
+// is only linked into builds with the postgres tag (see postgres_driver.go).
+const pgxDriver = "pgx"
+
+// hypertables are the reading tables TimescaleDB partitions by time
+var hypertables = []string{"soil_moisture_readings", "soil_reports", "water_meter_readings"}
+
+// postgresBackend stores to PostgreSQL. Its connections translate the
+// package's SQLite dialect: ? placeholders, column types, foreign keys (which
+// SQLite leaves unenforced), append-only triggers, and LastInsertId.
+type postgresBackend struct {
+	cfg    PostgresConfig
+	serial *serialColumns
+}
+
+func newPostgresBackend(cfg PostgresConfig) *postgresBackend {
+	return &postgresBackend{cfg: cfg, serial: &serialColumns{columns: make(map[string]string)}}
+}
+
+func (*postgresBackend) driver() string { return DriverPostgres }
+
+func (b *postgresBackend) open() (*sql.DB, error) {
+	if !slices.Contains(sql.Drivers(), pgxDriver) {
+		return nil, fmt.Errorf("PostgreSQL support is not built in (build with -tags postgres)")
+	}
+	probe, err := sql.Open(pgxDriver, b.cfg.DSN)
+	if err != nil {
+		return nil, err
+	}
+	drv := probe.Driver()
+	probe.Close()
+	return sql.OpenDB(&pgConnector{driver: drv, dsn: b.cfg.DSN, serial: b.serial}), nil
+}
+
+func (*postgresBackend) hasColumn(conn *sql.DB, table, column string) (bool, error) {
+	var n int
+	err := conn.QueryRow(`SELECT COUNT(*) FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = ? AND column_name = ?`, table, column).Scan(&n)
+	return n > 0, err
+}
+
+// setup turns the reading tables into TimescaleDB hypertables and keeps their
+// retention policy in line with the config
+func (b *postgresBackend) setup(conn *sql.DB) error {
+	if !b.cfg.Timescale {
+		return nil
+	}
+	if _, err := conn.Exec("CREATE EXTENSION IF NOT EXISTS timescaledb"); err != nil {
+		return fmt.Errorf("failed to enable TimescaleDB: %w", err)
+	}
+
+	for _, table := range hypertables {
+		var n int
+		err := conn.QueryRow(`SELECT COUNT(*) FROM timescaledb_information.hypertables
+			WHERE hypertable_schema = current_schema() AND hypertable_name = ?`, table).Scan(&n)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			// Every unique index of a hypertable must include its time column
+			_, err := conn.Exec(fmt.Sprintf(`ALTER TABLE %[1]s DROP CONSTRAINT %[1]s_pkey, ADD PRIMARY KEY (id, timestamp);
+				SELECT create_hypertable('%[1]s', 'timestamp', migrate_data => true)`, table))
+			if err != nil {
+				return fmt.Errorf("failed to make %s a hypertable: %w", table, err)
+			}
+		}
+
+		policy := fmt.Sprintf("SELECT remove_retention_policy('%s', if_exists => true)", table)
+		if b.cfg.RetentionDays > 0 {
+			policy += fmt.Sprintf("; SELECT add_retention_policy('%s', INTERVAL '%d days')", table, b.cfg.RetentionDays)
+		}
+		if _, err := conn.Exec(policy); err != nil {
+			return fmt.Errorf("failed to set retention of %s: %w", table, err)
+		}
+	}
+	return nil
+}
+
+// serialColumns records the generated ID column of each table, learned from
+// the schema as it is created
+type serialColumns struct {
+	mu      sync.RWMutex
+	columns map[string]string
+}
+
+func (s *serialColumns) set(table, column string) {
+	s.mu.Lock()
+	s.columns[table] = column
+	s.mu.Unlock()
+}
+
+func (s *serialColumns) get(table string) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	column, ok := s.columns[table]
+	return column, ok
+}
+
+// pgConnector opens PostgreSQL connections that run the package's queries
+type pgConnector struct {
+	driver driver.Driver
+	dsn    string
+	serial *serialColumns
+}
+
+// pgDriverConn is what a PostgreSQL connection must support to be wrapped
+type pgDriverConn interface {
+	driver.Conn
+	driver.ConnBeginTx
+	driver.ConnPrepareContext
+	driver.ExecerContext
+	driver.QueryerContext
+}
+
+func (c *pgConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.driver.Open(c.dsn)
+	if err != nil {
+		return nil, err
+	}
+	inner, ok := conn.(pgDriverConn)
+	if !ok {
+		conn.Close()
+		return nil, fmt.Errorf("PostgreSQL driver %T does not support contexts", conn)
+	}
+	return &pgConn{pgDriverConn: inner, serial: c.serial}, nil
+}
+
+func (c *pgConnector) Driver() driver.Driver { return c.driver }
+
+// pgConn translates queries on their way to a PostgreSQL connection
+type pgConn struct {
+	pgDriverConn
+	serial *serialColumns
+}
+
+func (c *pgConn) Prepare(query string) (driver.Stmt, error) {
+	return c.pgDriverConn.Prepare(c.translate(query))
+}
+
+func (c *pgConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	return c.pgDriverConn.PrepareContext(ctx, c.translate(query))
+}
+
+func (c *pgConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	return c.pgDriverConn.QueryContext(ctx, c.translate(query), args)
+}
+
+// ExecContext runs a statement. PostgreSQL has no LastInsertId, so inserts
+// into a table with a generated ID return it instead.
+func (c *pgConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	query = c.translate(query)
+	column, ok := c.serial.get(insertTable(query))
+	if !ok {
+		return c.pgDriverConn.ExecContext(ctx, query, args)
+	}
+
+	rows, err := c.pgDriverConn.QueryContext(ctx, strings.TrimRight(query, "; \t\n")+" RETURNING "+column, args)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result pgResult
+	dest := make([]driver.Value, 1)
+	for {
+		if err := rows.Next(dest); err == io.EOF {
+			return result, nil
+		} else if err != nil {
+			return nil, err
+		}
+		result.rows++
+		result.id, _ = dest[0].(int64)
+	}
+}
+
+// CheckNamedValue stores bools as integers, as SQLite does, since the flag
+// columns are INTEGER
+func (c *pgConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if valuer, ok := nv.Value.(driver.Valuer); ok {
+		if v, err := valuer.Value(); err == nil {
+			if b, ok := v.(bool); ok {
+				nv.Value = b
+			}
+		}
+	}
+	if b, ok := nv.Value.(bool); ok {
+		nv.Value = int64(0)
+		if b {
+			nv.Value = int64(1)
+		}
+		return nil
+	}
+	if checker, ok := c.pgDriverConn.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+func (c *pgConn) Ping(ctx context.Context) error {
+	if pinger, ok := c.pgDriverConn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *pgConn) ResetSession(ctx context.Context) error {
+	if resetter, ok := c.pgDriverConn.(driver.SessionResetter); ok {
+		return resetter.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *pgConn) IsValid() bool {
+	if validator, ok := c.pgDriverConn.(driver.Validator); ok {
+		return validator.IsValid()
+	}
+	return true
+}
+
+// translate rewrites a query for PostgreSQL
+func (c *pgConn) translate(query string) string {
+	if ddlPattern.MatchString(query) {
+		query = translateDDL(query, c.serial)
+	}
+	return rebind(query)
+}
+
+// pgResult is the result of an insert that returned its generated ID
+type pgResult struct {
+	id, rows int64
+}
+
+func (r pgResult) LastInsertId() (int64, error) { return r.id, nil }
+func (r pgResult) RowsAffected() (int64, error) { return r.rows, nil }
+
+var (
+	ddlPattern         = regexp.MustCompile(`\b(CREATE|ALTER) TABLE\b`)
+	createTablePattern = regexp.MustCompile(`CREATE TABLE IF NOT EXISTS (\w+)`)
+	serialPattern      = regexp.MustCompile(`(\w+) INTEGER PRIMARY KEY AUTOINCREMENT`)
+	typePattern        = regexp.MustCompile(`\b(INTEGER|REAL|DATETIME|BLOB)\b`)
+	foreignKeyPattern  = regexp.MustCompile(`,(\s*--[^\n]*)?\s*FOREIGN KEY\s*\([^)]*\)\s*REFERENCES\s+\w+\s*\([^)]*\)`)
+	referencesPattern  = regexp.MustCompile(`\s+REFERENCES\s+\w+\s*\(\w+\)`)
+	abortPattern       = regexp.MustCompile(`CREATE TRIGGER IF NOT EXISTS (\w+) (BEFORE \w+ ON \w+)\s+BEGIN\s+SELECT RAISE\(ABORT, ('[^']*')\);\s+END`)
+	insertPattern      = regexp.MustCompile(`^\s*INSERT INTO (\w+)`)
+)
+
+// pgTypes maps SQLite column types to PostgreSQL ones wide enough for what
+// SQLite stores in them
+var pgTypes = map[string]string{
+	"INTEGER":  "BIGINT",
+	"REAL":     "DOUBLE PRECISION",
+	"DATETIME": "TIMESTAMPTZ",
+	"BLOB":     "BYTEA",
+}
+
+// pgAbortFunction backs the triggers translated from SQLite's RAISE(ABORT)
+const pgAbortFunction = `CREATE OR REPLACE FUNCTION agsys_abort() RETURNS trigger LANGUAGE plpgsql AS $$
+	BEGIN
+		RAISE EXCEPTION '%', TG_ARGV[0];
+	END $$;
+`
+
+// translateDDL rewrites SQLite table definitions for PostgreSQL, recording
+// the generated ID columns of the tables it creates
+func translateDDL(ddl string, serial *serialColumns) string {
+	tables := createTablePattern.FindAllStringSubmatchIndex(ddl, -1)
+	for _, m := range serialPattern.FindAllStringSubmatchIndex(ddl, -1) {
+		for i := len(tables) - 1; i >= 0; i-- {
+			if tables[i][0] < m[0] {
+				serial.set(ddl[tables[i][2]:tables[i][3]], ddl[m[2]:m[3]])
+				break
+			}
+		}
+	}
+
+	ddl = serialPattern.ReplaceAllString(ddl, "$1 BIGSERIAL PRIMARY KEY")
+	ddl = typePattern.ReplaceAllStringFunc(ddl, func(t string) string { return pgTypes[t] })
+	ddl = foreignKeyPattern.ReplaceAllString(ddl, "$1")
+	ddl = referencesPattern.ReplaceAllString(ddl, "")
+	if abortPattern.MatchString(ddl) {
+		ddl = pgAbortFunction + abortPattern.ReplaceAllString(ddl,
+			"CREATE OR REPLACE TRIGGER $1 $2 FOR EACH ROW EXECUTE FUNCTION agsys_abort($3)")
+	}
+	return ddl
+}
+
+// insertTable returns the table an INSERT without a RETURNING clause writes
+// to, or "" for other statements
+func insertTable(query string) string {
+	m := insertPattern.FindStringSubmatch(query)
+	if m == nil || strings.Contains(query, "RETURNING") {
+		return ""
+	}
+	return m[1]
+}
+
+// rebind numbers the ? placeholders of a query $1, $2, ... as PostgreSQL
+// expects, skipping string literals and comments
+func rebind(query string) string {
+	if !strings.Contains(query, "?") {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for i := 0; i < len(query); i++ {
+		switch {
+		case query[i] == '\'':
+			end := strings.IndexByte(query[i+1:], '\'')
+			if end < 0 {
+				end = len(query) - i - 2
+			}
+			b.WriteString(query[i : i+end+2])
+			i += end + 1
+		case strings.HasPrefix(query[i:], "--"):
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				end = len(query) - i
+			}
+			b.WriteString(query[i : i+end])
+			i += end - 1
+		case query[i] == '?':
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+		default:
+			b.WriteByte(query[i])
+		}
+	}
+	return b.String()
+}
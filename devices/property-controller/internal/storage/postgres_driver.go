@@ -0,0 +1,7 @@
+//go:build postgres
+
+package storage
+
+// The PostgreSQL driver is only linked into builds that ask for it, so
+// controllers on SQLite don't carry it.
+import _ "github.com/jackc/pgx/v5/stdlib"
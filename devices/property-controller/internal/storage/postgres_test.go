@@ -0,0 +1,135 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// TestRebind tests numbering placeholders for PostgreSQL
+func TestRebind(t *testing.T) {
+	tests := []struct{ query, want string }{
+		{"SELECT 1", "SELECT 1"},
+		{"UPDATE t SET a = ?, b = ? WHERE id = ?", "UPDATE t SET a = $1, b = $2 WHERE id = $3"},
+		{"SELECT '?' FROM t WHERE a = ?", "SELECT '?' FROM t WHERE a = $1"},
+		{"SELECT 'it''s' FROM t WHERE a = ?", "SELECT 'it''s' FROM t WHERE a = $1"},
+		{"-- what's this?\nSELECT a FROM t WHERE b = ?", "-- what's this?\nSELECT a FROM t WHERE b = $1"},
+	}
+	for _, tt := range tests {
+		if got := rebind(tt.query); got != tt.want {
+			t.Errorf("rebind(%q) = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+// TestPostgresSchema runs the migration over a PostgreSQL connection to a
+// driver that records statements, and checks they are translated
+func TestPostgresSchema(t *testing.T) {
+	rec := &recordingDriver{}
+	b := newPostgresBackend(PostgresConfig{DSN: "postgres://test"})
+	db := &DB{conn: sql.OpenDB(&pgConnector{driver: rec, serial: b.serial}), backend: b}
+	defer db.Close()
+
+	if err := db.migrate(); err != nil {
+		t.Fatalf("migrate failed: %v", err)
+	}
+
+	sqliteOnly := regexp.MustCompile(`AUTOINCREMENT|\bDATETIME\b|\bREAL\b|\bINTEGER\b|FOREIGN KEY|REFERENCES|RAISE\(ABORT|PRAGMA|INSERT OR`)
+	for _, q := range rec.queries {
+		if m := sqliteOnly.FindString(q); m != "" {
+			t.Errorf("Statement still has SQLite's %s:\n%s", m, q)
+		}
+		if rebind(q) != q {
+			t.Errorf("Statement has unnumbered placeholders:\n%s", q)
+		}
+	}
+	if column, ok := b.serial.get("soil_moisture_readings"); !ok || column != "id" {
+		t.Errorf("Generated ID of soil_moisture_readings = %q, %v, want id", column, ok)
+	}
+	if _, ok := b.serial.get("sync_cursors"); ok {
+		t.Error("sync_cursors has no generated ID")
+	}
+
+	// Inserts return their ID, and bools are stored as integers
+	rec.queries = nil
+	id, err := db.InsertSoilMoistureReading(&SoilMoistureReading{DeviceUID: "0102030405060708"})
+	if err != nil || id != recordedID {
+		t.Errorf("InsertSoilMoistureReading = %d, %v, want ID %d", id, err, recordedID)
+	}
+	if len(rec.queries) != 1 || !strings.HasSuffix(rec.queries[0], "RETURNING id") {
+		t.Errorf("Insert ran %q, want one statement returning the ID", rec.queries)
+	}
+	rec.args = nil
+	if err := db.RecordMaintenance(&MaintenanceRun{Task: "vacuum", OK: true}); err != nil {
+		t.Fatalf("RecordMaintenance failed: %v", err)
+	}
+	for _, arg := range rec.args {
+		if _, ok := arg.(bool); ok {
+			t.Errorf("RecordMaintenance passed bool %v, want an integer", arg)
+		}
+	}
+}
+
+// recordedID is the ID the recording driver returns for every query
+const recordedID = 42
+
+// recordingDriver stands in for the PostgreSQL driver, recording statements
+// and answering every query with one row holding recordedID
+type recordingDriver struct {
+	queries []string
+	args    []driver.Value
+}
+
+func (d *recordingDriver) Open(string) (driver.Conn, error) { return &recordingConn{d}, nil }
+
+type recordingConn struct{ d *recordingDriver }
+
+func (c *recordingConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, driver.ErrSkip
+}
+func (c *recordingConn) PrepareContext(context.Context, string) (driver.Stmt, error) {
+	return nil, driver.ErrSkip
+}
+func (c *recordingConn) Close() error              { return nil }
+func (c *recordingConn) Begin() (driver.Tx, error) { return c, nil }
+func (c *recordingConn) BeginTx(context.Context, driver.TxOptions) (driver.Tx, error) {
+	return c, nil
+}
+func (c *recordingConn) Commit() error   { return nil }
+func (c *recordingConn) Rollback() error { return nil }
+
+func (c *recordingConn) record(query string, args []driver.NamedValue) {
+	c.d.queries = append(c.d.queries, query)
+	for _, arg := range args {
+		c.d.args = append(c.d.args, arg.Value)
+	}
+}
+
+func (c *recordingConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c.record(query, args)
+	return driver.RowsAffected(1), nil
+}
+
+func (c *recordingConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	c.record(query, args)
+	return &recordedRows{}, nil
+}
+
+type recordedRows struct{ done bool }
+
+func (r *recordedRows) Columns() []string { return []string{"id"} }
+func (r *recordedRows) Close() error      { return nil }
+func (r *recordedRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	r.done = true
+	for i := range dest {
+		dest[i] = int64(recordedID)
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+package storage
+
+import "database/sql"
+
+// InsertPowerEvent records a change in a valve controller's power supply
+func (db *DB) InsertPowerEvent(ev *PowerEvent) error {
+	result, err := db.conn.Exec(`INSERT INTO power_events (controller_uid, event, valves_closed, timestamp)
+		VALUES (?, ?, ?, ?)`, ev.ControllerUID, ev.Event, ev.ValvesClosed, ev.Timestamp)
+	if err != nil {
+		return err
+	}
+	ev.ID, err = result.LastInsertId()
+	return err
+}
+
+// GetLastPowerEvent retrieves a valve controller's latest power event, or nil
+// if it has none
+func (db *DB) GetLastPowerEvent(controllerUID string) (*PowerEvent, error) {
+	ev := &PowerEvent{}
+	err := db.conn.QueryRow(`SELECT id, controller_uid, event, COALESCE(valves_closed, 0), timestamp
+		FROM power_events WHERE controller_uid = ? ORDER BY id DESC LIMIT 1`, controllerUID).Scan(
+		&ev.ID, &ev.ControllerUID, &ev.Event, &ev.ValvesClosed, &ev.Timestamp)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ev, nil
+}
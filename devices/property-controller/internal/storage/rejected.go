@@ -0,0 +1,57 @@
+package storage
+
+import (
+	"database/sql"
+	"time"
+)
+
+// InsertRejectedReading quarantines a reading that failed validation
+func (db *DB) InsertRejectedReading(r *RejectedReading) (int64, error) {
+	if r.Timestamp.IsZero() {
+		r.Timestamp = time.Now()
+	}
+	result, err := db.conn.Exec(`INSERT INTO rejected_readings
+		(timestamp, device_uid, probe_id, reading_type, reason, value, previous, reading)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		r.Timestamp, r.DeviceUID, r.ProbeID, r.ReadingType, r.Reason, r.Value, r.Previous, nullIfEmpty(r.Reading))
+	if err != nil {
+		return 0, err
+	}
+	r.ID, err = result.LastInsertId()
+	return r.ID, err
+}
+
+// GetRejectedReadings retrieves the newest rejected readings, optionally for
+// one device, newest first
+func (db *DB) GetRejectedReadings(deviceUID string, limit int) ([]*RejectedReading, error) {
+	query := `SELECT id, timestamp, device_uid, probe_id, reading_type, reason, COALESCE(value, 0),
+		previous, COALESCE(reading, '') FROM rejected_readings`
+	var args []interface{}
+	if deviceUID != "" {
+		query += ` WHERE device_uid = ?`
+		args = append(args, deviceUID)
+	}
+	query += ` ORDER BY id DESC LIMIT ?`
+	args = append(args, limit)
+
+	rows, err := db.conn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rejected []*RejectedReading
+	for rows.Next() {
+		r := &RejectedReading{}
+		var previous sql.NullFloat64
+		if err := rows.Scan(&r.ID, &r.Timestamp, &r.DeviceUID, &r.ProbeID, &r.ReadingType, &r.Reason,
+			&r.Value, &previous, &r.Reading); err != nil {
+			return nil, err
+		}
+		if previous.Valid {
+			r.Previous = &previous.Float64
+		}
+		rejected = append(rejected, r)
+	}
+	return rejected, rows.Err()
+}
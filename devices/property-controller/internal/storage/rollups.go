@@ -0,0 +1,443 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Raw readings are rolled up a day at a time, hourly rollups a month at a time
+const (
+	hourRollupChunk = 24 * time.Hour
+	dayRollupChunk  = 30 // days
+)
+
+// UpdateRollups brings the hourly and daily rollup tables up to date. Hourly
+// rollups cover complete hours before now and daily rollups complete days in
+// now's time zone. The latest existing period is recomputed so readings that
+// arrived late are included.
+func (db *DB) UpdateRollups(now time.Time) error {
+	hourEnd := now.Truncate(time.Hour)
+	dayEnd := startOfDay(now, now.Location())
+
+	if err := db.rollupSoilHours(hourEnd); err != nil {
+		return fmt.Errorf("failed to roll up soil readings: %w", err)
+	}
+	if err := db.rollupMeterHours(hourEnd); err != nil {
+		return fmt.Errorf("failed to roll up meter readings: %w", err)
+	}
+	if err := db.rollupSoilDays(dayEnd); err != nil {
+		return fmt.Errorf("failed to roll up daily soil readings: %w", err)
+	}
+	if err := db.rollupMeterDays(dayEnd); err != nil {
+		return fmt.Errorf("failed to roll up daily meter readings: %w", err)
+	}
+	return nil
+}
+
+// rollupStart returns where a rollup should resume: the latest existing period,
+// or failing that the earliest source row. ok is false if there is no data.
+func (db *DB) rollupStart(latestQuery, earliestQuery string) (start time.Time, ok bool, err error) {
+	err = db.conn.QueryRow(latestQuery).Scan(&start)
+	if err == nil {
+		return start, true, nil
+	}
+	if err != sql.ErrNoRows {
+		return start, false, err
+	}
+
+	err = db.conn.QueryRow(earliestQuery).Scan(&start)
+	if err == sql.ErrNoRows {
+		return start, false, nil
+	}
+	return start, err == nil, err
+}
+
+func startOfDay(t time.Time, loc *time.Location) time.Time {
+	y, m, d := t.In(loc).Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, loc)
+}
+
+func earlier(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+// --- Soil Rollups ---
+
+type soilRollupKey struct {
+	deviceUID string
+	probeID   uint8
+	start     time.Time
+}
+
+// rollupSoilHours aggregates raw soil readings into hourly rollups up to end
+func (db *DB) rollupSoilHours(end time.Time) error {
+	start, ok, err := db.rollupStart(
+		"SELECT period_start FROM soil_rollups WHERE period = 'hour' ORDER BY period_start DESC LIMIT 1",
+		"SELECT timestamp FROM soil_moisture_readings ORDER BY timestamp LIMIT 1")
+	if err != nil || !ok {
+		return err
+	}
+
+	for from := start.Truncate(time.Hour); from.Before(end); from = from.Add(hourRollupChunk) {
+		to := earlier(from.Add(hourRollupChunk), end)
+
+		rows, err := db.conn.Query(`SELECT device_uid, probe_id, moisture_percent, COALESCE(temperature, 0), timestamp
+			FROM soil_moisture_readings WHERE timestamp >= ? AND timestamp < ?`, from, to)
+		if err != nil {
+			return err
+		}
+
+		rollups := make(map[soilRollupKey]*SoilRollup)
+		for rows.Next() {
+			var uid string
+			var probe, moisture uint8
+			var temp int16
+			var ts time.Time
+			if err := rows.Scan(&uid, &probe, &moisture, &temp, &ts); err != nil {
+				rows.Close()
+				return err
+			}
+
+			key := soilRollupKey{uid, probe, ts.Truncate(time.Hour)}
+			r := rollups[key]
+			if r == nil {
+				r = &SoilRollup{DeviceUID: uid, ProbeID: probe, Period: RollupHour, PeriodStart: key.start,
+					MoistureMin: moisture, MoistureMax: moisture, TemperatureMin: temp, TemperatureMax: temp}
+				rollups[key] = r
+			}
+			r.Samples++
+			r.MoistureMin = min(r.MoistureMin, moisture)
+			r.MoistureMax = max(r.MoistureMax, moisture)
+			r.MoistureAvg += float64(moisture) // Sum until finished
+			r.TemperatureMin = min(r.TemperatureMin, temp)
+			r.TemperatureMax = max(r.TemperatureMax, temp)
+			r.TemperatureAvg += float64(temp)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, r := range rollups {
+			r.MoistureAvg /= float64(r.Samples)
+			r.TemperatureAvg /= float64(r.Samples)
+		}
+		if err := db.saveSoilRollups(rollups); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rollupSoilDays aggregates hourly soil rollups into daily rollups up to end
+func (db *DB) rollupSoilDays(end time.Time) error {
+	start, ok, err := db.rollupStart(
+		"SELECT period_start FROM soil_rollups WHERE period = 'day' ORDER BY period_start DESC LIMIT 1",
+		"SELECT period_start FROM soil_rollups WHERE period = 'hour' ORDER BY period_start LIMIT 1")
+	if err != nil || !ok {
+		return err
+	}
+
+	loc := end.Location()
+	for from := startOfDay(start, loc); from.Before(end); from = from.AddDate(0, 0, dayRollupChunk) {
+		to := earlier(from.AddDate(0, 0, dayRollupChunk), end)
+
+		hours, err := db.querySoilRollups(`SELECT device_uid, probe_id, period, period_start, samples,
+			moisture_min, moisture_max, moisture_avg, temperature_min, temperature_max, temperature_avg
+			FROM soil_rollups WHERE period = 'hour' AND period_start >= ? AND period_start < ?`, from, to)
+		if err != nil {
+			return err
+		}
+
+		rollups := make(map[soilRollupKey]*SoilRollup)
+		for _, h := range hours {
+			key := soilRollupKey{h.DeviceUID, h.ProbeID, startOfDay(h.PeriodStart, loc)}
+			r := rollups[key]
+			if r == nil {
+				r = &SoilRollup{DeviceUID: h.DeviceUID, ProbeID: h.ProbeID, Period: RollupDay, PeriodStart: key.start,
+					MoistureMin: h.MoistureMin, MoistureMax: h.MoistureMax,
+					TemperatureMin: h.TemperatureMin, TemperatureMax: h.TemperatureMax}
+				rollups[key] = r
+			}
+			r.Samples += h.Samples
+			r.MoistureMin = min(r.MoistureMin, h.MoistureMin)
+			r.MoistureMax = max(r.MoistureMax, h.MoistureMax)
+			r.MoistureAvg += h.MoistureAvg * float64(h.Samples)
+			r.TemperatureMin = min(r.TemperatureMin, h.TemperatureMin)
+			r.TemperatureMax = max(r.TemperatureMax, h.TemperatureMax)
+			r.TemperatureAvg += h.TemperatureAvg * float64(h.Samples)
+		}
+
+		for _, r := range rollups {
+			r.MoistureAvg /= float64(r.Samples)
+			r.TemperatureAvg /= float64(r.Samples)
+		}
+		if err := db.saveSoilRollups(rollups); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *DB) saveSoilRollups(rollups map[soilRollupKey]*SoilRollup) error {
+	if len(rollups) == 0 {
+		return nil
+	}
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, r := range rollups {
+		_, err := tx.Exec(`INSERT INTO soil_rollups
+			(device_uid, probe_id, period, period_start, samples, moisture_min, moisture_max, moisture_avg,
+			temperature_min, temperature_max, temperature_avg)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT(device_uid, probe_id, period, period_start) DO UPDATE SET
+				samples = excluded.samples,
+				moisture_min = excluded.moisture_min,
+				moisture_max = excluded.moisture_max,
+				moisture_avg = excluded.moisture_avg,
+				temperature_min = excluded.temperature_min,
+				temperature_max = excluded.temperature_max,
+				temperature_avg = excluded.temperature_avg`,
+			r.DeviceUID, r.ProbeID, r.Period, r.PeriodStart, r.Samples, r.MoistureMin, r.MoistureMax, r.MoistureAvg,
+			r.TemperatureMin, r.TemperatureMax, r.TemperatureAvg)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetSoilRollups returns soil rollups for a period type since a time, oldest
+// first. An empty deviceUID returns all devices.
+func (db *DB) GetSoilRollups(deviceUID, period string, since time.Time) ([]*SoilRollup, error) {
+	return db.querySoilRollups(`SELECT device_uid, probe_id, period, period_start, samples,
+		moisture_min, moisture_max, moisture_avg, temperature_min, temperature_max, temperature_avg
+		FROM soil_rollups WHERE period = ? AND period_start >= ? AND (? = '' OR device_uid = ?)
+		ORDER BY period_start, device_uid, probe_id`, period, since, deviceUID, deviceUID)
+}
+
+func (db *DB) querySoilRollups(query string, args ...interface{}) ([]*SoilRollup, error) {
+	rows, err := db.conn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rollups []*SoilRollup
+	for rows.Next() {
+		r := &SoilRollup{}
+		if err := rows.Scan(&r.DeviceUID, &r.ProbeID, &r.Period, &r.PeriodStart, &r.Samples,
+			&r.MoistureMin, &r.MoistureMax, &r.MoistureAvg, &r.TemperatureMin, &r.TemperatureMax, &r.TemperatureAvg); err != nil {
+			return nil, err
+		}
+		rollups = append(rollups, r)
+	}
+	return rollups, rows.Err()
+}
+
+// --- Meter Rollups ---
+
+type meterRollupKey struct {
+	deviceUID string
+	start     time.Time
+}
+
+// rollupMeterHours aggregates raw meter readings into hourly rollups up to end.
+// Totalizer increases are credited to the hour of the later reading. The
+// cumulative total is used, so volume across a rollover or reset is kept;
+// decreases in readings stored before it was tracked are skipped.
+func (db *DB) rollupMeterHours(end time.Time) error {
+	start, ok, err := db.rollupStart(
+		"SELECT period_start FROM meter_rollups WHERE period = 'hour' ORDER BY period_start DESC LIMIT 1",
+		"SELECT timestamp FROM water_meter_readings ORDER BY timestamp LIMIT 1")
+	if err != nil || !ok {
+		return err
+	}
+	start = start.Truncate(time.Hour)
+
+	// Seed each meter's previous totalizer from the last reading before start
+	prev := make(map[string]float64)
+	rows, err := db.conn.Query(`SELECT device_uid, COALESCE(cumulative_l, total_volume_l) FROM water_meter_readings
+		WHERE id IN (SELECT MAX(id) FROM water_meter_readings WHERE timestamp < ? GROUP BY device_uid)`, start)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var uid string
+		var total float64
+		if err := rows.Scan(&uid, &total); err != nil {
+			rows.Close()
+			return err
+		}
+		prev[uid] = total
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for from := start; from.Before(end); from = from.Add(hourRollupChunk) {
+		to := earlier(from.Add(hourRollupChunk), end)
+
+		rows, err := db.conn.Query(`SELECT device_uid, COALESCE(cumulative_l, total_volume_l), COALESCE(flow_rate_lpm, 0), timestamp
+			FROM water_meter_readings WHERE timestamp >= ? AND timestamp < ?
+			ORDER BY timestamp, id`, from, to)
+		if err != nil {
+			return err
+		}
+
+		rollups := make(map[meterRollupKey]*MeterRollup)
+		for rows.Next() {
+			var uid string
+			var total, flow float64
+			var ts time.Time
+			if err := rows.Scan(&uid, &total, &flow, &ts); err != nil {
+				rows.Close()
+				return err
+			}
+
+			key := meterRollupKey{uid, ts.Truncate(time.Hour)}
+			r := rollups[key]
+			if r == nil {
+				r = &MeterRollup{DeviceUID: uid, Period: RollupHour, PeriodStart: key.start, FlowMin: flow, FlowMax: flow}
+				rollups[key] = r
+			}
+			r.Samples++
+			r.FlowMin = min(r.FlowMin, flow)
+			r.FlowMax = max(r.FlowMax, flow)
+			r.FlowAvg += flow // Sum until finished
+			if p, ok := prev[uid]; ok && total > p {
+				r.VolumeDeltaL += total - p
+			}
+			r.TotalVolumeL = total
+			prev[uid] = total
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, r := range rollups {
+			r.FlowAvg /= float64(r.Samples)
+		}
+		if err := db.saveMeterRollups(rollups); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rollupMeterDays aggregates hourly meter rollups into daily rollups up to end
+func (db *DB) rollupMeterDays(end time.Time) error {
+	start, ok, err := db.rollupStart(
+		"SELECT period_start FROM meter_rollups WHERE period = 'day' ORDER BY period_start DESC LIMIT 1",
+		"SELECT period_start FROM meter_rollups WHERE period = 'hour' ORDER BY period_start LIMIT 1")
+	if err != nil || !ok {
+		return err
+	}
+
+	loc := end.Location()
+	for from := startOfDay(start, loc); from.Before(end); from = from.AddDate(0, 0, dayRollupChunk) {
+		to := earlier(from.AddDate(0, 0, dayRollupChunk), end)
+
+		hours, err := db.queryMeterRollups(`SELECT device_uid, period, period_start, samples,
+			flow_min, flow_max, flow_avg, volume_delta_l, total_volume_l
+			FROM meter_rollups WHERE period = 'hour' AND period_start >= ? AND period_start < ?
+			ORDER BY period_start`, from, to)
+		if err != nil {
+			return err
+		}
+
+		rollups := make(map[meterRollupKey]*MeterRollup)
+		for _, h := range hours {
+			key := meterRollupKey{h.DeviceUID, startOfDay(h.PeriodStart, loc)}
+			r := rollups[key]
+			if r == nil {
+				r = &MeterRollup{DeviceUID: h.DeviceUID, Period: RollupDay, PeriodStart: key.start,
+					FlowMin: h.FlowMin, FlowMax: h.FlowMax}
+				rollups[key] = r
+			}
+			r.Samples += h.Samples
+			r.FlowMin = min(r.FlowMin, h.FlowMin)
+			r.FlowMax = max(r.FlowMax, h.FlowMax)
+			r.FlowAvg += h.FlowAvg * float64(h.Samples)
+			r.VolumeDeltaL += h.VolumeDeltaL
+			r.TotalVolumeL = h.TotalVolumeL
+		}
+
+		for _, r := range rollups {
+			r.FlowAvg /= float64(r.Samples)
+		}
+		if err := db.saveMeterRollups(rollups); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *DB) saveMeterRollups(rollups map[meterRollupKey]*MeterRollup) error {
+	if len(rollups) == 0 {
+		return nil
+	}
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, r := range rollups {
+		_, err := tx.Exec(`INSERT INTO meter_rollups
+			(device_uid, period, period_start, samples, flow_min, flow_max, flow_avg, volume_delta_l, total_volume_l)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT(device_uid, period, period_start) DO UPDATE SET
+				samples = excluded.samples,
+				flow_min = excluded.flow_min,
+				flow_max = excluded.flow_max,
+				flow_avg = excluded.flow_avg,
+				volume_delta_l = excluded.volume_delta_l,
+				total_volume_l = excluded.total_volume_l`,
+			r.DeviceUID, r.Period, r.PeriodStart, r.Samples, r.FlowMin, r.FlowMax, r.FlowAvg, r.VolumeDeltaL, r.TotalVolumeL)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetMeterRollups returns meter rollups for a period type since a time, oldest
+// first. An empty deviceUID returns all devices.
+func (db *DB) GetMeterRollups(deviceUID, period string, since time.Time) ([]*MeterRollup, error) {
+	return db.queryMeterRollups(`SELECT device_uid, period, period_start, samples,
+		flow_min, flow_max, flow_avg, volume_delta_l, total_volume_l
+		FROM meter_rollups WHERE period = ? AND period_start >= ? AND (? = '' OR device_uid = ?)
+		ORDER BY period_start, device_uid`, period, since, deviceUID, deviceUID)
+}
+
+func (db *DB) queryMeterRollups(query string, args ...interface{}) ([]*MeterRollup, error) {
+	rows, err := db.conn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rollups []*MeterRollup
+	for rows.Next() {
+		r := &MeterRollup{}
+		if err := rows.Scan(&r.DeviceUID, &r.Period, &r.PeriodStart, &r.Samples,
+			&r.FlowMin, &r.FlowMax, &r.FlowAvg, &r.VolumeDeltaL, &r.TotalVolumeL); err != nil {
+			return nil, err
+		}
+		rollups = append(rollups, r)
+	}
+	return rollups, rows.Err()
+}
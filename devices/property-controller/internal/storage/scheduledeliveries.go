@@ -0,0 +1,90 @@
+package storage
+
+import (
+	"database/sql"
+	"time"
+)
+
+const scheduleDeliveryColumns = `controller_uid, version, state, COALESCE(attempts, 0), sent_at, acked_version, acked_at, updated_at`
+
+// GetScheduleDelivery retrieves the schedule last pushed to a valve
+// controller, or nil if none has been
+func (db *DB) GetScheduleDelivery(controllerUID string) (*ScheduleDelivery, error) {
+	d, err := scanScheduleDelivery(db.conn.QueryRow(`SELECT `+scheduleDeliveryColumns+`
+		FROM schedule_deliveries WHERE controller_uid = ?`, controllerUID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return d, err
+}
+
+// GetPendingScheduleDeliveries retrieves schedules awaiting their
+// controller's ack that were last sent before the given time
+func (db *DB) GetPendingScheduleDeliveries(sentBefore time.Time) ([]*ScheduleDelivery, error) {
+	rows, err := db.conn.Query(`SELECT `+scheduleDeliveryColumns+`
+		FROM schedule_deliveries WHERE state = ? AND sent_at < ?
+		ORDER BY controller_uid`, DeviceConfigPending, sentBefore)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []*ScheduleDelivery
+	for rows.Next() {
+		d, err := scanScheduleDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+// SaveScheduleDelivery inserts or replaces the schedule last pushed to a
+// valve controller
+func (db *DB) SaveScheduleDelivery(d *ScheduleDelivery) error {
+	d.UpdatedAt = time.Now()
+	var sentAt, ackedVersion, ackedAt interface{}
+	if d.SentAt != nil {
+		sentAt = *d.SentAt
+	}
+	if d.AckedVersion != nil {
+		ackedVersion = *d.AckedVersion
+	}
+	if d.AckedAt != nil {
+		ackedAt = *d.AckedAt
+	}
+	_, err := db.conn.Exec(`INSERT INTO schedule_deliveries
+		(controller_uid, version, state, attempts, sent_at, acked_version, acked_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(controller_uid) DO UPDATE SET
+			version = excluded.version,
+			state = excluded.state,
+			attempts = excluded.attempts,
+			sent_at = excluded.sent_at,
+			acked_version = excluded.acked_version,
+			acked_at = excluded.acked_at,
+			updated_at = excluded.updated_at`,
+		d.ControllerUID, d.Version, d.State, d.Attempts, sentAt, ackedVersion, ackedAt, d.UpdatedAt)
+	return err
+}
+
+func scanScheduleDelivery(row interface{ Scan(...interface{}) error }) (*ScheduleDelivery, error) {
+	d := &ScheduleDelivery{}
+	var sentAt, ackedAt sql.NullTime
+	var acked sql.NullInt64
+	if err := row.Scan(&d.ControllerUID, &d.Version, &d.State, &d.Attempts, &sentAt, &acked, &ackedAt, &d.UpdatedAt); err != nil {
+		return nil, err
+	}
+	if sentAt.Valid {
+		d.SentAt = &sentAt.Time
+	}
+	if acked.Valid {
+		v := uint16(acked.Int64)
+		d.AckedVersion = &v
+	}
+	if ackedAt.Valid {
+		d.AckedAt = &ackedAt.Time
+	}
+	return d, nil
+}
@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"fmt"
+	"time"
+)
+
+// Tables synced to cloud through a cursor rather than a per-row flag. Their
+// rows are only ever appended, so everything up to the cursor's ID has been
+// sent and everything after it is waiting.
+const (
+	SyncSoilReadings  = "soil_moisture_readings"
+	SyncMeterReadings = "water_meter_readings"
+	SyncValveEvents   = "valve_events"
+)
+
+// SyncCursorTables lists the tables synced through a cursor
+var SyncCursorTables = []string{SyncSoilReadings, SyncMeterReadings, SyncValveEvents}
+
+// Subqueries for a cursor table's last synced ID, used in place of the
+// synced_to_cloud column the cursors replaced
+const (
+	soilCursorSQL  = "(SELECT last_id FROM sync_cursors WHERE table_name = '" + SyncSoilReadings + "')"
+	meterCursorSQL = "(SELECT last_id FROM sync_cursors WHERE table_name = '" + SyncMeterReadings + "')"
+	valveCursorSQL = "(SELECT last_id FROM sync_cursors WHERE table_name = '" + SyncValveEvents + "')"
+)
+
+// migrateSyncCursors starts a cursor for each cursor table that has none,
+// just before its oldest row still flagged unsynced, and drops the flag
+// indexes that made every insert and sync write twice
+func (db *DB) migrateSyncCursors() error {
+	for _, table := range SyncCursorTables {
+		_, err := db.conn.Exec(fmt.Sprintf(`INSERT INTO sync_cursors (table_name, last_id, updated_at)
+			SELECT ?, COALESCE((SELECT MIN(id) - 1 FROM %[1]s WHERE synced_to_cloud = 0), (SELECT MAX(id) FROM %[1]s), 0), ?
+			WHERE true ON CONFLICT(table_name) DO NOTHING`,
+			table), table, time.Now())
+		if err != nil {
+			return fmt.Errorf("failed to start sync cursor for %s: %w", table, err)
+		}
+	}
+	for _, index := range []string{"idx_soil_moisture_synced", "idx_water_meter_synced", "idx_valve_events_synced"} {
+		if _, err := db.conn.Exec("DROP INDEX IF EXISTS " + index); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetSyncCursor returns the ID of the last row of a table synced to cloud
+func (db *DB) GetSyncCursor(table string) (int64, error) {
+	var id int64
+	err := db.conn.QueryRow("SELECT last_id FROM sync_cursors WHERE table_name = ?", table).Scan(&id)
+	return id, err
+}
+
+// AdvanceSyncCursor records a table's rows as synced through an ID in one
+// write. The cursor never moves back here; agsys-db resync does that.
+func (db *DB) AdvanceSyncCursor(table string, id int64) error {
+	_, err := db.conn.Exec(`UPDATE sync_cursors SET last_id = ?, updated_at = ?
+		WHERE table_name = ? AND last_id < ?`, id, time.Now(), table, id)
+	return err
+}
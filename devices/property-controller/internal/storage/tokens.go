@@ -0,0 +1,43 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"time"
+)
+
+// HashAPIToken returns the hash stored for a token
+func HashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// InsertAPIToken stores a new token under its hash
+func (db *DB) InsertAPIToken(name, role, token string) (int64, error) {
+	result, err := db.conn.Exec(`INSERT INTO api_tokens (name, role, token_hash, created_at)
+		VALUES (?, ?, ?, ?)`, name, role, HashAPIToken(token), time.Now())
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// GetAPIToken looks up a token and records that it was used. Returns
+// sql.ErrNoRows for unknown tokens.
+func (db *DB) GetAPIToken(token string) (*APIToken, error) {
+	t := &APIToken{}
+	var lastUsed sql.NullTime
+	err := db.conn.QueryRow(`SELECT id, name, role, token_hash, created_at, last_used_at
+		FROM api_tokens WHERE token_hash = ?`, HashAPIToken(token)).Scan(
+		&t.ID, &t.Name, &t.Role, &t.TokenHash, &t.CreatedAt, &lastUsed)
+	if err != nil {
+		return nil, err
+	}
+	if lastUsed.Valid {
+		t.LastUsedAt = lastUsed.Time
+	}
+
+	_, err = db.conn.Exec(`UPDATE api_tokens SET last_used_at = ? WHERE id = ?`, time.Now(), t.ID)
+	return t, err
+}
@@ -0,0 +1,48 @@
+package storage
+
+import (
+	"database/sql"
+	"time"
+)
+
+// GetMeterTotalizer retrieves a meter's totalizer state, or nil if it has none
+func (db *DB) GetMeterTotalizer(deviceUID string) (*MeterTotalizer, error) {
+	t := &MeterTotalizer{}
+	var pendingID sql.NullInt64
+	var pendingL sql.NullFloat64
+	err := db.conn.QueryRow(`SELECT device_uid, offset_l, last_raw_l, COALESCE(rollovers, 0), COALESCE(resets, 0),
+		pending_reset_id, pending_reset_l, updated_at
+		FROM meter_totalizers WHERE device_uid = ?`, deviceUID).Scan(&t.DeviceUID, &t.OffsetL, &t.LastRawL,
+		&t.Rollovers, &t.Resets, &pendingID, &pendingL, &t.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	t.PendingResetID = uint16(pendingID.Int64)
+	t.PendingResetL = pendingL.Float64
+	return t, nil
+}
+
+// SaveMeterTotalizer inserts or replaces a meter's totalizer state
+func (db *DB) SaveMeterTotalizer(t *MeterTotalizer) error {
+	t.UpdatedAt = time.Now()
+	var pendingL interface{}
+	if t.PendingResetID != 0 {
+		pendingL = t.PendingResetL
+	}
+	_, err := db.conn.Exec(`INSERT INTO meter_totalizers
+		(device_uid, offset_l, last_raw_l, rollovers, resets, pending_reset_id, pending_reset_l, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(device_uid) DO UPDATE SET
+			offset_l = excluded.offset_l,
+			last_raw_l = excluded.last_raw_l,
+			rollovers = excluded.rollovers,
+			resets = excluded.resets,
+			pending_reset_id = excluded.pending_reset_id,
+			pending_reset_l = excluded.pending_reset_l,
+			updated_at = excluded.updated_at`,
+		t.DeviceUID, t.OffsetL, t.LastRawL, t.Rollovers, t.Resets, nullIfZero(int64(t.PendingResetID)), pendingL, t.UpdatedAt)
+	return err
+}
@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"database/sql"
+	"time"
+)
+
+// SetValveTimer schedules a valve's automatic close, replacing any timer the
+// valve already has
+func (db *DB) SetValveTimer(t *ValveTimer) error {
+	t.CreatedAt = time.Now()
+	_, err := db.conn.Exec(`INSERT INTO valve_timers
+		(controller_uid, actuator_addr, close_at, cloud_command_id, created_at)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(controller_uid, actuator_addr) DO UPDATE SET
+			close_at = excluded.close_at,
+			cloud_command_id = excluded.cloud_command_id,
+			created_at = excluded.created_at`,
+		t.ControllerUID, t.ActuatorAddr, t.CloseAt.UTC(), sql.NullString{String: t.CloudCommandID, Valid: t.CloudCommandID != ""}, t.CreatedAt)
+	return err
+}
+
+// DeleteValveTimer cancels a valve's automatic close. It reports whether the
+// valve had one.
+func (db *DB) DeleteValveTimer(controllerUID string, actuatorAddr uint8) (bool, error) {
+	result, err := db.conn.Exec("DELETE FROM valve_timers WHERE controller_uid = ? AND actuator_addr = ?",
+		controllerUID, actuatorAddr)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// GetValveTimers returns the pending automatic closes, soonest first
+func (db *DB) GetValveTimers() ([]*ValveTimer, error) {
+	return db.queryValveTimers("SELECT controller_uid, actuator_addr, close_at, COALESCE(cloud_command_id, ''), created_at FROM valve_timers ORDER BY close_at")
+}
+
+// GetDueValveTimers returns the automatic closes due by a time, soonest first
+func (db *DB) GetDueValveTimers(now time.Time) ([]*ValveTimer, error) {
+	return db.queryValveTimers(`SELECT controller_uid, actuator_addr, close_at, COALESCE(cloud_command_id, ''), created_at
+		FROM valve_timers WHERE close_at <= ? ORDER BY close_at`, now.UTC())
+}
+
+func (db *DB) queryValveTimers(query string, args ...interface{}) ([]*ValveTimer, error) {
+	rows, err := db.conn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var timers []*ValveTimer
+	for rows.Next() {
+		t := &ValveTimer{}
+		if err := rows.Scan(&t.ControllerUID, &t.ActuatorAddr, &t.CloseAt, &t.CloudCommandID, &t.CreatedAt); err != nil {
+			return nil, err
+		}
+		timers = append(timers, t)
+	}
+	return timers, rows.Err()
+}
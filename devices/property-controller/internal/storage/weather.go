@@ -0,0 +1,50 @@
+package storage
+
+import "time"
+
+// UpsertWeatherHours stores fetched weather, replacing earlier forecasts for
+// the same hours
+func (db *DB) UpsertWeatherHours(hours []*WeatherHour) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, h := range hours {
+		if _, err := tx.Exec(`INSERT INTO weather_hours (hour, rain_mm, et_mm, updated_at)
+			VALUES (?, ?, ?, ?)
+			ON CONFLICT(hour) DO UPDATE SET rain_mm = excluded.rain_mm, et_mm = excluded.et_mm,
+				updated_at = excluded.updated_at`,
+			h.Hour.UTC(), h.RainMM, h.ETMM, h.UpdatedAt); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetWeatherTotals sums rainfall and ET0 for hours starting in [from, to)
+func (db *DB) GetWeatherTotals(from, to time.Time) (*WeatherTotals, error) {
+	t := &WeatherTotals{}
+	err := db.conn.QueryRow(`SELECT COUNT(*), COALESCE(SUM(rain_mm), 0), COALESCE(SUM(et_mm), 0)
+		FROM weather_hours WHERE hour >= ? AND hour < ?`, from.UTC(), to.UTC()).
+		Scan(&t.Hours, &t.RainMM, &t.ETMM)
+	if err != nil || t.Hours == 0 {
+		return t, err
+	}
+
+	// Selected directly rather than with MAX() so it scans as a time
+	err = db.conn.QueryRow(`SELECT updated_at FROM weather_hours WHERE hour >= ? AND hour < ?
+		ORDER BY updated_at DESC LIMIT 1`, from.UTC(), to.UTC()).Scan(&t.UpdatedAt)
+	return t, err
+}
+
+// DeleteWeatherHoursBefore deletes weather for hours before a time, returning
+// the number removed
+func (db *DB) DeleteWeatherHoursBefore(before time.Time) (int64, error) {
+	result, err := db.conn.Exec("DELETE FROM weather_hours WHERE hour < ?", before.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
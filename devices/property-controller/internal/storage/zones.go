@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// UpsertZone inserts or updates a zone
+func (db *DB) UpsertZone(z *Zone) error {
+	_, err := db.conn.Exec(`INSERT INTO zones (uid, property_id, name, alias, updated_at)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(uid) DO UPDATE SET property_id = excluded.property_id, name = excluded.name,
+			alias = excluded.alias, updated_at = excluded.updated_at`,
+		z.UID, z.PropertyID, z.Name, nullIfEmpty(z.Alias), time.Now())
+	return err
+}
+
+// GetZone retrieves a zone by UID
+func (db *DB) GetZone(uid string) (*Zone, error) {
+	z := &Zone{}
+	var alias sql.NullString
+	err := db.conn.QueryRow(`SELECT uid, property_id, name, alias, updated_at FROM zones WHERE uid = ?`, uid).
+		Scan(&z.UID, &z.PropertyID, &z.Name, &alias, &z.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	z.Alias = alias.String
+	return z, nil
+}
+
+// GetZones retrieves all zones ordered by name
+func (db *DB) GetZones() ([]*Zone, error) {
+	rows, err := db.conn.Query(`SELECT uid, property_id, name, alias, updated_at FROM zones ORDER BY name, uid`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var zones []*Zone
+	for rows.Next() {
+		z := &Zone{}
+		var alias sql.NullString
+		if err := rows.Scan(&z.UID, &z.PropertyID, &z.Name, &alias, &z.UpdatedAt); err != nil {
+			return nil, err
+		}
+		z.Alias = alias.String
+		zones = append(zones, z)
+	}
+	return zones, rows.Err()
+}
+
+// DeleteZone removes a zone. Devices and valves keep their zone ID.
+func (db *DB) DeleteZone(uid string) error {
+	_, err := db.conn.Exec("DELETE FROM zones WHERE uid = ?", uid)
+	return err
+}
+
+// ReplaceZones makes the zones table match a full list from the cloud,
+// returning the number of zones removed. Aliases of existing zones are kept
+// when the list doesn't carry one.
+func (db *DB) ReplaceZones(zones []*Zone) (int64, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	keep := make([]interface{}, 0, len(zones))
+	for _, z := range zones {
+		if _, err := tx.Exec(`INSERT INTO zones (uid, property_id, name, alias, updated_at)
+			VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT(uid) DO UPDATE SET property_id = excluded.property_id, name = excluded.name,
+				alias = COALESCE(excluded.alias, zones.alias), updated_at = excluded.updated_at`,
+			z.UID, z.PropertyID, z.Name, nullIfEmpty(z.Alias), now); err != nil {
+			return 0, err
+		}
+		keep = append(keep, z.UID)
+	}
+
+	query := "DELETE FROM zones"
+	if len(keep) > 0 {
+		query += " WHERE uid NOT IN (?" + strings.Repeat(", ?", len(keep)-1) + ")"
+	}
+	result, err := tx.Exec(query, keep...)
+	if err != nil {
+		return 0, err
+	}
+	removed, _ := result.RowsAffected()
+	return removed, tx.Commit()
+}
+
+// nullIfEmpty stores an empty optional string as NULL
+func nullIfEmpty(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
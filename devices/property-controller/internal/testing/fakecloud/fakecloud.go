@@ -0,0 +1,322 @@
+// Package fakecloud is an in-process stand-in for the AgSys backend. It
+// implements the controller and firmware gRPC services, records everything
+// a controller sends, and lets callers push backend messages down the stream.
+// The integration test harness and the agsys-fakecloud development server
+// are both built on it.
+package fakecloud
+
+import (
+	"context"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"sync"
+	"time"
+
+	_ "github.com/agsys/property-controller/internal/cloud/zstd" // Accept compressed streams, as the backend does
+	controllerv1 "github.com/ccroswhite/agsys-api/gen/go/proto/controller/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	_ "google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// firmwareChunkSize is the size of each DownloadFirmware stream message
+const firmwareChunkSize = 4096
+
+// sessionTokenKey is the metadata key controllers send their session token in
+const sessionTokenKey = "x-controller-token"
+
+// Firmware is an image served for one device type
+type Firmware struct {
+	ID                  string
+	Major, Minor, Patch int32
+	Data                []byte
+}
+
+// Server implements ControllerService and FirmwareService in memory
+type Server struct {
+	controllerv1.UnimplementedControllerServiceServer
+	controllerv1.UnimplementedFirmwareServiceServer
+
+	// APIKey, when set, is the only key Authenticate accepts
+	APIKey string
+
+	// PingInterval, when set, is how often open streams are pinged, as the
+	// real backend does to keep them alive
+	PingInterval time.Duration
+
+	// Hooks, set before serving
+	OnConnect func()                                // A controller opened its stream
+	OnMessage func(*controllerv1.ControllerMessage) // A controller sent a message
+
+	mu         sync.Mutex
+	changed    chan struct{} // Closed and replaced whenever state changes
+	streams    int
+	kick       chan struct{} // Closed to end every open stream
+	kickErr    error         // What kicked streams fail with
+	sessions   map[string]bool
+	auths      int
+	downlink   chan *controllerv1.BackendMessage
+	messages   []*controllerv1.ControllerMessage
+	otaReports []*controllerv1.OTAStatusReport
+	firmware   map[controllerv1.DeviceTypeEnum]*Firmware
+	nextID     int
+}
+
+// New creates an empty fake backend
+func New() *Server {
+	return &Server{
+		changed:  make(chan struct{}),
+		kick:     make(chan struct{}),
+		sessions: make(map[string]bool),
+		downlink: make(chan *controllerv1.BackendMessage, 100),
+		firmware: make(map[controllerv1.DeviceTypeEnum]*Firmware),
+	}
+}
+
+// Register adds both services to a gRPC server
+func (s *Server) Register(gs *grpc.Server) {
+	controllerv1.RegisterControllerServiceServer(gs, s)
+	controllerv1.RegisterFirmwareServiceServer(gs, s)
+}
+
+// notify wakes everything waiting on a state change. Callers hold mu.
+func (s *Server) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// Authenticate accepts any controller, or only those with the configured
+// key, issuing a new session token each time
+func (s *Server) Authenticate(ctx context.Context, req *controllerv1.AuthRequest) (*controllerv1.AuthResponse, error) {
+	if s.APIKey != "" && req.ApiKey != s.APIKey {
+		return &controllerv1.AuthResponse{Success: false, ErrorMessage: "invalid API key"}, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.auths++
+	token := fmt.Sprintf("session-%s-%d", req.ControllerId, s.auths)
+	s.sessions[token] = true
+	s.notify()
+	return &controllerv1.AuthResponse{Success: true, SessionToken: token}, nil
+}
+
+// Connect records controller messages and forwards pushed backend messages
+// until the controller disconnects. Streams without a current session token
+// are rejected as unauthenticated.
+func (s *Server) Connect(stream controllerv1.ControllerService_ConnectServer) error {
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	tokens := md.Get(sessionTokenKey)
+
+	s.mu.Lock()
+	if len(tokens) == 0 || !s.sessions[tokens[0]] {
+		s.mu.Unlock()
+		return status.Error(codes.Unauthenticated, "invalid session token")
+	}
+	s.streams++
+	kick := s.kick
+	s.notify()
+	s.mu.Unlock()
+
+	if s.OnConnect != nil {
+		s.OnConnect()
+	}
+
+	defer func() {
+		s.mu.Lock()
+		s.streams--
+		s.notify()
+		s.mu.Unlock()
+	}()
+
+	// A nil channel never fires when pings are off
+	var ping <-chan time.Time
+	if s.PingInterval > 0 {
+		ticker := time.NewTicker(s.PingInterval)
+		defer ticker.Stop()
+		ping = ticker.C
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		for {
+			msg, err := stream.Recv()
+			if err != nil {
+				errc <- err
+				return
+			}
+			s.mu.Lock()
+			s.messages = append(s.messages, msg)
+			s.notify()
+			s.mu.Unlock()
+
+			if s.OnMessage != nil {
+				s.OnMessage(msg)
+			}
+		}
+	}()
+
+	for {
+		select {
+		case err := <-errc:
+			return err
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		case <-kick:
+			s.mu.Lock()
+			err := s.kickErr
+			s.mu.Unlock()
+			return err
+		case <-ping:
+			if err := stream.Send(&controllerv1.BackendMessage{Payload: &controllerv1.BackendMessage_Ping{}}); err != nil {
+				return err
+			}
+		case msg := <-s.downlink:
+			if err := stream.Send(msg); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Push queues a message for the connected controller. Its ID is filled in
+// when empty.
+func (s *Server) Push(msg *controllerv1.BackendMessage) {
+	s.mu.Lock()
+	if msg.MessageId == "" {
+		s.nextID++
+		msg.MessageId = fmt.Sprintf("msg-%d", s.nextID)
+	}
+	s.mu.Unlock()
+	s.downlink <- msg
+}
+
+// DropStreams ends every open stream as if the network failed. Sessions
+// stay valid.
+func (s *Server) DropStreams() {
+	s.endStreams(status.Error(codes.Unavailable, "connection dropped"))
+}
+
+// RevokeSessions invalidates every session token and ends the streams using
+// them as unauthenticated
+func (s *Server) RevokeSessions() {
+	s.mu.Lock()
+	clear(s.sessions)
+	s.mu.Unlock()
+	s.endStreams(status.Error(codes.Unauthenticated, "session revoked"))
+}
+
+func (s *Server) endStreams(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.kickErr = err
+	close(s.kick)
+	s.kick = make(chan struct{})
+}
+
+// Auths returns how many times controllers have authenticated
+func (s *Server) Auths() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.auths
+}
+
+// Connected reports whether a controller stream is open
+func (s *Server) Connected() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.streams > 0
+}
+
+// Messages returns everything controllers have sent on the stream
+func (s *Server) Messages() []*controllerv1.ControllerMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*controllerv1.ControllerMessage(nil), s.messages...)
+}
+
+// OTAReports returns the OTA results controllers have reported
+func (s *Server) OTAReports() []*controllerv1.OTAStatusReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*controllerv1.OTAStatusReport(nil), s.otaReports...)
+}
+
+// Changed returns a channel closed at the next state change, for waiting
+// on messages or connections without polling
+func (s *Server) Changed() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.changed
+}
+
+// SetFirmware serves an image as the latest firmware for a device type
+func (s *Server) SetFirmware(deviceType controllerv1.DeviceTypeEnum, fw *Firmware) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.firmware[deviceType] = fw
+}
+
+// GetLatestFirmware describes the image set for the device type, if any
+func (s *Server) GetLatestFirmware(ctx context.Context, req *controllerv1.GetLatestFirmwareRequest) (*controllerv1.GetLatestFirmwareResponse, error) {
+	s.mu.Lock()
+	fw := s.firmware[req.DeviceType]
+	s.mu.Unlock()
+
+	if fw == nil {
+		return &controllerv1.GetLatestFirmwareResponse{Available: false}, nil
+	}
+	return &controllerv1.GetLatestFirmwareResponse{
+		Available: true,
+		Firmware: &controllerv1.FirmwareInfo{
+			FirmwareId:   fw.ID,
+			VersionMajor: fw.Major,
+			VersionMinor: fw.Minor,
+			VersionPatch: fw.Patch,
+			SizeBytes:    int64(len(fw.Data)),
+			Crc32:        crc32.ChecksumIEEE(fw.Data),
+		},
+	}, nil
+}
+
+// DownloadFirmware streams the image for the device type
+func (s *Server) DownloadFirmware(req *controllerv1.DownloadFirmwareRequest, stream controllerv1.FirmwareService_DownloadFirmwareServer) error {
+	s.mu.Lock()
+	fw := s.firmware[req.DeviceType]
+	s.mu.Unlock()
+
+	if fw == nil || fw.ID != req.FirmwareId {
+		return fmt.Errorf("firmware %s not found", req.FirmwareId)
+	}
+
+	total := (len(fw.Data) + firmwareChunkSize - 1) / firmwareChunkSize
+	for i := 0; i < total; i++ {
+		end := (i + 1) * firmwareChunkSize
+		if end > len(fw.Data) {
+			end = len(fw.Data)
+		}
+		if err := stream.Send(&controllerv1.FirmwareChunk{
+			ChunkIndex:  int32(i),
+			TotalChunks: int32(total),
+			Data:        fw.Data[i*firmwareChunkSize : end],
+			IsLast:      i == total-1,
+		}); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Fake cloud: Served firmware %s (%d bytes)", fw.ID, len(fw.Data))
+	return nil
+}
+
+// ReportOTAStatus records an OTA result
+func (s *Server) ReportOTAStatus(ctx context.Context, req *controllerv1.OTAStatusReport) (*controllerv1.OTAStatusResponse, error) {
+	s.mu.Lock()
+	s.otaReports = append(s.otaReports, req)
+	s.notify()
+	s.mu.Unlock()
+	return &controllerv1.OTAStatusResponse{Success: true}, nil
+}
@@ -0,0 +1,674 @@
+package harness
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/agsys/property-controller/internal/engine"
+	"github.com/agsys/property-controller/internal/protocol"
+	"github.com/agsys/property-controller/internal/storage"
+	"github.com/agsys/property-controller/internal/testing/fakecloud"
+	controllerv1 "github.com/ccroswhite/agsys-api/gen/go/proto/controller/v1"
+	"github.com/ccroswhite/agsys-api/pkg/lora"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// TestSensorIngestSync tests a soil reading from the radio through storage
+// to the cloud
+func TestSensorIngestSync(t *testing.T) {
+	h := New(t)
+	h.Start()
+
+	probe := h.Device([8]byte{0x01, 0, 0, 0, 0, 0, 0, 0x01}, protocol.DeviceTypeSoilMoisture)
+	reading := &protocol.SensorDataPayload{
+		ProbeID:         1,
+		MoistureRaw:     2100,
+		MoisturePercent: 37,
+		Temperature:     215,
+		BatteryMV:       3300,
+	}
+	probe.Send(protocol.MsgTypeSensorReport, reading.Encode())
+
+	// Stored by the engine
+	var stored []*storage.SoilMoistureReading
+	h.WaitFor("stored reading", func() bool {
+		stored, _ = h.DB.GetSoilMoistureReadings(probe.UIDString(), 10)
+		return len(stored) == 1
+	})
+	if stored[0].MoisturePercent != 37 || stored[0].ProbeID != 1 || stored[0].RSSI != -80 {
+		t.Errorf("Stored reading = %+v", stored[0])
+	}
+
+	// Synced to the cloud and marked as such
+	var batch *controllerv1.SensorDataBatch
+	h.WaitFor("synced reading", func() bool {
+		for _, msg := range h.Cloud.Messages() {
+			if p, ok := msg.Payload.(*controllerv1.ControllerMessage_SensorData); ok {
+				batch = p.SensorData
+				return true
+			}
+		}
+		return false
+	})
+	if batch.DeviceUid != probe.UIDString() || len(batch.Readings) != 1 {
+		t.Fatalf("Synced batch = %+v", batch)
+	}
+	got := batch.Readings[0]
+	if len(got.Probes) != 1 || got.Probes[0].MoisturePercent != 37 || got.BatteryMv != 3300 {
+		t.Errorf("Synced reading = %+v", got)
+	}
+
+	h.WaitFor("reading marked synced", func() bool {
+		unsynced, _ := h.DB.GetUnsyncedSoilMoistureReadings(10)
+		return len(unsynced) == 0
+	})
+}
+
+// TestSharedRadio tests two properties on one radio: an unclaimed device is
+// heard by both until one property's cloud approves it
+func TestSharedRadio(t *testing.T) {
+	loop := NewLoopback()
+	radioCfg := engine.DefaultConfig()
+	radioCfg.Radio = loop
+	shared, err := engine.NewSharedRadio(radioCfg)
+	if err != nil {
+		t.Fatalf("NewSharedRadio failed: %v", err)
+	}
+	if err := shared.Start(); err != nil {
+		t.Fatalf("Failed to start shared radio: %v", err)
+	}
+	t.Cleanup(func() { shared.Stop() })
+
+	onShared := func(c *engine.Config) {
+		c.Radio = loop
+		c.SharedRadio = shared
+	}
+	h1 := New(t, onShared)
+	h2 := New(t, onShared, func(c *engine.Config) { c.ControllerID = "test-controller-2" })
+	h1.Start()
+	h2.Start()
+
+	probe := h1.Device([8]byte{0x01, 0, 0, 0, 0, 0, 0, 0x02}, protocol.DeviceTypeSoilMoisture)
+	reading := &protocol.SensorDataPayload{ProbeID: 1, MoisturePercent: 40}
+	probe.Send(protocol.MsgTypeSensorReport, reading.Encode())
+
+	for _, h := range []*Harness{h1, h2} {
+		h.WaitFor("unclaimed reading", func() bool {
+			stored, _ := h.DB.GetSoilMoistureReadings(probe.UIDString(), 10)
+			return len(stored) == 1
+		})
+	}
+
+	h2.Cloud.Push(&controllerv1.BackendMessage{
+		Payload: &controllerv1.BackendMessage_DeviceApproved{
+			DeviceApproved: &controllerv1.DeviceApproved{
+				DeviceUid:  probe.UIDString(),
+				DeviceType: "soil_moisture",
+				Name:       "North probe",
+			},
+		},
+	})
+	h2.WaitFor("approved device", func() bool {
+		registered, _ := h2.DB.IsDeviceRegistered(probe.UIDString())
+		return registered
+	})
+
+	reading.MoisturePercent = 41
+	probe.Send(protocol.MsgTypeSensorReport, reading.Encode())
+	h2.WaitFor("claimed reading", func() bool {
+		stored, _ := h2.DB.GetSoilMoistureReadings(probe.UIDString(), 10)
+		return len(stored) == 2
+	})
+	if stored, _ := h1.DB.GetSoilMoistureReadings(probe.UIDString(), 10); len(stored) != 1 {
+		t.Errorf("Other property stored %d readings, want 1", len(stored))
+	}
+}
+
+// TestCloudCompression tests that readings reach the cloud over a
+// compressed stream with each supported encoding
+func TestCloudCompression(t *testing.T) {
+	for _, compression := range []string{"gzip", "zstd"} {
+		t.Run(compression, func(t *testing.T) {
+			h := New(t, func(c *engine.Config) { c.CloudCompression = compression })
+			h.Start()
+
+			probe := h.Device([8]byte{0x01, 0, 0, 0, 0, 0, 0, 0x02}, protocol.DeviceTypeSoilMoisture)
+			reading := &protocol.SensorDataPayload{ProbeID: 1, MoisturePercent: 42, BatteryMV: 3300}
+			probe.Send(protocol.MsgTypeSensorReport, reading.Encode())
+
+			h.WaitFor("synced reading", func() bool {
+				for _, msg := range h.Cloud.Messages() {
+					if p, ok := msg.Payload.(*controllerv1.ControllerMessage_SensorData); ok {
+						return p.SensorData.Readings[0].Probes[0].MoisturePercent == 42
+					}
+				}
+				return false
+			})
+		})
+	}
+}
+
+// TestValveCommandAck tests a cloud valve command through the radio and
+// back as a cloud ack
+func TestValveCommandAck(t *testing.T) {
+	h := New(t)
+	h.Start()
+
+	valve := h.Device([8]byte{0x02, 0, 0, 0, 0, 0, 0, 0x01}, protocol.DeviceTypeValveController)
+	h.Cloud.Push(&controllerv1.BackendMessage{
+		Payload: &controllerv1.BackendMessage_ValveCommand{
+			ValveCommand: &controllerv1.ValveCommand{
+				CommandId:       "cmd-1",
+				ControllerUid:   valve.UIDString(),
+				ActuatorAddress: 3,
+				Command:         controllerv1.Command_COMMAND_OPEN,
+			},
+		},
+	})
+
+	msg := valve.Expect(protocol.MsgTypeValveCommand, WaitTimeout)
+	cmd, err := protocol.DecodeValveCommand(msg.Payload)
+	if err != nil {
+		t.Fatalf("DecodeValveCommand failed: %v", err)
+	}
+	if cmd.ActuatorAddr != 3 || cmd.Command != protocol.ValveCmdOpen {
+		t.Fatalf("Valve command = %+v", cmd)
+	}
+
+	// The command is tracked just after it is handed to the radio
+	h.WaitFor("pending command", func() bool {
+		_, err := h.DB.GetPendingCommand(cmd.CommandID)
+		return err == nil
+	})
+
+	ack := &protocol.ValveAckPayload{
+		ActuatorAddr: 3,
+		CommandID:    cmd.CommandID,
+		ResultState:  protocol.ValveStateOpen,
+		Success:      true,
+	}
+	valve.Send(protocol.MsgTypeValveAck, ack.Encode())
+
+	var cloudAck *controllerv1.CommandAck
+	h.WaitFor("cloud ack", func() bool {
+		for _, msg := range h.Cloud.Messages() {
+			if p, ok := msg.Payload.(*controllerv1.ControllerMessage_CommandAck); ok {
+				cloudAck = p.CommandAck
+				return true
+			}
+		}
+		return false
+	})
+	if cloudAck.CommandId != "cmd-1" || !cloudAck.Success {
+		t.Errorf("Cloud ack = %+v", cloudAck)
+	}
+
+	entries, err := h.DB.GetCommandAudit(valve.UIDString(), 10)
+	if err != nil {
+		t.Fatalf("GetCommandAudit failed: %v", err)
+	}
+	acked := false
+	for _, a := range entries {
+		if a.Outcome == storage.AuditAcked && a.CloudCommandID == "cmd-1" {
+			acked = true
+		}
+	}
+	if !acked {
+		t.Errorf("No acked audit entry for cmd-1 in %+v", entries)
+	}
+}
+
+// TestDebugCommand tests a diagnostic command from the cloud through to a
+// device, and its reply relayed back as the command's ack
+func TestDebugCommand(t *testing.T) {
+	h := New(t)
+	h.Start()
+
+	valve := h.Device([8]byte{0x02, 0, 0, 0, 0, 0, 0, 0x05}, protocol.DeviceTypeValveController)
+	h.Cloud.Push(&controllerv1.BackendMessage{
+		Payload: &controllerv1.BackendMessage_DeviceApproved{
+			DeviceApproved: &controllerv1.DeviceApproved{
+				DeviceUid:  valve.UIDString(),
+				DeviceType: "valve_controller",
+				Name:       "Debug valve",
+			},
+		},
+	})
+	h.WaitFor("approved device", func() bool {
+		registered, _ := h.DB.IsDeviceRegistered(valve.UIDString())
+		return registered
+	})
+
+	h.Cloud.Push(&controllerv1.BackendMessage{
+		Payload: &controllerv1.BackendMessage_ConfigUpdate{
+			ConfigUpdate: &controllerv1.ConfigUpdate{
+				Target: "debug_command",
+				Config: map[string]string{
+					"device_uid": valve.UIDString(),
+					"command_id": "dbg-1",
+					"data":       "0102ff",
+				},
+			},
+		},
+	})
+
+	msg := valve.Expect(protocol.MsgTypeDebugCommand, WaitTimeout)
+	cmd, err := protocol.DecodeDebugCommand(msg.Payload)
+	if err != nil {
+		t.Fatalf("DecodeDebugCommand failed: %v", err)
+	}
+	if !bytes.Equal(cmd.Data, []byte{0x01, 0x02, 0xFF}) {
+		t.Fatalf("Debug command data = % X", cmd.Data)
+	}
+
+	reply := &protocol.DebugReplyPayload{RequestID: cmd.RequestID, Data: []byte{0xAB, 0xCD}}
+	valve.Send(protocol.MsgTypeDebugReply, reply.Encode())
+
+	var cloudAck *controllerv1.CommandAck
+	h.WaitFor("cloud ack", func() bool {
+		for _, msg := range h.Cloud.Messages() {
+			if p, ok := msg.Payload.(*controllerv1.ControllerMessage_CommandAck); ok && p.CommandAck.CommandId == "dbg-1" {
+				cloudAck = p.CommandAck
+				return true
+			}
+		}
+		return false
+	})
+	if !cloudAck.Success || cloudAck.ErrorMessage != "abcd" {
+		t.Errorf("Cloud ack = %+v", cloudAck)
+	}
+
+	entries, err := h.DB.GetCommandAudit(valve.UIDString(), 10)
+	if err != nil {
+		t.Fatalf("GetCommandAudit failed: %v", err)
+	}
+	acked := false
+	for _, a := range entries {
+		if a.Kind == "debug" && a.Outcome == storage.AuditAcked && a.CloudCommandID == "dbg-1" {
+			acked = true
+		}
+	}
+	if !acked {
+		t.Errorf("No acked audit entry for dbg-1 in %+v", entries)
+	}
+}
+
+// TestValveDuration tests that a valve opened for a duration closes by itself,
+// and that a timer stored before a restart still fires
+func TestValveDuration(t *testing.T) {
+	h := New(t)
+
+	valve := h.Device([8]byte{0x02, 0, 0, 0, 0, 0, 0, 0x01}, protocol.DeviceTypeValveController)
+	overdue := &storage.ValveTimer{ControllerUID: valve.UIDString(), ActuatorAddr: 1, CloseAt: time.Now().Add(-time.Minute)}
+	if err := h.DB.SetValveTimer(overdue); err != nil {
+		t.Fatalf("SetValveTimer failed: %v", err)
+	}
+	h.Start()
+
+	expectClose := func(addr uint8) {
+		t.Helper()
+		msg := valve.Expect(protocol.MsgTypeValveCommand, WaitTimeout)
+		cmd, err := protocol.DecodeValveCommand(msg.Payload)
+		if err != nil {
+			t.Fatalf("DecodeValveCommand failed: %v", err)
+		}
+		if cmd.ActuatorAddr != addr || cmd.Command != protocol.ValveCmdClose {
+			t.Fatalf("Valve command = %+v, want close of addr %d", cmd, addr)
+		}
+		ack := &protocol.ValveAckPayload{ActuatorAddr: addr, CommandID: cmd.CommandID, ResultState: protocol.ValveStateClosed, Success: true}
+		valve.Send(protocol.MsgTypeValveAck, ack.Encode())
+	}
+	expectClose(1)
+
+	h.Cloud.Push(&controllerv1.BackendMessage{
+		Payload: &controllerv1.BackendMessage_ValveCommand{
+			ValveCommand: &controllerv1.ValveCommand{
+				CommandId:       "cmd-1",
+				ControllerUid:   valve.UIDString(),
+				ActuatorAddress: 3,
+				Command:         controllerv1.Command_COMMAND_OPEN,
+				DurationSeconds: 1,
+			},
+		},
+	})
+	msg := valve.Expect(protocol.MsgTypeValveCommand, WaitTimeout)
+	if cmd, err := protocol.DecodeValveCommand(msg.Payload); err != nil || cmd.Command != protocol.ValveCmdOpen {
+		t.Fatalf("Valve command = %+v (err %v), want open", cmd, err)
+	}
+	expectClose(3)
+
+	h.WaitFor("duration close events", func() bool {
+		events, _ := h.DB.GetValveEventsSince(time.Time{})
+		closed := 0
+		for _, e := range events {
+			if e.Source == "duration" && e.NewState == protocol.ValveStateClosing {
+				closed++
+			}
+		}
+		return closed == 2
+	})
+	if timers, _ := h.DB.GetValveTimers(); len(timers) != 0 {
+		t.Errorf("Timers left after closing: %+v", timers)
+	}
+}
+
+// TestEmergencyStop tests that an emergency stop from the cloud closes every
+// valve and refuses opens until it is re-armed
+func TestEmergencyStop(t *testing.T) {
+	h := New(t)
+
+	valve := h.Device([8]byte{0x02, 0, 0, 0, 0, 0, 0, 0x01}, protocol.DeviceTypeValveController)
+	for addr := uint8(1); addr <= 2; addr++ {
+		if err := h.DB.RegisterValve(fmt.Sprintf("valve-%d", addr), valve.UIDString(), addr, "", ""); err != nil {
+			t.Fatalf("RegisterValve failed: %v", err)
+		}
+	}
+	h.Start()
+
+	config := func(target string) {
+		h.Cloud.Push(&controllerv1.BackendMessage{
+			Payload: &controllerv1.BackendMessage_ConfigUpdate{
+				ConfigUpdate: &controllerv1.ConfigUpdate{Target: target, Config: map[string]string{"actor": "user-1", "reason": "pipe burst"}},
+			},
+		})
+	}
+	open := func(id string) {
+		h.Cloud.Push(&controllerv1.BackendMessage{
+			Payload: &controllerv1.BackendMessage_ValveCommand{
+				ValveCommand: &controllerv1.ValveCommand{CommandId: id, ValveId: "valve-1", Command: controllerv1.Command_COMMAND_OPEN},
+			},
+		})
+	}
+	nextCommand := func() *protocol.ValveCommandPayload {
+		t.Helper()
+		msg := valve.Expect(protocol.MsgTypeValveCommand, WaitTimeout)
+		cmd, err := protocol.DecodeValveCommand(msg.Payload)
+		if err != nil {
+			t.Fatalf("DecodeValveCommand failed: %v", err)
+		}
+		return cmd
+	}
+
+	config("emergency_stop")
+	for addr := uint8(1); addr <= 2; addr++ {
+		if cmd := nextCommand(); cmd.ActuatorAddr != addr || cmd.Command != protocol.ValveCmdClose {
+			t.Fatalf("Valve command = %+v, want close of addr %d", cmd, addr)
+		}
+	}
+	h.WaitFor("emergency stop", func() bool {
+		stop, _ := h.DB.GetActiveEmergencyStop()
+		return stop != nil && stop.ValvesClosed == 2
+	})
+
+	// Opens are refused while stopped
+	open("cmd-1")
+	var refused *controllerv1.CommandAck
+	h.WaitFor("refused open", func() bool {
+		for _, msg := range h.Cloud.Messages() {
+			if p, ok := msg.Payload.(*controllerv1.ControllerMessage_CommandAck); ok && p.CommandAck.CommandId == "cmd-1" {
+				refused = p.CommandAck
+				return true
+			}
+		}
+		return false
+	})
+	if refused.Success {
+		t.Errorf("Open during emergency stop acked as %+v", refused)
+	}
+
+	config("emergency_rearm")
+	h.WaitFor("re-arm", func() bool {
+		stop, _ := h.DB.GetActiveEmergencyStop()
+		return stop == nil
+	})
+	open("cmd-2")
+	if cmd := nextCommand(); cmd.ActuatorAddr != 1 || cmd.Command != protocol.ValveCmdOpen {
+		t.Fatalf("Valve command after re-arm = %+v, want open of addr 1", cmd)
+	}
+}
+
+// TestGroupCommand tests that a command for a set of valves reaches each of
+// them and is acknowledged to the cloud once, with the aggregate outcome
+func TestGroupCommand(t *testing.T) {
+	h := New(t)
+	valve := h.Device([8]byte{0x02, 0, 0, 0, 0, 0, 0, 0x01}, protocol.DeviceTypeValveController)
+	h.Start()
+
+	h.Cloud.Push(&controllerv1.BackendMessage{
+		Payload: &controllerv1.BackendMessage_ConfigUpdate{
+			ConfigUpdate: &controllerv1.ConfigUpdate{Target: "valve_group", Config: map[string]string{
+				"command_id": "grp-1", "command": "open", "controller_uid": valve.UIDString(), "actuator_mask": "0x6"}},
+		},
+	})
+
+	// Addr 1 opens, addr 2 is rejected by the controller
+	for addr := uint8(1); addr <= 2; addr++ {
+		msg := valve.Expect(protocol.MsgTypeValveCommand, WaitTimeout)
+		cmd, err := protocol.DecodeValveCommand(msg.Payload)
+		if err != nil {
+			t.Fatalf("DecodeValveCommand failed: %v", err)
+		}
+		if cmd.ActuatorAddr != addr || cmd.Command != protocol.ValveCmdOpen {
+			t.Fatalf("Valve command = %+v, want open of addr %d", cmd, addr)
+		}
+		ack := &protocol.ValveAckPayload{ActuatorAddr: addr, CommandID: cmd.CommandID, ResultState: protocol.ValveStateOpen, Success: addr == 1}
+		valve.Send(protocol.MsgTypeValveAck, ack.Encode())
+	}
+
+	var acks []*controllerv1.CommandAck
+	h.WaitFor("group ack", func() bool {
+		acks = nil
+		for _, msg := range h.Cloud.Messages() {
+			if p, ok := msg.Payload.(*controllerv1.ControllerMessage_CommandAck); ok {
+				acks = append(acks, p.CommandAck)
+			}
+		}
+		return len(acks) > 0
+	})
+	if len(acks) != 1 || acks[0].CommandId != "grp-1" || acks[0].Success {
+		t.Fatalf("Command acks = %+v, want one failed ack of grp-1", acks)
+	}
+	if !strings.Contains(acks[0].ErrorMessage, "1 of 2 valves failed") {
+		t.Errorf("Group ack error = %q", acks[0].ErrorMessage)
+	}
+}
+
+// TestCloudSessionReuse tests that a dropped stream reconnects with its
+// session token, and that a revoked token is replaced by authenticating again
+func TestCloudSessionReuse(t *testing.T) {
+	h := New(t)
+	var streams atomic.Int32
+	h.Cloud.OnConnect = func() { streams.Add(1) }
+	h.Start()
+
+	if n := h.Cloud.Auths(); n != 1 {
+		t.Fatalf("Auths after connecting = %d, want 1", n)
+	}
+
+	h.Cloud.DropStreams()
+	h.WaitFor("reconnect after drop", func() bool { return streams.Load() == 2 && h.Cloud.Connected() })
+	if n := h.Cloud.Auths(); n != 1 {
+		t.Errorf("Auths after a dropped stream = %d, want 1", n)
+	}
+
+	h.Cloud.RevokeSessions()
+	h.WaitFor("reconnect after revocation", func() bool { return streams.Load() == 3 && h.Cloud.Connected() })
+	if n := h.Cloud.Auths(); n != 2 {
+		t.Errorf("Auths after a revoked session = %d, want 2", n)
+	}
+}
+
+// TestCloudLiveness tests that a stream the cloud pings stays up, and one it
+// goes quiet on is reconnected
+func TestCloudLiveness(t *testing.T) {
+	liveness := func(c *engine.Config) { c.CloudLiveness = 300 * time.Millisecond }
+
+	pinged := New(t, liveness)
+	pinged.Cloud.PingInterval = 50 * time.Millisecond
+	var pingedStreams atomic.Int32
+	pinged.Cloud.OnConnect = func() { pingedStreams.Add(1) }
+	pinged.Start()
+
+	time.Sleep(time.Second)
+	if n := pingedStreams.Load(); n != 1 {
+		t.Errorf("Pinged stream opened %d times, want 1", n)
+	}
+
+	silent := New(t, liveness)
+	var silentStreams atomic.Int32
+	silent.Cloud.OnConnect = func() { silentStreams.Add(1) }
+	silent.Start()
+
+	silent.WaitFor("reconnect of a silent stream", func() bool {
+		return silentStreams.Load() >= 2 && silent.Cloud.Connected()
+	})
+}
+
+// TestCloudFailover tests that a controller whose primary backend goes down
+// moves to its fallback, and back to the primary once it answers again
+func TestCloudFailover(t *testing.T) {
+	fallback := fakecloud.New()
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	fallback.Register(server)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	// Taking the primary down closes its connections and refuses new ones
+	var primaryDown atomic.Bool
+	var mu sync.Mutex
+	var primaryConns []net.Conn
+	h := New(t, func(c *engine.Config) {
+		c.GRPCFallbacks = []string{"fallback"}
+		c.CloudFailover = 1
+		c.CloudFailback = 100 * time.Millisecond
+		dialPrimary := c.CloudDialer
+		c.CloudDialer = func(ctx context.Context, addr string) (net.Conn, error) {
+			if addr == "fallback" {
+				return listener.DialContext(ctx)
+			}
+			if primaryDown.Load() {
+				return nil, errors.New("primary is down")
+			}
+			conn, err := dialPrimary(ctx, addr)
+			if err == nil {
+				mu.Lock()
+				primaryConns = append(primaryConns, conn)
+				mu.Unlock()
+			}
+			return conn, err
+		}
+	})
+	h.Start()
+
+	primaryDown.Store(true)
+	mu.Lock()
+	for _, conn := range primaryConns {
+		conn.Close()
+	}
+	mu.Unlock()
+	h.WaitFor("failover", func() bool { return fallback.Connected() && !h.Cloud.Connected() })
+	if status, err := h.API.Status(); err != nil || status.Cloud.ServerAddr != "fallback" {
+		t.Errorf("Status server = %+v, %v; want fallback", status, err)
+	}
+
+	primaryDown.Store(false)
+	h.WaitFor("failback", func() bool { return h.Cloud.Connected() && !fallback.Connected() })
+}
+
+// TestOTAFullTransfer tests a firmware image from the cloud through a full
+// chunked transfer to a device
+func TestOTAFullTransfer(t *testing.T) {
+	// Chunks at SF10 would otherwise be held for the airtime budget
+	h := New(t, func(c *engine.Config) { c.OTA.AirtimeBudget = 0 })
+
+	image := make([]byte, 1000) // Five 200-byte chunks
+	rand.New(rand.NewSource(1)).Read(image)
+	h.Cloud.SetFirmware(controllerv1.DeviceTypeEnum_DEVICE_TYPE_SOIL_MOISTURE, &fakecloud.Firmware{
+		ID: "fw-soil-1.1.0", Major: 1, Minor: 1, Patch: 0, Data: image,
+	})
+	h.Start()
+
+	h.WaitFor("firmware download", func() bool {
+		fw, err := h.API.OTAListFirmware()
+		return err == nil && len(fw) == 1
+	})
+
+	probe := h.Device([8]byte{0x01, 0, 0, 0, 0, 0, 0, 0x02}, protocol.DeviceTypeSoilMoisture)
+	req := &lora.OTARequestPayload{CurrentMajor: 1, CurrentMinor: 0, CurrentPatch: 0}
+	probe.Send(protocol.MsgTypeOTARequest, req.Encode())
+
+	announce, err := protocol.DecodeOTAAnnounce(probe.Expect(protocol.MsgTypeOTAAnnounce, WaitTimeout).Payload)
+	if err != nil {
+		t.Fatalf("DecodeOTAAnnounce failed: %v", err)
+	}
+	if announce.FirmwareSize != uint32(len(image)) || announce.ChunkCount != 5 {
+		t.Fatalf("Announce = %+v", announce)
+	}
+
+	ready := &lora.OTAReadyPayload{StartChunk: 0}
+	probe.Send(protocol.MsgTypeOTAReady, ready.Encode())
+
+	// Receive each chunk and report progress, as the device bootloader does
+	var received []byte
+	for i := uint16(0); i < announce.ChunkCount; i++ {
+		payload := probe.Expect(protocol.MsgTypeOTAChunk, WaitTimeout).Payload
+		if len(payload) < 4 {
+			t.Fatalf("Chunk %d too short: %d bytes", i, len(payload))
+		}
+		if index := binary.LittleEndian.Uint16(payload[0:2]); index != i {
+			t.Fatalf("Got chunk %d, want %d", index, i)
+		}
+		received = append(received, payload[4:]...)
+
+		progress := &lora.OTAStatusPayload{Status: lora.OTAStatusInProgress, ChunksReceived: i + 1}
+		probe.Send(protocol.MsgTypeOTAStatus, progress.Encode())
+	}
+
+	finish := probe.Expect(protocol.MsgTypeOTAFinish, WaitTimeout).Payload
+	if !bytes.Equal(received, image) {
+		t.Fatalf("Reassembled image differs from the cloud image")
+	}
+	if crc := binary.LittleEndian.Uint32(finish[0:4]); crc != crc32.ChecksumIEEE(image) {
+		t.Fatalf("Finish CRC = 0x%08X, want 0x%08X", crc, crc32.ChecksumIEEE(image))
+	}
+
+	done := &lora.OTAStatusPayload{
+		Status:         lora.OTAStatusSuccess,
+		ChunksReceived: announce.ChunkCount,
+		VersionMajor:   1,
+		VersionMinor:   1,
+		BootReason:     protocol.BootReasonOTASuccess,
+	}
+	probe.Send(protocol.MsgTypeOTAStatus, done.Encode())
+
+	h.WaitFor("update complete", func() bool {
+		status, err := h.API.OTAStatus()
+		if err != nil {
+			return false
+		}
+		for _, u := range status.Updates {
+			if u.DeviceUID == probe.UIDString() {
+				return u.State == "complete" && u.ChunksSent == announce.ChunkCount
+			}
+		}
+		return false
+	})
+
+	// Nothing more is sent once the device reports success
+	if msg := probe.Receive(protocol.MsgTypeOTAChunk, 200*time.Millisecond); msg != nil {
+		t.Errorf("Unexpected chunk after completion")
+	}
+}
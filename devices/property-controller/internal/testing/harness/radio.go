@@ -0,0 +1,94 @@
+package harness
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/agsys/property-controller/internal/protocol"
+)
+
+// receivePoll is how long Receive waits for an uplink before reporting none
+const receivePoll = 10 * time.Millisecond
+
+// Loopback is an in-memory radio. Uplinks injected by simulated devices are
+// received by the driver, and frames the driver transmits are decoded and
+// queued for the device they are addressed to.
+type Loopback struct {
+	uplink chan *protocol.LoRaMessage
+
+	mu        sync.Mutex
+	downlinks map[[8]byte]chan *protocol.LoRaMessage
+}
+
+// NewLoopback creates an idle loopback radio
+func NewLoopback() *Loopback {
+	return &Loopback{
+		uplink:    make(chan *protocol.LoRaMessage, 100),
+		downlinks: make(map[[8]byte]chan *protocol.LoRaMessage),
+	}
+}
+
+// Receive implements lora.Radio
+func (l *Loopback) Receive() (*protocol.LoRaMessage, error) {
+	select {
+	case msg := <-l.uplink:
+		return msg, nil
+	case <-time.After(receivePoll):
+		return nil, nil
+	}
+}
+
+// Transmit implements lora.Radio. Frames are expected in the clear; the
+// harness runs without network or device keys.
+func (l *Loopback) Transmit(data []byte, sf uint8, txPower int8) error {
+	msg, err := protocol.Decode(data)
+	if err != nil {
+		return fmt.Errorf("loopback: %w", err)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if msg.Header.DeviceUID == broadcastUID {
+		for _, ch := range l.downlinks {
+			deliver(ch, msg)
+		}
+		return nil
+	}
+	deliver(l.queue(msg.Header.DeviceUID), msg)
+	return nil
+}
+
+// deliver queues a downlink, dropping it if the device has stopped reading
+func deliver(ch chan *protocol.LoRaMessage, msg *protocol.LoRaMessage) {
+	select {
+	case ch <- msg:
+	default:
+	}
+}
+
+// queue returns the downlink queue of a device. Callers hold mu.
+func (l *Loopback) queue(uid [8]byte) chan *protocol.LoRaMessage {
+	ch, ok := l.downlinks[uid]
+	if !ok {
+		ch = make(chan *protocol.LoRaMessage, 256)
+		l.downlinks[uid] = ch
+	}
+	return ch
+}
+
+// Uplink hands a frame to the driver as if it had been received over the air
+func (l *Loopback) Uplink(msg *protocol.LoRaMessage) {
+	l.uplink <- msg
+}
+
+// Downlinks returns the queue of frames sent to a device
+func (l *Loopback) Downlinks(uid [8]byte) <-chan *protocol.LoRaMessage {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.queue(uid)
+}
+
+// broadcastUID addresses every device
+var broadcastUID = [8]byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
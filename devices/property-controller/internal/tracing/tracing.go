@@ -0,0 +1,83 @@
+// Package tracing configures OpenTelemetry tracing from controller.yaml.
+// Spans follow an uplink from the radio through decoding and storage to its
+// cloud sync. Without an endpoint the global tracer provider stays the no-op
+// default, and spans cost next to nothing.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Name of the tracer spans are started from, and of the service they are
+// exported under
+const (
+	tracerName  = "github.com/agsys/property-controller"
+	serviceName = "agsys-property-controller"
+)
+
+// Config selects where spans are exported
+type Config struct {
+	Endpoint    string  // OTLP gRPC collector, host:port ("" disables tracing)
+	Insecure    bool    // Connect without TLS, e.g. to a collector on the same host
+	SampleRatio float64 // Fraction of uplinks traced (0 or 1 and above traces all)
+}
+
+// Tracer returns the controller's tracer
+func Tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// Setup starts exporting spans over OTLP if an endpoint is set. The returned
+// function flushes spans still buffered and stops the export; call it once
+// everything traced has stopped. The controller ID and firmware version are
+// attached to every span.
+func Setup(cfg Config, controllerID, version string) (func(context.Context) error, error) {
+	if cfg.Endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(cfg.Endpoint)}
+	if cfg.Insecure {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	}
+	// Connects lazily, so a collector that is down doesn't hold up startup
+	exporter, err := otlptracegrpc.New(context.Background(), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		semconv.ServiceName(serviceName),
+		semconv.ServiceVersion(version),
+		attribute.String("agsys.controller_id", controllerID),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe tracing resource: %w", err)
+	}
+
+	sampler := sdktrace.AlwaysSample()
+	if cfg.SampleRatio > 0 && cfg.SampleRatio < 1 {
+		sampler = sdktrace.TraceIDRatioBased(cfg.SampleRatio)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sampler)),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		log.Printf("Tracing: %v", err)
+	}))
+	log.Printf("Exporting traces to %s", cfg.Endpoint)
+	return provider.Shutdown, nil
+}
@@ -0,0 +1,110 @@
+package weather
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Config selects the OpenWeather account and location
+type Config struct {
+	APIKey    string // Empty disables weather adjustment
+	Latitude  float64
+	Longitude float64
+	URL       string // One Call API endpoint
+	Timeout   time.Duration
+}
+
+// DefaultConfig returns default OpenWeather settings
+func DefaultConfig() Config {
+	return Config{
+		URL:     "https://api.openweathermap.org/data/3.0/onecall",
+		Timeout: 15 * time.Second,
+	}
+}
+
+// OpenWeather fetches forecasts from the OpenWeather One Call API
+type OpenWeather struct {
+	config Config
+	client *http.Client
+}
+
+// NewOpenWeather creates an OpenWeather provider
+func NewOpenWeather(config Config) *OpenWeather {
+	return &OpenWeather{
+		config: config,
+		client: &http.Client{Timeout: config.Timeout},
+	}
+}
+
+// oneCallResponse is the part of a One Call response that is used
+type oneCallResponse struct {
+	TimezoneOffset int64 `json:"timezone_offset"`
+	Hourly         []struct {
+		Dt   int64 `json:"dt"`
+		Rain struct {
+			OneHour float64 `json:"1h"`
+		} `json:"rain"`
+	} `json:"hourly"`
+	Daily []struct {
+		Dt   int64 `json:"dt"`
+		Temp struct {
+			Min float64 `json:"min"`
+			Max float64 `json:"max"`
+		} `json:"temp"`
+	} `json:"daily"`
+}
+
+// Fetch returns the hourly forecast, with ET0 spread evenly over the hours of
+// each day
+func (o *OpenWeather) Fetch(ctx context.Context) ([]Hour, error) {
+	query := url.Values{
+		"lat":     {strconv.FormatFloat(o.config.Latitude, 'f', -1, 64)},
+		"lon":     {strconv.FormatFloat(o.config.Longitude, 'f', -1, 64)},
+		"appid":   {o.config.APIKey},
+		"units":   {"metric"},
+		"exclude": {"current,minutely,alerts"},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, o.config.URL+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch forecast: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("forecast request failed: %s", resp.Status)
+	}
+
+	var body oneCallResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("failed to decode forecast: %w", err)
+	}
+
+	// Daily entries are keyed by local date
+	zone := time.FixedZone("", int(body.TimezoneOffset))
+	dailyET := make(map[string]float64)
+	for _, d := range body.Daily {
+		day := time.Unix(d.Dt, 0).In(zone)
+		dailyET[day.Format(time.DateOnly)] = HargreavesET0(d.Temp.Min, d.Temp.Max, o.config.Latitude, day.YearDay())
+	}
+
+	hours := make([]Hour, 0, len(body.Hourly))
+	for _, h := range body.Hourly {
+		t := time.Unix(h.Dt, 0)
+		hours = append(hours, Hour{
+			Time:   t.UTC(),
+			RainMM: h.Rain.OneHour,
+			ETMM:   dailyET[t.In(zone).Format(time.DateOnly)] / 24,
+		})
+	}
+	return hours, nil
+}
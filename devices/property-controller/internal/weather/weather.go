@@ -0,0 +1,49 @@
+// Package weather fetches rainfall and evapotranspiration forecasts used to
+// adjust irrigation schedules.
+package weather
+
+import (
+	"context"
+	"math"
+	"time"
+)
+
+// Hour is the weather for one hour, observed or forecast
+type Hour struct {
+	Time   time.Time // Start of the hour
+	RainMM float64   // Rainfall
+	ETMM   float64   // Reference evapotranspiration (ET0)
+}
+
+// Provider fetches hourly weather around the present
+type Provider interface {
+	Fetch(ctx context.Context) ([]Hour, error)
+}
+
+// HargreavesET0 estimates daily reference evapotranspiration in mm from the
+// day's temperature range in °C, the latitude in degrees, and the day of the
+// year, using the Hargreaves-Samani equation (FAO-56 eq. 52)
+func HargreavesET0(tMin, tMax, latitude float64, yday int) float64 {
+	if tMax < tMin {
+		tMin, tMax = tMax, tMin
+	}
+	ra := extraterrestrialRadiation(latitude, yday)
+	et := 0.0023 * 0.408 * ra * ((tMin+tMax)/2 + 17.8) * math.Sqrt(tMax-tMin)
+	return math.Max(et, 0)
+}
+
+// extraterrestrialRadiation returns daily radiation at the top of the
+// atmosphere in MJ/m² (FAO-56 eq. 21)
+func extraterrestrialRadiation(latitude float64, yday int) float64 {
+	const solarConstant = 0.0820 // MJ/m²/min
+
+	phi := latitude * math.Pi / 180
+	angle := 2 * math.Pi * float64(yday) / 365
+	dr := 1 + 0.033*math.Cos(angle)
+	delta := 0.409 * math.Sin(angle-1.39)
+	// Clamped for polar day and night
+	ws := math.Acos(math.Max(-1, math.Min(1, -math.Tan(phi)*math.Tan(delta))))
+
+	return 24 * 60 / math.Pi * solarConstant * dr *
+		(ws*math.Sin(phi)*math.Sin(delta) + math.Cos(phi)*math.Cos(delta)*math.Sin(ws))
+}
@@ -0,0 +1,77 @@
+package weather
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestHargreavesET0 checks ET0 against hand-worked values
+func TestHargreavesET0(t *testing.T) {
+	tests := []struct {
+		name       string
+		tMin, tMax float64
+		latitude   float64
+		yday       int
+		want       float64
+	}{
+		{"mid-latitude summer", 18, 35, 36.5, 190, 7.0},
+		{"mid-latitude winter", 2, 14, 36.5, 15, 1.6},
+		{"swapped temperatures", 35, 18, 36.5, 190, 7.0},
+		{"no temperature range", 20, 20, 36.5, 190, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := HargreavesET0(tt.tMin, tt.tMax, tt.latitude, tt.yday)
+			if math.Abs(got-tt.want) > 0.2 {
+				t.Errorf("HargreavesET0 = %.2f mm, want %.1f mm", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestOpenWeatherFetch tests request parameters and forecast decoding
+func TestOpenWeatherFetch(t *testing.T) {
+	day := time.Date(2026, 7, 9, 0, 0, 0, 0, time.UTC)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("appid") != "key" || q.Get("lat") != "36.5" || q.Get("units") != "metric" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"timezone_offset": 0,
+			"hourly": [{"dt": 1783555200, "rain": {"1h": 1.5}}, {"dt": 1783558800}],
+			"daily": [{"dt": 1783598400, "temp": {"min": 18, "max": 35}}]}`))
+	}))
+	defer srv.Close()
+
+	config := DefaultConfig()
+	config.URL = srv.URL
+	config.APIKey = "key"
+	config.Latitude = 36.5
+	config.Longitude = -120
+
+	hours, err := NewOpenWeather(config).Fetch(context.Background())
+	if err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+	if len(hours) != 2 {
+		t.Fatalf("got %d hours, want 2", len(hours))
+	}
+	if !hours[0].Time.Equal(day) || hours[0].RainMM != 1.5 || hours[1].RainMM != 0 {
+		t.Errorf("unexpected hours: %+v", hours)
+	}
+	wantET := HargreavesET0(18, 35, 36.5, day.YearDay()) / 24
+	if math.Abs(hours[1].ETMM-wantET) > 1e-9 {
+		t.Errorf("ET = %f mm/h, want %f", hours[1].ETMM, wantET)
+	}
+
+	config.APIKey = "wrong"
+	if _, err := NewOpenWeather(config).Fetch(context.Background()); err == nil {
+		t.Error("expected an error for a rejected request")
+	}
+}